@@ -45,13 +45,131 @@ $.physicals.Neil = {};
 
 $.system = {};
 $.system.log = new 'CC.log';
+$.system.logWrite = new 'CC.logWrite';
+$.system.logChannel = new 'CC.logChannel';
+$.system.adminLog = new 'CC.adminLog';
 $.system.checkpoint = new 'CC.checkpoint';
 $.system.shutdown = new 'CC.shutdown';
+$.system.checkpoints = new 'CC.checkpoints';
+$.system.hrtime = new 'CC.hrtime';
+$.system.restoreCheckpoint = new 'CC.restoreCheckpoint';
+$.system.isReplica = new 'CC.isReplica';
+$.system.stats = new 'CC.stats';
+$.system.exportPackage = new 'CC.exportPackage';
+$.system.importPackage = new 'CC.importPackage';
+$.system.exportOwned = new 'CC.exportOwned';
+$.system.importOwned = new 'CC.importOwned';
 $.system.connectionListen = new 'CC.connectionListen';
 $.system.connectionUnlisten = new 'CC.connectionUnlisten';
+$.system.connectionOpen = new 'CC.connectionOpen';
 $.system.connectionWrite = new 'CC.connectionWrite';
+$.system.connectionWriteBinary = new 'CC.connectionWriteBinary';
 $.system.connectionClose = new 'CC.connectionClose';
+$.system.connectionSetIdle = new 'CC.connectionSetIdle';
+$.system.connectionSetEcho = new 'CC.connectionSetEcho';
+$.system.connectionAttach = new 'CC.connectionAttach';
+$.system.connectionDetach = new 'CC.connectionDetach';
+$.system.connectionPlayer = new 'CC.connectionPlayer';
+$.system.connectionIdentity = new 'CC.connectionIdentity';
+$.system.playerConnections = new 'CC.playerConnections';
+$.system.httpWriteHead = new 'CC.httpWriteHead';
 $.system.xhr = new 'CC.xhr';
+$.system.fetch = new 'CC.fetch';
+$.system.mailSend = new 'CC.mailSend';
+$.system.rateLimit = new 'CC.rateLimit';
+$.system.rateLimitCheck = new 'CC.rateLimitCheck';
+$.system.rateLimitReset = new 'CC.rateLimitReset';
+$.system.ban = new 'CC.ban';
+$.system.unban = new 'CC.unban';
+$.system.bans = new 'CC.bans';
+$.system.accountCreate = new 'CC.accountCreate';
+$.system.accountVerify = new 'CC.accountVerify';
+$.system.accountSetPassword = new 'CC.accountSetPassword';
+$.system.accountRequireReset = new 'CC.accountRequireReset';
+$.system.accountReset = new 'CC.accountReset';
+$.system.accountDelete = new 'CC.accountDelete';
+$.system.accountInfo = new 'CC.accountInfo';
+$.system.accountTotpEnroll = new 'CC.accountTotpEnroll';
+$.system.accountTotpConfirm = new 'CC.accountTotpConfirm';
+$.system.accountTotpDisable = new 'CC.accountTotpDisable';
+$.system.accountVerifyCode = new 'CC.accountVerifyCode';
+$.system.accountRecoveryCodes = new 'CC.accountRecoveryCodes';
+$.system.guestCreate = new 'CC.guestCreate';
+$.system.guestRelease = new 'CC.guestRelease';
+$.system.isGuest = new 'CC.isGuest';
+$.system.federationPeers = new 'CC.federationPeers';
+$.system.federationTeleport = new 'CC.federationTeleport';
+$.system.blobPut = new 'CC.blobPut';
+$.system.blobGet = new 'CC.blobGet';
+$.system.blobDelete = new 'CC.blobDelete';
+$.system.compress = new 'CC.compress';
+$.system.decompress = new 'CC.decompress';
+$.system.htmlEscape = new 'CC.htmlEscape';
+$.system.htmlSanitize = new 'CC.htmlSanitize';
+$.system.markdown = new 'CC.markdown';
+$.system.csvParse = new 'CC.csvParse';
+$.system.csvStringify = new 'CC.csvStringify';
+$.system.xmlTokenize = new 'CC.xmlTokenize';
+$.system.inspect = new 'CC.inspect';
+$.system.commandParse = new 'CC.commandParse';
+$.system.commandMatch = new 'CC.commandMatch';
+$.system.commandResolve = new 'CC.commandResolve';
+$.system.commandFindVerb = new 'CC.commandFindVerb';
+$.system.editRequest = new 'CC.editRequest';
+$.system.editReply = new 'CC.editReply';
+$.system.editLine = new 'CC.editLine';
+$.system.require = new 'CC.require';
+$.system.moduleReload = new 'CC.moduleReload';
+$.system.modules = new 'CC.modules';
+$.system.moduleLibraries = new 'CC.moduleLibraries';
+$.system.moduleSetLibraries = new 'CC.moduleSetLibraries';
+$.system.packages = new 'CC.packages';
+$.system.packageVersions = new 'CC.packageVersions';
+$.system.packageInstall = new 'CC.packageInstall';
+$.system.packageUpdate = new 'CC.packageUpdate';
+$.system.packageUninstall = new 'CC.packageUninstall';
+$.system.tier = new 'CC.tier';
+$.system.tiers = new 'CC.tiers';
+$.system.tierSet = new 'CC.tierSet';
+$.system.tierDefault = new 'CC.tierDefault';
+$.system.tierSetDefault = new 'CC.tierSetDefault';
+$.system.destroy = new 'CC.destroy';
+$.system.isDestroyed = new 'CC.isDestroyed';
+$.system.restore = new 'CC.restore';
+$.system.recycleBin = new 'CC.recycleBin';
+$.system.recycleBinEmpty = new 'CC.recycleBinEmpty';
+$.system.sandboxCreate = new 'CC.sandboxCreate';
+$.system.sandboxEval = new 'CC.sandboxEval';
+$.system.sizeLimits = new 'CC.sizeLimits';
+$.system.sizeLimitsSet = new 'CC.sizeLimitsSet';
+$.system.securityEvents = new 'CC.securityEvents';
+$.system.taint = new 'CC.taint';
+$.system.untaint = new 'CC.untaint';
+$.system.isTainted = new 'CC.isTainted';
+$.system.crypto = {};
+$.system.crypto.hash = new 'CC.crypto.hash';
+$.system.crypto.hmac = new 'CC.crypto.hmac';
+$.system.crypto.pbkdf2 = new 'CC.crypto.pbkdf2';
+$.system.crypto.scrypt = new 'CC.crypto.scrypt';
+$.system.crypto.equal = new 'CC.crypto.equal';
+$.system.crypto.randomBytes = new 'CC.crypto.randomBytes';
+$.system.crypto.randomInt = new 'CC.crypto.randomInt';
+$.system.crypto.token = new 'CC.crypto.token';
+$.system.crypto.uuid = new 'CC.crypto.uuid';
+$.system.debug = {};
+$.system.debug.setBreakpoint = new 'CC.debugSetBreakpoint';
+$.system.debug.clearBreakpoint = new 'CC.debugClearBreakpoint';
+$.system.debug.breakpoints = new 'CC.debugBreakpoints';
+$.system.debug.setWatchpoint = new 'CC.debugSetWatchpoint';
+$.system.debug.clearWatchpoint = new 'CC.debugClearWatchpoint';
+$.system.debug.watchpoints = new 'CC.debugWatchpoints';
+$.system.debug.pause = new 'CC.debugPause';
+$.system.debug.resume = new 'CC.debugResume';
+$.system.debug.frames = new 'CC.debugFrames';
+$.system.debug.setHandler = new 'CC.debugSetHandler';
+$.system.debug.startCoverage = new 'CC.debugStartCoverage';
+$.system.debug.stopCoverage = new 'CC.debugStopCoverage';
+$.system.debug.coverage = new 'CC.debugCoverage';
 $.system.onStartup = function onStartup() {
   /* Do things needed at database start, when starting from a .js dump
    * rather than from a .city snapshot (which preserves threads,
@@ -61,6 +179,9 @@ $.system.onStartup = function onStartup() {
   try {$.system.connectionListen(7776, $.servers.login.connection, 100);} catch(e) {}
   try {$.system.connectionListen(7777, $.servers.telnet.connection, 100);} catch(e) {}
   try {$.system.connectionListen(7780, $.servers.http.connection, 100);} catch(e) {}
+  try {$.system.connectionListen(7784, $.servers.telnet.connection, 100, {protocol: 'websocket', resume: 60 * 1000, compress: true, features: ['editor']});} catch(e) {}
+  try {$.system.connectionListen(7785, $.http.router, 100, {protocol: 'http'});} catch(e) {}
+  try {$.system.connectionListen(7786, $.mail.inbound, 100, {protocol: 'smtp'});} catch(e) {}
   try {$.system.connectionListen(9999, $.servers.eval.connection);} catch(e) {}
   $.system.log('Startup: listeners started.');
 
@@ -74,9 +195,37 @@ $.system.onStartup = function onStartup() {
   // preserved in the dump as it is a WeakMap.
   $.Selector.db.populate();
   $.system.log('Startup: Selector reverse-lookup DB rebuilt.');
+
+  // Designate the libraries in which modules are found (see
+  // $.system.require), which are not preserved in the dump.
+  $.system.moduleSetLibraries([$.lib]);
+  $.system.log('Startup: module libraries set.');
 };
 Object.setOwnerOf($.system.onStartup, $.physicals.Neil);
 Object.setOwnerOf($.system.onStartup.prototype, $.physicals.Maximilian);
+$.system.onShutdown = function onShutdown(deadline) {
+  /* Called by the server when it is about to shut down (after it has
+   * stopped accepting connections, but before it saves its final
+   * checkpoint), as root.  The server waits for this to return (and
+   * for any threads it starts to finish) until deadline (in ms since
+   * the epoch), then shuts down regardless.
+   */
+  var seconds = Math.round((deadline - Date.now()) / 1000);
+  $.system.log('Shutdown: notifying connected users.');
+  var users = $.userDatabase.byMd5;
+  for (var key in users) {
+    var user = users[key];
+    if (!user.connection) continue;
+    try {
+      user.narrate('The server is shutting down in ' + seconds +
+          ' seconds.  Please save your work.');
+    } catch (e) {
+      // Never mind.
+    }
+  }
+};
+Object.setOwnerOf($.system.onShutdown, $.physicals.Maximilian);
+Object.setOwnerOf($.system.onShutdown.prototype, $.physicals.Maximilian);
 
 var user = function user() {
   /* The global user() is intended to be used to find the current
@@ -101,3 +250,5 @@ $.utils.validate = {};
 
 $.servers = {};
 
+$.lib = {};
+
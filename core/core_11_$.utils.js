@@ -269,6 +269,19 @@ $.utils.string.VOWELS = 'aeiouy';
 $.utils.string.CONSONANTS = 'bcdfghjklmnpqrstvwxz';
 $.utils.string.ALPHABET = 'abcdefghijklmnopqrstuvwxyz';
 $.utils.string.hash = new 'CC.hash';
+$.utils.string.graphemes = new 'CC.textGraphemes';
+$.utils.string.words = new 'CC.textWords';
+$.utils.string.width = new 'CC.textWidth';
+$.utils.string.pad = new 'CC.textPad';
+$.utils.string.truncate = new 'CC.textTruncate';
+$.utils.string.wrap = new 'CC.textWrap';
+$.utils.string.table = new 'CC.textTable';
+$.utils.string.columns = new 'CC.textColumns';
+$.utils.string.color = new 'CC.textColor';
+$.utils.string.stripAnsi = new 'CC.textStripAnsi';
+$.utils.string.supportsColor = new 'CC.textSupportsColor';
+$.utils.string.substitute = new 'CC.substitute';
+$.utils.string.pronouns = new 'CC.pronouns';
 $.utils.string.translate = function translate(text, language) {
   /* Try to translate text into the specified language using an
    * external translation server.
@@ -403,6 +403,7 @@ $.utils.code.getGlobal = function getGlobal() {
 Object.setOwnerOf($.utils.code.getGlobal, $.physicals.Maximilian);
 $.utils.code.parse = new 'CC.acorn.parse';
 $.utils.code.parseExpressionAt = new 'CC.acorn.parseExpressionAt';
+$.utils.code.lint = new 'CC.lint';
 $.utils.code.isIdentifierName = function isIdentifierName(id) {
   /* Arguments:
    * - id: any - any JavaScript value.
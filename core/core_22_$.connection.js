@@ -24,11 +24,15 @@
 //////////////////////////////////////////////////////////////////////
 
 $.connection = {};
-$.connection.onConnect = function onConnect() {
+$.connection.onConnect = function onConnect(client) {
   this.connectTime = Date.now();
   this.user = null;
   this.buffer = '';
   this.connected = true;
+  // WebSocket clients pass a description of the protocol negotiated:
+  // {version: number, features: !Array<string>, compress: boolean}.
+  this.client = (client && typeof client.version === 'number') ?
+      client : null;
 };
 Object.setOwnerOf($.connection.onConnect, $.physicals.Maximilian);
 Object.setOwnerOf($.connection.onConnect.prototype, $.physicals.Maximilian);
@@ -46,16 +50,151 @@ $.connection.onReceiveLine = function onReceiveLine(text) {
   // Override this on child classes.
 };
 Object.setOwnerOf($.connection.onReceiveLine, $.physicals.Maximilian);
+$.connection.onReceiveBinary = function onReceiveBinary(data) {
+  // Called with each binary message received (as a string of
+  // characters U+0000 to U+00FF, one per byte) from a client that has
+  // agreed to the 'binary' feature.  Override this on child classes.
+};
+Object.setOwnerOf($.connection.onReceiveBinary, $.physicals.Maximilian);
+$.connection.onRateLimit = function onRateLimit(policy, wait) {
+  // Called when input is being ignored for the next wait ms, because
+  // it is arriving faster than the named rate limit policy allows
+  // (see $.system.rateLimit).  Override this on child classes.
+};
+Object.setOwnerOf($.connection.onRateLimit, $.physicals.Maximilian);
+$.connection.onIdle = function onIdle(remaining) {
+  // Called when nothing has been received from the client for a while:
+  // unless something is within the next remaining ms, the connection
+  // will be closed (see the idle listener option, and .setIdle).
+  // Override this on child classes.
+};
+Object.setOwnerOf($.connection.onIdle, $.physicals.Maximilian);
+$.connection.onResume = function onResume(client) {
+  // Called when the client has reconnected after its connection was
+  // lost, within the listener's resume grace period; anything written
+  // meanwhile has been sent to it.  The protocol negotiated with the
+  // new connection may differ.  Override this on child classes.
+  if (client) this.client = client;
+};
+Object.setOwnerOf($.connection.onResume, $.physicals.Maximilian);
+$.connection.width = null;
+$.connection.color = false;
+$.connection.onResize = function onResize(width, height) {
+  // Called when a telnet client reports the size of its window.
+  this.width = width || null;
+  this.height = height || null;
+};
+Object.setOwnerOf($.connection.onResize, $.physicals.Maximilian);
+$.connection.onTerminalType = function onTerminalType(type) {
+  // Called when a telnet client reports its terminal type.
+  this.terminalType = type;
+  this.color = $.utils.string.supportsColor(type);
+};
+Object.setOwnerOf($.connection.onTerminalType, $.physicals.Maximilian);
+$.connection.format = function format(text) {
+  // Lay out text for this connection's terminal: wrap it to the width
+  // of the client's window (if known), and remove any colors (see
+  // $.utils.string.color) unless it supports them.
+  text = String(text);
+  if (!this.color) text = $.utils.string.stripAnsi(text);
+  if (this.width) text = $.utils.string.wrap(text, this.width);
+  return text;
+};
+Object.setOwnerOf($.connection.format, $.physicals.Maximilian);
+$.connection.narrate = function narrate(text) {
+  // Write text for the user to read.  Override this on child classes
+  // whose clients expect something else (e.g., memos).
+  this.write(this.format(text) + '\n');
+};
+Object.setOwnerOf($.connection.narrate, $.physicals.Maximilian);
+$.connection.editing = null;
+$.connection.editCount = 0;
+$.connection.edit = function edit(title, text, onDone, syntax) {
+  // Let the user edit text (e.g., the source of a function, or a
+  // description), then call onDone with the result, or with null if
+  // they abandon it.  A client that has agreed to the 'editor' feature
+  // is sent the text to edit in an editor of its own, highlighted as
+  // syntax ('text' (default), 'javascript', 'html', 'css' or 'json');
+  // any other client edits it a line at a time.  Editing anything
+  // else meanwhile abandons the earlier edit.
+  if (this.editing) this.finishEdit(null);
+  var id = String(++this.editCount);
+  text = String(text);
+  if (this.hasFeature('editor')) {
+    var request = $.system.editRequest(id, String(title), text, syntax);
+    this.editing = {id: id, title: title, onDone: onDone};
+    this.write(request + '\n');
+    return;
+  }
+  var lines = text ? text.split('\n') : [];
+  this.editing = {id: id, title: title, onDone: onDone, lines: lines,
+                  point: lines.length};
+  this.narrate('Editing ' + title + ' (' + lines.length +
+      (lines.length === 1 ? ' line' : ' lines') + ').  Type .h for ' +
+      'help, . to save or .q to stop without saving.');
+};
+Object.setOwnerOf($.connection.edit, $.physicals.Maximilian);
+$.connection.receiveEdit = function receiveEdit(line) {
+  // Handle a line of input received while editing (see .edit).
+  // Returns true if it was part of the edit, or false if it should be
+  // handled as usual (e.g., as a command).
+  var editing = this.editing;
+  if (!editing) return false;
+  if (!editing.lines) {  // Being edited by the client.
+    var reply = $.system.editReply(line);
+    if (!reply || reply.id !== editing.id) return false;
+    this.finishEdit(reply.text);
+    return true;
+  }
+  var result = $.system.editLine(editing, line);
+  editing.lines = result.lines;
+  editing.point = result.point;
+  if (result.output) this.narrate(result.output);
+  if (result.done) {
+    this.finishEdit(result.done === 'save' ? result.lines.join('\n') : null);
+  }
+  return true;
+};
+Object.setOwnerOf($.connection.receiveEdit, $.physicals.Maximilian);
+$.connection.finishEdit = function finishEdit(text) {
+  // Stop editing (see .edit), calling its onDone with text (or with
+  // null, if abandoned).
+  var editing = this.editing;
+  if (!editing) return;
+  this.editing = null;
+  if (typeof editing.onDone === 'function') editing.onDone(text);
+};
+Object.setOwnerOf($.connection.finishEdit, $.physicals.Maximilian);
 $.connection.onEnd = function onEnd() {
   this.connected = false;
   this.disconnectTime = Date.now();
   this.close();
 };
 Object.setOwnerOf($.connection.onEnd, $.physicals.Maximilian);
+$.connection.hasFeature = function hasFeature(name) {
+  // Has the client agreed to use the named optional feature of the
+  // client protocol (e.g., 'editor')?
+  return Boolean(this.client) && this.client.features.indexOf(name) !== -1;
+};
+Object.setOwnerOf($.connection.hasFeature, $.physicals.Maximilian);
 $.connection.write = function write(text) {
   $.system.connectionWrite(this, text);
 };
 Object.setOwnerOf($.connection.write, $.physicals.Maximilian);
+$.connection.writeBinary = function writeBinary(data) {
+  // Send a binary message (a Buffer, or a string of characters U+0000
+  // to U+00FF, one per byte) to a client that has agreed to the
+  // 'binary' feature.
+  $.system.connectionWriteBinary(this, data);
+};
+Object.setOwnerOf($.connection.writeBinary, $.physicals.Maximilian);
+$.connection.setIdle = function setIdle(idle, warning) {
+  // Change how long (in ms; 0 for no limit) the client may be idle
+  // before being disconnected, and how long before then to call
+  // .onIdle (default: one minute, or half of idle if less).
+  $.system.connectionSetIdle(this, idle, warning);
+};
+Object.setOwnerOf($.connection.setIdle, $.physicals.Maximilian);
 $.connection.close = function close() {
   $.system.connectionClose(this);
 };
@@ -69,4 +208,10 @@ $.connection.onError = function onError(error) {
   }
 };
 Object.setOwnerOf($.connection.onError, $.physicals.Maximilian);
+$.connection.onReattach = function onReattach(error) {
+  // The server was restarted from a checkpoint, so this connection no
+  // longer exists.  Tidy up as if the other end had closed it.
+  this.onEnd();
+};
+Object.setOwnerOf($.connection.onReattach, $.physicals.Maximilian);
 
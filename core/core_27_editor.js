@@ -117,6 +117,8 @@ $.hosts.code['/editorXhr'].www = function code_editorXhr_www(request, response)
    * - butter: short status message to be displayed to user
    * - saved: boolean indicating if a save was successful,
    *   only present if save was requested
+   * - warnings: array of {rule, message, line, col} lint warnings
+   *   about the saved source, only present if save was requested
    * - login: boolean indicating if the user is logged in
    */
   var data = {login: !!request.user};
@@ -215,8 +217,8 @@ Object.setOwnerOf($.hosts.code['/editorXhr'].load, $.physicals.Maximilian);
 $.hosts.code['/editorXhr'].save = function $_www_code_editor_save(src, binding, data, user) {
   // Save changes by evalling src, doing post-processing as directed
   // by metadata, and then calling binding.set(/* new value */).
-  // Sets data.saved and data.butter as appropriate to give feedback
-  // to user.
+  // Sets data.saved, data.butter and data.warnings as appropriate to
+  // give feedback to user.
   if (!user) {
     data.butter = 'User not logged in.';
     return;
@@ -234,6 +236,12 @@ $.hosts.code['/editorXhr'].save = function $_www_code_editor_save(src, binding,
     data.butter = String(e);
     return;
   }
+  // Warn about likely mistakes, without preventing the save.
+  try {
+    data.warnings = $.utils.code.lint(expr);
+  } catch (e) {
+    data.warnings = [];
+  }
   var oldValue = binding.get(/*inherited:*/false);  // Get actual current value.
   try {
     this.handleMetaData(src, oldValue, saveValue);
@@ -30,6 +30,7 @@ $.servers.eval.connection.onReceiveLine = function onReceiveLine(text) {
     this.close();
     return;
   }
+  $.system.adminLog('eval', {via: 'eval server', src: text});
   this.write('⇒ ' + $.utils.code.eval(text) + '\n');
   this.write('eval> ');
 };
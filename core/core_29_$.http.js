@@ -0,0 +1,98 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview HTTP request router for Code City.
+ */
+
+//////////////////////////////////////////////////////////////////////
+// AUTO-GENERATED CODE FROM DUMP.  EDIT WITH CAUTION!
+//////////////////////////////////////////////////////////////////////
+
+$.http = {};
+$.http.router = {};
+$.http.router.README = "$.http.router is the prototype for the responses of an 'http' listener (see $.system.connectionListen): the server parses each request and calls .onRequest(request) on a new response object, where request has .method, .url, .path, .query, .headers, .cookies, .body and .remoteAddress.\n\nRoutes are added with .addRoute(method, path, handler), where method is e.g. 'GET' (or undefined for any method) and path is a string (matching exactly, or as a prefix if it ends with '*') or a RegExp tested against request.path.  The handler of the first matching route is called with (request, response), and must eventually call response.end().  response.writeHead(status, headers) may be called before the first response.write(text); otherwise the status is 200.";
+$.http.router.routes = [];
+$.http.router.addRoute = function addRoute(method, path, handler) {
+  if (typeof handler !== 'function') {
+    throw new TypeError('handler must be a function');
+  }
+  this.routes.push({method: method, path: path, handler: handler});
+};
+Object.setOwnerOf($.http.router.addRoute, $.physicals.Maximilian);
+Object.setOwnerOf($.http.router.addRoute.prototype, $.physicals.Maximilian);
+$.http.router.match = function match(route, request) {
+  if (route.method !== undefined && route.method !== request.method) {
+    return false;
+  }
+  var path = route.path;
+  if (path instanceof RegExp) {
+    return path.test(request.path);
+  } else if (path.slice(-1) === '*') {
+    return request.path.slice(0, path.length - 1) === path.slice(0, -1);
+  }
+  return request.path === path;
+};
+Object.setOwnerOf($.http.router.match, $.physicals.Maximilian);
+$.http.router.onRequest = function onRequest(request) {
+  this.request = request;
+  for (var i = 0; i < this.routes.length; i++) {
+    var route = this.routes[i];
+    if (!this.match(route, request)) continue;
+    try {
+      route.handler(request, this);
+    } catch (e) {
+      $.system.log('Error handling ' + request.method + ' ' + request.url +
+          ': ' + String(e));
+      this.sendError(500);
+    }
+    return;
+  }
+  this.sendError(404);
+};
+Object.setOwnerOf($.http.router.onRequest, $.physicals.Maximilian);
+$.http.router.writeHead = function writeHead(status, headers) {
+  $.system.httpWriteHead(this, status, headers);
+  this.headersSent = true;
+};
+Object.setOwnerOf($.http.router.writeHead, $.physicals.Maximilian);
+$.http.router.write = function write(text) {
+  $.system.connectionWrite(this, text);
+  this.headersSent = true;
+};
+Object.setOwnerOf($.http.router.write, $.physicals.Maximilian);
+$.http.router.end = function end(text) {
+  if (text !== undefined) this.write(text);
+  $.system.connectionClose(this);
+};
+Object.setOwnerOf($.http.router.end, $.physicals.Maximilian);
+$.http.router.sendError = function sendError(status) {
+  // If the response has already begun, all that can be done is to end it.
+  if (!this.headersSent) {
+    this.writeHead(status, {'Content-Type': 'text/plain; charset=utf-8'});
+    this.write(status + ' ' + ($.servers.http.STATUS_CODES[status] || '') +
+        '\n');
+  }
+  this.end();
+};
+Object.setOwnerOf($.http.router.sendError, $.physicals.Maximilian);
+$.http.router.headersSent = false;
+$.http.router.onReattach = function onReattach(error) {
+  // The server was restarted before the response was complete; the
+  // client has long since gone.
+};
+Object.setOwnerOf($.http.router.onReattach, $.physicals.Maximilian);
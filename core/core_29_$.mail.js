@@ -0,0 +1,64 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Inbound mail dispatcher for Code City.
+ */
+
+//////////////////////////////////////////////////////////////////////
+// AUTO-GENERATED CODE FROM DUMP.  EDIT WITH CAUTION!
+//////////////////////////////////////////////////////////////////////
+
+$.mail = {};
+$.mail.inbound = {};
+$.mail.inbound.README = "$.mail.inbound receives the messages sent to an 'smtp' listener (see $.system.connectionListen): the server calls .onMail(message) for each, where message has .sender and .recipients (the addresses given by the sending server), .from, .subject, .text (the plain text body) and .headers (from the message itself), and .secure (true if it was received over TLS).\n\nEach message is dispatched to the handler registered for the local part of each recipient address (the part before the '@', in lower case, and ignoring any '+tag' suffix), by calling handler.onMail(message, address).  Handlers are registered with .addHandler(localPart, handler) and removed with .removeHandler(localPart).  Mail for unknown recipients is logged and dropped.";
+$.mail.inbound.handlers = (new 'Object.create')(null);
+$.mail.inbound.addHandler = function addHandler(localPart, handler) {
+  if (!handler || typeof handler.onMail !== 'function') {
+    throw new TypeError('handler must have an onMail method');
+  }
+  this.handlers[String(localPart).toLowerCase()] = handler;
+};
+Object.setOwnerOf($.mail.inbound.addHandler, $.physicals.Maximilian);
+Object.setOwnerOf($.mail.inbound.addHandler.prototype, $.physicals.Maximilian);
+$.mail.inbound.removeHandler = function removeHandler(localPart) {
+  delete this.handlers[String(localPart).toLowerCase()];
+};
+Object.setOwnerOf($.mail.inbound.removeHandler, $.physicals.Maximilian);
+$.mail.inbound.localPart = function localPart(address) {
+  var local = String(address).split('@')[0].toLowerCase();
+  var plus = local.indexOf('+');
+  return (plus === -1) ? local : local.slice(0, plus);
+};
+Object.setOwnerOf($.mail.inbound.localPart, $.physicals.Maximilian);
+$.mail.inbound.onMail = function onMail(message) {
+  for (var i = 0; i < message.recipients.length; i++) {
+    var address = message.recipients[i];
+    var handler = this.handlers[this.localPart(address)];
+    if (!handler) {
+      $.system.log('Mail from ' + message.sender + ' to unknown recipient ' +
+          address + ' dropped.');
+      continue;
+    }
+    try {
+      handler.onMail(message, address);
+    } catch (e) {
+      $.system.log('Error delivering mail to ' + address + ': ' + String(e));
+    }
+  }
+};
+Object.setOwnerOf($.mail.inbound.onMail, $.physicals.Maximilian);
@@ -105,51 +105,23 @@ $.utils.command.parse = function parse(cmdstr, user) {
   // The cmdstr, verbstr and argstr properties are "raw" strings,
   // unmodified from the cmdstr parameter, while dobjstr, prepstr and
   // iobjstr are normalised, being substrings of args.join(' ').
+  // Words in double quotes are kept together (and never taken to be
+  // prepositions).
+  //
+  // The string parts are parsed by $.system.commandParse.
 
-  // Spit off verb from the rest.
-  cmdstr = String(cmdstr);
-  var m = cmdstr.match($.utils.command.verbRegExp);
-  if (!m) return null;
-  var verbstr = m[1];
-  var argstr = m[2] || '';
-  // Split argstr into words.
-  // TODO(cpcallen): support quoting.
-  var argstrTrimmed = argstr.trim();
-  var args = argstrTrimmed ? argstrTrimmed.split(/\s+/) : [];
-  // Recombine args and split into dobjstr / prepstr / iobjstr
-  var argsNormalised = args.join(' ');
-  var dobjstr = '';
-  var prepstr = '';
-  var iobjstr = '';
-  m = argsNormalised.match($.utils.command.prepositionsRegExp);
-  if (m) {
-    // Preposition found.
-    dobjstr = (m[1] || '').trim();
-    prepstr = m[2].replace(/ +/g, ' ');
-    iobjstr = (m[3] || '').trim();
-  } else {
-    dobjstr = argsNormalised;
-  }
+  var cmd = $.system.commandParse(String(cmdstr));
+  if (!cmd) return null;
   function match(str) {
     if (str === '') return null;
     if (str === 'me' || str === 'myself') return user;
     if (str === 'here') return user.location;
     return $.utils.command.match(str, user);
   }
-  var dobj = match(dobjstr);
-  var iobj = match(iobjstr);
-  return {
-    user: user,
-    cmdstr: cmdstr,
-    verbstr: verbstr,
-    argstr: argstr,
-    args: args,
-    dobjstr: dobjstr,
-    dobj: dobj,
-    prepstr: prepstr,
-    iobjstr: iobjstr,
-    iobj: iobj
-  };
+  cmd.user = user;
+  cmd.dobj = match(cmd.dobjstr);
+  cmd.iobj = match(cmd.iobjstr);
+  return cmd;
 };
 Object.setOwnerOf($.utils.command.parse, $.physicals.Maximilian);
 $.utils.command.execute = function execute(cmdstr, user) {
@@ -159,36 +131,13 @@ $.utils.command.execute = function execute(cmdstr, user) {
    */
   var cmd = $.utils.command.parse(cmdstr, user);
   if (!cmd) return false;
-  // Collect all objects which could host the verb.
+  // Check every verb on all objects which could host it for a match.
   var hosts = [user, user.location, cmd.dobj, cmd.iobj];
-  for (var i = 0; i < hosts.length; i++) {
-    var host = hosts[i];
-    if (!host) {
-      continue;
-    }
-    // Check every verb on each object for a match.
-    for (var prop in host) {
-      var func = host[prop];
-      if (typeof func !== 'function') continue;  // Not a function.
-      var verbSpec = func.verb;
-      var dobjSpec = func.dobj;
-      var prepSpec = func.prep;
-      var iobjSpec = func.iobj;  // I can't wait for ES6.
-      if (!verbSpec || !dobjSpec || !prepSpec || !iobjSpec) continue;  // Not a verb.
-      var verbRegExp = new RegExp('^(?:' + verbSpec + ')$');
-      if (verbRegExp.test(cmd.verbstr) &&
-          (prepSpec === 'any' ||
-           $.utils.command.prepositions[cmd.prepstr] === prepSpec ||
-           (prepSpec == 'none' && !cmd.prepstr)) &&
-          (dobjSpec === 'any' || (dobjSpec === 'this' && cmd.dobj === host) ||
-           (dobjSpec === 'none' && !cmd.dobj)) &&
-          (iobjSpec === 'any' || (iobjSpec === 'this' && cmd.iobj === host) ||
-           (iobjSpec === 'none' && !cmd.iobj))) {
-        // TODO: security check/perms.
-        host[prop](cmd);
-        return true;
-      }
-    }
+  var verb = $.system.commandFindVerb(cmd, hosts);
+  if (verb) {
+    // TODO: security check/perms.
+    verb.host[verb.key](cmd);
+    return true;
   }
   cmd.user.narrate('I don\'t understand that.');
   return false;
@@ -200,17 +149,42 @@ $.utils.command.match = function match(str, context) {
    * context.location, and context.contents.
    *
    * Args:
-   * - str: string: prefix of name or alias of desired object.
+   * - str: string: prefix of name or alias of desired object,
+   *     optionally preceded by an ordinal (e.g. "second lamp").
    * - context: $.physical: an object to search.
    *
    * Returns: an object matching str, or $.FAILED_MATCH if none or
    * $.AMBIGUOUS_MATCH if more than one.
    */
+  var r = $.utils.command.resolve(str, context);
+  if (r.match) return r.match;
+  return r.ambiguous ? $.AMBIGUOUS_MATCH : $.FAILED_MATCH;
+};
+Object.setOwnerOf($.utils.command.match, $.physicals.Maximilian);
+$.utils.command.resolve = function resolve(str, context) {
+  /* Find the objects matching str amongst context, context.location,
+   * and context.contents, as for $.utils.command.match, but reporting
+   * all the candidates if it is ambiguous.
+   *
+   * Args:
+   * - str: string: prefix of name or alias of desired object,
+   *     optionally preceded by an ordinal (e.g. "second lamp").
+   * - context: $.physical: an object to search.
+   *
+   * Returns: an object with properties (see $.system.commandResolve):
+   * - match: the object matching str, or null if none or ambiguous.
+   * - matches: array of the objects str matches (ignoring any ordinal).
+   * - ambiguous: true iff str matches more than one object, and no
+   *     ordinal chooses between them.
+   * - ordinal: the ordinal given, or null if none.
+   */
   str = str.trim();
   // First, check for matches against universally accessible things.
   try {
     var v = $(str);
-    if ($.utils.isObject(v)) return v;
+    if ($.utils.isObject(v)) {
+      return {match: v, matches: [v], ambiguous: false, ordinal: null};
+    }
   } catch (e) {
     // Ignore failed Selector parse/lookup.
   }
@@ -218,17 +192,9 @@ $.utils.command.match = function match(str, context) {
   if (context.location) {
     objects = objects.concat([context.location], context.location.getContents());
   }
-  var m = $.utils.command.matchObjects(str, objects);
-  switch (m.length) {
-    case 0:
-      return $.FAILED_MATCH;
-    case 1:
-      return m[0];
-    default:
-      return $.AMBIGUOUS_MATCH;
-  }
+  return $.system.commandResolve(str, objects);
 };
-Object.setOwnerOf($.utils.command.match, $.physicals.Maximilian);
+Object.setOwnerOf($.utils.command.resolve, $.physicals.Maximilian);
 $.utils.command.matchFailed = function matchFailed(obj, objstr, user) {
   /* Return true iff obj is NOT a valid match, and optionally narrate
    * a suitable error message if not.
@@ -254,7 +220,10 @@ $.utils.command.matchFailed = function matchFailed(obj, objstr, user) {
     if (send) user.narrate('I see no "' + objstr + '" here.');
     return true;
   } else if (obj === $.AMBIGUOUS_MATCH) {
-    if (send) user.narrate('I don\'t know which "' + objstr + '" you mean.');
+    if (send) {
+      user.narrate('I don\'t know which "' + objstr + '" you mean.  ' +
+          '(Try, e.g., "second ' + objstr + '".)');
+    }
     return true;
   } else if ($.physical.isPrototypeOf(obj)) {
     return false;
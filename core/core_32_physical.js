@@ -456,6 +456,25 @@ $.physical.describe.verb = 'describe';
 $.physical.describe.dobj = 'this';
 $.physical.describe.prep = 'as';
 $.physical.describe.iobj = 'any';
+$.physical.editDescription = function editDescription(cmd) {
+  /* Edit this object's description (see $.connection.edit), for
+   * descriptions too long to give on one line with "describe ... as".
+   */
+  if (!cmd.user.connection) return;
+  var thing = this;
+  cmd.user.connection.edit('the description of ' + String(this),
+      this.description, function(text) {
+        if (text === null) return;
+        thing.description = text;
+        cmd.user.narrate($.utils.string.capitalize(String(thing)) +
+            '\'s description set.');
+      });
+};
+Object.setOwnerOf($.physical.editDescription, $.physicals.Maximilian);
+$.physical.editDescription.verb = 'describe';
+$.physical.editDescription.dobj = 'this';
+$.physical.editDescription.prep = 'none';
+$.physical.editDescription.iobj = 'none';
 $.physical.examine = function $_physical_examine(cmd) {
   var html = $.jssp.eval(this, 'examineJssp', {user: cmd.user});
   cmd.user.readMemo({type: "html", htmlText: html});
@@ -31,6 +31,7 @@ $.user.eval = function $_user_eval(cmd) {
   // Format:  ;1+1    -or-    eval 1+1
   var src = (cmd.cmdstr[0] === ';') ? cmd.cmdstr.substring(1) : cmd.argstr;
   src = $.utils.code.rewriteForEval(src, /* forceExpression= */ false);
+  $.system.adminLog('eval', {user: this.name, src: src});
   // Do eval with this === this and vars me === this and here === this.location.
   var evalFunc = $_user_eval.doEval_.bind(this, this, this.location);
   var out = $.utils.code.eval(src, evalFunc);
@@ -290,13 +291,13 @@ $.user.readMemo = function readMemo(memo) {
   if (!this.connection) return;
   memo = $.utils.replacePhysicalsWithName(memo);
   var json = JSON.stringify(memo) + '\n';
-  try {
-    this.connection.write(json);
-  } catch(e) {
-    if (e.message === 'object is not connected') {
-      this.connection = null;
-    } else {
-      throw e;
+  // Send to every connection this user is logged in on.
+  var connections = $.system.playerConnections(this);
+  for (var i = 0; i < connections.length; i++) {
+    try {
+      connections[i].write(json);
+    } catch(e) {
+      // Never mind: it is closing, and will soon be detached.
     }
   }
 };
@@ -364,10 +365,51 @@ $.user.go.verb = 'go';
 $.user.go.dobj = 'none';
 $.user.go.prep = 'at/to';
 $.user.go.iobj = 'any';
+$.user.onAttach = function onAttach(connection, count) {
+  /* Called by the server once a connection has been attached to this
+   * user (see $.servers.telnet.connection.login); count is the number
+   * of connections it now has attached (including this one).
+   */
+  this.connection = connection;
+  // Run as this user.
+  Object.setOwnerOf(Thread.current(), this);
+  setPerms(this);
+  this.onConnect(count > 1);
+};
+Object.setOwnerOf($.user.onAttach, $.physicals.Maximilian);
+$.user.onDetach = function onDetach(connection, remaining, reason) {
+  /* Called by the server once a connection has been detached from this
+   * user: because it closed ('disconnect'), the server was restarted
+   * ('restart'), or it was detached ('detach') or attached to another
+   * user ('attach').  remaining is the number of connections it still
+   * has attached.
+   */
+  if (this.connection === connection) {
+    var connections = $.system.playerConnections(this);
+    this.connection = connections[connections.length - 1] || null;
+  }
+  if (remaining) return;
+  $.system.log('Unbinding connection from ' + this.name);
+  if ($.system.isGuest(this)) {
+    $.servers.telnet.releaseGuest(this);
+  } else {
+    Object.setOwnerOf(Thread.current(), this);
+    setPerms(this);
+    this.onDisconnect();
+  }
+};
+Object.setOwnerOf($.user.onDetach, $.physicals.Maximilian);
+$.user.onIdle = function onIdle(connection, remaining) {
+  /* Called by the server when one of this user's connections has been
+   * idle for a while, and will be closed in remaining ms unless the
+   * user does something (see $.connection.onIdle).
+   */
+};
+Object.setOwnerOf($.user.onIdle, $.physicals.Maximilian);
 $.user.onConnect = function onConnect(reconnect) {
-  /* Called from $.servers.telnet.connection.onReceiveLine once a new
-   * connection is logged in to this user.  Argument will be true if
-   * user was already connected (and this is just a reconnection).
+  /* Called from .onAttach once a new connection is logged in to this
+   * user.  Argument will be true if user was already connected (and
+   * this is just another connection).
    */
   if ($.room.isPrototypeOf(this.location)) {
     this.location.narrate(
@@ -387,8 +429,8 @@ $.user.onConnect = function onConnect(reconnect) {
 Object.setOwnerOf($.user.onConnect, $.physicals.Maximilian);
 Object.setOwnerOf($.user.onConnect.prototype, $.physicals.Maximilian);
 $.user.onDisconnect = function onDisconnect() {
-  /* Called from $.servers.telnet.connection.onEnd once connection
-   * has dropped.
+  /* Called from .onDetach once the user's last connection has been
+   * detached (e.g., because it dropped).
    */
   // Have they made an effort to not look like a guest?
   if (this.hasOwnProperty('description') ||
@@ -409,6 +451,16 @@ $.user.onDisconnect = function onDisconnect() {
 };
 Object.setOwnerOf($.user.onDisconnect, $.physicals.Maximilian);
 Object.setOwnerOf($.user.onDisconnect.prototype, $.physicals.Maximilian);
+$.user.onError = function onError(report) {
+  /* Called by the server when a thread owned by this user dies with an
+   * uncaught exception.  Argument is an object with .error, .stack and
+   * .thread properties.
+   */
+  if (!this.connection || !this.connection.connected) return;
+  var text = 'Uncaught exception in thread ' + report.thread.id + ':\n';
+  text += report.stack || String(report.error);
+  this.narrate(text);
+};
 $.user.description = 'A new user who has not yet set his/her description.';
 $.user.destroy = function destroy() {
   $.physical.destroy.call(this);
@@ -476,6 +528,28 @@ $.user.describe.verb = 'describe';
 $.user.describe.dobj = 'this';
 $.user.describe.prep = 'as';
 $.user.describe.iobj = 'any';
+$.user.pronouns = 'they';
+$.user.setPronouns = function setPronouns(cmd) {
+  /* Set the pronouns used for this user in action messages (see
+   * $.utils.string.substitute): he, she, they, it, or five forms
+   * separated by slashes (e.g. "ze/zir/zir/zirs/zirself").
+   */
+  var pronouns = $.utils.string.pronouns(cmd.argstr);
+  if (!pronouns) {
+    cmd.user.narrate('Usage: pronouns he|she|they|it|' +
+        '<subject>/<object>/<possessive>/<possessive pronoun>/<reflexive>');
+    return;
+  }
+  this.pronouns = cmd.argstr.trim().toLowerCase();
+  cmd.user.narrate('Your pronouns are now ' + pronouns.subject + '/' +
+      pronouns.object + '/' + pronouns.possessive + '/' +
+      pronouns.possessivePronoun + '/' + pronouns.reflexive + '.');
+};
+Object.setOwnerOf($.user.setPronouns, $.physicals.Maximilian);
+$.user.setPronouns.verb = 'pronouns';
+$.user.setPronouns.dobj = 'any';
+$.user.setPronouns.prep = 'any';
+$.user.setPronouns.iobj = 'any';
 $.user.lookJssp = "<table style=\"height: 100%; width: 100%;\">\n  <tr>\n    <td style=\"padding: 1ex; width: 30%;\">\n      <svg width=\"100%\" height=\"100%\" viewBox=\"0 0 0 0\">\n        <%= $.utils.object.getValue(this, 'svgText') %>\n      </svg>\n    </td>\n    <td>\n    <h1><%: this %><%= $.utils.commandMenu(this.getCommands(request.user)) %></h1>\n    <p><%= $.utils.html.preserveWhitespace($.utils.object.getValue(this, 'description')) %><br>\n      <%: String(this) + (this.connection && this.connection.connected ? ' is awake.' : ' is sleeping.') %></p>\n<%\nvar contents = this.getContents();\nif (contents.length) {\n  var contentsHtml = [];\n  for (var i = 0; i < contents.length; i++) {\n    contentsHtml[i] = $.utils.html.escape(contents[i].name) +\n        $.utils.commandMenu(contents[i].getCommands(request.user));\n  }\n  response.write('<p>Contents: ' + contentsHtml.join(', ') + '</p>');\n}\nif (this.location) {\n  response.write('<p>Location: ' + $.utils.html.escape(this.location.name) +\n      $.utils.commandMenu(this.location.getCommands(request.user)) + '</p>');\n}\n%>\n    </td>\n  </tr>\n</table>";
 
 $.room = (new 'Object.create')($.physical);
@@ -580,6 +654,31 @@ $.room.narrate = function narrate(text, except, obj) {
   }
 };
 Object.setOwnerOf($.room.narrate, $.physicals.Maximilian);
+$.room.announce = function announce(template, roles, except) {
+  /* Send an action message to the contents of the room, rendered for
+   * each of them by $.utils.string.substitute (so that, e.g., the
+   * actor sees "You pick up the key." while others see "Alice picks
+   * up the key.").
+   *
+   * template is the message, e.g. '%N %[picks|pick] up %t.'
+   *
+   * roles is an object whose actor, dobj, iobj, this and location
+   *       properties are the objects the message refers to.
+   *
+   * except is an individual $.physical object, or an array of such,
+   *        which should not receive the message.
+   */
+  var contents = this.getContents();
+  for (var i = 0; i < contents.length; i++) {
+    var thing = contents[i];
+    if (thing !== except &&
+        !(except && except.includes && except.includes(thing)) &&
+        thing.narrate) {
+      thing.narrate($.utils.string.substitute(template, roles, thing));
+    }
+  }
+};
+Object.setOwnerOf($.room.announce, $.physicals.Maximilian);
 $.room.willAccept = function willAccept(what, src) {
   /* Returns true iff this is willing to accept what arriving from src.
    *
@@ -681,9 +780,11 @@ $.thing.get = function get(cmd) {
   } catch (e) {
     throw (e instanceof Error) ? e.message : e;
   }
-  cmd.user.narrate('You pick up ' + this.name + '.');
+  var roles = {actor: cmd.user, this: this};
   if (cmd.user.location) {
-    cmd.user.location.narrate(cmd.user.name + ' picks up ' + this.name + '.', cmd.user);
+    cmd.user.location.announce('%N %[picks|pick] up %t.', roles);
+  } else {
+    cmd.user.narrate($.utils.string.substitute('%N %[picks|pick] up %t.', roles, cmd.user));
   }
 };
 Object.setOwnerOf($.thing.get, $.physicals.Maximilian);
@@ -701,9 +802,11 @@ $.thing.drop = function drop(cmd) {
   } catch (e) {
     throw (e instanceof Error) ? e.message : e;
   }
-  cmd.user.narrate('You drop ' + this.name + '.');
+  var roles = {actor: cmd.user, this: this};
   if (cmd.user.location) {
-    cmd.user.location.narrate(cmd.user.name + ' drops ' + this.name + '.', cmd.user);
+    cmd.user.location.announce('%N %[drops|drop] %t.', roles);
+  } else {
+    cmd.user.narrate($.utils.string.substitute('%N %[drops|drop] %t.', roles, cmd.user));
   }
 };
 Object.setOwnerOf($.thing.drop, $.physicals.Maximilian);
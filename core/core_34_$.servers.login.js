@@ -47,13 +47,21 @@ $.servers.login.getCookie = function getCookie(loginData) {
   /* Get the ID cookie for the given loginData.
    *
    * Arguments:
-   * - loginData: !Object - the loginData object from loginServer.
+   * - loginData: !Object - the loginData object from loginServer.  If
+   *     it has a .link property (the ID cookie of the account the user
+   *     is logged in to), the identity is linked to that account
+   *     rather than logged in to.
    * Returns: string - the ID cookie to set.  Empty string denotes
    *     invalid login.
    */
   var id = loginData.id;
   if (typeof(id) !== 'string') {
     return '';
+  } else if (loginData.link !== undefined) {  // Link to existing user.
+    var user = $.userDatabase.get(loginData.link);
+    if (!user) return '';
+    this.linkIdentity(user, id, loginData.provider);
+    return loginData.link;
   } else if ($.userDatabase.get(id)) {  // User already exists.
     return id;
   } else {  // Create new user object.
@@ -93,4 +101,24 @@ $.servers.login.createUser = function createUser(id, name) {
 };
 Object.setOwnerOf($.servers.login.createUser, $.physicals.Maximilian);
 Object.setOwnerOf($.servers.login.createUser.prototype, $.physicals.Maximilian);
+$.servers.login.linkIdentity = function linkIdentity(user, id, provider) {
+  /* Link an additional external identity to an existing user, so that
+   * logging in with it logs in as that user.
+   *
+   * Arguments:
+   * - user: $.user - the user to link the identity to.
+   * - id: string - the identity's ID (as passed by loginServer).
+   * - provider?: string - the name of the identity provider.
+   * Calls user.onIdentityLinked(provider), if it exists, once linked.
+   */
+  var existing = $.userDatabase.get(id);
+  if (existing === user) return;  // Already linked.
+  if (existing) throw new Error('identity belongs to another user');
+  $.userDatabase.set(id, user);
+  if (typeof user.onIdentityLinked === 'function') {
+    user.onIdentityLinked(provider);
+  }
+};
+Object.setOwnerOf($.servers.login.linkIdentity, $.physicals.Maximilian);
+Object.setOwnerOf($.servers.login.linkIdentity.prototype, $.physicals.Maximilian);
 
@@ -27,59 +27,104 @@ $.servers.telnet = {};
 $.servers.telnet.connection = (new 'Object.create')($.connection);
 $.servers.telnet.connection.onReceiveLine = function onReceiveLine(text) {
   if (this.user) {  // Logged in?
+    // Limit commands per account, as well as per address (which the
+    // server does, except for connections via connectServer).
+    var user = this.user;
+    var wait = (function() {
+      setPerms($.root);  // Only root may use rate limits.
+      return $.system.rateLimit('command', user);
+    })();
+    if (wait) {
+      this.onRateLimit('command', wait);
+      return;
+    }
     // Set 'user' for this thread, and permissions for call
     Object.setOwnerOf(Thread.current(), this.user);
     setPerms(this.user);
+    if (this.receiveEdit(text)) return;
     this.user.onInput(text);
     return;
   }
   // Remainder of function handles login.
   // TODO(fraser): Make sure that no security issues exist due to
   // called code suspending or timing out unexpectedly.
-  var m = text.match(/identify as ([0-9a-f]+)/);
+  var m = text.match(/identify as (guest|[0-9a-f]+)/);
   if (!m) {
+    var conn = this;
+    wait = (function() {
+      setPerms($.root);
+      return $.system.rateLimit('login', conn);
+    })();
+    if (wait) {
+      this.onRateLimit('login', wait);
+      this.close();
+      return;
+    }
     this.write('{type: "narrate", text: "Unknown command: ' +
                $.utils.html.preserveWhitespace(text) + '"}');
     return;
   }
-  var id = m[1];
-  var user = $.userDatabase.get(id) || $.servers.login.createUser(id);
-  this.user = user;
-  var rebind = false;
-  if (user.connection) {
-    rebind = true;
-    try {
-      user.connection.close();
-    } catch (e) {
-      // Ignore; maybe connection already closed (e.g., due to crash/reboot).
+  this.login(m[1]);
+};
+Object.setOwnerOf($.servers.telnet.connection.onReceiveLine, $.physicals.Maximilian);
+$.servers.telnet.connection.onAuthenticate = function onAuthenticate(id) {
+  // Called with the login ID presented by a WebSocket client (whose
+  // ID cookie was set by $.servers.login).
+  if (!this.user) this.login(id);
+};
+Object.setOwnerOf($.servers.telnet.connection.onAuthenticate, $.physicals.Maximilian);
+$.servers.telnet.connection.login = function login(id) {
+  /* Log this connection in: attach it to the user with login ID id
+   * (or to a new guest, if id is 'guest').  The server then calls the
+   * user's .onAttach method (and, once the connection has closed, its
+   * .onDetach method).  A user may be logged in on several connections
+   * at once.
+   */
+  if (id === 'guest') {
+    var user = $.servers.telnet.createGuest(this);
+    if (!user) {
+      this.write('{type: "narrate", text: "Guest access is not available."}');
+      this.close();
+      return;
     }
-    $.system.log('Rebinding connection to ' + user.name);
   } else {
-    $.system.log('Binding connection to ' + user.name);
+    user = $.userDatabase.get(id) || $.servers.login.createUser(id);
   }
-  user.connection = this;
-  Object.setOwnerOf(Thread.current(), user);
-  setPerms(this.user);
-  new Thread(user.onConnect, 0, user, rebind);
+  this.user = user;
+  $.system.log('Binding connection to ' + user.name);
+  var connection = this;
+  (function() {
+    setPerms($.root);  // Only root may attach connections.
+    $.system.connectionAttach(connection, user);
+  })();
 };
-Object.setOwnerOf($.servers.telnet.connection.onReceiveLine, $.physicals.Maximilian);
+Object.setOwnerOf($.servers.telnet.connection.login, $.physicals.Maximilian);
+$.servers.telnet.connection.onRateLimit = function onRateLimit(policy, wait) {
+  var seconds = Math.ceil(wait / 1000);
+  var text = (policy === 'login') ?
+      'Too many failed logins; try again in ' + seconds + ' seconds.' :
+      'Too many commands; input ignored for ' + seconds + ' seconds.';
+  this.write('{type: "narrate", text: "' + text + '"}');
+};
+Object.setOwnerOf($.servers.telnet.connection.onRateLimit, $.physicals.Maximilian);
+$.servers.telnet.connection.onIdle = function onIdle(remaining) {
+  var minutes = Math.ceil(remaining / 60000);
+  var text = 'You have been idle for a while, and will be disconnected in ' +
+      minutes + (minutes === 1 ? ' minute' : ' minutes') +
+      ' unless you do something.';
+  this.write('{type: "narrate", text: "' + text + '"}');
+};
+Object.setOwnerOf($.servers.telnet.connection.onIdle, $.physicals.Maximilian);
+$.servers.telnet.connection.narrate = function narrate(text) {
+  // Clients of this server expect memos, not plain text.
+  this.write(JSON.stringify({type: 'narrate', text: String(text)}) + '\n');
+};
+Object.setOwnerOf($.servers.telnet.connection.narrate, $.physicals.Maximilian);
 $.servers.telnet.connection.onEnd = function onEnd() {
-  var user = this.user;
-  // Mark connection as closed.
+  // Mark connection as closed.  (Once it has closed, the server
+  // detaches it from its user: see $.user.onDetach.)
   $.connection.onEnd.call(this);
-  if (user) {
-    // Unbind connection from user.
-    this.user = null;
-    if (user.connection === this) {
-      user.connection = null;
-      $.system.log('Unbinding connection from ' + user.name);
-      (function () {
-        setPerms(user);
-        new Thread(user.onDisconnect, 0, user);
-      })();
-    }
-  }
-  // Remove this and any other closed / debound connections from array of open connections.
+  // Remove this and any other closed connections from array of open connections.
   $.servers.telnet.validate();
 };
 Object.setOwnerOf($.servers.telnet.connection.onEnd, $.physicals.Maximilian);
@@ -96,7 +141,7 @@ Object.setOwnerOf($.servers.telnet.connection.onConnect, $.physicals.Maximilian)
 Object.setOwnerOf($.servers.telnet.connection.onConnect.prototype, $.physicals.Maximilian);
 $.servers.telnet.validate = function validate() {
   // Examine supposedly-open connections and close and/or remove
-  // closed / timed-out / debound ones from the .connected arary.
+  // closed / timed-out ones from the .connected arary.
   var limit = Date.now() - this.LOGIN_TIMEOUT_MS;
   this.connected = this.connected.filter(function(c) {
     // Close any connections that haven't logged in promptly.
@@ -113,11 +158,58 @@ $.servers.telnet.validate = function validate() {
         c.connected = false;
       }
     }
-    return c.connected && (!c.user || c.user.connection === c);
+    return c.connected;
   });
 };
 Object.setOwnerOf($.servers.telnet.validate, $.physicals.Maximilian);
 Object.setOwnerOf($.servers.telnet.validate.prototype, $.physicals.Maximilian);
+$.servers.telnet.createGuest = function createGuest(connection) {
+  /* Create an ephemeral guest user for a connection, if guest access
+   * is enabled (see "guests" in the server's config.txt).
+   *
+   * Arguments:
+   * - connection: $.servers.telnet.connection - the connection.
+   * Returns: $.user - the guest, or null if guest access is disabled or
+   *     there are already too many guests.
+   */
+  try {
+    var user = (function() {
+      setPerms($.root);
+      return $.system.guestCreate($.user, connection);
+    })();
+  } catch (e) {
+    $.system.log('Refusing guest: ' + String(e));
+    return null;
+  }
+  user.setName('Guest', /*tryAlternative:*/ true);
+  return user;
+};
+Object.setOwnerOf($.servers.telnet.createGuest, $.physicals.Maximilian);
+Object.setOwnerOf($.servers.telnet.createGuest.prototype, $.physicals.Maximilian);
+$.servers.telnet.releaseGuest = function releaseGuest(user) {
+  /* Dispose of a guest user once its connection has ended: release it
+   * (killing any threads it still has running), then destroy it and
+   * any physical objects it created, so that they can be garbage
+   * collected.
+   *
+   * Arguments:
+   * - user: $.user - the guest.
+   */
+  (function() {
+    setPerms($.root);
+    $.system.guestRelease(user);
+  })();
+  if (user.location) {
+    user.location.narrate(String(user) + ' suddenly vanishes without a trace!');
+  }
+  for (var key in $.physicals) {
+    var obj = $.physicals[key];
+    if (obj !== user && Object.getOwnerOf(obj) === user) obj.destroy();
+  }
+  user.destroy();
+};
+Object.setOwnerOf($.servers.telnet.releaseGuest, $.physicals.Maximilian);
+Object.setOwnerOf($.servers.telnet.releaseGuest.prototype, $.physicals.Maximilian);
 $.servers.telnet.LOGIN_TIMEOUT_MS = 20000;
 
 $.servers.telnet.connected = [];
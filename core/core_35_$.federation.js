@@ -0,0 +1,65 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Teleportation of users between federated worlds.
+ */
+
+//////////////////////////////////////////////////////////////////////
+// AUTO-GENERATED CODE FROM DUMP.  EDIT WITH CAUTION!
+//////////////////////////////////////////////////////////////////////
+
+$.federation = {};
+Object.setOwnerOf($.federation, $.physicals.Maximilian);
+$.federation.README = "$.federation sends users to, and receives them from, peer worlds (as configured by the server's \"federation\" config section).\n\n.teleport(peer, user, id, withObjects) sends user to the world named peer, describing them by their name and id (a string identifying them uniquely in this world), and optionally sending everything they own too.  It returns the peer's decision: {accepted: true, reply: ...} or {accepted: false, reason: '...'}.\n\nThe server calls .onOffer(offer) when a peer offers a user, where offer has .world (the peer's name), .info (as sent by .teleport) and .objects (whether their objects were sent too).  Unless .acceptVisitors is true it refuses them.  If it accepts, the server calls .onArrive(arrival), where arrival.objects is an array of the copies of the user and their objects (or null), which registers the visitor in $.userDatabase under '<world>:<id>' (creating a new $.user if none was sent) and moves them to $.startRoom.";
+$.federation.acceptVisitors = false;
+$.federation.teleport = function teleport(peer, user, id, withObjects) {
+  if (!$.user.isPrototypeOf(user)) {
+    throw new TypeError('user must be a $.user');
+  } else if (typeof id !== 'string' || !id) {
+    throw new TypeError('id must be a non-empty string');
+  }
+  var info = {id: id, name: user.name};
+  return $.system.federationTeleport(peer, info, withObjects ? user : null);
+};
+Object.setOwnerOf($.federation.teleport, $.physicals.Maximilian);
+Object.setOwnerOf($.federation.teleport.prototype, $.physicals.Maximilian);
+$.federation.onOffer = function onOffer(offer) {
+  if (!this.acceptVisitors) return 'This world is not accepting visitors.';
+  if (!offer.info || typeof offer.info.id !== 'string' || !offer.info.id) {
+    return 'Visitors must have an id.';
+  }
+  return true;
+};
+Object.setOwnerOf($.federation.onOffer, $.physicals.Maximilian);
+Object.setOwnerOf($.federation.onOffer.prototype, $.physicals.Maximilian);
+$.federation.onArrive = function onArrive(arrival) {
+  var id = arrival.world + ':' + arrival.info.id;
+  var user = $.userDatabase.get(id);
+  var copy = arrival.objects && arrival.objects[0];
+  if (!user && $.user.isPrototypeOf(copy)) {
+    user = copy;
+    $.userDatabase.set(id, user);
+  } else if (!user) {
+    user = $.servers.login.createUser(id, arrival.info.name);
+  }
+  if ($.startRoom) user.moveTo($.startRoom);
+  $.system.log('Visitor ' + user.name + ' arrived from ' + arrival.world);
+  return {id: id, name: user.name};
+};
+Object.setOwnerOf($.federation.onArrive, $.physicals.Maximilian);
+Object.setOwnerOf($.federation.onArrive.prototype, $.physicals.Maximilian);
@@ -0,0 +1,350 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview External identity providers for the login server:
+ * Google, GitHub, and generic OpenID Connect.  Each implements the
+ * OAuth 2.0 authorization code flow: the user is sent to the
+ * provider's authorization URL, and on their return the code is
+ * exchanged for a token with which to fetch a description of them.
+ */
+
+'use strict';
+
+const https = require('https');
+const {URL, URLSearchParams} = require('url');
+
+/**
+ * A description of an authenticated user, as passed to the login
+ * service backend.  Only id is guaranteed to be present; it is
+ * unique (and stable) across all providers.
+ * @typedef {{id: string,
+ *            provider: string,
+ *            email: (string|undefined),
+ *            verified_email: (boolean|undefined),
+ *            name: (string|undefined),
+ *            given_name: (string|undefined),
+ *            family_name: (string|undefined),
+ *            picture: (string|undefined),
+ *            hd: (string|undefined)}}
+ */
+let Identity;
+
+/**
+ * Make an HTTPS request and parse the JSON response.
+ * @param {string} url The URL to request.
+ * @param {{method: (string|undefined),
+ *          headers: (!Object<string, string>|undefined),
+ *          form: (!Object<string, string>|undefined)}=} options The
+ *     request method (default GET), headers, and (for a POST) fields to
+ *     send as an application/x-www-form-urlencoded body.
+ * @return {!Promise<*>} The parsed response.
+ */
+function fetchJson(url, options = {}) {
+  const headers = Object.assign({
+    'Accept': 'application/json',
+    'User-Agent': 'CodeCity-login',
+  }, options.headers);
+  let body;
+  if (options.form) {
+    body = String(new URLSearchParams(options.form));
+    headers['Content-Type'] = 'application/x-www-form-urlencoded';
+    headers['Content-Length'] = String(Buffer.byteLength(body));
+  }
+  return new Promise((resolve, reject) => {
+    const req = https.request(url, {method: options.method || 'GET', headers},
+        (res) => {
+          let data = '';
+          res.setEncoding('utf8');
+          res.on('data', (chunk) => data += chunk);
+          res.on('end', () => {
+            if (res.statusCode !== 200) {
+              reject(new Error(`${url}: ${res.statusCode} ${data}`));
+              return;
+            }
+            try {
+              resolve(JSON.parse(data));
+            } catch (err) {
+              reject(new Error(`${url}: ${err.message}`));
+            }
+          });
+        });
+    req.on('error', reject);
+    req.end(body);
+  });
+}
+
+/**
+ * Abstract base class for identity providers.
+ */
+class Provider {
+  /**
+   * @param {string} name Name of the provider, as used in the
+   *     configuration (and to distinguish its users' IDs).
+   * @param {!Object} options The provider's configuration: clientId,
+   *     clientSecret, and optionally label (text of its login button)
+   *     and scope.
+   */
+  constructor(name, options) {
+    if (!options.clientId || !options.clientSecret) {
+      throw new TypeError(`Provider ${name} needs clientId and clientSecret`);
+    }
+    /** @const {string} */
+    this.name = name;
+    /** @const {string} */
+    this.label = options.label || name;
+    /** @const {string} */
+    this.clientId = options.clientId;
+    /** @const {string} */
+    this.clientSecret = options.clientSecret;
+    /** @const {string|undefined} */
+    this.scope = options.scope;
+  }
+
+  /**
+   * Get the provider's endpoints.
+   * @return {!Promise<{authorization: string, token: string,
+   *     userinfo: string}>}
+   */
+  async endpoints() {
+    throw new Error('Not implemented');
+  }
+
+  /**
+   * Compute the URL to send the user to in order to log in.
+   * @param {string} redirectUri Where the provider should send the user
+   *     back to (the login server's URL).
+   * @param {string} state Opaque value to be returned with the user.
+   * @return {!Promise<string>}
+   */
+  async authUrl(redirectUri, state) {
+    const url = new URL((await this.endpoints()).authorization);
+    url.searchParams.set('response_type', 'code');
+    url.searchParams.set('client_id', this.clientId);
+    url.searchParams.set('redirect_uri', redirectUri);
+    url.searchParams.set('scope', this.scope);
+    url.searchParams.set('state', state);
+    return String(url);
+  }
+
+  /**
+   * Exchange an authorization code for an access token.
+   * @param {string} code The code returned with the user.
+   * @param {string} redirectUri The redirectUri passed to authUrl.
+   * @return {!Promise<string>} The access token.
+   */
+  async token(code, redirectUri) {
+    const data = await fetchJson((await this.endpoints()).token, {
+      method: 'POST',
+      form: {
+        grant_type: 'authorization_code',
+        code,
+        redirect_uri: redirectUri,
+        client_id: this.clientId,
+        client_secret: this.clientSecret,
+      },
+    });
+    if (!data.access_token) {
+      throw new Error(`No access token: ${data.error || JSON.stringify(data)}`);
+    }
+    return data.access_token;
+  }
+
+  /**
+   * Authenticate a user returning from the provider.
+   * @param {string} code The code returned with the user.
+   * @param {string} redirectUri The redirectUri passed to authUrl.
+   * @return {!Promise<!Identity>}
+   */
+  async identify(code, redirectUri) {
+    throw new Error('Not implemented');
+  }
+}
+
+/**
+ * A generic OpenID Connect provider, whose endpoints are found by
+ * discovery from its issuer URL.
+ */
+class OidcProvider extends Provider {
+  /**
+   * @param {string} name Name of the provider.
+   * @param {!Object} options As for Provider, plus issuer: the
+   *     provider's issuer URL (e.g., 'https://accounts.example.com').
+   */
+  constructor(name, options) {
+    super(name, Object.assign({scope: 'openid email profile'}, options));
+    if (!options.issuer) {
+      throw new TypeError(`Provider ${name} needs an issuer`);
+    }
+    /** @const {string} */
+    this.issuer = options.issuer.replace(/\/$/, '');
+    /** @private {?Promise<!Object>} The discovery document. */
+    this.discovery_ = null;
+  }
+
+  /** @override */
+  async endpoints() {
+    if (!this.discovery_) {
+      this.discovery_ =
+          fetchJson(this.issuer + '/.well-known/openid-configuration');
+      // Retry discovery next time if it fails.
+      this.discovery_.catch(() => this.discovery_ = null);
+    }
+    const discovery = await this.discovery_;
+    return {
+      authorization: discovery.authorization_endpoint,
+      token: discovery.token_endpoint,
+      userinfo: discovery.userinfo_endpoint,
+    };
+  }
+
+  /** @override */
+  async identify(code, redirectUri) {
+    const token = await this.token(code, redirectUri);
+    const info = await fetchJson((await this.endpoints()).userinfo,
+        {headers: {'Authorization': `Bearer ${token}`}});
+    if (typeof info.sub !== 'string' || !info.sub) {
+      throw new Error('Userinfo has no subject');
+    }
+    return {
+      id: this.subjectId(info.sub),
+      provider: this.name,
+      email: info.email,
+      verified_email: info.email_verified,
+      name: info.name,
+      given_name: info.given_name,
+      family_name: info.family_name,
+      picture: info.picture,
+      hd: info.hd,
+    };
+  }
+
+  /**
+   * Convert a subject identifier into an ID unique across providers.
+   * @param {string} sub The subject identifier.
+   * @return {string}
+   */
+  subjectId(sub) {
+    return `${this.name}:${sub}`;
+  }
+}
+
+/**
+ * Google, via OpenID Connect.
+ */
+class GoogleProvider extends OidcProvider {
+  /**
+   * @param {string} name Name of the provider.
+   * @param {!Object} options As for Provider.
+   */
+  constructor(name, options) {
+    super(name, Object.assign(
+        {issuer: 'https://accounts.google.com', label: 'Google'}, options));
+  }
+
+  /**
+   * Google's subject identifiers are the (GAIA) IDs used by earlier
+   * versions of the login server, and so are left unprefixed: existing
+   * users keep their IDs.
+   * @override
+   */
+  subjectId(sub) {
+    return sub;
+  }
+}
+
+/**
+ * GitHub, via OAuth 2.0 and its REST API.
+ */
+class GitHubProvider extends Provider {
+  /**
+   * @param {string} name Name of the provider.
+   * @param {!Object} options As for Provider.
+   */
+  constructor(name, options) {
+    super(name, Object.assign({label: 'GitHub', scope: 'user:email'},
+                              options));
+  }
+
+  /** @override */
+  async endpoints() {
+    return {
+      authorization: 'https://github.com/login/oauth/authorize',
+      token: 'https://github.com/login/oauth/access_token',
+      userinfo: 'https://api.github.com/user',
+    };
+  }
+
+  /** @override */
+  async identify(code, redirectUri) {
+    const token = await this.token(code, redirectUri);
+    const headers = {'Authorization': `token ${token}`};
+    const user = await fetchJson((await this.endpoints()).userinfo, {headers});
+    // The profile's email (if any) is not necessarily verified.
+    const emails =
+        await fetchJson('https://api.github.com/user/emails', {headers});
+    const primary = emails.find((email) => email.primary && email.verified);
+    return {
+      id: `${this.name}:${user.id}`,
+      provider: this.name,
+      email: primary ? primary.email : undefined,
+      verified_email: Boolean(primary),
+      name: user.name || user.login,
+      picture: user.avatar_url,
+    };
+  }
+}
+
+/**
+ * Provider classes, by type.
+ * @const {!Object<string, function(new:Provider, string, !Object)>}
+ */
+const TYPES = {
+  'google': GoogleProvider,
+  'github': GitHubProvider,
+  'oidc': OidcProvider,
+};
+
+/**
+ * Create the providers configured.
+ * @param {!Object<string, !Object>} config The configured providers, by
+ *     name.  Each's type (one of the keys of TYPES) defaults to its
+ *     name.
+ * @return {!Map<string, !Provider>} The providers, by name.
+ */
+function create(config) {
+  const providers = new Map();
+  for (const name of Object.keys(config)) {
+    if (!/^[\w-]+$/.test(name)) {
+      throw new TypeError(`Invalid provider name ${name}`);
+    }
+    const options = config[name];
+    const type = options.type || name;
+    if (!TYPES[type]) throw new TypeError(`Unknown provider type ${type}`);
+    providers.set(name, new TYPES[type](name, options));
+  }
+  return providers;
+}
+
+module.exports = {
+  create,
+  fetchJson,
+  GitHubProvider,
+  GoogleProvider,
+  OidcProvider,
+  Provider,
+};
@@ -0,0 +1,488 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Password accounts, so that in-world code need never
+ * store (or even hash) passwords itself.
+ *
+ * Passwords are hashed with scrypt, a memory-hard function built in to
+ * Node (argon2id and bcrypt both need native modules), with a random
+ * salt for each, and encoded in PHC string format
+ * ('$scrypt$ln=<log2 N>,r=<r>,p=<p>$<salt>$<hash>').  Hashes made with
+ * weaker parameters, or with PBKDF2 (in passlib's
+ * '$pbkdf2-sha256$<rounds>$<salt>$<hash>' format, e.g. as imported
+ * from elsewhere), are still accepted, and are replaced when the
+ * password is next verified.
+ *
+ * Accounts may also have a second factor: a TOTP (RFC 6238) secret,
+ * as used by authenticator apps, plus single-use recovery codes for
+ * when the app is lost.
+ *
+ * Accounts are plain objects, so that a table of them can be saved in
+ * checkpoints.
+ */
+'use strict';
+
+var crypto = require('crypto');
+
+var Accounts = {};
+
+/**
+ * Default cost of hashing: log2 of scrypt's N parameter.  (2^15, with
+ * r = 8, uses 32 MiB and takes about 100ms.)
+ * @const {number}
+ */
+Accounts.COST = 15;
+
+/**
+ * Minimum length of a password.
+ * @const {number}
+ */
+Accounts.MIN_PASSWORD = 8;
+
+/**
+ * Maximum length of a password (to bound the work of hashing one).
+ * @const {number}
+ */
+Accounts.MAX_PASSWORD = 1024;
+
+/**
+ * Maximum memory (in bytes) that verifying an scrypt hash may use:
+ * 128 * N * r.  Hashes needing more are rejected, so that a hash
+ * (e.g., an imported one) cannot exhaust the server's memory.  (This
+ * limits Accounts.hash's cost to 18.)
+ * @const {number}
+ */
+Accounts.MAX_SCRYPT_MEMORY = 256 * 1024 * 1024;
+
+/**
+ * Maximum number of rounds that verifying a PBKDF2 hash may use.
+ * Hashes needing more are rejected, so that a hash cannot tie up the
+ * server for minutes.  (Passlib's default is 29000; OWASP currently
+ * recommends 600000 for PBKDF2-SHA256.)
+ * @const {number}
+ */
+Accounts.MAX_PBKDF2_ROUNDS = 2000000;
+
+/**
+ * Default time (in ms) for which a reset token is valid.
+ * @const {number}
+ */
+Accounts.RESET_TTL = 24 * 60 * 60 * 1000;
+
+/**
+ * Period, in seconds, of TOTP codes.
+ * @const {number}
+ */
+Accounts.TOTP_PERIOD = 30;
+
+/**
+ * Number of digits in TOTP codes.
+ * @const {number}
+ */
+Accounts.TOTP_DIGITS = 6;
+
+/**
+ * Number of periods either side of the current one whose codes are
+ * also accepted (to allow for clock skew).
+ * @const {number}
+ */
+Accounts.TOTP_WINDOW = 1;
+
+/**
+ * Number of recovery codes issued at once.
+ * @const {number}
+ */
+Accounts.RECOVERY_CODES = 10;
+
+/**
+ * An account's TOTP second factor: its (base32) secret, whether
+ * enrollment has been confirmed (by a valid code), and the counter of
+ * the last code accepted (so that it cannot be replayed).
+ * @typedef {{secret: string, enabled: boolean, last: number}}
+ */
+Accounts.Totp;
+
+/**
+ * An account: the hash of its password (or null if it must be reset
+ * before it can be logged in to), when it was created and its
+ * password last changed (as from Date.now()), the (SHA-256) hash of
+ * an outstanding reset token and when that expires, and its TOTP
+ * second factor and the (SHA-256) hashes of its unused recovery codes,
+ * if any.  (The last two are absent from accounts created before they
+ * were introduced.)
+ * @typedef {{hash: ?string,
+ *            created: number,
+ *            updated: number,
+ *            reset: ?{token: string, expires: number},
+ *            totp: (?Accounts.Totp|undefined),
+ *            recovery: (!Array<string>|undefined)}}
+ */
+Accounts.Account;
+
+/**
+ * Check that a password is acceptable.
+ * @param {*} password The password.
+ * @throws {!TypeError} If it is not.
+ */
+Accounts.checkPassword = function(password) {
+  if (typeof password !== 'string') {
+    throw new TypeError('password must be a string');
+  } else if (password.length < Accounts.MIN_PASSWORD) {
+    throw new TypeError('password must be at least ' + Accounts.MIN_PASSWORD +
+                        ' characters');
+  } else if (password.length > Accounts.MAX_PASSWORD) {
+    throw new TypeError('password is too long');
+  }
+};
+
+/**
+ * Hash a password.
+ * @param {string} password The password.
+ * @param {number=} cost log2 of scrypt's N parameter (default
+ *     Accounts.COST).
+ * @return {!Promise<string>} The hash, in PHC string format.  Rejects
+ *     with a RangeError if cost would need more than
+ *     Accounts.MAX_SCRYPT_MEMORY to verify.
+ */
+Accounts.hash = function(password, cost) {
+  var params = {ln: cost || Accounts.COST, r: 8, p: 1};
+  if (!Accounts.withinLimits_(params)) {
+    return Promise.reject(new RangeError('cost ' + params.ln + ' too high'));
+  }
+  var salt = crypto.randomBytes(16);
+  return Accounts.scrypt_(password, salt, params, 32).then(function(key) {
+    return '$scrypt$ln=' + params.ln + ',r=' + params.r + ',p=' + params.p +
+        '$' + Accounts.encode_(salt) + '$' + Accounts.encode_(key);
+  });
+};
+
+/**
+ * Verify a password against a hash.
+ * @param {string} password The password.
+ * @param {string} hash The hash (as from Accounts.hash, or PBKDF2).
+ * @return {!Promise<boolean>} Whether the password matches.
+ */
+Accounts.verify = function(password, hash) {
+  var parsed = Accounts.parse_(hash);
+  if (!parsed) return Promise.resolve(false);
+  var derive = (parsed.id === 'scrypt') ?
+      Accounts.scrypt_(password, parsed.salt, parsed.params,
+                       parsed.key.length) :
+      new Promise(function(resolve, reject) {
+        crypto.pbkdf2(password, parsed.salt, parsed.params.rounds,
+                      parsed.key.length, 'sha256', function(err, key) {
+                        if (err) reject(err); else resolve(key);
+                      });
+      });
+  return derive.then(function(key) {
+    return crypto.timingSafeEqual(key, parsed.key);
+  });
+};
+
+/**
+ * Does a hash need replacing, because it was made with an older
+ * algorithm or weaker parameters than those now used?
+ * @param {string} hash The hash.
+ * @param {number=} cost Current cost (default Accounts.COST).
+ * @return {boolean}
+ */
+Accounts.needsRehash = function(hash, cost) {
+  var parsed = Accounts.parse_(hash);
+  return !parsed || parsed.id !== 'scrypt' ||
+      parsed.params.ln < (cost || Accounts.COST) || parsed.params.r < 8;
+};
+
+/**
+ * Make a random reset token.
+ * @return {{token: string, hash: string}} The token (to give to the
+ *     user), and its hash (to store).
+ */
+Accounts.makeToken = function() {
+  var token = crypto.randomBytes(24).toString('hex');
+  return {token: token, hash: Accounts.hashToken(token)};
+};
+
+/**
+ * Hash a reset token.
+ * @param {string} token The token.
+ * @return {string} Its SHA-256 hash, in hex.
+ */
+Accounts.hashToken = function(token) {
+  return crypto.createHash('sha256').update(token).digest('hex');
+};
+
+/**
+ * Check a reset token against an account, in constant time.
+ * @param {!Accounts.Account} account The account.
+ * @param {*} token The token presented.
+ * @param {number} now The current time (as from Date.now()).
+ * @return {boolean} Whether it is the account's unexpired reset token.
+ */
+Accounts.checkToken = function(account, token, now) {
+  if (!account.reset || typeof token !== 'string' ||
+      now >= account.reset.expires) {
+    return false;
+  }
+  return crypto.timingSafeEqual(Buffer.from(Accounts.hashToken(token), 'hex'),
+                                Buffer.from(account.reset.token, 'hex'));
+};
+
+/**
+ * Make a random TOTP secret.
+ * @return {string} The secret, in base32 (as authenticator apps expect).
+ */
+Accounts.makeTotpSecret = function() {
+  return Accounts.base32Encode_(crypto.randomBytes(20));
+};
+
+/**
+ * Make an otpauth: URI describing a TOTP secret, for an authenticator
+ * app to import (typically by scanning it as a QR code).
+ * @param {string} secret The secret, in base32.
+ * @param {string} account Name of the account.
+ * @param {string} issuer Name of the service (e.g., the server's name).
+ * @return {string}
+ */
+Accounts.totpUri = function(secret, account, issuer) {
+  var label = encodeURIComponent(issuer) + ':' + encodeURIComponent(account);
+  return 'otpauth://totp/' + label + '?secret=' + secret +
+      '&issuer=' + encodeURIComponent(issuer) + '&algorithm=SHA1' +
+      '&digits=' + Accounts.TOTP_DIGITS + '&period=' + Accounts.TOTP_PERIOD;
+};
+
+/**
+ * Compute the TOTP code for a given period (i.e., the HOTP code, per
+ * RFC 4226, for that counter).
+ * @param {string} secret The secret, in base32.
+ * @param {number} counter The number of the period (time in seconds
+ *     divided by TOTP_PERIOD).
+ * @return {string} The code (zero-padded to TOTP_DIGITS digits).
+ */
+Accounts.totp = function(secret, counter) {
+  var message = Buffer.alloc(8);
+  message.writeUInt32BE(Math.floor(counter / 0x100000000), 0);
+  message.writeUInt32BE(counter % 0x100000000, 4);
+  var mac = crypto.createHmac('sha1', Accounts.base32Decode_(secret))
+      .update(message).digest();
+  var offset = mac[mac.length - 1] & 0xf;
+  var code = (mac.readUInt32BE(offset) & 0x7fffffff) %
+      Math.pow(10, Accounts.TOTP_DIGITS);
+  return String(code).padStart(Accounts.TOTP_DIGITS, '0');
+};
+
+/**
+ * Check a TOTP code.  Only codes for periods after the last one
+ * accepted are accepted, so that no code can be used twice.
+ * @param {!Accounts.Totp} totp The second factor to check against.
+ * @param {*} code The code presented.
+ * @param {number} now The current time (as from Date.now()).
+ * @return {number} The counter of the period the code is for, or -1 if
+ *     it is not valid.
+ */
+Accounts.checkTotp = function(totp, code, now) {
+  if (typeof code !== 'string') return -1;
+  code = code.replace(/\s/g, '');
+  if (!/^\d+$/.test(code) || code.length !== Accounts.TOTP_DIGITS) return -1;
+  var current = Math.floor(now / 1000 / Accounts.TOTP_PERIOD);
+  var found = -1;
+  // Check every candidate, so as to take the same time whichever matches.
+  for (var i = -Accounts.TOTP_WINDOW; i <= Accounts.TOTP_WINDOW; i++) {
+    var counter = current + i;
+    if (counter <= totp.last) continue;
+    if (crypto.timingSafeEqual(Buffer.from(Accounts.totp(totp.secret, counter)),
+                               Buffer.from(code))) {
+      found = counter;
+    }
+  }
+  return found;
+};
+
+/**
+ * Make a set of random recovery codes.
+ * @return {{codes: !Array<string>, hashes: !Array<string>}} The codes (to
+ *     give to the user), and their hashes (to store).
+ */
+Accounts.makeRecoveryCodes = function() {
+  var codes = [];
+  for (var i = 0; i < Accounts.RECOVERY_CODES; i++) {
+    var hex = crypto.randomBytes(5).toString('hex');
+    codes.push(hex.slice(0, 5) + '-' + hex.slice(5));
+  }
+  return {codes: codes, hashes: codes.map(Accounts.hashRecoveryCode_)};
+};
+
+/**
+ * Use a recovery code: if it is one of an account's unused codes,
+ * remove it.
+ * @param {!Accounts.Account} account The account.
+ * @param {*} code The code presented.
+ * @return {boolean} True iff the code was valid.
+ */
+Accounts.useRecoveryCode = function(account, code) {
+  if (!account.recovery || typeof code !== 'string') return false;
+  var index = account.recovery.indexOf(Accounts.hashRecoveryCode_(code));
+  if (index === -1) return false;
+  account.recovery.splice(index, 1);
+  return true;
+};
+
+/**
+ * Hash a recovery code, ignoring case, whitespace and dashes (which
+ * users are apt to get wrong when copying it).  Recovery codes are
+ * random, so (like reset tokens) need no salt.
+ * @private
+ * @param {string} code The code.
+ * @return {string}
+ */
+Accounts.hashRecoveryCode_ = function(code) {
+  return Accounts.hashToken(code.toLowerCase().replace(/[\s-]/g, ''));
+};
+
+/**
+ * Derive a key with scrypt.
+ * @private
+ * @param {string} password The password.
+ * @param {!Buffer} salt The salt.
+ * @param {{ln: number, r: number, p: number}} params The parameters.
+ * @param {number} length Length of key to derive.
+ * @return {!Promise<!Buffer>}
+ */
+Accounts.scrypt_ = function(password, salt, params, length) {
+  var N = Math.pow(2, params.ln);
+  var options = {N: N, r: params.r, p: params.p,
+                 maxmem: 256 * N * params.r + 1024 * 1024};
+  return new Promise(function(resolve, reject) {
+    crypto.scrypt(password, salt, length, options, function(err, key) {
+      if (err) reject(err); else resolve(key);
+    });
+  });
+};
+
+/**
+ * Parse a hash in PHC string (or passlib PBKDF2) format.
+ * @private
+ * @param {string} hash The hash.
+ * @return {?{id: string, params: !Object<string, number>, salt: !Buffer,
+ *     key: !Buffer}} Its parts, or null if it is not a supported hash.
+ */
+Accounts.parse_ = function(hash) {
+  var m = /^\$scrypt\$ln=(\d+),r=(\d+),p=(\d+)\$([^$]+)\$([^$]+)$/.exec(hash);
+  if (m) {
+    var params = {ln: Number(m[1]), r: Number(m[2]), p: Number(m[3])};
+    if (!Accounts.withinLimits_(params)) return null;
+    var parsed = {id: 'scrypt', params: params, salt: Accounts.decode_(m[4]),
+                  key: Accounts.decode_(m[5])};
+  } else if ((m = /^\$pbkdf2-sha256\$(\d+)\$([^$]+)\$([^$]+)$/.exec(hash)) &&
+             Number(m[1]) > 0 && Number(m[1]) <= Accounts.MAX_PBKDF2_ROUNDS) {
+    parsed = {id: 'pbkdf2-sha256', params: {rounds: Number(m[1])},
+              salt: Accounts.decode_(m[2]), key: Accounts.decode_(m[3])};
+  } else {
+    return null;
+  }
+  // Reject truncated hashes, which would be too easy to match.
+  return (parsed.key.length >= 16) ? parsed : null;
+};
+
+/**
+ * Are the given scrypt parameters within those this server will use
+ * (in particular, do they need at most Accounts.MAX_SCRYPT_MEMORY)?
+ * @private
+ * @param {{ln: number, r: number, p: number}} params The parameters.
+ * @return {boolean}
+ */
+Accounts.withinLimits_ = function(params) {
+  return params.ln >= 1 && params.ln <= 24 && params.r >= 1 &&
+      params.r <= 64 && params.p >= 1 && params.p <= 16 &&
+      128 * Math.pow(2, params.ln) * params.r <= Accounts.MAX_SCRYPT_MEMORY;
+};
+
+/**
+ * Encode bytes as unpadded base64 (as in PHC strings).
+ * @private
+ * @param {!Buffer} bytes The bytes.
+ * @return {string}
+ */
+Accounts.encode_ = function(bytes) {
+  return bytes.toString('base64').replace(/=+$/, '');
+};
+
+/**
+ * Decode unpadded base64 (or passlib's variant, which uses '.' for
+ * '+').
+ * @private
+ * @param {string} text The encoded bytes.
+ * @return {!Buffer}
+ */
+Accounts.decode_ = function(text) {
+  return Buffer.from(text.replace(/\./g, '+'), 'base64');
+};
+
+/**
+ * RFC 4648 base32 alphabet.
+ * @private @const {string}
+ */
+Accounts.BASE32_ = 'ABCDEFGHIJKLMNOPQRSTUVWXYZ234567';
+
+/**
+ * Encode bytes as unpadded base32.
+ * @private
+ * @param {!Buffer} bytes The bytes.
+ * @return {string}
+ */
+Accounts.base32Encode_ = function(bytes) {
+  var text = '';
+  var bits = 0;
+  var value = 0;
+  for (var i = 0; i < bytes.length; i++) {
+    value = (value << 8) | bytes[i];
+    bits += 8;
+    while (bits >= 5) {
+      bits -= 5;
+      text += Accounts.BASE32_[(value >>> bits) & 0x1f];
+    }
+  }
+  if (bits) text += Accounts.BASE32_[(value << (5 - bits)) & 0x1f];
+  return text;
+};
+
+/**
+ * Decode base32 (ignoring case, whitespace and padding).
+ * @private
+ * @param {string} text The encoded bytes.
+ * @return {!Buffer}
+ * @throws {!TypeError} If text is not valid base32.
+ */
+Accounts.base32Decode_ = function(text) {
+  text = text.toUpperCase().replace(/[\s=]/g, '');
+  var bytes = [];
+  var bits = 0;
+  var value = 0;
+  for (var i = 0; i < text.length; i++) {
+    var digit = Accounts.BASE32_.indexOf(text[i]);
+    if (digit === -1) throw new TypeError('invalid base32');
+    value = ((value << 5) | digit) & 0xfff;
+    bits += 5;
+    if (bits >= 8) {
+      bits -= 8;
+      bytes.push((value >>> bits) & 0xff);
+    }
+  }
+  return Buffer.from(bytes);
+};
+
+module.exports = Accounts;
@@ -0,0 +1,475 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview A client for the ACME protocol (RFC 8555), to obtain
+ * TLS certificates from a certificate authority such as Let's
+ * Encrypt.
+ *
+ * Only the http-01 challenge is supported: the CA checks control of
+ * each hostname by fetching
+ * http://<hostname>/.well-known/acme-challenge/<token>, which must be
+ * answered (e.g., by Acme.Responder) with the key authorization
+ * supplied to the client's responder.  Account keys are ECDSA P-256;
+ * certificate keys may be ECDSA or RSA.
+ */
+'use strict';
+
+var crypto = require('crypto');
+var Der = require('./der');
+var http = require('http');
+var https = require('https');
+
+var Acme = {};
+
+/** @const {string} Let's Encrypt's production directory. */
+Acme.LETS_ENCRYPT = 'https://acme-v02.api.letsencrypt.org/directory';
+
+/** @const {string} Let's Encrypt's staging (test) directory. */
+Acme.LETS_ENCRYPT_STAGING =
+    'https://acme-staging-v02.api.letsencrypt.org/directory';
+
+/** @const {string} Path at which http-01 challenges are fetched. */
+Acme.CHALLENGE_PATH = '/.well-known/acme-challenge/';
+
+/** @const {number} Request timeout, in milliseconds. */
+Acme.TIMEOUT = 60 * 1000;
+
+/**
+ * Receives the key authorizations to be served for http-01
+ * challenges.
+ * @typedef {{set: function(string, string), remove: function(string)}}
+ */
+Acme.ChallengeHandler;
+
+/**
+ * Options for Acme.Client:
+ *
+ * - email: contact address for the account (optional).
+ * - pollInterval: milliseconds between checks on the progress of an
+ *   order (default 2000).
+ * - maxPolls: number of checks before giving up (default 60).
+ * @typedef {{email: (string|undefined),
+ *            pollInterval: (number|undefined),
+ *            maxPolls: (number|undefined)}}
+ */
+Acme.Options;
+
+/**
+ * Encode data as base64url, without padding (as JWS requires).
+ * @param {!Buffer|string} data The data.
+ * @return {string}
+ */
+Acme.base64url = function(data) {
+  return Buffer.from(data).toString('base64').replace(/=+$/, '')
+      .replace(/\+/g, '-').replace(/\//g, '_');
+};
+
+/**
+ * Make an HTTP(S) request (which resolves whatever the status of the
+ * response).
+ * @param {string} method HTTP method.
+ * @param {string} url The URL.
+ * @param {!Object<string,string>} headers Request headers.
+ * @param {?Buffer} body Request body, if any.
+ * @return {!Promise<{status: number, headers: !Object, body: !Buffer}>}
+ */
+Acme.request = function(method, url, headers, body) {
+  var lib = url.startsWith('http:') ? http : https;
+  return new Promise(function(resolve, reject) {
+    var req = lib.request(url, {
+      method: method,
+      headers: headers,
+      timeout: Acme.TIMEOUT,
+    }, function(res) {
+      var chunks = [];
+      res.on('data', (chunk) => chunks.push(chunk));
+      res.on('error', reject);
+      res.on('end', function() {
+        resolve({status: res.statusCode, headers: res.headers,
+                 body: Buffer.concat(chunks)});
+      });
+    });
+    req.on('timeout', function() {
+      req.destroy(new Error(method + ' ' + url + ' timed out'));
+    });
+    req.on('error', reject);
+    req.end(body || undefined);
+  });
+};
+
+/**
+ * A client for an ACME server, using a single account.
+ * @constructor
+ * @param {string} directoryUrl URL of the server's directory (e.g.,
+ *     Acme.LETS_ENCRYPT).
+ * @param {!crypto.KeyObject} accountKey Private key of the account
+ *     (ECDSA, P-256).
+ * @param {!Acme.Options=} options Options.
+ */
+Acme.Client = function(directoryUrl, accountKey, options) {
+  options = options || {};
+  if (accountKey.asymmetricKeyType !== 'ec' ||
+      accountKey.asymmetricKeyDetails.namedCurve !== 'prime256v1') {
+    throw new TypeError('ACME account key must be ECDSA P-256');
+  }
+  /** @private @const {string} */
+  this.directoryUrl_ = directoryUrl;
+  /** @private @const {!crypto.KeyObject} */
+  this.accountKey_ = accountKey;
+  var jwk = crypto.createPublicKey(accountKey).export({format: 'jwk'});
+  /**
+   * Public account key, as a JWK (with members in lexicographic order,
+   * as required for its thumbprint).
+   * @private @const {!Object<string,string>}
+   */
+  this.jwk_ = {crv: jwk.crv, kty: jwk.kty, x: jwk.x, y: jwk.y};
+  /** @private @const {string|undefined} */
+  this.email_ = options.email;
+  /** @private @const {number} */
+  this.pollInterval_ = options.pollInterval || 2000;
+  /** @private @const {number} */
+  this.maxPolls_ = options.maxPolls || 60;
+  /** @private {?Object<string,string>} The server's directory. */
+  this.directory_ = null;
+  /** @private {?string} Next nonce to use, if any. */
+  this.nonce_ = null;
+  /** @private {?string} URL of the account, once registered. */
+  this.kid_ = null;
+};
+
+/**
+ * Get the JWK thumbprint (RFC 7638) of the account key.
+ * @return {string}
+ */
+Acme.Client.prototype.thumbprint = function() {
+  return Acme.base64url(crypto.createHash('sha256')
+      .update(JSON.stringify(this.jwk_)).digest());
+};
+
+/**
+ * Get the server's directory.
+ * @private
+ * @return {!Promise<!Object<string,string>>}
+ */
+Acme.Client.prototype.getDirectory_ = function() {
+  if (this.directory_) return Promise.resolve(this.directory_);
+  var client = this;
+  return Acme.request('GET', this.directoryUrl_, {}, null).then(
+      function(res) {
+        if (res.status !== 200) {
+          throw new Error('Unable to get ACME directory ' +
+                          client.directoryUrl_ + ': ' + res.status);
+        }
+        client.directory_ = JSON.parse(res.body.toString('utf8'));
+        return client.directory_;
+      });
+};
+
+/**
+ * Get a fresh nonce.
+ * @private
+ * @return {!Promise<string>}
+ */
+Acme.Client.prototype.getNonce_ = function() {
+  if (this.nonce_) {
+    var nonce = this.nonce_;
+    this.nonce_ = null;
+    return Promise.resolve(nonce);
+  }
+  return this.getDirectory_().then(function(directory) {
+    return Acme.request('HEAD', directory['newNonce'], {}, null);
+  }).then(function(res) {
+    var nonce = res.headers['replay-nonce'];
+    if (!nonce) throw new Error('ACME server supplied no nonce');
+    return nonce;
+  });
+};
+
+/**
+ * Make a signed POST request (or a POST-as-GET request, if payload is
+ * null).  Retries once if the nonce used was rejected.
+ * @private
+ * @param {string} url The URL.
+ * @param {?Object} payload The request, or null.
+ * @param {boolean=} retried Has the request already been retried?
+ * @return {!Promise<{status: number, headers: !Object, body: *}>} The
+ *     response, with body parsed if it was JSON.  Rejects with an
+ *     Error (whose .problem is the server's problem document, if any)
+ *     if the request failed.
+ */
+Acme.Client.prototype.post_ = function(url, payload, retried) {
+  var client = this;
+  return this.getNonce_().then(function(nonce) {
+    var header = {alg: 'ES256', nonce: nonce, url: url};
+    if (client.kid_) {
+      header.kid = client.kid_;
+    } else {
+      header.jwk = client.jwk_;
+    }
+    var protected64 = Acme.base64url(JSON.stringify(header));
+    var payload64 =
+        (payload === null) ? '' : Acme.base64url(JSON.stringify(payload));
+    var signature = crypto.sign('sha256',
+        Buffer.from(protected64 + '.' + payload64),
+        {key: client.accountKey_, dsaEncoding: 'ieee-p1363'});
+    var body = Buffer.from(JSON.stringify({
+      protected: protected64,
+      payload: payload64,
+      signature: Acme.base64url(signature),
+    }));
+    return Acme.request('POST', url, {
+      'content-type': 'application/jose+json',
+      'content-length': String(body.length),
+    }, body);
+  }).then(function(res) {
+    client.nonce_ = res.headers['replay-nonce'] || null;
+    var body = res.body;
+    if (/json/.test(res.headers['content-type'] || '')) {
+      body = JSON.parse(body.toString('utf8'));
+    }
+    if (res.status < 400) {
+      return {status: res.status, headers: res.headers, body: body};
+    }
+    if (!retried && body &&
+        body.type === 'urn:ietf:params:acme:error:badNonce') {
+      return client.post_(url, payload, true);
+    }
+    var error = new Error('ACME request to ' + url + ' failed: ' + res.status +
+        (body && body.detail ? ' ' + body.detail : ''));
+    error.problem = (body && body.type) ? body : null;
+    throw error;
+  });
+};
+
+/**
+ * Register the account (or find it, if it already exists).
+ * @return {!Promise}
+ */
+Acme.Client.prototype.register = function() {
+  if (this.kid_) return Promise.resolve();
+  var client = this;
+  return this.getDirectory_().then(function(directory) {
+    var request = {termsOfServiceAgreed: true};
+    if (client.email_) request.contact = ['mailto:' + client.email_];
+    return client.post_(directory['newAccount'], request);
+  }).then(function(res) {
+    client.kid_ = res.headers['location'];
+    if (!client.kid_) throw new Error('ACME server supplied no account URL');
+  });
+};
+
+/**
+ * Obtain a certificate.
+ * @param {!Array<string>} hostnames Hostnames for the certificate
+ *     (the first being its subject).
+ * @param {!crypto.KeyObject} key Private key for the certificate.
+ * @param {!Acme.ChallengeHandler} handler Called with the token and
+ *     key authorization for each http-01 challenge, which must then be
+ *     served until removed.
+ * @return {!Promise<string>} The certificate chain, in PEM format.
+ */
+Acme.Client.prototype.issue = function(hostnames, key, handler) {
+  var client = this;
+  var orderUrl;
+  return this.register().then(function() {
+    return client.getDirectory_();
+  }).then(function(directory) {
+    return client.post_(directory['newOrder'], {
+      identifiers: hostnames.map(function(hostname) {
+        return {type: 'dns', value: hostname};
+      }),
+    });
+  }).then(function(res) {
+    orderUrl = res.headers['location'];
+    var order = res.body;
+    // Authorize each hostname in turn.
+    var authorized = Promise.resolve();
+    order.authorizations.forEach(function(url) {
+      authorized = authorized.then(function() {
+        return client.authorize_(url, handler);
+      });
+    });
+    return authorized.then(function() {
+      var csr = Acme.csr(hostnames, key);
+      return client.post_(order.finalize, {csr: Acme.base64url(csr)});
+    });
+  }).then(function() {
+    return client.poll_(orderUrl, 'order');
+  }).then(function(order) {
+    return client.post_(order.certificate, null);
+  }).then(function(res) {
+    return String(res.body);
+  });
+};
+
+/**
+ * Complete an authorization, by responding to its http-01 challenge.
+ * @private
+ * @param {string} url URL of the authorization.
+ * @param {!Acme.ChallengeHandler} handler Challenge handler.
+ * @return {!Promise}
+ */
+Acme.Client.prototype.authorize_ = function(url, handler) {
+  var client = this;
+  return this.post_(url, null).then(function(res) {
+    var authorization = res.body;
+    if (authorization.status === 'valid') return undefined;
+    var challenge = authorization.challenges.find(function(c) {
+      return c.type === 'http-01';
+    });
+    if (!challenge) {
+      throw new Error('No http-01 challenge for ' +
+                      authorization.identifier.value);
+    }
+    var token = challenge.token;
+    handler.set(token, token + '.' + client.thumbprint());
+    return client.post_(challenge.url, {}).then(function() {
+      return client.poll_(url, 'authorization');
+    }).then(function() {
+      handler.remove(token);
+    }, function(e) {
+      handler.remove(token);
+      throw e;
+    });
+  });
+};
+
+/**
+ * Wait until an order or authorization is valid.
+ * @private
+ * @param {string} url URL of the order or authorization.
+ * @param {string} what Description, for error messages.
+ * @return {!Promise<!Object>} The order or authorization, once valid.
+ */
+Acme.Client.prototype.poll_ = function(url, what) {
+  var client = this;
+  var attempt = function(n) {
+    return client.post_(url, null).then(function(res) {
+      var status = res.body.status;
+      if (status === 'valid') return res.body;
+      if (status === 'invalid') {
+        var problem = res.body.error ||
+            (res.body.challenges || []).map((c) => c.error).find(Boolean);
+        throw new Error('ACME ' + what + ' failed' +
+                        (problem ? ': ' + problem.detail : ''));
+      }
+      if (n >= client.maxPolls_) {
+        throw new Error('ACME ' + what + ' timed out (' + status + ')');
+      }
+      return new Promise(function(resolve) {
+        setTimeout(resolve, client.pollInterval_);
+      }).then(function() {
+        return attempt(n + 1);
+      });
+    });
+  };
+  return attempt(1);
+};
+
+/**
+ * Build a certificate signing request (PKCS #10, RFC 2986), with the
+ * hostnames as subject alternative names.
+ * @param {!Array<string>} hostnames Hostnames (the first also being
+ *     the subject's common name).
+ * @param {!crypto.KeyObject} key Private key (ECDSA or RSA).
+ * @return {!Buffer} The DER-encoded request.
+ */
+Acme.csr = function(hostnames, key) {
+  var spki = crypto.createPublicKey(key).export({type: 'spki', format: 'der'});
+  var san = Der.sequence(hostnames.map(function(hostname) {
+    return Der.context(2, Buffer.from(hostname, 'ascii'), false);  // dNSName
+  }));
+  var info = Der.sequence([
+    Der.integer(0),
+    Der.sequence([Der.set([Der.sequence([
+      Der.oid('2.5.4.3'),  // commonName
+      Der.utf8String(hostnames[0]),
+    ])])]),
+    spki,
+    Der.context(0, Der.sequence([
+      Der.oid('1.2.840.113549.1.9.14'),  // extensionRequest
+      Der.set([Der.sequence([Der.sequence([
+        Der.oid('2.5.29.17'),  // subjectAltName
+        Der.octetString(san),
+      ])])]),
+    ])),
+  ]);
+  var algorithm = (key.asymmetricKeyType === 'rsa') ?
+      Der.sequence([Der.oid('1.2.840.113549.1.1.11'), Der.NULL]) :
+      Der.sequence([Der.oid('1.2.840.10045.4.3.2')]);
+  return Der.sequence([info, algorithm,
+                       Der.bitString(crypto.sign('sha256', info, key))]);
+};
+
+/**
+ * Answers http-01 challenges: an HTTP request handler serving the key
+ * authorizations set on it (and 404 for anything else), which also
+ * serves as the Acme.ChallengeHandler.
+ * @constructor
+ */
+Acme.Responder = function() {
+  /** @private @const {!Map<string,string>} Key authorizations, by token. */
+  this.tokens_ = new Map();
+};
+
+/**
+ * Serve a key authorization.
+ * @param {string} token The challenge's token.
+ * @param {string} keyAuthorization The key authorization.
+ */
+Acme.Responder.prototype.set = function(token, keyAuthorization) {
+  this.tokens_.set(token, keyAuthorization);
+};
+
+/**
+ * Stop serving a key authorization.
+ * @param {string} token The challenge's token.
+ */
+Acme.Responder.prototype.remove = function(token) {
+  this.tokens_.delete(token);
+};
+
+/**
+ * Handle an HTTP request.
+ * @param {!http.IncomingMessage} req The request.
+ * @param {!http.ServerResponse} res The response.
+ */
+Acme.Responder.prototype.handle = function(req, res) {
+  var url = String(req.url);
+  var token = url.startsWith(Acme.CHALLENGE_PATH) ?
+      url.slice(Acme.CHALLENGE_PATH.length) : null;
+  if (req.method === 'GET' && token && this.tokens_.has(token)) {
+    res.writeHead(200, {'Content-Type': 'application/octet-stream'});
+    res.end(this.tokens_.get(token));
+  } else {
+    res.writeHead(404, {'Content-Type': 'text/plain'});
+    res.end('Not found');
+  }
+};
+
+/**
+ * Number of challenges being served.
+ * @type {number}
+ */
+Object.defineProperty(Acme.Responder.prototype, 'size', {
+  get: function() {
+    return this.tokens_.size;
+  }
+});
+
+module.exports = Acme;
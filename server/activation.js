@@ -0,0 +1,145 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Inheriting listening sockets, so that the server can be
+ * restarted (or upgraded) without ceasing to listen on its ports: while
+ * it is down, connections queue rather than being refused.
+ *
+ * Sockets are inherited as in systemd's socket activation protocol
+ * (see sd_listen_fds(3)): as file descriptors 3, 4, ... whose number
+ * is given by the LISTEN_FDS environment variable, and whose names are
+ * given, separated by colons, by LISTEN_FDNAMES.  Each must be named
+ * after the port it listens on: e.g., by being listened on by a systemd
+ * unit named codecity-7777.socket (see etc/codecity-7777.socket), or
+ * one with FileDescriptorName=7777.  It is then used by the main
+ * world's in-world listener (see CC.connectionListen) for that port.
+ *
+ * A running server can also hand its listening sockets over to a
+ * successor process in the same way (see CodeCity.handoff).  The
+ * successor waits for its predecessor (whose pid is given by the
+ * CODECITY_HANDOFF_PID environment variable) to save its final
+ * checkpoint and exit before loading the database.
+ */
+'use strict';
+
+var Activation = {};
+
+/**
+ * First file descriptor passed by the socket activation protocol.
+ * @const {number}
+ */
+Activation.FDS_START = 3;
+
+/**
+ * Environment variable giving the pid of the process handing its
+ * sockets over.
+ * @const {string}
+ */
+Activation.HANDOFF_PID = 'CODECITY_HANDOFF_PID';
+
+/**
+ * An inherited socket: its file descriptor, name, and the port it
+ * listens on (or null if that cannot be told from its name).
+ * @typedef {{fd: number, name: string, port: ?number}}
+ */
+Activation.Socket;
+
+/**
+ * Find the sockets passed to this process, and remove the environment
+ * variables describing them (so that they are not passed on to any
+ * child process).
+ * @param {!Object<string, string>} env The environment (e.g.,
+ *     process.env).
+ * @param {number} pid This process's pid.
+ * @return {!Array<!Activation.Socket>} The sockets.
+ */
+Activation.inherited = function(env, pid) {
+  var count = Number(env['LISTEN_FDS']);
+  var listenPid = env['LISTEN_PID'];
+  var names = (env['LISTEN_FDNAMES'] || '').split(':');
+  delete env['LISTEN_FDS'];
+  delete env['LISTEN_PID'];
+  delete env['LISTEN_FDNAMES'];
+  // Sockets are for the process named by LISTEN_PID, if given (and for
+  // the one CodeCity.handoff started, which cannot know its pid).
+  if (!(count > 0) ||
+      (listenPid !== undefined && Number(listenPid) !== pid)) {
+    return [];
+  }
+  var sockets = [];
+  for (var i = 0; i < count; i++) {
+    var name = names[i] || '';
+    var m = /(?:^|\D)(\d{1,5})(?:\.socket)?$/.exec(name);
+    var port = m ? Number(m[1]) : null;
+    sockets.push({fd: Activation.FDS_START + i, name: name,
+                  port: (port !== null && port <= 0xffff) ? port : null});
+  }
+  return sockets;
+};
+
+/**
+ * Compute the options with which to spawn a successor process to hand
+ * listening sockets over to.
+ * @param {!Map<number, number>} fds File descriptors of the sockets, by
+ *     port.
+ * @param {!Object<string, string>} env The environment to give it
+ *     (e.g., process.env), to which the variables describing the
+ *     sockets are added.
+ * @param {number} pid This process's pid.
+ * @return {{stdio: !Array<(string|number)>, env: !Object<string, string>}}
+ *     Options for child_process.spawn.
+ */
+Activation.handoffOptions = function(fds, env, pid) {
+  var stdio = ['inherit', 'inherit', 'inherit'];
+  var names = [];
+  fds.forEach(function(fd, port) {
+    stdio.push(fd);
+    names.push(String(port));
+  });
+  env = Object.assign({}, env);
+  delete env['LISTEN_PID'];
+  env['LISTEN_FDS'] = String(names.length);
+  env['LISTEN_FDNAMES'] = names.join(':');
+  env[Activation.HANDOFF_PID] = String(pid);
+  return {stdio: stdio, env: env};
+};
+
+/**
+ * Wait for a process to exit.
+ * @param {number} pid The process's pid.
+ * @param {number=} interval How often (in ms) to check (default 100).
+ * @return {!Promise<void>} Resolves once it has exited.
+ */
+Activation.waitForExit = function(pid, interval) {
+  return new Promise(function(resolve) {
+    (function check() {
+      try {
+        process.kill(pid, 0);  // Just checks whether it exists.
+      } catch (e) {
+        // ESRCH: it does not.  (EPERM would mean it does.)
+        if (e.code !== 'EPERM') {
+          resolve();
+          return;
+        }
+      }
+      setTimeout(check, interval || 100);
+    })();
+  });
+};
+
+module.exports = Activation;
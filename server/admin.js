@@ -0,0 +1,1572 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview An HTTP API for administering a running Code City,
+ * intended for external tools (editors, dashboards, bots and the
+ * like).  It is served on its own port, separate from any in-world
+ * listener, and every request must present one of the configured
+ * tokens as "Authorization: Bearer <token>".
+ *
+ * Requests and responses have JSON bodies; failed requests get a
+ * response of the form {"error": "<message>"}.  Objects are named by
+ * selectors (e.g., "$.physical.location"), and values are described as
+ * by Admin.describeValue.  Routes:
+ *
+ * GET /objects?search=<text>&limit=<n>: list objects whose selectors
+ *     contain text.
+ * GET /object?selector=<s>: describe an object and its properties.
+ * PATCH /object?selector=<s>: set or delete properties of an object:
+ *     the body is {"properties": {<name>: <spec>|null, ...}}, where
+ *     each spec is {"value": <JSON value>}, {"selector": <s>} or
+ *     {"type": "undefined"}, and null deletes the property.
+ * POST /eval: evaluate {"src": <code>, "owner": <s>} as owner (by
+ *     default root), in a new thread.
+ * GET /heap/inbound?selector=<s>&limit=<n>: list the references to an
+ *     object (from roots and from reachable objects, scopes and
+ *     threads; see Heap).
+ * GET /heap/paths?selector=<s>&limit=<n>: list the shortest paths from
+ *     roots to an object, i.e. why it is not garbage.
+ * GET /heap/retained?selector=<s>: estimate how much would become
+ *     garbage if nothing referred to an object.
+ * GET /audits, POST /audits, DELETE /audits?selector=<s>&property=<p>:
+ *     list, add ({"selector": <s>, "property": <p>}) and remove audits
+ *     of accesses to a property of an object (or, with no property
+ *     given, all its properties).
+ * GET /audits/log?selector=<s>&property=<p>&limit=<n>: list the most
+ *     recent recorded accesses to audited properties (optionally only
+ *     those of an object, or of one of its properties), oldest first,
+ *     each with the acting owner and call stack.
+ * GET /security?after=<id>&type=<t>&limit=<n>: list the most recent
+ *     security events (see Interpreter.prototype.getSecurityEvents),
+ *     optionally only those after a given ID or of a given type, oldest
+ *     first.
+ * GET /threads: list threads that have not yet finished.
+ * GET /stats: a snapshot of resource usage (see Stats.Recorder): the
+ *     scheduler, memory, connections, checkpoints and each owner's
+ *     objects and threads, with rates, averages and maxima over recent
+ *     time windows.
+ * GET /slow?limit=<n>: list the most recent slow tasks and long
+ *     scheduler pauses (see Interpreter.prototype.getSlowLog), oldest
+ *     first, with samples of slow tasks' call stacks.
+ * POST /checkpoint: begin saving a checkpoint.
+ * GET /checkpoints: list saved checkpoints.
+ * POST /shutdown: shut down {"exitCode": <n>} gracefully (see
+ *     CodeCity.shutdown), once the response has been sent.
+ * POST /handoff: start a successor process, handing it the listening
+ *     sockets (see CodeCity.handoff), then shut down gracefully once the
+ *     response (giving its "pid") has been sent.
+ * POST /config/reload: reload the configuration file, applying the
+ *     changes that can be applied without a restart; responds with the
+ *     names of the options changed that were ("applied") and were not
+ *     ("restartRequired") applied.
+ * GET /log/levels, POST /log/levels: get and set ({"subsystem": <s>,
+ *     "level": <l>}) the minimum levels of the server log (see
+ *     Logging.Logger), the subsystem being omitted to set the level of
+ *     the log as a whole, and the level null to revert a subsystem to
+ *     that of the log as a whole.
+ * POST /restore: restore {"checkpoint": <name>} or {"time": <ms>}, then
+ *     restart.
+ * GET /bans, POST /bans, DELETE /bans?network=<network>: list, add and
+ *     remove bans.
+ * GET /worlds, POST /worlds, DELETE /worlds?name=<name>: list, add
+ *     ({"name": <name>, "directory": <dir>, "startup": <dir>}, the
+ *     directories being relative to the configuration file's, and
+ *     startup optional) and remove (once stopped) hosted worlds (see
+ *     Worlds).
+ * POST /worlds/start, POST /worlds/stop: start and stop {"name":
+ *     <name>} a hosted world.
+ * GET /breakpoints, POST /breakpoints, DELETE /breakpoints?id=<n>: list,
+ *     set ({"selector": <s>, "line": <n>}, the line being optional) and
+ *     remove debugger breakpoints.
+ * GET /watchpoints, POST /watchpoints, DELETE /watchpoints?id=<n>: list,
+ *     set ({"selector": <s>, "property": <p>}) and remove watchpoints,
+ *     which pause any thread that writes to the property.
+ * POST /coverage/start, POST /coverage/stop: start (discarding what
+ *     was previously collected) and stop collecting statement coverage.
+ * GET /coverage?owner=<s>: list the statement coverage of each function
+ *     executed (optionally only those of an owner, in which case its
+ *     named functions that were not executed are listed too): each
+ *     statement's line, column and execution count.
+ * POST /debug/pause, POST /debug/resume: pause {"thread": <id>} (just
+ *     before the next statement it executes), or resume a paused one
+ *     ({"thread": <id>, "mode": <m>}, where the mode is "continue"
+ *     (the default), "into", "over" or "out").
+ * GET /debug/frames?thread=<id>: describe the call stack of a paused
+ *     thread, with each frame's variables.
+ * POST /debug/eval: evaluate {"thread": <id>, "frame": <n>, "src":
+ *     <code>} in a new thread, in the scope of a frame of a paused
+ *     thread (by default the innermost).
+ * GET /json/version, GET /json/list: describe the server, and the
+ *     (one) debugging target, for Chrome DevTools Protocol clients.
+ * GET /adminlog?limit=<n>: list the most recent entries in the admin
+ *     log, oldest first.
+ * GET /adminlog/verify: check that the admin log has not been tampered
+ *     with (see AdminLog.verify).
+ *
+ * If an admin log is given (see AdminLog), every request other than a
+ * GET, and every DevTools session, is recorded in it, with the client's
+ * address and which token it presented (by its position in the list of
+ * tokens, counting from 1).
+ *
+ * WebSocket connections to /devtools are Chrome DevTools Protocol
+ * sessions (see DevTools.Session).  Since browsers cannot send an
+ * Authorization header with a WebSocket request, the token may instead
+ * be given as a query parameter (/devtools?token=<token>).  GET
+ * /json/list gives the URL to connect to, and a devtools:// URL to open
+ * in Chrome to do so.
+ */
+'use strict';
+
+var AdminLog = require('./adminlog');
+var crypto = require('crypto');
+var DevTools = require('./devtools');
+var Heap = require('./heap');
+var http = require('http');
+var Interpreter = require('./interpreter');
+var Logging = require('./logging');
+var Package = require('./package');
+var RateLimit = require('./ratelimit');
+var WebSocket = require('./websocket');
+var Worlds = require('./worlds');
+
+var Admin = {};
+
+/**
+ * Maximum size (in bytes) of a request body.
+ * @const {number}
+ */
+Admin.MAX_BODY = 1024 * 1024;
+
+/**
+ * Time (in ms) to wait for an evaluation to finish before responding
+ * that it timed out.  (The thread continues to run regardless.)
+ * @const {number}
+ */
+Admin.EVAL_TIMEOUT = 30 * 1000;
+
+/**
+ * Default maximum number of objects returned by a search.
+ * @const {number}
+ */
+Admin.SEARCH_LIMIT = 100;
+
+/**
+ * Default maximum number of references or paths returned by a heap
+ * query.
+ * @const {number}
+ */
+Admin.HEAP_LIMIT = 20;
+
+/**
+ * An error to be reported to the client with a given HTTP status.
+ * @constructor
+ * @extends {Error}
+ * @param {number} status The HTTP status code.
+ * @param {string} message The error message.
+ * @param {!Object<string, string>=} headers Headers to send with the
+ *     response.
+ */
+Admin.HttpError = function(status, message, headers) {
+  this.name = 'HttpError';
+  this.message = message;
+  /** @const {number} */
+  this.status = status;
+  /** @const {!Object<string, string>|undefined} */
+  this.headers = headers;
+};
+Admin.HttpError.prototype = Object.create(Error.prototype);
+Admin.HttpError.prototype.constructor = Admin.HttpError;
+
+/**
+ * A set of tokens that clients may present to authenticate themselves.
+ * @constructor
+ * @struct
+ * @param {!Array<string>} tokens The tokens.
+ */
+Admin.Tokens = function(tokens) {
+  if (!tokens || !tokens.length) {
+    throw new TypeError('At least one admin token is required');
+  }
+  /** @private @const {!Array<!Buffer>} Hashes of the tokens. */
+  this.hashes_ = tokens.map(Admin.Tokens.hash_);
+};
+
+/**
+ * Check an Authorization header.
+ * @param {string|undefined} header The header's value.
+ * @return {boolean} True iff it presents one of the tokens.
+ */
+Admin.Tokens.prototype.check = function(header) {
+  return this.identify(header) !== -1;
+};
+
+/**
+ * Find which token an Authorization header presents.
+ * @param {string|undefined} header The header's value.
+ * @return {number} The index of the token presented, or -1 if none.
+ */
+Admin.Tokens.prototype.identify = function(header) {
+  var m = /^Bearer\s+(\S+)\s*$/i.exec(header || '');
+  if (!m) return -1;
+  var hash = Admin.Tokens.hash_(m[1]);
+  var found = -1;
+  // Compare with every token, in constant time.
+  for (var i = 0; i < this.hashes_.length; i++) {
+    if (crypto.timingSafeEqual(hash, this.hashes_[i])) found = i;
+  }
+  return found;
+};
+
+/**
+ * Hash a token, for comparison in constant time.
+ * @private
+ * @param {string} token The token.
+ * @return {!Buffer} Its SHA-256 hash.
+ */
+Admin.Tokens.hash_ = function(token) {
+  return crypto.createHash('sha256').update(token).digest();
+};
+
+/**
+ * A request, as passed to route handlers.  .afterResponse may be set by
+ * the handler to a function to be called once the response has been
+ * sent.
+ * @typedef {{method: string,
+ *            path: string,
+ *            query: !URLSearchParams,
+ *            headers: !Object<string, (string|!Array<string>)>,
+ *            body: *,
+ *            remoteAddress: (string|undefined),
+ *            afterResponse: ?function()}}
+ */
+Admin.Request;
+
+/**
+ * A route handler.  Returns the response body (which will be sent as
+ * JSON), or a promise of it, or throws (or rejects with) an
+ * Admin.HttpError.
+ * @typedef {function(!Admin.Request): *}
+ */
+Admin.Handler;
+
+/**
+ * Options for an Admin.Server.
+ *
+ * - tokens: the tokens that clients may present.
+ * - interpreter: the Interpreter to be administered.
+ * - checkpoint, catalog, restore: functions to save a checkpoint, list
+ *   saved checkpoints and restore one (by name or time), as
+ *   CodeCity.checkpoint, .catalog, .restore and .restoreToTime.  If
+ *   omitted, the corresponding routes respond 501 (Not Implemented).
+ * - reloadConfig, shutdown, handoff: functions to reload the
+ *   configuration file, to shut down and to start a successor process,
+ *   as CodeCity.reloadConfig, .shutdown and .handoff (likewise).
+ * - limiter: rate limiter for failed authentication attempts (using its
+ *   'login' policy).  By default a new one, without exemptions.
+ * - worlds: the manager of hosted worlds.  If omitted, the /worlds
+ *   routes respond 501 (Not Implemented).
+ * - stats: function making a snapshot of resource usage, as
+ *   CodeCity.stats.  If omitted, GET /stats responds 501 (Not
+ *   Implemented).
+ * - logger: the log whose levels are got and set by /log/levels.  By
+ *   default, the server log (Logging.server).
+ * - adminLog: the log in which to record requests (see above).  If
+ *   omitted, they are not recorded, and the /adminlog routes respond
+ *   501 (Not Implemented).
+ * @typedef {{tokens: !Array<string>,
+ *            interpreter: !Interpreter,
+ *            checkpoint: (function()|undefined),
+ *            reloadConfig: (function(): {applied: !Array<string>,
+ *                restartRequired: !Array<string>}|undefined),
+ *            shutdown: (function(number)|undefined),
+            handoff: (function(): !Promise<number>|undefined),
+ *            catalog: (function(): !Array<!Object>|undefined),
+ *            restore: (function((string|number))|undefined),
+ *            limiter: (!RateLimit.Limiter|undefined),
+ *            worlds: (?Worlds.Manager|undefined),
+            stats: (function(): ?Object|undefined),
+            logger: (!Logging.Logger|undefined),
+            adminLog: (?AdminLog.Log|undefined)}}
+ */
+Admin.Options;
+
+/**
+ * An admin API server.
+ * @constructor
+ * @struct
+ * @param {!Admin.Options} options Options.
+ */
+Admin.Server = function(options) {
+  /** @private @const {!Admin.Tokens} */
+  this.tokens_ = new Admin.Tokens(options.tokens);
+  /** @const {!Interpreter} */
+  this.intrp = options.interpreter;
+  /** @private @const {!Admin.Options} */
+  this.options_ = options;
+  /** @private @const {!RateLimit.Limiter} */
+  this.limiter_ = options.limiter || new RateLimit.Limiter({exempt: []});
+  /**
+   * Route handlers, by path then method.
+   * @private @const {!Map<string, !Map<string, !Admin.Handler>>}
+   */
+  this.routes_ = new Map();
+  /** @private @const {!DevTools.Server} */
+  this.devtools_ = new DevTools.Server(this.intrp);
+  /** @private @const {!http.Server} */
+  this.server_ = http.createServer(this.handle_.bind(this));
+  this.server_.on('upgrade', this.upgrade_.bind(this));
+  this.addRoutes_();
+};
+
+/**
+ * Add (or replace) a route.
+ * @param {string} method The HTTP method (e.g., 'GET').
+ * @param {string} path The path (e.g., '/objects').
+ * @param {!Admin.Handler} handler The handler.
+ */
+Admin.Server.prototype.route = function(method, path, handler) {
+  if (!this.routes_.has(path)) this.routes_.set(path, new Map());
+  this.routes_.get(path).set(method, handler);
+};
+
+/**
+ * Start listening for requests.
+ * @param {number} port The port to listen on.
+ * @param {string=} host The address to listen on (default: all).
+ * @return {!Promise<number>} Resolves to the port listened on (useful
+ *     if port was 0) once listening.
+ */
+Admin.Server.prototype.listen = function(port, host) {
+  var server = this.server_;
+  return new Promise(function(resolve, reject) {
+    server.once('error', reject);
+    server.listen(port, host, function() {
+      server.removeListener('error', reject);
+      resolve(server.address().port);
+    });
+  });
+};
+
+/**
+ * Stop listening for requests.
+ * @return {!Promise<void>} Resolves once all connections have closed.
+ */
+Admin.Server.prototype.close = function() {
+  var server = this.server_;
+  var promise = new Promise(function(resolve) {
+    server.close(function() {resolve();});
+  });
+  this.devtools_.close();
+  return promise;
+};
+
+/**
+ * Check that a client has presented one of the tokens, and is not
+ * locked out for having presented wrong ones too often.
+ * @private
+ * @param {string|undefined} header The Authorization header sent.
+ * @param {string|undefined} address The client's address.
+ * @return {number} The index of the token presented.
+ * @throws {!Admin.HttpError} If it is not authenticated.
+ */
+Admin.Server.prototype.authenticate_ = function(header, address) {
+  var locked = this.limiter_.check('login', address);
+  if (locked) {
+    throw new Admin.HttpError(429, 'Too many failed attempts',
+        {'Retry-After': String(Math.ceil(locked / 1000))});
+  }
+  var index = this.tokens_.identify(header);
+  if (index === -1) {
+    this.limiter_.record('login', address);
+    throw new Admin.HttpError(401, 'Missing or invalid token',
+                              {'WWW-Authenticate': 'Bearer'});
+  }
+  this.limiter_.reset('login', address);
+  return index;
+};
+
+/**
+ * Record an authenticated request in the admin log, if there is one.
+ * Failure to record it is logged, but not thrown.
+ * @private
+ * @param {number} index The index of the token presented.
+ * @param {!Object} details Details of the request.
+ */
+Admin.Server.prototype.record_ = function(index, details) {
+  if (!this.options_.adminLog) return;
+  try {
+    this.options_.adminLog.record('admin token ' + (index + 1), 'admin',
+                                  details);
+  } catch (e) {
+    this.intrp.log('admin', 'Unable to record admin request: %s', e);
+  }
+};
+
+/**
+ * Handle an HTTP request: authenticate it, read its body and dispatch
+ * it to the route's handler, then send the handler's result.
+ * @private
+ * @param {!http.IncomingMessage} req The request.
+ * @param {!http.ServerResponse} res The response.
+ */
+Admin.Server.prototype.handle_ = function(req, res) {
+  var server = this;
+  var address = req.socket.remoteAddress;
+  var url = new URL(req.url, 'http://localhost');
+  var request = {
+    method: req.method,
+    path: url.pathname,
+    query: url.searchParams,
+    headers: req.headers,
+    body: undefined,
+    remoteAddress: address,
+    afterResponse: null,
+  };
+  var index = -1;
+  var reply = function(status, body, headers) {
+    server.intrp.log('admin', 'Admin %s %s from %s: %d',
+                     req.method, req.url, address, status);
+    if (index !== -1 && req.method !== 'GET') {
+      server.record_(index, {
+        method: req.method,
+        path: req.url,
+        body: request.body === undefined ? null : request.body,
+        address: address,
+        status: status,
+      });
+    }
+    res.writeHead(status, Object.assign({
+      'Content-Type': 'application/json; charset=utf-8',
+      'Cache-Control': 'no-store',
+    }, headers));
+    res.end(JSON.stringify(body === undefined ? {} : body) + '\n',
+            request.afterResponse || undefined);
+  };
+  var fail = function(e) {
+    if (e instanceof Admin.HttpError) {
+      reply(e.status, {error: e.message}, e.headers);
+    } else {
+      request.afterResponse = null;
+      reply(500, {error: String(e)});
+    }
+  };
+
+  try {
+    index = this.authenticate_(req.headers['authorization'], address);
+  } catch (e) {
+    req.resume();
+    fail(e);
+    return;
+  }
+  var methods = this.routes_.get(request.path);
+  if (!methods) {
+    req.resume();
+    fail(new Admin.HttpError(404, 'No such route: ' + request.path));
+    return;
+  }
+  var handler = methods.get(req.method);
+  if (!handler) {
+    req.resume();
+    reply(405, {error: 'Method not allowed'},
+          {'Allow': Array.from(methods.keys()).join(', ')});
+    return;
+  }
+  Admin.readBody_(req).then(function(body) {
+    request.body = body;
+    return handler.call(server, request);
+  }).then(function(result) {
+    reply(request.method === 'POST' && result === undefined ? 202 : 200,
+          result);
+  }).catch(fail);
+};
+
+/**
+ * Handle a request to upgrade a connection to the WebSocket protocol:
+ * authenticate it (by its Authorization header or token parameter),
+ * and accept it as a DevTools session.
+ * @private
+ * @param {!http.IncomingMessage} req The request.
+ * @param {!net.Socket} socket The connection.
+ * @param {!Buffer} head Data received after the request.
+ */
+Admin.Server.prototype.upgrade_ = function(req, socket, head) {
+  var address = req.socket.remoteAddress;
+  var url = new URL(req.url, 'http://localhost');
+  var token = url.searchParams.get('token');
+  var status = 101;
+  var index = -1;
+  try {
+    index = this.authenticate_(
+        token ? 'Bearer ' + token : req.headers['authorization'], address);
+    if (url.pathname !== '/devtools') {
+      throw new Admin.HttpError(404, 'No such route: ' + url.pathname);
+    } else if (String(req.headers['upgrade']).toLowerCase() !==
+               'websocket' ||
+               req.headers['sec-websocket-version'] !== '13' ||
+               Buffer.from(String(req.headers['sec-websocket-key']),
+                           'base64').length !== 16) {
+      throw new Admin.HttpError(400, 'Bad WebSocket request');
+    }
+  } catch (e) {
+    status = e.status || 500;
+    WebSocket.reject(socket, status, e.message);
+  }
+  // N.B.: the URL may include a token, so only its path is logged.
+  this.intrp.log('admin', 'Admin %s %s (WebSocket) from %s: %d',
+                 req.method, url.pathname, address, status);
+  if (status !== 101) return;
+  this.record_(index, {
+    method: req.method,
+    path: url.pathname,
+    body: null,
+    address: address,
+    status: status,
+  });
+  this.devtools_.accept(socket, {
+    method: String(req.method),
+    url: String(req.url),
+    headers: /** @type {!Object<string, string>} */(req.headers),
+  }, head);
+};
+
+/**
+ * Add the standard routes.
+ * @private
+ */
+Admin.Server.prototype.addRoutes_ = function() {
+  var intrp = this.intrp;
+  var options = this.options_;
+
+  this.route('GET', '/objects', function(request) {
+    var search = (request.query.get('search') || '').toLowerCase();
+    var limit = Admin.limit_(request, Admin.SEARCH_LIMIT);
+    var objects = [];
+    var truncated = false;
+    Package.findNames(intrp).forEach(function(selector, obj) {
+      if (!selector.toLowerCase().includes(search)) return;
+      if (objects.length >= limit) {
+        truncated = true;
+        return;
+      }
+      objects.push({selector: selector, class: obj.class});
+    });
+    return {objects: objects, truncated: truncated};
+  });
+
+  this.route('GET', '/object', function(request) {
+    return Admin.describeObject(intrp, this.lookup_(request),
+                                Package.findNames(intrp));
+  });
+
+  this.route('PATCH', '/object', function(request) {
+    var obj = this.lookup_(request);
+    var properties = request.body && request.body['properties'];
+    if (typeof properties !== 'object' || properties === null) {
+      throw new Admin.HttpError(400, 'Body must have properties object');
+    }
+    // Convert all the values before changing anything.
+    var values = new Map();
+    for (var key in properties) {
+      values.set(key, (properties[key] === null) ? null :
+          Admin.valueFromSpec(intrp, properties[key]));
+    }
+    values.forEach(function(value, key) {
+      try {
+        if (value === null) {
+          obj.deleteProperty(key, intrp.ROOT);
+        } else {
+          obj.set(key, value.value, intrp.ROOT);
+        }
+      } catch (e) {
+        var message = (e instanceof intrp.Object) ?
+            e.get('message', intrp.ROOT) : e;
+        throw new Admin.HttpError(409,
+            'Unable to modify ' + key + ': ' + String(message));
+      }
+    });
+    return Admin.describeObject(intrp, obj, Package.findNames(intrp));
+  });
+
+  this.route('GET', '/heap/inbound', function(request) {
+    var obj = this.lookup_(request);
+    var result = Heap.inbound(intrp, obj, Admin.limit_(request,
+                                                       Admin.HEAP_LIMIT));
+    var names = Package.findNames(intrp);
+    return {
+      references: result.references.map(function(ref) {
+        return {
+          from: ref.from && Admin.describeNode_(intrp, ref.from, names),
+          name: ref.name,
+        };
+      }),
+      truncated: result.truncated,
+    };
+  });
+
+  this.route('GET', '/heap/paths', function(request) {
+    var obj = this.lookup_(request);
+    var result = Heap.paths(intrp, obj, Admin.limit_(request,
+                                                     Admin.HEAP_LIMIT));
+    var names = Package.findNames(intrp);
+    return {
+      paths: result.paths.map(function(path) {
+        return path.map(function(ref) {
+          return {name: ref.name,
+                  to: Admin.describeNode_(intrp, ref.value, names)};
+        });
+      }),
+      truncated: result.truncated,
+    };
+  });
+
+  this.route('GET', '/heap/retained', function(request) {
+    return Heap.retained(intrp, this.lookup_(request));
+  });
+
+  this.route('GET', '/audits', function(request) {
+    var names = Package.findNames(intrp);
+    return {audits: intrp.getAudits().map(function(audit) {
+      return {object: Admin.describeValue(intrp, audit.object, names),
+              properties: audit.keys};
+    })};
+  });
+
+  this.route('POST', '/audits', function(request) {
+    var body = request.body || {};
+    var obj = Admin.lookup_(intrp, body['selector']);
+    var key = body['property'];
+    if (key !== undefined && typeof key !== 'string') {
+      throw new Admin.HttpError(400, 'Property must be a string');
+    }
+    intrp.audit(obj, key);
+    return {object: Admin.describeValue(intrp, obj, Package.findNames(intrp)),
+            property: (key === undefined) ? null : key};
+  });
+
+  this.route('DELETE', '/audits', function(request) {
+    var key = request.query.get('property');
+    return {removed: intrp.unaudit(this.lookup_(request),
+                                   (key === null) ? undefined : key)};
+  });
+
+  this.route('GET', '/audits/log', function(request) {
+    var obj = request.query.has('selector') ? this.lookup_(request) : null;
+    var key = request.query.get('property');
+    var limit = Admin.limit_(request, Admin.SEARCH_LIMIT);
+    var records = intrp.getAuditLog(obj, (key === null) ? undefined : key);
+    var names = Package.findNames(intrp);
+    return {
+      records: records.slice(-limit).map(function(record) {
+        return Admin.describeAuditRecord(intrp, record, names);
+      }),
+      truncated: records.length > limit,
+    };
+  });
+
+  this.route('GET', '/security', function(request) {
+    var after;
+    if (request.query.has('after')) {
+      after = Number(request.query.get('after'));
+      if (!Number.isInteger(after)) {
+        throw new Admin.HttpError(400, 'Invalid after');
+      }
+    }
+    var type = request.query.get('type');
+    var limit = Admin.limit_(request, Admin.SEARCH_LIMIT);
+    var events = intrp.getSecurityEvents(after, (type === null) ?
+        undefined : /** @type {!Interpreter.SecurityEventType} */(type));
+    var names = Package.findNames(intrp);
+    return {
+      events: events.slice(-limit).map(function(event) {
+        return Admin.describeSecurityEvent(intrp, event, names);
+      }),
+      truncated: events.length > limit,
+    };
+  });
+
+  this.route('POST', '/eval', function(request) {
+    var body = request.body || {};
+    if (typeof body['src'] !== 'string') {
+      throw new Admin.HttpError(400, 'Body must have src string');
+    }
+    var owner = intrp.ROOT;
+    if (body['owner'] !== undefined) {
+      owner = Admin.lookup_(intrp, body['owner']);
+    }
+    return Admin.evaluate(intrp, body['src'], owner, Admin.EVAL_TIMEOUT);
+  });
+
+  this.route('GET', '/threads', function(request) {
+    var names = Package.findNames(intrp);
+    return {threads: intrp.getThreads().map(function(thread) {
+      return Admin.describeThread(intrp, thread, names);
+    })};
+  });
+
+  this.route('GET', '/stats', function(request) {
+    if (!options.stats) {
+      throw new Admin.HttpError(501, 'Statistics not available');
+    }
+    var stats = options.stats();
+    if (!stats) throw new Admin.HttpError(503, 'Not yet started');
+    return stats;
+  });
+
+  this.route('GET', '/slow', function(request) {
+    var limit = Admin.limit_(request, Admin.SEARCH_LIMIT);
+    var records = intrp.getSlowLog();
+    var names = Package.findNames(intrp);
+    return {
+      records: records.slice(-limit).map(function(record) {
+        return Admin.describeSlowRecord(intrp, record, names);
+      }),
+      truncated: records.length > limit,
+    };
+  });
+
+  this.route('POST', '/checkpoint', function(request) {
+    if (!options.checkpoint) {
+      throw new Admin.HttpError(501, 'Checkpoints not available');
+    }
+    options.checkpoint();
+  });
+
+  this.route('GET', '/checkpoints', function(request) {
+    if (!options.catalog) {
+      throw new Admin.HttpError(501, 'Checkpoints not available');
+    }
+    return {checkpoints: options.catalog()};
+  });
+
+  this.route('POST', '/shutdown', function(request) {
+    var body = request.body || {};
+    var code = ('exitCode' in body) ? body['exitCode'] : 0;
+    if (typeof code !== 'number') {
+      throw new Admin.HttpError(400, 'exitCode must be a number');
+    }
+    if (!options.shutdown) {
+      throw new Admin.HttpError(501, 'Shutdown not available');
+    }
+    request.afterResponse = function() {
+      options.shutdown(code);
+    };
+  });
+
+  this.route('POST', '/handoff', function(request) {
+    if (!options.handoff || !options.shutdown) {
+      throw new Admin.HttpError(501, 'Handoff not available');
+    }
+    return options.handoff().then(function(pid) {
+      request.afterResponse = function() {
+        options.shutdown(0);
+      };
+      return {pid: pid};
+    }, function(e) {
+      throw new Admin.HttpError(500, 'Unable to start successor: ' +
+                                e.message);
+    });
+  });
+
+  this.route('POST', '/config/reload', function(request) {
+    if (!options.reloadConfig) {
+      throw new Admin.HttpError(501, 'Configuration reload not available');
+    }
+    try {
+      return options.reloadConfig();
+    } catch (e) {
+      throw new Admin.HttpError(400, e.message);
+    }
+  });
+
+  var logger = options.logger || Logging.server;
+
+  this.route('GET', '/log/levels', function(request) {
+    return logger.getLevels();
+  });
+
+  this.route('POST', '/log/levels', function(request) {
+    var body = request.body || {};
+    var subsystem = ('subsystem' in body) ? body['subsystem'] : null;
+    var level = body['level'];
+    if (subsystem !== null && typeof subsystem !== 'string') {
+      throw new Admin.HttpError(400, 'subsystem must be a string');
+    } else if (level !== null && typeof level !== 'string') {
+      throw new Admin.HttpError(400, 'level must be a string or null');
+    }
+    try {
+      logger.setLevel(subsystem, level);
+    } catch (e) {
+      throw new Admin.HttpError(400, e.message);
+    }
+    intrp.log('admin', 'Log level of %s set to %s.', subsystem || 'all',
+              level || 'default');
+    return logger.getLevels();
+  });
+
+  this.route('POST', '/restore', function(request) {
+    var body = request.body || {};
+    var point = ('time' in body) ? body['time'] : body['checkpoint'];
+    if (typeof point !== 'string' && typeof point !== 'number') {
+      throw new Admin.HttpError(400, 'Body must have checkpoint or time');
+    }
+    if (!options.restore || !options.catalog) {
+      throw new Admin.HttpError(501, 'Checkpoints not available');
+    }
+    if (!options.catalog().some(function(p) {
+      return (typeof point === 'number') ? p.time <= point : p.name === point;
+    })) {
+      throw new Admin.HttpError(404, 'No such checkpoint');
+    }
+    // Restoring restarts the server, so only once the client knows.
+    request.afterResponse = function() {
+      options.restore(point);
+    };
+  });
+
+  this.route('GET', '/breakpoints', function(request) {
+    var names = Package.findNames(intrp);
+    return {breakpoints: intrp.getBreakpoints().map(function(breakpoint) {
+      return Admin.describeBreakpoint(intrp, breakpoint, names);
+    })};
+  });
+
+  this.route('POST', '/breakpoints', function(request) {
+    var body = request.body || {};
+    var func = Admin.lookup_(intrp, body['selector']);
+    try {
+      var breakpoint = intrp.setBreakpoint(func, body['line']);
+    } catch (e) {
+      throw new Admin.HttpError(400, e.message);
+    }
+    return Admin.describeBreakpoint(intrp, breakpoint,
+                                    Package.findNames(intrp));
+  });
+
+  this.route('DELETE', '/breakpoints', function(request) {
+    return {removed: intrp.clearBreakpoint(
+        Number(request.query.get('id')))};
+  });
+
+  this.route('GET', '/watchpoints', function(request) {
+    var names = Package.findNames(intrp);
+    return {watchpoints: intrp.getWatchpoints().map(function(watchpoint) {
+      return Admin.describeWatchpoint(intrp, watchpoint, names);
+    })};
+  });
+
+  this.route('POST', '/watchpoints', function(request) {
+    var body = request.body || {};
+    var obj = Admin.lookup_(intrp, body['selector']);
+    if (typeof body['property'] !== 'string') {
+      throw new Admin.HttpError(400, 'Body must have property string');
+    }
+    return Admin.describeWatchpoint(intrp,
+        intrp.setWatchpoint(obj, body['property']), Package.findNames(intrp));
+  });
+
+  this.route('DELETE', '/watchpoints', function(request) {
+    return {removed: intrp.clearWatchpoint(
+        Number(request.query.get('id')))};
+  });
+
+  this.route('POST', '/coverage/start', function(request) {
+    intrp.startCoverage();
+    return {collecting: true};
+  });
+
+  this.route('POST', '/coverage/stop', function(request) {
+    intrp.stopCoverage();
+    return {collecting: false};
+  });
+
+  this.route('GET', '/coverage', function(request) {
+    var owner = request.query.has('owner') ?
+        Admin.lookup_(intrp, request.query.get('owner')) : undefined;
+    var names = Package.findNames(intrp);
+    var coverage = intrp.getCoverage(owner);
+    if (owner !== undefined) {
+      // Include the owner's (named) functions that were never executed.
+      var executed = new Set(coverage.map(function(c) {return c.func;}));
+      names.forEach(function(name, obj) {
+        if (obj instanceof intrp.UserFunction && obj.owner === owner &&
+            !executed.has(obj)) {
+          coverage.push(intrp.getFunctionCoverage(obj));
+        }
+      });
+    }
+    return {
+      collecting: intrp.isCollectingCoverage(),
+      functions: coverage.map(function(c) {
+        return Admin.describeCoverage(intrp, c, names);
+      }),
+    };
+  });
+
+  this.route('POST', '/debug/pause', function(request) {
+    var id = Admin.threadId_(request.body && request.body['thread']);
+    if (!intrp.pauseThread(id)) {
+      throw new Admin.HttpError(404, 'No such thread: ' + id);
+    }
+    return Admin.describeThread(intrp, Admin.pausedThread_(intrp, id, false),
+                                Package.findNames(intrp));
+  });
+
+  this.route('POST', '/debug/resume', function(request) {
+    var body = request.body || {};
+    var id = Admin.threadId_(body['thread']);
+    var thread = Admin.pausedThread_(intrp, id, true);
+    var mode = (body['mode'] === undefined) ? 'continue' : body['mode'];
+    try {
+      intrp.resumeThread(id, mode);
+    } catch (e) {
+      throw new Admin.HttpError(400, e.message);
+    }
+    return Admin.describeThread(intrp, thread, Package.findNames(intrp));
+  });
+
+  this.route('GET', '/debug/frames', function(request) {
+    var id = Admin.threadId_(request.query.get('thread'));
+    Admin.pausedThread_(intrp, id, true);
+    var names = Package.findNames(intrp);
+    return {frames: intrp.getFrames(id).map(function(frame) {
+      return Admin.describeDebugFrame(intrp, frame, names);
+    })};
+  });
+
+  this.route('POST', '/debug/eval', function(request) {
+    var body = request.body || {};
+    var id = Admin.threadId_(body['thread']);
+    var index = (body['frame'] === undefined) ? 0 : body['frame'];
+    if (typeof body['src'] !== 'string') {
+      throw new Admin.HttpError(400, 'Body must have src string');
+    }
+    Admin.pausedThread_(intrp, id, true);
+    try {
+      var wrapper = intrp.evalInFrame(id, index, body['src']);
+    } catch (e) {
+      throw new Admin.HttpError(400, String(e));
+    }
+    return Admin.awaitThread(intrp, wrapper.thread, Admin.EVAL_TIMEOUT);
+  });
+
+  var target = function(request) {
+    var host = String(request.headers['host'] || 'localhost');
+    var m = /^Bearer\s+(\S+)\s*$/i.exec(
+        String(request.headers['authorization']));
+    var path = host + '/devtools?token=' + encodeURIComponent(m[1]);
+    return {
+      id: 'codecity',
+      type: 'node',
+      title: 'Code City',
+      description: 'Code City',
+      url: DevTools.URL_PREFIX,
+      webSocketDebuggerUrl: 'ws://' + path,
+      devtoolsFrontendUrl: 'devtools://devtools/bundled/js_app.html?ws=' +
+          encodeURIComponent(path),
+    };
+  };
+
+  this.route('GET', '/json/version', function(request) {
+    return {
+      'Browser': 'CodeCity',
+      'Protocol-Version': '1.3',
+      'webSocketDebuggerUrl': target(request).webSocketDebuggerUrl,
+    };
+  });
+
+  this.route('GET', '/json/list', function(request) {
+    return [target(request)];
+  });
+  this.route('GET', '/json', function(request) {
+    return [target(request)];
+  });
+
+  this.route('GET', '/bans', function(request) {
+    return {bans: intrp.getBans()};
+  });
+
+  this.route('POST', '/bans', function(request) {
+    var body = request.body || {};
+    var expires = (body['expires'] === undefined) ? null : body['expires'];
+    if (typeof body['network'] !== 'string' ||
+        (expires !== null && typeof expires !== 'number')) {
+      throw new Admin.HttpError(400,
+          'Body must have network string and optional expires time');
+    }
+    try {
+      return {network: intrp.ban(body['network'],
+                                 String(body['reason'] || ''), expires)};
+    } catch (e) {
+      throw new Admin.HttpError(400, e.message);
+    }
+  });
+
+  this.route('DELETE', '/bans', function(request) {
+    try {
+      return {removed: intrp.unban(request.query.get('network') || '')};
+    } catch (e) {
+      throw new Admin.HttpError(400, e.message);
+    }
+  });
+
+  var worlds = function() {
+    if (!options.worlds) {
+      throw new Admin.HttpError(501, 'Hosted worlds not available');
+    }
+    return options.worlds;
+  };
+  var world = function(name) {
+    try {
+      return worlds().get(String(name));
+    } catch (e) {
+      if (e instanceof Admin.HttpError) throw e;
+      throw new Admin.HttpError(404, e.message);
+    }
+  };
+
+  this.route('GET', '/worlds', function(request) {
+    return {worlds: worlds().list().map(function(world) {
+      return world.describe();
+    })};
+  });
+
+  this.route('POST', '/worlds', function(request) {
+    var body = request.body || {};
+    if (typeof body['name'] !== 'string' ||
+        typeof body['directory'] !== 'string' ||
+        (body['startup'] !== undefined &&
+         typeof body['startup'] !== 'string')) {
+      throw new Admin.HttpError(400,
+          'Body must have name and directory strings, and optional startup');
+    }
+    var manager = worlds();
+    try {
+      return manager.create(body['name'], body['directory'],
+                            body['startup']).describe();
+    } catch (e) {
+      throw new Admin.HttpError(400, e.message);
+    }
+  });
+
+  this.route('DELETE', '/worlds', function(request) {
+    var name = request.query.get('name') || '';
+    world(name);
+    try {
+      worlds().remove(name);
+    } catch (e) {
+      throw new Admin.HttpError(409, e.message);
+    }
+    return {removed: name};
+  });
+
+  this.route('POST', '/worlds/start', function(request) {
+    var w = world((request.body || {})['name']);
+    return w.start().then(function() {
+      return w.describe();
+    }, function(e) {
+      throw new Admin.HttpError(409, e.message);
+    });
+  });
+
+  this.route('POST', '/worlds/stop', function(request) {
+    var w = world((request.body || {})['name']);
+    if (w.status !== Worlds.Status.RUNNING) {
+      throw new Admin.HttpError(409, 'World ' + w.name + ' is ' + w.status);
+    }
+    w.stop();
+    return w.describe();
+  });
+
+  var adminLog = function() {
+    if (!options.adminLog) {
+      throw new Admin.HttpError(501, 'Admin log not available');
+    }
+    return options.adminLog;
+  };
+
+  this.route('GET', '/adminlog', function(request) {
+    var limit = Admin.limit_(request, Admin.SEARCH_LIMIT);
+    return {entries: adminLog().tail(limit)};
+  });
+
+  this.route('GET', '/adminlog/verify', function(request) {
+    return adminLog().verify();
+  });
+};
+
+/**
+ * Look up the object named by a request's selector parameter.
+ * @private
+ * @param {!Admin.Request} request The request.
+ * @return {!Interpreter.prototype.Object} The object.
+ * @throws {!Admin.HttpError} If there is no such object.
+ */
+Admin.Server.prototype.lookup_ = function(request) {
+  return Admin.lookup_(this.intrp, request.query.get('selector') || '');
+};
+
+/**
+ * Get the limit parameter of a request.
+ * @private
+ * @param {!Admin.Request} request The request.
+ * @param {number} defaultLimit The limit if none is given.
+ * @return {number} The limit.
+ * @throws {!Admin.HttpError} If it is not a positive number.
+ */
+Admin.limit_ = function(request, defaultLimit) {
+  var limit = Number(request.query.get('limit') || defaultLimit);
+  if (!(limit > 0)) throw new Admin.HttpError(400, 'Invalid limit');
+  return limit;
+};
+
+/**
+ * Get the ID of a thread from a request.
+ * @private
+ * @param {*} value The ID, as given in the request.
+ * @return {number} The ID.
+ * @throws {!Admin.HttpError} If it is not a valid thread ID.
+ */
+Admin.threadId_ = function(value) {
+  var id = (typeof value === 'string' && value) ? Number(value) : value;
+  if (typeof id !== 'number' || !Number.isInteger(id) || id < 0) {
+    throw new Admin.HttpError(400, 'Invalid thread: ' + value);
+  }
+  return id;
+};
+
+/**
+ * Get a thread, checking that it exists and (optionally) that it has
+ * been paused by the debugger.
+ * @private
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {number} id The thread's ID.
+ * @param {boolean} paused Must the thread be paused?
+ * @return {!Interpreter.Thread} The thread.
+ * @throws {!Admin.HttpError} If there is no such (paused) thread.
+ */
+Admin.pausedThread_ = function(intrp, id, paused) {
+  var thread = intrp.getThreads().find(function(thread) {
+    return thread.id === id;
+  });
+  if (!thread) throw new Admin.HttpError(404, 'No such thread: ' + id);
+  if (paused && thread.status !== Interpreter.Thread.Status.PAUSED) {
+    throw new Admin.HttpError(409, 'Thread ' + id + ' is not paused');
+  }
+  return thread;
+};
+
+/**
+ * Look up the object a selector refers to.
+ * @private
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {*} selector The selector.
+ * @return {!Interpreter.prototype.Object} The object.
+ * @throws {!Admin.HttpError} If it is invalid or there is no such object.
+ */
+Admin.lookup_ = function(intrp, selector) {
+  var obj = null;
+  try {
+    obj = Package.lookup(intrp, String(selector));
+  } catch (e) {
+    throw new Admin.HttpError(400, 'Invalid selector: ' + selector);
+  }
+  if (!obj) throw new Admin.HttpError(404, 'No such object: ' + selector);
+  return obj;
+};
+
+/**
+ * Describe a value.  Primitives are described as {type, value} (with
+ * non-finite numbers given as strings, e.g. "NaN"; and no value for
+ * undefined); objects as {type: 'object' or 'function', class,
+ * selector} (selector being null for objects with no name), with the
+ * message of errors.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {?Interpreter.Value} value The value.
+ * @param {!Map<!Interpreter.prototype.Object, string>} names Selectors
+ *     of objects, as from Package.findNames.
+ * @return {!Object} The description.
+ */
+Admin.describeValue = function(intrp, value, names) {
+  if (value instanceof intrp.Object) {
+    var desc = {
+      type: (value instanceof intrp.Function) ? 'function' : 'object',
+      class: value.class,
+      selector: names.get(value) || null,
+    };
+    if (value instanceof intrp.Error) {
+      desc.message = String(value.get('message', intrp.ROOT));
+    }
+    return desc;
+  } else if (value === undefined) {
+    return {type: 'undefined'};
+  } else if (value === null) {
+    return {type: 'null', value: null};
+  } else if (typeof value === 'number' && !isFinite(value)) {
+    return {type: 'number', value: String(value)};
+  }
+  return {type: typeof value, value: value};
+};
+
+/**
+ * Describe an object, with its prototype, owner and own properties.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Interpreter.prototype.Object} obj The object.
+ * @param {!Map<!Interpreter.prototype.Object, string>} names Selectors
+ *     of objects, as from Package.findNames.
+ * @return {!Object} The description.
+ */
+Admin.describeObject = function(intrp, obj, names) {
+  var describe = function(value) {
+    return Admin.describeValue(intrp, value, names);
+  };
+  var properties = {};
+  var keys = obj.ownKeys(intrp.ROOT);
+  for (var i = 0; i < keys.length; i++) {
+    var pd = obj.getOwnPropertyDescriptor(keys[i], intrp.ROOT);
+    properties[keys[i]] = {
+      value: describe(pd.value),
+      writable: pd.writable,
+      enumerable: pd.enumerable,
+      configurable: pd.configurable,
+    };
+  }
+  return Object.assign(describe(obj), {
+    proto: describe(obj.proto),
+    owner: describe(obj.owner),
+    properties: properties,
+  });
+};
+
+/**
+ * Describe a thread, with its call stack.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Interpreter.Thread} thread The thread.
+ * @param {!Map<!Interpreter.prototype.Object, string>} names Selectors
+ *     of objects, as from Package.findNames.
+ * @return {!Object} The description.
+ */
+Admin.describeThread = function(intrp, thread, names) {
+  var statuses = Interpreter.Thread.Status;
+  var status = Object.keys(statuses).find(function(name) {
+    return statuses[name] === thread.status;
+  });
+  return {
+    id: thread.id,
+    status: status,
+    owner: Admin.describeValue(intrp, thread.wrapper && thread.wrapper.owner,
+                               names),
+    runAt: thread.runAt,
+    timeLimit: thread.timeLimit,
+    callers: thread.callers(intrp.ROOT).map(function(frame) {
+      return Admin.describeFrame_(intrp, frame, names);
+    }),
+  };
+};
+
+/**
+ * Describe a frame of a call stack: the function (or whether it is a
+ * program or eval), and the position in it.
+ * @private
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Object} frame The frame, as from Thread.prototype.callers.
+ * @param {!Map<!Interpreter.prototype.Object, string>} names Selectors
+ *     of objects, as from Package.findNames.
+ * @return {!Object} The description.
+ */
+Admin.describeFrame_ = function(intrp, frame, names) {
+  var desc = ('func' in frame) ?
+      {func: Admin.describeValue(intrp, frame.func, names)} :
+      {type: ('eval' in frame) ? 'eval' : 'program'};
+  if ('line' in frame) {
+    desc.line = frame.line;
+    desc.col = frame.col;
+  }
+  return desc;
+};
+
+/**
+ * Describe a frame of a paused thread's call stack, as by
+ * Admin.describeThread, with the value of this and the variables in
+ * each scope (short of the global scope), innermost first.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Interpreter.DebugFrame} frame The frame.
+ * @param {!Map<!Interpreter.prototype.Object, string>} names Selectors
+ *     of objects, as from Package.findNames.
+ * @return {!Object} The description.
+ */
+Admin.describeDebugFrame = function(intrp, frame, names) {
+  var scopes = [];
+  for (var scope = frame.scope;
+       scope && scope.type !== Interpreter.Scope.Type.GLOBAL;
+       scope = scope.outerScope) {
+    var vars = {};
+    for (var name in scope.vars) {
+      vars[name] = Admin.describeValue(intrp, scope.vars[name], names);
+    }
+    scopes.push({type: scope.type, vars: vars});
+  }
+  return Object.assign(Admin.describeFrame_(intrp, frame.frame, names), {
+    this: Admin.describeValue(intrp, frame.scope.this, names),
+    scopes: scopes,
+  });
+};
+
+/**
+ * Describe a breakpoint.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Interpreter.Breakpoint} breakpoint The breakpoint.
+ * @param {!Map<!Interpreter.prototype.Object, string>} names Selectors
+ *     of objects, as from Package.findNames.
+ * @return {!Object} The description.
+ */
+Admin.describeBreakpoint = function(intrp, breakpoint, names) {
+  return {
+    id: breakpoint.id,
+    func: Admin.describeValue(intrp, breakpoint.func, names),
+    line: breakpoint.line,
+    hits: breakpoint.hits,
+  };
+};
+
+/**
+ * Describe a watchpoint.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Interpreter.Watchpoint} watchpoint The watchpoint.
+ * @param {!Map<!Interpreter.prototype.Object, string>} names Selectors
+ *     of objects, as from Package.findNames.
+ * @return {!Object} The description.
+ */
+Admin.describeWatchpoint = function(intrp, watchpoint, names) {
+  return {
+    id: watchpoint.id,
+    object: Admin.describeValue(intrp, watchpoint.object, names),
+    property: watchpoint.key,
+    handler: Admin.describeValue(intrp, watchpoint.handler, names),
+    hits: watchpoint.hits,
+  };
+};
+
+/**
+ * Describe the statement coverage of a function.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Interpreter.FunctionCoverage} coverage The coverage.
+ * @param {!Map<!Interpreter.prototype.Object, string>} names Selectors
+ *     of objects, as from Package.findNames.
+ * @return {!Object} The description.
+ */
+Admin.describeCoverage = function(intrp, coverage, names) {
+  return {
+    func: Admin.describeValue(intrp, coverage.func, names),
+    statements: coverage.statements,
+    covered: coverage.statements.filter(function(statement) {
+      return statement.hits > 0;
+    }).length,
+    total: coverage.statements.length,
+  };
+};
+
+/**
+ * Describe a record from the audit log.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Interpreter.AuditRecord} record The record.
+ * @param {!Map<!Interpreter.prototype.Object, string>} names Selectors
+ *     of objects, as from Package.findNames.
+ * @return {!Object} The description.
+ */
+Admin.describeAuditRecord = function(intrp, record, names) {
+  return {
+    time: record.time,
+    access: record.access,
+    object: Admin.describeValue(intrp, record.object, names),
+    property: record.key,
+    perms: Admin.describeValue(intrp, record.perms, names),
+    thread: record.thread,
+    callers: record.callers.map(function(frame) {
+      return Admin.describeFrame_(intrp, frame, names);
+    }),
+  };
+};
+
+/**
+ * Describe an event from the security log.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Interpreter.SecurityEvent} event The event.
+ * @param {!Map<!Interpreter.prototype.Object, string>} names Selectors
+ *     of objects, as from Package.findNames.
+ * @return {!Object} The description.
+ */
+Admin.describeSecurityEvent = function(intrp, event, names) {
+  return {
+    id: event.id,
+    time: event.time,
+    type: event.type,
+    perms: Admin.describeValue(intrp, event.perms, names),
+    thread: event.thread,
+    details: event.details,
+  };
+};
+
+/**
+ * Describe a record from the slow log.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Interpreter.SlowRecord} record The record.
+ * @param {!Map<!Interpreter.prototype.Object, string>} names Selectors
+ *     of objects, as from Package.findNames.
+ * @return {!Object} The description.
+ */
+Admin.describeSlowRecord = function(intrp, record, names) {
+  return {
+    time: record.time,
+    kind: record.kind,
+    duration: record.duration,
+    thread: record.thread,
+    steps: record.steps,
+    samples: record.samples.map(function(sample) {
+      return sample.map(function(frame) {
+        return Admin.describeFrame_(intrp, frame, names);
+      });
+    }),
+  };
+};
+
+/**
+ * Describe a node of the object graph (see Heap): objects as by
+ * Admin.describeValue; scopes as {type: 'scope', scopeType}; and
+ * threads as {type: 'thread', id}.
+ * @private
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Heap.Node} node The node.
+ * @param {!Map<!Interpreter.prototype.Object, string>} names Selectors
+ *     of objects, as from Package.findNames.
+ * @return {!Object} The description.
+ */
+Admin.describeNode_ = function(intrp, node, names) {
+  if (node instanceof Interpreter.Scope) {
+    return {type: 'scope', scopeType: node.type};
+  } else if (node instanceof Interpreter.Thread) {
+    return {type: 'thread', id: node.id};
+  }
+  return Admin.describeValue(intrp, node, names);
+};
+
+/**
+ * Convert a property value spec (see the PATCH /object route) to a
+ * value.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {*} spec The spec.
+ * @return {{value: ?Interpreter.Value}} The value.
+ * @throws {!Admin.HttpError} If the spec is invalid.
+ */
+Admin.valueFromSpec = function(intrp, spec) {
+  if (typeof spec !== 'object' || spec === null) {
+    throw new Admin.HttpError(400, 'Invalid value spec');
+  } else if ('selector' in spec) {
+    return {value: Admin.lookup_(intrp, spec['selector'])};
+  } else if (spec['type'] === 'undefined') {
+    return {value: undefined};
+  } else if ('value' in spec) {
+    return {value: intrp.nativeToPseudo(spec['value'], intrp.ROOT)};
+  }
+  throw new Admin.HttpError(400, 'Invalid value spec');
+};
+
+/**
+ * Evaluate code, in a new thread, as if by eval called by owner.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {string} src The code.
+ * @param {!Interpreter.Owner} owner Who is evaluating it.
+ * @param {number} timeout Time (in ms) to wait for the thread to finish.
+ * @return {!Promise<!Object>} Resolves to {thread, threw, value} (value
+ *     being described as by Admin.describeValue) once the thread
+ *     finishes.  Rejects with a 504 Admin.HttpError if it has yet to do
+ *     so after timeout.
+ */
+Admin.evaluate = function(intrp, src, owner, timeout) {
+  var evalFunc = intrp.global.get('eval');
+  if (!(evalFunc instanceof intrp.Function)) {
+    return Promise.reject(new Admin.HttpError(501, 'No eval function'));
+  }
+  var wrapper = intrp.createThreadForFuncCall(
+      /** @type {!Interpreter.Owner} */(owner), evalFunc, undefined, [src]);
+  return Admin.awaitThread(intrp, wrapper.thread, timeout);
+};
+
+/**
+ * Wait for a thread to finish.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Interpreter.Thread} thread The thread.
+ * @param {number} timeout Time (in ms) to wait for the thread to finish.
+ * @return {!Promise<!Object>} Resolves to {thread, threw, value}, as
+ *     for Admin.evaluate, once the thread finishes.  Rejects with a 504
+ *     Admin.HttpError if it has yet to do so after timeout.
+ */
+Admin.awaitThread = function(intrp, thread, timeout) {
+  return new Promise(function(resolve, reject) {
+    var timer = setTimeout(function() {
+      thread.onExit = null;
+      reject(new Admin.HttpError(504,
+          'Thread ' + thread.id + ' still running after ' + timeout + 'ms'));
+    }, timeout);
+    thread.onExit = function(threw, value) {
+      clearTimeout(timer);
+      resolve({
+        thread: thread.id,
+        threw: threw,
+        value: Admin.describeValue(intrp, value, Package.findNames(intrp)),
+      });
+    };
+  });
+};
+
+/**
+ * Read a request's body, as JSON.
+ * @private
+ * @param {!http.IncomingMessage} req The request.
+ * @return {!Promise<*>} The body (undefined if it was empty).
+ */
+Admin.readBody_ = function(req) {
+  return new Promise(function(resolve, reject) {
+    var chunks = [];
+    var length = 0;
+    req.on('data', function(chunk) {
+      length += chunk.length;
+      if (length > Admin.MAX_BODY) {
+        req.removeAllListeners('data');
+        req.resume();
+        reject(new Admin.HttpError(413, 'Request body too large'));
+        return;
+      }
+      chunks.push(chunk);
+    });
+    req.on('end', function() {
+      var text = Buffer.concat(chunks).toString('utf8');
+      if (!text.trim()) {
+        resolve(undefined);
+        return;
+      }
+      try {
+        resolve(JSON.parse(text));
+      } catch (e) {
+        reject(new Admin.HttpError(400, 'Invalid JSON: ' + e.message));
+      }
+    });
+    req.on('error', reject);
+  });
+};
+
+module.exports = Admin;
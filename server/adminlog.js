@@ -0,0 +1,189 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview An append-only, tamper-evident log of privileged
+ * operations (admin API requests, changes of ownership and killing of
+ * other owners' threads, bans, and whatever in-world code records via
+ * CC.adminLog, such as evals), kept in a file outside the database so
+ * that it survives restoring a checkpoint.
+ *
+ * The log is a file of JSON entries, one per line.  Each includes the
+ * hash of the one before it (see AdminLog.hash), so that altering,
+ * inserting or removing entries breaks the chain, as AdminLog.verify
+ * reports, unless only the last ones are removed.  To detect that too,
+ * the hash of the last entry (the "head") is written to the server log
+ * when the log is opened, and after each checkpoint.
+ */
+'use strict';
+
+var crypto = require('crypto');
+var fs = require('fs');
+
+var AdminLog = {};
+
+/**
+ * An entry in the log: its sequence number (from 1), time, who did what
+ * (e.g., the name of the owner whose perms were used, or 'admin' for
+ * the admin API), the kind of operation, its details, the hash of the
+ * previous entry ('' for the first), and its own hash.
+ * @typedef {{seq: number,
+ *            time: number,
+ *            actor: string,
+ *            action: string,
+ *            details: !Object,
+ *            prev: string,
+ *            hash: string}}
+ */
+AdminLog.Entry;
+
+/**
+ * Compute the hash of an entry (which covers everything but its hash
+ * field, including the hash of the previous entry).
+ * @param {!AdminLog.Entry} entry The entry.
+ * @return {string} The hash, as hex.
+ */
+AdminLog.hash = function(entry) {
+  return crypto.createHash('sha256').update(JSON.stringify([
+    entry.seq, entry.time, entry.actor, entry.action, entry.details,
+    entry.prev,
+  ])).digest('hex');
+};
+
+/**
+ * Check the entries of a log: that each is well-formed, numbered in
+ * sequence, and chained by hash to the one before.
+ * @param {string} text The contents of the log file.
+ * @return {{entries: number, head: string, error: ?string}} The number
+ *     of valid entries before any error, the hash of the last of them
+ *     ('' if none), and a description of the first error (or null if
+ *     the whole log is valid).
+ */
+AdminLog.verify = function(text) {
+  var lines = text.split('\n');
+  if (lines[lines.length - 1] === '') lines.pop();
+  var prev = '';
+  for (var i = 0; i < lines.length; i++) {
+    var where = 'line ' + (i + 1) + ': ';
+    var result = {entries: i, head: prev, error: null};
+    try {
+      var entry = JSON.parse(lines[i]);
+    } catch (e) {
+      result.error = where + 'not JSON';
+      return result;
+    }
+    if (!entry || typeof entry !== 'object') {
+      result.error = where + 'not an entry';
+    } else if (entry.seq !== i + 1) {
+      result.error = where + 'expected entry ' + (i + 1) + ', found ' +
+          entry.seq;
+    } else if (entry.prev !== prev) {
+      result.error = where + 'does not follow the previous entry';
+    } else if (entry.hash !== AdminLog.hash(entry)) {
+      result.error = where + 'hash mismatch';
+    }
+    if (result.error) return result;
+    prev = entry.hash;
+  }
+  return {entries: lines.length, head: prev, error: null};
+};
+
+/**
+ * A log of privileged operations, appended to a file.
+ * @constructor
+ * @struct
+ * @param {string} filename Path of the log file, which is created if it
+ *     does not exist.
+ */
+AdminLog.Log = function(filename) {
+  /** @const {string} */
+  this.filename = filename;
+  var contents = fs.existsSync(filename) ?
+      fs.readFileSync(filename, 'utf8') : '';
+  var check = AdminLog.verify(contents);
+  if (check.error) {
+    throw new Error('Admin log ' + filename + ' is corrupt (' + check.error +
+                    '); refusing to append to it');
+  }
+  /** @private {number} File descriptor of the log file. */
+  this.fd_ = fs.openSync(filename, 'a');
+  /** @type {number} Sequence number of the last entry (0 if none). */
+  this.seq = check.entries;
+  /** @type {string} Hash of the last entry ('' if none). */
+  this.head = check.head;
+};
+
+/**
+ * Append an entry to the log (and flush it to disk).
+ * @param {string} actor Who did it.
+ * @param {string} action What kind of operation it was.
+ * @param {!Object} details Its details (which must be JSONable).
+ * @return {!AdminLog.Entry} The entry.
+ */
+AdminLog.Log.prototype.record = function(actor, action, details) {
+  var entry = {
+    seq: this.seq + 1,
+    time: Date.now(),
+    actor: actor,
+    action: action,
+    details: details,
+    prev: this.head,
+    hash: '',
+  };
+  entry.hash = AdminLog.hash(entry);
+  fs.writeSync(this.fd_, JSON.stringify(entry) + '\n');
+  fs.fsyncSync(this.fd_);
+  this.seq = entry.seq;
+  this.head = entry.hash;
+  return entry;
+};
+
+/**
+ * Read the most recent entries.
+ * @param {number} limit Maximum number of entries to return.
+ * @return {!Array<!AdminLog.Entry>} The entries, oldest first.
+ */
+AdminLog.Log.prototype.tail = function(limit) {
+  var lines = fs.readFileSync(this.filename, 'utf8').split('\n');
+  if (lines[lines.length - 1] === '') lines.pop();
+  return lines.slice(Math.max(lines.length - limit, 0)).map(function(line) {
+    return JSON.parse(line);
+  });
+};
+
+/**
+ * Check the log file as it now is (see AdminLog.verify), and that it
+ * still ends with the last entry appended.
+ * @return {{entries: number, head: string, error: ?string}}
+ */
+AdminLog.Log.prototype.verify = function() {
+  var result = AdminLog.verify(fs.readFileSync(this.filename, 'utf8'));
+  if (!result.error && result.head !== this.head) {
+    result.error = 'expected ' + this.seq + ' entries ending with ' +
+        this.head + ', found ' + result.entries;
+  }
+  return result;
+};
+
+/**
+ * Close the log file.
+ */
+AdminLog.Log.prototype.close = function() {
+  fs.closeSync(this.fd_);
+};
+
+module.exports = AdminLog;
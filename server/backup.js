@@ -0,0 +1,558 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Off-site backup of checkpoints to a storage bucket.
+ *
+ * Completed checkpoint files are uploaded, one at a time, to an
+ * S3-compatible bucket: Amazon S3, Google Cloud Storage (via its XML
+ * API, with HMAC keys) or any other service (e.g. MinIO) that
+ * implements the same API with AWS Signature Version 4.  Each upload
+ * is checked by the service against the MD5 digest of the file, and
+ * the file's SHA-256 digest is saved with it (as metadata), to be
+ * checked when it is downloaded again.  Failed uploads are retried,
+ * with exponential backoff.  After each full checkpoint is uploaded,
+ * all but the most recent few full checkpoints in the bucket are
+ * deleted, together with the incremental checkpoints based on them.
+ *
+ * Objects are addressed path-style (e.g.
+ * https://storage.googleapis.com/<bucket>/<key>), which all of these
+ * support, and are uploaded with a single request, so no checkpoint
+ * may exceed 5GB.
+ */
+'use strict';
+
+var crypto = require('crypto');
+var fs = require('fs');
+var http = require('http');
+var https = require('https');
+var path = require('path');
+
+var Backup = {};
+
+/**
+ * Options for a Backup.Bucket.
+ * @typedef {{provider: (string|undefined),
+ *            bucket: string,
+ *            endpoint: (string|undefined),
+ *            region: (string|undefined),
+ *            prefix: (string|undefined),
+ *            accessKeyId: string,
+ *            secretAccessKey: string}}
+ */
+Backup.BucketOptions;
+
+/**
+ * An object in a bucket, as listed by Backup.Bucket.prototype.list.
+ * @typedef {{key: string, size: number}}
+ */
+Backup.Entry;
+
+/**
+ * Default endpoints of the supported providers.
+ * @private @const {!Object<string,function(string):string>}
+ */
+Backup.ENDPOINTS_ = {
+  's3': (region) => 'https://s3.' + region + '.amazonaws.com',
+  'gcs': (region) => 'https://storage.googleapis.com',
+};
+
+/**
+ * A storage bucket (or the part of one whose keys begin with a given
+ * prefix), accessed via the S3 API.
+ * @constructor
+ * @struct
+ * @param {!Backup.BucketOptions} options The bucket's name, the
+ *     provider ("s3" or "gcs", used to choose a default endpoint and
+ *     region; default "s3"), the endpoint URL (e.g.
+ *     "http://localhost:9000"), the region (default "us-east-1" for S3
+ *     and "auto" otherwise), a prefix for all keys (e.g. "mycity/"),
+ *     and the credentials.
+ */
+Backup.Bucket = function(options) {
+  var provider = options.provider || 's3';
+  if (!Backup.ENDPOINTS_.hasOwnProperty(provider) && !options.endpoint) {
+    throw new RangeError('Unknown backup provider: ' + provider);
+  }
+  if (!options.bucket) throw new TypeError('No backup bucket specified');
+  if (!options.accessKeyId || !options.secretAccessKey) {
+    throw new TypeError('No backup credentials specified');
+  }
+  /** @const {string} */
+  this.name = options.bucket;
+  /** @const {string} */
+  this.region = options.region || (provider === 's3' ? 'us-east-1' : 'auto');
+  /** @const {string} */
+  this.prefix = options.prefix || '';
+  /** @private @const {!URL} */
+  this.endpoint_ = new URL(options.endpoint ||
+      Backup.ENDPOINTS_[provider](this.region));
+  /** @private @const {string} */
+  this.accessKeyId_ = options.accessKeyId;
+  /** @private @const {string} */
+  this.secretAccessKey_ = options.secretAccessKey;
+};
+
+/**
+ * Upload an object.
+ * @param {string} key Key of the object (excluding the prefix).
+ * @param {!Buffer} body Contents of the object.
+ * @param {!Object<string,string>=} metadata User metadata to save with it.
+ * @return {!Promise<void>} Resolves once the service has stored it
+ *     (having checked that its MD5 digest matches).
+ */
+Backup.Bucket.prototype.put = function(key, body, metadata) {
+  var md5 = crypto.createHash('md5').update(body).digest();
+  var headers = {
+    'content-md5': md5.toString('base64'),
+    'content-type': 'application/octet-stream',
+  };
+  for (var name in metadata) {
+    headers['x-amz-meta-' + name.toLowerCase()] = metadata[name];
+  }
+  return this.request_('PUT', key, {}, headers, body).then(function(res) {
+    // For a simple upload, the ETag is the MD5 digest.
+    var etag = String(res.headers['etag'] || '').replace(/"/g, '');
+    if (/^[0-9a-f]{32}$/.test(etag) && etag !== md5.toString('hex')) {
+      throw new Error('Upload of ' + key + ' corrupted (ETag ' + etag + ')');
+    }
+  });
+};
+
+/**
+ * Download an object.
+ * @param {string} key Key of the object (excluding the prefix).
+ * @return {!Promise<{body: !Buffer, metadata: !Object<string,string>}>}
+ *     The object's contents and user metadata.
+ */
+Backup.Bucket.prototype.get = function(key) {
+  return this.request_('GET', key, {}, {}, null).then(function(res) {
+    var metadata = {};
+    for (var name in res.headers) {
+      // GCS returns metadata set via x-amz-meta-* as x-goog-meta-*.
+      var m = name.match(/^x-(?:amz|goog)-meta-(.*)$/);
+      if (m) metadata[m[1]] = String(res.headers[name]);
+    }
+    return {body: res.body, metadata: metadata};
+  });
+};
+
+/**
+ * Delete an object.
+ * @param {string} key Key of the object (excluding the prefix).
+ * @return {!Promise<void>}
+ */
+Backup.Bucket.prototype.delete = function(key) {
+  return this.request_('DELETE', key, {}, {}, null).then(function() {});
+};
+
+/**
+ * List the objects in the bucket (whose keys begin with the prefix).
+ * @return {!Promise<!Array<!Backup.Entry>>} The objects, with keys
+ *     excluding the prefix, in key order.
+ */
+Backup.Bucket.prototype.list = function() {
+  var entries = [];
+  var prefix = this.prefix;
+  var page = function(token) {
+    var query = {'list-type': '2', 'prefix': prefix};
+    if (token) query['continuation-token'] = token;
+    return this.request_('GET', null, query, {}, null).then(function(res) {
+      var xml = res.body.toString('utf8');
+      var re = /<Contents>([\s\S]*?)<\/Contents>/g;
+      for (var m; (m = re.exec(xml)); ) {
+        var key = Backup.unescapeXml_(Backup.xmlValue_(m[1], 'Key'));
+        entries.push({key: key.slice(prefix.length),
+                      size: Number(Backup.xmlValue_(m[1], 'Size'))});
+      }
+      if (Backup.xmlValue_(xml, 'IsTruncated') === 'true') {
+        return page.call(this, Backup.unescapeXml_(
+            Backup.xmlValue_(xml, 'NextContinuationToken')));
+      }
+      return undefined;
+    }.bind(this));
+  };
+  return page.call(this, '').then(function() {
+    entries.sort((a, b) => (a.key < b.key) ? -1 : (a.key > b.key) ? 1 : 0);
+    return entries;
+  });
+};
+
+/**
+ * Make a signed request to the service.
+ * @private
+ * @param {string} method HTTP method.
+ * @param {?string} key Key of the object (excluding the prefix), or
+ *     null for a request concerning the bucket itself.
+ * @param {!Object<string,string>} query Query parameters.
+ * @param {!Object<string,string>} headers Additional (lower case)
+ *     headers.
+ * @param {?Buffer} body Request body, if any.
+ * @return {!Promise<{status: number, headers: !Object, body: !Buffer}>}
+ *     The response, if successful.  Otherwise rejects with an Error
+ *     whose .status is the HTTP status (if any) and whose .retryable
+ *     is true if the request is worth retrying.
+ */
+Backup.Bucket.prototype.request_ = function(method, key, query, headers,
+                                            body) {
+  var endpoint = this.endpoint_;
+  var basePath = endpoint.pathname.replace(/\/$/, '');
+  var pathname = basePath + '/' + Backup.encode_(this.name) +
+      (key === null ? '' : '/' + Backup.encode_(this.prefix + key, true));
+  var queryString = Backup.canonicalQuery_(query);
+  var payloadHash =
+      crypto.createHash('sha256').update(body || '').digest('hex');
+  headers = Object.assign({}, headers);
+  headers['host'] = endpoint.host;
+  headers['x-amz-content-sha256'] = payloadHash;
+  if (body) headers['content-length'] = String(body.length);
+  headers['authorization'] = this.sign_(method, pathname, queryString,
+                                        headers, payloadHash, new Date());
+  var lib = (endpoint.protocol === 'http:') ? http : https;
+  return new Promise(function(resolve, reject) {
+    var req = lib.request({
+      protocol: endpoint.protocol,
+      hostname: endpoint.hostname,
+      port: endpoint.port || undefined,
+      method: method,
+      path: pathname + (queryString ? '?' + queryString : ''),
+      headers: headers,
+      timeout: Backup.Bucket.TIMEOUT,
+    }, function(res) {
+      var chunks = [];
+      res.on('data', (chunk) => chunks.push(chunk));
+      res.on('error', reject);
+      res.on('end', function() {
+        var data = Buffer.concat(chunks);
+        if (res.statusCode < 300) {
+          resolve({status: res.statusCode, headers: res.headers, body: data});
+          return;
+        }
+        var code = Backup.xmlValue_(data.toString('utf8'), 'Code');
+        var error = new Error(method + ' ' + pathname + ' failed: ' +
+            res.statusCode + (code ? ' ' + code : ''));
+        error.status = res.statusCode;
+        error.retryable = res.statusCode >= 500 || res.statusCode === 408 ||
+            res.statusCode === 429;
+        reject(error);
+      });
+    });
+    req.on('timeout', function() {
+      req.destroy(new Error(method + ' ' + pathname + ' timed out'));
+    });
+    req.on('error', function(e) {
+      e.retryable = true;  // Network problems may be transient.
+      reject(e);
+    });
+    req.end(body || undefined);
+  });
+};
+
+/** @const {number} Request timeout, in milliseconds. */
+Backup.Bucket.TIMEOUT = 5 * 60 * 1000;
+
+/**
+ * Sign a request with AWS Signature Version 4 (which also sets the
+ * x-amz-date header).
+ * @private
+ * @param {string} method HTTP method.
+ * @param {string} pathname Request path, already URI-encoded.
+ * @param {string} queryString Canonical query string.
+ * @param {!Object<string,string>} headers Headers to sign (with lower
+ *     case names), including host and x-amz-content-sha256.
+ * @param {string} payloadHash Hex SHA-256 digest of the request body.
+ * @param {!Date} date Time of the request.
+ * @return {string} Value for the authorization header.
+ */
+Backup.Bucket.prototype.sign_ = function(method, pathname, queryString,
+                                         headers, payloadHash, date) {
+  var amzDate = date.toISOString().replace(/[-:]|\.\d{3}/g, '');
+  var day = amzDate.slice(0, 8);
+  headers['x-amz-date'] = amzDate;
+  var names = Object.keys(headers).filter((name) => name !== 'authorization' &&
+      name !== 'content-length').sort();
+  var canonicalRequest = [
+    method,
+    pathname,
+    queryString,
+    names.map((name) => name + ':' + String(headers[name]).trim() + '\n')
+        .join(''),
+    names.join(';'),
+    payloadHash,
+  ].join('\n');
+  var scope = [day, this.region, 's3', 'aws4_request'].join('/');
+  var stringToSign = ['AWS4-HMAC-SHA256', amzDate, scope,
+      crypto.createHash('sha256').update(canonicalRequest).digest('hex'),
+  ].join('\n');
+  var hmac = (key, data) =>
+      crypto.createHmac('sha256', key).update(data).digest();
+  var signingKey = hmac(hmac(hmac(hmac('AWS4' + this.secretAccessKey_, day),
+      this.region), 's3'), 'aws4_request');
+  return 'AWS4-HMAC-SHA256 Credential=' + this.accessKeyId_ + '/' + scope +
+      ', SignedHeaders=' + names.join(';') +
+      ', Signature=' + hmac(signingKey, stringToSign).toString('hex');
+};
+
+/**
+ * URI-encode a string as required by AWS Signature Version 4.
+ * @private
+ * @param {string} str String to encode.
+ * @param {boolean=} keepSlashes True to leave '/' unencoded (as in a key).
+ * @return {string}
+ */
+Backup.encode_ = function(str, keepSlashes) {
+  var encoded = encodeURIComponent(str).replace(/[!'()*]/g,
+      (c) => '%' + c.charCodeAt(0).toString(16).toUpperCase());
+  return keepSlashes ? encoded.replace(/%2F/g, '/') : encoded;
+};
+
+/**
+ * Encode query parameters as a canonical query string (sorted by name).
+ * @private
+ * @param {!Object<string,string>} query Query parameters.
+ * @return {string}
+ */
+Backup.canonicalQuery_ = function(query) {
+  return Object.keys(query).sort().map(
+      (name) => Backup.encode_(name) + '=' + Backup.encode_(query[name]))
+      .join('&');
+};
+
+/**
+ * Extract the text of the first element with the given name from XML.
+ * @private
+ * @param {string} xml XML text.
+ * @param {string} name Element name.
+ * @return {string} Its (still escaped) text, or '' if there is none.
+ */
+Backup.xmlValue_ = function(xml, name) {
+  var m = xml.match(new RegExp('<' + name + '>([^<]*)</' + name + '>'));
+  return m ? m[1] : '';
+};
+
+/**
+ * Unescape the text of an XML element.
+ * @private
+ * @param {string} text Escaped text.
+ * @return {string}
+ */
+Backup.unescapeXml_ = function(text) {
+  var entities = {'amp': '&', 'lt': '<', 'gt': '>', 'quot': '"', 'apos': "'"};
+  return text.replace(/&(?:#(\d+)|#x([0-9a-f]+)|(\w+));/gi,
+      function(match, dec, hex, name) {
+        if (dec) return String.fromCodePoint(Number(dec));
+        if (hex) return String.fromCodePoint(parseInt(hex, 16));
+        return entities.hasOwnProperty(name) ? entities[name] : match;
+      });
+};
+
+/**
+ * Is a key that of a full checkpoint?
+ * @private
+ * @param {string} key Key (excluding the bucket's prefix).
+ * @return {boolean}
+ */
+Backup.isFull_ = function(key) {
+  return /^\d{4}-\d\d-\d\dT\d\d\.\d\d\.\d\d(\.\d{1,3})?Z?\.city$/.test(key);
+};
+
+/**
+ * Return the keys of the incremental checkpoints based on a full
+ * checkpoint, in sequence order.
+ * @private
+ * @param {!Array<!Backup.Entry>} entries Contents of the bucket.
+ * @param {string} checkpoint Key of the full checkpoint.
+ * @return {!Array<string>}
+ */
+Backup.deltasOf_ = function(entries, checkpoint) {
+  var prefix = checkpoint.slice(0, -4);  // Remove 'city'.
+  var seq = (key) => Number(key.slice(prefix.length, -'.delta'.length));
+  return entries.map((entry) => entry.key).filter(
+      (key) => key.startsWith(prefix) && /^\d+\.delta$/.test(
+          key.slice(prefix.length))).sort((a, b) => seq(a) - seq(b));
+};
+
+/**
+ * Options for a Backup.Uploader.
+ * @typedef {{keep: (number|undefined),
+ *            retries: (number|undefined),
+ *            retryDelay: (number|undefined),
+ *            onRetry: (function(string, *, number)|undefined)}}
+ */
+Backup.UploaderOptions;
+
+/**
+ * Uploads checkpoint files to a bucket, one at a time, in the order
+ * requested.
+ * @constructor
+ * @struct
+ * @param {!Backup.Bucket} bucket The bucket.
+ * @param {!Backup.UploaderOptions=} options The number of full
+ *     checkpoints to keep in the bucket (default 0, for all), the
+ *     number of times to retry a failed upload (default 5), the delay
+ *     before the first retry, in milliseconds (default 1000; it
+ *     doubles each time), and a callback to call (with the filename,
+ *     error and attempt number) before each retry.
+ */
+Backup.Uploader = function(bucket, options) {
+  options = options || {};
+  /** @const {!Backup.Bucket} */
+  this.bucket = bucket;
+  /** @private @const {number} */
+  this.keep_ = Math.max(0, options.keep || 0);
+  /** @private @const {number} */
+  this.retries_ = (options.retries === undefined) ? 5 : options.retries;
+  /** @private @const {number} */
+  this.retryDelay_ =
+      (options.retryDelay === undefined) ? 1000 : options.retryDelay;
+  /** @private @const {function(string, *, number)|undefined} */
+  this.onRetry_ = options.onRetry;
+  /** @private {!Promise} Completion of the last upload requested. */
+  this.queue_ = Promise.resolve();
+  /** @type {number} Number of uploads requested but not yet finished. */
+  this.pending = 0;
+};
+
+/**
+ * Upload a checkpoint file (once those requested earlier have been
+ * uploaded), then, if it is a full checkpoint, delete old ones from
+ * the bucket.  The file is read when its upload begins.
+ * @param {string} filename Path of the checkpoint file.
+ * @return {!Promise<void>} Resolves once uploaded; rejects if it could
+ *     not be, even after retrying.
+ */
+Backup.Uploader.prototype.upload = function(filename) {
+  this.pending++;
+  var done = this.queue_.then(this.upload_.bind(this, filename));
+  this.queue_ = done.then(() => {this.pending--;},
+                          () => {this.pending--;});
+  return done;
+};
+
+/**
+ * Upload those of the given checkpoint files that are not already in
+ * the bucket (e.g., because the server was shut down before they were
+ * uploaded).
+ * @param {!Array<string>} filenames Paths of the checkpoint files, in
+ *     the order to upload them.
+ * @return {!Promise<!Array<string>>} Resolves to the paths of the files
+ *     uploaded.
+ */
+Backup.Uploader.prototype.sync = function(filenames) {
+  return this.bucket.list().then(function(entries) {
+    var present = new Set(entries.map((entry) => entry.key));
+    var missing = filenames.filter(
+        (filename) => !present.has(path.basename(filename)));
+    return Promise.all(missing.map((filename) => this.upload(filename)))
+        .then(() => missing);
+  }.bind(this));
+};
+
+/**
+ * Upload a checkpoint file now, retrying if needed.
+ * @private
+ * @param {string} filename Path of the checkpoint file.
+ * @return {!Promise<void>}
+ */
+Backup.Uploader.prototype.upload_ = function(filename) {
+  var key = path.basename(filename);
+  var body = fs.readFileSync(filename);
+  var sha256 = crypto.createHash('sha256').update(body).digest('hex');
+  var attempt = function(n) {
+    return this.bucket.put(key, body, {'sha256': sha256}).catch(function(e) {
+      if (n >= this.retries_ || (e && e.retryable === false)) throw e;
+      if (this.onRetry_) this.onRetry_(filename, e, n + 1);
+      return new Promise(
+          (resolve) => setTimeout(resolve, this.retryDelay_ * 2 ** n))
+          .then(attempt.bind(this, n + 1));
+    }.bind(this));
+  };
+  var uploaded = attempt.call(this, 0);
+  return Backup.isFull_(key) ? uploaded.then(this.prune_.bind(this)) :
+      uploaded;
+};
+
+/**
+ * Delete all but the most recent full checkpoints in the bucket (and
+ * the incremental checkpoints based on them).
+ * @private
+ * @return {!Promise<void>}
+ */
+Backup.Uploader.prototype.prune_ = function() {
+  if (!this.keep_) return Promise.resolve();
+  var bucket = this.bucket;
+  return bucket.list().then(function(entries) {
+    var fulls = entries.map((entry) => entry.key).filter(Backup.isFull_);
+    fulls.sort().reverse();
+    var keys = [];
+    fulls.slice(this.keep_).forEach(function(checkpoint) {
+      // Incremental checkpoints first, so none is left without its base.
+      keys.push.apply(keys, Backup.deltasOf_(entries, checkpoint).reverse());
+      keys.push(checkpoint);
+    });
+    return keys.reduce((p, key) => p.then(() => bucket.delete(key)),
+                       Promise.resolve());
+  }.bind(this));
+};
+
+/**
+ * Download the most recent full checkpoint in a bucket, together with
+ * the incremental checkpoints based on it, to a directory, checking
+ * each file's SHA-256 digest.  Each file is written under a temporary
+ * name, and all are renamed once all have been downloaded, the full
+ * checkpoint last (so it is never found without them).
+ * @param {!Backup.Bucket} bucket The bucket.
+ * @param {string} dir Directory to download into.
+ * @return {!Promise<?string>} Resolves to the filename of the full
+ *     checkpoint, or null if the bucket contains none.
+ */
+Backup.restore = function(bucket, dir) {
+  return bucket.list().then(function(entries) {
+    var fulls = entries.map((entry) => entry.key).filter(Backup.isFull_);
+    if (!fulls.length) return null;
+    var checkpoint = fulls.sort()[fulls.length - 1];
+    var keys = [checkpoint].concat(Backup.deltasOf_(entries, checkpoint));
+    var download = function(key) {
+      return bucket.get(key).then(function(object) {
+        var sha256 =
+            crypto.createHash('sha256').update(object.body).digest('hex');
+        if (object.metadata['sha256'] && object.metadata['sha256'] !== sha256) {
+          throw new Error('Backup ' + key + ' is corrupt (SHA-256 mismatch)');
+        }
+        fs.writeFileSync(path.join(dir, key + '.partial'), object.body);
+      });
+    };
+    return keys.reduce((p, key) => p.then(() => download(key)),
+                       Promise.resolve()).then(function() {
+      for (var i = keys.length - 1; i >= 0; i--) {
+        var file = path.join(dir, keys[i]);
+        fs.renameSync(file + '.partial', file);
+      }
+      return checkpoint;
+    }, function(e) {
+      keys.forEach(function(key) {
+        try {
+          fs.unlinkSync(path.join(dir, key + '.partial'));
+        } catch (e) {
+        }
+      });
+      throw e;
+    });
+  });
+};
+
+module.exports = Backup;
@@ -0,0 +1,213 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Bans of IP addresses and networks.
+ *
+ * A ban applies to a network given in CIDR notation (e.g.,
+ * '192.0.2.0/24' or '2001:db8::/32'), or to a single address.  IPv4
+ * addresses mapped into IPv6 (e.g. '::ffff:192.0.2.1', as reported
+ * for IPv4 clients of dual-stack listeners) are treated as the IPv4
+ * addresses they represent.  Bans are plain objects, so that a list
+ * of them can be saved in checkpoints.
+ */
+'use strict';
+
+var net = require('net');
+
+var Bans = {};
+
+/**
+ * A ban: the network banned (in canonical form), why, when the ban was
+ * made and when it expires (as from Date.now(); null if never).
+ * @typedef {{network: string,
+ *            reason: string,
+ *            created: number,
+ *            expires: ?number}}
+ */
+Bans.Ban;
+
+/**
+ * Parse an IP address.
+ * @param {string} address The address.
+ * @return {?Array<number>} Its bytes (4 for IPv4, 16 for IPv6), or
+ *     null if it is not a valid address.
+ */
+Bans.parseAddress = function(address) {
+  var version = net.isIP(address);
+  if (version === 4) {
+    return address.split('.').map(Number);
+  } else if (version !== 6) {
+    return null;
+  }
+  // Convert any trailing dotted-quad part to hex groups.
+  var m = address.match(/^(.*:)(\d+\.\d+\.\d+\.\d+)$/);
+  if (m) {
+    var quad = Bans.parseAddress(m[2]);
+    address = m[1] + ((quad[0] << 8) | quad[1]).toString(16) + ':' +
+        ((quad[2] << 8) | quad[3]).toString(16);
+  }
+  var halves = address.split('::');
+  var head = halves[0] ? halves[0].split(':') : [];
+  var tail = (halves.length > 1 && halves[1]) ? halves[1].split(':') : [];
+  var groups = head.concat(new Array(8 - head.length - tail.length).fill('0'),
+                           tail);
+  var bytes = [];
+  for (var i = 0; i < 8; i++) {
+    var group = parseInt(groups[i], 16);
+    bytes.push(group >> 8, group & 0xff);
+  }
+  // Unmap IPv4-mapped addresses (::ffff:0:0/96).
+  if (bytes.slice(0, 10).every(function(b) {return b === 0;}) &&
+      bytes[10] === 0xff && bytes[11] === 0xff) {
+    return bytes.slice(12);
+  }
+  return bytes;
+};
+
+/**
+ * Format the bytes of an IP address (as from Bans.parseAddress).
+ * @param {!Array<number>} bytes The address's bytes.
+ * @return {string} The address, in canonical form (RFC 5952 for IPv6).
+ */
+Bans.formatAddress = function(bytes) {
+  if (bytes.length === 4) return bytes.join('.');
+  var groups = [];
+  for (var i = 0; i < 16; i += 2) {
+    groups.push(((bytes[i] << 8) | bytes[i + 1]).toString(16));
+  }
+  // Find the longest run of (two or more) zero groups to elide.
+  var best = -1, bestLength = 1;
+  for (i = 0; i < 8; i++) {
+    for (var j = i; j < 8 && groups[j] === '0'; j++) {}
+    if (j - i > bestLength) {
+      best = i;
+      bestLength = j - i;
+    }
+  }
+  if (best === -1) return groups.join(':');
+  return groups.slice(0, best).join(':') + '::' +
+      groups.slice(best + bestLength).join(':');
+};
+
+/**
+ * Parse a network, in CIDR notation or as a single address.
+ * @param {string} network The network (e.g., '192.0.2.0/24').
+ * @return {{bytes: !Array<number>, prefix: number}} The network's
+ *     address (with any bits beyond the prefix cleared) and prefix
+ *     length.
+ * @throws {TypeError} If network is not a valid network.
+ */
+Bans.parseNetwork = function(network) {
+  var m = String(network).match(/^([^\/]+)(?:\/(\d{1,3}))?$/);
+  var bytes = m && Bans.parseAddress(m[1]);
+  if (!bytes) throw new TypeError('Invalid network ' + network);
+  var bits = bytes.length * 8;
+  var prefix = (m[2] === undefined) ? bits : Number(m[2]);
+  // A prefix given for a mapped IPv4 address counts the mapping's 96.
+  if (bytes.length === 4 && net.isIP(m[1]) === 6 && m[2] !== undefined) {
+    prefix -= 96;
+  }
+  if (prefix < 0 || prefix > bits) {
+    throw new TypeError('Invalid prefix length in ' + network);
+  }
+  for (var i = 0; i < bytes.length; i++) {
+    var keep = Math.max(0, Math.min(8, prefix - i * 8));
+    bytes[i] &= (0xff00 >> keep) & 0xff;
+  }
+  return {bytes: bytes, prefix: prefix};
+};
+
+/**
+ * Put a network into canonical form, so that equivalent ways of
+ * writing it compare equal.
+ * @param {string} network The network (e.g., '2001:DB8:0::1/32').
+ * @return {string} The network in canonical form (e.g.,
+ *     '2001:db8::/32').
+ * @throws {TypeError} If network is not a valid network.
+ */
+Bans.canonicalize = function(network) {
+  var parsed = Bans.parseNetwork(network);
+  return Bans.formatAddress(parsed.bytes) + '/' + parsed.prefix;
+};
+
+/**
+ * Check whether a network contains an address.
+ * @param {string} network The network.
+ * @param {string} address The address.
+ * @return {boolean} True iff address is valid and within network.
+ */
+Bans.contains = function(network, address) {
+  var parsed = Bans.parseNetwork(network);
+  var bytes = Bans.parseAddress(address);
+  if (!bytes || bytes.length !== parsed.bytes.length) return false;
+  for (var i = 0; i < bytes.length; i++) {
+    var keep = Math.max(0, Math.min(8, parsed.prefix - i * 8));
+    var mask = (0xff00 >> keep) & 0xff;
+    if ((bytes[i] & mask) !== parsed.bytes[i]) return false;
+  }
+  return true;
+};
+
+/**
+ * Remove the ban (if any) of a network from a list.
+ * @param {!Array<!Bans.Ban>} bans The list.  Modified in place.
+ * @param {string} network The network, in canonical form.
+ * @return {boolean} True iff a ban was removed.
+ */
+Bans.remove = function(bans, network) {
+  for (var i = 0; i < bans.length; i++) {
+    if (bans[i].network === network) {
+      bans.splice(i, 1);
+      return true;
+    }
+  }
+  return false;
+};
+
+/**
+ * Discard any expired bans from a list.
+ * @param {!Array<!Bans.Ban>} bans The list.  Modified in place.
+ * @param {number=} now The time (default Date.now()).
+ */
+Bans.prune = function(bans, now) {
+  if (now === undefined) now = Date.now();
+  for (var i = bans.length - 1; i >= 0; i--) {
+    if (bans[i].expires !== null && bans[i].expires <= now) {
+      bans.splice(i, 1);
+    }
+  }
+};
+
+/**
+ * Find a ban (if any) applying to an address.
+ * @param {!Array<!Bans.Ban>} bans The list of bans.  Expired ones are
+ *     discarded.
+ * @param {string} address The address.
+ * @param {number=} now The time (default Date.now()).
+ * @return {?Bans.Ban} The first unexpired ban of a network containing
+ *     address, or null if none.
+ */
+Bans.find = function(bans, address, now) {
+  Bans.prune(bans, now);
+  for (var i = 0; i < bans.length; i++) {
+    if (Bans.contains(bans[i].network, address)) return bans[i];
+  }
+  return null;
+};
+
+module.exports = Bans;
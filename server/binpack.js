@@ -0,0 +1,626 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview A compact binary encoding for flatpacks (the arrays
+ * of JSON-compatible records produced by Serializer.serialize).
+ *
+ * The encoding is lossless: decoding an encoded flatpack yields a
+ * value that is JSON-equivalent to the original, so files can be
+ * converted between the textual and binary formats at will.
+ *
+ * Format (all integers are unsigned LEB128 varints):
+ *
+ *     magic:    4 bytes: 0x00 'C' 'C' 'B'
+ *     version:  format version (currently 2)
+ *     records:  (byte length, value) for each, then 0
+ *
+ * where each value is a one-byte tag (see Binpack.Tag_) followed by
+ * tag-specific data.  Each distinct string (including property
+ * names) is stored in full only the first time it is used, which
+ * implicitly adds it to the string table; subsequent uses refer to
+ * it by index.  Object references ({'#': 42}) and the encoding of
+ * undefined ({'Value': 'undefined'}) get dedicated tags, since they
+ * are very common.
+ *
+ * Since neither the number of records nor the string table need be
+ * known in advance, a flatpack can be encoded (by Binpack.Encoder)
+ * and decoded (by Binpack.Decoder) one record at a time, without
+ * ever having the whole thing in memory.
+ *
+ * Version 1 files, which had a string table and record count before
+ * the first record, can still be decoded (but not streamed).
+ */
+'use strict';
+
+var Binpack = {};
+
+/**
+ * Magic number at the start of every binary flatpack.  Since JSON
+ * text can never begin with a NUL, this also serves to distinguish
+ * the two formats.
+ * @private @const {!Buffer}
+ */
+Binpack.MAGIC_ = Buffer.from([0x00, 0x43, 0x43, 0x42]);  // '\0CCB'
+
+/**
+ * Current binary format version.
+ * @private @const {number}
+ */
+Binpack.VERSION_ = 2;
+
+/**
+ * Value type tags.
+ * @private @enum {number}
+ */
+Binpack.Tag_ = {
+  NULL: 0,
+  FALSE: 1,
+  TRUE: 2,
+  UINT: 3,       // Followed by varint n.
+  NINT: 4,       // Followed by varint n; value is -n - 1.
+  DOUBLE: 5,     // Followed by 8-byte little-endian IEEE 754 double.
+  STRING: 6,     // Followed by string reference (see Binpack.Encoder).
+  ARRAY: 7,      // Followed by varint length, then that many values.
+  OBJECT: 8,     // Followed by varint count, then (key, value) pairs.
+  REF: 9,        // Followed by varint object ID: {'#': id}.
+  UNDEFINED: 10, // Encoded undefined: {'Value': 'undefined'}.
+};
+
+/**
+ * Is the given data a binary flatpack?
+ * @param {!Buffer} data Contents of a file.
+ * @return {boolean} True iff data begins with the binary magic number.
+ */
+Binpack.isBinary = function(data) {
+  return data.length >= Binpack.MAGIC_.length &&
+      data.compare(Binpack.MAGIC_, 0, Binpack.MAGIC_.length,
+                   0, Binpack.MAGIC_.length) === 0;
+};
+
+/**
+ * Encode a flatpack in binary format.
+ * @param {!Array<*>} records JSON-compatible records.
+ * @return {!Buffer} The encoded flatpack.
+ */
+Binpack.encode = function(records) {
+  var encoder = new Binpack.Encoder();
+  var chunks = [];
+  for (var i = 0; i < records.length; i++) {
+    chunks.push(Buffer.from(encoder.encode(records[i])));
+  }
+  chunks.push(encoder.end());
+  return Buffer.concat(chunks);
+};
+
+/**
+ * Decode a binary flatpack.
+ * @param {!Buffer} data The encoded flatpack.
+ * @return {!Array<*>} JSON-compatible records.
+ */
+Binpack.decode = function(data) {
+  if (!Binpack.isBinary(data)) {
+    throw new TypeError('Not a binary flatpack');
+  }
+  var decoder = new Binpack.Decoder();
+  var records = decoder.push(data);
+  return records.concat(decoder.end());
+};
+
+/**
+ * An encoder for a binary flatpack, which encodes one record at a
+ * time.
+ *
+ * A string is encoded as a varint n: if n is 0, it is followed by
+ * the byte length and UTF-8 bytes of a string not previously used;
+ * otherwise it refers to the (n-1)th such string.
+ * @constructor
+ * @struct
+ */
+Binpack.Encoder = function() {
+  /** @private @const {!Map<string,number>} String table index. */
+  this.index_ = new Map();
+  /** @private @const {!Binpack.Writer_} */
+  this.out_ = new Binpack.Writer_();
+  /** @private @const {!Binpack.Writer_} */
+  this.scratch_ = new Binpack.Writer_();
+  /** @private {boolean} Has the header been written? */
+  this.started_ = false;
+};
+
+/**
+ * Encode a record.
+ * @param {*} record A JSON-compatible record.
+ * @return {!Buffer} The encoded record (preceded by the file header if
+ *     this is the first one).  Only valid until the next call.
+ */
+Binpack.Encoder.prototype.encode = function(record) {
+  var out = this.out_;
+  out.pos = 0;
+  this.writeHeader_();
+  var scratch = this.scratch_;
+  scratch.pos = 0;
+  Binpack.encodeValue_(record, this.index_, scratch);
+  out.writeVarint(scratch.pos);
+  out.writeBytes(scratch.buf.subarray(0, scratch.pos));
+  return out.buf.subarray(0, out.pos);
+};
+
+/**
+ * Finish encoding.
+ * @return {!Buffer} The end-of-records marker (preceded by the file
+ *     header if no records were encoded).
+ */
+Binpack.Encoder.prototype.end = function() {
+  var out = this.out_;
+  out.pos = 0;
+  this.writeHeader_();
+  out.writeVarint(0);
+  return Buffer.from(out.buf.subarray(0, out.pos));
+};
+
+/**
+ * Write the file header to the output buffer, if not already done.
+ * @private
+ */
+Binpack.Encoder.prototype.writeHeader_ = function() {
+  if (this.started_) return;
+  this.out_.writeBytes(Binpack.MAGIC_);
+  this.out_.writeVarint(Binpack.VERSION_);
+  this.started_ = true;
+};
+
+/**
+ * Encode a single JSON-compatible value.
+ * @private
+ * @param {*} value The value to encode.
+ * @param {!Map<string,number>} index String table index.
+ * @param {!Binpack.Writer_} out Where to write the encoded value.
+ */
+Binpack.encodeValue_ = function(value, index, out) {
+  var Tag = Binpack.Tag_;
+  if (value === null) {
+    out.writeByte(Tag.NULL);
+  } else if (value === false) {
+    out.writeByte(Tag.FALSE);
+  } else if (value === true) {
+    out.writeByte(Tag.TRUE);
+  } else if (typeof value === 'number') {
+    if (Number.isSafeInteger(value) && !Object.is(value, -0)) {
+      if (value >= 0) {
+        out.writeByte(Tag.UINT);
+        out.writeVarint(value);
+      } else {
+        out.writeByte(Tag.NINT);
+        out.writeVarint(-value - 1);
+      }
+    } else if (Number.isFinite(value)) {
+      out.writeByte(Tag.DOUBLE);
+      out.writeDouble(value);
+    } else {
+      throw new TypeError('Non-finite number in flatpack: ' + value);
+    }
+  } else if (typeof value === 'string') {
+    out.writeByte(Tag.STRING);
+    Binpack.encodeString_(value, index, out);
+  } else if (Array.isArray(value)) {
+    out.writeByte(Tag.ARRAY);
+    out.writeVarint(value.length);
+    for (var i = 0; i < value.length; i++) {
+      Binpack.encodeValue_(value[i], index, out);
+    }
+  } else if (value && typeof value === 'object') {
+    var keys = Object.keys(value);
+    if (keys.length === 1 && keys[0] === '#' &&
+        Number.isSafeInteger(value['#']) && value['#'] >= 0) {
+      out.writeByte(Tag.REF);
+      out.writeVarint(value['#']);
+    } else if (keys.length === 1 && keys[0] === 'Value' &&
+        value['Value'] === 'undefined') {
+      out.writeByte(Tag.UNDEFINED);
+    } else {
+      out.writeByte(Tag.OBJECT);
+      out.writeVarint(keys.length);
+      for (var i = 0; i < keys.length; i++) {
+        Binpack.encodeString_(keys[i], index, out);
+        Binpack.encodeValue_(value[keys[i]], index, out);
+      }
+    }
+  } else {
+    throw new TypeError('Value not JSON-compatible: ' + String(value));
+  }
+};
+
+/**
+ * Encode a string: in full, adding it to the string table, if it has
+ * not been seen before, or otherwise by reference.
+ * @private
+ * @param {string} string The string to encode.
+ * @param {!Map<string,number>} index String table index (modified).
+ * @param {!Binpack.Writer_} out Where to write the encoded string.
+ */
+Binpack.encodeString_ = function(string, index, out) {
+  var i = index.get(string);
+  if (i !== undefined) {
+    out.writeVarint(i + 1);
+    return;
+  }
+  index.set(string, index.size);
+  var length = Buffer.byteLength(string, 'utf8');
+  out.writeVarint(0);
+  out.writeVarint(length);
+  out.reserve(length);
+  out.pos += out.buf.write(string, out.pos, 'utf8');
+};
+
+/**
+ * A decoder for a binary flatpack, which decodes records as soon as
+ * enough data has been supplied.
+ * @constructor
+ * @struct
+ */
+Binpack.Decoder = function() {
+  /** @private {!Buffer} Data received but not yet decoded. */
+  this.pending_ = Buffer.alloc(0);
+  /** @private {number} Format version, or 0 if header not yet read. */
+  this.version_ = 0;
+  /** @private @const {!Array<string>} String table. */
+  this.strings_ = [];
+  /** @private {number} Number of records decoded so far. */
+  this.count_ = 0;
+  /** @private {boolean} Has the end-of-records marker been read? */
+  this.done_ = false;
+};
+
+/**
+ * Supply more data to the decoder.
+ * @param {!Buffer} data The next part of the encoded flatpack.
+ * @return {!Array<*>} The JSON-compatible records that could be decoded.
+ */
+Binpack.Decoder.prototype.push = function(data) {
+  if (this.done_) {
+    if (data.length) throw new RangeError('Trailing data after last record');
+    return [];
+  }
+  this.pending_ = this.pending_.length ?
+      Buffer.concat([this.pending_, data]) : data;
+  var reader = new Binpack.Reader_(this.pending_);
+  if (!this.version_) {
+    var headerLength = Binpack.MAGIC_.length + 1;
+    if (reader.buf.length < headerLength) return [];
+    if (!Binpack.isBinary(reader.buf)) {
+      throw new TypeError('Not a binary flatpack');
+    }
+    reader.pos = Binpack.MAGIC_.length;
+    this.version_ = reader.readVarint();
+    if (this.version_ !== 1 && this.version_ !== Binpack.VERSION_) {
+      throw new RangeError(
+          'Unsupported binary flatpack version ' + this.version_);
+    }
+  }
+  if (this.version_ === 1) {
+    return [];  // Decoded, all at once, by end().
+  }
+  var records = [];
+  while (reader.pos < reader.buf.length) {
+    var start = reader.pos;
+    var length = reader.tryReadVarint();
+    if (length === -1 || reader.pos + length > reader.buf.length) {
+      reader.pos = start;  // Incomplete record; await more data.
+      break;
+    }
+    if (length === 0) {
+      this.done_ = true;
+      if (reader.pos !== reader.buf.length) {
+        throw new RangeError('Trailing data after last record');
+      }
+      break;
+    }
+    var end = reader.pos + length;
+    records.push(Binpack.decodeValue_(reader, this.strings_, true));
+    if (reader.pos !== end) {
+      throw new RangeError('Record ' + this.count_ + ' has incorrect length');
+    }
+    this.count_++;
+  }
+  this.pending_ = reader.buf.subarray(reader.pos);
+  return records;
+};
+
+/**
+ * Signal the end of the data.
+ * @return {!Array<*>} Any remaining JSON-compatible records (only
+ *     for version 1 files).
+ */
+Binpack.Decoder.prototype.end = function() {
+  if (this.version_ === 1) {
+    this.done_ = true;
+    return Binpack.decodeVersion1_(this.pending_);
+  }
+  if (!this.done_) {
+    throw new RangeError('Unexpected end of binary flatpack');
+  }
+  return [];
+};
+
+/**
+ * Decode a version 1 binary flatpack.
+ * @private
+ * @param {!Buffer} data The encoded flatpack.
+ * @return {!Array<*>} JSON-compatible records.
+ */
+Binpack.decodeVersion1_ = function(data) {
+  var reader = new Binpack.Reader_(data);
+  reader.pos = Binpack.MAGIC_.length;
+  reader.readVarint();  // Version.
+  var stringCount = reader.readVarint();
+  var strings = new Array(stringCount);
+  for (var i = 0; i < stringCount; i++) {
+    var length = reader.readVarint();
+    strings[i] = reader.readBytes(length).toString('utf8');
+  }
+  var recordCount = reader.readVarint();
+  var records = new Array(recordCount);
+  for (var i = 0; i < recordCount; i++) {
+    var length = reader.readVarint();
+    var end = reader.pos + length;
+    records[i] = Binpack.decodeValue_(reader, strings, false);
+    if (reader.pos !== end) {
+      throw new RangeError('Record ' + i + ' has incorrect length');
+    }
+  }
+  if (reader.pos !== data.length) {
+    throw new RangeError('Trailing data after last record');
+  }
+  return records;
+};
+
+/**
+ * Decode a single JSON-compatible value.
+ * @private
+ * @param {!Binpack.Reader_} reader Where to read the encoded value from.
+ * @param {!Array<string>} strings String table (modified, if inline).
+ * @param {boolean} inline True if strings are defined inline on first
+ *     use (version 2); false if they are all in the string table
+ *     already (version 1).
+ * @return {*} The decoded value.
+ */
+Binpack.decodeValue_ = function(reader, strings, inline) {
+  var Tag = Binpack.Tag_;
+  var tag = reader.readByte();
+  switch (tag) {
+    case Tag.NULL:
+      return null;
+    case Tag.FALSE:
+      return false;
+    case Tag.TRUE:
+      return true;
+    case Tag.UINT:
+      return reader.readVarint();
+    case Tag.NINT:
+      return -reader.readVarint() - 1;
+    case Tag.DOUBLE:
+      return reader.readDouble();
+    case Tag.STRING:
+      return Binpack.decodeString_(reader, strings, inline);
+    case Tag.ARRAY:
+      var length = reader.readVarint();
+      var arr = new Array(length);
+      for (var i = 0; i < length; i++) {
+        arr[i] = Binpack.decodeValue_(reader, strings, inline);
+      }
+      return arr;
+    case Tag.OBJECT:
+      var count = reader.readVarint();
+      var obj = {};
+      for (var i = 0; i < count; i++) {
+        var key = Binpack.decodeString_(reader, strings, inline);
+        var value = Binpack.decodeValue_(reader, strings, inline);
+        if (key === '__proto__') {  // Create own property, as JSON.parse does.
+          Object.defineProperty(obj, key, {configurable: true,
+              enumerable: true, writable: true, value: value});
+        } else {
+          obj[key] = value;
+        }
+      }
+      return obj;
+    case Tag.REF:
+      return {'#': reader.readVarint()};
+    case Tag.UNDEFINED:
+      return {'Value': 'undefined'};
+    default:
+      throw new RangeError('Unknown tag ' + tag + ' at offset ' +
+          (reader.pos - 1));
+  }
+};
+
+/**
+ * Decode a string.
+ * @private
+ * @param {!Binpack.Reader_} reader Where to read the encoded string from.
+ * @param {!Array<string>} strings String table (modified, if inline).
+ * @param {boolean} inline As for Binpack.decodeValue_.
+ * @return {string} The decoded string.
+ */
+Binpack.decodeString_ = function(reader, strings, inline) {
+  var n = reader.readVarint();
+  if (!inline) {
+    return Binpack.lookupString_(strings, n);
+  } else if (n) {
+    return Binpack.lookupString_(strings, n - 1);
+  }
+  var string = reader.readBytes(reader.readVarint()).toString('utf8');
+  strings.push(string);
+  return string;
+};
+
+/**
+ * Look up an entry in the string table.
+ * @private
+ * @param {!Array<string>} strings String table.
+ * @param {number} i Index.
+ * @return {string}
+ */
+Binpack.lookupString_ = function(strings, i) {
+  if (i >= strings.length) {
+    throw new RangeError('String index ' + i + ' out of range');
+  }
+  return strings[i];
+};
+
+///////////////////////////////////////////////////////////////////////////////
+// Buffer reading / writing.
+
+/**
+ * A growable output buffer.
+ * @private
+ * @constructor
+ * @struct
+ */
+Binpack.Writer_ = function() {
+  /** @type {!Buffer} */
+  this.buf = Buffer.allocUnsafe(4096);
+  /** @type {number} */
+  this.pos = 0;
+};
+
+/**
+ * Ensure there is room to write n more bytes.
+ * @param {number} n Number of bytes.
+ */
+Binpack.Writer_.prototype.reserve = function(n) {
+  if (this.pos + n <= this.buf.length) return;
+  var size = this.buf.length * 2;
+  while (size < this.pos + n) size *= 2;
+  var buf = Buffer.allocUnsafe(size);
+  this.buf.copy(buf, 0, 0, this.pos);
+  this.buf = buf;
+};
+
+/** @param {number} b Byte to write. */
+Binpack.Writer_.prototype.writeByte = function(b) {
+  this.reserve(1);
+  this.buf[this.pos++] = b;
+};
+
+/** @param {!Buffer} bytes Bytes to write. */
+Binpack.Writer_.prototype.writeBytes = function(bytes) {
+  this.reserve(bytes.length);
+  bytes.copy(this.buf, this.pos);
+  this.pos += bytes.length;
+};
+
+/**
+ * Write a non-negative integer (up to 2**53 - 1) as a LEB128 varint.
+ * Uses arithmetic rather than bitwise operators, which are limited
+ * to 32 bits.
+ * @param {number} n Integer to write.
+ */
+Binpack.Writer_.prototype.writeVarint = function(n) {
+  this.reserve(8);
+  while (n >= 0x80) {
+    this.buf[this.pos++] = (n % 0x80) + 0x80;
+    n = Math.floor(n / 0x80);
+  }
+  this.buf[this.pos++] = n;
+};
+
+/** @param {number} d Double to write. */
+Binpack.Writer_.prototype.writeDouble = function(d) {
+  this.reserve(8);
+  this.buf.writeDoubleLE(d, this.pos);
+  this.pos += 8;
+};
+
+/**
+ * A reader for an input buffer.
+ * @private
+ * @constructor
+ * @struct
+ * @param {!Buffer} buf Data to read.
+ */
+Binpack.Reader_ = function(buf) {
+  /** @const {!Buffer} */
+  this.buf = buf;
+  /** @type {number} */
+  this.pos = 0;
+};
+
+/**
+ * Check that there are at least n bytes left to read.
+ * @param {number} n Number of bytes.
+ */
+Binpack.Reader_.prototype.need = function(n) {
+  if (this.pos + n > this.buf.length) {
+    throw new RangeError('Unexpected end of binary flatpack');
+  }
+};
+
+/** @return {number} Byte read. */
+Binpack.Reader_.prototype.readByte = function() {
+  this.need(1);
+  return this.buf[this.pos++];
+};
+
+/**
+ * @param {number} n Number of bytes to read.
+ * @return {!Buffer} Bytes read (shares memory with the input buffer).
+ */
+Binpack.Reader_.prototype.readBytes = function(n) {
+  this.need(n);
+  var bytes = this.buf.subarray(this.pos, this.pos + n);
+  this.pos += n;
+  return bytes;
+};
+
+/** @return {number} Varint read. */
+Binpack.Reader_.prototype.readVarint = function() {
+  var n = 0;
+  var scale = 1;
+  for (;;) {
+    var b = this.readByte();
+    n += (b & 0x7f) * scale;
+    if (b < 0x80) break;
+    scale *= 0x80;
+    if (scale > Number.MAX_SAFE_INTEGER) {
+      throw new RangeError('Varint too large');
+    }
+  }
+  return n;
+};
+
+/**
+ * Read a varint, if there are enough bytes for all of it.
+ * @return {number} Varint read, or -1 if incomplete (in which case
+ *     the read position is left unspecified).
+ */
+Binpack.Reader_.prototype.tryReadVarint = function() {
+  for (var i = this.pos; i < this.buf.length; i++) {
+    if (this.buf[i] < 0x80) return this.readVarint();
+  }
+  return -1;
+};
+
+/** @return {number} Double read. */
+Binpack.Reader_.prototype.readDouble = function() {
+  this.need(8);
+  var d = this.buf.readDoubleLE(this.pos);
+  this.pos += 8;
+  return d;
+};
+
+module.exports = Binpack;
@@ -0,0 +1,351 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Content-addressed storage of binary assets (images,
+ * sounds, maps, etc.), kept out of the heap and checkpoints.
+ *
+ * Each blob is identified by the hex SHA-256 digest of its contents,
+ * so storing the same data twice stores it once, and a blob's ID can
+ * be kept in a string property of an in-world object in place of the
+ * data itself.  Blobs are saved either as files in a directory
+ * (Blobs.FileBackend) or as objects in an S3-compatible bucket
+ * (Blobs.BucketBackend, using Backup.Bucket), and are checked against
+ * their ID whenever they are read back.  A Blobs.Server serves them
+ * over HTTP, at /<id>, with headers allowing them to be cached
+ * indefinitely (since a blob's contents never change).
+ */
+'use strict';
+
+var crypto = require('crypto');
+var fs = require('fs');
+var http = require('http');
+var path = require('path');
+
+var Blobs = {};
+
+/**
+ * Somewhere blobs are kept.  Blobs.Store checks IDs and contents, so
+ * a backend need not.
+ * @record
+ */
+Blobs.Backend = function() {};
+
+/**
+ * Save a blob (if not already saved).
+ * @param {string} id The blob's ID.
+ * @param {!Buffer} data The blob's contents.
+ * @return {!Promise<void>}
+ */
+Blobs.Backend.prototype.put;
+
+/**
+ * Read a blob.
+ * @param {string} id The blob's ID.
+ * @return {!Promise<?Buffer>} The blob's contents, or null if there is
+ *     no such blob.
+ */
+Blobs.Backend.prototype.get;
+
+/**
+ * Delete a blob (if it exists).
+ * @param {string} id The blob's ID.
+ * @return {!Promise<void>}
+ */
+Blobs.Backend.prototype.delete;
+
+/** @const {!RegExp} Valid blob IDs. */
+Blobs.ID_REGEXP = /^[0-9a-f]{64}$/;
+
+/** @const {number} Default maximum size of a blob, in bytes. */
+Blobs.MAX_SIZE = 16 * 1024 * 1024;
+
+/**
+ * Compute the ID of a blob.
+ * @param {!Buffer} data The blob's contents.
+ * @return {string} The hex SHA-256 digest of data.
+ */
+Blobs.idOf = function(data) {
+  return crypto.createHash('sha256').update(data).digest('hex');
+};
+
+/**
+ * Blobs saved as files in a directory (created if need be), in
+ * subdirectories named after the first two characters of their IDs.
+ * @constructor
+ * @struct
+ * @implements {Blobs.Backend}
+ * @param {string} dir The directory.
+ */
+Blobs.FileBackend = function(dir) {
+  /** @const {string} */
+  this.dir = dir;
+};
+
+/**
+ * Get the path of the file containing a blob.
+ * @private
+ * @param {string} id The blob's ID.
+ * @return {string}
+ */
+Blobs.FileBackend.prototype.filename_ = function(id) {
+  return path.join(this.dir, id.slice(0, 2), id);
+};
+
+/** @override */
+Blobs.FileBackend.prototype.put = function(id, data) {
+  var filename = this.filename_(id);
+  // Write to a temporary file, then rename it, so that a blob's file
+  // is never seen (nor left, after a crash) only partially written.
+  var temp = filename + '.' + process.pid + '.' +
+      crypto.randomBytes(4).toString('hex') + '.tmp';
+  var fsp = fs.promises;
+  return fsp.access(filename).catch(function() {
+    return fsp.mkdir(path.dirname(filename), {recursive: true})
+        .then(() => fsp.writeFile(temp, data))
+        .then(() => fsp.rename(temp, filename))
+        .catch(function(e) {
+          return fsp.unlink(temp).catch(function() {}).then(function() {
+            throw e;
+          });
+        });
+  });
+};
+
+/** @override */
+Blobs.FileBackend.prototype.get = function(id) {
+  return fs.promises.readFile(this.filename_(id)).catch(function(e) {
+    if (e.code === 'ENOENT') return null;
+    throw e;
+  });
+};
+
+/** @override */
+Blobs.FileBackend.prototype.delete = function(id) {
+  return fs.promises.unlink(this.filename_(id)).catch(function(e) {
+    if (e.code !== 'ENOENT') throw e;
+  });
+};
+
+/**
+ * Blobs saved as objects in a storage bucket, keyed by their IDs.
+ * @constructor
+ * @struct
+ * @implements {Blobs.Backend}
+ * @param {!Backup.Bucket} bucket The bucket (whose prefix, if any,
+ *     should not be shared with checkpoint backups).
+ */
+Blobs.BucketBackend = function(bucket) {
+  /** @const {!Backup.Bucket} */
+  this.bucket = bucket;
+};
+
+/** @override */
+Blobs.BucketBackend.prototype.put = function(id, data) {
+  return this.bucket.put(id, data);
+};
+
+/** @override */
+Blobs.BucketBackend.prototype.get = function(id) {
+  return this.bucket.get(id).then(function(object) {
+    return object.body;
+  }, function(e) {
+    if (e.status === 404) return null;
+    throw e;
+  });
+};
+
+/** @override */
+Blobs.BucketBackend.prototype.delete = function(id) {
+  return this.bucket.delete(id);
+};
+
+/**
+ * A content-addressed store of blobs.
+ * @constructor
+ * @struct
+ * @param {!Blobs.Backend} backend Where the blobs are kept.
+ * @param {{maxSize: (number|undefined)}=} options The maximum size of
+ *     a blob, in bytes (default Blobs.MAX_SIZE).
+ */
+Blobs.Store = function(backend, options) {
+  options = options || {};
+  /** @const {!Blobs.Backend} */
+  this.backend = backend;
+  /** @const {number} */
+  this.maxSize = (options.maxSize === undefined) ?
+      Blobs.MAX_SIZE : options.maxSize;
+  if (!(this.maxSize >= 0)) {
+    throw new RangeError('maxSize must be a non-negative number');
+  }
+};
+
+/**
+ * Check a blob ID.
+ * @private
+ * @param {*} id The supposed ID.
+ */
+Blobs.Store.prototype.checkId_ = function(id) {
+  if (typeof id !== 'string' || !Blobs.ID_REGEXP.test(id)) {
+    throw new TypeError('Invalid blob ID: ' + String(id));
+  }
+};
+
+/**
+ * Store a blob.
+ * @param {!Buffer} data The blob's contents.
+ * @return {!Promise<string>} Resolves to the blob's ID once it has
+ *     been saved.
+ */
+Blobs.Store.prototype.put = function(data) {
+  if (data.length > this.maxSize) {
+    return Promise.reject(new RangeError(
+        'Blob of ' + data.length + ' bytes exceeds maximum size of ' +
+        this.maxSize + ' bytes'));
+  }
+  var id = Blobs.idOf(data);
+  return this.backend.put(id, data).then(() => id);
+};
+
+/**
+ * Retrieve a blob.  Throws a TypeError if the ID is invalid.
+ * @param {string} id The blob's ID.
+ * @return {!Promise<?Buffer>} The blob's contents, or null if there is
+ *     no such blob.  Rejects if the contents do not match the ID.
+ */
+Blobs.Store.prototype.get = function(id) {
+  this.checkId_(id);
+  return this.backend.get(id).then(function(data) {
+    if (data && Blobs.idOf(data) !== id) {
+      throw new Error('Blob ' + id + ' is corrupt');
+    }
+    return data;
+  });
+};
+
+/**
+ * Delete a blob, if it exists.  Throws a TypeError if the ID is
+ * invalid.  Other objects may still refer to it, so it is up to the
+ * caller to decide that it is no longer needed.
+ * @param {string} id The blob's ID.
+ * @return {!Promise<void>}
+ */
+Blobs.Store.prototype.delete = function(id) {
+  this.checkId_(id);
+  return this.backend.delete(id);
+};
+
+/**
+ * A server of the blobs in a store, each at /<id>.  Requests may
+ * include a type parameter (e.g. /<id>?type=image/png) giving the
+ * Content-Type of the response, which is otherwise
+ * application/octet-stream.
+ * @constructor
+ * @struct
+ * @param {!Blobs.Store} store The blobs to serve.
+ */
+Blobs.Server = function(store) {
+  /** @const {!Blobs.Store} */
+  this.store = store;
+  /** @private @const {!http.Server} */
+  this.server_ = http.createServer(this.handle_.bind(this));
+};
+
+/**
+ * Start listening for requests.
+ * @param {number} port The port to listen on.
+ * @param {string=} host The address to listen on (default: all).
+ * @return {!Promise<number>} Resolves to the port listened on.
+ */
+Blobs.Server.prototype.listen = function(port, host) {
+  var server = this.server_;
+  return new Promise(function(resolve, reject) {
+    server.once('error', reject);
+    server.listen(port, host, function() {
+      server.removeListener('error', reject);
+      resolve(server.address().port);
+    });
+  });
+};
+
+/**
+ * Stop listening for requests.
+ * @return {!Promise<void>} Resolves once all connections have closed.
+ */
+Blobs.Server.prototype.close = function() {
+  var server = this.server_;
+  return new Promise(function(resolve) {
+    server.close(function() {resolve();});
+  });
+};
+
+/** @const {!RegExp} Acceptable values of the type parameter. */
+Blobs.Server.TYPE_REGEXP = /^[a-z]+\/[a-z0-9][a-z0-9.+-]*$/;
+
+/**
+ * Handle an HTTP request.
+ * @private
+ * @param {!http.IncomingMessage} req The request.
+ * @param {!http.ServerResponse} res The response.
+ */
+Blobs.Server.prototype.handle_ = function(req, res) {
+  req.resume();
+  var url = new URL(req.url, 'http://localhost');
+  var id = url.pathname.slice(1);
+  var type = url.searchParams.get('type') || 'application/octet-stream';
+  var error = function(status, message, headers) {
+    res.writeHead(status, Object.assign({'Content-Type': 'text/plain'},
+                                        headers));
+    res.end(message + '\n');
+  };
+  if (!Blobs.ID_REGEXP.test(id)) {
+    error(404, 'Not Found');
+    return;
+  } else if (req.method !== 'GET' && req.method !== 'HEAD') {
+    error(405, 'Method Not Allowed', {'Allow': 'GET, HEAD'});
+    return;
+  } else if (!Blobs.Server.TYPE_REGEXP.test(type)) {
+    error(400, 'Bad Request');
+    return;
+  }
+  var headers = {
+    'ETag': '"' + id + '"',
+    'Cache-Control': 'public, max-age=31536000, immutable',
+  };
+  if (req.headers['if-none-match'] === headers['ETag']) {
+    res.writeHead(304, headers);
+    res.end();
+    return;
+  }
+  this.store.get(id).then(function(data) {
+    if (!data) {
+      error(404, 'Not Found');
+      return;
+    }
+    res.writeHead(200, Object.assign(headers, {
+      'Content-Type': type,
+      'Content-Length': data.length,
+      'X-Content-Type-Options': 'nosniff',
+    }));
+    res.end(req.method === 'HEAD' ? undefined : data);
+  }, function(e) {
+    console.error('Unable to serve blob %s: %s', id, e.message);
+    error(500, 'Internal Server Error');
+  });
+};
+
+module.exports = Blobs;
@@ -0,0 +1,559 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Certificates for TLS listeners: a Certificates.Manager
+ * holds a certificate for each configured hostname, chosen by the
+ * name the client asks for (SNI), and wraps accepted connections in
+ * TLS.
+ *
+ * Each hostname's certificate is either read from files given in the
+ * configuration or, by default, obtained from an ACME certificate
+ * authority (Let's Encrypt, unless otherwise configured) and renewed
+ * automatically when it nears expiry.  Keys and certificates so
+ * obtained are kept in the manager's directory, as <hostname>.key and
+ * <hostname>.crt, with the ACME account key in account.key.
+ *
+ * Responses from the certificate authority's OCSP responder (RFC 6960)
+ * are fetched, cached and stapled to handshakes, so clients need not
+ * query it themselves.
+ */
+'use strict';
+
+var Acme = require('./acme');
+var crypto = require('crypto');
+var Der = require('./der');
+var fs = require('fs');
+var http = require('http');
+var path = require('path');
+var tls = require('tls');
+
+var Certificates = {};
+
+/** @const {number} Milliseconds between checks for renewals due. */
+Certificates.CHECK_INTERVAL = 12 * 60 * 60 * 1000;
+
+/** @const {number} Longest to cache an OCSP response, in milliseconds. */
+Certificates.MAX_OCSP_AGE = 7 * 24 * 60 * 60 * 1000;
+
+/** @const {number} Milliseconds to wait for a TLS handshake. */
+Certificates.HANDSHAKE_TIMEOUT = 10 * 1000;
+
+/**
+ * Configuration for a hostname: certFile and keyFile give the paths of
+ * PEM files containing its certificate chain and private key, if it is
+ * not to use ACME.
+ * @typedef {{certFile: (string|undefined), keyFile: (string|undefined)}}
+ */
+Certificates.HostOptions;
+
+/**
+ * Options for Certificates.Manager:
+ *
+ * - directory: where ACME keys and certificates are kept.
+ * - hosts: configuration for each hostname served.  The first is used
+ *   for clients that don't indicate which they want.
+ * - acmeDirectory: URL of the ACME server's directory (default: Let's
+ *   Encrypt).
+ * - email: contact address for the ACME account.
+ * - challengePort: port on which to answer ACME http-01 challenges
+ *   while obtaining certificates (default 80), or 0 if they are to be
+ *   answered by .responder by some other means.
+ * - renewDays: renew certificates this many days before they expire
+ *   (default 30).
+ * - ocspStapling: staple OCSP responses? (Default true.)
+ * - pollInterval: passed on to Acme.Client.
+ * - log: function to log progress (default console.log).
+ * @typedef {{
+ *     directory: string,
+ *     hosts: !Object<string,!Certificates.HostOptions>,
+ *     acmeDirectory: (string|undefined),
+ *     email: (string|undefined),
+ *     challengePort: (number|undefined),
+ *     renewDays: (number|undefined),
+ *     ocspStapling: (boolean|undefined),
+ *     pollInterval: (number|undefined),
+ *     log: (function(...*)|undefined),
+ * }}
+ */
+Certificates.Options;
+
+/**
+ * Manages the certificates of a set of hostnames.
+ * @constructor
+ * @param {!Certificates.Options} options Options.
+ */
+Certificates.Manager = function(options) {
+  var hostnames = Object.keys(options.hosts || {});
+  if (!hostnames.length) throw new Error('No TLS hosts configured');
+  /** @private @const {string} */
+  this.directory_ = options.directory;
+  /** @private @const {string} */
+  this.acmeDirectory_ = options.acmeDirectory || Acme.LETS_ENCRYPT;
+  /** @private @const {string|undefined} */
+  this.email_ = options.email;
+  /** @private @const {number} */
+  this.challengePort_ =
+      (options.challengePort === undefined) ? 80 : options.challengePort;
+  /** @private @const {number} Milliseconds. */
+  this.renewBefore_ =
+      (options.renewDays === undefined ? 30 : options.renewDays) * 86400000;
+  /** @private @const {boolean} */
+  this.ocspStapling_ = options.ocspStapling !== false;
+  /** @private @const {number|undefined} */
+  this.pollInterval_ = options.pollInterval;
+  /** @private @const {function(...*)} */
+  this.log_ = options.log || console.log;
+  /**
+   * State of each hostname, by (lower case) name.
+   * @private @const {!Map<string,!Certificates.Host_>}
+   */
+  this.hosts_ = new Map();
+  for (var i = 0; i < hostnames.length; i++) {
+    this.hosts_.set(hostnames[i].toLowerCase(),
+                    new Certificates.Host_(hostnames[i].toLowerCase(),
+                                           options.hosts[hostnames[i]]));
+  }
+  /** @private @const {!Certificates.Host_} */
+  this.defaultHost_ = this.hosts_.get(hostnames[0].toLowerCase());
+  /** @const {!Acme.Responder} Answers ACME challenges. */
+  this.responder = new Acme.Responder();
+  /** @private {?Acme.Client} Created when first needed. */
+  this.client_ = null;
+  /** @private {?http.Server} Serving ACME challenges, if any. */
+  this.challengeServer_ = null;
+  /** @private {?Promise} Renewal in progress, if any. */
+  this.renewing_ = null;
+  /** @private {?NodeJS.Timer} */
+  this.timer_ = null;
+
+  var manager = this;
+  /**
+   * tls.Server (which never listens) used to configure the TLSSockets
+   * created by .wrap, and to handle OCSP stapling for them.
+   * @private @const {!tls.Server}
+   */
+  this.server_ = tls.createServer({
+    SNICallback: function(servername, callback) {
+      manager.sniCallback_(servername, callback);
+    },
+  });
+  if (this.ocspStapling_) {
+    this.server_.on('OCSPRequest', function(cert, issuer, callback) {
+      manager.ocspRequest_(cert, issuer, callback);
+    });
+  }
+};
+
+/**
+ * Load the certificates available, then obtain or renew any that are
+ * missing or due for renewal, and check again periodically.
+ * @return {!Promise} Resolves once renewals have been attempted (TLS
+ *     connections can be accepted before then, but will fail for
+ *     hostnames with no certificate yet).
+ */
+Certificates.Manager.prototype.start = function() {
+  this.hosts_.forEach(function(host) {
+    try {
+      this.load_(host);
+    } catch (e) {
+      if (host.options.certFile) {
+        this.log_('Unable to load certificate for %s: %s', host.name, e);
+      }
+    }
+  }, this);
+  var manager = this;
+  this.timer_ = setInterval(function() {
+    manager.renew();
+  }, Certificates.CHECK_INTERVAL);
+  return this.renew();
+};
+
+/**
+ * Stop checking for renewals.
+ */
+Certificates.Manager.prototype.stop = function() {
+  if (this.timer_) clearInterval(this.timer_);
+  this.timer_ = null;
+  this.stopChallengeServer_();
+};
+
+/**
+ * Wrap a newly-accepted connection in TLS.  Clients that don't say
+ * which hostname they want (via SNI) get the first, without an OCSP
+ * response.  The connection is destroyed if the handshake is not
+ * complete within HANDSHAKE_TIMEOUT.
+ * @param {!net.Socket} socket The connection.
+ * @return {!tls.TLSSocket} The connection, which emits 'secure' once
+ *     the handshake is complete.
+ */
+Certificates.Manager.prototype.wrap = function(socket) {
+  var manager = this;
+  var secure = new tls.TLSSocket(socket, {
+    isServer: true,
+    server: this.server_,
+    secureContext: this.defaultHost_.context || undefined,
+    SNICallback: function(servername, callback) {
+      manager.sniCallback_(servername, callback);
+    },
+  });
+  var timer = setTimeout(function() {
+    secure.destroy();
+  }, Certificates.HANDSHAKE_TIMEOUT);
+  secure.once('secure', function() {
+    clearTimeout(timer);
+  });
+  secure.once('close', function() {
+    clearTimeout(timer);
+  });
+  return secure;
+};
+
+/**
+ * Obtain certificates (from the ACME server) for those hostnames that
+ * don't have one, or whose certificate expires soon.
+ * @return {!Promise} Resolves (even if some renewals failed) once all
+ *     have been attempted.
+ */
+Certificates.Manager.prototype.renew = function() {
+  if (this.renewing_) return this.renewing_;
+  var manager = this;
+  var due = Array.from(this.hosts_.values()).filter(function(host) {
+    return !host.options.certFile && (!host.cert ||
+        Date.parse(host.cert.validTo) - Date.now() < manager.renewBefore_);
+  });
+  if (!due.length) return Promise.resolve();
+  var done = this.startChallengeServer_();
+  due.forEach(function(host) {
+    done = done.then(function() {
+      return manager.issue_(host);
+    }).catch(function(e) {
+      manager.log_('Unable to obtain certificate for %s: %s', host.name, e);
+    });
+  });
+  this.renewing_ = done.then(function() {
+    manager.stopChallengeServer_();
+    manager.renewing_ = null;
+  });
+  return this.renewing_;
+};
+
+/**
+ * Get the secure context for a connection.
+ * @private
+ * @param {string|undefined} servername Hostname requested by client.
+ * @param {function(?Error, !tls.SecureContext=)} callback
+ */
+Certificates.Manager.prototype.sniCallback_ = function(servername,
+                                                       callback) {
+  var host = servername && this.hosts_.get(servername.toLowerCase()) ||
+      this.defaultHost_;
+  if (host.context) {
+    callback(null, host.context);
+  } else {
+    callback(new Error('No certificate for ' + (servername || host.name)));
+  }
+};
+
+/**
+ * Read a hostname's certificate and key, and create its secure
+ * context.
+ * @private
+ * @param {!Certificates.Host_} host The hostname.
+ */
+Certificates.Manager.prototype.load_ = function(host) {
+  var certFile = host.options.certFile ||
+      path.join(this.directory_, host.name + '.crt');
+  var keyFile = host.options.keyFile ||
+      path.join(this.directory_, host.name + '.key');
+  this.install_(host, fs.readFileSync(certFile, 'utf8'),
+                fs.readFileSync(keyFile, 'utf8'));
+};
+
+/**
+ * Start using a certificate.
+ * @private
+ * @param {!Certificates.Host_} host The hostname.
+ * @param {string} chain Certificate chain, PEM encoded.
+ * @param {string} key Private key, PEM encoded.
+ */
+Certificates.Manager.prototype.install_ = function(host, chain, key) {
+  host.context = tls.createSecureContext({cert: chain, key: key});
+  host.cert = new crypto.X509Certificate(chain);
+  host.ocsp = null;
+  this.log_('Certificate for %s valid until %s.', host.name,
+            host.cert.validTo);
+};
+
+/**
+ * Obtain a new certificate for a hostname from the ACME server.
+ * @private
+ * @param {!Certificates.Host_} host The hostname.
+ * @return {!Promise}
+ */
+Certificates.Manager.prototype.issue_ = function(host) {
+  this.log_('Requesting certificate for %s from %s.', host.name,
+            this.acmeDirectory_);
+  var key = crypto.generateKeyPairSync('ec', {namedCurve: 'P-256'}).privateKey;
+  var manager = this;
+  return this.getClient_().issue([host.name], key, this.responder).then(
+      function(chain) {
+        var keyPem = key.export({type: 'pkcs8', format: 'pem'});
+        manager.install_(host, chain, String(keyPem));
+        Certificates.writeSecret_(
+            path.join(manager.directory_, host.name + '.key'), keyPem);
+        fs.writeFileSync(path.join(manager.directory_, host.name + '.crt'),
+                         chain);
+      });
+};
+
+/**
+ * Get the ACME client, creating the account key if necessary.
+ * @private
+ * @return {!Acme.Client}
+ */
+Certificates.Manager.prototype.getClient_ = function() {
+  if (this.client_) return this.client_;
+  var filename = path.join(this.directory_, 'account.key');
+  var key;
+  if (fs.existsSync(filename)) {
+    key = crypto.createPrivateKey(fs.readFileSync(filename));
+  } else {
+    key = crypto.generateKeyPairSync('ec', {namedCurve: 'P-256'}).privateKey;
+    Certificates.writeSecret_(filename,
+                              key.export({type: 'pkcs8', format: 'pem'}));
+  }
+  this.client_ = new Acme.Client(this.acmeDirectory_, key,
+      {email: this.email_, pollInterval: this.pollInterval_});
+  return this.client_;
+};
+
+/**
+ * Start listening for ACME challenges (unless configured not to).
+ * @private
+ * @return {!Promise}
+ */
+Certificates.Manager.prototype.startChallengeServer_ = function() {
+  if (!this.challengePort_ || this.challengeServer_) return Promise.resolve();
+  var responder = this.responder;
+  var server = http.createServer(function(req, res) {
+    responder.handle(req, res);
+  });
+  this.challengeServer_ = server;
+  var manager = this;
+  return new Promise(function(resolve) {
+    server.on('error', function(e) {
+      // Perhaps the challenges are to be answered another way.
+      manager.log_('Unable to answer ACME challenges on port %d: %s',
+                   manager.challengePort_, e);
+      manager.challengeServer_ = null;
+      resolve();
+    });
+    server.listen(manager.challengePort_, resolve);
+  });
+};
+
+/**
+ * Stop listening for ACME challenges.
+ * @private
+ */
+Certificates.Manager.prototype.stopChallengeServer_ = function() {
+  if (!this.challengeServer_) return;
+  this.challengeServer_.close();
+  this.challengeServer_ = null;
+};
+
+/**
+ * Supply the OCSP response to staple to a handshake, fetching a new
+ * one if there is none cached or it is due for refresh.
+ * @private
+ * @param {?Buffer} certDer The certificate (DER encoded), if known.
+ * @param {?Buffer} issuerDer Its issuer's certificate, if known.
+ * @param {function(?Error, ?Buffer)} callback Called with the
+ *     response, or null to staple nothing.
+ */
+Certificates.Manager.prototype.ocspRequest_ = function(certDer, issuerDer,
+                                                       callback) {
+  var host = certDer && Array.from(this.hosts_.values()).find(function(h) {
+    return h.cert && h.cert.raw.equals(certDer);
+  });
+  if (!host || !issuerDer) {
+    callback(null, null);
+    return;
+  }
+  var now = Date.now();
+  var cached = host.ocsp;
+  if (cached && now < cached.refreshAt) {
+    callback(null, cached.response);
+    return;
+  }
+  var fetching = host.ocspFetch || Certificates.fetchOcsp(certDer, issuerDer);
+  host.ocspFetch = fetching;
+  var manager = this;
+  fetching.catch(function(e) {
+    manager.log_('OCSP request for %s failed: %s', host.name, e);
+    return null;
+  }).then(function(result) {
+    host.ocspFetch = null;
+    if (result) host.ocsp = result;
+    if (!cached || Date.now() >= cached.expires) {
+      // Nothing usable until now.
+      cached = host.ocsp;
+      callback(null, (cached && Date.now() < cached.expires) ?
+               cached.response : null);
+    }
+  });
+  if (cached && now < cached.expires) {
+    // Still valid; use while refreshing.
+    callback(null, cached.response);
+  }
+};
+
+/**
+ * A cached OCSP response, with the times (in milliseconds since the
+ * epoch) that it should be refreshed and that it expires.
+ * @typedef {{response: !Buffer, refreshAt: number, expires: number}}
+ */
+Certificates.OcspResponse;
+
+/**
+ * Build an OCSP request for a certificate.
+ * @param {!Buffer} certDer The certificate (DER encoded).
+ * @param {!Buffer} issuerDer Its issuer's certificate (DER encoded).
+ * @return {!Buffer} The DER-encoded request.
+ */
+Certificates.ocspRequest = function(certDer, issuerDer) {
+  var sha1 = function(data) {
+    return crypto.createHash('sha1').update(data).digest();
+  };
+  var tbs = Certificates.tbsFields_(certDer);
+  var issuer = Certificates.tbsFields_(issuerDer);
+  var issuerKey = issuer.spki.child(1).contents.subarray(1);  // Unused bits.
+  return Der.sequence([Der.sequence([Der.sequence([Der.sequence([
+    Der.sequence([
+      Der.sequence([Der.oid('1.3.14.3.2.26'), Der.NULL]),  // SHA-1
+      Der.octetString(sha1(issuer.subject.raw)),
+      Der.octetString(sha1(issuerKey)),
+      tbs.serial.raw,
+    ]),
+  ])])])]);
+};
+
+/**
+ * Fetch a certificate's status from its issuer's OCSP responder (given
+ * in the certificate's authority information access extension).
+ * @param {!Buffer} certDer The certificate (DER encoded).
+ * @param {!Buffer} issuerDer Its issuer's certificate (DER encoded).
+ * @return {!Promise<?Certificates.OcspResponse>} The response, or null
+ *     if the certificate names no responder.  Rejects if the request
+ *     fails, or the certificate is not reported as good.
+ */
+Certificates.fetchOcsp = function(certDer, issuerDer) {
+  var info = new crypto.X509Certificate(certDer).infoAccess || '';
+  var m = info.match(/^OCSP - URI:(\S+)$/m);
+  if (!m) return Promise.resolve(null);
+  var body = Certificates.ocspRequest(certDer, issuerDer);
+  return Acme.request('POST', m[1], {
+    'content-type': 'application/ocsp-request',
+    'content-length': String(body.length),
+  }, body).then(function(res) {
+    if (res.status !== 200) throw new Error('OCSP responder: ' + res.status);
+    return Certificates.parseOcspResponse(res.body);
+  });
+};
+
+/**
+ * Check an OCSP response, and determine how long it may be cached.
+ * @param {!Buffer} response The DER-encoded response.
+ * @param {number=} now Current time, in milliseconds since the epoch.
+ *     (Default: Date.now().)
+ * @return {!Certificates.OcspResponse}
+ * @throws {Error} If the response is unsuccessful, malformed or not
+ *     for a good certificate.
+ */
+Certificates.parseOcspResponse = function(response, now) {
+  if (now === undefined) now = Date.now();
+  var root = Der.decode(response);
+  var status = root.child(0).contents[0];
+  if (status !== 0) throw new Error('OCSP response status ' + status);
+  var basic = Der.decode(root.child(1).child(0).child(1).contents);
+  var data = basic.child(0);
+  // Skip optional version, responderID and producedAt.
+  var i = 0;
+  while (data.child(i).tag !== Der.Tag.GENERALIZED_TIME) i++;
+  var single = data.child(i + 1).child(0);
+  if (single.child(1).tag !== 0x80) {  // good: [0] IMPLICIT NULL.
+    throw new Error('Certificate status is not good');
+  }
+  var thisUpdate = single.child(2).time().getTime();
+  var hasNext = single.children.length > 3 && single.child(3).tag === 0xa0;
+  var nextUpdate = hasNext ? single.child(3).child(0).time().getTime() :
+      thisUpdate + Certificates.MAX_OCSP_AGE;
+  var expires = Math.min(nextUpdate, now + Certificates.MAX_OCSP_AGE);
+  if (expires <= now) throw new Error('OCSP response has expired');
+  return {response: response, refreshAt: now + (expires - now) / 2,
+          expires: expires};
+};
+
+/**
+ * Get the fields of a certificate needed for OCSP requests.
+ * @private
+ * @param {!Buffer} der The DER-encoded certificate.
+ * @return {{serial: !Der.Element, subject: !Der.Element,
+ *           spki: !Der.Element}}
+ */
+Certificates.tbsFields_ = function(der) {
+  var tbs = Der.decode(der).child(0);
+  var i = (tbs.child(0).tag === 0xa0) ? 1 : 0;  // Skip version.
+  return {serial: tbs.child(i), subject: tbs.child(i + 4),
+          spki: tbs.child(i + 5)};
+};
+
+/**
+ * Write a file readable only by its owner.
+ * @private
+ * @param {string} filename Name of file.
+ * @param {string|!Buffer} data Contents.
+ */
+Certificates.writeSecret_ = function(filename, data) {
+  fs.writeFileSync(filename, data, {mode: 0o600});
+};
+
+/**
+ * The state of a hostname.
+ * @private
+ * @constructor
+ * @struct
+ * @param {string} name The hostname.
+ * @param {!Certificates.HostOptions} options Its configuration.
+ */
+Certificates.Host_ = function(name, options) {
+  /** @const {string} */
+  this.name = name;
+  /** @const {!Certificates.HostOptions} */
+  this.options = options || {};
+  /** @type {?tls.SecureContext} */
+  this.context = null;
+  /** @type {?crypto.X509Certificate} */
+  this.cert = null;
+  /** @type {?Certificates.OcspResponse} */
+  this.ocsp = null;
+  /** @type {?Promise<?Certificates.OcspResponse>} Fetch in progress. */
+  this.ocspFetch = null;
+};
+
+module.exports = Certificates;
@@ -0,0 +1,465 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Parsing users' commands and finding the verbs that
+ * handle them (the CC.commandParse, CC.commandMatch, CC.commandResolve
+ * and CC.commandFindVerb builtins), which would otherwise be done in
+ * interpreted code for every command typed.
+ *
+ * Commands are of the form:
+ *
+ *     <verb> <direct object> <preposition> <indirect object>
+ *
+ * where all parts but <verb> are optional (though <preposition> is
+ * required if <indirect object> is present).  Words may be grouped by
+ * double quotes (e.g., say "put it in the box"); quoted words are never
+ * taken to be prepositions.
+ *
+ * A verb is a function, found on one of a set of host objects (or
+ * their prototypes), that has string properties verb (a regular
+ * expression the verb must match in full), dobj and iobj (each 'none',
+ * 'this' or 'any') and prep ('none', 'any' or one of the values of
+ * Command.PREPOSITIONS), as set by the in-world code editor.
+ */
+'use strict';
+
+var RegExpGuard = require('./regexp_guard');
+
+var Command = {};
+
+/**
+ * Prepositions, each with the option (as used by the prep property of
+ * verbs) it belongs to.  Multi-word prepositions are given with single
+ * spaces.
+ * @const {!Object<string, string>}
+ */
+Command.PREPOSITIONS = {
+  'with': 'with/using',
+  'using': 'with/using',
+  'at': 'at/to',
+  'to': 'at/to',
+  'in front of': 'in front of',
+  'in': 'in/inside/into',
+  'inside': 'in/inside/into',
+  'into': 'in/inside/into',
+  'on top of': 'on top of/on/onto/upon',
+  'on': 'on top of/on/onto/upon',
+  'onto': 'on top of/on/onto/upon',
+  'upon': 'on top of/on/onto/upon',
+  'over': 'over',
+  'through': 'through',
+  'under': 'under/underneath/beneath',
+  'underneath': 'under/underneath/beneath',
+  'beneath': 'under/underneath/beneath',
+  'behind': 'behind',
+  'beside': 'beside',
+  'for': 'for/about',
+  'about': 'for/about',
+  'is': 'is',
+  'as': 'as',
+  'off': 'off/off of',
+  'off of': 'off/off of',
+  'out of': 'out of/from inside/from',
+  'from inside': 'out of/from inside/from',
+  'from': 'out of/from inside/from',
+};
+
+/**
+ * Prepositions as arrays of words, longest first (so that, e.g.,
+ * 'on top of' is preferred to 'on').
+ * @private @const {!Array<!Array<string>>}
+ */
+Command.PREPOSITION_WORDS_ = Object.keys(Command.PREPOSITIONS).map(
+    function(prep) {return prep.split(' ');}).sort(function(a, b) {
+      return b.length - a.length;
+    });
+
+/**
+ * Ordinal words, with the numbers they stand for.  (Ordinals can also
+ * be written as, e.g., 2nd or 11th.)
+ * @const {!Object<string, number>}
+ */
+Command.ORDINALS = {
+  'first': 1,
+  'second': 2,
+  'third': 3,
+  'fourth': 4,
+  'fifth': 5,
+  'sixth': 6,
+  'seventh': 7,
+  'eighth': 8,
+  'ninth': 9,
+  'tenth': 10,
+};
+
+/**
+ * Maximum number of compiled verb patterns to cache.
+ * @const {number}
+ */
+Command.CACHE_SIZE = 1000;
+
+/**
+ * Estimated speed (properties examined per ms, when finding a verb),
+ * for computing the cost of operations.
+ * @const {number}
+ */
+Command.SPEED = 1000;
+
+/**
+ * A parsed command:
+ *
+ * - cmdstr: the command, as given.
+ * - verbstr: its first word.
+ * - argstr: the rest of it, starting from the second character after
+ *   the verb.
+ * - args: the words of argstr (with any quotes removed).
+ * - dobjstr: the words before the (first) preposition, if any.
+ * - prepstr: the (first) preposition, if any.
+ * - iobjstr: the words after it.
+ *
+ * cmdstr, verbstr and argstr are unmodified from the command, while
+ * dobjstr, prepstr and iobjstr are normalized (words joined by single
+ * spaces).
+ * @typedef {{cmdstr: string,
+ *            verbstr: string,
+ *            argstr: string,
+ *            args: !Array<string>,
+ *            dobjstr: string,
+ *            prepstr: string,
+ *            iobjstr: string}}
+ */
+Command.Parsed;
+
+/**
+ * Split some text into words, at whitespace except within double
+ * quotes.  Within quotes, a backslash escapes the next character.  An
+ * unterminated quote extends to the end of the text.
+ * @param {string} text The text.
+ * @return {!Array<{text: string, quoted: boolean}>} The words.
+ */
+Command.words = function(text) {
+  var words = [];
+  var re = /"((?:[^"\\]|\\[^])*)(?:"|$)|[^\s"]+/g;
+  var m;
+  while ((m = re.exec(text))) {
+    if (m[1] === undefined) {
+      words.push({text: m[0], quoted: false});
+    } else {
+      words.push({text: m[1].replace(/\\([^])/g, '$1'), quoted: true});
+    }
+  }
+  return words;
+};
+
+/**
+ * Parse a command.
+ * @param {string} cmdstr The command.
+ * @return {?Command.Parsed} The parsed command, or null if it contains
+ *     no non-whitespace characters.
+ */
+Command.parse = function(cmdstr) {
+  var m = /^\s*(\S+)(?:\s([^]*))?/.exec(cmdstr);
+  if (!m) return null;
+  var argstr = m[2] || '';
+  var words = Command.words(argstr);
+  var texts = words.map(function(word) {return word.text;});
+  var parsed = {
+    cmdstr: cmdstr,
+    verbstr: m[1],
+    argstr: argstr,
+    args: texts,
+    dobjstr: texts.join(' '),
+    prepstr: '',
+    iobjstr: '',
+  };
+  for (var i = 0; i < words.length; i++) {
+    var prep = Command.PREPOSITION_WORDS_.find(function(prep) {
+      for (var j = 0; j < prep.length; j++) {
+        var word = words[i + j];
+        if (!word || word.quoted || word.text !== prep[j]) return false;
+      }
+      return true;
+    });
+    if (prep) {
+      parsed.dobjstr = texts.slice(0, i).join(' ');
+      parsed.prepstr = prep.join(' ');
+      parsed.iobjstr = texts.slice(i + prep.length).join(' ');
+      break;
+    }
+  }
+  return parsed;
+};
+
+/**
+ * Score a string as a match for an object's name and aliases.
+ * @param {string} str The string (e.g., a dobjstr).
+ * @param {string} name The object's name.
+ * @param {!Array<string>} aliases Its aliases.
+ * @return {number} 0 for no match, 1 if str is a prefix of the name or
+ *     an alias, 2 if it is an alias, or 3 if it is the name (ignoring
+ *     case).
+ */
+Command.strength = function(str, name, aliases) {
+  if (!str) return 0;
+  str = str.toLowerCase();
+  name = name.toLowerCase();
+  if (name === str) return 3;
+  var partial = name.startsWith(str);
+  for (var i = 0; i < aliases.length; i++) {
+    var alias = aliases[i].toLowerCase();
+    if (alias === str) return 2;
+    partial = partial || alias.startsWith(str);
+  }
+  return partial ? 1 : 0;
+};
+
+/**
+ * Find the objects, amongst some candidates (e.g., those near the user
+ * who typed a command), that best match a string: those whose name it
+ * is, else those it is an alias of, else those whose name or an alias
+ * it is a prefix of.  Names and aliases are read with the perms of the
+ * caller; objects whose name cannot be read are ignored.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {string} str The string.
+ * @param {!Array<?Interpreter.Value>} objects The candidates.
+ * @param {!Interpreter.Owner} perms Who is matching.
+ * @return {!Array<!Interpreter.prototype.Object>} The best matches (each
+ *     once), in the order given.
+ */
+Command.match = function(intrp, str, objects, perms) {
+  str = str.trim();
+  var best = 0;
+  var matches = [];
+  for (var i = 0; i < objects.length; i++) {
+    var obj = objects[i];
+    if (!(obj instanceof intrp.Object) || matches.includes(obj)) continue;
+    try {
+      var name = obj.get('name', perms);
+      var aliases = obj.get('aliases', perms);
+      aliases = (aliases instanceof intrp.Array) ?
+          intrp.createListFromArrayLike(aliases, perms) : [];
+    } catch (e) {
+      continue;
+    }
+    if (typeof name !== 'string') continue;
+    var strength = Command.strength(str, name, aliases.filter(
+        function(alias) {return typeof alias === 'string';}));
+    if (!strength || strength < best) continue;
+    if (strength > best) {
+      best = strength;
+      matches.length = 0;
+    }
+    matches.push(obj);
+  }
+  return matches;
+};
+
+/**
+ * The result of resolving a string to an object:
+ *
+ * - match: the object it refers to, or null if none or if it is
+ *   ambiguous.
+ * - matches: the objects it best matches (ignoring any ordinal), in
+ *   the order given.  If there is more than one, and no ordinal to
+ *   choose between them, these are what it might refer to.
+ * - ambiguous: true iff it matches more than one object, and no
+ *   ordinal chooses between them.
+ * - ordinal: the ordinal given (e.g., 2 for 'second lamp'), or null if
+ *   none.  If it is greater than the number of matches, match is null.
+ * @typedef {{match: ?Interpreter.prototype.Object,
+ *            matches: !Array<!Interpreter.prototype.Object>,
+ *            ambiguous: boolean,
+ *            ordinal: ?number}}
+ */
+Command.Resolution;
+
+/**
+ * Split a leading ordinal (e.g., 'second' or '2nd') from a string.
+ * @param {string} str The string (e.g., 'second lamp').
+ * @return {?{ordinal: number, rest: string}} The ordinal and the rest
+ *     of the string (e.g., 2 and 'lamp'), or null if it does not start
+ *     with an ordinal followed by something else.
+ */
+Command.splitOrdinal = function(str) {
+  var m = /^\s*(\S+)\s+(\S[^]*)$/.exec(str);
+  if (!m) return null;
+  var word = m[1].toLowerCase();
+  var ordinal = null;
+  if (Object.prototype.hasOwnProperty.call(Command.ORDINALS, word)) {
+    ordinal = Command.ORDINALS[word];
+  } else if (/^[1-9]\d{0,5}(?:st|nd|rd|th)$/.test(word)) {
+    ordinal = parseInt(word, 10);
+  }
+  return ordinal ? {ordinal: ordinal, rest: m[2].trim()} : null;
+};
+
+/**
+ * Resolve a string to one of some candidate objects (see
+ * Command.match), choosing between several matches by a leading
+ * ordinal (e.g., 'second lamp', or '2nd lamp'), if given.  A string
+ * that matches as a whole is not taken to start with an ordinal (so an
+ * object named 'first aid kit' is found by 'first aid').
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {string} str The string.
+ * @param {!Array<?Interpreter.Value>} objects The candidates.
+ * @param {!Interpreter.Owner} perms Who is matching.
+ * @return {!Command.Resolution} The result.
+ */
+Command.resolve = function(intrp, str, objects, perms) {
+  var matches = Command.match(intrp, str, objects, perms);
+  var split = matches.length ? null : Command.splitOrdinal(str);
+  if (split) {
+    matches = Command.match(intrp, split.rest, objects, perms);
+    return {
+      match: matches[split.ordinal - 1] || null,
+      matches: matches,
+      ambiguous: false,
+      ordinal: split.ordinal,
+    };
+  }
+  return {
+    match: (matches.length === 1) ? matches[0] : null,
+    matches: matches,
+    ambiguous: matches.length > 1,
+    ordinal: null,
+  };
+};
+
+/**
+ * Cache of compiled verb patterns, by source.  (A null entry is an
+ * invalid pattern.)
+ * @private @const {!Map<string, ?RegExp>}
+ */
+Command.verbRegExps_ = new Map();
+
+/**
+ * Compile a verb pattern (to a RegExp matching the verb in full).
+ * @private
+ * @param {string} spec The pattern.
+ * @return {?RegExp} The RegExp, or null if spec is not valid.
+ */
+Command.verbRegExp_ = function(spec) {
+  var regexp = Command.verbRegExps_.get(spec);
+  if (regexp === undefined) {
+    try {
+      regexp = new RegExp('^(?:' + spec + ')$');
+    } catch (e) {
+      regexp = null;
+    }
+    if (Command.verbRegExps_.size >= Command.CACHE_SIZE) {
+      Command.verbRegExps_.clear();
+    }
+    Command.verbRegExps_.set(spec, regexp);
+  }
+  return regexp;
+};
+
+/**
+ * Does an object spec (the dobj or iobj property of a verb) accept an
+ * object?
+ * @private
+ * @param {string} spec The spec: 'any', 'this' or 'none'.
+ * @param {?Interpreter.Value} obj The object matched (or null if none
+ *     was given).
+ * @param {!Interpreter.prototype.Object} host The object the verb is
+ *     on.
+ * @return {boolean} True iff it does.
+ */
+Command.objMatches_ = function(spec, obj, host) {
+  return spec === 'any' || (spec === 'this' && obj === host) ||
+      (spec === 'none' && !obj);
+};
+
+/**
+ * Find the verb that handles a parsed command: the first function, in
+ * the enumerable properties (own or inherited) of each host in turn,
+ * whose verb, dobj, prep and iobj properties match the command.
+ * Properties are read with the perms of the caller; those that cannot
+ * be read are skipped.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {{verbstr: string,
+ *          prepstr: string,
+ *          dobj: ?Interpreter.Value,
+ *          iobj: ?Interpreter.Value}} cmd The command, with the objects
+ *     matched for its dobjstr and iobjstr.
+ * @param {!Array<?Interpreter.Value>} hosts Objects that could host the
+ *     verb, in order of preference (e.g., the user, their location,
+ *     cmd.dobj and cmd.iobj).  Non-objects are ignored.
+ * @param {!Interpreter.Owner} perms Who is looking.
+ * @return {{verb: ?{host: !Interpreter.prototype.Object, key: string},
+ *           examined: number}} The host and key of the verb found (or
+ *     null if none), and the number of properties examined.
+ */
+Command.findVerb = function(intrp, cmd, hosts, perms) {
+  var examined = 0;
+  var prep = 'none';
+  if (cmd.prepstr) {
+    prep = Object.prototype.hasOwnProperty.call(
+        Command.PREPOSITIONS, cmd.prepstr) ? Command.PREPOSITIONS[cmd.prepstr] :
+        null;
+  }
+  var done = new Set();
+  for (var i = 0; i < hosts.length; i++) {
+    var host = hosts[i];
+    if (!(host instanceof intrp.Object) || done.has(host)) continue;
+    done.add(host);
+    var seen = new Set();
+    for (var obj = host; obj; obj = obj.proto) {
+      try {
+        var keys = obj.ownKeys(perms);
+      } catch (e) {
+        break;
+      }
+      for (var j = 0; j < keys.length; j++) {
+        var key = keys[j];
+        if (seen.has(key)) continue;  // Shadowed.
+        seen.add(key);
+        examined++;
+        try {
+          var pd = obj.getOwnPropertyDescriptor(key, perms);
+          var func = pd && pd.enumerable && pd.value;
+          if (!(func instanceof intrp.Function)) continue;
+          var verbSpec = func.get('verb', perms);
+          var dobjSpec = func.get('dobj', perms);
+          var prepSpec = func.get('prep', perms);
+          var iobjSpec = func.get('iobj', perms);
+        } catch (e) {
+          continue;
+        }
+        if (typeof verbSpec !== 'string' || !verbSpec ||
+            typeof dobjSpec !== 'string' || typeof prepSpec !== 'string' ||
+            typeof iobjSpec !== 'string') {
+          continue;  // Not a verb.
+        }
+        if ((prepSpec === 'any' || prepSpec === prep) &&
+            Command.objMatches_(dobjSpec, cmd.dobj, host) &&
+            Command.objMatches_(iobjSpec, cmd.iobj, host)) {
+          var regexp = Command.verbRegExp_(verbSpec);
+          if (regexp && RegExpGuard.run(regexp, function() {
+                return regexp.test(cmd.verbstr);
+              })) {
+            return {verb: {host: host, key: key}, examined: examined};
+          }
+        }
+      }
+    }
+  }
+  return {verb: null, examined: examined};
+};
+
+module.exports = Command;
@@ -0,0 +1,193 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Compression for in-world code (the CC.compress and
+ * CC.decompress builtins), e.g. of stored logs or HTTP responses.
+ *
+ * The formats are those understood by web browsers (as values of the
+ * Content-Encoding header): "gzip", "deflate" (zlib-wrapped, as HTTP
+ * requires), "br" (Brotli), and "zstd" if this version of Node.js
+ * supports it.  Compression levels are limited to those fast enough
+ * to use interactively, and decompressed data to a maximum length, so
+ * that a small input cannot expand to fill memory.  As for
+ * cryptography.js, each operation has an estimated cost (in ms) with
+ * which the calling thread is charged.  The builtins accept data as
+ * Buffers, or as strings (UTF-8 text to compress, or base64 compressed
+ * data to decompress), and return Buffers.
+ */
+'use strict';
+
+var zlib = require('zlib');
+
+var Compression = {};
+
+/**
+ * A compression format: its range of levels (and default level), and
+ * its functions, or null if it is not supported by this version of
+ * Node.js.
+ * @typedef {?{minLevel: number, maxLevel: number, level: number,
+ *             compress: function(!Buffer, number): !Buffer,
+ *             decompress: function(!Buffer, number): !Buffer}}
+ */
+Compression.Format;
+
+/**
+ * Supported formats, by name.
+ * @const {!Object<string, !Compression.Format>}
+ */
+Compression.FORMATS = {
+  'gzip': {
+    minLevel: 1, maxLevel: 9, level: 6,
+    compress: (data, level) => zlib.gzipSync(data, {level: level}),
+    decompress: (data, max) => zlib.gunzipSync(data, {maxOutputLength: max}),
+  },
+  'deflate': {
+    minLevel: 1, maxLevel: 9, level: 6,
+    compress: (data, level) => zlib.deflateSync(data, {level: level}),
+    decompress: (data, max) => zlib.inflateSync(data, {maxOutputLength: max}),
+  },
+  // Brotli qualities above 9 are much slower, for little gain.
+  'br': {
+    minLevel: 1, maxLevel: 9, level: 4,
+    compress: (data, level) => zlib.brotliCompressSync(data,
+        {params: {[zlib.constants.BROTLI_PARAM_QUALITY]: level}}),
+    decompress: (data, max) => zlib.brotliDecompressSync(data,
+        {maxOutputLength: max}),
+  },
+  'zstd': (typeof zlib.zstdCompressSync !== 'function') ? null : {
+    minLevel: 1, maxLevel: 9, level: 3,
+    compress: (data, level) => zlib.zstdCompressSync(data,
+        {params: {[zlib.constants.ZSTD_c_compressionLevel]: level}}),
+    decompress: (data, max) => zlib.zstdDecompressSync(data,
+        {maxOutputLength: max}),
+  },
+};
+
+/**
+ * Maximum length (in bytes) of data to compress, and of decompressed
+ * data.
+ * @const {number}
+ */
+Compression.MAX_DATA = 16 * 1024 * 1024;
+
+/**
+ * Estimated speeds, for computing the cost of operations: bytes
+ * compressed per ms (at the slowest level allowed) and bytes
+ * decompressed (i.e., output) per ms.
+ * @const {{compress: number, decompress: number}}
+ */
+Compression.SPEED = {compress: 8 * 1024, decompress: 200 * 1024};
+
+/**
+ * Get a supported format.
+ * @param {*} format The format's name.
+ * @return {!Compression.Format} The format.
+ */
+Compression.getFormat = function(format) {
+  if (!Object.prototype.hasOwnProperty.call(Compression.FORMATS, format) ||
+      !Compression.FORMATS[format]) {
+    throw new TypeError('Unsupported compression format ' + String(format));
+  }
+  return Compression.FORMATS[format];
+};
+
+/**
+ * Check that data is not too long.
+ * @param {!Buffer} data The data.
+ * @return {!Buffer} The data.
+ */
+Compression.checkData = function(data) {
+  if (data.length > Compression.MAX_DATA) {
+    throw new RangeError('data too long');
+  }
+  return data;
+};
+
+/**
+ * Estimated cost (in ms) of compressing some data.
+ * @param {!Buffer} data The data.
+ * @return {number} The cost.
+ */
+Compression.compressCost = function(data) {
+  return data.length / Compression.SPEED.compress;
+};
+
+/**
+ * Estimated cost (in ms) of decompressing some data.
+ * @param {!Buffer} result The decompressed data.
+ * @return {number} The cost.
+ */
+Compression.decompressCost = function(result) {
+  return result.length / Compression.SPEED.decompress;
+};
+
+/**
+ * Compress some data.
+ * @param {*} format 'gzip', 'deflate', 'br' or 'zstd'.
+ * @param {!Buffer} data The data.
+ * @param {*=} level Compression level (default depends on format).
+ * @return {!Buffer} The compressed data.
+ */
+Compression.compress = function(format, data, level) {
+  var f = Compression.getFormat(format);
+  if (level === undefined) {
+    level = f.level;
+  } else if (typeof level !== 'number' || !Number.isInteger(level) ||
+             level < f.minLevel || level > f.maxLevel) {
+    throw new RangeError('level must be an integer from ' + f.minLevel +
+                         ' to ' + f.maxLevel);
+  }
+  return f.compress(Compression.checkData(data),
+                    /** @type {number} */(level));
+};
+
+/**
+ * Decompress some data.
+ * @param {*} format 'gzip', 'deflate', 'br' or 'zstd'.
+ * @param {!Buffer} data The compressed data.
+ * @param {*=} maxLength Maximum length (in bytes) of the decompressed
+ *     data (default and at most MAX_DATA).
+ * @return {!Buffer} The decompressed data.
+ */
+Compression.decompress = function(format, data, maxLength) {
+  var f = Compression.getFormat(format);
+  if (maxLength === undefined) {
+    maxLength = Compression.MAX_DATA;
+  } else if (typeof maxLength !== 'number' || !Number.isInteger(maxLength) ||
+             maxLength < 0 || maxLength > Compression.MAX_DATA) {
+    throw new RangeError('maxLength must be an integer from 0 to ' +
+                         Compression.MAX_DATA);
+  }
+  try {
+    // zlib refuses a maxOutputLength of 0.
+    var result = f.decompress(data, Math.max(1, maxLength));
+  } catch (e) {
+    if (e.code === 'ERR_BUFFER_TOO_LARGE') {
+      throw new RangeError('Decompressed data longer than ' + maxLength +
+                           ' bytes');
+    }
+    throw new Error('Invalid ' + format + ' data');
+  }
+  if (result.length > maxLength) {
+    throw new RangeError('Decompressed data longer than ' + maxLength +
+                         ' bytes');
+  }
+  return result;
+};
+
+module.exports = Compression;
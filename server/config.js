@@ -0,0 +1,388 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Parsing and validation of the server's configuration
+ * file (documented in config.txt), and working out which changes to it
+ * can be applied to a running server (see CodeCity.reloadConfig) and
+ * which take effect only once it is restarted.
+ */
+'use strict';
+
+var Envelope = require('./envelope');
+var Logging = require('./logging');
+
+var Config = {};
+
+/**
+ * Specification of a configuration option (or of a field of one):
+ *
+ * - type: 'string', 'number', 'boolean', 'object' or 'array'.
+ * - values: the values permitted (if only some are).
+ * - min: the minimum value permitted (of a number).
+ * - check: function returning an error message (or null) for a value
+ *   otherwise of the right type.
+ * - fields: the fields permitted (of an object).
+ * - entries: the specification of every other field (of an object) or
+ *   of every element (of an array).
+ * - reloadable: whether a change to it can be applied without a
+ *   restart.  (An object's fields may be reloadable individually.)
+ * - default: the value it is given if it is not specified.
+ * @typedef {{type: string,
+ *            values: (!Array<*>|undefined),
+ *            min: (number|undefined),
+ *            check: (function(*): ?string|undefined),
+ *            fields: (!Object<string, !Config.Spec>|undefined),
+ *            entries: (!Config.Spec|undefined),
+ *            reloadable: (boolean|undefined),
+ *            default: (*|undefined)}}
+ */
+Config.Spec;
+
+/**
+ * Specifications of the options that a configuration file may contain.
+ * @const {!Object<string, !Config.Spec>}
+ */
+Config.SCHEMA = (function() {
+  var string = {type: 'string'};
+  var count = {type: 'number', min: 0};
+  var port = {type: 'number', min: 0};
+  var strings = {type: 'array', entries: string};
+  var bucket = {
+    provider: {type: 'string', values: ['s3', 'gcs']},
+    bucket: string,
+    endpoint: string,
+    region: string,
+    prefix: string,
+    credentialsFile: string,
+  };
+  var level = {type: 'string', values: Logging.LEVELS};
+  var reloadable = function(spec) {
+    return Object.assign({reloadable: true}, spec);
+  };
+  return {
+    databaseDirectory: string,
+    logFile: string,
+    log: {type: 'object', fields: {
+      level: reloadable(level),
+      subsystems: reloadable({type: 'object', entries: level}),
+      maxSize: count, rotateInterval: count, keep: count,
+    }},
+    adminLog: string,
+    checkpointInterval: reloadable({type: 'number', min: 0, default: 600}),
+    checkpointStorage: {type: 'string', values: ['files', 'log']},
+    lazyLoading: count,
+    checkpointAtShutdown: reloadable({type: 'boolean'}),
+    checkpointMinFiles: reloadable(count),
+    checkpointMaxDirectorySize: reloadable(count),
+    checkpointRetention: reloadable({type: 'object', fields: {
+      hourly: count, daily: count, weekly: count,
+    }}),
+    checkpointIncremental: count,
+    checkpointBackground: reloadable({type: 'boolean'}),
+    journalInterval: count,
+    checkpointFormat: {type: 'string', values: ['json', 'binary']},
+    checkpointCompression: {type: 'string', check: Envelope.checkCompression},
+    checkpointCompressionThreads: count,
+    checkpointKeyFile: string,
+    checkpointKeyCommand: string,
+    backup: {type: 'object', fields: Object.assign({
+      keep: count, retries: count,
+    }, bucket)},
+    blobs: {type: 'object', fields: Object.assign({
+      directory: string, maxSize: count, port: port, host: string,
+    }, bucket)},
+    packages: {type: 'object', fields: {
+      url: string, publicKey: string, publicKeyFile: string,
+    }},
+    tls: {type: 'object', fields: {
+      hosts: {type: 'object', entries: {type: 'object', fields: {
+        certFile: string, keyFile: string,
+      }}},
+      email: string,
+      acmeDirectory: string,
+      directory: string,
+      renewDays: count,
+      challengePort: port,
+      ocspStapling: {type: 'boolean'},
+    }},
+    fetch: reloadable({type: 'object', fields: {
+      allow: strings, deny: strings,
+      rateLimit: count, maxResponse: count, timeout: count,
+    }}),
+    mail: {type: 'object', fields: {
+      host: string, port: port, secure: {type: 'boolean'},
+      from: string, fromName: string, credentialsFile: string,
+      rateLimit: reloadable(count),
+      maxRecipients: reloadable(count),
+      maxSize: reloadable(count),
+    }},
+    slow: reloadable({type: 'object', fields: {
+      taskTime: count, taskSteps: count, pauseTime: count,
+    }}),
+    rateLimits: reloadable({type: 'object', fields: {exempt: strings},
+      entries: {type: 'object', fields: {
+        limit: count, period: count, lockout: count,
+      }},
+    }),
+    trustedProxies: reloadable(strings),
+    passwordHashCost: reloadable({type: 'number', min: 1}),
+    guests: reloadable({type: 'object', fields: {
+      maxGuests: count, maxObjects: count, maxThreads: count,
+    }}),
+    sizeLimits: reloadable({type: 'object', fields: {
+      maxString: count, maxArray: count, maxProperties: count,
+    }}),
+    taint: reloadable({type: 'string', values: ['warn', 'error']}),
+    v8Messages: reloadable({type: 'boolean'}),
+    shutdown: reloadable({type: 'object', fields: {
+      handler: string, timeout: count,
+    }}),
+    replica: {type: 'object', fields: {interval: {type: 'number', min: 1}}},
+    worlds: {type: 'object', entries: {type: 'object', fields: {
+      directory: string, startup: string, autostart: {type: 'boolean'},
+    }}},
+    admin: {type: 'object', fields: {
+      port: port, host: string, tokenFile: string,
+    }},
+    control: {type: 'object', fields: {
+      port: port, host: string, tokenFile: string, userDatabase: string,
+    }},
+    federation: {type: 'object', fields: {
+      name: string, port: port, host: string, tls: {type: 'boolean'},
+      handler: string,
+      peers: {type: 'object', entries: {type: 'object', fields: {
+        url: string, key: string, keyFile: string,
+      }}},
+    }},
+    metrics: {type: 'object', fields: {
+      port: port, host: string, userDatabase: string,
+    }},
+    health: {type: 'object', fields: {
+      port: port, host: string,
+      maxSchedulerDelay: count, maxCheckpointAge: count,
+    }},
+  };
+})();
+
+/**
+ * Parse and validate the contents of a configuration file, filling in
+ * the defaults of options not specified.
+ * @param {string} text The contents.
+ * @return {!Object} The configuration.
+ * @throws {SyntaxError} If it is not valid JSON, or not a valid
+ *     configuration; the message lists every problem found.
+ */
+Config.parse = function(text) {
+  try {
+    var config = JSON.parse(text);
+  } catch (e) {
+    var m = /position (\d+)/.exec(e.message);
+    if (m) {
+      var lines = text.slice(0, Number(m[1])).split('\n');
+      throw new SyntaxError(e.message + ' (line ' + lines.length +
+          ', column ' + (lines[lines.length - 1].length + 1) + ')');
+    }
+    throw e;
+  }
+  var problems = Config.validate(config);
+  if (problems.length) {
+    throw new SyntaxError('Invalid configuration:\n  ' +
+                          problems.join('\n  '));
+  }
+  for (var name in Config.SCHEMA) {
+    if (config[name] === undefined && 'default' in Config.SCHEMA[name]) {
+      config[name] = Config.SCHEMA[name].default;
+    }
+  }
+  return config;
+};
+
+/**
+ * Validate a configuration.
+ * @param {*} config The configuration (as parsed from JSON).
+ * @return {!Array<string>} Descriptions of the problems found (if any),
+ *     each beginning with the name of the offending option.
+ */
+Config.validate = function(config) {
+  var problems = [];
+  Config.check_(config, {type: 'object', fields: Config.SCHEMA}, '',
+                problems);
+  return problems;
+};
+
+/**
+ * Check a value against a specification.
+ * @private
+ * @param {*} value The value.
+ * @param {!Config.Spec} spec The specification.
+ * @param {string} name The name of the option (or field) it is the value
+ *     of (e.g. 'admin.port'), or '' for the whole configuration.
+ * @param {!Array<string>} problems List of problems; appended to.
+ */
+Config.check_ = function(value, spec, name, problems) {
+  var problem = function(message) {
+    problems.push((name || 'Configuration') + ': ' + message);
+  };
+  var type = Array.isArray(value) ? 'array' :
+      (value === null) ? 'null' : typeof value;
+  if (type !== spec.type) {
+    problem('must be ' + (/^[aeiou]/.test(spec.type) ? 'an ' : 'a ') +
+            spec.type + ' (not ' + ((type === 'string') ?
+            JSON.stringify(value) : type) + ')');
+    return;
+  }
+  if (spec.values && !spec.values.includes(value)) {
+    problem('must be one of ' + spec.values.map(function(v) {
+      return JSON.stringify(v);
+    }).join(', ') + ' (not ' + JSON.stringify(value) + ')');
+  } else if (spec.min !== undefined && !(value >= spec.min)) {
+    problem('must be at least ' + spec.min + ' (not ' + value + ')');
+  } else if (spec.check) {
+    var message = spec.check(value);
+    if (message) problem(message);
+  }
+  var prefix = name ? name + '.' : '';
+  if (type === 'array' && spec.entries) {
+    for (var i = 0; i < value.length; i++) {
+      Config.check_(value[i], spec.entries, name + '[' + i + ']', problems);
+    }
+  } else if (type === 'object' && (spec.fields || spec.entries)) {
+    for (var key in value) {
+      var fieldSpec = (spec.fields && spec.fields[key]) || spec.entries;
+      if (fieldSpec) {
+        if (value[key] !== undefined) {
+          Config.check_(value[key], fieldSpec, prefix + key, problems);
+        }
+        continue;
+      }
+      var suggestion = Config.suggest_(key, Object.keys(spec.fields));
+      problems.push(prefix + key + ': unknown option' + (suggestion ?
+          ' (did you mean ' + JSON.stringify(suggestion) + '?)' : ''));
+    }
+  }
+};
+
+/**
+ * Find the known name most like a misspelt one, if any is close enough
+ * to be what was meant.
+ * @private
+ * @param {string} name The misspelt name.
+ * @param {!Array<string>} known The known names.
+ * @return {?string} The suggestion, or null if none.
+ */
+Config.suggest_ = function(name, known) {
+  var best = null;
+  var bestDistance = Math.max(2, Math.floor(name.length / 4)) + 1;
+  for (var i = 0; i < known.length; i++) {
+    var distance = Config.distance_(name.toLowerCase(),
+                                    known[i].toLowerCase());
+    if (distance < bestDistance) {
+      best = known[i];
+      bestDistance = distance;
+    }
+  }
+  return best;
+};
+
+/**
+ * Compute the edit (Levenshtein) distance between two strings.
+ * @private
+ * @param {string} a One string.
+ * @param {string} b The other.
+ * @return {number} The number of insertions, deletions and substitutions
+ *     needed to turn one into the other.
+ */
+Config.distance_ = function(a, b) {
+  var row = [];
+  for (var j = 0; j <= b.length; j++) row[j] = j;
+  for (var i = 1; i <= a.length; i++) {
+    var diagonal = row[0];
+    row[0] = i;
+    for (j = 1; j <= b.length; j++) {
+      var above = row[j];
+      row[j] = Math.min(above + 1, row[j - 1] + 1,
+                        diagonal + (a[i - 1] === b[j - 1] ? 0 : 1));
+      diagonal = above;
+    }
+  }
+  return row[b.length];
+};
+
+/**
+ * Work out how to apply a new configuration to a server running with
+ * an old one: which of the changes can be applied now, and which
+ * require a restart.
+ * @param {!Object} oldConfig The configuration the server is running
+ *     with.
+ * @param {!Object} newConfig The new configuration (validated).
+ * @return {{config: !Object, applied: !Array<string>,
+ *     restartRequired: !Array<string>}} The configuration to run with
+ *     from now on (the old one, with the reloadable changes made), and
+ *     the names of the options (or fields) changed that were, and were
+ *     not, applied.
+ */
+Config.reload = function(oldConfig, newConfig) {
+  var result = {config: Object.assign({}, oldConfig), applied: [],
+                restartRequired: []};
+  for (var name in Config.SCHEMA) {
+    var spec = Config.SCHEMA[name];
+    var oldValue = oldConfig[name];
+    var newValue = newConfig[name];
+    if (Config.equal_(oldValue, newValue)) continue;
+    if (spec.reloadable) {
+      result.config[name] = newValue;
+      result.applied.push(name);
+      continue;
+    }
+    // Some fields of the option may be reloadable, if it is (and was)
+    // present at all.
+    var fields = spec.fields || {};
+    var merged = Object.assign({}, oldValue);
+    var restart = oldValue === undefined || newValue === undefined;
+    var keys = Object.keys(Object.assign({}, oldValue, newValue));
+    for (var i = 0; i < keys.length && !restart; i++) {
+      var key = keys[i];
+      if (Config.equal_(oldValue[key], newValue[key])) continue;
+      if (fields[key] && fields[key].reloadable) {
+        merged[key] = newValue[key];
+        result.applied.push(name + '.' + key);
+      } else {
+        result.restartRequired.push(name + '.' + key);
+      }
+    }
+    if (restart) {
+      result.restartRequired.push(name);
+    } else {
+      result.config[name] = merged;
+    }
+  }
+  return result;
+};
+
+/**
+ * Are two values (as parsed from JSON) equal?
+ * @private
+ * @param {*} a One value.
+ * @param {*} b The other.
+ * @return {boolean} True iff they are.
+ */
+Config.equal_ = function(a, b) {
+  return JSON.stringify(a) === JSON.stringify(b);
+};
+
+module.exports = Config;
@@ -0,0 +1,359 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview The gRPC control-plane service, which exposes the
+ * server's operational controls to automation and orchestration tools:
+ * a typed counterpart of the admin API (see admin.js).  The service is
+ * defined by control.proto; Control.SERVICE gives the same definitions
+ * for Grpc (and so must be kept in sync with it).
+ */
+'use strict';
+
+var Admin = require('./admin');
+var Grpc = require('./grpc');
+var Interpreter = require('./interpreter');
+var Package = require('./package');
+var RateLimit = require('./ratelimit');
+
+var Control = {};
+
+/**
+ * Schema of messages with no fields.
+ * @private @const {!Grpc.Schema}
+ */
+Control.EMPTY_ = {};
+
+/**
+ * Names of the values of the ThreadInfo.Status enum, which correspond
+ * to those of Interpreter.Thread.Status.
+ * @private @const {!Array<string>}
+ */
+Control.THREAD_STATUSES_ =
+    ['ZOMBIE', 'READY', 'BLOCKED', 'SLEEPING', 'PAUSED'];
+
+/**
+ * The Control service (see control.proto).
+ * @const {!Grpc.Service}
+ */
+Control.SERVICE = {
+  name: 'codecity.control.Control',
+  methods: {
+    Checkpoint: {request: Control.EMPTY_, response: Control.EMPTY_},
+    Shutdown: {
+      request: {exitCode: {id: 1, type: 'int32'}},
+      response: Control.EMPTY_,
+    },
+    GetStats: {
+      request: Control.EMPTY_,
+      response: {
+        uptimeMs: {id: 1, type: 'uint64'},
+        threads: {id: 2, type: 'uint32'},
+        listeners: {id: 3, type: 'uint32'},
+        heapUsedBytes: {id: 4, type: 'uint64'},
+        rssBytes: {id: 5, type: 'uint64'},
+      },
+    },
+    ListThreads: {
+      request: Control.EMPTY_,
+      response: {
+        threads: {id: 1, type: 'message', repeated: true, message: {
+          id: {id: 1, type: 'uint64'},
+          status: {id: 2, type: 'enum', values: Control.THREAD_STATUSES_},
+          owner: {id: 3, type: 'string'},
+          runAt: {id: 4, type: 'double'},
+          timeLimit: {id: 5, type: 'uint64'},
+        }},
+      },
+    },
+    KillThread: {
+      request: {id: {id: 1, type: 'uint64'}},
+      response: {killed: {id: 1, type: 'bool'}},
+    },
+    ListUsers: {
+      request: Control.EMPTY_,
+      response: {
+        users: {id: 1, type: 'message', repeated: true, message: {
+          selector: {id: 1, type: 'string'},
+          name: {id: 2, type: 'string'},
+          connected: {id: 3, type: 'bool'},
+        }},
+      },
+    },
+    RemoveUser: {
+      request: {selector: {id: 1, type: 'string'}},
+      response: {removed: {id: 1, type: 'uint32'}},
+    },
+  },
+};
+
+/**
+ * Options for a Control.Server.
+ *
+ * - tokens: the tokens that clients may present.
+ * - interpreter: the Interpreter to be controlled.
+ * - checkpoint, shutdown: functions to save a checkpoint and to shut
+ *   down (with a given exit status), as CodeCity.checkpoint and
+ *   .shutdown.  If omitted, the corresponding calls fail with
+ *   UNIMPLEMENTED.
+ * - userDatabase: selector of the user database, an object whose
+ *   byMd5 property maps hashed login IDs to users (default
+ *   '$.userDatabase').
+ * - limiter: rate limiter for failed authentication attempts (using its
+ *   'login' policy).  By default a new one, without exemptions.
+ * @typedef {{tokens: !Array<string>,
+ *            interpreter: !Interpreter,
+ *            checkpoint: (function()|undefined),
+ *            shutdown: (function(number)|undefined),
+ *            userDatabase: (string|undefined),
+ *            limiter: (!RateLimit.Limiter|undefined)}}
+ */
+Control.Options;
+
+/**
+ * A control-plane server.
+ * @constructor
+ * @struct
+ * @param {!Control.Options} options Options.
+ */
+Control.Server = function(options) {
+  /** @private @const {!Admin.Tokens} */
+  this.tokens_ = new Admin.Tokens(options.tokens);
+  /** @const {!Interpreter} */
+  this.intrp = options.interpreter;
+  /** @private @const {!Control.Options} */
+  this.options_ = options;
+  /** @private @const {!RateLimit.Limiter} */
+  this.limiter_ = options.limiter || new RateLimit.Limiter({exempt: []});
+  var handlers = {};
+  for (var method in Control.SERVICE.methods) {
+    handlers[method] = this['call' + method + '_'].bind(this);
+  }
+  var intrp = this.intrp;
+  /** @private @const {!Grpc.Server} */
+  this.server_ = new Grpc.Server(Control.SERVICE, handlers, {
+    authorize: this.authorize_.bind(this),
+    onCall: function(call, code) {
+      intrp.log('admin', 'Control %s from %s: %d',
+                call.method, call.remoteAddress, code);
+    },
+  });
+};
+
+/**
+ * Start listening for calls.
+ * @param {number} port The port to listen on.
+ * @param {string=} host The address to listen on (default: all).
+ * @return {!Promise<number>} Resolves to the port listened on.
+ */
+Control.Server.prototype.listen = function(port, host) {
+  return this.server_.listen(port, host);
+};
+
+/**
+ * Stop listening for calls.
+ * @return {!Promise<void>}
+ */
+Control.Server.prototype.close = function() {
+  return this.server_.close();
+};
+
+/**
+ * Check that a call presents one of the tokens.
+ * @private
+ * @param {!Grpc.Call} call The call.
+ * @throws {!Grpc.Error} If it does not, or the client is locked out.
+ */
+Control.Server.prototype.authorize_ = function(call) {
+  var address = call.remoteAddress;
+  if (this.limiter_.check('login', address)) {
+    throw new Grpc.Error(Grpc.Status.RESOURCE_EXHAUSTED,
+                         'Too many failed attempts');
+  }
+  var header = call.metadata['authorization'];
+  if (!this.tokens_.check(Array.isArray(header) ? header[0] : header)) {
+    this.limiter_.record('login', address);
+    throw new Grpc.Error(Grpc.Status.UNAUTHENTICATED,
+                         'Missing or invalid token');
+  }
+  this.limiter_.reset('login', address);
+};
+
+/**
+ * Handle a Checkpoint call.
+ * @private
+ * @param {!Grpc.Call} call The call.
+ * @return {!Object} The response.
+ */
+Control.Server.prototype.callCheckpoint_ = function(call) {
+  if (!this.options_.checkpoint) {
+    throw new Grpc.Error(Grpc.Status.UNIMPLEMENTED,
+                         'Checkpoints not available');
+  }
+  this.options_.checkpoint();
+  return {};
+};
+
+/**
+ * Handle a Shutdown call.  The server shuts down once the response has
+ * been sent.
+ * @private
+ * @param {!Grpc.Call} call The call.
+ * @return {!Object} The response.
+ */
+Control.Server.prototype.callShutdown_ = function(call) {
+  var shutdown = this.options_.shutdown;
+  if (!shutdown) {
+    throw new Grpc.Error(Grpc.Status.UNIMPLEMENTED,
+                         'Shutdown not available');
+  }
+  call.afterResponse = function() {
+    shutdown(call.request['exitCode']);
+  };
+  return {};
+};
+
+/**
+ * Handle a GetStats call.
+ * @private
+ * @param {!Grpc.Call} call The call.
+ * @return {!Object} The response.
+ */
+Control.Server.prototype.callGetStats_ = function(call) {
+  var memory = process.memoryUsage();
+  return {
+    uptimeMs: Math.round(process.uptime() * 1000),
+    threads: this.intrp.getThreads().length,
+    listeners: Object.keys(this.intrp.listeners_).length,
+    heapUsedBytes: memory.heapUsed,
+    rssBytes: memory.rss,
+  };
+};
+
+/**
+ * Handle a ListThreads call.
+ * @private
+ * @param {!Grpc.Call} call The call.
+ * @return {!Object} The response.
+ */
+Control.Server.prototype.callListThreads_ = function(call) {
+  var intrp = this.intrp;
+  var names = Package.findNames(intrp);
+  return {threads: intrp.getThreads().map(function(thread) {
+    var owner = thread.wrapper && thread.wrapper.owner;
+    return {
+      id: thread.id,
+      status: thread.status,
+      owner: (owner && names.get(owner)) || '',
+      runAt: thread.runAt,
+      timeLimit: thread.timeLimit,
+    };
+  })};
+};
+
+/**
+ * Handle a KillThread call.
+ * @private
+ * @param {!Grpc.Call} call The call.
+ * @return {!Object} The response.
+ */
+Control.Server.prototype.callKillThread_ = function(call) {
+  return {killed: this.intrp.killThread(call.request['id'])};
+};
+
+/**
+ * Handle a ListUsers call.
+ * @private
+ * @param {!Grpc.Call} call The call.
+ * @return {!Object} The response.
+ */
+Control.Server.prototype.callListUsers_ = function(call) {
+  var intrp = this.intrp;
+  var names = Package.findNames(intrp);
+  var users = new Set(this.userTable_().values());
+  return {users: Array.from(users, function(user) {
+    return {
+      selector: names.get(user) || '',
+      name: String(user.get('name', intrp.ROOT)),
+      connected: user.get('connection', intrp.ROOT) instanceof intrp.Object,
+    };
+  })};
+};
+
+/**
+ * Handle a RemoveUser call.
+ * @private
+ * @param {!Grpc.Call} call The call.
+ * @return {!Object} The response.
+ */
+Control.Server.prototype.callRemoveUser_ = function(call) {
+  var selector = call.request['selector'];
+  var user = null;
+  try {
+    user = Package.lookup(this.intrp, selector);
+  } catch (e) {
+    throw new Grpc.Error(Grpc.Status.INVALID_ARGUMENT,
+                         'Invalid selector: ' + selector);
+  }
+  if (!user) {
+    throw new Grpc.Error(Grpc.Status.NOT_FOUND, 'No such object: ' + selector);
+  }
+  var table = this.userTable_();
+  var byMd5 = Package.lookup(this.intrp, this.userDatabase_() + '.byMd5');
+  var removed = 0;
+  table.forEach(function(value, key) {
+    if (value === user) {
+      byMd5.deleteProperty(key, this.intrp.ROOT);
+      removed++;
+    }
+  }, this);
+  return {removed: removed};
+};
+
+/**
+ * Selector of the user database.
+ * @private
+ * @return {string}
+ */
+Control.Server.prototype.userDatabase_ = function() {
+  return this.options_.userDatabase || '$.userDatabase';
+};
+
+/**
+ * Read the user database's table of users.
+ * @private
+ * @return {!Map<string, !Interpreter.prototype.Object>} The users, by
+ *     key (hashed login ID).
+ * @throws {!Grpc.Error} If there is no user database.
+ */
+Control.Server.prototype.userTable_ = function() {
+  var intrp = this.intrp;
+  var byMd5 = Package.lookup(intrp, this.userDatabase_() + '.byMd5');
+  if (!byMd5) {
+    throw new Grpc.Error(Grpc.Status.FAILED_PRECONDITION,
+                         'No user database: ' + this.userDatabase_());
+  }
+  var table = new Map();
+  var keys = byMd5.ownKeys(intrp.ROOT);
+  for (var i = 0; i < keys.length; i++) {
+    var user = byMd5.get(keys[i], intrp.ROOT);
+    if (user instanceof intrp.Object) table.set(keys[i], user);
+  }
+  return table;
+};
+
+module.exports = Control;
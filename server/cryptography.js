@@ -0,0 +1,364 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Cryptographic primitives for in-world code (the
+ * CC.crypto builtins): hashes, HMACs, key derivation, constant-time
+ * comparison, and secure random numbers, tokens and UUIDs.
+ *
+ * Data may be passed as Buffers, or as strings (which are encoded as
+ * UTF-8); binary results are returned as strings in hex (by default)
+ * or base64 encoding, or as Buffers.  Each operation
+ * also has an estimated cost (in ms), with which the calling thread is
+ * charged, so that hashing a lot of data (or deriving a key with many
+ * iterations) uses up its time limit as interpreted code doing the
+ * same work would.  Key derivation is by PBKDF2 or scrypt: argon2
+ * would need a native module (see also accounts.js).
+ */
+'use strict';
+
+var crypto = require('crypto');
+
+var Cryptography = {};
+
+/**
+ * Hash algorithms supported (by hash, hmac and pbkdf2).
+ * @const {!Array<string>}
+ */
+Cryptography.ALGORITHMS = ['sha256', 'sha512'];
+
+/**
+ * Encodings supported for binary results.
+ * @const {!Array<string>}
+ */
+Cryptography.ENCODINGS = ['hex', 'base64', 'base64url', 'buffer'];
+
+/**
+ * Maximum length (in characters) of data to hash.
+ * @const {number}
+ */
+Cryptography.MAX_DATA = 16 * 1024 * 1024;
+
+/**
+ * Maximum length (in bytes) of a derived key, or of random data.
+ * @const {number}
+ */
+Cryptography.MAX_BYTES = 1024;
+
+/**
+ * Maximum number of PBKDF2 iterations.
+ * @const {number}
+ */
+Cryptography.MAX_ITERATIONS = 10 * 1000 * 1000;
+
+/**
+ * Maximum log2 of scrypt's N parameter.  (2^20, with r = 8, uses 1
+ * GiB.)
+ * @const {number}
+ */
+Cryptography.MAX_COST = 20;
+
+/**
+ * Estimated speeds, for computing the cost of operations: bytes hashed
+ * per ms, PBKDF2 iterations per ms, and scrypt N * r per ms.
+ * @const {{hash: number, pbkdf2: number, scrypt: number}}
+ */
+Cryptography.SPEED = {hash: 200 * 1024, pbkdf2: 500, scrypt: 2500};
+
+/**
+ * Check that an algorithm is supported.
+ * @param {*} algorithm The algorithm name.
+ * @return {string} The algorithm.
+ */
+Cryptography.checkAlgorithm = function(algorithm) {
+  if (!Cryptography.ALGORITHMS.includes(algorithm)) {
+    throw new TypeError('Unsupported algorithm ' + String(algorithm));
+  }
+  return /** @type {string} */(algorithm);
+};
+
+/**
+ * Check that data (or a key, password, salt, etc.) is a string or
+ * Buffer of acceptable length.
+ * @param {*} data The data.
+ * @param {string} name What the data is, for error messages.
+ * @return {string|!Buffer} The data.
+ */
+Cryptography.checkData = function(data, name) {
+  if (typeof data !== 'string' && !Buffer.isBuffer(data)) {
+    throw new TypeError(name + ' must be a string or Buffer');
+  } else if (data.length > Cryptography.MAX_DATA) {
+    throw new RangeError(name + ' too long');
+  }
+  return data;
+};
+
+/**
+ * Check that a count (of iterations, bytes, etc.) is a positive
+ * integer no larger than max.
+ * @param {*} n The count.
+ * @param {number} max The largest count allowed.
+ * @param {string} name What is being counted, for error messages.
+ * @return {number} The count.
+ */
+Cryptography.checkCount = function(n, max, name) {
+  if (typeof n !== 'number' || !Number.isInteger(n) || n < 1 || n > max) {
+    throw new RangeError(name + ' must be an integer from 1 to ' + max);
+  }
+  return n;
+};
+
+/**
+ * Encode a binary result.
+ * @param {!Buffer} buffer The result.
+ * @param {*=} encoding 'hex' (default), 'base64', 'base64url' or
+ *     'buffer' (to return it unencoded).
+ * @return {string|!Buffer} The encoded result.
+ */
+Cryptography.encode = function(buffer, encoding) {
+  if (encoding === undefined) encoding = 'hex';
+  if (!Cryptography.ENCODINGS.includes(encoding)) {
+    throw new TypeError('Unsupported encoding ' + String(encoding));
+  }
+  if (encoding === 'buffer') return buffer;
+  return buffer.toString(/** @type {string} */(encoding));
+};
+
+/**
+ * Estimated cost (in ms) of hashing some data.
+ * @param {string|!Buffer} data The data.
+ * @return {number} The cost.
+ */
+Cryptography.hashCost = function(data) {
+  return Buffer.byteLength(data) / Cryptography.SPEED.hash;
+};
+
+/**
+ * Hash some data.
+ * @param {*} algorithm 'sha256' or 'sha512'.
+ * @param {*} data The data to hash.
+ * @param {*=} encoding Encoding of the result (see .encode).
+ * @return {string|!Buffer} The digest.
+ */
+Cryptography.hash = function(algorithm, data, encoding) {
+  var hash = crypto.createHash(Cryptography.checkAlgorithm(algorithm));
+  hash.update(Cryptography.checkData(data, 'data'));
+  return Cryptography.encode(hash.digest(), encoding);
+};
+
+/**
+ * Compute the HMAC of some data.
+ * @param {*} algorithm 'sha256' or 'sha512'.
+ * @param {*} key The secret key.
+ * @param {*} data The data to authenticate.
+ * @param {*=} encoding Encoding of the result (see .encode).
+ * @return {string|!Buffer} The HMAC.
+ */
+Cryptography.hmac = function(algorithm, key, data, encoding) {
+  var hmac = crypto.createHmac(Cryptography.checkAlgorithm(algorithm),
+                               Cryptography.checkData(key, 'key'));
+  hmac.update(Cryptography.checkData(data, 'data'));
+  return Cryptography.encode(hmac.digest(), encoding);
+};
+
+/**
+ * Derive a key from a password with PBKDF2.
+ * @param {*} algorithm 'sha256' or 'sha512'.
+ * @param {*} password The password.
+ * @param {*} salt The salt.
+ * @param {*} iterations Number of iterations.
+ * @param {*} length Length (in bytes) of the key.
+ * @param {*=} encoding Encoding of the result (see .encode).
+ * @return {!Promise<string|!Buffer>} The key.
+ */
+Cryptography.pbkdf2 = function(algorithm, password, salt, iterations, length,
+                               encoding) {
+  return new Promise(function(resolve, reject) {
+    Cryptography.encode(Buffer.alloc(0), encoding);  // Check encoding.
+    crypto.pbkdf2(Cryptography.checkData(password, 'password'),
+        Cryptography.checkData(salt, 'salt'),
+        Cryptography.checkCount(iterations, Cryptography.MAX_ITERATIONS,
+                                'iterations'),
+        Cryptography.checkCount(length, Cryptography.MAX_BYTES, 'length'),
+        Cryptography.checkAlgorithm(algorithm),
+        function(err, key) {
+          if (err) {
+            reject(err);
+          } else {
+            resolve(Cryptography.encode(key, encoding));
+          }
+        });
+  });
+};
+
+/**
+ * Estimated cost (in ms) of deriving a key with PBKDF2.
+ * @param {number} iterations Number of iterations.
+ * @param {number} length Length (in bytes) of the key.
+ * @return {number} The cost.
+ */
+Cryptography.pbkdf2Cost = function(iterations, length) {
+  // Each block of the key (32 bytes, for sha256) takes all iterations.
+  return iterations * Math.ceil(length / 32) / Cryptography.SPEED.pbkdf2;
+};
+
+/**
+ * Derive a key from a password with scrypt.
+ * @param {*} password The password.
+ * @param {*} salt The salt.
+ * @param {*} cost log2 of scrypt's N parameter.  (r is 8, p is 1.)
+ * @param {*} length Length (in bytes) of the key.
+ * @param {*=} encoding Encoding of the result (see .encode).
+ * @return {!Promise<string|!Buffer>} The key.
+ */
+Cryptography.scrypt = function(password, salt, cost, length, encoding) {
+  return new Promise(function(resolve, reject) {
+    Cryptography.encode(Buffer.alloc(0), encoding);  // Check encoding.
+    var n = Math.pow(2, Cryptography.checkCount(
+        cost, Cryptography.MAX_COST, 'cost'));
+    crypto.scrypt(Cryptography.checkData(password, 'password'),
+        Cryptography.checkData(salt, 'salt'),
+        Cryptography.checkCount(length, Cryptography.MAX_BYTES, 'length'),
+        {N: n, r: 8, p: 1, maxmem: 256 * n * 8 + 1024 * 1024},
+        function(err, key) {
+          if (err) {
+            reject(err);
+          } else {
+            resolve(Cryptography.encode(key, encoding));
+          }
+        });
+  });
+};
+
+/**
+ * Estimated cost (in ms) of deriving a key with scrypt.
+ * @param {number} cost log2 of scrypt's N parameter.
+ * @return {number} The cost.
+ */
+Cryptography.scryptCost = function(cost) {
+  return Math.pow(2, cost) * 8 / Cryptography.SPEED.scrypt;
+};
+
+/**
+ * Compare two strings (or Buffers) in time that depends only on their
+ * lengths (e.g., to check an HMAC without revealing how much of it
+ * matched).
+ * @param {*} a One string.
+ * @param {*} b The other.
+ * @return {boolean} True iff they are equal.
+ */
+Cryptography.equal = function(a, b) {
+  var bufA = Buffer.from(/** @type {?} */(Cryptography.checkData(a, 'a')));
+  var bufB = Buffer.from(/** @type {?} */(Cryptography.checkData(b, 'b')));
+  if (bufA.length !== bufB.length) {
+    // Still do a comparison, so as not to leak how they differ.
+    crypto.timingSafeEqual(bufA, bufA);
+    return false;
+  }
+  return crypto.timingSafeEqual(bufA, bufB);
+};
+
+/**
+ * Source of cryptographically secure random bytes.
+ * @typedef {function(number): !Buffer}
+ */
+Cryptography.Random;
+
+/**
+ * Generate cryptographically secure random bytes.
+ * @param {*} length Number of bytes.
+ * @param {*=} encoding Encoding of the result (see .encode).
+ * @param {!Cryptography.Random=} random Source of the bytes.  (Default:
+ *     crypto.randomBytes.)
+ * @return {string|!Buffer} The bytes.
+ */
+Cryptography.randomBytes = function(length, encoding, random) {
+  length = Cryptography.checkCount(length, Cryptography.MAX_BYTES, 'length');
+  return Cryptography.encode((random || crypto.randomBytes)(length),
+                             encoding);
+};
+
+/**
+ * Largest range of random integers (2^48 - 1, as six bytes).
+ * @private @const {number}
+ */
+Cryptography.MAX_RANGE_ = 0xffffffffffff;
+
+/**
+ * Generate a cryptographically secure random integer.
+ * @param {*} min Smallest value (inclusive).
+ * @param {*} max Largest value (exclusive).
+ * @param {!Cryptography.Random=} random Source of randomness.
+ * @return {number} The integer.
+ */
+Cryptography.randomInt = function(min, max, random) {
+  if (!Number.isSafeInteger(min) || !Number.isSafeInteger(max) ||
+      max <= min || max - min > Cryptography.MAX_RANGE_) {
+    throw new RangeError('Invalid range [' + min + ', ' + max + ')');
+  }
+  var range = /** @type {number} */(max) - /** @type {number} */(min);
+  // Discard values from the incomplete last multiple of range, so as
+  // not to favour smaller results.
+  var limit = Cryptography.MAX_RANGE_ + 1 -
+      (Cryptography.MAX_RANGE_ + 1) % range;
+  var value;
+  do {
+    value = (random || crypto.randomBytes)(6).readUIntBE(0, 6);
+  } while (value >= limit);
+  return /** @type {number} */(min) + value % range;
+};
+
+/**
+ * Generate a URL-safe random token (e.g., for a session or an
+ * unguessable link).
+ * @param {*=} length Number of random bytes.  (Default: 16, giving a
+ *     token of 22 characters.)
+ * @param {!Cryptography.Random=} random Source of the bytes.
+ * @return {string} The token.
+ */
+Cryptography.token = function(length, random) {
+  return /** @type {string} */(Cryptography.randomBytes(
+      length === undefined ? 16 : length, 'base64url', random));
+};
+
+/**
+ * Generate a UUID (RFC 9562): version 4 (random) or version 7
+ * (time-ordered: a millisecond timestamp, then random bits, so that
+ * UUIDs generated later sort later).
+ * @param {*=} version 4 (default) or 7.
+ * @param {number=} time Timestamp for version 7 UUIDs.  (Default:
+ *     Date.now().)
+ * @param {!Cryptography.Random=} random Source of randomness.
+ * @return {string} The UUID, in the usual hyphenated lowercase form.
+ */
+Cryptography.uuid = function(version, time, random) {
+  if (version === undefined) version = 4;
+  if (version !== 4 && version !== 7) {
+    throw new RangeError('Unsupported UUID version ' + String(version));
+  }
+  var bytes = (random || crypto.randomBytes)(16);
+  if (version === 7) {
+    bytes.writeUIntBE(time === undefined ? Date.now() : time, 0, 6);
+  }
+  bytes[6] = (bytes[6] & 0x0f) | (version << 4);
+  bytes[8] = (bytes[8] & 0x3f) | 0x80;  // Variant 10xx.
+  var hex = bytes.toString('hex');
+  return [hex.slice(0, 8), hex.slice(8, 12), hex.slice(12, 16),
+          hex.slice(16, 20), hex.slice(20)].join('-');
+};
+
+module.exports = Cryptography;
@@ -0,0 +1,183 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Parsing and serializing comma-separated values (the
+ * CC.csvParse and CC.csvStringify builtins), e.g. for importing data
+ * exported from a spreadsheet.
+ *
+ * The format is that of RFC 4180: records separated by line breaks
+ * (CRLF, or as is common, LF alone), fields separated by commas (or
+ * another delimiter, such as a tab), and fields containing delimiters,
+ * quotes or line breaks enclosed in double quotes, with any quotes in
+ * them doubled.  Parsing is lenient in the way spreadsheets are: a
+ * quote in the middle of an unquoted field is just a character.
+ */
+'use strict';
+
+var Csv = {};
+
+/**
+ * Maximum length (in characters) of CSV to parse or produce.
+ * @const {number}
+ */
+Csv.MAX_LENGTH = 4 * 1024 * 1024;
+
+/**
+ * Estimated speed (characters parsed or produced per ms), for
+ * computing the cost of operations.
+ * @const {number}
+ */
+Csv.SPEED = 20 * 1024;
+
+/**
+ * Estimated cost (in ms) of parsing or producing some CSV.
+ * @param {number} length The length of the CSV.
+ * @return {number} The cost.
+ */
+Csv.cost = function(length) {
+  return length / Csv.SPEED;
+};
+
+/**
+ * Check a delimiter.
+ * @param {*} delimiter The delimiter, or undefined for the default
+ *     (a comma).
+ * @return {string} The delimiter.
+ */
+Csv.checkDelimiter = function(delimiter) {
+  if (delimiter === undefined) return ',';
+  if (typeof delimiter !== 'string' || delimiter.length !== 1 ||
+      /["\r\n]/.test(delimiter)) {
+    throw new TypeError('delimiter must be a single character (other ' +
+                        'than a quote or line break)');
+  }
+  return delimiter;
+};
+
+/**
+ * Parse some CSV.  A line break at the end of the last record is
+ * optional, and blank lines are skipped.
+ * @param {string} text The CSV.
+ * @param {string=} delimiter The field delimiter (default ',').
+ * @return {!Array<!Array<string>>} The records, each an array of
+ *     fields.
+ */
+Csv.parse = function(text, delimiter) {
+  if (text.length > Csv.MAX_LENGTH) throw new RangeError('CSV too long');
+  delimiter = delimiter || ',';
+  var records = [];
+  var record = [];
+  var i = 0;
+  // Skip a byte order mark, as written by some spreadsheets.
+  if (text[0] === '\ufeff') i++;
+  while (i < text.length) {
+    var field;
+    if (text[i] === '"') {
+      field = '';
+      var start = i + 1;
+      for (;;) {
+        var quote = text.indexOf('"', start);
+        if (quote === -1) {
+          throw new SyntaxError('Unterminated quoted field in record ' +
+                                (records.length + 1));
+        }
+        field += text.slice(start, quote);
+        if (text[quote + 1] !== '"') break;
+        field += '"';
+        start = quote + 2;
+      }
+      i = quote + 1;
+      // Anything between the closing quote and the delimiter is kept.
+      var end = Csv.fieldEnd_(text, i, delimiter);
+      field += text.slice(i, end);
+      i = end;
+    } else {
+      end = Csv.fieldEnd_(text, i, delimiter);
+      field = text.slice(i, end);
+      i = end;
+    }
+    record.push(field);
+    if (text[i] === delimiter) {
+      i++;
+      if (i === text.length) record.push('');
+      continue;
+    }
+    // End of record.
+    if (text[i] === '\r') i++;
+    if (text[i] === '\n') i++;
+    if (record.length > 1 || record[0] !== '') records.push(record);
+    record = [];
+  }
+  if (record.length) records.push(record);
+  return records;
+};
+
+/**
+ * Find the end of an unquoted field (or of the rest of a quoted one).
+ * @private
+ * @param {string} text The CSV.
+ * @param {number} i Index at which to start looking.
+ * @param {string} delimiter The field delimiter.
+ * @return {number} Index of the delimiter or line break after the
+ *     field, or the length of text.
+ */
+Csv.fieldEnd_ = function(text, i, delimiter) {
+  for (; i < text.length; i++) {
+    var c = text[i];
+    if (c === delimiter || c === '\n' || c === '\r') break;
+  }
+  return i;
+};
+
+/**
+ * Serialize some records as CSV, with CRLF line breaks (including at
+ * the end).  Fields are quoted only when they need to be.
+ * @param {!Array<!Array<*>>} records The records, each an array of
+ *     fields: strings, numbers or booleans (converted to strings), or
+ *     null or undefined (empty).
+ * @param {string=} delimiter The field delimiter (default ',').
+ * @return {string} The CSV.
+ */
+Csv.stringify = function(records, delimiter) {
+  delimiter = delimiter || ',';
+  var out = [];
+  var length = 0;
+  for (var i = 0; i < records.length; i++) {
+    var record = records[i];
+    if (!Array.isArray(record)) {
+      throw new TypeError('Record ' + (i + 1) + ' is not an array');
+    }
+    var line = record.map(function(value) {
+      if (value === null || value === undefined) return '';
+      if (typeof value === 'object' || typeof value === 'function') {
+        throw new TypeError('Fields must be primitives');
+      }
+      var field = String(value);
+      if (field.includes(delimiter) || /["\r\n]|^\s|\s$/.test(field)) {
+        field = '"' + field.replace(/"/g, '""') + '"';
+      }
+      return field;
+    }).join(delimiter) + '\r\n';
+    length += line.length;
+    if (length > Csv.MAX_LENGTH) throw new RangeError('CSV too long');
+    out.push(line);
+  }
+  return out.join('');
+};
+
+module.exports = Csv;
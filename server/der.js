@@ -0,0 +1,304 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Just enough of ASN.1's Distinguished Encoding Rules
+ * (X.690) to build certificate signing requests and OCSP requests,
+ * and to pick apart certificates and OCSP responses.
+ *
+ * Values are encoded by functions returning Buffers, which can be
+ * nested to build structures:
+ *
+ *     Der.sequence([Der.oid('2.5.4.3'), Der.utf8String('example.com')])
+ *
+ * and decoded into a tree of Der.Element objects.
+ */
+'use strict';
+
+var Der = {};
+
+/**
+ * Tags of universal types (and of the constructed forms used).
+ * @enum {number}
+ */
+Der.Tag = {
+  BOOLEAN: 0x01,
+  INTEGER: 0x02,
+  BIT_STRING: 0x03,
+  OCTET_STRING: 0x04,
+  NULL: 0x05,
+  OID: 0x06,
+  ENUMERATED: 0x0a,
+  UTF8_STRING: 0x0c,
+  PRINTABLE_STRING: 0x13,
+  IA5_STRING: 0x16,
+  UTC_TIME: 0x17,
+  GENERALIZED_TIME: 0x18,
+  SEQUENCE: 0x30,
+  SET: 0x31,
+};
+
+/**
+ * Encode an element.
+ * @param {number} tag Identifier octet.
+ * @param {!Buffer} contents Contents octets.
+ * @return {!Buffer}
+ */
+Der.encode = function(tag, contents) {
+  var length = contents.length;
+  var header;
+  if (length < 0x80) {
+    header = Buffer.from([tag, length]);
+  } else {
+    var bytes = [];
+    for (var n = length; n > 0; n = Math.floor(n / 256)) {
+      bytes.unshift(n & 0xff);
+    }
+    header = Buffer.from([tag, 0x80 | bytes.length].concat(bytes));
+  }
+  return Buffer.concat([header, contents]);
+};
+
+/**
+ * Encode a SEQUENCE.
+ * @param {!Array<!Buffer>} elements Encoded elements.
+ * @return {!Buffer}
+ */
+Der.sequence = function(elements) {
+  return Der.encode(Der.Tag.SEQUENCE, Buffer.concat(elements));
+};
+
+/**
+ * Encode a SET (whose elements must already be in sorted order).
+ * @param {!Array<!Buffer>} elements Encoded elements.
+ * @return {!Buffer}
+ */
+Der.set = function(elements) {
+  return Der.encode(Der.Tag.SET, Buffer.concat(elements));
+};
+
+/**
+ * Encode a context-specific tagged element.
+ * @param {number} number Tag number.
+ * @param {!Buffer} contents Contents: the encoded element if explicit,
+ *     or the contents octets of the element it replaces if implicit.
+ * @param {boolean=} constructed Is the contents constructed?  (Default:
+ *     true, as for explicit tagging.)
+ * @return {!Buffer}
+ */
+Der.context = function(number, contents, constructed) {
+  var tag = 0x80 | ((constructed === false) ? 0 : 0x20) | number;
+  return Der.encode(tag, contents);
+};
+
+/**
+ * Encode a non-negative INTEGER.
+ * @param {number|!Buffer} value The value, or its big-endian bytes.
+ * @return {!Buffer}
+ */
+Der.integer = function(value) {
+  var bytes;
+  if (typeof value === 'number') {
+    bytes = [];
+    do {
+      bytes.unshift(value & 0xff);
+      value = Math.floor(value / 256);
+    } while (value > 0);
+    bytes = Buffer.from(bytes);
+  } else {
+    bytes = value;
+    var i = 0;
+    while (i < bytes.length - 1 && bytes[i] === 0) i++;
+    bytes = bytes.subarray(i);
+  }
+  if (bytes[0] & 0x80) bytes = Buffer.concat([Buffer.from([0]), bytes]);
+  return Der.encode(Der.Tag.INTEGER, bytes);
+};
+
+/**
+ * Encode an OBJECT IDENTIFIER.
+ * @param {string} oid The OID in dotted-decimal form (e.g., '2.5.4.3').
+ * @return {!Buffer}
+ */
+Der.oid = function(oid) {
+  var arcs = oid.split('.').map(Number);
+  var bytes = [arcs[0] * 40 + arcs[1]];
+  for (var i = 2; i < arcs.length; i++) {
+    var arc = arcs[i];
+    var group = [arc & 0x7f];
+    for (arc = Math.floor(arc / 128); arc > 0; arc = Math.floor(arc / 128)) {
+      group.unshift(0x80 | (arc & 0x7f));
+    }
+    bytes = bytes.concat(group);
+  }
+  return Der.encode(Der.Tag.OID, Buffer.from(bytes));
+};
+
+/**
+ * Encode a UTF8String.
+ * @param {string} text The string.
+ * @return {!Buffer}
+ */
+Der.utf8String = function(text) {
+  return Der.encode(Der.Tag.UTF8_STRING, Buffer.from(text, 'utf8'));
+};
+
+/**
+ * Encode an OCTET STRING.
+ * @param {!Buffer} bytes The octets.
+ * @return {!Buffer}
+ */
+Der.octetString = function(bytes) {
+  return Der.encode(Der.Tag.OCTET_STRING, bytes);
+};
+
+/**
+ * Encode a BIT STRING (of a whole number of octets).
+ * @param {!Buffer} bytes The bits.
+ * @return {!Buffer}
+ */
+Der.bitString = function(bytes) {
+  return Der.encode(Der.Tag.BIT_STRING,
+                    Buffer.concat([Buffer.from([0]), bytes]));
+};
+
+/** @const {!Buffer} Encoded NULL. */
+Der.NULL = Buffer.from([Der.Tag.NULL, 0]);
+
+/**
+ * A decoded element.
+ * @constructor
+ * @struct
+ * @param {number} tag Identifier octet.
+ * @param {!Buffer} contents Contents octets.
+ * @param {!Buffer} raw Complete encoding (header and contents).
+ */
+Der.Element = function(tag, contents, raw) {
+  /** @const {number} */
+  this.tag = tag;
+  /** @const {!Buffer} */
+  this.contents = contents;
+  /** @const {!Buffer} */
+  this.raw = raw;
+  /**
+   * Elements contained, if constructed (and decoded).
+   * @type {?Array<!Der.Element>}
+   */
+  this.children = null;
+};
+
+/**
+ * Get a contained element.
+ * @param {number} index Index of the element.
+ * @return {!Der.Element}
+ * @throws {RangeError} If there is no such element.
+ */
+Der.Element.prototype.child = function(index) {
+  if (!this.children || index >= this.children.length) {
+    throw new RangeError('Missing ASN.1 element');
+  }
+  return this.children[index];
+};
+
+/**
+ * Decode the value of an OBJECT IDENTIFIER.
+ * @return {string} The OID in dotted-decimal form.
+ */
+Der.Element.prototype.oid = function() {
+  var bytes = this.contents;
+  var arcs = [Math.floor(bytes[0] / 40), bytes[0] % 40];
+  var arc = 0;
+  for (var i = 1; i < bytes.length; i++) {
+    arc = arc * 128 + (bytes[i] & 0x7f);
+    if (!(bytes[i] & 0x80)) {
+      arcs.push(arc);
+      arc = 0;
+    }
+  }
+  return arcs.join('.');
+};
+
+/**
+ * Decode the value of a UTCTime or GeneralizedTime (in the forms
+ * required by RFC 5280).
+ * @return {!Date}
+ */
+Der.Element.prototype.time = function() {
+  var text = this.contents.toString('latin1');
+  if (this.tag === Der.Tag.UTC_TIME) {
+    text = ((Number(text.slice(0, 2)) < 50) ? '20' : '19') + text;
+  }
+  var m = text.match(/^(\d{4})(\d\d)(\d\d)(\d\d)(\d\d)(\d\d)(\.\d+)?Z$/);
+  if (!m) throw new SyntaxError('Invalid ASN.1 time: ' + text);
+  return new Date(m[1] + '-' + m[2] + '-' + m[3] + 'T' + m[4] + ':' + m[5] +
+                  ':' + m[6] + (m[7] || '') + 'Z');
+};
+
+/**
+ * Decode an element (and, recursively, any it contains).
+ * @param {!Buffer} data Encoding of the element.
+ * @return {!Der.Element}
+ * @throws {SyntaxError} If the data is malformed or has trailing bytes.
+ */
+Der.decode = function(data) {
+  var result = Der.decodeAt_(data, 0);
+  if (result.end !== data.length) {
+    throw new SyntaxError('Trailing data after ASN.1 element');
+  }
+  return result.element;
+};
+
+/**
+ * Decode an element starting at a given offset.
+ * @private
+ * @param {!Buffer} data Data containing the element.
+ * @param {number} offset Offset of the element.
+ * @return {{element: !Der.Element, end: number}}
+ */
+Der.decodeAt_ = function(data, offset) {
+  if (offset + 2 > data.length) throw new SyntaxError('Truncated ASN.1');
+  var tag = data[offset];
+  if ((tag & 0x1f) === 0x1f) throw new SyntaxError('Unsupported ASN.1 tag');
+  var length = data[offset + 1];
+  var start = offset + 2;
+  if (length & 0x80) {
+    var count = length & 0x7f;
+    if (count === 0 || count > 4) {
+      throw new SyntaxError('Unsupported ASN.1 length');
+    }
+    length = 0;
+    for (var i = 0; i < count; i++) {
+      length = length * 256 + data[start + i];
+    }
+    start += count;
+  }
+  var end = start + length;
+  if (end > data.length) throw new SyntaxError('Truncated ASN.1');
+  var element = new Der.Element(tag, data.subarray(start, end),
+                                data.subarray(offset, end));
+  if (tag & 0x20) {  // Constructed.
+    element.children = [];
+    for (var pos = start; pos < end; ) {
+      var child = Der.decodeAt_(data.subarray(0, end), pos);
+      element.children.push(child.element);
+      pos = child.end;
+    }
+  }
+  return {element: element, end: end};
+};
+
+module.exports = Der;
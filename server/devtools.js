@@ -0,0 +1,973 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview An adapter exposing the debugger (breakpoints,
+ * stepping and frame inspection; see Interpreter.prototype.setBreakpoint
+ * and friends) and profiler (Interpreter.prototype.startProfiling)
+ * over a subset of the Chrome DevTools Protocol, so that Chrome
+ * DevTools, VS Code and other tools that speak it can be attached to a
+ * running Code City.  Sessions are WebSocket connections accepted by
+ * the admin API (see Admin.Server), which does the authentication.
+ *
+ * The protocol was designed for a single thread of execution, and
+ * Code City has many.  A session shows one paused thread at a time:
+ * threads that pause while it is showing another wait their turn, and
+ * are shown (one after another) as each is resumed.  Debugger.pause
+ * pauses every thread.
+ *
+ * Scripts, as the protocol calls them, are the source code of
+ * functions, programs and evals; line and column numbers count from the
+ * start of each.  Those of functions that have selectors are given URLs
+ * of the form codecity:///<selector> (e.g., codecity:///$.user.look),
+ * and are announced when the debugger is enabled; others are announced
+ * as they turn up (in call stacks or profiles).
+ *
+ * Supported: the Debugger methods enable, disable, getScriptSource,
+ * setBreakpointByUrl (by URL only, without conditions), setBreakpoint,
+ * removeBreakpoint, pause, resume, stepOver, stepInto, stepOut and
+ * evaluateOnCallFrame; the Runtime methods enable, disable, evaluate,
+ * getProperties, releaseObject and releaseObjectGroup; and the Profiler
+ * methods enable, disable, start and stop.  Some methods sent by
+ * clients as a matter of course (e.g., Debugger.setAsyncCallStackDepth)
+ * are accepted but have no effect; others get a "method not found"
+ * error.
+ */
+'use strict';
+
+var crypto = require('crypto');
+var Interpreter = require('./interpreter');
+var Package = require('./package');
+var WebSocket = require('./websocket');
+
+var DevTools = {};
+
+/**
+ * Prefix of the URLs of scripts of functions with selectors.
+ * @const {string}
+ */
+DevTools.URL_PREFIX = 'codecity:///';
+
+/**
+ * Time (in ms) to wait for an evaluation to finish before responding
+ * that it timed out.  (The thread continues to run regardless.)
+ * @const {number}
+ */
+DevTools.EVAL_TIMEOUT = 30 * 1000;
+
+/**
+ * Largest message (in bytes) accepted from a client.
+ * @const {number}
+ */
+DevTools.MAX_MESSAGE_SIZE = 1024 * 1024;
+
+/**
+ * ID of the (only) execution context.
+ * @private @const {number}
+ */
+DevTools.CONTEXT_ID_ = 1;
+
+/**
+ * JSON-RPC error codes.
+ * @enum {number}
+ */
+DevTools.ErrorCode = {
+  PARSE_ERROR: -32700,
+  METHOD_NOT_FOUND: -32601,
+  SERVER_ERROR: -32000,
+};
+
+/**
+ * Methods that clients commonly send, and that are accepted (with an
+ * empty result) but have no effect.
+ * @private @const {!Set<string>}
+ */
+DevTools.IGNORED_ = new Set([
+  'Debugger.setAsyncCallStackDepth',
+  'Debugger.setBlackboxPatterns',
+  'Debugger.setPauseOnExceptions',
+  'Profiler.setSamplingInterval',
+  'Runtime.runIfWaitingForDebugger',
+]);
+
+/**
+ * A script: the source code of a function, program or eval.  func is
+ * the (or a) function whose source it is, if it is that of a user
+ * function.
+ * @typedef {{id: string,
+ *            url: string,
+ *            name: string,
+ *            source: string,
+ *            func: ?Interpreter.prototype.UserFunction}}
+ */
+DevTools.Script;
+
+/**
+ * A DevTools server: accepts sessions, and reports threads paused by
+ * the debugger to them.
+ * @constructor
+ * @struct
+ * @param {!Interpreter} intrp The interpreter to be debugged.
+ */
+DevTools.Server = function(intrp) {
+  /** @const {!Interpreter} */
+  this.intrp = intrp;
+  /** @private @const {!Set<!DevTools.Session>} */
+  this.sessions_ = new Set();
+  /**
+   * The interpreter's .onThreadPaused hook before the first session was
+   * accepted, which is called in turn.
+   * @private @type {?function(!Interpreter.Thread, string)}
+   */
+  this.previousHook_ = null;
+};
+
+/**
+ * Accept a WebSocket connection (already authenticated) as a new
+ * session.
+ * @param {!net.Socket} socket The underlying connection.
+ * @param {!WebSocket.Request} request The opening request.
+ * @param {?Buffer} head Data received after the request.
+ * @return {!DevTools.Session} The new session.
+ */
+DevTools.Server.prototype.accept = function(socket, request, head) {
+  var connection = new WebSocket.Connection(socket, request, head,
+      {maxMessageSize: DevTools.MAX_MESSAGE_SIZE});
+  if (!this.sessions_.size) {
+    this.previousHook_ = this.intrp.onThreadPaused;
+    this.intrp.onThreadPaused = this.threadPaused_.bind(this);
+  }
+  var session = new DevTools.Session(this, connection);
+  this.sessions_.add(session);
+  this.intrp.log('admin', 'DevTools session from %s',
+                 connection.remoteAddress);
+  return session;
+};
+
+/**
+ * End every session.
+ */
+DevTools.Server.prototype.close = function() {
+  this.sessions_.forEach(function(session) {
+    session.end();
+  });
+};
+
+/**
+ * Forget a session that has ended.
+ * @private
+ * @param {!DevTools.Session} session The session.
+ */
+DevTools.Server.prototype.remove_ = function(session) {
+  if (!this.sessions_.delete(session) || this.sessions_.size) return;
+  this.intrp.onThreadPaused = this.previousHook_;
+  this.previousHook_ = null;
+};
+
+/**
+ * Report a thread paused by the debugger to every session.
+ * @private
+ * @param {!Interpreter.Thread} thread The thread.
+ * @param {string} reason Why it was paused.
+ */
+DevTools.Server.prototype.threadPaused_ = function(thread, reason) {
+  if (this.previousHook_) this.previousHook_(thread, reason);
+  this.sessions_.forEach(function(session) {
+    session.threadPaused(thread, reason);
+  });
+};
+
+/**
+ * A DevTools session: a client's connection, and what it has asked
+ * for.
+ * @constructor
+ * @struct
+ * @param {!DevTools.Server} server The server that accepted it.
+ * @param {!WebSocket.Connection} connection The client's connection.
+ */
+DevTools.Session = function(server, connection) {
+  /** @private @const {!DevTools.Server} */
+  this.server_ = server;
+  /** @private @const {!Interpreter} */
+  this.intrp_ = server.intrp;
+  /** @private @const {!WebSocket.Connection} */
+  this.connection_ = connection;
+  /** @private @type {boolean} Has Debugger.enable been called? */
+  this.debuggerEnabled_ = false;
+  /** @private @type {boolean} Has Profiler.start been called? */
+  this.profiling_ = false;
+  /** @private @const {!Map<string, !DevTools.Script>} Scripts by ID. */
+  this.scripts_ = new Map();
+  /**
+   * Scripts, by the Source of a user function's body, the source text
+   * of a program or eval, or a native function.
+   * @private @const {!Map<*, !DevTools.Script>}
+   */
+  this.scriptsByKey_ = new Map();
+  /**
+   * Values (objects, or scopes) given to the client as remote objects,
+   * by ID, with the object groups they belong to.
+   * @private @const {!Map<string, {value: (!Interpreter.prototype.Object|
+   *     !Interpreter.Scope), group: string}>}
+   */
+  this.objects_ = new Map();
+  /** @private @type {number} Next ID for a script or remote object. */
+  this.nextId_ = 1;
+  /** @private @const {!Set<number>} IDs of breakpoints set. */
+  this.breakpoints_ = new Set();
+  /** @private @type {?Interpreter.Thread} The thread being shown. */
+  this.paused_ = null;
+  /**
+   * Threads waiting to be shown, with the reasons they were paused.
+   * @private @const {!Array<{thread: !Interpreter.Thread, reason: string}>}
+   */
+  this.queue_ = [];
+
+  connection.on('data', this.receive_.bind(this));
+  connection.on('close', this.close_.bind(this));
+  connection.on('error', function(error) {
+    server.intrp.log('admin', 'DevTools session error: %s', error);
+  });
+};
+
+/**
+ * End the session.
+ */
+DevTools.Session.prototype.end = function() {
+  this.connection_.end(WebSocket.Status.GOING_AWAY);
+};
+
+/**
+ * Note that a thread has been paused by the debugger, showing it if no
+ * other is being shown.
+ * @param {!Interpreter.Thread} thread The thread.
+ * @param {string} reason Why it was paused: 'breakpoint', 'watchpoint',
+ *     'step' or 'pause'.
+ */
+DevTools.Session.prototype.threadPaused = function(thread, reason) {
+  if (!this.debuggerEnabled_) return;
+  this.queue_.push({thread: thread, reason: reason});
+  if (!this.paused_) this.showNext_();
+};
+
+/**
+ * Handle a message from the client: a command, to which a response
+ * is sent (once any promise returned by its method has settled).
+ * @private
+ * @param {string|!Buffer} data The message.
+ */
+DevTools.Session.prototype.receive_ = function(data) {
+  var session = this;
+  try {
+    var command = JSON.parse(String(data));
+  } catch (e) {
+    this.send_({error: {code: DevTools.ErrorCode.PARSE_ERROR,
+                        message: 'Invalid JSON: ' + e.message}});
+    return;
+  }
+  var id = command['id'];
+  var method = String(command['method']);
+  var params = command['params'] || {};
+  var impl = DevTools.methods_[method];
+  if (!impl && !DevTools.IGNORED_.has(method)) {
+    this.send_({id: id, error: {code: DevTools.ErrorCode.METHOD_NOT_FOUND,
+                                message: "'" + method + "' wasn't found"}});
+    return;
+  }
+  new Promise(function(resolve) {
+    resolve(impl ? impl.call(session, params) : undefined);
+  }).then(function(result) {
+    session.send_({id: id, result: result || {}});
+  }, function(e) {
+    session.send_({id: id, error: {code: DevTools.ErrorCode.SERVER_ERROR,
+                                   message: e.message || String(e)}});
+  });
+};
+
+/**
+ * Send a message (a response or event) to the client.
+ * @private
+ * @param {!Object} message The message.
+ */
+DevTools.Session.prototype.send_ = function(message) {
+  this.connection_.write(JSON.stringify(message));
+};
+
+/**
+ * Send an event to the client.
+ * @private
+ * @param {string} method The event's name (e.g., 'Debugger.paused').
+ * @param {!Object} params Its parameters.
+ */
+DevTools.Session.prototype.notify_ = function(method, params) {
+  this.send_({method: method, params: params});
+};
+
+/**
+ * Clean up once the connection has closed: remove breakpoints that
+ * were set, resume threads that are paused, and stop profiling.
+ * @private
+ */
+DevTools.Session.prototype.close_ = function() {
+  this.disableDebugger_();
+  if (this.profiling_) this.intrp_.stopProfiling();
+  this.profiling_ = false;
+  this.server_.remove_(this);
+};
+
+/**
+ * Disable the debugger: remove breakpoints that were set and resume
+ * threads that are paused.
+ * @private
+ */
+DevTools.Session.prototype.disableDebugger_ = function() {
+  var intrp = this.intrp_;
+  this.debuggerEnabled_ = false;
+  this.breakpoints_.forEach(function(id) {
+    intrp.clearBreakpoint(id);
+  });
+  this.breakpoints_.clear();
+  var threads = this.queue_.map(function(entry) {return entry.thread;});
+  if (this.paused_) threads.unshift(this.paused_);
+  this.paused_ = null;
+  this.queue_.length = 0;
+  threads.forEach(function(thread) {
+    if (thread.status === Interpreter.Thread.Status.PAUSED) {
+      intrp.resumeThread(thread.id, 'continue');
+    }
+  });
+};
+
+/**
+ * Show the next waiting thread that is still paused (if any), by
+ * sending a Debugger.paused event.
+ * @private
+ */
+DevTools.Session.prototype.showNext_ = function() {
+  var intrp = this.intrp_;
+  while (this.queue_.length) {
+    var entry = this.queue_.shift();
+    var thread = entry.thread;
+    if (thread.status !== Interpreter.Thread.Status.PAUSED) continue;
+    this.paused_ = thread;
+    var frames = intrp.getFrames(thread.id);
+    var params = {
+      callFrames: frames.map(this.callFrame_, this),
+      reason: 'other',
+      data: {thread: thread.id, reason: entry.reason},
+    };
+    if (entry.reason === 'breakpoint') {
+      var top = frames[0].frame;
+      params.hitBreakpoints = intrp.getBreakpoints()
+          .filter(function(breakpoint) {
+            return top.func && breakpoint.func.node === top.func.node &&
+                breakpoint.line === top.line;
+          }).map(function(breakpoint) {
+            return String(breakpoint.id);
+          });
+    }
+    this.notify_('Debugger.paused', params);
+    return;
+  }
+};
+
+/**
+ * Resume the thread being shown, then show the next one waiting.
+ * @private
+ * @param {string} mode How far to let it run (see
+ *     Interpreter.prototype.resumeThread).
+ */
+DevTools.Session.prototype.resume_ = function(mode) {
+  var thread = this.paused_;
+  if (!thread) throw new Error('Not paused');
+  this.paused_ = null;
+  this.releaseGroup_('backtrace');
+  this.notify_('Debugger.resumed', {});
+  // Another session (or the admin API) may have resumed it already.
+  if (thread.status === Interpreter.Thread.Status.PAUSED) {
+    this.intrp_.resumeThread(thread.id, mode);
+  }
+  this.showNext_();
+};
+
+/**
+ * Describe a frame of the call stack of the thread being shown.
+ * @private
+ * @param {!Interpreter.DebugFrame} frame The frame.
+ * @param {number} index Its index (0 being the innermost).
+ * @return {!Object} A Debugger.CallFrame.
+ */
+DevTools.Session.prototype.callFrame_ = function(frame, index) {
+  var info = frame.frame;
+  var script = info.func ? this.scriptForFunction_(info.func) :
+      this.scriptForSource_(String(info.program || info.eval || ''),
+                            ('eval' in info) ? 'eval' : 'program');
+  var scopeChain = [];
+  var local = true;
+  for (var scope = frame.scope; scope; scope = scope.outerScope) {
+    var type;
+    switch (scope.type) {
+      case Interpreter.Scope.Type.GLOBAL:
+        type = 'global';
+        break;
+      case Interpreter.Scope.Type.FUNCTION:
+        type = local ? 'local' : 'closure';
+        local = false;
+        break;
+      case Interpreter.Scope.Type.CATCH:
+        type = 'catch';
+        break;
+      case Interpreter.Scope.Type.EVAL:
+        type = 'eval';
+        break;
+      case Interpreter.Scope.Type.FUNEXP:
+        type = 'closure';
+        break;
+      default:
+        continue;
+    }
+    scopeChain.push({
+      type: type,
+      object: {
+        type: 'object',
+        className: 'Object',
+        description: type,
+        objectId: this.objectId_(scope, 'backtrace'),
+      },
+    });
+  }
+  return {
+    callFrameId: String(index),
+    functionName: info.func ? script.name : '',
+    location: {
+      scriptId: script.id,
+      lineNumber: (info.line || 1) - 1,
+      columnNumber: (info.col || 1) - 1,
+    },
+    url: script.url,
+    scopeChain: scopeChain,
+    this: this.remoteObject_(frame.scope.this, 'backtrace'),
+  };
+};
+
+/**
+ * Get (announcing it if new) the script of a function.
+ * @private
+ * @param {!Interpreter.prototype.Function} func The function.
+ * @param {string=} selector The function's selector, if known.
+ * @return {!DevTools.Script} The script.
+ */
+DevTools.Session.prototype.scriptForFunction_ = function(func, selector) {
+  var intrp = this.intrp_;
+  var user = func instanceof intrp.UserFunction;
+  var key = user ? func.node['body']['source'] : func;
+  var script = this.scriptsByKey_.get(key);
+  if (script) return script;
+  var name = selector;
+  if (name === undefined) {
+    name = func.get('name', intrp.ROOT);
+    name = (typeof name === 'string') ? name : '';
+  }
+  return this.addScript_(key, {
+    id: String(this.nextId_++),
+    url: (selector === undefined) ? '' : DevTools.URL_PREFIX + selector,
+    name: name,
+    source: user ? String(key) :
+        'function ' + name + '() { [native code] }',
+    func: user ? /** @type {!Interpreter.prototype.UserFunction} */(func) :
+        null,
+  });
+};
+
+/**
+ * Get (announcing it if new) the script of a program or eval.
+ * @private
+ * @param {string} source Its source code.
+ * @param {string} name What it is: 'program' or 'eval'.
+ * @return {!DevTools.Script} The script.
+ */
+DevTools.Session.prototype.scriptForSource_ = function(source, name) {
+  return this.scriptsByKey_.get(source) || this.addScript_(source, {
+    id: String(this.nextId_++),
+    url: '',
+    name: name,
+    source: source,
+    func: null,
+  });
+};
+
+/**
+ * Record a new script, and announce it to the client (if the debugger
+ * is enabled).
+ * @private
+ * @param {*} key The script's key (see .scriptsByKey_).
+ * @param {!DevTools.Script} script The script.
+ * @return {!DevTools.Script} The script.
+ */
+DevTools.Session.prototype.addScript_ = function(key, script) {
+  this.scriptsByKey_.set(key, script);
+  this.scripts_.set(script.id, script);
+  if (this.debuggerEnabled_) this.announce_(script);
+  return script;
+};
+
+/**
+ * Announce a script to the client, with a Debugger.scriptParsed event.
+ * @private
+ * @param {!DevTools.Script} script The script.
+ */
+DevTools.Session.prototype.announce_ = function(script) {
+  var lines = script.source.split('\n');
+  this.notify_('Debugger.scriptParsed', {
+    scriptId: script.id,
+    url: script.url,
+    startLine: 0,
+    startColumn: 0,
+    endLine: lines.length - 1,
+    endColumn: lines[lines.length - 1].length,
+    executionContextId: DevTools.CONTEXT_ID_,
+    hash: crypto.createHash('sha256').update(script.source).digest('hex'),
+  });
+};
+
+/**
+ * Get a script by ID.
+ * @private
+ * @param {*} id The ID.
+ * @return {!DevTools.Script} The script.
+ */
+DevTools.Session.prototype.script_ = function(id) {
+  var script = this.scripts_.get(String(id));
+  if (!script) throw new Error('No script with given id');
+  return script;
+};
+
+/**
+ * Set a breakpoint on the first statement that begins on or after a
+ * given line of a script.
+ * @private
+ * @param {!DevTools.Script} script The script.
+ * @param {*} lineNumber The line number (counting from 0).
+ * @return {{breakpointId: string, location: !Object}} The breakpoint's
+ *     ID, and its Debugger.Location.
+ */
+DevTools.Session.prototype.setBreakpoint_ = function(script, lineNumber) {
+  if (!script.func) {
+    throw new Error('Breakpoints can only be set in user functions');
+  } else if (typeof lineNumber !== 'number' ||
+      !Number.isInteger(lineNumber) || lineNumber < 0) {
+    throw new Error('lineNumber must be a non-negative integer');
+  }
+  var lines = script.source.split('\n').length;
+  for (var line = lineNumber + 1; line <= lines; line++) {
+    try {
+      var breakpoint = this.intrp_.setBreakpoint(script.func, line);
+    } catch (e) {
+      continue;  // No statement begins on that line.
+    }
+    this.breakpoints_.add(breakpoint.id);
+    var body = script.func.node['body'];
+    var lc = body['source'].lineColForPos(breakpoint.node['start']);
+    return {
+      breakpointId: String(breakpoint.id),
+      location: {
+        scriptId: script.id,
+        lineNumber: lc.line - 1,
+        columnNumber: lc.col - 1,
+      },
+    };
+  }
+  throw new Error('No statement begins on or after line ' + lineNumber);
+};
+
+/**
+ * Evaluate code in a new thread, and wait for it to finish.
+ * @private
+ * @param {!Interpreter.prototype.Thread} wrapper The thread.
+ * @param {string} group Object group of the result.
+ * @return {!Promise<!Object>} Resolves to the response (a result, as a
+ *     Runtime.RemoteObject, and any exceptionDetails) once the thread
+ *     finishes.  Rejects if it has yet to do so after
+ *     DevTools.EVAL_TIMEOUT.
+ */
+DevTools.Session.prototype.await_ = function(wrapper, group) {
+  var session = this;
+  var thread = wrapper.thread;
+  return new Promise(function(resolve, reject) {
+    var timer = setTimeout(function() {
+      thread.onExit = null;
+      reject(new Error('Thread ' + thread.id + ' still running after ' +
+                       DevTools.EVAL_TIMEOUT + 'ms'));
+    }, DevTools.EVAL_TIMEOUT);
+    thread.onExit = function(threw, value) {
+      clearTimeout(timer);
+      var remote = session.remoteObject_(value, group);
+      var response = {result: remote};
+      if (threw) {
+        response.exceptionDetails = {
+          exceptionId: session.nextId_++,
+          text: 'Uncaught',
+          lineNumber: 0,
+          columnNumber: 0,
+          exception: remote,
+        };
+      }
+      resolve(response);
+    };
+  });
+};
+
+/**
+ * Get an ID by which the client can refer to an object or scope.
+ * @private
+ * @param {!Interpreter.prototype.Object|!Interpreter.Scope} value The
+ *     object or scope.
+ * @param {string} group The object group it is to belong to.
+ * @return {string} The ID.
+ */
+DevTools.Session.prototype.objectId_ = function(value, group) {
+  var id = String(this.nextId_++);
+  this.objects_.set(id, {value: value, group: group});
+  return id;
+};
+
+/**
+ * Forget the objects in an object group.
+ * @private
+ * @param {string} group The group.
+ */
+DevTools.Session.prototype.releaseGroup_ = function(group) {
+  var objects = this.objects_;
+  objects.forEach(function(entry, id) {
+    if (entry.group === group) objects.delete(id);
+  });
+};
+
+/**
+ * Describe a value, as a Runtime.RemoteObject.
+ * @private
+ * @param {?Interpreter.Value} value The value.
+ * @param {string} group The object group any object is to belong to.
+ * @return {!Object} The description.
+ */
+DevTools.Session.prototype.remoteObject_ = function(value, group) {
+  var intrp = this.intrp_;
+  if (value instanceof intrp.Object) {
+    var remote = {
+      type: 'object',
+      className: value.class,
+      description: value.class,
+      objectId: this.objectId_(value, group),
+    };
+    if (value instanceof intrp.UserFunction) {
+      remote.type = 'function';
+      remote.description = String(value.node['body']['source']);
+    } else if (value instanceof intrp.Function) {
+      remote.type = 'function';
+      remote.description = 'function () { [native code] }';
+    } else if (value instanceof intrp.Error) {
+      remote.subtype = 'error';
+      remote.description = String(value.get('name', intrp.ROOT)) + ': ' +
+          String(value.get('message', intrp.ROOT));
+    } else if (value.class === 'Array') {
+      remote.subtype = 'array';
+      remote.description =
+          'Array(' + String(value.get('length', intrp.ROOT)) + ')';
+    }
+    return remote;
+  } else if (value === undefined) {
+    return {type: 'undefined'};
+  } else if (value === null) {
+    return {type: 'object', subtype: 'null', value: null};
+  } else if (typeof value === 'number' &&
+      (!isFinite(value) || Object.is(value, -0))) {
+    var text = Object.is(value, -0) ? '-0' : String(value);
+    return {type: 'number', unserializableValue: text, description: text};
+  }
+  return {type: typeof value, value: value, description: String(value)};
+};
+
+/**
+ * Implementations of protocol methods, by name.  Each is called with
+ * the session as this and the command's params, and returns the
+ * result (or a promise of it, or undefined for an empty result), or
+ * throws.
+ * @private @const {!Object<string, function(this:DevTools.Session,
+ *     !Object): *>}
+ */
+DevTools.methods_ = {};
+
+DevTools.methods_['Schema.getDomains'] = function(params) {
+  return {domains: ['Debugger', 'Profiler', 'Runtime', 'Schema']
+      .map(function(name) {return {name: name, version: '1.3'};})};
+};
+
+DevTools.methods_['Runtime.enable'] = function(params) {
+  this.notify_('Runtime.executionContextCreated', {
+    context: {
+      id: DevTools.CONTEXT_ID_,
+      origin: '',
+      name: 'Code City',
+      uniqueId: 'codecity',
+    },
+  });
+};
+
+DevTools.methods_['Runtime.disable'] = function(params) {
+  this.objects_.clear();
+};
+
+DevTools.methods_['Runtime.evaluate'] = function(params) {
+  var intrp = this.intrp_;
+  var evalFunc = intrp.global.get('eval');
+  if (!(evalFunc instanceof intrp.Function)) {
+    throw new Error('No eval function');
+  }
+  var wrapper = intrp.createThreadForFuncCall(
+      intrp.ROOT, evalFunc, undefined, [String(params['expression'])]);
+  return this.await_(wrapper, String(params['objectGroup'] || ''));
+};
+
+DevTools.methods_['Runtime.getProperties'] = function(params) {
+  var intrp = this.intrp_;
+  var entry = this.objects_.get(String(params['objectId']));
+  if (!entry) throw new Error('Could not find object with given id');
+  var value = entry.value;
+  var result = [];
+  if (value instanceof Interpreter.Scope) {
+    for (var name in value.vars) {
+      result.push({
+        name: name,
+        value: this.remoteObject_(value.vars[name], entry.group),
+        writable: true,
+        configurable: false,
+        enumerable: true,
+        isOwn: true,
+      });
+    }
+  } else {
+    var keys = value.ownKeys(intrp.ROOT);
+    for (var i = 0; i < keys.length; i++) {
+      var pd = value.getOwnPropertyDescriptor(keys[i], intrp.ROOT);
+      result.push({
+        name: keys[i],
+        value: this.remoteObject_(pd.value, entry.group),
+        writable: pd.writable,
+        configurable: pd.configurable,
+        enumerable: pd.enumerable,
+        isOwn: true,
+      });
+    }
+    result.push({
+      name: '__proto__',
+      value: this.remoteObject_(value.proto, entry.group),
+      writable: true,
+      configurable: true,
+      enumerable: false,
+      isOwn: true,
+    });
+  }
+  return {result: result};
+};
+
+DevTools.methods_['Runtime.releaseObject'] = function(params) {
+  this.objects_.delete(String(params['objectId']));
+};
+
+DevTools.methods_['Runtime.releaseObjectGroup'] = function(params) {
+  this.releaseGroup_(String(params['objectGroup']));
+};
+
+DevTools.methods_['Debugger.enable'] = function(params) {
+  var intrp = this.intrp_;
+  if (!this.debuggerEnabled_) {
+    this.debuggerEnabled_ = true;
+    var session = this;
+    this.scripts_.forEach(function(script) {
+      session.announce_(script);
+    });
+    Package.findNames(intrp).forEach(function(selector, obj) {
+      if (obj instanceof intrp.UserFunction) {
+        session.scriptForFunction_(obj, selector);
+      }
+    });
+    // Show threads that were already paused.
+    intrp.getThreads().forEach(function(thread) {
+      if (thread.status === Interpreter.Thread.Status.PAUSED) {
+        session.threadPaused(thread, 'pause');
+      }
+    });
+  }
+  return {debuggerId: 'codecity'};
+};
+
+DevTools.methods_['Debugger.disable'] = function(params) {
+  this.disableDebugger_();
+};
+
+DevTools.methods_['Debugger.getScriptSource'] = function(params) {
+  return {scriptSource: this.script_(params['scriptId']).source};
+};
+
+DevTools.methods_['Debugger.setBreakpointByUrl'] = function(params) {
+  var url = params['url'];
+  if (typeof url !== 'string' || !url.startsWith(DevTools.URL_PREFIX)) {
+    throw new Error('url must be a ' + DevTools.URL_PREFIX + ' URL');
+  } else if (params['condition']) {
+    throw new Error('Conditional breakpoints are not supported');
+  }
+  var selector = url.slice(DevTools.URL_PREFIX.length);
+  var intrp = this.intrp_;
+  try {
+    var func = Package.lookup(intrp, selector);
+  } catch (e) {
+    throw new Error('Invalid selector: ' + selector);
+  }
+  if (!(func instanceof intrp.Function)) {
+    throw new Error('No such function: ' + selector);
+  }
+  var set = this.setBreakpoint_(this.scriptForFunction_(func, selector),
+                                params['lineNumber']);
+  return {breakpointId: set.breakpointId, locations: [set.location]};
+};
+
+DevTools.methods_['Debugger.setBreakpoint'] = function(params) {
+  var location = params['location'] || {};
+  if (params['condition']) {
+    throw new Error('Conditional breakpoints are not supported');
+  }
+  var set = this.setBreakpoint_(this.script_(location['scriptId']),
+                                location['lineNumber']);
+  return {breakpointId: set.breakpointId, actualLocation: set.location};
+};
+
+DevTools.methods_['Debugger.removeBreakpoint'] = function(params) {
+  var id = Number(params['breakpointId']);
+  if (this.breakpoints_.delete(id)) this.intrp_.clearBreakpoint(id);
+};
+
+DevTools.methods_['Debugger.pause'] = function(params) {
+  var intrp = this.intrp_;
+  intrp.getThreads().forEach(function(thread) {
+    if (!thread.isDebugHandler) intrp.pauseThread(thread.id);
+  });
+};
+
+DevTools.methods_['Debugger.resume'] = function(params) {
+  this.resume_('continue');
+};
+
+DevTools.methods_['Debugger.stepOver'] = function(params) {
+  this.resume_('over');
+};
+
+DevTools.methods_['Debugger.stepInto'] = function(params) {
+  this.resume_('into');
+};
+
+DevTools.methods_['Debugger.stepOut'] = function(params) {
+  this.resume_('out');
+};
+
+DevTools.methods_['Debugger.evaluateOnCallFrame'] = function(params) {
+  if (!this.paused_) throw new Error('Not paused');
+  var index = Number(params['callFrameId']);
+  var wrapper = this.intrp_.evalInFrame(
+      this.paused_.id, index, String(params['expression']));
+  return this.await_(wrapper, String(params['objectGroup'] || ''));
+};
+
+DevTools.methods_['Profiler.enable'] = function(params) {};
+
+DevTools.methods_['Profiler.disable'] = function(params) {
+  if (this.profiling_) this.intrp_.stopProfiling();
+  this.profiling_ = false;
+};
+
+DevTools.methods_['Profiler.start'] = function(params) {
+  this.intrp_.startProfiling();
+  this.profiling_ = true;
+};
+
+DevTools.methods_['Profiler.stop'] = function(params) {
+  var profile = this.profiling_ ? this.intrp_.stopProfiling() : null;
+  this.profiling_ = false;
+  if (!profile) throw new Error('Profiling has not been started');
+  return {profile: this.cpuProfile_(profile)};
+};
+
+/**
+ * Convert a profile recorded by the interpreter to a Profiler.Profile.
+ * @private
+ * @param {!Interpreter.Profile} profile The profile.
+ * @return {!Object} The Profiler.Profile.
+ */
+DevTools.Session.prototype.cpuProfile_ = function(profile) {
+  var session = this;
+  var newNode = function(name, script) {
+    var node = {
+      id: nodes.length + 1,
+      callFrame: {
+        functionName: name,
+        scriptId: script ? script.id : '0',
+        url: script ? script.url : '',
+        lineNumber: script ? 0 : -1,
+        columnNumber: script ? 0 : -1,
+      },
+      hitCount: 0,
+      children: [],
+    };
+    nodes.push(node);
+    children.push(new Map());
+    return node;
+  };
+  var nodes = [];
+  var children = [];  // Child nodes of each node, by key.
+  newNode('(root)', null);
+  var samples = [];
+  var timeDeltas = [];
+  var time = profile.startTime;
+  profile.samples.forEach(function(sample) {
+    var node = nodes[0];
+    sample.stack.forEach(function(frame) {
+      var map = children[node.id - 1];
+      var child = map.get(frame);
+      if (!child) {
+        var script = (frame instanceof Interpreter.Source) ?
+            session.scriptForSource_(String(frame), 'program') :
+            session.scriptForFunction_(frame);
+        child = newNode(script.name, script);
+        map.set(frame, child);
+        node.children.push(child.id);
+      }
+      node = child;
+    });
+    node.hitCount++;
+    samples.push(node.id);
+    timeDeltas.push(Math.round((sample.time - time) * 1000));
+    time = sample.time;
+  });
+  return {
+    nodes: nodes,
+    startTime: Math.round(profile.startTime * 1000),
+    endTime: Math.round(profile.endTime * 1000),
+    samples: samples,
+    timeDeltas: timeDeltas,
+  };
+};
+
+module.exports = DevTools;
@@ -0,0 +1,336 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Comparison of two states of the world (e.g., those
+ * saved in two checkpoints), to find which user-visible objects
+ * have been created, deleted or modified, and how.
+ *
+ * Objects are identified by selector: every object reachable from
+ * the global scope is known by the shortest selector that refers to
+ * it (see Package.findNames), and corresponds to the object with the
+ * same selector in the other state.  (So an object that has merely
+ * been moved appears to have been deleted and another created.)  An
+ * object is modified if its prototype, owner or own properties
+ * (including their attributes) have changed, or if it is a function
+ * whose source, or a Date, RegExp or Buffer whose value, has.
+ * Variables in the global scope are compared as if they were the
+ * properties of an object named Diff.GLOBAL.
+ *
+ * Changes are reported grouped by the owner of the object concerned,
+ * in a JSON-compatible form:
+ *
+ *     {"owners": [{"owner": "$.alice",
+ *                  "created": ["$.alice.hat"],
+ *                  "deleted": ["$.oldThing"],
+ *                  "modified": [{"object": "$.room",
+ *                                "changes": [{"property": "name",
+ *                                             "before": "'Hall'",
+ *                                             "after": "'Kitchen'"},
+ *                                            ...]},
+ *                               ...]},
+ *                 ...]}
+ *
+ * where values are described as source text (objects by selector),
+ * and "before" or "after" are omitted for properties that have been
+ * added or deleted respectively.  Pseudo-properties ({proto},
+ * {owner}, etc.) describe changes other than to properties.
+ */
+'use strict';
+
+var code = require('./code');
+var Package = require('./package');
+
+var Diff = {};
+
+/** @const {string} Name of the global scope, in reports. */
+Diff.GLOBAL = '{global}';
+
+/** @const {string} Name of unnamed (or nonexistent) owners, in reports. */
+Diff.NO_OWNER = '{none}';
+
+/**
+ * A change to a single property (or pseudo-property) of an object.
+ * @typedef {{property: string, before: (string|undefined),
+ *            after: (string|undefined)}}
+ */
+Diff.Change;
+
+/**
+ * Changes to the objects belonging to a single owner.
+ * @typedef {{owner: string,
+ *            created: !Array<string>,
+ *            deleted: !Array<string>,
+ *            modified: !Array<{object: string,
+ *                              changes: !Array<!Diff.Change>}>}}
+ */
+Diff.Group;
+
+/**
+ * Result of comparing two states.
+ * @typedef {{owners: !Array<!Diff.Group>}}
+ */
+Diff.Report;
+
+/**
+ * Compare two states of the world.
+ * @param {!Interpreter} before Interpreter containing the earlier state.
+ * @param {!Interpreter} after Interpreter containing the later state.
+ * @return {!Diff.Report}
+ */
+Diff.compare = function(before, after) {
+  var world1 = new Diff.World_(before);
+  var world2 = new Diff.World_(after);
+  var /** !Map<string,!Diff.Group> */ groups = new Map();
+  var group = function(owner) {
+    var g = groups.get(owner);
+    if (!g) {
+      g = {owner: owner, created: [], deleted: [], modified: []};
+      groups.set(owner, g);
+    }
+    return g;
+  };
+  world2.selectors.forEach(function(selector) {
+    var obj2 = world2.objects.get(selector);
+    if (!world1.objects.has(selector)) {
+      group(world2.ownerOf(obj2)).created.push(selector);
+      return;
+    }
+    var changes = Diff.compareObjects_(world1, world1.objects.get(selector),
+                                       world2, obj2);
+    if (changes.length) {
+      group(world2.ownerOf(obj2)).modified.push(
+          {object: selector, changes: changes});
+    }
+  });
+  world1.selectors.forEach(function(selector) {
+    if (!world2.objects.has(selector)) {
+      group(world1.ownerOf(world1.objects.get(selector))).deleted.push(
+          selector);
+    }
+  });
+  var owners = Array.from(groups.keys()).sort(function(a, b) {
+    // Unowned objects last.
+    if (a === b) return 0;
+    if (a === Diff.NO_OWNER || b === Diff.NO_OWNER) {
+      return (a === Diff.NO_OWNER) ? 1 : -1;
+    }
+    return (a < b) ? -1 : 1;
+  });
+  return {owners: owners.map(function(owner) {
+    var g = /** @type {!Diff.Group} */(groups.get(owner));
+    g.created.sort();
+    g.deleted.sort();
+    g.modified.sort(function(a, b) {
+      return (a.object < b.object) ? -1 : (a.object > b.object) ? 1 : 0;
+    });
+    return g;
+  })};
+};
+
+/**
+ * Format a report as human-readable text: for each owner, a line for
+ * each object created (+), deleted (-) or modified (~), the latter
+ * followed by a line for each change.
+ * @param {!Diff.Report} report The report (as returned by Diff.compare).
+ * @return {string}
+ */
+Diff.format = function(report) {
+  var lines = [];
+  report.owners.forEach(function(g) {
+    lines.push('Owner ' + g.owner + ':');
+    g.created.forEach(function(selector) {
+      lines.push('  + ' + selector);
+    });
+    g.deleted.forEach(function(selector) {
+      lines.push('  - ' + selector);
+    });
+    g.modified.forEach(function(m) {
+      lines.push('  ~ ' + m.object);
+      m.changes.forEach(function(change) {
+        if (change.before === undefined) {
+          lines.push('      + ' + change.property + ': ' + change.after);
+        } else if (change.after === undefined) {
+          lines.push('      - ' + change.property + ': ' + change.before);
+        } else {
+          lines.push('      ' + change.property + ': ' + change.before +
+                     ' -> ' + change.after);
+        }
+      });
+    });
+  });
+  return lines.length ? lines.join('\n') : 'No changes.';
+};
+
+/**
+ * Compare two corresponding objects.
+ * @private
+ * @param {!Diff.World_} world1 The earlier state.
+ * @param {!Object} obj1 Object (or global scope) in the earlier state.
+ * @param {!Diff.World_} world2 The later state.
+ * @param {!Object} obj2 Corresponding object in the later state.
+ * @return {!Array<!Diff.Change>}
+ */
+Diff.compareObjects_ = function(world1, obj1, world2, obj2) {
+  var changes = [];
+  var compare = function(property, before, after) {
+    if (before !== after) {
+      changes.push({property: property, before: before, after: after});
+    }
+  };
+  var props1 = world1.propertiesOf(obj1);
+  var props2 = world2.propertiesOf(obj2);
+  var specials1 = world1.specialsOf(obj1);
+  var specials2 = world2.specialsOf(obj2);
+  for (var key in specials2) {
+    compare(key, specials1[key], specials2[key]);
+  }
+  for (var key in specials1) {
+    if (!(key in specials2)) compare(key, specials1[key], undefined);
+  }
+  var keys = Object.getOwnPropertyNames(props2);
+  for (var i = 0; i < keys.length; i++) {
+    var key = keys[i];
+    compare(Diff.propertyName_(key),
+            Object.prototype.hasOwnProperty.call(props1, key) ?
+                world1.describeProperty(props1, key) : undefined,
+            world2.describeProperty(props2, key));
+  }
+  keys = Object.getOwnPropertyNames(props1);
+  for (var i = 0; i < keys.length; i++) {
+    var key = keys[i];
+    if (!Object.prototype.hasOwnProperty.call(props2, key)) {
+      compare(Diff.propertyName_(key), world1.describeProperty(props1, key),
+              undefined);
+    }
+  }
+  return changes;
+};
+
+/**
+ * Format a property key as for a selector part.
+ * @private
+ * @param {string} key The property key.
+ * @return {string}
+ */
+Diff.propertyName_ = function(key) {
+  return code.regexps.identifierExact.test(key) ? key : code.quote(key);
+};
+
+/**
+ * One of the two states being compared, with names for its objects.
+ * @private
+ * @constructor
+ * @struct
+ * @param {!Interpreter} intrp Interpreter containing the state.
+ */
+Diff.World_ = function(intrp) {
+  /** @const {!Interpreter} */
+  this.intrp = intrp;
+  /** @const {!Map<!Interpreter.prototype.Object,string>} */
+  this.names = Package.findNames(intrp);
+  /** @const {!Map<string,!Object>} Objects (and global scope), by name. */
+  this.objects = new Map();
+  this.objects.set(Diff.GLOBAL, intrp.global);
+  this.names.forEach(function(name, obj) {
+    this.objects.set(name, obj);
+  }, this);
+  /** @const {!Array<string>} Names of the objects, in order found. */
+  this.selectors = Array.from(this.objects.keys());
+};
+
+/**
+ * Get the name of the owner of an object.
+ * @param {!Object} obj Object (or global scope).
+ * @return {string}
+ */
+Diff.World_.prototype.ownerOf = function(obj) {
+  var owner = (obj instanceof this.intrp.Object) ? obj.owner : obj.perms;
+  return (owner && this.names.get(owner)) || Diff.NO_OWNER;
+};
+
+/**
+ * Get the object containing the properties of an object.
+ * @param {!Object} obj Object (or global scope).
+ * @return {!Object}
+ */
+Diff.World_.prototype.propertiesOf = function(obj) {
+  return (obj instanceof this.intrp.Object) ? obj.properties : obj.vars;
+};
+
+/**
+ * Describe those aspects of an object other than its properties that
+ * are to be compared, as pseudo-properties.
+ * @param {!Object} obj Object (or global scope).
+ * @return {!Object<string,string>}
+ */
+Diff.World_.prototype.specialsOf = function(obj) {
+  var intrp = this.intrp;
+  var specials = Object.create(null);
+  if (!(obj instanceof intrp.Object)) return specials;
+  specials['{class}'] = obj.class;
+  specials['{proto}'] = this.describe(obj.proto);
+  specials['{owner}'] = this.describe(obj.owner);
+  specials['{extensible}'] = String(Object.isExtensible(obj.properties));
+  if (obj instanceof intrp.UserFunction) {
+    specials['{source}'] = String(obj);
+  } else if (obj instanceof intrp.Date) {
+    specials['{date}'] = String(obj.date.getTime());
+  } else if (obj instanceof intrp.RegExp) {
+    specials['{regexp}'] = String(obj.regexp);
+  } else if (obj instanceof intrp.Buffer) {
+    specials['{data}'] = obj.data.toString('base64');
+  }
+  return specials;
+};
+
+/**
+ * Describe a property: its value and any attributes other than the
+ * usual (writable, enumerable and configurable).
+ * @param {!Object} props Object containing the property.
+ * @param {string} key The property key.
+ * @return {string}
+ */
+Diff.World_.prototype.describeProperty = function(props, key) {
+  var pd = Object.getOwnPropertyDescriptor(props, key);
+  var text = this.describe(pd.value);
+  var attributes = [];
+  if (!pd.writable) attributes.push('non-writable');
+  if (!pd.enumerable) attributes.push('non-enumerable');
+  if (!pd.configurable) attributes.push('non-configurable');
+  if (attributes.length) text += ' (' + attributes.join(', ') + ')';
+  return text;
+};
+
+/**
+ * Describe a value, as source text: primitives by value and objects
+ * by name.
+ * @param {*} value The value.
+ * @return {string}
+ */
+Diff.World_.prototype.describe = function(value) {
+  if (typeof value === 'string') {
+    return code.quote(value);
+  } else if (Object.is(value, -0)) {
+    return '-0';
+  } else if (!value || typeof value !== 'object') {
+    return String(value);
+  }
+  return this.names.get(value) || '{unnamed ' + (value.class || 'object') + '}';
+};
+
+module.exports = Diff;
@@ -204,8 +204,23 @@ Dumper.prototype.dump = function() {
     var port = Number(key);
     var server = this.intrp2.listeners_[port];
     var args = [port, server.proto];
-    if (server.timeLimit) args.push(server.timeLimit);
-    this.write(this.exprForCall_('CC.connectionListen', args), ';');
+    // Options are native, so can't be dumped by exprFor_.
+    var options = [];
+    if (server.protocol !== 'tcp') {
+      options.push('protocol: ' + code.quote(server.protocol));
+    }
+    if (server.origins) {
+      options.push('origins: [' + server.origins.map(code.quote).join(', ') +
+                   ']');
+    }
+    if (server.compress) options.push('compress: true');
+    if (server.tls) options.push('tls: true');
+    if (server.timeLimit || options.length) args.push(server.timeLimit);
+    var call = this.exprForCall_('CC.connectionListen', args);
+    if (options.length) {
+      call = call.slice(0, -1) + ', {' + options.join(', ') + '})';
+    }
+    this.write(call, ';');
   }
 };
 
@@ -316,6 +331,8 @@ Dumper.prototype.exprFor_ = function(value, ref, callable, funcName) {
     expr = this.exprForError_(value, objDumper);
   } else if (value instanceof intrp2.WeakMap) {
     expr = this.exprForWeakMap_(value, objDumper);
+  } else if (value instanceof intrp2.Buffer) {
+    expr = this.exprForBuffer_(value, objDumper);
   } else {
     expr = this.exprForObject_(value, objDumper);
   }
@@ -412,6 +429,26 @@ Dumper.prototype.exprForDate_ = function(date, dateDumper) {
   return 'new ' + this.exprForCall_('Date', [date.date.toISOString()]);
 };
 
+/**
+ * Get a source text representation of a given Buffer object.  The
+ * return value will usually be a string of the form
+ * "Buffer.from('AQID', 'base64')" (but the new hack will be invoked if
+ * Buffer.from has not yet been initialised).
+ * @private
+ * @param {!Interpreter.prototype.Buffer} buffer Buffer to be recreated.
+ * @param {!ObjectDumper} bufferDumper ObjectDumper for buffer.
+ * @return {string} An eval-able representation of buffer.
+ */
+Dumper.prototype.exprForBuffer_ = function(buffer, bufferDumper) {
+  bufferDumper.proto = this.intrp2.BUFFER;
+  // .length is implicitly pre-set.
+  bufferDumper.attributes['length'] =
+      {writable: false, enumerable: false, configurable: false};
+  bufferDumper.setDone('length', Do.RECURSE);
+  return this.exprForCall_('Buffer.from',
+                           [buffer.data.toString('base64'), 'base64']);
+};
+
 /**
  * Get a source text representation of a given Error object.  The
  * return value will usually be a string of the form "new
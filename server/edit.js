@@ -0,0 +1,265 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Remote editing (the CC.edit* builtins): sending a
+ * buffer of text (such as the source of a function, or the
+ * description of an object) to a user to edit, and receiving the
+ * result.
+ *
+ * A client that has agreed to the 'editor' feature of the client
+ * protocol is sent an edit request, as one line of JSON:
+ *
+ *     {"type":"edit","id":"3","title":"$.thing.get","syntax":"javascript",
+ *      "text":"function get(cmd) {\n..."}
+ *
+ * It opens the text in an editor of its own and, when the user is
+ * done, replies (in-band, as one line of input) with either
+ *
+ *     {"type":"edit-save","id":"3","text":"function get(cmd) {\n..."}
+ *     {"type":"edit-cancel","id":"3"}
+ *
+ * Any other client (e.g., plain telnet) instead edits the text a line
+ * at a time, with the commands in Edit.HELP.
+ */
+'use strict';
+
+var Edit = {};
+
+/**
+ * Maximum length (in UTF-16 code units) of text to edit.
+ * @const {number}
+ */
+Edit.MAX_LENGTH = 1024 * 1024;
+
+/**
+ * Estimated speed (code units processed per ms), for computing the
+ * cost of operations.
+ * @const {number}
+ */
+Edit.SPEED = 1024;
+
+/**
+ * Syntaxes a client editor may be asked to highlight.
+ * @const {!Array<string>}
+ */
+Edit.SYNTAXES = ['text', 'javascript', 'html', 'css', 'json'];
+
+/**
+ * Compute the cost (in ms) of processing some text.
+ * @param {string} text The text.
+ * @return {number} The cost.
+ */
+Edit.cost = function(text) {
+  return text.length / Edit.SPEED;
+};
+
+/**
+ * Encode a request to a client editor to edit some text.
+ * @param {string} id Identifies the request (and its reply).
+ * @param {string} title What is being edited, for the user.
+ * @param {string} text The text to edit.
+ * @param {string=} syntax How to highlight the text (one of
+ *     Edit.SYNTAXES; default 'text').
+ * @return {string} The request, as one line of JSON (without a
+ *     terminating newline).
+ */
+Edit.request = function(id, title, text, syntax) {
+  if (text.length > Edit.MAX_LENGTH) {
+    throw new RangeError('text too long to edit');
+  }
+  syntax = (syntax === undefined) ? 'text' : syntax;
+  if (!Edit.SYNTAXES.includes(syntax)) {
+    throw new RangeError('unknown syntax ' + syntax);
+  }
+  return JSON.stringify(
+      {type: 'edit', id: id, title: title, syntax: syntax, text: text});
+};
+
+/**
+ * A reply from a client editor: the text as edited, or null if the
+ * user abandoned editing it.
+ * @typedef {{id: string, text: ?string}}
+ */
+Edit.Reply;
+
+/**
+ * Decode a line of input which may be a reply from a client editor.
+ * @param {string} line The line.
+ * @return {?Edit.Reply} The reply, or null if line is not one.
+ */
+Edit.reply = function(line) {
+  line = line.trim();
+  if (line[0] !== '{' || line.length > Edit.MAX_LENGTH * 2) return null;
+  try {
+    var data = JSON.parse(line);
+  } catch (e) {
+    return null;
+  }
+  if (!data || typeof data.id !== 'string') return null;
+  if (data.type === 'edit-save' && typeof data.text === 'string' &&
+      data.text.length <= Edit.MAX_LENGTH) {
+    return {id: data.id, text: data.text};
+  } else if (data.type === 'edit-cancel') {
+    return {id: data.id, text: null};
+  }
+  return null;
+};
+
+/**
+ * Help for the line editor.
+ * @const {string}
+ */
+Edit.HELP = [
+  'Type lines of text to insert them.  Commands:',
+  '  .l [m[-n]]    List lines (default: all).',
+  '  .i n          Insert lines before line n.',
+  '  .a            Insert lines at the end.',
+  '  .r n text     Replace line n with text.',
+  '  .d m[-n]      Delete lines.',
+  '  ..text        Insert a line beginning with ".text".',
+  '  . or .s       Save and stop editing.',
+  '  .q            Stop editing without saving.',
+  '  .h            Show this help.',
+].join('\n');
+
+/**
+ * The state of the line editor: the lines of text being edited, and
+ * the (0-based) index at which lines typed are to be inserted.
+ * @typedef {{lines: !Array<string>, point: number}}
+ */
+Edit.LineState;
+
+/**
+ * The result of a line editor command: the new state, any output for
+ * the user, and whether editing is done ('save' or 'quit') or not
+ * (null).
+ * @typedef {{lines: !Array<string>, point: number, output: string,
+ *            done: ?string}}
+ */
+Edit.LineResult;
+
+/**
+ * Parse a range of (1-based) line numbers, "m" or "m-n".
+ * @private
+ * @param {string} str The range.
+ * @param {number} count The number of lines.
+ * @return {?Array<number>} The 0-based start (inclusive) and end
+ *     (exclusive) of the range, or null if str is not a valid range.
+ */
+Edit.range_ = function(str, count) {
+  var m = /^(\d+)(?:\s*-\s*(\d+))?$/.exec(str.trim());
+  if (!m) return null;
+  var start = Number(m[1]);
+  var end = (m[2] === undefined) ? start : Number(m[2]);
+  if (start < 1 || end < start || end > count) return null;
+  return [start - 1, end];
+};
+
+/**
+ * Number lines for listing, marking the insertion point.
+ * @private
+ * @param {!Array<string>} lines The lines.
+ * @param {number} start The index of the first line to list.
+ * @param {number} end The index after the last line to list.
+ * @param {number} point The insertion point.
+ * @return {string} The listing.
+ */
+Edit.list_ = function(lines, start, end, point) {
+  var digits = String(lines.length).length;
+  var listing = [];
+  for (var i = start; i < end; i++) {
+    if (i === point) listing.push('^'.padStart(digits) + ':');
+    listing.push(String(i + 1).padStart(digits) + ': ' + lines[i]);
+  }
+  if (end === lines.length && point === lines.length) {
+    listing.push('^'.padStart(digits) + ':');
+  }
+  return listing.join('\n');
+};
+
+/**
+ * Apply one line of input to the line editor.
+ * @param {!Edit.LineState} state The editor's state (not modified).
+ * @param {string} input The line of input: a command (see Edit.HELP)
+ *     or a line of text.
+ * @return {!Edit.LineResult} The result.
+ */
+Edit.line = function(state, input) {
+  var lines = state.lines.slice();
+  var point = Math.max(0, Math.min(Math.floor(state.point) || 0,
+                                   lines.length));
+  var result = function(output, done) {
+    return {lines: lines, point: point, output: output, done: done || null};
+  };
+  input = input.replace(/\r$/, '');
+  if (input[0] !== '.' || input[1] === '.') {
+    if (input[0] === '.') input = input.slice(1);
+    lines.splice(point++, 0, input);
+    return result('');
+  }
+  var m = /^\.(\S?)(?:\s+(.*))?$/.exec(input);
+  var command = m ? m[1].toLowerCase() : null;
+  var arg = (m && m[2]) || '';
+  switch (command) {
+    case '':
+    case 's':
+      return result('Saved.', 'save');
+    case 'q':
+      return result('Not saved.', 'quit');
+    case 'h':
+    case '?':
+      return result(Edit.HELP);
+    case 'a':
+      point = lines.length;
+      return result('Inserting at the end.');
+    case 'l':
+      var range = arg ? Edit.range_(arg, lines.length) : [0, lines.length];
+      if (!range) break;
+      return result(Edit.list_(lines, range[0], range[1], point));
+    case 'i':
+      var n = /^\d+$/.test(arg) ? Number(arg) : NaN;
+      if (!(n >= 1 && n <= lines.length + 1)) break;
+      point = n - 1;
+      return result('Inserting before line ' + n + '.');
+    case 'r':
+      m = /^(\d+)(?: (.*))?$/.exec(arg);
+      n = m ? Number(m[1]) : NaN;
+      if (!(n >= 1 && n <= lines.length)) break;
+      lines[n - 1] = m[2] || '';
+      return result(Edit.list_(lines, n - 1, n, -1));
+    case 'd':
+      range = Edit.range_(arg, lines.length);
+      if (!range) break;
+      lines.splice(range[0], range[1] - range[0]);
+      if (point > range[1]) {
+        point -= range[1] - range[0];
+      } else if (point > range[0]) {
+        point = range[0];
+      }
+      var deleted = range[1] - range[0];
+      return result('Deleted ' + deleted +
+                    (deleted === 1 ? ' line.' : ' lines.'));
+    default:
+      return result('Unknown command ' + JSON.stringify(input) +
+                    '.  Type .h for help.');
+  }
+  return result('Invalid line number(s) in ' + JSON.stringify(input) +
+                '.  Type .h for help.');
+};
+
+module.exports = Edit;
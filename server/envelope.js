@@ -0,0 +1,727 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Compression and encryption of checkpoint files.
+ *
+ * A checkpoint file's contents (JSON text or a binary flatpack) may
+ * be wrapped in zero or more layers: compression (gzip or zstd) and
+ * then, optionally, encryption (AES-256-GCM).  Each layer begins with
+ * a recognisable header, so Envelope.unwrap can peel them off without
+ * being told which were applied.
+ *
+ * gzip and zstd use their standard formats (and so can also be
+ * decompressed with the usual command-line tools).  The encryption
+ * layer is:
+ *
+ *     magic:       4 bytes: 0x00 'C' 'C' 'E'
+ *     version:     1 byte (currently 1)
+ *     key ID:      8 bytes: first 8 bytes of SHA-256 of key
+ *     IV:          12 bytes
+ *     ciphertext:  variable
+ *     auth tag:    16 bytes
+ *
+ * The header (magic through IV) is authenticated as additional data.
+ *
+ * Envelope.Writer and Envelope.createReadStream process files
+ * incrementally, so that neither the plaintext nor the compressed
+ * data need be held in memory all at once.  The writer compresses
+ * data in independent chunks, producing a multi-member gzip file or
+ * multi-frame zstd file (both standard, and both decompressed as a
+ * single stream).
+ *
+ * Since the chunks are independent, a writer can instead hand them to
+ * a pool of worker threads to be compressed in parallel, while the
+ * main thread carries on producing data.  Only compression is done in
+ * parallel: producing the data (e.g., serializing the heap) has to be
+ * done on the main thread, since the interpreter's objects cannot be
+ * shared with other threads.  The compressed chunks are merged back
+ * in order, and encrypted, on the main thread, so the file is the
+ * same as one compressed serially.
+ */
+'use strict';
+
+var crypto = require('crypto');
+var fs = require('fs');
+var stream = require('stream');
+var workerThreads = require('worker_threads');
+var zlib = require('zlib');
+
+var Envelope = {};
+
+/** @private @const {!Buffer} */
+Envelope.ENCRYPTED_MAGIC_ = Buffer.from([0x00, 0x43, 0x43, 0x45]);  // '\0CCE'
+
+/** @private @const {number} */
+Envelope.ENCRYPTED_VERSION_ = 1;
+
+/** @private @const {!Buffer} */
+Envelope.GZIP_MAGIC_ = Buffer.from([0x1f, 0x8b]);
+
+/** @private @const {!Buffer} */
+Envelope.ZSTD_MAGIC_ = Buffer.from([0x28, 0xb5, 0x2f, 0xfd]);
+
+/** @private @const {number} */
+Envelope.KEY_ID_LENGTH_ = 8;
+
+/** @private @const {number} */
+Envelope.IV_LENGTH_ = 12;
+
+/** @private @const {number} */
+Envelope.TAG_LENGTH_ = 16;
+
+/** @private @const {number} */
+Envelope.HEADER_LENGTH_ = Envelope.ENCRYPTED_MAGIC_.length + 1 +
+    Envelope.KEY_ID_LENGTH_ + Envelope.IV_LENGTH_;
+
+/**
+ * Amount of data Envelope.Writer accumulates before compressing,
+ * encrypting and writing it.
+ * @private @const {number}
+ */
+Envelope.CHUNK_SIZE_ = 1024 * 1024;
+
+/**
+ * Time (in ms) to wait for a worker thread to compress a chunk before
+ * giving up on it.
+ * @private @const {number}
+ */
+Envelope.WORKER_TIMEOUT_ = 60 * 1000;
+
+/**
+ * Options for Envelope.Writer and Envelope.wrap.
+ *
+ * - compression: 'gzip', 'zstd' or 'none'.  (Default: 'none'.)
+ * - key: encryption key, if any.
+ * - threads: number of worker threads with which to compress chunks
+ *   in parallel, or 0 to compress them on the calling thread.  Ignored
+ *   by Envelope.wrap, which always does the latter.  (Default: 0.)
+ * @typedef {{compression: (string|undefined),
+ *            key: (?Buffer|undefined),
+ *            threads: (number|undefined)}}
+ */
+Envelope.Options;
+
+/**
+ * Is zstd compression available in this version of Node.js?
+ * @return {boolean}
+ */
+Envelope.zstdAvailable = function() {
+  return typeof zlib.zstdCompressSync === 'function';
+};
+
+/**
+ * Check that a compression method name is valid and supported.
+ * @param {string|undefined} compression 'gzip', 'zstd', 'none' or undefined.
+ * @return {?string} Error message, or null if compression is OK.
+ */
+Envelope.checkCompression = function(compression) {
+  if (compression === undefined || compression === 'none' ||
+      compression === 'gzip') {
+    return null;
+  } else if (compression === 'zstd') {
+    return Envelope.zstdAvailable() ? null :
+        'zstd compression requires a newer version of Node.js';
+  }
+  return 'Unknown compression method: ' + compression;
+};
+
+/**
+ * Check that a key is suitable for use with Envelope.wrap/unwrap.
+ * @param {!Buffer} key The key.
+ * @return {?string} Error message, or null if key is OK.
+ */
+Envelope.checkKey = function(key) {
+  return key.length === 32 ? null :
+      'Encryption key must be 32 bytes (got ' + key.length + ')';
+};
+
+/**
+ * Compress and/or encrypt the contents of a checkpoint file.
+ * @param {string|!Buffer} data The contents to wrap.
+ * @param {!Envelope.Options} options Which layers to apply.
+ * @return {!Buffer} The wrapped data.
+ */
+Envelope.wrap = function(data, options) {
+  var chunks = [];
+  var writer = new Envelope.Writer(function(chunk) {
+    chunks.push(Buffer.from(chunk));
+  }, Object.assign({}, options, {threads: 0}));
+  writer.write(data);
+  writer.end();
+  return Buffer.concat(chunks);
+};
+
+/**
+ * A writer that compresses and/or encrypts data as it is written,
+ * passing the result to a sink function in chunks.
+ *
+ * Without worker threads, everything is done on the calling thread,
+ * and all of the output has been passed to the sink by the time .end
+ * returns.  With them, writing never waits for a chunk to be
+ * compressed: compressed chunks are passed to the sink, in order, from
+ * the event loop as they become ready (so those not yet compressed are
+ * held in memory meanwhile), and the promise returned by .end resolves
+ * once the last has been.
+ * @constructor
+ * @struct
+ * @param {function(!Buffer)} sink Function to receive output.  The
+ *     buffer passed may be reused once the sink returns.
+ * @param {!Envelope.Options} options Which layers to apply.
+ */
+Envelope.Writer = function(sink, options) {
+  var message = Envelope.checkCompression(options.compression);
+  if (message) throw new RangeError(message);
+  /** @private @const {function(!Buffer)} */
+  this.sink_ = sink;
+  /** @private @const {string|undefined} */
+  this.compression_ = options.compression;
+  /** @private {?Cipher} */
+  this.cipher_ = null;
+  /** @private {!Array<!Buffer>} Data not yet processed. */
+  this.buffered_ = [];
+  /** @private {number} Total length of buffered data. */
+  this.bufferedLength_ = 0;
+  /** @private {?Envelope.Pool_} Pool compressing chunks, if any. */
+  this.pool_ = (options.threads > 0 && this.compression_ &&
+                this.compression_ !== 'none') ?
+      Envelope.Pool_.acquire(options.threads) : null;
+  /**
+   * Chunks being compressed by the pool, in order, each with its
+   * compressed data once that is ready.
+   * @private {!Array<{data: ?Buffer}>}
+   */
+  this.pending_ = [];
+  /** @private {?Error} Error compressing or outputting a chunk, if any. */
+  this.error_ = null;
+  /** @private {?function()} Called once no chunks are pending. */
+  this.onDrained_ = null;
+  if (options.key) {
+    message = Envelope.checkKey(options.key);
+    if (message) throw new RangeError(message);
+    var iv = crypto.randomBytes(Envelope.IV_LENGTH_);
+    var header = Buffer.concat([Envelope.ENCRYPTED_MAGIC_,
+        Buffer.from([Envelope.ENCRYPTED_VERSION_]),
+        Envelope.keyId_(options.key), iv]);
+    this.cipher_ = crypto.createCipheriv('aes-256-gcm', options.key, iv,
+        {authTagLength: Envelope.TAG_LENGTH_});
+    this.cipher_.setAAD(header);
+    sink(header);
+  }
+};
+
+/**
+ * Write data.
+ * @param {string|!Buffer} data Data to write.  If a buffer, it must
+ *     not be modified until the writer is flushed or ended.
+ */
+Envelope.Writer.prototype.write = function(data) {
+  var buf = Buffer.isBuffer(data) ? data : Buffer.from(data, 'utf8');
+  this.buffered_.push(buf);
+  this.bufferedLength_ += buf.length;
+  if (this.bufferedLength_ >= Envelope.CHUNK_SIZE_) {
+    this.flush_();
+  }
+};
+
+/**
+ * Finish writing.
+ * @return {!Promise<void>} Resolves once all of the output has been
+ *     passed to the sink (which, without worker threads, it already
+ *     has), or rejects if a chunk could not be compressed or output.
+ */
+Envelope.Writer.prototype.end = function() {
+  this.flush_();
+  if (!this.pool_) {
+    this.finish_();
+    return Promise.resolve();
+  }
+  var writer = this;
+  return new Promise(function(resolve, reject) {
+    writer.onDrained_ = function() {
+      writer.onDrained_ = null;
+      try {
+        writer.finish_();
+      } catch (e) {
+        reject(e);
+        return;
+      }
+      resolve();
+    };
+    writer.drain_();
+  });
+};
+
+/**
+ * Abandon writing: pass nothing more to the sink, discarding any
+ * chunks still being compressed.
+ */
+Envelope.Writer.prototype.abort = function() {
+  this.buffered_ = [];
+  this.bufferedLength_ = 0;
+  this.pending_ = [];
+  this.cipher_ = null;
+  this.error_ = this.error_ || new Error('Writing abandoned');
+  if (this.onDrained_) this.onDrained_();
+  if (this.pool_) {
+    this.pool_.release();
+    this.pool_ = null;
+  }
+};
+
+/**
+ * Process and output all buffered data.
+ * @private
+ */
+Envelope.Writer.prototype.flush_ = function() {
+  if (!this.bufferedLength_) return;
+  var buf = this.buffered_.length === 1 ?
+      this.buffered_[0] : Buffer.concat(this.buffered_);
+  this.buffered_ = [];
+  this.bufferedLength_ = 0;
+  if (this.pool_) {
+    var entry = {data: null};
+    this.pending_.push(entry);
+    var writer = this;
+    this.pool_.compress(buf, this.compression_).then(function(data) {
+      entry.data = data;
+    }, function(e) {
+      writer.error_ = writer.error_ || e;
+    }).then(function() {
+      // Unless abandoned meanwhile.
+      if (writer.pending_.includes(entry)) writer.drain_();
+    });
+    return;
+  }
+  if (this.compression_ === 'gzip') {
+    buf = zlib.gzipSync(buf);
+  } else if (this.compression_ === 'zstd') {
+    buf = zlib.zstdCompressSync(buf);
+  }
+  this.output_(buf);
+};
+
+/**
+ * Output those chunks compressed by the pool that are next in order,
+ * then, if no more are pending (or one has failed), call .onDrained_.
+ * @private
+ */
+Envelope.Writer.prototype.drain_ = function() {
+  try {
+    while (!this.error_ && this.pending_.length && this.pending_[0].data) {
+      this.output_(/** @type {!Buffer} */(this.pending_.shift().data));
+    }
+  } catch (e) {
+    this.error_ = e;
+  }
+  if ((this.error_ || !this.pending_.length) && this.onDrained_) {
+    this.onDrained_();
+  }
+};
+
+/**
+ * Complete the output, once every chunk has been: release the pool (if
+ * any), and output the end of the encryption layer (if any).
+ * @private
+ * @throws {!Error} If a chunk could not be compressed or output.
+ */
+Envelope.Writer.prototype.finish_ = function() {
+  if (this.pool_) {
+    this.pool_.release();
+    this.pool_ = null;
+  }
+  if (this.error_) throw this.error_;
+  if (this.cipher_) {
+    this.sink_(this.cipher_.final());
+    this.sink_(this.cipher_.getAuthTag());
+    this.cipher_ = null;
+  }
+};
+
+/**
+ * Encrypt (if need be) and output a compressed chunk.
+ * @private
+ * @param {!Buffer} buf The chunk.
+ */
+Envelope.Writer.prototype.output_ = function(buf) {
+  if (this.cipher_) {
+    buf = this.cipher_.update(buf);
+  }
+  this.sink_(buf);
+};
+
+/**
+ * Source of the worker threads of an Envelope.Pool_.  Each compresses
+ * the chunks posted to it in turn, posting back each result.
+ * @private @const {string}
+ */
+Envelope.WORKER_SOURCE_ = `
+  const {workerData} = require('worker_threads');
+  const zlib = require('zlib');
+  const {port} = workerData;
+  port.on('message', function(message) {
+    const data = Buffer.from(message.data.buffer, message.data.byteOffset,
+                             message.data.byteLength);
+    let result;
+    try {
+      result = {id: message.id, data: message.compression === 'gzip' ?
+          zlib.gzipSync(data) : zlib.zstdCompressSync(data)};
+    } catch (e) {
+      result = {id: message.id, error: String(e)};
+    }
+    port.postMessage(result);
+  });
+`;
+
+/**
+ * A pool of worker threads which compress chunks for Envelope.Writers.
+ * Use Envelope.Pool_.acquire rather than constructing one.
+ * @private
+ * @constructor
+ * @struct
+ * @param {number} size Number of threads.
+ */
+Envelope.Pool_ = function(size) {
+  /** @const {number} */
+  this.size = size;
+  /**
+   * @private @const {!Array<{port: !workerThreads.MessagePort,
+   *                           worker: !workerThreads.Worker}>}
+   */
+  this.threads_ = [];
+  /** @private {number} ID of the next chunk. */
+  this.nextId_ = 0;
+  /** @private {number} Number of writers using the pool. */
+  this.users_ = 0;
+  /** @private {boolean} Has a thread failed? */
+  this.failed_ = false;
+  /**
+   * Callbacks for the chunks being compressed, by chunk ID.
+   * @private @const {!Map<number, {resolve: function(!Buffer),
+   *                                reject: function(!Error),
+   *                                timer: *}>}
+   */
+  this.waiting_ = new Map();
+  var pool = this;
+  var onError = function(error) {
+    pool.failed_ = true;
+    pool.rejectAll_(error);
+  };
+  for (var i = 0; i < size; i++) {
+    var channel = new workerThreads.MessageChannel();
+    var worker = new workerThreads.Worker(Envelope.WORKER_SOURCE_, {
+      eval: true,
+      workerData: {port: channel.port2},
+      transferList: [channel.port2],
+    });
+    worker.on('error', onError);
+    channel.port1.on('message', this.onMessage_.bind(this));
+    // Idle threads should not keep the process alive.  (While a chunk
+    // is being compressed, its timeout does.)
+    worker.unref();
+    channel.port1.unref();
+    this.threads_.push({port: channel.port1, worker: worker});
+  }
+};
+
+/**
+ * The pool new writers use, if any.
+ * @private {?Envelope.Pool_}
+ */
+Envelope.Pool_.current_ = null;
+
+/**
+ * Get a pool of the given size for a writer to use (until it calls
+ * .release), replacing the current pool if it is of a different size
+ * or a thread of it has failed.  The threads of a pool replaced are
+ * only terminated once no writer is using it.
+ * @param {number} size Number of threads.
+ * @return {!Envelope.Pool_}
+ */
+Envelope.Pool_.acquire = function(size) {
+  var pool = Envelope.Pool_.current_;
+  if (!pool || pool.size !== size || pool.failed_) {
+    var old = pool;
+    pool = Envelope.Pool_.current_ = new Envelope.Pool_(size);
+    if (old && !old.users_) old.terminate_();
+  }
+  pool.users_++;
+  return pool;
+};
+
+/**
+ * Note that a writer has finished using the pool, terminating its
+ * threads if it has been replaced and no writer is now using it.
+ */
+Envelope.Pool_.prototype.release = function() {
+  this.users_--;
+  if (!this.users_ && this !== Envelope.Pool_.current_) this.terminate_();
+};
+
+/**
+ * Compress a chunk.
+ * @param {!Buffer} buf The chunk.  (It is copied.)
+ * @param {string} compression 'gzip' or 'zstd'.
+ * @return {!Promise<!Buffer>} The compressed chunk.
+ */
+Envelope.Pool_.prototype.compress = function(buf, compression) {
+  var id = this.nextId_++;
+  var pool = this;
+  return new Promise(function(resolve, reject) {
+    var timer = setTimeout(function() {
+      pool.waiting_.delete(id);
+      reject(new Error('Compression thread not responding'));
+    }, Envelope.WORKER_TIMEOUT_);
+    pool.waiting_.set(id, {resolve: resolve, reject: reject, timer: timer});
+    pool.threads_[id % pool.size].port.postMessage(
+        {id: id, data: buf, compression: compression});
+  });
+};
+
+/**
+ * Handle a result posted by a thread.
+ * @private
+ * @param {!Object} message The result.
+ */
+Envelope.Pool_.prototype.onMessage_ = function(message) {
+  var waiting = this.waiting_.get(message.id);
+  if (!waiting) return;  // Timed out.
+  this.waiting_.delete(message.id);
+  clearTimeout(waiting.timer);
+  if (message.error) {
+    waiting.reject(new Error(message.error));
+    return;
+  }
+  var data = message.data;
+  waiting.resolve(Buffer.from(data.buffer, data.byteOffset, data.byteLength));
+};
+
+/**
+ * Fail every chunk being compressed.
+ * @private
+ * @param {!Error} error The reason.
+ */
+Envelope.Pool_.prototype.rejectAll_ = function(error) {
+  this.waiting_.forEach(function(waiting) {
+    clearTimeout(waiting.timer);
+    waiting.reject(error);
+  });
+  this.waiting_.clear();
+};
+
+/**
+ * Terminate the pool's threads.
+ * @private
+ */
+Envelope.Pool_.prototype.terminate_ = function() {
+  this.rejectAll_(new Error('Compression thread terminated'));
+  this.threads_.forEach(function(thread) {
+    thread.port.close();
+    thread.worker.terminate();
+  });
+};
+
+/**
+ * Remove all compression and encryption layers from the contents of
+ * a checkpoint file.  Data that has no recognised layers is returned
+ * unchanged.
+ * @param {!Buffer} data The contents of the file.
+ * @param {?Buffer=} key Decryption key, if any.
+ * @return {!Buffer} The unwrapped data.
+ */
+Envelope.unwrap = function(data, key) {
+  for (;;) {
+    if (Envelope.startsWith_(data, Envelope.ENCRYPTED_MAGIC_)) {
+      if (!key) {
+        throw new Error('File is encrypted but no key was supplied');
+      }
+      data = Envelope.decrypt_(data, key);
+    } else if (Envelope.startsWith_(data, Envelope.GZIP_MAGIC_)) {
+      data = zlib.gunzipSync(data);
+    } else if (Envelope.startsWith_(data, Envelope.ZSTD_MAGIC_)) {
+      if (!Envelope.zstdAvailable()) {
+        throw new Error(
+            'File is zstd-compressed, which requires a newer version of ' +
+            'Node.js');
+      }
+      data = zlib.zstdDecompressSync(data);
+    } else {
+      return data;
+    }
+  }
+};
+
+/**
+ * Open a checkpoint file for reading, removing any compression and
+ * encryption layers as it is read.
+ *
+ * An error is thrown immediately if the file cannot be opened or is
+ * encrypted with a different key.  Corrupt or tampered-with data will
+ * instead cause an 'error' event on the stream, and in particular
+ * the authenticity of encrypted data can only be confirmed once the
+ * stream has ended without error.
+ * @param {string} filename Name of the file to read.
+ * @param {?Buffer=} key Decryption key, if any.
+ * @return {!stream.Readable} Stream of unwrapped data.
+ */
+Envelope.createReadStream = function(filename, key) {
+  var fd = fs.openSync(filename, 'r');
+  try {
+    var size = fs.fstatSync(fd).size;
+    var head = Buffer.alloc(Math.min(size, Envelope.HEADER_LENGTH_ + 16));
+    fs.readSync(fd, head, 0, head.length, 0);
+    var streams = [];
+    var start = 0;
+    var end = size;
+    if (Envelope.startsWith_(head, Envelope.ENCRYPTED_MAGIC_)) {
+      if (!key) {
+        throw new Error('File is encrypted but no key was supplied');
+      }
+      var decipher = Envelope.createDecipher_(head, key, size);
+      var tag = Buffer.alloc(Envelope.TAG_LENGTH_);
+      fs.readSync(fd, tag, 0, tag.length, size - tag.length);
+      decipher.setAuthTag(tag);
+      streams.push(decipher);
+      start = Envelope.HEADER_LENGTH_;
+      end = size - Envelope.TAG_LENGTH_;
+      // Decrypt (but don't yet authenticate) the start of the
+      // plaintext, to see if it is compressed.
+      var peek = Envelope.createDecipher_(head, key, size);
+      head = peek.update(head.subarray(start));
+    }
+    if (Envelope.startsWith_(head, Envelope.GZIP_MAGIC_)) {
+      streams.push(zlib.createGunzip());
+    } else if (Envelope.startsWith_(head, Envelope.ZSTD_MAGIC_)) {
+      if (!Envelope.zstdAvailable()) {
+        throw new Error(
+            'File is zstd-compressed, which requires a newer version of ' +
+            'Node.js');
+      }
+      streams.push(zlib.createZstdDecompress());
+    }
+  } catch (e) {
+    fs.closeSync(fd);
+    throw e;
+  }
+  var input;
+  if (end > start) {
+    input = fs.createReadStream('', {fd: fd, start: start, end: end - 1});
+  } else {
+    fs.closeSync(fd);
+    input = stream.Readable.from([]);
+  }
+  if (!streams.length) return input;
+  // Connect the streams, forwarding any error to the output.
+  var output = new stream.PassThrough();
+  var chain = [input].concat(streams, [output]);
+  var onError = function(err) {
+    for (var i = 0; i < chain.length - 1; i++) {
+      chain[i].destroy();
+    }
+    output.destroy(err);
+  };
+  for (var i = 0; i < chain.length - 1; i++) {
+    chain[i].pipe(chain[i + 1]);
+    if (chain[i] === decipher) {
+      chain[i].on('error', function() {
+        onError(new Error(
+            'Encrypted file is corrupt or has been tampered with'));
+      });
+    } else {
+      chain[i].on('error', onError);
+    }
+  }
+  return output;
+};
+
+/**
+ * Create a decipher for an encryption layer, given its header.
+ * @private
+ * @param {!Buffer} head Start of the encryption layer.
+ * @param {!Buffer} key 32-byte key.
+ * @param {number} size Total size of the encryption layer.
+ * @return {!Decipher}
+ */
+Envelope.createDecipher_ = function(head, key, size) {
+  var message = Envelope.checkKey(key);
+  if (message) throw new RangeError(message);
+  var magicLength = Envelope.ENCRYPTED_MAGIC_.length;
+  var headerLength = Envelope.HEADER_LENGTH_;
+  if (size < headerLength + Envelope.TAG_LENGTH_) {
+    throw new RangeError('Encrypted file is truncated');
+  }
+  var version = head[magicLength];
+  if (version !== Envelope.ENCRYPTED_VERSION_) {
+    throw new RangeError('Unsupported encrypted file version ' + version);
+  }
+  var keyId = head.subarray(magicLength + 1,
+                            magicLength + 1 + Envelope.KEY_ID_LENGTH_);
+  if (!keyId.equals(Envelope.keyId_(key))) {
+    throw new Error('File was encrypted with a different key');
+  }
+  var header = head.subarray(0, headerLength);
+  var iv = head.subarray(headerLength - Envelope.IV_LENGTH_, headerLength);
+  var decipher = crypto.createDecipheriv('aes-256-gcm', key, iv,
+      {authTagLength: Envelope.TAG_LENGTH_});
+  decipher.setAAD(header);
+  return decipher;
+};
+
+/**
+ * Does data begin with the given bytes?
+ * @private
+ * @param {!Buffer} data
+ * @param {!Buffer} prefix
+ * @return {boolean}
+ */
+Envelope.startsWith_ = function(data, prefix) {
+  return data.length >= prefix.length &&
+      data.compare(prefix, 0, prefix.length, 0, prefix.length) === 0;
+};
+
+/**
+ * Compute the ID recorded in the header of data encrypted with key.
+ * @private
+ * @param {!Buffer} key
+ * @return {!Buffer}
+ */
+Envelope.keyId_ = function(key) {
+  return crypto.createHash('sha256').update(key).digest()
+      .subarray(0, Envelope.KEY_ID_LENGTH_);
+};
+
+/**
+ * Decrypt an encryption layer.
+ * @private
+ * @param {!Buffer} data Encryption layer (header, ciphertext and tag).
+ * @param {!Buffer} key 32-byte key.
+ * @return {!Buffer} Plaintext.
+ */
+Envelope.decrypt_ = function(data, key) {
+  var decipher = Envelope.createDecipher_(data, key, data.length);
+  var tag = data.subarray(data.length - Envelope.TAG_LENGTH_);
+  decipher.setAuthTag(tag);
+  var ciphertext = data.subarray(Envelope.HEADER_LENGTH_,
+                                 data.length - tag.length);
+  try {
+    return Buffer.concat([decipher.update(ciphertext), decipher.final()]);
+  } catch (e) {
+    throw new Error('Encrypted file is corrupt or has been tampered with');
+  }
+};
+
+module.exports = Envelope;
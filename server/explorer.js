@@ -0,0 +1,320 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Offline exploration of a checkpoint, for post-mortem
+ * analysis: the world is loaded but never run (so no listeners are
+ * started and no code is executed), and can be queried: finding
+ * objects by property value, dumping an object and what it contains,
+ * and summarizing what is in the heap.  Run as:
+ *
+ *     node codecity inspect <checkpoint>
+ *
+ * (see CodeCity.inspect).
+ */
+'use strict';
+
+var Heap = require('./heap');
+var Inspect = require('./inspect');
+var Interpreter = require('./interpreter');
+var Package = require('./package');
+var readline = require('readline');
+
+var Explorer = {};
+
+/**
+ * Default maximum number of objects for Explorer.find to report.
+ * @const {number}
+ */
+Explorer.MAX_MATCHES = 100;
+
+/**
+ * Number of owners (and classes) listed by Explorer.formatStats.
+ * @const {number}
+ */
+Explorer.TOP = 10;
+
+/**
+ * Help text for the query interface.
+ * @const {string}
+ */
+Explorer.HELP = [
+  'find <key> <value>    Find objects with a property whose value is',
+  '                      <value>: a JSON literal (e.g. "Bob" or 42), or',
+  '                      a selector for an object.  <key> * means any.',
+  'dump <selector> [n]   Show an object, and those it contains to depth',
+  '                      n (default ' + Inspect.DEPTH + ').',
+  'stats                 Summarize what is in the heap.',
+  'help                  Show this help.',
+  'quit                  Exit.',
+].join('\n');
+
+/**
+ * Find objects with a given property value.  Only objects reachable
+ * from the roots (i.e., not garbage) are searched.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {string} key The property's key, or '*' for any property.
+ * @param {?Interpreter.Value} value The value.
+ * @param {number=} limit Maximum number of objects to find (default
+ *     Explorer.MAX_MATCHES).
+ * @return {{objects: !Array<!Interpreter.prototype.Object>,
+ *     truncated: boolean}} The objects found (in breadth-first order
+ *     from the roots), and whether there were more.
+ */
+Explorer.find = function(intrp, key, value, limit) {
+  if (limit === undefined) limit = Explorer.MAX_MATCHES;
+  var objects = [];
+  var truncated = false;
+  Heap.reachable(intrp).forEach(function(node) {
+    if (!(node instanceof intrp.Object)) return;
+    var keys = (key === '*') ? Object.getOwnPropertyNames(node.properties) :
+        [key];
+    for (var i = 0; i < keys.length; i++) {
+      if (Object.prototype.hasOwnProperty.call(node.properties, keys[i]) &&
+          Object.is(node.properties[keys[i]], value)) {
+        if (objects.length < limit) {
+          objects.push(node);
+        } else {
+          truncated = true;
+        }
+        return;
+      }
+    }
+  });
+  return {objects: objects, truncated: truncated};
+};
+
+/**
+ * Render an object, and those it contains, as text (see
+ * Inspect.inspect).  Non-enumerable properties are included.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Interpreter.prototype.Object} obj The object.
+ * @param {number=} depth How deeply to render nested objects (default
+ *     Inspect.DEPTH).
+ * @return {string} The rendering.
+ */
+Explorer.dump = function(intrp, obj, depth) {
+  return Inspect.inspect(intrp, obj, intrp.ROOT,
+                         {depth: depth, hidden: true});
+};
+
+/**
+ * Statistics about a heap.  byClass and byOwner give the number and
+ * total estimated size (in bytes) of the objects of each class and of
+ * each owner (by selector, or as root, null or '(unnamed)').
+ * @typedef {{objects: number, scopes: number, threads: number,
+ *     size: number,
+ *     threadsByStatus: !Object<string, number>,
+ *     byClass: !Object<string, {count: number, size: number}>,
+ *     byOwner: !Object<string, {count: number, size: number}>}}
+ */
+Explorer.Stats;
+
+/**
+ * Compute statistics about the heap.  Only nodes reachable from the
+ * roots (i.e., not garbage) are counted.
+ * @param {!Interpreter} intrp The interpreter.
+ * @return {!Explorer.Stats} The statistics.
+ */
+Explorer.stats = function(intrp) {
+  var names = Package.findNames(intrp);
+  var stats = {objects: 0, scopes: 0, threads: 0, size: 0,
+               threadsByStatus: {}, byClass: {}, byOwner: {}};
+  var add = function(table, name, size) {
+    var entry = table[name] || (table[name] = {count: 0, size: 0});
+    entry.count++;
+    entry.size += size;
+  };
+  var statuses = {};
+  for (var status in Interpreter.Thread.Status) {
+    statuses[Interpreter.Thread.Status[status]] = status;
+  }
+  Heap.reachable(intrp).forEach(function(node) {
+    var size = Heap.sizeOf(intrp, node);
+    stats.size += size;
+    if (node instanceof intrp.Object) {
+      stats.objects++;
+      add(stats.byClass, node.class, size);
+      add(stats.byOwner, Explorer.ownerName_(intrp, node, names), size);
+    } else if (node instanceof Interpreter.Scope) {
+      stats.scopes++;
+    } else {
+      stats.threads++;
+      var name = statuses[node.status];
+      stats.threadsByStatus[name] = (stats.threadsByStatus[name] || 0) + 1;
+    }
+  });
+  return stats;
+};
+
+/**
+ * Format statistics as text.
+ * @param {!Explorer.Stats} stats The statistics.
+ * @return {string} The text.
+ */
+Explorer.formatStats = function(stats) {
+  var lines = [
+    stats.objects + ' objects, ' + stats.scopes + ' scopes, ' +
+        stats.threads + ' threads; about ' + stats.size + ' bytes.',
+  ];
+  var statuses = Object.keys(stats.threadsByStatus).sort();
+  if (statuses.length) {
+    lines.push('Threads: ' + statuses.map(function(status) {
+      return stats.threadsByStatus[status] + ' ' + status;
+    }).join(', ') + '.');
+  }
+  var table = function(title, entries) {
+    var keys = Object.keys(entries).sort(function(a, b) {
+      return entries[b].size - entries[a].size || (a < b ? -1 : 1);
+    });
+    lines.push(title + ':');
+    keys.slice(0, Explorer.TOP).forEach(function(key) {
+      lines.push('  ' + key + ': ' + entries[key].count + ' objects, ' +
+                 entries[key].size + ' bytes');
+    });
+    if (keys.length > Explorer.TOP) {
+      lines.push('  ... ' + (keys.length - Explorer.TOP) + ' more');
+    }
+  };
+  table('Largest classes', stats.byClass);
+  table('Largest owners', stats.byOwner);
+  return lines.join('\n');
+};
+
+/**
+ * Carry out one query (a line of input to the query interface).
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {string} line The query.
+ * @return {string} The result, as text.
+ * @throws {Error} If the query is malformed or refers to an object that
+ *     does not exist.
+ */
+Explorer.query = function(intrp, line) {
+  var m = /^\s*(\S+)\s*(.*?)\s*$/.exec(line);
+  var command = m ? m[1] : '';
+  var rest = m ? m[2] : '';
+  var names;
+  var lookup = function(selector) {
+    var obj = Package.lookup(intrp, selector);
+    if (!obj) throw new ReferenceError(selector + ' does not exist');
+    return obj;
+  };
+  switch (command) {
+    case 'find':
+      m = /^(\S+)\s+(.+)$/.exec(rest);
+      if (!m) throw new SyntaxError('Usage: find <key> <value>');
+      var value;
+      try {
+        value = JSON.parse(m[2]);
+        if (value !== null && typeof value === 'object') {
+          throw new SyntaxError('Objects must be given by selector');
+        }
+      } catch (e) {
+        if (!(e instanceof SyntaxError) || /^[{[]/.test(m[2])) throw e;
+        value = lookup(m[2]);
+      }
+      var result = Explorer.find(intrp, m[1], value);
+      if (!result.objects.length) return 'No objects found.';
+      names = Package.findNames(intrp);
+      var lines = result.objects.map(function(obj) {
+        return Explorer.describe_(intrp, obj, names);
+      });
+      if (result.truncated) lines.push('... (more not shown)');
+      return lines.join('\n');
+    case 'dump':
+      m = /^(.+?)(?:\s+(\d+))?$/.exec(rest);
+      if (!m) throw new SyntaxError('Usage: dump <selector> [depth]');
+      return Explorer.dump(intrp, lookup(m[1]),
+                           (m[2] === undefined) ? undefined : Number(m[2]));
+    case 'stats':
+      return Explorer.formatStats(Explorer.stats(intrp));
+    case 'help':
+      return Explorer.HELP;
+    default:
+      throw new SyntaxError('Unknown command ' + JSON.stringify(command) +
+                            ' (try help)');
+  }
+};
+
+/**
+ * Describe an object briefly: by its selector if it has one, otherwise
+ * by its class and owner.
+ * @private
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Interpreter.prototype.Object} obj The object.
+ * @param {!Map<!Interpreter.prototype.Object, string>} names Selectors
+ *     of named objects (see Package.findNames).
+ * @return {string} The description.
+ */
+Explorer.describe_ = function(intrp, obj, names) {
+  if (names.has(obj)) return String(names.get(obj));
+  return '(unnamed ' + obj.class + ', owner ' +
+      Explorer.ownerName_(intrp, obj, names) + ')';
+};
+
+/**
+ * Name the owner of an object: by its selector if it has one, or as
+ * root, null or (unnamed).
+ * @private
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Interpreter.prototype.Object} obj The object.
+ * @param {!Map<!Interpreter.prototype.Object, string>} names Selectors
+ *     of named objects (see Package.findNames).
+ * @return {string} The name.
+ */
+Explorer.ownerName_ = function(intrp, obj, names) {
+  var owner = /** @type {?Interpreter.prototype.Object} */(obj.owner);
+  if (owner === null) return 'null';
+  if (names.has(owner)) return String(names.get(owner));
+  return (owner === intrp.ROOT) ? 'root' : '(unnamed)';
+};
+
+/**
+ * Start the query interface.
+ * @param {!Interpreter} intrp The interpreter (not running).
+ * @param {{input: (!stream.Readable|undefined),
+ *          output: (!stream.Writable|undefined)}=} options The streams to
+ *     use (default: stdin and stdout).
+ * @return {!readline.Interface} The readline interface.
+ */
+Explorer.start = function(intrp, options) {
+  options = options || {};
+  var output = options.output || process.stdout;
+  var rl = readline.createInterface({
+    input: options.input || process.stdin,
+    output: output,
+    prompt: 'inspect> ',
+    removeHistoryDuplicates: true,
+  });
+  rl.on('line', function(line) {
+    if (/^\s*(quit|exit)\s*$/.test(line)) {
+      rl.close();
+      return;
+    } else if (line.trim()) {
+      try {
+        output.write(Explorer.query(intrp, line) + '\n');
+      } catch (e) {
+        output.write('Error: ' + e.message + '\n');
+      }
+    }
+    rl.prompt();
+  });
+  rl.prompt();
+  return rl;
+};
+
+module.exports = Explorer;
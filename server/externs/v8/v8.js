@@ -0,0 +1,33 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Fake implementation of node.js's v8 module to satisfy
+ *     Closure Compiler dependencies.
+ */
+
+/** @const */
+var v8 = {};
+
+/**
+ * @param {string} flags
+ * @return {void}
+ */
+v8.setFlagsFromString = function(flags) {};
+
+
+module.exports = v8;
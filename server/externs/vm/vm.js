@@ -0,0 +1,48 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Fake implementation of node.js's vm module to satisfy
+ *     Closure Compiler dependencies.
+ */
+
+/** @const */
+var vm = {};
+
+/**
+ * @param {!Object=} contextObject
+ * @param {!Object=} options
+ * @return {!Object}
+ */
+vm.createContext = function(contextObject, options) {};
+
+/**
+ * @constructor
+ * @param {string} code
+ * @param {!Object=} options
+ */
+vm.Script = function(code, options) {};
+
+/**
+ * @param {!Object} contextifiedObject
+ * @param {!Object=} options
+ * @return {*}
+ */
+vm.Script.prototype.runInContext = function(contextifiedObject, options) {};
+
+
+module.exports = vm;
@@ -0,0 +1,591 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Federation of Code City worlds: a server-to-server
+ * protocol by which one world (the origin) can send a player, and
+ * optionally an owner's package of everything they own (see
+ * Package.exportOwned), to another (the destination).
+ *
+ * Each world has a name, and knows each of its peers by name, URL and
+ * a secret key shared with that peer alone.  A teleport is a single
+ * request from the origin:
+ *
+ *     POST /teleport
+ *     {"info": <JSON value>, "package": <owner's package>}
+ *
+ * where info describes the player (as the origin's in-world code
+ * sees fit: name, login ID, etc.) and package is omitted if no
+ * objects are sent.  The response is
+ *
+ *     {"accepted": true, "reply": <JSON value>}
+ *  or {"accepted": false, "reason": "<explanation>"}
+ *
+ * Both are authenticated (mutually) by the shared key: the request
+ * has headers
+ *
+ *     X-CodeCity-World: <origin's name>
+ *     X-CodeCity-Time: <time sent, in ms since the epoch>
+ *     X-CodeCity-Nonce: <random hex>
+ *     X-CodeCity-Signature: <hex HMAC-SHA256 of the signed fields>
+ *
+ * where the signed fields are, joined by newlines: 'request', the
+ * method, path, origin's name, destination's name, time, nonce and
+ * the hex SHA-256 of the body.  Requests more than CLOCK_SKEW old (or
+ * in the future), or repeating a recent nonce, are refused.  The
+ * response has an X-CodeCity-Signature header similarly signing
+ * 'response', the status code, the request's nonce and the hash of the
+ * response body.
+ *
+ * Consent is sought on both sides.  On the origin, the in-world code
+ * calling CC.federationTeleport decides whether (and what) to send.
+ * On the destination, the handler object (by default $.federation)
+ * has its .onOffer method called (as root) with {world, info, objects}
+ * (the origin's name, info, and whether a package was sent): unless it
+ * returns true, the teleport is refused, with any string it returns as
+ * the reason.  Otherwise the package, if any, is imported (creating a
+ * new copy of the owner, which owns itself and the copies of what it
+ * owned), and the handler's .onArrive method called with {world, info,
+ * objects} (objects now being the array returned by
+ * Package.importOwned, or null); its return value is sent back to the
+ * origin as the reply (e.g., the URL at which the player can log in).
+ */
+'use strict';
+
+var crypto = require('crypto');
+var http = require('http');
+var https = require('https');
+var net = require('net');
+var Package = require('./package');
+var RateLimit = require('./ratelimit');
+
+var Federation = {};
+
+/**
+ * Maximum size (in bytes) of a request or response body.
+ * @const {number}
+ */
+Federation.MAX_BODY = 16 * 1024 * 1024;
+
+/**
+ * Maximum difference (in ms) between the time a request was signed
+ * and the time it is received.
+ * @const {number}
+ */
+Federation.CLOCK_SKEW = 5 * 60 * 1000;
+
+/**
+ * Time (in ms) allowed for the handler's .onOffer and .onArrive
+ * methods to return, and for a peer to respond to a teleport.
+ * @const {number}
+ */
+Federation.TIMEOUT = 30 * 1000;
+
+/**
+ * A peer world.
+ * @typedef {{url: string, key: string}}
+ */
+Federation.Peer;
+
+/**
+ * The outcome of a teleport, as reported by the destination.
+ * @typedef {{accepted: boolean, reason: (string|undefined), reply: *}}
+ */
+Federation.Result;
+
+/**
+ * Options for a Federation.Service.
+ *
+ * - name: this world's name, as known to its peers.
+ * - peers: the peer worlds, by name.
+ * - interpreter: the Interpreter whose players are teleported.
+ * - handler: selector of the in-world handler object.  (Default:
+ *   '$.federation'.)
+ * - wrapTls: function to wrap accepted connections in TLS (see
+ *   Certificates.Manager.prototype.wrap), if they are to use it.
+ * - limiter: rate limiter for requests failing authentication (using
+ *   its 'login' policy).  By default a new one, without exemptions.
+ * @typedef {{name: string,
+ *            peers: !Object<string, !Federation.Peer>,
+ *            interpreter: !Interpreter,
+ *            handler: (string|undefined),
+ *            wrapTls: (?function(!net.Socket): !net.Socket|undefined),
+ *            limiter: (!RateLimit.Limiter|undefined)}}
+ */
+Federation.Options;
+
+/**
+ * An error to be reported to the peer with a given HTTP status.
+ * @constructor
+ * @extends {Error}
+ * @param {number} status The HTTP status code.
+ * @param {string} message The error message.
+ */
+Federation.HttpError = function(status, message) {
+  this.name = 'HttpError';
+  this.message = message;
+  /** @const {number} */
+  this.status = status;
+};
+Federation.HttpError.prototype = Object.create(Error.prototype);
+Federation.HttpError.prototype.constructor = Federation.HttpError;
+
+/**
+ * Sign some fields with a key.
+ * @param {string} key The shared key.
+ * @param {!Array<string|number>} fields The fields to sign.
+ * @return {string} The signature (in hex).
+ */
+Federation.sign = function(key, fields) {
+  return crypto.createHmac('sha256', key).update(fields.join('\n'))
+      .digest('hex');
+};
+
+/**
+ * Hash a body, for signing.
+ * @param {string|!Buffer} body The body.
+ * @return {string} Its SHA-256 hash (in hex).
+ */
+Federation.hashBody = function(body) {
+  return crypto.createHash('sha256').update(body).digest('hex');
+};
+
+/**
+ * Compare a signature with the one expected, in constant time.
+ * @private
+ * @param {string|undefined} signature The signature presented.
+ * @param {string} expected The correct signature.
+ * @return {boolean}
+ */
+Federation.checkSignature_ = function(signature, expected) {
+  var a = Buffer.from(String(signature || ''), 'utf8');
+  var b = Buffer.from(expected, 'utf8');
+  return a.length === b.length && crypto.timingSafeEqual(a, b);
+};
+
+/**
+ * A federation service: accepts teleports from peers, and sends them.
+ * @constructor
+ * @struct
+ * @param {!Federation.Options} options Options.
+ */
+Federation.Service = function(options) {
+  if (!options.name || !/^[\w.-]+$/.test(options.name)) {
+    throw new TypeError('Invalid world name');
+  }
+  var peers = options.peers || {};
+  for (var name in peers) {
+    if (!/^[\w.-]+$/.test(name)) {
+      throw new TypeError('Invalid peer name ' + name);
+    } else if (!peers[name] || typeof peers[name].url !== 'string' ||
+               !/^https?:\/\//.test(peers[name].url)) {
+      throw new TypeError('Peer ' + name + ' needs an http(s) URL');
+    } else if (typeof peers[name].key !== 'string' ||
+               peers[name].key.length < 16) {
+      throw new TypeError('Peer ' + name + ' needs a key (16+ characters)');
+    }
+  }
+  /** @const {string} */
+  this.name = options.name;
+  /** @const {!Interpreter} */
+  this.intrp = options.interpreter;
+  /** @private @const {!Object<string, !Federation.Peer>} */
+  this.peers_ = peers;
+  /** @private @const {string} */
+  this.handler_ = options.handler || '$.federation';
+  /** @private @const {!RateLimit.Limiter} */
+  this.limiter_ = options.limiter || new RateLimit.Limiter({exempt: []});
+  /**
+   * Nonces of requests recently received, and when they may be
+   * forgotten.
+   * @private @const {!Map<string, number>}
+   */
+  this.nonces_ = new Map();
+  /** @private @const {!http.Server} */
+  this.server_ = http.createServer(this.handle_.bind(this));
+  /** @private @const {?net.Server} Accepts TLS connections, if used. */
+  this.tlsServer_ = null;
+  if (options.wrapTls) {
+    var wrapTls = options.wrapTls;
+    var server = this.server_;
+    this.tlsServer_ = net.createServer(function(socket) {
+      socket.on('error', function() {});
+      server.emit('connection', wrapTls(socket));
+    });
+  }
+};
+
+/**
+ * Names of the peer worlds.
+ * @return {!Array<string>}
+ */
+Federation.Service.prototype.peers = function() {
+  return Object.keys(this.peers_);
+};
+
+/**
+ * Start listening for requests from peers.
+ * @param {number} port The port to listen on.
+ * @param {string=} host The address to listen on (default: all).
+ * @return {!Promise<number>} Resolves to the port listened on.
+ */
+Federation.Service.prototype.listen = function(port, host) {
+  var server = this.tlsServer_ || this.server_;
+  return new Promise(function(resolve, reject) {
+    server.once('error', reject);
+    server.listen(port, host, function() {
+      server.removeListener('error', reject);
+      resolve(server.address().port);
+    });
+  });
+};
+
+/**
+ * Stop listening for requests.
+ * @return {!Promise<void>} Resolves once all connections have closed.
+ */
+Federation.Service.prototype.close = function() {
+  var servers = [this.server_];
+  if (this.tlsServer_) servers.push(this.tlsServer_);
+  return Promise.all(servers.map(function(server) {
+    return new Promise(function(resolve) {
+      if (!server.listening) {
+        resolve();
+        return;
+      }
+      server.close(function() {resolve();});
+    });
+  })).then(function() {});
+};
+
+/**
+ * Teleport a player to a peer.
+ * @param {string} peer Name of the destination.
+ * @param {?Interpreter.prototype.Object} owner Owner whose objects are to
+ *     be sent (as an owner's package), or null to send none.
+ * @param {*} info JSON-compatible description of the player.
+ * @return {!Promise<!Federation.Result>} The destination's decision.
+ */
+Federation.Service.prototype.teleport = function(peer, owner, info) {
+  var body = {'info': info};
+  try {
+    if (!Object.prototype.hasOwnProperty.call(this.peers_, peer)) {
+      throw new RangeError('Unknown peer world ' + peer);
+    }
+    if (owner) body['package'] = Package.exportOwned(this.intrp, owner);
+  } catch (e) {
+    return Promise.reject(e);
+  }
+  this.intrp.log('net', 'Teleporting to %s', peer);
+  return this.send_(peer, '/teleport', body).then(function(result) {
+    if (!result || typeof result !== 'object' ||
+        typeof result['accepted'] !== 'boolean') {
+      throw new Error('Invalid response from ' + peer);
+    }
+    return {
+      accepted: result['accepted'],
+      reason: (typeof result['reason'] === 'string') ?
+          result['reason'] : undefined,
+      reply: result['reply'],
+    };
+  });
+};
+
+/**
+ * Send a signed request to a peer, and check its signed response.
+ * @private
+ * @param {string} peer Name of the peer.
+ * @param {string} path The path to POST to.
+ * @param {*} body JSON-compatible request body.
+ * @return {!Promise<*>} The (parsed) response body.
+ */
+Federation.Service.prototype.send_ = function(peer, path, body) {
+  var config = this.peers_[peer];
+  var url = new URL(path, config.url);
+  var data = JSON.stringify(body);
+  var time = Date.now();
+  var nonce = crypto.randomBytes(16).toString('hex');
+  var headers = {
+    'Content-Type': 'application/json; charset=utf-8',
+    'Content-Length': String(Buffer.byteLength(data)),
+    'X-CodeCity-World': this.name,
+    'X-CodeCity-Time': String(time),
+    'X-CodeCity-Nonce': nonce,
+    'X-CodeCity-Signature': Federation.sign(config.key, ['request', 'POST',
+        url.pathname, this.name, peer, time, nonce,
+        Federation.hashBody(data)]),
+  };
+  var transport = (url.protocol === 'https:') ? https : http;
+  return new Promise(function(resolve, reject) {
+    var req = transport.request(url, {method: 'POST', headers: headers},
+        function(res) {
+          var chunks = [];
+          var length = 0;
+          res.on('data', function(chunk) {
+            length += chunk.length;
+            if (length > Federation.MAX_BODY) {
+              req.destroy(new Error('Response from ' + peer + ' too large'));
+              return;
+            }
+            chunks.push(chunk);
+          });
+          res.on('end', function() {
+            var text = Buffer.concat(chunks);
+            var expected = Federation.sign(config.key, ['response',
+                res.statusCode, nonce, Federation.hashBody(text)]);
+            if (!Federation.checkSignature_(
+                res.headers['x-codecity-signature'], expected)) {
+              reject(new Error('Response from ' + peer + ' not authentic'));
+              return;
+            }
+            var result;
+            try {
+              result = JSON.parse(text.toString('utf8'));
+            } catch (e) {
+              reject(new Error('Invalid response from ' + peer));
+              return;
+            }
+            if (res.statusCode !== 200) {
+              reject(new Error(peer + ': ' + res.statusCode + ' ' +
+                               (result && result['error'])));
+              return;
+            }
+            resolve(result);
+          });
+        });
+    req.setTimeout(Federation.TIMEOUT, function() {
+      req.destroy(new Error('No response from ' + peer));
+    });
+    req.on('error', reject);
+    req.end(data);
+  });
+};
+
+/**
+ * Handle an HTTP request from a peer: authenticate it, read its body
+ * and dispatch it, then send the (signed) result.
+ * @private
+ * @param {!http.IncomingMessage} req The request.
+ * @param {!http.ServerResponse} res The response.
+ */
+Federation.Service.prototype.handle_ = function(req, res) {
+  var service = this;
+  var address = req.socket.remoteAddress;
+  var peer = String(req.headers['x-codecity-world'] || '');
+  var nonce = String(req.headers['x-codecity-nonce'] || '');
+  var config = Object.prototype.hasOwnProperty.call(this.peers_, peer) ?
+      this.peers_[peer] : null;
+  var reply = function(status, body) {
+    service.intrp.log('net', 'Federation %s %s from %s (%s): %d',
+                      req.method, req.url, peer || '?', address, status);
+    var data = JSON.stringify(body) + '\n';
+    var headers = {
+      'Content-Type': 'application/json; charset=utf-8',
+      'Content-Length': String(Buffer.byteLength(data)),
+      'Cache-Control': 'no-store',
+    };
+    // Only a known peer can check a signature.
+    if (config) {
+      headers['X-CodeCity-Signature'] = Federation.sign(config.key,
+          ['response', status, nonce, Federation.hashBody(data)]);
+    }
+    res.writeHead(status, headers);
+    res.end(data);
+  };
+  var fail = function(e) {
+    if (e instanceof Federation.HttpError) {
+      reply(e.status, {error: e.message});
+    } else {
+      reply(500, {error: String(e)});
+    }
+  };
+
+  var locked = this.limiter_.check('login', address);
+  if (locked) {
+    req.resume();
+    res.setHeader('Retry-After', String(Math.ceil(locked / 1000)));
+    fail(new Federation.HttpError(429, 'Too many failed attempts'));
+    return;
+  }
+  var path = new URL(req.url, 'http://localhost').pathname;
+  if (path !== '/teleport') {
+    req.resume();
+    fail(new Federation.HttpError(404, 'No such route: ' + path));
+    return;
+  } else if (req.method !== 'POST') {
+    req.resume();
+    fail(new Federation.HttpError(405, 'Method not allowed'));
+    return;
+  }
+  Federation.readBody_(req).then(function(data) {
+    var time = Number(req.headers['x-codecity-time']);
+    var expected = config && Federation.sign(config.key, ['request',
+        req.method, path, peer, service.name, time, nonce,
+        Federation.hashBody(data)]);
+    if (!config || !/^[0-9a-f]{16,64}$/.test(nonce) ||
+        !Federation.checkSignature_(req.headers['x-codecity-signature'],
+                                    expected)) {
+      service.limiter_.record('login', address);
+      throw new Federation.HttpError(401, 'Not authenticated');
+    }
+    var now = Date.now();
+    if (!(Math.abs(now - time) <= Federation.CLOCK_SKEW)) {
+      throw new Federation.HttpError(401, 'Request expired');
+    }
+    service.nonces_.forEach(function(expiry, key) {
+      if (expiry < now) service.nonces_.delete(key);
+    });
+    if (service.nonces_.has(nonce)) {
+      throw new Federation.HttpError(401, 'Request replayed');
+    }
+    service.nonces_.set(nonce, time + Federation.CLOCK_SKEW);
+    service.limiter_.reset('login', address);
+    var body;
+    try {
+      body = JSON.parse(data.toString('utf8'));
+    } catch (e) {
+      throw new Federation.HttpError(400, 'Invalid JSON: ' + e.message);
+    }
+    if (!body || typeof body !== 'object') {
+      throw new Federation.HttpError(400, 'Body must be an object');
+    }
+    return service.receive_(peer, body);
+  }).then(function(result) {
+    reply(200, result);
+  }).catch(fail);
+};
+
+/**
+ * Receive a teleport: ask the handler's consent, then import the
+ * package (if any) and tell the handler of the arrival.
+ * @private
+ * @param {string} peer Name of the origin.
+ * @param {!Object} body The request body.
+ * @return {!Promise<!Object>} The response body.
+ */
+Federation.Service.prototype.receive_ = function(peer, body) {
+  var intrp = this.intrp;
+  var handler = Package.lookup(intrp, this.handler_);
+  if (!(handler instanceof intrp.Object)) {
+    return Promise.reject(
+        new Federation.HttpError(503, 'Not accepting teleports'));
+  }
+  var pkg = body['package'];
+  var info = body['info'];
+  var offer = intrp.nativeToPseudo(
+      {world: peer, info: info, objects: pkg !== undefined}, intrp.ROOT);
+  return Federation.call_(intrp, handler, 'onOffer', [offer])
+      .then(function(consent) {
+        if (consent !== true) {
+          intrp.log('net', 'Teleport from %s refused', peer);
+          return {accepted: false, reason: (typeof consent === 'string') ?
+              consent : 'Refused'};
+        }
+        var objects = null;
+        if (pkg !== undefined) {
+          try {
+            objects = Package.importOwned(intrp, pkg);
+          } catch (e) {
+            throw new Federation.HttpError(400,
+                'Invalid package: ' + e.message);
+          }
+        }
+        var arrival = intrp.nativeToPseudo(
+            {world: peer, info: info, objects: null}, intrp.ROOT);
+        arrival.set('objects', objects, intrp.ROOT);
+        return Federation.call_(intrp, handler, 'onArrive', [arrival])
+            .then(function(reply) {
+              intrp.log('net', 'Teleport from %s accepted', peer);
+              return {accepted: true, reply: reply};
+            });
+      });
+};
+
+/**
+ * Call one of an in-world object's methods (as root) in a new thread,
+ * and wait for it to return.
+ * @private
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Interpreter.prototype.Object} obj The object.
+ * @param {string} name Name of the method.
+ * @param {!Array<?Interpreter.Value>} args Arguments to pass.
+ * @return {!Promise<*>} The value returned (converted to a native,
+ *     JSON-compatible value).  Rejects with an HttpError if the method
+ *     is missing, throws, or does not return in time.
+ */
+Federation.call_ = function(intrp, obj, name, args) {
+  var func = obj.get(name, intrp.ROOT);
+  if (!(func instanceof intrp.Function)) {
+    return Promise.reject(
+        new Federation.HttpError(503, 'Handler has no ' + name + ' method'));
+  }
+  return new Promise(function(resolve, reject) {
+    var thread = intrp.createThreadForFuncCall(
+        intrp.ROOT, func, obj, args).thread;
+    var timer = setTimeout(function() {
+      thread.onExit = null;
+      reject(new Federation.HttpError(504, name + ' did not return'));
+    }, Federation.TIMEOUT);
+    thread.onExit = function(threw, value) {
+      clearTimeout(timer);
+      if (threw) {
+        reject(new Federation.HttpError(500, name + ' threw'));
+        return;
+      }
+      var result;
+      try {
+        // Round trip through JSON to drop anything that can't be sent.
+        var json = JSON.stringify(intrp.pseudoToNative(value));
+        result = (json === undefined) ? null : JSON.parse(json);
+      } catch (e) {
+        reject(new Federation.HttpError(500,
+            name + ' returned an invalid value'));
+        return;
+      }
+      resolve(result);
+    };
+  });
+};
+
+/**
+ * Read a request's body.
+ * @private
+ * @param {!http.IncomingMessage} req The request.
+ * @return {!Promise<!Buffer>} The body.
+ */
+Federation.readBody_ = function(req) {
+  return new Promise(function(resolve, reject) {
+    var chunks = [];
+    var length = 0;
+    req.on('data', function(chunk) {
+      length += chunk.length;
+      if (length > Federation.MAX_BODY) {
+        req.removeAllListeners('data');
+        req.resume();
+        reject(new Federation.HttpError(413, 'Request body too large'));
+        return;
+      }
+      chunks.push(chunk);
+    });
+    req.on('end', function() {
+      resolve(Buffer.concat(chunks));
+    });
+    req.on('error', reject);
+  });
+};
+
+module.exports = Federation;
@@ -0,0 +1,470 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Reading and writing flatpack files (checkpoints and
+ * incremental checkpoints) one record at a time.
+ *
+ * Flatpacks can be large, so rather than building the whole file
+ * contents in memory (and then, when compressing or encrypting, a
+ * second copy), records are encoded and written as they are produced
+ * by the serializer, and decoded and passed to the deserializer as
+ * they are read.
+ *
+ * Textual flatpacks are written with one record per line, which is
+ * what allows them to be read incrementally.  Other valid JSON (e.g.,
+ * pretty-printed) can also be read, but is parsed all at once.
+ *
+ * To detect corruption, the records are divided into sections, each
+ * followed by a checksum record:
+ *
+ *     {"Checksum": "<hex>", "Records": <number of records in section>}
+ *
+ * where the checksum is (the first 128 bits of) the SHA-256 hash of
+ * the concatenated JSON encodings of the section's records, each
+ * followed by a newline.  Checksum records are verified and removed
+ * when a flatpack is read.  (Flatpacks without them, written by
+ * earlier versions, can still be read.)
+ */
+'use strict';
+
+var Binpack = require('./binpack');
+var crypto = require('crypto');
+var Envelope = require('./envelope');
+var StringDecoder = require('string_decoder').StringDecoder;
+
+var Flatpack = {};
+
+/**
+ * Number of records in each checksummed section.
+ * @private @const {number}
+ */
+Flatpack.SECTION_SIZE_ = 10000;
+
+/**
+ * A writer for flatpack files.
+ * @constructor
+ * @struct
+ * @param {function(!Buffer)} sink Function to receive output.  The
+ *     buffer passed may be reused once the sink returns.
+ * @param {string|undefined} format 'binary' or 'json'.  (Default: 'json'.)
+ * @param {!Envelope.Options} options Compression and encryption to apply.
+ */
+Flatpack.Writer = function(sink, format, options) {
+  if (format !== undefined && format !== 'json' && format !== 'binary') {
+    throw new RangeError('Unknown checkpoint format ' + format);
+  }
+  /** @private @const {!Envelope.Writer} */
+  this.out_ = new Envelope.Writer(sink, options);
+  /** @private @const {?Binpack.Encoder} */
+  this.encoder_ = (format === 'binary') ? new Binpack.Encoder() : null;
+  /** @type {number} Number of records written so far. */
+  this.count = 0;
+  /** @private @const {!Flatpack.Checksum_} */
+  this.checksum_ = new Flatpack.Checksum_();
+  /** @private {boolean} Has any record (including checksums) been written? */
+  this.started_ = false;
+};
+
+/**
+ * Write a record.
+ * @param {!Object} record JSON-compatible record.
+ */
+Flatpack.Writer.prototype.write = function(record) {
+  var text = JSON.stringify(record);
+  this.checksum_.add(text);
+  this.write_(record, text);
+  this.count++;
+  if (this.checksum_.records >= Flatpack.SECTION_SIZE_) {
+    this.writeChecksum_();
+  }
+};
+
+/**
+ * Finish writing.
+ * @return {!Promise<void>} Resolves once all of the output has been
+ *     passed to the sink (see Envelope.Writer.prototype.end).
+ */
+Flatpack.Writer.prototype.end = function() {
+  if (this.checksum_.records) {
+    this.writeChecksum_();
+  }
+  if (this.encoder_) {
+    this.out_.write(this.encoder_.end());
+  } else {
+    this.out_.write(this.started_ ? ']' : '[]');
+  }
+  return this.out_.end();
+};
+
+/**
+ * Abandon writing: pass nothing more to the sink.
+ */
+Flatpack.Writer.prototype.abort = function() {
+  this.out_.abort();
+};
+
+/**
+ * Write a checksum record for the records written since the last.
+ * @private
+ */
+Flatpack.Writer.prototype.writeChecksum_ = function() {
+  var record = this.checksum_.record();
+  this.write_(record, JSON.stringify(record));
+};
+
+/**
+ * Write a record, whether data or checksum.
+ * @private
+ * @param {!Object} record JSON-compatible record.
+ * @param {string} text JSON encoding of record.
+ */
+Flatpack.Writer.prototype.write_ = function(record, text) {
+  if (this.encoder_) {
+    // Copy, since the encoder reuses its buffer.
+    this.out_.write(Buffer.from(this.encoder_.encode(record)));
+  } else {
+    // JSON.stringify(json) would work, but adding linebreaks so that
+    // every object is on its own line makes the output more readable
+    // (and allows it to be read incrementally).
+    this.out_.write((this.started_ ? ',\n' : '[') + text);
+  }
+  this.started_ = true;
+};
+
+/**
+ * Encode flatpack records.
+ * @param {!Array<!Object>} json Flatpack records.
+ * @param {string=} format 'binary' or 'json'.  (Default: 'json'.)
+ * @param {!Envelope.Options=} options Compression and encryption to apply.
+ * @return {!Buffer} Encoded flatpack.
+ */
+Flatpack.encode = function(json, format, options) {
+  var chunks = [];
+  var writer = new Flatpack.Writer(function(chunk) {
+    chunks.push(Buffer.from(chunk));
+  }, format, options || {});
+  for (var i = 0; i < json.length; i++) {
+    writer.write(json[i]);
+  }
+  writer.end();
+  return Buffer.concat(chunks);
+};
+
+/**
+ * Decode flatpack records, in either textual (JSON) or binary format,
+ * decompressing and decrypting them if necessary.
+ * @param {!Buffer} data Encoded flatpack.
+ * @param {?Buffer=} key Decryption key, if any.
+ * @return {!Array<!Object>} Flatpack records.
+ */
+Flatpack.decode = function(data, key) {
+  var plain = Envelope.unwrap(data, key);
+  var decoded;
+  if (Binpack.isBinary(plain)) {
+    decoded = /** @type {!Array<!Object>} */(Binpack.decode(plain));
+  } else {
+    var decoder = new Flatpack.JsonDecoder_();
+    decoded = decoder.push(plain).concat(decoder.end());
+  }
+  var records = [];
+  var verifier = new Flatpack.Verifier_(records.push.bind(records));
+  decoded.forEach(verifier.add, verifier);
+  verifier.finish();
+  return records;
+};
+
+/**
+ * Read a flatpack file, in either textual (JSON) or binary format,
+ * decompressing and decrypting it if necessary.
+ *
+ * N.B.: records are passed to onRecord as soon as they are read, so
+ * their integrity (and, if the file is encrypted, authenticity) is
+ * not confirmed until the returned promise resolves.
+ * @param {string} filename Name of file to read.
+ * @param {?Buffer} key Decryption key, if any.
+ * @param {function(!Object)} onRecord Callback to receive each record.
+ * @return {!Promise<!Flatpack.ReadResult>} Promise that resolves once
+ *     the whole file has been read, or rejects if there is any error.
+ */
+Flatpack.read = function(filename, key, onRecord) {
+  return new Promise(function(resolve, reject) {
+    var input = Envelope.createReadStream(filename, key);
+    var decoder = null;
+    var head = Buffer.alloc(0);
+    var verifier = new Flatpack.Verifier_(onRecord);
+    var emit = function(records) {
+      for (var i = 0; i < records.length; i++) {
+        verifier.add(records[i]);
+      }
+    };
+    var fail = function(err) {
+      input.destroy();
+      reject(err);
+    };
+    input.on('data', function(chunk) {
+      try {
+        if (!decoder) {
+          // Wait for enough data to determine format.
+          head = Buffer.concat([head, chunk]);
+          if (head.length < 4) return;
+          decoder = Binpack.isBinary(head) ?
+              new Binpack.Decoder() : new Flatpack.JsonDecoder_();
+          chunk = head;
+        }
+        emit(decoder.push(chunk));
+      } catch (e) {
+        fail(e);
+      }
+    });
+    input.on('error', reject);
+    input.on('end', function() {
+      try {
+        if (!decoder) {
+          decoder = new Flatpack.JsonDecoder_();
+          emit(decoder.push(head));
+        }
+        emit(decoder.end());
+        verifier.finish();
+        resolve({records: verifier.count, sections: verifier.sections});
+      } catch (e) {
+        reject(e);
+      }
+    });
+  });
+};
+
+/**
+ * Result of reading a flatpack: the number of (data) records it
+ * contained, and the number of checksummed sections verified.
+ * @typedef {{records: number, sections: number}}
+ */
+Flatpack.ReadResult;
+
+/**
+ * A running checksum of records.
+ * @private
+ * @constructor
+ * @struct
+ */
+Flatpack.Checksum_ = function() {
+  /** @private {!crypto.Hash} */
+  this.hash_ = crypto.createHash('sha256');
+  /** @type {number} Number of records added since the last checksum. */
+  this.records = 0;
+};
+
+/**
+ * Add a record to the checksum.
+ * @param {string} text JSON encoding of the record.
+ */
+Flatpack.Checksum_.prototype.add = function(text) {
+  this.hash_.update(text);
+  this.hash_.update('\n');
+  this.records++;
+};
+
+/**
+ * Make a checksum record for the records added since the last one.
+ * @return {!Object} Checksum record.
+ */
+Flatpack.Checksum_.prototype.record = function() {
+  var record = {
+    'Checksum': this.hash_.digest('hex').slice(0, 32),
+    'Records': this.records,
+  };
+  this.hash_ = crypto.createHash('sha256');
+  this.records = 0;
+  return record;
+};
+
+/**
+ * A filter which verifies and removes checksum records.
+ * @private
+ * @constructor
+ * @struct
+ * @param {function(!Object)} onRecord Callback to receive each data record.
+ */
+Flatpack.Verifier_ = function(onRecord) {
+  /** @private @const {function(!Object)} */
+  this.onRecord_ = onRecord;
+  /** @private @const {!Flatpack.Checksum_} */
+  this.checksum_ = new Flatpack.Checksum_();
+  /** @type {number} Number of data records passed on. */
+  this.count = 0;
+  /** @type {number} Number of sections verified. */
+  this.sections = 0;
+};
+
+/**
+ * Process one record.
+ * @param {!Object} record Record read from flatpack.
+ */
+Flatpack.Verifier_.prototype.add = function(record) {
+  if (!('#' in record) && ('Checksum' in record)) {
+    var expected = this.checksum_.record();
+    if (record['Checksum'] !== expected['Checksum'] ||
+        record['Records'] !== expected['Records']) {
+      throw new Error('Checksum mismatch in section ' + (this.sections + 1) +
+          ' (records ' + (this.count - expected['Records']) + ' to ' +
+          (this.count - 1) + ')');
+    }
+    this.sections++;
+    return;
+  }
+  this.checksum_.add(JSON.stringify(record));
+  this.count++;
+  this.onRecord_(record);
+};
+
+/**
+ * Signal the end of the records.
+ */
+Flatpack.Verifier_.prototype.finish = function() {
+  if (this.sections && this.checksum_.records) {
+    throw new Error('No checksum for last ' + this.checksum_.records +
+        ' records');
+  }
+};
+
+/**
+ * A decoder for textual flatpacks, which decodes records as soon as
+ * enough data has been supplied, if they are one per line.
+ * @private
+ * @constructor
+ * @struct
+ */
+Flatpack.JsonDecoder_ = function() {
+  /** @private @const {!StringDecoder} */
+  this.utf8_ = new StringDecoder('utf8');
+  /** @private {string} Partial line not yet decoded. */
+  this.pending_ = '';
+  /** @private {number} Number of lines decoded so far. */
+  this.lines_ = 0;
+  /**
+   * Complete text so far, if the file turned out not to be written
+   * one record per line, or null otherwise.
+   * @private {?Array<string>}
+   */
+  this.text_ = null;
+  /** @private {boolean} Has the closing bracket been read? */
+  this.done_ = false;
+};
+
+/**
+ * Supply more data to the decoder.
+ * @param {!Buffer} data The next part of the file.
+ * @return {!Array<!Object>} The records that could be decoded.
+ */
+Flatpack.JsonDecoder_.prototype.push = function(data) {
+  var text = this.utf8_.write(data);
+  if (this.text_) {
+    this.text_.push(text);
+    return [];
+  }
+  var lines = (this.pending_ + text).split('\n');
+  this.pending_ = lines.pop();
+  var records = [];
+  for (var i = 0; i < lines.length && !this.text_; i++) {
+    var record = this.decodeLine_(lines[i]);
+    if (record) records.push(record);
+  }
+  if (this.text_) {
+    // Switched to parsing all at once; keep the rest of the text.
+    for (; i < lines.length; i++) {
+      this.text_.push('\n' + lines[i]);
+    }
+    this.text_.push('\n' + this.pending_);
+    this.pending_ = '';
+  }
+  return records;
+};
+
+/**
+ * Signal the end of the data.
+ * @return {!Array<!Object>} Any remaining records.
+ */
+Flatpack.JsonDecoder_.prototype.end = function() {
+  var rest = this.utf8_.end();
+  if (this.text_) {
+    this.text_.push(rest);
+  } else {
+    var record = this.decodeLine_(this.pending_ + rest);
+    this.pending_ = '';
+    if (!this.text_) {
+      if (!this.done_) {
+        throw new SyntaxError('Unexpected end of JSON flatpack');
+      }
+      return record ? [record] : [];
+    }
+  }
+  var json = JSON.parse(this.text_.join(''));
+  if (!Array.isArray(json)) {
+    throw new TypeError('Top-level JSON is not a list.');
+  }
+  return json;
+};
+
+/**
+ * Decode one line of a flatpack written one record per line.  If the
+ * first line is not in the expected form, switch to accumulating all
+ * the text so it can be parsed at the end.
+ * @private
+ * @param {string} line Line of text (without trailing newline).
+ * @return {?Object} Record decoded, if any.
+ */
+Flatpack.JsonDecoder_.prototype.decodeLine_ = function(line) {
+  var first = (this.lines_++ === 0);
+  if (this.done_) {
+    if (line.trim()) throw new SyntaxError('Trailing data after JSON list');
+    return null;
+  }
+  var body = line;
+  if (first) {
+    if (body[0] !== '[') {
+      this.text_ = [line];
+      return null;
+    }
+    body = body.slice(1);
+  }
+  var last = body[body.length - 1];
+  if (last === ']') {
+    this.done_ = true;
+  } else if (last !== ',') {
+    if (first) {
+      this.text_ = [line];
+      return null;
+    }
+    throw new SyntaxError(
+        'Malformed JSON flatpack at line ' + this.lines_);
+  }
+  body = body.slice(0, -1);
+  if (!body && this.done_ && first) return null;  // Empty list.
+  try {
+    var record = JSON.parse(body);
+  } catch (e) {
+    if (first) {
+      this.text_ = [line];
+      return null;
+    }
+    throw new SyntaxError('Malformed JSON flatpack at line ' + this.lines_ +
+        ': ' + e.message);
+  }
+  return record;
+};
+
+module.exports = Flatpack;
@@ -0,0 +1,697 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview A minimal implementation of gRPC (unary calls only,
+ * without compression) over HTTP/2, as specified by
+ * https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+ * together with the protocol buffer encoding of the messages, as
+ * specified by https://developers.google.com/protocol-buffers/docs/encoding
+ *
+ * Messages are plain JS objects, described by a Grpc.Schema giving the
+ * number and type of each field (corresponding to the message's
+ * definition in a .proto file, but with field names in lowerCamelCase,
+ * as in protobuf's JSON mapping).  64-bit integers are represented as
+ * numbers, so are only exact up to Number.MAX_SAFE_INTEGER.
+ */
+'use strict';
+
+var http2 = require('http2');
+
+var Grpc = {};
+
+/**
+ * gRPC status codes.
+ * @enum {number}
+ */
+Grpc.Status = {
+  OK: 0,
+  CANCELLED: 1,
+  UNKNOWN: 2,
+  INVALID_ARGUMENT: 3,
+  DEADLINE_EXCEEDED: 4,
+  NOT_FOUND: 5,
+  PERMISSION_DENIED: 7,
+  RESOURCE_EXHAUSTED: 8,
+  FAILED_PRECONDITION: 9,
+  UNIMPLEMENTED: 12,
+  INTERNAL: 13,
+  UNAVAILABLE: 14,
+  UNAUTHENTICATED: 16,
+};
+
+/**
+ * Maximum size (in bytes) of a message received.
+ * @const {number}
+ */
+Grpc.MAX_MESSAGE = 4 * 1024 * 1024;
+
+/**
+ * Definition of one field of a message.  type is one of 'double',
+ * 'int32', 'int64', 'uint32', 'uint64', 'bool', 'string', 'bytes',
+ * 'enum' (with values giving the name of each value, in order) or
+ * 'message' (with message giving its schema).
+ * @typedef {{id: number,
+ *            type: string,
+ *            repeated: (boolean|undefined),
+ *            values: (!Array<string>|undefined),
+ *            message: (!Grpc.Schema|undefined)}}
+ */
+Grpc.Field;
+
+/**
+ * Definition of a message: its fields, by (lowerCamelCase) name.
+ * @typedef {!Object<string, !Grpc.Field>}
+ */
+Grpc.Schema;
+
+/**
+ * Definition of a service: its full name (e.g., 'pkg.Service') and the
+ * request and response schemas of each of its methods, by name.
+ * @typedef {{name: string,
+ *            methods: !Object<string, {request: !Grpc.Schema,
+ *                                      response: !Grpc.Schema}>}}
+ */
+Grpc.Service;
+
+/**
+ * An error to be reported to the client with a given gRPC status.
+ * @constructor
+ * @extends {Error}
+ * @param {!Grpc.Status} code The status code.
+ * @param {string} message The error message.
+ */
+Grpc.Error = function(code, message) {
+  this.name = 'GrpcError';
+  this.message = message;
+  /** @const {!Grpc.Status} */
+  this.code = code;
+};
+Grpc.Error.prototype = Object.create(Error.prototype);
+Grpc.Error.prototype.constructor = Grpc.Error;
+
+///////////////////////////////////////////////////////////////////////////////
+// Protocol buffer encoding.
+
+/**
+ * Wire types, by field type.
+ * @private @const {!Object<string, number>}
+ */
+Grpc.WIRE_TYPES_ = {
+  double: 1, int32: 0, int64: 0, uint32: 0, uint64: 0, bool: 0, enum: 0,
+  string: 2, bytes: 2, message: 2,
+};
+
+/**
+ * Encode a message.
+ * @param {!Grpc.Schema} schema The message's schema.
+ * @param {!Object} message The message.
+ * @return {!Buffer} The encoded message.
+ */
+Grpc.encode = function(schema, message) {
+  var bytes = [];
+  for (var name in schema) {
+    var field = schema[name];
+    var value = message[name];
+    var wireType = Grpc.WIRE_TYPES_[field.type];
+    if (wireType === undefined) {
+      throw new TypeError('Unknown field type ' + field.type);
+    }
+    if (field.repeated) {
+      var values = value || [];
+      if (!values.length) continue;
+      if (wireType === 2) {
+        for (var i = 0; i < values.length; i++) {
+          Grpc.pushTag_(bytes, field.id, 2);
+          Grpc.pushDelimited_(bytes, Grpc.encodeValue_(field, values[i]));
+        }
+      } else {  // Packed.
+        var packed = [];
+        for (i = 0; i < values.length; i++) {
+          Array.prototype.push.apply(packed,
+                                     Grpc.encodeValue_(field, values[i]));
+        }
+        Grpc.pushTag_(bytes, field.id, 2);
+        Grpc.pushDelimited_(bytes, packed);
+      }
+    } else if (!Grpc.isDefault_(field, value)) {
+      Grpc.pushTag_(bytes, field.id, wireType);
+      var encoded = Grpc.encodeValue_(field, value);
+      if (wireType === 2) {
+        Grpc.pushDelimited_(bytes, encoded);
+      } else {
+        Array.prototype.push.apply(bytes, encoded);
+      }
+    }
+  }
+  return Buffer.from(bytes);
+};
+
+/**
+ * Decode a message.  Fields not present are given their default values
+ * (so every field of the schema is set); unknown fields are ignored.
+ * @param {!Grpc.Schema} schema The message's schema.
+ * @param {!Buffer} buffer The encoded message.
+ * @return {!Object} The message.
+ * @throws {!Grpc.Error} If the message is malformed.
+ */
+Grpc.decode = function(schema, buffer) {
+  var message = {};
+  var byId = Object.create(null);
+  for (var name in schema) {
+    var field = schema[name];
+    byId[field.id] = name;
+    message[name] = field.repeated ? [] : Grpc.defaultValue_(field);
+  }
+  var pos = {offset: 0};
+  while (pos.offset < buffer.length) {
+    var tag = Grpc.readVarint_(buffer, pos, false);
+    var id = Math.floor(tag / 8);
+    var wireType = tag % 8;
+    var end;
+    switch (wireType) {
+      case 0:
+        var start = pos.offset;
+        Grpc.readVarint_(buffer, pos, false);
+        end = pos.offset;
+        pos.offset = start;
+        break;
+      case 1:
+        end = pos.offset + 8;
+        break;
+      case 2:
+        var length = Grpc.readVarint_(buffer, pos, false);
+        start = pos.offset;
+        end = start + length;
+        break;
+      case 5:
+        end = pos.offset + 4;
+        break;
+      default:
+        throw new Grpc.Error(Grpc.Status.INTERNAL,
+                             'Unsupported wire type ' + wireType);
+    }
+    if (end > buffer.length) {
+      throw new Grpc.Error(Grpc.Status.INTERNAL, 'Truncated message');
+    }
+    name = byId[id];
+    field = name && schema[name];
+    if (field) {
+      var expected = Grpc.WIRE_TYPES_[field.type];
+      if (field.repeated && wireType === 2 && expected !== 2) {  // Packed.
+        var packed = {offset: pos.offset};
+        while (packed.offset < end) {
+          message[name].push(Grpc.decodeValue_(field, buffer, packed));
+        }
+      } else if (wireType !== expected) {
+        throw new Grpc.Error(Grpc.Status.INTERNAL,
+                             'Wrong wire type for field ' + name);
+      } else {
+        var value = Grpc.decodeValue_(field, buffer, pos, end);
+        if (field.repeated) {
+          message[name].push(value);
+        } else {
+          message[name] = value;
+        }
+      }
+    }
+    pos.offset = end;
+  }
+  return message;
+};
+
+/**
+ * Is value the default value of a (non-repeated) field, and so not to
+ * be sent?
+ * @private
+ * @param {!Grpc.Field} field The field.
+ * @param {*} value The value.
+ * @return {boolean}
+ */
+Grpc.isDefault_ = function(field, value) {
+  if (value === undefined || value === null) return true;
+  if (field.type === 'message') return false;
+  if (field.type === 'enum') return !value || value === field.values[0];
+  if (field.type === 'bytes') return !value.length;
+  return !value;
+};
+
+/**
+ * Return the default value of a (non-repeated) field.
+ * @private
+ * @param {!Grpc.Field} field The field.
+ * @return {*}
+ */
+Grpc.defaultValue_ = function(field) {
+  switch (field.type) {
+    case 'bool': return false;
+    case 'string': return '';
+    case 'bytes': return Buffer.alloc(0);
+    case 'enum': return field.values[0];
+    case 'message': return null;
+    default: return 0;
+  }
+};
+
+/**
+ * Encode a single value of a field (without its tag, or length prefix).
+ * @private
+ * @param {!Grpc.Field} field The field.
+ * @param {*} value The value.
+ * @return {!Array<number>} The encoded value.
+ */
+Grpc.encodeValue_ = function(field, value) {
+  var bytes = [];
+  switch (field.type) {
+    case 'double':
+      var buffer = Buffer.alloc(8);
+      buffer.writeDoubleLE(Number(value));
+      return Array.from(buffer);
+    case 'bool':
+      return [value ? 1 : 0];
+    case 'enum':
+      var index = (typeof value === 'number') ? value :
+          field.values.indexOf(value);
+      if (index < 0) throw new RangeError('Unknown enum value ' + value);
+      Grpc.pushVarint_(bytes, index);
+      return bytes;
+    case 'string':
+      return Array.from(Buffer.from(String(value), 'utf8'));
+    case 'bytes':
+      return Array.from(value);
+    case 'message':
+      return Array.from(Grpc.encode(field.message, value));
+    default:  // Integer types.
+      Grpc.pushVarint_(bytes, Math.trunc(Number(value)));
+      return bytes;
+  }
+};
+
+/**
+ * Decode a single value of a field.
+ * @private
+ * @param {!Grpc.Field} field The field.
+ * @param {!Buffer} buffer The encoded message.
+ * @param {!{offset: number}} pos Position of the value; updated to
+ *     follow varints and fixed-length values.
+ * @param {number=} end End of a length-delimited value.
+ * @return {*} The value.
+ */
+Grpc.decodeValue_ = function(field, buffer, pos, end) {
+  switch (field.type) {
+    case 'double':
+      var value = buffer.readDoubleLE(pos.offset);
+      pos.offset += 8;
+      return value;
+    case 'bool':
+      return Boolean(Grpc.readVarint_(buffer, pos, false));
+    case 'enum':
+      var index = Grpc.readVarint_(buffer, pos, true);
+      return (index in field.values) ? field.values[index] : index;
+    case 'string':
+      return buffer.toString('utf8', pos.offset, end);
+    case 'bytes':
+      return Buffer.from(buffer.slice(pos.offset, end));
+    case 'message':
+      return Grpc.decode(/** @type {!Grpc.Schema} */(field.message),
+                         buffer.slice(pos.offset, end));
+    default:  // Integer types.
+      return Grpc.readVarint_(buffer, pos, field.type[0] === 'i');
+  }
+};
+
+/**
+ * Append a field's tag.
+ * @private
+ * @param {!Array<number>} bytes The bytes to append to.
+ * @param {number} id The field's number.
+ * @param {number} wireType The wire type.
+ */
+Grpc.pushTag_ = function(bytes, id, wireType) {
+  Grpc.pushVarint_(bytes, id * 8 + wireType);
+};
+
+/**
+ * Append a length-delimited value.
+ * @private
+ * @param {!Array<number>} bytes The bytes to append to.
+ * @param {!Array<number>} value The encoded value.
+ */
+Grpc.pushDelimited_ = function(bytes, value) {
+  Grpc.pushVarint_(bytes, value.length);
+  Array.prototype.push.apply(bytes, value);
+};
+
+/**
+ * Append a varint.  Negative numbers are encoded in 64-bit two's
+ * complement (taking ten bytes), as for int32 and int64 fields.
+ * @private
+ * @param {!Array<number>} bytes The bytes to append to.
+ * @param {number} n The number (a safe integer).
+ */
+Grpc.pushVarint_ = function(bytes, n) {
+  var lo = ((n % 0x100000000) + 0x100000000) % 0x100000000;
+  var hi = Math.floor(n / 0x100000000) >>> 0;
+  do {
+    var b = lo & 0x7f;
+    lo = (lo >>> 7) | ((hi & 0x7f) << 25);
+    lo >>>= 0;
+    hi >>>= 7;
+    bytes.push((lo || hi) ? b | 0x80 : b);
+  } while (lo || hi);
+};
+
+/**
+ * Read a varint.
+ * @private
+ * @param {!Buffer} buffer The buffer.
+ * @param {!{offset: number}} pos Position of the varint; updated to
+ *     follow it.
+ * @param {boolean} signed Interpret it as a two's complement number?
+ * @return {number}
+ * @throws {!Grpc.Error} If it is truncated or too long.
+ */
+Grpc.readVarint_ = function(buffer, pos, signed) {
+  var lo = 0;
+  var hi = 0;
+  for (var shift = 0; ; shift += 7) {
+    if (pos.offset >= buffer.length || shift >= 70) {
+      throw new Grpc.Error(Grpc.Status.INTERNAL, 'Malformed varint');
+    }
+    var b = buffer[pos.offset++];
+    if (shift < 28) {
+      lo |= (b & 0x7f) << shift;
+    } else if (shift === 28) {
+      lo |= (b & 0x0f) << 28;
+      hi |= (b & 0x7f) >>> 4;
+    } else {
+      hi |= (b & 0x7f) << (shift - 32);
+    }
+    if (!(b & 0x80)) break;
+  }
+  lo >>>= 0;
+  return (signed ? (hi | 0) : (hi >>> 0)) * 0x100000000 + lo;
+};
+
+///////////////////////////////////////////////////////////////////////////////
+// gRPC over HTTP/2.
+
+/**
+ * Frame a message for sending in the body of an HTTP/2 request or
+ * response.
+ * @param {!Buffer} message The encoded message.
+ * @return {!Buffer} The framed (length-prefixed) message.
+ */
+Grpc.frame = function(message) {
+  var header = Buffer.alloc(5);
+  header.writeUInt32BE(message.length, 1);  // Uncompressed.
+  return Buffer.concat([header, message]);
+};
+
+/**
+ * Extract the messages from the body of a request or response.
+ * @param {!Buffer} body The body.
+ * @return {!Array<!Buffer>} The encoded messages.
+ * @throws {!Grpc.Error} If the body is malformed.
+ */
+Grpc.unframe = function(body) {
+  var messages = [];
+  var offset = 0;
+  while (offset < body.length) {
+    if (body.length - offset < 5) {
+      throw new Grpc.Error(Grpc.Status.INTERNAL, 'Truncated message frame');
+    }
+    if (body[offset]) {
+      throw new Grpc.Error(Grpc.Status.UNIMPLEMENTED,
+                           'Compressed messages are not supported');
+    }
+    var length = body.readUInt32BE(offset + 1);
+    if (body.length - offset - 5 < length) {
+      throw new Grpc.Error(Grpc.Status.INTERNAL, 'Truncated message');
+    }
+    messages.push(body.slice(offset + 5, offset + 5 + length));
+    offset += 5 + length;
+  }
+  return messages;
+};
+
+/**
+ * A call, as passed to method handlers.
+ * @typedef {{method: string,
+ *            request: !Object,
+ *            metadata: !http2.IncomingHttpHeaders,
+ *            remoteAddress: (string|undefined),
+ *            afterResponse: ?function()}}
+ */
+Grpc.Call;
+
+/**
+ * Options for a Grpc.Server.
+ *
+ * - authorize: called before each handler; throws (or rejects with) a
+ *   Grpc.Error to refuse the call.
+ * - onCall: called as each call completes, with its status (e.g., for
+ *   logging).
+ * @typedef {{authorize: (function(!Grpc.Call): (void|!Promise<void>)|
+ *                        undefined),
+ *            onCall: (function(!Grpc.Call, !Grpc.Status)|undefined)}}
+ */
+Grpc.ServerOptions;
+
+/**
+ * A gRPC server, implementing one service.  Handlers (by method name)
+ * are called with a Grpc.Call, and return the response message (or a
+ * promise of it), or throw (or reject with) a Grpc.Error.  A handler
+ * may set the call's .afterResponse to a function to be called once
+ * the response has been sent.
+ * @constructor
+ * @struct
+ * @param {!Grpc.Service} service The service.
+ * @param {!Object<string, function(!Grpc.Call): *>} handlers Handlers.
+ * @param {!Grpc.ServerOptions=} options Options.
+ */
+Grpc.Server = function(service, handlers, options) {
+  options = options || {};
+  /** @const {!Grpc.Service} */
+  this.service = service;
+  /** @private @const {!Object<string, function(!Grpc.Call): *>} */
+  this.handlers_ = handlers;
+  /** @private @const {function(!Grpc.Call): (void|!Promise<void>)} */
+  this.authorize_ = options.authorize || function() {};
+  /** @private @const {function(!Grpc.Call, !Grpc.Status)} */
+  this.onCall_ = options.onCall || function() {};
+  /** @private @const {!http2.Http2Server} */
+  this.server_ = http2.createServer();
+  this.server_.on('stream', this.handle_.bind(this));
+};
+
+/**
+ * Start listening for calls.
+ * @param {number} port The port to listen on.
+ * @param {string=} host The address to listen on (default: all).
+ * @return {!Promise<number>} Resolves to the port listened on (useful
+ *     if port was 0) once listening.
+ */
+Grpc.Server.prototype.listen = function(port, host) {
+  var server = this.server_;
+  return new Promise(function(resolve, reject) {
+    server.once('error', reject);
+    server.listen(port, host, function() {
+      server.removeListener('error', reject);
+      resolve(server.address().port);
+    });
+  });
+};
+
+/**
+ * Stop listening for calls.
+ * @return {!Promise<void>} Resolves once all sessions have closed.
+ */
+Grpc.Server.prototype.close = function() {
+  var server = this.server_;
+  return new Promise(function(resolve) {
+    server.close(function() {resolve();});
+  });
+};
+
+/**
+ * Handle a new stream (i.e., a call).
+ * @private
+ * @param {!http2.ServerHttp2Stream} stream The stream.
+ * @param {!http2.IncomingHttpHeaders} headers The request headers.
+ */
+Grpc.Server.prototype.handle_ = function(stream, headers) {
+  var server = this;
+  var prefix = '/' + this.service.name + '/';
+  var path = String(headers[':path']);
+  var call = {
+    method: path.startsWith(prefix) ? path.slice(prefix.length) : '',
+    request: {},
+    metadata: headers,
+    remoteAddress: stream.session.socket.remoteAddress,
+    afterResponse: null,
+  };
+  var responseHeaders = {
+    ':status': 200,
+    'content-type': 'application/grpc+proto',
+  };
+  var fail = function(e) {
+    if (stream.destroyed) return;
+    var error = (e instanceof Grpc.Error) ? e :
+        new Grpc.Error(Grpc.Status.INTERNAL, String(e));
+    server.onCall_(call, error.code);
+    // Trailers-only response.
+    stream.respond(Object.assign(responseHeaders, {
+      'grpc-status': String(error.code),
+      'grpc-message': encodeURIComponent(error.message),
+    }), {endStream: true});
+  };
+  var definition = Object.prototype.hasOwnProperty.call(
+      this.service.methods, call.method) && this.service.methods[call.method];
+  if (headers[':method'] !== 'POST' ||
+      !/^application\/grpc(\+proto)?(;|$)/.test(
+          String(headers['content-type']))) {
+    stream.respond({':status': 415}, {endStream: true});
+    return;
+  }
+  var chunks = [];
+  var length = 0;
+  stream.on('data', function(chunk) {
+    length += chunk.length;
+    if (length > Grpc.MAX_MESSAGE + 5) {
+      stream.removeAllListeners('data');
+      stream.resume();
+      fail(new Grpc.Error(Grpc.Status.RESOURCE_EXHAUSTED,
+                          'Message too large'));
+      return;
+    }
+    chunks.push(chunk);
+  });
+  stream.on('error', function() {});  // E.g., client cancelled.
+  stream.on('end', function() {
+    if (length > Grpc.MAX_MESSAGE + 5) return;
+    Promise.resolve().then(function() {
+      if (!definition || !server.handlers_[call.method]) {
+        throw new Grpc.Error(Grpc.Status.UNIMPLEMENTED,
+                             'Unknown method: ' + path);
+      }
+      var messages = Grpc.unframe(Buffer.concat(chunks));
+      if (messages.length !== 1) {
+        throw new Grpc.Error(Grpc.Status.INTERNAL,
+                             'Expected exactly one request message');
+      }
+      call.request = Grpc.decode(definition.request, messages[0]);
+      return server.authorize_(call);
+    }).then(function() {
+      return server.handlers_[call.method](call);
+    }).then(function(response) {
+      if (stream.destroyed) return;
+      var body = Grpc.frame(Grpc.encode(definition.response, response || {}));
+      stream.respond(responseHeaders, {waitForTrailers: true});
+      stream.on('wantTrailers', function() {
+        stream.sendTrailers({'grpc-status': String(Grpc.Status.OK)});
+      });
+      server.onCall_(call, Grpc.Status.OK);
+      if (call.afterResponse) stream.once('close', call.afterResponse);
+      stream.end(body);
+    }).catch(fail);
+  });
+};
+
+/**
+ * A client of a gRPC service.
+ * @constructor
+ * @struct
+ * @param {string} authority URL of the server (e.g.,
+ *     'http://localhost:7791').
+ * @param {!Grpc.Service} service The service.
+ * @param {!Object<string, string>=} metadata Metadata (e.g.,
+ *     authorization) to send with every call.
+ */
+Grpc.Client = function(authority, service, metadata) {
+  /** @const {!Grpc.Service} */
+  this.service = service;
+  /** @private @const {!Object<string, string>} */
+  this.metadata_ = metadata || {};
+  /** @private @const {!http2.ClientHttp2Session} */
+  this.session_ = http2.connect(authority);
+  this.session_.on('error', function() {});  // Reported by calls.
+};
+
+/**
+ * Make a unary call.
+ * @param {string} method The method's name.
+ * @param {!Object} request The request message.
+ * @return {!Promise<!Object>} The response message.  Rejects with a
+ *     Grpc.Error if the call fails.
+ */
+Grpc.Client.prototype.call = function(method, request) {
+  var definition = this.service.methods[method];
+  if (!definition) {
+    return Promise.reject(new Grpc.Error(Grpc.Status.UNIMPLEMENTED,
+                                         'Unknown method: ' + method));
+  }
+  var req = this.session_.request(Object.assign({
+    ':method': 'POST',
+    ':path': '/' + this.service.name + '/' + method,
+    'content-type': 'application/grpc+proto',
+    'te': 'trailers',
+  }, this.metadata_));
+  req.end(Grpc.frame(Grpc.encode(definition.request, request)));
+  return new Promise(function(resolve, reject) {
+    var status = {};
+    var chunks = [];
+    req.on('response', function(headers) {
+      Object.assign(status, headers);
+    });
+    req.on('trailers', function(trailers) {
+      Object.assign(status, trailers);
+    });
+    req.on('data', function(chunk) {
+      chunks.push(chunk);
+    });
+    req.on('error', function(e) {
+      reject(new Grpc.Error(Grpc.Status.UNAVAILABLE, String(e)));
+    });
+    req.on('end', function() {
+      var code = Number(status['grpc-status']);
+      if (status['grpc-status'] === undefined) {
+        reject(new Grpc.Error(Grpc.Status.UNKNOWN,
+                              'HTTP status ' + status[':status']));
+      } else if (code !== Grpc.Status.OK) {
+        reject(new Grpc.Error(code, decodeURIComponent(
+            String(status['grpc-message'] || ''))));
+      } else {
+        try {
+          var messages = Grpc.unframe(Buffer.concat(chunks));
+          resolve(Grpc.decode(definition.response, messages[0]));
+        } catch (e) {
+          reject(e);
+        }
+      }
+    });
+  });
+};
+
+/**
+ * Close the connection to the server.
+ */
+Grpc.Client.prototype.close = function() {
+  this.session_.close();
+};
+
+module.exports = Grpc;
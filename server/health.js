@@ -0,0 +1,195 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Health and readiness of a running server, for
+ * orchestrators and uptime monitors.  Subsystems report their state
+ * into a Health.Registry (or register checks that compute it on
+ * demand), and a Health.Server exposes it at two endpoints:
+ *
+ * GET /healthz: is the process alive?  Fails only if a liveness check
+ *     fails (whereupon it should be restarted).
+ * GET /readyz: is it ready to serve players?  Fails if any check
+ *     fails (e.g., while the database is still loading).
+ *
+ * Each responds 200 if all the relevant checks pass, or otherwise 503,
+ * with a JSON body of the form {"status": "ok"|"fail", "checks":
+ * {<name>: {"ok": <boolean>, "message": <string>}, ...}}.
+ */
+'use strict';
+
+var http = require('http');
+
+var Health = {};
+
+/**
+ * Kinds of check.  Liveness checks are also included in readiness.
+ * @enum {string}
+ */
+Health.Kind = {
+  LIVENESS: 'liveness',
+  READINESS: 'readiness',
+};
+
+/**
+ * The result of a check.
+ * @typedef {{ok: boolean, message: string}}
+ */
+Health.Result;
+
+/**
+ * The status of the server: the results of the relevant checks, by
+ * name, and whether they all passed.
+ * @typedef {{ok: boolean, checks: !Object<string, !Health.Result>}}
+ */
+Health.Status;
+
+/**
+ * A collection of checks.
+ * @constructor
+ * @struct
+ */
+Health.Registry = function() {
+  /**
+   * Checks, by name, in order of addition.
+   * @private @const {!Map<string, {kind: !Health.Kind,
+   *                               check: function(): !Health.Result}>}
+   */
+  this.checks_ = new Map();
+};
+
+/**
+ * Add (or replace) a check, computed on demand.  A check that throws
+ * fails, with the exception as its message.
+ * @param {string} name Name of the check.
+ * @param {!Health.Kind} kind Kind of check.
+ * @param {function(): !Health.Result} check The check.
+ */
+Health.Registry.prototype.check = function(name, kind, check) {
+  this.checks_.set(name, {kind: kind, check: check});
+};
+
+/**
+ * Report the current state of a subsystem, replacing any earlier
+ * report (or check) of the same name.
+ * @param {string} name Name of the subsystem.
+ * @param {!Health.Kind} kind Kind of check.
+ * @param {boolean} ok Is it healthy (or ready)?
+ * @param {string} message Description of its state.
+ */
+Health.Registry.prototype.report = function(name, kind, ok, message) {
+  var result = {ok: ok, message: message};
+  this.check(name, kind, function() {return result;});
+};
+
+/**
+ * Run the checks.
+ * @param {!Health.Kind} kind Which checks to run: liveness checks
+ *     only, or all of them.
+ * @return {!Health.Status}
+ */
+Health.Registry.prototype.status = function(kind) {
+  var status = {ok: true, checks: {}};
+  this.checks_.forEach(function(entry, name) {
+    if (kind === Health.Kind.LIVENESS && entry.kind !== kind) return;
+    try {
+      var result = entry.check();
+      result = {ok: Boolean(result.ok), message: String(result.message)};
+    } catch (e) {
+      result = {ok: false, message: String(e)};
+    }
+    status.checks[name] = result;
+    if (!result.ok) status.ok = false;
+  });
+  return status;
+};
+
+/**
+ * A server exposing a registry's checks at /healthz and /readyz.
+ * @constructor
+ * @struct
+ * @param {!Health.Registry} registry The checks to expose.
+ */
+Health.Server = function(registry) {
+  /** @const {!Health.Registry} */
+  this.registry = registry;
+  /** @private @const {!http.Server} */
+  this.server_ = http.createServer(this.handle_.bind(this));
+};
+
+/**
+ * Start listening for requests.
+ * @param {number} port The port to listen on.
+ * @param {string=} host The address to listen on (default: all).
+ * @return {!Promise<number>} Resolves to the port listened on.
+ */
+Health.Server.prototype.listen = function(port, host) {
+  var server = this.server_;
+  return new Promise(function(resolve, reject) {
+    server.once('error', reject);
+    server.listen(port, host, function() {
+      server.removeListener('error', reject);
+      resolve(server.address().port);
+    });
+  });
+};
+
+/**
+ * Stop listening for requests.
+ * @return {!Promise<void>} Resolves once all connections have closed.
+ */
+Health.Server.prototype.close = function() {
+  var server = this.server_;
+  return new Promise(function(resolve) {
+    server.close(function() {resolve();});
+  });
+};
+
+/**
+ * Handle an HTTP request.
+ * @private
+ * @param {!http.IncomingMessage} req The request.
+ * @param {!http.ServerResponse} res The response.
+ */
+Health.Server.prototype.handle_ = function(req, res) {
+  req.resume();
+  var path = new URL(req.url, 'http://localhost').pathname;
+  var kind = {'/healthz': Health.Kind.LIVENESS,
+              '/readyz': Health.Kind.READINESS}[path];
+  if (!kind) {
+    res.writeHead(404, {'Content-Type': 'text/plain'});
+    res.end('Not Found\n');
+    return;
+  } else if (req.method !== 'GET' && req.method !== 'HEAD') {
+    res.writeHead(405, {'Content-Type': 'text/plain', 'Allow': 'GET, HEAD'});
+    res.end('Method Not Allowed\n');
+    return;
+  }
+  var status = this.registry.status(kind);
+  var body = JSON.stringify({
+    status: status.ok ? 'ok' : 'fail',
+    checks: status.checks,
+  }, undefined, 2) + '\n';
+  res.writeHead(status.ok ? 200 : 503, {
+    'Content-Type': 'application/json; charset=utf-8',
+    'Content-Length': Buffer.byteLength(body),
+    'Cache-Control': 'no-store',
+  });
+  res.end(req.method === 'HEAD' ? undefined : body);
+};
+
+module.exports = Health;
@@ -0,0 +1,279 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Queries of the in-world object graph, for answering
+ * questions like "why won't this object be garbage collected?" and
+ * "what still refers to the deleted player?".
+ *
+ * The graph's nodes are in-world objects, scopes and threads; its
+ * edges are the references between them: properties, prototypes and
+ * owners of objects, variables of scopes, the scopes of functions,
+ * and whatever the states on threads' stacks hold.  Its roots are the
+ * references the interpreter itself holds (see
+ * Interpreter.prototype.getRoots): the global scope, builtins,
+ * threads, listeners, connections and so on.  Anything not reachable
+ * from a root is garbage.  The entries of WeakMaps, being weak, are
+ * not edges.
+ *
+ * Every query walks the whole (reachable) graph, so is too slow to be
+ * made often.
+ */
+'use strict';
+
+var Interpreter = require('./interpreter');
+
+var Heap = {};
+
+/**
+ * Estimated size (in bytes) of an object, scope or thread, not
+ * counting its properties.
+ * @const {number}
+ */
+Heap.NODE_SIZE = 64;
+
+/**
+ * Estimated size (in bytes) of a property (or variable), not counting
+ * the characters of its name or of a string value.
+ * @const {number}
+ */
+Heap.PROPERTY_SIZE = 32;
+
+/**
+ * A node of the graph.
+ * @typedef {!Interpreter.prototype.Object|!Interpreter.Scope|
+ *     !Interpreter.Thread}
+ */
+Heap.Node;
+
+/**
+ * Is a value a node of the graph?
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {*} value The value.
+ * @return {boolean} True iff it is an object, scope or thread.
+ */
+Heap.isNode = function(intrp, value) {
+  return value instanceof intrp.Object ||
+      value instanceof Interpreter.Scope ||
+      value instanceof Interpreter.Thread;
+};
+
+/**
+ * List the references from a node to other nodes.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Heap.Node} node The node.
+ * @return {!Array<!Interpreter.Reference>} The references (each value
+ *     being a node).
+ */
+Heap.references = function(intrp, node) {
+  var refs = [];
+  if (node instanceof intrp.Object) {
+    refs.push({name: '[[Prototype]]', value: node.proto},
+              {name: '[[Owner]]', value: node.owner});
+    var keys = Object.getOwnPropertyNames(node.properties);
+    for (var i = 0; i < keys.length; i++) {
+      refs.push({name: keys[i], value: node.properties[keys[i]]});
+    }
+    if (node instanceof intrp.UserFunction) {
+      refs.push({name: '[[Scope]]', value: node.scope});
+    } else if (node instanceof intrp.BoundFunction) {
+      refs.push({name: '[[BoundTargetFunction]]', value: node.boundFunc},
+                {name: '[[BoundThis]]', value: node.thisVal});
+      for (i = 0; i < node.args.length; i++) {
+        refs.push({name: '[[BoundArguments]][' + i + ']',
+                   value: node.args[i]});
+      }
+    } else if (node instanceof intrp.Thread) {
+      refs.push({name: '[[Thread]]', value: node.thread});
+    }
+  } else if (node instanceof Interpreter.Scope) {
+    for (var name in node.vars) {
+      refs.push({name: name, value: node.vars[name]});
+    }
+    refs.push({name: '[[OuterScope]]', value: node.outerScope},
+              {name: '[[This]]', value: node.this},
+              {name: '[[Owner]]', value: node.perms});
+  } else {
+    refs = node.references();
+  }
+  return refs.filter(function(ref) {
+    return Heap.isNode(intrp, ref.value);
+  });
+};
+
+/**
+ * Estimate the size of a node (not counting the nodes it refers to).
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Heap.Node} node The node.
+ * @return {number} The estimated size, in bytes.
+ */
+Heap.sizeOf = function(intrp, node) {
+  var values = (node instanceof intrp.Object) ? node.properties :
+      (node instanceof Interpreter.Scope) ? node.vars : {};
+  var size = Heap.NODE_SIZE;
+  var keys = Object.getOwnPropertyNames(values);
+  for (var i = 0; i < keys.length; i++) {
+    var value = values[keys[i]];
+    size += Heap.PROPERTY_SIZE + 2 * keys[i].length +
+        ((typeof value === 'string') ? 2 * value.length : 0);
+  }
+  return size;
+};
+
+/**
+ * Walk the graph breadth first, from the roots, calling a function for
+ * each reference from a root or reachable node.
+ * @private
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {?Heap.Node} avoid A node not to walk through (though
+ *     references to it are still visited), or null.
+ * @param {function(?Heap.Node, !Interpreter.Reference, boolean)} visit
+ *     Called with the node (or null, for a root) each reference is
+ *     from, the reference, and whether this is the first reference to
+ *     its value to be visited.
+ * @return {!Set<!Heap.Node>} The nodes reached.
+ */
+Heap.walk_ = function(intrp, avoid, visit) {
+  var reached = new Set();
+  var queue = [];
+  var follow = function(from, ref) {
+    var first = !reached.has(ref.value);
+    if (first) {
+      reached.add(ref.value);
+      if (ref.value !== avoid) queue.push(ref.value);
+    }
+    visit(from, ref, first);
+  };
+  intrp.getRoots().forEach(function(root) {
+    if (Heap.isNode(intrp, root.value)) follow(null, root);
+  });
+  for (var i = 0; i < queue.length; i++) {
+    var node = queue[i];
+    var refs = Heap.references(intrp, node);
+    for (var j = 0; j < refs.length; j++) {
+      follow(node, refs[j]);
+    }
+  }
+  return reached;
+};
+
+/**
+ * List all the nodes reachable from the roots (i.e., that are not
+ * garbage).
+ * @param {!Interpreter} intrp The interpreter.
+ * @return {!Set<!Heap.Node>} The nodes.
+ */
+Heap.reachable = function(intrp) {
+  return Heap.walk_(intrp, null, function() {});
+};
+
+/**
+ * Find the references to a node (from roots and reachable nodes).
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Heap.Node} target The node.
+ * @param {number=} limit Maximum number of references to find (default:
+ *     no limit).
+ * @return {{references: !Array<{from: ?Heap.Node, name: string}>,
+ *     truncated: boolean}} The references (from being null for roots),
+ *     and whether there were more than limit.
+ */
+Heap.inbound = function(intrp, target, limit) {
+  limit = (limit === undefined) ? Infinity : limit;
+  var references = [];
+  var truncated = false;
+  Heap.walk_(intrp, null, function(from, ref) {
+    if (ref.value !== target) return;
+    if (references.length >= limit) {
+      truncated = true;
+    } else {
+      references.push({from: from, name: ref.name});
+    }
+  });
+  return {references: references, truncated: truncated};
+};
+
+/**
+ * Find paths from roots to a node: the shortest path ending with each
+ * reference to it, shortest paths first.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Heap.Node} target The node.
+ * @param {number=} limit Maximum number of paths to find (default: no
+ *     limit).
+ * @return {{paths: !Array<!Array<!Interpreter.Reference>>,
+ *     truncated: boolean}} The paths, each being the references
+ *     followed (beginning with a root, and ending with a reference to
+ *     the target); and whether there were more than limit.  There are
+ *     none if the target is garbage.
+ */
+Heap.paths = function(intrp, target, limit) {
+  limit = (limit === undefined) ? Infinity : limit;
+  var /** !Map<!Heap.Node, {from: ?Heap.Node,
+                            ref: !Interpreter.Reference}> */
+      parents = new Map();
+  var last = [];  // Final references of paths, in order found.
+  var truncated = false;
+  Heap.walk_(intrp, target, function(from, ref, first) {
+    if (first) parents.set(ref.value, {from: from, ref: ref});
+    if (ref.value !== target) return;
+    if (last.length >= limit) {
+      truncated = true;
+    } else {
+      last.push({from: from, ref: ref});
+    }
+  });
+  var paths = last.map(function(step) {
+    var path = [];
+    for (; step; step = step.from && parents.get(step.from)) {
+      path.unshift(step.ref);
+    }
+    return path;
+  });
+  return {paths: paths, truncated: truncated};
+};
+
+/**
+ * Compute the retained size of a node: the (estimated) size of the
+ * nodes that would become garbage if it did (i.e., were no longer
+ * referred to), including itself.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Heap.Node} target The node.
+ * @return {{nodes: number, size: number}} The number of nodes retained,
+ *     and their total size (in bytes).
+ */
+Heap.retained = function(intrp, target) {
+  // Everything reachable other than through the target.
+  var reached = Heap.walk_(intrp, target, function() {});
+  var retained = new Set([target]);
+  var queue = [target];
+  var size = 0;
+  for (var i = 0; i < queue.length; i++) {
+    var node = queue[i];
+    size += Heap.sizeOf(intrp, node);
+    var refs = Heap.references(intrp, node);
+    for (var j = 0; j < refs.length; j++) {
+      var value = refs[j].value;
+      if (retained.has(value) || (reached.has(value) && value !== target)) {
+        continue;
+      }
+      retained.add(value);
+      queue.push(value);
+    }
+  }
+  return {nodes: retained.size, size: size};
+};
+
+module.exports = Heap;
@@ -0,0 +1,479 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Tokenizing, escaping and sanitizing HTML (the
+ * CC.htmlSanitize and CC.htmlEscape builtins).
+ *
+ * The sanitizer is allow-list based: markup is tokenized (leniently,
+ * as a browser would), and only elements and attributes named in a
+ * Html.Policy are kept; everything else is dropped, together with the
+ * content of elements such as <script> and <style> that is not meant
+ * to be displayed.  URL-valued attributes are kept only if their
+ * scheme (after decoding character references, and ignoring the
+ * whitespace and control characters that browsers ignore) is one of
+ * the policy's protocols.  Elements and attributes that can run
+ * script or load active content (event handlers, style, <iframe>,
+ * etc.) are never allowed, whatever the policy says.  The result is
+ * well-formed: every element kept is closed, and properly nested.
+ */
+'use strict';
+
+var Html = {};
+
+/**
+ * A token of HTML: text (or the raw content of an element such as
+ * <script>), a start tag (with its attributes, as [name, value, raw
+ * value] triples, names in lower case and values decoded), an end
+ * tag, or a comment (including doctypes and processing instructions).
+ * Text, raw and comment tokens have the text as found in .raw, and
+ * text tokens also decoded in .text.
+ * @typedef {{type: string, name: (string|undefined),
+ *            attrs: (!Array<!Array<string>>|undefined),
+ *            selfClosing: (boolean|undefined),
+ *            text: (string|undefined), raw: (string|undefined)}}
+ */
+Html.Token;
+
+/**
+ * What the sanitizer allows: the attributes allowed on each allowed
+ * element (by lower case name), and the schemes allowed in URLs.
+ * @typedef {{elements: !Object<string, !Array<string>>,
+ *            protocols: !Array<string>}}
+ */
+Html.Policy;
+
+/**
+ * The default policy: common formatting, lists, tables, links and
+ * images.
+ * @const {!Html.Policy}
+ */
+Html.DEFAULT_POLICY = {
+  elements: {
+    'a': ['href', 'title'],
+    'abbr': ['title'],
+    'b': [], 'blockquote': ['cite'], 'br': [], 'code': [],
+    'dd': [], 'del': [], 'div': [], 'dl': [], 'dt': [], 'em': [],
+    'h1': [], 'h2': [], 'h3': [], 'h4': [], 'h5': [], 'h6': [],
+    'hr': [], 'i': [],
+    'img': ['src', 'alt', 'title', 'width', 'height'],
+    'ins': [], 'kbd': [], 'li': [], 'ol': ['start'], 'p': [], 'pre': [],
+    's': [], 'small': [], 'span': [], 'strong': [], 'sub': [], 'sup': [],
+    'table': [], 'tbody': [], 'td': ['colspan', 'rowspan'], 'tfoot': [],
+    'th': ['colspan', 'rowspan'], 'thead': [], 'tr': [], 'u': [], 'ul': [],
+  },
+  protocols: ['http', 'https', 'mailto'],
+};
+
+/**
+ * Elements that are never allowed, because they run script, load
+ * active content or change how the rest of the page is interpreted.
+ * The content of each is dropped too.
+ * @const {!Array<string>}
+ */
+Html.UNSAFE_ELEMENTS = ['applet', 'base', 'embed', 'frame', 'frameset',
+    'iframe', 'link', 'math', 'meta', 'noembed', 'noframes', 'noscript',
+    'object', 'script', 'style', 'svg', 'template', 'title', 'xmp'];
+
+/**
+ * Attributes that are never allowed (besides event handlers, whose
+ * names begin with "on").
+ * @const {!Array<string>}
+ */
+Html.UNSAFE_ATTRIBUTES = ['style', 'srcdoc', 'srcset', 'formaction'];
+
+/**
+ * Attributes whose values are URLs.
+ * @const {!Array<string>}
+ */
+Html.URL_ATTRIBUTES = ['action', 'background', 'cite', 'href', 'longdesc',
+                       'poster', 'src'];
+
+/**
+ * Elements that have no content (nor end tag).
+ * @const {!Array<string>}
+ */
+Html.VOID_ELEMENTS = ['area', 'base', 'br', 'col', 'embed', 'hr', 'img',
+    'input', 'link', 'meta', 'param', 'source', 'track', 'wbr'];
+
+/**
+ * Elements whose start tags implicitly end an open element of the same
+ * group (e.g., <li> ends the previous <li>).
+ * @const {!Object<string, !Array<string>>}
+ */
+Html.IMPLIED_END = {
+  'dd': ['dd', 'dt'], 'dt': ['dd', 'dt'], 'li': ['li'], 'p': ['p'],
+  'td': ['td', 'th'], 'th': ['td', 'th'], 'tr': ['td', 'th', 'tr'],
+};
+
+/**
+ * Elements whose content is raw text, up to the matching end tag.
+ * @const {!Array<string>}
+ */
+Html.RAW_TEXT_ELEMENTS = ['iframe', 'noembed', 'noframes', 'noscript',
+    'script', 'style', 'textarea', 'title', 'xmp'];
+
+/**
+ * Maximum length (in characters) of HTML to tokenize.
+ * @const {number}
+ */
+Html.MAX_LENGTH = 1024 * 1024;
+
+/**
+ * Maximum depth of nested elements kept by the sanitizer; more deeply
+ * nested ones are dropped (but not their content).
+ * @const {number}
+ */
+Html.MAX_DEPTH = 100;
+
+/**
+ * Estimated speed (characters processed per ms), for computing the
+ * cost of operations.
+ * @const {number}
+ */
+Html.SPEED = 20 * 1024;
+
+/**
+ * Named character references decoded (besides numeric ones).  Others
+ * are left as they are.
+ * @const {!Object<string, string>}
+ */
+Html.ENTITIES = {
+  'amp': '&', 'lt': '<', 'gt': '>', 'quot': '"', 'apos': "'", 'nbsp': '\u00a0',
+  'copy': '\u00a9', 'reg': '\u00ae', 'trade': '\u2122', 'hellip': '\u2026',
+  'mdash': '\u2014', 'ndash': '\u2013', 'lsquo': '\u2018', 'rsquo': '\u2019',
+  'ldquo': '\u201c', 'rdquo': '\u201d', 'laquo': '\u00ab', 'raquo': '\u00bb',
+  'middot': '\u00b7', 'bull': '\u2022', 'deg': '\u00b0', 'times': '\u00d7',
+  'divide': '\u00f7', 'euro': '\u20ac', 'pound': '\u00a3', 'yen': '\u00a5',
+  'cent': '\u00a2', 'sect': '\u00a7', 'para': '\u00b6',
+};
+
+/**
+ * Estimated cost (in ms) of tokenizing or sanitizing some HTML.
+ * @param {string} html The HTML.
+ * @return {number} The cost.
+ */
+Html.cost = function(html) {
+  return html.length / Html.SPEED;
+};
+
+/**
+ * Escape text for inclusion in HTML (as content or an attribute value).
+ * @param {string} text The text.
+ * @return {string} The HTML.
+ */
+Html.escape = function(text) {
+  return text.replace(/[&<>"']/g, function(c) {
+    return {'&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;',
+            "'": '&#39;'}[c];
+  });
+};
+
+/**
+ * Escape HTML text that may contain character references: as
+ * Html.escape, but leaving well-formed references intact.
+ * @private
+ * @param {string} raw The text.
+ * @return {string} The HTML.
+ */
+Html.escapeRaw_ = function(raw) {
+  return raw.replace(Html.UNESCAPED_RE_, Html.escape);
+};
+
+/**
+ * Characters to escape in HTML text that may contain character
+ * references: &, unless it begins one, and <, >, " and '.
+ * @private @const {!RegExp}
+ */
+Html.UNESCAPED_RE_ = new RegExp('&(?![a-zA-Z][a-zA-Z0-9]*;|' +
+    '#[0-9]{1,7};|#[xX][0-9a-fA-F]{1,6};)|[<>"\']', 'g');
+
+/**
+ * Character references decoded by Html.decode.
+ * @private @const {!RegExp}
+ */
+Html.REFERENCE_RE_ = new RegExp('&(?:#([0-9]{1,7});?|' +
+    '#[xX]([0-9a-fA-F]{1,6});?|([a-zA-Z][a-zA-Z0-9]*);)', 'g');
+
+/**
+ * Decode the character references in some text: numeric ones (with or
+ * without the trailing semicolon, as browsers allow) and those named
+ * in Html.ENTITIES.
+ * @param {string} text The text.
+ * @return {string} The decoded text.
+ */
+Html.decode = function(text) {
+  if (!text.includes('&')) return text;
+  return text.replace(Html.REFERENCE_RE_, function(ref, dec, hex, name) {
+    if (name !== undefined) {
+      return Html.ENTITIES.hasOwnProperty(name) ? Html.ENTITIES[name] : ref;
+    }
+    var code = (dec !== undefined) ? parseInt(dec, 10) : parseInt(hex, 16);
+    if (code === 0 || code > 0x10ffff || (code >= 0xd800 && code <= 0xdfff)) {
+      return '\ufffd';
+    }
+    return String.fromCodePoint(code);
+  });
+};
+
+/**
+ * Tokenize some HTML, leniently: anything that is not well-formed
+ * markup is treated as text (so "a < b" is text, as is an unclosed
+ * tag at the end).
+ * @param {string} html The HTML.
+ * @return {!Array<!Html.Token>} The tokens.
+ */
+Html.tokenize = function(html) {
+  if (html.length > Html.MAX_LENGTH) throw new RangeError('HTML too long');
+  var tokens = [];
+  var text = '';
+  var flush = function() {
+    if (text) tokens.push({type: 'text', text: Html.decode(text), raw: text});
+    text = '';
+  };
+  var tagRe = /<([a-zA-Z][^\s/>]*)/y;
+  var endRe = /<\/([a-zA-Z][^\s/>]*)[^>]*>/y;
+  // An attribute (name, then value double-quoted, single-quoted or
+  // unquoted), or the end of the tag.
+  var attrRe = new RegExp('[\\s/]*(?:([^\\s/>=]+)(?:\\s*=\\s*' +
+      '(?:"([^"]*)"|\'([^\']*)\'|([^\\s>]+)))?|(>))', 'y');
+  var i = 0;
+  while (i < html.length) {
+    var lt = html.indexOf('<', i);
+    if (lt === -1) {
+      text += html.slice(i);
+      break;
+    }
+    text += html.slice(i, lt);
+    i = lt;
+    if (html.startsWith('<!--', i)) {
+      var end = html.indexOf('-->', i + 4);
+      end = (end === -1) ? html.length : end + 3;
+      flush();
+      tokens.push({type: 'comment', raw: html.slice(i, end)});
+      i = end;
+      continue;
+    } else if (/^<[!?]/.test(html.slice(i, i + 2))) {
+      end = html.indexOf('>', i);
+      end = (end === -1) ? html.length : end + 1;
+      flush();
+      tokens.push({type: 'comment', raw: html.slice(i, end)});
+      i = end;
+      continue;
+    }
+    endRe.lastIndex = i;
+    var m = endRe.exec(html);
+    if (m) {
+      flush();
+      tokens.push({type: 'end', name: m[1].toLowerCase()});
+      i = endRe.lastIndex;
+      continue;
+    }
+    tagRe.lastIndex = i;
+    m = tagRe.exec(html);
+    if (!m) {
+      text += '<';
+      i++;
+      continue;
+    }
+    var name = m[1].toLowerCase();
+    var attrs = [];
+    var closed = false;
+    var selfClosing = false;
+    var j = tagRe.lastIndex;
+    for (;;) {
+      attrRe.lastIndex = j;
+      var a = attrRe.exec(html);
+      if (!a) break;
+      j = attrRe.lastIndex;
+      if (a[5]) {
+        closed = true;
+        selfClosing = html[j - 2] === '/';
+        break;
+      }
+      var raw = (a[2] !== undefined) ? a[2] :
+          (a[3] !== undefined) ? a[3] : (a[4] !== undefined) ? a[4] : '';
+      var attrName = a[1].toLowerCase();
+      if (!attrs.some((attr) => attr[0] === attrName)) {
+        attrs.push([attrName, Html.decode(raw), raw]);
+      }
+    }
+    if (!closed) {
+      // Unterminated tag: the rest is text.
+      text += html.slice(i);
+      break;
+    }
+    flush();
+    tokens.push({type: 'start', name: name, attrs: attrs,
+                 selfClosing: selfClosing});
+    i = j;
+    if (Html.RAW_TEXT_ELEMENTS.includes(name)) {
+      var close = html.slice(i).search(
+          new RegExp('</' + name + '[\\s/>]', 'i'));
+      end = (close === -1) ? html.length : i + close;
+      if (end > i) {
+        var content = html.slice(i, end);
+        tokens.push({type: 'raw', text: content, raw: content});
+      }
+      i = end;
+    }
+  }
+  flush();
+  return tokens;
+};
+
+/**
+ * Check that a policy (e.g., from in-world code) is valid, and remove
+ * anything it allows that is never allowed.
+ * @param {!Html.Policy} policy The policy.
+ * @return {!Html.Policy} The policy, made safe.
+ */
+Html.checkPolicy = function(policy) {
+  var elements = Object.create(null);
+  for (var name in policy.elements) {
+    var attrs = policy.elements[name];
+    if (!Array.isArray(attrs)) {
+      throw new TypeError('Attributes of ' + name + ' must be an array');
+    }
+    name = String(name).toLowerCase();
+    if (Html.UNSAFE_ELEMENTS.includes(name)) continue;
+    elements[name] = attrs.map((attr) => String(attr).toLowerCase())
+        .filter((attr) => !Html.isUnsafeAttribute_(attr));
+  }
+  if (!Array.isArray(policy.protocols)) {
+    throw new TypeError('protocols must be an array');
+  }
+  var protocols = policy.protocols.map((p) => String(p).toLowerCase())
+      .filter((p) => p !== 'javascript' && p !== 'vbscript' && p !== 'data');
+  return {elements: elements, protocols: protocols};
+};
+
+/**
+ * Is an attribute never allowed?
+ * @private
+ * @param {string} name The attribute's (lower case) name.
+ * @return {boolean}
+ */
+Html.isUnsafeAttribute_ = function(name) {
+  return name.startsWith('on') || Html.UNSAFE_ATTRIBUTES.includes(name) ||
+      name.includes(':');
+};
+
+/**
+ * Is a URL safe under a policy?
+ * @param {string} url The URL (with character references decoded).
+ * @param {!Html.Policy} policy The policy.
+ * @return {boolean} True iff the URL is relative, or has one of the
+ *     policy's protocols.
+ */
+Html.isSafeUrl = function(url, policy) {
+  // Browsers ignore tabs and newlines anywhere in a URL, and leading
+  // control characters and spaces.
+  url = url.replace(/[\t\n\r]/g, '').replace(/^[\x00-\x20]+/, '');
+  if (/&[a-zA-Z][a-zA-Z0-9]*;/.test(url)) {
+    return false;  // An undecoded reference might hide the scheme.
+  }
+  var m = url.match(/^([^/?#]*?):/);
+  return !m || policy.protocols.includes(m[1].toLowerCase());
+};
+
+/**
+ * Sanitize some HTML.
+ * @param {string} html The HTML.
+ * @param {!Html.Policy=} policy What to allow (default
+ *     Html.DEFAULT_POLICY).  Should have been checked with
+ *     Html.checkPolicy if it did not come from trusted code.
+ * @return {string} The sanitized HTML.
+ */
+Html.sanitize = function(html, policy) {
+  policy = policy || Html.DEFAULT_POLICY;
+  var tokens = Html.tokenize(html);
+  var out = [];
+  var open = [];  // Names of allowed elements open in out.
+  var dropping = null;  // Name of unsafe element being skipped.
+  var dropDepth = 0;
+  for (var i = 0; i < tokens.length; i++) {
+    var token = tokens[i];
+    var name = token.name;
+    if (dropping) {
+      // Skip everything until the unsafe element ends.
+      if (token.type === 'start' && name === dropping &&
+          !Html.VOID_ELEMENTS.includes(name)) {
+        dropDepth++;
+      } else if (token.type === 'end' && name === dropping && !--dropDepth) {
+        dropping = null;
+      }
+      continue;
+    }
+    switch (token.type) {
+      case 'text':
+        out.push(Html.escapeRaw_(/** @type {string} */(token.raw)));
+        break;
+      case 'raw':
+        // Content of an allowed raw text element (e.g., <textarea>).
+        out.push(Html.escape(/** @type {string} */(token.text)));
+        break;
+      case 'start':
+        if (Html.UNSAFE_ELEMENTS.includes(name) ||
+            Html.RAW_TEXT_ELEMENTS.includes(name) &&
+            !Object.prototype.hasOwnProperty.call(policy.elements, name)) {
+          if (!Html.VOID_ELEMENTS.includes(name) && !token.selfClosing) {
+            dropping = name;
+            dropDepth = 1;
+          }
+          break;
+        }
+        if (!Object.prototype.hasOwnProperty.call(policy.elements, name) ||
+            open.length >= Html.MAX_DEPTH) {
+          break;
+        }
+        var implied = Html.IMPLIED_END[name];
+        while (implied && implied.includes(open[open.length - 1])) {
+          out.push('</' + open.pop() + '>');
+        }
+        var allowed = policy.elements[name];
+        var tag = '<' + name;
+        for (var j = 0; j < token.attrs.length; j++) {
+          var attr = token.attrs[j];
+          if (!allowed.includes(attr[0]) ||
+              Html.isUnsafeAttribute_(attr[0])) {
+            continue;
+          }
+          if (Html.URL_ATTRIBUTES.includes(attr[0])) {
+            if (!Html.isSafeUrl(attr[1], policy)) continue;
+            tag += ' ' + attr[0] + '="' + Html.escape(attr[1]) + '"';
+          } else {
+            tag += ' ' + attr[0] + '="' + Html.escapeRaw_(attr[2]) + '"';
+          }
+        }
+        out.push(tag + '>');
+        if (!Html.VOID_ELEMENTS.includes(name)) open.push(name);
+        break;
+      case 'end':
+        var index = open.lastIndexOf(name);
+        if (index === -1) break;
+        // Close any elements left open within this one.
+        while (open.length > index) out.push('</' + open.pop() + '>');
+        break;
+      // Comments are dropped.
+    }
+  }
+  while (open.length) out.push('</' + open.pop() + '>');
+  return out.join('');
+};
+
+module.exports = Html;
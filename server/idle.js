@@ -0,0 +1,142 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Idle timeouts for connections: a connection from which
+ * nothing has been received for some time is warned, and then (if it
+ * stays idle) disconnected.
+ */
+'use strict';
+
+var Idle = {};
+
+/**
+ * Tracks the activity of one connection.  Disabled until .set is
+ * called with a non-zero timeout.
+ * @constructor
+ * @struct
+ * @param {function(number)} onWarning Called (with the time, in ms,
+ *     until the timeout) once the connection has been idle for the
+ *     timeout less the warning period.  Not called again unless there
+ *     is further activity.
+ * @param {function()} onTimeout Called once the connection has been
+ *     idle for the whole timeout, after which the timer stops.
+ */
+Idle.Timer = function(onWarning, onTimeout) {
+  /** @type {number} Idle time (in ms) allowed, or 0 if unlimited. */
+  this.timeout = 0;
+  /** @type {number} Time (in ms) before the timeout to warn at. */
+  this.warning = 0;
+  /** @private @const {function(number)} */
+  this.onWarning_ = onWarning;
+  /** @private @const {function()} */
+  this.onTimeout_ = onTimeout;
+  /** @private @type {number} Time (as from Date.now()) of last activity. */
+  this.last_ = Date.now();
+  /** @private @type {boolean} Has the warning been given? */
+  this.warned_ = false;
+  /** @private @type {boolean} Has the timer been stopped? */
+  this.stopped_ = false;
+  /**
+   * Pending timeout, or null if none.  N.B. that activity does not
+   * reschedule it; instead, it is rescheduled as it fires.
+   * @private @type {?Object}
+   */
+  this.timer_ = null;
+};
+
+/**
+ * Set (or change) the timeout.  Activity is counted from the last
+ * activity (or from construction), not from the change.
+ * @param {number} timeout Idle time (in ms) allowed, or 0 for no limit.
+ * @param {number=} warning Time (in ms) before the timeout to warn at.
+ *     (Default: none.)  Values larger than timeout warn immediately.
+ */
+Idle.Timer.prototype.set = function(timeout, warning) {
+  if (!(timeout >= 0) || timeout === Infinity) {
+    throw new RangeError('timeout must be a non-negative number');
+  } else if (warning !== undefined && (!(warning >= 0) ||
+                                       warning === Infinity)) {
+    throw new RangeError('warning must be a non-negative number');
+  }
+  this.timeout = timeout;
+  this.warning = Math.min(warning || 0, timeout);
+  this.schedule_();
+};
+
+/**
+ * Record activity on the connection.
+ */
+Idle.Timer.prototype.touch = function() {
+  this.last_ = Date.now();
+  this.warned_ = false;
+  if (!this.timer_) this.schedule_();
+};
+
+/**
+ * Time (in ms) until the connection times out, if it remains idle.
+ * @return {number} The time, or Infinity if there is no timeout.
+ */
+Idle.Timer.prototype.remaining = function() {
+  if (this.stopped_ || !this.timeout) return Infinity;
+  return Math.max(0, this.last_ + this.timeout - Date.now());
+};
+
+/**
+ * Stop the timer for good (e.g., once the connection has closed).
+ */
+Idle.Timer.prototype.stop = function() {
+  this.stopped_ = true;
+  clearTimeout(this.timer_);
+  this.timer_ = null;
+};
+
+/**
+ * Schedule a check for the next time a warning or the timeout might
+ * be due.
+ * @private
+ */
+Idle.Timer.prototype.schedule_ = function() {
+  clearTimeout(this.timer_);
+  this.timer_ = null;
+  if (this.stopped_ || !this.timeout) return;
+  var due = this.last_ + this.timeout;
+  if (this.warning && !this.warned_) due -= this.warning;
+  this.timer_ = setTimeout(this.check_.bind(this),
+                           Math.max(0, due - Date.now()));
+};
+
+/**
+ * Warn or time out, if due; then reschedule.
+ * @private
+ */
+Idle.Timer.prototype.check_ = function() {
+  this.timer_ = null;
+  var idle = Date.now() - this.last_;
+  if (idle >= this.timeout) {
+    this.stop();
+    this.onTimeout_();
+    return;
+  } else if (this.warning && !this.warned_ &&
+             idle >= this.timeout - this.warning) {
+    this.warned_ = true;
+    this.onWarning_(this.timeout - idle);
+  }
+  this.schedule_();
+};
+
+module.exports = Idle;
@@ -0,0 +1,336 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Rendering of arbitrary in-world values as text, for
+ * debugging, in the manner of Node's util.inspect (see CC.inspect).
+ * Properties are read with the permissions of whoever is inspecting,
+ * so an inspection reveals nothing they could not have found out for
+ * themselves; any that cannot be read are shown as [unreadable].
+ */
+'use strict';
+
+var Inspect = {};
+
+/**
+ * Default depth to which nested objects are rendered.
+ * @const {number}
+ */
+Inspect.DEPTH = 2;
+
+/**
+ * Default maximum number of properties (or array elements) of an
+ * object to render.
+ * @const {number}
+ */
+Inspect.MAX_ITEMS = 100;
+
+/**
+ * Maximum length of a rendering that is put on one line.
+ * @const {number}
+ */
+Inspect.LINE_LENGTH = 72;
+
+/**
+ * Maximum length of a rendering.  Anything longer is truncated.
+ * @const {number}
+ */
+Inspect.MAX_LENGTH = 100000;
+
+/**
+ * ANSI escape codes (start and end) with which to color each kind of
+ * value, if colors are wanted.
+ * @const {!Object<string, !Array<string>>}
+ */
+Inspect.STYLES = {
+  'undefined': ['\x1b[90m', '\x1b[39m'],  // Grey.
+  'null': ['\x1b[1m', '\x1b[22m'],  // Bold.
+  'boolean': ['\x1b[33m', '\x1b[39m'],  // Yellow.
+  'number': ['\x1b[33m', '\x1b[39m'],  // Yellow.
+  'string': ['\x1b[32m', '\x1b[39m'],  // Green.
+  'special': ['\x1b[36m', '\x1b[39m'],  // Cyan (functions, circular).
+  'date': ['\x1b[35m', '\x1b[39m'],  // Magenta.
+  'regexp': ['\x1b[31m', '\x1b[39m'],  // Red.
+};
+
+/**
+ * Options for Inspect.inspect:
+ *
+ * - depth: how deeply to render nested objects (default Inspect.DEPTH;
+ *   may be Infinity).  Deeper ones are shown as (e.g.) [Object].
+ * - colors: whether to color values with ANSI escape codes.
+ * - hidden: whether to include non-enumerable properties.
+ * - attributes: whether to show each property's attributes, as (e.g.)
+ *   <w-c> for one that is writable and configurable but not
+ *   enumerable.
+ * - maxItems: maximum number of properties of each object to render
+ *   (default Inspect.MAX_ITEMS).
+ * @typedef {{depth: (number|undefined),
+ *            colors: (boolean|undefined),
+ *            hidden: (boolean|undefined),
+ *            attributes: (boolean|undefined),
+ *            maxItems: (number|undefined)}}
+ */
+Inspect.Options;
+
+/**
+ * Render a value as text.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {?Interpreter.Value} value The value.
+ * @param {!Interpreter.Owner} perms Who is inspecting it.
+ * @param {!Inspect.Options=} options Options.
+ * @return {string} The rendering.
+ */
+Inspect.inspect = function(intrp, value, perms, options) {
+  options = options || {};
+  var inspector = new Inspect.Inspector_(intrp, perms, {
+    depth: (options.depth === undefined) ? Inspect.DEPTH : options.depth,
+    colors: Boolean(options.colors),
+    hidden: Boolean(options.hidden),
+    attributes: Boolean(options.attributes),
+    maxItems: (options.maxItems === undefined) ? Inspect.MAX_ITEMS :
+        options.maxItems,
+  });
+  var text = inspector.render_(value, 0);
+  if (text.length > Inspect.MAX_LENGTH) {
+    text = text.slice(0, Inspect.MAX_LENGTH) + '...';
+  }
+  return text;
+};
+
+/**
+ * State of one inspection.
+ * @private
+ * @constructor
+ * @struct
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Interpreter.Owner} perms Who is inspecting.
+ * @param {!Inspect.Options} options Options (all given).
+ */
+Inspect.Inspector_ = function(intrp, perms, options) {
+  /** @private @const {!Interpreter} */
+  this.intrp_ = intrp;
+  /** @private @const {!Interpreter.Owner} */
+  this.perms_ = perms;
+  /** @private @const {!Inspect.Options} */
+  this.options_ = options;
+  /**
+   * Objects being rendered (i.e., those enclosing the current one).
+   * @private @const {!Set<!Interpreter.prototype.Object>}
+   */
+  this.seen_ = new Set();
+};
+
+/**
+ * Color some text, if colors are wanted.
+ * @private
+ * @param {string} text The text.
+ * @param {string} style The style (a key of Inspect.STYLES).
+ * @return {string} The text, colored.
+ */
+Inspect.Inspector_.prototype.style_ = function(text, style) {
+  if (!this.options_.colors) return text;
+  return Inspect.STYLES[style][0] + text + Inspect.STYLES[style][1];
+};
+
+/**
+ * Render a value.
+ * @private
+ * @param {?Interpreter.Value} value The value.
+ * @param {number} depth How deeply nested it is.
+ * @return {string} The rendering.
+ */
+Inspect.Inspector_.prototype.render_ = function(value, depth) {
+  var intrp = this.intrp_;
+  if (value === undefined) return this.style_('undefined', 'undefined');
+  if (value === null) return this.style_('null', 'null');
+  switch (typeof value) {
+    case 'boolean':
+      return this.style_(String(value), 'boolean');
+    case 'number':
+      return this.style_(Object.is(value, -0) ? '-0' : String(value),
+                         'number');
+    case 'string':
+      return this.style_(Inspect.quote(value), 'string');
+  }
+  if (!(value instanceof intrp.Object)) {
+    return this.style_('[' + String(value) + ']', 'special');
+  }
+  if (this.seen_.has(value)) return this.style_('[Circular]', 'special');
+
+  var obj = value;
+  var prefix = this.prefix_(obj);
+  var isArray = obj instanceof intrp.Array;
+  var keys;
+  try {
+    keys = this.keys_(obj, isArray);
+  } catch (e) {
+    return (prefix ? prefix + ' ' : '') + '[unreadable]';
+  }
+  if (!keys.length) return prefix || (isArray ? '[]' : '{}');
+  if (depth > this.options_.depth) {
+    return prefix || this.style_('[' + obj.class + ']', 'special');
+  }
+
+  this.seen_.add(obj);
+  var items = [];
+  var limit = Math.min(keys.length, this.options_.maxItems);
+  for (var i = 0; i < limit; i++) {
+    items.push(this.renderProperty_(obj, keys[i], isArray, depth));
+  }
+  if (keys.length > limit) {
+    items.push('... ' + (keys.length - limit) + ' more item' +
+               (keys.length - limit === 1 ? '' : 's'));
+  }
+  this.seen_.delete(obj);
+
+  var open = isArray ? '[' : '{';
+  var close = isArray ? ']' : '}';
+  var start = prefix ? prefix + ' ' + open : open;
+  var oneLine = start + ' ' + items.join(', ') + ' ' + close;
+  if (Inspect.visibleLength_(oneLine) <= Inspect.LINE_LENGTH &&
+      !oneLine.includes('\n')) {
+    return oneLine;
+  }
+  var indent = '  ';
+  return start + '\n' + items.map(function(item) {
+    return indent + item.replace(/\n/g, '\n' + indent);
+  }).join(',\n') + '\n' + close;
+};
+
+/**
+ * List the keys of the properties of an object that are to be
+ * rendered.
+ * @private
+ * @param {!Interpreter.prototype.Object} obj The object.
+ * @param {boolean} isArray Is it an array?
+ * @return {!Array<string>} The keys.
+ */
+Inspect.Inspector_.prototype.keys_ = function(obj, isArray) {
+  var perms = this.perms_;
+  var keys = obj.ownKeys(perms);
+  if (!this.options_.hidden) {
+    keys = keys.filter(function(key) {
+      var pd = obj.getOwnPropertyDescriptor(key, perms);
+      return pd && pd.enumerable;
+    });
+  }
+  if (isArray) {
+    // Array elements first (as bare values), then other properties.
+    keys = keys.filter(Inspect.isIndex_).concat(keys.filter(function(key) {
+      return !Inspect.isIndex_(key);
+    }));
+  }
+  return keys;
+};
+
+/**
+ * Render a property of an object.
+ * @private
+ * @param {!Interpreter.prototype.Object} obj The object.
+ * @param {string} key The property's key.
+ * @param {boolean} isArray Is the object an array?
+ * @param {number} depth How deeply nested the object is.
+ * @return {string} The rendering.
+ */
+Inspect.Inspector_.prototype.renderProperty_ = function(obj, key, isArray,
+                                                         depth) {
+  try {
+    var pd = obj.getOwnPropertyDescriptor(key, this.perms_);
+  } catch (e) {
+    pd = undefined;
+  }
+  var value = pd ? this.render_(pd.value, depth + 1) : '[unreadable]';
+  var name = (isArray && Inspect.isIndex_(key)) ? '' :
+      (/^[A-Za-z_$][\w$]*$/.test(key) ? key : Inspect.quote(key));
+  if (this.options_.attributes && pd) {
+    name += (name ? ' ' : '') + '<' + (pd.writable ? 'w' : '-') +
+        (pd.enumerable ? 'e' : '-') + (pd.configurable ? 'c' : '-') + '>';
+  }
+  return name ? name + ': ' + value : value;
+};
+
+/**
+ * Compute the prefix with which an object is rendered, identifying
+ * what kind of object it is (if not an ordinary object or array): for
+ * example, [Function: foo], 2020-01-01T00:00:00.000Z or /a+/g.
+ * @private
+ * @param {!Interpreter.prototype.Object} obj The object.
+ * @return {string} The prefix, or '' for none.
+ */
+Inspect.Inspector_.prototype.prefix_ = function(obj) {
+  var intrp = this.intrp_;
+  var perms = this.perms_;
+  var get = function(key) {
+    try {
+      return obj.get(key, perms);
+    } catch (e) {
+      return undefined;
+    }
+  };
+  if (obj instanceof intrp.Function) {
+    var name = get('name');
+    return this.style_('[Function' +
+        (typeof name === 'string' && name ? ': ' + name : '') + ']',
+        'special');
+  } else if (obj instanceof intrp.Date) {
+    var date = obj.date;
+    return this.style_(isNaN(date.getTime()) ? 'Invalid Date' :
+                       date.toISOString(), 'date');
+  } else if (obj instanceof intrp.RegExp) {
+    return this.style_(String(obj.regexp), 'regexp');
+  } else if (obj instanceof intrp.Error) {
+    return '[' + String(get('name')) + ': ' + String(get('message')) + ']';
+  } else if (obj instanceof intrp.Thread) {
+    return '[Thread ' + obj.thread.id + ']';
+  } else if (obj instanceof intrp.Array || obj.class === 'Object') {
+    return '';
+  }
+  return obj.class;
+};
+
+/**
+ * Quote a string, with single quotes (as in JavaScript source).
+ * @param {string} s The string.
+ * @return {string} The quoted string.
+ */
+Inspect.quote = function(s) {
+  return "'" + JSON.stringify(s).slice(1, -1).replace(/\\"/g, '"')
+      .replace(/'/g, "\\'") + "'";
+};
+
+/**
+ * Is a key an array index?
+ * @private
+ * @param {string} key The key.
+ * @return {boolean} True iff it is.
+ */
+Inspect.isIndex_ = function(key) {
+  return /^(?:0|[1-9]\d*)$/.test(key) && Number(key) < 4294967295;
+};
+
+/**
+ * Length of text, not counting ANSI escape codes.
+ * @private
+ * @param {string} text The text.
+ * @return {number} The length.
+ */
+Inspect.visibleLength_ = function(text) {
+  return text.replace(/\x1b\[\d+m/g, '').length;
+};
+
+module.exports = Inspect;
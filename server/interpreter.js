@@ -21,13 +21,43 @@
  */
 'use strict';
 
+var Accounts = require('./accounts');
+var Bans = require('./bans');
+var Command = require('./command');
+var crypto = require('crypto');
+var Compression = require('./compression');
+var Cryptography = require('./cryptography');
+var Csv = require('./csv');
+var Edit = require('./edit');
 var events = require('events');
+var Html = require('./html');
 var IterableWeakMap = require('./iterable_weakmap');
+var Logging = require('./logging');
+var Mail = require('./mail');
+var Markdown = require('./markdown');
+var Modules = require('./modules');
 var net = require('net');
+var os = require('os');
 var http = require('http');
 var https = require('https');
+var Idle = require('./idle');
+var Inspect = require('./inspect');
+var packageJson = require('./package.json');
 var parser = require('./parser');
+var Pronouns = require('./pronouns');
+var Proxies = require('./proxies');
+var RateLimit = require('./ratelimit');
+var RegExpGuard = require('./regexp_guard');
 var Registry = require('./registry');
+var Sessions = require('./sessions');
+var SSE = require('./sse');
+var StringDecoder = require('string_decoder').StringDecoder;
+var Telnet = require('./telnet');
+var Text = require('./text');
+var Tiers = require('./tiers');
+var util = require('util');
+var WebSocket = require('./websocket');
+var Xml = require('./xml');
 
 var Node = parser.Node;
 var Parser = parser.Parser;
@@ -36,10 +66,11 @@ var Parser = parser.Parser;
  * Version number for the serialisation format.  MUST be incremented
  * when any change is made to the implementation of Interpreter and
  * related classes (in this file and others) which would change how
- * the runtime state is represented on disk.
+ * the runtime state is represented on disk, and a migration from the
+ * previous version registered in migrate.js.
  * @type {number}
  */
-var SERIALIZATION_VERSION = 1;
+var SERIALIZATION_VERSION = 24;
 
 /**
  * Create a new interpreter.
@@ -59,6 +90,12 @@ var Interpreter = function(options) {
    * @type {number|undefined}
    */
   this.serializationVersion = undefined;
+  /**
+   * Version of the server that most recently serialized this
+   * Interpreter instance (for information only).  Set in .preSerialize.
+   * @type {string|undefined}
+   */
+  this.serverVersion = undefined;
   // Install .Object, .Function, etc.
   this.installTypes();
   /**
@@ -76,6 +113,156 @@ var Interpreter = function(options) {
    * @private @const {!Set<!Interpreter.prototype.Object>}
    */
   this.toStringVisited_ = new Set;
+  /**
+   * Set of objects modified since the last incremental checkpoint, or
+   * null if modifications are not being tracked.  Maintained by the
+   * mutating methods of intrp.Object (and a few builtins that modify
+   * internal slots directly); consumed by
+   * Serializer.serializeIncremental.
+   * @type {?Set<!Interpreter.prototype.Object>}
+   */
+  this.dirtyObjects = null;
+  /**
+   * Audited objects, each with the set of keys of its audited
+   * properties (or null if all are), in the order they were first
+   * audited (see .audit).  Consulted by the property access methods of
+   * intrp.Object, so must exist before any objects are created.  Saved
+   * in checkpoints.
+   * @private @const {!Map<!Interpreter.prototype.Object, ?Set<string>>}
+   */
+  this.audits_ = new Map();
+  /**
+   * Recent accesses to audited properties, oldest first (see
+   * .getAuditLog).  Saved in checkpoints.
+   * @private @const {!Array<!Interpreter.AuditRecord>}
+   */
+  this.auditLog_ = [];
+  /**
+   * Recent security events, oldest first (see .getSecurityEvents), and
+   * the ID of the next.  Saved in checkpoints.
+   * @private @const {!Array<!Interpreter.SecurityEvent>}
+   */
+  this.securityLog_ = [];
+  /** @private @type {number} */
+  this.nextSecurityEventId_ = 1;
+  /**
+   * Watchpoints set by the debugger, by ID (see .setWatchpoint).
+   * Consulted by the mutating methods of intrp.Object, so must exist
+   * before any objects are created.  Saved in checkpoints.
+   * @private @const {!Map<number, !Interpreter.Watchpoint>}
+   */
+  this.watchpoints_ = new Map();
+  /** @private @type {number} */
+  this.nextWatchpointId_ = 1;
+  /**
+   * Function to be called with a (JSON-compatible) description of each
+   * external effect (data written to a network connection, etc.) once
+   * it has been carried out, or null if effects are not being
+   * recorded.  Used to maintain the checkpoint journal.
+   * @type {?function(!Object)}
+   */
+  this.onExternalEffect = null;
+  /**
+   * Function to wrap a newly-accepted connection in TLS (see
+   * Certificates.Manager.prototype.wrap), for Servers listening with
+   * the tls option, or null if TLS has not been configured.
+   * @type {?function(!net.Socket): !tls.TLSSocket}
+   */
+  this.wrapTls = null;
+  /**
+   * Function to send an email message (see Mail.Mailer.prototype.send)
+   * for CC.mailSend, or null if mail has not been configured.  Throws
+   * a TypeError if the message is invalid; otherwise returns a promise
+   * that resolves with the relay's reply once it has been accepted.
+   * @type {?function(!Object): !Promise<string>}
+   */
+  this.sendMail = null;
+  /**
+   * Function to record a privileged operation in the admin log (see
+   * AdminLog.Log.prototype.record), or null if there is none: see
+   * .recordPrivileged.
+   * @type {?function(string, string, !Object)}
+   */
+  this.adminLog = null;
+  /**
+   * Listening sockets inherited from whatever started the server (see
+   * Activation), as file descriptors by port, or null if none.  A
+   * Server listening on one of these ports adopts its socket (which is
+   * then removed from the map) instead of binding the port itself.
+   * @type {?Map<number, number>}
+   */
+  this.inheritedFds = null;
+  /**
+   * Federation service through which players are teleported to peer
+   * worlds by CC.federationTeleport (see Federation.Service), or null
+   * if federation has not been configured.
+   * @type {?Federation.Service}
+   */
+  this.federation = null;
+  /**
+   * Store of binary assets for CC.blobPut, CC.blobGet and
+   * CC.blobDelete (see Blobs.Store), or null if blob storage has not
+   * been configured.  Blobs are kept out of the heap (and so out of
+   * checkpoints); in-world objects refer to them by ID.
+   * @type {?Blobs.Store}
+   */
+  this.blobs = null;
+  /**
+   * Registry from which CC.packageInstall and CC.packageUpdate install
+   * packages (see Packages.Registry), or null if no registry has been
+   * configured.
+   * @type {?Packages.Registry}
+   */
+  this.packageRegistry = null;
+  /**
+   * Function to be called with each thread paused by the debugger (see
+   * .setBreakpoint, .setWatchpoint and .resumeThread), and the reason:
+   * 'breakpoint', 'watchpoint', 'step' or 'pause'; or null.  Used by
+   * debugging tools.
+   * @type {?function(!Interpreter.Thread, string)}
+   */
+  this.onThreadPaused = null;
+
+  /**
+   * Guests (ephemeral owners for unauthenticated users, created with
+   * CC.guestCreate), and their usage of resources.  Consulted by the
+   * intrp.Object constructor, so must exist before any builtins are
+   * created.  Saved in checkpoints (so that guests whose connections
+   * did not survive can still be released).
+   * @private @const {!Map<!Interpreter.prototype.Object,
+   *                       !Interpreter.Guest_>}
+   */
+  this.guests_ = new Map();
+
+  /**
+   * Notified as objects owned by guests are garbage collected, so that
+   * their live objects can be counted.  Not saved in checkpoints (so
+   * the counts of guests which survive one include objects they
+   * created earlier, even if since collected).
+   * @private @const {!FinalizationRegistry<!Interpreter.Guest_>}
+   */
+  this.guestObjects_ = new FinalizationRegistry(function(guest) {
+    guest.objects--;
+  });
+
+  /**
+   * Upper bounds on the numbers of own properties of objects, for
+   * enforcing Interpreter.SizeLimits.maxProperties without counting
+   * them on every assignment: incremented as properties are added, but
+   * (as deletions are not tracked) recounted only once over the limit.
+   * Not saved in checkpoints.
+   * @private @const {!WeakMap<!Interpreter.prototype.Object, number>}
+   */
+  this.propertyCounts_ = new WeakMap();
+
+  /**
+   * Tainted strings (see Interpreter.Options.taint), oldest first, and
+   * their total length.  Not saved in checkpoints.
+   * @private @const {!Set<string>}
+   */
+  this.tainted_ = new Set();
+  /** @private @type {number} */
+  this.taintedLength_ = 0;
 
   /**
    * The interpreter's global scope.
@@ -103,6 +290,7 @@ var Interpreter = function(options) {
   /** @type {!Interpreter.prototype.Error} */ this.URI_ERROR;
   /** @type {!Interpreter.prototype.Error} */ this.PERM_ERROR;
   /** @type {!Interpreter.prototype.Object} */ this.WEAKMAP;
+  /** @type {!Interpreter.prototype.Object} */ this.BUFFER;
   /** @type {!Interpreter.prototype.Object} */ this.THREAD;
   /** @type {!Interpreter.Owner} */ this.ANYBODY;
 
@@ -124,6 +312,187 @@ var Interpreter = function(options) {
   /** @const {!Object<number, !Interpreter.prototype.Server>} */
   this.listeners_ = Object.create(null);
 
+  /**
+   * Handles on host resources currently in use (open connections and
+   * operations in progress), to be reattached after deserialization.
+   * @private @const {!Set<!Interpreter.HostHandle>}
+   */
+  this.hostHandles_ = new Set();
+
+  /**
+   * Number of requests to 'http' Servers in progress, by the Servers'
+   * owner (for enforcing Interpreter.Options.httpMaxRequests).
+   * @private @const {!Map<?Interpreter.Owner, number>}
+   */
+  this.httpRequests_ = new Map();
+
+  /**
+   * Times (as from Date.now()) of recent requests made with CC.fetch,
+   * by the owner on whose behalf they were made (for enforcing
+   * Interpreter.Options.fetchRateLimit).
+   * @private @const {!Map<?Interpreter.Owner, !Array<number>>}
+   */
+  this.fetchTimes_ = new Map();
+
+  /**
+   * Times (as from Date.now()) of recent messages sent with
+   * CC.mailSend, by the owner on whose behalf they were sent (for
+   * enforcing Interpreter.Options.mailRateLimit).
+   * @private @const {!Map<?Interpreter.Owner, !Array<number>>}
+   */
+  this.mailTimes_ = new Map();
+
+  /**
+   * Settings of owners' log channels (see CC.logChannel), for those
+   * owners whose settings are not the defaults.  Saved in checkpoints.
+   * @private @const {!Map<!Interpreter.Owner, !Logging.Channel>}
+   */
+  this.logChannels_ = new Map();
+
+  /**
+   * Rate limits on connection attempts, logins and commands (see
+   * Interpreter.Options.rateLimits and CC.rateLimit).
+   * @private @const {!RateLimit.Limiter}
+   */
+  this.rateLimiter_ = new RateLimit.Limiter(this.options.rateLimits);
+
+  /**
+   * Banned networks, from which connections are refused (see CC.ban).
+   * Saved in checkpoints.
+   * @private @const {!Array<!Bans.Ban>}
+   */
+  this.bans_ = [];
+
+  /**
+   * Library objects in which modules are looked up, in order (see
+   * CC.require).  Saved in checkpoints.
+   * @private @type {!Array<!Interpreter.prototype.Object>}
+   */
+  this.moduleLibraries_ = [];
+
+  /**
+   * Modules which have been required, by name.  Saved in checkpoints.
+   * @private @const {!Map<string, !Modules.Entry>}
+   */
+  this.modules_ = new Map();
+
+  /**
+   * Packages installed from the registry (see CC.packageInstall), by
+   * name.  Saved in checkpoints.
+   * @private @const {!Map<string, {version: string,
+   *     root: !Interpreter.prototype.Object, installed: number}>}
+   */
+  this.packages_ = new Map();
+
+  /**
+   * Permission tiers assigned to owners (see CC.tierSet), and the tier
+   * of owners not assigned one.  Saved in checkpoints.
+   * @private @const {!Map<!Interpreter.Owner, !Tiers.Tier>}
+   */
+  this.tiers_ = new Map();
+  /** @private @type {!Tiers.Tier} */
+  this.defaultTier_ = Tiers.Tier.PROGRAMMER;
+
+  /**
+   * Objects destroyed with a grace period (see CC.destroy), which may
+   * still be restored, and when (as from Date.now()) each is due to be
+   * purged.  Saved in checkpoints.
+   * @private @const {!Map<!Interpreter.prototype.Object, number>}
+   */
+  this.recycleBin_ = new Map();
+
+  /**
+   * Sandboxes (see CC.sandboxCreate), by the in-world object which
+   * stands for each.  Saved in checkpoints.
+   * @private @const {!IterableWeakMap<!Interpreter.prototype.Object,
+   *                                   !Interpreter.Sandbox>}
+   */
+  this.sandboxes_ = new IterableWeakMap();
+
+  /**
+   * Size limits set for particular owners (see CC.sizeLimitsSet), in
+   * place of those given by Interpreter.Options.sizeLimits.  Saved in
+   * checkpoints.
+   * @private @const {!Map<!Interpreter.Owner, !Interpreter.SizeLimits>}
+   */
+  this.sizeLimits_ = new Map();
+
+  /**
+   * Password accounts, by name (see CC.accountCreate).  Saved in
+   * checkpoints.
+   * @private @const {!Map<string, !Accounts.Account>}
+   */
+  this.accounts_ = new Map();
+
+  /**
+   * Breakpoints set by the debugger, by ID (see .setBreakpoint).  Saved
+   * in checkpoints (as are paused threads).
+   * @private @const {!Map<number, !Interpreter.Breakpoint>}
+   */
+  this.breakpoints_ = new Map();
+  /** @private @type {number} */
+  this.nextBreakpointId_ = 1;
+
+  /**
+   * In-world function to be called with each thread paused by the
+   * debugger (see CC.debugSetHandler), or null.  Saved in checkpoints.
+   * @private @type {?Interpreter.prototype.Function}
+   */
+  this.debugHandler_ = null;
+
+  /**
+   * The CPU profile being recorded, or null if not profiling (see
+   * .startProfiling).  Not saved in checkpoints.
+   * @private @type {?Interpreter.Profile}
+   */
+  this.profile_ = null;
+
+  /**
+   * Statement coverage being (or last) collected: the number of times
+   * each statement has been executed, by function; or null if none has
+   * been collected (see .startCoverage).  Not saved in checkpoints.
+   * @private @type {?Map<!Interpreter.prototype.UserFunction,
+   *                      !Map<!Node, number>>}
+   */
+  this.coverage_ = null;
+  /** @private @type {boolean} */
+  this.collectingCoverage_ = false;
+
+  /**
+   * Most recent records of slow tasks and long scheduler pauses (see
+   * .getSlowLog), oldest first.  Not saved in checkpoints.
+   * @private @const {!Array<!Interpreter.SlowRecord>}
+   */
+  this.slowLog_ = [];
+  /**
+   * When (as from .uptime) the pending runner (see .go_) is due to
+   * run, or undefined if there is none.  Not saved in checkpoints.
+   * @private @type {number|undefined}
+   */
+  this.runnerDue_ = undefined;
+
+  /**
+   * Sessions of clients of Servers with a .resume grace period, by
+   * token.  Not saved in checkpoints (connections do not survive them).
+   * @private @const {!Sessions.Registry}
+   */
+  this.sessions_ = new Sessions.Registry();
+
+  /**
+   * Traffic on each port listened on, by port (see .getTraffic).  Not
+   * saved in checkpoints.
+   * @private @const {!Map<number, !Interpreter.TrafficRecord_>}
+   */
+  this.traffic_ = new Map();
+
+  /**
+   * Numbers of steps executed and threads created since the
+   * interpreter was created, for monitoring.  Not saved in
+   * checkpoints.
+   * @const {{steps: number, threads: number}}
+   */
+  this.counts = {steps: 0, threads: 0};
+
   // TODO(cpcallen): This is an ugly hack to allow the serialiser to
   // know the names of step functions in an otherwise-empty
   // interpreter.  Find a better way to do this.
@@ -159,13 +528,28 @@ Interpreter.prototype.uptime = function() {
  * Return a monotonically increasing count of milliseconds since this
  * Interpreter instance was created.  In the event of an interpreter
  * being serialized / deserialized, this count will continue from
- * where it left off before serialization.
+ * where it left off before serialization.  This is the clock seen by
+ * in-world code (via CC.hrtime) as well as the one by which threads
+ * are scheduled, so replacing this method (e.g., for deterministic
+ * replay, or in tests) controls both.
  * @return {number} Elapsed total time in milliseconds.
  */
 Interpreter.prototype.now = function() {
   return this.uptime() + this.previousTime_;
 };
 
+/**
+ * Generate cryptographically secure random bytes.  All randomness
+ * given to in-world code (by CC.crypto.randomBytes, CC.crypto.uuid,
+ * etc.) comes from here, so that it can be made reproducible (e.g.,
+ * for deterministic replay, or in tests) by replacing this method.
+ * @param {number} length Number of bytes.
+ * @return {!Buffer} The bytes.
+ */
+Interpreter.prototype.randomBytes = function(length) {
+  return crypto.randomBytes(length);
+};
+
 /**
  * Create a new thread and add it to .threads_, and create a companion
  * user-visible wrapper object and return it.
@@ -181,6 +565,7 @@ Interpreter.prototype.createThread = function(owner, state, runAt, timeLimit) {
   var thread =
       new Interpreter.Thread(id, state, runAt || this.now(), timeLimit);
   this.threads_[this.threads_.length] = thread;
+  this.counts.threads++;
   this.go_();
   return new this.Thread(thread, owner);
 };
@@ -256,6 +641,7 @@ Interpreter.prototype.schedule = function() {
         delete threads[i];
         continue;
       case Interpreter.Thread.Status.BLOCKED:
+      case Interpreter.Thread.Status.PAUSED:
         // Ignore blocked threads except noting existence.
         this.done = false;
         continue;
@@ -335,9 +721,22 @@ Interpreter.prototype.run = function() {
   while ((t = this.schedule()) === 0) {
     var thread = this.thread_;
     var stack = thread.stateStack_;
+    // Time the task, sampling its stack every so often in case it
+    // turns out to be slow.
+    var startTime = this.uptime();
+    var startSteps = this.counts.steps;
+    var samples = [];
+    var countdown = Interpreter.SLOW_SAMPLE_INTERVAL;
     while (thread.status === Interpreter.Thread.Status.READY) {
       this.step_(thread, stack);
+      if (--countdown <= 0) {
+        countdown = Interpreter.SLOW_SAMPLE_INTERVAL;
+        if (samples.length >= Interpreter.SLOW_MAX_SAMPLES) samples.shift();
+        samples.push(thread.callers(this.ROOT));
+      }
     }
+    this.checkSlowTask_(thread, this.uptime() - startTime,
+                        this.counts.steps - startSteps, samples);
   }
   if (t === Number.MAX_VALUE) {
     return this.done ? 0 : -1;
@@ -353,6 +752,8 @@ Interpreter.prototype.run = function() {
  * @param {!Array<!Interpreter.State>} stack The current thread's state stack.
  */
 Interpreter.prototype.step_ = function(thread, stack) {
+  this.counts.steps++;
+  if (this.profile_ && --this.profile_.countdown <= 0) this.sample_(stack);
   var state = stack[stack.length - 1];
   var node = state.node;
   try {
@@ -363,9 +764,14 @@ Interpreter.prototype.step_ = function(thread, stack) {
   }
   if (nextState) {
     stack[stack.length] = nextState;
+    if (thread.step || this.breakpoints_.size) {
+      this.checkBreak_(thread, stack, nextState);
+    }
+    if (this.collectingCoverage_) this.cover_(stack, nextState);
   }
   if (stack.length === 0) {
     thread.status = Interpreter.Thread.Status.ZOMBIE;
+    if (thread.onExit) thread.onExit(false, thread.value);
   }
 };
 
@@ -383,12 +789,17 @@ Interpreter.prototype.go_ = function() {
   // Kill any existing runner and restart.
   if (this.runner_) clearTimeout(this.runner_);
   var intrp = this;
+  this.runnerDue_ = this.uptime();
   this.runner_ = setTimeout(function runner() {
     // Invariant check: pausing or stopping interpreter should cancel
     // timeout, so we should never get here while it is not RUNNING.
     if (intrp.status !== Interpreter.Status.RUNNING) {
       throw new Error('Un-cancelled runner on non-RUNNING interpreteter');
     }
+    if (intrp.runnerDue_ !== undefined) {
+      intrp.checkSlowPause_(intrp.uptime() - intrp.runnerDue_);
+      intrp.runnerDue_ = undefined;
+    }
     // N.B.: .run may indirectly call .go_ or even .pause or .stop
     // (e.g. via native function calling .createThread, .pause, etc.).
     var r = intrp.run();
@@ -404,7 +815,9 @@ Interpreter.prototype.go_ = function() {
       // No more code to run right now, but there is an outstanding
       // userland timeout, so set up a future reinvocation of runner
       // when it's time for that to run.
-      intrp.runner_ = setTimeout(runner, r - intrp.now());
+      var delay = r - intrp.now();
+      intrp.runnerDue_ = intrp.uptime() + Math.max(delay, 0);
+      intrp.runner_ = setTimeout(runner, delay);
     }
   });
 };
@@ -487,11 +900,38 @@ Interpreter.prototype.stop = function() {
   }
   // Do RUNNING -> PAUSED transition if required; update elapsed time.
   this.pause();
-  // Unlisten to network sockets.
+  this.stopListening();
+  this.status = Interpreter.Status.STOPPED;
+};
+
+/**
+ * Stop listening on any port (but do not close any open sockets),
+ * without otherwise stopping the interpreter: e.g., so that in-world
+ * code can finish up while the server is shutting down.  The ports
+ * remain listened on as far as in-world code (and checkpoints) are
+ * concerned, so are listened on again when the interpreter is next
+ * started after being stopped.
+ */
+Interpreter.prototype.stopListening = function() {
   for (var port in this.listeners_) {
     this.listeners_[Number(port)].unlisten();
   }
-  this.status = Interpreter.Status.STOPPED;
+};
+
+/**
+ * Replace the interpreter's options, e.g. when the server's
+ * configuration is reloaded.  Limits (on rates, fetches, mail, guests
+ * and so on) apply from now on; connections already accepted are not
+ * affected.
+ * @param {!Interpreter.Options} options The new options.
+ */
+Interpreter.prototype.setOptions = function(options) {
+  this.options = options;
+  this.rateLimiter_.configure(options.rateLimits);
+  if (!options.taint) {
+    this.tainted_.clear();
+    this.taintedLength_ = 0;
+  }
 };
 
 /**
@@ -502,6 +942,7 @@ Interpreter.prototype.preSerialize = function() {
   // before serialising, so as to avoid mistaking old, un-versioned
   // .city files for the current version.
   this.serializationVersion = SERIALIZATION_VERSION;
+  this.serverVersion = packageJson.version;
 };
 
 /**
@@ -520,6 +961,48 @@ Interpreter.prototype.postDeserialize = function() {
   // actually stopped (i.e., with no listening sockets, and with
   // questionable timer state information).
   this.status = Interpreter.Status.STOPPED;
+  // None of the host resources in use when it was serialized exist
+  // any longer.
+  var handles = Array.from(this.hostHandles_);
+  for (var i = 0; i < handles.length; i++) {
+    this.hostHandles_.delete(handles[i]);
+    this.reattach_(handles[i]);
+  }
+};
+
+/**
+ * Deal with the loss (i.e., on deserialization) of the host resource
+ * a handle referred to: by calling the .onReattach method of the
+ * object that was connected, with an Error, and detaching it from its
+ * player; or by throwing an Error in the thread that was waiting for
+ * the operation to complete.
+ * @private
+ * @param {!Interpreter.HostHandle} handle The handle.
+ */
+Interpreter.prototype.reattach_ = function(handle) {
+  var perms = handle.perms;
+  switch (handle.kind) {
+    case Interpreter.HostHandle.Kind.CONNECTION:
+      var obj = /** @type {!Interpreter.prototype.Object} */(handle.target);
+      var func = (perms === null) ? undefined : obj.get('onReattach', perms);
+      if (func instanceof this.Function) {
+        var error = new this.Error(perms, this.ERROR,
+            'connection from ' + handle.description + ' no longer exists');
+        this.createThreadForFuncCall(
+            perms, func, obj, [error], undefined, handle.timeLimit);
+      }
+      this.detachPlayer_(handle, 'restart');
+      break;
+    case Interpreter.HostHandle.Kind.OPERATION:
+      var thread = /** @type {!Interpreter.Thread} */(handle.target);
+      if (thread.status !== Interpreter.Thread.Status.BLOCKED) return;
+      thread.status = Interpreter.Thread.Status.READY;
+      this.throw_(thread, new this.Error(perms, this.ERROR,
+          handle.description + ' interrupted by server restart'), perms);
+      break;
+    default:
+      throw new Error('Unknown host handle kind??');
+  }
 };
 
 /**
@@ -624,12 +1107,15 @@ Interpreter.prototype.initBuiltins_ = function() {
         // eval(Array) -> Array
         return code;
       }
+      intrp.checkTier_(perms, Tiers.Tier.PROGRAMMER, 'eval code');
+      intrp.checkTaint_(args[0], perms, 'eval');
       var ast = intrp.compile_(code, perms);
       // Change node type from Program to EvalProgram_.
       ast['type'] = 'EvalProgram_';
       ast['stepFunc'] = stepFuncs_['EvalProgram_'];
       // Create new scope and update it with definitions in eval().
-      var outerScope = state.info_.directEval ? state.scope : intrp.global;
+      var outerScope = state.info_.directEval ? state.scope :
+          intrp.globalScopeOf_(state.scope);
       var scope =
           new Interpreter.Scope(Interpreter.Scope.Type.EVAL, perms, outerScope);
       intrp.populateScope_(ast, scope);
@@ -673,7 +1159,27 @@ Interpreter.prototype.initBuiltins_ = function() {
 
   // Initialize CC-specific globals.
   this.initThread_();
+  this.initBuffer_();
   this.initNetwork_();
+  this.initCrypto_();
+  this.initCompression_();
+  this.initLogging_();
+  this.initHtml_();
+  this.initFormats_();
+  this.initText_();
+  this.initInspect_();
+  this.initCommand_();
+  this.initPronouns_();
+  this.initEdit_();
+  this.initModules_();
+  this.initPackages_();
+  this.initTiers_();
+  this.initRecycler_();
+  this.initSandbox_();
+  this.initSizeLimits_();
+  this.initSecurity_();
+  this.initBlobs_();
+  this.initDebugger_();
 };
 
 /**
@@ -707,7 +1213,7 @@ Interpreter.prototype.initObject_ = function() {
   });
 
   // Static methods on Object.
-  this.createNativeFunction('Object.is', Object.is, false);
+  this.createNativeFunction('Object.is', Interpreter.sameValue, false);
 
   new this.NativeFunction({
     id: 'Object.getOwnPropertyNames', length: 1,
@@ -761,7 +1267,8 @@ Interpreter.prototype.initObject_ = function() {
         throw new intrp.Error(perms, intrp.TYPE_ERROR,
             'Object.defineProperty called on non-object');
       }
-      key = String(key);
+      key = intrp.propertyKeyArg_(thread, state, key);
+      if (key === undefined) return Interpreter.FunctionResult.CallAgain;
       if (!(attr instanceof intrp.Object)) {
         throw new intrp.Error(perms, intrp.TYPE_ERROR,
             'Property description must be an object');
@@ -796,7 +1303,8 @@ Interpreter.prototype.initObject_ = function() {
         throw new intrp.Error(perms, intrp.TYPE_ERROR,
             'Object.getOwnPropertyDescriptor called on non-object');
       }
-      prop = String(prop);
+      prop = intrp.propertyKeyArg_(thread, state, prop);
+      if (prop === undefined) return Interpreter.FunctionResult.CallAgain;
       var pd = obj.getOwnPropertyDescriptor(prop, perms);
       if (!pd) {
         return undefined;
@@ -817,6 +1325,7 @@ Interpreter.prototype.initObject_ = function() {
       // N.B.: This conforms to ES6.  ES5.1 would throw TypeError for
       // Object.getPrototypeOf(<boolean, string or number>)
       var o = intrp.toObject(args[0], state.scope.perms);
+      if (o.destroyed) throw intrp.destroyedError_(state.scope.perms);
       return o.proto;
     }
   });
@@ -890,10 +1399,11 @@ Interpreter.prototype.initObject_ = function() {
     id: 'Object.prototype.hasOwnProperty', length: 1,
     /** @type {!Interpreter.NativeCallImpl} */
     call: function(intrp, thread, state, thisVal, args) {
-      var key = args[0];
+      var key = intrp.propertyKeyArg_(thread, state, args[0]);
+      if (key === undefined) return Interpreter.FunctionResult.CallAgain;
       var perms = state.scope.perms;
       var obj = intrp.toObject(thisVal, perms);
-      return Boolean(obj.getOwnPropertyDescriptor(String(key), perms));
+      return Boolean(obj.getOwnPropertyDescriptor(key, perms));
     }
   });
 
@@ -901,7 +1411,8 @@ Interpreter.prototype.initObject_ = function() {
     id: 'Object.prototype.propertyIsEnumerable', length: 1,
     /** @type {!Interpreter.NativeCallImpl} */
     call: function(intrp, thread, state, thisVal, args) {
-      var key = String(args[0]);
+      var key = intrp.propertyKeyArg_(thread, state, args[0]);
+      if (key === undefined) return Interpreter.FunctionResult.CallAgain;
       var perms = state.scope.perms;
       var obj = intrp.toObject(thisVal, perms);
       var desc = obj.getOwnPropertyDescriptor(key, perms);
@@ -940,6 +1451,11 @@ Interpreter.prototype.initFunction_ = function() {
     id: 'Function', length: 1,
     /** @type {!Interpreter.NativeConstructImpl} */
     construct: function(intrp, thread, state, args) {
+      intrp.checkTier_(state.scope.perms, Tiers.Tier.PROGRAMMER,
+          'construct functions from source');
+      for (var i = 0; i < args.length; i++) {
+        intrp.checkTaint_(args[i], state.scope.perms, 'Function');
+      }
       args = args.slice();  // Copy, so we can .pop safely.
       var body = args.length ? String(args.pop()) : '';
       // Concatenate formal parameter names.  Let Acorn verify they
@@ -958,9 +1474,11 @@ Interpreter.prototype.initFunction_ = function() {
             'Invalid code in function body');
       }
       // Interestingly, the scope for constructed functions is the global
-      // scope, even if they were constructed in some other scope.
+      // scope (of the sandbox, if any), even if they were constructed in
+      // some other scope.
       return new intrp.UserFunction(ast['body'][0]['expression'],
-          intrp.global, new Interpreter.Source(source), state.scope.perms);
+          intrp.globalScopeOf_(state.scope), new Interpreter.Source(source),
+          state.scope.perms);
     },
     /** @type {!Interpreter.NativeCallImpl} */
     call: function(intrp, thread, state, thisVal, args) {
@@ -994,7 +1512,11 @@ Interpreter.prototype.initFunction_ = function() {
       if (!(func instanceof intrp.Function)) {
         throw new intrp.Error(perms, intrp.TYPE_ERROR,
             func + ' is not a function');
-      } else if (argArray === null || argArray === undefined) {
+      } else if (func.destroyed) {
+        throw intrp.destroyedError_(perms);
+      }
+      intrp.checkSandbox_(state.scope, func);
+      if (argArray === null || argArray === undefined) {
         var argList = [];
       } else {
         argList = intrp.createListFromArrayLike(argArray, perms);
@@ -1050,7 +1572,10 @@ Interpreter.prototype.initFunction_ = function() {
       if (!(func instanceof intrp.Function)) {
         throw new intrp.Error(state.scope.perms, intrp.TYPE_ERROR,
             func + ' is not a function');
+      } else if (func.destroyed) {
+        throw intrp.destroyedError_(state.scope.perms);
       }
+      intrp.checkSandbox_(state.scope, func);
       var thisArg = args[0];
       var argList = args.slice(1);
       // Rewrite state.info_, as a short-circuit optimisation in case
@@ -1184,10 +1709,8 @@ Interpreter.prototype.initArray_ = function() {
       var k = (n >= 0) ? n : Math.max(len - Math.abs(n), 0);
       for (; k < len; k++) {
         if (obj.has(String(k), perms)) {
-          var v = obj.get(String(k), perms);
-          if (v === searchElement ||
-              (Number.isNaN(/** @type{?} */(v)) &&
-               Number.isNaN(/** @type{?} */(searchElement)))) {
+          if (Interpreter.sameValueZero(obj.get(String(k), perms),
+                                        searchElement)) {
             return true;
           }
         }
@@ -1211,7 +1734,8 @@ Interpreter.prototype.initArray_ = function() {
       var k = (n >= 0) ? n : Math.max(len - Math.abs(n), 0);
       for (; k < len; k++) {
         if (obj.has(String(k), perms) &&
-            obj.get(String(k), perms) === searchElement) {
+            Interpreter.strictEquals(obj.get(String(k), perms),
+                                     searchElement)) {
           return k;
         }
       }
@@ -1234,7 +1758,8 @@ Interpreter.prototype.initArray_ = function() {
       var k = (n >= 0) ? Math.min(n, len - 1) : len - Math.abs(n);
       for (; k >= 0 ; k--) {
         if (obj.has(String(k), perms) &&
-            obj.get(String(k), perms) === searchElement) {
+            Interpreter.strictEquals(obj.get(String(k), perms),
+                                     searchElement)) {
           return k;
         }
       }
@@ -1615,7 +2140,9 @@ Interpreter.prototype.initString_ = function() {
     if (separator instanceof intrp.RegExp) {
       separator = separator.regexp;
     }
-    var jsList = this.split(separator, limit);
+    var str = this;
+    var jsList = intrp.runRegExp_(separator,
+        function() {return str.split(separator, limit);});
     return intrp.createArrayFromList(jsList, intrp.thread_.perms());
   };
   this.createNativeFunction('String.prototype.split', wrapper, false);
@@ -1623,8 +2150,13 @@ Interpreter.prototype.initString_ = function() {
   wrapper = function(regexp) {
     if (regexp instanceof intrp.RegExp) {
       regexp = regexp.regexp;
+    } else {
+      // Convert here (rather than leaving it to .match) so that the
+      // pattern is subject to the usual time limit.
+      regexp = new RegExp(regexp);
     }
-    var m = this.match(regexp);
+    var str = this;
+    var m = intrp.runRegExp_(regexp, function() {return str.match(regexp);});
     return m && intrp.createArrayFromList(m, intrp.thread_.perms());
   };
   this.createNativeFunction('String.prototype.match', wrapper, false);
@@ -1632,8 +2164,11 @@ Interpreter.prototype.initString_ = function() {
   wrapper = function(regexp) {
     if (regexp instanceof intrp.RegExp) {
       regexp = regexp.regexp;
+    } else {
+      regexp = new RegExp(regexp);  // As for String.prototype.match.
     }
-    return this.search(regexp);
+    var str = this;
+    return intrp.runRegExp_(regexp, function() {return str.search(regexp);});
   };
   this.createNativeFunction('String.prototype.search', wrapper, false);
 
@@ -1642,19 +2177,44 @@ Interpreter.prototype.initString_ = function() {
     if (substr instanceof intrp.RegExp) {
       substr = substr.regexp;
     }
-    return String(this).replace(substr, newSubstr);
+    var str = String(this);
+    return intrp.runRegExp_(substr,
+        function() {return str.replace(substr, newSubstr);});
   };
   this.createNativeFunction('String.prototype.replace', wrapper, false);
 
-  wrapper = function(count) {
-    try {
-      return this.repeat(count);
-    } catch (e) {
-      // 'abc'.repeat(-1) will throw an error.  Catch and rethrow.
-      throw intrp.errorNativeToPseudo(e, intrp.thread_.perms());
+  new this.NativeFunction({
+    id: 'String.prototype.repeat', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      // Long results are built NATIVE_CHUNK_SIZE characters at a time,
+      // over several visits, in state.info_.funcState.
+      var job = state.info_.funcState;
+      if (!job) {  // First visit: check count and length of result.
+        var perms = state.scope.perms;
+        if (thisVal === null || thisVal === undefined) {
+          throw new intrp.Error(perms, intrp.TYPE_ERROR,
+              'String.prototype.repeat called on null or undefined');
+        }
+        var str = String(thisVal);
+        var count = Math.trunc(Number(args[0])) || 0;
+        if (count < 0 || count === Infinity) {
+          throw new intrp.Error(perms, intrp.RANGE_ERROR,
+              'Invalid count value: ' + count);
+        }
+        intrp.checkStringLength_(str.length * count, perms);
+        if (str.length * count <= Interpreter.NATIVE_CHUNK_SIZE) {
+          return str.repeat(count);
+        }
+        job = state.info_.funcState = {str: str, count: count, result: ''};
+      }
+      var n = Math.min(job.count, Math.max(1,
+          Math.floor(Interpreter.NATIVE_CHUNK_SIZE / job.str.length)));
+      job.result += job.str.repeat(n);
+      job.count -= n;
+      return job.count ? Interpreter.FunctionResult.CallAgain : job.result;
     }
-  };
-  this.createNativeFunction('String.prototype.repeat', wrapper, false);
+  });
 
   new this.NativeFunction({
     id: 'String.prototype.toString', length: 0,
@@ -1917,6 +2477,10 @@ Interpreter.prototype.initDate_ = function() {
   for (var i = 0; i < functions.length; i++) {
     wrapper = (function(nativeFunc) {
       return function(var_args) {
+        // Setters modify the internal [[DateValue]] slot.
+        if (intrp.dirtyObjects && nativeFunc.startsWith('set')) {
+          intrp.dirtyObjects.add(this);
+        }
         return this.date[nativeFunc].apply(this.date, arguments);
       };
     })(functions[i]);
@@ -2010,7 +2574,8 @@ Interpreter.prototype.initRegExp_ = function() {
           'Method RegExp.prototype.exec called on incompatible receiver' +
               this);
     }
-    return this.regexp.test(str);
+    var regexp = this.regexp;
+    return intrp.runRegExp_(regexp, function() {return regexp.test(str);});
   };
   this.createNativeFunction('RegExp.prototype.test', wrapper, false);
 
@@ -2024,7 +2589,8 @@ Interpreter.prototype.initRegExp_ = function() {
     str = String(str);
     // Get lastIndex from wrapped regex, since this is settable.
     this.regexp.lastIndex = this.get('lastIndex', perms);
-    var match = this.regexp.exec(str);
+    var regexp = this.regexp;
+    var match = intrp.runRegExp_(regexp, function() {return regexp.exec(str);});
     this.set('lastIndex', this.regexp.lastIndex, perms);
 
     if (match) {
@@ -2121,33 +2687,133 @@ Interpreter.prototype.initJSON_ = function() {
   };
   this.createNativeFunction('JSON.parse', wrapper, false);
 
-  wrapper = function(value, replacer, space) {
-    var nativeObj = intrp.pseudoToNative(value);
-    var perms = intrp.thread_.perms();
-    if (replacer instanceof intrp.Function) {
-      throw new intrp.Error(perms, intrp.TYPE_ERROR,
-          'Function replacer on JSON.stringify not supported');
-    } else if (replacer instanceof intrp.Array) {
-      replacer = intrp.createListFromArrayLike(replacer, perms);
-      replacer = replacer.filter(function(word) {
-        // Spec says we should also support boxed primitives here.
-        return typeof word === 'string' || typeof word === 'number';
-      });
+  /**
+   * Append a piece of text to the output of JSON.stringify.
+   * @param {!Object} job The stringify job (see below).
+   * @param {string} text The text.
+   * @param {!Interpreter.Owner} perms Who called JSON.stringify?
+   */
+  var emit = function(job, text, perms) {
+    intrp.checkStringLength_(job.length + text.length, perms);
+    job.out.push(text);
+    job.length += text.length;
+  };
+
+  /**
+   * Serialize a value for JSON.stringify: emit it if primitive, else
+   * emit its opening bracket and push a frame for its contents.
+   * @param {!Object} job The stringify job (see below).
+   * @param {?Interpreter.Value} value The value (not undefined or a
+   *     function).
+   * @param {string} indent Indentation of the value.
+   * @param {!Interpreter.Owner} perms Who called JSON.stringify?
+   */
+  var serialize = function(job, value, indent, perms) {
+    if (!(value instanceof intrp.Object)) {
+      emit(job, typeof value === 'number' && !isFinite(value) ? 'null' :
+          /** @type {string} */(JSON.stringify(value)), perms);
+    } else if (value instanceof intrp.RegExp) {
+      emit(job, '{}', perms);
+    } else if (value instanceof intrp.Buffer) {
+      var text = JSON.stringify(Buffer.from(value.data), job.keys, job.gap);
+      emit(job, job.gap ? text.replace(/\n/g, '\n' + indent) : text, perms);
     } else {
-      replacer = null;
-    }
-    // Spec says we should also support boxed primitives here.
-    if (typeof space !== 'string' && typeof space !== 'number') {
-      space = undefined;
-    }
-    try {
-      var str = JSON.stringify(nativeObj, replacer, space);
-    } catch (e) {
-      throw intrp.errorNativeToPseudo(e, perms);
+      for (var i = 0; i < job.stack.length; i++) {
+        if (job.stack[i].obj === value) {
+          throw new intrp.Error(perms, intrp.TYPE_ERROR,
+              'Converting circular structure to JSON');
+        }
+      }
+      var isArray = value instanceof intrp.Array;
+      job.stack.push({
+        obj: value,
+        keys: isArray ? null : job.keys || value.ownKeys(perms),
+        length: isArray ? Interpreter.toLength(value.get('length', perms)) : 0,
+        i: 0,
+        count: 0,
+        indent: indent,
+      });
+      emit(job, isArray ? '[' : '{', perms);
     }
-    return str;
   };
-  this.createNativeFunction('JSON.stringify', wrapper, false);
+
+  // Objects are serialized NATIVE_CHUNK_SIZE properties at a time, over
+  // several visits, in state.info_.funcState: a job recording the
+  // output so far and a stack of frames, one for each object or array
+  // being serialized.
+  new this.NativeFunction({
+    id: 'JSON.stringify', length: 3,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      var job = state.info_.funcState;
+      if (!job) {  // First visit.
+        var value = args[0];
+        var replacer = args[1];
+        var space = args[2];
+        if (value === undefined || value instanceof intrp.Function) {
+          return undefined;
+        }
+        var keys = null;
+        if (replacer instanceof intrp.Function) {
+          throw new intrp.Error(perms, intrp.TYPE_ERROR,
+              'Function replacer on JSON.stringify not supported');
+        } else if (replacer instanceof intrp.Array) {
+          keys = [];
+          intrp.createListFromArrayLike(replacer, perms).forEach(
+              function(word) {
+                // Spec says we should also support boxed primitives here.
+                if (typeof word === 'string' || typeof word === 'number') {
+                  word = String(word);
+                  if (!keys.includes(word)) keys.push(word);
+                }
+              });
+        }
+        // Spec says we should also support boxed primitives here.
+        var gap = '';
+        if (typeof space === 'number') {
+          gap = ' '.repeat(Math.min(10, Math.max(0, Math.trunc(space))));
+        } else if (typeof space === 'string') {
+          gap = space.slice(0, 10);
+        }
+        job = {out: [], length: 0, stack: [], keys: keys, gap: gap};
+        serialize(job, value, '', perms);
+        state.info_.funcState = job;
+      }
+      for (var work = 0; job.stack.length; work++) {
+        if (work >= Interpreter.NATIVE_CHUNK_SIZE) {
+          return Interpreter.FunctionResult.CallAgain;
+        }
+        var frame = job.stack[job.stack.length - 1];
+        var isArray = !frame.keys;
+        if (frame.i >= (isArray ? frame.length : frame.keys.length)) {
+          // Done with this object; emit closing bracket.
+          job.stack.pop();
+          emit(job, (frame.count && job.gap ? '\n' + frame.indent : '') +
+              (isArray ? ']' : '}'), perms);
+          continue;
+        }
+        var key = isArray ? String(frame.i) : frame.keys[frame.i];
+        frame.i++;
+        var pd = frame.obj.getOwnPropertyDescriptor(key, perms);
+        value = pd ? pd.value : undefined;
+        var omit = value === undefined || value instanceof intrp.Function;
+        if (!isArray && (omit || !job.keys && !pd.enumerable)) continue;
+        var indent = frame.indent + job.gap;
+        emit(job, (frame.count ? ',' : '') +
+            (job.gap ? '\n' + indent : '') +
+            (isArray ? '' : JSON.stringify(key) + (job.gap ? ': ' : ':')),
+            perms);
+        frame.count++;
+        if (omit) {
+          emit(job, 'null', perms);
+        } else {
+          serialize(job, value, indent, perms);
+        }
+      }
+      return job.out.join('');
+    }
+  });
 };
 
 /**
@@ -2212,6 +2878,7 @@ Interpreter.prototype.initWeakMap_ = function() {
   new this.NativeFunction({
     id: 'WeakMap.prototype.delete', length: 1,
     call: withChecks(function(intrp, thread, state, thisVal, args) {
+      if (intrp.dirtyObjects) intrp.dirtyObjects.add(thisVal);
       return thisVal.weakMap.delete(args[0]);
     }, 'delete')
   });
@@ -2233,6 +2900,7 @@ Interpreter.prototype.initWeakMap_ = function() {
   new this.NativeFunction({
     id: 'WeakMap.prototype.set', length: 2,
     call: withChecks(function set(intrp, thread, state, thisVal, args) {
+      if (intrp.dirtyObjects) intrp.dirtyObjects.add(thisVal);
       thisVal.weakMap.set(args[0], args[1]);
       return thisVal;
     })
@@ -2271,6 +2939,7 @@ Interpreter.prototype.initThread_ = function() {
         throw new intrp.Error(perms, intrp.TYPE_ERROR,
             func + ' is not a function');
       }
+      intrp.checkGuestThreads_(perms);
       return intrp.createThreadForFuncCall(
           perms, func, thisArg, args, intrp.now() + delay, thread.timeLimit);
     }
@@ -2294,9 +2963,14 @@ Interpreter.prototype.initThread_ = function() {
         throw new intrp.Error(perms, intrp.TYPE_ERROR, t + ' is not a Thread');
       }
       // TODO(cpcallen:perms): add security check here.
-      var id = t.thread.id;
-      if (intrp.threads_[id]) {
-        intrp.threads_[id].status = Interpreter.Thread.Status.ZOMBIE;
+      if (t.owner !== perms) {
+        intrp.checkTier_(perms, Tiers.Tier.WIZARD, "kill others' threads");
+      }
+      if (intrp.killThread(t.thread.id) && t.owner !== perms) {
+        intrp.recordPrivileged(perms, 'kill', {
+          'thread': t.thread.id,
+          'owner': t.owner ? intrp.ownerName_(t.owner) : null,
+        });
       }
     }
   });
@@ -2374,6 +3048,23 @@ Interpreter.prototype.initThread_ = function() {
     };
   };
 
+  /**
+   * Throw a PermissionError unless perms controls the given Thread:
+   * i.e., unless the thread is running with perms (or, if it has
+   * finished, was owned by perms) or perms are those of a wizard.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {?Interpreter.Owner} perms The caller's permissions.
+   * @param {!Interpreter.prototype.Thread} t The Thread object.
+   * @param {string} description What the caller is attempting.
+   */
+  var checkControls = function(intrp, perms, t, description) {
+    var owner = (t.thread.status === Interpreter.Thread.Status.ZOMBIE) ?
+        t.owner : t.thread.perms();
+    if (owner !== perms) {
+      intrp.checkTier_(perms, Tiers.Tier.WIZARD, description);
+    }
+  };
+
   new this.NativeFunction({
     id: 'Thread.prototype.getTimeLimit', length: 0,
     call: withChecks(function getTimeLimit(
@@ -2405,6 +3096,85 @@ Interpreter.prototype.initThread_ = function() {
       thisVal.thread.timeLimit = limit;
     })
   });
+
+  // Cooperative cancellation.  Sets the thread's .cancelled property
+  // to true (permanently), and wakes it if it is sleeping so it can
+  // notice promptly.
+  new this.NativeFunction({
+    id: 'Thread.prototype.cancel', length: 0,
+    call: withChecks(function cancel(intrp, thread, state, thisVal, args) {
+      checkControls(intrp, state.scope.perms, thisVal,
+                    "cancel others' threads");
+      var t = thisVal.thread;
+      if (t.cancelled) return;
+      t.cancelled = true;
+      thisVal.defineProperty(
+          'cancelled', Descriptor.none.withValue(true), state.scope.perms);
+      if (t.status === Interpreter.Thread.Status.SLEEPING) {
+        t.runAt = Math.min(t.runAt, intrp.now());
+      }
+    })
+  });
+
+  // Thread-local storage.  Keys are converted to strings, as property
+  // keys are.
+  new this.NativeFunction({
+    id: 'Thread.prototype.getLocal', length: 1,
+    call: withChecks(function getLocal(intrp, thread, state, thisVal, args) {
+      checkControls(intrp, state.scope.perms, thisVal,
+                    "access others' thread-locals");
+      var key = intrp.propertyKeyArg_(thread, state, args[0]);
+      if (key === undefined) return Interpreter.FunctionResult.CallAgain;
+      return thisVal.thread.locals.get(key);
+    })
+  });
+
+  new this.NativeFunction({
+    id: 'Thread.prototype.setLocal', length: 2,
+    call: withChecks(function setLocal(intrp, thread, state, thisVal, args) {
+      checkControls(intrp, state.scope.perms, thisVal,
+                    "access others' thread-locals");
+      var key = intrp.propertyKeyArg_(thread, state, args[0]);
+      if (key === undefined) return Interpreter.FunctionResult.CallAgain;
+      thisVal.thread.locals.set(key, args[1]);
+    })
+  });
+
+  new this.NativeFunction({
+    id: 'Thread.prototype.hasLocal', length: 1,
+    call: withChecks(function hasLocal(intrp, thread, state, thisVal, args) {
+      checkControls(intrp, state.scope.perms, thisVal,
+                    "access others' thread-locals");
+      var key = intrp.propertyKeyArg_(thread, state, args[0]);
+      if (key === undefined) return Interpreter.FunctionResult.CallAgain;
+      return thisVal.thread.locals.has(key);
+    })
+  });
+
+  new this.NativeFunction({
+    id: 'Thread.prototype.deleteLocal', length: 1,
+    call: withChecks(function deleteLocal(
+        intrp, thread, state, thisVal, args) {
+      checkControls(intrp, state.scope.perms, thisVal,
+                    "access others' thread-locals");
+      var key = intrp.propertyKeyArg_(thread, state, args[0]);
+      if (key === undefined) return Interpreter.FunctionResult.CallAgain;
+      return thisVal.thread.locals.delete(key);
+    })
+  });
+
+  // Monotonic time, as by .now(): milliseconds (with microsecond
+  // precision) since this world was created, excluding time when the
+  // server was not running.  Unlike Date.now(), it is not affected by
+  // changes to the system clock, and is the clock by which threads are
+  // scheduled.
+  new this.NativeFunction({
+    id: 'CC.hrtime', length: 0,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return Math.round(intrp.now() * 1000) / 1000;
+    }
+  });
 };
 
 /**
@@ -2440,6 +3210,12 @@ Interpreter.prototype.initPerms_ = function() {
       }
       // TODO(cpcallen:perms): throw if current perms does not
       // control new perms.
+      if (perms !== state.scope.perms) {
+        intrp.checkTier_(state.scope.perms, Tiers.Tier.WIZARD,
+            'change perms');
+        intrp.securityEvent_(Interpreter.SecurityEventType.SET_PERMS,
+            state.scope.perms, {'to': intrp.ownerName_(perms)});
+      }
       state.scope.perms = /** @type {!Interpreter.Owner} */ (perms);
     }
   });
@@ -2474,6 +3250,22 @@ Interpreter.prototype.initPerms_ = function() {
       }
       // TODO(cpcallen:perms): throw if current perms does not
       // control obj and (new) owner.
+      // Giving away one's own objects (or taking those given) is
+      // routine; changing the ownership of others' objects is not.
+      var privileged = obj.owner !== owner && obj.owner !== perms &&
+          owner !== perms && !(obj instanceof intrp.Thread);
+      if (privileged) {
+        intrp.checkTier_(perms, Tiers.Tier.WIZARD,
+            "change the ownership of others' objects");
+      }
+      if (intrp.dirtyObjects) intrp.dirtyObjects.add(obj);
+      if (privileged) {
+        intrp.recordPrivileged(perms, 'chown', {
+          'object': obj.class,
+          'from': obj.owner ? intrp.ownerName_(obj.owner) : null,
+          'to': owner ? intrp.ownerName_(owner) : null,
+        });
+      }
       obj.owner = /** @type {?Interpreter.Owner} */(owner);
       return obj;
     }
@@ -2481,20 +3273,260 @@ Interpreter.prototype.initPerms_ = function() {
 };
 
 /**
- * Initialize the networking subsystem API.
+ * Initialize the Buffer class, for binary data.
  * @private
  */
-Interpreter.prototype.initNetwork_ = function() {
+Interpreter.prototype.initBuffer_ = function() {
+  // Buffer prototype.
+  this.BUFFER = new this.Object(this.ROOT);
+  this.builtins.set('Buffer.prototype', this.BUFFER);
+
+  // Buffer constructor.
   new this.NativeFunction({
-    id: 'CC.connectionListen', length: 2,
+    id: 'Buffer', length: 2,
     /** @type {!Interpreter.NativeCallImpl} */
     call: function(intrp, thread, state, thisVal, args) {
-      var port = args[0];
-      var proto = args[1];
-      var timeLimit = Number(args[2]) || thread.timeLimit;
-      var perms = state.scope.perms;
-      if (port !== (port >>> 0) || port > 0xffff) {
-        throw new intrp.Error(perms, intrp.RANGE_ERROR, 'invalid port');
+      throw new intrp.Error(state.scope.perms, intrp.TYPE_ERROR,
+          "Constructor Buffer requires 'new'");
+    },
+    /** @type {!Interpreter.NativeConstructImpl} */
+    construct: function(intrp, thread, state, args) {
+      var perms = state.scope.perms;
+      return new intrp.Buffer(intrp.toBytes_(args[0], args[1], perms), perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'Buffer.from', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      return new intrp.Buffer(intrp.toBytes_(args[0], args[1], perms), perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'Buffer.isBuffer', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return args[0] instanceof intrp.Buffer;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'Buffer.byteLength', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return intrp.toBytes_(args[0], args[1], state.scope.perms).length;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'Buffer.concat', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var list = args[0];
+      var perms = state.scope.perms;
+      if (!(list instanceof intrp.Array)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'list argument must be an array of Buffers');
+      }
+      var buffers = [];
+      var length = Interpreter.toLength(list.get('length', perms));
+      for (var i = 0; i < length; i++) {
+        var buffer = list.get(String(i), perms);
+        if (!(buffer instanceof intrp.Buffer)) {
+          throw new intrp.Error(perms, intrp.TYPE_ERROR,
+              'list argument must be an array of Buffers');
+        }
+        buffers.push(buffer.data);
+      }
+      return new intrp.Buffer(Buffer.concat(buffers), perms);
+    }
+  });
+
+  // Properties of the Buffer prototype object.
+
+  /**
+   * A narrowing of Interpreter.NativeCallImpl for decorated Buffer
+   * .call implementations.
+   * @typedef {function(this: Interpreter.prototype.NativeFunction,
+   *                    !Interpreter,
+   *                    !Interpreter.Thread,
+   *                    !Interpreter.State,
+   *                    !Interpreter.prototype.Buffer,
+   *                    !Array<?Interpreter.Value>)
+   *               : (?Interpreter.Value|!Interpreter.FunctionResult)}
+   */
+  var BufferCallImpl;
+
+  /**
+   * Decorator to add standard type checks for Buffer prototype
+   * methods.
+   * @param {!BufferCallImpl} func Function to decorate.
+   * @return {!Interpreter.NativeCallImpl} The decorated function.
+   */
+  var withChecks = function(func) {
+    return function call(intrp, thread, state, thisVal, args) {
+      if (!(thisVal instanceof intrp.Buffer)) {
+        throw new intrp.Error(state.scope.perms, intrp.TYPE_ERROR,
+            'Method Buffer.prototype.' + func.name +
+            ' called on incompatible receiver ' + String(thisVal));
+      }
+      return func.apply(this, arguments);
+    };
+  };
+
+  /**
+   * Convert start and end arguments to offsets into a buffer, in the
+   * manner of Array.prototype.slice.
+   * @param {!Buffer} data The buffer.
+   * @param {?Interpreter.Value} start Start argument.
+   * @param {?Interpreter.Value} end End argument.
+   * @return {!Array<number>} Start and end offsets.
+   */
+  var range = function(data, start, end) {
+    var len = data.length;
+    start = Interpreter.toInteger(start);
+    start = (start < 0) ? Math.max(len + start, 0) : Math.min(start, len);
+    end = (end === undefined) ? len : Interpreter.toInteger(end);
+    end = (end < 0) ? Math.max(len + end, 0) : Math.min(end, len);
+    return [start, Math.max(start, end)];
+  };
+
+  new this.NativeFunction({
+    id: 'Buffer.prototype.at', length: 1,
+    call: withChecks(function at(intrp, thread, state, thisVal, args) {
+      var index = Interpreter.toInteger(args[0]);
+      if (index < 0) index += thisVal.data.length;
+      return thisVal.data[index];
+    })
+  });
+
+  new this.NativeFunction({
+    id: 'Buffer.prototype.equals', length: 1,
+    call: withChecks(function equals(intrp, thread, state, thisVal, args) {
+      if (!(args[0] instanceof intrp.Buffer)) {
+        throw new intrp.Error(state.scope.perms, intrp.TYPE_ERROR,
+            'argument must be a Buffer');
+      }
+      return thisVal.data.equals(args[0].data);
+    })
+  });
+
+  new this.NativeFunction({
+    id: 'Buffer.prototype.indexOf', length: 2,
+    call: withChecks(function indexOf(intrp, thread, state, thisVal, args) {
+      var value = args[0];
+      if (typeof value !== 'number') {
+        value = intrp.toBytes_(value, undefined, state.scope.perms);
+      }
+      return thisVal.data.indexOf(value, Interpreter.toInteger(args[1]));
+    })
+  });
+
+  new this.NativeFunction({
+    id: 'Buffer.prototype.slice', length: 2,
+    call: withChecks(function slice(intrp, thread, state, thisVal, args) {
+      var r = range(thisVal.data, args[0], args[1]);
+      // Buffers are immutable, so the slice can share thisVal's data.
+      return new intrp.Buffer(thisVal.data.subarray(r[0], r[1]),
+                              state.scope.perms);
+    })
+  });
+
+  new this.NativeFunction({
+    id: 'Buffer.prototype.toString', length: 3,
+    call: withChecks(function toString(intrp, thread, state, thisVal, args) {
+      var encoding = intrp.checkEncoding_(args[0], state.scope.perms);
+      var r = range(thisVal.data, args[1], args[2]);
+      return thisVal.data.toString(encoding, r[0], r[1]);
+    })
+  });
+};
+
+/**
+ * Encodings of strings as binary data supported by Buffers.
+ * @const {!Array<string>}
+ */
+Interpreter.ENCODINGS = ['utf8', 'hex', 'base64', 'base64url', 'latin1'];
+
+/**
+ * Check that an encoding argument passed to a builtin is one of
+ * Interpreter.ENCODINGS.
+ * @private
+ * @param {?Interpreter.Value} encoding The encoding (default 'utf8').
+ * @param {!Interpreter.Owner} perms Perm to use to create Error object.
+ * @return {string} The encoding.
+ */
+Interpreter.prototype.checkEncoding_ = function(encoding, perms) {
+  if (encoding === undefined) return 'utf8';
+  if (!Interpreter.ENCODINGS.includes(encoding)) {
+    throw new this.Error(perms, this.TYPE_ERROR,
+        'Unknown encoding: ' + String(encoding));
+  }
+  return /** @type {string} */(encoding);
+};
+
+/**
+ * Convert a value passed to a builtin to binary data: a Buffer (whose
+ * data is returned, not copied), a string (encoded with the given
+ * encoding), or an array of bytes.
+ * @private
+ * @param {?Interpreter.Value} value The value.
+ * @param {?Interpreter.Value} encoding Encoding of a string value (see
+ *     .checkEncoding_).
+ * @param {!Interpreter.Owner} perms Perm to use to create Error object.
+ * @return {!Buffer} The data.
+ */
+Interpreter.prototype.toBytes_ = function(value, encoding, perms) {
+  if (value instanceof this.Buffer) {
+    return value.data;
+  } else if (typeof value === 'string') {
+    encoding = this.checkEncoding_(encoding, perms);
+    if (encoding === 'hex' && !/^(?:[0-9a-fA-F]{2})*$/.test(value)) {
+      throw new this.Error(perms, this.SYNTAX_ERROR, 'Invalid hex string');
+    }
+    return Buffer.from(value, encoding);
+  } else if (value instanceof this.Array) {
+    var length = Interpreter.toLength(value.get('length', perms));
+    var data = Buffer.alloc(length);
+    for (var i = 0; i < length; i++) {
+      var byte = value.get(String(i), perms);
+      if (typeof byte !== 'number' || !Number.isInteger(byte) ||
+          byte < 0 || byte > 0xff) {
+        throw new this.Error(perms, this.RANGE_ERROR,
+            'Array elements must be integers from 0 to 255');
+      }
+      data[i] = byte;
+    }
+    return data;
+  }
+  throw new this.Error(perms, this.TYPE_ERROR,
+      'Expected a Buffer, string or array of bytes');
+};
+
+/**
+ * Initialize the networking subsystem API.
+ * @private
+ */
+Interpreter.prototype.initNetwork_ = function() {
+  new this.NativeFunction({
+    id: 'CC.connectionListen', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var port = args[0];
+      var proto = args[1];
+      var timeLimit = Number(args[2]) || thread.timeLimit;
+      var options = args[3];
+      var perms = state.scope.perms;
+      if (intrp.isGuest(perms)) {
+        throw intrp.permissionDenied_(perms,
+            'guests may not listen on ports');
+      }
+      intrp.checkTier_(perms, Tiers.Tier.PROGRAMMER, 'listen on ports');
+      if (port !== (port >>> 0) || port > 0xffff) {
+        throw new intrp.Error(perms, intrp.RANGE_ERROR, 'invalid port');
       } else if (port in intrp.listeners_) {
         throw new intrp.Error(perms, intrp.RANGE_ERROR,
             'port already listened');
@@ -2503,11 +3535,90 @@ Interpreter.prototype.initNetwork_ = function() {
         throw new intrp.Error(perms, intrp.TYPE_ERROR,
            'prototype argument to connectionListen must be an object');
       }
+      var listenOptions = {};
+      /**
+       * Get a duration option.
+       * @param {string} name Name of the option.
+       * @return {number|undefined} Its value (in ms), if given.
+       */
+      var getDuration = function(name) {
+        var value = options.get(name, perms);
+        if (value !== undefined && (typeof value !== 'number' ||
+                                    !(value >= 0) || value === Infinity)) {
+          throw new intrp.Error(perms, intrp.RANGE_ERROR,
+              name + ' must be a non-negative number');
+        }
+        return value;
+      };
+      if (options instanceof intrp.Object) {
+        var protocol = options.get('protocol', perms);
+        var origins = intrp.pseudoToNative(options.get('origins', perms));
+        if (protocol !== undefined) {
+          if (protocol !== 'tcp' && protocol !== 'websocket' &&
+              protocol !== 'telnet' && protocol !== 'http' &&
+              protocol !== 'smtp' && protocol !== 'sse') {
+            throw new intrp.Error(perms, intrp.RANGE_ERROR, 'protocol must ' +
+                'be "tcp", "websocket", "telnet", "http", "smtp" or "sse"');
+          }
+          listenOptions.protocol = protocol;
+        }
+        listenOptions.compress = Boolean(options.get('compress', perms));
+        var features = intrp.pseudoToNative(options.get('features', perms));
+        if (features !== undefined) {
+          if (!Array.isArray(features) || !features.every((f) =>
+              typeof f === 'string' && Interpreter.FEATURE_RE_.test(f))) {
+            throw new intrp.Error(perms, intrp.TYPE_ERROR,
+                'features must be an array of feature names');
+          } else if (listenOptions.protocol !== 'websocket') {
+            throw new intrp.Error(perms, intrp.TYPE_ERROR,
+                'features are supported only by websocket listeners');
+          }
+          listenOptions.features = features;
+        }
+        listenOptions.tls = Boolean(options.get('tls', perms));
+        listenOptions.proxy = Boolean(options.get('proxy', perms));
+        var resume = getDuration('resume');
+        if (resume !== undefined) {
+          if (resume && listenOptions.protocol !== 'websocket') {
+            throw new intrp.Error(perms, intrp.TYPE_ERROR,
+                'resume is supported only by websocket listeners');
+          }
+          listenOptions.resume = resume;
+        }
+        var streams = listenOptions.protocol !== 'http' &&
+            listenOptions.protocol !== 'smtp' &&
+            listenOptions.protocol !== 'sse';
+        var names = ['idle', 'idleWarning', 'keepalive'];
+        for (var i = 0; i < names.length; i++) {
+          var value = getDuration(names[i]);
+          if (value === undefined) continue;
+          if (value && !streams) {
+            throw new intrp.Error(perms, intrp.TYPE_ERROR, names[i] +
+                ' is supported only by tcp, telnet and websocket listeners');
+          }
+          listenOptions[names[i]] = value;
+        }
+        if (listenOptions.tls && !intrp.wrapTls) {
+          throw new intrp.Error(perms, intrp.ERROR, 'TLS is not configured');
+        }
+        if (origins !== undefined) {
+          if (!Array.isArray(origins) ||
+              !origins.every((o) => typeof o === 'string')) {
+            throw new intrp.Error(perms, intrp.TYPE_ERROR,
+                'origins must be an array of strings');
+          }
+          listenOptions.origins = origins;
+        }
+      } else if (options !== undefined) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+           'options argument to connectionListen must be an object');
+      }
       // TODO(cpcallen): do validity check on timeLimit.  It should
       // probaly not be larger than current limit (unless root).
-      var server = new intrp.Server(perms, port, proto, timeLimit);
+      var server =
+          new intrp.Server(perms, port, proto, timeLimit, listenOptions);
       intrp.listeners_[port] = server;
-      var rr = intrp.getResolveReject(thread, state);
+      var rr = intrp.getResolveReject(thread, state, 'listen on port ' + port);
       server.listen(function(error) {
         if (!error) {
           rr.resolve();
@@ -2533,7 +3644,8 @@ Interpreter.prototype.initNetwork_ = function() {
       if (!(intrp.listeners_[port].server_ instanceof net.Server)) {
         throw new Error('no net.Serfer object for port %s??', port);
       }
-      var rr = intrp.getResolveReject(thread, state);
+      var rr =
+          intrp.getResolveReject(thread, state, 'unlisten on port ' + port);
       intrp.listeners_[port].unlisten(function() {
         // Socket (and all open connections on it) now closed.
         delete intrp.listeners_[/** @type {number} */(port)];
@@ -2543,25 +3655,180 @@ Interpreter.prototype.initNetwork_ = function() {
     }
   });
 
+  new this.NativeFunction({
+    id: 'CC.connectionOpen', length: 3,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var obj = args[0];
+      var host = args[1];
+      var port = args[2];
+      var options = args[3];
+      var perms = state.scope.perms;
+      if (perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(perms,
+            'only root may open connections');
+      } else if (!(obj instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'first argument to connectionOpen must be an object');
+      } else if (obj.socket && obj.socket.resource &&
+                 !obj.socket.resource.destroyed) {
+        throw new intrp.Error(perms, intrp.ERROR,
+            'object is already connected');
+      } else if (typeof host !== 'string' || !host) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR, 'invalid host');
+      } else if (port !== (port >>> 0) || port < 1 || port > 0xffff) {
+        throw new intrp.Error(perms, intrp.RANGE_ERROR, 'invalid port');
+      }
+      var lines = false;
+      var timeLimit = thread.timeLimit;
+      if (options instanceof intrp.Object) {
+        lines = Boolean(options.get('lines', perms));
+        timeLimit = Number(options.get('timeLimit', perms)) || timeLimit;
+      } else if (options !== undefined) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+           'options argument to connectionOpen must be an object');
+      }
+      var address = host + ':' + port;
+      intrp.log('net', 'Connecting to %s', address);
+      var socket = net.createConnection(
+          {host: host, port: port, allowHalfOpen: true});
+      intrp.noteExternalEffect_('connectionOpen', null,
+                                {'host': host, 'port': port});
+      intrp.attachSocket_(obj, socket, perms, timeLimit, address,
+                          'to ' + address, {connected: false, lines: lines});
+    }
+  });
+
+  /**
+   * Write data to a connected object's connection, blocking the thread
+   * if the client needs to catch up.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {!Interpreter.Thread} thread The current thread.
+   * @param {!Interpreter.State} state The current state.
+   * @param {?Interpreter.Value} obj The connected object.
+   * @param {?Interpreter.Value} data The data: a string, or (if binary)
+   *     a Buffer or a string of characters U+0000 to U+00FF, one per
+   *     byte.
+   * @param {boolean} binary Send the data as a binary message?
+   * @return {?Interpreter.Value|!Interpreter.FunctionResult}
+   */
+  var writeConnection = function(intrp, thread, state, obj, data, binary) {
+    if (!(obj instanceof intrp.Object) || !obj.socket) {
+      throw new intrp.Error(state.scope.perms, intrp.TYPE_ERROR,
+          'object is not connected');
+    } else if (binary && data instanceof intrp.Buffer) {
+      // OK.
+    } else if (typeof data !== 'string') {
+      throw new intrp.Error(state.scope.perms, intrp.TYPE_ERROR,
+          binary ? 'data is not a string or Buffer' : 'data is not a string');
+    } else if (binary && /[^\x00-\xff]/.test(data)) {
+      throw new intrp.Error(state.scope.perms, intrp.RANGE_ERROR,
+          'binary data must contain only characters U+0000 to U+00FF');
+    }
+    var socket = obj.socket.resource;
+    if (!socket) {
+      throw new intrp.Error(state.scope.perms, intrp.ERROR,
+          'connection from ' + obj.socket.description +
+          ' no longer exists');
+    } else if (socket instanceof http.ServerResponse &&
+               socket.writableEnded) {
+      throw new intrp.Error(state.scope.perms, intrp.ERROR,
+          'response to ' + obj.socket.description + ' already complete');
+    } else if (binary && !((socket instanceof WebSocket.Connection ||
+                            socket instanceof Sessions.Session) &&
+                           socket.binary)) {
+      throw new intrp.Error(state.scope.perms, intrp.TYPE_ERROR,
+          'connection from ' + obj.socket.description +
+          ' does not accept binary messages');
+    }
+    if (binary) {
+      data = (data instanceof intrp.Buffer) ?
+          data.data : Buffer.from(/** @type {string} */(data), 'latin1');
+    }
+    var full = !socket.write(data);
+    intrp.noteExternalEffect_('connectionWrite', socket,
+                              {'length': data.length});
+    if (full && (socket instanceof WebSocket.Connection ||
+                 socket instanceof Sessions.Session ||
+                 socket instanceof SSE.Connection ||
+                 socket instanceof http.ServerResponse)) {
+      // Backpressure: wait until the client has caught up.
+      var rr = intrp.getResolveReject(thread, state,
+          'write to ' + obj.socket.description);
+      var resume = function() {
+        socket.removeListener('drain', resume);
+        socket.removeListener('close', resume);
+        rr.resolve();
+      };
+      socket.on('drain', resume);
+      socket.on('close', resume);
+      return Interpreter.FunctionResult.Block;
+    }
+  };
+
   new this.NativeFunction({
     id: 'CC.connectionWrite', length: 2,
     /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return writeConnection(intrp, thread, state, args[0], args[1], false);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.connectionWriteBinary', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return writeConnection(intrp, thread, state, args[0], args[1], true);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.connectionClose', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
     call: function(intrp, thread, state, thisVal, args) {
       var obj = args[0];
-      var data = args[1];
       if (!(obj instanceof intrp.Object) || !obj.socket) {
         throw new intrp.Error(state.scope.perms, intrp.TYPE_ERROR,
             'object is not connected');
-      } else if (typeof data !== 'string') {
-        throw new intrp.Error(state.scope.perms, intrp.TYPE_ERROR,
-            'data is not a string');
       }
-      obj.socket.write(data);
+      var socket = obj.socket.resource;
+      if (!socket) return;  // No longer exists, so already closed.
+      socket.end();
+      intrp.noteExternalEffect_('connectionClose', socket, {});
     }
   });
 
   new this.NativeFunction({
-    id: 'CC.connectionClose', length: 2,
+    id: 'CC.connectionSetIdle', length: 3,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var obj = args[0];
+      var idle = args[1];
+      var warning = args[2];
+      var perms = state.scope.perms;
+      if (!(obj instanceof intrp.Object) || !obj.socket) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'object is not connected');
+      } else if (perms !== intrp.ROOT && perms !== obj.owner) {
+        throw intrp.permissionDenied_(perms,
+            "only root or the object's owner may set its idle timeout");
+      } else if (typeof idle !== 'number' || !(idle >= 0) ||
+                 idle === Infinity) {
+        throw new intrp.Error(perms, intrp.RANGE_ERROR,
+            'idle must be a non-negative number');
+      } else if (warning !== undefined && (typeof warning !== 'number' ||
+                 !(warning >= 0) || warning === Infinity)) {
+        throw new intrp.Error(perms, intrp.RANGE_ERROR,
+            'warning must be a non-negative number');
+      }
+      // No longer exists (or not a connection), so nothing to time out.
+      if (!obj.socket.idle || !obj.socket.resource) return;
+      obj.socket.idle.set(idle, Interpreter.idleWarning_(idle, warning));
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.connectionSetEcho', length: 2,
     /** @type {!Interpreter.NativeCallImpl} */
     call: function(intrp, thread, state, thisVal, args) {
       var obj = args[0];
@@ -2569,647 +3836,6169 @@ Interpreter.prototype.initNetwork_ = function() {
         throw new intrp.Error(state.scope.perms, intrp.TYPE_ERROR,
             'object is not connected');
       }
-      obj.socket.end();
+      var socket = obj.socket.resource;
+      // Only telnet clients can be asked not to echo.
+      if (!(socket instanceof Telnet.Connection)) return false;
+      socket.setEcho(Boolean(args[1]));
+      return true;
     }
   });
 
   new this.NativeFunction({
-    id: 'CC.xhr', length: 1,
+    id: 'CC.connectionAttach', length: 2,
     /** @type {!Interpreter.NativeCallImpl} */
     call: function(intrp, thread, state, thisVal, args) {
-      var url = String(args[0]);
+      var obj = args[0];
+      var player = args[1];
       var perms = state.scope.perms;
-      if (url.match(/^http:\/\//)) {
-        var req = http.get(url);
-      } else if (url.match(/^https:\/\//)) {
-        req = https.get(url);
-      } else {
-        throw new intrp.Error(perms, intrp.SYNTAX_ERROR,
-            'Unrecognized URL "' + url + '"');
+      if (perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(perms,
+            'only root may attach connections to players');
+      } else if (!(obj instanceof intrp.Object) || !obj.socket) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'object is not connected');
+      } else if (!(player instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'player must be an object');
+      } else if (!intrp.hostHandles_.has(obj.socket)) {
+        throw new intrp.Error(perms, intrp.ERROR,
+            'connection from ' + obj.socket.description +
+            ' no longer exists');
       }
-      intrp.log('net', 'XHR for %s: connect', url);
-      var rr = intrp.getResolveReject(thread, state);
-      req.on('response', function(res) {
-        intrp.log('net', 'XHR for %s: response', url);
-        if (res.statusCode !== 200) {
-          var err = new intrp.Error(perms, intrp.ERROR,
-              'HTTP request failed: ' + res.statusCode + ' ' +
-              res.statusMessage);
-          err.set('statusCode', Number(res.statusCode), perms);
-          err.set('statusMessage', String(res.statusMessage), perms);
-          res.resume();
-          rr.reject(err, perms);
-          return;
-        }
-        var body = '';
-        res.on('data', function(data) {
-          body += String(data);
-        });
-        res.on('end', function() {
-          intrp.log('net', 'XHR for %s: end', url);
-          rr.resolve(body);
-        });
-      }).on('error', function(e) {
-        intrp.log('net', 'XHR for %s: %s', url, e);
-        rr.reject(intrp.errorNativeToPseudo(e, perms), perms);
-      });
-      return Interpreter.FunctionResult.Block;
+      return intrp.attachPlayer_(obj.socket, player);
     }
   });
-};
 
-/**
- * The ToInteger function from ES6 §7.1.4.  The abstract operation
- * ToInteger converts argument to an integral numeric value.
- * @param {?Interpreter.Value} value
- * @return {number} An integer if the value can be converted to such;
- *     0 otherwise.
- */
-Interpreter.toInteger = function toInteger(value) {
-  var number = Number(value);
-  if (isNaN(number)) {
-    return 0;
-  } else if (number === 0 || !isFinite(number)) {
-    return number;
-  }
-  return Math.trunc(number);
-};
+  new this.NativeFunction({
+    id: 'CC.connectionDetach', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var obj = args[0];
+      var perms = state.scope.perms;
+      if (perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(perms,
+            'only root may detach connections from players');
+      } else if (!(obj instanceof intrp.Object) || !obj.socket) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'object is not connected');
+      }
+      return intrp.detachPlayer_(obj.socket, 'detach');
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.connectionPlayer', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var obj = args[0];
+      if (!(obj instanceof intrp.Object) || !obj.socket) {
+        throw new intrp.Error(state.scope.perms, intrp.TYPE_ERROR,
+            'object is not connected');
+      }
+      return obj.socket.player;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.connectionIdentity', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var obj = args[0];
+      var perms = state.scope.perms;
+      if (perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(perms,
+            'only root may see login IDs');
+      } else if (!(obj instanceof intrp.Object) || !obj.socket) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'object is not connected');
+      }
+      return obj.socket.identity;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.playerConnections', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var player = args[0];
+      var perms = state.scope.perms;
+      if (!(player instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'player must be an object');
+      }
+      return intrp.createArrayFromList(
+          intrp.connectionsOf_(player).map(function(handle) {
+            return handle.target;
+          }), perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.httpWriteHead', length: 3,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var obj = args[0];
+      var status = args[1];
+      var headers = intrp.pseudoToNative(args[2]);
+      var perms = state.scope.perms;
+      if (!(obj instanceof intrp.Object) || !obj.socket ||
+          !(obj.socket.resource instanceof http.ServerResponse)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'object is not an HTTP response');
+      }
+      var res = obj.socket.resource;
+      if (res.headersSent) {
+        throw new intrp.Error(perms, intrp.ERROR, 'headers already sent');
+      } else if (status !== (status >>> 0) || status < 100 || status > 999) {
+        throw new intrp.Error(perms, intrp.RANGE_ERROR, 'invalid status');
+      } else if (headers !== undefined &&
+                 (typeof headers !== 'object' || headers === null)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'headers must be an object');
+      }
+      try {
+        res.writeHead(status, headers);
+      } catch (e) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR, String(e.message));
+      }
+      intrp.noteExternalEffect_('httpWriteHead', res, {'status': status});
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.xhr', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var url = String(args[0]);
+      var perms = state.scope.perms;
+      if (intrp.isGuest(perms)) {
+        throw intrp.permissionDenied_(perms,
+            'guests may not make requests');
+      }
+      intrp.checkTier_(perms, Tiers.Tier.PROGRAMMER, 'make requests');
+      intrp.checkTaint_(args[0], perms, 'CC.xhr');
+      if (url.match(/^http:\/\//)) {
+        var req = http.get(url);
+      } else if (url.match(/^https:\/\//)) {
+        req = https.get(url);
+      } else {
+        throw new intrp.Error(perms, intrp.SYNTAX_ERROR,
+            'Unrecognized URL "' + url + '"');
+      }
+      intrp.log('net', 'XHR for %s: connect', url);
+      intrp.noteExternalEffect_('xhr', null, {'url': url});
+      var rr = intrp.getResolveReject(thread, state, 'XHR for ' + url);
+      req.on('response', function(res) {
+        intrp.log('net', 'XHR for %s: response', url);
+        if (res.statusCode !== 200) {
+          var err = new intrp.Error(perms, intrp.ERROR,
+              'HTTP request failed: ' + res.statusCode + ' ' +
+              res.statusMessage);
+          err.set('statusCode', Number(res.statusCode), perms);
+          err.set('statusMessage', String(res.statusMessage), perms);
+          res.resume();
+          rr.reject(err, perms);
+          return;
+        }
+        var body = '';
+        res.on('data', function(data) {
+          body += String(data);
+        });
+        res.on('end', function() {
+          intrp.log('net', 'XHR for %s: end', url);
+          rr.resolve(intrp.taint(body));
+        });
+      }).on('error', function(e) {
+        intrp.log('net', 'XHR for %s: %s', url, e);
+        rr.reject(intrp.errorNativeToPseudo(e, perms), perms);
+      });
+      return Interpreter.FunctionResult.Block;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.fetch', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      if (intrp.isGuest(perms)) {
+        throw intrp.permissionDenied_(perms,
+            'guests may not make requests');
+      }
+      intrp.checkTier_(perms, Tiers.Tier.PROGRAMMER, 'make requests');
+      intrp.checkTaint_(args[0], perms, 'CC.fetch');
+      var url = String(args[0]);
+      var options = args[1];
+      var parsed;
+      try {
+        parsed = new URL(url);
+      } catch (e) {
+        // Fall through.
+      }
+      if (!parsed || (parsed.protocol !== 'http:' &&
+                      parsed.protocol !== 'https:')) {
+        throw new intrp.Error(perms, intrp.SYNTAX_ERROR,
+            'Unrecognized URL "' + url + '"');
+      }
+      if (options === undefined) {
+        options = {};
+      } else if (options instanceof intrp.Object) {
+        intrp.checkTaint_(options.get('body', perms), perms, 'CC.fetch');
+        options = intrp.pseudoToNative(options);
+      } else {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'options must be an object');
+      }
+      var method = (options.method === undefined) ?
+          'GET' : String(options.method).toUpperCase();
+      var headers = options.headers;
+      if (headers !== undefined &&
+          (typeof headers !== 'object' || headers === null)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'headers must be an object');
+      }
+      var body = (options.body === undefined) ?
+          undefined : String(options.body);
+      var maxTimeout = ('fetchTimeout' in intrp.options) ?
+          intrp.options.fetchTimeout : Interpreter.FETCH_TIMEOUT;
+      var timeout = (options.timeout === undefined) ?
+          maxTimeout : Math.min(Number(options.timeout), maxTimeout);
+      if (!(timeout > 0)) {
+        throw new intrp.Error(perms, intrp.RANGE_ERROR, 'invalid timeout');
+      }
+      if (!intrp.fetchPermitted_(parsed.hostname)) {
+        throw intrp.permissionDenied_(perms,
+            'Requests to ' + parsed.hostname + ' are not permitted');
+      }
+      // Enforce per-owner rate limit.
+      var limit = ('fetchRateLimit' in intrp.options) ?
+          intrp.options.fetchRateLimit : Interpreter.FETCH_RATE_LIMIT;
+      if (!intrp.checkRate_(intrp.fetchTimes_, perms, limit,
+                            Interpreter.FETCH_RATE_PERIOD)) {
+        throw intrp.quotaExceeded_(perms, 'fetchRateLimit', limit,
+            'Too many requests; try again later');
+      }
+
+      var req;
+      try {
+        req = (parsed.protocol === 'https:' ? https : http).request(
+            parsed, {method: method, headers: headers});
+      } catch (e) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR, String(e.message));
+      }
+      intrp.log('net', 'Fetch %s %s: connect', method, url);
+      intrp.noteExternalEffect_('fetch', null, {'url': url, 'method': method});
+      var rr = intrp.getResolveReject(thread, state,
+                                      'Fetch ' + method + ' ' + url);
+      var done = false;
+      var fail = function(message) {
+        if (done) return;
+        done = true;
+        clearTimeout(timer);
+        intrp.log('net', 'Fetch %s %s: %s', method, url, message);
+        req.destroy();
+        rr.reject(new intrp.Error(perms, intrp.ERROR, message), perms);
+      };
+      var timer = setTimeout(function() {
+        fail('Request timed out');
+      }, timeout);
+      var maxResponse = ('fetchMaxResponse' in intrp.options) ?
+          intrp.options.fetchMaxResponse : Interpreter.FETCH_MAX_RESPONSE;
+      req.on('response', function(res) {
+        intrp.log('net', 'Fetch %s %s: response', method, url);
+        var chunks = [];
+        var length = 0;
+        res.on('data', function(chunk) {
+          length += chunk.length;
+          if (length > maxResponse) {
+            fail('Response too large');
+          } else {
+            chunks.push(chunk);
+          }
+        });
+        res.on('end', function() {
+          if (done) return;
+          done = true;
+          clearTimeout(timer);
+          intrp.log('net', 'Fetch %s %s: end', method, url);
+          rr.resolve(intrp.nativeToPseudo({
+            status: res.statusCode,
+            statusText: res.statusMessage,
+            headers: res.headers,
+            body: intrp.taint(Buffer.concat(chunks).toString()),
+          }, perms));
+        });
+        res.on('error', function(e) {
+          fail(String(e.message));
+        });
+      }).on('error', function(e) {
+        fail(String(e.message));
+      });
+      req.end(body);
+      return Interpreter.FunctionResult.Block;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.mailSend', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var message = args[0];
+      var callback = args[1];
+      var perms = state.scope.perms;
+      if (intrp.isGuest(perms)) {
+        throw intrp.permissionDenied_(perms,
+            'guests may not send mail');
+      }
+      intrp.checkTier_(perms, Tiers.Tier.PROGRAMMER, 'send mail');
+      if (!intrp.sendMail) {
+        throw new intrp.Error(perms, intrp.ERROR, 'Mail is not configured');
+      } else if (!(message instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'message must be an object');
+      } else if (callback !== undefined &&
+                 !(callback instanceof intrp.Function)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'callback must be a function');
+      }
+      var to = intrp.pseudoToNative(message.get('to', perms));
+      if (typeof to === 'string') to = [to];
+      var maxRecipients = ('mailMaxRecipients' in intrp.options) ?
+          intrp.options.mailMaxRecipients : Interpreter.MAIL_MAX_RECIPIENTS;
+      if (!Array.isArray(to) || !to.length) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'to must be an address or an array of addresses');
+      } else if (to.length > maxRecipients) {
+        throw new intrp.Error(perms, intrp.RANGE_ERROR,
+            'too many recipients');
+      }
+      var params = intrp.pseudoToNative(message.get('params', perms));
+      var replyTo = message.get('replyTo', perms);
+      var native = {
+        to: to,
+        subject: String(message.get('subject', perms) || ''),
+        text: String(message.get('text', perms) || ''),
+        replyTo: (replyTo === undefined) ? undefined : String(replyTo),
+        params: (params && typeof params === 'object') ? params : undefined,
+      };
+      var limit = ('mailRateLimit' in intrp.options) ?
+          intrp.options.mailRateLimit : Interpreter.MAIL_RATE_LIMIT;
+      if (!intrp.checkRate_(intrp.mailTimes_, perms, limit,
+                            Interpreter.MAIL_RATE_PERIOD)) {
+        throw intrp.quotaExceeded_(perms, 'mailRateLimit', limit,
+            'Too many messages; try again later');
+      }
+      var sent;
+      try {
+        sent = intrp.sendMail(native);
+      } catch (e) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR, String(e.message));
+      }
+      intrp.log('net', 'Mail to %s: sending', to.join(', '));
+      intrp.noteExternalEffect_('mailSend', null, {'to': to.join(', ')});
+      // Report the outcome to the callback, if any.  N.B. that this
+      // does not survive serialization: if the server is restarted
+      // before delivery is complete, the callback is never called.
+      var report = function(args) {
+        if (callback && perms !== null) {
+          intrp.createThreadForFuncCall(
+              perms, callback, undefined, args, undefined, thread.timeLimit);
+        }
+      };
+      sent.then(function(reply) {
+        intrp.log('net', 'Mail to %s: %s', to.join(', '), reply);
+        report([null, reply]);
+      }, function(e) {
+        intrp.log('net', 'Mail to %s: %s', to.join(', '), e.message);
+        report([intrp.errorNativeToPseudo(e, perms)]);
+      });
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.ban', length: 3,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var network = args[0];
+      var reason = args[1];
+      var expires = args[2];
+      var perms = state.scope.perms;
+      if (perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(perms, 'only root may ban');
+      } else if (typeof network !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'network must be a string');
+      } else if (expires !== undefined && expires !== null &&
+                 (typeof expires !== 'number' || !isFinite(expires))) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'expires must be a time or null');
+      }
+      try {
+        var ban = intrp.ban(network,
+                            (reason === undefined) ? '' : String(reason),
+                            (expires === undefined) ? null : expires);
+      } catch (e) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR, String(e.message));
+      }
+      intrp.recordPrivileged(perms, 'ban', {
+        'network': network,
+        'reason': (reason === undefined) ? '' : String(reason),
+      });
+      return ban;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.unban', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var network = args[0];
+      var perms = state.scope.perms;
+      if (perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(perms, 'only root may unban');
+      }
+      try {
+        var removed = intrp.unban(String(network));
+      } catch (e) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR, String(e.message));
+      }
+      if (removed) {
+        intrp.recordPrivileged(perms, 'unban', {'network': String(network)});
+      }
+      return removed;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.bans', length: 0,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      if (perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(perms,
+            'only root may list bans');
+      }
+      return intrp.nativeToPseudo(intrp.getBans(), perms);
+    }
+  });
+
+  /**
+   * Check the arguments common to the CC.account* functions.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {!Interpreter.Owner} perms The caller's permissions.
+   * @param {*} name The account name passed.
+   * @param {string} what Description of the operation, for errors.
+   */
+  var checkAccountArgs = function(intrp, perms, name, what) {
+    if (perms !== intrp.ROOT) {
+      throw intrp.permissionDenied_(perms, 'only root may ' + what);
+    } else if (typeof name !== 'string' || !name) {
+      throw new intrp.Error(perms, intrp.TYPE_ERROR,
+          'name must be a non-empty string');
+    }
+  };
+
+  /**
+   * Block a thread until an account operation completes.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {!Interpreter.Thread} thread The thread.
+   * @param {!Interpreter.State} state The state of the call.
+   * @param {string} description Description of the operation.
+   * @param {!Promise<*>} promise The operation.
+   * @return {!Interpreter.FunctionResult}
+   */
+  var awaitAccount = function(intrp, thread, state, description, promise) {
+    var perms = state.scope.perms;
+    var rr = intrp.getResolveReject(thread, state, description);
+    promise.then(function(value) {
+      rr.resolve(value);
+    }, function(e) {
+      rr.reject(intrp.errorNativeToPseudo(e, perms), perms);
+    });
+    return Interpreter.FunctionResult.Block;
+  };
+
+  new this.NativeFunction({
+    id: 'CC.accountCreate', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      checkAccountArgs(intrp, state.scope.perms, name, 'create accounts');
+      return awaitAccount(intrp, thread, state, 'create account ' + name,
+                          intrp.createAccount(name, args[1]));
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.accountVerify', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      checkAccountArgs(intrp, state.scope.perms, name, 'verify accounts');
+      return awaitAccount(intrp, thread, state, 'verify account ' + name,
+                          intrp.verifyAccount(name, args[1]));
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.accountSetPassword', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      checkAccountArgs(intrp, state.scope.perms, name, 'set passwords');
+      return awaitAccount(intrp, thread, state,
+                          'set password of account ' + name,
+                          intrp.setAccountPassword(name, args[1]));
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.accountRequireReset', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      var ttl = args[1];
+      var perms = state.scope.perms;
+      checkAccountArgs(intrp, perms, name, 'reset accounts');
+      if (ttl !== undefined &&
+          (typeof ttl !== 'number' || !isFinite(ttl) || ttl <= 0)) {
+        throw new intrp.Error(perms, intrp.RANGE_ERROR,
+            'ttl must be a positive number');
+      }
+      try {
+        return intrp.requireAccountReset(name, ttl);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.accountReset', length: 3,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      checkAccountArgs(intrp, state.scope.perms, name, 'reset accounts');
+      return awaitAccount(intrp, thread, state, 'reset account ' + name,
+                          intrp.resetAccountPassword(name, args[1], args[2]));
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.accountDelete', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      checkAccountArgs(intrp, state.scope.perms, name, 'delete accounts');
+      return intrp.deleteAccount(name);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.accountInfo', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      var perms = state.scope.perms;
+      checkAccountArgs(intrp, perms, name, 'inspect accounts');
+      var info = intrp.getAccount(name);
+      return info && intrp.nativeToPseudo(info, perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.guestCreate', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var proto = args[0];
+      var connection = args[1];
+      var perms = state.scope.perms;
+      if (perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(perms,
+            'only root may create guests');
+      } else if (proto !== null && !(proto instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'prototype must be an object or null');
+      } else if (connection !== undefined && connection !== null &&
+                 !(connection instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'connection must be an object');
+      }
+      try {
+        return intrp.createGuest(proto, connection || null);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.guestRelease', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var guest = args[0];
+      var perms = state.scope.perms;
+      if (perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(perms,
+            'only root may release guests');
+      }
+      return (guest instanceof intrp.Object) && intrp.releaseGuest(guest);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.isGuest', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return intrp.isGuest(args[0]);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.federationPeers', length: 0,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      if (perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(perms,
+            'only root may list peer worlds');
+      }
+      return intrp.nativeToPseudo(
+          intrp.federation ? intrp.federation.peers() : [], perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.federationTeleport', length: 3,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var peer = args[0];
+      var info = args[1];
+      var owner = args[2];
+      var perms = state.scope.perms;
+      if (perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(perms,
+            'only root may teleport players');
+      } else if (!intrp.federation) {
+        throw new intrp.Error(perms, intrp.ERROR,
+            'Federation is not configured');
+      } else if (typeof peer !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'peer must be a string');
+      } else if (owner !== undefined && owner !== null &&
+                 !(owner instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'owner must be an object or null');
+      }
+      try {
+        var json = JSON.stringify(intrp.pseudoToNative(info));
+      } catch (e) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'info must be JSON-compatible');
+      }
+      info = (json === undefined) ? null : JSON.parse(json);
+      var teleport = intrp.federation.teleport(peer, owner || null, info);
+      intrp.noteExternalEffect_('federationTeleport', null, {'peer': peer});
+      var rr = intrp.getResolveReject(thread, state, 'teleport to ' + peer);
+      teleport.then(function(result) {
+        rr.resolve(intrp.nativeToPseudo(result, perms));
+      }, function(e) {
+        rr.reject(intrp.errorNativeToPseudo(e, perms), perms);
+      });
+      return Interpreter.FunctionResult.Block;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.accountTotpEnroll', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      var issuer = args[1];
+      var perms = state.scope.perms;
+      checkAccountArgs(intrp, perms, name, 'enroll accounts');
+      if (typeof issuer !== 'string' || !issuer) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'issuer must be a non-empty string');
+      }
+      try {
+        return intrp.nativeToPseudo(intrp.enrollTotp(name, issuer), perms);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.accountTotpConfirm', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      var perms = state.scope.perms;
+      checkAccountArgs(intrp, perms, name, 'enroll accounts');
+      try {
+        var codes = intrp.confirmTotp(name, args[1]);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+      return codes && intrp.nativeToPseudo(codes, perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.accountTotpDisable', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      checkAccountArgs(intrp, state.scope.perms, name, 'enroll accounts');
+      return intrp.disableTotp(name);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.accountVerifyCode', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      checkAccountArgs(intrp, state.scope.perms, name, 'verify accounts');
+      return intrp.verifyAccountCode(name, args[1]);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.accountRecoveryCodes', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      var perms = state.scope.perms;
+      checkAccountArgs(intrp, perms, name, 'enroll accounts');
+      try {
+        return intrp.nativeToPseudo(intrp.regenerateRecoveryCodes(name),
+                                    perms);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.rateLimit', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return intrp.rateLimit_('record', args[0], args[1], state.scope.perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.rateLimitCheck', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return intrp.rateLimit_('check', args[0], args[1], state.scope.perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.rateLimitReset', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      intrp.rateLimit_('reset', args[0], args[1], state.scope.perms);
+    }
+  });
+};
+
+/**
+ * Initialize the cryptography API (see cryptography.js).
+ * @private
+ */
+Interpreter.prototype.initCrypto_ = function() {
+  var intrp = this;
+  /**
+   * Call a Cryptography function, passing it the data of any Buffer
+   * arguments, and converting its result (or any error it throws).
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {!Interpreter.Owner} perms Perms of the caller.
+   * @param {function(...?): ?} func The function.
+   * @param {!Array<?>} args Arguments to pass to it.
+   * @return {?Interpreter.Value} Its result.
+   */
+  var call = function(intrp, perms, func, args) {
+    try {
+      return intrp.nativeToPseudo(func.apply(null, args.map(unwrap)), perms);
+    } catch (e) {
+      throw intrp.errorNativeToPseudo(e, perms);
+    }
+  };
+
+  /**
+   * Get the data of a Buffer argument.
+   * @param {?} arg The argument.
+   * @return {?} Its data, if a Buffer; otherwise the argument itself.
+   */
+  var unwrap = function(arg) {
+    return (arg instanceof intrp.Buffer) ? arg.data : arg;
+  };
+
+  /**
+   * Get the cost of hashing data arguments.
+   * @param {...?} var_args The arguments.
+   * @return {number} The cost (in ms) of hashing those that are strings
+   *     or Buffers.
+   */
+  var hashCost = function(var_args) {
+    var cost = 0;
+    for (var i = 0; i < arguments.length; i++) {
+      var data = unwrap(arguments[i]);
+      if (typeof data === 'string' || Buffer.isBuffer(data)) {
+        cost += Cryptography.hashCost(data);
+      }
+    }
+    return cost;
+  };
+
+  /**
+   * Block the calling thread until a key has been derived.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {!Interpreter.Thread} thread The calling thread.
+   * @param {!Interpreter.State} state The calling state.
+   * @param {string} description Description of the operation.
+   * @param {!Promise<string|!Buffer>} promise The key, once derived.
+   * @return {!Interpreter.FunctionResult} FunctionResult.Block.
+   */
+  var awaitKey = function(intrp, thread, state, description, promise) {
+    var perms = state.scope.perms;
+    var rr = intrp.getResolveReject(thread, state, description);
+    promise.then(function(key) {
+      rr.resolve(intrp.nativeToPseudo(key, perms));
+    }, function(e) {
+      rr.reject(intrp.errorNativeToPseudo(e, perms), perms);
+    });
+    return Interpreter.FunctionResult.Block;
+  };
+
+  new this.NativeFunction({
+    id: 'CC.crypto.hash', length: 3,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      intrp.charge_(hashCost(args[1]), perms);
+      return call(intrp, perms, Cryptography.hash, args);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.crypto.hmac', length: 4,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      intrp.charge_(hashCost(args[1], args[2]), perms);
+      return call(intrp, perms, Cryptography.hmac, args);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.crypto.pbkdf2', length: 6,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      var iterations = call(intrp, perms, Cryptography.checkCount,
+          [args[3], Cryptography.MAX_ITERATIONS, 'iterations']);
+      var length = call(intrp, perms, Cryptography.checkCount,
+          [args[4], Cryptography.MAX_BYTES, 'length']);
+      intrp.charge_(Cryptography.pbkdf2Cost(iterations, length), perms);
+      return awaitKey(intrp, thread, state, 'PBKDF2 key derivation',
+          Cryptography.pbkdf2.apply(null, args.map(unwrap)));
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.crypto.scrypt', length: 5,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      var cost = call(intrp, perms, Cryptography.checkCount,
+          [args[2], Cryptography.MAX_COST, 'cost']);
+      intrp.charge_(Cryptography.scryptCost(cost), perms);
+      return awaitKey(intrp, thread, state, 'scrypt key derivation',
+          Cryptography.scrypt.apply(null, args.map(unwrap)));
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.crypto.equal', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      intrp.charge_(hashCost(args[0], args[1]), perms);
+      return call(intrp, perms, Cryptography.equal, args);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.crypto.randomBytes', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return call(intrp, state.scope.perms, Cryptography.randomBytes,
+                  [args[0], args[1], intrp.randomBytes.bind(intrp)]);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.crypto.randomInt', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return call(intrp, state.scope.perms, Cryptography.randomInt,
+                  [args[0], args[1], intrp.randomBytes.bind(intrp)]);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.crypto.token', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return call(intrp, state.scope.perms, Cryptography.token,
+                  [args[0], intrp.randomBytes.bind(intrp)]);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.crypto.uuid', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return call(intrp, state.scope.perms, Cryptography.uuid,
+                  [args[0], Date.now(), intrp.randomBytes.bind(intrp)]);
+    }
+  });
+};
+
+/**
+ * Initialize the compression API (see compression.js).
+ * @private
+ */
+Interpreter.prototype.initCompression_ = function() {
+  new this.NativeFunction({
+    id: 'CC.compress', length: 3,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      var data = intrp.toBytes_(args[1], undefined, perms);
+      try {
+        Compression.getFormat(args[0]);
+        Compression.checkData(data);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+      intrp.charge_(Compression.compressCost(data), perms);
+      try {
+        return new intrp.Buffer(
+            Compression.compress(args[0], data, args[2]), perms);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.decompress', length: 3,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      var data = intrp.toBytes_(args[1], 'base64', perms);
+      try {
+        var result = Compression.decompress(args[0], data, args[2]);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+      // Charged afterwards, since the cost depends on the result (whose
+      // length is limited).
+      intrp.charge_(Compression.decompressCost(result), perms);
+      return new intrp.Buffer(result, perms);
+    }
+  });
+};
+
+/**
+ * Initialize the logging API (see logging.js).
+ * @private
+ */
+Interpreter.prototype.initLogging_ = function() {
+  var intrp = this;
+  /**
+   * Describe a value passed to CC.log.
+   * @param {?Interpreter.Value} value The value.
+   * @return {string} The value, if a string; otherwise a description.
+   */
+  var describe = function(value) {
+    if (value instanceof intrp.Object) return '[object ' + value.class + ']';
+    return String(value);
+  };
+
+  new this.NativeFunction({
+    id: 'CC.log', length: 0,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      intrp.writeLog(state.scope.perms, 'info', args.map(describe).join(' '));
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.logWrite', length: 3,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var level = args[0];
+      var message = args[1];
+      var fields = args[2];
+      var perms = state.scope.perms;
+      try {
+        Logging.checkLevel(level);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+      if (typeof message !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'message must be a string');
+      }
+      var nativeFields = {};
+      if (fields !== undefined && fields !== null) {
+        if (!(fields instanceof intrp.Object)) {
+          throw new intrp.Error(perms, intrp.TYPE_ERROR,
+              'fields must be an object');
+        }
+        var keys = fields.ownKeys(perms);
+        for (var i = 0; i < keys.length; i++) {
+          var value = fields.get(keys[i], perms);
+          nativeFields[keys[i]] =
+              (value instanceof intrp.Object) ? describe(value) : value;
+        }
+      }
+      return intrp.writeLog(perms, /** @type {string} */(level), message,
+                            nativeFields);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.logChannel', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var settings = args[0];
+      var owner = args[1];
+      var perms = state.scope.perms;
+      if (owner === undefined) {
+        owner = perms;
+      } else if (!(owner instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'owner must be an object');
+      } else if (owner !== perms && perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(perms,
+            'only root may configure the log channels of other owners');
+      }
+      var channel = Object.assign(Logging.defaultChannel(),
+                                  intrp.logChannels_.get(owner));
+      if (settings !== undefined && settings !== null) {
+        if (!(settings instanceof intrp.Object)) {
+          throw new intrp.Error(perms, intrp.TYPE_ERROR,
+              'settings must be an object');
+        }
+        var level = settings.get('level', perms);
+        var server = settings.get('server', perms);
+        var connection = settings.get('connection', perms);
+        if (level !== undefined) {
+          try {
+            channel.level = Logging.checkLevel(level);
+          } catch (e) {
+            throw intrp.errorNativeToPseudo(e, perms);
+          }
+        }
+        if (server !== undefined) channel.server = Boolean(server);
+        if (connection !== undefined) {
+          if (connection !== null &&
+              !(connection instanceof intrp.Object && connection.socket)) {
+            throw new intrp.Error(perms, intrp.TYPE_ERROR,
+                'connection must be a connected object or null');
+          }
+          channel.connection = connection;
+        }
+        intrp.logChannels_.set(owner, channel);
+      }
+      var result = new intrp.Object(perms);
+      result.set('level', channel.level, perms);
+      result.set('server', channel.server, perms);
+      result.set('connection', channel.connection, perms);
+      return result;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.adminLog', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var action = args[0];
+      var fields = args[1];
+      var perms = state.scope.perms;
+      if (typeof action !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'action must be a string');
+      }
+      var details = {};
+      if (fields !== undefined && fields !== null) {
+        if (!(fields instanceof intrp.Object)) {
+          throw new intrp.Error(perms, intrp.TYPE_ERROR,
+              'fields must be an object');
+        }
+        var keys = fields.ownKeys(perms);
+        for (var i = 0; i < keys.length; i++) {
+          var value = fields.get(keys[i], perms);
+          details[keys[i]] = (value instanceof intrp.Object) ?
+              describe(value) : (value === undefined ? null : value);
+        }
+      }
+      return intrp.recordPrivileged(perms, action, details);
+    }
+  });
+};
+
+/**
+ * Initialize the HTML API (see html.js and markdown.js).
+ * @private
+ */
+Interpreter.prototype.initHtml_ = function() {
+  /**
+   * Convert an in-world policy object to a checked Html.Policy.
+   * Elements or protocols not specified are those of the default
+   * policy.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {*} options The policy object, or undefined or null for the
+   *     default policy.
+   * @param {!Interpreter.Owner} perms Who is using the policy.
+   * @return {!Html.Policy}
+   */
+  var toPolicy = function(intrp, options, perms) {
+    var policy = Html.DEFAULT_POLICY;
+    if (options === undefined || options === null) return policy;
+    if (!(options instanceof intrp.Object)) {
+      throw new intrp.Error(perms, intrp.TYPE_ERROR,
+          'policy must be an object');
+    }
+    try {
+      var native = intrp.pseudoToNative(options);
+      return Html.checkPolicy({
+        elements: native['elements'] || policy.elements,
+        protocols: native['protocols'] || policy.protocols,
+      });
+    } catch (e) {
+      throw intrp.errorNativeToPseudo(e, perms);
+    }
+  };
+
+  new this.NativeFunction({
+    id: 'CC.htmlEscape', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return Html.escape(String(args[0]));
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.htmlSanitize', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var html = args[0];
+      var options = args[1];
+      var perms = state.scope.perms;
+      if (typeof html !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'html must be a string');
+      }
+      var policy = toPolicy(intrp, options, perms);
+      intrp.charge_(Html.cost(html), perms);
+      try {
+        return Html.sanitize(html, policy);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.markdown', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var text = args[0];
+      var perms = state.scope.perms;
+      if (typeof text !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'text must be a string');
+      }
+      var policy = toPolicy(intrp, args[1], perms);
+      intrp.charge_(Markdown.cost(text), perms);
+      try {
+        return Markdown.toHtml(text, policy);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+    }
+  });
+};
+
+/**
+ * Initialize the data format API (see csv.js and xml.js).
+ * @private
+ */
+Interpreter.prototype.initFormats_ = function() {
+  /**
+   * Get the field delimiter from a CSV options object.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {*} options The options object, if any.
+   * @param {!Interpreter.Owner} perms Who is calling.
+   * @return {string} The delimiter.
+   */
+  var getDelimiter = function(intrp, options, perms) {
+    if (options === undefined || options === null) return ',';
+    if (!(options instanceof intrp.Object)) {
+      throw new intrp.Error(perms, intrp.TYPE_ERROR,
+          'options must be an object');
+    }
+    try {
+      return Csv.checkDelimiter(options.get('delimiter', perms));
+    } catch (e) {
+      throw intrp.errorNativeToPseudo(e, perms);
+    }
+  };
+
+  new this.NativeFunction({
+    id: 'CC.csvParse', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var text = args[0];
+      var perms = state.scope.perms;
+      if (typeof text !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'text must be a string');
+      }
+      var delimiter = getDelimiter(intrp, args[1], perms);
+      intrp.charge_(Csv.cost(text.length), perms);
+      try {
+        return intrp.nativeToPseudo(Csv.parse(text, delimiter), perms);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.csvStringify', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var records = args[0];
+      var perms = state.scope.perms;
+      if (!(records instanceof intrp.Array)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'records must be an array');
+      }
+      var delimiter = getDelimiter(intrp, args[1], perms);
+      try {
+        var csv = Csv.stringify(
+            /** @type {!Array<!Array<*>>} */(intrp.pseudoToNative(records)),
+            delimiter);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+      intrp.charge_(Csv.cost(csv.length), perms);
+      return csv;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.xmlTokenize', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var text = args[0];
+      var options = args[1];
+      var perms = state.scope.perms;
+      if (typeof text !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'text must be a string');
+      }
+      var opts = {};
+      if (options !== undefined && options !== null) {
+        if (!(options instanceof intrp.Object)) {
+          throw new intrp.Error(perms, intrp.TYPE_ERROR,
+              'options must be an object');
+        }
+        opts.html = Boolean(options.get('html', perms));
+        opts.final = options.get('final', perms) !== false;
+        var open = options.get('open', perms);
+        if (open !== undefined && open !== null) {
+          open = intrp.pseudoToNative(open);
+          if (!Array.isArray(open) || open.length > Xml.MAX_DEPTH ||
+              !open.every((name) => typeof name === 'string')) {
+            throw new intrp.Error(perms, intrp.TYPE_ERROR,
+                'open must be an array of element names');
+          }
+          opts.open = open;
+        }
+      }
+      intrp.charge_(Xml.cost(text), perms);
+      try {
+        return intrp.nativeToPseudo(Xml.tokenize(text, opts), perms);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+    }
+  });
+};
+
+/**
+ * Initialize the text layout API (see text.js).
+ * @private
+ */
+Interpreter.prototype.initText_ = function() {
+  var intrp = this;
+  /**
+   * Create a native function whose first argument is text, which it
+   * is charged for processing.
+   * @param {string} id The function's ID.
+   * @param {number} length The function's length.
+   * @param {function(string, ...*): (string|number|!Array<string>)} impl
+   *     The implementation, given the text and any other arguments.
+   */
+  var textFunction = function(id, length, impl) {
+    new intrp.NativeFunction({
+      id: id, length: length,
+      /** @type {!Interpreter.NativeCallImpl} */
+      call: function(intrp, thread, state, thisVal, args) {
+        var text = args[0];
+        var perms = state.scope.perms;
+        if (typeof text !== 'string') {
+          throw new intrp.Error(perms, intrp.TYPE_ERROR,
+              'text must be a string');
+        }
+        intrp.charge_(Text.cost(text), perms);
+        try {
+          var result = impl.apply(null, args);
+        } catch (e) {
+          throw intrp.errorNativeToPseudo(e, perms);
+        }
+        return Array.isArray(result) ?
+            intrp.nativeToPseudo(result, perms) : result;
+      }
+    });
+  };
+
+  textFunction('CC.textGraphemes', 1, Text.graphemes);
+  textFunction('CC.textWords', 1, Text.words);
+  textFunction('CC.textWidth', 1, Text.width);
+  textFunction('CC.textPad', 4, function(text, width, align, fill) {
+    if (fill !== undefined && typeof fill !== 'string') {
+      throw new TypeError('fill must be a string');
+    }
+    return Text.pad(text, width, align, fill);
+  });
+  textFunction('CC.textTruncate', 3, function(text, width, ellipsis) {
+    if (ellipsis !== undefined && typeof ellipsis !== 'string') {
+      throw new TypeError('ellipsis must be a string');
+    }
+    return Text.truncate(text, width, ellipsis);
+  });
+  textFunction('CC.textWrap', 2, Text.wrap);
+  textFunction('CC.textColor', 2, function(text, style) {
+    if (typeof style !== 'string') {
+      throw new TypeError('style must be a string');
+    }
+    return Text.color(text, style);
+  });
+  textFunction('CC.textStripAnsi', 1, Text.stripAnsi);
+  textFunction('CC.textSupportsColor', 1, Text.supportsColor);
+
+  /**
+   * Convert an array of strings to a native array, checking it.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {*} value The array.
+   * @param {string} name Name of the argument, for errors.
+   * @param {!Interpreter.Owner} perms Who is calling.
+   * @return {!Array<string>} The native array.
+   */
+  var toStrings = function(intrp, value, name, perms) {
+    if (!(value instanceof intrp.Array)) {
+      throw new intrp.Error(perms, intrp.TYPE_ERROR,
+          name + ' must be an array');
+    }
+    var list = intrp.createListFromArrayLike(value, perms);
+    for (var i = 0; i < list.length; i++) {
+      if (typeof list[i] !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            name + ' must be an array of strings');
+      }
+      intrp.charge_(Text.cost(list[i]), perms);
+    }
+    return /** @type {!Array<string>} */ (list);
+  };
+
+  new this.NativeFunction({
+    id: 'CC.textTable', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var rows = args[0];
+      var options = args[1];
+      var perms = state.scope.perms;
+      if (!(rows instanceof intrp.Array)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'rows must be an array');
+      }
+      rows = intrp.createListFromArrayLike(rows, perms).map(function(row) {
+        return toStrings(intrp, row, 'each row', perms);
+      });
+      var opts = {};
+      if (options !== undefined && options !== null) {
+        if (!(options instanceof intrp.Object)) {
+          throw new intrp.Error(perms, intrp.TYPE_ERROR,
+              'options must be an object');
+        }
+        var width = options.get('width', perms);
+        if (width !== undefined) opts.width = width;
+        var separator = options.get('separator', perms);
+        if (separator !== undefined) opts.separator = String(separator);
+        var align = options.get('align', perms);
+        if (align !== undefined) {
+          opts.align = toStrings(intrp, align, 'align', perms);
+        }
+        opts.header = Boolean(options.get('header', perms));
+      }
+      try {
+        var table = Text.table(rows, opts);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+      intrp.charge_(Text.cost(table), perms);
+      return table;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.textColumns', length: 3,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      var items = toStrings(intrp, args[0], 'items', perms);
+      var separator = args[2];
+      if (separator !== undefined && typeof separator !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'separator must be a string');
+      }
+      try {
+        var columns = Text.columns(items, args[1], separator);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+      intrp.charge_(Text.cost(columns), perms);
+      return columns;
+    }
+  });
+};
+
+/**
+ * Initialize the value inspector (see inspect.js).
+ * @private
+ */
+Interpreter.prototype.initInspect_ = function() {
+  new this.NativeFunction({
+    id: 'CC.inspect', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var value = args[0];
+      var options = args[1];
+      var perms = state.scope.perms;
+      var opts = {};
+      if (options !== undefined && options !== null) {
+        if (!(options instanceof intrp.Object)) {
+          throw new intrp.Error(perms, intrp.TYPE_ERROR,
+              'options must be an object');
+        }
+        ['depth', 'maxItems'].forEach(function(name) {
+          var n = options.get(name, perms);
+          if (n === undefined) return;
+          if (typeof n !== 'number' || !(n >= 0)) {
+            throw new intrp.Error(perms, intrp.RANGE_ERROR,
+                name + ' must be a non-negative number');
+          }
+          opts[name] = n;
+        });
+        opts.colors = Boolean(options.get('colors', perms));
+        opts.hidden = Boolean(options.get('hidden', perms));
+        opts.attributes = Boolean(options.get('attributes', perms));
+      }
+      var text = Inspect.inspect(intrp, value, perms, opts);
+      intrp.charge_(Text.cost(text), perms);
+      return text;
+    }
+  });
+};
+
+/**
+ * Initialize the command parser (see command.js).
+ * @private
+ */
+Interpreter.prototype.initCommand_ = function() {
+  new this.NativeFunction({
+    id: 'CC.commandParse', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var cmdstr = args[0];
+      var perms = state.scope.perms;
+      if (typeof cmdstr !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'command must be a string');
+      }
+      intrp.charge_(Text.cost(cmdstr), perms);
+      return intrp.nativeToPseudo(Command.parse(cmdstr), perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.commandMatch', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var str = args[0];
+      var objects = args[1];
+      var perms = state.scope.perms;
+      if (typeof str !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'str must be a string');
+      } else if (!(objects instanceof intrp.Array)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'objects must be an array');
+      }
+      var list = intrp.createListFromArrayLike(objects, perms);
+      intrp.charge_(list.length / Command.SPEED, perms);
+      return intrp.createArrayFromList(
+          Command.match(intrp, str, list, perms), perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.commandResolve', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var str = args[0];
+      var objects = args[1];
+      var perms = state.scope.perms;
+      if (typeof str !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'str must be a string');
+      } else if (!(objects instanceof intrp.Array)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'objects must be an array');
+      }
+      var list = intrp.createListFromArrayLike(objects, perms);
+      // Up to twice over (if an ordinal is split off).
+      intrp.charge_(2 * list.length / Command.SPEED, perms);
+      var resolution = Command.resolve(intrp, str, list, perms);
+      var result = new intrp.Object(perms);
+      result.set('match', resolution.match, perms);
+      result.set('matches',
+          intrp.createArrayFromList(resolution.matches, perms), perms);
+      result.set('ambiguous', resolution.ambiguous, perms);
+      result.set('ordinal', resolution.ordinal, perms);
+      return result;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.commandFindVerb', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var cmd = args[0];
+      var hosts = args[1];
+      var perms = state.scope.perms;
+      if (!(cmd instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'cmd must be an object');
+      } else if (!(hosts instanceof intrp.Array)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'hosts must be an array');
+      }
+      var verbstr = cmd.get('verbstr', perms);
+      var prepstr = cmd.get('prepstr', perms);
+      try {
+        var result = Command.findVerb(intrp, {
+          verbstr: (typeof verbstr === 'string') ? verbstr : '',
+          prepstr: (typeof prepstr === 'string') ? prepstr : '',
+          dobj: cmd.get('dobj', perms),
+          iobj: cmd.get('iobj', perms),
+        }, intrp.createListFromArrayLike(hosts, perms), perms);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+      intrp.charge_(result.examined / Command.SPEED, perms);
+      if (!result.verb) return null;
+      var verb = new intrp.Object(perms);
+      verb.set('host', result.verb.host, perms);
+      verb.set('key', result.verb.key, perms);
+      return verb;
+    }
+  });
+};
+
+/**
+ * Initialize the message substitution API (see pronouns.js).
+ * @private
+ */
+Interpreter.prototype.initPronouns_ = function() {
+  /**
+   * Convert a pronoun set to a pseudo object.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {?Pronouns.Set} pronouns The pronouns (or null if none).
+   * @param {!Interpreter.Owner} perms Who is to own the object.
+   * @return {?Interpreter.prototype.Object} The object (or null).
+   */
+  var pronounsToPseudo = function(intrp, pronouns, perms) {
+    return pronouns && intrp.nativeToPseudo(Object.assign({}, pronouns),
+                                            perms);
+  };
+
+  new this.NativeFunction({
+    id: 'CC.pronouns', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return pronounsToPseudo(intrp, Pronouns.parse(args[0]),
+                              state.scope.perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.substitute', length: 3,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var template = args[0];
+      var roles = args[1];
+      var viewer = args[2];
+      var perms = state.scope.perms;
+      if (typeof template !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'template must be a string');
+      } else if (!(roles instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'roles must be an object');
+      }
+      intrp.charge_(Text.cost(template), perms);
+      // Each role is an object (with name and pronouns properties), or
+      // a string giving a name.
+      var nativeRoles = {};
+      ['actor', 'dobj', 'iobj', 'this', 'location'].forEach(function(key) {
+        var value = roles.get(key, perms);
+        if (typeof value === 'string') {
+          nativeRoles[key] = {name: value, pronouns: null, id: value};
+        } else if (value instanceof intrp.Object) {
+          var name = value.get('name', perms);
+          nativeRoles[key] = {
+            name: (typeof name === 'string') ? name : '',
+            pronouns: Pronouns.parse(value.get('pronouns', perms)),
+            id: value,
+          };
+        }
+      });
+      return Pronouns.substitute(template, nativeRoles,
+          (viewer instanceof intrp.Object) ? viewer : undefined);
+    }
+  });
+};
+
+/**
+ * Initialize the remote editing API (see edit.js).
+ * @private
+ */
+Interpreter.prototype.initEdit_ = function() {
+  new this.NativeFunction({
+    id: 'CC.editRequest', length: 4,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var id = args[0];
+      var title = args[1];
+      var text = args[2];
+      var syntax = args[3];
+      var perms = state.scope.perms;
+      if (typeof id !== 'string' || typeof title !== 'string' ||
+          typeof text !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'id, title and text must be strings');
+      } else if (syntax !== undefined && typeof syntax !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'syntax must be a string');
+      }
+      intrp.charge_(Edit.cost(text), perms);
+      try {
+        return Edit.request(id, title, text, syntax);
+      } catch (e) {
+        throw intrp.errorNativeToPseudo(e, perms);
+      }
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.editReply', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var line = args[0];
+      var perms = state.scope.perms;
+      if (typeof line !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'line must be a string');
+      }
+      intrp.charge_(Edit.cost(line), perms);
+      var reply = Edit.reply(line);
+      return reply && intrp.nativeToPseudo(reply, perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.editLine', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var editState = args[0];
+      var input = args[1];
+      var perms = state.scope.perms;
+      if (!(editState instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'state must be an object');
+      } else if (typeof input !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'input must be a string');
+      }
+      var lines = editState.get('lines', perms);
+      if (!(lines instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'state.lines must be an array');
+      }
+      lines = intrp.createListFromArrayLike(lines, perms).map(String);
+      var point = Number(editState.get('point', perms));
+      var length = lines.reduce(function(sum, line) {
+        return sum + line.length + 1;
+      }, input.length);
+      if (length > Edit.MAX_LENGTH) {
+        throw new intrp.Error(perms, intrp.RANGE_ERROR,
+            'text too long to edit');
+      }
+      intrp.charge_(length / Edit.SPEED, perms);
+      return intrp.nativeToPseudo(
+          Edit.line({lines: lines, point: point}, input), perms);
+    }
+  });
+};
+
+/**
+ * Initialize the module system (see modules.js).
+ * @private
+ */
+Interpreter.prototype.initModules_ = function() {
+  /**
+   * Find the cached module (if any) whose module object is given.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {?Interpreter.Value} module The module object.
+   * @return {?Modules.Entry} The module's entry, or null if none.
+   */
+  var findByModule = function(intrp, module) {
+    var found = null;
+    if (module instanceof intrp.Object) {
+      intrp.modules_.forEach(function(entry) {
+        if (entry.module === module) found = entry;
+      });
+    }
+    return found;
+  };
+
+  var require = new this.NativeFunction({
+    id: 'CC.require', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      var perms = state.scope.perms;
+      var cache = intrp.modules_;
+      var entry = cache.get(name);
+      var module = state.info_.funcState;
+      if (module instanceof intrp.Object) {  // The module has been run.
+        // (Unless reloaded meanwhile.)
+        if (entry && entry.module === module) {
+          entry.loaded = true;
+          entry.loading = null;
+        }
+        return module.get('exports', perms);
+      }
+      if (!Modules.isValidName(name)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'invalid module name ' + name);
+      }
+      // The require function passed to each module is bound to its
+      // module object, so that its dependencies can be recorded.
+      var parent = findByModule(intrp, thisVal);
+      if (entry && (entry.loaded ||
+                    thread.stateStack_.includes(entry.loading))) {
+        // Already run (or, if required by itself, being run).
+        if (parent) Modules.addDependency(cache, parent.name, name);
+        return entry.module.get('exports', perms);
+      }
+      // Find the module in a library.
+      var library = null;
+      for (var i = 0; i < intrp.moduleLibraries_.length; i++) {
+        var pd = intrp.moduleLibraries_[i].getOwnPropertyDescriptor(
+            name, perms);
+        if (pd && (typeof pd.value === 'string' ||
+                   pd.value instanceof intrp.Function)) {
+          library = intrp.moduleLibraries_[i];
+          var code = pd.value;
+          break;
+        }
+      }
+      if (!library) {
+        throw new intrp.Error(perms, intrp.ERROR,
+            'Cannot find module ' + name);
+      }
+      var owner = library.owner || perms;
+      var func = code;
+      if (typeof code === 'string') {
+        var source = Modules.wrap(code);
+        var ast = intrp.compile_(source, perms);
+        if (ast['body'].length !== 1) {
+          throw new intrp.Error(perms, intrp.SYNTAX_ERROR,
+              'Invalid code in module ' + name);
+        }
+        func = new intrp.UserFunction(ast['body'][0]['expression'],
+            intrp.global, new Interpreter.Source(source), owner);
+      }
+      module = new intrp.Object(owner);
+      var exports = new intrp.Object(owner);
+      module.set('id', name, owner);
+      module.set('exports', exports, owner);
+      var moduleRequire = new intrp.BoundFunction(require, module, [], owner);
+      cache.set(name, {name: name, library: library, module: module,
+                       requires: [], loaded: false, loading: state});
+      if (parent) Modules.addDependency(cache, parent.name, name);
+      thread.stateStack_[thread.stateStack_.length] =
+          Interpreter.State.newForCall(func, module,
+                                       [moduleRequire, module, exports],
+                                       perms);
+      state.info_.funcState = module;
+      return Interpreter.FunctionResult.CallAgain;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.moduleReload', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      var perms = state.scope.perms;
+      var entry = intrp.modules_.get(name);
+      if (entry && perms !== intrp.ROOT && perms !== entry.library.owner) {
+        throw intrp.permissionDenied_(perms,
+            'only root or the owner of its library may reload ' + name);
+      }
+      return intrp.createArrayFromList(
+          Modules.invalidate(intrp.modules_, name), perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.modules', length: 0,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      var list = [];
+      intrp.modules_.forEach(function(entry) {
+        var obj = new intrp.Object(perms);
+        obj.set('name', entry.name, perms);
+        obj.set('library', entry.library, perms);
+        obj.set('loaded', entry.loaded, perms);
+        obj.set('requires',
+                intrp.createArrayFromList(entry.requires, perms), perms);
+        list.push(obj);
+      });
+      return intrp.createArrayFromList(list, perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.moduleLibraries', length: 0,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return intrp.createArrayFromList(intrp.moduleLibraries_,
+                                       state.scope.perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.moduleSetLibraries', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var libraries = args[0];
+      var perms = state.scope.perms;
+      if (perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(perms,
+            'only root may set module libraries');
+      } else if (!(libraries instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'libraries must be an array of objects');
+      }
+      var list = intrp.createListFromArrayLike(libraries, perms);
+      if (!list.every(function(lib) {return lib instanceof intrp.Object;})) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'libraries must be an array of objects');
+      }
+      intrp.moduleLibraries_ = list;
+      // Modules may now be found elsewhere.
+      intrp.modules_.clear();
+    }
+  });
+};
+
+/**
+ * Initialize the package manager (see packages.js).
+ * @private
+ */
+Interpreter.prototype.initPackages_ = function() {
+  /**
+   * Check that the caller is root and a registry is configured, and
+   * start an operation on the registry, blocking the calling thread
+   * until it completes.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {!Interpreter.Thread} thread The calling thread.
+   * @param {!Interpreter.State} state The calling state.
+   * @param {string} description Description of the operation.
+   * @param {function(!Packages.Registry): !Promise<?Interpreter.Value>} op
+   *     The operation, resolving to the value to return.
+   * @return {!Interpreter.FunctionResult} FunctionResult.Block.
+   */
+  var awaitRegistry = function(intrp, thread, state, description, op) {
+    var perms = state.scope.perms;
+    if (perms !== intrp.ROOT) {
+      throw intrp.permissionDenied_(perms,
+          'only root may ' + description);
+    } else if (!intrp.packageRegistry) {
+      throw new intrp.Error(perms, intrp.ERROR,
+          'Package registry is not configured');
+    }
+    var rr = intrp.getResolveReject(thread, state, description);
+    op(intrp.packageRegistry).then(rr.resolve, function(e) {
+      rr.reject(intrp.errorNativeToPseudo(e, perms), perms);
+    });
+    return Interpreter.FunctionResult.Block;
+  };
+
+  /**
+   * Import a release, in place of any version of it already
+   * installed: a module library that was the old version's root is
+   * replaced by the new one's, and the modules found in it discarded
+   * from the module cache, so that they are required afresh.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {!Packages.Registry} registry The registry.
+   * @param {!Packages.Release} release The release.
+   * @return {!Interpreter.prototype.Object} The package's new root.
+   */
+  var install = function(intrp, registry, release) {
+    var root = registry.importRelease(intrp, release);
+    var old = intrp.packages_.get(release.name);
+    if (old) {
+      var libraries = intrp.moduleLibraries_;
+      for (var i = 0; i < libraries.length; i++) {
+        if (libraries[i] === old.root) libraries[i] = root;
+      }
+      intrp.modules_.forEach(function(entry) {
+        if (entry.library === old.root) {
+          Modules.invalidate(intrp.modules_, entry.name);
+        }
+      });
+    }
+    intrp.packages_.set(release.name,
+        {version: release.version, root: root, installed: Date.now()});
+    intrp.log('system', 'Installed package %s %s', release.name,
+              release.version);
+    return root;
+  };
+
+  /**
+   * Describe an installed package.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {string} name The package's name.
+   * @param {!Interpreter.Owner} perms Who is asking.
+   * @return {!Interpreter.prototype.Object} {name, version, root,
+   *     installed}.
+   */
+  var describe = function(intrp, name, perms) {
+    var record = intrp.packages_.get(name);
+    var obj = new intrp.Object(perms);
+    obj.set('name', name, perms);
+    obj.set('version', record.version, perms);
+    obj.set('root', record.root, perms);
+    obj.set('installed', record.installed, perms);
+    return obj;
+  };
+
+  new this.NativeFunction({
+    id: 'CC.packages', length: 0,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      var list = [];
+      intrp.packages_.forEach(function(record, name) {
+        list.push(describe(intrp, name, perms));
+      });
+      return intrp.createArrayFromList(list, perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.packageVersions', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      var perms = state.scope.perms;
+      return awaitRegistry(intrp, thread, state, 'list package versions',
+          function(registry) {
+            return registry.versions(String(name)).then(function(versions) {
+              return intrp.createArrayFromList(versions, perms);
+            });
+          });
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.packageInstall', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      var version = args[1];
+      var perms = state.scope.perms;
+      if (typeof name !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'name must be a string');
+      } else if (version !== undefined && typeof version !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'version must be a string, if present');
+      }
+      return awaitRegistry(intrp, thread, state, 'install packages',
+          function(registry) {
+            return registry.release(name, version).then(function(release) {
+              var old = intrp.packages_.get(name);
+              if (old && old.version === release.version) return old.root;
+              return install(intrp, registry, release);
+            });
+          });
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.packageUpdate', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      var perms = state.scope.perms;
+      if (typeof name !== 'string' || !intrp.packages_.has(name)) {
+        throw new intrp.Error(perms, intrp.RANGE_ERROR,
+            'package ' + name + ' is not installed');
+      }
+      return awaitRegistry(intrp, thread, state, 'update packages',
+          function(registry) {
+            var old = intrp.packages_.get(name);
+            return registry.newer(name, old.version).then(function(latest) {
+              if (latest === null) return null;  // Already up to date.
+              return registry.release(name, latest).then(function(release) {
+                install(intrp, registry, release);
+                return describe(intrp, name, perms);
+              });
+            });
+          });
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.packageUninstall', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var name = args[0];
+      var perms = state.scope.perms;
+      if (perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(perms,
+            'only root may uninstall packages');
+      }
+      // The objects remain, for as long as anything refers to them.
+      return intrp.packages_.delete(String(name));
+    }
+  });
+};
+
+/**
+ * Initialize the permission tiers API (see tiers.js).
+ * @private
+ */
+Interpreter.prototype.initTiers_ = function() {
+  /**
+   * Check that a value is the name of a tier.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {!Interpreter.Owner} perms Who is asking.
+   * @param {*} tier The value.
+   * @throws {!Interpreter.prototype.Error} If it is not.
+   */
+  var checkValid = function(intrp, perms, tier) {
+    if (!Tiers.isValid(tier)) {
+      throw new intrp.Error(perms, intrp.RANGE_ERROR,
+          'tier must be one of ' + Tiers.ORDER.join(', '));
+    }
+  };
+
+  new this.NativeFunction({
+    id: 'CC.tier', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var owner = args[0];
+      if (!(owner instanceof intrp.Object) && owner !== null) {
+        throw new intrp.Error(state.scope.perms, intrp.TYPE_ERROR,
+            'owner must be an object or null');
+      }
+      return intrp.tierOf(/** @type {?Interpreter.Owner} */(owner));
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.tiers', length: 0,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      var list = [];
+      intrp.tiers_.forEach(function(tier, owner) {
+        var obj = new intrp.Object(perms);
+        obj.set('owner', owner, perms);
+        obj.set('tier', tier, perms);
+        list.push(obj);
+      });
+      return intrp.createArrayFromList(list, perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.tierSet', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var owner = args[0];
+      var tier = args[1];
+      var perms = state.scope.perms;
+      intrp.checkTier_(perms, Tiers.Tier.WIZARD, 'assign tiers');
+      if (!(owner instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'owner must be an object');
+      } else if (owner === intrp.ROOT || intrp.isGuest(owner)) {
+        throw intrp.permissionDenied_(perms,
+            "Can't change the tier of root or guests");
+      }
+      if (tier === null) {
+        intrp.tiers_.delete(owner);  // Revert to the default tier.
+      } else {
+        checkValid(intrp, perms, tier);
+        intrp.tiers_.set(owner, /** @type {!Tiers.Tier} */(tier));
+      }
+      intrp.recordPrivileged(perms, 'tier', {
+        'owner': intrp.ownerName_(owner),
+        'tier': tier,
+      });
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.tierDefault', length: 0,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return intrp.defaultTier_;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.tierSetDefault', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var tier = args[0];
+      var perms = state.scope.perms;
+      intrp.checkTier_(perms, Tiers.Tier.WIZARD, 'assign tiers');
+      checkValid(intrp, perms, tier);
+      intrp.defaultTier_ = /** @type {!Tiers.Tier} */(tier);
+      intrp.recordPrivileged(perms, 'tier', {'owner': null, 'tier': tier});
+    }
+  });
+};
+
+/**
+ * Initialize the object destruction API.
+ * @private
+ */
+Interpreter.prototype.initRecycler_ = function() {
+  /**
+   * Check that an owner may destroy (or restore) an object: it must be
+   * the object's owner, or a wizard (see tiers.js).
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {!Interpreter.Owner} perms Who is asking.
+   * @param {*} obj The object.
+   * @param {string} description What it is trying to do.
+   * @throws {!Interpreter.prototype.Error} If it may not.
+   */
+  var checkControl = function(intrp, perms, obj, description) {
+    if (!(obj instanceof intrp.Object)) {
+      throw new intrp.Error(perms, intrp.TYPE_ERROR,
+          "Can't " + description + ' non-object');
+    } else if (obj.owner !== perms) {
+      intrp.checkTier_(perms, Tiers.Tier.WIZARD,
+          description + " others' objects");
+    }
+  };
+
+  new this.NativeFunction({
+    id: 'CC.destroy', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var obj = args[0];
+      var grace = args[1] === undefined ? 0 : Number(args[1]);
+      var perms = state.scope.perms;
+      checkControl(intrp, perms, obj, 'destroy');
+      if (obj === intrp.ROOT || intrp.builtins.getKey(obj) !== undefined) {
+        throw intrp.permissionDenied_(perms,
+            "Can't destroy root or builtins");
+      } else if (obj.destroyed) {
+        throw intrp.destroyedError_(perms);
+      } else if (!(grace >= 0 && grace <= Interpreter.RECYCLE_MAX_GRACE)) {
+        throw new intrp.Error(perms, intrp.RANGE_ERROR,
+            'grace period must be between 0 and ' +
+            Interpreter.RECYCLE_MAX_GRACE + ' ms');
+      }
+      intrp.emptyRecycleBin();
+      var owner = obj.owner;
+      if (owner !== perms) {
+        intrp.recordPrivileged(perms, 'destroy', {
+          'object': obj.class,
+          'owner': owner ? intrp.ownerName_(owner) : null,
+        });
+      }
+      intrp.destroyObject(obj, grace);
+      // Let the owner forget the object (e.g., remove it from any
+      // registries), knowing whether it may yet be restored.
+      if (owner && !owner.destroyed && !intrp.isGuest(owner)) {
+        var func = owner.get('onDestroy', owner);
+        if (func instanceof intrp.Function) {
+          intrp.createThreadForFuncCall(owner, func, owner, [obj, grace > 0],
+                                        undefined, thread.timeLimit);
+        }
+      }
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.isDestroyed', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var obj = args[0];
+      return obj instanceof intrp.Object && obj.destroyed;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.restore', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var obj = args[0];
+      var perms = state.scope.perms;
+      checkControl(intrp, perms, obj, 'restore');
+      intrp.emptyRecycleBin();
+      if (!intrp.restoreObject(obj)) {
+        throw new intrp.Error(perms, intrp.RANGE_ERROR,
+            'Object is not in the recycle bin');
+      }
+      return obj;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.recycleBin', length: 0,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      intrp.emptyRecycleBin();
+      // Wizards see every object in the bin; others only their own.
+      var all = Tiers.atLeast(intrp.tierOf(perms), Tiers.Tier.WIZARD);
+      var list = [];
+      intrp.recycleBin_.forEach(function(expires, obj) {
+        if (!all && obj.owner !== perms) return;
+        var entry = new intrp.Object(perms);
+        entry.set('object', obj, perms);
+        entry.set('purge', expires, perms);
+        list.push(entry);
+      });
+      return intrp.createArrayFromList(list, perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.recycleBinEmpty', length: 0,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      intrp.checkTier_(perms, Tiers.Tier.WIZARD, 'empty the recycle bin');
+      return intrp.emptyRecycleBin(true);
+    }
+  });
+};
+
+/**
+ * Initialize the sandboxed evaluation API.
+ * @private
+ */
+Interpreter.prototype.initSandbox_ = function() {
+  /**
+   * Add a function, or the functions which are an object's own
+   * properties (except its constructor), to a set of allowed functions.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {!Set<!Interpreter.prototype.Function>} allowed The set.
+   * @param {!Interpreter.prototype.Object} obj The function or object.
+   * @param {string=} path Name by which obj is known, if it is a
+   *     standard global (for excluding Interpreter.SANDBOX_EXCLUDED).
+   */
+  var allow = function(intrp, allowed, obj, path) {
+    if (obj instanceof intrp.Function) {
+      allowed.add(obj);
+      if (!path) return;
+    }
+    obj.ownKeys(intrp.ROOT).forEach(function(key) {
+      if (key === 'constructor' || key === 'prototype' ||
+          (path && Interpreter.SANDBOX_EXCLUDED.includes(path + '.' + key))) {
+        return;
+      }
+      var value = obj.get(key, intrp.ROOT);
+      if (value instanceof intrp.Function) allowed.add(value);
+    });
+  };
+
+  new this.NativeFunction({
+    id: 'CC.sandboxCreate', length: 3,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var global = args[0];
+      var list = args[1];
+      var standard = Boolean(args[2]);
+      var perms = state.scope.perms;
+      if (!(global instanceof intrp.Object) || global.owner === null) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'global must be an object with an owner');
+      } else if (list !== undefined && !(list instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'allowed must be an array, if present');
+      } else if (global.owner !== perms) {
+        // Code in the sandbox will run with the global object's owner's
+        // perms.
+        intrp.checkTier_(perms, Tiers.Tier.WIZARD,
+            "create sandboxes for others' global objects");
+      }
+      var owner = /** @type {!Interpreter.Owner} */(global.owner);
+      var scope = new Interpreter.Scope(
+          Interpreter.Scope.Type.SANDBOX, owner, null, global);
+      var sandbox = {scope: scope, allowed: new Set()};
+      scope.sandbox = sandbox;
+      scope.createImmutableBinding('NaN', NaN);
+      scope.createImmutableBinding('Infinity', Infinity);
+      scope.createImmutableBinding('undefined', undefined);
+      if (standard) {
+        Interpreter.SANDBOX_GLOBALS.forEach(function(name) {
+          if (!intrp.global.hasBinding(name)) return;
+          var value = intrp.global.get(name);
+          scope.createMutableBinding(name, value);
+          if (!(value instanceof intrp.Object)) return;
+          allow(intrp, sandbox.allowed, value, name);
+          var proto = value.get('prototype', intrp.ROOT);
+          if (value instanceof intrp.Function &&
+              proto instanceof intrp.Object) {
+            allow(intrp, sandbox.allowed, proto, name + '.prototype');
+          }
+        });
+      }
+      var items = list ? intrp.createListFromArrayLike(list, perms) : [];
+      items.forEach(function(item) {
+        if (!(item instanceof intrp.Object)) {
+          throw new intrp.Error(perms, intrp.TYPE_ERROR,
+              'allowed items must be functions or objects');
+        }
+        allow(intrp, sandbox.allowed, item);
+      });
+      global.ownKeys(perms).forEach(function(key) {
+        if (scope.hasImmutableBinding(key)) return;
+        scope.vars[key] = global.get(key, perms);
+      });
+      var handle = new intrp.Object(perms);
+      intrp.sandboxes_.set(handle, sandbox);
+      return handle;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.sandboxEval', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var handle = args[0];
+      var code = args[1];
+      var perms = state.scope.perms;
+      var sandbox = intrp.sandboxes_.get(/** @type {?} */(handle));
+      if (!sandbox) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR, 'not a sandbox');
+      } else if (typeof code !== 'string') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'code must be a string');
+      }
+      intrp.checkTier_(perms, Tiers.Tier.PROGRAMMER, 'eval code');
+      intrp.checkTaint_(code, perms, 'CC.sandboxEval');
+      var ast = intrp.compile_(code, perms);
+      ast['type'] = 'EvalProgram_';
+      ast['stepFunc'] = stepFuncs_['EvalProgram_'];
+      // Declarations persist in the sandbox's global scope.
+      intrp.populateScope_(ast, sandbox.scope);
+      thread.stateStack_[thread.stateStack_.length] =
+          new Interpreter.State(ast, sandbox.scope);
+      thread.value = undefined;  // In case no ExpressionStatements evaluated.
+      return Interpreter.FunctionResult.AwaitValue;
+    }
+  });
+};
+
+/**
+ * Initialize the size limits API (see Interpreter.SizeLimits).
+ * @private
+ */
+Interpreter.prototype.initSizeLimits_ = function() {
+  var names = Object.keys(Interpreter.SIZE_LIMITS);
+
+  new this.NativeFunction({
+    id: 'CC.sizeLimits', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var owner = args[0];
+      var perms = state.scope.perms;
+      if (!(owner instanceof intrp.Object) && owner !== null) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'owner must be an object or null');
+      }
+      var limits = new intrp.Object(perms);
+      for (var i = 0; i < names.length; i++) {
+        limits.set(names[i], intrp.sizeLimit_(
+            /** @type {?Interpreter.Owner} */(owner), names[i]), perms);
+      }
+      return limits;
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.sizeLimitsSet', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var owner = args[0];
+      var limits = args[1];
+      var perms = state.scope.perms;
+      intrp.checkTier_(perms, Tiers.Tier.WIZARD, 'set size limits');
+      if (!(owner instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'owner must be an object');
+      }
+      var details = {'owner': intrp.ownerName_(owner)};
+      if (limits === null) {
+        intrp.sizeLimits_.delete(owner);  // Revert to the configured limits.
+      } else if (!(limits instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'limits must be an object or null');
+      } else {
+        var record = {};
+        for (var i = 0; i < names.length; i++) {
+          var value = limits.get(names[i], perms);
+          if (value === undefined) continue;
+          if (typeof value !== 'number' || !Number.isInteger(value) ||
+              value < 0 || value > Interpreter.SIZE_LIMITS.maxArray) {
+            throw new intrp.Error(perms, intrp.RANGE_ERROR,
+                names[i] + ' must be an integer from 0 to ' +
+                Interpreter.SIZE_LIMITS.maxArray);
+          }
+          record[names[i]] = value;
+          details[names[i]] = value;
+        }
+        intrp.sizeLimits_.set(owner, record);
+      }
+      intrp.recordPrivileged(perms, 'sizeLimits', details);
+    }
+  });
+};
+
+/**
+ * Initialize the security event API (see .getSecurityEvents) and the
+ * taint tracking API (see .taint).
+ * @private
+ */
+Interpreter.prototype.initSecurity_ = function() {
+  /**
+   * Check that a value is a string.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {!Interpreter.Owner} perms Who is asking.
+   * @param {*} str The value.
+   * @throws {!Interpreter.prototype.Error} If it is not.
+   */
+  var checkString = function(intrp, perms, str) {
+    if (typeof str !== 'string') {
+      throw new intrp.Error(perms, intrp.TYPE_ERROR, 'not a string');
+    }
+  };
+
+  new this.NativeFunction({
+    id: 'CC.securityEvents', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var after = args[0];
+      var type = args[1];
+      var perms = state.scope.perms;
+      intrp.checkTier_(perms, Tiers.Tier.WIZARD, 'read security events');
+      if (after !== undefined && typeof after !== 'number') {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'after must be a number');
+      } else if (type !== undefined &&
+          !Object.values(Interpreter.SecurityEventType).includes(type)) {
+        throw new intrp.Error(perms, intrp.RANGE_ERROR,
+            'type must be one of ' +
+            Object.values(Interpreter.SecurityEventType).join(', '));
+      }
+      var events = intrp.getSecurityEvents(after,
+          /** @type {!Interpreter.SecurityEventType|undefined} */(type));
+      return intrp.createArrayFromList(events.map(function(event) {
+        var obj = new intrp.Object(perms);
+        obj.set('id', event.id, perms);
+        obj.set('time', event.time, perms);
+        obj.set('type', event.type, perms);
+        obj.set('perms', event.perms, perms);
+        obj.set('thread', event.thread, perms);
+        obj.set('details', intrp.nativeToPseudo(event.details, perms), perms);
+        return obj;
+      }), perms);
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.taint', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      checkString(intrp, state.scope.perms, args[0]);
+      return intrp.taint(/** @type {string} */(args[0]));
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.untaint', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      checkString(intrp, state.scope.perms, args[0]);
+      return intrp.untaint(/** @type {string} */(args[0]));
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.isTainted', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      return intrp.isTainted(args[0]);
+    }
+  });
+};
+
+/**
+ * Initialize the blob storage API (see blobs.js).
+ * @private
+ */
+Interpreter.prototype.initBlobs_ = function() {
+  /**
+   * Check that blob storage is configured, and start an operation on
+   * it, blocking the calling thread until it completes.
+   * @param {!Interpreter} intrp The interpreter.
+   * @param {!Interpreter.Thread} thread The calling thread.
+   * @param {!Interpreter.State} state The calling state.
+   * @param {string} description Description of the operation.
+   * @param {function(!Blobs.Store): !Promise<?string|?Buffer|void>} op
+   *     The operation.
+   * @return {!Interpreter.FunctionResult} FunctionResult.Block.
+   */
+  var awaitBlob = function(intrp, thread, state, description, op) {
+    var perms = state.scope.perms;
+    if (!intrp.blobs) {
+      throw new intrp.Error(perms, intrp.ERROR,
+          'Blob storage is not configured');
+    }
+    try {
+      var promise = op(intrp.blobs);
+    } catch (e) {
+      throw intrp.errorNativeToPseudo(e, perms);
+    }
+    var rr = intrp.getResolveReject(thread, state, description);
+    promise.then(function(result) {
+      rr.resolve(Buffer.isBuffer(result) ?
+          new intrp.Buffer(result, perms) : result);
+    }, function(e) {
+      rr.reject(intrp.errorNativeToPseudo(e, perms), perms);
+    });
+    return Interpreter.FunctionResult.Block;
+  };
+
+  new this.NativeFunction({
+    id: 'CC.blobPut', length: 2,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      var data = intrp.toBytes_(args[0], args[1], perms);
+      intrp.charge_(Cryptography.hashCost(data), perms);
+      return awaitBlob(intrp, thread, state, 'store blob', function(blobs) {
+        return blobs.put(data);
+      });
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.blobGet', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var id = args[0];
+      return awaitBlob(intrp, thread, state, 'retrieve blob ' + id,
+                       function(blobs) {
+        return blobs.get(id);
+      });
+    }
+  });
+
+  new this.NativeFunction({
+    id: 'CC.blobDelete', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var id = args[0];
+      if (state.scope.perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(state.scope.perms,
+            'only root may delete blobs');
+      }
+      return awaitBlob(intrp, thread, state, 'delete blob ' + id,
+                       function(blobs) {
+        return blobs.delete(id);
+      });
+    }
+  });
+};
+
+/**
+ * Initialize the debugger API (see Interpreter.prototype.setBreakpoint,
+ * etc.).  Only root may use it.
+ * @private
+ */
+Interpreter.prototype.initDebugger_ = function() {
+  var intrp = this;
+  /**
+   * Create a native function that only root may call, and whose native
+   * exceptions are rethrown as in-world ones.
+   * @param {string} id The function's ID.
+   * @param {number} length The function's length.
+   * @param {function(!Interpreter.Owner, ...?Interpreter.Value):
+   *     ?Interpreter.Value} impl The implementation, given the caller's
+   *     perms and the arguments.
+   * @param {number=} keyIndex Index of an argument that is a property
+   *     key, which is converted (with ToPropertyKey) before impl is
+   *     called.
+   */
+  var debugFunction = function(id, length, impl, keyIndex) {
+    new intrp.NativeFunction({
+      id: id, length: length,
+      /** @type {!Interpreter.NativeCallImpl} */
+      call: function(intrp, thread, state, thisVal, args) {
+        var perms = state.scope.perms;
+        if (perms !== intrp.ROOT) {
+          throw intrp.permissionDenied_(perms,
+              'only root may debug');
+        }
+        if (keyIndex !== undefined) {
+          var key = intrp.propertyKeyArg_(thread, state, args[keyIndex]);
+          if (key === undefined) return Interpreter.FunctionResult.CallAgain;
+          args = args.slice();
+          args[keyIndex] = key;
+        }
+        try {
+          return impl.apply(null, [perms].concat(args));
+        } catch (e) {
+          if (e instanceof intrp.Object) throw e;
+          throw intrp.errorNativeToPseudo(e, perms);
+        }
+      }
+    });
+  };
+
+  /**
+   * Get the ID of a Thread argument.
+   * @param {?Interpreter.Value} thread The argument.
+   * @return {number} The thread's ID.
+   */
+  var threadId = function(thread) {
+    if (!(thread instanceof intrp.Thread)) {
+      throw new TypeError('thread must be a Thread');
+    }
+    return thread.thread.id;
+  };
+
+  /**
+   * Create an object with the given properties.
+   * @param {!Object<string, ?Interpreter.Value>} props The properties.
+   * @param {!Interpreter.Owner} perms Owner of the new object.
+   * @return {!Interpreter.prototype.Object} The object.
+   */
+  var toObject = function(props, perms) {
+    var obj = new intrp.Object(perms);
+    for (var key in props) {
+      obj.defineProperty(key, Descriptor.wec.withValue(props[key]), perms);
+    }
+    return obj;
+  };
+
+  debugFunction('CC.debugSetBreakpoint', 2, function(perms, func, line) {
+    return intrp.setBreakpoint(/** @type {?} */ (func),
+                               /** @type {?} */ (line)).id;
+  });
+
+  debugFunction('CC.debugClearBreakpoint', 1, function(perms, id) {
+    return intrp.clearBreakpoint(/** @type {?} */ (id));
+  });
+
+  debugFunction('CC.debugBreakpoints', 0, function(perms) {
+    return intrp.createArrayFromList(
+        intrp.getBreakpoints().map(function(breakpoint) {
+          return toObject({
+            id: breakpoint.id,
+            func: breakpoint.func,
+            line: breakpoint.line,
+            hits: breakpoint.hits,
+          }, perms);
+        }), perms);
+  });
+
+  // The handler, if given, is called (in a new thread, with root perms)
+  // with the object, key, old value, new value and writing Thread (or
+  // null) after each write; otherwise the writing thread is paused.
+  debugFunction('CC.debugSetWatchpoint', 3,
+                function(perms, obj, key, handler) {
+    return intrp.setWatchpoint(/** @type {?} */ (obj), String(key),
+                               /** @type {?} */ (handler)).id;
+  }, 1);
+
+  debugFunction('CC.debugClearWatchpoint', 1, function(perms, id) {
+    return intrp.clearWatchpoint(/** @type {?} */ (id));
+  });
+
+  debugFunction('CC.debugWatchpoints', 0, function(perms) {
+    return intrp.createArrayFromList(
+        intrp.getWatchpoints().map(function(watchpoint) {
+          return toObject({
+            id: watchpoint.id,
+            object: watchpoint.object,
+            key: watchpoint.key,
+            handler: watchpoint.handler,
+            hits: watchpoint.hits,
+          }, perms);
+        }), perms);
+  });
+
+  debugFunction('CC.debugPause', 1, function(perms, thread) {
+    return intrp.pauseThread(threadId(thread));
+  });
+
+  debugFunction('CC.debugResume', 2, function(perms, thread, mode) {
+    intrp.resumeThread(threadId(thread),
+                       (mode === undefined) ? 'continue' : String(mode));
+  });
+
+  // Returns the frames of a paused thread, innermost first: each is as
+  // from Thread.callers, plus .scopes: the frame's scope and those
+  // enclosing it (short of the global scope), each as {type, vars}.
+  debugFunction('CC.debugFrames', 1, function(perms, thread) {
+    return intrp.createArrayFromList(
+        intrp.getFrames(threadId(thread)).map(function(frame) {
+          var scopes = [];
+          for (var scope = frame.scope;
+               scope && scope.type !== Interpreter.Scope.Type.GLOBAL;
+               scope = scope.outerScope) {
+            scopes.push(toObject({
+              type: scope.type,
+              vars: toObject(scope.vars, perms),
+            }, perms));
+          }
+          var props = Object.assign({}, frame.frame);
+          props.scopes = intrp.createArrayFromList(scopes, perms);
+          return toObject(props, perms);
+        }), perms);
+  });
+
+  // Sets the function to be called (in a new thread, with root perms)
+  // with each Thread paused by the debugger and the reason
+  // ('breakpoint', 'watchpoint', 'step' or 'pause'), or null for none.
+  debugFunction('CC.debugSetHandler', 1, function(perms, func) {
+    if (func !== null && !(func instanceof intrp.Function)) {
+      throw new TypeError('handler must be a function or null');
+    }
+    intrp.debugHandler_ = func;
+  });
+
+  debugFunction('CC.debugStartCoverage', 0, function(perms) {
+    intrp.startCoverage();
+  });
+
+  debugFunction('CC.debugStopCoverage', 0, function(perms) {
+    intrp.stopCoverage();
+  });
+
+  // Returns the statement coverage collected for the functions owned by
+  // owner (by default the caller) that have been executed, as an array
+  // of {func, statements: [{line, col, hits}, ...]}.  Unlike the other
+  // debugger functions, it may be called by anyone: for their own
+  // functions.
+  new intrp.NativeFunction({
+    id: 'CC.debugCoverage', length: 1,
+    /** @type {!Interpreter.NativeCallImpl} */
+    call: function(intrp, thread, state, thisVal, args) {
+      var perms = state.scope.perms;
+      var owner = (args[0] === undefined) ? perms : args[0];
+      if (!(owner instanceof intrp.Object)) {
+        throw new intrp.Error(perms, intrp.TYPE_ERROR,
+            'owner must be an object');
+      } else if (owner !== perms && perms !== intrp.ROOT) {
+        throw intrp.permissionDenied_(perms,
+            'only root may see the coverage of others\' functions');
+      }
+      return intrp.createArrayFromList(
+          intrp.getCoverage(/** @type {!Interpreter.Owner} */ (owner))
+              .map(function(coverage) {
+                return toObject({
+                  func: coverage.func,
+                  statements: intrp.createArrayFromList(
+                      coverage.statements.map(function(statement) {
+                        return toObject(statement, perms);
+                      }), perms),
+                }, perms);
+              }), perms);
+    }
+  });
+};
+
+/**
+ * The ToInteger function from ES6 §7.1.4.  The abstract operation
+ * ToInteger converts argument to an integral numeric value.
+ * @param {?Interpreter.Value} value
+ * @return {number} An integer if the value can be converted to such;
+ *     0 otherwise.
+ */
+Interpreter.toInteger = function toInteger(value) {
+  var number = Number(value);
+  if (isNaN(number)) {
+    return 0;
+  } else if (number === 0 || !isFinite(number)) {
+    return number;
+  }
+  return Math.trunc(number);
+};
+
+/**
+ * The ToUint32 function from ES6 §7.1.6.  The abstract operation
+ * ToUint32 converts argument to one of 2**32 integer values in the
+ * range 0 through 2**32−1, inclusive.
+ * @param {?Interpreter.Value} value
+ * @return {number} A non-negative integer less than 2**32.
+ */
+Interpreter.toUint32 = function toUint32(value) {
+  return Interpreter.toInteger(value) >>> 0;
+};
+
+/**
+ * The ToLength function from ES6 §7.1.15.  Note that this does NOT
+ * enforce the actual array length limit of 2**32-1, but deals with
+ * lengths up to 2**53-1, which is correct for the polymorphic
+ * Array.prototype methods.
+ * @param {?Interpreter.Value} value
+ * @return {number} A non-negative integer less than 2**53.
+ */
+Interpreter.toLength = function toLength(value) {
+  var len = Interpreter.toInteger(value);
+  if (len <= 0) return 0;
+  return Math.min(len, Number.MAX_SAFE_INTEGER);  // Handles len === Infinity.
+};
+
+/**
+ * The Strict Equality Comparison algorithm from ES6 §7.2.13: NaN is
+ * not equal to anything (even itself), and +0 is equal to -0.  Used
+ * by ===, !==, switch, Array.prototype.indexOf and .lastIndexOf.
+ * @param {?Interpreter.Value} x
+ * @param {?Interpreter.Value} y
+ * @return {boolean} True iff x and y are strictly equal.
+ */
+Interpreter.strictEquals = function strictEquals(x, y) {
+  return x === y;
+};
+
+/**
+ * The SameValueZero function from ES6 §7.2.10: like strict equality,
+ * except that NaN is the same value as itself.  Used by
+ * Array.prototype.includes (and, when they are implemented, for the
+ * keys of Maps and Sets).
+ * @param {?Interpreter.Value} x
+ * @param {?Interpreter.Value} y
+ * @return {boolean} True iff x and y are the same value.
+ */
+Interpreter.sameValueZero = function sameValueZero(x, y) {
+  return x === y || (Number.isNaN(/** @type {?} */(x)) &&
+                     Number.isNaN(/** @type {?} */(y)));
+};
+
+/**
+ * The SameValue function from ES6 §7.2.9: like SameValueZero, except
+ * that +0 and -0 are different values.  Used by Object.is.
+ * @param {?Interpreter.Value} x
+ * @param {?Interpreter.Value} y
+ * @return {boolean} True iff x and y are the same value.
+ */
+Interpreter.sameValue = function sameValue(x, y) {
+  if (x === 0 && y === 0) return 1 / x === 1 / y;
+  return Interpreter.sameValueZero(x, y);
+};
+
+/**
+ * Create a new native function.  Function will be owned by root.
+ * @param {string} id ID to register new function in builtins registry.
+ * @param {!Function} nativeFunc Any JavaScript function.
+ * @param {boolean} legalConstructor True if the function can be used as a
+ *     constructor (e.g. Array), false if not (e.g. escape).
+ * @return {!Interpreter.prototype.Function} New function.
+*/
+Interpreter.prototype.createNativeFunction = function(
+    id, nativeFunc, legalConstructor) {
+  if (nativeFunc instanceof this.Object) {
+    throw new TypeError('createNativeFunction passed non-native function??');
+  }
+  // Make sure impl function has an id for serialization.
+  if (!nativeFunc.id) nativeFunc.id = id;
+  return new this.OldNativeFunction(nativeFunc, legalConstructor, {id: id});
+};
+
+/**
+ * Converts from a native JS object or value to a JS interpreter
+ * object.  Can handle JSON-style values plus regexps and errors (of
+ * all standard native types), and handles additional properties on
+ * arrays, regexps and errors (just as for plain objects).  Ignores
+ * prototype and inherited properties.  Efficiently handles
+ * sparse arrays.  Does NOT handle cyclic structures.
+ * @param {*} nativeObj The native JS object to be converted.
+ * @return {?Interpreter.Value} The equivalent JS interpreter object.
+ * @param {!Interpreter.Owner} owner Owner for new object.
+ */
+Interpreter.prototype.nativeToPseudo = function(nativeObj, owner) {
+  if ((typeof nativeObj !== 'object' && typeof nativeObj !== 'function') ||
+      nativeObj === null) {
+    // It's a primitive; just return it.
+    return /** @type {boolean|number|string|undefined|null} */ (nativeObj);
+  } else if (nativeObj instanceof this.Object) {
+    throw new TypeError('nativeToPseudo called on a pseudo-object??');
+  } else if (Buffer.isBuffer(nativeObj)) {
+    return new this.Buffer(Buffer.from(nativeObj), owner);
+  }
+
+  var pseudoObj;
+  switch (Object.prototype.toString.apply(nativeObj)) {
+    case '[object Array]':
+      pseudoObj = new this.Array(owner);
+      break;
+    case '[object RegExp]':
+      pseudoObj = new this.RegExp(/** @type {!RegExp} */(nativeObj), owner);
+      break;
+    case '[object Error]':
+      var proto;
+      if (nativeObj instanceof EvalError) {
+        proto = this.EVAL_ERROR;
+      } else if (nativeObj instanceof RangeError) {
+        proto = this.RANGE_ERROR;
+      } else if (nativeObj instanceof ReferenceError) {
+        proto = this.REFERENCE_ERROR;
+      } else if (nativeObj instanceof SyntaxError) {
+        proto = this.SYNTAX_ERROR;
+      } else if (nativeObj instanceof TypeError) {
+        proto = this.TYPE_ERROR;
+      } else if (nativeObj instanceof URIError) {
+        proto = this.URI_ERROR;
+      } else {
+        proto = this.ERROR;
+      }
+      pseudoObj = new this.Error(owner, proto);
+      break;
+    default:
+      pseudoObj = new this.Object(owner);
+  }
+
+  // Cast to satisfy type-checker; it might be a lie: nativeObj could
+  // be an object (i.e., non-primitive) but not an Object (i.e.,
+  // inherits from Object.prototype).  Fortunately we don't care.
+  var keys = Object.getOwnPropertyNames(/** @type {!Object} */(nativeObj));
+  for (var i = 0; i < keys.length; i++) {
+    var key = keys[i];
+    var desc = Object.getOwnPropertyDescriptor(nativeObj, key);
+    var pd = new Descriptor(desc.writable, desc.enumerable, desc.configurable);
+    pd.value = this.nativeToPseudo(desc.value, owner);
+    pseudoObj.defineProperty(key, pd, owner);
+  }
+  return pseudoObj;
+};
+
+/**
+ * Converts from a JS interpreter object to native JS object.
+ * Can handle JSON-style values, plus cycles.
+ *
+ * TODO(cpcallen): Audit this to ensure that it can safely accept any
+ * user object (especially because it is used by our implementations
+ * of JSON.stringify, String.prototype.localeCompare, etc.)
+ *
+ * TODO(cpcallen:perms): Audit all callers of this to ensure that they
+ * do not allow circumvention of access control.
+ * @param {?Interpreter.Value} pseudoObj The JS interpreter object to
+ *     be converted.
+ * @param {!Object=} cycles Cycle detection (used only in recursive calls).
+ * @return {*} The equivalent native JS object or value.
+ */
+Interpreter.prototype.pseudoToNative = function(pseudoObj, cycles) {
+  // BUG(cpcallen:perms): Kludge.  Incorrect except when doing .step
+  // or run.  Should be an argument instead, forcing caller to decide.
+  try {
+    var perms = this.thread_.perms();
+  } catch (e) {
+    perms = this.ROOT;
+  }
+  if (typeof pseudoObj === 'boolean' ||
+      typeof pseudoObj === 'number' ||
+      typeof pseudoObj === 'string' ||
+      pseudoObj === null || pseudoObj === undefined) {
+    // It's a primitive; just return it.
+    return pseudoObj;
+  } else if (!(pseudoObj instanceof this.Object)) {
+    throw new TypeError('pseudoToObject called on wrong type??');
+  } else if (pseudoObj instanceof this.RegExp) {  // Regular expression.
+    return pseudoObj.regexp;
+  } else if (pseudoObj instanceof this.Buffer) {  // Binary data.
+    return Buffer.from(pseudoObj.data);
+  } else if (pseudoObj instanceof this.Function) {  // Function.
+    return undefined;
+  }
+
+  if (!cycles) {
+    cycles = {pseudo: [], native: []};
+  }
+  var i = cycles.pseudo.indexOf(pseudoObj);
+  if (i !== -1) {
+    return cycles.native[i];
+  }
+  cycles.pseudo[cycles.pseudo.length] = pseudoObj;
+  var nativeObj = pseudoObj instanceof this.Array ? [] : {};
+  cycles.native[cycles.native.length] = nativeObj;
+  var keys = pseudoObj.ownKeys(perms);
+  for (i = 0; i < keys.length; i++) {
+    var key = keys[i];
+    var pd = pseudoObj.getOwnPropertyDescriptor(key, perms);
+    Object.defineProperty(nativeObj, key, {
+      writable: pd.writable,
+      enumerable: pd.enumerable,
+      configurable: pd.configurable,
+      value: this.pseudoToNative(pd.value, cycles)
+    });
+  }
+  cycles.pseudo.pop();
+  cycles.native.pop();
+  return nativeObj;
+};
+
+/**
+ * CreateArrayFromList from ES6 §7.3.16
+ *
+ * Converts from a native array to an Interpreter.prototype.Array.
+ * Does NOT recursively convert the type of the array's contents.
+ * @param {!Array<?Interpreter.Value>} elements The native array to be
+ *     converted.
+ * @param {!Interpreter.Owner} owner Owner for new object.
+ * @return {!Interpreter.prototype.Array} The equivalent interpreter array.
+ */
+Interpreter.prototype.createArrayFromList = function(elements, owner) {
+  if (!Array.isArray(elements) || (elements instanceof this.Object)) {
+    throw new TypeError('CreateArrayFromList called on wrong type??');
+  }
+  var array = new this.Array(owner);
+  for (var n = 0; n < elements.length; n++) {
+    array.defineProperty(
+        String(n), Descriptor.wec.withValue(elements[n]), owner);
+  }
+  return array;
+};
+
+/**
+ * CreateListFromArrayLike from ES6 §7.3.17.
+ *
+ * This function converts from an Interpreter.prototype.Array (or
+ * array-like I.p.Object) to a native array.  This is an evolution of
+ * the algorithm from ES5.1 §15.3.4.3 (Function.prototype.apply).  It
+ * does NOT recursively convert the type of the array's contents.
+ *
+ * TODO(ES6): Add elementTypes param and associated type checks.
+ * @param {?Interpreter.Value} obj The interpreter array or array-like
+ *     object to be converted.  Error thrown if non-object.
+ * @param {!Interpreter.Owner} perms Who is trying convert it?
+ * @return {!Array<?Interpreter.Value>} The equivalent native JS array.
+ */
+Interpreter.prototype.createListFromArrayLike = function(obj, perms) {
+  if (!(obj instanceof this.Object)) {
+    throw new this.Error(perms, this.TYPE_ERROR,
+        'CreateListFromArrayLike called on non-object');
+  }
+  var len = Interpreter.toLength(obj.get('length', perms));
+  var list = [];
+  for (var i = 0; i < len; i++) {
+    list[i] = obj.get(String(i), perms);
+  }
+  return list;
+};
+
+/**
+ * Converts from a native Error to a JS interpreter Error.  Unlike
+ * pseudoToNative, this fucntion only converts type and .message.
+ * @param {!Error} err Native Error value to be converted.
+ * @param {?Interpreter.Owner} owner Owner for new (pseudo) Error object.
+ * @return {!Interpreter.prototype.Error}
+ */
+Interpreter.prototype.errorNativeToPseudo = function(err, owner) {
+  var proto;
+  if (err instanceof this.Object) {
+    throw new TypeError('errorNativeToPseudo called on wrong type??');
+  }
+
+  if (err instanceof EvalError) {
+    proto = this.EVAL_ERROR;
+  } else if (err instanceof RangeError) {
+    proto = this.RANGE_ERROR;
+  } else if (err instanceof ReferenceError) {
+    proto = this.REFERENCE_ERROR;
+  } else if (err instanceof SyntaxError) {
+    proto = this.SYNTAX_ERROR;
+  } else if (err instanceof TypeError) {
+    proto = this.TYPE_ERROR;
+  } else if (err instanceof URIError) {
+    proto = this.URI_ERROR;
+  } else {
+    proto = this.ERROR;
+  }
+  return new this.Error(owner, proto, err.message);
+};
+
+/**
+ * Implements the ToObject specification method from ES5.1 §9.9 / ES6
+ * §7.1.13, but returning temporary Box objects instead of boxed
+ * Boolean, Number or String instances.
+ * @param {?Interpreter.Value} value The value to be converted to an Object.
+ * @param {!Interpreter.Owner} perms Who is trying convert it?
+ * @return {!Interpreter.ObjectLike}
+ */
+Interpreter.prototype.toObject = function(value, perms) {
+  if (value === null || value === undefined) {
+    throw new this.Error(perms, this.TYPE_ERROR, this.options.v8Messages ?
+        'Cannot convert undefined or null to object' :
+        "Can't convert " + value + ' to Object');
+  } else if (typeof value === 'boolean' || typeof value === 'number' ||
+      typeof value === 'string') {
+    return new this.Box(value);
+  }
+  return value;
+};
+
+/**
+ * Begins the ToPropertyKey specification method from ES6 §7.1.14 for
+ * an object key: since ToPrimitive may call the object's .toString
+ * or .valueOf method, this returns a State that calls the String
+ * builtin to do the conversion, leaving the key (always a string,
+ * since Symbols are not supported) as the caller's state.value.
+ * Primitive keys need no such help: String(key) is canonical, so
+ * obj[1], obj[1.0] and obj['1'] denote the same property, while
+ * obj['01'] does not.
+ * @param {!Interpreter.prototype.Object} key The object to convert.
+ * @param {!Interpreter.Owner} perms Who is trying convert it?
+ * @return {!Interpreter.State} State to push onto the stack.
+ */
+Interpreter.prototype.toPropertyKey_ = function(key, perms) {
+  var func = /** @type {!Interpreter.prototype.Function} */(
+      this.builtins.get('String'));
+  return Interpreter.State.newForCall(func, undefined, [key], perms);
+};
+
+/**
+ * The ToPropertyKey specification method from ES6 §7.1.14, for a key
+ * passed to a NativeFunction.  If the key is an object, the first
+ * visit pushes a call of the String builtin (see .toPropertyKey_) and
+ * returns undefined, in which case the NativeFunction must return
+ * FunctionResult.CallAgain; on the next visit, this returns the
+ * converted key.  Uses state.info_.funcState, so cannot be used by
+ * NativeFunctions that use it themselves.
+ * @private
+ * @param {!Interpreter.Thread} thread The current thread.
+ * @param {!Interpreter.State} state The NativeFunction's call state.
+ * @param {?Interpreter.Value} key The key to convert.
+ * @return {string|undefined} The key, or undefined if a call of
+ *     String has been pushed to convert it.
+ */
+Interpreter.prototype.propertyKeyArg_ = function(thread, state, key) {
+  if (!(key instanceof this.Object)) return String(key);
+  if (state.info_.funcState === 'ToPropertyKey') {
+    return String(state.value);
+  }
+  state.info_.funcState = 'ToPropertyKey';
+  thread.stateStack_[thread.stateStack_.length] =
+      this.toPropertyKey_(key, state.scope.perms);
+  return undefined;
+};
+
+/**
+ * Render a property key as V8 does in error messages (see
+ * Interpreter.Options.v8Messages).
+ * @private
+ * @param {?Interpreter.Value} key The key.
+ * @return {string}
+ */
+Interpreter.prototype.v8Key_ = function(key) {
+  return key instanceof this.Object ? '#<' + key.class + '>' : String(key);
+};
+
+/**
+ * Compose the message V8 would give for an attempt to get or set a
+ * property of null or undefined: e.g., "Cannot read properties of
+ * undefined (reading 'foo')".
+ * @private
+ * @param {!Array<!Interpreter.State>} stack The current thread's
+ *     state stack, with the MemberExpression's state on top.
+ * @param {!Node} node The MemberExpression node.
+ * @param {null|undefined} base The value of its object.
+ * @param {?Interpreter.Value} value The value of its property key, if
+ *     computed.
+ * @return {string}
+ */
+Interpreter.prototype.v8MemberMessage_ = function(stack, node, base, value) {
+  var parent = stack[stack.length - 2].node;
+  if (parent['type'] === 'UnaryExpression' &&
+      parent['operator'] === 'delete') {
+    return 'Cannot convert undefined or null to object';
+  }
+  var key = node['computed'] ? this.v8Key_(value) : node['property']['name'];
+  if (parent['type'] === 'AssignmentExpression' &&
+      parent['operator'] === '=' && parent['left'] === node) {
+    return 'Cannot set properties of ' + base + " (setting '" + key + "')";
+  }
+  return 'Cannot read properties of ' + base + " (reading '" + key + "')";
+};
+
+/**
+ * Retrieves a value from the scope chain.
+ * @param {!Interpreter.Scope} scope Scope to read from.
+ * @param {string} name Name of variable.
+ * @return {?Interpreter.Value} Value (may be undefined).
+ */
+Interpreter.prototype.getValueFromScope = function(scope, name) {
+  for (var s = scope; s; s = s.outerScope) {
+    if (name in s.vars) {
+      return s.vars[name];
+    }
+  }
+  throw new this.Error(this.thread_.perms(), this.REFERENCE_ERROR,
+      name + ' is not defined');
+};
+
+/**
+ * Sets a value to the current scope.
+ * @param {!Interpreter.Scope} scope Scope to write to.
+ * @param {string} name Name of variable.
+ * @param {?Interpreter.Value} value Value.
+ */
+Interpreter.prototype.setValueToScope = function(scope, name, value) {
+  for (var s = scope; s; s = s.outerScope) {
+    if (name in s.vars) {
+      try {
+        s.vars[name] = value;
+      } catch (e) {  // Trying to set immutable binding.
+        // TODO(cpcallen:perms): we have a scope here, but scope.perms
+        // is probably not the right value for owner of new error.
+        throw new this.Error(this.thread_.perms(), this.TYPE_ERROR,
+            'Assignment to constant variable ' + name);
+      }
+      return;
+    }
+  }
+  throw new this.Error(this.thread_.perms(), this.REFERENCE_ERROR,
+      name + ' is not defined');
+};
+
+/**
+ * Populate a scope with declarations from given node.
+ * @param {!Node} node AST node (program or function).
+ * @param {!Interpreter.Scope} scope Scope dictionary to populate.
+ * @param {!Interpreter.Source=} source Original source code.  If not
+ *     supplied, will use node['source'] instead.
+ * @private
+ */
+Interpreter.prototype.populateScope_ = function(node, scope, source) {
+  if (!source) {
+    if (!node['source']) throw new Error('Source not found');
+    source = node['source'];
+  }
+  // Obtain list of bound names for node.  We cache this on the AST
+  // node to save time when repeatedly calling the same function.
+  var boundNames = getBoundNames(node);
+  for (var name in boundNames) {
+    var boundValue = boundNames[name];
+    var value = boundValue ?
+        new this.UserFunction(boundValue, scope, source, scope.perms)
+        : undefined;
+    if (!scope.hasBinding(name)) scope.createMutableBinding(name, value);
+    if (value) this.setValueToScope(scope, name, value);
+  }
+};
+
+/**
+ * Is the current state directly being called with as a construction with 'new'.
+ * @return {boolean} True if 'new foo()', false if 'foo()'.
+ */
+Interpreter.prototype.calledWithNew = function() {
+  return this.thread_.stateStack_[this.thread_.stateStack_.length - 1]
+      .info_.construct;
+};
+
+/**
+ * Implements IsUnresolvableReference from ES5 §8.7 / ES6 §6.2.3.
+ * @param {!Interpreter.Scope} scope Current scope dictionary.
+ * @param {!Array} ref Reference tuple.
+ * @param {!Interpreter.Owner} perms Who is trying to get it?
+ * @return {boolean} True iff refernece is unresolvable.
+ */
+Interpreter.prototype.isUnresolvableReference = function(scope, ref, perms) {
+  // Property references never unresolvable.
+  return ref[0] === null;
+};
+
+/**
+ * Gets the value of a referenced name from the scope or object referred to.
+ * @param {!Array} ref Reference tuple.
+ * @param {!Interpreter.Owner} perms Who is trying to get it?
+ * @return {?Interpreter.Value} Value (may be undefined).
+ */
+Interpreter.prototype.getValue = function(ref, perms) {
+  var base = ref[0];
+  var name = ref[1];
+  if (base === null) {  // Unresolvable reference.
+    throw new this.Error(perms, this.REFERENCE_ERROR, name + ' is not defined');
+  } else if (base instanceof Interpreter.Scope) {  // An environment reference.
+    return base.get(name);
+  } else if (typeof name === 'number') {  // An element reference.
+    return base.getElement(name, perms);
+  } else {  // A property reference.
+    return this.toObject(base, perms).get(name, perms);
+  }
+};
+
+/**
+ * Sets value of a referenced name to the scope or object referred to.
+ * @param {!Array} ref Reference tuple.
+ * @param {?Interpreter.Value} value Value.
+ * @param {!Interpreter.Owner} perms Who is trying to set it?
+ */
+Interpreter.prototype.setValue = function(ref, value, perms) {
+  var base = ref[0];
+  var name = ref[1];
+  if (base === null) {  // Unresolvable reference.
+    throw new this.Error(perms, this.REFERENCE_ERROR, name + ' is not defined');
+  } else if (base instanceof Interpreter.Scope) {  // An environment reference.
+    var err = base.set(name, value);
+    if (err) {
+      throw this.errorNativeToPseudo(err, perms);
+    }
+  } else if (typeof name === 'number') {  // An element reference.
+    base.setElement(name, value, perms);
+  } else {  // A property reference.
+    this.toObject(ref[0], perms).set(name, value, perms);
+  }
+};
+
+/**
+ * Check to see if the current thread has run too long.  Called at the
+ * top of loops and before making function calls.
+ * @private
+ * @param {!Interpreter.Owner} perms Perm to use to create Error object.
+ */
+Interpreter.prototype.checkTimeLimit_ = function(perms) {
+  if (this.threadTimeLimit_ && this.now() > this.threadTimeLimit_) {
+    throw new this.Error(perms, this.RANGE_ERROR, 'Thread ran too long');
+  }
+};
+
+/**
+ * Run a native match operation on behalf of the current thread,
+ * limiting the time it can take to what remains of the thread's time
+ * limit (and to RegExpGuard.MAX_TIME), so that a pattern given to
+ * RegExp.prototype.exec, String.prototype.replace, etc. by in-world
+ * code can't stall the server by backtracking catastrophically.
+ * @private
+ * @template T
+ * @param {*} regexp The native RegExp being matched (or the string
+ *     being searched for, in which case no limit is needed).
+ * @param {function(): T} func Function doing the matching.
+ * @return {T} The result of func.
+ */
+Interpreter.prototype.runRegExp_ = function(regexp, func) {
+  var perms = this.thread_.perms();
+  this.checkTimeLimit_(perms);
+  var timeLimit = this.threadTimeLimit_ ?
+      this.threadTimeLimit_ - this.now() : RegExpGuard.MAX_TIME;
+  try {
+    return RegExpGuard.run(regexp, func, timeLimit);
+  } catch (e) {
+    if (e instanceof RangeError) throw this.errorNativeToPseudo(e, perms);
+    throw e;
+  }
+};
+
+/**
+ * Charge the current thread for work done on its behalf by native
+ * code (e.g., hashing), by reducing the time it has left to run.
+ * Throws, instead of charging, if it does not have that much time
+ * left, so that the work need not be started.
+ * @private
+ * @param {number} cost Estimated time the work takes (in ms).
+ * @param {!Interpreter.Owner} perms Perm to use to create Error object.
+ */
+Interpreter.prototype.charge_ = function(cost, perms) {
+  if (!this.threadTimeLimit_) return;
+  if (this.now() + cost > this.threadTimeLimit_) {
+    throw new this.Error(perms, this.RANGE_ERROR, 'Thread ran too long');
+  }
+  this.threadTimeLimit_ -= cost;
+};
+
+
+/**
+ * Carry out the mechanics of throwing an exception.
+ *
+ * This is intended only to be called from exception handlers in
+ * .step() and .run(), and from async function's reject() callback.
+ * Elsewhere, just throw.
+ * @param {!Interpreter.Thread} thread in which throw is occurring.
+ * @param {?Interpreter.Value} e Exception being thrown.
+ * @param {!Interpreter.Owner} perms Perm to use to obtain (e.g.)
+ *     function names, etc.
+ */
+Interpreter.prototype.throw_ = function(thread, e, perms) {
+  if (e instanceof this.Error) {
+    // Userland Error object thrown; make sure it has a .stack.
+    // BUG(cpcallen): this will set .stack on Error.prototype, etc.
+    e.makeStack(thread.callers(perms), perms);
+  } else if (e instanceof Error) {
+    // Uh oh.  This is an internal error in the interpreter.  Kill
+    // thread and rethrow.
+    thread.status = Interpreter.Thread.Status.ZOMBIE;
+    throw e;
+  } else if (!(e instanceof this.Object) && e !== null &&
+      (typeof e === 'object' || typeof e === 'function')) {
+    // WTF: not a native exception, not an interpreter object and not
+    // a primitive, but just some random (internal) object.
+    throw new TypeError('Unexpected exception value ' + String(e));
+  }
+  this.unwind_(thread, Interpreter.CompletionType.THROW, e, undefined);
+};
+
+/**
+ * Unwind the stack to the innermost relevant enclosing TryStatement,
+ * For/ForIn/WhileStatement or Call.  If this results in
+ * the stack being completely unwound the thread will be terminated
+ * and an appropriate error being logged.
+ *
+ * N.B. Normally unwind should be called from the current stack frame
+ * (i.e., do NOT do stack.pop() before calling unwind) because the
+ * target label of a break statement can be the statement itself
+ * (e.g., `foo: break foo;`).
+ * @private
+ * @param {!Interpreter.Thread} thread The thread whose stack is to be unwound.
+ * @param {!Interpreter.CompletionType} type Completion type.
+ * @param {?Interpreter.Value=} value Value computed, returned or thrown.
+ * @param {string=} label Target label for break or return.
+ */
+Interpreter.prototype.unwind_ = function(thread, type, value, label) {
+  if (type === Interpreter.CompletionType.NORMAL) {
+    throw new TypeError('Should not unwind for NORMAL completions');
+  }
+  for (var stack = thread.stateStack_; stack.length > 0; stack.pop()) {
+    var state = stack[stack.length - 1];
+    switch (state.node['type']) {
+      case 'TryStatement':
+        state.info_ = {type: type, value: value, label: label};
+        return;
+      case 'Call':
+        switch (type) {
+          case Interpreter.CompletionType.BREAK:
+          case Interpreter.CompletionType.CONTINUE:
+            throw new Error('Unsynatctic break/continue not rejected by Acorn');
+          case Interpreter.CompletionType.RETURN:
+            state.value = value;
+            return;
+        }
+        break;
+    }
+    if (type === Interpreter.CompletionType.BREAK) {
+      if (label ? (state.labels && state.labels.includes(label)) :
+          (state.isLoop || state.isSwitch)) {
+        // Top of stack is now target of break.  But we are breaking
+        // out of this statement, so pop to discard it.
+        stack.pop();
+        return;
+      }
+    } else if (type === Interpreter.CompletionType.CONTINUE) {
+      if (label ? (state.labels && state.labels.includes(label)) :
+          state.isLoop) {
+        return;
+      }
+    }
+  }
+
+  // Unhandled completion.  Terminate thread.
+  thread.status = Interpreter.Thread.Status.ZOMBIE;
+
+  if (type === Interpreter.CompletionType.THROW) {
+    // Log exception and stack trace.
+    var stackTrace = undefined;
+    if (value instanceof this.Error) {
+      this.log('unhandled', 'Unhandled %s', value);
+      stackTrace = value.get('stack', this.ROOT);
+      if (stackTrace) {
+        this.log('unhandled', stackTrace);
+      }
+    } else {
+      var native = this.pseudoToNative(value);
+      this.log('unhandled', 'Unhandled exception with value: %o', native);
+    }
+    this.reportUnhandled_(thread, value, stackTrace);
+    if (thread.onExit) thread.onExit(true, value);
+  } else {
+    throw new Error('Unsynatctic break/continue/return not rejected by Acorn');
+  }
+};
+
+/**
+ * Deliver a report of an uncaught exception to the owner of the
+ * thread in which it occurred, by calling the owner's .onError
+ * method (if it has one) in a new thread.  The method is passed a
+ * single argument: an object with properties .error (the value
+ * thrown), .stack (the stack trace, if any) and .thread (the Thread
+ * that died).
+ *
+ * Exceptions thrown by an .onError handler are logged as usual but
+ * not reported again.
+ * @private
+ * @param {!Interpreter.Thread} thread The thread that died.
+ * @param {?Interpreter.Value} value The value thrown.
+ * @param {?Interpreter.Value=} stackTrace Value of value.stack, if any.
+ */
+Interpreter.prototype.reportUnhandled_ = function(thread, value, stackTrace) {
+  if (thread.isErrorHandler || !thread.wrapper) return;
+  var owner = thread.wrapper.owner;
+  if (!(owner instanceof this.Object)) return;
+  // TODO(cpcallen:perms): should probably check readability of
+  // .onError with owner's perms rather than ROOT's.
+  var handler = owner.get('onError', this.ROOT);
+  if (!(handler instanceof this.Function)) return;
+  var report = new this.Object(owner);
+  report.set('error', value, owner);
+  report.set('stack', stackTrace, owner);
+  report.set('thread', thread.wrapper, owner);
+  var handlerThread = this.createThreadForFuncCall(
+      owner, handler, owner, [report], undefined, thread.timeLimit);
+  handlerThread.thread.isErrorHandler = true;
+};
+
+/**
+ * Get a {resovle, reject} tuple for the specified thread and state,
+ * which is presumed to be about to block on an async function call.
+ *
+ * The resolve function takes a single argument and, when called, will
+ * unblock the thread and save its argument in state.value.
+ *
+ * The reject function takes a single argument and, when called, will
+ * unblock the thread and unwind the stack as if its argument had been
+ * thrown.
+ *
+ * Only one of these may be called, and only once, or an internal
+ * Error will be thrown.
+ * @param {!Interpreter.Thread} thread The thread to be controlled.
+ * @param {!Interpreter.State} state The state in which thread to block.
+ * @param {string} description Description of the operation the thread
+ *     is waiting for (e.g., 'XHR for http://example.com/'), for the
+ *     Error thrown if it is interrupted (see Interpreter.HostHandle).
+ * @return {{resolve: function(?Interpreter.Value=):void,
+ *           reject: function(?Interpreter.Value, !Interpreter.Owner):void}}
+ */
+Interpreter.prototype.getResolveReject = function(thread, state,
+                                                  description) {
+  var /** boolean */ done = false;
+  // The operation will not survive serialization, so track it in case
+  // it is interrupted by deserialization.
+  var handle = new Interpreter.HostHandle(Interpreter.HostHandle.Kind.OPERATION,
+      thread, description, state.scope.perms, thread.timeLimit);
+  this.hostHandles_.add(handle);
+
+  /**
+   * Throw an internal error if previously invoked or if the thread
+   * does not appear to be in a plausible state.
+   */
+  var check = function() {
+    if (done) {
+      throw new Error('Async resolved or rejected more than once??');
+    }
+    done = true;
+    intrp.hostHandles_.delete(handle);
+    if (thread.status !== Interpreter.Thread.Status.BLOCKED ||
+        thread.stateStack_[thread.stateStack_.length - 1] !== state) {
+      throw new Error('Thread state corrupt at async resolve/reject??');
+    }
+  };
+
+  var intrp = this;
+  return {
+    resolve: function resolve(value) {
+      check();
+      state.value = value;
+      thread.status = Interpreter.Thread.Status.READY;
+      intrp.go_();
+    },
+    reject: function reject(value, perms) {
+      check();
+      thread.status = Interpreter.Thread.Status.READY;
+      intrp.throw_(thread, value, perms);
+      intrp.go_();
+    }
+  };
+};
+
+/**
+ * Levels at which entries in each category are written to the server
+ * log (see .log); 'info' for those not listed.
+ * @const {!Object<string, string>}
+ */
+Interpreter.LOG_LEVELS = {
+  'slow': 'warn', 'taint': 'warn', 'unhandled': 'warn',
+};
+
+/**
+ * Log something to the server log (see Logging.server), in which the
+ * category is the subsystem.
+ * @param {string} category About what topic is this log?
+ * @param {...*} var_args Format string and arguments, as for
+ *     console.log.
+ */
+Interpreter.prototype.log = function(category, var_args) {
+  this.logAt_(category, Interpreter.LOG_LEVELS[category] || 'info',
+              util.format.apply(util, Array.prototype.slice.call(arguments,
+                                                                 1)));
+};
+
+/**
+ * Log something to the server log at a given level, unless its category
+ * is excluded by the noLog option.
+ * @private
+ * @param {string} category About what topic is this log?
+ * @param {string} level The entry's level.
+ * @param {string} message The message.
+ * @param {!Object<string, *>=} fields Key/value fields, if any.
+ */
+Interpreter.prototype.logAt_ = function(category, level, message, fields) {
+  if (this.options.noLog && this.options.noLog.includes(category)) {
+    return;
+  }
+  Logging.server.log(category, level, message, fields);
+};
+
+/**
+ * Write an entry to an owner's log channel (see logging.js), subject
+ * to the channel's level and, for owners other than root, the "log"
+ * rate limit.  Entries to the server log are logged in category
+ * 'user'.
+ * @param {!Interpreter.Owner} owner Owner whose channel to write to.
+ * @param {string} level The entry's level.
+ * @param {string} message The message.
+ * @param {!Object<string, *>=} fields Key/value fields, if any.
+ * @return {boolean} True iff the entry was written.
+ */
+Interpreter.prototype.writeLog = function(owner, level, message, fields) {
+  var channel = this.logChannels_.get(owner) || Logging.defaultChannel();
+  if (!Logging.enabled(channel, level)) return false;
+  if (owner !== this.ROOT && this.rateLimiter_.record('log', owner)) {
+    channel.suppressed++;
+    this.logChannels_.set(owner, channel);
+    return false;
+  }
+  var name = this.ownerName_(owner);
+  var entries = [];
+  if (channel.suppressed) {
+    entries.push({level: 'warn', message: 'Log rate limit exceeded',
+                  fields: {'suppressed': channel.suppressed}});
+    channel.suppressed = 0;
+  }
+  entries.push({level: level, message: message, fields: fields});
+  var obj = /** @type {?Interpreter.prototype.Object} */(channel.connection);
+  var socket = obj && obj.socket && obj.socket.resource;
+  if (socket instanceof http.ServerResponse && socket.writableEnded) {
+    socket = null;
+  }
+  for (var i = 0, entry; (entry = entries[i]); i++) {
+    if (channel.server) {
+      this.logAt_('user', entry.level, name + ': ' + entry.message,
+                  entry.fields);
+    }
+    if (socket) {
+      var line = Logging.format(entry.level, name, entry.message,
+                                entry.fields);
+      socket.write(line + '\n');
+      this.noteExternalEffect_('connectionWrite', socket,
+                               {'length': line.length + 1});
+    }
+  }
+  return true;
+};
+
+/**
+ * Get the name of an owner, for logs: 'root', or the value of its own
+ * name property (if a string).
+ * @private
+ * @param {!Interpreter.Owner} owner The owner.
+ * @return {string}
+ */
+Interpreter.prototype.ownerName_ = function(owner) {
+  if (owner === this.ROOT) return 'root';
+  var pd = owner.getOwnPropertyDescriptor('name', this.ROOT);
+  return (pd && typeof pd.value === 'string') ? pd.value : 'anonymous';
+};
+
+/**
+ * Record a privileged operation in the admin log, if there is one (see
+ * .adminLog).  Failure to record it is logged, but not thrown: the
+ * operation has already been done.
+ * @param {!Interpreter.Owner} perms Whose perms it was done with.
+ * @param {string} action What kind of operation it was (e.g., 'chown').
+ * @param {!Object} details Its details (which must be JSONable).
+ * @return {boolean} True iff it was recorded.
+ */
+Interpreter.prototype.recordPrivileged = function(perms, action, details) {
+  if (!this.adminLog) return false;
+  try {
+    this.adminLog(this.ownerName_(perms), action, details);
+  } catch (e) {
+    this.log('admin', 'Unable to record %s in admin log: %s', action, e);
+    return false;
+  }
+  return true;
+};
+
+/**
+ * Report an external effect to this.onExternalEffect, if set.
+ * @private
+ * @param {string} type Kind of effect (e.g., 'connectionWrite').
+ * @param {?net.Socket} socket Connection affected, if any.
+ * @param {!Object} details Further details of the effect.
+ */
+Interpreter.prototype.noteExternalEffect_ = function(type, socket, details) {
+  if (!this.onExternalEffect) return;
+  var effect = {'type': type, 'time': Date.now()};
+  if (socket instanceof http.ServerResponse) socket = socket.socket;
+  if (socket) {
+    effect['remote'] = socket.remoteAddress + ':' + socket.remotePort;
+  }
+  for (var key in details) {
+    effect[key] = details[key];
+  }
+  this.onExternalEffect(effect);
+};
+
+/**
+ * Check whether CC.fetch may make requests to a host, according to
+ * Interpreter.Options.fetchDeny and .fetchAllow.  Each entry in those
+ * lists is a domain name, matching that domain and its subdomains, or
+ * '*', matching any host.  A host matching any entry in fetchDeny is
+ * not permitted; otherwise, if fetchAllow is given, it must match some
+ * entry in it.
+ * @private
+ * @param {string} hostname The hostname (or IP address) of the host.
+ * @return {boolean} True iff requests to the host are permitted.
+ */
+Interpreter.prototype.fetchPermitted_ = function(hostname) {
+  hostname = hostname.toLowerCase().replace(/\.$/, '');
+  var matches = function(domain) {
+    domain = String(domain).toLowerCase();
+    return domain === '*' || hostname === domain ||
+        hostname.endsWith('.' + domain);
+  };
+  if (this.options.fetchDeny && this.options.fetchDeny.some(matches)) {
+    return false;
+  }
+  return !this.options.fetchAllow || this.options.fetchAllow.some(matches);
+};
+
+/**
+ * Enforce a per-owner rate limit: check whether fewer than limit
+ * events have been recorded for owner in the last period ms and, if
+ * so, record another.
+ * @private
+ * @param {!Map<?Interpreter.Owner, !Array<number>>} times Times (as
+ *     from Date.now()) of recent events, by owner.
+ * @param {?Interpreter.Owner} owner The owner.
+ * @param {number} limit Maximum number of events per period.
+ * @param {number} period The period (in ms).
+ * @return {boolean} True iff the event is permitted (and recorded).
+ */
+Interpreter.prototype.checkRate_ = function(times, owner, limit, period) {
+  var now = Date.now();
+  var recent = (times.get(owner) || []).filter(function(t) {
+    return t > now - period;
+  });
+  var permitted = recent.length < limit;
+  if (permitted) recent.push(now);
+  if (recent.length) {
+    times.set(owner, recent);
+  } else {
+    times.delete(owner);
+  }
+  return permitted;
+};
+
+/**
+ * Check whether an address is that of a trusted proxy (see
+ * Interpreter.Options.trustedProxies), whose word can be taken as to
+ * the addresses of the clients it connects on behalf of.
+ * @private
+ * @param {string|undefined} address The address.
+ * @return {boolean} True iff trusted.
+ */
+Interpreter.prototype.isTrustedProxy_ = function(address) {
+  var proxies = this.options.trustedProxies || [];
+  return address !== undefined && proxies.some(function(network) {
+    return Bans.contains(network, address);
+  });
+};
+
+/**
+ * Implement CC.rateLimit, CC.rateLimitCheck and CC.rateLimitReset:
+ * record an event against key for the named policy, check whether key
+ * is locked out, or forget its events.  The key may be an object
+ * connected to a client, in which case the client's address is used
+ * (so that, e.g., failed logins count against the same address as the
+ * connection attempts and commands limited by Servers), or else any
+ * other object (e.g., a user) or a string.
+ * @private
+ * @param {string} method 'record', 'check' or 'reset'.
+ * @param {?Interpreter.Value} name The policy's name.
+ * @param {?Interpreter.Value} key The key.
+ * @param {?Interpreter.Owner} perms The caller's permissions.
+ * @return {number|undefined} For 'record' and 'check', 0 if key is not
+ *     (now) locked out; otherwise the time, in ms, until it will be.
+ */
+Interpreter.prototype.rateLimit_ = function(method, name, key, perms) {
+  if (perms !== this.ROOT) {
+    throw this.permissionDenied_(perms,
+        'only root may use rate limits');
+  } else if (typeof name !== 'string') {
+    throw new this.Error(perms, this.TYPE_ERROR,
+        'policy name must be a string');
+  }
+  if (key instanceof this.Object) {
+    var socket = key.socket && key.socket.resource;
+    if (socket instanceof http.ServerResponse) socket = socket.socket;
+    if (socket && socket.remoteAddress) key = socket.remoteAddress;
+  } else if (typeof key !== 'string') {
+    throw new this.Error(perms, this.TYPE_ERROR,
+        'key must be a string or an object');
+  }
+  try {
+    if (method === 'record') {
+      return this.rateLimiter_.record(name, key);
+    } else if (method === 'check') {
+      return this.rateLimiter_.check(name, key);
+    }
+    this.rateLimiter_.reset(name, key);
+  } catch (e) {
+    throw new this.Error(perms, this.RANGE_ERROR, String(e.message));
+  }
+};
+
+/**
+ * Ban a network: refuse connections (and requests via trusted proxies)
+ * from clients within it.  Replaces any existing ban of the same
+ * network.
+ * @param {string} network The network (in CIDR notation, or a single
+ *     address).
+ * @param {string} reason Why (for logs, and admins).
+ * @param {?number} expires When the ban expires (as from Date.now()),
+ *     or null if never.
+ * @return {string} The network, in canonical form.
+ * @throws {TypeError} If network is not a valid network.
+ */
+Interpreter.prototype.ban = function(network, reason, expires) {
+  network = Bans.canonicalize(network);
+  Bans.remove(this.bans_, network);
+  this.bans_.push(
+      {network: network, reason: reason, created: Date.now(),
+       expires: expires});
+  this.log('net', 'Banned %s: %s', network, reason);
+  return network;
+};
+
+/**
+ * Remove the ban (if any) of a network.
+ * @param {string} network The network.
+ * @return {boolean} True iff it was banned.
+ * @throws {TypeError} If network is not a valid network.
+ */
+Interpreter.prototype.unban = function(network) {
+  network = Bans.canonicalize(network);
+  if (!Bans.remove(this.bans_, network)) return false;
+  this.log('net', 'Unbanned %s', network);
+  return true;
+};
+
+/**
+ * List the bans in force.
+ * @return {!Array<!Bans.Ban>} A copy of the (unexpired) bans.
+ */
+Interpreter.prototype.getBans = function() {
+  Bans.prune(this.bans_);
+  return this.bans_.map(function(ban) {
+    return Object.assign({}, ban);
+  });
+};
+
+/**
+ * Create a password account.
+ * @param {string} name The account's name.
+ * @param {string} password The account's password.
+ * @return {!Promise<void>} Resolves once the account has been created.
+ *     Rejects with a TypeError if the password is unacceptable (see
+ *     Accounts.checkPassword), or an Error if the account exists.
+ */
+Interpreter.prototype.createAccount = function(name, password) {
+  var intrp = this;
+  return new Promise(function(resolve) {
+    Accounts.checkPassword(password);
+    if (intrp.accounts_.has(name)) throw new Error('account already exists');
+    resolve(Accounts.hash(password, intrp.passwordHashCost_()));
+  }).then(function(hash) {
+    // Check again, in case it was created while hashing.
+    if (intrp.accounts_.has(name)) throw new Error('account already exists');
+    var now = Date.now();
+    intrp.accounts_.set(name,
+        {hash: hash, created: now, updated: now, reset: null, totp: null,
+         recovery: []});
+    intrp.log('net', 'Created account %s', name);
+  });
+};
+
+/**
+ * Verify an account's password.  If it was hashed with an older
+ * algorithm or weaker parameters than are now used, it is rehashed.
+ * @param {string} name The account's name.
+ * @param {*} password The password presented.
+ * @return {!Promise<boolean>} Resolves true iff the account exists, does
+ *     not need resetting, and the password matches.
+ */
+Interpreter.prototype.verifyAccount = function(name, password) {
+  var account = this.accounts_.get(name);
+  if (!account || !account.hash || typeof password !== 'string' ||
+      password.length > Accounts.MAX_PASSWORD) {
+    this.loginFailed_(name, 'password');
+    return Promise.resolve(false);
+  }
+  var intrp = this;
+  var hash = account.hash;
+  var cost = this.passwordHashCost_();
+  return Accounts.verify(password, hash).then(function(ok) {
+    if (!ok) intrp.loginFailed_(name, 'password');
+    if (!ok || !Accounts.needsRehash(hash, cost)) return ok;
+    return Accounts.hash(password, cost).then(function(newHash) {
+      // Don't clobber a change made while hashing.
+      if (account.hash === hash) account.hash = newHash;
+      intrp.log('net', 'Rehashed password of account %s', name);
+      return true;
+    });
+  });
+};
+
+/**
+ * Set an account's password (cancelling any pending reset).
+ * @param {string} name The account's name.
+ * @param {string} password The new password.
+ * @return {!Promise<void>} Resolves once the password has been set.
+ *     Rejects with a TypeError if the password is unacceptable, or an
+ *     Error if the account does not exist.
+ */
+Interpreter.prototype.setAccountPassword = function(name, password) {
+  var intrp = this;
+  return new Promise(function(resolve) {
+    Accounts.checkPassword(password);
+    if (!intrp.accounts_.has(name)) throw new Error('no such account');
+    resolve(Accounts.hash(password, intrp.passwordHashCost_()));
+  }).then(function(hash) {
+    var account = intrp.accounts_.get(name);
+    if (!account) throw new Error('no such account');
+    account.hash = hash;
+    account.updated = Date.now();
+    account.reset = null;
+    intrp.log('net', 'Set password of account %s', name);
+  });
+};
+
+/**
+ * Force an account's password to be reset: the current password no
+ * longer works, and a new one can only be set with the returned token
+ * (or by setAccountPassword).
+ * @param {string} name The account's name.
+ * @param {number=} ttl How long (in ms) the token is valid for
+ *     (default Accounts.RESET_TTL).
+ * @return {string} The reset token (of which only a hash is kept).
+ * @throws {Error} If the account does not exist.
+ */
+Interpreter.prototype.requireAccountReset = function(name, ttl) {
+  var account = this.accounts_.get(name);
+  if (!account) throw new Error('no such account');
+  var token = Accounts.makeToken();
+  account.hash = null;
+  account.reset = {token: token.hash,
+                   expires: Date.now() + (ttl || Accounts.RESET_TTL)};
+  this.log('net', 'Required reset of account %s', name);
+  return token.token;
+};
+
+/**
+ * Reset an account's password using a token from requireAccountReset.
+ * @param {string} name The account's name.
+ * @param {*} token The token presented.
+ * @param {string} password The new password.
+ * @return {!Promise<boolean>} Resolves true iff the token was valid (and
+ *     the password has been set).  Rejects with a TypeError if the
+ *     password is unacceptable.
+ */
+Interpreter.prototype.resetAccountPassword = function(name, token,
+                                                      password) {
+  var intrp = this;
+  var account = this.accounts_.get(name);
+  return new Promise(function(resolve) {
+    Accounts.checkPassword(password);
+    if (!account || !Accounts.checkToken(account, token, Date.now())) {
+      resolve(null);
+      return;
+    }
+    var reset = account.reset;
+    resolve(Accounts.hash(password, intrp.passwordHashCost_()).then(
+        function(hash) {
+          // The token may have been used (or replaced) while hashing.
+          return (account.reset === reset) ? hash : null;
+        }));
+  }).then(function(hash) {
+    if (!hash) return false;
+    account.hash = hash;
+    account.updated = Date.now();
+    account.reset = null;
+    intrp.log('net', 'Reset password of account %s', name);
+    return true;
+  });
+};
+
+/**
+ * Delete an account.
+ * @param {string} name The account's name.
+ * @return {boolean} True iff it existed.
+ */
+Interpreter.prototype.deleteAccount = function(name) {
+  if (!this.accounts_.delete(name)) return false;
+  this.log('net', 'Deleted account %s', name);
+  return true;
+};
+
+/**
+ * Begin enrolling an account in TOTP two-factor authentication.  The
+ * second factor is not required until confirmed with confirmTotp (so
+ * that a user who fails to set up their authenticator app is not
+ * locked out).  Replaces any unconfirmed enrollment.
+ * @param {string} name The account's name.
+ * @param {string} issuer Name of the service, as shown in the app.
+ * @return {{secret: string, uri: string}} The secret (in base32, for
+ *     entering by hand) and an otpauth: URI (for display as a QR code).
+ * @throws {Error} If the account does not exist or is already enrolled.
+ */
+Interpreter.prototype.enrollTotp = function(name, issuer) {
+  var account = this.accounts_.get(name);
+  if (!account) throw new Error('no such account');
+  if (account.totp && account.totp.enabled) {
+    throw new Error('two-factor authentication already enabled');
+  }
+  var secret = Accounts.makeTotpSecret();
+  account.totp = {secret: secret, enabled: false, last: -1};
+  return {secret: secret, uri: Accounts.totpUri(secret, name, issuer)};
+};
+
+/**
+ * Complete TOTP enrollment of an account, given a code from the
+ * user's authenticator app.
+ * @param {string} name The account's name.
+ * @param {*} code The code presented.
+ * @return {?Array<string>} New recovery codes (of which only hashes
+ *     are kept), or null if the code is not valid.
+ * @throws {Error} If the account has no enrollment pending.
+ */
+Interpreter.prototype.confirmTotp = function(name, code) {
+  var account = this.accounts_.get(name);
+  if (!account || !account.totp || account.totp.enabled) {
+    throw new Error('no two-factor enrollment pending');
+  }
+  var counter = Accounts.checkTotp(account.totp, code, Date.now());
+  if (counter === -1) return null;
+  account.totp.enabled = true;
+  account.totp.last = counter;
+  var recovery = Accounts.makeRecoveryCodes();
+  account.recovery = recovery.hashes;
+  this.log('net', 'Enabled two-factor authentication for account %s', name);
+  return recovery.codes;
+};
+
+/**
+ * Remove an account's TOTP second factor and recovery codes.
+ * @param {string} name The account's name.
+ * @return {boolean} True iff it had one (enabled or pending).
+ */
+Interpreter.prototype.disableTotp = function(name) {
+  var account = this.accounts_.get(name);
+  if (!account || !account.totp) return false;
+  account.totp = null;
+  account.recovery = [];
+  this.log('net', 'Disabled two-factor authentication for account %s', name);
+  return true;
+};
+
+/**
+ * Verify the second factor of a login: a code from an account's
+ * authenticator app, or one of its recovery codes (which is then used
+ * up).  This does not check the password; callers must do that too
+ * (with verifyAccount).
+ * @param {string} name The account's name.
+ * @param {*} code The code presented.
+ * @return {boolean} True iff the account has two-factor authentication
+ *     enabled and the code is valid.
+ */
+Interpreter.prototype.verifyAccountCode = function(name, code) {
+  var account = this.accounts_.get(name);
+  if (!account || !account.totp || !account.totp.enabled) {
+    this.loginFailed_(name, 'code');
+    return false;
+  }
+  var counter = Accounts.checkTotp(account.totp, code, Date.now());
+  if (counter !== -1) {
+    account.totp.last = counter;
+    return true;
+  }
+  if (Accounts.useRecoveryCode(account, code)) {
+    this.log('net', 'Recovery code used for account %s (%d left)', name,
+             account.recovery.length);
+    return true;
+  }
+  this.loginFailed_(name, 'code');
+  return false;
+};
+
+/**
+ * Record a failed login as a security event.
+ * @private
+ * @param {string} name The name of the account.
+ * @param {string} factor What was wrong: 'password' or 'code'.
+ */
+Interpreter.prototype.loginFailed_ = function(name, factor) {
+  this.securityEvent_(Interpreter.SecurityEventType.LOGIN, null,
+                      {'account': name, 'factor': factor});
+};
+
+/**
+ * Replace an account's recovery codes with new ones.
+ * @param {string} name The account's name.
+ * @return {!Array<string>} The new codes.
+ * @throws {Error} If the account does not have two-factor
+ *     authentication enabled.
+ */
+Interpreter.prototype.regenerateRecoveryCodes = function(name) {
+  var account = this.accounts_.get(name);
+  if (!account || !account.totp || !account.totp.enabled) {
+    throw new Error('two-factor authentication not enabled');
+  }
+  var recovery = Accounts.makeRecoveryCodes();
+  account.recovery = recovery.hashes;
+  return recovery.codes;
+};
+
+/**
+ * Describe an account (without revealing its password hash).
+ * @param {string} name The account's name.
+ * @return {{created: number, updated: number, resetPending: boolean,
+ *     totp: boolean, recoveryCodes: number}|undefined} The account's
+ *     details (including whether it has two-factor authentication
+ *     enabled, and how many recovery codes it has left), or undefined
+ *     if it does not exist.
+ */
+Interpreter.prototype.getAccount = function(name) {
+  var account = this.accounts_.get(name);
+  if (!account) return undefined;
+  return {
+    created: account.created,
+    updated: account.updated,
+    resetPending: Boolean(account.reset) && account.reset.expires > Date.now(),
+    totp: Boolean(account.totp && account.totp.enabled),
+    recoveryCodes: account.recovery ? account.recovery.length : 0,
+  };
+};
+
+/**
+ * Get the cost with which to hash passwords.
+ * @private
+ * @return {number}
+ */
+Interpreter.prototype.passwordHashCost_ = function() {
+  return ('passwordHashCost' in this.options) ?
+      this.options.passwordHashCost : Accounts.COST;
+};
+
+/**
+ * Create a guest: a new object, owning itself, to act as the owner of
+ * an unauthenticated user's activities.  Guests may own only limited
+ * numbers of objects and threads (see Interpreter.GuestLimits), and
+ * may not make outbound requests or listen on ports.
+ * @param {?Interpreter.prototype.Object} proto The guest's prototype
+ *     (e.g., $.user).
+ * @param {?Interpreter.prototype.Object} connection The connection the
+ *     guest is for (to be closed if it exceeds its quota), or null.
+ * @return {!Interpreter.prototype.Object} The guest.
+ * @throws {Error} If guests are disabled (by the absence of
+ *     Interpreter.Options.guests).
+ * @throws {RangeError} If there are already too many guests.
+ */
+Interpreter.prototype.createGuest = function(proto, connection) {
+  var limits = this.options.guests;
+  if (!limits) throw new Error('guests are not enabled');
+  var maxGuests = ('maxGuests' in limits) ?
+      limits.maxGuests : Interpreter.GUEST_MAX_GUESTS;
+  if (this.guests_.size >= maxGuests) throw new RangeError('too many guests');
+  var guest = new this.Object(null, proto);
+  guest.owner = guest;
+  var record =
+      {connection: connection, created: Date.now(), objects: 0, over: false};
+  this.guests_.set(guest, record);
+  this.countGuestObject_(record, guest);
+  return guest;
+};
+
+/**
+ * Release a guest: kill its threads, and stop treating it as a guest.
+ * (Objects it owns are garbage collected as usual, once no longer
+ * referenced; in-world code should ensure they are not.)
+ * @param {!Interpreter.prototype.Object} guest The guest.
+ * @return {boolean} True iff it was a guest.
+ */
+Interpreter.prototype.releaseGuest = function(guest) {
+  if (!this.guests_.delete(guest)) return false;
+  this.killThreadsOf_(guest);
+  return true;
+};
+
+/**
+ * Is an owner a guest?
+ * @param {?Interpreter.Owner} owner The owner.
+ * @return {boolean}
+ */
+Interpreter.prototype.isGuest = function(owner) {
+  return this.guests_.has(/** @type {?} */(owner));
+};
+
+/**
+ * Get the permission tier of an owner (see tiers.js): wizard for root,
+ * player for guests (and null), else the tier assigned it (see
+ * CC.tierSet) or the default tier.
+ * @param {?Interpreter.Owner} owner The owner.
+ * @return {!Tiers.Tier}
+ */
+Interpreter.prototype.tierOf = function(owner) {
+  if (owner === this.ROOT) {
+    return Tiers.Tier.WIZARD;
+  } else if (owner === null || this.isGuest(owner)) {
+    return Tiers.Tier.PLAYER;
+  }
+  return this.tiers_.get(owner) || this.defaultTier_;
+};
+
+/**
+ * Check that an owner is of at least a given tier.
+ * @private
+ * @param {!Interpreter.Owner} perms The owner.
+ * @param {!Tiers.Tier} tier The tier required.
+ * @param {string} description What it is trying to do (e.g., 'eval
+ *     code').
+ * @throws {!Interpreter.prototype.Error} If it is not.
+ */
+Interpreter.prototype.checkTier_ = function(perms, tier, description) {
+  if (!Tiers.atLeast(this.tierOf(perms), tier)) {
+    throw this.permissionDenied_(perms,
+        'only ' + tier + 's may ' + description);
+  }
+};
+
+/**
+ * Get the limit of a given kind on the sizes of values an owner may
+ * create (see Interpreter.SizeLimits): that set for the owner with
+ * CC.sizeLimitsSet, if any, else that given by
+ * Interpreter.Options.sizeLimits, else the default.
+ * @private
+ * @param {?Interpreter.Owner} owner The owner.
+ * @param {string} name The kind of limit (e.g., 'maxString').
+ * @return {number}
+ */
+Interpreter.prototype.sizeLimit_ = function(owner, name) {
+  var limits = owner && this.sizeLimits_.get(owner);
+  if (limits && limits[name] !== undefined) return limits[name];
+  limits = this.options.sizeLimits;
+  if (limits && limits[name] !== undefined) return limits[name];
+  return Interpreter.SIZE_LIMITS[name];
+};
+
+/**
+ * Check that a string created on behalf of an owner is no longer than
+ * the owner's limit.
+ * @private
+ * @param {string} str The string.
+ * @param {?Interpreter.Owner} perms The owner.
+ * @throws {!Interpreter.prototype.Error} If it is longer.
+ */
+Interpreter.prototype.checkStringSize_ = function(str, perms) {
+  this.checkStringLength_(str.length, perms);
+};
+
+/**
+ * Check that a string of a given length may be created on behalf of
+ * an owner, before creating it.
+ * @private
+ * @param {number} length The length of the string.
+ * @param {?Interpreter.Owner} perms The owner.
+ * @throws {!Interpreter.prototype.Error} If it would be too long.
+ */
+Interpreter.prototype.checkStringLength_ = function(length, perms) {
+  var max = this.sizeLimit_(perms, 'maxString');
+  if (length > max) {
+    throw this.quotaExceeded_(perms, 'maxString', max,
+        'String length exceeds the limit of ' + max);
+  }
+};
+
+/**
+ * Check that setting (or defining) a property of an object on behalf of
+ * an owner will not make the object larger than the owner's limits:
+ * neither lengthen an array beyond maxArray, nor add a property to an
+ * object which already has maxProperties.
+ * @private
+ * @param {!Interpreter.prototype.Object} obj The object.
+ * @param {string} key Key (name) of the property.
+ * @param {?Interpreter.Value} value Its new value.
+ * @param {!Interpreter.Owner} perms The owner.
+ * @throws {!Interpreter.prototype.Error} If it would.
+ */
+Interpreter.prototype.checkObjectSize_ = function(obj, key, value, perms) {
+  var props = obj.properties;
+  if (Array.isArray(props)) {
+    var length = 0;
+    if (key === 'length') {
+      if (typeof value === 'number' || typeof value === 'string') {
+        length = Number(value);
+      }
+    } else {
+      var index = Number(key) >>> 0;
+      if (String(index) === key && index !== 0xffffffff) length = index + 1;
+    }
+    var maxArray = this.sizeLimit_(perms, 'maxArray');
+    if (length > props.length && length > maxArray) {
+      throw this.quotaExceeded_(perms, 'maxArray', maxArray,
+          'Array length exceeds the limit of ' + maxArray);
+    }
+  }
+  if (Object.prototype.hasOwnProperty.call(props, key)) return;
+  var max = this.sizeLimit_(perms, 'maxProperties');
+  var count = this.propertyCounts_.get(obj);
+  if (count === undefined || count >= max) {
+    count = Object.getOwnPropertyNames(props).length;
+    if (count >= max) {
+      throw this.quotaExceeded_(perms, 'maxProperties', max,
+          'Object already has the limit of ' + max + ' properties');
+    }
+  }
+  this.propertyCounts_.set(obj, count + 1);
+};
+
+/**
+ * Create a PermissionError to be thrown, recording the denial as a
+ * security event.
+ * @private
+ * @param {?Interpreter.Owner} perms The owner denied.
+ * @param {string} message The error's message.
+ * @param {!Interpreter.SecurityEventType=} type The type of event to
+ *     record (default: PERMISSION).
+ * @return {!Interpreter.prototype.Error}
+ */
+Interpreter.prototype.permissionDenied_ = function(perms, message, type) {
+  this.securityEvent_(type || Interpreter.SecurityEventType.PERMISSION,
+                      perms, {'message': message});
+  return new this.Error(perms, this.PERM_ERROR, message);
+};
+
+/**
+ * Create a RangeError to be thrown when an owner exceeds a quota,
+ * recording it as a security event.
+ * @private
+ * @param {?Interpreter.Owner} perms The owner.
+ * @param {string} quota Which quota (e.g., 'maxString').
+ * @param {number} limit The quota's limit.
+ * @param {string} message The error's message.
+ * @return {!Interpreter.prototype.Error}
+ */
+Interpreter.prototype.quotaExceeded_ = function(perms, quota, limit,
+                                                message) {
+  this.securityEvent_(Interpreter.SecurityEventType.QUOTA, perms,
+                      {'quota': quota, 'limit': limit});
+  return new this.Error(perms, this.RANGE_ERROR, message);
+};
+
+/**
+ * Create the error thrown on an attempt to use a destroyed object.
+ * @private
+ * @param {?Interpreter.Owner} perms Who is trying to use it.
+ * @return {!Interpreter.prototype.Error}
+ */
+Interpreter.prototype.destroyedError_ = function(perms) {
+  return new this.Error(perms, this.TYPE_ERROR, 'Object has been destroyed');
+};
+
+/**
+ * Get the global scope for code in a scope: that of the sandbox to
+ * which it is confined, if any, else the interpreter's.
+ * @private
+ * @param {!Interpreter.Scope} scope The scope.
+ * @return {!Interpreter.Scope}
+ */
+Interpreter.prototype.globalScopeOf_ = function(scope) {
+  return scope.sandbox ? scope.sandbox.scope : this.global;
+};
+
+/**
+ * May code in a sandbox call a function?  It may call those it was
+ * allowed to, those created within it, and bound versions of either.
+ * @private
+ * @param {!Interpreter.Sandbox} sandbox The sandbox.
+ * @param {?Interpreter.Value} func The function.
+ * @return {boolean}
+ */
+Interpreter.prototype.sandboxAllows_ = function(sandbox, func) {
+  while (func instanceof this.BoundFunction) {
+    if (sandbox.allowed.has(func)) return true;
+    func = func.boundFunc;
+  }
+  return sandbox.allowed.has(/** @type {?} */(func)) ||
+      (func instanceof this.UserFunction && func.scope.sandbox === sandbox);
+};
+
+/**
+ * Check that code in a scope may call a function (see
+ * .sandboxAllows_).
+ * @private
+ * @param {!Interpreter.Scope} scope The calling scope.
+ * @param {!Interpreter.prototype.Function} func The function.
+ * @throws {!Interpreter.prototype.Error} If it may not.
+ */
+Interpreter.prototype.checkSandbox_ = function(scope, func) {
+  if (scope.sandbox && !this.sandboxAllows_(scope.sandbox, func)) {
+    throw this.permissionDenied_(scope.perms,
+        'function is not available in this sandbox',
+        Interpreter.SecurityEventType.SANDBOX);
+  }
+};
+
+/**
+ * Get a property of an object, for code in a scope: functions which
+ * code confined to a sandbox may not call are hidden from it (read as
+ * undefined), so that it cannot pass them to functions it may call.
+ * @private
+ * @param {!Interpreter.Scope} scope The scope.
+ * @param {?Interpreter.Value} base The object (or primitive).
+ * @param {string} key The property's key.
+ * @return {?Interpreter.Value} The property's value.
+ */
+Interpreter.prototype.getProperty_ = function(scope, base, key) {
+  var value = this.toObject(base, scope.perms).get(key, scope.perms);
+  if (scope.sandbox && value instanceof this.Function &&
+      !this.sandboxAllows_(scope.sandbox, value)) {
+    return undefined;
+  }
+  return value;
+};
+
+/**
+ * Destroy an object: thenceforth any attempt to access its properties
+ * or prototype, or to call it, throws.  Unless it is given a grace
+ * period, during which it is kept in the recycle bin (and can be
+ * restored with .restoreObject), it is purged at once.
+ * @param {!Interpreter.prototype.Object} obj The object.
+ * @param {number=} grace Grace period, in ms.  (Default: none.)
+ */
+Interpreter.prototype.destroyObject = function(obj, grace) {
+  if (this.dirtyObjects) this.dirtyObjects.add(obj);
+  obj.destroyed = true;
+  if (grace) {
+    this.recycleBin_.set(obj, Date.now() + grace);
+  } else {
+    this.purgeObject_(obj);
+  }
+};
+
+/**
+ * Restore a destroyed object from the recycle bin.
+ * @param {!Interpreter.prototype.Object} obj The object.
+ * @return {boolean} True iff it was in the recycle bin.
+ */
+Interpreter.prototype.restoreObject = function(obj) {
+  if (!this.recycleBin_.delete(obj)) return false;
+  if (this.dirtyObjects) this.dirtyObjects.add(obj);
+  obj.destroyed = false;
+  return true;
+};
+
+/**
+ * Purge the objects in the recycle bin whose grace periods have
+ * expired (or, if all is true, every one).
+ * @param {boolean=} all Purge them all?
+ * @return {number} How many were purged.
+ */
+Interpreter.prototype.emptyRecycleBin = function(all) {
+  var now = Date.now();
+  var count = 0;
+  this.recycleBin_.forEach(function(expires, obj) {
+    if (all || expires <= now) {
+      this.recycleBin_.delete(obj);
+      this.purgeObject_(obj);
+      count++;
+    }
+  }, this);
+  return count;
+};
+
+/**
+ * Release the storage of a destroyed object: delete all its (deletable)
+ * properties, and its prototype, so that nothing need be kept alive
+ * by it.  (Objects inheriting from it thenceforth inherit nothing from
+ * it.)
+ * @private
+ * @param {!Interpreter.prototype.Object} obj The object.
+ */
+Interpreter.prototype.purgeObject_ = function(obj) {
+  if (this.dirtyObjects) this.dirtyObjects.add(obj);
+  var properties = obj.properties;
+  Object.getOwnPropertyNames(properties).forEach(function(key) {
+    Reflect.deleteProperty(properties, key);
+  });
+  if (Reflect.setPrototypeOf(properties, null)) obj.proto = null;
+};
+
+/**
+ * Check that an owner may create another thread.
+ * @private
+ * @param {!Interpreter.Owner} owner The owner.
+ * @throws {!Interpreter.prototype.Error} If it is a guest, and already
+ *     has as many threads as it may, or has been cut off.
+ */
+Interpreter.prototype.checkGuestThreads_ = function(owner) {
+  var guest = this.guests_.get(/** @type {?} */(owner));
+  if (!guest) return;
+  var limits = this.options.guests || {};
+  var maxThreads = ('maxThreads' in limits) ?
+      limits.maxThreads : Interpreter.GUEST_MAX_THREADS;
+  var count = 0;
+  // .threads_ will be very sparse, so use for-in loop.
+  for (var i in this.threads_) {
+    var thread = this.threads_[i];
+    if (thread.status !== Interpreter.Thread.Status.ZOMBIE &&
+        thread.wrapper && thread.wrapper.owner === owner) {
+      count++;
+    }
+  }
+  if (guest.over || count >= maxThreads) {
+    throw this.quotaExceeded_(owner, 'guestMaxThreads', maxThreads,
+        'guests may not own more than ' + maxThreads + ' threads');
+  }
+};
+
+/**
+ * Note the creation of an object owned by a guest, and cut the guest
+ * off if it now owns too many.  (Called from the Object constructor,
+ * so must not throw.)
+ * @private
+ * @param {!Interpreter.Guest_} guest The guest's record.
+ * @param {!Interpreter.prototype.Object} obj The object.
+ */
+Interpreter.prototype.countGuestObject_ = function(guest, obj) {
+  guest.objects++;
+  this.guestObjects_.register(obj, guest);
+  var limits = this.options.guests || {};
+  var maxObjects = ('maxObjects' in limits) ?
+      limits.maxObjects : Interpreter.GUEST_MAX_OBJECTS;
+  if (guest.over || guest.objects <= maxObjects) return;
+  guest.over = true;
+  var owner = /** @type {!Interpreter.prototype.Object} */(obj.owner);
+  this.log('net', 'Guest exceeded quota of %d objects', maxObjects);
+  this.securityEvent_(Interpreter.SecurityEventType.QUOTA, owner,
+                      {'quota': 'guestMaxObjects', 'limit': maxObjects});
+  this.killThreadsOf_(owner);
+  var socket = guest.connection && guest.connection.socket &&
+      guest.connection.socket.resource;
+  if (socket) socket.end();
+};
+
+/**
+ * Kill all the threads owned by a given owner.
+ * @private
+ * @param {!Interpreter.prototype.Object} owner The owner.
+ */
+Interpreter.prototype.killThreadsOf_ = function(owner) {
+  // .threads_ will be very sparse, so use for-in loop.
+  for (var i in this.threads_) {
+    var thread = this.threads_[i];
+    if (thread.wrapper && thread.wrapper.owner === owner) {
+      this.killThread(thread.id);
+    }
+  }
+};
+
+/**
+ * List the threads that have not yet finished.
+ * @return {!Array<!Interpreter.Thread>}
+ */
+Interpreter.prototype.getThreads = function() {
+  var threads = [];
+  // .threads_ will be very sparse, so use for-in loop.
+  for (var i in this.threads_) {
+    var thread = this.threads_[i];
+    if (thread.status !== Interpreter.Thread.Status.ZOMBIE) {
+      threads.push(thread);
+    }
+  }
+  return threads;
+};
+
+/**
+ * List the ports listened on (by CC.connectionListen), and whether
+ * each is actually listening (it may not be if, e.g., re-listening at
+ * startup failed).
+ * @return {!Array<{port: number, protocol: string, listening: boolean}>}
+ */
+Interpreter.prototype.getListeners = function() {
+  var listeners = [];
+  for (var port in this.listeners_) {
+    var server = this.listeners_[Number(port)];
+    listeners.push({
+      port: server.port,
+      protocol: server.protocol,
+      listening: server.server_.listening,
+    });
+  }
+  return listeners;
+};
+
+/**
+ * List the file descriptors of the sockets of the ports listened on
+ * (by CC.connectionListen) that are actually listening: e.g., to hand
+ * them over to a successor process (see Activation).
+ * @return {!Map<number, number>} The file descriptors, by port.
+ */
+Interpreter.prototype.getListeningFds = function() {
+  var fds = new Map();
+  for (var port in this.listeners_) {
+    var server = this.listeners_[Number(port)].server_;
+    // The handle is not part of net.Server's public API, but its fd is
+    // the only way to get at the socket.
+    var handle = server.listening && server['_handle'];
+    if (handle && handle['fd'] >= 0) fds.set(Number(port), handle['fd']);
+  }
+  return fds;
+};
+
+/**
+ * Traffic on a port listened on: connections accepted, connections
+ * still open, and bytes read and written (as counted by the transport,
+ * so including protocol overheads such as TLS and WebSocket framing).
+ * @typedef {{port: number,
+ *            accepted: number,
+ *            open: number,
+ *            bytesRead: number,
+ *            bytesWritten: number}}
+ */
+Interpreter.Traffic;
+
+/**
+ * Traffic on a port: as Interpreter.Traffic, except that bytesRead and
+ * bytesWritten count only connections that have closed.
+ * @private
+ * @typedef {{accepted: number,
+ *            sockets: !Set<!net.Socket>,
+ *            bytesRead: number,
+ *            bytesWritten: number}}
+ */
+Interpreter.TrafficRecord_;
+
+/**
+ * Count a connection accepted on a port listened on, and (once it
+ * closes) the bytes read and written on it.
+ * @private
+ * @param {number} port The port.
+ * @param {!net.Socket} socket The connection.
+ */
+Interpreter.prototype.countTraffic_ = function(port, socket) {
+  var record = this.traffic_.get(port);
+  if (!record) {
+    record = {accepted: 0, sockets: new Set(), bytesRead: 0, bytesWritten: 0};
+    this.traffic_.set(port, record);
+  }
+  record.accepted++;
+  record.sockets.add(socket);
+  socket.on('close', function() {
+    record.sockets.delete(socket);
+    record.bytesRead += socket.bytesRead;
+    record.bytesWritten += socket.bytesWritten;
+  });
+};
+
+/**
+ * Report the traffic on each port listened on since the interpreter
+ * was created (including ports no longer listened on).
+ * @return {!Array<!Interpreter.Traffic>}
+ */
+Interpreter.prototype.getTraffic = function() {
+  var traffic = [];
+  this.traffic_.forEach(function(record, port) {
+    var entry = {
+      port: port,
+      accepted: record.accepted,
+      open: record.sockets.size,
+      bytesRead: record.bytesRead,
+      bytesWritten: record.bytesWritten,
+    };
+    record.sockets.forEach(function(socket) {
+      entry.bytesRead += socket.bytesRead;
+      entry.bytesWritten += socket.bytesWritten;
+    });
+    traffic.push(entry);
+  });
+  return traffic;
+};
+
+/**
+ * Close every open connection accepted on a port listened on: e.g.,
+ * once the interpreter has been stopped for good, so that clients are
+ * not left waiting for a reply that will never come.
+ */
+Interpreter.prototype.closeConnections = function() {
+  this.traffic_.forEach(function(record) {
+    record.sockets.forEach(function(socket) {
+      socket.end();
+    });
+  });
+};
+
+/**
+ * Kill a thread.
+ * @param {number} id The thread's ID.
+ * @return {boolean} True iff there was such a thread, which had not yet
+ *     finished.
+ */
+Interpreter.prototype.killThread = function(id) {
+  var thread = this.threads_[id];
+  if (!thread || thread.status === Interpreter.Thread.Status.ZOMBIE) {
+    return false;
+  }
+  thread.status = Interpreter.Thread.Status.ZOMBIE;
+  return true;
+};
+
+/**
+ * A breakpoint: a statement, in the body of a user function, at which
+ * threads are to be paused.  Since the statement is identified by its
+ * AST node, the breakpoint applies to every function created from the
+ * same function expression or declaration.
+ * @typedef {{id: number,
+ *            func: !Interpreter.prototype.UserFunction,
+ *            line: number,
+ *            node: !Node,
+ *            hits: number}}
+ */
+Interpreter.Breakpoint;
+
+/**
+ * A frame on the call stack of a paused thread, for the debugger: as
+ * from Thread.prototype.callers, plus the innermost scope in which the
+ * frame's code is executing.
+ * @typedef {{frame: !FrameInfo, scope: !Interpreter.Scope}}
+ */
+Interpreter.DebugFrame;
+
+/**
+ * Set a breakpoint on the first statement that begins on a given line
+ * of a function.  Threads are paused just before executing it.
+ * @param {!Interpreter.prototype.Function} func The function.
+ * @param {number=} line Line number, counting from the line on which
+ *     the function's source begins (default: that of its first
+ *     statement).
+ * @return {!Interpreter.Breakpoint} The new breakpoint.
+ */
+Interpreter.prototype.setBreakpoint = function(func, line) {
+  if (!(func instanceof this.UserFunction)) {
+    throw new TypeError('Breakpoints can only be set in user functions');
+  } else if (line !== undefined &&
+      (typeof line !== 'number' || !Number.isInteger(line) || line < 1)) {
+    throw new RangeError('line must be a positive integer');
+  }
+  var body = func.node['body'];
+  var lineOf = function(node) {
+    return body['source'].lineColForPos(node['start']).line;
+  };
+  var statements = Interpreter.breakableStatements_(body);
+  var node = (line === undefined) ? statements[0] :
+      statements.find(function(statement) {
+        return lineOf(statement) === line;
+      });
+  if (!node) {
+    throw new RangeError((line === undefined) ? 'Function has no statements' :
+                         'No statement begins on line ' + line);
+  }
+  var breakpoint = {
+    id: this.nextBreakpointId_++,
+    func: func,
+    line: lineOf(node),
+    node: node,
+    hits: 0,
+  };
+  this.breakpoints_.set(breakpoint.id, breakpoint);
+  return breakpoint;
+};
+
+/**
+ * Remove a breakpoint.
+ * @param {number} id The breakpoint's ID.
+ * @return {boolean} True iff there was such a breakpoint.
+ */
+Interpreter.prototype.clearBreakpoint = function(id) {
+  return this.breakpoints_.delete(id);
+};
+
+/**
+ * List the breakpoints, in the order they were set.
+ * @return {!Array<!Interpreter.Breakpoint>}
+ */
+Interpreter.prototype.getBreakpoints = function() {
+  return Array.from(this.breakpoints_.values());
+};
+
+/**
+ * A watchpoint: a property of an object, writes to which (by
+ * assignment, definition or deletion) are to be reported.  If it has a
+ * handler, it is called (in a new thread, with root perms) with the
+ * object, key, old value, new value and the writing Thread (or null,
+ * if not written by in-world code); if not, the writing thread is
+ * paused before its next statement.
+ * @typedef {{id: number,
+ *            object: !Interpreter.prototype.Object,
+ *            key: string,
+ *            handler: ?Interpreter.prototype.Function,
+ *            hits: number}}
+ */
+Interpreter.Watchpoint;
+
+/**
+ * Set a watchpoint on a property of an object.
+ * @param {!Interpreter.prototype.Object} obj The object.
+ * @param {string} key The property's key.
+ * @param {?Interpreter.prototype.Function=} handler Function to call
+ *     with each write (default: pause the writing thread instead).
+ * @return {!Interpreter.Watchpoint} The new watchpoint.
+ */
+Interpreter.prototype.setWatchpoint = function(obj, key, handler) {
+  if (!(obj instanceof this.Object)) {
+    throw new TypeError('Watchpoints can only be set on objects');
+  } else if (handler !== undefined && handler !== null &&
+             !(handler instanceof this.Function)) {
+    throw new TypeError('handler must be a function or null');
+  }
+  var watchpoint = {
+    id: this.nextWatchpointId_++,
+    object: obj,
+    key: String(key),
+    handler: handler || null,
+    hits: 0,
+  };
+  this.watchpoints_.set(watchpoint.id, watchpoint);
+  return watchpoint;
+};
+
+/**
+ * Remove a watchpoint.
+ * @param {number} id The watchpoint's ID.
+ * @return {boolean} True iff there was such a watchpoint.
+ */
+Interpreter.prototype.clearWatchpoint = function(id) {
+  return this.watchpoints_.delete(id);
+};
+
+/**
+ * List the watchpoints, in the order they were set.
+ * @return {!Array<!Interpreter.Watchpoint>}
+ */
+Interpreter.prototype.getWatchpoints = function() {
+  return Array.from(this.watchpoints_.values());
+};
+
+/**
+ * Report a write to a property to any watchpoints on it.  Called by
+ * the mutating methods of Object (once the write has succeeded)
+ * whenever any watchpoints are set.  Writes made by debug handler
+ * threads (including watchpoint handlers) are ignored, lest a handler
+ * trigger itself.
+ * @private
+ * @param {!Interpreter.prototype.Object} obj The object written to.
+ * @param {string} key The key of the property written.
+ * @param {?Interpreter.Value} oldValue The property's previous value.
+ * @param {?Interpreter.Value} newValue The property's new value.
+ */
+Interpreter.prototype.watch_ = function(obj, key, oldValue, newValue) {
+  var thread = this.thread_;
+  if (thread && thread.isDebugHandler) return;
+  var intrp = this;
+  this.watchpoints_.forEach(function(watchpoint) {
+    if (watchpoint.object !== obj || watchpoint.key !== key) return;
+    watchpoint.hits++;
+    if (watchpoint.handler) {
+      var handlerThread = intrp.createThreadForFuncCall(intrp.ROOT,
+          watchpoint.handler, undefined,
+          [obj, key, oldValue, newValue, thread ? thread.wrapper : null]);
+      handlerThread.thread.isDebugHandler = true;
+    } else if (thread && thread.status !== Interpreter.Thread.Status.PAUSED) {
+      thread.step = {mode: 'watchpoint', depth: 0};
+    }
+  });
+};
+
+/**
+ * Ask for a thread to be paused, just before the next statement it
+ * executes.  (A sleeping or blocked thread will not pause until it
+ * wakes.)
+ * @param {number} id The thread's ID.
+ * @return {boolean} True iff there was such a thread, which had not yet
+ *     finished.
+ */
+Interpreter.prototype.pauseThread = function(id) {
+  var thread = this.threads_[id];
+  if (!thread || thread.status === Interpreter.Thread.Status.ZOMBIE) {
+    return false;
+  }
+  if (thread.status !== Interpreter.Thread.Status.PAUSED) {
+    thread.step = {mode: 'pause', depth: 0};
+  }
+  return true;
+};
+
+/**
+ * Resume a paused thread.
+ * @param {number} id The thread's ID.
+ * @param {string} mode How far to let it run: 'continue' (until it hits
+ *     a breakpoint) or, to step, 'into', 'over' or 'out' (see
+ *     Interpreter.Step).
+ */
+Interpreter.prototype.resumeThread = function(id, mode) {
+  var thread = this.getPausedThread_(id);
+  if (!['continue', 'into', 'over', 'out'].includes(mode)) {
+    throw new TypeError('mode must be "continue", "into", "over" or "out"');
+  }
+  thread.step = (mode === 'continue') ? null :
+      {mode: mode, depth: Interpreter.frameDepth_(thread.stateStack_)};
+  thread.status = Interpreter.Thread.Status.READY;
+  this.go_();
+};
+
+/**
+ * List the frames on a paused thread's call stack, innermost first.
+ * @param {number} id The thread's ID.
+ * @return {!Array<!Interpreter.DebugFrame>} The frames.
+ */
+Interpreter.prototype.getFrames = function(id) {
+  var thread = this.getPausedThread_(id);
+  var stack = thread.stateStack_;
+  var callers = thread.callers(this.ROOT);
+  var frames = [];
+  // The innermost scope of each frame is that of the topmost state
+  // below the next frame up (whose Call state is in the caller's scope).
+  var top = stack.length - 1;
+  for (var i = stack.length - 1; i >= 0; i--) {
+    if (!stack[i].frame()) continue;
+    frames.push({frame: callers[frames.length], scope: stack[top].scope});
+    top = i;
+  }
+  return frames;
+};
+
+/**
+ * Evaluate code in a new thread, as if by a direct eval in a frame of a
+ * paused thread (and so with the same permissions, and access to its
+ * variables).
+ * @param {number} id The paused thread's ID.
+ * @param {number} index Index of the frame (0 being the innermost).
+ * @param {string} src The code.
+ * @return {!Interpreter.prototype.Thread} The new thread.  Its value
+ *     (see Interpreter.Thread.prototype.onExit) will be that of the
+ *     code's last expression statement.
+ */
+Interpreter.prototype.evalInFrame = function(id, index, src) {
+  var frame = this.getFrames(id)[index];
+  if (!frame) throw new RangeError('No frame ' + index);
+  var ast = this.compile_(src);
+  var scope = new Interpreter.Scope(
+      Interpreter.Scope.Type.EVAL, frame.scope.perms, frame.scope);
+  this.populateScope_(ast, scope);
+  return this.createThread(
+      frame.scope.perms, new Interpreter.State(ast, scope));
+};
+
+/**
+ * Get a thread that has been paused by the debugger.
+ * @private
+ * @param {number} id The thread's ID.
+ * @return {!Interpreter.Thread} The thread.
+ */
+Interpreter.prototype.getPausedThread_ = function(id) {
+  var thread = this.threads_[id];
+  if (!thread || thread.status !== Interpreter.Thread.Status.PAUSED) {
+    throw new Error('Thread ' + id + ' is not paused');
+  }
+  return thread;
+};
+
+/**
+ * Check whether a thread should be paused, having just pushed a new
+ * state: if it is about to execute a statement that has a breakpoint,
+ * or it is being stepped and has gone as far as it should.
+ * @private
+ * @param {!Interpreter.Thread} thread The current thread.
+ * @param {!Array<!Interpreter.State>} stack The current thread's state stack.
+ * @param {!Interpreter.State} state The state just pushed.
+ */
+Interpreter.prototype.checkBreak_ = function(thread, stack, state) {
+  var node = state.node;
+  if (thread.isDebugHandler || !Interpreter.isBreakable_(node)) return;
+  var reason;
+  this.breakpoints_.forEach(function(breakpoint) {
+    if (breakpoint.node === node) {
+      breakpoint.hits++;
+      reason = 'breakpoint';
+    }
+  });
+  var step = thread.step;
+  if (!reason && step) {
+    if (step.mode === 'pause' || step.mode === 'watchpoint') {
+      reason = step.mode;
+    } else if (step.mode === 'into') {
+      reason = 'step';
+    } else {
+      var depth = Interpreter.frameDepth_(stack);
+      if (depth < step.depth ||
+          (step.mode === 'over' && depth === step.depth)) {
+        reason = 'step';
+      }
+    }
+  }
+  if (!reason) return;
+  thread.step = null;
+  thread.status = Interpreter.Thread.Status.PAUSED;
+  if (this.onThreadPaused) this.onThreadPaused(thread, reason);
+  if (this.debugHandler_ && thread.wrapper) {
+    var handlerThread = this.createThreadForFuncCall(this.ROOT,
+        this.debugHandler_, undefined, [thread.wrapper, reason]);
+    handlerThread.thread.isDebugHandler = true;
+  }
+};
+
+/**
+ * Can a thread be paused just before executing the given node?  Only
+ * statements are breakable, other than blocks (which contain
+ * statements that are) and function declarations (which are not
+ * executed where they appear).
+ * @private
+ * @param {!Node} node The node.
+ * @return {boolean} True iff the node is breakable.
+ */
+Interpreter.isBreakable_ = function(node) {
+  var type = node['type'];
+  return /(?:Statement|Declaration)$/.test(type) &&
+      type !== 'BlockStatement' && type !== 'FunctionDeclaration';
+};
+
+/**
+ * List the breakable statements in a function's body (but not in any
+ * functions nested within it), in the order they appear.
+ * @private
+ * @param {!Node} body The body (a BlockStatement).
+ * @return {!Array<!Node>} The statements.
+ */
+Interpreter.breakableStatements_ = function(body) {
+  var statements = [];
+  (function find(node) {
+    if (Interpreter.isBreakable_(node)) statements.push(node);
+    for (var name in node) {
+      var prop = node[name];
+      var children = Array.isArray(prop) ? prop : [prop];
+      for (var i = 0; i < children.length; i++) {
+        var child = children[i];
+        if (child instanceof Node && child['type'] !== 'FunctionExpression' &&
+            child['type'] !== 'FunctionDeclaration') {
+          find(child);
+        }
+      }
+    }
+  })(body);
+  return statements.sort(function(a, b) {return a['start'] - b['start'];});
+};
+
+/**
+ * Count the frames on a thread's call stack.
+ * @private
+ * @param {!Array<!Interpreter.State>} stack The thread's state stack.
+ * @return {number} The number of frames.
+ */
+Interpreter.frameDepth_ = function(stack) {
+  var depth = 0;
+  for (var i = 0; i < stack.length; i++) {
+    var type = stack[i].node['type'];
+    if (type === 'Call' || type === 'Program' || type === 'EvalProgram_') {
+      depth++;
+    }
+  }
+  return depth;
+};
+
+/**
+ * Maximum number of records kept in the audit log (see .audit); older
+ * ones are discarded.
+ * @const {number}
+ */
+Interpreter.AUDIT_LOG_SIZE = 10000;
+
+/**
+ * A record of an access to an audited property: when, what kind of
+ * access ('get', 'set', 'define' or 'delete'), to which property of
+ * which object, by whom (the owner whose perms were used), and on which
+ * thread (null if not by in-world code) with what call stack.
+ * @typedef {{time: number,
+ *            access: string,
+ *            object: !Interpreter.prototype.Object,
+ *            key: string,
+ *            perms: !Interpreter.Owner,
+ *            thread: ?number,
+ *            callers: !Array<!FrameInfo>}}
+ */
+Interpreter.AuditRecord;
+
+/**
+ * Start auditing accesses to a property of an object (or to all its
+ * properties): each read, write, definition and deletion made through
+ * the object is recorded in the audit log (see .getAuditLog).  Reads
+ * of an inherited property are recorded only if the inheriting object
+ * is itself audited.
+ * @param {!Interpreter.prototype.Object} obj The object.
+ * @param {string=} key The property's key (default: all properties).
+ */
+Interpreter.prototype.audit = function(obj, key) {
+  var keys = this.audits_.get(obj);
+  if (key === undefined) {
+    this.audits_.set(obj, null);
+  } else if (keys) {
+    keys.add(key);
+  } else if (keys === undefined) {
+    this.audits_.set(obj, new Set([key]));
+  }
+};
+
+/**
+ * Stop auditing accesses to a property of an object (or to all its
+ * properties).  Records already in the audit log are kept.
+ * @param {!Interpreter.prototype.Object} obj The object.
+ * @param {string=} key The property's key (default: all properties,
+ *     whether audited individually or as a whole).
+ * @return {boolean} True iff it was being audited.
+ */
+Interpreter.prototype.unaudit = function(obj, key) {
+  var keys = this.audits_.get(obj);
+  if (keys === undefined) {
+    return false;
+  } else if (key === undefined) {
+    return this.audits_.delete(obj);
+  } else if (!keys || !keys.delete(key)) {
+    return false;  // An individual property of a wholly audited object.
+  }
+  if (!keys.size) this.audits_.delete(obj);
+  return true;
+};
+
+/**
+ * List what is being audited.
+ * @return {!Array<{object: !Interpreter.prototype.Object,
+ *                  keys: ?Array<string>}>} The audited objects, in the
+ *     order they were first audited, each with its audited keys (or
+ *     null if all its properties are).
+ */
+Interpreter.prototype.getAudits = function() {
+  var audits = [];
+  this.watchpoints_.forEach(function(watchpoint) {
+    var name = 'watchpoint ' + watchpoint.id;
+    roots.push({name: name + ' object', value: watchpoint.object},
+               {name: name + ' handler', value: watchpoint.handler});
+  });
+  this.audits_.forEach(function(keys, obj) {
+    audits.push({object: obj, keys: keys && Array.from(keys)});
+  });
+  return audits;
+};
+
+/**
+ * Get records from the audit log, oldest first.
+ * @param {?Interpreter.prototype.Object=} obj Only get records of
+ *     accesses to this object (default: of all objects).
+ * @param {string=} key Only get records of accesses to this property
+ *     (default: of all properties).
+ * @return {!Array<!Interpreter.AuditRecord>} The records.
+ */
+Interpreter.prototype.getAuditLog = function(obj, key) {
+  return this.auditLog_.filter(function(record) {
+    return (!obj || record.object === obj) &&
+        (key === undefined || record.key === key);
+  });
+};
+
+/**
+ * Discard all records from the audit log.
+ */
+Interpreter.prototype.clearAuditLog = function() {
+  this.auditLog_.length = 0;
+};
+
+/**
+ * Record an access to a property, if it is audited.  Called by the
+ * property access methods of Object whenever anything is being audited.
+ * @private
+ * @param {!Interpreter.prototype.Object} obj The object accessed.
+ * @param {string} key The key of the property accessed.
+ * @param {string} access The kind of access.
+ * @param {!Interpreter.Owner} perms Who is accessing it?
+ */
+Interpreter.prototype.audit_ = function(obj, key, access, perms) {
+  var keys = this.audits_.get(obj);
+  if (keys === undefined || (keys && !keys.has(key))) return;
+  var thread = this.thread_;
+  this.auditLog_.push({
+    time: this.now(),
+    access: access,
+    object: obj,
+    key: key,
+    perms: perms,
+    thread: thread && thread.id,
+    callers: thread ? thread.callers(this.ROOT) : [],
+  });
+  if (this.auditLog_.length > Interpreter.AUDIT_LOG_SIZE) {
+    this.auditLog_.shift();
+  }
+};
+
+/**
+ * Maximum number of events kept in the security log (see
+ * .getSecurityEvents); older ones are discarded.
+ * @const {number}
+ */
+Interpreter.SECURITY_LOG_SIZE = 10000;
+
+/**
+ * Types of security event.
+ * @enum {string}
+ */
+Interpreter.SecurityEventType = {
+  /** A PermissionError was thrown (details: message). */
+  PERMISSION: 'permission',
+  /** A quota or limit was exceeded (details: quota, limit or address). */
+  QUOTA: 'quota',
+  /** A password or code did not verify (details: account, factor). */
+  LOGIN: 'login',
+  /** Code in a sandbox called a function not allowed it (details:
+   *  message). */
+  SANDBOX: 'sandbox',
+  /** A thread's perms were changed with setPerms (details: to). */
+  SET_PERMS: 'setPerms',
+  /** A tainted string reached a sensitive sink (details: sink). */
+  TAINT: 'taint',
+};
+
+/**
+ * A security event: its ID (counting from 1), when it happened, its
+ * type, the owner whose perms were in use (null if none, e.g. for a
+ * failed login or a connection refused), the thread it happened on
+ * (null if not in in-world code), and details depending on its type
+ * (see Interpreter.SecurityEventType), which are JSON-compatible.
+ * @typedef {{id: number,
+ *            time: number,
+ *            type: !Interpreter.SecurityEventType,
+ *            perms: ?Interpreter.Owner,
+ *            thread: ?number,
+ *            details: !Object<string, (string|number)>}}
+ */
+Interpreter.SecurityEvent;
+
+/**
+ * Record a security event in the security log, for consumption by
+ * in-world monitoring code (see CC.securityEvents) and the admin API.
+ * Must not throw.
+ * @private
+ * @param {!Interpreter.SecurityEventType} type The event's type.
+ * @param {?Interpreter.Owner} perms The owner whose perms were in use.
+ * @param {!Object<string, (string|number)>} details Its details.
+ */
+Interpreter.prototype.securityEvent_ = function(type, perms, details) {
+  var thread = this.thread_;
+  this.securityLog_.push({
+    id: this.nextSecurityEventId_++,
+    time: this.now(),
+    type: type,
+    perms: perms,
+    thread: thread ? thread.id : null,
+    details: details,
+  });
+  if (this.securityLog_.length > Interpreter.SECURITY_LOG_SIZE) {
+    this.securityLog_.shift();
+  }
+};
 
 /**
- * The ToUint32 function from ES6 §7.1.6.  The abstract operation
- * ToUint32 converts argument to one of 2**32 integer values in the
- * range 0 through 2**32−1, inclusive.
- * @param {?Interpreter.Value} value
- * @return {number} A non-negative integer less than 2**32.
+ * Get events from the security log, oldest first.
+ * @param {number=} after Only get events with IDs greater than this
+ *     (e.g., the last one already seen; default: all).
+ * @param {!Interpreter.SecurityEventType=} type Only get events of
+ *     this type (default: all types).
+ * @return {!Array<!Interpreter.SecurityEvent>} The events.
  */
-Interpreter.toUint32 = function toUint32(value) {
-  return Interpreter.toInteger(value) >>> 0;
+Interpreter.prototype.getSecurityEvents = function(after, type) {
+  return this.securityLog_.filter(function(event) {
+    return (after === undefined || event.id > after) &&
+        (type === undefined || event.type === type);
+  });
 };
 
 /**
- * The ToLength function from ES6 §7.1.15.  Note that this does NOT
- * enforce the actual array length limit of 2**32-1, but deals with
- * lengths up to 2**53-1, which is correct for the polymorphic
- * Array.prototype methods.
- * @param {?Interpreter.Value} value
- * @return {number} A non-negative integer less than 2**53.
+ * Maximum total length of the strings marked tainted at once; the
+ * oldest marked are forgotten (i.e., become untainted) once it is
+ * exceeded.
+ * @const {number}
  */
-Interpreter.toLength = function toLength(value) {
-  var len = Interpreter.toInteger(value);
-  if (len <= 0) return 0;
-  return Math.min(len, Number.MAX_SAFE_INTEGER);  // Handles len === Infinity.
-};
+Interpreter.TAINT_MAX_LENGTH = 16 * 1024 * 1024;
 
 /**
- * Create a new native function.  Function will be owned by root.
- * @param {string} id ID to register new function in builtins registry.
- * @param {!Function} nativeFunc Any JavaScript function.
- * @param {boolean} legalConstructor True if the function can be used as a
- *     constructor (e.g. Array), false if not (e.g. escape).
- * @return {!Interpreter.prototype.Function} New function.
-*/
-Interpreter.prototype.createNativeFunction = function(
-    id, nativeFunc, legalConstructor) {
-  if (nativeFunc instanceof this.Object) {
-    throw new TypeError('createNativeFunction passed non-native function??');
+ * Mark a string as tainted: as having originated from network input
+ * (or from in-world code calling CC.taint).  Does nothing unless taint
+ * tracking is enabled (see Interpreter.Options.taint).
+ *
+ * Strings are primitive values, so taint is tracked by value: any
+ * string equal to a tainted one is tainted, wherever it came from.
+ * Taint propagates to the result of concatenating a tainted string
+ * (with + or +=), and to strings returned by builtins given a tainted
+ * string as this or as an argument (e.g., .slice and .toLowerCase),
+ * but not to strings found inside objects (e.g., from JSON.parse).
+ * @param {string} str The string.
+ * @return {string} The same string.
+ */
+Interpreter.prototype.taint = function(str) {
+  if (!this.options.taint || !str || this.tainted_.has(str)) return str;
+  this.tainted_.add(str);
+  this.taintedLength_ += str.length;
+  while (this.taintedLength_ > Interpreter.TAINT_MAX_LENGTH &&
+         this.tainted_.size > 1) {
+    var oldest = this.tainted_.values().next().value;
+    this.tainted_.delete(oldest);
+    this.taintedLength_ -= oldest.length;
   }
-  // Make sure impl function has an id for serialization.
-  if (!nativeFunc.id) nativeFunc.id = id;
-  return new this.OldNativeFunction(nativeFunc, legalConstructor, {id: id});
+  return str;
 };
 
 /**
- * Converts from a native JS object or value to a JS interpreter
- * object.  Can handle JSON-style values plus regexps and errors (of
- * all standard native types), and handles additional properties on
- * arrays, regexps and errors (just as for plain objects).  Ignores
- * prototype and inherited properties.  Efficiently handles
- * sparse arrays.  Does NOT handle cyclic structures.
- * @param {*} nativeObj The native JS object to be converted.
- * @return {?Interpreter.Value} The equivalent JS interpreter object.
- * @param {!Interpreter.Owner} owner Owner for new object.
+ * Clear the taint of a string (e.g., once in-world code has validated
+ * it).
+ * @param {string} str The string.
+ * @return {string} The same string.
  */
-Interpreter.prototype.nativeToPseudo = function(nativeObj, owner) {
-  if ((typeof nativeObj !== 'object' && typeof nativeObj !== 'function') ||
-      nativeObj === null) {
-    // It's a primitive; just return it.
-    return /** @type {boolean|number|string|undefined|null} */ (nativeObj);
-  } else if (nativeObj instanceof this.Object) {
-    throw new TypeError('nativeToPseudo called on a pseudo-object??');
-  }
+Interpreter.prototype.untaint = function(str) {
+  if (this.tainted_.delete(str)) this.taintedLength_ -= str.length;
+  return str;
+};
 
-  var pseudoObj;
-  switch (Object.prototype.toString.apply(nativeObj)) {
-    case '[object Array]':
-      pseudoObj = new this.Array(owner);
-      break;
-    case '[object RegExp]':
-      pseudoObj = new this.RegExp(/** @type {!RegExp} */(nativeObj), owner);
-      break;
-    case '[object Error]':
-      var proto;
-      if (nativeObj instanceof EvalError) {
-        proto = this.EVAL_ERROR;
-      } else if (nativeObj instanceof RangeError) {
-        proto = this.RANGE_ERROR;
-      } else if (nativeObj instanceof ReferenceError) {
-        proto = this.REFERENCE_ERROR;
-      } else if (nativeObj instanceof SyntaxError) {
-        proto = this.SYNTAX_ERROR;
-      } else if (nativeObj instanceof TypeError) {
-        proto = this.TYPE_ERROR;
-      } else if (nativeObj instanceof URIError) {
-        proto = this.URI_ERROR;
-      } else {
-        proto = this.ERROR;
-      }
-      pseudoObj = new this.Error(owner, proto);
-      break;
-    default:
-      pseudoObj = new this.Object(owner);
-  }
+/**
+ * Is a value a tainted string?
+ * @param {*} value The value.
+ * @return {boolean} True iff it is.
+ */
+Interpreter.prototype.isTainted = function(value) {
+  return typeof value === 'string' && this.tainted_.has(value);
+};
 
-  // Cast to satisfy type-checker; it might be a lie: nativeObj could
-  // be an object (i.e., non-primitive) but not an Object (i.e.,
-  // inherits from Object.prototype).  Fortunately we don't care.
-  var keys = Object.getOwnPropertyNames(/** @type {!Object} */(nativeObj));
-  for (var i = 0; i < keys.length; i++) {
-    var key = keys[i];
-    var desc = Object.getOwnPropertyDescriptor(nativeObj, key);
-    var pd = new Descriptor(desc.writable, desc.enumerable, desc.configurable);
-    pd.value = this.nativeToPseudo(desc.value, owner);
-    pseudoObj.defineProperty(key, pd, owner);
+/**
+ * Check a value passed to a sensitive sink (such as eval or CC.fetch):
+ * if it is a tainted string, record a security event, then warn in the
+ * server log, or (if Interpreter.Options.taint is 'error') throw.
+ * @private
+ * @param {*} value The value.
+ * @param {!Interpreter.Owner} perms Who is passing it.
+ * @param {string} sink The sink (e.g., 'eval').
+ * @throws {!Interpreter.prototype.Error} If the value is tainted and
+ *     taint is an error.
+ */
+Interpreter.prototype.checkTaint_ = function(value, perms, sink) {
+  if (!this.options.taint || !this.isTainted(value)) return;
+  this.securityEvent_(Interpreter.SecurityEventType.TAINT, perms,
+                      {'sink': sink});
+  if (this.options.taint === 'error') {
+    throw new this.Error(perms, this.PERM_ERROR,
+        'tainted string passed to ' + sink);
   }
-  return pseudoObj;
+  this.log('taint', 'Tainted string passed to %s as %s', sink,
+           this.ownerName_(perms));
 };
 
 /**
- * Converts from a JS interpreter object to native JS object.
- * Can handle JSON-style values, plus cycles.
- *
- * TODO(cpcallen): Audit this to ensure that it can safely accept any
- * user object (especially because it is used by our implementations
- * of JSON.stringify, String.prototype.localeCompare, etc.)
- *
- * TODO(cpcallen:perms): Audit all callers of this to ensure that they
- * do not allow circumvention of access control.
- * @param {?Interpreter.Value} pseudoObj The JS interpreter object to
- *     be converted.
- * @param {!Object=} cycles Cycle detection (used only in recursive calls).
- * @return {*} The equivalent native JS object or value.
+ * Default number of steps executed between samples taken by the
+ * profiler.
+ * @const {number}
  */
-Interpreter.prototype.pseudoToNative = function(pseudoObj, cycles) {
-  // BUG(cpcallen:perms): Kludge.  Incorrect except when doing .step
-  // or run.  Should be an argument instead, forcing caller to decide.
-  try {
-    var perms = this.thread_.perms();
-  } catch (e) {
-    perms = this.ROOT;
-  }
-  if (typeof pseudoObj === 'boolean' ||
-      typeof pseudoObj === 'number' ||
-      typeof pseudoObj === 'string' ||
-      pseudoObj === null || pseudoObj === undefined) {
-    // It's a primitive; just return it.
-    return pseudoObj;
-  } else if (!(pseudoObj instanceof this.Object)) {
-    throw new TypeError('pseudoToObject called on wrong type??');
-  } else if (pseudoObj instanceof this.RegExp) {  // Regular expression.
-    return pseudoObj.regexp;
-  } else if (pseudoObj instanceof this.Function) {  // Function.
-    return undefined;
-  }
+Interpreter.PROFILE_INTERVAL = 1000;
 
-  if (!cycles) {
-    cycles = {pseudo: [], native: []};
-  }
-  var i = cycles.pseudo.indexOf(pseudoObj);
-  if (i !== -1) {
-    return cycles.native[i];
-  }
-  cycles.pseudo[cycles.pseudo.length] = pseudoObj;
-  var nativeObj = pseudoObj instanceof this.Array ? [] : {};
-  cycles.native[cycles.native.length] = nativeObj;
-  var keys = pseudoObj.ownKeys(perms);
-  for (i = 0; i < keys.length; i++) {
-    var key = keys[i];
-    var pd = pseudoObj.getOwnPropertyDescriptor(key, perms);
-    Object.defineProperty(nativeObj, key, {
-      writable: pd.writable,
-      enumerable: pd.enumerable,
-      configurable: pd.configurable,
-      value: this.pseudoToNative(pd.value, cycles)
-    });
+/**
+ * Maximum number of samples in a profile.  Once it is reached, no more
+ * are taken.
+ * @const {number}
+ */
+Interpreter.PROFILE_MAX_SAMPLES = 100000;
+
+/**
+ * A CPU profile, recorded by sampling the call stack of the running
+ * thread every so many steps (so that the number of samples in which
+ * a function appears measures the steps executed in it, rather than
+ * elapsed time).  Times are as from .uptime.
+ * @typedef {{interval: number,
+ *            countdown: number,
+ *            startTime: number,
+ *            endTime: number,
+ *            samples: !Array<!Interpreter.Sample>}}
+ */
+Interpreter.Profile;
+
+/**
+ * A sample of a call stack: the time it was taken, and its frames,
+ * outermost first, each being the function called or (for a program
+ * or eval) the source being executed.
+ * @typedef {{time: number,
+ *            stack: !Array<!Interpreter.prototype.Function|
+ *                          !Interpreter.Source>}}
+ */
+Interpreter.Sample;
+
+/**
+ * Start recording a CPU profile (discarding any being recorded).
+ * @param {number=} interval Number of steps between samples (default:
+ *     Interpreter.PROFILE_INTERVAL).
+ */
+Interpreter.prototype.startProfiling = function(interval) {
+  interval = (interval === undefined) ? Interpreter.PROFILE_INTERVAL :
+      interval;
+  if (typeof interval !== 'number' || !Number.isInteger(interval) ||
+      interval < 1) {
+    throw new RangeError('interval must be a positive integer');
   }
-  cycles.pseudo.pop();
-  cycles.native.pop();
-  return nativeObj;
+  this.profile_ = {
+    interval: interval,
+    countdown: interval,
+    startTime: this.uptime(),
+    endTime: NaN,
+    samples: [],
+  };
 };
 
 /**
- * CreateArrayFromList from ES6 §7.3.16
- *
- * Converts from a native array to an Interpreter.prototype.Array.
- * Does NOT recursively convert the type of the array's contents.
- * @param {!Array<?Interpreter.Value>} elements The native array to be
- *     converted.
- * @param {!Interpreter.Owner} owner Owner for new object.
- * @return {!Interpreter.prototype.Array} The equivalent interpreter array.
+ * Stop recording a CPU profile.
+ * @return {?Interpreter.Profile} The profile, or null if none was
+ *     being recorded.
  */
-Interpreter.prototype.createArrayFromList = function(elements, owner) {
-  if (!Array.isArray(elements) || (elements instanceof this.Object)) {
-    throw new TypeError('CreateArrayFromList called on wrong type??');
-  }
-  var array = new this.Array(owner);
-  for (var n = 0; n < elements.length; n++) {
-    array.defineProperty(
-        String(n), Descriptor.wec.withValue(elements[n]), owner);
-  }
-  return array;
+Interpreter.prototype.stopProfiling = function() {
+  var profile = this.profile_;
+  if (!profile) return null;
+  this.profile_ = null;
+  profile.endTime = this.uptime();
+  return profile;
 };
 
 /**
- * CreateListFromArrayLike from ES6 §7.3.17.
- *
- * This function converts from an Interpreter.prototype.Array (or
- * array-like I.p.Object) to a native array.  This is an evolution of
- * the algorithm from ES5.1 §15.3.4.3 (Function.prototype.apply).  It
- * does NOT recursively convert the type of the array's contents.
- *
- * TODO(ES6): Add elementTypes param and associated type checks.
- * @param {?Interpreter.Value} obj The interpreter array or array-like
- *     object to be converted.  Error thrown if non-object.
- * @param {!Interpreter.Owner} perms Who is trying convert it?
- * @return {!Array<?Interpreter.Value>} The equivalent native JS array.
+ * Add a sample of the running thread's call stack to the profile being
+ * recorded.
+ * @private
+ * @param {!Array<!Interpreter.State>} stack The thread's state stack.
  */
-Interpreter.prototype.createListFromArrayLike = function(obj, perms) {
-  if (!(obj instanceof this.Object)) {
-    throw new this.Error(perms, this.TYPE_ERROR,
-        'CreateListFromArrayLike called on non-object');
-  }
-  var len = Interpreter.toLength(obj.get('length', perms));
-  var list = [];
-  for (var i = 0; i < len; i++) {
-    list[i] = obj.get(String(i), perms);
+Interpreter.prototype.sample_ = function(stack) {
+  var profile = /** @type {!Interpreter.Profile} */(this.profile_);
+  profile.countdown = profile.interval;
+  if (profile.samples.length >= Interpreter.PROFILE_MAX_SAMPLES) return;
+  var frames = [];
+  for (var i = 0; i < stack.length; i++) {
+    var frame = stack[i].frame();
+    if (!frame) continue;
+    frames.push(frame.func || stack[i].node['source']);
   }
-  return list;
+  profile.samples.push({time: this.uptime(), stack: frames});
 };
 
 /**
- * Converts from a native Error to a JS interpreter Error.  Unlike
- * pseudoToNative, this fucntion only converts type and .message.
- * @param {!Error} err Native Error value to be converted.
- * @param {?Interpreter.Owner} owner Owner for new (pseudo) Error object.
- * @return {!Interpreter.prototype.Error}
+ * Statement coverage of a function: each of its statements (see
+ * .isBreakable_, but not including those of functions nested within
+ * it), in order, with the (1-based) line and column it begins on and
+ * the number of times it has been executed.
+ * @typedef {{func: !Interpreter.prototype.UserFunction,
+ *            statements: !Array<{line: number, col: number,
+ *                                hits: number}>}}
  */
-Interpreter.prototype.errorNativeToPseudo = function(err, owner) {
-  var proto;
-  if (err instanceof this.Object) {
-    throw new TypeError('errorNativeToPseudo called on wrong type??');
-  }
+Interpreter.FunctionCoverage;
 
-  if (err instanceof EvalError) {
-    proto = this.EVAL_ERROR;
-  } else if (err instanceof RangeError) {
-    proto = this.RANGE_ERROR;
-  } else if (err instanceof ReferenceError) {
-    proto = this.REFERENCE_ERROR;
-  } else if (err instanceof SyntaxError) {
-    proto = this.SYNTAX_ERROR;
-  } else if (err instanceof TypeError) {
-    proto = this.TYPE_ERROR;
-  } else if (err instanceof URIError) {
-    proto = this.URI_ERROR;
-  } else {
-    proto = this.ERROR;
-  }
-  return new this.Error(owner, proto, err.message);
+/**
+ * Start collecting statement coverage (discarding any previously
+ * collected).  Only code in user functions is covered, not top-level
+ * programs or evals.
+ */
+Interpreter.prototype.startCoverage = function() {
+  this.coverage_ = new Map();
+  this.collectingCoverage_ = true;
 };
 
 /**
- * Implements the ToObject specification method from ES5.1 §9.9 / ES6
- * §7.1.13, but returning temporary Box objects instead of boxed
- * Boolean, Number or String instances.
- * @param {?Interpreter.Value} value The value to be converted to an Object.
- * @param {!Interpreter.Owner} perms Who is trying convert it?
- * @return {!Interpreter.ObjectLike}
+ * Stop collecting statement coverage.  What has been collected remains
+ * available from .getCoverage, until coverage is next started.
  */
-Interpreter.prototype.toObject = function(value, perms) {
-  if (value === null || value === undefined) {
-    throw new this.Error(perms, this.TYPE_ERROR,
-        "Can't convert " + value + ' to Object');
-  } else if (typeof value === 'boolean' || typeof value === 'number' ||
-      typeof value === 'string') {
-    return new this.Box(value);
-  }
-  return value;
+Interpreter.prototype.stopCoverage = function() {
+  this.collectingCoverage_ = false;
+};
+
+/**
+ * Is statement coverage being collected?
+ * @return {boolean} True iff it is.
+ */
+Interpreter.prototype.isCollectingCoverage = function() {
+  return Boolean(this.collectingCoverage_);
 };
 
 /**
- * Retrieves a value from the scope chain.
- * @param {!Interpreter.Scope} scope Scope to read from.
- * @param {string} name Name of variable.
- * @return {?Interpreter.Value} Value (may be undefined).
+ * Get the statement coverage collected for the functions executed
+ * (optionally only those with a given owner).
+ * @param {!Interpreter.Owner=} owner Only report functions it owns.
+ * @return {!Array<!Interpreter.FunctionCoverage>} The coverage of each
+ *     function, in the order they were first executed.
  */
-Interpreter.prototype.getValueFromScope = function(scope, name) {
-  for (var s = scope; s; s = s.outerScope) {
-    if (name in s.vars) {
-      return s.vars[name];
+Interpreter.prototype.getCoverage = function(owner) {
+  var intrp = this;
+  var result = [];
+  if (!this.coverage_) return result;
+  this.coverage_.forEach(function(hits, func) {
+    if (owner === undefined || func.owner === owner) {
+      result.push(intrp.getFunctionCoverage(func));
     }
-  }
-  throw new this.Error(this.thread_.perms(), this.REFERENCE_ERROR,
-      name + ' is not defined');
+  });
+  return result;
 };
 
 /**
- * Sets a value to the current scope.
- * @param {!Interpreter.Scope} scope Scope to write to.
- * @param {string} name Name of variable.
- * @param {?Interpreter.Value} value Value.
+ * Get the statement coverage collected for a function (which need not
+ * have been executed).
+ * @param {!Interpreter.prototype.UserFunction} func The function.
+ * @return {!Interpreter.FunctionCoverage} Its coverage.
  */
-Interpreter.prototype.setValueToScope = function(scope, name, value) {
-  for (var s = scope; s; s = s.outerScope) {
-    if (name in s.vars) {
-      try {
-        s.vars[name] = value;
-      } catch (e) {  // Trying to set immutable binding.
-        // TODO(cpcallen:perms): we have a scope here, but scope.perms
-        // is probably not the right value for owner of new error.
-        throw new this.Error(this.thread_.perms(), this.TYPE_ERROR,
-            'Assignment to constant variable ' + name);
-      }
-      return;
-    }
-  }
-  throw new this.Error(this.thread_.perms(), this.REFERENCE_ERROR,
-      name + ' is not defined');
+Interpreter.prototype.getFunctionCoverage = function(func) {
+  var hits = (this.coverage_ && this.coverage_.get(func)) || new Map();
+  var body = func.node['body'];
+  var statements = Interpreter.breakableStatements_(body);
+  return {
+    func: func,
+    statements: statements.map(function(node) {
+      var lc = body['source'].lineColForPos(node['start']);
+      return {line: lc.line, col: lc.col, hits: hits.get(node) || 0};
+    }),
+  };
 };
 
 /**
- * Populate a scope with declarations from given node.
- * @param {!Node} node AST node (program or function).
- * @param {!Interpreter.Scope} scope Scope dictionary to populate.
- * @param {!Interpreter.Source=} source Original source code.  If not
- *     supplied, will use node['source'] instead.
+ * Record the execution of a statement for the coverage being collected
+ * (if it is a statement, in a user function).
  * @private
+ * @param {!Array<!Interpreter.State>} stack The thread's state stack.
+ * @param {!Interpreter.State} state The state just pushed.
  */
-Interpreter.prototype.populateScope_ = function(node, scope, source) {
-  if (!source) {
-    if (!node['source']) throw new Error('Source not found');
-    source = node['source'];
+Interpreter.prototype.cover_ = function(stack, state) {
+  var node = state.node;
+  if (!Interpreter.isBreakable_(node)) return;
+  // Find the innermost frame; statements of programs or evals are not
+  // covered.
+  for (var i = stack.length - 1; i >= 0; i--) {
+    var type = stack[i].node['type'];
+    if (type === 'Program' || type === 'EvalProgram_') return;
+    if (type === 'Call') break;
   }
-  // Obtain list of bound names for node.  We cache this on the AST
-  // node to save time when repeatedly calling the same function.
-  var boundNames = getBoundNames(node);
-  for (var name in boundNames) {
-    var boundValue = boundNames[name];
-    var value = boundValue ?
-        new this.UserFunction(boundValue, scope, source, scope.perms)
-        : undefined;
-    if (!scope.hasBinding(name)) scope.createMutableBinding(name, value);
-    if (value) this.setValueToScope(scope, name, value);
+  if (i < 0) return;
+  var func = stack[i].frame().func;
+  if (!(func instanceof this.UserFunction)) return;
+  var coverage = /** @type {!Map} */(this.coverage_);
+  var hits = coverage.get(func);
+  if (!hits) {
+    hits = new Map();
+    coverage.set(func, hits);
   }
+  hits.set(node, (hits.get(node) || 0) + 1);
 };
 
 /**
- * Is the current state directly being called with as a construction with 'new'.
- * @return {boolean} True if 'new foo()', false if 'foo()'.
+ * Default wall time (in ms) a task (i.e., a thread running until it
+ * finishes, blocks, sleeps or is paused) may take before being logged
+ * as slow.
+ * @const {number}
  */
-Interpreter.prototype.calledWithNew = function() {
-  return this.thread_.stateStack_[this.thread_.stateStack_.length - 1]
-      .info_.construct;
-};
+Interpreter.SLOW_TASK_TIME = 1000;
 
 /**
- * Implements IsUnresolvableReference from ES5 §8.7 / ES6 §6.2.3.
- * @param {!Interpreter.Scope} scope Current scope dictionary.
- * @param {!Array} ref Reference tuple.
- * @param {!Interpreter.Owner} perms Who is trying to get it?
- * @return {boolean} True iff refernece is unresolvable.
+ * Default number of steps a task may take before being logged as slow.
+ * @const {number}
  */
-Interpreter.prototype.isUnresolvableReference = function(scope, ref, perms) {
-  // Property references never unresolvable.
-  return ref[0] === null;
-};
+Interpreter.SLOW_TASK_STEPS = 10000000;
 
 /**
- * Gets the value of a referenced name from the scope or object referred to.
- * @param {!Array} ref Reference tuple.
- * @param {!Interpreter.Owner} perms Who is trying to get it?
- * @return {?Interpreter.Value} Value (may be undefined).
+ * Default time (in ms) by which the scheduler may run late before the
+ * pause is logged as long (e.g., because of a checkpoint, or garbage
+ * collection).
+ * @const {number}
  */
-Interpreter.prototype.getValue = function(ref, perms) {
-  var base = ref[0];
-  var name = ref[1];
-  if (base === null) {  // Unresolvable reference.
-    throw new this.Error(perms, this.REFERENCE_ERROR, name + ' is not defined');
-  } else if (base instanceof Interpreter.Scope) {  // An environment reference.
-    return base.get(name);
-  } else {  // A property reference.
-    return this.toObject(base, perms).get(name, perms);
+Interpreter.SLOW_PAUSE_TIME = 1000;
+
+/**
+ * Number of steps between samples of the stack of a running task.
+ * @const {number}
+ */
+Interpreter.SLOW_SAMPLE_INTERVAL = 100000;
+
+/**
+ * Maximum number of (the most recent) stack samples kept for a task.
+ * @const {number}
+ */
+Interpreter.SLOW_MAX_SAMPLES = 10;
+
+/**
+ * Maximum number of records kept in the slow log.  Once it is full,
+ * the oldest are discarded.
+ * @const {number}
+ */
+Interpreter.SLOW_LOG_SIZE = 1000;
+
+/**
+ * A record of a slow task or long scheduler pause: when (as from .now)
+ * it ended, its kind ('task' or 'pause'), how long it took (in ms),
+ * and, for tasks, the ID of the thread, the number of steps taken, and
+ * samples of its call stack (each as from Thread.prototype.callers,
+ * innermost frame first), oldest first.
+ * @typedef {{time: number,
+ *            kind: string,
+ *            duration: number,
+ *            thread: ?number,
+ *            steps: number,
+ *            samples: !Array<!Array<!FrameInfo>>}}
+ */
+Interpreter.SlowRecord;
+
+/**
+ * Get the most recent records of slow tasks and long scheduler pauses.
+ * @return {!Array<!Interpreter.SlowRecord>} The records, oldest first.
+ */
+Interpreter.prototype.getSlowLog = function() {
+  return this.slowLog_.slice();
+};
+
+/**
+ * Record and log a task, if it was slow.
+ * @private
+ * @param {!Interpreter.Thread} thread The thread.
+ * @param {number} duration How long it took (in ms).
+ * @param {number} steps How many steps it took.
+ * @param {!Array<!Array<!FrameInfo>>} samples Samples of its stack.
+ */
+Interpreter.prototype.checkSlowTask_ = function(thread, duration, steps,
+                                                samples) {
+  var maxTime = (this.options.slowTaskTime !== undefined) ?
+      this.options.slowTaskTime : Interpreter.SLOW_TASK_TIME;
+  var maxSteps = (this.options.slowTaskSteps !== undefined) ?
+      this.options.slowTaskSteps : Interpreter.SLOW_TASK_STEPS;
+  if (!(maxTime && duration >= maxTime) && !(maxSteps && steps >= maxSteps)) {
+    return;
   }
+  this.recordSlow_({time: this.now(), kind: 'task', duration: duration,
+                    thread: thread.id, steps: steps, samples: samples});
+  var lines = ['Slow task: thread ' + thread.id + ' ran for ' +
+               Math.round(duration) + ' ms (' + steps + ' steps)'];
+  samples.forEach(function(sample, i) {
+    lines.push('  Sample ' + (i + 1) + ':');
+    sample.forEach(function(frame) {
+      lines.push('    ' + Interpreter.formatFrame_(frame));
+    });
+  });
+  this.log('slow', lines.join('\n'));
 };
 
 /**
- * Sets value of a referenced name to the scope or object referred to.
- * @param {!Array} ref Reference tuple.
- * @param {?Interpreter.Value} value Value.
- * @param {!Interpreter.Owner} perms Who is trying to set it?
+ * Record and log a scheduler pause, if it was long.
+ * @private
+ * @param {number} duration How late the scheduler ran (in ms).
  */
-Interpreter.prototype.setValue = function(ref, value, perms) {
-  var base = ref[0];
-  var name = ref[1];
-  if (base === null) {  // Unresolvable reference.
-    throw new this.Error(perms, this.REFERENCE_ERROR, name + ' is not defined');
-  } else if (base instanceof Interpreter.Scope) {  // An environment reference.
-    var err = base.set(name, value);
-    if (err) {
-      throw this.errorNativeToPseudo(err, perms);
-    }
-  } else {  // A property reference.
-    this.toObject(ref[0], perms).set(name, value, perms);
-  }
+Interpreter.prototype.checkSlowPause_ = function(duration) {
+  var maxTime = (this.options.slowPauseTime !== undefined) ?
+      this.options.slowPauseTime : Interpreter.SLOW_PAUSE_TIME;
+  if (!maxTime || duration < maxTime) return;
+  this.recordSlow_({time: this.now(), kind: 'pause', duration: duration,
+                    thread: null, steps: 0, samples: []});
+  this.log('slow', 'Long pause: scheduler ran %d ms late',
+           Math.round(duration));
 };
 
 /**
- * Check to see if the current thread has run too long.  Called at the
- * top of loops and before making function calls.
+ * Add a record to the slow log, discarding the oldest if it is full.
  * @private
- * @param {!Interpreter.Owner} perms Perm to use to create Error object.
+ * @param {!Interpreter.SlowRecord} record The record.
  */
-Interpreter.prototype.checkTimeLimit_ = function(perms) {
-  if (this.threadTimeLimit_ && this.now() > this.threadTimeLimit_) {
-    throw new this.Error(perms, this.RANGE_ERROR, 'Thread ran too long');
+Interpreter.prototype.recordSlow_ = function(record) {
+  this.slowLog_.push(record);
+  if (this.slowLog_.length > Interpreter.SLOW_LOG_SIZE) {
+    this.slowLog_.shift();
   }
 };
 
+/**
+ * Format a stack frame for the server log.
+ * @private
+ * @param {!FrameInfo} frame The frame, as from Thread.prototype.callers.
+ * @return {string} The formatted frame.
+ */
+Interpreter.formatFrame_ = function(frame) {
+  var name;
+  if ('func' in frame) {
+    var pd = frame.func.getOwnPropertyDescriptor('name', frame.func.owner);
+    name = (pd && pd.value) ? String(pd.value) : 'anonymous function';
+  } else {
+    var src = String(('eval' in frame) ? frame.eval : frame.program);
+    name = JSON.stringify(src.length > 40 ? src.slice(0, 40) + '...' : src);
+  }
+  return ('line' in frame) ?
+      'at ' + name + ' ' + frame.line + ':' + frame.col : 'in ' + name;
+};
 
 /**
- * Carry out the mechanics of throwing an exception.
- *
- * This is intended only to be called from exception handlers in
- * .step() and .run(), and from async function's reject() callback.
- * Elsewhere, just throw.
- * @param {!Interpreter.Thread} thread in which throw is occurring.
- * @param {?Interpreter.Value} e Exception being thrown.
- * @param {!Interpreter.Owner} perms Perm to use to obtain (e.g.)
- *     function names, etc.
+ * A reference from one part of the heap to another (or, for a root,
+ * from the interpreter itself), with a name describing it (e.g., a
+ * property name, or '[[Prototype]]').  See Heap.
+ * @typedef {{name: string, value: *}}
  */
-Interpreter.prototype.throw_ = function(thread, e, perms) {
-  if (e instanceof this.Error) {
-    // Userland Error object thrown; make sure it has a .stack.
-    // BUG(cpcallen): this will set .stack on Error.prototype, etc.
-    e.makeStack(thread.callers(perms), perms);
-  } else if (e instanceof Error) {
-    // Uh oh.  This is an internal error in the interpreter.  Kill
-    // thread and rethrow.
-    thread.status = Interpreter.Thread.Status.ZOMBIE;
-    throw e;
-  } else if (!(e instanceof this.Object) && e !== null &&
-      (typeof e === 'object' || typeof e === 'function')) {
-    // WTF: not a native exception, not an interpreter object and not
-    // a primitive, but just some random (internal) object.
-    throw new TypeError('Unexpected exception value ' + String(e));
+Interpreter.Reference;
+
+/**
+ * List the roots of the heap: the references held by the interpreter
+ * itself (rather than by in-world objects, scopes or threads) that
+ * keep in-world objects alive.  Values may be of any type; those that
+ * are not objects, scopes or threads can be ignored.
+ * @return {!Array<!Interpreter.Reference>} The roots.
+ */
+Interpreter.prototype.getRoots = function() {
+  var roots = [{name: 'global', value: this.global}];
+  this.builtins.entries().forEach(function(entry) {
+    roots.push({name: 'builtin ' + entry[0], value: entry[1]});
+  });
+  this.getThreads().forEach(function(thread) {
+    roots.push({name: 'thread ' + thread.id, value: thread});
+  });
+  for (var port in this.listeners_) {
+    var server = this.listeners_[Number(port)];
+    roots.push({name: 'listener ' + port + ' owner', value: server.owner},
+               {name: 'listener ' + port + ' proto', value: server.proto});
   }
-  this.unwind_(thread, Interpreter.CompletionType.THROW, e, undefined);
+  this.hostHandles_.forEach(function(handle) {
+    roots.push({name: 'host handle ' + handle.description,
+                value: handle.target});
+  });
+  if (this.debugHandler_) {
+    roots.push({name: 'debug handler', value: this.debugHandler_});
+  }
+  this.breakpoints_.forEach(function(breakpoint) {
+    roots.push({name: 'breakpoint ' + breakpoint.id, value: breakpoint.func});
+  });
+  this.audits_.forEach(function(keys, obj) {
+    roots.push({name: 'audit', value: obj});
+  });
+  this.auditLog_.forEach(function(record, i) {
+    roots.push({name: 'audit log[' + i + '] object', value: record.object},
+               {name: 'audit log[' + i + '] perms', value: record.perms});
+    record.callers.forEach(function(frame, j) {
+      if (frame.func) {
+        roots.push({name: 'audit log[' + i + '] callers[' + j + ']',
+                    value: frame.func});
+      }
+    });
+  });
+  this.slowLog_.forEach(function(record, i) {
+    record.samples.forEach(function(sample, j) {
+      sample.forEach(function(frame, k) {
+        if (!('func' in frame)) return;
+        roots.push({name: 'slow log[' + i + '] samples[' + j + '][' + k +
+                    ']', value: frame.func});
+      });
+    });
+  });
+  if (this.coverage_) {
+    this.coverage_.forEach(function(hits, func) {
+      roots.push({name: 'coverage', value: func});
+    });
+  }
+  // Maps keyed by owner.
+  var maps = {guests: this.guests_, logChannels: this.logChannels_,
+              httpRequests: this.httpRequests_, fetchTimes: this.fetchTimes_,
+              mailTimes: this.mailTimes_};
+  for (var name in maps) {
+    maps[name].forEach(function(value, owner) {
+      roots.push({name: name + ' entry', value: owner});
+    });
+  }
+  return roots;
 };
 
 /**
- * Unwind the stack to the innermost relevant enclosing TryStatement,
- * For/ForIn/WhileStatement or Call.  If this results in
- * the stack being completely unwound the thread will be terminated
- * and an appropriate error being logged.
- *
- * N.B. Normally unwind should be called from the current stack frame
- * (i.e., do NOT do stack.pop() before calling unwind) because the
- * target label of a break statement can be the statement itself
- * (e.g., `foo: break foo;`).
+ * Describe an HTTP request, for in-world code (see
+ * Interpreter.ListenOptions).
  * @private
- * @param {!Interpreter.Thread} thread The thread whose stack is to be unwound.
- * @param {!Interpreter.CompletionType} type Completion type.
- * @param {?Interpreter.Value=} value Value computed, returned or thrown.
- * @param {string=} label Target label for break or return.
- */
-Interpreter.prototype.unwind_ = function(thread, type, value, label) {
-  if (type === Interpreter.CompletionType.NORMAL) {
-    throw new TypeError('Should not unwind for NORMAL completions');
+ * @param {!http.IncomingMessage} req The request.
+ * @param {string} address The client's address.
+ * @return {!Object<string, *>} The description (without the body).
+ */
+Interpreter.describeRequest_ = function(req, address) {
+  var url = String(req.url);
+  var q = url.indexOf('?');
+  var headers = {};
+  for (var name in req.headers) {
+    headers[name] = req.headers[name];
   }
-  for (var stack = thread.stateStack_; stack.length > 0; stack.pop()) {
-    var state = stack[stack.length - 1];
-    switch (state.node['type']) {
-      case 'TryStatement':
-        state.info_ = {type: type, value: value, label: label};
-        return;
-      case 'Call':
-        switch (type) {
-          case Interpreter.CompletionType.BREAK:
-          case Interpreter.CompletionType.CONTINUE:
-            throw new Error('Unsynatctic break/continue not rejected by Acorn');
-          case Interpreter.CompletionType.RETURN:
-            state.value = value;
-            return;
-        }
-        break;
-    }
-    if (type === Interpreter.CompletionType.BREAK) {
-      if (label ? (state.labels && state.labels.includes(label)) :
-          (state.isLoop || state.isSwitch)) {
-        // Top of stack is now target of break.  But we are breaking
-        // out of this statement, so pop to discard it.
-        stack.pop();
-        return;
-      }
-    } else if (type === Interpreter.CompletionType.CONTINUE) {
-      if (label ? (state.labels && state.labels.includes(label)) :
-          state.isLoop) {
-        return;
-      }
+  return {
+    'method': req.method,
+    'url': url,
+    'path': (q === -1) ? url : url.slice(0, q),
+    'query': (q === -1) ? '' : url.slice(q + 1),
+    'headers': headers,
+    'cookies': WebSocket.parseCookies(req.headers['cookie']),
+    'remoteAddress': address,
+  };
+};
+
+/**
+ * Connect an object to a connection (accepted by a Server, or opened
+ * with CC.connectionOpen): make it the object's .socket, and call its
+ * .onConnect method once connected; then call its .onReceive, .onEnd,
+ * .onClose and .onError methods as data arrives, etc.
+ *
+ * The lifecycle of a connection to a player is thus: connect
+ * (.onConnect); authenticate (.onAuthenticate, if the client presented
+ * a login ID); attach (CC.connectionAttach, which calls the player's
+ * .onAttach); idle (.onIdle, and the player's .onIdle, if attached);
+ * detach (CC.connectionDetach, or the connection closing, either of
+ * which calls the player's .onDetach); and disconnect (.onEnd and
+ * .onClose).  A player may have any number of connections attached.
+ * @private
+ * @param {!Interpreter.prototype.Object} obj The object to connect.
+ * @param {!net.Socket|!WebSocket.Connection|!Telnet.Connection|
+ *     !Sessions.Session|!SSE.Connection} socket The connection.
+ * @param {!Interpreter.Owner} owner Owner for threads calling methods.
+ * @param {number} timeLimit Time limit for those threads (in ms).
+ * @param {string} description Description of the connection, for
+ *     messages (e.g., its remote address).
+ * @param {string} label Description of the connection for logging
+ *     (e.g., 'on :7777 from 127.0.0.1:54321').
+ * @param {{connected: boolean,
+ *          request: (!Interpreter.prototype.Object|undefined),
+ *          identity: (string|undefined),
+ *          lines: (boolean|undefined),
+ *          address: (string|undefined),
+ *          idle: (number|undefined),
+ *          idleWarning: (number|undefined)}} options Whether the socket
+ *     is already connected; an object describing the request that
+ *     opened it (or the client protocol negotiated), to pass to
+ *     .onConnect; the login ID presented by the client, if any, to
+ *     pass to .onAuthenticate (or, if obj has no such method, to
+ *     .onReceive as 'identify as <ID>\n'); whether to pass data to
+ *     .onReceive one line (without line terminator) at a time; the
+ *     client's address, if input from it is to be subject to the
+ *     'command' rate limit; and the idle timeout and warning time (see
+ *     Interpreter.ListenOptions.idle), if any.  Input exceeding the
+ *     rate limit is discarded, and obj's .onRateLimit method called
+ *     (with the policy name and the time, in ms, until the lockout
+ *     ends) as it begins.
+ */
+Interpreter.prototype.attachSocket_ = function(obj, socket, owner, timeLimit,
+                                               description, label, options) {
+  var intrp = this;
+  var handle = new Interpreter.HostHandle(
+      Interpreter.HostHandle.Kind.CONNECTION, obj, description, owner,
+      timeLimit, socket);
+  obj.socket = handle;
+  this.hostHandles_.add(handle);
+
+  /**
+   * Call one of obj's methods (if it has one) in a new thread.
+   * @param {string} name Name of the method.
+   * @param {!Array<?Interpreter.Value>} args Arguments to pass.
+   */
+  var call = function(name, args) {
+    var func = obj.get(name, owner);
+    if (func instanceof intrp.Function && owner !== null) {
+      // TODO(cpcallen:perms): Is the server's owner the correct owner
+      // for the thread?  Note that this will typically be root, and
+      // .onConnect will therefore get caller perms === root, which
+      // is probably dangerous.  Here and several places below.
+      intrp.createThreadForFuncCall(
+          owner, func, obj, args, undefined, timeLimit);
     }
+  };
+  if (options.connected) {
+    call('onConnect', options.request ? [options.request] : []);
+  } else {
+    socket.on('connect', function() {
+      intrp.log('net', 'Connection %s established', label);
+      call('onConnect', []);
+    });
   }
 
-  // Unhandled completion.  Terminate thread.
-  thread.status = Interpreter.Thread.Status.ZOMBIE;
+  // Handle idleness: warn obj, then close the connection.
+  var idle = new Idle.Timer(function(remaining) {
+    call('onIdle', [remaining]);
+    if (handle.player) {
+      intrp.callPlayer_(handle, 'onIdle', [obj, remaining]);
+    }
+  }, function() {
+    intrp.log('net', 'Connection %s idle; closing', label);
+    socket.end();
+  });
+  handle.idle = idle;
+  if (options.idle) idle.set(options.idle, options.idleWarning);
+  socket.on('data', function() {
+    idle.touch();
+  });
 
-  if (type === Interpreter.CompletionType.THROW) {
-    // Log exception and stack trace.
-    if (value instanceof this.Error) {
-      this.log('unhandled', 'Unhandled %s', value);
-      var stackTrace = value.get('stack', this.ROOT);
-      if (stackTrace) {
-        this.log('unhandled', stackTrace);
+  // Handle socket closing completely.
+  socket.on('close', function() {
+    intrp.log('net', 'Connection %s closed', label);
+    idle.stop();
+    intrp.hostHandles_.delete(handle);
+    intrp.detachPlayer_(handle, 'disconnect');
+    call('onClose', []);
+  });
+
+  // Handle incoming data.  N.B. that data is a node buffer object
+  // (except from a WebSocket.Connection), so we must convert it to a
+  // string before passing it to user code.
+  var lockedUntil = 0;
+  var receive = function(data) {
+    // Binary WebSocket messages are passed on one character per byte.
+    var binary = Buffer.isBuffer(data) &&
+        (socket instanceof WebSocket.Connection ||
+         socket instanceof Sessions.Session);
+    var wait = (options.address === undefined) ? 0 :
+        intrp.rateLimiter_.record('command', options.address);
+    if (wait) {
+      var now = Date.now();
+      if (now >= lockedUntil) {
+        intrp.log('net', 'Connection %s rate limited for %ss',
+                  label, Math.ceil(wait / 1000));
+        call('onRateLimit', ['command', wait]);
       }
+      lockedUntil = now + wait;
+      return;
+    }
+    if (binary) {
+      call('onReceiveBinary', [intrp.taint(data.toString('latin1'))]);
     } else {
-      var native = this.pseudoToNative(value);
-      this.log('unhandled', 'Unhandled exception with value: %o', native);
+      call('onReceive', [intrp.taint(String(data))]);
+    }
+  };
+  if (options.identity !== undefined) {
+    handle.identity = options.identity;
+    if (owner !== null &&
+        obj.get('onAuthenticate', owner) instanceof intrp.Function) {
+      call('onAuthenticate', [options.identity]);
+    } else {
+      call('onReceive', ['identify as ' + options.identity + '\n']);
     }
+  }
+  var decoder = null;
+  var partial = '';
+  if (options.lines) {
+    decoder = new StringDecoder('utf8');
+    socket.on('data', function(data) {
+      var lines = (partial + decoder.write(data)).split('\n');
+      partial = lines.pop();
+      for (var i = 0; i < lines.length; i++) {
+        receive(lines[i].replace(/\r$/, ''));
+      }
+    });
   } else {
-    throw new Error('Unsynatctic break/continue/return not rejected by Acorn');
+    socket.on('data', receive);
+  }
+
+  // Handle far end closing connection.
+  socket.on('end', function() {
+    intrp.log('net', 'Connection %s ended', label);
+    if (decoder) {
+      // Pass on any unterminated last line.
+      partial += decoder.end();
+      if (partial) receive(partial.replace(/\r$/, ''));
+      partial = '';
+    }
+    call('onEnd', []);
+  });
+
+  // Handle errors.
+  socket.on('error', function(error) {
+    intrp.log('net', 'Socket error %s: %s: %s',
+              label, error.name, error.message);
+    if (owner !== null && obj.get('onError', owner) instanceof intrp.Function) {
+      call('onError', [intrp.errorNativeToPseudo(error, owner)]);
+    }
+  });
+
+  // Handle session resumption.
+  if (socket instanceof Sessions.Session) {
+    socket.on('detach', function() {
+      intrp.log('net', 'Connection %s lost; awaiting resumption', label);
+    });
+    socket.on('resume', function(client) {
+      intrp.log('net', 'Connection %s resumed from %s:%s',
+                label, socket.remoteAddress, socket.remotePort);
+      call('onResume', client ? [client] : []);
+    });
+  }
+
+  // Handle telnet option negotiation.
+  if (socket instanceof Telnet.Connection) {
+    socket.on('resize', function(width, height) {
+      call('onResize', [width, height]);
+    });
+    socket.on('terminaltype', function(type) {
+      call('onTerminalType', [type]);
+    });
   }
 };
 
 /**
- * Get a {resovle, reject} tuple for the specified thread and state,
- * which is presumed to be about to block on an async function call.
- *
- * The resolve function takes a single argument and, when called, will
- * unblock the thread and save its argument in state.value.
- *
- * The reject function takes a single argument and, when called, will
- * unblock the thread and unwind the stack as if its argument had been
- * thrown.
- *
- * Only one of these may be called, and only once, or an internal
- * Error will be thrown.
- * @param {!Interpreter.Thread} thread The thread to be controlled.
- * @param {!Interpreter.State} state The state in which thread to block.
- * @return {{resolve: function(?Interpreter.Value=):void,
- *           reject: function(?Interpreter.Value, !Interpreter.Owner):void}}
- */
-Interpreter.prototype.getResolveReject = function(thread, state) {
-  var /** boolean */ done = false;
+ * Find the connections attached to a player.
+ * @private
+ * @param {!Interpreter.prototype.Object} player The player.
+ * @return {!Array<!Interpreter.HostHandle>} Handles of its connections,
+ *     in the order they were made.
+ */
+Interpreter.prototype.connectionsOf_ = function(player) {
+  var handles = [];
+  this.hostHandles_.forEach(function(handle) {
+    if (handle.player === player) handles.push(handle);
+  });
+  return handles;
+};
 
-  /**
-   * Throw an internal error if previously invoked or if the thread
-   * does not appear to be in a plausible state.
-   */
-  var check = function() {
-    if (done) {
-      throw new Error('Async resolved or rejected more than once??');
-    }
-    done = true;
-    if (thread.status !== Interpreter.Thread.Status.BLOCKED ||
-        thread.stateStack_[thread.stateStack_.length - 1] !== state) {
-      throw new Error('Thread state corrupt at async resolve/reject??');
-    }
-  };
+/**
+ * Attach a connection to a player (detaching it from any other), and
+ * call the player's .onAttach method with the connected object and the
+ * number of connections it now has attached.
+ * @private
+ * @param {!Interpreter.HostHandle} handle Handle of the connection.
+ * @param {!Interpreter.prototype.Object} player The player.
+ * @return {number} The number of connections attached to the player.
+ */
+Interpreter.prototype.attachPlayer_ = function(handle, player) {
+  if (handle.player !== player) {
+    this.detachPlayer_(handle, 'attach');
+    handle.player = player;
+    this.log('net', 'Connection from %s attached to player',
+             handle.description);
+    var count = this.connectionsOf_(player).length;
+    this.callPlayer_(handle, 'onAttach', [handle.target, count]);
+  }
+  return this.connectionsOf_(player).length;
+};
 
-  var intrp = this;
-  return {
-    resolve: function resolve(value) {
-      check();
-      state.value = value;
-      thread.status = Interpreter.Thread.Status.READY;
-      intrp.go_();
-    },
-    reject: function reject(value, perms) {
-      check();
-      thread.status = Interpreter.Thread.Status.READY;
-      intrp.throw_(thread, value, perms);
-      intrp.go_();
-    }
-  };
+/**
+ * Detach a connection from its player, if any, and call the player's
+ * .onDetach method with the connected object, the number of
+ * connections it still has attached, and the reason: 'detach' (by
+ * CC.connectionDetach), 'attach' (to another player), 'disconnect'
+ * (the connection closed) or 'restart' (the server was restarted).
+ * @private
+ * @param {!Interpreter.HostHandle} handle Handle of the connection.
+ * @param {string} reason Why it is being detached.
+ * @return {boolean} True iff it was attached.
+ */
+Interpreter.prototype.detachPlayer_ = function(handle, reason) {
+  var player = handle.player;
+  if (!player) return false;
+  handle.player = null;
+  this.log('net', 'Connection from %s detached from player (%s)',
+           handle.description, reason);
+  var remaining = this.connectionsOf_(player).length;
+  this.callPlayer_(handle, 'onDetach', [handle.target, remaining, reason],
+                   player);
+  return true;
 };
 
 /**
- * Log something.
- * @param {string} category About what topic is this log?
- * @param {...*} var_args
- */
-Interpreter.prototype.log = function(category, var_args) {
-  if (this.options.noLog && this.options.noLog.includes(category)) {
-    return;
+ * Call one of the methods (if it has one) of the player a connection
+ * is attached to, in a new thread, as the connected object's methods
+ * are called (see Interpreter.prototype.attachSocket_).
+ * @private
+ * @param {!Interpreter.HostHandle} handle Handle of the connection.
+ * @param {string} name Name of the method.
+ * @param {!Array<?Interpreter.Value>} args Arguments to pass.
+ * @param {?Interpreter.prototype.Object=} player The player.  (Default:
+ *     the one the connection is attached to.)
+ */
+Interpreter.prototype.callPlayer_ = function(handle, name, args, player) {
+  player = player || handle.player;
+  var perms = handle.perms;
+  if (!player || perms === null) return;
+  var func = player.get(name, perms);
+  if (func instanceof this.Function) {
+    this.createThreadForFuncCall(
+        perms, func, player, args, undefined, handle.timeLimit);
   }
-  console.log.apply(console, Array.prototype.slice.call(arguments, 1));
 };
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -3276,10 +10065,374 @@ Interpreter.FunctionResult.Sleep = new Interpreter.FunctionResult;
  *     trimEval: (boolean|undefined),
  *     trimProgram: (boolean|undefined),
  *     stackLimit: (number|undefined),
+ *     httpMaxRequests: (number|undefined),
+ *     httpMaxBody: (number|undefined),
+ *     fetchAllow: (!Array<string>|undefined),
+ *     fetchDeny: (!Array<string>|undefined),
+ *     fetchRateLimit: (number|undefined),
+ *     fetchMaxResponse: (number|undefined),
+ *     fetchTimeout: (number|undefined),
+ *     mailRateLimit: (number|undefined),
+ *     mailMaxRecipients: (number|undefined),
+ *     mailMaxSize: (number|undefined),
+ *     passwordHashCost: (number|undefined),
+ *     guests: (!Interpreter.GuestLimits|undefined),
+ *     sizeLimits: (!Interpreter.SizeLimits|undefined),
+ *     taint: (string|undefined),
+ *     rateLimits: (!RateLimit.Config|undefined),
+ *     trustedProxies: (!Array<string>|undefined),
+ *     slowTaskTime: (number|undefined),
+ *     slowTaskSteps: (number|undefined),
+ *     slowPauseTime: (number|undefined),
+ *     v8Messages: (boolean|undefined),
  * }}
  */
 Interpreter.Options;
 
+/**
+ * Default maximum number of requests to 'http' Servers belonging to
+ * any one owner that may be in progress at once (see
+ * Interpreter.Options.httpMaxRequests).  Further requests are refused
+ * (with 503 Service Unavailable) until some are complete.
+ * @const {number}
+ */
+Interpreter.HTTP_MAX_REQUESTS = 100;
+
+/**
+ * Default maximum size, in bytes, of the body of a request to an
+ * 'http' Server (see Interpreter.Options.httpMaxBody).  Larger
+ * requests are refused (with 413 Payload Too Large).
+ * @const {number}
+ */
+Interpreter.HTTP_MAX_BODY = 1024 * 1024;
+
+/**
+ * Default maximum number of requests that may be made with CC.fetch on
+ * behalf of any one owner in any period of FETCH_RATE_PERIOD ms (see
+ * Interpreter.Options.fetchRateLimit).
+ * @const {number}
+ */
+Interpreter.FETCH_RATE_LIMIT = 60;
+
+/**
+ * Period, in ms, over which CC.fetch requests are counted against
+ * Interpreter.Options.fetchRateLimit.
+ * @const {number}
+ */
+Interpreter.FETCH_RATE_PERIOD = 60 * 1000;
+
+/**
+ * Default maximum size, in bytes, of the body of a response to
+ * CC.fetch (see Interpreter.Options.fetchMaxResponse).
+ * @const {number}
+ */
+Interpreter.FETCH_MAX_RESPONSE = 1024 * 1024;
+
+/**
+ * Default (and maximum) time, in ms, allowed for a CC.fetch request to
+ * complete (see Interpreter.Options.fetchTimeout).
+ * @const {number}
+ */
+Interpreter.FETCH_TIMEOUT = 30 * 1000;
+
+/**
+ * Default maximum number of messages that may be sent with
+ * CC.mailSend on behalf of any one owner in any period of
+ * MAIL_RATE_PERIOD ms (see Interpreter.Options.mailRateLimit).
+ * @const {number}
+ */
+Interpreter.MAIL_RATE_LIMIT = 20;
+
+/**
+ * Period, in ms, over which CC.mailSend messages are counted against
+ * Interpreter.Options.mailRateLimit.
+ * @const {number}
+ */
+Interpreter.MAIL_RATE_PERIOD = 60 * 60 * 1000;
+
+/**
+ * Default maximum number of recipients of a message sent with
+ * CC.mailSend (see Interpreter.Options.mailMaxRecipients).
+ * @const {number}
+ */
+Interpreter.MAIL_MAX_RECIPIENTS = 10;
+
+/**
+ * Default maximum size, in bytes, of a message received by an 'smtp'
+ * Server (see Interpreter.Options.mailMaxSize).
+ * @const {number}
+ */
+Interpreter.MAIL_MAX_SIZE = 1024 * 1024;
+
+/**
+ * Maximum number of recipients of a message received by an 'smtp'
+ * Server (the minimum RFC 5321 §4.5.3.1.8 requires be accepted).
+ * @const {number}
+ */
+Interpreter.MAIL_MAX_INBOUND_RECIPIENTS = 100;
+
+/**
+ * Standard globals which CC.sandboxCreate can make available in a
+ * sandbox, together with the functions which are their properties (and
+ * those of their prototypes), except those in SANDBOX_EXCLUDED.
+ * @const {!Array<string>}
+ */
+Interpreter.SANDBOX_GLOBALS = [
+  'Array', 'Boolean', 'Date', 'Error', 'EvalError', 'JSON', 'Math', 'Number',
+  'Object', 'RangeError', 'ReferenceError', 'RegExp', 'String', 'SyntaxError',
+  'TypeError', 'URIError', 'decodeURI', 'decodeURIComponent', 'encodeURI',
+  'encodeURIComponent', 'escape', 'isFinite', 'isNaN', 'parseFloat',
+  'parseInt', 'unescape',
+];
+
+/**
+ * Functions which are not made available in a sandbox with the
+ * standard globals, because they change ownership or can be used to
+ * reach functions which are otherwise hidden.
+ * @const {!Array<string>}
+ */
+Interpreter.SANDBOX_EXCLUDED = [
+  'Object.entries', 'Object.getOwnPropertyDescriptor',
+  'Object.getOwnPropertyDescriptors', 'Object.setOwnerOf', 'Object.values',
+];
+
+/**
+ * Maximum grace period, in ms, for which an object destroyed with
+ * CC.destroy may be kept in the recycle bin.
+ * @const {number}
+ */
+Interpreter.RECYCLE_MAX_GRACE = 30 * 24 * 60 * 60 * 1000;
+
+/**
+ * Limits on the sizes of values an owner may create: the length of
+ * strings, the length of arrays, and the number of own properties of
+ * any object.  Exceeding one throws a RangeError.
+ * @typedef {{maxString: (number|undefined),
+ *            maxArray: (number|undefined),
+ *            maxProperties: (number|undefined)}}
+ */
+Interpreter.SizeLimits;
+
+/**
+ * Default size limits (see Interpreter.SizeLimits).  Arrays may by
+ * default be as long as JavaScript allows, since sparse ones cost
+ * nothing and dense ones are bounded by maxProperties.
+ * @const {{maxString: number, maxArray: number, maxProperties: number}}
+ */
+Interpreter.SIZE_LIMITS = {
+  maxString: 16 * 1024 * 1024,
+  maxArray: 0xffffffff,
+  maxProperties: 1024 * 1024,
+};
+
+/**
+ * Maximum amount of work (roughly: characters produced, or values
+ * visited) done in a single step by builtins that may otherwise take
+ * a long time, such as String.prototype.repeat and JSON.stringify.
+ * They do the rest in later visits (see FunctionResult.CallAgain),
+ * before each of which the thread's time limit is checked, so that
+ * they can be interrupted rather than running to completion
+ * atomically.  (Array.prototype.join and the like are implemented in
+ * the startup files, and so can be interrupted already.)
+ * @const {number}
+ */
+Interpreter.NATIVE_CHUNK_SIZE = 16 * 1024;
+
+/**
+ * Limits on guests (see CC.guestCreate): how many may exist at once,
+ * and how many live objects and (unfinished) threads each may own.
+ * @typedef {{maxGuests: (number|undefined),
+ *            maxObjects: (number|undefined),
+ *            maxThreads: (number|undefined)}}
+ */
+Interpreter.GuestLimits;
+
+/**
+ * Default maximum number of guests that may exist at once (see
+ * Interpreter.GuestLimits).
+ * @const {number}
+ */
+Interpreter.GUEST_MAX_GUESTS = 20;
+
+/**
+ * Default maximum number of live objects any one guest may own.  A
+ * guest that exceeds it is cut off: its threads are killed, and its
+ * connection closed.
+ * @const {number}
+ */
+Interpreter.GUEST_MAX_OBJECTS = 10000;
+
+/**
+ * Default maximum number of unfinished threads any one guest may own.
+ * @const {number}
+ */
+Interpreter.GUEST_MAX_THREADS = 10;
+
+/**
+ * The record of a guest: the connection it was created for (if any),
+ * when it was created, how many live objects it owns, and whether it
+ * has been cut off for exceeding its quota.
+ * @typedef {{connection: ?Interpreter.prototype.Object,
+ *            created: number,
+ *            objects: number,
+ *            over: boolean}}
+ */
+Interpreter.Guest_;
+
+/**
+ * Options for a listening Server (see CC.connectionListen):
+ *
+ * - protocol: 'tcp' (default), for raw connections, 'websocket' or
+ *   'telnet'.  WebSocket clients must be logged in (their ID cookie is
+ *   passed to .onAuthenticate, or else to .onReceive as 'identify as
+ *   <ID>'), and each message sent or received is passed to .onReceive
+ *   or written whole.  Telnet
+ *   connections report the client's window size and terminal type to
+ *   .onResize(width, height) and .onTerminalType(type), and support
+ *   CC.connectionSetEcho.  Or 'http': a new object is created from the
+ *   Server's proto for each request (rather than each connection) and
+ *   its .onRequest method called with an object describing the
+ *   request (.method, .url, .path, .query, .headers, .cookies, .body
+ *   and .remoteAddress); the response is then streamed by calling
+ *   CC.httpWriteHead (optionally), CC.connectionWrite and finally
+ *   CC.connectionClose on that object.  Or 'smtp': SMTP clients may
+ *   send mail (offered STARTTLS, if TLS is configured, except on tls
+ *   listeners), and the Server's proto's .onMail method is called with
+ *   an object describing each message received (.sender and
+ *   .recipients, from the envelope; .from, .subject, .text and
+ *   .headers, from the message; and .secure).  Or 'sse': each GET
+ *   request opens a one-way stream of server-sent events (as read by
+ *   a web page's EventSource): a new object is created from the
+ *   Server's proto and connected to it, its .onConnect method called
+ *   with an object describing the request (as for 'http', but without
+ *   .body), and each string passed to CC.connectionWrite sent as one
+ *   message event.  .onEnd is called if the client goes away.
+ * - origins: if given, WebSocket connections and SSE streams are
+ *   accepted only from web pages at these origins (e.g.,
+ *   'https://example.codecity.world').  Other SSE clients' requests
+ *   must be from the same origin.
+ * - compress: if true, offer telnet clients MCCP2 compression, and
+ *   WebSocket clients the permessage-deflate extension.
+ * - features: names of the optional features of the client protocol
+ *   (see Interpreter.CLIENT_PROTOCOL_VERSIONS) which the listener's
+ *   objects support, and so WebSocket clients may ask for (e.g.,
+ *   'editor', for remote editing: see edit.js).  The feature 'binary'
+ *   also allows binary messages to be exchanged: each received is
+ *   passed to .onReceiveBinary, and each passed to
+ *   CC.connectionWriteBinary is sent whole.  (There being no typed
+ *   arrays in ES5, their contents are represented as strings of
+ *   characters U+0000 to U+00FF, one per byte.)
+ * - tls: if true, connections use TLS (with whichever certificate
+ *   matches the hostname the client asks for), before any of the
+ *   above.
+ * - proxy: if true, connections must come from a trusted proxy (see
+ *   Interpreter.Options.trustedProxies), and begin with a PROXY
+ *   protocol header (before any TLS handshake) giving the client's
+ *   address.  Regardless, requests from trusted proxies to 'http' and
+ *   'websocket' listeners are taken to be from the client named by
+ *   their X-Forwarded-For (or X-Real-IP) header.
+ * - resume: if non-zero, a grace period (in ms) for which the object
+ *   connected to a WebSocket client is kept if the client's connection
+ *   is lost, data written to it being kept.  If the client reconnects
+ *   (presenting its SESSION cookie), it is reattached to that object
+ *   (instead of a new one being connected), sent the data kept and the
+ *   object's .onResume method called; otherwise .onEnd and .onClose are
+ *   called once the grace period has passed.
+ * - idle: if non-zero, the time (in ms) a client may send nothing
+ *   before being disconnected.  The connected object's .onIdle method
+ *   is called (with the time, in ms, remaining) idleWarning ms before
+ *   then (by default, Interpreter.IDLE_WARNING or half of idle,
+ *   whichever is less), and the connection closed (as if by
+ *   CC.connectionClose) if the client remains idle.  Root or the
+ *   connected object's owner may change these for any one connection
+ *   with CC.connectionSetIdle (e.g., to let a particular user idle for
+ *   longer).  Only for tcp, telnet and websocket listeners.
+ * - keepalive: interval (in ms) at which to check that clients are
+ *   still reachable, so that dead connections do not linger (default
+ *   Interpreter.KEEPALIVE; 0 not to check).  WebSocket clients are
+ *   pinged, and dropped if they have not responded by the next ping;
+ *   other connections use TCP keepalive probes.  Only for tcp, telnet
+ *   and websocket listeners.
+ * Each WebSocket client's .onConnect method is passed an object
+ * describing the version of the client protocol and the features
+ * negotiated with it (see Interpreter.ClientProtocol); so too is
+ * .onResume, as a resuming client may have been upgraded meanwhile.
+ * @typedef {{
+ *     protocol: (string|undefined),
+ *     origins: (?Array<string>|undefined),
+ *     compress: (boolean|undefined),
+ *     features: (!Array<string>|undefined),
+ *     tls: (boolean|undefined),
+ *     proxy: (boolean|undefined),
+ *     resume: (number|undefined),
+ *     idle: (number|undefined),
+ *     idleWarning: (number|undefined),
+ *     keepalive: (number|undefined),
+ * }}
+ */
+Interpreter.ListenOptions;
+
+/**
+ * Default time (in ms), before a connection is closed for being idle,
+ * at which its object's .onIdle method is called (see
+ * Interpreter.ListenOptions.idle).
+ * @const {number}
+ */
+Interpreter.IDLE_WARNING = 60 * 1000;
+
+/**
+ * Default interval (in ms) at which to check that clients are still
+ * reachable (see Interpreter.ListenOptions.keepalive).
+ * @const {number}
+ */
+Interpreter.KEEPALIVE = 30 * 1000;
+
+/**
+ * Compute when, before a connection is closed for being idle, to warn
+ * its object.
+ * @private
+ * @param {number} idle Idle time allowed (in ms), or 0 if unlimited.
+ * @param {number|undefined} warning Warning time given, if any.
+ * @return {number} The warning time (in ms).
+ */
+Interpreter.idleWarning_ = function(idle, warning) {
+  return (warning === undefined) ?
+      Math.min(Interpreter.IDLE_WARNING, idle / 2) : warning;
+};
+
+/**
+ * Versions of the client protocol spoken over WebSocket connections.
+ * A client lists the versions it speaks as the subprotocols it offers
+ * in its opening handshake ('codecity.v1', 'codecity.v2', ...), and
+ * the newest of them also listed here is selected.  A client that
+ * offers no subprotocol is taken to speak version 1 (the protocol
+ * spoken before versions were negotiated); one that offers only
+ * subprotocols not listed here is refused.
+ *
+ * Version 2 clients may ask for optional features by listing them in
+ * the 'features' query parameter of the URL they connect to (e.g.,
+ * '/?features=editor,binary'); those the listener supports are
+ * agreed.  The first message sent to a version 2 client is then
+ * '{"type":"hello", ...}', with the remaining properties of the
+ * Interpreter.ClientProtocol also passed to the connected object's
+ * .onConnect method.
+ * @const {!Array<number>}
+ */
+Interpreter.CLIENT_PROTOCOL_VERSIONS = [1, 2];
+
+/**
+ * Description of the client protocol negotiated with a WebSocket
+ * client: the version spoken, the optional features agreed (in the
+ * order the client listed them), and whether messages are compressed.
+ * @typedef {{version: number, features: !Array<string>, compress: boolean}}
+ */
+Interpreter.ClientProtocol;
+
+/**
+ * @private @const {!RegExp} Valid names of client protocol features.
+ */
+Interpreter.FEATURE_RE_ = /^[a-z][a-z0-9-]{0,31}$/;
+
 /**
  * Interpreter statuses.
  * @enum {number}
@@ -3389,6 +10542,95 @@ Interpreter.PropertyIterator.prototype.next = function() {
   }
 };
 
+/**
+ * A handle on a host resource: something outside the interpreter (not
+ * serializable) that it uses on behalf of the world.  These are:
+ *
+ * - Connections: the net.Socket of a connected object (its .socket),
+ *   accepted by a listening Server or opened with CC.connectionOpen.
+ * - Operations in progress: e.g. an XHR (see CC.xhr), made on behalf
+ *   of a thread BLOCKED until it completes (see getResolveReject).
+ *
+ * (Listening servers and timers are not host resources in this sense:
+ * Servers are re-listened when a deserialized interpreter is
+ * restarted, and sleeping threads' wake times are serialized.)
+ *
+ * A handle is serialized as a placeholder, without the resource
+ * itself.  The interpreter keeps track of handles in use; when it is
+ * deserialized, the resources they referred to no longer exist, so
+ * each is "reattached" to let the world know (see
+ * Interpreter.prototype.reattach_): the connected object's
+ * .onReattach method is called with an Error saying so (after which
+ * writing to it throws, and closing it does nothing), and it is
+ * detached from its player (if any); or the blocked thread has an
+ * Error thrown in it.
+ * @constructor
+ * @struct
+ * @param {!Interpreter.HostHandle.Kind} kind What sort of resource.
+ * @param {!Interpreter.prototype.Object|!Interpreter.Thread} target
+ *     The connected object or blocked thread.
+ * @param {string} description Description of the resource, for
+ *     messages (e.g., the remote address of a connection).
+ * @param {?Interpreter.Owner} perms Owner on whose behalf it is used.
+ * @param {number} timeLimit Time limit for threads created to handle
+ *     its loss (in ms).
+ * @param {*=} resource The resource itself (e.g. a net.Socket), if
+ *     there is an object representing it.
+ */
+Interpreter.HostHandle = function(kind, target, description, perms,
+                                  timeLimit, resource) {
+  if (kind === undefined) {  // Deserializing.
+    this.resource = null;
+    this.idle = null;
+    this.player = null;
+    this.identity = null;
+    return;
+  }
+  /** @const {!Interpreter.HostHandle.Kind} */
+  this.kind = kind;
+  /** @const {!Interpreter.prototype.Object|!Interpreter.Thread} */
+  this.target = target;
+  /** @const {string} */
+  this.description = description;
+  /** @const {?Interpreter.Owner} */
+  this.perms = perms;
+  /** @const {number} */
+  this.timeLimit = timeLimit;
+  /**
+   * The resource, or null if it does not exist (any longer).  Not
+   * serialized.
+   * @type {*}
+   */
+  this.resource = (resource === undefined) ? null : resource;
+  /**
+   * Idle timer of a connection (see Interpreter.ListenOptions.idle).
+   * Not serialized.
+   * @type {?Idle.Timer}
+   */
+  this.idle = null;
+  /**
+   * Player object a connection is attached to (see
+   * CC.connectionAttach), or null if none.
+   * @type {?Interpreter.prototype.Object}
+   */
+  this.player = null;
+  /**
+   * Login ID presented by a connection's client (e.g., a WebSocket
+   * client's ID cookie), or null if none.
+   * @type {?string}
+   */
+  this.identity = null;
+};
+
+/**
+ * Kinds of host resource.
+ * @enum {string}
+ */
+Interpreter.HostHandle.Kind = {
+  CONNECTION: 'connection',
+  OPERATION: 'operation',
+};
+
 /**
  * Class for a scope.  Implements Lexical Environments and the
  * Environment Record specification type from E5.1 §10.2 / ES6 §8.1.
@@ -3414,8 +10656,17 @@ Interpreter.Scope = function(type, perms, outerScope, thisVal) {
   this.this = (outerScope && arguments.length < 4) ? outerScope.this : thisVal;
   /** @const {!Object<string, ?Interpreter.Value>} */
   this.vars = Object.create(null);
+  // Code in a scope within a sandbox is confined to it.
+  if (outerScope && outerScope.sandbox) this.sandbox = outerScope.sandbox;
 };
 
+/**
+ * The sandbox to which code in the scope is confined (see
+ * CC.sandboxCreate), or null if none.
+ * @type {?Interpreter.Sandbox}
+ */
+Interpreter.Scope.prototype.sandbox = null;
+
 /**
  * Returns true iff this scope has a binding for the given name.
  *
@@ -3541,6 +10792,8 @@ Interpreter.Scope.Type = {
   FUNCTION: 'function',
   /** A scope to contain the name of a named function expression. */
   FUNEXP: 'funexp',
+  /** The global scope of a sandbox. */
+  SANDBOX: 'sandbox',
   /** An eval body scope. */
   EVAL: 'eval',
   /** A catch clause scope. */
@@ -3549,6 +10802,15 @@ Interpreter.Scope.Type = {
   DUMMY: 'dummy',
 };
 
+/**
+ * A sandbox: a global scope (whose bindings were copied from a global
+ * object) in which untrusted code can be run, and the functions
+ * outside it which that code may call (see CC.sandboxCreate).
+ * @typedef {{scope: !Interpreter.Scope,
+ *            allowed: !Set<!Interpreter.prototype.Function>}}
+ */
+Interpreter.Sandbox;
+
 /**
  * Source is an encapsulated hunk of source text.  Source objects can
  * be sliced to obtain a Source object representing a substring of the
@@ -3767,6 +11029,48 @@ Interpreter.Thread = function(id, state, runAt, timeLimit) {
   this.wrapper = null;
   /** @type {?Interpreter.Value} */
   this.value = undefined;
+  /**
+   * Thread-local storage, accessed via Thread.prototype.getLocal etc.
+   * @type {!Map<string, ?Interpreter.Value>}
+   */
+  this.locals = new Map;
+  /**
+   * Has cancellation of this thread been requested (via
+   * Thread.prototype.cancel)?  Unlike Thread.kill, this does not stop
+   * the thread; it is up to the code running in it to notice and
+   * exit cleanly.
+   * @type {boolean}
+   */
+  this.cancelled = false;
+  /**
+   * Was this thread created to run an owner's onError handler?  Used
+   * to avoid reporting exceptions thrown by such handlers (to
+   * themselves) indefinitely.
+   * @type {boolean}
+   */
+  this.isErrorHandler = false;
+  /**
+   * Was this thread created to run the debug handler (see
+   * CC.debugSetHandler)?  Such threads are never paused by the
+   * debugger, lest pausing one start another.
+   * @type {boolean}
+   */
+  this.isDebugHandler = false;
+  /**
+   * If the thread is being stepped (or is to be paused) by the
+   * debugger, how far to let it run; otherwise null.
+   * @type {?Interpreter.Step}
+   */
+  this.step = null;
+  /**
+   * Called (if set) when the thread finishes: with false and the value
+   * of its last expression statement (or, for a thread created with
+   * createThreadForFuncCall, the function's return value), or (if it
+   * ended by throwing an exception) with true and the exception.  Not
+   * called if the thread is killed, nor saved in checkpoints.
+   * @type {?function(boolean, ?Interpreter.Value)}
+   */
+  this.onExit = null;
 };
 
 /**
@@ -3818,6 +11122,42 @@ Interpreter.Thread.prototype.callers = function(perms) {
   return frames;
 };
 
+/**
+ * List the values a thread refers to (for heap analysis; see Heap):
+ * those held by the states on its stack, its locals, its wrapper and
+ * its value.  Values may be of any type.
+ * @return {!Array<!Interpreter.Reference>} The references.
+ */
+Interpreter.Thread.prototype.references = function() {
+  var refs = [{name: 'wrapper', value: this.wrapper},
+              {name: 'value', value: this.value}];
+  this.locals.forEach(function(value, key) {
+    refs.push({name: 'locals.' + key, value: value});
+  });
+  var add = function(name, value) {
+    if (Array.isArray(value) || value instanceof Set) {
+      Array.from(value).forEach(function(v, i) {
+        refs.push({name: name + '[' + i + ']', value: v});
+      });
+    } else {
+      refs.push({name: name, value: value});
+    }
+  };
+  for (var i = 0; i < this.stateStack_.length; i++) {
+    var state = this.stateStack_[i];
+    var prefix = 'stack[' + i + '].';
+    add(prefix + 'scope', state.scope);
+    add(prefix + 'value', state.value);
+    add(prefix + 'ref', state.ref);
+    add(prefix + 'tmp', state.tmp_);
+    var info = state.info_;
+    for (var key in info) {
+      add(prefix + key, info[key]);
+    }
+  }
+  return refs;
+};
+
 /**
  * Returns the permissions with which currently-executing code is
  * running (equivalent to a unix EUID, but in the form of a
@@ -3846,8 +11186,21 @@ Interpreter.Thread.Status = {
   BLOCKED: 2,
   /** The thread is sleeping, awaiting arrival of its .runAt time. */
   SLEEPING: 3,
+  /** The thread has been paused by the debugger. */
+  PAUSED: 4,
 };
 
+/**
+ * How far a thread being stepped by the debugger is to run before
+ * pausing again: mode is 'pause', 'watchpoint' (having written to a
+ * watched property) or 'into' (until the next statement executed),
+ * 'over' (until the next statement in the same or an outer frame) or
+ * 'out' (until the next statement in an outer frame); depth is the
+ * number of frames on its stack when it was resumed.
+ * @typedef {{mode: string, depth: number}}
+ */
+Interpreter.Step;
+
 ///////////////////////////////////////////////////////////////////////////////
 // Inner classes of Interpreter: Declarations.
 ///////////////////////////////////////////////////////////////////////////////
@@ -3949,7 +11302,7 @@ Interpreter.prototype.Object = function(owner, proto) {
   // have their shape mutated by the on('connect') handler in Server.
   // Consider rewriting it so that there is a WeakMap on Interpreter
   // instances mapping objects to their corresponding Socket.
-  /** @type {!net.Socket|undefined} */
+  /** @type {!Interpreter.HostHandle|undefined} */
   this.socket;
   throw new Error('Inner class constructor not callable on prototype');
 };
@@ -4013,16 +11366,35 @@ Interpreter.prototype.Object.prototype.has = function(key, perms) {
  * @param {!Interpreter.Owner} perms
  * @return {?Interpreter.Value}
  */
-Interpreter.prototype.Object.prototype.get = function(key, perms) {
+Interpreter.prototype.Object.prototype.get = function(key, perms) {
+  throw new Error('Inner class method not callable on prototype');
+};
+
+/**
+ * @param {string} key
+ * @param {?Interpreter.Value} value
+ * @param {!Interpreter.Owner} perms
+ */
+Interpreter.prototype.Object.prototype.set = function(key, value, perms) {
+  throw new Error('Inner class method not callable on prototype');
+};
+
+/**
+ * @param {number} index
+ * @param {!Interpreter.Owner} perms
+ * @return {?Interpreter.Value}
+ */
+Interpreter.prototype.Object.prototype.getElement = function(index, perms) {
   throw new Error('Inner class method not callable on prototype');
 };
 
 /**
- * @param {string} key
+ * @param {number} index
  * @param {?Interpreter.Value} value
  * @param {!Interpreter.Owner} perms
  */
-Interpreter.prototype.Object.prototype.set = function(key, value, perms) {
+Interpreter.prototype.Object.prototype.setElement = function(index, value,
+                                                             perms) {
   throw new Error('Inner class method not callable on prototype');
 };
 
@@ -4260,6 +11632,20 @@ Interpreter.prototype.WeakMap = function(owner, proto) {
   throw new Error('Inner class constructor not callable on prototype');
 };
 
+/**
+ * @constructor
+ * @struct
+ * @extends {Interpreter.prototype.Object}
+ * @param {!Buffer=} data
+ * @param {?Interpreter.Owner=} owner
+ * @param {?Interpreter.prototype.Object=} proto
+ */
+Interpreter.prototype.Buffer = function(data, owner, proto) {
+  /** @type {!Buffer} */
+  this.data;
+  throw new Error('Inner class constructor not callable on prototype');
+};
+
 /**
  * @constructor
  * @struct
@@ -4370,8 +11756,10 @@ Interpreter.prototype.Box.prototype.valueOf = function() {
  * @param {number} port
  * @param {!Interpreter.prototype.Object} proto
  * @param {number=} timeLimit
+ * @param {!Interpreter.ListenOptions=} options
  */
-Interpreter.prototype.Server = function(owner, port, proto, timeLimit) {
+Interpreter.prototype.Server = function(owner, port, proto, timeLimit,
+                                        options) {
   /** @type {!Interpreter.Owner} */
   this.owner;
   /** @type {number} */
@@ -4380,11 +11768,61 @@ Interpreter.prototype.Server = function(owner, port, proto, timeLimit) {
   this.proto;
   /** @type {number} */
   this.timeLimit;
+  /** @type {string} */
+  this.protocol;
+  /** @type {?Array<string>} */
+  this.origins;
+  /** @type {boolean} */
+  this.compress;
+  /** @type {!Array<string>} */
+  this.features;
+  /** @type {boolean} */
+  this.tls;
+  /** @type {number} */
+  this.idle;
+  /** @type {number} */
+  this.idleWarning;
+  /** @type {number} */
+  this.keepalive;
   /** @private @type {!net.Server} */
   this.server_;
+  /** @private @type {?http.Server} */
+  this.http_;
   throw new Error('Inner class constructor not callable on prototype');
 };
 
+/** @param {!net.Socket} socket */
+Interpreter.prototype.Server.prototype.accept_ = function(socket) {
+  throw new Error('Inner class method not callable on prototype');
+};
+
+/**
+ * @param {!http.IncomingMessage} req
+ * @param {!http.ServerResponse} res
+ */
+Interpreter.prototype.Server.prototype.request_ = function(req, res) {
+  throw new Error('Inner class method not callable on prototype');
+};
+
+/**
+ * @param {!Mail.Envelope} envelope
+ * @param {!Buffer} data
+ */
+Interpreter.prototype.Server.prototype.mail_ = function(envelope, data) {
+  throw new Error('Inner class method not callable on prototype');
+};
+
+/**
+ * @param {!net.Socket|!WebSocket.Connection|!Telnet.Connection|
+ *     !Sessions.Session} socket
+ * @param {string=} identity
+ * @param {!Interpreter.prototype.Object=} client
+ */
+Interpreter.prototype.Server.prototype.connect_ = function(socket, identity,
+                                                           client) {
+  throw new Error('Inner class method not callable on prototype');
+};
+
 /** @param {!function(!Error=)=} callback */
 Interpreter.prototype.Server.prototype.listen = function(callback) {
   throw new Error('Inner class method not callable on prototype');
@@ -4427,12 +11865,22 @@ Interpreter.prototype.installTypes = function() {
     this.owner = owner;
     this.proto = proto;
     this.properties = Object.create((proto === null) ? null : proto.properties);
+    if (intrp.guests_.size) {
+      var guest = intrp.guests_.get(/** @type {?} */(owner));
+      if (guest) intrp.countGuestObject_(guest, this);
+    }
   };
 
   /** @type {?Interpreter.prototype.Object} */
   intrp.Object.prototype.proto = null;
   /** @type {string} */
   intrp.Object.prototype.class = 'Object';
+  /**
+   * Has the object been destroyed (see CC.destroy)?  If so, any
+   * attempt to access its properties or prototype throws.
+   * @type {boolean}
+   */
+  intrp.Object.prototype.destroyed = false;
 
   /**
    * The [[SetPrototypeOf]] internal method from ES6 §9.1.2, with
@@ -4449,6 +11897,7 @@ Interpreter.prototype.installTypes = function() {
   intrp.Object.prototype.setPrototypeOf = function(proto, perms) {
     if (perms === null) throw new TypeError("null can't check extensibility");
     // TODO(cpcallen:perms): add "controls"-type perm check.
+    if (this.destroyed) throw intrp.destroyedError_(perms);
     if (proto === this.proto) {  // Doing nothing always succeeds.
       return true;
     } else if (!this.isExtensible(perms)) {
@@ -4461,6 +11910,7 @@ Interpreter.prototype.installTypes = function() {
             "An object's prototype chain can't include the object itself");
       }
     }
+    if (intrp.dirtyObjects) intrp.dirtyObjects.add(this);
     Object.setPrototypeOf(this.properties, proto && proto.properties);
     this.proto = proto;
     return true;
@@ -4476,6 +11926,7 @@ Interpreter.prototype.installTypes = function() {
   intrp.Object.prototype.isExtensible = function(perms) {
     if (perms === null) throw new TypeError("null can't check extensibility");
     // TODO(cpcallen:perms): add check for (object) readability.
+    if (this.destroyed) throw intrp.destroyedError_(perms);
     return Object.isExtensible(this.properties);
   };
 
@@ -4489,6 +11940,8 @@ Interpreter.prototype.installTypes = function() {
   intrp.Object.prototype.preventExtensions = function(perms) {
     if (perms === null) throw new TypeError("null can't prevent extensibions");
     // TODO(cpcallen:perms): add "controls"-type perm check.
+    if (this.destroyed) throw intrp.destroyedError_(perms);
+    if (intrp.dirtyObjects) intrp.dirtyObjects.add(this);
     Object.preventExtensions(this.properties);
     return true;
   };
@@ -4507,6 +11960,8 @@ Interpreter.prototype.installTypes = function() {
       throw new TypeError("null can't getOwnPropertyDescriptor");
     }
     // TODO(cpcallen:perms): add check for (property) readability.
+    if (this.destroyed) throw intrp.destroyedError_(perms);
+    if (intrp.audits_.size) intrp.audit_(this, key, 'get', perms);
     var pd = Object.getOwnPropertyDescriptor(this.properties, key);
     // TODO(cpcallen): can we eliminate this pointless busywork while
     // still maintaining type safety?
@@ -4529,11 +11984,21 @@ Interpreter.prototype.installTypes = function() {
       if (perms === null) throw new TypeError("null can't defineProperty");
       // TODO(cpcallen:perms): add "controls"-type perm check.
     }
+    if (this.destroyed) throw intrp.destroyedError_(perms || this.owner);
+    if (perms) intrp.checkObjectSize_(this, key, desc.value, perms);
+    if (intrp.audits_.size) {
+      intrp.audit_(this, key, 'define', perms || this.owner);
+    }
+    if (intrp.dirtyObjects) intrp.dirtyObjects.add(this);
+    var oldValue = this.properties[key];
     try {
       Object.defineProperty(this.properties, key, desc);
     } catch (e) {
       throw intrp.errorNativeToPseudo(e, perms || this.owner);
     }
+    if (intrp.watchpoints_.size) {
+      intrp.watch_(this, key, oldValue, this.properties[key]);
+    }
   };
 
   /**
@@ -4547,6 +12012,7 @@ Interpreter.prototype.installTypes = function() {
   intrp.Object.prototype.has = function(key, perms) {
     if (perms === null) throw new TypeError("null can't has");
     // TODO(cpcallen:perms): add check for (object) readability.
+    if (this.destroyed) throw intrp.destroyedError_(perms);
     return key in this.properties;
   };
 
@@ -4561,6 +12027,14 @@ Interpreter.prototype.installTypes = function() {
   intrp.Object.prototype.get = function(key, perms) {
     if (perms === null) throw new TypeError("null can't get");
     // TODO(cpcallen:perms): add check for (property) readability.
+    if (this.destroyed) throw intrp.destroyedError_(perms);
+    if (intrp.audits_.size) intrp.audit_(this, key, 'get', perms);
+    // N.B.: No lookup cache is needed here.  Because this.properties
+    // inherits from this.proto.properties (and so on up the chain), the
+    // lookup is done by V8 itself, which is faster than a cache kept
+    // here (one keyed by prototype and invalidated on any mutation of
+    // an object on a cached chain was 3-4 times slower, even for
+    // chains 30 deep; see benchInheritance in interpreter_bench.js).
     return this.properties[key];
   };
 
@@ -4575,12 +12049,61 @@ Interpreter.prototype.installTypes = function() {
   intrp.Object.prototype.set = function(key, value, perms) {
     if (perms === null) throw new TypeError("null can't set");
     // TODO(cpcallen:perms): add "controls"-type perm check.
+    if (this.destroyed) throw intrp.destroyedError_(perms);
+    intrp.checkObjectSize_(this, key, value, perms);
+    if (intrp.audits_.size) intrp.audit_(this, key, 'set', perms);
+    if (intrp.dirtyObjects) intrp.dirtyObjects.add(this);
+    var oldValue = this.properties[key];
     try {
       this.properties[key] = value;
     } catch (e) {
       throw intrp.errorNativeToPseudo(e, perms);
     }
+    if (intrp.watchpoints_.size) intrp.watch_(this, key, oldValue, value);
+  };
+
+  /**
+   * As .get, but with the key an array index given as a number, so
+   * that it need not be converted to a string (and back again, if this
+   * is an Array, whose .properties is a native array).  This is only
+   * equivalent to .get because no subclass of intrp.Object overrides
+   * .get; boxed primitives (intrp.Box, e.g. for 'abc'[1]), which do,
+   * are not intrp.Objects and so never get here.
+   * @param {number} index Array index of property to get.
+   * @param {!Interpreter.Owner} perms Who is trying to get it?
+   * @return {?Interpreter.Value} The value of the property, or undefined.
+   */
+  intrp.Object.prototype.getElement = function(index, perms) {
+    if (perms === null || this.destroyed || intrp.audits_.size) {
+      return this.get(String(index), perms);
+    }
+    return this.properties[index];
+  };
 
+  /**
+   * As .set, but with the key an array index given as a number.  Only
+   * replacing an existing element of an Array (by far the most common
+   * case, e.g. in loops), which neither lengthens it nor adds a
+   * property, is done without converting the index to a string.
+   * @param {number} index Array index of property to set.
+   * @param {?Interpreter.Value} value The new value of the property.
+   * @param {!Interpreter.Owner} perms Who is trying to set it?
+   */
+  intrp.Object.prototype.setElement = function(index, value, perms) {
+    var props = this.properties;
+    if (perms === null || this.destroyed || intrp.audits_.size ||
+        intrp.watchpoints_.size || !Array.isArray(props) ||
+        index >= props.length ||
+        !Object.prototype.hasOwnProperty.call(props, index)) {
+      this.set(String(index), value, perms);
+      return;
+    }
+    if (intrp.dirtyObjects) intrp.dirtyObjects.add(this);
+    try {
+      props[index] = value;
+    } catch (e) {
+      throw intrp.errorNativeToPseudo(e, perms);
+    }
   };
 
   /**
@@ -4594,11 +12117,18 @@ Interpreter.prototype.installTypes = function() {
   intrp.Object.prototype.deleteProperty = function(key, perms) {
     if (perms === null) throw new TypeError("null can't delete");
     // TODO(cpcallen:perms): add "controls"-type perm check.
+    if (this.destroyed) throw intrp.destroyedError_(perms);
+    if (intrp.audits_.size) intrp.audit_(this, key, 'delete', perms);
+    if (intrp.dirtyObjects) intrp.dirtyObjects.add(this);
+    var oldValue = this.properties[key];
     try {
       delete this.properties[key];
     } catch (e) {
       throw intrp.errorNativeToPseudo(e, perms);
     }
+    if (intrp.watchpoints_.size) {
+      intrp.watch_(this, key, oldValue, this.properties[key]);
+    }
     return true;
   };
 
@@ -4616,6 +12146,7 @@ Interpreter.prototype.installTypes = function() {
   intrp.Object.prototype.ownKeys = function(perms) {
     if (perms === null) throw new TypeError("null can't ownPropertyKeys");
     // TODO(cpcallen:perms): add check for (object) readability.
+    if (this.destroyed) throw intrp.destroyedError_(perms);
     return Object.getOwnPropertyNames(this.properties);
   };
 
@@ -4825,7 +12356,7 @@ Interpreter.prototype.installTypes = function() {
   intrp.UserFunction.prototype.call = function(
       intrp, thread, state, thisVal, args) {
     if (this.owner === null) {
-      throw new intrp.Error(state.scope.perms, intrp.PERM_ERROR,
+      throw intrp.permissionDenied_(state.scope.perms,
           'Functions with null owner are not executable');
     }
     var scope = this.instantiateDeclarations_(this.owner, thisVal, args);
@@ -4844,7 +12375,7 @@ Interpreter.prototype.installTypes = function() {
       intrp, thread, state, args) {
     if (!state.info_.funcState) {  // First visit.
       if (this.owner === null) {
-        throw new intrp.Error(state.scope.perms, intrp.PERM_ERROR,
+        throw intrp.permissionDenied_(state.scope.perms,
             'Functions with null owner are not constructable');
       }
       // TODO(cpcallen:perms): Is it really OK to construct if caller
@@ -4954,7 +12485,7 @@ Interpreter.prototype.installTypes = function() {
     // TODO(cpcallen:perms): Consider carefully whose perms should be
     // used where!
     if (this.owner === null) {
-      throw new intrp.Error(state.scope.perms, intrp.PERM_ERROR,
+      throw intrp.permissionDenied_(state.scope.perms,
           'Functions with null owner are not executable');
     }
     var argList = this.args.concat(args);
@@ -4984,7 +12515,7 @@ Interpreter.prototype.installTypes = function() {
     // TODO(cpcallen:perms): Consider carefully whose perms should be
     // used where!
     if (this.owner === null) {
-      throw new intrp.Error(state.scope.perms, intrp.PERM_ERROR,
+      throw intrp.permissionDenied_(state.scope.perms,
           'Functions with null owner are not constructable');
     }
     var argList = this.args.concat(args);
@@ -5116,7 +12647,7 @@ Interpreter.prototype.installTypes = function() {
   intrp.OldNativeFunction.prototype.call = function(
       intrp, thread, state, thisVal, args) {
     if (this.owner === null) {
-      throw new intrp.Error(state.scope.perms, intrp.PERM_ERROR,
+      throw intrp.permissionDenied_(state.scope.perms,
           'Functions with null owner are not executable');
     }
     return this.impl.apply(thisVal, args);
@@ -5131,7 +12662,7 @@ Interpreter.prototype.installTypes = function() {
           /** @type {?} */ (this), intrp, thread, state, args);
     }
     if (this.owner === null) {
-      throw new intrp.Error(state.scope.perms, intrp.PERM_ERROR,
+      throw intrp.permissionDenied_(state.scope.perms,
           'Functions with null owner are not constructable');
     }
     return this.impl.apply(undefined, args);
@@ -5412,6 +12943,31 @@ Interpreter.prototype.installTypes = function() {
   intrp.WeakMap.prototype.constructor = intrp.WeakMap;
   intrp.WeakMap.prototype.class = 'WeakMap';
 
+  /**
+   * Class for a buffer of binary data.  Buffers are immutable (like
+   * strings), so the data can be shared, and need not be copied by
+   * snapshots or tracked for incremental checkpoints.
+   * @constructor
+   * @struct
+   * @extends {Interpreter.prototype.Buffer}
+   * @param {!Buffer=} data The bytes.  N.B.: not copied, so must not
+   *     be modified afterwards.
+   * @param {?Interpreter.Owner=} owner Owner object or null.
+   * @param {?Interpreter.prototype.Object=} proto Prototype object or null.
+   */
+  intrp.Buffer = function(data, owner, proto) {
+    if (!data) return;  // Deserializing
+    intrp.Object.call(/** @type {?} */ (this), owner,
+        (proto === undefined ? intrp.BUFFER : proto));
+    /** @type {!Buffer} */
+    this.data = data;
+    this.defineProperty('length', Descriptor.none.withValue(data.length));
+  };
+
+  intrp.Buffer.prototype = Object.create(intrp.Object.prototype);
+  intrp.Buffer.prototype.constructor = intrp.Buffer;
+  intrp.Buffer.prototype.class = 'Buffer';
+
   /**
    * Class for the user-visible representation of an Interpreter.Thread.
    *
@@ -5435,6 +12991,9 @@ Interpreter.prototype.installTypes = function() {
     this.thread = thread;
     this.thread.wrapper = this;
     this.defineProperty('id', Descriptor.none.withValue(thread.id), owner);
+    // Configurable so Thread.prototype.cancel can later fix it at true.
+    this.defineProperty('cancelled',
+        Descriptor.c.withValue(thread.cancelled), owner);
   };
 
   intrp.Thread.prototype = Object.create(intrp.Object.prototype);
@@ -5615,13 +13174,15 @@ Interpreter.prototype.installTypes = function() {
    * @param {!Interpreter.prototype.Object} proto Prototype object for
    *     new connections.
    * @param {number=} timeLimit Maximum runtime without suspending (in ms).
+   * @param {!Interpreter.ListenOptions=} options Protocol, etc.
    */
-  intrp.Server = function(owner, port, proto, timeLimit) {
+  intrp.Server = function(owner, port, proto, timeLimit, options) {
     // Special excepetion: port === undefined when deserializing, in
     // violation of usual type rules.
     if ((port !== (port >>> 0) || port > 0xffff) && port !== undefined) {
       throw new RangeError('invalid port ' + port);
     }
+    options = options || {};
     /** @type {!Interpreter.Owner} */
     this.owner = owner;
     /** @type {number} */
@@ -5630,8 +13191,45 @@ Interpreter.prototype.installTypes = function() {
     this.proto = proto;
     /** @type {number} */
     this.timeLimit = timeLimit || 0;
+    /**
+     * @type {string} 'tcp', 'websocket', 'telnet', 'http', 'smtp' or
+     *     'sse'.
+     */
+    this.protocol = options.protocol || 'tcp';
+    /**
+     * @type {?Array<string>} Origins WebSocket and SSE clients may come
+     *     from.
+     */
+    this.origins = options.origins || null;
+    /** @type {boolean} Offer telnet and WebSocket clients compression? */
+    this.compress = Boolean(options.compress);
+    /**
+     * @type {!Array<string>} Client protocol features WebSocket clients
+     *     may ask for.
+     */
+    this.features = options.features || [];
+    /** @type {boolean} Wrap connections in TLS? */
+    this.tls = Boolean(options.tls);
+    /** @type {boolean} Expect a PROXY protocol header from proxies? */
+    this.proxy = Boolean(options.proxy);
+    /** @type {number} Grace period (in ms) for sessions to resume. */
+    this.resume = options.resume || 0;
+    /** @type {number} Idle time (in ms) allowed, or 0 if unlimited. */
+    this.idle = options.idle || 0;
+    /** @type {number} Time (in ms) before the idle timeout to warn. */
+    this.idleWarning = Interpreter.idleWarning_(this.idle,
+                                                options.idleWarning);
+    /** @type {number} Interval (in ms) of keepalive checks, or 0. */
+    this.keepalive = (options.keepalive === undefined) ?
+        Interpreter.KEEPALIVE : options.keepalive;
     /** @type {!net.Server} */
     this.server_ = new net.Server({allowHalfOpen: true});
+    /**
+     * Parser of requests, for 'http' Servers (created when first
+     * needed).  Never listens itself; connections are passed to it.
+     * @private @type {?http.Server}
+     */
+    this.http_ = null;
 
     // Create the net.Server instance and set up event handlers but
     // don't yet start it listening.
@@ -5639,6 +13237,7 @@ Interpreter.prototype.installTypes = function() {
     this.server_.on('connection', function(socket) {
       intrp.log('net', 'Connection on :%s from %s:%s',
                 server.port, socket.remoteAddress, socket.remotePort);
+      intrp.countTraffic_(server.port, socket);
       // TODO(cpcallen): Add localhost test here, like this - only
       // also allow IPV6 connections:
       // if (socket.remoteAddress != '127.0.0.1') {
@@ -5648,70 +13247,27 @@ Interpreter.prototype.installTypes = function() {
       //   socket.end('Connection rejected.');
       //   return;
       // }
-
-      // Create new object from proto and call onConnect.
-      var obj = new intrp.Object(server.owner, server.proto);
-      obj.socket = socket;
-      var func = obj.get('onConnect', server.owner);
-      if (func instanceof intrp.Function && server.owner !== null) {
-        // TODO(cpcallen:perms): Is server.owner the correct owner for
-        // the thread?  Note that this will typically be root, and
-        // .onConnect will therefore get caller perms === root, which
-        // is probably dangerous.  Here and several places below.
-        intrp.createThreadForFuncCall(
-            server.owner, func, obj, [], undefined, server.timeLimit);
-      }
-
-      // Handle socket closing completely.
-      socket.on('close', function() {
-        intrp.log('net', 'Connection on :%s from %s:%s closed',
-                  server.port, socket.remoteAddress, socket.remotePort);
-        var func = obj.get('onClose', server.owner);
-        if (func instanceof intrp.Function && server.owner !== null) {
-          intrp.createThreadForFuncCall(
-              server.owner, func, obj, [], undefined, server.timeLimit);
-        }
-      });
-
-      // Handle incoming data from clients.  N.B. that data is a
-      // node buffer object, so we must convert it to a string
-      // before passing it to user code.
-      socket.on('data', function(data) {
-        var func = obj.get('onReceive', server.owner);
-        if (func instanceof intrp.Function && server.owner !== null) {
-          intrp.createThreadForFuncCall(
-              server.owner, func, obj, [String(data)],
-              undefined, server.timeLimit);
-        }
-      });
-
-      // Handle far end closing connection.
-      socket.on('end', function() {
-        intrp.log('net', 'Connection on :%s from %s:%s ended',
-                  server.port, socket.remoteAddress, socket.remotePort);
-        var func = obj.get('onEnd', server.owner);
-        if (func instanceof intrp.Function && server.owner !== null) {
-          intrp.createThreadForFuncCall(
-              server.owner, func, obj, [], undefined, server.timeLimit);
-        }
-      });
-
-      // Handle errors.
-      socket.on('error', function(error) {
-        intrp.log('net', 'Socket error on :%s from %s:%s: %s: %s',
-                  server.port, socket.remoteAddress, socket.remotePort,
-                  error.name, error.message);
-        var func = obj.get('onError', server.owner);
-        if (func instanceof intrp.Function && server.owner !== null) {
-          var userError = intrp.errorNativeToPseudo(error, server.owner);
-          intrp.createThreadForFuncCall(
-              server.owner, func, obj, [userError],
-              undefined, server.timeLimit);
+      if (!server.proxy) {
+        server.admit_(socket);
+        return;
+      } else if (!intrp.isTrustedProxy_(socket.remoteAddress)) {
+        intrp.log('net', 'Rejecting connection on :%s from %s: ' +
+                  'not a trusted proxy', server.port, socket.remoteAddress);
+        socket.destroy();
+        return;
+      }
+      Proxies.readHeader(socket, function(error, client) {
+        if (error) {
+          intrp.log('net', 'Rejecting connection on :%s from %s: %s',
+                    server.port, socket.remoteAddress, error.message);
+          socket.destroy();
+          return;
         }
+        intrp.log('net', 'Connection on :%s via %s is from %s:%s',
+                  server.port, socket.remoteAddress, client.remoteAddress,
+                  client.remotePort);
+        server.admit_(client);
       });
-
-      // TODO(cpcallen): save new object somewhere we can find it
-      // later (when we want to obtain list of connected objects).
     });
 
     this.server_.on('listening', function() {
@@ -5730,6 +13286,498 @@ Interpreter.prototype.installTypes = function() {
     });
   };
 
+  /**
+   * Refuse a newly accepted connection if the client is banned or has
+   * exceeded the 'connect' rate limit; otherwise, complete any TLS
+   * handshake and accept it.  Connections from trusted proxies to
+   * 'http' and 'websocket' Servers are instead checked once the
+   * client's address is known (see .forwarded_).
+   * @private
+   * @param {!net.Socket|!Proxies.Socket} socket The connection.
+   */
+  intrp.Server.prototype.admit_ = function(socket) {
+    var server = this;  // So we can refer to it in handlers below.
+    var forwarded = (server.protocol === 'http' ||
+                     server.protocol === 'sse' ||
+                     server.protocol === 'websocket') &&
+        intrp.isTrustedProxy_(socket.remoteAddress);
+    if (!forwarded && server.refused_(socket.remoteAddress)) {
+      socket.destroy();
+      return;
+    }
+    if (!server.tls) {
+      server.accept_(socket);
+      return;
+    } else if (!intrp.wrapTls) {
+      intrp.log('net', 'Rejecting connection on :%s: TLS not configured',
+                server.port);
+      socket.destroy();
+      return;
+    }
+    var secure = intrp.wrapTls(socket);
+    if (socket instanceof Proxies.Socket) {
+      // A TLSSocket wrapping a plain stream doesn't know the address.
+      Object.defineProperty(secure, 'remoteAddress',
+                            {value: socket.remoteAddress});
+      Object.defineProperty(secure, 'remotePort', {value: socket.remotePort});
+    }
+    var fail = function(error) {
+      intrp.log('net', 'TLS handshake with %s:%s failed: %s',
+                socket.remoteAddress, socket.remotePort, error.message);
+      secure.destroy();
+    };
+    secure.on('error', fail);
+    secure.once('secure', function() {
+      secure.removeListener('error', fail);
+      server.accept_(secure);
+    });
+  };
+
+  /**
+   * Check whether connections (or requests) from a client are to be
+   * refused, because it is banned or has exceeded the 'connect' rate
+   * limit, and if so log why.
+   * @private
+   * @param {string} address The client's address.
+   * @return {boolean} True iff refused.
+   */
+  intrp.Server.prototype.refused_ = function(address) {
+    var ban = Bans.find(intrp.bans_, address);
+    if (ban) {
+      intrp.log('net', 'Rejecting connection on :%s from %s: banned (%s)',
+                this.port, address, ban.reason);
+      return true;
+    }
+    var wait = intrp.rateLimiter_.record('connect', address);
+    if (wait) {
+      intrp.securityEvent_(Interpreter.SecurityEventType.QUOTA, null,
+                           {'quota': 'connect', 'address': address});
+      intrp.log('net', 'Rejecting connection on :%s from %s: ' +
+                'rate limited for %ss', this.port, address,
+                Math.ceil(wait / 1000));
+      return true;
+    }
+    return false;
+  };
+
+  /**
+   * Find the address of the client that made an HTTP request (or
+   * WebSocket opening handshake), as given by any trusted proxy it
+   * came via, and check (as .admit_ did not) whether it is refused.
+   * @private
+   * @param {string} peer Address the request was received from.
+   * @param {!Object<string, (string|!Array<string>|undefined)>} headers
+   *     The request's headers.
+   * @return {?string} The client's address, or null if refused.
+   */
+  intrp.Server.prototype.forwarded_ = function(peer, headers) {
+    if (!intrp.isTrustedProxy_(peer)) return peer;
+    var address = Proxies.forwardedFor(peer, headers, function(address) {
+      return intrp.isTrustedProxy_(address);
+    });
+    if (address === peer) return peer;  // The proxy's own request.
+    return this.refused_(address) ? null : address;
+  };
+
+  /**
+   * Negotiate the version of the client protocol and its optional
+   * features with a WebSocket client (see
+   * Interpreter.CLIENT_PROTOCOL_VERSIONS).
+   * @private
+   * @param {!WebSocket.Request} request The opening request.
+   * @return {?{protocol: (string|undefined), version: number,
+   *            features: !Array<string>}} The subprotocol to select
+   *     (if any), the version it names, and the features agreed; or
+   *     null if the client speaks no version the server does.
+   */
+  intrp.Server.prototype.negotiate_ = function(request) {
+    var offered =
+        WebSocket.parseList(request.headers['sec-websocket-protocol']);
+    if (!offered.length) return {version: 1, features: []};
+    var version = 0;
+    var protocol;
+    for (var i = 0; i < offered.length; i++) {
+      var m = offered[i].match(/^codecity\.v([1-9][0-9]*)$/);
+      var v = m ? Number(m[1]) : 0;
+      if (v > version && Interpreter.CLIENT_PROTOCOL_VERSIONS.includes(v)) {
+        version = v;
+        protocol = offered[i];
+      }
+    }
+    if (!version) return null;
+    var features = [];
+    if (version >= 2) {
+      var q = request.url.indexOf('?');
+      var query = new URLSearchParams((q === -1) ? '' : request.url.slice(q));
+      var server = this;
+      features = WebSocket.parseList(query.get('features') || undefined)
+          .filter(function(feature, index, list) {
+            return server.features.includes(feature) &&
+                list.indexOf(feature) === index;
+          });
+    }
+    return {protocol: protocol, version: version, features: features};
+  };
+
+  /**
+   * Handle a newly accepted connection (once any TLS handshake is
+   * complete), according to the server's protocol.
+   * @private
+   * @param {!net.Socket|!Proxies.Socket} socket The connection.
+   */
+  intrp.Server.prototype.accept_ = function(socket) {
+    var server = this;  // So we can refer to it in handlers below.
+    if (server.protocol === 'http' || server.protocol === 'sse') {
+      if (!server.http_) {
+        server.http_ = http.createServer(function(req, res) {
+          if (server.protocol === 'sse') {
+            server.stream_(req, res);
+          } else {
+            server.request_(req, res);
+          }
+        });
+      }
+      server.http_.emit('connection', socket);
+      return;
+    } else if (server.protocol === 'smtp') {
+      var description = socket.remoteAddress + ':' + socket.remotePort;
+      socket.on('error', function(error) {
+        intrp.log('net', 'SMTP error from %s: %s', description,
+                  error.message);
+      });
+      var maxSize = ('mailMaxSize' in intrp.options) ?
+          intrp.options.mailMaxSize : Interpreter.MAIL_MAX_SIZE;
+      Mail.receive(socket, {
+        name: os.hostname(),
+        maxSize: maxSize,
+        maxRecipients: Interpreter.MAIL_MAX_INBOUND_RECIPIENTS,
+        startTls: server.tls ? null : intrp.wrapTls,
+      }, function(envelope, data) {
+        intrp.log('net', 'Mail on :%s from %s: <%s> to %s', server.port,
+                  description, envelope.from, envelope.to.join(', '));
+        server.mail_(envelope, data);
+      });
+      return;
+    }
+    // WebSocket clients are pinged instead.  (Connections via a proxy
+    // are not net.Sockets, and so have no TCP keepalive.)
+    if (server.keepalive && server.protocol !== 'websocket' &&
+        typeof socket.setKeepAlive === 'function') {
+      socket.setKeepAlive(true, server.keepalive);
+    }
+    if (server.protocol === 'telnet') {
+      server.connect_(new Telnet.Connection(socket,
+                                            {compress: server.compress}));
+      return;
+    } else if (server.protocol !== 'websocket') {
+      server.connect_(socket);
+      return;
+    }
+    // Complete the WebSocket opening handshake, then perform the
+    // same login handshake as connectServer: the ID cookie set by
+    // loginServer is passed on (see attachSocket_).
+    // Errors before the handshake is complete just drop the connection.
+    socket.on('error', function() {});
+    WebSocket.readRequest(socket, function(error, request, head) {
+      if (error) {
+        intrp.log('net', 'Rejecting WebSocket from %s:%s: %s',
+                  socket.remoteAddress, socket.remotePort, error.message);
+        WebSocket.reject(socket, 400, 'Bad Request');
+        return;
+      }
+      var address = server.forwarded_(socket.remoteAddress, request.headers);
+      if (address === null) {
+        WebSocket.reject(socket, 403, 'Forbidden');
+        return;
+      }
+      var origin = request.headers['origin'];
+      if (server.origins && !server.origins.includes(origin)) {
+        intrp.log('net', 'Rejecting WebSocket from %s:%s: origin %s',
+                  socket.remoteAddress, socket.remotePort, origin);
+        WebSocket.reject(socket, 403, 'Forbidden');
+        return;
+      }
+      var cookies = WebSocket.parseCookies(request.headers['cookie']);
+      var id = cookies['ID'];
+      if (!id || !/^[0-9a-f]+$/.test(id)) {
+        intrp.log('net', 'Rejecting WebSocket from %s:%s: not logged in',
+                  socket.remoteAddress, socket.remotePort);
+        WebSocket.reject(socket, 401, 'Unauthorized');
+        return;
+      }
+      var negotiated = server.negotiate_(request);
+      if (!negotiated) {
+        intrp.log('net', 'Rejecting WebSocket from %s:%s: unsupported ' +
+                  'protocol versions %s', socket.remoteAddress,
+                  socket.remotePort, request.headers['sec-websocket-protocol']);
+        WebSocket.reject(socket, 400, 'Unsupported Protocol Version');
+        return;
+      }
+      var session = server.resume ?
+          intrp.sessions_.find(cookies['SESSION'], id) : null;
+      var token = null;
+      var wsOptions = {
+        protocol: negotiated.protocol,
+        binary: negotiated.features.includes('binary'),
+        deflate: server.compress,
+        keepalive: server.keepalive,
+      };
+      if (server.resume && !session) {
+        token = Sessions.newToken();
+        wsOptions.headers = {'Set-Cookie': 'SESSION=' + token +
+            '; Path=/; HttpOnly; SameSite=Strict' +
+            (server.tls ? '; Secure' : '')};
+      }
+      var connection =
+          new WebSocket.Connection(socket, request, head, wsOptions);
+      connection.remoteAddress = address;
+      /** @type {!Interpreter.ClientProtocol} */
+      var client = {
+        version: negotiated.version,
+        features: negotiated.features,
+        compress: connection.deflate,
+      };
+      if (client.version >= 2) {
+        connection.write(JSON.stringify({
+          type: 'hello',
+          version: client.version,
+          features: client.features,
+          compress: client.compress,
+        }));
+      }
+      var description = intrp.nativeToPseudo(client, server.owner);
+      if (session) {
+        intrp.log('net', 'Resuming session on :%s from %s:%s', server.port,
+                  socket.remoteAddress, socket.remotePort);
+        session.resume(connection, description);
+      } else if (token) {
+        server.connect_(
+            intrp.sessions_.create(connection, token, server.resume, id),
+            id, description);
+      } else {
+        server.connect_(connection, id, description);
+      }
+    });
+  };
+
+  /**
+   * Handle a request to an 'http' Server: once the body has been
+   * received, create a new object from the server's proto, connected
+   * to the response, and call its .onRequest method with an object
+   * describing the request.  Its .onClose method is called once the
+   * response is complete (or the client has gone away).
+   * @private
+   * @param {!http.IncomingMessage} req The request.
+   * @param {!http.ServerResponse} res The response.
+   */
+  intrp.Server.prototype.request_ = function(req, res) {
+    var server = this;
+    var owner = server.owner;
+    var address = server.forwarded_(String(req.socket.remoteAddress),
+                                    req.headers);
+    var description = (address || req.socket.remoteAddress) + ':' +
+        req.socket.remotePort + ' ' + req.method + ' ' + req.url;
+    var refuse = function(status, message) {
+      intrp.log('net', 'Refusing request from %s: %s', description, message);
+      res.writeHead(status, {'Content-Type': 'text/plain'});
+      res.end(message + '\n');
+    };
+    res.on('error', function(error) {
+      intrp.log('net', 'Error responding to %s: %s', description,
+                error.message);
+    });
+    // Connections are not kept alive, since http_ (never having
+    // listened itself) cannot close idle ones when unlistened.
+    res.setHeader('Connection', 'close');
+    if (address === null) {
+      refuse(403, 'Forbidden');
+      req.resume();
+      return;
+    }
+    var maxRequests = ('httpMaxRequests' in intrp.options) ?
+        intrp.options.httpMaxRequests : Interpreter.HTTP_MAX_REQUESTS;
+    var count = intrp.httpRequests_.get(owner) || 0;
+    if (count >= maxRequests) {
+      intrp.securityEvent_(Interpreter.SecurityEventType.QUOTA, owner,
+          {'quota': 'httpMaxRequests', 'limit': maxRequests});
+      res.setHeader('Retry-After', '1');
+      refuse(503, 'Too many requests in progress');
+      req.resume();
+      return;
+    }
+    intrp.httpRequests_.set(owner, count + 1);
+    var done = false;
+    var finish = function() {
+      if (done) return;
+      done = true;
+      var n = intrp.httpRequests_.get(owner) - 1;
+      if (n > 0) {
+        intrp.httpRequests_.set(owner, n);
+      } else {
+        intrp.httpRequests_.delete(owner);
+      }
+    };
+    res.on('close', finish);
+
+    // Read body.
+    var maxBody = ('httpMaxBody' in intrp.options) ?
+        intrp.options.httpMaxBody : Interpreter.HTTP_MAX_BODY;
+    var chunks = [];
+    var length = 0;
+    req.on('data', function(chunk) {
+      length += chunk.length;
+      if (length > maxBody) {
+        chunks = null;
+        refuse(413, 'Request body too large');
+        req.destroy();
+      } else if (chunks) {
+        chunks.push(chunk);
+      }
+    });
+    req.on('error', function() {});  // Client went away; res will close.
+    req.on('end', function() {
+      if (!chunks || res.writableEnded) return;
+      var described = Interpreter.describeRequest_(req, String(address));
+      described['body'] = Buffer.concat(chunks).toString('utf8');
+      ['url', 'path', 'query', 'body'].forEach(function(key) {
+        intrp.taint(described[key]);
+      });
+      var request = intrp.nativeToPseudo(described, owner);
+
+      var obj = new intrp.Object(owner, server.proto);
+      var handle = new Interpreter.HostHandle(
+          Interpreter.HostHandle.Kind.CONNECTION, obj, description, owner,
+          server.timeLimit, res);
+      obj.socket = handle;
+      intrp.hostHandles_.add(handle);
+      res.on('close', function() {
+        intrp.hostHandles_.delete(handle);
+        var func = obj.get('onClose', owner);
+        if (func instanceof intrp.Function && owner !== null) {
+          intrp.createThreadForFuncCall(
+              owner, func, obj, [], undefined, server.timeLimit);
+        }
+      });
+      var func = obj.get('onRequest', owner);
+      if (!(func instanceof intrp.Function) || owner === null) {
+        refuse(404, 'Not Found');
+        return;
+      }
+      intrp.createThreadForFuncCall(
+          owner, func, obj, [request], undefined, server.timeLimit);
+    });
+  };
+
+  /**
+   * Handle a request to an 'sse' Server: create a new object from the
+   * server's proto, connected to an event stream sent in response, and
+   * call its .onConnect method with an object describing the request.
+   * @private
+   * @param {!http.IncomingMessage} req The request.
+   * @param {!http.ServerResponse} res The response.
+   */
+  intrp.Server.prototype.stream_ = function(req, res) {
+    var server = this;
+    var address = server.forwarded_(String(req.socket.remoteAddress),
+                                    req.headers);
+    var description = (address || req.socket.remoteAddress) + ':' +
+        req.socket.remotePort;
+    var refuse = function(status, message) {
+      intrp.log('net', 'Refusing event stream to %s: %s', description,
+                message);
+      res.writeHead(status, {'Content-Type': 'text/plain'});
+      res.end(message + '\n');
+      req.resume();
+    };
+    res.on('error', function(error) {
+      intrp.log('net', 'Error streaming events to %s: %s', description,
+                error.message);
+    });
+    // As for request_, connections are not kept alive.
+    res.setHeader('Connection', 'close');
+    if (address === null) {
+      refuse(403, 'Forbidden');
+      return;
+    } else if (req.method !== 'GET') {
+      res.setHeader('Allow', 'GET');
+      refuse(405, 'Method Not Allowed');
+      return;
+    }
+    var headers = {};
+    var origin = req.headers['origin'];
+    if (server.origins && origin !== undefined) {
+      if (!server.origins.includes(origin)) {
+        refuse(403, 'Forbidden');
+        return;
+      }
+      // Allow cross-origin EventSources (including with credentials,
+      // so that pages can be logged in).
+      headers['Access-Control-Allow-Origin'] = origin;
+      headers['Access-Control-Allow-Credentials'] = 'true';
+      headers['Vary'] = 'Origin';
+    }
+    var request = intrp.nativeToPseudo(
+        Interpreter.describeRequest_(req, address), server.owner);
+    var connection = new SSE.Connection(req, res, headers);
+    connection.remoteAddress = address;
+    var obj = new intrp.Object(server.owner, server.proto);
+    intrp.attachSocket_(obj, connection, server.owner, server.timeLimit,
+        description, 'on :' + server.port + ' from ' + description,
+        {connected: true, request: request});
+  };
+
+  /**
+   * Handle a message received by an 'smtp' Server: parse it, and call
+   * the server's proto's .onMail method with an object describing it.
+   * @private
+   * @param {!Mail.Envelope} envelope The message's envelope.
+   * @param {!Buffer} data The message.
+   */
+  intrp.Server.prototype.mail_ = function(envelope, data) {
+    var owner = this.owner;
+    var func = this.proto.get('onMail', owner);
+    if (!(func instanceof intrp.Function) || owner === null) return;
+    var parsed = Mail.parse(data);
+    var message = intrp.nativeToPseudo({
+      sender: envelope.from,
+      recipients: envelope.to,
+      from: parsed.from,
+      subject: parsed.subject,
+      text: parsed.text,
+      headers: Object.assign({}, parsed.headers),
+      secure: envelope.secure,
+    }, owner);
+    intrp.createThreadForFuncCall(
+        owner, func, this.proto, [message], undefined, this.timeLimit);
+  };
+
+  /**
+   * Connect a new object (created from the server's proto) to a newly
+   * accepted connection, and call its .onConnect method; then call
+   * its .onReceive, .onEnd, .onClose and .onError methods as data
+   * arrives, etc.
+   * @private
+   * @param {!net.Socket|!WebSocket.Connection|!Telnet.Connection|
+   *     !Sessions.Session} socket The connection.
+   * @param {string=} identity Login ID presented by the client, to
+   *     pass to .onAuthenticate (see Interpreter.prototype.attachSocket_).
+   * @param {!Interpreter.prototype.Object=} client Description of the
+   *     client protocol negotiated (see Interpreter.ClientProtocol), to
+   *     pass to .onConnect.
+   */
+  intrp.Server.prototype.connect_ = function(socket, identity, client) {
+    var obj = new intrp.Object(this.owner, this.proto);
+    intrp.attachSocket_(obj, socket, this.owner, this.timeLimit,
+        socket.remoteAddress + ':' + socket.remotePort,
+        'on :' + this.port + ' from ' + socket.remoteAddress + ':' +
+            socket.remotePort,
+        {connected: true, request: client, identity: identity,
+         address: socket.remoteAddress, idle: this.idle,
+         idleWarning: this.idleWarning});
+    // TODO(cpcallen): save new object somewhere we can find it
+    // later (when we want to obtain list of connected objects).
+  };
+
   /**
    * Start a Server object listening on its assigned port.
    * @param {!function(!Error=)=} callback
@@ -5759,7 +13807,18 @@ Interpreter.prototype.installTypes = function() {
       if (callback) callback(error);
     };
     this.server_.on(events.errorMonitor, hook);
-    this.server_.listen(this.port, hook);
+    // Adopt an inherited socket for this port, if there is one (but
+    // only once: it is closed when the Server stops listening).
+    var fds = intrp.inheritedFds;
+    if (fds && fds.has(this.port)) {
+      var fd = fds.get(this.port);
+      fds.delete(this.port);
+      intrp.log('net', 'Listening on :%s using inherited socket (fd %d)',
+                this.port, fd);
+      this.server_.listen({fd: fd}, hook);
+    } else {
+      this.server_.listen(this.port, hook);
+    }
   };
 
   /**
@@ -5928,6 +13987,67 @@ var isMemberRef = function(node) {
   return node['type'] === 'MemberExpression';
 };
 
+/**
+ * Returns true iff value is a number which is an array index (an
+ * integer from 0 to 2**32 - 2; ES5.1 §15.4), and so can be used as a
+ * property key without first being converted to a string (see
+ * Interpreter.prototype.Object.prototype.getElement).
+ * @param {?Interpreter.Value} value The value to be tested.
+ * @return {boolean} True if value is an array index.
+ */
+var isArrayIndex = function(value) {
+  return typeof value === 'number' && (value >>> 0) === value &&
+      value !== 0xffffffff;
+};
+
+/**
+ * Describe an expression as V8 does in error messages such as "o.f is
+ * not a function" (see Interpreter.Options.v8Messages): identifiers,
+ * literals and member expressions as written, calls as "f(...)", and
+ * anything more complicated as "(intermediate value)".
+ * @param {!Node} node AST node for the expression.
+ * @return {string} The description.
+ */
+var describeExpression = function(node) {
+  switch (node['type']) {
+    case 'Identifier':
+      return node['name'];
+    case 'ThisExpression':
+      return 'this';
+    case 'Literal':
+      var value = node['value'];
+      return typeof value === 'string' ? JSON.stringify(value) :
+          String(node['regex'] ? node['raw'] : value);
+    case 'ArrayExpression':
+      return '[' + node['elements'].map(function(element) {
+        return element ? describeExpression(element) : '';
+      }).join(',') + ']';
+    case 'ObjectExpression':
+      return node['properties'].length ? '{(intermediate value)}' : '{}';
+    case 'MemberExpression':
+      var object = describeExpression(node['object']);
+      var property = node['property'];
+      if (!node['computed']) {
+        return object + '.' + property['name'];
+      } else if (property['type'] === 'Literal' &&
+                 typeof property['value'] === 'string') {
+        return object + '.' + property['value'];
+      }
+      return object + '[' + describeExpression(property) + ']';
+    case 'CallExpression':
+      return describeExpression(node['callee']) + '(...)';
+    case 'BinaryExpression':
+    case 'LogicalExpression':
+      return '(' + describeExpression(node['left']) + ' ' +
+          node['operator'] + ' ' + describeExpression(node['right']) + ')';
+    case 'SequenceExpression':
+      return '(' + node['expressions'].map(describeExpression).join(' , ') +
+          ')';
+    default:
+      return '(intermediate value)';
+  }
+};
+
 /**
  * Walk an AST (or sub-tree), collecting bound names by looking for
  * VariableDeclaration and FunctionDeclaration nodes, and checking for
@@ -6097,7 +14217,7 @@ stepFuncs_['AssignmentExpression'] = function(thread, stack, state, node) {
         // TODO(ES6): Check that func does not already have a 'name'
         // own property before calling setName?  (Spec requires, but
         // unclear why since we know RHS is anonymous.  Proxies?)
-        func.setName(state.ref[1]);
+        func.setName(String(state.ref[1]));
       }
       break;
     // All the rest are simple and similar.
@@ -6116,6 +14236,13 @@ stepFuncs_['AssignmentExpression'] = function(thread, stack, state, node) {
       throw new SyntaxError(
           'Unknown assignment expression: ' + node['operator']);
   }
+  if (node['operator'] === '+=' && typeof value === 'string') {
+    this.checkStringSize_(value, state.scope.perms);
+    if (this.tainted_.size &&
+        (this.isTainted(state.tmp_) || this.isTainted(rightValue))) {
+      this.taint(value);
+    }
+  }
   this.setValue(state.ref, value, state.scope.perms);
   stack.pop();
   stack[stack.length - 1].value = value;
@@ -6139,15 +14266,31 @@ stepFuncs_['BinaryExpression'] = function(thread, stack, state, node) {
     state.tmp_ = state.value;
     return new Interpreter.State(node['right'], state.scope);
   }
-  // state.step_ === 2: Got operands; do binary operation.
-  var leftValue = state.tmp_;
-  var rightValue = state.value;
+  if (state.step_ === 2 && node['operator'] === 'in' &&
+      state.tmp_ instanceof this.Object &&
+      state.value instanceof this.Object) {
+    // Convert object key using ToPropertyKey, which may call user
+    // code.  Save right; left will be the resulting key.
+    state.step_ = 3;
+    var key = state.tmp_;
+    state.tmp_ = state.value;
+    return this.toPropertyKey_(key, state.scope.perms);
+  }
+  // state.step_ === 2 (or 3, for 'in' with an object key): Got
+  // operands; do binary operation.
+  if (state.step_ === 3) {
+    var leftValue = state.value;
+    var rightValue = state.tmp_;
+  } else {
+    leftValue = state.tmp_;
+    rightValue = state.value;
+  }
   var /** ?Interpreter.Value */ value;
   switch (node['operator']) {
     case '==':  value = leftValue ==  rightValue; break;
     case '!=':  value = leftValue !=  rightValue; break;
-    case '===': value = leftValue === rightValue; break;
-    case '!==': value = leftValue !== rightValue; break;
+    case '===': value = Interpreter.strictEquals(leftValue, rightValue); break;
+    case '!==': value = !Interpreter.strictEquals(leftValue, rightValue); break;
     case '>':   value = leftValue >   rightValue; break;
     case '>=':  value = leftValue >=  rightValue; break;
     case '<':   value = leftValue <   rightValue; break;
@@ -6165,21 +14308,36 @@ stepFuncs_['BinaryExpression'] = function(thread, stack, state, node) {
     case '>>>': value = leftValue >>> rightValue; break;
     case 'in':
       if (!(rightValue instanceof this.Object)) {
-      throw new this.Error(state.scope.perms, this.TYPE_ERROR,
+        throw new this.Error(state.scope.perms, this.TYPE_ERROR,
+            this.options.v8Messages ?
+            "Cannot use 'in' operator to search for '" +
+                this.v8Key_(leftValue) + "' in " + rightValue :
             "'in' expects an object, not '" + rightValue + "'");
       }
       value = rightValue.has(String(leftValue), state.scope.perms);
       break;
     case 'instanceof':
       if (!(rightValue instanceof this.Function)) {
-        throw new this.Error(state.scope.perms, this.TYPE_ERROR,
-            'Right-hand side of instanceof is not a function');
+        if (!this.options.v8Messages) {
+          var message = 'Right-hand side of instanceof is not a function';
+        } else {
+          message = "Right-hand side of 'instanceof' is not " +
+              (rightValue instanceof this.Object ? 'callable' : 'an object');
+        }
+        throw new this.Error(state.scope.perms, this.TYPE_ERROR, message);
       }
       value = rightValue.hasInstance(leftValue, state.scope.perms);
       break;
     default:
       throw new SyntaxError('Unknown binary operator: ' + node['operator']);
   }
+  if (typeof value === 'string') {
+    this.checkStringSize_(value, state.scope.perms);
+    if (this.tainted_.size &&
+        (this.isTainted(leftValue) || this.isTainted(rightValue))) {
+      this.taint(value);
+    }
+  }
   stack.pop();
   stack[stack.length - 1].value = value;
 };
@@ -6301,6 +14459,9 @@ stepFuncs_['CallExpression'] = function(thread, stack, state, node) {
     state.step_ = 3;  // N.B: SEE NOTE 1 ABOVE!
     if (!(state.tmp_ instanceof this.Function)) {
       throw new this.Error(state.scope.perms, this.TYPE_ERROR,
+          this.options.v8Messages ?
+          describeExpression(node['callee']) + ' is not a ' +
+              (node['type'] === 'NewExpression' ? 'constructor' : 'function') :
           state.tmp_ + ' is not a function');
     }
     state.info_.func = state.tmp_;
@@ -6356,6 +14517,17 @@ stepFuncs_['Call'] = function(thread, stack, state, node) {
     }
     var func = state.info_.func;
     var args = state.info_.arguments;
+    if (func.destroyed) {
+      stack.pop();  // Remove not-called function from stack trace.
+      throw this.destroyedError_(state.scope.perms);
+    } else if (state.scope.sandbox) {
+      try {
+        this.checkSandbox_(state.scope, func);
+      } catch (e) {
+        stack.pop();  // Remove not-called function from stack trace.
+        throw e;
+      }
+    }
     // Abort call if out of time, unless it's a call to Thread.suspend().
     if (func !== this.builtins.get('Thread.suspend')) {
       try {
@@ -6386,13 +14558,23 @@ stepFuncs_['Call'] = function(thread, stack, state, node) {
           throw new Error('Unknown FunctionResult??');
       }
     }
+    if (typeof r === 'string') {
+      this.checkStringSize_(r, state.scope.perms);
+      if (this.tainted_.size && (this.isTainted(state.info_.this) ||
+                                 args.some(this.isTainted, this))) {
+        this.taint(r);
+      }
+    }
     state.value = r;
   }
   // state.step_ === 1: Execution done; handle return value.
   stack.pop();
-  // Previous stack frame may not exist if this is a setTimeout function.
+  // Previous stack frame may not exist if this is a setTimeout function,
+  // in which case the return value is the thread's.
   if (stack.length > 0) {
     stack[stack.length - 1].value = state.value;
+  } else {
+    thread.value = state.value;
   }
 };
 
@@ -6804,6 +14986,8 @@ stepFuncs_['MemberExpression'] = function(thread, stack, state, node) {
       state.step_ = 2;
       return new Interpreter.State(node['property'], state.scope);
     }
+  } else if (state.step_ === 3) {  // Got key from ToPropertyKey.
+    state.value = String(state.value);
   }
   // TODO(cpcallen): add test for order of following two specification
   // method calls from the algorithm in ES6 §2.3.2.1.
@@ -6811,15 +14995,47 @@ stepFuncs_['MemberExpression'] = function(thread, stack, state, node) {
   var /** ?Interpreter.Value */ base = state.tmp_;
   var /** !Interpreter.Owner */ perms = state.scope.perms;
   if (base === null || base === undefined) {
-    throw new this.Error(perms, this.TYPE_ERROR,
+    throw new this.Error(perms, this.TYPE_ERROR, this.options.v8Messages ?
+        this.v8MemberMessage_(stack, node, base, state.value) :
         "Can't convert " + base + ' to Object');
   }
-  // Step 9: propertyKey = ToPropertyKey(propertyNameValue).
+  if (state.step_ === 2 && state.value instanceof this.Object) {
+    // Step 9: propertyKey = ToPropertyKey(propertyNameValue), which
+    // for an object key may call its .toString or .valueOf method.
+    state.step_ = 3;
+    return this.toPropertyKey_(state.value, perms);
+  }
+  if (node['computed'] && isArrayIndex(state.value) &&
+      base instanceof this.Object && !state.scope.sandbox) {
+    // Fast path for a[i]: the key is left as a number, and so is
+    // looked up without being converted to a string (and, since
+    // .properties of an Array is a native array, a string back to an
+    // index).  References with such keys are handled by .getValue
+    // and .setValue.
+    //
+    // Only keys that are numbers take this path: a['1'] is looked up
+    // as usual.  Nor do primitives: they are boxed (below) as
+    // Interpreter.prototype.Box, which is not an intrp.Object, and
+    // whose .get (reading e.g. a string's characters from the
+    // primitive itself) .getElement does not replicate.
+    var index = /** @type {number} */(state.value);
+    stack.pop();
+    if (state.wantRef_) {
+      stack[stack.length - 1].ref = [base, index];
+    } else {
+      stack[stack.length - 1].value = base.getElement(index, perms);
+    }
+    return;
+  }
+  // Step 9: propertyKey = ToPropertyKey(propertyNameValue).  (Object
+  // keys have already been converted, above.)
   var /** string */ key =
       node['computed'] ? String(state.value) : node['property']['name'];
   stack.pop();  // Must be after last throw new this.Error...
   if (state.wantRef_) {
     stack[stack.length - 1].ref = [base, key];
+  } else if (state.scope.sandbox) {
+    stack[stack.length - 1].value = this.getProperty_(state.scope, base, key);
   } else {
     // toObject guaranteed not to throw because of earlier check.
     stack[stack.length - 1].value = this.toObject(base, perms).get(key, perms);
@@ -6846,7 +15062,8 @@ stepFuncs_['ObjectExpression'] = function(thread, stack, state, node) {
     if (keyNode['type'] === 'Identifier') {
       var /** string */ key = keyNode['name'];
     } else if (keyNode['type'] === 'Literal') {
-      key = keyNode['value'];
+      // ToPropertyKey: {1: x}, {1.0: x} and {'1': x} are equivalent.
+      key = String(keyNode['value']);
     } else {
       throw new SyntaxError('Unknown object structure: ' + keyNode['type']);
     }
@@ -6945,7 +15162,7 @@ Interpreter.SwitchInfo;
  */
 stepFuncs_['SwitchStatement'] = function(thread, stack, state, node) {
   // First check return value to see if case test succeeded.
-  if (state.step_ === 2 && state.value === state.tmp_) {
+  if (state.step_ === 2 && Interpreter.strictEquals(state.value, state.tmp_)) {
     state.step_ = 3;
   }
   switch (state.step_) {
@@ -7104,7 +15321,7 @@ stepFuncs_['UnaryExpression'] = function(thread, stack, state, node) {
         throw new Error('Uncaught illegal deletion of unqualified identifier');
       }
       var obj = this.toObject(state.ref[0], state.scope.perms);
-      value = obj.deleteProperty(state.ref[1], state.scope.perms);
+      value = obj.deleteProperty(String(state.ref[1]), state.scope.perms);
     } else {
       // Attempted to deleted some expression that wasn't a reference
       // to a variable or property.  Skip delete; return true.
@@ -7224,6 +15441,9 @@ for (var name in stepFuncs_) {
 
 exports = module.exports = Interpreter;
 
+// For migrate.js.
+Interpreter.SERIALIZATION_VERSION = SERIALIZATION_VERSION;
+
 exports.testOnly = {
   getBoundNames: getBoundNames,
   hasArgumentsOrEval: hasArgumentsOrEval,
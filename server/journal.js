@@ -0,0 +1,287 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Write-ahead journal of changes made since the most
+ * recent checkpoint, for recovery after a crash.
+ *
+ * A journal file begins with the four magic bytes '\0CCJ' and a
+ * version byte, followed by any number of entries, each appended (and
+ * for heap deltas, synced to disk) as it is made:
+ *
+ *     kind      1 byte: Journal.Kind.
+ *     length    4 bytes, big-endian: length of payload.
+ *     time      8 bytes: when the entry was made, in milliseconds
+ *               since the epoch (a big-endian double).
+ *     checksum  8 bytes: start of SHA-256 hash of kind, length, time
+ *               and payload.
+ *     payload   An encoded flatpack (optionally compressed and/or
+ *               encrypted as for checkpoint files).
+ *
+ * (Version 1 journals, which can still be read, lack the time.)
+ *
+ * The payload of a DELTA entry is an incremental serialization: the
+ * records of all objects changed since the previous entry (or the
+ * checkpoint).  The payload of an EFFECT entry is a single record
+ * describing an external effect (e.g., data written to a network
+ * connection) that the server has carried out.  Effects recorded
+ * after the last DELTA entry are ones whose consequences for the
+ * state of the world will have been lost in a crash.
+ *
+ * If the server crashes while appending an entry, the journal will
+ * end with an incomplete one; this (and anything after it) is
+ * ignored when the journal is read.
+ */
+'use strict';
+
+var crypto = require('crypto');
+var Flatpack = require('./flatpack');
+var fs = require('fs');
+
+var Journal = {};
+
+/** @private @const {!Buffer} */
+Journal.MAGIC_ = Buffer.from([0x00, 0x43, 0x43, 0x4a]);  // '\0CCJ'
+
+/** @private @const {number} */
+Journal.VERSION_ = 2;
+
+/**
+ * Length of entry header (kind, length, time and checksum), by version.
+ * @private @const {!Object<number,number>}
+ */
+Journal.ENTRY_HEADER_LENGTH_ = {1: 1 + 4 + 8, 2: 1 + 4 + 8 + 8};
+
+/**
+ * Kinds of journal entry.
+ * @enum {number}
+ */
+Journal.Kind = {
+  DELTA: 0x44,  // 'D'
+  EFFECT: 0x45,  // 'E'
+};
+
+/**
+ * An entry read from a journal.  .time is when it was made (in
+ * milliseconds since the epoch), or null if not known.
+ * @typedef {{kind: !Journal.Kind, time: ?number, records: !Array<!Object>}}
+ */
+Journal.Entry;
+
+/**
+ * A writer for journal files.  Creates (or truncates) the file.
+ * @constructor
+ * @struct
+ * @param {string} filename Name of file to write.
+ * @param {string|undefined} format 'binary' or 'json'.  (Default: 'json'.)
+ * @param {!Envelope.Options} options Compression and encryption to apply.
+ */
+Journal.Writer = function(filename, format, options) {
+  /** @const {string} */
+  this.filename = filename;
+  /** @private @const {string|undefined} */
+  this.format_ = format;
+  /** @private @const {!Envelope.Options} */
+  this.options_ = options;
+  /** @private {?number} File descriptor, or null once closed. */
+  this.fd_ = fs.openSync(filename, 'w');
+  this.write_(Buffer.concat(
+      [Journal.MAGIC_, Buffer.from([Journal.VERSION_])]), true);
+};
+
+/**
+ * Append an incremental serialization to the journal, and wait for it
+ * to reach the disk.
+ * @param {!Array<!Object>} records Records of objects changed since
+ *     the previous DELTA entry.
+ */
+Journal.Writer.prototype.appendDelta = function(records) {
+  this.append_(Journal.Kind.DELTA, records, true);
+};
+
+/**
+ * Append a record of an external effect to the journal.  For speed,
+ * this does not wait for it to reach the disk (so it would survive a
+ * crash of the server, but not of the operating system).
+ * @param {!Object} effect JSON-compatible description of the effect.
+ */
+Journal.Writer.prototype.appendEffect = function(effect) {
+  this.append_(Journal.Kind.EFFECT, [effect], false);
+};
+
+/**
+ * Close the journal file.
+ */
+Journal.Writer.prototype.close = function() {
+  if (this.fd_ === null) return;
+  fs.closeSync(this.fd_);
+  this.fd_ = null;
+};
+
+/**
+ * Append an entry to the journal.
+ * @private
+ * @param {!Journal.Kind} kind Kind of entry.
+ * @param {!Array<!Object>} records Records to encode as the payload.
+ * @param {boolean} sync Wait for the entry to reach the disk?
+ */
+Journal.Writer.prototype.append_ = function(kind, records, sync) {
+  var payload = Flatpack.encode(records, this.format_, this.options_);
+  var header = Buffer.alloc(Journal.ENTRY_HEADER_LENGTH_[Journal.VERSION_]);
+  header[0] = kind;
+  header.writeUInt32BE(payload.length, 1);
+  header.writeDoubleBE(Date.now(), 5);
+  Journal.checksum_(Journal.VERSION_, header, payload).copy(header, 13);
+  // Written all at once, so that a crash cannot interleave entries.
+  this.write_(Buffer.concat([header, payload]), sync);
+};
+
+/**
+ * Write data to the file.
+ * @private
+ * @param {!Buffer} data Data to write.
+ * @param {boolean} sync Wait for the data to reach the disk?
+ */
+Journal.Writer.prototype.write_ = function(data, sync) {
+  if (this.fd_ === null) throw new Error('Journal is closed');
+  for (var offset = 0; offset < data.length; ) {
+    offset += fs.writeSync(this.fd_, data, offset);
+  }
+  if (sync) fs.fsyncSync(this.fd_);
+};
+
+/**
+ * Read a journal file.
+ * @param {string} filename Name of file to read.
+ * @param {?Buffer=} key Decryption key, if any.
+ * @return {{entries: !Array<!Journal.Entry>, torn: boolean}} The
+ *     complete entries in the journal, and whether it ended with an
+ *     incomplete or damaged one (which was ignored).
+ */
+Journal.read = function(filename, key) {
+  var scan = Journal.scan_(fs.readFileSync(filename));
+  return {
+    entries: scan.entries.map(function(entry) {
+      return {kind: entry.kind, time: entry.time,
+              records: Flatpack.decode(entry.payload, key)};
+    }),
+    torn: scan.torn,
+  };
+};
+
+/**
+ * Get the time of the last complete DELTA entry in a journal file.
+ * @param {string} filename Name of file to read.
+ * @return {?number} Time (in milliseconds since the epoch), or null
+ *     if there is no such entry or its time is not known.
+ */
+Journal.lastDeltaTime = function(filename) {
+  var entries = Journal.scan_(fs.readFileSync(filename)).entries;
+  for (var i = entries.length - 1; i >= 0; i--) {
+    if (entries[i].kind === Journal.Kind.DELTA) return entries[i].time;
+  }
+  return null;
+};
+
+/**
+ * Copy the entries of a journal file made no later than a given time
+ * to a new journal file (e.g., to restore the world as it was then).
+ * Entries whose time is not known are not copied, nor is anything
+ * after them.
+ * @param {string} source Name of file to read.
+ * @param {string} dest Name of file to write.
+ * @param {number} time Latest time to copy (in milliseconds since the
+ *     epoch).
+ * @return {number} The number of DELTA entries copied.
+ */
+Journal.copyUntil = function(source, dest, time) {
+  var data = fs.readFileSync(source);
+  var scan = Journal.scan_(data);
+  var end = Journal.MAGIC_.length + 1;
+  var deltas = 0;
+  for (var i = 0; i < scan.entries.length; i++) {
+    var entry = scan.entries[i];
+    if (entry.time === null || entry.time > time) break;
+    if (entry.kind === Journal.Kind.DELTA) deltas++;
+    end = entry.end;
+  }
+  fs.writeFileSync(dest, data.subarray(0, end));
+  return deltas;
+};
+
+/**
+ * Find the complete entries in the contents of a journal file, without
+ * decoding their payloads.
+ * @private
+ * @param {!Buffer} data Contents of journal file.
+ * @return {{entries: !Array<{kind: !Journal.Kind, time: ?number,
+ *                            payload: !Buffer, end: number}>,
+ *           torn: boolean}} The entries (with the offset of the end of
+ *     each), and whether the data ended with an incomplete or damaged
+ *     one.
+ */
+Journal.scan_ = function(data) {
+  var start = Journal.MAGIC_.length + 1;
+  if (data.length < start ||
+      !data.subarray(0, Journal.MAGIC_.length).equals(Journal.MAGIC_)) {
+    throw new TypeError('Not a journal file');
+  }
+  var version = data[Journal.MAGIC_.length];
+  var headerLength = Journal.ENTRY_HEADER_LENGTH_[version];
+  if (!headerLength) {
+    throw new RangeError('Unsupported journal version ' + version);
+  }
+  var entries = [];
+  for (var offset = start; offset < data.length; ) {
+    var payloadStart = offset + headerLength;
+    if (payloadStart > data.length) break;
+    var header = data.subarray(offset, payloadStart);
+    var end = payloadStart + header.readUInt32BE(1);
+    if (end > data.length) break;
+    var payload = data.subarray(payloadStart, end);
+    if (!Journal.checksum_(version, header, payload).equals(
+            header.subarray(headerLength - 8))) {
+      break;
+    }
+    var kind = header[0];
+    if (kind !== Journal.Kind.DELTA && kind !== Journal.Kind.EFFECT) {
+      throw new RangeError('Unknown journal entry kind ' + kind);
+    }
+    entries.push({kind: kind, time: version > 1 ? header.readDoubleBE(5) : null,
+                  payload: payload, end: end});
+    offset = end;
+  }
+  return {entries: entries, torn: offset < data.length};
+};
+
+/**
+ * Compute the checksum of a journal entry.
+ * @private
+ * @param {number} version Journal version.
+ * @param {!Buffer} header Entry header (only the fields before the
+ *     checksum are used).
+ * @param {!Buffer} payload Entry payload.
+ * @return {!Buffer} Checksum.
+ */
+Journal.checksum_ = function(version, header, payload) {
+  var hash = crypto.createHash('sha256');
+  hash.update(header.subarray(0, Journal.ENTRY_HEADER_LENGTH_[version] - 8));
+  hash.update(payload);
+  return hash.digest().subarray(0, 8);
+};
+
+module.exports = Journal;
@@ -0,0 +1,344 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview A lightweight lint pass over user code, to catch
+ * likely mistakes when code is saved rather than when it runs.  The
+ * rules are:
+ *
+ * - 'unreachable': a statement following a return, throw, break or
+ *   continue in the same block.
+ * - 'assign-in-condition': an assignment used as the condition of an
+ *   if, loop or ?: (unless wrapped in an extra pair of parentheses,
+ *   which marks it as intended).
+ * - 'use-before-declaration': a var used, in the function declaring
+ *   it, before its declaration.
+ * - 'implicit-global': an assignment to an undeclared variable (which
+ *   would throw a ReferenceError, code being strict).
+ */
+'use strict';
+
+var parser = require('./parser');
+
+var Node = parser.Node;
+var Parser = parser.Parser;
+
+var Lint = {};
+
+/**
+ * A warning about a line of code.  line and col are 1-based.
+ * @typedef {{rule: string, message: string, line: number, col: number}}
+ */
+Lint.Warning;
+
+/**
+ * Check code for likely mistakes.
+ * @param {string} src The code.
+ * @param {function(string): boolean=} isGlobal Is the named global
+ *     variable defined?  (Default: none are.)
+ * @return {!Array<!Lint.Warning>} The warnings, in order of position.
+ * @throws {SyntaxError} If the code does not parse.
+ */
+Lint.check = function(src, isGlobal) {
+  var ast = Parser.parse(src);
+  var linter = new Lint.Linter_(src, isGlobal || function() {return false;});
+  linter.visitFunction_(ast, null);
+  linter.warnings_.sort(function(a, b) {return a.pos - b.pos;});
+  return linter.warnings_.map(function(warning) {
+    var lines = src.slice(0, warning.pos).split('\n');
+    return {rule: warning.rule, message: warning.message,
+            line: lines.length, col: lines[lines.length - 1].length + 1};
+  });
+};
+
+/**
+ * A scope, for resolving variables.  Catch clauses have their own
+ * (binding just the exception); otherwise there is one per function
+ * (and one for the program).
+ * @typedef {{vars: !Map<string, {kind: string, pos: number}>,
+ *     outer: ?Lint.Scope_, isCatch: boolean}}
+ */
+Lint.Scope_;
+
+/**
+ * State of a lint pass over one piece of code.
+ * @private
+ * @constructor
+ * @struct
+ * @param {string} src The code.
+ * @param {function(string): boolean} isGlobal Is the named global
+ *     variable defined?
+ */
+Lint.Linter_ = function(src, isGlobal) {
+  /** @private @const {string} */
+  this.src_ = src;
+  /** @private @const {function(string): boolean} */
+  this.isGlobal_ = isGlobal;
+  /** @private @const {!Array<{rule: string, message: string, pos: number}>} */
+  this.warnings_ = [];
+  /**
+   * Declarations already reported as used before being declared (as
+   * 'pos:name').
+   * @private @const {!Set<string>}
+   */
+  this.reported_ = new Set();
+};
+
+/**
+ * Record a warning.
+ * @private
+ * @param {string} rule The rule broken.
+ * @param {string} message The message.
+ * @param {!Node} node The offending node.
+ */
+Lint.Linter_.prototype.warn_ = function(rule, message, node) {
+  this.warnings_.push({rule: rule, message: message, pos: node['start']});
+};
+
+/**
+ * Visit a function (or the program): create its scope, hoisting its
+ * declarations into it, then visit its body.
+ * @private
+ * @param {!Node} node The Program, FunctionDeclaration or
+ *     FunctionExpression node.
+ * @param {?Lint.Scope_} outer The enclosing scope.
+ */
+Lint.Linter_.prototype.visitFunction_ = function(node, outer) {
+  var scope = {vars: new Map(), outer: outer, isCatch: false};
+  var declare = function(id, kind) {
+    if (!scope.vars.has(id['name'])) {
+      scope.vars.set(id['name'], {kind: kind, pos: id['start']});
+    }
+  };
+  if (node['type'] === 'Program') {
+    this.hoist_(node['body'], declare);
+    this.visitStatements_(node['body'], scope);
+    return;
+  }
+  if (node['type'] === 'FunctionExpression' && node['id']) {
+    declare(node['id'], 'function');
+  }
+  scope.vars.set('arguments', {kind: 'param', pos: node['start']});
+  node['params'].forEach(function(param) {declare(param, 'param');});
+  this.hoist_(node['body'], declare);
+  this.visit_(node['body'], scope);
+};
+
+/**
+ * Find the declarations of variables and functions in a function's
+ * body (but not in any functions nested within it).
+ * @private
+ * @param {!Node|!Array<!Node>} node The body (or part of it).
+ * @param {function(!Node, string)} declare Called with the identifier
+ *     and kind ('var' or 'function') of each declaration.
+ */
+Lint.Linter_.prototype.hoist_ = function(node, declare) {
+  (function find(node) {
+    if (node['type'] === 'VariableDeclarator') {
+      declare(node['id'], 'var');
+    } else if (node['type'] === 'FunctionDeclaration') {
+      declare(node['id'], 'function');
+      return;
+    } else if (node['type'] === 'FunctionExpression') {
+      return;
+    }
+    Lint.children_(node).forEach(find);
+  })(Array.isArray(node) ? {body: node} : node);
+};
+
+/**
+ * List the child nodes of a node, in order.
+ * @private
+ * @param {!Node|!Object} node The node.
+ * @return {!Array<!Node>} The children.
+ */
+Lint.children_ = function(node) {
+  var children = [];
+  for (var name in node) {
+    var prop = node[name];
+    var props = Array.isArray(prop) ? prop : [prop];
+    for (var i = 0; i < props.length; i++) {
+      if (props[i] instanceof Node) children.push(props[i]);
+    }
+  }
+  return children;
+};
+
+/**
+ * Visit a list of statements, warning about any unreachable ones.
+ * @private
+ * @param {!Array<!Node>} statements The statements.
+ * @param {!Lint.Scope_} scope The scope they are in.
+ */
+Lint.Linter_.prototype.visitStatements_ = function(statements, scope) {
+  var jumped = false;
+  for (var i = 0; i < statements.length; i++) {
+    var statement = statements[i];
+    var type = statement['type'];
+    if (jumped && type !== 'FunctionDeclaration' &&
+        type !== 'EmptyStatement') {
+      this.warn_('unreachable', 'Unreachable code', statement);
+      jumped = false;  // Once per block is enough.
+    }
+    if (type === 'ReturnStatement' || type === 'ThrowStatement' ||
+        type === 'BreakStatement' || type === 'ContinueStatement') {
+      jumped = true;
+    }
+    this.visit_(statement, scope);
+  }
+};
+
+/**
+ * Warn if a condition is an assignment not wrapped in extra
+ * parentheses.
+ * @private
+ * @param {?Node} test The condition (if any).
+ * @param {number} parens The number of parentheses the syntax requires
+ *     around it.
+ */
+Lint.Linter_.prototype.checkCondition_ = function(test, parens) {
+  if (!test || test['type'] !== 'AssignmentExpression') return;
+  var count = 0;
+  for (var i = test['start'] - 1; i >= 0; i--) {
+    var c = this.src_[i];
+    if (c === '(') {
+      count++;
+    } else if (!/\s/.test(c)) {
+      break;
+    }
+  }
+  if (count <= parens) {
+    this.warn_('assign-in-condition',
+        'Assignment in condition (use === to compare, or wrap the ' +
+        'assignment in parentheses if it is intended)', test);
+  }
+};
+
+/**
+ * Resolve a variable used (read or written) by code.
+ * @private
+ * @param {!Node} id The Identifier.
+ * @param {!Lint.Scope_} scope The scope it is used in.
+ * @param {boolean} write Is it assigned to?
+ */
+Lint.Linter_.prototype.use_ = function(id, scope, write) {
+  var name = id['name'];
+  var fn = scope;
+  while (fn.isCatch) fn = /** @type {!Lint.Scope_} */(fn.outer);
+  for (var s = scope; s; s = s.outer) {
+    var decl = s.vars.get(name);
+    if (!decl) continue;
+    if (s === fn && decl.kind === 'var' && id['start'] < decl.pos &&
+        !this.reported_.has(decl.pos + ':' + name)) {
+      this.reported_.add(decl.pos + ':' + name);
+      this.warn_('use-before-declaration',
+          "'" + name + "' is used before its declaration", id);
+    }
+    return;
+  }
+  if (write && !this.isGlobal_(name)) {
+    this.warn_('implicit-global',
+        "Assignment to undeclared variable '" + name + "'", id);
+  }
+};
+
+/**
+ * Visit a node and its descendants.
+ * @private
+ * @param {!Node} node The node.
+ * @param {!Lint.Scope_} scope The scope it is in.
+ */
+Lint.Linter_.prototype.visit_ = function(node, scope) {
+  var linter = this;
+  var visit = function(child) {
+    if (child) linter.visit_(child, scope);
+  };
+  switch (node['type']) {
+    case 'FunctionDeclaration':
+    case 'FunctionExpression':
+      this.visitFunction_(node, scope);
+      return;
+    case 'Identifier':
+      this.use_(node, scope, false);
+      return;
+    case 'BlockStatement':
+      this.visitStatements_(node['body'], scope);
+      return;
+    case 'SwitchCase':
+      visit(node['test']);
+      this.visitStatements_(node['consequent'], scope);
+      return;
+    case 'CatchClause':
+      var catchScope = {vars: new Map(), outer: scope, isCatch: true};
+      catchScope.vars.set(node['param']['name'],
+                          {kind: 'catch', pos: node['param']['start']});
+      this.visit_(node['body'], catchScope);
+      return;
+    case 'VariableDeclarator':
+      visit(node['init']);  // The id is a declaration, not a use.
+      return;
+    case 'MemberExpression':
+      visit(node['object']);
+      if (node['computed']) visit(node['property']);
+      return;
+    case 'Property':
+      visit(node['value']);  // The key is not a variable.
+      return;
+    case 'LabeledStatement':
+      visit(node['body']);
+      return;
+    case 'BreakStatement':
+    case 'ContinueStatement':
+      return;  // Labels are not variables.
+    case 'AssignmentExpression':
+      if (node['left']['type'] === 'Identifier') {
+        this.use_(node['left'], scope, true);
+      } else {
+        visit(node['left']);
+      }
+      visit(node['right']);
+      return;
+    case 'UpdateExpression':
+      if (node['argument']['type'] === 'Identifier') {
+        this.use_(node['argument'], scope, true);
+      } else {
+        visit(node['argument']);
+      }
+      return;
+    case 'ForInStatement':
+      if (node['left']['type'] === 'Identifier') {
+        this.use_(node['left'], scope, true);
+      } else {
+        visit(node['left']);
+      }
+      visit(node['right']);
+      visit(node['body']);
+      return;
+    case 'IfStatement':
+    case 'WhileStatement':
+    case 'DoWhileStatement':
+    case 'ConditionalExpression':  // Needs parentheses to parse at all.
+      this.checkCondition_(node['test'], 1);
+      break;
+    case 'ForStatement':
+      this.checkCondition_(node['test'], 0);
+      break;
+  }
+  Lint.children_(node).forEach(visit);
+};
+
+module.exports = Lint;
@@ -0,0 +1,419 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Structured logging: the server log, and logging by
+ * in-world code (CC.log and CC.logWrite).
+ *
+ * The server log (Logging.server) is divided into subsystems: those of
+ * the server itself, each written to with a Logging.Subsystem ('server'
+ * for the server as a whole, and for anything else written with
+ * console.log, etc.; 'checkpoint', 'backup', 'startup', 'snapshot',
+ * 'replica' and 'worlds'), and the categories of
+ * Interpreter.prototype.log ('net', 'admin', 'slow', 'unhandled' and
+ * 'user', the last for in-world logging).
+ * Each subsystem has a minimum level (by default that of the log as a
+ * whole), below which entries are discarded; levels can be changed at
+ * runtime (see the log option in config.txt, and the /log/levels
+ * routes of the admin API).  The log is written to stdout and stderr,
+ * or to a file (see Logging.File) that is rotated once it grows too
+ * large or too old.
+ *
+ * Each entry has a level, a message and optional key/value fields, and
+ * is written to the channel of the owner that wrote it.  A channel
+ * (configured with CC.logChannel) has a minimum level, below which
+ * entries are discarded, and routes the rest to the server log and/or
+ * to a connection (e.g., that of the owner's player, for debugging).
+ * Entries are formatted as a single line, in logfmt style:
+ *
+ *     warn alice: Door jammed room="Kitchen" tries=3
+ */
+'use strict';
+
+var fs = require('fs');
+var util = require('util');
+
+var Logging = {};
+
+/**
+ * Levels, in increasing order of severity.
+ * @const {!Array<string>}
+ */
+Logging.LEVELS = ['debug', 'info', 'warn', 'error'];
+
+/**
+ * Settings of an owner's log channel.  suppressed counts entries
+ * discarded by rate limiting since the last one written.
+ * @typedef {{level: string, server: boolean, connection: ?Object,
+ *            suppressed: number}}
+ */
+Logging.Channel;
+
+/**
+ * Create a channel with the default settings: entries of level info
+ * and above, to the server log only.
+ * @return {!Logging.Channel}
+ */
+Logging.defaultChannel = function() {
+  return {level: 'info', server: true, connection: null, suppressed: 0};
+};
+
+/**
+ * Check that a level is valid.
+ * @param {*} level The level's name.
+ * @return {string} The level.
+ */
+Logging.checkLevel = function(level) {
+  if (!Logging.LEVELS.includes(level)) {
+    throw new TypeError('Unknown log level ' + String(level));
+  }
+  return /** @type {string} */(level);
+};
+
+/**
+ * Should an entry be written to a channel?
+ * @param {!Logging.Channel} channel The channel.
+ * @param {string} level The entry's level.
+ * @return {boolean}
+ */
+Logging.enabled = function(channel, level) {
+  return Logging.LEVELS.indexOf(level) >=
+      Logging.LEVELS.indexOf(channel.level);
+};
+
+/**
+ * Format a field's value: numbers, booleans and null as they are,
+ * anything else as a JSON string (so that it is quoted if it contains
+ * spaces, etc.).
+ * @param {*} value The value.
+ * @return {string}
+ */
+Logging.formatValue = function(value) {
+  if (typeof value === 'number' || typeof value === 'boolean' ||
+      value === null) {
+    return String(value);
+  }
+  return JSON.stringify(typeof value === 'string' ? value : String(value));
+};
+
+/**
+ * Format an entry as a single line.
+ * @param {string} level The entry's level.
+ * @param {string} name Name of the channel's owner.
+ * @param {string} message The message.
+ * @param {!Object<string, *>=} fields Key/value fields, if any.
+ * @return {string}
+ */
+Logging.format = function(level, name, message, fields) {
+  var line = level + ' ' + name + ': ' +
+      message.replace(/\r?\n/g, '\\n');
+  for (var key in fields) {
+    line += ' ' + key.replace(/[\s=]/g, '_') + '=' +
+        Logging.formatValue(fields[key]);
+  }
+  return line;
+};
+
+///////////////////////////////////////////////////////////////////////////////
+// The server log.
+
+/**
+ * Subsystem to which entries written by the server itself (with
+ * console.log, etc.) are attributed.
+ * @const {string}
+ */
+Logging.SERVER = 'server';
+
+/**
+ * Default number of rotated log files kept (see Logging.File).
+ * @const {number}
+ */
+Logging.KEEP = 5;
+
+/**
+ * A leveled log, divided into subsystems.  Entries are written as
+ * single lines: the time, then as formatted by Logging.format, with the
+ * subsystem in place of the owner's name:
+ *
+ *     2020-06-01T12:00:00.000Z warn net: Connection refused port=7777
+ *
+ * @constructor
+ * @struct
+ * @param {function(string, string)=} write Function to write a line
+ *     (given, without a trailing newline, with its level).  By default,
+ *     lines are written to stdout, or to stderr for warnings and errors.
+ */
+Logging.Logger = function(write) {
+  /** @type {function(string, string)} */
+  this.write = write || Logging.Logger.writeStd;
+  /** @type {string} Minimum level of subsystems with no level set. */
+  this.level = 'info';
+  /** @private @const {!Map<string, string>} Levels, by subsystem. */
+  this.levels_ = new Map();
+};
+
+/**
+ * Write a line to stdout, or to stderr if it is a warning or error.
+ * @param {string} line The line.
+ * @param {string} level Its level.
+ */
+Logging.Logger.writeStd = function(line, level) {
+  var stream = (level === 'warn' || level === 'error') ?
+      process.stderr : process.stdout;
+  stream.write(line + '\n');
+};
+
+/**
+ * Set the minimum level of the log as a whole and of each subsystem,
+ * replacing any levels previously set.
+ * @param {string=} level Minimum level of subsystems not given (default
+ *     'info').
+ * @param {!Object<string, string>=} subsystems Minimum levels, by
+ *     subsystem.
+ */
+Logging.Logger.prototype.configure = function(level, subsystems) {
+  this.level = Logging.checkLevel(level || 'info');
+  this.levels_.clear();
+  for (var subsystem in subsystems) {
+    this.setLevel(subsystem, subsystems[subsystem]);
+  }
+};
+
+/**
+ * Set (or clear) the minimum level of a subsystem.
+ * @param {?string} subsystem The subsystem, or null for the log as a
+ *     whole.
+ * @param {?string} level The level, or null to revert to that of the
+ *     log as a whole.
+ */
+Logging.Logger.prototype.setLevel = function(subsystem, level) {
+  if (subsystem === null) {
+    if (level === null) throw new TypeError('A level is required');
+    this.level = Logging.checkLevel(level);
+  } else if (level === null) {
+    this.levels_.delete(subsystem);
+  } else {
+    this.levels_.set(subsystem, Logging.checkLevel(level));
+  }
+};
+
+/**
+ * Get the minimum level of the log as a whole and of each subsystem
+ * that has one set.
+ * @return {{level: string, subsystems: !Object<string, string>}}
+ */
+Logging.Logger.prototype.getLevels = function() {
+  var subsystems = {};
+  this.levels_.forEach(function(level, subsystem) {
+    subsystems[subsystem] = level;
+  });
+  return {level: this.level, subsystems: subsystems};
+};
+
+/**
+ * Should an entry be written?
+ * @param {string} subsystem The subsystem it is from.
+ * @param {string} level Its level.
+ * @return {boolean}
+ */
+Logging.Logger.prototype.enabled = function(subsystem, level) {
+  var minimum = this.levels_.get(subsystem) || this.level;
+  return Logging.LEVELS.indexOf(level) >= Logging.LEVELS.indexOf(minimum);
+};
+
+/**
+ * Write an entry, if its level is enabled for its subsystem.
+ * @param {string} subsystem The subsystem it is from.
+ * @param {string} level Its level.
+ * @param {string} message The message.
+ * @param {!Object<string, *>=} fields Key/value fields, if any.
+ * @return {boolean} True iff it was written.
+ */
+Logging.Logger.prototype.log = function(subsystem, level, message, fields) {
+  if (!this.enabled(subsystem, level)) return false;
+  this.write(new Date().toISOString() + ' ' +
+             Logging.format(level, subsystem, message, fields), level);
+  return true;
+};
+
+/**
+ * The server log.
+ * @const {!Logging.Logger}
+ */
+Logging.server = new Logging.Logger();
+
+/**
+ * A subsystem of the server log, with a method for each level that
+ * writes an entry whose message is formatted as by console.log (i.e.,
+ * with util.format):
+ *
+ *     var log = new Logging.Subsystem('checkpoint');
+ *     log.info('Checkpoint %s complete.', name);
+ *
+ * @constructor
+ * @struct
+ * @param {string} name The subsystem.
+ * @param {!Logging.Logger=} logger The log written to (default
+ *     Logging.server).
+ */
+Logging.Subsystem = function(name, logger) {
+  /** @const {string} */
+  this.name = name;
+  /** @private @const {!Logging.Logger} */
+  this.logger_ = logger || Logging.server;
+};
+
+/**
+ * Write an entry, if its level is enabled for this subsystem.
+ * @private
+ * @param {string} level Its level.
+ * @param {!Array<*>} args Arguments to util.format.
+ * @return {boolean} True iff it was written.
+ */
+Logging.Subsystem.prototype.log_ = function(level, args) {
+  if (!this.logger_.enabled(this.name, level)) return false;
+  return this.logger_.log(this.name, level, util.format.apply(util, args));
+};
+
+/**
+ * Write an entry of level debug.
+ * @param {...*} var_args Format string and values, as for util.format.
+ * @return {boolean} True iff it was written.
+ */
+Logging.Subsystem.prototype.debug = function(var_args) {
+  return this.log_('debug', Array.from(arguments));
+};
+
+/**
+ * Write an entry of level info.
+ * @param {...*} var_args Format string and values, as for util.format.
+ * @return {boolean} True iff it was written.
+ */
+Logging.Subsystem.prototype.info = function(var_args) {
+  return this.log_('info', Array.from(arguments));
+};
+
+/**
+ * Write an entry of level warn.
+ * @param {...*} var_args Format string and values, as for util.format.
+ * @return {boolean} True iff it was written.
+ */
+Logging.Subsystem.prototype.warn = function(var_args) {
+  return this.log_('warn', Array.from(arguments));
+};
+
+/**
+ * Write an entry of level error.
+ * @param {...*} var_args Format string and values, as for util.format.
+ * @return {boolean} True iff it was written.
+ */
+Logging.Subsystem.prototype.error = function(var_args) {
+  return this.log_('error', Array.from(arguments));
+};
+
+/**
+ * A log file, rotated once it exceeds a maximum size or has been open
+ * for a maximum time: the file is renamed with the suffix .1 (and any
+ * previously rotated files' suffixes incremented, the oldest being
+ * deleted), and a new one started.  Writes are synchronous, so nothing
+ * logged just before the process exits is lost.
+ * @constructor
+ * @struct
+ * @param {string} filename Path of the log file, which is appended to
+ *     if it exists.
+ * @param {{maxSize: (number|undefined),
+ *          interval: (number|undefined),
+ *          keep: (number|undefined)}=} options Maximum size (in bytes)
+ *     and age (in seconds) of the file before it is rotated (0 or
+ *     absent for no maximum), and the number of rotated files to keep
+ *     (default Logging.KEEP).
+ */
+Logging.File = function(filename, options) {
+  options = options || {};
+  /** @const {string} */
+  this.filename = filename;
+  /** @private @const {number} */
+  this.maxSize_ = options.maxSize || 0;
+  /** @private @const {number} */
+  this.interval_ = (options.interval || 0) * 1000;
+  /** @private @const {number} */
+  this.keep_ = (options.keep === undefined) ? Logging.KEEP : options.keep;
+  /** @private {?number} File descriptor of the file. */
+  this.fd_ = null;
+  /** @private {number} Size of the file. */
+  this.size_ = 0;
+  /** @private {number} Time at which the file was opened. */
+  this.opened_ = 0;
+  this.reopen();
+};
+
+/**
+ * Append a line to the file, rotating it first if it is due.
+ * @param {string} line The line (without a trailing newline).
+ */
+Logging.File.prototype.write = function(line) {
+  var buffer = Buffer.from(line + '\n');
+  if (this.size_ > 0 &&
+      ((this.maxSize_ && this.size_ + buffer.length > this.maxSize_) ||
+       (this.interval_ && Date.now() - this.opened_ >= this.interval_))) {
+    this.rotate();
+  }
+  fs.writeSync(/** @type {number} */(this.fd_), buffer);
+  this.size_ += buffer.length;
+};
+
+/**
+ * Rotate the file now.
+ */
+Logging.File.prototype.rotate = function() {
+  var name = function(filename, n) {
+    return n ? filename + '.' + n : filename;
+  };
+  for (var n = this.keep_; n >= 0; n--) {
+    if (!fs.existsSync(name(this.filename, n))) continue;
+    if (n === this.keep_) {
+      fs.unlinkSync(name(this.filename, n));
+    } else {
+      fs.renameSync(name(this.filename, n), name(this.filename, n + 1));
+    }
+  }
+  this.reopen();
+};
+
+/**
+ * (Re)open the file by name: e.g., once something else (such as
+ * logrotate) has moved it aside.  The file previously open, if any, is
+ * closed once the new one has been opened.
+ */
+Logging.File.prototype.reopen = function() {
+  var fd = fs.openSync(this.filename, 'a');
+  var old = this.fd_;
+  this.fd_ = fd;
+  this.size_ = fs.fstatSync(fd).size;
+  this.opened_ = Date.now();
+  if (old !== null) fs.closeSync(old);
+};
+
+/**
+ * Close the file.
+ */
+Logging.File.prototype.close = function() {
+  if (this.fd_ !== null) fs.closeSync(this.fd_);
+  this.fd_ = null;
+};
+
+module.exports = Logging;
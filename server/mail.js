@@ -0,0 +1,856 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Sending email via an SMTP relay, and receiving it.
+ *
+ * Each message is delivered in a separate SMTP session (RFC 5321)
+ * with the configured relay, either over implicit TLS (usually port
+ * 465) or upgraded with STARTTLS (RFC 3207) whenever the relay offers
+ * it.  Credentials, if given, are sent (with AUTH PLAIN or AUTH LOGIN,
+ * RFC 4954) only over TLS.  Messages are plain text, encoded as UTF-8
+ * in base64, with any non-ASCII subject encoded as per RFC 2047.
+ *
+ * Messages can also be received, by acting as the server side of SMTP
+ * sessions (as the target of an MX record, for example), and parsed:
+ * headers are decoded, and the plain text body (or the first plain
+ * text part of a multipart message) extracted.  Nothing is relayed.
+ */
+'use strict';
+
+var crypto = require('crypto');
+var net = require('net');
+var os = require('os');
+var tls = require('tls');
+
+var Mail = {};
+
+/**
+ * Options for a Mail.Mailer:
+ *
+ * - host, port: the relay (port defaults to 465 if secure, else 587).
+ * - secure: connect with TLS from the start (rather than STARTTLS).
+ * - user, password: credentials for AUTH, if the relay requires them.
+ * - from, fromName: the sender's address and (optional) display name.
+ * - name: hostname to give in EHLO (default os.hostname()).
+ * - timeout: time allowed for each step of a session (in ms).
+ * - tls: further options for tls.connect (e.g. {ca: ...}).
+ * @typedef {{host: string,
+ *            port: (number|undefined),
+ *            secure: (boolean|undefined),
+ *            user: (string|undefined),
+ *            password: (string|undefined),
+ *            from: string,
+ *            fromName: (string|undefined),
+ *            name: (string|undefined),
+ *            timeout: (number|undefined),
+ *            tls: (!Object|undefined)}}
+ */
+Mail.Options;
+
+/**
+ * A message to send.  If params is given, {{name}} in subject and text
+ * is replaced with the value of params[name] (see Mail.render).
+ * @typedef {{to: !Array<string>,
+ *            subject: string,
+ *            text: string,
+ *            replyTo: (string|undefined),
+ *            params: (!Object<string, *>|undefined)}}
+ */
+Mail.Message;
+
+/**
+ * Default time allowed for each step of an SMTP session (in ms).
+ * @const {number}
+ */
+Mail.TIMEOUT = 30 * 1000;
+
+/**
+ * Check that a string is a plausible email address: local@domain, with
+ * no whitespace, angle brackets or other characters that could be
+ * used to inject further headers or SMTP commands.
+ * @param {*} address The string to check.
+ * @return {boolean} True iff it is acceptable.
+ */
+Mail.isAddress = function(address) {
+  return typeof address === 'string' && address.length <= 254 &&
+      /^[^\s@<>()\[\],;:\\"]+@[A-Za-z0-9.-]+$/.test(address);
+};
+
+/**
+ * Fill in a template: replace each {{name}} (optionally with spaces
+ * inside the braces) with String(params[name]), or with nothing if
+ * params has no such property.
+ * @param {string} template The template.
+ * @param {!Object<string, *>} params The values to fill in.
+ * @return {string} The filled-in template.
+ */
+Mail.render = function(template, params) {
+  return template.replace(/\{\{\s*([\w.$]+)\s*\}\}/g, function(_, name) {
+    return Object.prototype.hasOwnProperty.call(params, name) &&
+        params[name] !== undefined && params[name] !== null ?
+        String(params[name]) : '';
+  });
+};
+
+/**
+ * Encode a header value as an RFC 2047 encoded-word, if it contains
+ * anything other than printable ASCII.
+ * @param {string} text The header value.
+ * @return {string} The encoded value.
+ */
+Mail.encodeHeader = function(text) {
+  if (/^[\x20-\x7e]*$/.test(text)) return text;
+  return '=?UTF-8?B?' + Buffer.from(text).toString('base64') + '?=';
+};
+
+/**
+ * Format a message (RFC 5322), with CRLF line endings.
+ * @param {!Mail.Message} message The message (already rendered).
+ * @param {string} from The From: header value.
+ * @param {!Date} date The date of the message.
+ * @param {string} messageId The Message-ID (without angle brackets).
+ * @return {string} The formatted message.
+ */
+Mail.format = function(message, from, date, messageId) {
+  var headers = [
+    'From: ' + from,
+    'To: ' + message.to.join(', '),
+  ];
+  if (message.replyTo) headers.push('Reply-To: ' + message.replyTo);
+  headers.push(
+      'Subject: ' + Mail.encodeHeader(message.subject),
+      'Date: ' + date.toUTCString(),
+      'Message-ID: <' + messageId + '>',
+      'MIME-Version: 1.0',
+      'Content-Type: text/plain; charset=utf-8',
+      'Content-Transfer-Encoding: base64');
+  var body = Buffer.from(message.text.replace(/\r?\n/g, '\r\n'))
+      .toString('base64').replace(/.{76}(?=.)/g, '$&\r\n');
+  return headers.join('\r\n') + '\r\n\r\n' + body + '\r\n';
+};
+
+/**
+ * A reply from an SMTP server.
+ * @typedef {{code: number, lines: !Array<string>}}
+ */
+Mail.Reply;
+
+/**
+ * An SMTP session in progress: reads replies from the connection and
+ * sends commands.
+ * @constructor
+ * @struct
+ * @private
+ * @param {!net.Socket} socket The connection to the server.
+ * @param {number} timeout Time allowed for each reply (in ms).
+ */
+Mail.Session_ = function(socket, timeout) {
+  /** @type {!net.Socket} */
+  this.socket = socket;
+  /** @private @const {number} */
+  this.timeout_ = timeout;
+  /** @private @type {string} Incomplete line received. */
+  this.partial_ = '';
+  /** @private @type {!Array<string>} Lines of incomplete reply. */
+  this.lines_ = [];
+  /** @private @const {!Array<!Mail.Reply>} Replies not yet read. */
+  this.replies_ = [];
+  /** @private @type {?Error} Error that ended the session, if any. */
+  this.error_ = null;
+  /** @private @type {?{resolve: function(!Mail.Reply),
+   *                    reject: function(!Error)}} */
+  this.waiting_ = null;
+  /** @private @const {function(!Buffer)} */
+  this.onData_ = this.receive_.bind(this);
+  /** @private @const {function(!Error=)} */
+  this.onError_ = this.fail_.bind(this);
+  this.attach_(socket);
+};
+
+/**
+ * Start reading from a connection.
+ * @private
+ * @param {!net.Socket} socket The connection.
+ */
+Mail.Session_.prototype.attach_ = function(socket) {
+  var session = this;
+  this.socket = socket;
+  socket.setTimeout(this.timeout_, function() {
+    socket.destroy(new Error('SMTP server timed out'));
+  });
+  socket.on('data', this.onData_);
+  socket.on('error', this.onError_);
+  socket.on('close', function() {
+    session.fail_(new Error('SMTP connection closed'));
+  });
+};
+
+/**
+ * Handle data received from the server.
+ * @private
+ * @param {!Buffer} data The data.
+ */
+Mail.Session_.prototype.receive_ = function(data) {
+  var lines = (this.partial_ + data.toString('latin1')).split('\r\n');
+  this.partial_ = lines.pop();
+  for (var i = 0; i < lines.length; i++) {
+    var m = lines[i].match(/^(\d{3})([ -]?)(.*)$/);
+    if (!m) {
+      this.socket.destroy(new Error('Bad SMTP reply: ' + lines[i]));
+      return;
+    }
+    this.lines_.push(m[3]);
+    if (m[2] === '-') continue;  // More lines to come.
+    this.replies_.push({code: Number(m[1]), lines: this.lines_});
+    this.lines_ = [];
+  }
+  if (this.waiting_ && this.replies_.length) {
+    var waiting = this.waiting_;
+    this.waiting_ = null;
+    waiting.resolve(this.replies_.shift());
+  }
+};
+
+/**
+ * Handle the end of the session.
+ * @private
+ * @param {!Error=} error The reason it ended.
+ */
+Mail.Session_.prototype.fail_ = function(error) {
+  if (!this.error_) this.error_ = error || new Error('SMTP session ended');
+  if (this.waiting_) {
+    var waiting = this.waiting_;
+    this.waiting_ = null;
+    waiting.reject(this.error_);
+  }
+};
+
+/**
+ * Read the next reply from the server.
+ * @param {number=} expected The expected reply code.  If given, the
+ *     reply must have this code (or the returned promise rejects).
+ * @param {string=} what Description of the command replied to, for
+ *     error messages.
+ * @return {!Promise<!Mail.Reply>}
+ */
+Mail.Session_.prototype.read = function(expected, what) {
+  var session = this;
+  return new Promise(function(resolve, reject) {
+    if (session.replies_.length) {
+      resolve(session.replies_.shift());
+    } else if (session.error_) {
+      reject(session.error_);
+    } else {
+      session.waiting_ = {resolve: resolve, reject: reject};
+    }
+  }).then(function(reply) {
+    if (expected !== undefined && reply.code !== expected) {
+      throw new Error('SMTP ' + (what || 'greeting') + ' failed: ' +
+          reply.code + ' ' + reply.lines.join(' '));
+    }
+    return reply;
+  });
+};
+
+/**
+ * Send a command and read the reply.
+ * @param {string} command The command (without CRLF).
+ * @param {number} expected The expected reply code.
+ * @param {string=} what Description of the command, for error
+ *     messages (default: its first word).
+ * @return {!Promise<!Mail.Reply>}
+ */
+Mail.Session_.prototype.command = function(command, expected, what) {
+  this.socket.write(command + '\r\n');
+  return this.read(expected, what || command.split(/[ :]/)[0]);
+};
+
+/**
+ * Upgrade the connection to TLS (after the server has agreed to
+ * STARTTLS).
+ * @param {!Object} options Options for tls.connect.
+ * @return {!Promise} Resolves once the TLS handshake is complete.
+ */
+Mail.Session_.prototype.startTls = function(options) {
+  var session = this;
+  var plain = this.socket;
+  plain.removeListener('data', this.onData_);
+  plain.removeListener('error', this.onError_);
+  plain.setTimeout(0);
+  return new Promise(function(resolve, reject) {
+    var secure = tls.connect(Object.assign({socket: plain}, options));
+    secure.once('secureConnect', resolve);
+    session.attach_(secure);
+    var fail = function() {
+      reject(session.error_);
+    };
+    secure.once('close', fail);
+    secure.once('secureConnect', function() {
+      secure.removeListener('close', fail);
+    });
+  });
+};
+
+/**
+ * End the session: politely, with QUIT, if it is still going.
+ */
+Mail.Session_.prototype.close = function() {
+  var socket = this.socket;
+  if (this.error_ || socket.destroyed) return;
+  socket.end('QUIT\r\n');
+  // Don't wait long for the server to hang up.
+  setTimeout(function() {
+    socket.destroy();
+  }, 1000).unref();
+};
+
+/**
+ * Deliver a message via an SMTP relay.
+ * @param {!Mail.Options} options The relay and how to use it.
+ * @param {string} from The envelope sender address.
+ * @param {!Array<string>} recipients The envelope recipient addresses.
+ * @param {string} data The formatted message (see Mail.format).
+ * @return {!Promise<string>} Resolves to the relay's reply to the
+ *     message (e.g. '250 2.0.0 Ok: queued as 12345').
+ */
+Mail.deliver = function(options, from, recipients, data) {
+  var port = options.port || (options.secure ? 465 : 587);
+  var tlsOptions = Object.assign({servername: options.host}, options.tls);
+  var socket = options.secure ?
+      tls.connect(Object.assign({host: options.host, port: port},
+                                tlsOptions)) :
+      net.connect({host: options.host, port: port});
+  var session = new Mail.Session_(socket, options.timeout || Mail.TIMEOUT);
+  var secure = Boolean(options.secure);
+  /** @type {!Array<string>} */
+  var extensions = [];
+  var ehlo = function() {
+    return session.command('EHLO ' + (options.name || os.hostname()), 250)
+        .then(function(reply) {
+          extensions = reply.lines.slice(1).map(function(line) {
+            return line.toUpperCase();
+          });
+        });
+  };
+  var hasExtension = function(name) {
+    return extensions.some(function(line) {
+      return line.split(' ')[0] === name;
+    });
+  };
+
+  var ready = session.read(220).then(ehlo).then(function() {
+    if (secure || !hasExtension('STARTTLS')) return;
+    return session.command('STARTTLS', 220).then(function() {
+      return session.startTls(tlsOptions);
+    }).then(function() {
+      secure = true;
+      return ehlo();
+    });
+  });
+  if (options.user) {
+    ready = ready.then(function() {
+      if (!secure) {
+        throw new Error('Refusing to send SMTP credentials without TLS');
+      }
+      var auth = extensions.find(function(line) {
+        return line.split(' ')[0] === 'AUTH';
+      }) || '';
+      var user = String(options.user);
+      var password = String(options.password || '');
+      if (auth.split(' ').includes('PLAIN')) {
+        var token = Buffer.from('\0' + user + '\0' + password);
+        return session.command('AUTH PLAIN ' + token.toString('base64'),
+                               235, 'AUTH');
+      }
+      return session.command('AUTH LOGIN', 334, 'AUTH').then(function() {
+        return session.command(Buffer.from(user).toString('base64'), 334,
+                               'AUTH');
+      }).then(function() {
+        return session.command(Buffer.from(password).toString('base64'),
+                               235, 'AUTH');
+      });
+    });
+  }
+  return ready.then(function() {
+    return session.command('MAIL FROM:<' + from + '>', 250);
+  }).then(function() {
+    return recipients.reduce(function(previous, recipient) {
+      return previous.then(function() {
+        return session.command('RCPT TO:<' + recipient + '>', 250);
+      });
+    }, Promise.resolve());
+  }).then(function() {
+    return session.command('DATA', 354);
+  }).then(function() {
+    // Escape lines beginning with '.' (RFC 5321 §4.5.2).
+    var body = data.replace(/^\./gm, '..');
+    if (!body.endsWith('\r\n')) body += '\r\n';
+    return session.command(body + '.', 250, 'message');
+  }).then(function(reply) {
+    session.close();
+    return reply.code + ' ' + reply.lines.join(' ');
+  }, function(error) {
+    session.socket.destroy();
+    socket.destroy();
+    throw error;
+  });
+};
+
+/**
+ * Sends messages via an SMTP relay.
+ * @constructor
+ * @struct
+ * @param {!Mail.Options} options The relay and sender.
+ */
+Mail.Mailer = function(options) {
+  if (!options.host) throw new TypeError('No SMTP host given');
+  if (!Mail.isAddress(options.from)) {
+    throw new TypeError('Invalid from address: ' + options.from);
+  }
+  /** @const {!Mail.Options} */
+  this.options = options;
+};
+
+/**
+ * Send a message.
+ * @param {!Mail.Message} message The message.
+ * @return {!Promise<string>} Resolves to the relay's reply once the
+ *     message has been accepted by it.
+ * @throws {TypeError} If the message is invalid.
+ */
+Mail.Mailer.prototype.send = function(message) {
+  if (!Array.isArray(message.to) || !message.to.length ||
+      !message.to.every(Mail.isAddress)) {
+    throw new TypeError('Invalid recipient address');
+  } else if (message.replyTo !== undefined &&
+             !Mail.isAddress(message.replyTo)) {
+    throw new TypeError('Invalid reply-to address');
+  }
+  var subject = String(message.subject || '');
+  var text = String(message.text || '');
+  if (message.params) {
+    subject = Mail.render(subject, message.params);
+    text = Mail.render(text, message.params);
+  }
+  subject = subject.replace(/[\r\n]+/g, ' ');
+  var options = this.options;
+  var from = options.from;
+  if (options.fromName) {
+    var name = options.fromName.replace(/[\r\n"\\]/g, '');
+    var encoded = Mail.encodeHeader(name);
+    from = (encoded === name ? '"' + name + '"' : encoded) +
+        ' <' + from + '>';
+  }
+  var messageId = crypto.randomBytes(16).toString('hex') + '@' +
+      options.from.split('@')[1];
+  var data = Mail.format({
+    to: message.to,
+    subject: subject,
+    text: text,
+    replyTo: message.replyTo,
+  }, from, new Date(), messageId);
+  return Mail.deliver(options, options.from, message.to, data);
+};
+
+/**
+ * Options for Mail.receive:
+ *
+ * - name: hostname to give in the greeting and EHLO reply.
+ * - maxSize: maximum size of a message, in bytes.
+ * - maxRecipients: maximum number of recipients of a message.
+ * - startTls: function to wrap the connection in TLS (see
+ *   Certificates.Manager.prototype.wrap), if STARTTLS is to be offered.
+ * - timeout: time allowed for the client to send each command (in ms).
+ * @typedef {{name: string,
+ *            maxSize: number,
+ *            maxRecipients: number,
+ *            startTls: (?function(!net.Socket): !tls.TLSSocket|undefined),
+ *            timeout: (number|undefined)}}
+ */
+Mail.ReceiveOptions;
+
+/**
+ * The envelope of a received message: the sender and recipients given
+ * in MAIL FROM and RCPT TO, and whether the session was secured with
+ * TLS.
+ * @typedef {{from: string, to: !Array<string>, secure: boolean}}
+ */
+Mail.Envelope;
+
+/**
+ * Default time allowed for an SMTP client to send each command (in
+ * ms), as recommended by RFC 5321 §4.5.3.2.
+ * @const {number}
+ */
+Mail.RECEIVE_TIMEOUT = 5 * 60 * 1000;
+
+/**
+ * Maximum length of a command line (RFC 5321 §4.5.3.1.4, plus slack
+ * for ESMTP parameters).
+ * @private @const {number}
+ */
+Mail.MAX_LINE_ = 2048;
+
+/**
+ * Conduct the server side of an SMTP session: accept messages from
+ * the client (without relaying them anywhere), passing each to
+ * onMessage once it has been received.
+ * @param {!net.Socket} socket The connection from the client.
+ * @param {!Mail.ReceiveOptions} options Limits, etc.
+ * @param {function(!Mail.Envelope, !Buffer)} onMessage Function to be
+ *     called with the envelope and content of each message.
+ */
+Mail.receive = function(socket, options, onMessage) {
+  var secure = socket instanceof tls.TLSSocket;
+  var greeted = false;
+  var from = null;
+  var to = [];
+  var data = null;  // Chunks of message being received, or null.
+  var size = 0;
+  var partial = '';
+
+  var reply = function(text) {
+    if (!socket.destroyed) socket.write(text + '\r\n');
+  };
+  var reset = function() {
+    from = null;
+    to = [];
+  };
+
+  /**
+   * Handle one line (without CRLF) from the client.
+   * @param {string} line The line, decoded as latin1.
+   */
+  var handle = function(line) {
+    if (data) {
+      if (line !== '.') {
+        // Remove dot-stuffing (RFC 5321 §4.5.2).
+        if (line[0] === '.') line = line.slice(1);
+        size += line.length + 2;
+        if (size <= options.maxSize) {
+          data.push(Buffer.from(line + '\r\n', 'latin1'));
+        }
+        return;
+      }
+      var chunks = data;
+      data = null;
+      if (size > options.maxSize) {
+        reply('552 5.3.4 Message too big');
+      } else {
+        onMessage({from: from, to: to, secure: secure},
+                  Buffer.concat(chunks));
+        reply('250 2.0.0 OK');
+      }
+      reset();
+      return;
+    }
+    var m = line.match(/^(\S+)\s*(.*)$/);
+    var verb = m ? m[1].toUpperCase() : '';
+    var arg = m ? m[2] : '';
+    if (verb === 'EHLO' || verb === 'HELO') {
+      greeted = true;
+      reset();
+      if (verb === 'HELO') {
+        reply('250 ' + options.name);
+        return;
+      }
+      var lines = [options.name, 'SIZE ' + options.maxSize, '8BITMIME'];
+      if (options.startTls && !secure) lines.push('STARTTLS');
+      lines.push('ENHANCEDSTATUSCODES');
+      reply(lines.map(function(text, i) {
+        return '250' + (i < lines.length - 1 ? '-' : ' ') + text;
+      }).join('\r\n'));
+    } else if (verb === 'STARTTLS') {
+      if (!options.startTls || secure) {
+        reply('502 5.5.1 STARTTLS not available');
+        return;
+      }
+      reply('220 2.0.0 Ready to start TLS');
+      var plain = socket;
+      plain.removeListener('data', receive);
+      plain.setTimeout(0);
+      socket = options.startTls(plain);
+      secure = true;
+      // The client must start afresh (RFC 3207 §4.2).
+      greeted = false;
+      reset();
+      socket.on('error', function() {});
+      listen();
+    } else if (verb === 'MAIL') {
+      m = arg.match(/^FROM:\s*<([^>]*)>(.*)$/i);
+      var declared = m && m[2].match(/\bSIZE=(\d+)/i);
+      if (!greeted) {
+        reply('503 5.5.1 Say hello first');
+      } else if (from !== null) {
+        reply('503 5.5.1 Sender already given');
+      } else if (!m || (m[1] !== '' && !Mail.isAddress(m[1]))) {
+        reply('501 5.1.7 Bad sender address');
+      } else if (declared && Number(declared[1]) > options.maxSize) {
+        reply('552 5.3.4 Message too big');
+      } else {
+        from = m[1];
+        reply('250 2.1.0 OK');
+      }
+    } else if (verb === 'RCPT') {
+      m = arg.match(/^TO:\s*<([^>]*)>/i);
+      if (from === null) {
+        reply('503 5.5.1 Need MAIL first');
+      } else if (!m || !Mail.isAddress(m[1])) {
+        reply('501 5.1.3 Bad recipient address');
+      } else if (to.length >= options.maxRecipients) {
+        reply('452 4.5.3 Too many recipients');
+      } else {
+        to.push(m[1]);
+        reply('250 2.1.5 OK');
+      }
+    } else if (verb === 'DATA') {
+      if (!to.length) {
+        reply('503 5.5.1 Need RCPT first');
+      } else {
+        data = [];
+        size = 0;
+        reply('354 End data with <CR><LF>.<CR><LF>');
+      }
+    } else if (verb === 'RSET') {
+      reset();
+      reply('250 2.0.0 OK');
+    } else if (verb === 'NOOP') {
+      reply('250 2.0.0 OK');
+    } else if (verb === 'VRFY') {
+      reply('252 2.5.0 Cannot verify');
+    } else if (verb === 'QUIT') {
+      reply('221 2.0.0 Bye');
+      socket.end();
+    } else {
+      reply('502 5.5.2 Command not recognized');
+    }
+  };
+
+  /**
+   * Handle data from the client.
+   * @param {!Buffer} chunk The data.
+   */
+  var receive = function(chunk) {
+    var lines = (partial + chunk.toString('latin1')).split('\r\n');
+    partial = lines.pop();
+    if (partial.length > Mail.MAX_LINE_ && !data) {
+      reply('500 5.5.6 Line too long');
+      socket.destroy();
+      return;
+    }
+    for (var i = 0; i < lines.length && !socket.destroyed; i++) {
+      var current = socket;
+      handle(lines[i]);
+      // Anything after STARTTLS was sent in the clear; ignore it.
+      if (socket !== current) {
+        partial = '';
+        return;
+      }
+    }
+  };
+
+  var listen = function() {
+    socket.on('data', receive);
+    socket.setTimeout(options.timeout || Mail.RECEIVE_TIMEOUT, function() {
+      reply('421 4.4.2 Timeout');
+      socket.destroy();
+    });
+  };
+  listen();
+  reply('220 ' + options.name + ' ESMTP');
+};
+
+/**
+ * A parsed message.  headers maps each (lower-case) header name to
+ * the (unfolded and decoded) value of its first occurrence; text is
+ * the plain text body (or the first plain text part of a multipart
+ * message), decoded.
+ * @typedef {{headers: !Object<string, string>,
+ *            subject: string,
+ *            from: string,
+ *            text: string}}
+ */
+Mail.Parsed;
+
+/**
+ * Decode bytes in the given character set (only UTF-8, US-ASCII and
+ * ISO-8859-1 are understood; anything else is treated as UTF-8).
+ * @private
+ * @param {!Buffer} bytes The bytes.
+ * @param {string|undefined} charset The character set.
+ * @return {string}
+ */
+Mail.decodeCharset_ = function(bytes, charset) {
+  charset = (charset || '').toLowerCase();
+  if (charset === 'iso-8859-1' || charset === 'latin1' ||
+      charset === 'windows-1252') {
+    return bytes.toString('latin1');
+  }
+  return bytes.toString('utf8');
+};
+
+/**
+ * Decode quoted-printable text (RFC 2045 §6.7) to bytes.
+ * @private
+ * @param {string} text The encoded text.
+ * @param {boolean=} header Decode as an RFC 2047 "Q" encoded-word
+ *     (in which '_' represents a space)?
+ * @return {!Buffer}
+ */
+Mail.decodeQuotedPrintable_ = function(text, header) {
+  if (header) text = text.replace(/_/g, ' ');
+  text = text.replace(/=\r?\n/g, '');  // Soft line breaks.
+  var bytes = [];
+  for (var i = 0; i < text.length; i++) {
+    var hex = text.slice(i + 1, i + 3);
+    if (text[i] === '=' && /^[0-9A-Fa-f]{2}$/.test(hex)) {
+      bytes.push(parseInt(hex, 16));
+      i += 2;
+    } else {
+      bytes.push(text.charCodeAt(i) & 0xff);
+    }
+  }
+  return Buffer.from(bytes);
+};
+
+/**
+ * Decode any RFC 2047 encoded-words in a header value.
+ * @param {string} value The header value.
+ * @return {string} The decoded value.
+ */
+Mail.decodeHeader = function(value) {
+  return value.replace(/(=\?[^?]+\?[BbQq]\?[^?]*\?=)\s+(?==\?)/g, '$1')
+      .replace(/=\?([^?*]+)(?:\*[^?]*)?\?([BbQq])\?([^?]*)\?=/g,
+               function(_, charset, encoding, text) {
+        var bytes = (encoding.toUpperCase() === 'B') ?
+            Buffer.from(text, 'base64') :
+            Mail.decodeQuotedPrintable_(text, true);
+        return Mail.decodeCharset_(bytes, charset);
+      });
+};
+
+/**
+ * Parse the header section of a message or MIME part.
+ * @private
+ * @param {string} head The header section (decoded as latin1).
+ * @return {!Object<string, string>} Header values, by lower-case name.
+ */
+Mail.parseHeaders_ = function(head) {
+  var headers = Object.create(null);
+  var lines = head.replace(/\r?\n(?=[ \t])/g, '').split(/\r?\n/);
+  for (var i = 0; i < lines.length; i++) {
+    var colon = lines[i].indexOf(':');
+    if (colon < 1) continue;
+    var name = lines[i].slice(0, colon).trim().toLowerCase();
+    if (name in headers) continue;
+    // Header values are decoded as UTF-8 (RFC 6532), since 8-bit
+    // headers are invariably so.
+    var value = Buffer.from(lines[i].slice(colon + 1).trim(), 'latin1');
+    headers[name] = Mail.decodeHeader(value.toString('utf8'));
+  }
+  return headers;
+};
+
+/**
+ * Get a parameter (e.g. charset) of a header value such as that of
+ * Content-Type.
+ * @private
+ * @param {string|undefined} value The header value.
+ * @param {string} name The parameter's name.
+ * @return {string|undefined} The parameter's value, if present.
+ */
+Mail.headerParam_ = function(value, name) {
+  var re = new RegExp(';\\s*' + name + '\\s*=\\s*(?:"([^"]*)"|([^;\\s]*))',
+                      'i');
+  var m = (value || '').match(re);
+  return m ? (m[1] !== undefined ? m[1] : m[2]) : undefined;
+};
+
+/**
+ * Find and decode the plain text of a MIME entity: its body, if it is
+ * text/plain (or has no Content-Type), or else the first plain text
+ * part of it, if it is multipart.
+ * @private
+ * @param {!Object<string, string>} headers The entity's headers.
+ * @param {string} body The entity's body (decoded as latin1).
+ * @param {number} depth How deeply nested this part is.
+ * @return {?string} The text, or null if there is none.
+ */
+Mail.textOf_ = function(headers, body, depth) {
+  var type = (headers['content-type'] || 'text/plain').toLowerCase();
+  if (type.startsWith('multipart/')) {
+    var boundary = Mail.headerParam_(headers['content-type'], 'boundary');
+    if (!boundary || depth > 10) return null;
+    var parts = body.split(new RegExp('(?:^|\\r?\\n)--' +
+        boundary.replace(/[^\w]/g, '\\$&') + '(?:--)?[ \\t]*(?=\\r?\\n|$)'));
+    // Skip the preamble (and stop at the epilogue).
+    for (var i = 1; i < parts.length - 1; i++) {
+      var part = Mail.split_(parts[i].replace(/^\r?\n/, ''));
+      var text = Mail.textOf_(Mail.parseHeaders_(part.head), part.body,
+                              depth + 1);
+      if (text !== null) return text;
+    }
+    return null;
+  } else if (!type.startsWith('text/plain')) {
+    return null;
+  }
+  var encoding = (headers['content-transfer-encoding'] || '').toLowerCase();
+  var bytes;
+  if (encoding === 'base64') {
+    bytes = Buffer.from(body.replace(/\s+/g, ''), 'base64');
+  } else if (encoding === 'quoted-printable') {
+    bytes = Mail.decodeQuotedPrintable_(body);
+  } else {
+    bytes = Buffer.from(body, 'latin1');
+  }
+  return Mail.decodeCharset_(
+      bytes, Mail.headerParam_(headers['content-type'], 'charset'))
+      .replace(/\r\n/g, '\n');
+};
+
+/**
+ * Split a message or MIME part into its header section and body.
+ * @private
+ * @param {string} text The message or part (decoded as latin1).
+ * @return {{head: string, body: string}}
+ */
+Mail.split_ = function(text) {
+  var m = text.match(/\r?\n\r?\n/);
+  if (!m) return {head: text, body: ''};
+  return {head: text.slice(0, m.index),
+          body: text.slice(m.index + m[0].length)};
+};
+
+/**
+ * Parse a received message (RFC 5322, with MIME).
+ * @param {!Buffer} data The message.
+ * @return {!Mail.Parsed}
+ */
+Mail.parse = function(data) {
+  var parts = Mail.split_(data.toString('latin1'));
+  var headers = Mail.parseHeaders_(parts.head);
+  var text = Mail.textOf_(headers, parts.body, 0);
+  return {
+    headers: headers,
+    subject: headers['subject'] || '',
+    from: headers['from'] || '',
+    text: (text === null) ? '' : text,
+  };
+};
+
+module.exports = Mail;
@@ -0,0 +1,806 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Rendering Markdown as HTML (the CC.markdown builtin),
+ * for help files, mail and web pages written in-world.
+ *
+ * This implements the commonly used subset of CommonMark: paragraphs,
+ * ATX and setext headings, thematic breaks, indented and fenced code
+ * blocks, block quotes, ordered and bullet lists (tight or loose), raw
+ * HTML blocks and tags, code spans, emphasis, inline and reference
+ * links and images, autolinks, backslash escapes, character
+ * references and hard line breaks.  It departs from the specification
+ * in corner cases (e.g., link text may not contain links or images,
+ * and "lazy" continuation lines are accepted wherever a paragraph
+ * might continue).  The result is always passed through
+ * Html.sanitize, so raw HTML and link destinations are subject to an
+ * Html.Policy like any other HTML from in-world code.
+ */
+'use strict';
+
+var Html = require('./html');
+
+var Markdown = {};
+
+/**
+ * A block of a document: a paragraph, heading, code block, thematic
+ * break, raw HTML, block quote (with child blocks) or list (with an
+ * array of child blocks for each item).
+ * @typedef {{type: string, text: (string|undefined),
+ *            level: (number|undefined), info: (string|undefined),
+ *            children: (!Array<!Markdown.Block>|undefined),
+ *            items: (!Array<!Array<!Markdown.Block>>|undefined),
+ *            ordered: (boolean|undefined), start: (number|undefined),
+ *            tight: (boolean|undefined)}}
+ */
+Markdown.Block;
+
+/**
+ * State of a rendering: the link reference definitions found, by
+ * normalized label, and the number of characters of links rendered so
+ * far (which, since references can be repeated, is not otherwise
+ * bounded by the length of the Markdown).
+ * @typedef {{refs: !Object<string, {url: string, title: string}>,
+ *            size: number}}
+ */
+Markdown.Context;
+
+/**
+ * Maximum length (in characters) of Markdown to render.  The HTML
+ * rendered can be several times as long, and must not exceed
+ * Html.MAX_LENGTH.
+ * @const {number}
+ */
+Markdown.MAX_LENGTH = 128 * 1024;
+
+/**
+ * Maximum depth of nested block quotes and lists; more deeply nested
+ * ones are rendered as paragraphs.
+ * @const {number}
+ */
+Markdown.MAX_DEPTH = 32;
+
+/**
+ * Estimated speed (characters rendered and sanitized per ms), for
+ * computing the cost of rendering.
+ * @const {number}
+ */
+Markdown.SPEED = 1024;
+
+/** @private @const {!RegExp} Start of a fenced code block. */
+Markdown.FENCE_RE_ = /^( {0,3})(`{3,}(?=[^`]*$)|~{3,})[ \t]*(\S*)/;
+
+/** @private @const {!RegExp} Close of a fenced code block. */
+Markdown.FENCE_CLOSE_RE_ = /^ {0,3}(`{3,}|~{3,})[ \t]*$/;
+
+/** @private @const {!RegExp} An ATX heading. */
+Markdown.HEADING_RE_ = /^ {0,3}(#{1,6})(?=[ \t]|$)(.*)$/;
+
+/** @private @const {!RegExp} A setext heading underline. */
+Markdown.SETEXT_RE_ = /^ {0,3}(=+|-+)[ \t]*$/;
+
+/** @private @const {!RegExp} A thematic break. */
+Markdown.HR_RE_ = /^ {0,3}([-*_])(?:[ \t]*\1){2,}[ \t]*$/;
+
+/** @private @const {!RegExp} Marker of a block quote line. */
+Markdown.QUOTE_RE_ = /^ {0,3}> ?/;
+
+/** @private @const {!RegExp} Marker of a list item. */
+Markdown.LIST_RE_ = /^( {0,3})(?:([-*+])|([0-9]{1,9})([.)]))(?=[ \t]|$)/;
+
+/**
+ * Start of a raw HTML block: a comment, or a tag of an element that
+ * cannot be inside a paragraph.
+ * @private @const {!RegExp}
+ */
+Markdown.HTML_BLOCK_RE_ = new RegExp('^ {0,3}(?:<!--|</?(address|article|' +
+    'aside|blockquote|details|dialog|dd|div|dl|dt|fieldset|figcaption|' +
+    'figure|footer|form|h[1-6]|header|hr|li|main|nav|ol|p|pre|script|' +
+    'section|style|summary|table|tbody|td|textarea|tfoot|th|thead|tr|ul)' +
+    '(?=[\\s/>]|$))', 'i');
+
+/**
+ * Elements whose raw HTML blocks end at their end tag, rather than at
+ * a blank line (since their content may include blank lines).
+ * @private @const {!Array<string>}
+ */
+Markdown.RAW_HTML_BLOCKS_ = ['pre', 'script', 'style', 'textarea'];
+
+/** @private @const {!RegExp} A link reference definition. */
+Markdown.REF_RE_ = new RegExp('^ {0,3}\\[((?:[^\\[\\]\\\\]|\\\\.)' +
+    '{1,999})\\]:[ \\t]*(<[^<>\\n]*>|\\S+)(?:[ \\t]+("(?:[^"\\\\]|\\\\.)*"|' +
+    '\'(?:[^\'\\\\]|\\\\.)*\'|\\((?:[^()\\\\]|\\\\.)*\\)))?[ \\t]*$');
+
+/**
+ * Destination and optional title of an inline link, after the "(".
+ * @private @const {!RegExp}
+ */
+Markdown.INLINE_LINK_RE_ = new RegExp('[ \\t\\n]*(?:<([^<>\\n]*)>|' +
+    '((?:[^\\s()\\\\]|\\\\.|\\((?:[^\\s()\\\\]|\\\\.)*\\))*))' +
+    '(?:[ \\t\\n]+("(?:[^"\\\\]|\\\\.)*"|\'(?:[^\'\\\\]|\\\\.)*\'|' +
+    '\\((?:[^()\\\\]|\\\\.)*\\)))?[ \\t\\n]*\\)', 'y');
+
+/** @private @const {!RegExp} Label of a full reference link. */
+Markdown.LABEL_RE_ = /\[((?:[^\[\]\\]|\\.){0,999})\]/y;
+
+/** @private @const {!RegExp} A URI autolink. */
+Markdown.AUTOLINK_RE_ = /<([a-zA-Z][a-zA-Z0-9+.-]{1,31}:[^\s<>]*)>/y;
+
+/** @private @const {!RegExp} An email autolink. */
+Markdown.EMAIL_RE_ = new RegExp('<([a-zA-Z0-9.!#$%&\'*+/=?^_`{|}~-]+@' +
+    '[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?' +
+    '(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*)>', 'y');
+
+/** @private @const {!RegExp} An inline raw HTML tag. */
+Markdown.TAG_RE_ = new RegExp('</?[a-zA-Z][a-zA-Z0-9-]*(?:\\s+' +
+    '[a-zA-Z_:][a-zA-Z0-9_.:-]*(?:\\s*=\\s*(?:[^\\s"\'=<>`]+|\'[^\']*\'|' +
+    '"[^"]*"))?)*\\s*/?>', 'y');
+
+/** @private @const {!RegExp} A character reference. */
+Markdown.ENTITY_RE_ =
+    /&(?:#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[a-zA-Z][a-zA-Z0-9]{1,31});/y;
+
+/** @private @const {!RegExp} A run of text with no special meaning. */
+Markdown.PLAIN_RE_ = /[^\\`<&!\[*_\n]+/y;
+
+/** @private @const {!RegExp} An ASCII punctuation character. */
+Markdown.ESCAPABLE_RE_ = /[!-\/:-@\[-`{-~]/;
+
+/** @private @const {!RegExp} A punctuation character (for emphasis). */
+Markdown.PUNCTUATION_RE_ = /[!-\/:-@\[-`{-~]|[\p{P}\p{S}]/u;
+
+/**
+ * Estimated cost (in ms) of rendering some Markdown.
+ * @param {string} text The Markdown.
+ * @return {number} The cost.
+ */
+Markdown.cost = function(text) {
+  return text.length / Markdown.SPEED;
+};
+
+/**
+ * Render some Markdown as sanitized HTML.
+ * @param {string} text The Markdown.
+ * @param {!Html.Policy=} policy What HTML to allow (default
+ *     Html.DEFAULT_POLICY).  Should have been checked with
+ *     Html.checkPolicy if it did not come from trusted code.
+ * @return {string} The HTML.
+ */
+Markdown.toHtml = function(text, policy) {
+  if (text.length > Markdown.MAX_LENGTH) {
+    throw new RangeError('Markdown too long');
+  }
+  var lines = text.replace(/\r\n?/g, '\n').replace(/\0/g, '\ufffd')
+      .split('\n').map(Markdown.expandTabs_);
+  var ctx = {refs: Object.create(null), size: 0};
+  var blocks = Markdown.parseBlocks_(lines, 0, ctx);
+  var html = Markdown.renderBlocks_(blocks, ctx, false);
+  if (html.length > Html.MAX_LENGTH) {
+    throw new RangeError('Rendered HTML too long');
+  }
+  return Html.sanitize(html, policy);
+};
+
+/**
+ * Expand tabs in the indentation of a line to spaces (with tab stops
+ * every four columns).
+ * @private
+ * @param {string} line The line.
+ * @return {string} The line, expanded.
+ */
+Markdown.expandTabs_ = function(line) {
+  return line.replace(/^[ \t]+/, function(indent) {
+    var spaces = '';
+    for (var i = 0; i < indent.length; i++) {
+      spaces += (indent[i] === '\t') ? ' '.repeat(4 - spaces.length % 4) : ' ';
+    }
+    return spaces;
+  });
+};
+
+/**
+ * Is a line blank?
+ * @private
+ * @param {string} line The line.
+ * @return {boolean}
+ */
+Markdown.isBlank_ = function(line) {
+  return !/\S/.test(line);
+};
+
+/**
+ * Does a line start a block that can interrupt a paragraph?
+ * @private
+ * @param {string} line The line.
+ * @return {boolean}
+ */
+Markdown.interrupts_ = function(line) {
+  if (Markdown.HEADING_RE_.test(line) || Markdown.FENCE_RE_.test(line) ||
+      Markdown.HR_RE_.test(line) || Markdown.QUOTE_RE_.test(line) ||
+      Markdown.HTML_BLOCK_RE_.test(line)) {
+    return true;
+  }
+  // Only a non-empty list item, and if ordered starting with 1.
+  var m = line.match(Markdown.LIST_RE_);
+  return Boolean(m) && !Markdown.isBlank_(line.slice(m[0].length)) &&
+      (m[3] === undefined || Number(m[3]) === 1);
+};
+
+/**
+ * Normalize the label of a link reference.
+ * @private
+ * @param {string} label The label.
+ * @return {string} The label, trimmed, with internal whitespace
+ *     collapsed, and in lower case.
+ */
+Markdown.normalizeLabel_ = function(label) {
+  return label.trim().replace(/\s+/g, ' ').toLowerCase();
+};
+
+/**
+ * Remove the backslash from backslash escapes.
+ * @private
+ * @param {string} text The text.
+ * @return {string} The text, unescaped.
+ */
+Markdown.unescape_ = function(text) {
+  return text.replace(/\\([!-\/:-@\[-`{-~])/g, '$1');
+};
+
+/**
+ * Parse lines of Markdown into blocks.
+ * @private
+ * @param {!Array<string>} lines The lines.
+ * @param {number} depth Number of enclosing block quotes and lists.
+ * @param {!Markdown.Context} ctx The rendering context (to which any
+ *     link reference definitions found are added).
+ * @return {!Array<!Markdown.Block>} The blocks.
+ */
+Markdown.parseBlocks_ = function(lines, depth, ctx) {
+  var blocks = [];
+  var i = 0;
+  while (i < lines.length) {
+    var line = lines[i];
+    var m;
+    if (Markdown.isBlank_(line)) {
+      i++;
+    } else if ((m = line.match(Markdown.FENCE_RE_))) {
+      var fence = m[2];
+      var indent = new RegExp('^ {0,' + m[1].length + '}');
+      var body = [];
+      for (i++; i < lines.length; i++) {
+        var close = lines[i].match(Markdown.FENCE_CLOSE_RE_);
+        if (close && close[1][0] === fence[0] &&
+            close[1].length >= fence.length) {
+          i++;
+          break;
+        }
+        body.push(lines[i].replace(indent, '') + '\n');
+      }
+      blocks.push({type: 'code', text: body.join(''),
+                   info: Markdown.unescape_(m[3])});
+    } else if (/^ {4}/.test(line)) {
+      body = [];
+      for (; i < lines.length; i++) {
+        if (/^ {4}/.test(lines[i])) {
+          body.push(lines[i].slice(4));
+        } else if (Markdown.isBlank_(lines[i])) {
+          body.push('');
+        } else {
+          break;
+        }
+      }
+      while (!body[body.length - 1]) body.pop();
+      blocks.push({type: 'code', text: body.join('\n') + '\n'});
+    } else if ((m = line.match(Markdown.HEADING_RE_))) {
+      blocks.push({type: 'heading', level: m[1].length,
+                   text: m[2].replace(/(?:^|[ \t]+)#+[ \t]*$/, '').trim()});
+      i++;
+    } else if (Markdown.HR_RE_.test(line)) {
+      blocks.push({type: 'hr'});
+      i++;
+    } else if ((m = line.match(Markdown.HTML_BLOCK_RE_))) {
+      var name = m[1] && m[1].toLowerCase();
+      var end = Markdown.RAW_HTML_BLOCKS_.includes(name) ?
+          new RegExp('</' + name + '>', 'i') : null;
+      body = [];
+      for (; i < lines.length; i++) {
+        if (end ? (body.length && end.test(body[body.length - 1])) :
+            Markdown.isBlank_(lines[i])) {
+          break;
+        }
+        body.push(lines[i]);
+      }
+      blocks.push({type: 'html', text: body.join('\n')});
+    } else if (depth < Markdown.MAX_DEPTH && Markdown.QUOTE_RE_.test(line)) {
+      body = [];
+      for (; i < lines.length; i++) {
+        line = lines[i];
+        if ((m = line.match(Markdown.QUOTE_RE_))) {
+          body.push(line.slice(m[0].length));
+        } else if (!Markdown.isBlank_(line) &&
+                   !Markdown.isBlank_(body[body.length - 1]) &&
+                   !Markdown.interrupts_(line)) {
+          body.push(line);  // Lazy continuation of a paragraph.
+        } else {
+          break;
+        }
+      }
+      blocks.push({type: 'quote',
+                   children: Markdown.parseBlocks_(body, depth + 1, ctx)});
+    } else if (depth < Markdown.MAX_DEPTH &&
+               (m = line.match(Markdown.LIST_RE_))) {
+      i = Markdown.parseList_(lines, i, depth, ctx, blocks);
+    } else {
+      i = Markdown.parseParagraph_(lines, i, ctx, blocks);
+    }
+  }
+  return blocks;
+};
+
+/**
+ * Parse a list.
+ * @private
+ * @param {!Array<string>} lines The lines.
+ * @param {number} i Index of the line with the first list item.
+ * @param {number} depth Number of enclosing block quotes and lists.
+ * @param {!Markdown.Context} ctx The rendering context.
+ * @param {!Array<!Markdown.Block>} blocks Blocks, to which the list is
+ *     added.
+ * @return {number} Index of the line after the list.
+ */
+Markdown.parseList_ = function(lines, i, depth, ctx, blocks) {
+  var first = lines[i].match(Markdown.LIST_RE_);
+  var ordered = first[3] !== undefined;
+  var marker = first[2] || first[4];
+  var items = [];
+  var tight = true;
+  var blankAfter = false;
+  var m;
+  while (i < lines.length && (m = lines[i].match(Markdown.LIST_RE_)) &&
+         (m[3] !== undefined) === ordered && (m[2] || m[4]) === marker &&
+         !Markdown.HR_RE_.test(lines[i])) {
+    if (blankAfter) tight = false;
+    var line = lines[i];
+    var rest = line.slice(m[0].length);
+    var spaces = rest.match(/^[ \t]*/)[0].length;
+    // Content begins after the marker and up to four spaces; any more,
+    // and it begins with an indented code block.
+    var indent = m[0].length +
+        ((Markdown.isBlank_(rest) || spaces > 4) ? 1 : spaces);
+    var body = [Markdown.isBlank_(rest) ? '' : line.slice(indent)];
+    for (i++; i < lines.length; i++) {
+      line = lines[i];
+      if (Markdown.isBlank_(line)) {
+        body.push('');
+      } else if (line.match(/^ */)[0].length >= indent) {
+        body.push(line.slice(indent));
+      } else if (body[body.length - 1] && !Markdown.interrupts_(line) &&
+                 !Markdown.LIST_RE_.test(line)) {
+        body.push(line.trim());  // Lazy continuation of a paragraph.
+      } else {
+        break;
+      }
+    }
+    blankAfter = false;
+    while (body.length > 1 && !body[body.length - 1]) {
+      body.pop();
+      blankAfter = true;
+    }
+    var children = Markdown.parseBlocks_(body, depth + 1, ctx);
+    if (children.length > 1 && body.some((l) => Markdown.isBlank_(l))) {
+      tight = false;
+    }
+    items.push(children);
+  }
+  blocks.push({type: 'list', ordered: ordered,
+               start: ordered ? Number(first[3]) : undefined,
+               tight: tight, items: items});
+  return i;
+};
+
+/**
+ * Parse a paragraph (or setext heading), and any link reference
+ * definitions at its start.
+ * @private
+ * @param {!Array<string>} lines The lines.
+ * @param {number} i Index of the paragraph's first line.
+ * @param {!Markdown.Context} ctx The rendering context.
+ * @param {!Array<!Markdown.Block>} blocks Blocks, to which the
+ *     paragraph is added.
+ * @return {number} Index of the line after the paragraph.
+ */
+Markdown.parseParagraph_ = function(lines, i, ctx, blocks) {
+  var body = [lines[i].replace(/^ +/, '')];
+  var level = 0;
+  for (i++; i < lines.length; i++) {
+    var line = lines[i];
+    var m = line.match(Markdown.SETEXT_RE_);
+    if (m) {
+      level = (m[1][0] === '=') ? 1 : 2;
+      i++;
+      break;
+    }
+    if (Markdown.isBlank_(line) || Markdown.interrupts_(line)) break;
+    body.push(line.replace(/^ +/, ''));
+  }
+  while (body.length && (m = body[0].match(Markdown.REF_RE_)) &&
+         /\S/.test(m[1])) {
+    var label = Markdown.normalizeLabel_(m[1]);
+    if (!(label in ctx.refs)) {
+      var url = m[2].replace(/^<(.*)>$/, '$1');
+      ctx.refs[label] = {
+        url: Html.decode(Markdown.unescape_(url)),
+        title: m[3] ? Html.decode(Markdown.unescape_(m[3].slice(1, -1))) : '',
+      };
+    }
+    body.shift();
+  }
+  if (!body.length) {
+    // Nothing but definitions; an underline is then just text.
+    if (level) blocks.push({type: 'paragraph', text: lines[i - 1].trim()});
+    return i;
+  }
+  var text = body.join('\n').trim();
+  blocks.push(level ? {type: 'heading', level: level, text: text} :
+                      {type: 'paragraph', text: text});
+  return i;
+};
+
+/**
+ * Render blocks as HTML.
+ * @private
+ * @param {!Array<!Markdown.Block>} blocks The blocks.
+ * @param {!Markdown.Context} ctx The rendering context.
+ * @param {boolean} tight True if the blocks are the content of an item
+ *     of a tight list (whose paragraphs are not wrapped in <p>).
+ * @return {string} The HTML.
+ */
+Markdown.renderBlocks_ = function(blocks, ctx, tight) {
+  return blocks.map(function(block) {
+    switch (block.type) {
+      case 'paragraph':
+        var html = Markdown.renderInline_(block.text, ctx, false);
+        return tight ? html : '<p>' + html + '</p>';
+      case 'heading':
+        return '<h' + block.level + '>' +
+            Markdown.renderInline_(block.text, ctx, false) +
+            '</h' + block.level + '>';
+      case 'code':
+        var lang = block.info ?
+            ' class="language-' + Html.escape(block.info) + '"' : '';
+        return '<pre><code' + lang + '>' + Html.escape(block.text) +
+            '</code></pre>';
+      case 'hr':
+        return '<hr>';
+      case 'html':
+        return block.text;
+      case 'quote':
+        return '<blockquote>\n' +
+            Markdown.renderBlocks_(block.children, ctx, false) +
+            '\n</blockquote>';
+      case 'list':
+        var tag = block.ordered ? 'ol' : 'ul';
+        var start = (block.ordered && block.start !== 1) ?
+            ' start="' + block.start + '"' : '';
+        return '<' + tag + start + '>\n' + block.items.map(function(item) {
+          return '<li>' + Markdown.renderBlocks_(item, ctx, block.tight) +
+              '</li>';
+        }).join('\n') + '\n</' + tag + '>';
+    }
+    throw new Error('Unknown block type ' + block.type);
+  }).join('\n');
+};
+
+/**
+ * Find the matching close bracket of each open bracket in some text.
+ * @private
+ * @param {string} text The text.
+ * @return {!Object<number, number>} Index of each matched "]", by
+ *     index of its "[".
+ */
+Markdown.matchBrackets_ = function(text) {
+  var matches = {};
+  var open = [];
+  for (var i = 0; i < text.length; i++) {
+    var c = text[i];
+    if (c === '\\') {
+      i++;
+    } else if (c === '[') {
+      open.push(i);
+    } else if (c === ']' && open.length) {
+      matches[open.pop()] = i;
+    }
+  }
+  return matches;
+};
+
+/**
+ * Render the inline content of a paragraph or heading as HTML.
+ * @private
+ * @param {string} text The content.
+ * @param {!Markdown.Context} ctx The rendering context.
+ * @param {boolean} inLink True if the content is the text of a link or
+ *     image (which may not contain links or images).
+ * @return {string} The HTML.
+ */
+Markdown.renderInline_ = function(text, ctx, inLink) {
+  // Pieces of HTML, and runs of emphasis delimiters (to be resolved
+  // once all are known).
+  var nodes = [];
+  var brackets = inLink ? {} : Markdown.matchBrackets_(text);
+  // Lengths of code span delimiters that have no closer (so need not
+  // be searched for again), and whether comments have no end.
+  var unclosedCode = {};
+  var unclosedComment = false;
+  var m;
+  var i = 0;
+  while (i < text.length) {
+    var c = text[i];
+    if (c === '\\') {
+      var next = text[i + 1];
+      if (next === '\n') {
+        nodes.push('<br>\n');
+        i += 2;
+        continue;
+      } else if (next !== undefined && Markdown.ESCAPABLE_RE_.test(next)) {
+        nodes.push(Html.escape(next));
+        i += 2;
+        continue;
+      }
+    } else if (c === '`') {
+      var n = text.slice(i).match(/^`+/)[0].length;
+      var end = -1;
+      if (!unclosedCode[n]) {
+        var closeRe = /`+/g;
+        closeRe.lastIndex = i + n;
+        while ((m = closeRe.exec(text)) && m[0].length !== n) {}
+        if (m) {
+          end = m.index;
+        } else {
+          unclosedCode[n] = true;
+        }
+      }
+      if (end === -1) {
+        nodes.push('`'.repeat(n));
+        i += n;
+        continue;
+      }
+      var code = text.slice(i + n, end).replace(/\n/g, ' ');
+      if (/^ [\s\S]*[^ ][\s\S]* $/.test(code)) code = code.slice(1, -1);
+      nodes.push('<code>' + Html.escape(code) + '</code>');
+      i = end + n;
+      continue;
+    } else if (c === '<') {
+      if ((m = Markdown.match_(Markdown.AUTOLINK_RE_, text, i))) {
+        nodes.push(Markdown.renderLink_(ctx, false, m[1],
+            Html.escape(m[1]), ''));
+        i += m[0].length;
+        continue;
+      } else if ((m = Markdown.match_(Markdown.EMAIL_RE_, text, i))) {
+        nodes.push(Markdown.renderLink_(ctx, false, 'mailto:' + m[1],
+            Html.escape(m[1]), ''));
+        i += m[0].length;
+        continue;
+      } else if ((m = Markdown.match_(Markdown.TAG_RE_, text, i))) {
+        nodes.push(m[0]);
+        i += m[0].length;
+        continue;
+      } else if (text.startsWith('<!--', i) && !unclosedComment) {
+        end = text.indexOf('-->', i + 4);
+        if (end !== -1) {
+          nodes.push(text.slice(i, end + 3));
+          i = end + 3;
+          continue;
+        }
+        unclosedComment = true;
+      }
+    } else if (c === '&') {
+      if ((m = Markdown.match_(Markdown.ENTITY_RE_, text, i))) {
+        nodes.push(m[0]);
+        i += m[0].length;
+        continue;
+      }
+    } else if ((c === '[' || c === '!' && text[i + 1] === '[') && !inLink) {
+      var image = (c === '!');
+      var link = Markdown.parseLink_(text, image ? i + 1 : i, brackets,
+                                     ctx);
+      if (link) {
+        var content = Markdown.renderInline_(link.text, ctx, true);
+        if (image) {
+          // Alt text is plain text.
+          content = Html.escape(Html.decode(content.replace(/<[^>]*>/g, '')));
+        }
+        nodes.push(Markdown.renderLink_(ctx, image, link.url, content,
+                                        link.title));
+        i = link.end;
+        continue;
+      }
+    } else if (c === '*' || c === '_') {
+      n = text.slice(i).match(c === '*' ? /^\*+/ : /^_+/)[0].length;
+      var before = text[i - 1] || '\n';
+      var after = text[i + n] || '\n';
+      var spaceBefore = /\s/.test(before);
+      var spaceAfter = /\s/.test(after);
+      var punctBefore = Markdown.PUNCTUATION_RE_.test(before);
+      var punctAfter = Markdown.PUNCTUATION_RE_.test(after);
+      var left = !spaceAfter && (!punctAfter || spaceBefore || punctBefore);
+      var right = !spaceBefore && (!punctBefore || spaceAfter || punctAfter);
+      nodes.push({
+        delim: c, count: n, length: n, open: '', close: '',
+        canOpen: (c === '*') ? left : left && (!right || punctBefore),
+        canClose: (c === '*') ? right : right && (!left || punctAfter),
+      });
+      i += n;
+      continue;
+    } else if (c === '\n') {
+      // Two or more spaces at the end of a line make a hard break.
+      var last = nodes[nodes.length - 1];
+      var hard = typeof last === 'string' && / {2,}$/.test(last);
+      if (typeof last === 'string') {
+        nodes[nodes.length - 1] = last.replace(/ +$/, '');
+      }
+      nodes.push(hard ? '<br>\n' : '\n');
+      i++;
+      while (text[i] === ' ') i++;
+      continue;
+    } else if ((m = Markdown.match_(Markdown.PLAIN_RE_, text, i))) {
+      nodes.push(Html.escape(m[0]));
+      i += m[0].length;
+      continue;
+    }
+    // A special character with no special meaning here.
+    nodes.push(Html.escape(c));
+    i++;
+  }
+  Markdown.resolveEmphasis_(nodes);
+  return nodes.map(function(node) {
+    return (typeof node === 'string') ? node :
+        node.close + node.delim.repeat(node.count) + node.open;
+  }).join('');
+};
+
+/**
+ * Match a sticky regular expression at a given index.
+ * @private
+ * @param {!RegExp} re The regular expression (with the y flag).
+ * @param {string} text The text.
+ * @param {number} index The index.
+ * @return {?Array<string>} The match, if any.
+ */
+Markdown.match_ = function(re, text, index) {
+  re.lastIndex = index;
+  return re.exec(text);
+};
+
+/**
+ * Parse a link (or the part of an image after the "!").
+ * @private
+ * @param {string} text The inline content.
+ * @param {number} start Index of the link's "[".
+ * @param {!Object<number, number>} brackets Matching brackets in text.
+ * @param {!Markdown.Context} ctx The rendering context.
+ * @return {?{text: string, url: string, title: string, end: number}} The
+ *     link's text, destination and title, and the index after it, or
+ *     null if there is no link.
+ */
+Markdown.parseLink_ = function(text, start, brackets, ctx) {
+  var close = brackets[start];
+  if (close === undefined) return null;
+  var linkText = text.slice(start + 1, close);
+  var m;
+  if (text[close + 1] === '(' &&
+      (m = Markdown.match_(Markdown.INLINE_LINK_RE_, text, close + 2))) {
+    var url = (m[1] !== undefined) ? m[1] : m[2];
+    return {
+      text: linkText,
+      url: Html.decode(Markdown.unescape_(url)),
+      title: m[3] ? Html.decode(Markdown.unescape_(m[3].slice(1, -1))) : '',
+      end: close + 2 + m[0].length,
+    };
+  }
+  // A reference link: full ([text][label]), collapsed ([label][]) or
+  // shortcut ([label]).
+  var label = linkText;
+  var end = close + 1;
+  if ((m = Markdown.match_(Markdown.LABEL_RE_, text, close + 1))) {
+    if (m[1]) label = m[1];
+    end += m[0].length;
+  }
+  var ref = ctx.refs[Markdown.normalizeLabel_(label)];
+  if (!ref) return null;
+  return {text: linkText, url: ref.url, title: ref.title, end: end};
+};
+
+/**
+ * Render a link or image.
+ * @private
+ * @param {!Markdown.Context} ctx The rendering context.
+ * @param {boolean} image True for an image.
+ * @param {string} url The destination (or source of an image).
+ * @param {string} content The link's content (HTML), or image's alt text
+ *     (escaped).
+ * @param {string} title The title, if any.
+ * @return {string} The HTML.
+ */
+Markdown.renderLink_ = function(ctx, image, url, content, title) {
+  title = title ? ' title="' + Html.escape(title) + '"' : '';
+  var html = image ?
+      '<img src="' + Html.escape(url) + '" alt="' + content + '"' + title +
+          '>' :
+      '<a href="' + Html.escape(url) + '"' + title + '>' + content + '</a>';
+  ctx.size += html.length;
+  if (ctx.size > Html.MAX_LENGTH) {
+    throw new RangeError('Rendered HTML too long');
+  }
+  return html;
+};
+
+/**
+ * Match the emphasis delimiter runs in some inline content (as
+ * rendered by Markdown.renderInline_), adding the <em> and <strong>
+ * tags needed to them.  Follows the CommonMark algorithm, with the
+ * stack of potential openers kept as an array.
+ * @private
+ * @param {!Array<string|!Object>} nodes The content.
+ */
+Markdown.resolveEmphasis_ = function(nodes) {
+  var openers = [];
+  // Lowest index in openers at which to look for an opener for each
+  // kind of closer, so that failed searches are not repeated.
+  var bottom = Object.create(null);
+  for (var c = 0; c < nodes.length; c++) {
+    var closer = nodes[c];
+    if (typeof closer === 'string') continue;
+    if (closer.canClose) {
+      var kind = closer.delim + closer.canOpen + closer.length % 3;
+      while (closer.count) {
+        for (var o = openers.length - 1; o >= (bottom[kind] || 0); o--) {
+          var opener = openers[o];
+          // The "rule of 3": a run that can both open and close can
+          // match one only if their lengths do not sum to a multiple
+          // of 3, unless both are multiples of 3.
+          if (opener.delim === closer.delim &&
+              !((opener.canClose || closer.canOpen) &&
+                (opener.length + closer.length) % 3 === 0 &&
+                (opener.length % 3 || closer.length % 3))) {
+            break;
+          }
+        }
+        if (o < (bottom[kind] || 0)) {
+          bottom[kind] = openers.length;
+          break;
+        }
+        var use = (opener.count >= 2 && closer.count >= 2) ? 2 : 1;
+        var tag = (use === 2) ? 'strong' : 'em';
+        opener.count -= use;
+        closer.count -= use;
+        opener.open = '<' + tag + '>' + opener.open;
+        closer.close += '</' + tag + '>';
+        // Openers between the two can no longer be matched.
+        openers.length = opener.count ? o + 1 : o;
+        for (var k in bottom) {
+          bottom[k] = Math.min(bottom[k], openers.length);
+        }
+      }
+    }
+    if (closer.canOpen && closer.count) openers.push(closer);
+  }
+};
+
+module.exports = Markdown;
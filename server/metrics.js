@@ -0,0 +1,456 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Counters, gauges and histograms describing a running
+ * server, and an HTTP server exposing them at /metrics in the
+ * Prometheus text exposition format (version 0.0.4), for scraping by
+ * Prometheus and compatible monitoring systems.
+ */
+'use strict';
+
+var http = require('http');
+
+var Metrics = {};
+
+/**
+ * Default histogram buckets (upper bounds, in seconds), as used by the
+ * Prometheus client libraries.
+ * @const {!Array<number>}
+ */
+Metrics.DEFAULT_BUCKETS =
+    [0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10];
+
+/**
+ * Content-Type of the exposition format.
+ * @const {string}
+ */
+Metrics.CONTENT_TYPE = 'text/plain; version=0.0.4; charset=utf-8';
+
+/**
+ * A metric: a named family of values, one for each combination of
+ * values of its labels.
+ * @constructor
+ * @param {string} type The metric type ('counter', 'gauge' or
+ *     'histogram').
+ * @param {string} name The metric's name.
+ * @param {string} help Description of the metric.
+ * @param {!Array<string>=} labelNames Names of the metric's labels.
+ */
+Metrics.Metric = function(type, name, help, labelNames) {
+  labelNames = labelNames || [];
+  if (!/^[a-zA-Z_:][a-zA-Z0-9_:]*$/.test(name)) {
+    throw new TypeError('Invalid metric name: ' + name);
+  }
+  for (var i = 0; i < labelNames.length; i++) {
+    if (!/^[a-zA-Z_][a-zA-Z0-9_]*$/.test(labelNames[i]) ||
+        labelNames[i].startsWith('__') || labelNames[i] === 'le') {
+      throw new TypeError('Invalid label name: ' + labelNames[i]);
+    }
+  }
+  /** @const {string} */
+  this.type = type;
+  /** @const {string} */
+  this.name = name;
+  /** @const {string} */
+  this.help = help;
+  /** @const {!Array<string>} */
+  this.labelNames = labelNames;
+  /**
+   * Values, by their labels as formatted by .labels_.
+   * @private @const {!Map<string, *>}
+   */
+  this.values_ = new Map();
+};
+
+/**
+ * Format the labels of a value.
+ * @private
+ * @param {!Object<string, *>|undefined} labels The values of the
+ *     metric's labels.
+ * @return {string} The labels, as they appear in the exposition format
+ *     (e.g., '{port="7777"}'), or '' if the metric has none.
+ */
+Metrics.Metric.prototype.labels_ = function(labels) {
+  labels = labels || {};
+  var parts = [];
+  for (var i = 0; i < this.labelNames.length; i++) {
+    var name = this.labelNames[i];
+    if (!(name in labels)) {
+      throw new TypeError('Missing label ' + name + ' for ' + this.name);
+    }
+    parts.push(name + '="' + String(labels[name])
+        .replace(/\\/g, '\\\\').replace(/\n/g, '\\n').replace(/"/g, '\\"') +
+        '"');
+  }
+  return parts.length ? '{' + parts.join(',') + '}' : '';
+};
+
+/**
+ * The HELP and TYPE lines of the metric.
+ * @private
+ * @return {!Array<string>}
+ */
+Metrics.Metric.prototype.header_ = function() {
+  return [
+    '# HELP ' + this.name + ' ' +
+        this.help.replace(/\\/g, '\\\\').replace(/\n/g, '\\n'),
+    '# TYPE ' + this.name + ' ' + this.type,
+  ];
+};
+
+/**
+ * Remove all values (e.g., before re-collecting them).
+ */
+Metrics.Metric.prototype.clear = function() {
+  this.values_.clear();
+};
+
+/**
+ * Format the metric.
+ * @return {string} The metric, in the exposition format.
+ */
+Metrics.Metric.prototype.format = function() {
+  var lines = this.header_();
+  this.values_.forEach(function(value, labels) {
+    lines.push(this.name + labels + ' ' + Metrics.formatNumber_(value));
+  }, this);
+  return lines.join('\n') + '\n';
+};
+
+/**
+ * A counter: a value that only increases (except when the server
+ * restarts).
+ * @constructor
+ * @extends {Metrics.Metric}
+ * @param {string} name The metric's name (conventionally ending in
+ *     '_total').
+ * @param {string} help Description of the metric.
+ * @param {!Array<string>=} labelNames Names of the metric's labels.
+ */
+Metrics.Counter = function(name, help, labelNames) {
+  Metrics.Metric.call(this, 'counter', name, help, labelNames);
+};
+Metrics.Counter.prototype = Object.create(Metrics.Metric.prototype);
+Metrics.Counter.prototype.constructor = Metrics.Counter;
+
+/**
+ * Increase the counter.
+ * @param {number=} amount The amount to add (default 1).
+ * @param {!Object<string, *>=} labels The values of the labels.
+ */
+Metrics.Counter.prototype.inc = function(amount, labels) {
+  if (amount === undefined) amount = 1;
+  if (amount < 0) throw new RangeError('Counters cannot decrease');
+  var key = this.labels_(labels);
+  this.values_.set(key, (this.values_.get(key) || 0) + amount);
+};
+
+/**
+ * Set the counter, for counts maintained elsewhere (e.g., by a
+ * Metrics.Registry collector).
+ * @param {number} value The count.
+ * @param {!Object<string, *>=} labels The values of the labels.
+ */
+Metrics.Counter.prototype.set = function(value, labels) {
+  this.values_.set(this.labels_(labels), value);
+};
+
+/**
+ * A gauge: a value that can go up and down.
+ * @constructor
+ * @extends {Metrics.Metric}
+ * @param {string} name The metric's name.
+ * @param {string} help Description of the metric.
+ * @param {!Array<string>=} labelNames Names of the metric's labels.
+ */
+Metrics.Gauge = function(name, help, labelNames) {
+  Metrics.Metric.call(this, 'gauge', name, help, labelNames);
+};
+Metrics.Gauge.prototype = Object.create(Metrics.Metric.prototype);
+Metrics.Gauge.prototype.constructor = Metrics.Gauge;
+
+/**
+ * Set the gauge.
+ * @param {number} value The value.
+ * @param {!Object<string, *>=} labels The values of the labels.
+ */
+Metrics.Gauge.prototype.set = function(value, labels) {
+  this.values_.set(this.labels_(labels), value);
+};
+
+/**
+ * Increase (or, if amount is negative, decrease) the gauge.
+ * @param {number=} amount The amount to add (default 1).
+ * @param {!Object<string, *>=} labels The values of the labels.
+ */
+Metrics.Gauge.prototype.inc = function(amount, labels) {
+  var key = this.labels_(labels);
+  this.values_.set(key, (this.values_.get(key) || 0) +
+                   (amount === undefined ? 1 : amount));
+};
+
+/**
+ * A histogram: counts of observations (e.g., of durations) in
+ * buckets, along with their total.
+ * @constructor
+ * @extends {Metrics.Metric}
+ * @param {string} name The metric's name.
+ * @param {string} help Description of the metric.
+ * @param {!Array<number>=} buckets Upper bounds of the buckets, in
+ *     increasing order (default Metrics.DEFAULT_BUCKETS).  A final
+ *     bucket of +Inf is implied.
+ * @param {!Array<string>=} labelNames Names of the metric's labels.
+ */
+Metrics.Histogram = function(name, help, buckets, labelNames) {
+  Metrics.Metric.call(this, 'histogram', name, help, labelNames);
+  buckets = buckets || Metrics.DEFAULT_BUCKETS;
+  for (var i = 1; i < buckets.length; i++) {
+    if (!(buckets[i] > buckets[i - 1])) {
+      throw new RangeError('Histogram buckets must be increasing');
+    }
+  }
+  /** @const {!Array<number>} */
+  this.buckets = buckets.slice();
+  /** @private @const {!Map<string, !Object<string, *>>} */
+  this.labelValues_ = new Map();
+};
+Metrics.Histogram.prototype = Object.create(Metrics.Metric.prototype);
+Metrics.Histogram.prototype.constructor = Metrics.Histogram;
+
+/**
+ * Record an observation.
+ * @param {number} value The value observed.
+ * @param {!Object<string, *>=} labels The values of the labels.
+ */
+Metrics.Histogram.prototype.observe = function(value, labels) {
+  var key = this.labels_(labels);
+  var data = this.values_.get(key);
+  if (!data) {
+    data = {counts: this.buckets.map(function() {return 0;}), sum: 0,
+            count: 0};
+    this.values_.set(key, data);
+    this.labelValues_.set(key, labels || {});
+  }
+  for (var i = 0; i < this.buckets.length; i++) {
+    if (value <= this.buckets[i]) data.counts[i]++;
+  }
+  data.sum += value;
+  data.count++;
+};
+
+/** @override */
+Metrics.Histogram.prototype.clear = function() {
+  Metrics.Metric.prototype.clear.call(this);
+  this.labelValues_.clear();
+};
+
+/** @override */
+Metrics.Histogram.prototype.format = function() {
+  var lines = this.header_();
+  this.values_.forEach(function(data, key) {
+    var base = this.labels_(this.labelValues_.get(key));
+    // Insert le into the (possibly empty) labels.
+    var le = function(bound) {
+      var label = 'le="' + Metrics.formatNumber_(bound) + '"';
+      return base ? base.slice(0, -1) + ',' + label + '}' : '{' + label + '}';
+    };
+    for (var i = 0; i < this.buckets.length; i++) {
+      lines.push(this.name + '_bucket' + le(this.buckets[i]) + ' ' +
+                 data.counts[i]);
+    }
+    lines.push(this.name + '_bucket' + le(Infinity) + ' ' + data.count);
+    lines.push(this.name + '_sum' + base + ' ' +
+               Metrics.formatNumber_(data.sum));
+    lines.push(this.name + '_count' + base + ' ' + data.count);
+  }, this);
+  return lines.join('\n') + '\n';
+};
+
+/**
+ * Format a number as in the exposition format.
+ * @private
+ * @param {*} value The number.
+ * @return {string}
+ */
+Metrics.formatNumber_ = function(value) {
+  value = Number(value);
+  if (value === Infinity) return '+Inf';
+  if (value === -Infinity) return '-Inf';
+  return String(value);
+};
+
+/**
+ * A collection of metrics, to be exposed together.
+ * @constructor
+ * @struct
+ */
+Metrics.Registry = function() {
+  /** @private @const {!Map<string, !Metrics.Metric>} */
+  this.metrics_ = new Map();
+  /** @private @const {!Array<function()>} */
+  this.collectors_ = [];
+};
+
+/**
+ * Add a metric.
+ * @param {!Metrics.Metric} metric The metric.
+ * @return {!Metrics.Metric} The metric.
+ */
+Metrics.Registry.prototype.add = function(metric) {
+  if (this.metrics_.has(metric.name)) {
+    throw new Error('Duplicate metric: ' + metric.name);
+  }
+  this.metrics_.set(metric.name, metric);
+  return metric;
+};
+
+/**
+ * Create and add a counter.
+ * @param {string} name The metric's name.
+ * @param {string} help Description of the metric.
+ * @param {!Array<string>=} labelNames Names of the metric's labels.
+ * @return {!Metrics.Counter}
+ */
+Metrics.Registry.prototype.counter = function(name, help, labelNames) {
+  return /** @type {!Metrics.Counter} */(
+      this.add(new Metrics.Counter(name, help, labelNames)));
+};
+
+/**
+ * Create and add a gauge.
+ * @param {string} name The metric's name.
+ * @param {string} help Description of the metric.
+ * @param {!Array<string>=} labelNames Names of the metric's labels.
+ * @return {!Metrics.Gauge}
+ */
+Metrics.Registry.prototype.gauge = function(name, help, labelNames) {
+  return /** @type {!Metrics.Gauge} */(
+      this.add(new Metrics.Gauge(name, help, labelNames)));
+};
+
+/**
+ * Create and add a histogram.
+ * @param {string} name The metric's name.
+ * @param {string} help Description of the metric.
+ * @param {!Array<number>=} buckets Upper bounds of the buckets.
+ * @param {!Array<string>=} labelNames Names of the metric's labels.
+ * @return {!Metrics.Histogram}
+ */
+Metrics.Registry.prototype.histogram = function(name, help, buckets,
+                                                labelNames) {
+  return /** @type {!Metrics.Histogram} */(
+      this.add(new Metrics.Histogram(name, help, buckets, labelNames)));
+};
+
+/**
+ * Add a collector: a function called before the metrics are formatted,
+ * to update those whose values are computed on demand (e.g., from
+ * the interpreter's state).  An exception thrown by a collector is
+ * logged and otherwise ignored.
+ * @param {function()} collector The collector.
+ */
+Metrics.Registry.prototype.collect = function(collector) {
+  this.collectors_.push(collector);
+};
+
+/**
+ * Run the collectors, then format every metric.
+ * @return {string} The metrics, in the exposition format.
+ */
+Metrics.Registry.prototype.format = function() {
+  for (var i = 0; i < this.collectors_.length; i++) {
+    try {
+      this.collectors_[i]();
+    } catch (e) {
+      console.error('Metrics collector failed: %s', e);
+    }
+  }
+  var parts = [];
+  this.metrics_.forEach(function(metric) {
+    parts.push(metric.format());
+  });
+  return parts.join('');
+};
+
+/**
+ * A server exposing a registry's metrics at /metrics.
+ * @constructor
+ * @struct
+ * @param {!Metrics.Registry} registry The metrics to expose.
+ */
+Metrics.Server = function(registry) {
+  /** @const {!Metrics.Registry} */
+  this.registry = registry;
+  /** @private @const {!http.Server} */
+  this.server_ = http.createServer(this.handle_.bind(this));
+};
+
+/**
+ * Start listening for requests.
+ * @param {number} port The port to listen on.
+ * @param {string=} host The address to listen on (default: all).
+ * @return {!Promise<number>} Resolves to the port listened on.
+ */
+Metrics.Server.prototype.listen = function(port, host) {
+  var server = this.server_;
+  return new Promise(function(resolve, reject) {
+    server.once('error', reject);
+    server.listen(port, host, function() {
+      server.removeListener('error', reject);
+      resolve(server.address().port);
+    });
+  });
+};
+
+/**
+ * Stop listening for requests.
+ * @return {!Promise<void>} Resolves once all connections have closed.
+ */
+Metrics.Server.prototype.close = function() {
+  var server = this.server_;
+  return new Promise(function(resolve) {
+    server.close(function() {resolve();});
+  });
+};
+
+/**
+ * Handle an HTTP request.
+ * @private
+ * @param {!http.IncomingMessage} req The request.
+ * @param {!http.ServerResponse} res The response.
+ */
+Metrics.Server.prototype.handle_ = function(req, res) {
+  req.resume();
+  var path = new URL(req.url, 'http://localhost').pathname;
+  if (path !== '/metrics') {
+    res.writeHead(404, {'Content-Type': 'text/plain'});
+    res.end('Not Found\n');
+  } else if (req.method !== 'GET' && req.method !== 'HEAD') {
+    res.writeHead(405, {'Content-Type': 'text/plain', 'Allow': 'GET, HEAD'});
+    res.end('Method Not Allowed\n');
+  } else {
+    var body = this.registry.format();
+    res.writeHead(200, {
+      'Content-Type': Metrics.CONTENT_TYPE,
+      'Content-Length': Buffer.byteLength(body),
+    });
+    res.end(req.method === 'HEAD' ? undefined : body);
+  }
+};
+
+module.exports = Metrics;
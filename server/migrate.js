@@ -0,0 +1,322 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Migration of checkpoints saved by earlier versions of
+ * the server, so that they can be loaded by the current one.
+ *
+ * Every checkpoint records the serialization version of the
+ * interpreter that saved it (in the .serializationVersion property of
+ * the interpreter proper, object #0, whose record is always the first
+ * in the file).  Whenever SERIALIZATION_VERSION is incremented, a
+ * migration must be registered at the end of this file to convert
+ * records from the previous version: it is called with each record in
+ * turn, before deserialization, and should modify it in place to
+ * match the representation that the current implementation expects.
+ * Migrations are applied in sequence, so a checkpoint can be migrated
+ * from any earlier version for which a chain of migrations exists.
+ */
+'use strict';
+
+var Interpreter = require('./interpreter');
+
+var Migrate = {};
+
+/**
+ * A migration from one serialization version to the next.
+ * @typedef {{description: string, migrate: function(!Object)}}
+ */
+Migrate.Migration;
+
+/**
+ * Registered migrations, keyed by the version they migrate from.
+ * @private @const {!Object<number,!Migrate.Migration>}
+ */
+Migrate.migrations_ = Object.create(null);
+
+/**
+ * Register a migration.
+ * @param {number} version Serialization version migrated from.
+ * @param {string} description Summary of the change in representation.
+ * @param {function(!Object)} migrate Function to modify each record.
+ */
+Migrate.register = function(version, description, migrate) {
+  if (version in Migrate.migrations_) {
+    throw new Error('Duplicate migration from version ' + version);
+  }
+  Migrate.migrations_[version] = {description: description, migrate: migrate};
+};
+
+/**
+ * Get the serialization version recorded in the record for the
+ * interpreter proper.  Very old checkpoints have no version, and are
+ * treated as version 0.
+ * @param {!Object} record Record for object #0.
+ * @return {number} Serialization version.
+ */
+Migrate.versionOf = function(record) {
+  var props = record['props'];
+  var version = props && props['serializationVersion'];
+  return (typeof version === 'number') ? version : 0;
+};
+
+/**
+ * A filter that migrates the records of a single flatpack (checkpoint,
+ * incremental checkpoint or journal) as they are read, and passes them
+ * on.  The version of the flatpack is determined from the record for
+ * the interpreter proper; any records preceding it are held until it
+ * is seen.
+ * @constructor
+ * @struct
+ * @param {function(!Object)} onRecord Callback to receive each record,
+ *     once migrated.
+ * @param {number=} target Version to migrate to.  (Default: the
+ *     current SERIALIZATION_VERSION.)
+ * @param {!Object<number,!Migrate.Migration>=} migrations Migrations
+ *     available.  (Default: those registered.)
+ */
+Migrate.Migrator = function(onRecord, target, migrations) {
+  /** @private @const {function(!Object)} */
+  this.onRecord_ = onRecord;
+  /** @private @const {number} */
+  this.target_ = (target === undefined) ?
+      Interpreter.SERIALIZATION_VERSION : target;
+  /** @private @const {!Object<number,!Migrate.Migration>} */
+  this.migrations_ = migrations || Migrate.migrations_;
+  /**
+   * Migrations to apply, once the version is known.
+   * @private {?Array<!Migrate.Migration>}
+   */
+  this.steps_ = null;
+  /** @private @const {!Array<!Object>} Records awaiting the version. */
+  this.held_ = [];
+  /** @private {number} Number of records added so far. */
+  this.count_ = 0;
+  /** @type {number|undefined} Version migrated from, once known. */
+  this.version = undefined;
+};
+
+/**
+ * Migrate one record and pass it on.
+ * @param {!Object} record JSON-compatible record.
+ */
+Migrate.Migrator.prototype.add = function(record) {
+  // As in Serializer.Deserializer, a record with no ID is identified by
+  // its position.
+  var id = ('#' in record) ? record['#'] : this.count_;
+  this.count_++;
+  if (!this.steps_) {
+    if (id !== 0) {
+      this.held_.push(record);
+      return;
+    }
+    this.start_(Migrate.versionOf(record));
+    this.apply_(record, true);
+    for (var i = 0; i < this.held_.length; i++) {
+      this.apply_(this.held_[i], false);
+    }
+    this.held_.length = 0;
+    return;
+  }
+  this.apply_(record, false);
+};
+
+/**
+ * Signal that all records have been added.
+ */
+Migrate.Migrator.prototype.finish = function() {
+  if (this.held_.length) {
+    throw new ReferenceError('No record for interpreter (object #0)');
+  }
+};
+
+/**
+ * Determine which migrations to apply.
+ * @private
+ * @param {number} version Serialization version of records.
+ */
+Migrate.Migrator.prototype.start_ = function(version) {
+  if (version > this.target_) {
+    throw new RangeError('Checkpoint is serialization version ' + version +
+        ', but this server supports only version ' + this.target_ +
+        ' and earlier');
+  }
+  var steps = [];
+  for (var v = version; v < this.target_; v++) {
+    var migration = this.migrations_[v];
+    if (!migration) {
+      throw new RangeError('No migration from serialization version ' + v);
+    }
+    steps.push(migration);
+  }
+  this.version = version;
+  this.steps_ = steps;
+};
+
+/**
+ * Apply migrations to a record and pass it on.
+ * @private
+ * @param {!Object} record JSON-compatible record.
+ * @param {boolean} isInterpreter Is this the record for object #0?
+ */
+Migrate.Migrator.prototype.apply_ = function(record, isInterpreter) {
+  var steps = /** @type {!Array<!Migrate.Migration>} */(this.steps_);
+  for (var i = 0; i < steps.length; i++) {
+    steps[i].migrate(record);
+  }
+  if (steps.length && isInterpreter) {
+    record['props']['serializationVersion'] = this.target_;
+  }
+  this.onRecord_(record);
+};
+
+///////////////////////////////////////////////////////////////////////////////
+// Migrations.
+///////////////////////////////////////////////////////////////////////////////
+
+Migrate.register(3, 'Add .serverVersion to Interpreter', function() {
+  // Nothing to do: the property is left undefined.
+});
+
+Migrate.register(4, 'Add .protocol and .origins to Server', function(record) {
+  if (record['type'] === 'Server') {
+    var props = record['props'] || (record['props'] = {});
+    props['protocol'] = 'tcp';
+    props['origins'] = null;
+  }
+});
+
+Migrate.register(5, 'Add .compress to Server', function(record) {
+  if (record['type'] === 'Server') {
+    var props = record['props'] || (record['props'] = {});
+    props['compress'] = false;
+  }
+});
+
+Migrate.register(6, 'Add .tls to Server', function(record) {
+  if (record['type'] === 'Server') {
+    var props = record['props'] || (record['props'] = {});
+    props['tls'] = false;
+  }
+});
+
+Migrate.register(7, 'Add .bans_ to Interpreter', function() {
+  // Nothing to do: the interpreter's initial empty list is kept.
+});
+
+Migrate.register(8, 'Add .proxy to Server', function(record) {
+  if (record['type'] === 'Server') {
+    var props = record['props'] || (record['props'] = {});
+    props['proxy'] = false;
+  }
+});
+
+Migrate.register(9, 'Add .resume to Server', function(record) {
+  if (record['type'] === 'Server') {
+    var props = record['props'] || (record['props'] = {});
+    props['resume'] = 0;
+  }
+});
+
+Migrate.register(10, 'Add .logChannels_ to Interpreter', function() {
+  // Nothing to do: the interpreter's initial empty map is kept.
+});
+
+Migrate.register(11, 'Add debugger breakpoints and thread stepping',
+                 function() {
+  // Nothing to do: new Interpreter and Thread properties keep their
+  // initial values (no breakpoints; threads not being stepped).
+});
+
+Migrate.register(12, 'Add property access auditing', function() {
+  // Nothing to do: the interpreter's initial (empty) audits and audit
+  // log are kept.
+});
+
+Migrate.register(13, 'Add debugger watchpoints', function() {
+  // Nothing to do: the interpreter's initial (empty) map of watchpoints
+  // is kept.
+});
+
+Migrate.register(14, 'Add module libraries and cache', function() {
+  // Nothing to do: the interpreter's initial (empty) list of libraries
+  // and module cache are kept.
+});
+
+Migrate.register(15, 'Add installed packages', function() {
+  // Nothing to do: the interpreter's initial (empty) map of installed
+  // packages is kept.
+});
+
+Migrate.register(16, 'Add connection bindings to players', function() {
+  // Nothing to do: connections in checkpoints of earlier versions are
+  // not attached to players, and have no login ID.
+});
+
+Migrate.register(17, 'Add permission tiers', function(record) {
+  // Owners in checkpoints of earlier versions keep the privileges they
+  // effectively had, by making wizard the default tier of such worlds
+  // (new worlds default to programmer).
+  if (record['type'] === 'Interpreter') {
+    var props = record['props'] || (record['props'] = {});
+    if (props['defaultTier_'] === undefined) props['defaultTier_'] = 'wizard';
+  }
+});
+
+Migrate.register(18, 'Add object destruction and recycle bin', function() {
+  // Nothing to do: no objects in checkpoints of earlier versions have
+  // been destroyed.
+});
+
+Migrate.register(19, 'Add sandboxes', function() {
+  // Nothing to do: checkpoints of earlier versions have no sandboxes.
+});
+
+Migrate.register(20, 'Add size limits', function() {
+  // Nothing to do: checkpoints of earlier versions set no size limits.
+});
+
+Migrate.register(21, 'Add security events', function() {
+  // Nothing to do: checkpoints of earlier versions have no security log.
+});
+
+Migrate.register(22, 'Add .features to Server', function(record) {
+  // Checkpoints saved since .features was added (without a change of
+  // version) already have it.
+  if (record['type'] === 'Server') {
+    var props = record['props'] || (record['props'] = {});
+    if (props['features'] === undefined) props['features'] = [];
+  }
+});
+
+Migrate.register(23, 'Add .idle, .idleWarning and .keepalive to Server',
+                 function(record) {
+  // Checkpoints saved since these were added (without a change of
+  // version) already have them.
+  if (record['type'] === 'Server') {
+    var props = record['props'] || (record['props'] = {});
+    if (props['idle'] === undefined) {
+      props['idle'] = 0;  // No idle timeout, and so no warning.
+      props['idleWarning'] = 0;
+    }
+    if (props['keepalive'] === undefined) {
+      props['keepalive'] = Interpreter.KEEPALIVE;
+    }
+  }
+});
+
+module.exports = Migrate;
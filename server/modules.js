@@ -0,0 +1,130 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Modules of in-world code (the CC.require builtin), so
+ * that library code can be shared by name rather than by copying
+ * functions between objects.
+ *
+ * A module is stored as a property of one of the world's designated
+ * library objects (see CC.moduleSetLibraries), named by the module's
+ * name (e.g., $.lib['text/wrap']).  Its value is either the source of
+ * the module, or a function; either way it is run (as its owner, or
+ * the library's) in the manner of a CommonJS module, with arguments
+ * require (to require other modules), module and exports, and the
+ * value of module.exports afterwards is what requiring it returns.
+ *
+ * Each module is run only once: its exports are cached (in the
+ * interpreter, and so in checkpoints), along with the names of the
+ * modules it required.  Reloading a module (CC.moduleReload) discards
+ * it from the cache, together with every module that (directly or
+ * indirectly) required it, so that all are run again when next
+ * required.  As in Node.js, a module required (directly or
+ * indirectly) by itself gets its exports as they are so far.
+ */
+'use strict';
+
+var Modules = {};
+
+/**
+ * Maximum length of a module name.
+ * @const {number}
+ */
+Modules.MAX_NAME_LENGTH = 200;
+
+/**
+ * A module's entry in the cache.  library, module and loading are
+ * interpreter values (the library object, the module object passed to
+ * the module, and the state of the CC.require call running it).
+ * @typedef {{name: string,
+ *            library: *,
+ *            module: *,
+ *            requires: !Array<string>,
+ *            loaded: boolean,
+ *            loading: *}}
+ */
+Modules.Entry;
+
+/**
+ * Is a string a valid module name: one or more parts separated by
+ * slashes, each of letters, digits and _ $ . -, but not . or ..?
+ * @param {*} name The name.
+ * @return {boolean} True iff it is.
+ */
+Modules.isValidName = function(name) {
+  return typeof name === 'string' && name.length <= Modules.MAX_NAME_LENGTH &&
+      name.split('/').every(function(part) {
+        return /^[\w$.-]+$/.test(part) && part !== '.' && part !== '..';
+      });
+};
+
+/**
+ * Wrap the source of a module as a function expression.
+ * @param {string} source The source.
+ * @return {string} The source of the function.
+ */
+Modules.wrap = function(source) {
+  return '(function(require, module, exports) {\n' + source + '\n})';
+};
+
+/**
+ * Record that one module required another.
+ * @param {!Map<string, !Modules.Entry>} cache The module cache.
+ * @param {string} parent The name of the requiring module.
+ * @param {string} name The name of the module required.
+ */
+Modules.addDependency = function(cache, parent, name) {
+  var entry = cache.get(parent);
+  if (entry && !entry.requires.includes(name)) entry.requires.push(name);
+};
+
+/**
+ * Find the modules which (directly or indirectly) require a module.
+ * @param {!Map<string, !Modules.Entry>} cache The module cache.
+ * @param {string} name The name of the module.
+ * @return {!Array<string>} The names of the module (if cached) and
+ *     its dependents, in the order found.
+ */
+Modules.dependents = function(cache, name) {
+  var found = cache.has(name) ? [name] : [];
+  for (var i = 0; i < found.length; i++) {
+    var required = found[i];
+    cache.forEach(function(entry) {
+      if (entry.requires.includes(required) && !found.includes(entry.name)) {
+        found.push(entry.name);
+      }
+    });
+  }
+  return found;
+};
+
+/**
+ * Discard a module, and every module which (directly or indirectly)
+ * requires it, from the cache.
+ * @param {!Map<string, !Modules.Entry>} cache The module cache.
+ * @param {string} name The name of the module.
+ * @return {!Array<string>} The names of the modules discarded.
+ */
+Modules.invalidate = function(cache, name) {
+  var names = Modules.dependents(cache, name);
+  names.forEach(function(n) {
+    cache.delete(n);
+  });
+  return names;
+};
+
+module.exports = Modules;
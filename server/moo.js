@@ -0,0 +1,623 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Importing LambdaMOO databases (the mooimport tool).
+ *
+ * Moo.parse reads a database in LambdaMOO's textual format (versions
+ * 1 to 4, as written by LambdaMOO 1.8), and Moo.convert converts the
+ * objects it contains into JavaScript in the same form as the
+ * startup files written by the dump tool, so that it can be loaded
+ * into a new world (or evaluated in an existing one):
+ *
+ * - Each object #N becomes an object $.moo['#N'] (the namespace is an
+ *   option), whose prototype is that of its parent - except that the
+ *   generic room, thing, player and container (as named by #0, e.g.
+ *   #0.room) inherit instead from $.room, $.thing, $.user and
+ *   $.container.  Named objects are also, e.g., $.moo.room.
+ * - Each object's name, and the values of the properties it defines
+ *   or overrides, are copied; objects are referred to by reference,
+ *   and errors by name (e.g., 'E_PERM').  The locations of physical
+ *   objects are copied too.
+ * - MOO code cannot be converted automatically, so each verb becomes
+ *   a stub function (with the verb, dobj, prep and iobj properties of
+ *   a CodeCity verb, if it can be used as a command) that throws an
+ *   error, and has the original code in a comment.
+ *
+ * Ownership, permissions and flags are not copied.  Instead a report
+ * (see Moo.Report) lists the verbs to be ported by hand, the users,
+ * wizards and programmers, and anything else that could not be
+ * converted.
+ */
+'use strict';
+
+var code = require('./code');
+
+var Moo = {};
+
+/**
+ * Types of values, as numbered in the database.
+ * @enum {number}
+ */
+Moo.Type = {
+  INT: 0,
+  OBJ: 1,
+  STR: 2,
+  ERR: 3,
+  LIST: 4,
+  CLEAR: 5,
+  NONE: 6,
+  CATCH: 7,
+  FINALLY: 8,
+  FLOAT: 9,
+};
+
+/**
+ * Error codes, as numbered in the database.
+ * @const {!Array<string>}
+ */
+Moo.ERRORS = ['E_NONE', 'E_TYPE', 'E_DIV', 'E_PERM', 'E_PROPNF',
+              'E_VERBNF', 'E_VARNF', 'E_INVIND', 'E_RECMOVE', 'E_MAXREC',
+              'E_RANGE', 'E_ARGS', 'E_NACC', 'E_INVARG', 'E_QUOTA',
+              'E_FLOAT'];
+
+/**
+ * Prepositions of verbs, as numbered in the database.  (Conveniently,
+ * these are also the values of Command.PREPOSITIONS.)
+ * @const {!Array<string>}
+ */
+Moo.PREPOSITIONS = ['with/using', 'at/to', 'in front of', 'in/inside/into',
+                    'on top of/on/onto/upon', 'out of/from inside/from',
+                    'over', 'through', 'under/underneath/beneath', 'behind',
+                    'beside', 'for/about', 'is', 'as', 'off/off of'];
+
+/**
+ * Object flags.
+ * @enum {number}
+ */
+Moo.Flag = {
+  USER: 1,
+  PROGRAMMER: 2,
+  WIZARD: 4,
+  READ: 16,
+  WRITE: 32,
+  FERTILE: 128,
+};
+
+/**
+ * Generic objects (as named by properties of #0) which inherit from
+ * CodeCity prototypes instead of their parents, by name.
+ * @const {!Object<string, string>}
+ */
+Moo.ROOTS = {
+  'room': '$.room',
+  'thing': '$.thing',
+  'player': '$.user',
+  'container': '$.container',
+};
+
+/**
+ * Property names that would interfere with CodeCity (e.g., that are
+ * used by $.physical for other purposes), and so are prefixed with
+ * 'moo_'.
+ * @const {!Array<string>}
+ */
+Moo.RESERVED = ['location', 'contents_', 'constructor', 'prototype',
+                '__proto__', 'toString', 'valueOf', 'hasOwnProperty'];
+
+/**
+ * A value of a property: a number, string, error code (e.g.,
+ * {err: 'E_PERM'}), object number (e.g., {obj: 42}) or list; or
+ * undefined if clear (inherited).
+ * @typedef {number|string|{err: string}|{obj: number}|!Array<*>|undefined}
+ */
+Moo.Value;
+
+/**
+ * A verb.
+ * @typedef {{names: string, owner: number, perms: number, prep: number,
+ *            code: ?Array<string>}}
+ */
+Moo.Verb;
+
+/**
+ * An object.  propvals are the values of its properties, in order:
+ * those it defines (propdefs), then those its parent has, and so on.
+ * @typedef {{id: number, name: string, flags: number, owner: number,
+ *            location: number, parent: number,
+ *            verbs: !Array<!Moo.Verb>, propdefs: !Array<string>,
+ *            propvals: !Array<{value: Moo.Value, owner: number,
+ *                              perms: number}>}}
+ */
+Moo.Object;
+
+/**
+ * A database: its format version, its objects (indexed by number;
+ * null if recycled) and the numbers of its users.
+ * @typedef {{version: number, objects: !Array<?Moo.Object>,
+ *            users: !Array<number>}}
+ */
+Moo.Database;
+
+/**
+ * Reader for the lines of a database.
+ * @private
+ * @constructor
+ * @param {string} text The database.
+ */
+Moo.Reader_ = function(text) {
+  /** @type {!Array<string>} */
+  this.lines = text.split(/\r?\n/);
+  /** @type {number} */
+  this.index = 0;
+};
+
+/**
+ * Throw an error about the line last read.
+ * @param {string} message What is wrong with it.
+ */
+Moo.Reader_.prototype.fail = function(message) {
+  throw new SyntaxError('line ' + this.index + ': ' + message);
+};
+
+/**
+ * Read a line.
+ * @return {string} The line.
+ */
+Moo.Reader_.prototype.line = function() {
+  if (this.index >= this.lines.length) {
+    this.index++;
+    this.fail('unexpected end of database');
+  }
+  return this.lines[this.index++];
+};
+
+/**
+ * Read a line containing an integer.
+ * @return {number} The integer.
+ */
+Moo.Reader_.prototype.num = function() {
+  var line = this.line();
+  if (!/^-?\d+$/.test(line.trim())) this.fail('expected a number');
+  return Number(line);
+};
+
+/**
+ * Read a value.
+ * @return {Moo.Value} The value.
+ */
+Moo.Reader_.prototype.value = function() {
+  var type = this.num();
+  switch (type) {
+    case Moo.Type.INT:
+    case Moo.Type.CATCH:
+    case Moo.Type.FINALLY:
+      return this.num();
+    case Moo.Type.OBJ:
+      return {obj: this.num()};
+    case Moo.Type.STR:
+      return this.line();
+    case Moo.Type.ERR:
+      var n = this.num();
+      return {err: Moo.ERRORS[n] || 'E_' + n};
+    case Moo.Type.LIST:
+      var list = [];
+      for (var i = this.num(); i > 0; i--) {
+        list.push(this.value());
+      }
+      return list;
+    case Moo.Type.CLEAR:
+    case Moo.Type.NONE:
+      return undefined;
+    case Moo.Type.FLOAT:
+      var f = Number(this.line());
+      if (isNaN(f)) this.fail('expected a float');
+      return f;
+    default:
+      this.fail('unknown type of value ' + type);
+  }
+};
+
+/**
+ * Read an object (or recycled object).
+ * @param {number} id The number of the object expected.
+ * @return {?Moo.Object} The object, or null if recycled.
+ */
+Moo.Reader_.prototype.object = function(id) {
+  var header = this.line();
+  if (header === '#' + id + ' recycled') return null;
+  if (header !== '#' + id) this.fail('expected object #' + id);
+  var obj = {id: id, name: this.line()};
+  this.line();  // Obsolete "handles".
+  obj.flags = this.num();
+  obj.owner = this.num();
+  obj.location = this.num();
+  this.num();  // Contents (see location).
+  this.num();  // Next (sibling in location).
+  obj.parent = this.num();
+  this.num();  // Child.
+  this.num();  // Sibling (in parent).
+  obj.verbs = [];
+  for (var i = this.num(); i > 0; i--) {
+    obj.verbs.push({names: this.line(), owner: this.num(),
+                    perms: this.num(), prep: this.num(), code: null});
+  }
+  obj.propdefs = [];
+  for (i = this.num(); i > 0; i--) {
+    obj.propdefs.push(this.line());
+  }
+  obj.propvals = [];
+  for (i = this.num(); i > 0; i--) {
+    obj.propvals.push({value: this.value(), owner: this.num(),
+                       perms: this.num()});
+  }
+  return obj;
+};
+
+/**
+ * Parse a database.  Anything after the verbs' code (e.g., suspended
+ * tasks) is ignored.
+ * @param {string} text The database.
+ * @return {!Moo.Database} The database.
+ */
+Moo.parse = function(text) {
+  var reader = new Moo.Reader_(text);
+  var m = /^\*\* LambdaMOO Database, Format Version (\d+) \*\*$/.exec(
+      reader.line());
+  if (!m) reader.fail('not a LambdaMOO database');
+  var version = Number(m[1]);
+  if (version > 4) {
+    reader.fail('unsupported format version ' + version);
+  }
+  var nobjs = reader.num();
+  var nprogs = reader.num();
+  reader.num();  // Unused.
+  var db = {version: version, objects: [], users: []};
+  for (var i = reader.num(); i > 0; i--) {
+    db.users.push(reader.num());
+  }
+  for (i = 0; i < nobjs; i++) {
+    db.objects.push(reader.object(i));
+  }
+  for (i = 0; i < nprogs; i++) {
+    m = /^#(\d+):(\d+)$/.exec(reader.line());
+    if (!m) reader.fail('expected a verb');
+    var obj = db.objects[Number(m[1])];
+    var verb = obj && obj.verbs[Number(m[2])];
+    if (!verb) reader.fail('no such verb');
+    verb.code = [];
+    for (var line; (line = reader.line()) !== '.'; ) {
+      verb.code.push(line);
+    }
+  }
+  return db;
+};
+
+/**
+ * Get the names of all of an object's properties, in the order of its
+ * propvals.
+ * @param {!Moo.Database} db The database.
+ * @param {!Moo.Object} obj The object.
+ * @return {!Array<string>} The names.
+ */
+Moo.propertyNames = function(db, obj) {
+  var names = [];
+  var seen = new Set();
+  for (var o = obj; o && !seen.has(o); o = db.objects[o.parent]) {
+    seen.add(o);
+    names.push.apply(names, o.propdefs);
+  }
+  return names;
+};
+
+/**
+ * Convert the names of a verb (e.g., 'l*ook examine' or 'get take')
+ * to a regular expression for the verb property of a CodeCity verb
+ * (e.g., 'l(?:o(?:o(?:k)?)?)?|examine' or 'get|take').  In each name,
+ * a * marks where abbreviations may end, or (at the end) that
+ * anything may follow.
+ * @param {string} names The names.
+ * @return {string} The regular expression.
+ */
+Moo.verbPattern = function(names) {
+  var escape = function(str) {
+    return str.replace(/[\\^$.*+?()[\]{}|\/]/g, '\\$&');
+  };
+  return names.trim().split(/\s+/).map(function(name) {
+    var star = name.indexOf('*');
+    if (star === -1) return escape(name);
+    var prefix = escape(name.slice(0, star));
+    var rest = name.slice(star + 1).replace(/\*/g, '');
+    if (!rest) return prefix + '.*';
+    var optional = '';
+    for (var i = rest.length - 1; i >= 0; i--) {
+      optional = '(?:' + escape(rest[i]) + optional + ')?';
+    }
+    return prefix + optional;
+  }).join('|');
+};
+
+/**
+ * A report of an import: what was imported, and what needs attention.
+ * @typedef {{version: number,
+ *            objects: number,
+ *            recycled: number,
+ *            properties: number,
+ *            verbs: !Array<{object: number, name: string, key: string,
+ *                           lines: number}>,
+ *            users: !Array<string>,
+ *            wizards: !Array<string>,
+ *            programmers: !Array<string>,
+ *            warnings: !Array<string>}}
+ */
+Moo.Report;
+
+/**
+ * Convert a database to JavaScript.
+ * @param {!Moo.Database} db The database.
+ * @param {{namespace: (string|undefined),
+ *          roots: (!Object<string, string>|undefined)}=} options
+ *     Options: the selector of the object to create to contain the
+ *     imported objects (default '$.moo'), and which generic objects
+ *     are to inherit from which CodeCity prototypes (default
+ *     Moo.ROOTS).
+ * @return {{source: string, report: !Moo.Report}} The JavaScript,
+ *     and a report of the import.
+ */
+Moo.convert = function(db, options) {
+  options = options || {};
+  var namespace = options.namespace || '$.moo';
+  if (!/^[A-Za-z_$][\w$]*(?:\.[A-Za-z_$][\w$]*)*$/.test(namespace)) {
+    throw new RangeError('invalid namespace ' + namespace);
+  }
+  var roots = options.roots || Moo.ROOTS;
+  var report = {version: db.version, objects: 0, recycled: 0,
+                properties: 0, verbs: [], users: [], wizards: [],
+                programmers: [], warnings: []};
+  var out = [];
+  var exists = function(id) {
+    return id >= 0 && id < db.objects.length && Boolean(db.objects[id]);
+  };
+  var ref = function(id) {
+    return namespace + "['#" + id + "']";
+  };
+  var member = function(key) {
+    return code.regexps.identifierExact.test(key) ?
+        '.' + key : '[' + code.quote(key) + ']';
+  };
+  var describe = function(obj) {
+    return '#' + obj.id + ' (' + obj.name + ')';
+  };
+  // Objects named by properties of #0 (e.g., #0.room).
+  var /** !Map<number, string> */ names = new Map();
+  var system = db.objects[0];
+  if (system) {
+    Moo.propertyNames(db, system).forEach(function(name, i) {
+      var value = system.propvals[i] && system.propvals[i].value;
+      if (value && typeof value === 'object' && 'obj' in value &&
+          exists(value.obj) && !names.has(value.obj) &&
+          code.regexps.identifierExact.test(name) && !/^#/.test(name)) {
+        names.set(value.obj, name);
+      }
+    });
+  }
+  // Convert a value to an expression.
+  var valueExpr = function(value, where) {
+    if (typeof value === 'number') {
+      if (!isFinite(value)) {
+        report.warnings.push(where + ': non-finite number replaced by 0');
+        return '0';
+      }
+      return String(value);
+    } else if (typeof value === 'string') {
+      return code.quote(value);
+    } else if (Array.isArray(value)) {
+      return '[' + value.map(function(v) {
+        return valueExpr(v, where);
+      }).join(', ') + ']';
+    } else if (value && 'err' in value) {
+      return code.quote(value.err);
+    } else if (value && 'obj' in value) {
+      if (exists(value.obj)) return ref(value.obj);
+      if (value.obj !== -1) {
+        report.warnings.push(where + ': reference to missing object #' +
+                             value.obj + ' replaced by null');
+      }
+      return 'null';
+    }
+    return 'undefined';
+  };
+
+  // Is an object descended from one inheriting from a CodeCity
+  // prototype (and so, physical)?
+  var /** !Map<number, ?string> */ rootOf = new Map();
+  var findRoot = function(obj) {
+    var seen = new Set();
+    for (var o = obj; o && !seen.has(o); o = db.objects[o.parent]) {
+      seen.add(o);
+      var name = names.get(o.id);
+      if (name && Object.prototype.hasOwnProperty.call(roots, name)) {
+        return roots[name];
+      }
+    }
+    return null;
+  };
+  db.objects.forEach(function(obj) {
+    if (obj) rootOf.set(obj.id, findRoot(obj));
+  });
+
+  // Create objects, parents first.
+  out.push('// Imported from a LambdaMOO database (format version ' +
+           db.version + ').', '', namespace + ' = {};');
+  var created = new Set();
+  var create = function(obj) {
+    if (created.has(obj.id)) return;
+    created.add(obj.id);
+    var name = names.get(obj.id);
+    var proto;
+    if (name && Object.prototype.hasOwnProperty.call(roots, name)) {
+      proto = roots[name];
+    } else if (exists(obj.parent) && obj.parent !== obj.id) {
+      create(db.objects[obj.parent]);
+      proto = ref(obj.parent);
+    } else {
+      proto = null;
+    }
+    out.push(ref(obj.id) + ' = ' +
+             (proto ? "(new 'Object.create')(" + proto + ');' : '{};'));
+  };
+  db.objects.forEach(function(obj) {
+    if (obj) {
+      report.objects++;
+      create(obj);
+    } else {
+      report.recycled++;
+    }
+  });
+  names.forEach(function(name, id) {
+    out.push(namespace + member(name) + ' = ' + ref(id) + ';');
+  });
+
+  // Properties and verbs.
+  db.objects.forEach(function(obj) {
+    if (!obj) return;
+    var target = ref(obj.id);
+    out.push('', target + '.name = ' + code.quote(obj.name) + ';');
+    if (obj.flags & Moo.Flag.USER) report.users.push(describe(obj));
+    if (obj.flags & Moo.Flag.WIZARD) report.wizards.push(describe(obj));
+    if (obj.flags & Moo.Flag.PROGRAMMER) {
+      report.programmers.push(describe(obj));
+    }
+    var keys = new Set();
+    Moo.propertyNames(db, obj).forEach(function(name, i) {
+      var propval = obj.propvals[i];
+      if (!propval || propval.value === undefined) return;  // Inherited.
+      var key = name;
+      if (Moo.RESERVED.includes(key)) {
+        key = 'moo_' + key;
+        report.warnings.push(describe(obj) + ': property ' + name +
+                             ' renamed ' + key);
+      }
+      keys.add(key);
+      report.properties++;
+      out.push(target + member(key) + ' = ' +
+               valueExpr(propval.value, describe(obj) + '.' + name) + ';');
+    });
+    obj.verbs.forEach(function(verb) {
+      var first = verb.names.trim().split(/\s+/)[0].replace(/\*/g, '');
+      var key = first || 'verb';
+      for (var n = 2; keys.has(key); n++) {
+        key = first + '_' + n;
+      }
+      if (key !== first) {
+        report.warnings.push(describe(obj) + ': verb ' + verb.names +
+                             ' renamed ' + key);
+      }
+      keys.add(key);
+      var lines = verb.code || [];
+      report.verbs.push({object: obj.id, name: verb.names, key: key,
+                         lines: lines.length});
+      var dobj = ['none', 'any', 'this'][(verb.perms >> 4) & 3] || 'none';
+      var iobj = ['none', 'any', 'this'][(verb.perms >> 6) & 3] || 'none';
+      var prep = (verb.prep === -2) ? 'any' :
+          (verb.prep === -1) ? 'none' : Moo.PREPOSITIONS[verb.prep];
+      var isCommand = prep &&
+          !(dobj === 'this' && prep === 'none' && iobj === 'this');
+      var funcName = key.replace(/[^\w$]/g, '_');
+      if (!/^[A-Za-z_$]/.test(funcName)) funcName = '_' + funcName;
+      var func = target + member(key);
+      var where = '#' + obj.id + ':' + code.quote(verb.names);
+      out.push(func + ' = function ' + funcName +
+               (isCommand ? '(cmd) {' : '() {'));
+      out.push('  // Not yet ported from LambdaMOO verb ' + where +
+               (lines.length ? ':' : ' (which has no code).'));
+      lines.forEach(function(line) {
+        out.push('  //   ' + line.replace(/[\u2028\u2029]/g, ' '));
+      });
+      out.push('  throw new Error(' +
+               code.quote(where + ' has not been ported from LambdaMOO') +
+               ');', '};');
+      if (isCommand) {
+        out.push(func + '.verb = ' + code.quote(Moo.verbPattern(verb.names)) +
+                 ';', func + ".dobj = '" + dobj + "';",
+                 func + '.prep = ' + code.quote(prep) + ';',
+                 func + ".iobj = '" + iobj + "';");
+      }
+    });
+  });
+
+  // Locations of physical objects.
+  var /** !Map<number, number> */ locations = new Map();
+  var /** !Map<number, !Array<number>> */ contents = new Map();
+  db.objects.forEach(function(obj) {
+    if (!obj || !rootOf.get(obj.id)) return;
+    var location = -1;
+    if (exists(obj.location) && rootOf.get(obj.location)) {
+      location = obj.location;
+    } else if (exists(obj.location)) {
+      report.warnings.push(describe(obj) + ': location #' + obj.location +
+                           ' is not a physical object');
+    }
+    locations.set(obj.id, location);
+    if (!contents.has(obj.id)) contents.set(obj.id, []);
+    if (location !== -1) {
+      if (!contents.has(location)) contents.set(location, []);
+      contents.get(location).push(obj.id);
+    }
+  });
+  if (locations.size) out.push('', '// Locations.');
+  locations.forEach(function(location, id) {
+    out.push(ref(id) + '.location = ' +
+             (location === -1 ? 'null' : ref(location)) + ';',
+             ref(id) + '.contents_ = [' +
+             contents.get(id).map(ref).join(', ') + '];');
+  });
+  out.push('');
+  return {source: out.join('\n'), report: report};
+};
+
+/**
+ * Format a report of an import as text.
+ * @param {!Moo.Report} report The report.
+ * @return {string} The text.
+ */
+Moo.formatReport = function(report) {
+  var lines = [
+    'Imported ' + report.objects + ' objects (' + report.recycled +
+        ' recycled), ' + report.properties + ' property values and ' +
+        report.verbs.length + ' verbs from a format version ' +
+        report.version + ' LambdaMOO database.',
+  ];
+  var list = function(title, items) {
+    if (!items.length) return;
+    lines.push('', title + ' (' + items.length + '):');
+    items.forEach(function(item) {
+      lines.push('  ' + item);
+    });
+  };
+  list('Verbs to port by hand', report.verbs.map(function(verb) {
+    return '#' + verb.object + ':' + verb.name + ' (as .' + verb.key +
+        ', ' + verb.lines + (verb.lines === 1 ? ' line)' : ' lines)');
+  }));
+  list('Users (need CodeCity accounts)', report.users);
+  list('Wizards (need CodeCity permissions)', report.wizards);
+  list('Programmers', report.programmers);
+  list('Warnings', report.warnings);
+  return lines.join('\n');
+};
+
+module.exports = Moo;
@@ -0,0 +1,421 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Portable packages of objects, for sharing creations
+ * between worlds.
+ *
+ * A package contains a chosen object (the root) and everything that
+ * belongs to it: every object reachable from it (via properties,
+ * prototypes, function closures, etc.) that is not also reachable
+ * from the global scope by some other route.  Objects that are (such
+ * as built-ins, or prototypes shared with the rest of the world) are
+ * not included; instead the package refers to them by name: a
+ * built-in ID (e.g., 'Object.prototype') or a selector (e.g.,
+ * '$.physical').  Ownership is not included either.
+ *
+ * When a package is imported, each object named is looked up in the
+ * destination world, new objects are created for everything else,
+ * and all of them are owned by the importing user.
+ *
+ * A package is a JSON-compatible object:
+ *
+ *     {"package": 1, "serializationVersion": 7, "records": [...]}
+ *
+ * where the records are as for Serializer.serializePart (root is
+ * object #1) and the descriptor of each External record is one of:
+ *
+ *     {"builtin": "<builtin ID>"}
+ *     {"selector": "<selector>"}
+ *     {"scope": "global"}
+ *
+ * optionally with "part": "<key>" to refer to an internal slot of the
+ * named object (e.g., "properties", the object that contains its
+ * properties, which is the prototype of its heirs' ones).
+ *
+ * An owner's package (see Package.exportOwned) instead contains
+ * everything belonging to a particular owner, for exporting a user's
+ * data or moving them to another world.  Its root is an array of the
+ * owner and the objects it owns, and it is marked "owned": true.
+ * Objects owned by others are referred to by name where possible, or
+ * otherwise (e.g., an unnamed prototype) by a stub:
+ *
+ *     {"stub": <number>, "class": "<class>"}
+ *
+ * for which an empty placeholder object is created on import.
+ */
+'use strict';
+
+var Interpreter = require('./interpreter');
+var Migrate = require('./migrate');
+var Selector = require('./selector');
+var Serializer = require('./serialize');
+
+var Package = {};
+
+/** @private @const {number} Version of the package format. */
+Package.VERSION_ = 1;
+
+/**
+ * Export a package containing obj and the objects that belong to it.
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @param {!Interpreter.prototype.Object} root Object to export.
+ * @return {!Object} JSON-compatible package.
+ */
+Package.exportPackage = function(intrp, root) {
+  var names = Package.findNames(intrp, root);
+  // Descriptors for named objects' .properties objects.
+  var /** !Map<!Object,!Object> */ slots = new Map();
+  names.forEach(function(name, obj) {
+    slots.set(obj.properties, {'selector': name, 'part': 'properties'});
+  });
+  intrp.builtins.entries().forEach(function(entry) {
+    if (entry[1] instanceof intrp.Object) {
+      slots.set(entry[1].properties, {'builtin': entry[0],
+                                      'part': 'properties'});
+    }
+  });
+  var external = function(obj) {
+    var builtin = intrp.builtins.getKey(obj);
+    if (builtin !== undefined) return {'builtin': builtin};
+    if (obj === intrp.global) return {'scope': 'global'};
+    if (names.has(obj)) return {'selector': names.get(obj)};
+    if (slots.has(obj)) return slots.get(obj);
+    // Activity in (rather than contents of) the world can't be exported.
+    if (obj instanceof Interpreter || obj instanceof Interpreter.State ||
+        obj instanceof Interpreter.Thread ||
+        obj instanceof Interpreter.PropertyIterator ||
+        obj instanceof intrp.Thread || obj instanceof intrp.Server) {
+      throw new TypeError(
+          "Can't export threads, servers or other running state");
+    }
+    return undefined;
+  };
+  var omit = function(obj, key) {
+    return (obj instanceof intrp.Object && key === 'owner') ||
+        (obj instanceof Interpreter.Scope && key === 'perms');
+  };
+  return {
+    'package': Package.VERSION_,
+    'serializationVersion': Interpreter.SERIALIZATION_VERSION,
+    'records': Serializer.serializePart(
+        intrp, root, {external: external, omit: omit}),
+  };
+};
+
+/**
+ * Export a package containing an owner and all the objects it owns.
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @param {!Interpreter.prototype.Object} owner Owner whose objects are
+ *     to be exported.
+ * @return {!Object} JSON-compatible owner's package.
+ */
+Package.exportOwned = function(intrp, owner) {
+  var index = Serializer.indexByOwner(intrp);
+  // Root is an array of the owner and what it owns, except running
+  // state (which will be referred to by stubs instead).
+  var /** !Set<!Interpreter.prototype.Object> */ contents = new Set([owner]);
+  (index.get(owner) || []).forEach(function(obj) {
+    if (!(obj instanceof intrp.Thread) && !(obj instanceof intrp.Server)) {
+      contents.add(obj);
+    }
+  });
+  var root = intrp.createArrayFromList(Array.from(contents), intrp.ROOT);
+  var names = Package.findNames(intrp, contents);
+  // The object to which each .properties object belongs.
+  var /** !Map<!Object,!Interpreter.prototype.Object> */ holders = new Map();
+  index.forEach(function(objs) {
+    for (var i = 0; i < objs.length; i++) {
+      holders.set(objs[i].properties, objs[i]);
+    }
+  });
+  var /** !Map<!Interpreter.prototype.Object,number> */ stubs = new Map();
+  var external = function(obj) {
+    var builtin = intrp.builtins.getKey(obj);
+    if (builtin !== undefined) return {'builtin': builtin};
+    if (obj === intrp.global) return {'scope': 'global'};
+    if (obj instanceof Interpreter || obj instanceof Interpreter.State ||
+        obj instanceof Interpreter.Thread) {
+      throw new TypeError(
+          "Can't export threads, servers or other running state");
+    }
+    var part;
+    if (holders.has(obj)) {
+      obj = holders.get(obj);
+      part = 'properties';
+    } else if (!(obj instanceof intrp.Object)) {
+      return undefined;
+    }
+    if (obj === root || contents.has(obj)) return undefined;
+    var descriptor;
+    builtin = intrp.builtins.getKey(obj);
+    if (builtin !== undefined) {
+      descriptor = {'builtin': builtin};
+    } else if (names.has(obj)) {
+      descriptor = {'selector': names.get(obj)};
+    } else {
+      if (!stubs.has(obj)) stubs.set(obj, stubs.size + 1);
+      descriptor = {'stub': stubs.get(obj), 'class': obj.class};
+    }
+    if (part) descriptor['part'] = part;
+    return descriptor;
+  };
+  var omit = function(obj, key) {
+    return (obj instanceof intrp.Object && key === 'owner') ||
+        (obj instanceof Interpreter.Scope && key === 'perms');
+  };
+  return {
+    'package': Package.VERSION_,
+    'serializationVersion': Interpreter.SERIALIZATION_VERSION,
+    'owned': true,
+    'records': Serializer.serializePart(
+        intrp, root, {external: external, omit: omit}),
+  };
+};
+
+/**
+ * Import a package, creating the objects it contains.
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @param {*} pkg JSON-compatible package (as returned by
+ *     Package.exportPackage).
+ * @param {!Interpreter.Owner} owner Owner for the new objects.
+ * @return {!Interpreter.prototype.Object} The new copy of the package's
+ *     root object.
+ */
+Package.importPackage = function(intrp, pkg, owner) {
+  if (pkg && typeof pkg === 'object' && pkg['owned']) {
+    throw new TypeError("Can't import an owner's package as a package");
+  }
+  var loaded = Package.load_(intrp, pkg);
+  // Everything new belongs to the importer.
+  Package.setOwner_(intrp, loaded.created, owner);
+  if (!(loaded.root instanceof intrp.Object)) {
+    throw new TypeError('Package root is not an object');
+  }
+  return loaded.root;
+};
+
+/**
+ * Import an owner's package, creating a new copy of the owner and of
+ * the objects it owned (and a placeholder for each stub).
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @param {*} pkg JSON-compatible owner's package (as returned by
+ *     Package.exportOwned).
+ * @param {?Interpreter.Owner=} owner Owner for the new objects.
+ *     (Default: the new copy of the exported owner, which then owns
+ *     itself.)
+ * @return {!Interpreter.prototype.Array} Array of the new objects:
+ *     first the copy of the owner, then the copies of what it owned.
+ */
+Package.importOwned = function(intrp, pkg, owner) {
+  if (!pkg || typeof pkg !== 'object' || !pkg['owned']) {
+    throw new TypeError("Not an owner's package");
+  }
+  var loaded = Package.load_(intrp, pkg);
+  var root = loaded.root;
+  if (!(root instanceof intrp.Array) ||
+      !(root.get('0', intrp.ROOT) instanceof intrp.Object)) {
+    throw new TypeError("Owner's package root is not an array of objects");
+  }
+  Package.setOwner_(intrp, loaded.created,
+      owner || /** @type {!Interpreter.prototype.Object} */(
+          root.get('0', intrp.ROOT)));
+  return root;
+};
+
+/**
+ * Load the records of a package (of either kind) into an interpreter.
+ * @private
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @param {*} pkg JSON-compatible package.
+ * @return {{root: *, created: !Array<!Object>}} The new copy of the
+ *     package's root object, and all the objects created (including
+ *     placeholders for stubs).
+ */
+Package.load_ = function(intrp, pkg) {
+  if (!pkg || typeof pkg !== 'object' || pkg['package'] !== Package.VERSION_ ||
+      !Array.isArray(pkg['records'])) {
+    throw new TypeError('Not a package');
+  }
+  // Records are modified by migration and deserialization.
+  var records = JSON.parse(JSON.stringify(pkg['records']));
+  var deserializer = new Serializer.Deserializer(intrp, /* partial= */ true);
+  var /** !Map<number,!Interpreter.prototype.Object> */ stubs = new Map();
+  var migrator = new Migrate.Migrator(function(record) {
+    if (record['#'] === 0) {
+      return;  // Not a real record; see below.
+    } else if (record['type'] === 'External') {
+      deserializer.provide(record['#'],
+                           Package.resolve_(intrp, record['external'], stubs));
+    } else {
+      deserializer.add(record);
+    }
+  });
+  // The migrator takes the version from the interpreter's record.
+  migrator.add({'#': 0, 'type': 'Interpreter',
+      'props': {'serializationVersion': pkg['serializationVersion']}});
+  for (var i = 0; i < records.length; i++) {
+    var record = records[i];
+    if (!record || typeof record !== 'object' || record['#'] !== i + 1) {
+      throw new TypeError('Bad record in package: ' + JSON.stringify(record));
+    }
+    migrator.add(record);
+  }
+  migrator.finish();
+  deserializer.finish();
+  var created = Array.from(stubs.values());
+  for (var i = 0; i < records.length; i++) {
+    if (records[i]['type'] !== 'External') {
+      created.push(deserializer.get(i + 1));
+    }
+  }
+  return {root: deserializer.get(1), created: created};
+};
+
+/**
+ * Set the owner of newly-imported objects (and the permissions of
+ * newly-imported scopes).
+ * @private
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @param {!Array<!Object>} created The new objects.
+ * @param {!Interpreter.Owner} owner Their owner.
+ */
+Package.setOwner_ = function(intrp, created, owner) {
+  for (var i = 0; i < created.length; i++) {
+    var obj = created[i];
+    if (obj instanceof intrp.Object) {
+      obj.owner = owner;
+    } else if (obj instanceof Interpreter.Scope) {
+      obj.perms = owner;
+    }
+  }
+};
+
+/**
+ * Find names for objects in the world: the shortest selector for every
+ * user-visible object that is reachable from the global scope (other
+ * than via root, if given).  Used to name the objects that root (and
+ * what belongs to it) might refer to.
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @param {(?Interpreter.prototype.Object|
+ *          !Set<!Interpreter.prototype.Object>)=} root Object (or
+ *     objects) being exported.
+ * @return {!Map<!Interpreter.prototype.Object,string>} Selector
+ *     strings, by object.
+ */
+Package.findNames = function(intrp, root) {
+  var excluded = (root instanceof Set) ? root : new Set(root ? [root] : []);
+  var /** !Map<!Interpreter.prototype.Object,string> */ names = new Map();
+  var /** !Array<!Interpreter.prototype.Object> */ queue = [];
+  var /** !Map<!Interpreter.prototype.Object,!Selector> */ selectors =
+      new Map();
+  var visit = function(value, selector) {
+    if (!(value instanceof intrp.Object) || excluded.has(value) ||
+        selectors.has(value)) {
+      return;
+    }
+    selectors.set(value, selector);
+    queue.push(value);
+  };
+  // Breadth first, so that each object gets the shortest selector.
+  var vars = intrp.global.vars;
+  for (var name in vars) {
+    visit(vars[name], new Selector([name]));
+  }
+  for (var i = 0; i < queue.length; i++) {
+    var obj = queue[i];
+    var selector = selectors.get(obj);
+    names.set(obj, String(selector));
+    var parts = Array.from(selector);
+    visit(obj.proto, new Selector(parts.concat([Selector.PROTOTYPE])));
+    var keys = Object.getOwnPropertyNames(obj.properties);
+    for (var j = 0; j < keys.length; j++) {
+      visit(obj.properties[keys[j]], new Selector(parts.concat([keys[j]])));
+    }
+  }
+  return names;
+};
+
+/**
+ * Look up the object a selector refers to.
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @param {string} selector Selector string (e.g., '$.physical').
+ * @return {?Interpreter.prototype.Object} The object, or null if there
+ *     is none.
+ */
+Package.lookup = function(intrp, selector) {
+  var parts = new Selector(selector);
+  var obj = intrp.global.hasBinding(parts[0]) ?
+      intrp.global.get(parts[0]) : undefined;
+  for (var i = 1; i < parts.length && obj instanceof intrp.Object; i++) {
+    obj = (parts[i] === Selector.PROTOTYPE) ? obj.proto :
+        obj.get(/** @type {string} */(parts[i]), intrp.ROOT);
+  }
+  return (obj instanceof intrp.Object) ? obj : null;
+};
+
+/**
+ * Look up the object described by an External record's descriptor.
+ * @private
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @param {*} descriptor Descriptor (as created by Package.exportPackage
+ *     or Package.exportOwned).
+ * @param {!Map<number,!Interpreter.prototype.Object>} stubs Placeholders
+ *     created so far, by stub number; updated as new ones are created.
+ * @return {!Object} The object.
+ */
+Package.resolve_ = function(intrp, descriptor, stubs) {
+  if (!descriptor || typeof descriptor !== 'object') {
+    throw new TypeError('Bad external reference in package: ' +
+        JSON.stringify(descriptor));
+  }
+  var obj;
+  if (typeof descriptor['builtin'] === 'string') {
+    if (!intrp.builtins.has(descriptor['builtin'])) {
+      throw new ReferenceError('Package requires builtin ' +
+          descriptor['builtin'] + ', which does not exist');
+    }
+    obj = intrp.builtins.get(descriptor['builtin']);
+  } else if (descriptor['scope'] === 'global') {
+    obj = intrp.global;
+  } else if (typeof descriptor['stub'] === 'number') {
+    obj = stubs.get(descriptor['stub']);
+    if (!obj) {
+      obj = new intrp.Object(null);
+      stubs.set(descriptor['stub'], obj);
+    }
+  } else if (typeof descriptor['selector'] === 'string') {
+    obj = Package.lookup(intrp, descriptor['selector']);
+    if (!obj) {
+      throw new ReferenceError('Package requires ' +
+          descriptor['selector'] + ', which does not exist');
+    }
+  } else {
+    throw new TypeError('Bad external reference in package: ' +
+        JSON.stringify(descriptor));
+  }
+  if (descriptor['part'] !== undefined) {
+    if (descriptor['part'] !== 'properties') {
+      throw new TypeError('Bad external reference in package: ' +
+          JSON.stringify(descriptor));
+    }
+    obj = obj.properties;
+  }
+  return obj;
+};
+
+module.exports = Package;
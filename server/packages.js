@@ -0,0 +1,321 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Installing versioned packages (see package.js) from a
+ * registry of shared libraries (see CC.packageInstall).
+ *
+ * A registry is a set of files under a base URL (which may be served
+ * by any static web server):
+ *
+ *     <name>/index.json          {"name": "<name>",
+ *                                 "versions": ["1.0.0", "1.1.0", ...]}
+ *     <name>/<version>.json      {"name": "<name>", "version": "<version>",
+ *                                 "package": <portable package>}
+ *
+ * each accompanied by a detached signature (<file>.sig: the base64
+ * signature of the file's exact contents) made with the registry's
+ * private key; a world is configured with the corresponding public
+ * key, and refuses any file whose signature does not verify, or whose
+ * name or version is not the one requested.  Use Packages.sign to
+ * sign the files when publishing.
+ *
+ * Installing a package imports it (owned by root) and records its
+ * version; updating it imports the latest version in its place.  A
+ * package whose root object is a module library (see modules.js) can
+ * be required once it is installed as one.
+ */
+'use strict';
+
+var crypto = require('crypto');
+var http = require('http');
+var https = require('https');
+var Package = require('./package');
+
+var Packages = {};
+
+/**
+ * Maximum size (in bytes) of a file fetched from a registry.
+ * @const {number}
+ */
+Packages.MAX_SIZE = 16 * 1024 * 1024;
+
+/**
+ * Time (in ms) allowed for a registry to respond.
+ * @const {number}
+ */
+Packages.TIMEOUT = 30 * 1000;
+
+/**
+ * A release of a package, as fetched from a registry.
+ * @typedef {{name: string, version: string, package: *}}
+ */
+Packages.Release;
+
+/**
+ * Options for a Packages.Registry.
+ *
+ * - url: base URL of the registry (http or https).
+ * - publicKey: the registry's public key (PEM).
+ * @typedef {{url: string, publicKey: string}}
+ */
+Packages.Options;
+
+/**
+ * Is a string a valid package name: lower-case letters, digits and
+ * - _ . (starting with a letter or digit), at most 100 characters?
+ * @param {*} name The name.
+ * @return {boolean} True iff it is.
+ */
+Packages.isValidName = function(name) {
+  return typeof name === 'string' && /^[a-z0-9][a-z0-9_.-]{0,99}$/.test(name);
+};
+
+/**
+ * Is a string a valid version: one or more dot-separated numbers
+ * (e.g., '1.2.10')?
+ * @param {*} version The version.
+ * @return {boolean} True iff it is.
+ */
+Packages.isValidVersion = function(version) {
+  return typeof version === 'string' && version.length <= 50 &&
+      /^(0|[1-9]\d*)(\.(0|[1-9]\d*))*$/.test(version);
+};
+
+/**
+ * Compare two (valid) versions, numerically part by part; a missing
+ * part counts as 0.
+ * @param {string} a A version.
+ * @param {string} b Another version.
+ * @return {number} Negative if a is earlier than b, positive if it is
+ *     later, or 0 if they are the same.
+ */
+Packages.compareVersions = function(a, b) {
+  var as = a.split('.').map(Number);
+  var bs = b.split('.').map(Number);
+  for (var i = 0; i < Math.max(as.length, bs.length); i++) {
+    var diff = (as[i] || 0) - (bs[i] || 0);
+    if (diff) return diff;
+  }
+  return 0;
+};
+
+/**
+ * The digest algorithm to sign or verify with a key: none for Ed25519
+ * and Ed448 keys (which hash internally), else SHA-256.
+ * @private
+ * @param {!crypto.KeyObject} key The key.
+ * @return {?string}
+ */
+Packages.algorithm_ = function(key) {
+  return /^ed/.test(key.asymmetricKeyType) ? null : 'sha256';
+};
+
+/**
+ * Sign the contents of a registry file, for publishing.
+ * @param {string} privateKey The registry's private key (PEM).
+ * @param {string|!Buffer} data The file's contents.
+ * @return {string} The signature (in base64), for the file's .sig.
+ */
+Packages.sign = function(privateKey, data) {
+  var key = crypto.createPrivateKey(privateKey);
+  return crypto.sign(Packages.algorithm_(key), Buffer.from(data), key)
+      .toString('base64');
+};
+
+/**
+ * Check the signature of the contents of a registry file.
+ * @param {string} publicKey The registry's public key (PEM).
+ * @param {string|!Buffer} data The file's contents.
+ * @param {string} signature The signature (in base64).
+ * @return {boolean} True iff the signature is valid.
+ */
+Packages.verify = function(publicKey, data, signature) {
+  var key = crypto.createPublicKey(publicKey);
+  try {
+    return crypto.verify(Packages.algorithm_(key), Buffer.from(data), key,
+                         Buffer.from(signature.trim(), 'base64'));
+  } catch (e) {
+    return false;
+  }
+};
+
+/**
+ * A registry of packages.
+ * @constructor
+ * @struct
+ * @param {!Packages.Options} options Options.
+ */
+Packages.Registry = function(options) {
+  if (typeof options.url !== 'string' || !/^https?:\/\//.test(options.url)) {
+    throw new TypeError('Registry needs an http(s) URL');
+  }
+  // Check that the key is usable now, rather than at the first install.
+  crypto.createPublicKey(options.publicKey);
+  /** @const {string} */
+  this.url = options.url.replace(/\/?$/, '/');
+  /** @private @const {string} */
+  this.publicKey_ = options.publicKey;
+};
+
+/**
+ * List the versions of a package available from the registry.
+ * @param {string} name The package's name.
+ * @return {!Promise<!Array<string>>} Its versions, earliest first.
+ */
+Packages.Registry.prototype.versions = function(name) {
+  if (!Packages.isValidName(name)) {
+    return Promise.reject(new RangeError('Invalid package name ' + name));
+  }
+  return this.fetch_(name + '/index.json').then(function(index) {
+    if (!index || typeof index !== 'object' || index['name'] !== name ||
+        !Array.isArray(index['versions']) ||
+        !index['versions'].every(Packages.isValidVersion)) {
+      throw new Error('Invalid index of package ' + name);
+    }
+    return index['versions'].slice().sort(Packages.compareVersions);
+  });
+};
+
+/**
+ * Find the latest version of a package available from the registry.
+ * @param {string} name The package's name.
+ * @return {!Promise<string>} Its latest version.  Rejects if there are
+ *     none.
+ */
+Packages.Registry.prototype.latest = function(name) {
+  return this.versions(name).then(function(versions) {
+    if (!versions.length) {
+      throw new Error('No versions of package ' + name + ' available');
+    }
+    return versions[versions.length - 1];
+  });
+};
+
+/**
+ * Find whether a later version of a package than a given one is
+ * available from the registry.
+ * @param {string} name The package's name.
+ * @param {string} version The version (e.g., the one installed).
+ * @return {!Promise<?string>} The latest version, if later; else null.
+ */
+Packages.Registry.prototype.newer = function(name, version) {
+  return this.latest(name).then(function(latest) {
+    return (Packages.compareVersions(latest, version) > 0) ? latest : null;
+  });
+};
+
+/**
+ * Fetch a release of a package from the registry.
+ * @param {string} name The package's name.
+ * @param {string=} version The version wanted.  (Default: the latest.)
+ * @return {!Promise<!Packages.Release>} The release.
+ */
+Packages.Registry.prototype.release = function(name, version) {
+  if (version === undefined) {
+    return this.latest(name).then(this.release.bind(this, name));
+  } else if (!Packages.isValidName(name)) {
+    return Promise.reject(new RangeError('Invalid package name ' + name));
+  } else if (!Packages.isValidVersion(version)) {
+    return Promise.reject(new RangeError('Invalid version ' + version));
+  }
+  return this.fetch_(name + '/' + version + '.json').then(function(release) {
+    if (!release || typeof release !== 'object' ||
+        release['name'] !== name || release['version'] !== version ||
+        !release['package'] || typeof release['package'] !== 'object') {
+      throw new Error('Invalid release ' + name + ' ' + version);
+    }
+    return {name: name, version: version, package: release['package']};
+  });
+};
+
+/**
+ * Import a release into an interpreter, owned by root.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Packages.Release} release The release.
+ * @return {!Interpreter.prototype.Object} The new copy of the
+ *     package's root object.
+ */
+Packages.Registry.prototype.importRelease = function(intrp, release) {
+  return Package.importPackage(intrp, release.package, intrp.ROOT);
+};
+
+/**
+ * Fetch a file and its signature from the registry, verify the
+ * signature, and parse the file.
+ * @private
+ * @param {string} file Path of the file, relative to the registry.
+ * @return {!Promise<*>} The file's (parsed JSON) contents.
+ */
+Packages.Registry.prototype.fetch_ = function(file) {
+  var registry = this;
+  var url = new URL(file, this.url);
+  return Promise.all([
+    Packages.get_(url),
+    Packages.get_(new URL(file + '.sig', this.url)),
+  ]).then(function(results) {
+    if (!Packages.verify(registry.publicKey_, results[0],
+                         results[1].toString('utf8'))) {
+      throw new Error('Bad signature on ' + url);
+    }
+    try {
+      return JSON.parse(results[0].toString('utf8'));
+    } catch (e) {
+      throw new Error('Invalid JSON in ' + url + ': ' + e.message);
+    }
+  });
+};
+
+/**
+ * Fetch a URL.
+ * @private
+ * @param {!URL} url The URL.
+ * @return {!Promise<!Buffer>} Its contents.  Rejects unless the
+ *     response is a 200.
+ */
+Packages.get_ = function(url) {
+  var transport = (url.protocol === 'https:') ? https : http;
+  return new Promise(function(resolve, reject) {
+    var req = transport.get(url, function(res) {
+      if (res.statusCode !== 200) {
+        res.resume();
+        reject(new Error(url + ': ' + res.statusCode + ' ' +
+                         res.statusMessage));
+        return;
+      }
+      var chunks = [];
+      var length = 0;
+      res.on('data', function(chunk) {
+        length += chunk.length;
+        if (length > Packages.MAX_SIZE) {
+          req.destroy(new Error(url + ' too large'));
+          return;
+        }
+        chunks.push(chunk);
+      });
+      res.on('end', function() {
+        resolve(Buffer.concat(chunks));
+      });
+    });
+    req.setTimeout(Packages.TIMEOUT, function() {
+      req.destroy(new Error('No response from ' + url));
+    });
+    req.on('error', reject);
+  });
+};
+
+module.exports = Packages;
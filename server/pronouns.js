@@ -0,0 +1,200 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Substituting names and pronouns into action messages
+ * (the CC.substitute builtin), so that one template, such as
+ *
+ *     %N %[puts|put] %d in %p pocket.
+ *
+ * can be rendered for everyone in a room: as "You put the key in your
+ * pocket." for the user who did it, and "Alice puts the key in her
+ * pocket." for everyone else.
+ *
+ * The codes, in the manner of LambdaMOO's, are:
+ *
+ * - %n: the actor's name.
+ * - %s, %o, %p, %q, %r: the actor's subject (he), object (him),
+ *   possessive (his), possessive pronoun (his) and reflexive (himself)
+ *   pronouns.
+ * - %d, %i, %t, %l: the names of the direct object, indirect object,
+ *   this (the object whose verb is running) and location.
+ * - %[singular|plural]: whichever form of a verb agrees with the
+ *   actor, as last referred to: e.g., %[is|are] gives "is" after Sam
+ *   (%n) or she (%s), but "are" after they or you.
+ * - %%: a percent sign.
+ *
+ * A code in upper case (e.g., %N) capitalizes what it is replaced by.
+ * Whoever the message is rendered for (the viewer) is referred to as
+ * "you" (or "your", etc.).  Unknown codes are left as they are.
+ */
+'use strict';
+
+var Pronouns = {};
+
+/**
+ * A set of pronouns.
+ * @typedef {{subject: string,
+ *            object: string,
+ *            possessive: string,
+ *            possessivePronoun: string,
+ *            reflexive: string,
+ *            plural: boolean}}
+ */
+Pronouns.Set;
+
+/**
+ * The standard sets of pronouns, by name.
+ * @const {!Object<string, !Pronouns.Set>}
+ */
+Pronouns.SETS = {
+  'he': {subject: 'he', object: 'him', possessive: 'his',
+         possessivePronoun: 'his', reflexive: 'himself', plural: false},
+  'she': {subject: 'she', object: 'her', possessive: 'her',
+          possessivePronoun: 'hers', reflexive: 'herself', plural: false},
+  'they': {subject: 'they', object: 'them', possessive: 'their',
+           possessivePronoun: 'theirs', reflexive: 'themselves',
+           plural: true},
+  'it': {subject: 'it', object: 'it', possessive: 'its',
+         possessivePronoun: 'its', reflexive: 'itself', plural: false},
+};
+
+/**
+ * The pronouns referring to the viewer.
+ * @const {!Pronouns.Set}
+ */
+Pronouns.YOU = {subject: 'you', object: 'you', possessive: 'your',
+                possessivePronoun: 'yours', reflexive: 'yourself',
+                plural: true};
+
+/**
+ * The set of pronouns used for anyone who has not chosen valid ones.
+ * @const {string}
+ */
+Pronouns.DEFAULT = 'they';
+
+/**
+ * Parse a pronoun setting: either the name of a standard set (e.g.,
+ * 'she') or five forms separated by slashes, as subject, object,
+ * possessive, possessive pronoun and reflexive (e.g.,
+ * 'ze/zir/zir/zirs/zirself').
+ * @param {*} setting The setting.
+ * @return {?Pronouns.Set} The pronouns, or null if setting is not
+ *     valid.
+ */
+Pronouns.parse = function(setting) {
+  if (typeof setting !== 'string') return null;
+  setting = setting.trim().toLowerCase();
+  if (Object.prototype.hasOwnProperty.call(Pronouns.SETS, setting)) {
+    return Pronouns.SETS[setting];
+  }
+  var forms = setting.split('/').map(function(form) {return form.trim();});
+  if (forms.length !== 5 || forms.some(function(form) {
+        return !/^[^\s%]{1,20}$/.test(form);
+      })) {
+    return null;
+  }
+  return {subject: forms[0], object: forms[1], possessive: forms[2],
+          possessivePronoun: forms[3], reflexive: forms[4], plural: false};
+};
+
+/**
+ * Something a message refers to: its name and pronouns, and whatever
+ * identifies it (compared to the viewer, to tell whether it is them).
+ * @typedef {{name: string, pronouns: ?Pronouns.Set, id: *}}
+ */
+Pronouns.Role;
+
+/**
+ * Roles (see Pronouns.Role) of the actor, direct object, indirect
+ * object, this and location, any of which may be omitted.
+ * @typedef {{actor: (!Pronouns.Role|undefined),
+ *            dobj: (!Pronouns.Role|undefined),
+ *            iobj: (!Pronouns.Role|undefined),
+ *            this: (!Pronouns.Role|undefined),
+ *            location: (!Pronouns.Role|undefined)}}
+ */
+Pronouns.Roles;
+
+/**
+ * Codes for names, with the roles they refer to.
+ * @private @const {!Object<string, string>}
+ */
+Pronouns.NAMES_ = {
+  'n': 'actor',
+  'd': 'dobj',
+  'i': 'iobj',
+  't': 'this',
+  'l': 'location',
+};
+
+/**
+ * Codes for the actor's pronouns, with the forms they refer to.
+ * @private @const {!Object<string, string>}
+ */
+Pronouns.FORMS_ = {
+  's': 'subject',
+  'o': 'object',
+  'p': 'possessive',
+  'q': 'possessivePronoun',
+  'r': 'reflexive',
+};
+
+/**
+ * Render a message template for a viewer.
+ * @param {string} template The template.
+ * @param {!Pronouns.Roles} roles What the message refers to.
+ * @param {*=} viewer Whoever the message is for (compared to the ids of
+ *     the roles), or undefined if none.
+ * @return {string} The message.
+ */
+Pronouns.substitute = function(template, roles, viewer) {
+  var isViewer = function(role) {
+    return Boolean(role) && viewer !== undefined && role.id === viewer;
+  };
+  var actor = roles.actor;
+  var actorPronouns = isViewer(actor) ? Pronouns.YOU :
+      (actor && actor.pronouns) || Pronouns.SETS[Pronouns.DEFAULT];
+  // Is the actor, as last referred to, plural?
+  var plural = actorPronouns.plural;
+  return template.replace(/%(?:\[([^|\]]*)\|([^\]]*)\]|([a-zA-Z%]))/g,
+      function(match, singular, pluralForm, code) {
+        if (code === undefined) {
+          return plural ? pluralForm : singular;
+        } else if (code === '%') {
+          return '%';
+        }
+        var lower = code.toLowerCase();
+        var text;
+        if (Object.prototype.hasOwnProperty.call(Pronouns.NAMES_, lower)) {
+          var role = roles[Pronouns.NAMES_[lower]];
+          if (!role) return match;
+          text = isViewer(role) ? 'you' : role.name;
+          if (lower === 'n') plural = isViewer(role);
+        } else if (Object.prototype.hasOwnProperty.call(Pronouns.FORMS_,
+                                                        lower)) {
+          text = actorPronouns[Pronouns.FORMS_[lower]];
+          plural = actorPronouns.plural;
+        } else {
+          return match;
+        }
+        return (code === lower) ? text :
+            text.charAt(0).toUpperCase() + text.slice(1);
+      });
+};
+
+module.exports = Pronouns;
@@ -0,0 +1,315 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Finding the real addresses of clients that connect
+ * via proxies (e.g., load balancers).
+ *
+ * A proxy that speaks the PROXY protocol (versions 1 and 2, as
+ * specified by HAProxy) sends a header giving the client's address
+ * at the start of each connection, before any data from the client
+ * (and so before any TLS handshake).  Once the header has been read,
+ * the connection is represented by a Proxies.Socket, which reports
+ * the client's address as its .remoteAddress.
+ *
+ * An HTTP proxy instead adds the client's address to the
+ * X-Forwarded-For (or X-Real-IP) header of each request.
+ *
+ * Either is believed only if the proxy itself is trusted, since
+ * otherwise any client could claim any address.
+ */
+'use strict';
+
+var net = require('net');
+var stream = require('stream');
+var util = require('util');
+
+var Proxies = {};
+
+/**
+ * Time allowed for a PROXY protocol header to arrive (in ms).
+ * @const {number}
+ */
+Proxies.HEADER_TIMEOUT = 10 * 1000;
+
+/**
+ * Signature beginning a version 2 PROXY protocol header.
+ * @const {!Buffer}
+ */
+Proxies.V2_SIGNATURE =
+    Buffer.from([0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49,
+                 0x54, 0x0a]);
+
+/**
+ * Maximum length of a version 1 PROXY protocol header, including CRLF.
+ * @const {number}
+ */
+Proxies.V1_MAX_LENGTH = 107;
+
+/**
+ * Address of a client, as given by a proxy.
+ * @typedef {{address: string, port: number}}
+ */
+Proxies.Source;
+
+/**
+ * Parse a PROXY protocol header (version 1 or 2).
+ * @param {!Buffer} data Data received so far.
+ * @return {?{length: number, source: ?Proxies.Source}} Null if more
+ *     data is needed; otherwise, the length of the header and the
+ *     client's address (or null, if the proxy does not say, e.g. for
+ *     its own health checks).
+ * @throws {Error} If data does not begin with a valid header.
+ */
+Proxies.parseHeader = function(data) {
+  var sig = Proxies.V2_SIGNATURE;
+  var prefix = data.subarray(0, sig.length);
+  if (sig.subarray(0, prefix.length).equals(prefix)) {
+    return Proxies.parseV2_(data);
+  }
+  var v1 = Buffer.from('PROXY ');
+  prefix = data.subarray(0, v1.length);
+  if (!v1.subarray(0, prefix.length).equals(prefix)) {
+    throw new Error('Not a PROXY protocol header');
+  }
+  var end = data.indexOf('\r\n');
+  if (end === -1) {
+    if (data.length >= Proxies.V1_MAX_LENGTH) {
+      throw new Error('PROXY protocol header too long');
+    }
+    return null;
+  }
+  var fields = data.toString('latin1', 0, end).split(' ');
+  if (fields[1] === 'UNKNOWN') return {length: end + 2, source: null};
+  var version = {'TCP4': 4, 'TCP6': 6}[fields[1]];
+  if (fields.length !== 6 || !version || net.isIP(fields[2]) !== version ||
+      net.isIP(fields[3]) !== version || !/^\d{1,5}$/.test(fields[4]) ||
+      Number(fields[4]) > 0xffff) {
+    throw new Error('Invalid PROXY protocol header');
+  }
+  return {
+    length: end + 2,
+    source: {address: fields[2], port: Number(fields[4])},
+  };
+};
+
+/**
+ * Parse a version 2 PROXY protocol header.
+ * @private
+ * @param {!Buffer} data Data received so far.
+ * @return {?{length: number, source: ?Proxies.Source}}
+ * @throws {Error} If data does not begin with a valid header.
+ */
+Proxies.parseV2_ = function(data) {
+  if (data.length < 16) return null;
+  var length = 16 + data.readUInt16BE(14);
+  if (data.length < length) return null;
+  var version = data[12] >> 4;
+  var command = data[12] & 0xf;
+  if (version !== 2 || command > 1) {
+    throw new Error('Invalid PROXY protocol header');
+  }
+  var result = {length: length, source: null};
+  var family = data[13] >> 4;
+  var transport = data[13] & 0xf;
+  // LOCAL connections (and those for which the proxy gives no, or a
+  // non-IP, address) are reported as coming from the proxy.
+  if (command === 0 || transport === 0) return result;
+  if (family === 1 && length >= 16 + 12) {
+    result.source = {
+      address: Array.from(data.subarray(16, 20)).join('.'),
+      port: data.readUInt16BE(24),
+    };
+  } else if (family === 2 && length >= 16 + 36) {
+    var groups = [];
+    for (var i = 0; i < 16; i += 2) {
+      groups.push(data.readUInt16BE(16 + i).toString(16));
+    }
+    result.source = {address: groups.join(':'), port: data.readUInt16BE(48)};
+  }
+  return result;
+};
+
+/**
+ * Read a PROXY protocol header from the start of a connection.
+ * @param {!net.Socket} socket The connection (from the proxy).
+ * @param {function(?Error, ?Proxies.Socket=)} callback Called with an
+ *     error (if no valid header arrived in time) or a Proxies.Socket
+ *     representing the client's connection.
+ */
+Proxies.readHeader = function(socket, callback) {
+  var data = Buffer.alloc(0);
+  var done = false;
+  var finish = function(error, result) {
+    if (done) return;
+    done = true;
+    clearTimeout(timer);
+    socket.removeListener('data', onData);
+    socket.removeListener('end', onEnd);
+    socket.removeListener('error', finish);
+    if (error) {
+      callback(error);
+      return;
+    }
+    callback(null, new Proxies.Socket(socket,
+                                      data.subarray(result.length),
+                                      result.source));
+  };
+  var onData = function(chunk) {
+    data = Buffer.concat([data, chunk]);
+    var result;
+    try {
+      result = Proxies.parseHeader(data);
+    } catch (e) {
+      finish(e);
+      return;
+    }
+    if (result) finish(null, result);
+  };
+  var onEnd = function() {
+    finish(new Error('Connection ended before PROXY protocol header'));
+  };
+  var timer = setTimeout(function() {
+    finish(new Error('Timed out awaiting PROXY protocol header'));
+  }, Proxies.HEADER_TIMEOUT);
+  socket.on('data', onData);
+  socket.on('end', onEnd);
+  socket.on('error', finish);
+};
+
+/**
+ * A connection from a client via a proxy that has sent a PROXY
+ * protocol header.  Data received after the header (starting with
+ * head) can be read, and data written is passed on to the proxy.
+ * N.B. that being a plain stream (rather than a net.Socket), it can
+ * be wrapped by a tls.TLSSocket even though some of the data received
+ * from the proxy has already been read.
+ * @constructor
+ * @extends {stream.Duplex}
+ * @param {!net.Socket} socket The connection from the proxy.
+ * @param {!Buffer} head Data received after the header.
+ * @param {?Proxies.Source} source The client's address, if known.
+ */
+Proxies.Socket = function(socket, head, source) {
+  stream.Duplex.call(this, {allowHalfOpen: true});
+  /** @private @const {!net.Socket} */
+  this.socket_ = socket;
+  /** @const {string|undefined} */
+  this.remoteAddress = source ? source.address : socket.remoteAddress;
+  /** @const {number|undefined} */
+  this.remotePort = source ? source.port : socket.remotePort;
+  /** @const {string|undefined} Address of the proxy. */
+  this.proxyAddress = socket.remoteAddress;
+
+  var self = this;
+  if (head.length) this.push(head);
+  socket.on('data', function(data) {
+    if (!self.push(data)) socket.pause();
+  });
+  socket.on('end', function() {
+    self.push(null);
+  });
+  socket.on('timeout', function() {
+    self.emit('timeout');
+  });
+  socket.on('error', function(error) {
+    self.destroy(error);
+  });
+  socket.on('close', function() {
+    self.destroy();
+  });
+};
+util.inherits(Proxies.Socket, stream.Duplex);
+
+/** @override */
+Proxies.Socket.prototype._read = function(size) {
+  this.socket_.resume();
+};
+
+/** @override */
+Proxies.Socket.prototype._write = function(chunk, encoding, callback) {
+  this.socket_.write(chunk, encoding, callback);
+};
+
+/** @override */
+Proxies.Socket.prototype._final = function(callback) {
+  this.socket_.end(callback);
+};
+
+/** @override */
+Proxies.Socket.prototype._destroy = function(error, callback) {
+  this.socket_.destroy();
+  callback(error);
+};
+
+/**
+ * Set the socket to time out after ms of inactivity (as for
+ * net.Socket.prototype.setTimeout).
+ * @param {number} ms The timeout (in ms), or 0 to disable it.
+ * @param {function()=} callback Added as a listener for 'timeout'.
+ * @return {!Proxies.Socket} This socket.
+ */
+Proxies.Socket.prototype.setTimeout = function(ms, callback) {
+  this.socket_.setTimeout(ms);
+  if (callback) this.once('timeout', callback);
+  return this;
+};
+
+/**
+ * Enable or disable Nagle's algorithm (as for
+ * net.Socket.prototype.setNoDelay).
+ * @param {boolean=} noDelay Disable it?
+ * @return {!Proxies.Socket} This socket.
+ */
+Proxies.Socket.prototype.setNoDelay = function(noDelay) {
+  this.socket_.setNoDelay(noDelay);
+  return this;
+};
+
+/**
+ * Find the address of the client that made an HTTP request, from the
+ * X-Forwarded-For (or, failing that, X-Real-IP) header, if (and only
+ * if) the request came from a trusted proxy.  Each proxy appends the
+ * address it received the request from to X-Forwarded-For, so the
+ * client's address is the last one not added by a trusted proxy.
+ * @param {string} peer Address the request was received from.
+ * @param {!Object<string, (string|!Array<string>|undefined)>} headers
+ *     The request's headers (with lower-case names).
+ * @param {function(string): boolean} isTrusted Is a proxy at the given
+ *     address trusted?
+ * @return {string} The client's address: peer, unless it is trusted
+ *     and says otherwise.
+ */
+Proxies.forwardedFor = function(peer, headers, isTrusted) {
+  if (!isTrusted(peer)) return peer;
+  var forwarded = headers['x-forwarded-for'];
+  if (forwarded) {
+    var addresses = String(forwarded).split(',').map(function(address) {
+      return address.trim();
+    });
+    for (var i = addresses.length - 1; i >= 0; i--) {
+      if (!net.isIP(addresses[i])) break;
+      peer = addresses[i];
+      if (!isTrusted(peer)) break;
+    }
+    return peer;
+  }
+  var real = String(headers['x-real-ip'] || '').trim();
+  return net.isIP(real) ? real : peer;
+};
+
+module.exports = Proxies;
@@ -0,0 +1,222 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Rate limiting of connection attempts, logins and
+ * commands.
+ *
+ * Each named policy allows up to limit events for any one key (an IP
+ * address, or an account) in any period ms.  The event that exceeds
+ * the limit locks the key out for lockout ms, during which further
+ * events are refused (and not counted).  Addresses listed as exempt
+ * (by default, loopback ones: connectServer and loginServer connect
+ * from localhost on behalf of all their clients) are never limited.
+ */
+'use strict';
+
+var RateLimit = {};
+
+/**
+ * A rate limiting policy.
+ * @typedef {{limit: number, period: number, lockout: number}}
+ */
+RateLimit.Policy;
+
+/**
+ * Configuration for a RateLimit.Limiter: a list of exempt addresses,
+ * and overrides for (some properties of) any of the default policies,
+ * or complete additional policies, by name.  E.g.:
+ *     {exempt: [], login: {limit: 3}}
+ * @typedef {!Object<string, (!Array<string>|!Object<string, number>)>}
+ */
+RateLimit.Config;
+
+/**
+ * Default policies:
+ *
+ * - connect: connection attempts, by IP address.
+ * - login: failed logins, by IP address or account.
+ * - command: commands (lines or messages of input), by IP address or
+ *   account.
+ * - log: entries written to the log (with CC.log or CC.logWrite), by
+ *   owner.
+ * @const {!Object<string, !RateLimit.Policy>}
+ */
+RateLimit.POLICIES = {
+  connect: {limit: 30, period: 60 * 1000, lockout: 5 * 60 * 1000},
+  login: {limit: 5, period: 5 * 60 * 1000, lockout: 15 * 60 * 1000},
+  command: {limit: 100, period: 10 * 1000, lockout: 30 * 1000},
+  log: {limit: 100, period: 10 * 1000, lockout: 10 * 1000},
+};
+
+/**
+ * Default exempt addresses.
+ * @const {!Array<string>}
+ */
+RateLimit.EXEMPT = ['127.0.0.1', '::1', '::ffff:127.0.0.1'];
+
+/**
+ * Number of events recorded between sweeps of keys that no longer
+ * have any recent events or lockout.
+ * @const {number}
+ */
+RateLimit.SWEEP_INTERVAL = 1000;
+
+/**
+ * Record of recent events for one key.
+ * @typedef {{times: !Array<number>, until: number}}
+ */
+RateLimit.Entry_;
+
+/**
+ * A set of rate limits.
+ * @constructor
+ * @struct
+ * @param {!RateLimit.Config=} config Configuration.
+ */
+RateLimit.Limiter = function(config) {
+  /** @type {!Object<string, !RateLimit.Policy>} */
+  this.policies = Object.create(null);
+  /** @const {!Set<*>} */
+  this.exempt = new Set();
+  /**
+   * Entries, by policy name then key.
+   * @private @const {!Map<string, !Map<*, !RateLimit.Entry_>>}
+   */
+  this.entries_ = new Map();
+  /** @private @type {number} */
+  this.count_ = 0;
+  this.configure(config);
+};
+
+/**
+ * Replace the policies and exempt addresses with newly configured ones.
+ * Recent events are remembered (and lockouts continue), except those of
+ * policies no longer configured.
+ * @param {!RateLimit.Config=} config Configuration.
+ */
+RateLimit.Limiter.prototype.configure = function(config) {
+  config = config || {};
+  var policies = Object.create(null);
+  for (var name in RateLimit.POLICIES) {
+    policies[name] = Object.assign({}, RateLimit.POLICIES[name]);
+  }
+  for (name in config) {
+    if (name === 'exempt') continue;
+    policies[name] = /** @type {!RateLimit.Policy} */(
+        Object.assign(policies[name] || {}, config[name]));
+  }
+  this.policies = policies;
+  this.exempt.clear();
+  (/** @type {!Array<string>|undefined} */(config['exempt']) ||
+      RateLimit.EXEMPT).forEach(function(address) {
+    this.exempt.add(address);
+  }, this);
+  this.entries_.forEach(function(entries, name) {
+    if (!policies[name]) this.entries_.delete(name);
+  }, this);
+};
+
+/**
+ * Look up a policy.
+ * @private
+ * @param {string} name The policy's name.
+ * @return {!RateLimit.Policy}
+ */
+RateLimit.Limiter.prototype.policy_ = function(name) {
+  var policy = this.policies[name];
+  if (!policy) throw new RangeError('Unknown rate limit policy ' + name);
+  return policy;
+};
+
+/**
+ * Record an event, unless key is locked out.
+ * @param {string} name The policy's name.
+ * @param {*} key The key (e.g., IP address) the event is counted against.
+ * @param {number=} now The time (default Date.now()).
+ * @return {number} 0 if the event is permitted; otherwise the time, in
+ *     ms, until key's lockout ends.
+ */
+RateLimit.Limiter.prototype.record = function(name, key, now) {
+  var policy = this.policy_(name);
+  if (this.exempt.has(key)) return 0;
+  if (now === undefined) now = Date.now();
+  if (++this.count_ % RateLimit.SWEEP_INTERVAL === 0) this.sweep(now);
+  var entries = this.entries_.get(name);
+  if (!entries) {
+    entries = new Map();
+    this.entries_.set(name, entries);
+  }
+  var entry = entries.get(key) || {times: [], until: 0};
+  if (entry.until > now) return entry.until - now;
+  entry.times = entry.times.filter(function(t) {
+    return t > now - policy.period;
+  });
+  entry.times.push(now);
+  entries.set(key, entry);
+  if (entry.times.length <= policy.limit) return 0;
+  entry.times = [];
+  entry.until = now + policy.lockout;
+  return policy.lockout;
+};
+
+/**
+ * Check whether key is locked out, without recording an event.
+ * @param {string} name The policy's name.
+ * @param {*} key The key.
+ * @param {number=} now The time (default Date.now()).
+ * @return {number} 0 if key is not locked out; otherwise the time, in
+ *     ms, until its lockout ends.
+ */
+RateLimit.Limiter.prototype.check = function(name, key, now) {
+  this.policy_(name);
+  if (now === undefined) now = Date.now();
+  var entries = this.entries_.get(name);
+  var entry = entries && entries.get(key);
+  return (entry && entry.until > now) ? entry.until - now : 0;
+};
+
+/**
+ * Forget all events recorded for key (and end any lockout), e.g.
+ * after a successful login.
+ * @param {string} name The policy's name.
+ * @param {*} key The key.
+ */
+RateLimit.Limiter.prototype.reset = function(name, key) {
+  this.policy_(name);
+  var entries = this.entries_.get(name);
+  if (entries) entries.delete(key);
+};
+
+/**
+ * Discard entries for keys with no recent events or lockout.
+ * @param {number=} now The time (default Date.now()).
+ */
+RateLimit.Limiter.prototype.sweep = function(now) {
+  if (now === undefined) now = Date.now();
+  this.entries_.forEach(function(entries, name) {
+    var period = this.policies[name].period;
+    entries.forEach(function(entry, key) {
+      if (entry.until <= now &&
+          !entry.times.some(function(t) {return t > now - period;})) {
+        entries.delete(key);
+      }
+    });
+  }, this);
+};
+
+module.exports = RateLimit;
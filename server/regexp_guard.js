@@ -0,0 +1,124 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Execution limits for regular expressions supplied by
+ * in-world code.
+ *
+ * The interpreter runs RegExp methods on native V8 regular
+ * expressions, which backtrack, so a pattern like /(a+)+b/ can take
+ * time exponential in the length of its input, stalling the whole
+ * server (not just the thread that ran it).  Two defences are used:
+ *
+ * - V8 is told to switch to its (linear time, but more limited)
+ *   experimental regexp engine once a match has backtracked too many
+ *   times.  This handles most patterns with no overhead.
+ *
+ * - Patterns the linear engine cannot handle (those with
+ *   backreferences, lookarounds, or the i or u flags) are instead run
+ *   with a time limit, enforced by V8's watchdog via the vm module,
+ *   which costs some tens of microseconds per call.
+ */
+'use strict';
+
+var v8 = require('v8');
+var vm = require('vm');
+
+var RegExpGuard = {};
+
+/**
+ * Maximum time (in ms) for a single match operation, even on threads
+ * that have no time limit of their own.
+ * @const {number}
+ */
+RegExpGuard.MAX_TIME = 1000;
+
+/**
+ * Number of backtracks after which V8 switches to its linear engine.
+ * @const {number}
+ */
+RegExpGuard.BACKTRACK_LIMIT = 10000;
+
+v8.setFlagsFromString('--enable-experimental-regexp-engine');
+v8.setFlagsFromString(
+    '--enable-experimental-regexp-engine-on-excessive-backtracks');
+v8.setFlagsFromString(
+    '--regexp-backtracks-before-fallback=' + RegExpGuard.BACKTRACK_LIMIT);
+
+/**
+ * Cache of whether each RegExp can be run by the linear engine.
+ * @private @const {!WeakMap<!RegExp, boolean>}
+ */
+RegExpGuard.linear_ = new WeakMap();
+
+/** @private @const {!Object} */
+RegExpGuard.context_ = vm.createContext({f: null});
+
+/** @private @const {!vm.Script} */
+RegExpGuard.script_ = new vm.Script('f()');
+
+/**
+ * Can a RegExp be run by V8's linear engine (and so be left to fall
+ * back to it if it backtracks excessively)?
+ * @param {!RegExp} regexp The RegExp.
+ * @return {boolean} True iff it can.
+ */
+RegExpGuard.isLinear = function(regexp) {
+  var linear = RegExpGuard.linear_.get(regexp);
+  if (linear === undefined) {
+    try {
+      new RegExp(regexp.source, regexp.flags + 'l');
+      linear = true;
+    } catch (e) {
+      linear = false;
+    }
+    RegExpGuard.linear_.set(regexp, linear);
+  }
+  return linear;
+};
+
+/**
+ * Run a match operation, throwing a RangeError if it takes too long.
+ * @template T
+ * @param {*} regexp The RegExp being matched (or a string, in which
+ *     case no limit is needed).
+ * @param {function(): T} func Function doing the matching.
+ * @param {number=} timeLimit Time allowed (in ms; default and maximum
+ *     RegExpGuard.MAX_TIME).
+ * @return {T} The result of func.
+ */
+RegExpGuard.run = function(regexp, func, timeLimit) {
+  if (!(regexp instanceof RegExp) || RegExpGuard.isLinear(regexp)) {
+    return func();
+  }
+  timeLimit = (timeLimit === undefined) ? RegExpGuard.MAX_TIME :
+      Math.min(timeLimit, RegExpGuard.MAX_TIME);
+  RegExpGuard.context_.f = func;
+  try {
+    return RegExpGuard.script_.runInContext(RegExpGuard.context_,
+        {timeout: Math.max(1, Math.ceil(timeLimit))});
+  } catch (e) {
+    if (e && e.code === 'ERR_SCRIPT_EXECUTION_TIMEOUT') {
+      throw new RangeError('Regular expression took too long');
+    }
+    throw e;
+  } finally {
+    RegExpGuard.context_.f = null;
+  }
+};
+
+module.exports = RegExpGuard;
@@ -0,0 +1,274 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview A Read Eval Print Loop for a running Code City, over
+ * its admin API (see Admin.Server): each line typed is evaluated (by
+ * POST /eval) as a chosen owner, and the result printed, with the
+ * properties of named objects fetched (by GET /object) so they can be
+ * shown too.  Tab completes selectors, from the objects in the
+ * database.  Run as:
+ *
+ *     CODECITY_ADMIN_TOKEN=<token> node codecity repl [--owner <s>] <url>
+ *
+ * (see CodeCity.repl).
+ */
+'use strict';
+
+var http = require('http');
+var https = require('https');
+var readline = require('readline');
+
+var RemoteRepl = {};
+
+/**
+ * Maximum number of properties of an object to print.
+ * @const {number}
+ */
+RemoteRepl.MAX_PROPERTIES = 20;
+
+/**
+ * Maximum number of completions to offer.
+ * @const {number}
+ */
+RemoteRepl.MAX_COMPLETIONS = 100;
+
+/**
+ * A client of the admin API of a running Code City.
+ * @constructor
+ * @struct
+ * @param {string} url The admin API's URL (e.g. 'http://localhost:7781').
+ * @param {string} token The token to authenticate with.
+ */
+RemoteRepl.Client = function(url, token) {
+  /** @private @const {!URL} */
+  this.url_ = new URL(url);
+  if (this.url_.protocol !== 'http:' && this.url_.protocol !== 'https:') {
+    throw new TypeError('Admin URL must be http: or https:');
+  }
+  /** @private @const {string} */
+  this.token_ = token;
+};
+
+/**
+ * Make a request of the admin API.
+ * @param {string} method The HTTP method.
+ * @param {string} path The path (and query).
+ * @param {*=} body The request body (to be sent as JSON).
+ * @return {!Promise<*>} Resolves to the response body.  Rejects with an
+ *     Error (with the API's error message) if the request failed.
+ */
+RemoteRepl.Client.prototype.request = function(method, path, body) {
+  var url = new URL(path, this.url_);
+  var transport = (url.protocol === 'https:') ? https : http;
+  var headers = {'Authorization': 'Bearer ' + this.token_};
+  var data = (body === undefined) ? undefined : JSON.stringify(body);
+  if (data !== undefined) headers['Content-Type'] = 'application/json';
+  return new Promise(function(resolve, reject) {
+    var req = transport.request(url, {method: method, headers: headers},
+                                function(res) {
+      var chunks = [];
+      res.on('data', function(chunk) {chunks.push(chunk);});
+      res.on('end', function() {
+        try {
+          var result = JSON.parse(Buffer.concat(chunks).toString());
+        } catch (e) {
+          reject(new Error('Invalid response (status ' + res.statusCode +
+                           ')'));
+          return;
+        }
+        if (res.statusCode >= 400) {
+          reject(new Error(String(result && result['error'] ||
+                                  'Status ' + res.statusCode)));
+        } else {
+          resolve(result);
+        }
+      });
+      res.on('error', reject);
+    });
+    req.on('error', reject);
+    req.end(data);
+  });
+};
+
+/**
+ * Evaluate code, and describe the result (fetching the properties of
+ * named objects).
+ * @param {string} src The code.
+ * @param {string=} owner Selector for the owner to evaluate it as
+ *     (default: root).
+ * @return {!Promise<string>} Resolves to the description.
+ */
+RemoteRepl.Client.prototype.evaluate = function(src, owner) {
+  var client = this;
+  var body = {src: src};
+  if (owner !== undefined) body['owner'] = owner;
+  return this.request('POST', '/eval', body).then(function(result) {
+    var value = result['value'];
+    if (result['threw']) {
+      return 'Uncaught ' + RemoteRepl.format(value);
+    } else if (value['type'] !== 'object' || !value['selector'] ||
+               value['class'] === 'Error') {
+      return RemoteRepl.format(value);
+    }
+    return client.request('GET', '/object?selector=' +
+        encodeURIComponent(value['selector'])).then(function(obj) {
+      return RemoteRepl.formatObject(obj);
+    }, function() {
+      return RemoteRepl.format(value);  // E.g., deleted in the meantime.
+    });
+  });
+};
+
+/**
+ * Find completions for the selector at the end of a line of input.
+ * @param {string} line The line.
+ * @return {!Promise<!Array<?>>} Resolves to [completions, text being
+ *     completed], as for readline completers.
+ */
+RemoteRepl.Client.prototype.complete = function(line) {
+  var m = /[$\w]+(?:\.[$\w]+)*\.?$/.exec(line);
+  if (!m) return Promise.resolve([[], '']);
+  var text = m[0];
+  var dot = text.lastIndexOf('.');
+  var done = function(names) {
+    var completions = names.filter(function(name) {
+      return name.startsWith(text);
+    }).sort().slice(0, RemoteRepl.MAX_COMPLETIONS);
+    return [completions, text];
+  };
+  var fail = function() {
+    return [[], text];
+  };
+  if (dot === -1) {
+    // A top-level name: complete from the selectors of objects.
+    return this.request('GET', '/objects?search=' + encodeURIComponent(text) +
+        '&limit=' + RemoteRepl.MAX_COMPLETIONS).then(function(result) {
+      return done(result['objects'].map(function(obj) {
+        return obj['selector'].split(/[.[]/)[0];
+      }).filter(function(name, i, names) {
+        return names.indexOf(name) === i;
+      }));
+    }, fail);
+  }
+  // A property: complete from those of the object.
+  var parent = text.slice(0, dot);
+  return this.request('GET', '/object?selector=' +
+      encodeURIComponent(parent)).then(function(obj) {
+    return done(Object.keys(obj['properties']).filter(function(key) {
+      return /^[$A-Za-z_][$\w]*$/.test(key);
+    }).map(function(key) {
+      return parent + '.' + key;
+    }));
+  }, fail);
+};
+
+/**
+ * Format a value, as described by Admin.describeValue.
+ * @param {!Object} desc The description.
+ * @return {string} The formatted value.
+ */
+RemoteRepl.format = function(desc) {
+  switch (desc['type']) {
+    case 'undefined':
+      return 'undefined';
+    case 'string':
+      return JSON.stringify(desc['value']);
+    case 'function':
+      return '[Function' + (desc['selector'] ? ' ' + desc['selector'] : '') +
+          ']';
+    case 'object':
+      if ('message' in desc) {
+        return (desc['selector'] ? desc['selector'] + ' ' : '') + '[' +
+            desc['class'] + ': ' + desc['message'] + ']';
+      }
+      return desc['selector'] || '[' + desc['class'] + ']';
+    default:
+      return String(desc['value']);
+  }
+};
+
+/**
+ * Format an object and its properties, as described by
+ * Admin.describeObject.
+ * @param {!Object} desc The description.
+ * @return {string} The formatted object.
+ */
+RemoteRepl.formatObject = function(desc) {
+  var keys = Object.keys(desc['properties']);
+  var lines = keys.slice(0, RemoteRepl.MAX_PROPERTIES).map(function(key) {
+    var name = /^[$A-Za-z_][$\w]*$/.test(key) ? key : JSON.stringify(key);
+    return '  ' + name + ': ' +
+        RemoteRepl.format(desc['properties'][key]['value']) + ',';
+  });
+  if (keys.length > RemoteRepl.MAX_PROPERTIES) {
+    lines.push('  ... ' + (keys.length - RemoteRepl.MAX_PROPERTIES) +
+               ' more');
+  }
+  var header = desc['selector'] + ' ' +
+      ((desc['class'] === 'Object') ? '' : desc['class'] + ' ');
+  return header + (lines.length ? '{\n' + lines.join('\n') + '\n}' : '{}');
+};
+
+/**
+ * Start a REPL.
+ * @param {!RemoteRepl.Client} client The admin API client.
+ * @param {{owner: (string|undefined),
+ *          input: (!stream.Readable|undefined),
+ *          output: (!stream.Writable|undefined)}=} options The owner to
+ *     evaluate code as (default: root), and the streams to use (default:
+ *     stdin and stdout).
+ * @return {!readline.Interface} The readline interface.
+ */
+RemoteRepl.start = function(client, options) {
+  options = options || {};
+  var output = options.output || process.stdout;
+  var rl = readline.createInterface({
+    input: options.input || process.stdin,
+    output: output,
+    prompt: (options.owner ? options.owner : 'root') + '> ',
+    removeHistoryDuplicates: true,
+    completer: function(line, callback) {
+      client.complete(line).then(function(result) {
+        callback(null, result);
+      });
+    },
+  });
+  // Lines are evaluated one at a time, in order.
+  var pending = Promise.resolve();
+  rl.on('line', function(line) {
+    if (!line.trim()) {
+      rl.prompt();
+      return;
+    }
+    rl.pause();
+    pending = pending.then(function() {
+      return client.evaluate(line, options.owner);
+    }).then(function(text) {
+      output.write(text + '\n');
+    }, function(e) {
+      output.write('Error: ' + e.message + '\n');
+    }).then(function() {
+      rl.resume();
+      rl.prompt();
+    });
+  });
+  rl.prompt();
+  return rl;
+};
+
+module.exports = RemoteRepl;
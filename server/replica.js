@@ -0,0 +1,156 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Following a primary server's saved state, for a
+ * read-only replica (see the replica option in config.txt): a second
+ * server process that serves read-only traffic (web pages, search and
+ * the like) from a near-live copy of the primary's world, so as to
+ * take expensive reads off the primary.
+ *
+ * The replica polls the primary's database directory for a change to
+ * what has been saved there (a new checkpoint, incremental checkpoint
+ * or journal entry).  On finding one, it loads the saved state into a
+ * new interpreter in the background; once loaded, that replaces the
+ * current one, which is stopped (and its connections closed).  Changes
+ * made in the replica itself are never saved, and are lost when the
+ * next copy replaces it.
+ */
+'use strict';
+
+var Logging = require('./logging');
+
+var Replica = {};
+
+/**
+ * Subsystem of the server log to which refreshes are written.
+ * @const {!Logging.Subsystem}
+ */
+var log = new Logging.Subsystem('replica');
+
+/**
+ * Options for a Replica.Follower:
+ *
+ * - signature: function summarizing what the primary has saved (e.g.,
+ *   the names and sizes of the files), which changes whenever that
+ *   does.  May throw if it cannot be determined right now.
+ * - load: function to load what the primary has saved into a new
+ *   interpreter.
+ * - replaced: function called with the new and old interpreters once
+ *   the new one has replaced the old (e.g., to point other services at
+ *   it).
+ * - interval: seconds between polls.  (Default: Replica.INTERVAL.)
+ * @typedef {{signature: function(): string,
+ *            load: function(): !Promise<!Interpreter>,
+ *            replaced: (function(!Interpreter, !Interpreter)|undefined),
+ *            interval: (number|undefined)}}
+ */
+Replica.Options;
+
+/**
+ * Default number of seconds between polls of the primary.
+ * @const {number}
+ */
+Replica.INTERVAL = 10;
+
+/**
+ * Keeps a replica's interpreter up to date with what the primary has
+ * saved.
+ * @constructor
+ * @struct
+ * @param {!Interpreter} intrp The current (running) interpreter, as
+ *     loaded from what the primary has saved.
+ * @param {string} signature The signature (see Replica.Options) of what
+ *     it was loaded from.
+ * @param {!Replica.Options} options Options.
+ */
+Replica.Follower = function(intrp, signature, options) {
+  /** @type {!Interpreter} The current interpreter. */
+  this.intrp = intrp;
+  /** @private {string} Signature of what intrp was loaded from. */
+  this.signature_ = signature;
+  /** @private @const {!Replica.Options} */
+  this.options_ = options;
+  /** @private {?NodeJS.Timer} */
+  this.timer_ = null;
+  /** @private {boolean} Is a new copy being loaded? */
+  this.loading_ = false;
+  /** @type {number} Time the current copy was loaded. */
+  this.loadTime = Date.now();
+  /** @type {number} Number of times the interpreter has been replaced. */
+  this.refreshes = 0;
+};
+
+/**
+ * Start polling the primary.
+ */
+Replica.Follower.prototype.start = function() {
+  if (this.timer_) return;
+  var interval = this.options_.interval || Replica.INTERVAL;
+  this.timer_ = setInterval(this.poll.bind(this), interval * 1000);
+};
+
+/**
+ * Stop polling the primary.  (A copy already being loaded will still
+ * replace the current one once loaded.)
+ */
+Replica.Follower.prototype.stop = function() {
+  clearInterval(this.timer_);
+  this.timer_ = null;
+};
+
+/**
+ * Check whether the primary has saved anything new and, if so, load it
+ * and replace the current interpreter with it.  Errors are logged, not
+ * thrown: the current copy continues to be used until a new one can
+ * be loaded.
+ * @return {!Promise<boolean>} Resolves to true iff the interpreter was
+ *     replaced.
+ */
+Replica.Follower.prototype.poll = function() {
+  if (this.loading_) return Promise.resolve(false);
+  var follower = this;
+  try {
+    var signature = this.options_.signature();
+  } catch (e) {
+    log.error('Unable to check primary: %s', String(e));
+    return Promise.resolve(false);
+  }
+  if (signature === this.signature_) return Promise.resolve(false);
+  this.loading_ = true;
+  var started = Date.now();
+  return this.options_.load().then(function(intrp) {
+    follower.loading_ = false;
+    var old = follower.intrp;
+    old.stop();
+    old.closeConnections();
+    follower.intrp = intrp;
+    follower.signature_ = signature;
+    follower.loadTime = Date.now();
+    follower.refreshes++;
+    intrp.start();
+    if (follower.options_.replaced) follower.options_.replaced(intrp, old);
+    log.info('Replica refreshed (loaded in %dms).', Date.now() - started);
+    return true;
+  }, function(e) {
+    follower.loading_ = false;
+    log.error('Unable to load primary: %s', String(e));
+    return false;
+  });
+};
+
+module.exports = Replica;
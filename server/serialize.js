@@ -81,6 +81,32 @@ Serializer.getConfig_ = function(intrp) {
     
     // Interpreter-specific types.
     {tag: 'Interpreter', constructor: Interpreter, prune: [
+      'dirtyObjects',
+      'onExternalEffect',
+      'onThreadPaused',
+      'profile_',
+      'coverage_',
+      'collectingCoverage_',
+      'slowLog_',
+      'runnerDue_',
+      'wrapTls',
+      'sendMail',
+      'inheritedFds',
+      'adminLog',
+      'federation',
+      'blobs',
+      'packageRegistry',
+      'httpRequests_',
+      'fetchTimes_',
+      'mailTimes_',
+      'rateLimiter_',
+      'sessions_',
+      'traffic_',
+      'counts',
+      'guestObjects_',
+      'propertyCounts_',
+      'tainted_',
+      'taintedLength_',
       'hrStartTime_',
       'previousTime_',
       'runner_',
@@ -96,16 +122,19 @@ Serializer.getConfig_ = function(intrp) {
       'Error',
       'Arguments',
       'WeakMap',
+      'Buffer',
       'Thread',
       'Box',
       'Server',
     ]},
     {tag: 'Scope', constructor: Interpreter.Scope},
     {tag: 'State', constructor: Interpreter.State},
-    {tag: 'Thread', constructor: Interpreter.Thread},
+    {tag: 'Thread', constructor: Interpreter.Thread, prune: ['onExit']},
     {tag: 'PropertyIterator', constructor: Interpreter.PropertyIterator},
     {tag: 'Source', constructor: Interpreter.Source},
-    {tag: 'PseudoObject', constructor: intrp.Object, prune: ['socket']},
+    {tag: 'HostHandle', constructor: Interpreter.HostHandle,
+     prune: ['resource', 'idle']},
+    {tag: 'PseudoObject', constructor: intrp.Object},
     {tag: 'PseudoFunction', constructor: intrp.Function},
     {tag: 'PseudoUserFunction', constructor: intrp.UserFunction},
     {tag: 'PseudoBoundFunction', constructor: intrp.BoundFunction},
@@ -117,9 +146,10 @@ Serializer.getConfig_ = function(intrp) {
     {tag: 'PseudoError', constructor: intrp.Error},
     {tag: 'PseudoArguments', constructor: intrp.Arguments},
     {tag: 'PseudoWeakMap', constructor: intrp.WeakMap},
+    {tag: 'PseudoBuffer', constructor: intrp.Buffer},
     {tag: 'PseudoThread', constructor: intrp.Thread},
     {tag: 'Box', constructor: intrp.Box},
-    {tag: 'Server', constructor: intrp.Server, prune: ['server_']},
+    {tag: 'Server', constructor: intrp.Server, prune: ['server_', 'http_']},
     {tag: 'Node', constructor: Node},
   ];
   var /** !Object<string,!TypeInfo> */ byTag = Object.create(null);
@@ -137,38 +167,40 @@ Serializer.getConfig_ = function(intrp) {
  * @param {!Interpreter} intrp JS-Interpreter instance.
  */
 Serializer.deserialize = function(json, intrp) {
-  function decodeValue(value) {
-    if (value && typeof value === 'object') {
-      var data;
-      if ((data = value['#'])) {
-       // Object reference: {'#': 42}
-       value = objectList[data];
-        if (!value) {
-          throw new ReferenceError('Object reference not found: ' + data);
-        }
-        return value;
-      }
-      if ((data = value['Number'])) {
-        // Special number: {'Number': 'Infinity'}
-        return Number(data);
-      }
-      if ((data = value['Value'])) {
-        // Special value: {'Value': 'undefined'}
-        if (value['Value'] === 'undefined') {
-          return undefined;
-        }
-      }
-    }
-    return value;
-  }
-
-  // Get configuration.
-  var config = Serializer.getConfig_(intrp);
-  
   if (!Array.isArray(json)) {
     throw new TypeError('Top-level JSON is not a list.');
   }
+  var deserializer = new Serializer.Deserializer(intrp);
+  for (var i = 0; i < json.length; i++) {
+    if (!json[i]) {
+      throw new ReferenceError('Missing record for object ' + i);
+    }
+    deserializer.add(json[i]);
+  }
+  deserializer.finish();
+};
 
+/**
+ * A deserializer that accepts records one at a time, in any order,
+ * so that a serialization need not be held in memory in its entirety
+ * while it is being loaded.
+ *
+ * Each record is used to create and populate the corresponding object
+ * immediately.  References to objects whose records have not yet been
+ * seen are filled in when they are; population of Maps and Sets (whose
+ * contents are keyed by identity) and preventing extensions are
+ * deferred until finish is called.
+ *
+ * A partial deserializer creates objects in an interpreter that is
+ * already running (e.g., to import a package; see package.js): there
+ * is no record for the interpreter proper, IDs start at 1, and
+ * references to existing objects can be supplied using .provide.
+ * @constructor
+ * @struct
+ * @param {!Interpreter} intrp JS-Interpreter instance to deserialize into.
+ * @param {boolean=} partial Is this a partial deserialization?
+ */
+Serializer.Deserializer = function(intrp, partial) {
   // Require native functions to be present.  Can't just create fresh
   // new interpreter instance because client code may want to add
   // custom builtins.
@@ -176,9 +208,14 @@ Serializer.deserialize = function(json, intrp) {
     throw new Error(
         'Interpreter must be initialized prior to deserialization.');
   }
+  /** @private @const {!Interpreter} */
+  this.intrp_ = intrp;
+  /** @private @const {!Config} */
+  this.config_ = Serializer.getConfig_(intrp);
 
   // Find all native functions to get id => func mappings.
-  var functionHash = Object.create(null);
+  /** @private @const {!Object<string,!Function>} */
+  this.functionHash_ = Object.create(null);
   // Builtins.
   var builtins = Array.from(intrp.builtins.values());
   var implProps = ['impl', 'call', 'construct'];
@@ -186,148 +223,829 @@ Serializer.deserialize = function(json, intrp) {
     var builtin = builtins[i];
     for (var j = 0; j < implProps.length; j++) {
       var func = builtin[implProps[j]];
-      if (func) functionHash[func.id] = func;
+      if (func) this.functionHash_[func.id] = func;
     }
   }
   // Step functions.
   for (var stepName in intrp.stepFuncs) {
     var stepFunc = intrp.stepFuncs[stepName];
-    functionHash[stepFunc.id] = stepFunc;
+    this.functionHash_[stepFunc.id] = stepFunc;
   }
 
-  // First pass: Create object stubs for every object.  We don't need
-  // to (re)create object #0, because that's the interpreter proper.
-  var objectList = [intrp];
-  for (var i = 1; i < json.length; i++) {
-    var jsonObj = json[i];
-    var obj;
-    var tag = jsonObj['type'];
-    // Default case handles most types; sepcial cases handle only
-    // those that can't be correctly created by an unparameterized
-    // construction "new Constructor()".
-    switch (tag) {
-      case 'Function':
-        obj = functionHash[jsonObj['id']];
-        if (!obj) {
-          throw new RangeError('Function ID not found: ' + jsonObj['id']);
-        }
-        break;
-      case 'Date':
-        obj = new Date(jsonObj['data']);
-        if (isNaN(obj)) {
-          throw new TypeError('Invalid date: ' + jsonObj['data']);
-        }
-        break;
-      case 'RegExp':
-        obj = RegExp(jsonObj['source'], jsonObj['flags']);
-        break;
-      case 'State':
-        // TODO(cpcallen): this is just a little performance kludge so
-        // that the State constructor doesn't need a conditional in it.
-        // Find a more general solution to constructors requiring args.
-        obj = new Interpreter.State(/** @type {?} */({}),
-            /** @type {?} */(undefined));
-        break;
-      default:
-        if (config.byTag[tag]) {
-          obj = new config.byTag[tag].constructor();
-        } else {
-          throw new TypeError('Unknown type tag "' + tag + '"');
-        }
+  /**
+   * Objects created so far, indexed by ID.  We don't need to
+   * (re)create object #0, because that's the interpreter proper.
+   * @private @const {!Array<!Object>}
+   */
+  this.objectList_ = [];
+  /**
+   * Callbacks waiting for objects that have not been created yet.
+   * @private @const {!Map<number,!Array<function(!Object)>>}
+   */
+  this.pending_ = new Map();
+  /**
+   * Work to be done once all objects have been created.
+   * @private @const {!Array<function()>}
+   */
+  this.deferred_ = [];
+  /** @private {number} Number of records added so far. */
+  this.count_ = 0;
+  /** @private {?Object} Record for the interpreter proper (object #0). */
+  this.interpreterRecord_ = null;
+  /** @private @const {boolean} */
+  this.partial_ = Boolean(partial);
+};
+
+/**
+ * Create and populate the object described by one record.
+ * @param {!Object} jsonObj JSON-compatible record.  If it has no '#'
+ *     property then its ID is taken to be its position in the
+ *     sequence of records added.
+ */
+Serializer.Deserializer.prototype.add = function(jsonObj) {
+  var id = ('#' in jsonObj) ? jsonObj['#'] : this.count_;
+  this.count_++;
+  if (typeof id !== 'number' || id < 0 || id % 1) {
+    throw new TypeError('Record has no valid ID: ' + JSON.stringify(id));
+  } else if (this.objectList_[id]) {
+    throw new RangeError('Duplicate record for object ' + id);
+  }
+  var obj;
+  if (id === 0 && !this.partial_) {
+    // Stub constructors rely on the interpreter's existing state, so
+    // leave the interpreter proper unpopulated until the end.
+    obj = this.intrp_;
+    this.interpreterRecord_ = jsonObj;
+  } else {
+    obj = this.createStub_(jsonObj);
+    this.populate_(obj, jsonObj);
+  }
+  this.created_(id, obj);
+};
+
+/**
+ * Supply an existing object to be used for a given ID, in place of a
+ * record.  Only for partial deserializations.
+ * @param {number} id ID by which records refer to the object.
+ * @param {!Object} obj The object.
+ */
+Serializer.Deserializer.prototype.provide = function(id, obj) {
+  if (!this.partial_) {
+    throw new Error('Objects can only be provided to a partial deserializer');
+  } else if (this.objectList_[id]) {
+    throw new RangeError('Duplicate record for object ' + id);
+  }
+  this.created_(id, obj);
+};
+
+/**
+ * Get the object created (or provided) for a given ID.
+ * @param {number} id ID of the object.
+ * @return {!Object|undefined} The object, or undefined if there is none.
+ */
+Serializer.Deserializer.prototype.get = function(id) {
+  return this.objectList_[id];
+};
+
+/**
+ * Record that the object with the given ID exists, and fill in any
+ * references to it.
+ * @private
+ * @param {number} id ID of the object.
+ * @param {!Object} obj The object.
+ */
+Serializer.Deserializer.prototype.created_ = function(id, obj) {
+  this.objectList_[id] = obj;
+  var callbacks = this.pending_.get(id);
+  if (callbacks) {
+    this.pending_.delete(id);
+    for (var i = 0; i < callbacks.length; i++) {
+      callbacks[i](obj);
     }
-    objectList[i] = obj;
   }
-  // Second pass: Populate properties for every object.
-  for (var i = 0; i < json.length; i++) {
-    var jsonObj = json[i];
-    var tag = jsonObj['type'];
-    var typeInfo = config.byTag[tag];
-    var obj = objectList[i];
-    // Set prototype, if specified.
-    if (jsonObj['proto']) {
-      Object.setPrototypeOf(obj, decodeValue(jsonObj['proto']));
+};
+
+/**
+ * Complete deserialization, once all records have been added.
+ */
+Serializer.Deserializer.prototype.finish = function() {
+  for (var i = this.partial_ ? 1 : 0; i < this.objectList_.length; i++) {
+    if (!this.objectList_[i]) {
+      throw new ReferenceError('Missing record for object ' + i);
     }
-    // Repopulate properties.
-    var prune = (typeInfo && typeInfo.prune) || [];
-    var props = jsonObj['props'];
-    if (props) {
-      var nonConfigurable = jsonObj['nonConfigurable'] || [];
-      var nonEnumerable = jsonObj['nonEnumerable'] || [];
-      var nonWritable = jsonObj['nonWritable'] || [];
-      var keys = Object.getOwnPropertyNames(props);
-      for (var j = 0; j < keys.length; j++) {
-        var key = keys[j];
-        if (prune.includes(key)) continue;
-        Object.defineProperty(obj, key,
-            {configurable: !nonConfigurable.includes(key),
-             enumerable: !nonEnumerable.includes(key),
-             writable: !nonWritable.includes(key),
-             value: decodeValue(props[key])});
+  }
+  this.complete_();
+};
+
+/**
+ * Complete deserialization, once all the objects needed have been
+ * created: populate the interpreter proper and do the deferred work.
+ * @private
+ */
+Serializer.Deserializer.prototype.complete_ = function() {
+  if (this.pending_.size) {
+    throw new ReferenceError('Object reference not found: ' +
+        this.pending_.keys().next().value);
+  }
+  if (this.interpreterRecord_) {
+    this.populate_(this.intrp_, this.interpreterRecord_);
+    this.interpreterRecord_ = null;
+  }
+  this.runDeferred_();
+  // Finally: fixup interpreter state, post-deserialization.
+  if (!this.partial_) this.intrp_.postDeserialize();
+};
+
+/**
+ * Do the work deferred until all objects have been created.
+ * @private
+ */
+Serializer.Deserializer.prototype.runDeferred_ = function() {
+  for (var i = 0; i < this.deferred_.length; i++) {
+    this.deferred_[i]();
+  }
+  this.deferred_.length = 0;
+};
+
+/**
+ * Create a stub for the object described by a record.
+ * @private
+ * @param {!Object} jsonObj JSON-compatible record.
+ * @return {!Object} The new (unpopulated) object.
+ */
+Serializer.Deserializer.prototype.createStub_ = function(jsonObj) {
+  var tag = jsonObj['type'];
+  // Default case handles most types; sepcial cases handle only
+  // those that can't be correctly created by an unparameterized
+  // construction "new Constructor()".
+  switch (tag) {
+    case 'Function':
+      var func = this.functionHash_[jsonObj['id']];
+      if (!func) {
+        throw new RangeError('Function ID not found: ' + jsonObj['id']);
+      }
+      return func;
+    case 'Date':
+      var date = new Date(jsonObj['data']);
+      if (isNaN(date)) {
+        throw new TypeError('Invalid date: ' + jsonObj['data']);
       }
+      return date;
+    case 'RegExp':
+      return RegExp(jsonObj['source'], jsonObj['flags']);
+    case 'Buffer':
+      return Buffer.from(jsonObj['data'], 'base64');
+    case 'State':
+      // TODO(cpcallen): this is just a little performance kludge so
+      // that the State constructor doesn't need a conditional in it.
+      // Find a more general solution to constructors requiring args.
+      return new Interpreter.State(/** @type {?} */({}),
+          /** @type {?} */(undefined));
+    default:
+      if (this.config_.byTag[tag]) {
+        return new this.config_.byTag[tag].constructor();
+      }
+      throw new TypeError('Unknown type tag "' + tag + '"');
+  }
+};
+
+/**
+ * Populate an object from its record.
+ * @private
+ * @param {!Object} obj The object to populate.
+ * @param {!Object} jsonObj JSON-compatible record.
+ */
+Serializer.Deserializer.prototype.populate_ = function(obj, jsonObj) {
+  var self = this;
+  var typeInfo = this.config_.byTag[jsonObj['type']];
+  // Set prototype, if specified.  (N.B. may be null.)
+  var proto = jsonObj['proto'];
+  if (proto !== undefined) {
+    if (this.isUnresolved_(proto)) {
+      this.whenCreated_(proto['#'], function(proto) {
+        Object.setPrototypeOf(obj, proto);
+      });
+    } else {
+      Object.setPrototypeOf(obj, this.decodeResolved_(proto));
     }
-    // Repopulate sets.
-    if (obj instanceof Set || obj instanceof IterableWeakSet) {
-      var data = jsonObj['data'];
-      if (data) {
+  }
+  // Repopulate properties.
+  var prune = (typeInfo && typeInfo.prune) || [];
+  var props = jsonObj['props'];
+  if (props) {
+    var nonConfigurable = jsonObj['nonConfigurable'] || [];
+    var nonEnumerable = jsonObj['nonEnumerable'] || [];
+    var nonWritable = jsonObj['nonWritable'] || [];
+    var keys = Object.getOwnPropertyNames(props);
+    for (var j = 0; j < keys.length; j++) {
+      var key = keys[j];
+      if (prune.includes(key)) continue;
+      var value = props[key];
+      var pd = {configurable: !nonConfigurable.includes(key),
+                enumerable: !nonEnumerable.includes(key),
+                writable: !nonWritable.includes(key),
+                value: undefined};
+      if (this.isUnresolved_(value)) {
+        // Define property now (so as to preserve key order), and again
+        // with the correct value once known.
+        Object.defineProperty(obj, key, {configurable: true,
+            enumerable: pd.enumerable, writable: true, value: undefined});
+        this.whenCreated_(value['#'], function(key, pd, value) {
+          pd.value = value;
+          Object.defineProperty(obj, key, pd);
+        }.bind(null, key, pd));
+      } else {
+        pd.value = this.decodeResolved_(value);
+        Object.defineProperty(obj, key, pd);
+      }
+    }
+  }
+  // Repopulate sets.
+  if (obj instanceof Set || obj instanceof IterableWeakSet) {
+    var data = jsonObj['data'];
+    if (data) {
+      this.deferred_.push(function() {
         for (var j = 0; j < data.length; j++) {
-          obj.add(decodeValue(data[j]));
+          obj.add(self.decodeResolved_(data[j]));
         }
-      }
+      });
     }
-    // Repopulate maps.
-    if (obj instanceof Map || obj instanceof IterableWeakMap) {
-      var entries = jsonObj['entries'];
-      if (entries) {
+  }
+  // Repopulate maps.
+  if (obj instanceof Map || obj instanceof IterableWeakMap) {
+    var entries = jsonObj['entries'];
+    if (entries) {
+      this.deferred_.push(function() {
         for (var j = 0; j < entries.length; j++) {
-          var key = decodeValue(entries[j][0]);
-          var value = decodeValue(entries[j][1]);
+          var key = self.decodeResolved_(entries[j][0]);
+          var value = self.decodeResolved_(entries[j][1]);
           obj.set(key, value);
         }
-      }
+      });
     }
-    if (jsonObj['isExtensible'] === false) {  // N.B. normally omitted if true.
+  }
+  if (jsonObj['isExtensible'] === false) {  // N.B. normally omitted if true.
+    this.deferred_.push(function() {
       Object.preventExtensions(obj);
+    });
+  }
+};
+
+/**
+ * Is value a reference to an object that has not been created yet?
+ * @private
+ * @param {*} value JSON-compatible encoded value.
+ * @return {boolean}
+ */
+Serializer.Deserializer.prototype.isUnresolved_ = function(value) {
+  return Boolean(value && typeof value === 'object' && value['#'] &&
+                 !this.objectList_[value['#']]);
+};
+
+/**
+ * Arrange for a callback to be called once a given object is created.
+ * @private
+ * @param {number} id ID of the object.
+ * @param {function(!Object)} callback Callback to receive the object.
+ */
+Serializer.Deserializer.prototype.whenCreated_ = function(id, callback) {
+  var callbacks = this.pending_.get(id);
+  if (!callbacks) {
+    callbacks = [];
+    this.pending_.set(id, callbacks);
+  }
+  callbacks.push(callback);
+};
+
+/**
+ * Decode a value, once all objects have been created.
+ * @private
+ * @param {*} value JSON-compatible encoded value.
+ * @return {*} Decoded value.
+ */
+Serializer.Deserializer.prototype.decodeResolved_ = function(value) {
+  if (value && typeof value === 'object') {
+    var data;
+    if ((data = value['#'])) {
+      // Object reference: {'#': 42}
+      value = this.objectList_[data];
+      if (!value) {
+        throw new ReferenceError('Object reference not found: ' + data);
+      }
+      return value;
+    }
+    if ((data = value['Number'])) {
+      // Special number: {'Number': 'Infinity'}
+      return Number(data);
+    }
+    if ((data = value['Value'])) {
+      // Special value: {'Value': 'undefined'}
+      if (value['Value'] === 'undefined') {
+        return undefined;
+      }
     }
   }
-  // Finally: fixup interpreter state, post-deserialization.
-  intrp.postDeserialize();
+  return value;
+};
+
+/**
+ * A checker for the integrity of a serialization, which (like
+ * Serializer.Deserializer) accepts records one at a time in any
+ * order, but only records problems rather than creating objects.
+ *
+ * Checks that every record has a valid, unique ID and a known type;
+ * that there are no gaps in the sequence of IDs; that every object
+ * reference refers to a record that exists; and that no chain of
+ * prototypes (either of user-visible objects, or of the underlying
+ * JavaScript objects) is circular.
+ * @constructor
+ * @struct
+ * @param {!Interpreter} intrp JS-Interpreter instance (needed only
+ *     to determine which types exist).
+ */
+Serializer.Verifier = function(intrp) {
+  /** @private @const {!Config} */
+  this.config_ = Serializer.getConfig_(intrp);
+  /** @private @const {!Interpreter} */
+  this.intrp_ = intrp;
+  /** @private @const {!Array<boolean>} Which IDs have records. */
+  this.seen_ = [];
+  /**
+   * Map from referenced ID to the ID of (one of) the referring objects.
+   * @private @const {!Map<number,number>}
+   */
+  this.references_ = new Map();
+  /** @private @const {!Map<number,number>} Map from ID to prototype's ID. */
+  this.protos_ = new Map();
+  /** @type {number} Number of records added. */
+  this.count = 0;
+  /** @type {!Array<string>} Descriptions of problems found. */
+  this.problems = [];
 };
 
 /**
- * Serialize the provided interpreter.
+ * Maximum number of problems of each kind to describe individually.
+ * @private @const {number}
+ */
+Serializer.Verifier.MAX_PROBLEMS_ = 10;
+
+/**
+ * Check one record.
+ * @param {!Object} jsonObj JSON-compatible record.  If it has no '#'
+ *     property then its ID is taken to be its position in the
+ *     sequence of records added.
+ */
+Serializer.Verifier.prototype.add = function(jsonObj) {
+  var id = ('#' in jsonObj) ? jsonObj['#'] : this.count;
+  this.count++;
+  if (typeof id !== 'number' || id < 0 || id % 1) {
+    this.problems.push('Record has no valid ID: ' + JSON.stringify(id));
+    return;
+  } else if (this.seen_[id]) {
+    this.problems.push('Duplicate record for object ' + id);
+    return;
+  }
+  this.seen_[id] = true;
+  var tag = jsonObj['type'];
+  var typeInfo = this.config_.byTag[tag];
+  if (!typeInfo && tag !== 'Function' && tag !== 'Date' && tag !== 'RegExp' &&
+      tag !== 'Buffer') {
+    this.problems.push('Unknown type tag "' + tag + '" for object ' + id);
+  }
+  // Record all references, and the prototype link.
+  Serializer.forEachReference_(jsonObj, function(ref) {
+    if (!this.references_.has(ref)) this.references_.set(ref, id);
+  }, this);
+  var props = jsonObj['props'];
+  var proto = jsonObj['proto'];
+  // User-visible objects' prototypes are in .proto.
+  if (Serializer.isUserVisible_(typeInfo, this.intrp_)) {
+    proto = props && props['proto'];
+  }
+  if (Serializer.Verifier.isReference_(proto)) {
+    this.protos_.set(id, proto['#']);
+  }
+};
+
+/**
+ * Complete checking, once all records have been added.
+ * @return {!Array<string>} Descriptions of problems found (as .problems).
+ */
+Serializer.Verifier.prototype.finish = function() {
+  var max = Serializer.Verifier.MAX_PROBLEMS_;
+  var report = function(problems, what) {
+    for (var i = 0; i < problems.length && i < max; i++) {
+      this.problems.push(problems[i]);
+    }
+    if (problems.length > max) {
+      this.problems.push('... and ' + (problems.length - max) + ' more ' +
+          what);
+    }
+  }.bind(this);
+  // Gaps in the sequence of IDs.
+  var missing = [];
+  for (var i = 0; i < this.seen_.length; i++) {
+    if (!this.seen_[i]) missing.push('Missing record for object ' + i);
+  }
+  report(missing, 'missing records');
+  // Dangling references.
+  var dangling = [];
+  this.references_.forEach(function(from, id) {
+    if (!this.seen_[id]) {
+      dangling.push('Object reference not found: ' + id + ' (from object ' +
+          from + ')');
+    }
+  }, this);
+  report(dangling, 'dangling references');
+  // Prototype cycles.  Each chain is followed until it reaches an
+  // object already known to be acyclic, or one already visited on
+  // this chain.
+  var cycles = [];
+  var acyclic = new Set();
+  this.protos_.forEach(function(_, start) {
+    var chain = new Set();
+    for (var id = start; this.protos_.has(id) && !acyclic.has(id);
+         id = this.protos_.get(id)) {
+      if (chain.has(id)) {
+        cycles.push('Prototype cycle includes object ' + id);
+        break;
+      }
+      chain.add(id);
+    }
+    chain.forEach(acyclic.add, acyclic);
+  }, this);
+  report(cycles, 'prototype cycles');
+  return this.problems;
+};
+
+/**
+ * Is value an object reference?
+ * @private
+ * @param {*} value JSON-compatible encoded value.
+ * @return {boolean}
+ */
+Serializer.Verifier.isReference_ = function(value) {
+  return Boolean(value && typeof value === 'object' &&
+                 typeof value['#'] === 'number');
+};
+
+/**
+ * Call a function with the ID of each object referred to by a record.
+ * @private
+ * @param {!Object} jsonObj JSON-compatible record.
+ * @param {function(this:T, number)} callback Function to call.
+ * @param {T=} thisArg Value of this for callback.
+ * @template T
+ */
+Serializer.forEachReference_ = function(jsonObj, callback, thisArg) {
+  var visit = function(value) {
+    if (Serializer.Verifier.isReference_(value)) {
+      callback.call(thisArg, value['#']);
+    }
+  };
+  var props = jsonObj['props'];
+  if (props) {
+    for (var key in props) {
+      visit(props[key]);
+    }
+  }
+  var data = jsonObj['data'];
+  if (Array.isArray(data)) data.forEach(visit);
+  var entries = jsonObj['entries'];
+  if (Array.isArray(entries)) {
+    for (var i = 0; i < entries.length; i++) {
+      visit(entries[i][0]);
+      visit(entries[i][1]);
+    }
+  }
+  visit(jsonObj['proto']);
+};
+
+/**
+ * Is a type that of user-visible objects (intrp.Object and subclasses)?
+ * @private
+ * @param {!TypeInfo|undefined} typeInfo The type.
  * @param {!Interpreter} intrp JS-Interpreter instance.
- * @return {!Object} JSON-compatible object.
+ * @return {boolean}
  */
-Serializer.serialize = function(intrp) {
-  // First: prepare interpreter for serialization.
-  intrp.preSerialize();
-  
-  function encodeValue(value) {
-    if (value && (typeof value === 'object' || typeof value === 'function')) {
-      var ref = objectRefs.get(value);
-      if (ref === undefined) {
-        console.log('>>>', value);
-        throw new RangeError('object not found in table');
+Serializer.isUserVisible_ = function(typeInfo, intrp) {
+  return Boolean(typeInfo && (typeInfo.constructor === intrp.Object ||
+      typeInfo.constructor.prototype instanceof intrp.Object));
+};
+
+/**
+ * A loader that deserializes an interpreter from a store of records
+ * (such as a Store.Log) lazily, so that the resident heap is only a
+ * cache over the store and the world can be larger than memory.
+ *
+ * The .properties objects of user-visible objects (which hold the
+ * bulk of the heap's contents) are each replaced by a Proxy, whose
+ * target is populated from the object's record when any operation is
+ * first performed on it (a fault); everything else is loaded as
+ * usual.  Those that are clean (their owner not having been modified
+ * since the last save) and have not been used for a while can later
+ * be evicted: emptied again, to be refaulted if they are used.
+ *
+ * Loading continues the series of incremental serializations that
+ * saved the records (.incremental); planning the next serialization in
+ * the series neither faults in nor counts as a use of any proxy.  The
+ * store must be updated with the records of each serialization, and
+ * the loader notified (by calling .saved), before any objects are
+ * evicted.  A full serialization loads everything.
+ * @constructor
+ * @struct
+ * @param {!Interpreter} intrp JS-Interpreter instance to deserialize into.
+ * @param {function(number): (!Object|undefined)} fetch Function to get
+ *     the current record for a given ID from the store.
+ * @param {number} nextId Lowest ID not used by any record in the store.
+ */
+Serializer.LazyLoader = function(intrp, fetch, nextId) {
+  /** @private @const {!Interpreter} */
+  this.intrp_ = intrp;
+  /** @private @const {function(number): (!Object|undefined)} */
+  this.fetch_ = fetch;
+  /** @private @const {!Serializer.Deserializer} */
+  this.deserializer_ = new Serializer.Deserializer(intrp);
+  /** @const {!Serializer.Incremental} State of the serialization series. */
+  this.incremental = new Serializer.Incremental();
+  this.incremental.loader = this;
+  /** @private @const {number} */
+  this.nextId_ = nextId;
+  /**
+   * Lazily-loaded objects, by proxy target.
+   * @private @const {!Map<!Object,!Serializer.LazyLoader.Entry_>}
+   */
+  this.byTarget_ = new Map();
+  /**
+   * Lazily-loaded objects, by proxy.
+   * @private @const {!Map<!Object,!Serializer.LazyLoader.Entry_>}
+   */
+  this.byProxy_ = new Map();
+  /**
+   * IDs of all objects loaded from (or saved to) the store.
+   * @private @const {!Map<!Object,number>}
+   */
+  this.ids_ = new Map();
+  /**
+   * Owners of the lazily-loaded objects not yet created, by ID.
+   * @private @const {!Map<number,!Interpreter.prototype.Object>}
+   */
+  this.lazyIds_ = new Map();
+  /** @private @const {!Array<number>} IDs of objects still to create. */
+  this.queue_ = [];
+  /** @private {number} Number of calls to evict so far. */
+  this.epoch_ = 0;
+  /** @type {number} Number of objects faulted in so far. */
+  this.faults = 0;
+  /** @type {number} Number of objects evicted so far. */
+  this.evictions = 0;
+
+  var loader = this;
+  /** @private @const {!Object} Handler for proxies. */
+  this.handler_ = {};
+  Serializer.LazyLoader.TRAPS_.forEach(function(trap) {
+    loader.handler_[trap] = function(target) {
+      loader.touch_(target);
+      return Reflect[trap].apply(null, arguments);
+    };
+  });
+};
+
+/**
+ * Bookkeeping for a single lazily-loaded object.
+ * @private
+ * @typedef {{id: number,
+ *            owner: !Interpreter.prototype.Object,
+ *            target: !Object,
+ *            proxy: !Object,
+ *            loaded: boolean,
+ *            used: number}}
+ */
+Serializer.LazyLoader.Entry_;
+
+/**
+ * Proxy traps, all of which fault in the target before performing
+ * the operation on it.
+ * @private @const {!Array<string>}
+ */
+Serializer.LazyLoader.TRAPS_ = ['defineProperty', 'deleteProperty', 'get',
+    'getOwnPropertyDescriptor', 'getPrototypeOf', 'has', 'isExtensible',
+    'ownKeys', 'preventExtensions', 'set', 'setPrototypeOf'];
+
+/**
+ * Load the interpreter proper and everything except the contents of
+ * the lazily-loaded objects, and prepare to save the next
+ * serialization in the series.
+ */
+Serializer.LazyLoader.prototype.load = function() {
+  var d = this.deserializer_;
+  this.queue_.push(0);
+  this.drain_();
+  if (!d.interpreterRecord_) {
+    throw new ReferenceError('Missing record for object 0');
+  }
+  d.complete_();
+  this.incremental.ids = new Map(this.ids_);
+  this.incremental.nextId = this.nextId_;
+  this.intrp_.dirtyObjects = new Set();
+};
+
+/**
+ * Update the loader once the serialization most recently planned
+ * for .incremental has been saved to the store.  (After a full
+ * serialization, in which objects are renumbered, this also forgets
+ * those objects that were not saved.)
+ * @param {boolean} full Was it a full serialization?
+ */
+Serializer.LazyLoader.prototype.saved = function(full) {
+  var ids = this.incremental.ids;
+  if (!ids) return;
+  var objectList = this.deserializer_.objectList_;
+  if (full) {
+    objectList.length = 0;
+    this.ids_.clear();
+  }
+  ids.forEach(function(id, obj) {
+    objectList[id] = obj;
+    this.ids_.set(obj, id);
+  }, this);
+  if (!full) return;
+  this.byProxy_.forEach(function(entry, proxy) {
+    var id = ids.get(proxy);
+    if (id === undefined) {
+      this.byProxy_.delete(proxy);
+      this.byTarget_.delete(entry.target);
+    } else {
+      entry.id = id;
+    }
+  }, this);
+};
+
+/**
+ * Evict the lazily-loaded objects that are clean and have not been
+ * used since the previous age calls to evict.
+ * @param {number} age Number of calls.
+ * @return {number} Number of objects evicted.
+ */
+Serializer.LazyLoader.prototype.evict = function(age) {
+  this.epoch_++;
+  var dirty = this.intrp_.dirtyObjects;
+  if (!dirty) return 0;  // Can't tell what's clean.
+  var count = 0;
+  this.byTarget_.forEach(function(entry, target) {
+    if (!entry.loaded || this.epoch_ - entry.used <= age ||
+        dirty.has(entry.owner) || !Object.isExtensible(target)) {
+      return;
+    }
+    var isArray = Array.isArray(target);
+    var keys = Object.getOwnPropertyNames(target);
+    for (var i = 0; i < keys.length; i++) {
+      if (isArray && keys[i] === 'length') continue;
+      if (!Object.getOwnPropertyDescriptor(target, keys[i]).configurable) {
+        return;  // Couldn't be emptied.
       }
-      return {'#': ref};
-    }
-    if (value === undefined) {
-      return {'Value': 'undefined'};
-    }
-    if (typeof value === 'number') {
-      if (value === Infinity) {
-        return {'Number': 'Infinity'};
-      } else if (value === -Infinity) {
-        return {'Number': '-Infinity'};
-      } else if (Number.isNaN(value)) {
-        return {'Number': 'NaN'};
-      } else if (Object.is(value, -0)) {
-        return {'Number': '-0'};
+    }
+    if (isArray) target.length = 0;
+    for (var i = 0; i < keys.length; i++) {
+      if (!isArray || keys[i] !== 'length') delete target[keys[i]];
+    }
+    entry.loaded = false;
+    count++;
+  }, this);
+  this.evictions += count;
+  return count;
+};
+
+/**
+ * Is obj one of the proxies for lazily-loaded objects?
+ * @private
+ * @param {!Object} obj Object to check.
+ * @return {boolean}
+ */
+Serializer.LazyLoader.prototype.isProxy_ = function(obj) {
+  return this.byProxy_.has(obj);
+};
+
+/**
+ * Get the object whose contents are those of obj, without using it:
+ * the target of a proxy that is loaded, or null for one that is not.
+ * @private
+ * @param {!Object} obj Object to check.
+ * @return {?Object}
+ */
+Serializer.LazyLoader.prototype.contents_ = function(obj) {
+  var entry = this.byProxy_.get(obj);
+  if (!entry) return obj;
+  return entry.loaded ? entry.target : null;
+};
+
+/**
+ * Is obj a proxy that is not loaded?
+ * @private
+ * @param {!Object} obj Object to check.
+ * @return {boolean}
+ */
+Serializer.LazyLoader.prototype.isUnloaded_ = function(obj) {
+  var entry = this.byProxy_.get(obj);
+  return Boolean(entry) && !entry.loaded;
+};
+
+/**
+ * Note that a proxy's target is being used, and fault it in if
+ * necessary.
+ * @private
+ * @param {!Object} target Proxy target.
+ */
+Serializer.LazyLoader.prototype.touch_ = function(target) {
+  var entry = /** @type {!Serializer.LazyLoader.Entry_} */(
+      this.byTarget_.get(target));
+  entry.used = this.epoch_;
+  if (entry.loaded) return;
+  var record = this.fetch_(entry.id);
+  if (!record) {
+    throw new ReferenceError('Missing record for object ' + entry.id);
+  }
+  var d = this.deserializer_;
+  entry.loaded = true;
+  d.populate_(target, record);
+  this.enqueue_(record);
+  this.drain_();
+  if (d.pending_.size) {
+    throw new ReferenceError('Object reference not found: ' +
+        d.pending_.keys().next().value);
+  }
+  d.runDeferred_();
+  this.faults++;
+};
+
+/**
+ * Queue the IDs of the objects referred to by a record, so that they
+ * will be created by drain_.
+ * @private
+ * @param {!Object} record JSON-compatible record.
+ */
+Serializer.LazyLoader.prototype.enqueue_ = function(record) {
+  Serializer.forEachReference_(record, function(id) {
+    if (!this.deserializer_.get(id)) this.queue_.push(id);
+  }, this);
+};
+
+/**
+ * Create the objects whose IDs are queued, and those they refer to,
+ * except the contents of lazily-loaded ones.
+ * @private
+ */
+Serializer.LazyLoader.prototype.drain_ = function() {
+  var d = this.deserializer_;
+  while (this.queue_.length) {
+    var id = this.queue_.pop();
+    if (d.get(id)) continue;
+    var obj;
+    var owner = this.lazyIds_.get(id);
+    if (owner) {
+      this.lazyIds_.delete(id);
+      var target = (owner instanceof this.intrp_.Array) ? [] : {};
+      obj = new Proxy(target, this.handler_);
+      var entry = {id: id, owner: owner, target: target, proxy: obj,
+                   loaded: false, used: this.epoch_};
+      this.byTarget_.set(target, entry);
+      this.byProxy_.set(obj, entry);
+      this.ids_.set(obj, id);
+      d.created_(id, obj);
+    } else {
+      var record = this.fetch_(id);
+      if (!record || record['#'] !== id) {
+        throw new ReferenceError('Missing record for object ' + id);
       }
+      d.add(record);
+      obj = /** @type {!Object} */(d.get(id));
+      this.ids_.set(obj, id);
+      var properties = record['props'] && record['props']['properties'];
+      if (Serializer.isUserVisible_(d.config_.byTag[record['type']],
+                                    this.intrp_) &&
+          Serializer.Verifier.isReference_(properties) &&
+          !d.get(properties['#'])) {
+        this.lazyIds_.set(properties['#'], obj);
+      }
+      this.enqueue_(record);
     }
-    return value;
   }
+};
 
+/**
+ * Serialize the provided interpreter.  The result is deterministic:
+ * records are in ID order, and IDs are assigned in the order in which
+ * objects are found by a traversal that depends only on the state of
+ * the interpreter (see Serializer.canonicalize).
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @param {function(!Object)=} emit If supplied, each record is passed
+ *     to this function as soon as it has been created, rather than
+ *     being accumulated in the returned array (which will be empty).
+ * @return {!Array<!Object>} JSON-compatible records.
+ */
+Serializer.serialize = function(intrp, emit) {
+  // First: prepare interpreter for serialization.
+  intrp.preSerialize();
   // Get configuration.
   var config = Serializer.getConfig_(intrp);
 
@@ -340,122 +1058,828 @@ Serializer.serialize = function(intrp) {
   }
   // Serialize every object.
   var json = [];
+  emit = emit || json.push.bind(json);
   for (var i = 0; i < objectList.length; i++) {
-    var jsonObj = Object.create(null);
-    json.push(jsonObj);
-    var obj = objectList[i];
-    // TODO: Add a flag on the '#' prop.  On for debugging, off for production.
-    if (true) {
-      jsonObj['#'] = i;
+    emit(Serializer.encodeObject_(objectList[i], i, objectRefs, config,
+                                  intrp));
+  }
+  return json;
+};
+
+/**
+ * Options for Serializer.serializePart.
+ *
+ * - external: function called for each object found; if it returns a
+ *   descriptor (any JSON-compatible value), the object is not
+ *   serialized, nor searched for further objects, but is instead
+ *   represented by an External record containing the descriptor.
+ * - omit: function called with each object and property key found;
+ *   if it returns true, the property's value is neither searched nor
+ *   serialized, but replaced by null.
+ * @typedef {{external: function(!Object): *,
+ *            omit: (function(!Object, string): boolean|undefined)}}
+ */
+Serializer.PartOptions;
+
+/**
+ * Serialize part of the provided interpreter's heap: the objects
+ * reachable from root, excluding those deemed external (and anything
+ * reachable only through them).  The result can be loaded into the
+ * same or another interpreter using a partial Serializer.Deserializer,
+ * if an object is provided for each External record.
+ * IDs start at 1 (which is root).
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @param {!Object} root Object from which to start.
+ * @param {!Serializer.PartOptions} options What to exclude.
+ * @param {function(!Object)=} emit As for Serializer.serialize.
+ * @return {!Array<!Object>} JSON-compatible records.
+ */
+Serializer.serializePart = function(intrp, root, options, emit) {
+  var config = Serializer.getConfig_(intrp);
+  var omit = function(obj, key) {
+    // A copy of a connected object is not connected.
+    if (obj instanceof intrp.Object && key === 'socket') return true;
+    return Boolean(options.omit && options.omit(obj, key));
+  };
+  // Find all objects, breadth first.
+  var /** !Map<!Object,number> */ objectRefs = new Map();
+  var /** !Array<!Object> */ objectList = [];
+  var /** !Map<!Object,*> */ externals = new Map();
+  var visit = function(value) {
+    if (!value || (typeof value !== 'object' && typeof value !== 'function') ||
+        objectRefs.has(value)) {
+      return;
     }
+    objectRefs.set(value, objectList.length + 1);
+    objectList.push(value);
+    var descriptor = options.external(value);
+    if (descriptor !== undefined) externals.set(value, descriptor);
+  };
+  visit(root);
+  externals.delete(root);  // Root is never external.
+  for (var i = 0; i < objectList.length; i++) {
+    var obj = objectList[i];
+    if (externals.has(obj) || typeof obj !== 'object') continue;
+    // Find what Serializer.encodeObject_ will refer to.
     var proto = Object.getPrototypeOf(obj);
     var typeInfo = config.byProto.get(proto);
-    // Default case handles most types; sepcial cases handle only
-    // those that have extra intenal slots.
-    switch (proto) {
-      case Function.prototype:
-        jsonObj['type'] = 'Function';
-        jsonObj['id'] = obj.id;
-        if (!obj.id) {
-          throw new Error('Native function has no ID: ' + obj);
-        }
-        continue;  // No need to index properties.
-      case Date.prototype:
-        jsonObj['type'] = 'Date';
-        jsonObj['data'] = obj.toJSON();
-        continue;  // No need to index properties.
-      case RegExp.prototype:
-        jsonObj['type'] = 'RegExp';
-        jsonObj['source'] = obj.source;
-        jsonObj['flags'] = obj.flags;
-        continue;  // No need to index properties.
-      case Map.prototype:
-        jsonObj['type'] = 'Map';
-        if (obj.size) {
-          jsonObj['entries'] =
-              Array.from(/** @type {?} */(obj),function(entry) {
-                var key = encodeValue(entry[0]);
-                var value = encodeValue(entry[1]);
-                return [key, value];
-              });
-        }
-        break;
-      case Set.prototype:
-        jsonObj['type'] = 'Set';
-        if (obj.size) {
-          jsonObj['data'] = Array.from(obj.values(), encodeValue);
-        }
-        break;
-      case IterableWeakMap.prototype:
-        jsonObj['type'] = 'IterableWeakMap';
-        if (obj.size) {
-          jsonObj['entries'] =
-              Array.from(/** @type {?} */(obj), function(entry) {
-                var key = encodeValue(entry[0]);
-                var value = encodeValue(entry[1]);
-                return [key, value];
-              });
-        }
-        continue;  // Mustn't index internal properties for IterableWeakMap
-      case IterableWeakSet.prototype:
-        jsonObj['type'] = 'IterableWeakSet';
-        if (obj.size) {
-          jsonObj['data'] = Array.from(obj.values(), encodeValue);
-        }
-        continue;  // Mustn't index internal properties for IterableWeakSet
-      case Registry.prototype:
-        jsonObj['type'] = 'Registry';
-        break;
-      default:
-        if (typeInfo) {
-          jsonObj['type'] = typeInfo.tag;
-        } else {
-          jsonObj['type'] = Array.isArray(obj) ? 'Array' : 'Object';
-          jsonObj['proto'] = encodeValue(proto);
-        }
+    if (obj instanceof Set || obj instanceof IterableWeakSet) {
+      obj.forEach(visit);
+    }
+    if (obj instanceof Map || obj instanceof IterableWeakMap) {
+      obj.forEach(function(value, key) {
+        visit(key);
+        visit(value);
+      });
     }
-    var props = Object.create(null);
-    var nonConfigurable = [];
-    var nonEnumerable = [];
-    var nonWritable = [];
+    if (proto === Date.prototype || proto === RegExp.prototype ||
+        proto === Buffer.prototype ||
+        proto === IterableWeakMap.prototype ||
+        proto === IterableWeakSet.prototype) {
+      continue;  // Properties not encoded.
+    }
+    if (!typeInfo) visit(proto);
     var prune = (typeInfo && typeInfo.prune) || [];
     var keys = Object.getOwnPropertyNames(obj);
     for (var j = 0; j < keys.length; j++) {
       var key = keys[j];
-      if (prune.includes(key)) continue;
-      // Skip [[Socket]] slot on connected objects.
-      // TODO(cpcallen): this is pretty kludgy.  Try to find a better way.
-      if (obj instanceof intrp.Object && key === 'socket') continue;
-
-      props[key] = encodeValue(obj[key]);
-      var descriptor = Object.getOwnPropertyDescriptor(obj, key);
-      if (!descriptor.configurable) {
-        nonConfigurable.push(key);
+      if (prune.includes(key) || omit(obj, key)) continue;
+      visit(obj[key]);
+    }
+  }
+  // Serialize every object.
+  var json = [];
+  emit = emit || json.push.bind(json);
+  for (var i = 0; i < objectList.length; i++) {
+    var obj = objectList[i];
+    var id = i + 1;
+    if (externals.has(obj)) {
+      emit({'#': id, 'type': 'External', 'external': externals.get(obj)});
+      continue;
+    }
+    emit(Serializer.encodeObject_(obj, id, objectRefs, config, intrp, omit));
+  }
+  return json;
+};
+
+/**
+ * Build an index of the user-visible objects in the provided
+ * interpreter's heap, by owner.  The index is not maintained: it is
+ * built by searching the whole heap (loading any lazily-loaded
+ * objects), so it is out of date as soon as the heap is next changed.
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @return {!Map<?Interpreter.Owner,!Array<!Interpreter.prototype.Object>>}
+ *     Objects, by owner, each list in the order the objects were found
+ *     (as for Serializer.serialize).
+ */
+Serializer.indexByOwner = function(intrp) {
+  var objectList = Serializer.getObjectList_(intrp,
+                                             Serializer.getConfig_(intrp));
+  var /** !Map<?Interpreter.Owner,!Array<!Interpreter.prototype.Object>> */
+      index = new Map();
+  for (var i = 0; i < objectList.length; i++) {
+    var obj = objectList[i];
+    if (!(obj instanceof intrp.Object)) continue;
+    var owned = index.get(obj.owner);
+    if (!owned) {
+      owned = [];
+      index.set(obj.owner, owned);
+    }
+    owned.push(obj);
+  }
+  return index;
+};
+
+/**
+ * Bookkeeping for a series of incremental serializations of a single
+ * Interpreter instance.  The first serialization in a series is a
+ * full one; each subsequent one contains records only for those
+ * objects that are new or that might have been modified since the
+ * previous one.  Object IDs are stable for the duration of the
+ * series, so each serialization can be merged (using
+ * Serializer.merge) onto the result of merging its predecessors to
+ * reconstruct the complete state.
+ * @constructor
+ * @struct
+ */
+Serializer.Incremental = function() {
+  /**
+   * Map from object to ID, as of the most recent serialization, or
+   * null if the next serialization should be a full one.
+   * @type {?Map<!Object,number>}
+   */
+  this.ids = null;
+  /** @type {number} Lowest never-used ID. */
+  this.nextId = 0;
+  /**
+   * Loader whose lazily-loaded objects are part of the series, if any.
+   * @type {?Serializer.LazyLoader}
+   */
+  this.loader = null;
+};
+
+/**
+ * Start a new series: the next serialization will be a full one.
+ */
+Serializer.Incremental.prototype.reset = function() {
+  this.ids = null;
+  this.nextId = 0;
+};
+
+/**
+ * Incrementally serialize the provided interpreter.
+ *
+ * Which heap objects have changed is determined as follows:
+ *
+ * - User-visible objects (instances of intrp.Object and subclasses)
+ *   are considered changed if they appear in intrp.dirtyObjects.
+ *   Their internal satellite objects (.properties, .date, etc.)
+ *   are considered changed iff the object that owns them is.
+ * - Native functions, AST nodes, Sources and plain objects
+ *   belonging to AST nodes never change once created.
+ * - Everything else (Scopes, States, Threads, etc.) is assumed to be
+ *   changed every time.  These are normally a small fraction of the
+ *   total.
+ *
+ * Records are not emitted for objects that have become unreachable;
+ * they will persist in the merged serialization (harmlessly) until
+ * the next full serialization.
+ *
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @param {!Serializer.Incremental} inc State of the serialization series.
+ * @param {function(!Object)=} emit As for Serializer.serialize.
+ * @return {{full: boolean, json: !Array<!Object>}} JSON-compatible
+ *     records, and whether they are a full serialization.
+ */
+Serializer.serializeIncremental = function(intrp, inc, emit) {
+  var plan = Serializer.plan_(intrp, inc);
+  var json = [];
+  emit = emit || json.push.bind(json);
+  for (var i = 0; i < plan.objectList.length; i++) {
+    var obj = plan.objectList[i];
+    if (plan.isChanged(obj)) {
+      emit(Serializer.encodeObject_(obj, /** @type {number} */(
+          plan.ids.get(obj)), plan.ids, plan.config, intrp));
+    }
+  }
+  intrp.dirtyObjects = new Set();
+  return {full: plan.full, json: json};
+};
+
+/**
+ * The result of Serializer.plan_: what is to be serialized, and how.
+ * @private
+ * @typedef {{full: boolean,
+ *            config: !Config,
+ *            objectList: !Array<!Object>,
+ *            ids: !Map<!Object,number>,
+ *            owners: !Map<!Object,!Object>,
+ *            isChanged: function(!Object): boolean}}
+ */
+Serializer.Plan_;
+
+/**
+ * Find all objects to be serialized, assign them IDs, and determine
+ * which of them have changed since the previous serialization in the
+ * series (as described for Serializer.serializeIncremental).  Updates
+ * inc to record the IDs assigned.
+ * @private
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @param {!Serializer.Incremental} inc State of the serialization series.
+ * @return {!Serializer.Plan_}
+ */
+Serializer.plan_ = function(intrp, inc) {
+  // Start a new series if this is the first serialization, or if
+  // changes have not been tracked since the last one.
+  var dirty = intrp.dirtyObjects;
+  var full = !inc.ids || !dirty;
+  if (full) inc.reset();
+
+  intrp.preSerialize();
+  var config = Serializer.getConfig_(intrp);
+  var loader = inc.loader;
+  var isProxy = function(obj) {
+    return Boolean(loader) && loader.isProxy_(obj);
+  };
+  // Don't load lazily-loaded objects (nor mark them used) to find
+  // what they contain.  Those not loaded have not changed.
+  var objectList = Serializer.getObjectList_(intrp, config,
+      (loader && !full) ? loader.contents_.bind(loader) : undefined);
+  // Assign IDs, reusing those from the previous serialization.  (For a
+  // full serialization, IDs will be the same as Serializer.serialize
+  // would use: indices into objectList.)
+  var /** !Map<!Object,number> */ ids = new Map();
+  var /** !Set<!Object> */ added = new Set();
+  for (var i = 0; i < objectList.length; i++) {
+    var obj = objectList[i];
+    var id = inc.ids ? inc.ids.get(obj) : undefined;
+    if (id === undefined && loader && !full) {
+      // Perhaps previously only reachable via an unloaded object.
+      id = loader.ids_.get(obj);
+    }
+    if (id === undefined) {
+      id = inc.nextId++;
+      added.add(obj);
+    }
+    ids.set(obj, id);
+  }
+  inc.ids = ids;
+  // Find objects owned by user-visible objects or AST nodes.
+  var /** !Map<!Object,!Object> */ owners = new Map();
+  for (var i = 0; i < objectList.length; i++) {
+    var obj = objectList[i];
+    var fields;
+    if (isProxy(obj)) {
+      continue;  // Not an owner.  (N.B. instanceof would load it.)
+    } else if (obj instanceof intrp.Object) {
+      fields = Serializer.SATELLITES_;
+    } else if (obj instanceof Node) {
+      fields = Object.getOwnPropertyNames(obj);
+    } else {
+      continue;
+    }
+    for (var j = 0; j < fields.length; j++) {
+      var pd = Object.getOwnPropertyDescriptor(obj, fields[j]);
+      var value = pd && pd.value;
+      if (value && typeof value === 'object' && !owners.has(value) &&
+          (isProxy(value) || !(value instanceof intrp.Object))) {
+        owners.set(value, obj);
       }
-      if (!descriptor.enumerable) {
-        nonEnumerable.push(key);
+    }
+  }
+  var isChanged = function(obj) {
+    if (full || added.has(obj)) return true;
+    if (loader && loader.isUnloaded_(obj)) return false;
+    var owner = owners.get(obj) || obj;
+    if (owner instanceof intrp.Object) {
+      return dirty.has(owner);
+    } else if (owner instanceof Node || obj instanceof Interpreter.Source ||
+        typeof obj === 'function') {
+      return false;  // Immutable once created.
+    }
+    return true;
+  };
+  return {full: full, config: config, objectList: objectList, ids: ids,
+          owners: owners, isChanged: isChanged};
+};
+
+/**
+ * A snapshot of the state of an interpreter, taken at one instant but
+ * serialized gradually while the interpreter continues to run.
+ *
+ * Creating a snapshot briefly stops the world to find all objects
+ * and to serialize those that have no change tracking (Scopes,
+ * States, Threads, etc.; normally a small fraction of the total).
+ * The remainder are user-visible objects (instances of intrp.Object
+ * and their internal satellite objects) and immutable ones (AST
+ * nodes, etc.), which are serialized in the background by calling
+ * step.  Meanwhile, intrp.dirtyObjects is replaced by a write
+ * barrier that (it being notified before any user-visible object is
+ * modified) serializes the object first if that has not been done
+ * already, so that the records emitted reflect the state at the
+ * moment the snapshot was taken: copy-on-write.
+ *
+ * Records are emitted in no particular order.
+ * @constructor
+ * @struct
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @param {function(!Object)} emit Callback to receive each record.
+ * @param {?Serializer.Incremental=} inc State of the serialization
+ *     series, if this is (potentially) an incremental serialization.
+ */
+Serializer.Snapshot = function(intrp, emit, inc) {
+  var tracking = Boolean(inc);
+  var plan = Serializer.plan_(intrp, inc || new Serializer.Incremental());
+  /** @const {boolean} Is this a full (non-incremental) serialization? */
+  this.full = plan.full;
+  /** @private @const {!Interpreter} */
+  this.intrp_ = intrp;
+  /** @private @const {function(!Object)} */
+  this.emit_ = emit;
+  /** @private @const {!Serializer.Plan_} */
+  this.plan_ = plan;
+  /**
+   * Changed objects not yet serialized, in the order they will be (in
+   * the absence of intervening writes).
+   * @private @const {!Array<!Object>}
+   */
+  this.queue_ = [];
+  /** @private {number} Index of the next object in queue_. */
+  this.next_ = 0;
+  /**
+   * Objects in queue_ not yet serialized.
+   * @private @const {!Set<!Object>}
+   */
+  this.pending_ = new Set();
+  /** @private {*} Error thrown while serializing from the barrier. */
+  this.error_ = null;
+
+  for (var i = 0; i < plan.objectList.length; i++) {
+    var obj = plan.objectList[i];
+    if (!plan.isChanged(obj)) continue;
+    var owner = plan.owners.get(obj) || obj;
+    if (owner instanceof intrp.Object || owner instanceof Node ||
+        obj instanceof Interpreter.Source || typeof obj === 'function') {
+      this.queue_.push(obj);
+      this.pending_.add(obj);
+    } else {
+      this.serialize_(obj);
+    }
+  }
+  /** @private {?Serializer.Barrier_} */
+  this.barrier_ = new Serializer.Barrier_(this, tracking);
+  intrp.dirtyObjects = this.barrier_;
+};
+
+/**
+ * Serialize some (or all remaininig) objects.
+ * @param {number=} deadline Time (as returned by Date.now()) at which
+ *     to stop.  (Default: serialize everything.)
+ * @return {boolean} True iff the snapshot is now complete.
+ */
+Serializer.Snapshot.prototype.step = function(deadline) {
+  if (this.error_) {
+    this.abort();
+    throw this.error_;
+  }
+  var queue = this.queue_;
+  for (var n = 0; this.next_ < queue.length; n++) {
+    if (deadline !== undefined && n % 100 === 0 && Date.now() >= deadline) {
+      return false;
+    }
+    var obj = queue[this.next_++];
+    if (this.pending_.has(obj)) this.serialize_(obj);
+  }
+  this.abort();
+  return true;
+};
+
+/**
+ * Stop tracking writes, whether or not the snapshot is complete.
+ */
+Serializer.Snapshot.prototype.abort = function() {
+  if (!this.barrier_) return;
+  if (this.intrp_.dirtyObjects === this.barrier_) {
+    this.intrp_.dirtyObjects =
+        this.barrier_.tracking ? new Set(this.barrier_) : null;
+  }
+  this.barrier_.snapshot = null;
+  this.barrier_ = null;
+};
+
+/**
+ * Serialize an object that is about to be modified, if that has not
+ * been done yet, along with its satellite objects.
+ * @private
+ * @param {!Object} obj User-visible object about to be modified.
+ */
+Serializer.Snapshot.prototype.beforeWrite_ = function(obj) {
+  if (this.error_) return;
+  try {
+    if (this.pending_.has(obj)) this.serialize_(obj);
+    var owners = this.plan_.owners;
+    for (var i = 0; i < Serializer.SATELLITES_.length; i++) {
+      var satellite = obj[Serializer.SATELLITES_[i]];
+      if (satellite && this.pending_.has(satellite) &&
+          owners.get(satellite) === obj) {
+        this.serialize_(satellite);
       }
-      if (!descriptor.writable) {
-        nonWritable.push(key);
+    }
+  } catch (e) {
+    // Don't disrupt the running program; report at the next step.
+    this.error_ = e;
+  }
+};
+
+/**
+ * Serialize and emit a single object.
+ * @private
+ * @param {!Object} obj The object to serialize.
+ */
+Serializer.Snapshot.prototype.serialize_ = function(obj) {
+  this.pending_.delete(obj);
+  var plan = this.plan_;
+  this.emit_(Serializer.encodeObject_(obj, /** @type {number} */(
+      plan.ids.get(obj)), plan.ids, plan.config, this.intrp_));
+};
+
+/**
+ * The value of intrp.dirtyObjects while a Snapshot is in progress:
+ * it notifies the snapshot before each user-visible object is
+ * modified and (if changes were being tracked before the snapshot
+ * began) records which have been modified since.
+ * @private
+ */
+Serializer.Barrier_ = class extends Set {
+  /**
+   * @param {!Serializer.Snapshot} snapshot The snapshot to notify.
+   * @param {boolean} tracking Should modified objects be recorded?
+   */
+  constructor(snapshot, tracking) {
+    super();
+    /** @type {?Serializer.Snapshot} */
+    this.snapshot = snapshot;
+    /** @const {boolean} */
+    this.tracking = tracking;
+  }
+
+  /**
+   * @param {!Interpreter.prototype.Object} obj Object about to be modified.
+   * @return {THIS}
+   * @this {THIS}
+   * @template THIS
+   * @override
+   */
+  add(obj) {
+    if (this.snapshot) this.snapshot.beforeWrite_(obj);
+    return this.tracking ? super.add(obj) : this;
+  }
+};
+
+/**
+ * Names of the internal slots of user-visible objects which hold
+ * objects that should be considered part of the user-visible object
+ * for the purposes of change tracking.
+ * @private @const {!Array<string>}
+ */
+Serializer.SATELLITES_ =
+    ['properties', 'args', 'date', 'regexp', 'weakMap', 'data'];
+
+/**
+ * Merge the records from an incremental serialization into the
+ * records of the serialization(s) that preceded it.
+ * @param {!Array<!Object>} json Records to merge into (modified in place).
+ * @param {!Array<!Object>} delta Records to merge; each must have an ID.
+ */
+Serializer.merge = function(json, delta) {
+  for (var i = 0; i < delta.length; i++) {
+    var id = delta[i]['#'];
+    if (typeof id !== 'number' || id < 0 || id % 1) {
+      throw new TypeError('Record has no valid ID: ' + JSON.stringify(id));
+    }
+    json[id] = delta[i];
+  }
+};
+
+/**
+ * Put a serialization into canonical form: the form in which
+ * Serializer.serialize would have saved the same state.  Records are
+ * renumbered in the order in which the objects they describe are
+ * found by a canonical traversal starting from the interpreter proper
+ * (object #0), those that are not found (e.g., left over from earlier
+ * incremental serializations merged into this one) are dropped, and
+ * the remainder are returned in ID order.  So the canonical forms of
+ * two serializations of the same state are identical, regardless of
+ * how they were saved, and differences between two states can be
+ * found by comparing their canonical forms (e.g., using diff).
+ * @param {!Array<!Object>} json Records to canonicalize, in any order.
+ *     Records without an ID are identified by their position.
+ * @return {!Array<!Object>} Canonical records.
+ */
+Serializer.canonicalize = function(json) {
+  var /** !Array<!Object> */ byId = [];
+  for (var i = 0; i < json.length; i++) {
+    var id = ('#' in json[i]) ? json[i]['#'] : i;
+    if (typeof id !== 'number' || id < 0 || id % 1) {
+      throw new TypeError('Record has no valid ID: ' + JSON.stringify(id));
+    }
+    byId[id] = json[i];
+  }
+  // Traverse as getObjectList_ and objectHunt_ do, but via references
+  // in records rather than properties of objects.
+  var /** !Map<number,number> */ ids = new Map();  // Old ID -> new ID.
+  var /** !Array<!Object> */ order = [];  // Records, by new ID.
+  var /** !Array<!Object> */ weak = [];
+  var visit = function(value) {
+    if (!Serializer.Verifier.isReference_(value) || ids.has(value['#'])) {
+      return;
+    }
+    var record = byId[value['#']];
+    if (!record) {
+      throw new ReferenceError('Object reference not found: ' + value['#']);
+    }
+    ids.set(value['#'], order.length);
+    order.push(record);
+    var props = record['props'];
+    if (props) {
+      for (var key in props) {
+        visit(props[key]);
       }
     }
-    if (Object.getOwnPropertyNames(keys).length) {
-      jsonObj['props'] = props;
+    var type = record['type'];
+    if (type === 'IterableWeakMap' || type === 'IterableWeakSet') {
+      weak.push(record);
+      return;
+    }
+    if (Array.isArray(record['data'])) record['data'].forEach(visit);
+    var entries = record['entries'];
+    if (Array.isArray(entries)) {
+      for (var i = 0; i < entries.length; i++) {
+        visit(entries[i][0]);
+        visit(entries[i][1]);
+      }
     }
-    if (nonConfigurable.length) {
-      jsonObj['nonConfigurable'] = nonConfigurable;
+  };
+  // Order of the contents of a weak collection, as for weakEntries_.
+  var position = function(key) {
+    var id = Serializer.Verifier.isReference_(key) ?
+        ids.get(key['#']) : undefined;
+    return (id === undefined) ? Infinity : id;
+  };
+  var byPosition = function(a, b) {
+    var pa = position(a[0]);
+    var pb = position(b[0]);
+    return (pa === pb) ? 0 : (pa < pb) ? -1 : 1;
+  };
+  var weakEntries = function(record) {
+    return Array.isArray(record['entries']) ? record['entries'].slice() :
+        Array.isArray(record['data']) ?
+            record['data'].map(function(key) {return [key, undefined];}) : [];
+  };
+  visit({'#': 0});
+  // Prototypes are normally found via other references, so are only
+  // traversed if found no other way.
+  for (var w = 0, p = 0; w < weak.length || p < order.length; ) {
+    if (w < weak.length) {
+      var entries = weakEntries(weak[w++]).sort(byPosition);
+      for (var i = 0; i < entries.length; i++) {
+        visit(entries[i][0]);
+        visit(entries[i][1]);
+      }
+    } else {
+      visit(order[p++]['proto']);
     }
-    if (nonEnumerable.length) {
-      jsonObj['nonEnumerable'] = nonEnumerable;
+  }
+  // Renumber.
+  var renumber = function(value) {
+    return Serializer.Verifier.isReference_(value) ?
+        {'#': ids.get(value['#'])} : value;
+  };
+  return order.map(function(record, id) {
+    var copy = Object.create(null);
+    for (var key in record) {
+      var value = record[key];
+      if (key === '#') {
+        value = id;
+      } else if (key === 'proto') {
+        value = renumber(value);
+      } else if (key === 'props') {
+        value = Object.create(null);
+        for (var name in record['props']) {
+          value[name] = renumber(record['props'][name]);
+        }
+      } else if (key === 'data' && Array.isArray(value)) {
+        value = value.map(renumber);
+      } else if (key === 'entries' && Array.isArray(value)) {
+        value = value.map(function(entry) {
+          return [renumber(entry[0]), renumber(entry[1])];
+        });
+      }
+      copy[key] = value;
     }
-    if (nonWritable.length) {
-      jsonObj['nonWritable'] = nonWritable;
+    var type = record['type'];
+    if (type === 'IterableWeakMap' && copy['entries']) {
+      copy['entries'].sort(function(a, b) {
+        return a[0]['#'] - b[0]['#'];
+      });
+    } else if (type === 'IterableWeakSet' && copy['data']) {
+      copy['data'].sort(function(a, b) {
+        return a['#'] - b['#'];
+      });
+    }
+    return copy;
+  });
+};
+
+/**
+ * Encode a single value, replacing references to objects by their ID.
+ * @private
+ * @param {*} value The value to encode.
+ * @param {!Map<Object,number>} objectRefs Map of objects to IDs.
+ * @return {*} JSON-compatible value.
+ */
+Serializer.encodeValue_ = function(value, objectRefs) {
+  if (value && (typeof value === 'object' || typeof value === 'function')) {
+    var ref = objectRefs.get(value);
+    if (ref === undefined) {
+      console.log('>>>', value);
+      throw new RangeError('object not found in table');
     }
-    if (!Object.isExtensible(obj)) {
-      jsonObj['isExtensible'] = false;
+    return {'#': ref};
+  }
+  if (value === undefined) {
+    return {'Value': 'undefined'};
+  }
+  if (typeof value === 'number') {
+    if (value === Infinity) {
+      return {'Number': 'Infinity'};
+    } else if (value === -Infinity) {
+      return {'Number': '-Infinity'};
+    } else if (Number.isNaN(value)) {
+      return {'Number': 'NaN'};
+    } else if (Object.is(value, -0)) {
+      return {'Number': '-0'};
     }
   }
-  return json;
+  return value;
+};
+
+/**
+ * Encode a single object as a JSON-compatible record.
+ * @private
+ * @param {!Object} obj The object to encode.
+ * @param {number} id The ID of obj.
+ * @param {!Map<Object,number>} objectRefs Map of objects to IDs.
+ * @param {!Config} config Configuation object.
+ * @param {!Interpreter} intrp JS-Interpreter instance.
+ * @param {function(!Object, string): boolean=} omit Function to
+ *     determine which properties' values to replace by null.
+ * @return {!Object} JSON-compatible record.
+ */
+Serializer.encodeObject_ = function(
+    obj, id, objectRefs, config, intrp, omit) {
+  var encodeValue = function(value) {
+    return Serializer.encodeValue_(value, objectRefs);
+  };
+  var jsonObj = Object.create(null);
+  jsonObj['#'] = id;
+  var proto = Object.getPrototypeOf(obj);
+  var typeInfo = config.byProto.get(proto);
+  // Default case handles most types; sepcial cases handle only
+  // those that have extra intenal slots.
+  switch (proto) {
+    case Function.prototype:
+      jsonObj['type'] = 'Function';
+      jsonObj['id'] = obj.id;
+      if (!obj.id) {
+        throw new Error('Native function has no ID: ' + obj);
+      }
+      return jsonObj;  // No need to index properties.
+    case Date.prototype:
+      jsonObj['type'] = 'Date';
+      jsonObj['data'] = obj.toJSON();
+      return jsonObj;  // No need to index properties.
+    case RegExp.prototype:
+      jsonObj['type'] = 'RegExp';
+      jsonObj['source'] = obj.source;
+      jsonObj['flags'] = obj.flags;
+      return jsonObj;  // No need to index properties.
+    case Buffer.prototype:
+      jsonObj['type'] = 'Buffer';
+      jsonObj['data'] = obj.toString('base64');
+      return jsonObj;  // No need to index properties.
+    case Map.prototype:
+      jsonObj['type'] = 'Map';
+      if (obj.size) {
+        jsonObj['entries'] =
+            Array.from(/** @type {?} */(obj),function(entry) {
+              var key = encodeValue(entry[0]);
+              var value = encodeValue(entry[1]);
+              return [key, value];
+            });
+      }
+      break;
+    case Set.prototype:
+      jsonObj['type'] = 'Set';
+      if (obj.size) {
+        jsonObj['data'] = Array.from(obj.values(), encodeValue);
+      }
+      break;
+    case IterableWeakMap.prototype:
+      jsonObj['type'] = 'IterableWeakMap';
+      if (obj.size) {
+        // In order of key ID, for determinism; see getObjectList_.
+        jsonObj['entries'] = Serializer.weakEntries_(obj, objectRefs).map(
+            function(entry) {
+              var key = encodeValue(entry[0]);
+              var value = encodeValue(entry[1]);
+              return [key, value];
+            });
+      }
+      return jsonObj;  // Mustn't index internal properties for IterableWeakMap
+    case IterableWeakSet.prototype:
+      jsonObj['type'] = 'IterableWeakSet';
+      if (obj.size) {
+        jsonObj['data'] = Serializer.weakEntries_(obj, objectRefs).map(
+            function(entry) {
+              return encodeValue(entry[0]);
+            });
+      }
+      return jsonObj;  // Mustn't index internal properties for IterableWeakSet
+    case Registry.prototype:
+      jsonObj['type'] = 'Registry';
+      break;
+    default:
+      if (typeInfo) {
+        jsonObj['type'] = typeInfo.tag;
+      } else {
+        jsonObj['type'] = Array.isArray(obj) ? 'Array' : 'Object';
+        jsonObj['proto'] = encodeValue(proto);
+      }
+  }
+  var props = Object.create(null);
+  var nonConfigurable = [];
+  var nonEnumerable = [];
+  var nonWritable = [];
+  var prune = (typeInfo && typeInfo.prune) || [];
+  var keys = Object.getOwnPropertyNames(obj);
+  for (var j = 0; j < keys.length; j++) {
+    var key = keys[j];
+    if (prune.includes(key)) continue;
+
+    props[key] = (omit && omit(obj, key)) ? null : encodeValue(obj[key]);
+    var descriptor = Object.getOwnPropertyDescriptor(obj, key);
+    if (!descriptor.configurable) {
+      nonConfigurable.push(key);
+    }
+    if (!descriptor.enumerable) {
+      nonEnumerable.push(key);
+    }
+    if (!descriptor.writable) {
+      nonWritable.push(key);
+    }
+  }
+  if (Object.getOwnPropertyNames(keys).length) {
+    jsonObj['props'] = props;
+  }
+  if (nonConfigurable.length) {
+    jsonObj['nonConfigurable'] = nonConfigurable;
+  }
+  if (nonEnumerable.length) {
+    jsonObj['nonEnumerable'] = nonEnumerable;
+  }
+  if (nonWritable.length) {
+    jsonObj['nonWritable'] = nonWritable;
+  }
+  if (!Object.isExtensible(obj)) {
+    jsonObj['isExtensible'] = false;
+  }
+  return jsonObj;
+};
+
+/**
+ * Get the contents of an IterableWeakMap or IterableWeakSet, as [key,
+ * value] pairs (with undefined values, for a set), in order of the
+ * keys' positions.  Keys with no position come last, in the order
+ * they were added.
+ * @private
+ * @param {!IterableWeakMap|!IterableWeakSet} obj The collection.
+ * @param {!Map<?Object,number>} positions Positions (e.g., IDs) of keys.
+ * @return {!Array<!Array<*>>}
+ */
+Serializer.weakEntries_ = function(obj, positions) {
+  var entries = (obj instanceof IterableWeakSet) ?
+      Array.from(obj.values(), function(key) {return [key, undefined];}) :
+      Array.from(/** @type {?} */(obj));
+  var position = function(entry) {
+    var p = positions.get(entry[0]);
+    return (p === undefined) ? Infinity : p;
+  };
+  return entries.sort(function(a, b) {
+    var pa = position(a);
+    var pb = position(b);
+    return (pa === pb) ? 0 : (pa < pb) ? -1 : 1;
+  });
 };
 
 /**
@@ -466,11 +1890,25 @@ Serializer.serialize = function(intrp) {
  *     instead of numerical indices.
  * @param {*} node JavaScript value to search.
  * @param {!Config} config Configuation object.
+ * @param {function(!Object): ?Object=} unwrap Function giving the
+ *     object whose contents should be searched in place of a given
+ *     one, or null if none should be.
  * @return {!Array<!Object>} objectList Array of all objects found via node.
  */
-Serializer.getObjectList_ = function(node, config) {
-  var seen = new Set();
-  Serializer.objectHunt_(node, config, seen);
+Serializer.getObjectList_ = function(node, config, unwrap) {
+  var /** !Map<!Object,number> */ seen = new Map();
+  var /** !Array<!Object> */ weak = [];
+  Serializer.objectHunt_(node, config, seen, weak, unwrap);
+  // Search weak collections last, in order of their keys' positions,
+  // so that the order does not depend on the order in which entries
+  // were added (which is not observable).
+  for (var i = 0; i < weak.length; i++) {
+    var entries = Serializer.weakEntries_(weak[i], seen);
+    for (var j = 0; j < entries.length; j++) {
+      Serializer.objectHunt_(entries[j][0], config, seen, weak, unwrap);
+      Serializer.objectHunt_(entries[j][1], config, seen, weak, unwrap);
+    }
+  }
   return Array.from(seen.keys());
 };
 
@@ -479,17 +1917,26 @@ Serializer.getObjectList_ = function(node, config) {
  *
  * @param {*} node JavaScript value to search.
  * @param {!Config} config Configuation object.
- * @param {!Set<?Object>} seen Set of objects found so far.
+ * @param {!Map<!Object,number>} seen Objects found so far, and the
+ *     order in which they were found.
+ * @param {!Array<!Object>} weak IterableWeakMaps and IterableWeakSets
+ *     found so far, whose contents are yet to be searched.
+ * @param {function(!Object): ?Object=} unwrap As for getObjectList_.
  */
-Serializer.objectHunt_ = function(node, config, seen) {
+Serializer.objectHunt_ = function(node, config, seen, weak, unwrap) {
   if (!node || (typeof node !== 'object' && typeof node !== 'function')) {
     // node is primitive.  Nothing to do.
     return;
   }
-  var obj = /** @type {!Object} */(node);
-  if (seen.has(obj)) return;
+  var found = /** @type {!Object} */(node);
+  if (seen.has(found)) return;
+  var obj = unwrap ? unwrap(found) : found;
+  if (!obj) {
+    seen.set(found, seen.size);
+    return;
+  }
   var proto = Object.getPrototypeOf(obj);
-  seen.add(obj);
+  seen.set(found, seen.size);
   if (typeof obj === 'object') {  // Recurse.
     var typeInfo = config.byProto.get(proto);
     var prune = (typeInfo && typeInfo.prune) || [];
@@ -498,21 +1945,25 @@ Serializer.objectHunt_ = function(node, config, seen) {
     for (var i = 0; i < keys.length; i++) {
       var key = keys[i];
       if (prune.includes(key)) continue;
-      Serializer.objectHunt_(obj[key], config, seen);
+      Serializer.objectHunt_(obj[key], config, seen, weak, unwrap);
     }
     // Set members.
-    if (obj instanceof Set || obj instanceof IterableWeakSet) {
+    if (obj instanceof Set) {
       obj.forEach(function(value) {
-        Serializer.objectHunt_(value, config, seen);
+        Serializer.objectHunt_(value, config, seen, weak, unwrap);
       });
     }
     // Map entries.
-    if (obj instanceof Map || obj instanceof IterableWeakMap) {
+    if (obj instanceof Map) {
       obj.forEach(function(value, key) {
-        Serializer.objectHunt_(key, config, seen);
-        Serializer.objectHunt_(value, config, seen);
+        Serializer.objectHunt_(key, config, seen, weak, unwrap);
+        Serializer.objectHunt_(value, config, seen, weak, unwrap);
       });
     }
+    // Weak collections' contents are searched later.
+    if (obj instanceof IterableWeakSet || obj instanceof IterableWeakMap) {
+      weak.push(obj);
+    }
   }
 };
 
@@ -0,0 +1,315 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Sessions that survive clients reconnecting.
+ *
+ * A Sessions.Session stands in for a client's connection, and is
+ * identified by a secret token given to the client.  If the connection
+ * is lost (other than by the session being ended), the session waits
+ * for up to its grace period for the client to reconnect and present
+ * the token, keeping any data written meanwhile.  If the client does
+ * so, the new connection takes the place of the old one and the kept
+ * data is sent on it; if not, the session ends just as the connection
+ * would have.
+ */
+'use strict';
+
+var crypto = require('crypto');
+var events = require('events');
+var util = require('util');
+
+var Sessions = {};
+
+/**
+ * Length of session tokens, in bytes (before hex encoding).
+ * @const {number}
+ */
+Sessions.TOKEN_BYTES = 16;
+
+/**
+ * Maximum amount (in characters) of data kept for a client that has
+ * yet to reconnect.  If more is written the session is ended.
+ * @const {number}
+ */
+Sessions.MAX_BUFFERED = 1024 * 1024;
+
+/**
+ * A connection that can be used by a Session: a WebSocket.Connection,
+ * net.Socket or the like.
+ * @typedef {!events.EventEmitter}
+ */
+Sessions.Connection;
+
+/**
+ * Create a new random session token.
+ * @return {string} The token (in hex).
+ */
+Sessions.newToken = function() {
+  return crypto.randomBytes(Sessions.TOKEN_BYTES).toString('hex');
+};
+
+/**
+ * A collection of sessions, by token.
+ * @constructor
+ * @struct
+ */
+Sessions.Registry = function() {
+  /** @private @const {!Map<string, !Sessions.Session>} */
+  this.sessions_ = new Map();
+};
+
+/**
+ * Create a new session, which will be forgotten once it has ended.
+ * @param {!Sessions.Connection} connection The client's connection.
+ * @param {string} token The session's token (from Sessions.newToken).
+ * @param {number} grace Time (in ms) to wait for the client to
+ *     reconnect if the connection is lost.
+ * @param {string=} identity Identity (e.g., login ID) of the client,
+ *     which must match when it reconnects.
+ * @return {!Sessions.Session}
+ */
+Sessions.Registry.prototype.create = function(connection, token, grace,
+                                              identity) {
+  if (this.sessions_.has(token)) throw new Error('Duplicate session token');
+  var session = new Sessions.Session(connection, token, grace, identity);
+  this.sessions_.set(token, session);
+  var sessions = this.sessions_;
+  session.on('close', function() {
+    sessions.delete(token);
+  });
+  return session;
+};
+
+/**
+ * Find a session awaiting the reconnection of its client.
+ * @param {string|undefined} token The token presented by the client.
+ * @param {string=} identity Identity of the client.
+ * @return {?Sessions.Session} The session, or null if there is no
+ *     session with that token and identity which has lost its
+ *     connection.
+ */
+Sessions.Registry.prototype.find = function(token, identity) {
+  var session = (token === undefined) ? undefined : this.sessions_.get(token);
+  if (!session || session.identity !== identity || session.isConnected()) {
+    return null;
+  }
+  return session;
+};
+
+/**
+ * Number of sessions that have not yet ended.
+ * @type {number}
+ */
+Object.defineProperty(Sessions.Registry.prototype, 'size', {
+  get: function() {
+    return this.sessions_.size;
+  }
+});
+
+/**
+ * A session.  Data written is sent to the client's current connection
+ * (or kept until it has one), and data received on any of its
+ * connections is emitted as 'data' events.  Emits 'end' and 'close'
+ * events when the session ends (whether because the session was ended,
+ * or the client did not reconnect in time), 'detach' when the
+ * connection is lost and 'resume' when the client reconnects.
+ * @constructor
+ * @extends {events.EventEmitter}
+ * @param {!Sessions.Connection} connection The client's connection.
+ * @param {string} token The session's token.
+ * @param {number} grace Time (in ms) to wait for the client to
+ *     reconnect.
+ * @param {string=} identity Identity of the client.
+ */
+Sessions.Session = function(connection, token, grace, identity) {
+  events.EventEmitter.call(this);
+  /** @const {string} */
+  this.token = token;
+  /** @const {number} */
+  this.grace = grace;
+  /** @const {string|undefined} */
+  this.identity = identity;
+  /** @type {string|undefined} Address of the client's connection. */
+  this.remoteAddress = undefined;
+  /** @type {number|undefined} */
+  this.remotePort = undefined;
+  /**
+   * @type {boolean} Does the client's (current or most recent)
+   *     connection accept binary messages?
+   */
+  this.binary = false;
+  /** @private @type {?Sessions.Connection} */
+  this.connection_ = null;
+  /**
+   * @private @type {!Array<string|!Buffer>} Data written while
+   *     detached.
+   */
+  this.buffer_ = [];
+  /** @private @type {number} Total length of buffer_. */
+  this.buffered_ = 0;
+  /** @private @type {boolean} Has .end been called? */
+  this.ending_ = false;
+  /** @private @type {boolean} Has 'close' been emitted? */
+  this.closed_ = false;
+  /** @private @type {?Timeout} Timer for end of grace period. */
+  this.timer_ = null;
+  this.attach_(connection);
+};
+util.inherits(Sessions.Session, events.EventEmitter);
+
+/**
+ * Is the client currently connected?
+ * @return {boolean}
+ */
+Sessions.Session.prototype.isConnected = function() {
+  return this.connection_ !== null;
+};
+
+/**
+ * Send data to the client, or keep it until the client reconnects.
+ * @param {string|!Buffer} data The data (text, or a binary message).
+ * @return {boolean} False if the caller should wait for a 'drain'
+ *     event before sending more.
+ */
+Sessions.Session.prototype.write = function(data) {
+  if (this.ending_) return true;  // Discarded, like a closed socket.
+  if (this.connection_) return this.connection_.write(data);
+  this.buffer_.push(data);
+  this.buffered_ += data.length;
+  if (this.buffered_ > Sessions.MAX_BUFFERED) {
+    this.buffer_ = [];
+    this.buffered_ = 0;
+    this.finish_(true);
+  }
+  return true;
+};
+
+/**
+ * End the session (closing the client's connection, if any).
+ */
+Sessions.Session.prototype.end = function() {
+  if (this.ending_) return;
+  this.ending_ = true;
+  if (this.connection_) {
+    this.connection_.end();
+  } else {
+    this.finish_(false);
+  }
+};
+
+/**
+ * Attach the session to a new connection from the client, sending it
+ * any data kept since the previous connection was lost.
+ * @param {!Sessions.Connection} connection The new connection.
+ * @param {*=} info Passed on with the 'resume' event (e.g., a
+ *     description of the new connection).
+ */
+Sessions.Session.prototype.resume = function(connection, info) {
+  if (this.connection_ || this.ending_) {
+    throw new Error('Session is not awaiting reconnection');
+  }
+  clearTimeout(this.timer_);
+  this.timer_ = null;
+  this.attach_(connection);
+  var buffer = this.buffer_;
+  this.buffer_ = [];
+  this.buffered_ = 0;
+  for (var i = 0; i < buffer.length; i++) {
+    // Binary messages are dropped if the client can no longer take them.
+    if (!Buffer.isBuffer(buffer[i]) || this.binary) connection.write(buffer[i]);
+  }
+  this.emit('resume', info);
+};
+
+/**
+ * Start using a connection.
+ * @private
+ * @param {!Sessions.Connection} connection The connection.
+ */
+Sessions.Session.prototype.attach_ = function(connection) {
+  var session = this;
+  this.connection_ = connection;
+  this.remoteAddress = connection.remoteAddress;
+  this.remotePort = connection.remotePort;
+  this.binary = Boolean(connection.binary);
+  // Events from a connection are ignored once it has been replaced.
+  var current = function() {
+    return session.connection_ === connection;
+  };
+  connection.on('data', function(data) {
+    if (current()) session.emit('data', data);
+  });
+  connection.on('drain', function() {
+    if (current()) session.emit('drain');
+  });
+  connection.on('end', function() {
+    if (current() && session.ending_) session.emit('end');
+  });
+  connection.on('error', function(error) {
+    if (!current()) return;
+    if (session.ending_) {
+      session.emit('error', error);
+    } else {
+      session.detach_();
+    }
+  });
+  connection.on('close', function() {
+    if (!current()) return;
+    if (session.ending_) {
+      session.connection_ = null;
+      session.finish_(false);
+    } else {
+      session.detach_();
+    }
+  });
+};
+
+/**
+ * Stop using the current connection (which has been lost), and wait
+ * for the client to reconnect.
+ * @private
+ */
+Sessions.Session.prototype.detach_ = function() {
+  var connection = this.connection_;
+  this.connection_ = null;
+  connection.destroy();
+  var session = this;
+  this.timer_ = setTimeout(function() {
+    session.timer_ = null;
+    session.finish_(true);
+  }, this.grace);
+  this.emit('detach');
+};
+
+/**
+ * End the session, emitting 'end' (if the client went away) and
+ * 'close'.
+ * @private
+ * @param {boolean} lost Did the client fail to reconnect?
+ */
+Sessions.Session.prototype.finish_ = function(lost) {
+  if (this.closed_) return;
+  this.closed_ = true;
+  this.ending_ = true;
+  clearTimeout(this.timer_);
+  this.timer_ = null;
+  if (lost) this.emit('end');
+  this.emit('close');
+};
+
+module.exports = Sessions;
@@ -0,0 +1,207 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Startup snapshots: the state of a world freshly
+ * created from a directory of startup files (core*.js, etc.), saved so
+ * that further worlds can be created from it in milliseconds, rather
+ * than by evaluating the startup files all over again.
+ *
+ * A snapshot is an ordinary binary checkpoint (never encrypted), made
+ * by mksnapshot and saved as startup.city alongside the startup files,
+ * preceded by a one-line header recording the serialization version
+ * and server version that made it:
+ *
+ *     CodeCity snapshot serialization=24 server=0.0.0
+ *
+ * It is used in place of the startup files only if it is at least as
+ * recent as every one of them, so that a startup file edited since the
+ * snapshot was made is not silently ignored, and only if it was made
+ * by the running versions, so that a server upgraded since (whose
+ * startup files might now evaluate differently) does not load a world
+ * made by its predecessor.  Otherwise the startup files are evaluated,
+ * and running mksnapshot again rebuilds the snapshot.
+ */
+'use strict';
+
+var Flatpack = require('./flatpack');
+var fs = require('fs');
+var Interpreter = require('./interpreter');
+var Logging = require('./logging');
+var Migrate = require('./migrate');
+var packageJson = require('./package.json');
+var path = require('path');
+var Serializer = require('./serialize');
+
+var Snapshot = {};
+
+/**
+ * Subsystem of the server log to which snapshots' use is written.
+ * @const {!Logging.Subsystem}
+ */
+var log = new Logging.Subsystem('snapshot');
+
+/**
+ * Name of the snapshot file in a directory of startup files.
+ * @const {string}
+ */
+Snapshot.FILENAME = 'startup.city';
+
+/**
+ * Beginning of the header of a snapshot.
+ * @private @const {string}
+ */
+Snapshot.MAGIC_ = 'CodeCity snapshot ';
+
+/**
+ * Maximum length of the header of a snapshot (including its newline).
+ * @private @const {number}
+ */
+Snapshot.MAX_HEADER_ = 256;
+
+/**
+ * Names of startup files.
+ * @const {!RegExp}
+ */
+Snapshot.STARTUP_FILES = /^(core|db|test).*\.js$/;
+
+/**
+ * List the startup files in a directory.
+ * @param {string} dir The directory.
+ * @return {!Array<string>} Their names, in the order to be loaded.
+ */
+Snapshot.startupFiles = function(dir) {
+  return fs.readdirSync(dir).filter(function(file) {
+    return Snapshot.STARTUP_FILES.test(file);
+  }).sort();
+};
+
+/**
+ * Find an up-to-date snapshot of the startup files in a directory.
+ * @param {string} dir The directory.
+ * @return {?string} The snapshot's filename, or null if there is no
+ *     snapshot, or if any startup file is more recent than it.
+ */
+Snapshot.find = function(dir) {
+  var filename = path.join(dir, Snapshot.FILENAME);
+  try {
+    var time = fs.statSync(filename).mtimeMs;
+  } catch (e) {
+    return null;
+  }
+  var files = Snapshot.startupFiles(dir);
+  for (var i = 0; i < files.length; i++) {
+    if (fs.statSync(path.join(dir, files[i])).mtimeMs > time) {
+      log.info('Ignoring snapshot %s: %s is more recent.', filename,
+               files[i]);
+      return null;
+    }
+  }
+  var header = Snapshot.readHeader_(filename);
+  if (header !== Snapshot.header_()) {
+    var magic = Snapshot.MAGIC_.length;
+    log.info('Ignoring snapshot %s: made by %s, not %s.', filename,
+             header === null ? 'an earlier version' : header.slice(magic),
+             Snapshot.header_().slice(magic));
+    return null;
+  }
+  return filename;
+};
+
+/**
+ * Get the header of snapshots made by this server: Snapshot.MAGIC_
+ * followed by the serialization and server versions.
+ * @private
+ * @return {string} The header, without its newline.
+ */
+Snapshot.header_ = function() {
+  return Snapshot.MAGIC_ +
+      'serialization=' + Interpreter.SERIALIZATION_VERSION +
+      ' server=' + packageJson.version;
+};
+
+/**
+ * Read the header of a snapshot file.
+ * @private
+ * @param {string} filename The snapshot's filename.
+ * @return {?string} The header, without its newline, or null if the
+ *     file has none (e.g., because it was made by an earlier version).
+ */
+Snapshot.readHeader_ = function(filename) {
+  var buffer = Buffer.alloc(Snapshot.MAX_HEADER_);
+  var fd = fs.openSync(filename, 'r');
+  try {
+    var length = fs.readSync(fd, buffer, 0, buffer.length, 0);
+  } finally {
+    fs.closeSync(fd);
+  }
+  return Snapshot.parseHeader_(buffer.subarray(0, length));
+};
+
+/**
+ * Find the header at the start of a snapshot.
+ * @private
+ * @param {!Buffer} data The snapshot (or its beginning).
+ * @return {?string} The header, without its newline, or null if there
+ *     is none.
+ */
+Snapshot.parseHeader_ = function(data) {
+  var end = data.indexOf('\n');
+  if (end === -1 || end >= Snapshot.MAX_HEADER_ ||
+      data.toString('latin1', 0, Snapshot.MAGIC_.length) !==
+          Snapshot.MAGIC_) {
+    return null;
+  }
+  return data.toString('latin1', 0, end);
+};
+
+/**
+ * Make a snapshot of an interpreter.  It should be paused (or stopped)
+ * first, so that its timers are saved correctly.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {!Envelope.Options=} options Compression to apply.
+ * @return {!Buffer} The snapshot.
+ */
+Snapshot.encode = function(intrp, options) {
+  return Buffer.concat([
+    Buffer.from(Snapshot.header_() + '\n', 'latin1'),
+    Flatpack.encode(Serializer.serialize(intrp), 'binary', options || {}),
+  ]);
+};
+
+/**
+ * Load a snapshot into an interpreter, migrating it first if it was
+ * made by an earlier version.  The interpreter keeps its own options,
+ * rather than those it was made with, and is left PAUSED, just as a
+ * newly-constructed one would be.
+ * @param {!Buffer} data The snapshot.
+ * @param {!Interpreter} intrp A newly-constructed interpreter.
+ */
+Snapshot.load = function(data, intrp) {
+  var header = Snapshot.parseHeader_(data);
+  if (header !== null) data = data.subarray(header.length + 1);
+  var options = intrp.options;
+  var deserializer = new Serializer.Deserializer(intrp);
+  var migrator = new Migrate.Migrator(deserializer.add.bind(deserializer));
+  Flatpack.decode(data).forEach(migrator.add, migrator);
+  migrator.finish();
+  deserializer.finish();
+  intrp.setOptions(options);
+  intrp.pause();
+};
+
+module.exports = Snapshot;
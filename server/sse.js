@@ -0,0 +1,143 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Server-sent events (the text/event-stream format
+ * read by web pages' EventSource objects), as specified by
+ * https://html.spec.whatwg.org/multipage/server-sent-events.html
+ *
+ * An SSE.Connection sends each string written to it as one message
+ * event, over the response to an HTTP request.  The stream is one-way:
+ * the client sends nothing after its request.
+ */
+'use strict';
+
+var events = require('events');
+var util = require('util');
+
+var SSE = {};
+
+/**
+ * Interval (in ms) at which a comment is sent on otherwise-idle
+ * streams, so that proxies (and clients) do not time them out.
+ * @const {number}
+ */
+SSE.HEARTBEAT_INTERVAL = 15 * 1000;
+
+/**
+ * Format a message event as it is sent in an event stream.
+ * @param {string} data The event's data.  May contain line breaks
+ *     (each line being sent as a separate data field), which the
+ *     client turns back into newlines.
+ * @return {string}
+ */
+SSE.formatEvent = function(data) {
+  var lines = data.split(/\r\n|\r|\n/);
+  var text = '';
+  for (var i = 0; i < lines.length; i++) {
+    text += 'data: ' + lines[i] + '\n';
+  }
+  return text + '\n';
+};
+
+/**
+ * An event stream, sent in response to an HTTP request.  Sends the
+ * response's headers, then emits 'drain', 'error', 'end' (if the
+ * client goes away before the stream is ended) and 'close' events,
+ * like a net.Socket (but never 'data').
+ * @constructor
+ * @extends {events.EventEmitter}
+ * @param {!http.IncomingMessage} req The request.
+ * @param {!http.ServerResponse} res The response.
+ * @param {!Object<string, string>=} headers Additional response
+ *     headers (e.g., for CORS).
+ */
+SSE.Connection = function(req, res, headers) {
+  events.EventEmitter.call(this);
+  /** @private @const {!http.ServerResponse} */
+  this.res_ = res;
+  /**
+   * Address of the client (which the owner may correct, if it is known
+   * to have connected via a proxy).
+   * @type {string|undefined}
+   */
+  this.remoteAddress = req.socket.remoteAddress;
+  /** @const {number|undefined} */
+  this.remotePort = req.socket.remotePort;
+  /** @private @type {boolean} Has .end been called? */
+  this.ended_ = false;
+
+  res.writeHead(200, Object.assign({
+    'Content-Type': 'text/event-stream; charset=utf-8',
+    'Cache-Control': 'no-cache',
+    // Ask nginx (and similar proxies) not to buffer the stream.
+    'X-Accel-Buffering': 'no',
+  }, headers));
+  res.flushHeaders();
+  if (res.socket) res.socket.setNoDelay(true);
+
+  var sse = this;
+  /** @private @type {?Timeout} */
+  this.heartbeat_ = setInterval(function() {
+    res.write(':\n\n');
+  }, SSE.HEARTBEAT_INTERVAL);
+  req.resume();  // Discard any request body.
+  res.on('drain', function() {
+    sse.emit('drain');
+  });
+  res.on('error', function(error) {
+    sse.emit('error', error);
+  });
+  res.on('close', function() {
+    clearInterval(sse.heartbeat_);
+    if (!sse.ended_) sse.emit('end');  // Client went away.
+    sse.emit('close');
+  });
+};
+util.inherits(SSE.Connection, events.EventEmitter);
+
+/**
+ * Send a message event.
+ * @param {string} data The event's data.
+ * @return {boolean} False if the caller should wait for a 'drain'
+ *     event before sending more.
+ */
+SSE.Connection.prototype.write = function(data) {
+  if (this.ended_) return true;  // Discarded, like a closed socket.
+  return this.res_.write(SSE.formatEvent(data));
+};
+
+/**
+ * End the stream.  N.B. that clients will normally reconnect, unless
+ * they are sent a 204 (No Content) response when they do.
+ */
+SSE.Connection.prototype.end = function() {
+  if (this.ended_) return;
+  this.ended_ = true;
+  clearInterval(this.heartbeat_);
+  this.res_.end();
+};
+
+/**
+ * Immediately close the underlying connection.
+ */
+SSE.Connection.prototype.destroy = function() {
+  this.ended_ = true;
+  this.res_.destroy();
+};
+
+module.exports = SSE;
@@ -33,11 +33,101 @@ CC.root = new 'CC.root';
 var perms = new 'perms';
 var setPerms = new 'setPerms';
 
+///////////////////////////////////////////////////////////////////////////////
+// Timing API.
+//
+CC.hrtime = new 'CC.hrtime';
+
+///////////////////////////////////////////////////////////////////////////////
+// Logging API.
+//
+CC.log = new 'CC.log';
+CC.logWrite = new 'CC.logWrite';
+CC.logChannel = new 'CC.logChannel';
+
 ///////////////////////////////////////////////////////////////////////////////
 // Networking API.
 //
 CC.connectionListen = new 'CC.connectionListen';
 CC.connectionUnlisten = new 'CC.connectionUnlisten';
+CC.connectionOpen = new 'CC.connectionOpen';
 CC.connectionWrite = new 'CC.connectionWrite';
+CC.connectionWriteBinary = new 'CC.connectionWriteBinary';
 CC.connectionClose = new 'CC.connectionClose';
+CC.connectionSetIdle = new 'CC.connectionSetIdle';
+CC.connectionSetEcho = new 'CC.connectionSetEcho';
+CC.httpWriteHead = new 'CC.httpWriteHead';
 CC.xhr = new 'CC.xhr';
+CC.fetch = new 'CC.fetch';
+CC.mailSend = new 'CC.mailSend';
+CC.rateLimit = new 'CC.rateLimit';
+CC.rateLimitCheck = new 'CC.rateLimitCheck';
+CC.rateLimitReset = new 'CC.rateLimitReset';
+CC.ban = new 'CC.ban';
+CC.unban = new 'CC.unban';
+CC.bans = new 'CC.bans';
+CC.accountCreate = new 'CC.accountCreate';
+CC.accountVerify = new 'CC.accountVerify';
+CC.accountSetPassword = new 'CC.accountSetPassword';
+CC.accountRequireReset = new 'CC.accountRequireReset';
+CC.accountReset = new 'CC.accountReset';
+CC.accountDelete = new 'CC.accountDelete';
+CC.accountInfo = new 'CC.accountInfo';
+CC.accountTotpEnroll = new 'CC.accountTotpEnroll';
+CC.accountTotpConfirm = new 'CC.accountTotpConfirm';
+CC.accountTotpDisable = new 'CC.accountTotpDisable';
+CC.accountVerifyCode = new 'CC.accountVerifyCode';
+CC.accountRecoveryCodes = new 'CC.accountRecoveryCodes';
+CC.guestCreate = new 'CC.guestCreate';
+CC.guestRelease = new 'CC.guestRelease';
+CC.isGuest = new 'CC.isGuest';
+CC.federationPeers = new 'CC.federationPeers';
+CC.federationTeleport = new 'CC.federationTeleport';
+CC.blobPut = new 'CC.blobPut';
+CC.blobGet = new 'CC.blobGet';
+CC.blobDelete = new 'CC.blobDelete';
+CC.compress = new 'CC.compress';
+CC.decompress = new 'CC.decompress';
+CC.htmlEscape = new 'CC.htmlEscape';
+CC.htmlSanitize = new 'CC.htmlSanitize';
+CC.markdown = new 'CC.markdown';
+CC.csvParse = new 'CC.csvParse';
+CC.csvStringify = new 'CC.csvStringify';
+CC.xmlTokenize = new 'CC.xmlTokenize';
+CC.textGraphemes = new 'CC.textGraphemes';
+CC.textWords = new 'CC.textWords';
+CC.textWidth = new 'CC.textWidth';
+CC.textPad = new 'CC.textPad';
+CC.textTruncate = new 'CC.textTruncate';
+CC.inspect = new 'CC.inspect';
+
+///////////////////////////////////////////////////////////////////////////////
+// Cryptography API.
+//
+CC.crypto = {};
+CC.crypto.hash = new 'CC.crypto.hash';
+CC.crypto.hmac = new 'CC.crypto.hmac';
+CC.crypto.pbkdf2 = new 'CC.crypto.pbkdf2';
+CC.crypto.scrypt = new 'CC.crypto.scrypt';
+CC.crypto.equal = new 'CC.crypto.equal';
+CC.crypto.randomBytes = new 'CC.crypto.randomBytes';
+CC.crypto.randomInt = new 'CC.crypto.randomInt';
+CC.crypto.token = new 'CC.crypto.token';
+CC.crypto.uuid = new 'CC.crypto.uuid';
+
+///////////////////////////////////////////////////////////////////////////////
+// Debugger API.
+//
+CC.debugSetBreakpoint = new 'CC.debugSetBreakpoint';
+CC.debugClearBreakpoint = new 'CC.debugClearBreakpoint';
+CC.debugBreakpoints = new 'CC.debugBreakpoints';
+CC.debugSetWatchpoint = new 'CC.debugSetWatchpoint';
+CC.debugClearWatchpoint = new 'CC.debugClearWatchpoint';
+CC.debugWatchpoints = new 'CC.debugWatchpoints';
+CC.debugPause = new 'CC.debugPause';
+CC.debugResume = new 'CC.debugResume';
+CC.debugFrames = new 'CC.debugFrames';
+CC.debugSetHandler = new 'CC.debugSetHandler';
+CC.debugStartCoverage = new 'CC.debugStartCoverage';
+CC.debugStopCoverage = new 'CC.debugStopCoverage';
+CC.debugCoverage = new 'CC.debugCoverage';
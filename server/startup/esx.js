@@ -24,6 +24,7 @@
 // Global objects.
 var Thread = new 'Thread';
 var PermissionError = new 'PermissionError';
+var Buffer = new 'Buffer';
 
 (function() {
   // Hack to work around restriction that the 'new hack' only works on
@@ -33,7 +34,7 @@ var PermissionError = new 'PermissionError';
     return eval('new "' + name + '"');
   };
 
-  var classes = ['PermissionError', 'Thread'];
+  var classes = ['PermissionError', 'Thread', 'Buffer'];
   // Prototypes of global constructors.
   for (var i = 0; i < classes.length; i++) {
     var constructor = builtin(classes[i]);
@@ -70,7 +71,11 @@ var PermissionError = new 'PermissionError';
     [Object, 'Object', ['getOwnerOf', 'setOwnerOf'], []],
     [Thread, 'Thread',
      ['current', 'kill', 'suspend', 'callers'],
-     ['getTimeLimit', 'setTimeLimit']],
+     ['getTimeLimit', 'setTimeLimit', 'cancel',
+      'getLocal', 'setLocal', 'hasLocal', 'deleteLocal']],
+    [Buffer, 'Buffer',
+     ['from', 'isBuffer', 'byteLength', 'concat'],
+     ['at', 'equals', 'indexOf', 'slice', 'toString']],
   ];
   for (var i = 0; i < struct.length; i++) {
     var obj = struct[i][0];
@@ -0,0 +1,334 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Resource usage statistics for an admin dashboard: a
+ * single JSON-compatible snapshot of the scheduler, heap, connections
+ * and per-owner usage, with rates and peaks over recent time windows.
+ *
+ * The same figures are available piecemeal from the metrics server
+ * (for Prometheus) and the admin API; a Stats.Recorder samples them
+ * regularly so that they can be summarized over time windows (the last
+ * minute, five minutes, etc.) without an external monitoring system.
+ * Snapshots are served by the admin API (GET /stats) and to in-world
+ * code by CC.stats (e.g., for a dashboard page served by the in-world
+ * HTTP handler).
+ */
+'use strict';
+
+var Heap = require('./heap');
+var Interpreter = require('./interpreter');
+var Package = require('./package');
+
+var Stats = {};
+
+/**
+ * Default number of seconds between samples.
+ * @const {number}
+ */
+Stats.INTERVAL = 10;
+
+/**
+ * Default time windows (in seconds) over which samples are summarized.
+ * @const {!Array<number>}
+ */
+Stats.WINDOWS = [60, 300, 900, 3600];
+
+/**
+ * Default minimum number of seconds between counts of each owner's
+ * objects, which require walking the whole heap.
+ * @const {number}
+ */
+Stats.OWNER_INTERVAL = 300;
+
+/**
+ * A sample of the interpreter's state at a moment:
+ *
+ * - time: when it was taken (ms since the epoch).
+ * - steps, threadsStarted: interpreter steps executed and threads
+ *   created, so far.
+ * - threads: threads not yet finished.
+ * - delay: how long (in ms) the most overdue runnable thread has been
+ *   waiting to run.
+ * - connections: open connections (on all ports).
+ * - accepted, bytesRead, bytesWritten: connections accepted and bytes
+ *   received and sent (on all ports), so far.
+ * - heapUsed, rss: size of the JavaScript heap in use and resident
+ *   memory size, in bytes.
+ * @typedef {{time: number,
+ *            steps: number,
+ *            threadsStarted: number,
+ *            threads: number,
+ *            delay: number,
+ *            connections: number,
+ *            accepted: number,
+ *            bytesRead: number,
+ *            bytesWritten: number,
+ *            heapUsed: number,
+ *            rss: number}}
+ */
+Stats.Sample;
+
+/**
+ * Fields of Stats.Sample that are counters (summarized as rates), and
+ * that are gauges (summarized as averages and maxima).
+ * @const {{counters: !Array<string>, gauges: !Array<string>}}
+ */
+Stats.FIELDS = {
+  counters: ['steps', 'threadsStarted', 'accepted', 'bytesRead',
+             'bytesWritten'],
+  gauges: ['threads', 'delay', 'connections', 'heapUsed', 'rss'],
+};
+
+/**
+ * Take a sample of an interpreter's state.
+ * @param {!Interpreter} intrp The interpreter.
+ * @return {!Stats.Sample}
+ */
+Stats.sample = function(intrp) {
+  var now = intrp.now();
+  var threads = intrp.getThreads();
+  var delay = 0;
+  threads.forEach(function(thread) {
+    if (thread.status !== Interpreter.Thread.Status.BLOCKED) {
+      delay = Math.max(delay, now - thread.runAt);
+    }
+  });
+  var sample = {
+    time: Date.now(),
+    steps: intrp.counts.steps,
+    threadsStarted: intrp.counts.threads,
+    threads: threads.length,
+    delay: Math.round(delay),
+    connections: 0,
+    accepted: 0,
+    bytesRead: 0,
+    bytesWritten: 0,
+    heapUsed: 0,
+    rss: 0,
+  };
+  intrp.getTraffic().forEach(function(traffic) {
+    sample.connections += traffic.open;
+    sample.accepted += traffic.accepted;
+    sample.bytesRead += traffic.bytesRead;
+    sample.bytesWritten += traffic.bytesWritten;
+  });
+  var memory = process.memoryUsage();
+  sample.heapUsed = memory.heapUsed;
+  sample.rss = memory.rss;
+  return sample;
+};
+
+/**
+ * Summarize the samples taken in a time window: the rate (per second)
+ * of each counter, and the average and maximum of each gauge.
+ * @param {!Array<!Stats.Sample>} samples The samples, oldest first.
+ * @param {number} seconds Length of the window, ending with the most
+ *     recent sample.
+ * @return {?Object} The summary, with the number of seconds actually
+ *     covered (which is less than requested if there are too few
+ *     samples), or null if there are no samples.
+ */
+Stats.summarize = function(samples, seconds) {
+  if (!samples.length) return null;
+  var last = samples[samples.length - 1];
+  var start = last.time - seconds * 1000;
+  var i = samples.length - 1;
+  while (i > 0 && samples[i - 1].time >= start) i--;
+  var window = samples.slice(i);
+  var first = window[0];
+  var elapsed = (last.time - first.time) / 1000;
+  var summary = {seconds: elapsed, rates: {}, averages: {}, maxima: {}};
+  Stats.FIELDS.counters.forEach(function(field) {
+    summary.rates[field] =
+        elapsed ? (last[field] - first[field]) / elapsed : 0;
+  });
+  Stats.FIELDS.gauges.forEach(function(field) {
+    var total = 0;
+    var max = 0;
+    window.forEach(function(sample) {
+      total += sample[field];
+      max = Math.max(max, sample[field]);
+    });
+    summary.averages[field] = total / window.length;
+    summary.maxima[field] = max;
+  });
+  return summary;
+};
+
+/**
+ * Count each owner's objects (those reachable, as by Heap.reachable)
+ * and threads.  Slow: walks the whole heap.
+ * @param {!Interpreter} intrp The interpreter.
+ * @return {!Array<{owner: string, objects: number, threads: number}>}
+ *     The counts, each owner being named by its selector (or 'root',
+ *     or '(anonymous)' if it has none), with most objects first.
+ */
+Stats.countOwners = function(intrp) {
+  var counts = new Map();
+  var count = function(owner) {
+    if (!counts.has(owner)) counts.set(owner, {objects: 0, threads: 0});
+    return counts.get(owner);
+  };
+  Heap.reachable(intrp).forEach(function(node) {
+    if (node instanceof intrp.Object && node.owner) {
+      count(node.owner).objects++;
+    }
+  });
+  intrp.getThreads().forEach(function(thread) {
+    if (thread.wrapper && thread.wrapper.owner) {
+      count(thread.wrapper.owner).threads++;
+    }
+  });
+  var names = Package.findNames(intrp);
+  var owners = [];
+  counts.forEach(function(c, owner) {
+    owners.push({
+      owner: (owner === intrp.ROOT) ? 'root' :
+          names.get(owner) || '(anonymous)',
+      objects: c.objects,
+      threads: c.threads,
+    });
+  });
+  owners.sort(function(a, b) {return b.objects - a.objects;});
+  return owners;
+};
+
+/**
+ * Regularly samples an interpreter's state, keeping the samples for the
+ * longest time window, and makes snapshots of its resource usage.
+ * @constructor
+ * @struct
+ * @param {function(): ?Interpreter} getInterpreter Function returning
+ *     the interpreter to sample (or null if there is none yet).  (Not
+ *     fixed: a replica's is replaced whenever it is refreshed.)
+ * @param {{interval: (number|undefined),
+ *          windows: (!Array<number>|undefined),
+ *          ownerInterval: (number|undefined)}=} options Seconds between
+ *     samples (default Stats.INTERVAL), time windows (default
+ *     Stats.WINDOWS) and minimum seconds between counts of owners'
+ *     objects (default Stats.OWNER_INTERVAL).
+ */
+Stats.Recorder = function(getInterpreter, options) {
+  options = options || {};
+  /** @private @const {function(): ?Interpreter} */
+  this.getInterpreter_ = getInterpreter;
+  /** @private @const {number} */
+  this.interval_ = options.interval || Stats.INTERVAL;
+  /** @const {!Array<number>} */
+  this.windows = options.windows || Stats.WINDOWS;
+  /** @private @const {number} */
+  this.ownerInterval_ = (options.ownerInterval === undefined) ?
+      Stats.OWNER_INTERVAL : options.ownerInterval;
+  /** @private @const {!Array<!Stats.Sample>} Samples, oldest first. */
+  this.samples_ = [];
+  /** @private {?NodeJS.Timer} */
+  this.timer_ = null;
+  /**
+   * Most recent counts of owners' objects, and when they were made.
+   * @private {?{time: number, owners: !Array<!Object>}}
+   */
+  this.owners_ = null;
+};
+
+/**
+ * Start sampling.
+ */
+Stats.Recorder.prototype.start = function() {
+  if (this.timer_) return;
+  this.timer_ = setInterval(this.record.bind(this), this.interval_ * 1000);
+  this.timer_.unref();
+};
+
+/**
+ * Stop sampling.
+ */
+Stats.Recorder.prototype.stop = function() {
+  clearInterval(this.timer_);
+  this.timer_ = null;
+};
+
+/**
+ * Take a sample now, discarding those too old to be in any window.
+ * @return {?Stats.Sample} The sample (or null if there is no
+ *     interpreter).
+ */
+Stats.Recorder.prototype.record = function() {
+  var intrp = this.getInterpreter_();
+  if (!intrp) return null;
+  var sample = Stats.sample(intrp);
+  this.samples_.push(sample);
+  // Keep one sample from before the longest window, to cover it all.
+  var oldest = sample.time - Math.max.apply(Math, this.windows) * 1000;
+  while (this.samples_.length > 1 && this.samples_[1].time <= oldest) {
+    this.samples_.shift();
+  }
+  return sample;
+};
+
+/**
+ * Make a snapshot of the interpreter's resource usage.  Owners' objects
+ * are counted if they have not been for the owner interval.
+ * @param {!Object=} extra Further sections to include (e.g., about
+ *     checkpoints).
+ * @return {?Object} The snapshot (JSON-compatible), or null if there is
+ *     no interpreter.
+ */
+Stats.Recorder.prototype.snapshot = function(extra) {
+  var intrp = this.getInterpreter_();
+  if (!intrp) return null;
+  var current = Stats.sample(intrp);
+  var samples = this.samples_.concat([current]);
+  var windows = {};
+  for (var i = 0; i < this.windows.length; i++) {
+    windows[this.windows[i]] = Stats.summarize(samples, this.windows[i]);
+  }
+  if (!this.owners_ ||
+      current.time - this.owners_.time >= this.ownerInterval_ * 1000) {
+    this.owners_ = {time: current.time, owners: Stats.countOwners(intrp)};
+  }
+  var slow = {tasks: 0, pauses: 0};
+  var since = intrp.now() - Math.max.apply(Math, this.windows) * 1000;
+  intrp.getSlowLog().forEach(function(record) {
+    if (record.time < since) return;
+    if (record.kind === 'task') {
+      slow.tasks++;
+    } else {
+      slow.pauses++;
+    }
+  });
+  return Object.assign({
+    time: current.time,
+    uptime: Math.round(process.uptime()),
+    scheduler: {
+      status: Object.keys(Interpreter.Status).find(function(name) {
+        return Interpreter.Status[name] === intrp.status;
+      }).toLowerCase(),
+      threads: current.threads,
+      delay: current.delay,
+      steps: current.steps,
+      threadsStarted: current.threadsStarted,
+      slow: slow,
+    },
+    memory: {heapUsed: current.heapUsed, rss: current.rss},
+    connections: {open: current.connections, ports: intrp.getTraffic()},
+    owners: {time: this.owners_.time, owners: this.owners_.owners},
+    windows: windows,
+  }, extra);
+};
+
+module.exports = Stats;
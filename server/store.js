@@ -0,0 +1,761 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Storage backends for the serialized state of the
+ * world, and a log-structured object store.
+ *
+ * A backend (Store.Backend) holds a serialization: a set of records,
+ * keyed by object ID.  Each save is a transaction (Store.Transaction)
+ * whose records either replace the whole set (a full serialization)
+ * or are merged into it (an incremental one).  The traditional
+ * backend, which saves checkpoint files, is in codecity.
+ *
+ * Store.Log is a backend that keeps each record individually, in a
+ * directory of append-only segment files.  An index of where the
+ * current record for each object is to be found is kept in memory
+ * (and rebuilt by scanning the segments when the store is opened), so
+ * individual records can be read without loading the rest, and an
+ * incremental save costs only as much as the records it writes.
+ * Superseded records are garbage; segments containing nothing else
+ * are deleted, and the store is compacted (its live records copied
+ * into a new segment) when garbage exceeds the amount of live data.
+ *
+ * Each segment file is named with a sequence number (e.g.,
+ * '000001.seg'), and begins with the four magic bytes '\0CCS' and a
+ * version byte, followed by any number of entries:
+ *
+ *     kind      1 byte: Store.Kind_.
+ *     id        4 bytes, big-endian: object ID (0 for COMMIT entries).
+ *     length    4 bytes, big-endian: length of payload.
+ *     checksum  8 bytes: start of SHA-256 hash of kind, id, length
+ *               and payload.
+ *     payload   For RECORD entries, the encoded record (optionally
+ *               compressed and/or encrypted as for checkpoint files);
+ *               for COMMIT entries, a JSON object {"full": boolean,
+ *               "records": number}.
+ *
+ * A transaction's RECORD entries take effect only once the COMMIT
+ * entry that follows them has been written (and synced to disk);
+ * anything after the last COMMIT entry, such as a transaction that
+ * was interrupted by a crash, is discarded when the store is opened.
+ */
+'use strict';
+
+var Binpack = require('./binpack');
+var crypto = require('crypto');
+var Envelope = require('./envelope');
+var fs = require('fs');
+var path = require('path');
+
+var Store = {};
+
+///////////////////////////////////////////////////////////////////////////////
+// Interfaces.
+///////////////////////////////////////////////////////////////////////////////
+
+/**
+ * A place where the serialized state of the world is saved.
+ * @interface
+ */
+Store.Backend = function() {};
+
+/**
+ * Does the backend support incremental saves?  If not, every
+ * transaction must be committed as a full serialization.
+ * @type {boolean}
+ */
+Store.Backend.prototype.incremental;
+
+/**
+ * Is there no saved serialization to load?
+ * @return {boolean}
+ */
+Store.Backend.prototype.isEmpty = function() {};
+
+/**
+ * Read the saved serialization, passing each record to a callback in
+ * turn.
+ * @param {function(!Object)} onRecord Callback to receive each record.
+ * @return {!Promise<void>} Resolves once all records have been read.
+ */
+Store.Backend.prototype.read = function(onRecord) {};
+
+/**
+ * Should the next save be a full serialization (starting a new series
+ * of incremental ones)?
+ * @return {boolean}
+ */
+Store.Backend.prototype.wantsFull = function() {};
+
+/**
+ * Begin saving.  Only one transaction may be in progress at a time.
+ * @param {boolean=} sync Will the transaction be committed without
+ *     waiting for the promise returned by its .end?
+ * @return {!Store.Transaction}
+ */
+Store.Backend.prototype.begin = function(sync) {};
+
+/**
+ * Describe the saved serialization, for logging.
+ * @return {string}
+ */
+Store.Backend.prototype.toString = function() {};
+
+/**
+ * A save in progress.
+ * @interface
+ */
+Store.Transaction = function() {};
+
+/**
+ * Save a record.
+ * @param {!Object} record JSON-compatible record, with an ID.
+ */
+Store.Transaction.prototype.write = function(record) {};
+
+/**
+ * Finish writing records.
+ * @return {!Promise<void>} Resolves once they have all been written
+ *     (which, if the transaction was begun with sync true, they
+ *     already have), after which the transaction may be committed.
+ */
+Store.Transaction.prototype.end = function() {};
+
+/**
+ * Complete the save, making it durable.  If .end has not been called,
+ * it is called first.
+ * @param {boolean} full Are the records written a full serialization
+ *     (replacing everything previously saved)?
+ * @return {string} Description of what was saved, for logging.
+ */
+Store.Transaction.prototype.commit = function(full) {};
+
+/**
+ * Abandon the save, discarding the records written.  Later saves
+ * should be full serializations.
+ */
+Store.Transaction.prototype.abort = function() {};
+
+///////////////////////////////////////////////////////////////////////////////
+// Log-structured object store.
+///////////////////////////////////////////////////////////////////////////////
+
+/** @private @const {!Buffer} */
+Store.MAGIC_ = Buffer.from([0x00, 0x43, 0x43, 0x53]);  // '\0CCS'
+
+/** @private @const {number} */
+Store.VERSION_ = 1;
+
+/** @private @const {number} Length of kind, id, length and checksum. */
+Store.ENTRY_HEADER_LENGTH_ = 1 + 4 + 4 + 8;
+
+/**
+ * Kinds of segment entry.
+ * @private @enum {number}
+ */
+Store.Kind_ = {
+  COMMIT: 0x43,  // 'C'
+  RECORD: 0x52,  // 'R'
+};
+
+/**
+ * Location of a record in a segment file.
+ * @private
+ * @typedef {{segment: number, offset: number, length: number}}
+ */
+Store.Location_;
+
+/**
+ * Options for a log-structured store.
+ *
+ * - format: 'binary' or 'json' encoding for records.  (Default: 'json'.)
+ * - compression, key: as for Envelope.Options.
+ * - maxDeltas: number of incremental saves after which a full one is
+ *   wanted, or 0 for no limit.  (Default: 0.)
+ * - segmentSize: size in bytes at which a new segment is started.
+ *   (Default: Store.Log.SEGMENT_SIZE.)
+ * @typedef {{format: (string|undefined),
+ *            compression: (string|undefined),
+ *            key: (?Buffer|undefined),
+ *            maxDeltas: (number|undefined),
+ *            segmentSize: (number|undefined)}}
+ */
+Store.LogOptions;
+
+/**
+ * A log-structured object store, in the given directory (which is
+ * created if it does not exist).  Opening the store scans its
+ * segments to build the index, discarding any uncommitted entries.
+ * @constructor
+ * @struct
+ * @implements {Store.Backend}
+ * @param {string} dir Directory containing segment files.
+ * @param {!Store.LogOptions=} options Encoding and other options.
+ */
+Store.Log = function(dir, options) {
+  options = options || {};
+  /** @const {string} */
+  this.dir = dir;
+  /** @const {boolean} */
+  this.incremental = true;
+  /** @private @const {string|undefined} */
+  this.format_ = options.format;
+  /** @private @const {!Envelope.Options} */
+  this.envelope_ = {compression: options.compression, key: options.key};
+  /** @private @const {number} */
+  this.maxDeltas_ = options.maxDeltas || 0;
+  /** @private @const {number} */
+  this.segmentSize_ = options.segmentSize || Store.Log.SEGMENT_SIZE;
+  /** @private @const {!Map<number,!Store.Location_>} Index, by ID. */
+  this.index_ = new Map();
+  /**
+   * Number of bytes of live records in each segment, by sequence
+   * number.  Every segment has an entry.
+   * @private @const {!Map<number,number>}
+   */
+  this.live_ = new Map();
+  /** @private @const {!Map<number,number>} Size of each segment. */
+  this.sizes_ = new Map();
+  /** @private {number} Sequence number of the active segment. */
+  this.active_ = 0;
+  /** @private {?number} File descriptor for the active segment. */
+  this.fd_ = null;
+  /**
+   * Number of incremental saves committed since the last full one, or
+   * -1 if there has been no full one since the store was opened.  (A
+   * new series of incremental saves must begin with a full one, as
+   * IDs are only stable within a series.)
+   * @private {number}
+   */
+  this.deltas_ = -1;
+  /** @private {?Store.Log.Transaction_} Transaction in progress. */
+  this.transaction_ = null;
+
+  if (!fs.existsSync(dir)) fs.mkdirSync(dir, {recursive: true});
+  var segments = Store.Log.allSegments_(dir);
+  for (var i = 0; i < segments.length; i++) {
+    this.scan_(segments[i], i === segments.length - 1);
+  }
+  if (!segments.length) this.startSegment_();
+};
+
+/** @const {number} Default size at which a new segment is started. */
+Store.Log.SEGMENT_SIZE = 64 * 1024 * 1024;
+
+/**
+ * Amount of garbage (in bytes) below which the store is never
+ * compacted.
+ * @private @const {number}
+ */
+Store.Log.MIN_COMPACTION_ = 1024 * 1024;
+
+/** @override */
+Store.Log.prototype.isEmpty = function() {
+  return this.index_.size === 0;
+};
+
+/**
+ * Get the IDs of the objects in the store, in ascending order.
+ * @return {!Array<number>}
+ */
+Store.Log.prototype.ids = function() {
+  return Array.from(this.index_.keys()).sort(function(a, b) {return a - b;});
+};
+
+/**
+ * Read the current record for a single object.
+ * @param {number} id ID of the object.
+ * @return {!Object|undefined} The record, or undefined if there is none.
+ */
+Store.Log.prototype.get = function(id) {
+  var location = this.index_.get(id);
+  if (!location) return undefined;
+  var fd = fs.openSync(this.segmentFile_(location.segment), 'r');
+  try {
+    var entry = Store.Log.readEntry_(fd, location.offset);
+  } finally {
+    fs.closeSync(fd);
+  }
+  if (!entry || entry.kind !== Store.Kind_.RECORD || entry.id !== id) {
+    throw new Error('Store is damaged: bad entry for object ' + id + ' in ' +
+        this.segmentFile_(location.segment));
+  }
+  return Store.decode_(entry.payload, this.envelope_.key);
+};
+
+/**
+ * Read every record in the store, in ID order.
+ * @override
+ */
+Store.Log.prototype.read = function(onRecord) {
+  var store = this;
+  return new Promise(function(resolve) {
+    var ids = store.ids();
+    // Keep segments open while reading, since there are many records
+    // but few segments.
+    var fds = new Map();
+    try {
+      for (var i = 0; i < ids.length; i++) {
+        var location = store.index_.get(ids[i]);
+        var fd = fds.get(location.segment);
+        if (fd === undefined) {
+          fd = fs.openSync(store.segmentFile_(location.segment), 'r');
+          fds.set(location.segment, fd);
+        }
+        var entry = Store.Log.readEntry_(fd, location.offset);
+        if (!entry || entry.id !== ids[i]) {
+          throw new Error('Store is damaged: bad entry for object ' + ids[i]);
+        }
+        onRecord(Store.decode_(entry.payload, store.envelope_.key));
+      }
+    } finally {
+      fds.forEach(function(fd) {
+        fs.closeSync(fd);
+      });
+    }
+    resolve();
+  });
+};
+
+/** @override */
+Store.Log.prototype.wantsFull = function() {
+  return this.deltas_ < 0 ||
+      (this.maxDeltas_ > 0 && this.deltas_ >= this.maxDeltas_);
+};
+
+/**
+ * Continue the current series of incremental saves, even though no
+ * full save has been made since the store was opened: for when the
+ * state to be saved is that which was loaded from it, with the same
+ * IDs (see Serializer.LazyLoader).
+ */
+Store.Log.prototype.resume = function() {
+  if (this.deltas_ < 0 && !this.isEmpty()) this.deltas_ = 0;
+};
+
+/** @override */
+Store.Log.prototype.begin = function() {
+  if (this.transaction_) throw new Error('Transaction already in progress');
+  if (this.fd_ === null) throw new Error('Store is closed');
+  this.transaction_ = new Store.Log.Transaction_(this);
+  return this.transaction_;
+};
+
+/** @override */
+Store.Log.prototype.toString = function() {
+  return 'Object store ' + this.dir;
+};
+
+/**
+ * Statistics about the store's use of space.
+ * @return {{records: number, segments: number, live: number, total: number}}
+ *     Number of records and segments, and bytes of live records and
+ *     of all segments.
+ */
+Store.Log.prototype.stats = function() {
+  var live = 0;
+  var total = 0;
+  this.live_.forEach(function(n) {live += n;});
+  this.sizes_.forEach(function(n) {total += n;});
+  return {records: this.index_.size, segments: this.sizes_.size,
+          live: live, total: total};
+};
+
+/**
+ * Compact the store: copy all live records into a new segment,
+ * followed by a full COMMIT entry, then delete all older segments.
+ * (Should a crash occur part way through, the store is unchanged.)
+ */
+Store.Log.prototype.compact = function() {
+  if (this.transaction_) throw new Error('Transaction in progress');
+  var oldFd = this.fd_;
+  this.startSegment_();
+  var fds = new Map([[this.active_ - 1, oldFd]]);
+  try {
+    var ids = this.ids();
+    var index = new Map();
+    for (var i = 0; i < ids.length; i++) {
+      var location = this.index_.get(ids[i]);
+      var fd = fds.get(location.segment);
+      if (fd === undefined) {
+        fd = fs.openSync(this.segmentFile_(location.segment), 'r');
+        fds.set(location.segment, fd);
+      }
+      var entry = Store.Log.readEntry_(fd, location.offset);
+      if (!entry || entry.id !== ids[i]) {
+        throw new Error('Store is damaged: bad entry for object ' + ids[i]);
+      }
+      // Copied verbatim: no need to decode.
+      index.set(ids[i], this.append_(Store.Kind_.RECORD, ids[i],
+                                     entry.payload));
+    }
+    this.append_(Store.Kind_.COMMIT, 0, Buffer.from(
+        JSON.stringify({'full': true, 'records': ids.length})));
+    fs.fsyncSync(/** @type {number} */(this.fd_));
+  } finally {
+    fds.forEach(function(fd) {
+      fs.closeSync(fd);
+    });
+  }
+  this.setIndex_(index, true);
+};
+
+/**
+ * Close the store.
+ */
+Store.Log.prototype.close = function() {
+  if (this.transaction_) this.transaction_.abort();
+  if (this.fd_ === null) return;
+  fs.closeSync(this.fd_);
+  this.fd_ = null;
+};
+
+/**
+ * Get the filename of a segment.
+ * @private
+ * @param {number} segment Sequence number of the segment.
+ * @return {string} Filename.
+ */
+Store.Log.prototype.segmentFile_ = function(segment) {
+  return path.join(this.dir, String(segment).padStart(6, '0') + '.seg');
+};
+
+/**
+ * Start a new active segment.  The previous one (if any) must have
+ * been closed.
+ * @private
+ */
+Store.Log.prototype.startSegment_ = function() {
+  this.active_++;
+  var header = Buffer.concat([Store.MAGIC_, Buffer.from([Store.VERSION_])]);
+  this.fd_ = fs.openSync(this.segmentFile_(this.active_), 'wx');
+  fs.writeSync(this.fd_, header);
+  this.live_.set(this.active_, 0);
+  this.sizes_.set(this.active_, header.length);
+};
+
+/**
+ * Append an entry to the active segment (without waiting for it to
+ * reach the disk).
+ * @private
+ * @param {!Store.Kind_} kind Kind of entry.
+ * @param {number} id Object ID.
+ * @param {!Buffer} payload Payload of entry.
+ * @return {!Store.Location_} Where the entry was written.
+ */
+Store.Log.prototype.append_ = function(kind, id, payload) {
+  var header = Buffer.alloc(Store.ENTRY_HEADER_LENGTH_);
+  header[0] = kind;
+  header.writeUInt32BE(id, 1);
+  header.writeUInt32BE(payload.length, 5);
+  Store.checksum_(header, payload).copy(header, 9);
+  var data = Buffer.concat([header, payload]);
+  var offset = /** @type {number} */(this.sizes_.get(this.active_));
+  for (var done = 0; done < data.length; ) {
+    done += fs.writeSync(/** @type {number} */(this.fd_), data, done,
+                         data.length - done, offset + done);
+  }
+  this.sizes_.set(this.active_, offset + data.length);
+  return {segment: this.active_, offset: offset, length: data.length};
+};
+
+/**
+ * Scan a segment file, updating the index with the records of each
+ * committed transaction.  If this is the last segment, it becomes the
+ * active one, and any uncommitted entries at its end are removed.
+ * @private
+ * @param {number} segment Sequence number of the segment.
+ * @param {boolean} last Is this the last segment?
+ */
+Store.Log.prototype.scan_ = function(segment, last) {
+  var filename = this.segmentFile_(segment);
+  var fd = fs.openSync(filename, last ? 'r+' : 'r');
+  var size = fs.fstatSync(fd).size;
+  var head = Buffer.alloc(Store.MAGIC_.length + 1);
+  if (last && size < head.length) {
+    // Crashed while starting this segment.
+    fs.closeSync(fd);
+    fs.unlinkSync(filename);
+    this.active_ = segment - 1;
+    this.startSegment_();
+    return;
+  }
+  if (fs.readSync(fd, head, 0, head.length, 0) < head.length ||
+      !head.subarray(0, Store.MAGIC_.length).equals(Store.MAGIC_)) {
+    fs.closeSync(fd);
+    throw new TypeError('Not a store segment: ' + filename);
+  }
+  if (head[Store.MAGIC_.length] !== Store.VERSION_) {
+    fs.closeSync(fd);
+    throw new RangeError('Unsupported store version ' +
+        head[Store.MAGIC_.length] + ': ' + filename);
+  }
+  this.live_.set(segment, 0);
+  var /** !Map<number,!Store.Location_> */ pending = new Map();
+  var offset = head.length;
+  var committed = offset;
+  var entry;
+  while ((entry = Store.Log.readEntry_(fd, offset, size))) {
+    var location = {segment: segment, offset: offset, length: entry.length};
+    offset += entry.length;
+    if (entry.kind === Store.Kind_.RECORD) {
+      pending.set(entry.id, location);
+    } else if (entry.kind === Store.Kind_.COMMIT) {
+      var full = JSON.parse(entry.payload.toString())['full'];
+      this.setIndex_(pending, full);
+      pending = new Map();
+      committed = offset;
+    } else {
+      fs.closeSync(fd);
+      throw new RangeError('Unknown store entry kind ' + entry.kind + ': ' +
+          filename);
+    }
+  }
+  this.sizes_.set(segment, committed);
+  if (last) {
+    // Discard any incomplete transaction.
+    if (size > committed) fs.ftruncateSync(fd, committed);
+    this.active_ = segment;
+    this.fd_ = fd;
+  } else {
+    fs.closeSync(fd);
+  }
+};
+
+/**
+ * Update the index with the records of a committed transaction, then
+ * delete any segments (other than the active one) that no longer
+ * contain any live records.
+ * @private
+ * @param {!Map<number,!Store.Location_>} records Where each record
+ *     written by the transaction is, by ID.
+ * @param {boolean} full Was the transaction a full serialization?
+ */
+Store.Log.prototype.setIndex_ = function(records, full) {
+  if (full) {
+    this.index_.clear();
+    this.live_.forEach(function(_, segment, live) {
+      live.set(segment, 0);
+    });
+  }
+  records.forEach(function(location, id) {
+    var old = this.index_.get(id);
+    if (old) this.addLive_(old.segment, -old.length);
+    this.index_.set(id, location);
+    this.addLive_(location.segment, location.length);
+  }, this);
+  // Segment files are scanned in order, so only delete them once all
+  // have been.
+  if (this.fd_ === null) return;
+  this.live_.forEach(function(live, segment) {
+    if (live === 0 && segment !== this.active_) {
+      fs.unlinkSync(this.segmentFile_(segment));
+      this.live_.delete(segment);
+      this.sizes_.delete(segment);
+    }
+  }, this);
+};
+
+/**
+ * Adjust the number of bytes of live records in a segment.
+ * @private
+ * @param {number} segment Sequence number of the segment.
+ * @param {number} delta Number of bytes added (or removed, if negative).
+ */
+Store.Log.prototype.addLive_ = function(segment, delta) {
+  this.live_.set(segment, (this.live_.get(segment) || 0) + delta);
+};
+
+/**
+ * Get the sequence numbers of the segment files in a directory, in
+ * ascending order.
+ * @private
+ * @param {string} dir Directory containing segment files.
+ * @return {!Array<number>}
+ */
+Store.Log.allSegments_ = function(dir) {
+  return fs.readdirSync(dir).filter(function(file) {
+    return /^\d+\.seg$/.test(file);
+  }).map(function(file) {
+    return Number(file.slice(0, -4));
+  }).sort(function(a, b) {return a - b;});
+};
+
+/**
+ * Read an entry from a segment file.
+ * @private
+ * @param {number} fd File descriptor of segment file.
+ * @param {number} offset Position of the entry.
+ * @param {number=} size Size of the file, if known.
+ * @return {?{kind: number, id: number, length: number, payload: !Buffer}}
+ *     The entry (length being that of the whole entry), or null if
+ *     the file ends (or is damaged or incomplete) at that point.
+ */
+Store.Log.readEntry_ = function(fd, offset, size) {
+  var header = Buffer.alloc(Store.ENTRY_HEADER_LENGTH_);
+  if (fs.readSync(fd, header, 0, header.length, offset) < header.length) {
+    return null;
+  }
+  if (size !== undefined &&
+      offset + header.length + header.readUInt32BE(5) > size) {
+    return null;  // Don't allocate a buffer for a damaged length.
+  }
+  var payload = Buffer.alloc(header.readUInt32BE(5));
+  var read = fs.readSync(fd, payload, 0, payload.length,
+                         offset + header.length);
+  if (read < payload.length ||
+      !Store.checksum_(header, payload).equals(header.subarray(9))) {
+    return null;
+  }
+  return {kind: header[0], id: header.readUInt32BE(1),
+          length: header.length + payload.length, payload: payload};
+};
+
+/**
+ * A transaction saving records to a log-structured store.  Records
+ * are appended to the active segment as they are written.
+ * @private
+ * @constructor
+ * @struct
+ * @implements {Store.Transaction}
+ * @param {!Store.Log} store The store.
+ */
+Store.Log.Transaction_ = function(store) {
+  /** @private @const {!Store.Log} */
+  this.store_ = store;
+  /** @private @const {number} Active segment when begun. */
+  this.segment_ = store.active_;
+  /** @private @const {number} Size of active segment when begun. */
+  this.start_ = /** @type {number} */(store.sizes_.get(store.active_));
+  /** @private @const {!Map<number,!Store.Location_>} */
+  this.records_ = new Map();
+};
+
+/** @override */
+Store.Log.Transaction_.prototype.write = function(record) {
+  this.check_();
+  var id = record['#'];
+  if (typeof id !== 'number' || id < 0 || id % 1 || id > 0xffffffff) {
+    throw new TypeError('Record has no valid ID: ' + JSON.stringify(id));
+  }
+  var store = this.store_;
+  this.records_.set(id, store.append_(Store.Kind_.RECORD, id,
+      Store.encode_(record, store.format_, store.envelope_)));
+};
+
+/** @override */
+Store.Log.Transaction_.prototype.end = function() {
+  this.check_();
+  // Records are appended as they are written.
+  return Promise.resolve();
+};
+
+/** @override */
+Store.Log.Transaction_.prototype.commit = function(full) {
+  this.check_();
+  var store = this.store_;
+  store.append_(Store.Kind_.COMMIT, 0, Buffer.from(
+      JSON.stringify({'full': full, 'records': this.records_.size})));
+  fs.fsyncSync(/** @type {number} */(store.fd_));
+  store.transaction_ = null;
+  store.setIndex_(this.records_, full);
+  store.deltas_ = full ? 0 : store.deltas_ + 1;
+  var segment = store.segmentFile_(store.active_);
+  var stats = store.stats();
+  if (stats.total - stats.live > Math.max(stats.live,
+                                          Store.Log.MIN_COMPACTION_)) {
+    store.compact();
+  } else if (/** @type {number} */(store.sizes_.get(store.active_)) >=
+      store.segmentSize_) {
+    fs.closeSync(/** @type {number} */(store.fd_));
+    store.startSegment_();
+  }
+  return this.records_.size + ' record(s) in ' + segment;
+};
+
+/** @override */
+Store.Log.Transaction_.prototype.abort = function() {
+  if (this.store_.transaction_ !== this) return;
+  var store = this.store_;
+  store.transaction_ = null;
+  store.deltas_ = -1;
+  // Remove the entries written (which are all in the same segment,
+  // since new segments are only started by commit and compact).
+  try {
+    fs.ftruncateSync(/** @type {number} */(store.fd_), this.start_);
+    store.sizes_.set(this.segment_, this.start_);
+  } catch (e) {
+    // If they can't be removed, they will be ignored when the store is
+    // next opened, but another transaction must not commit them.
+    store.close();
+    throw e;
+  }
+};
+
+/**
+ * Throw if this transaction is no longer in progress.
+ * @private
+ */
+Store.Log.Transaction_.prototype.check_ = function() {
+  if (this.store_.transaction_ !== this) {
+    throw new Error('Transaction is not in progress');
+  }
+};
+
+/**
+ * Encode a record as the payload of a RECORD entry.
+ * @private
+ * @param {!Object} record JSON-compatible record.
+ * @param {string|undefined} format 'binary' or 'json'.
+ * @param {!Envelope.Options} options Compression and encryption to apply.
+ * @return {!Buffer} Encoded record.
+ */
+Store.encode_ = function(record, format, options) {
+  var data = (format === 'binary') ? Binpack.encode([record]) :
+      JSON.stringify(record);
+  return Envelope.wrap(data, options);
+};
+
+/**
+ * Decode the payload of a RECORD entry.
+ * @private
+ * @param {!Buffer} payload Encoded record.
+ * @param {?Buffer|undefined} key Decryption key, if any.
+ * @return {!Object} Record.
+ */
+Store.decode_ = function(payload, key) {
+  var plain = Envelope.unwrap(payload, key);
+  return Binpack.isBinary(plain) ? Binpack.decode(plain)[0] :
+      JSON.parse(plain.toString());
+};
+
+/**
+ * Compute the checksum of a segment entry.
+ * @private
+ * @param {!Buffer} header Entry header (only kind, id and length are used).
+ * @param {!Buffer} payload Entry payload.
+ * @return {!Buffer} Checksum.
+ */
+Store.checksum_ = function(header, payload) {
+  var hash = crypto.createHash('sha256');
+  hash.update(header.subarray(0, 9));
+  hash.update(payload);
+  return hash.digest().subarray(0, 8);
+};
+
+module.exports = Store;
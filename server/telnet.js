@@ -0,0 +1,438 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview The telnet protocol (RFC 854), for classic MUD
+ * clients.
+ *
+ * A Telnet.Connection wraps a newly-accepted net.Socket, removing
+ * telnet commands from the data received, so that it can be used in
+ * place of the socket.  It negotiates:
+ *
+ * - NAWS (RFC 1073): the client's window size, reported by a 'resize'
+ *   event.
+ * - TTYPE (RFC 1091): the client's terminal type, reported by a
+ *   'terminaltype' event.
+ * - ECHO (RFC 857): whether the client echoes input locally; see
+ *   .setEcho.
+ * - MCCP2 (COMPRESS2): compression of all data sent, if enabled by the
+ *   compress option.
+ *
+ * Other options are refused.
+ */
+'use strict';
+
+var events = require('events');
+var string_decoder = require('string_decoder');
+var util = require('util');
+var zlib = require('zlib');
+
+var Telnet = {};
+
+/**
+ * Telnet commands.
+ * @enum {number}
+ */
+Telnet.Command = {
+  SE: 240,
+  NOP: 241,
+  GA: 249,
+  SB: 250,
+  WILL: 251,
+  WONT: 252,
+  DO: 253,
+  DONT: 254,
+  IAC: 255,
+};
+
+/**
+ * Telnet options.
+ * @enum {number}
+ */
+Telnet.Option = {
+  ECHO: 1,
+  SGA: 3,
+  TTYPE: 24,
+  NAWS: 31,
+  COMPRESS2: 86,
+};
+
+/** @private @const {number} Longest subnegotiation to accept. */
+Telnet.MAX_SUBNEGOTIATION_ = 256;
+
+/** @private @const {number} TTYPE subnegotiation: terminal type follows. */
+Telnet.TTYPE_IS_ = 0;
+
+/** @private @const {number} TTYPE subnegotiation: request terminal type. */
+Telnet.TTYPE_SEND_ = 1;
+
+/**
+ * States of the parser for data received.
+ * @private
+ * @enum {number}
+ */
+Telnet.State_ = {
+  DATA: 0,
+  CR: 1,
+  IAC: 2,
+  OPTION: 3,
+  SB: 4,
+  SB_IAC: 5,
+};
+
+/**
+ * Options for a Telnet.Connection.
+ * @typedef {{compress: (boolean|undefined)}}
+ */
+Telnet.Options;
+
+/**
+ * A telnet connection.  Begins option negotiation immediately.
+ *
+ * Emits 'data' (with a string), 'end', 'close', 'error' and 'drain',
+ * like the underlying socket, and also 'resize' (with the width and
+ * height of the client's window) and 'terminaltype' (with the name
+ * of the client's terminal type) when the client reports them.
+ * @constructor
+ * @extends {events.EventEmitter}
+ * @param {!net.Socket} socket The underlying connection.
+ * @param {!Telnet.Options=} options Options.
+ */
+Telnet.Connection = function(socket, options) {
+  events.EventEmitter.call(this);
+  options = options || {};
+  /** @private @const {!net.Socket} */
+  this.socket_ = socket;
+  /** @const {string|undefined} */
+  this.remoteAddress = socket.remoteAddress;
+  /** @const {number|undefined} */
+  this.remotePort = socket.remotePort;
+  /** @type {?number} Width of client's window, if known. */
+  this.width = null;
+  /** @type {?number} Height of client's window, if known. */
+  this.height = null;
+  /** @type {?string} Client's terminal type, if known. */
+  this.terminalType = null;
+  /** @private @const {boolean} Offer compression? */
+  this.compress_ = Boolean(options.compress);
+  /**
+   * Stream compressing data sent, once compression has begun.
+   * @private {?zlib.Deflate}
+   */
+  this.deflate_ = null;
+  /** @private {!Telnet.State_} */
+  this.state_ = Telnet.State_.DATA;
+  /** @private {number} Command (WILL, etc.) awaiting its option. */
+  this.command_ = 0;
+  /** @private {!Array<number>} Subnegotiation being received. */
+  this.subnegotiation_ = [];
+  /**
+   * Negotiation commands we have sent and not had a reply to, as
+   * command + ':' + option.  Used to avoid replying to replies.
+   * @private @const {!Set<string>}
+   */
+  this.pending_ = new Set();
+  /** @private @const {!string_decoder.StringDecoder} */
+  this.decoder_ = new string_decoder.StringDecoder('utf8');
+  /** @private {boolean} Have we offered to echo (to stop client echo)? */
+  this.willEcho_ = false;
+
+  var conn = this;
+  socket.on('data', function(data) {
+    conn.parse_(data);
+  });
+  socket.on('drain', function() {
+    conn.emit('drain');
+  });
+  socket.on('end', function() {
+    conn.emit('end');
+  });
+  socket.on('error', function(error) {
+    conn.emit('error', error);
+  });
+  socket.on('close', function() {
+    conn.emit('close');
+  });
+
+  this.negotiate_(Telnet.Command.DO, Telnet.Option.NAWS);
+  this.negotiate_(Telnet.Command.DO, Telnet.Option.TTYPE);
+  if (this.compress_) {
+    this.negotiate_(Telnet.Command.WILL, Telnet.Option.COMPRESS2);
+  }
+};
+util.inherits(Telnet.Connection, events.EventEmitter);
+
+/**
+ * Send some text.  Newlines are sent as CR LF, as telnet requires.
+ * @param {string} data The text.
+ * @return {boolean} False if the caller should wait for a 'drain'
+ *     event before sending more.
+ */
+Telnet.Connection.prototype.write = function(data) {
+  // N.B.: UTF-8 never contains byte 0xff, so there are no IACs to escape.
+  return this.send_(Buffer.from(data.replace(/\r?\n/g, '\r\n'), 'utf8'));
+};
+
+/**
+ * Ask the client to echo, or not to echo, input locally.  (Turn local
+ * echo off while the user types a password.)
+ * @param {boolean} on Should the client echo input?
+ */
+Telnet.Connection.prototype.setEcho = function(on) {
+  // The server "will echo" (but in fact doesn't) to stop the client
+  // from doing so.
+  if (this.willEcho_ === !on) return;
+  this.willEcho_ = !on;
+  this.negotiate_(on ? Telnet.Command.WONT : Telnet.Command.WILL,
+                  Telnet.Option.ECHO);
+};
+
+/**
+ * Close the connection (once any data has been sent).
+ */
+Telnet.Connection.prototype.end = function() {
+  if (this.deflate_) {
+    this.deflate_.end();  // Ends socket once flushed.
+  } else {
+    this.socket_.end();
+  }
+};
+
+/**
+ * Immediately close the underlying connection.
+ * @param {!Error=} error Reason, if any (emitted as an 'error' event).
+ */
+Telnet.Connection.prototype.destroy = function(error) {
+  this.socket_.destroy(error);
+};
+
+/**
+ * Send some data, compressing it if compression has begun.
+ * @private
+ * @param {!Buffer} data The data.
+ * @return {boolean} False if the caller should wait for a 'drain' event.
+ */
+Telnet.Connection.prototype.send_ = function(data) {
+  if (this.deflate_) {
+    this.deflate_.write(data);
+    this.deflate_.flush(zlib.constants.Z_SYNC_FLUSH);
+    return !this.socket_.writableNeedDrain;
+  }
+  return this.socket_.write(data);
+};
+
+/**
+ * Send a negotiation command, remembering that a reply is expected.
+ * @private
+ * @param {!Telnet.Command} command WILL, WONT, DO or DONT.
+ * @param {number} option The option.
+ */
+Telnet.Connection.prototype.negotiate_ = function(command, option) {
+  this.pending_.add(command + ':' + option);
+  this.send_(Buffer.from([Telnet.Command.IAC, command, option]));
+};
+
+/**
+ * Send a subnegotiation.
+ * @private
+ * @param {number} option The option.
+ * @param {!Array<number>} data Content of subnegotiation.
+ */
+Telnet.Connection.prototype.subnegotiate_ = function(option, data) {
+  this.send_(Buffer.from([Telnet.Command.IAC, Telnet.Command.SB, option]
+      .concat(data, [Telnet.Command.IAC, Telnet.Command.SE])));
+};
+
+/**
+ * Handle data received: pass on text, and act on any commands.
+ * @private
+ * @param {!Buffer} data Data received.
+ */
+Telnet.Connection.prototype.parse_ = function(data) {
+  var text = [];
+  var start = 0;
+  var flush = function(end) {
+    if (end > start) text.push(data.subarray(start, end));
+  };
+  for (var i = 0; i < data.length; i++) {
+    var b = data[i];
+    switch (this.state_) {
+      case Telnet.State_.CR:
+        this.state_ = Telnet.State_.DATA;
+        if (b === 0) {  // CR NUL means a bare CR.
+          flush(i);
+          start = i + 1;
+          continue;
+        }
+        // FALLTHROUGH
+      case Telnet.State_.DATA:
+        if (b === Telnet.Command.IAC) {
+          flush(i);
+          this.state_ = Telnet.State_.IAC;
+        } else if (b === 0x0d) {
+          this.state_ = Telnet.State_.CR;
+        }
+        continue;
+      case Telnet.State_.IAC:
+        if (b === Telnet.Command.IAC) {  // Escaped 0xff.
+          start = i;
+          this.state_ = Telnet.State_.DATA;
+        } else if (b >= Telnet.Command.WILL) {
+          this.command_ = b;
+          this.state_ = Telnet.State_.OPTION;
+        } else if (b === Telnet.Command.SB) {
+          this.subnegotiation_ = [];
+          this.state_ = Telnet.State_.SB;
+        } else {  // Other commands (NOP, GA, etc.) are ignored.
+          start = i + 1;
+          this.state_ = Telnet.State_.DATA;
+        }
+        continue;
+      case Telnet.State_.OPTION:
+        this.handleNegotiation_(this.command_, b);
+        start = i + 1;
+        this.state_ = Telnet.State_.DATA;
+        continue;
+      case Telnet.State_.SB:
+        if (b === Telnet.Command.IAC) {
+          this.state_ = Telnet.State_.SB_IAC;
+        } else if (this.subnegotiation_.length < Telnet.MAX_SUBNEGOTIATION_) {
+          this.subnegotiation_.push(b);
+        }
+        continue;
+      case Telnet.State_.SB_IAC:
+        if (b === Telnet.Command.SE) {
+          this.handleSubnegotiation_(this.subnegotiation_);
+          start = i + 1;
+          this.state_ = Telnet.State_.DATA;
+        } else {  // IAC IAC is an escaped 0xff; anything else is an error.
+          this.subnegotiation_.push(b);
+          this.state_ = Telnet.State_.SB;
+        }
+        continue;
+    }
+  }
+  if (this.state_ === Telnet.State_.DATA ||
+      this.state_ === Telnet.State_.CR) {
+    flush(data.length);
+  }
+  var decoded = this.decoder_.write(Buffer.concat(text));
+  if (decoded) this.emit('data', decoded);
+};
+
+/**
+ * Handle a negotiation command from the client.
+ * @private
+ * @param {number} command WILL, WONT, DO or DONT.
+ * @param {number} option The option.
+ */
+Telnet.Connection.prototype.handleNegotiation_ = function(command, option) {
+  // Is this a reply to our request?
+  var request;
+  switch (command) {
+    case Telnet.Command.WILL:
+    case Telnet.Command.WONT:
+      request = Telnet.Command.DO;
+      break;
+    case Telnet.Command.DO:
+    case Telnet.Command.DONT:
+      request = this.pending_.has(Telnet.Command.WONT + ':' + option) ?
+          Telnet.Command.WONT : Telnet.Command.WILL;
+      break;
+  }
+  var reply = this.pending_.delete(request + ':' + option);
+  switch (command) {
+    case Telnet.Command.WILL:
+      if (option === Telnet.Option.TTYPE) {
+        this.subnegotiate_(option, [Telnet.TTYPE_SEND_]);
+      }
+      if (!reply) {
+        this.send_(Buffer.from([Telnet.Command.IAC,
+            this.accepts_(command, option) ? Telnet.Command.DO :
+                Telnet.Command.DONT, option]));
+      }
+      break;
+    case Telnet.Command.DO:
+      if (option === Telnet.Option.COMPRESS2 && this.compress_ &&
+          !this.deflate_) {
+        this.subnegotiate_(option, []);
+        this.deflate_ = zlib.createDeflate();
+        this.deflate_.pipe(this.socket_);
+        break;
+      }
+      if (!reply) {
+        var accept = this.accepts_(command, option);
+        if (option === Telnet.Option.ECHO) this.willEcho_ = accept;
+        this.send_(Buffer.from([Telnet.Command.IAC,
+            accept ? Telnet.Command.WILL : Telnet.Command.WONT, option]));
+      }
+      break;
+    case Telnet.Command.DONT:
+    case Telnet.Command.WONT:
+      // Acknowledge the request to disable an option only if it might
+      // have been enabled (otherwise the client is merely confirming
+      // the status quo, which must not be acknowledged).
+      if (option === Telnet.Option.ECHO) this.willEcho_ = false;
+      if (!reply && this.accepts_(command, option)) {
+        this.send_(Buffer.from([Telnet.Command.IAC,
+            (command === Telnet.Command.DONT) ? Telnet.Command.WONT :
+                Telnet.Command.DONT, option]));
+      }
+      break;
+  }
+};
+
+/**
+ * Is an option one we will agree to enable?
+ * @private
+ * @param {number} command The client's WILL, WONT, DO or DONT.
+ * @param {number} option The option.
+ * @return {boolean}
+ */
+Telnet.Connection.prototype.accepts_ = function(command, option) {
+  if (command === Telnet.Command.WILL || command === Telnet.Command.WONT) {
+    // Options the client may enable.
+    return option === Telnet.Option.NAWS || option === Telnet.Option.TTYPE;
+  }
+  // Options we may enable.  We'll echo, or suppress go-ahead, if asked
+  // (in fact we do the latter anyway).
+  return option === Telnet.Option.ECHO || option === Telnet.Option.SGA;
+};
+
+/**
+ * Handle a subnegotiation from the client.
+ * @private
+ * @param {!Array<number>} data Content of subnegotiation, starting
+ *     with the option.
+ */
+Telnet.Connection.prototype.handleSubnegotiation_ = function(data) {
+  switch (data[0]) {
+    case Telnet.Option.NAWS:
+      if (data.length !== 5) return;
+      this.width = (data[1] << 8) | data[2];
+      this.height = (data[3] << 8) | data[4];
+      this.emit('resize', this.width, this.height);
+      return;
+    case Telnet.Option.TTYPE:
+      if (data[1] !== Telnet.TTYPE_IS_) return;
+      this.terminalType = String.fromCharCode.apply(null, data.slice(2));
+      this.emit('terminaltype', this.terminalType);
+      return;
+  }
+};
+
+module.exports = Telnet;
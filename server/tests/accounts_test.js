@@ -0,0 +1,271 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for password accounts.
+ */
+'use strict';
+
+const Accounts = require('../accounts');
+const crypto = require('crypto');
+const {getInterpreter} = require('./interpreter_common');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Accounts.hash, Accounts.verify and Accounts.needsRehash.
+ * @param {!T} t The test runner object.
+ */
+exports.testAccountsHash = async function(t) {
+  const hash = await Accounts.hash('correct horse', 4);
+  t.assert('hash format', /^\$scrypt\$ln=4,r=8,p=1\$[^$]{22}\$[^$]{43}$/
+           .test(hash), hash);
+  t.assert('hash salted', hash !== await Accounts.hash('correct horse', 4));
+  t.expect('verify (correct)', await Accounts.verify('correct horse', hash),
+           true);
+  t.expect('verify (incorrect)', await Accounts.verify('battery', hash),
+           false);
+  t.expect('needsRehash (same cost)', Accounts.needsRehash(hash, 4), false);
+  t.expect('needsRehash (higher cost)', Accounts.needsRehash(hash, 5), true);
+
+  // A hash in passlib's PBKDF2 format.
+  const salt = Buffer.from('0123456789abcdef');
+  const key = crypto.pbkdf2Sync('correct horse', salt, 1000, 32, 'sha256');
+  const pbkdf2 = '$pbkdf2-sha256$1000$' + salt.toString('base64') + '$' +
+      key.toString('base64').replace(/\+/g, '.').replace(/=+$/, '');
+  t.expect('verify PBKDF2 (correct)',
+           await Accounts.verify('correct horse', pbkdf2), true);
+  t.expect('verify PBKDF2 (incorrect)',
+           await Accounts.verify('battery', pbkdf2), false);
+  t.expect('needsRehash (PBKDF2)', Accounts.needsRehash(pbkdf2, 4), true);
+
+  const invalid = [
+    '',
+    'correct horse',
+    '$scrypt$ln=4,r=8,p=1$c2FsdA$',
+    '$scrypt$ln=99,r=8,p=1' + hash.slice(hash.indexOf('$', 8)),
+    // Parameters needing too much memory (8 GiB; 512 MiB).
+    '$scrypt$ln=20,r=64,p=1' + hash.slice(hash.indexOf('$', 8)),
+    '$scrypt$ln=19,r=8,p=1' + hash.slice(hash.indexOf('$', 8)),
+    hash.slice(0, 40),
+    '$pbkdf2-sha256$0$' + pbkdf2.split('$').slice(3).join('$'),
+    '$pbkdf2-sha256$2000001$' + pbkdf2.split('$').slice(3).join('$'),
+  ];
+  for (const h of invalid) {
+    t.expect('verify(..., ' + JSON.stringify(h) + ')',
+             await Accounts.verify('correct horse', h), false);
+  }
+  try {
+    await Accounts.hash('correct horse', 19);
+    t.fail('hash (cost too high)', "Didn't reject.");
+  } catch (e) {
+    t.expect('hash (cost too high)', e.name, 'RangeError');
+  }
+};
+
+/**
+ * Unit tests for Accounts.checkPassword.
+ * @param {!T} t The test runner object.
+ */
+exports.testAccountsCheckPassword = function(t) {
+  const invalid = [undefined, 42, 'short', 'x'.repeat(2000)];
+  for (const password of invalid) {
+    const name = 'checkPassword(' + String(password).slice(0, 10) + ')';
+    try {
+      Accounts.checkPassword(password);
+      t.fail(name, "Didn't throw.");
+    } catch (e) {
+      t.expect(name, e.name, 'TypeError');
+    }
+  }
+  Accounts.checkPassword('long enough');
+  t.pass('checkPassword(long enough)');
+};
+
+/**
+ * Unit tests for Accounts.makeToken and Accounts.checkToken.
+ * @param {!T} t The test runner object.
+ */
+exports.testAccountsToken = function(t) {
+  const {token, hash} = Accounts.makeToken();
+  t.expect('hashToken', Accounts.hashToken(token), hash);
+  t.assert('token differs from hash', token !== hash);
+  const account = {hash: null, created: 0, updated: 0,
+                   reset: {token: hash, expires: 1000}};
+  t.expect('checkToken (valid)', Accounts.checkToken(account, token, 999),
+           true);
+  t.expect('checkToken (expired)', Accounts.checkToken(account, token, 1000),
+           false);
+  t.expect('checkToken (wrong)',
+           Accounts.checkToken(account, Accounts.makeToken().token, 0), false);
+  t.expect('checkToken (hash)', Accounts.checkToken(account, hash, 0), false);
+  t.expect('checkToken (not a string)', Accounts.checkToken(account, 42, 0),
+           false);
+  account.reset = null;
+  t.expect('checkToken (no reset)', Accounts.checkToken(account, token, 0),
+           false);
+};
+
+/**
+ * Unit tests for Accounts.totp, Accounts.checkTotp and recovery codes.
+ * @param {!T} t The test runner object.
+ */
+exports.testAccountsTotp = function(t) {
+  // Test vectors from RFC 6238 appendix B (truncated to six digits).
+  const secret = 'GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ';
+  t.expect('base32Decode_', String(Accounts.base32Decode_(secret)),
+           '12345678901234567890');
+  t.expect('base32Encode_',
+           Accounts.base32Encode_(Buffer.from('12345678901234567890')),
+           secret);
+  t.expect('base32Encode_ (partial)', Accounts.base32Encode_(Buffer.from('f')),
+           'MY');
+  t.expect('totp (T = 59)', Accounts.totp(secret, 1), '287082');
+  t.expect('totp (T = 1111111109)', Accounts.totp(secret, 37037036),
+           '081804');
+  t.expect('totp (T = 20000000000)', Accounts.totp(secret, 666666666),
+           '353130');
+  t.assert('makeTotpSecret',
+           /^[A-Z2-7]{32}$/.test(Accounts.makeTotpSecret()));
+  t.expect('totpUri', Accounts.totpUri('ABC', 'alice@example.com', 'Code City'),
+           'otpauth://totp/Code%20City:alice%40example.com?secret=ABC' +
+           '&issuer=Code%20City&algorithm=SHA1&digits=6&period=30');
+
+  const now = 1111111109 * 1000;
+  const totp = {secret, enabled: true, last: -1};
+  t.expect('checkTotp (current)', Accounts.checkTotp(totp, '081804', now),
+           37037036);
+  t.expect('checkTotp (spaces)', Accounts.checkTotp(totp, '081 804', now),
+           37037036);
+  t.expect('checkTotp (previous period)',
+           Accounts.checkTotp(totp, Accounts.totp(secret, 37037035), now),
+           37037035);
+  t.expect('checkTotp (too old)',
+           Accounts.checkTotp(totp, Accounts.totp(secret, 37037034), now), -1);
+  t.expect('checkTotp (wrong)', Accounts.checkTotp(totp, '000000', now), -1);
+  t.expect('checkTotp (not a string)', Accounts.checkTotp(totp, 81804, now),
+           -1);
+  totp.last = 37037036;
+  t.expect('checkTotp (replayed)', Accounts.checkTotp(totp, '081804', now),
+           -1);
+
+  const {codes, hashes} = Accounts.makeRecoveryCodes();
+  t.expect('makeRecoveryCodes count', codes.length, Accounts.RECOVERY_CODES);
+  t.assert('makeRecoveryCodes format', /^[0-9a-f]{5}-[0-9a-f]{5}$/
+           .test(codes[0]), codes[0]);
+  const account = {recovery: hashes};
+  t.expect('useRecoveryCode (valid, reformatted)',
+           Accounts.useRecoveryCode(account,
+                                    ' ' + codes[3].toUpperCase() + ' '),
+           true);
+  t.expect('useRecoveryCode (reused)',
+           Accounts.useRecoveryCode(account, codes[3]), false);
+  t.expect('useRecoveryCode (wrong)',
+           Accounts.useRecoveryCode(account, '00000-00000'), false);
+  t.expect('recovery codes left', account.recovery.length,
+           Accounts.RECOVERY_CODES - 1);
+};
+
+/**
+ * Unit tests for the Interpreter's account methods, including
+ * rehashing on login.
+ * @param {!T} t The test runner object.
+ */
+exports.testInterpreterAccounts = async function(t) {
+  const intrp = getInterpreter({noLog: ['net'], passwordHashCost: 4});
+  await intrp.createAccount('alice', 'correct horse');
+  try {
+    await intrp.createAccount('alice', 'correct horse');
+    t.fail('createAccount (duplicate)', "Didn't reject.");
+  } catch (e) {
+    t.pass('createAccount (duplicate)');
+  }
+  try {
+    await intrp.createAccount('bob', 'short');
+    t.fail('createAccount (weak password)', "Didn't reject.");
+  } catch (e) {
+    t.expect('createAccount (weak password)', e.name, 'TypeError');
+  }
+  t.expect('verifyAccount (correct)',
+           await intrp.verifyAccount('alice', 'correct horse'), true);
+  t.expect('verifyAccount (incorrect)',
+           await intrp.verifyAccount('alice', 'battery'), false);
+  t.expect('verifyAccount (no account)',
+           await intrp.verifyAccount('bob', 'correct horse'), false);
+
+  // Raising the cost causes the hash to be upgraded on next login.
+  const account = intrp.accounts_.get('alice');
+  const oldHash = account.hash;
+  intrp.options.passwordHashCost = 5;
+  t.expect('verifyAccount (rehash)',
+           await intrp.verifyAccount('alice', 'correct horse'), true);
+  t.assert('rehashed', account.hash !== oldHash &&
+           !Accounts.needsRehash(account.hash, 5), account.hash);
+
+  // Two-factor authentication.
+  t.expect('verifyAccountCode (not enrolled)',
+           intrp.verifyAccountCode('alice', '123456'), false);
+  const {secret, uri} = intrp.enrollTotp('alice', 'Test');
+  t.assert('enrollTotp uri', uri.startsWith('otpauth://totp/Test:alice?'),
+           uri);
+  t.expect('getAccount (enrollment pending)', intrp.getAccount('alice').totp,
+           false);
+  const code = () => Accounts.totp(secret,
+      Math.floor(Date.now() / 1000 / Accounts.TOTP_PERIOD));
+  t.expect('confirmTotp (wrong code)', intrp.confirmTotp('alice', 'abcdef'),
+           null);
+  const codes = intrp.confirmTotp('alice', code());
+  t.expect('confirmTotp', codes && codes.length, Accounts.RECOVERY_CODES);
+  t.expect('getAccount (enrolled)', intrp.getAccount('alice').totp, true);
+  t.expect('verifyAccountCode (replayed)',
+           intrp.verifyAccountCode('alice', code()), false);
+  t.expect('verifyAccountCode (recovery code)',
+           intrp.verifyAccountCode('alice', codes[0]), true);
+  t.expect('getAccount (recovery codes)',
+           intrp.getAccount('alice').recoveryCodes,
+           Accounts.RECOVERY_CODES - 1);
+  t.expect('regenerateRecoveryCodes',
+           intrp.regenerateRecoveryCodes('alice').length,
+           Accounts.RECOVERY_CODES);
+  t.expect('verifyAccountCode (old recovery code)',
+           intrp.verifyAccountCode('alice', codes[1]), false);
+  t.expect('disableTotp', intrp.disableTotp('alice'), true);
+  t.expect('verifyAccountCode (disabled)',
+           intrp.verifyAccountCode('alice', codes[1]), false);
+
+  const token = intrp.requireAccountReset('alice');
+  t.expect('getAccount (reset pending)',
+           intrp.getAccount('alice').resetPending, true);
+  t.expect('verifyAccount (reset pending)',
+           await intrp.verifyAccount('alice', 'correct horse'), false);
+  t.expect('resetAccountPassword (wrong token)',
+           await intrp.resetAccountPassword('alice', 'guess', 'new password'),
+           false);
+  t.expect('resetAccountPassword (valid)',
+           await intrp.resetAccountPassword('alice', token, 'new password'),
+           true);
+  t.expect('resetAccountPassword (reused token)',
+           await intrp.resetAccountPassword('alice', token, 'newer password'),
+           false);
+  t.expect('verifyAccount (after reset)',
+           await intrp.verifyAccount('alice', 'new password'), true);
+  t.expect('getAccount', JSON.stringify(intrp.getAccount('alice'),
+                                        ['resetPending']),
+           '{"resetPending":false}');
+  t.expect('deleteAccount', intrp.deleteAccount('alice'), true);
+  t.expect('deleteAccount (again)', intrp.deleteAccount('alice'), false);
+  t.expect('getAccount (deleted)', intrp.getAccount('alice'), undefined);
+};
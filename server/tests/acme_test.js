@@ -0,0 +1,174 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for the ACME client.
+ */
+'use strict';
+
+const Acme = require('../acme');
+const {Ca, FakeAcme, generateKey} = require('./certificates_common');
+const crypto = require('crypto');
+const Der = require('../der');
+const http = require('http');
+const {T} = require('./testing');
+
+/**
+ * Start an HTTP server answering challenges using an Acme.Responder.
+ * @param {!Acme.Responder} responder The responder.
+ * @return {!Promise<!http.Server>}
+ */
+async function serveChallenges(responder) {
+  const server = http.createServer((req, res) => responder.handle(req, res));
+  await new Promise((resolve) => server.listen(0, 'localhost', resolve));
+  return server;
+}
+
+/**
+ * Unit tests for Acme.base64url.
+ * @param {!T} t The test runner object.
+ */
+exports.testAcmeBase64url = function(t) {
+  t.expect('Acme.base64url(...)', Acme.base64url(Buffer.from([0xfb, 0xff])),
+           '-_8');
+  t.expect('Acme.base64url(\'{}\')', Acme.base64url('{}'), 'e30');
+};
+
+/**
+ * Unit tests for Acme.csr.
+ * @param {!T} t The test runner object.
+ */
+exports.testAcmeCsr = function(t) {
+  const keys = {
+    ec: generateKey(),
+    rsa: crypto.generateKeyPairSync('rsa', {modulusLength: 2048}).privateKey,
+  };
+  for (const type in keys) {
+    const name = 'Acme.csr(..., <' + type + ' key>)';
+    const csr = Der.decode(Acme.csr(['a.test', 'b.test'], keys[type]));
+    const info = csr.child(0);
+    t.expect(name + ' subject',
+             String(info.child(1).child(0).child(0).child(1).contents),
+             'a.test');
+    const spki = crypto.createPublicKey(
+        {key: info.child(2).raw, format: 'der', type: 'spki'});
+    t.expect(name + ' key', spki.asymmetricKeyType, type);
+    const extension = info.child(3).child(0).child(1).child(0).child(0);
+    t.expect(name + ' extension', extension.child(0).oid(), '2.5.29.17');
+    const san = Der.decode(extension.child(1).contents);
+    t.expect(name + ' subjectAltName',
+             san.children.map((n) => n.tag + ':' + n.contents).join(),
+             '130:a.test,130:b.test');
+    t.expect(name + ' signature',
+             crypto.verify('sha256', info.raw, spki,
+                           csr.child(2).contents.subarray(1)),
+             true);
+  }
+};
+
+/**
+ * Unit tests for Acme.Responder.
+ * @param {!T} t The test runner object.
+ */
+exports.testAcmeResponder = async function(t) {
+  const responder = new Acme.Responder();
+  const server = await serveChallenges(responder);
+  const base = 'http://localhost:' + server.address().port;
+  try {
+    responder.set('tok', 'tok.thumb');
+    t.expect('Responder.p.size', responder.size, 1);
+    let res = await Acme.request('GET', base + Acme.CHALLENGE_PATH + 'tok',
+                                 {}, null);
+    t.expect('Responder.p.handle(<challenge>)', res.status + ' ' + res.body,
+             '200 tok.thumb');
+    res = await Acme.request('GET', base + Acme.CHALLENGE_PATH + 'other', {},
+                             null);
+    t.expect('Responder.p.handle(<unknown token>)', res.status, 404);
+    res = await Acme.request('GET', base + '/tok', {}, null);
+    t.expect('Responder.p.handle(<other path>)', res.status, 404);
+    responder.remove('tok');
+    res = await Acme.request('GET', base + Acme.CHALLENGE_PATH + 'tok', {},
+                             null);
+    t.expect('Responder.p.handle(<removed>)', res.status, 404);
+    t.expect('Responder.p.size after remove', responder.size, 0);
+  } finally {
+    server.close();
+  }
+};
+
+/**
+ * Unit tests for Acme.Client.
+ * @param {!T} t The test runner object.
+ */
+exports.testAcmeClient = async function(t) {
+  const ca = new Ca();
+  const responder = new Acme.Responder();
+  const challenges = await serveChallenges(responder);
+  const acme = new FakeAcme(ca, challenges.address().port);
+  await acme.start();
+  try {
+    t.assert('new Client(<RSA key>) throws', (() => {
+      try {
+        new Acme.Client(acme.directoryUrl, crypto.generateKeyPairSync(
+            'rsa', {modulusLength: 1024}).privateKey);
+      } catch (e) {
+        return e instanceof TypeError;
+      }
+      return false;
+    })());
+
+    const client = new Acme.Client(acme.directoryUrl, generateKey(),
+                                   {email: 'a@b.test', pollInterval: 10});
+    // The client must retry when its first nonce is rejected.
+    acme.badNonces = 1;
+    const key = generateKey();
+    const chain = await client.issue(['a.test', 'www.a.test'], key, responder);
+    const cert = new crypto.X509Certificate(chain);
+    t.expect('Client.p.issue(...) subject', cert.subject, 'CN=a.test');
+    t.expect('Client.p.issue(...) subjectAltName', cert.subjectAltName,
+             'DNS:a.test, DNS:www.a.test');
+    t.expect('Client.p.issue(...) issued by CA',
+             cert.verify(crypto.createPublicKey(ca.key)), true);
+    t.expect('Client.p.issue(...) public key', cert.publicKey.export(
+        {type: 'spki', format: 'der'}).toString('hex'),
+             crypto.createPublicKey(key).export(
+                 {type: 'spki', format: 'der'}).toString('hex'));
+    t.assert('Client.p.issue(...) chain', chain.split('BEGIN').length === 3);
+    t.expect('Client.p.issue(...) challenges removed', responder.size, 0);
+    t.expect('Client.p.issue(...) accounts', acme.accounts.size, 1);
+
+    // A second certificate uses the same account.
+    acme.requests.length = 0;
+    await client.issue(['b.test'], generateKey(), responder);
+    t.expect('Client.p.issue(...) again', acme.requests.includes(
+        'POST /new-account'), false);
+    t.expect('Client.p.issue(...) again accounts', acme.accounts.size, 1);
+
+    // Challenges not answered.
+    const ignore = {set: () => {}, remove: () => {}};
+    try {
+      await client.issue(['c.test'], generateKey(), ignore);
+      t.fail('Client.p.issue(<unanswered>)', 'Did not reject');
+    } catch (e) {
+      t.expect('Client.p.issue(<unanswered>) rejects', e.message,
+               'ACME authorization failed: Challenge response 404');
+    }
+  } finally {
+    acme.stop();
+    challenges.close();
+  }
+};
@@ -0,0 +1,77 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for inheriting listening sockets.
+ */
+'use strict';
+
+const Activation = require('../activation');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Activation.inherited.
+ * @param {!T} t The test runner object.
+ */
+exports.testActivationInherited = function(t) {
+  let env = {
+    LISTEN_FDS: '4',
+    LISTEN_PID: '123',
+    LISTEN_FDNAMES: '7777:codecity-7780.socket:connection:99999',
+    PATH: '/bin',
+  };
+  const sockets = Activation.inherited(env, 123);
+  t.expect('sockets', sockets.map((s) => s.fd + '=' + s.port).join(),
+           '3=7777,4=7780,5=null,6=null');
+  t.expect('sockets[2].name', sockets[2].name, 'connection');
+  t.expect('env (after)', Object.keys(env).join(), 'PATH');
+
+  // For another process.
+  env = {LISTEN_FDS: '1', LISTEN_PID: '456', LISTEN_FDNAMES: '7777'};
+  t.expect('inherited (other pid)', Activation.inherited(env, 123).length, 0);
+  t.expect('env (other pid, after)', Object.keys(env).length, 0);
+
+  // No LISTEN_PID (as from CodeCity.handoff), nor names.
+  env = {LISTEN_FDS: '2'};
+  t.expect('inherited (no pid, names)',
+           Activation.inherited(env, 123).map((s) => s.port).join(), ',');
+
+  // Nothing inherited.
+  t.expect('inherited (none)', Activation.inherited({}, 123).length, 0);
+};
+
+/**
+ * Unit tests for Activation.handoffOptions.
+ * @param {!T} t The test runner object.
+ */
+exports.testActivationHandoffOptions = function(t) {
+  const env = {LISTEN_PID: '1', PATH: '/bin'};
+  const options =
+      Activation.handoffOptions(new Map([[7777, 20], [7780, 21]]), env, 99);
+  t.expect('stdio', options.stdio.join(), 'inherit,inherit,inherit,20,21');
+  t.expect('env.LISTEN_FDS', options.env['LISTEN_FDS'], '2');
+  t.expect('env.LISTEN_FDNAMES', options.env['LISTEN_FDNAMES'], '7777:7780');
+  t.expect('env.LISTEN_PID', options.env['LISTEN_PID'], undefined);
+  t.expect('env.PATH', options.env['PATH'], '/bin');
+  t.expect('env[HANDOFF_PID]', options.env[Activation.HANDOFF_PID], '99');
+  t.expect('env (unchanged)', env['LISTEN_FDS'], undefined);
+
+  // What is handed over is what the successor inherits.
+  const sockets = Activation.inherited(options.env, 1000);
+  t.expect('inherited (after handoff)',
+           sockets.map((s) => s.fd + '=' + s.port).join(), '3=7777,4=7780');
+};
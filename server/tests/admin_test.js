@@ -0,0 +1,529 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for the admin API.
+ */
+'use strict';
+
+const Admin = require('../admin');
+const AdminLog = require('../adminlog');
+const fs = require('fs');
+const http = require('http');
+const {getInterpreter} = require('./interpreter_common');
+const Logging = require('../logging');
+const os = require('os');
+const path = require('path');
+const {T} = require('./testing');
+
+/**
+ * Make a request of an admin server.
+ * @param {number} port The server's port.
+ * @param {string} method The HTTP method.
+ * @param {string} path The path (and query).
+ * @param {*=} body The request body (to be sent as JSON).
+ * @param {string=} token The token to present (default 'secret').
+ * @return {!Promise<{status: number, headers: !Object, body: *}>}
+ */
+function request(port, method, path, body, token = 'secret') {
+  return new Promise(function(resolve, reject) {
+    const headers = {};
+    if (token) headers['Authorization'] = 'Bearer ' + token;
+    const req = http.request({port, method, path, headers}, function(res) {
+      let text = '';
+      res.setEncoding('utf8');
+      res.on('data', (data) => text += data);
+      res.on('end', () => resolve(
+          {status: res.statusCode, headers: res.headers,
+           body: JSON.parse(text)}));
+    });
+    req.on('error', reject);
+    req.end(body === undefined ? undefined : JSON.stringify(body));
+  });
+}
+
+/**
+ * Unit tests for the admin API.
+ * @param {!T} t The test runner object.
+ */
+exports.testAdmin = async function(t) {
+  const intrp = getInterpreter({noLog: ['admin', 'net', 'slow', 'unhandled']});
+  intrp.createThreadForSrc(`
+      var $ = {};
+      $.widget = {name: 'Widget', count: 3, nan: NaN};
+      $.gadget = Object.create($.widget);
+      $.sleeper = function() {suspend(100000);};
+      setTimeout($.sleeper, 0);
+  `);
+  intrp.run();
+  const log = [];
+  let reloadError = null;
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'admin_test-'));
+  const adminLog = new AdminLog.Log(path.join(dir, 'admin.log'));
+  const logger = new Logging.Logger(() => {});
+  const admin = new Admin.Server({
+    tokens: ['other', 'secret'],
+    interpreter: intrp,
+    checkpoint: () => log.push('checkpoint'),
+    reloadConfig: () => {
+      if (reloadError) throw reloadError;
+      return {applied: ['fetch'], restartRequired: ['admin.port']};
+    },
+    catalog: () => [{name: 'a.city', time: 1000}],
+    restore: (point) => log.push('restore ' + point),
+    shutdown: (code) => log.push('shutdown ' + code),
+    handoff: () => Promise.resolve(4321),
+    adminLog: adminLog,
+    logger: logger,
+  });
+  const port = await admin.listen(0, '127.0.0.1');
+  intrp.start();
+  try {
+    // Authentication.
+    let r = await request(port, 'GET', '/objects', undefined, '');
+    t.expect('GET /objects (no token) status', r.status, 401);
+    t.expect('GET /objects (no token) WWW-Authenticate',
+             r.headers['www-authenticate'], 'Bearer');
+    r = await request(port, 'GET', '/objects', undefined, 'wrong');
+    t.expect('GET /objects (wrong token) status', r.status, 401);
+    r = await request(port, 'GET', '/nowhere');
+    t.expect('GET /nowhere status', r.status, 404);
+    r = await request(port, 'PUT', '/objects');
+    t.expect('PUT /objects status', r.status, 405);
+    t.expect('PUT /objects Allow', r.headers['allow'], 'GET');
+
+    // Objects.
+    r = await request(port, 'GET', '/objects?search=DGET');
+    t.expect('GET /objects?search=DGET', JSON.stringify(r.body),
+             JSON.stringify({
+               objects: [{selector: '$.widget', class: 'Object'},
+                         {selector: '$.gadget', class: 'Object'}],
+               truncated: false,
+             }));
+    r = await request(port, 'GET', '/objects?limit=1');
+    t.expect('GET /objects?limit=1 objects.length', r.body.objects.length, 1);
+    t.expect('GET /objects?limit=1 truncated', r.body.truncated, true);
+
+    r = await request(port, 'GET', '/object?selector=$.gadget');
+    t.expect('GET /object?selector=$.gadget proto',
+             JSON.stringify(r.body.proto),
+             JSON.stringify({type: 'object', class: 'Object',
+                             selector: '$.widget'}));
+    r = await request(port, 'GET', '/object?selector=$.widget');
+    t.expect('GET /object?selector=$.widget properties.count',
+             JSON.stringify(r.body.properties.count),
+             JSON.stringify({value: {type: 'number', value: 3},
+                             writable: true, enumerable: true,
+                             configurable: true}));
+    t.expect('GET /object?selector=$.widget properties.nan.value',
+             JSON.stringify(r.body.properties.nan.value),
+             JSON.stringify({type: 'number', value: 'NaN'}));
+    r = await request(port, 'GET', '/object?selector=$.missing');
+    t.expect('GET /object?selector=$.missing status', r.status, 404);
+
+    r = await request(port, 'PATCH', '/object?selector=$.widget', {
+      properties: {
+        count: {value: 4},
+        list: {value: [1, 'two']},
+        other: {selector: '$.gadget'},
+        nan: null,
+      },
+    });
+    t.expect('PATCH /object status', r.status, 200);
+    t.expect('PATCH /object result keys',
+             Object.keys(r.body.properties).join(), 'name,count,list,other');
+    const widget = intrp.global.get('$').get('widget', intrp.ROOT);
+    t.expect('$.widget.count', widget.get('count', intrp.ROOT), 4);
+    t.expect('$.widget.list[1]',
+             widget.get('list', intrp.ROOT).get('1', intrp.ROOT), 'two');
+    t.expect('$.widget.other.name',
+             widget.get('other', intrp.ROOT).get('name', intrp.ROOT),
+             'Widget');
+    r = await request(port, 'PATCH', '/object?selector=$.widget',
+                      {properties: {count: {value: 5}, bad: 7}});
+    t.expect('PATCH /object (bad spec) status', r.status, 400);
+    t.expect('$.widget.count (after bad spec)',
+             widget.get('count', intrp.ROOT), 4);
+
+    // Evaluation.
+    r = await request(port, 'POST', '/eval', {src: '$.widget.count * 10'});
+    t.expect('POST /eval', JSON.stringify([r.body.threw, r.body.value]),
+             JSON.stringify([false, {type: 'number', value: 40}]));
+    r = await request(port, 'POST', '/eval', {src: '$.gadget'});
+    t.expect('POST /eval (object) value.selector', r.body.value.selector,
+             '$.gadget');
+    r = await request(port, 'POST', '/eval',
+                      {src: 'throw new RangeError("oops")'});
+    t.expect('POST /eval (throws)',
+             JSON.stringify([r.body.threw, r.body.value.message]),
+             JSON.stringify([true, 'oops']));
+    r = await request(port, 'POST', '/eval',
+                      {src: 'perms() === $.widget', owner: '$.widget'});
+    t.expect('POST /eval (as owner) value.value', r.body.value.value, true);
+    r = await request(port, 'POST', '/eval', {src: 42});
+    t.expect('POST /eval (bad src) status', r.status, 400);
+
+    // Threads.
+    r = await request(port, 'GET', '/threads');
+    const sleeper = r.body.threads.find((thread) =>
+        thread.callers.some((frame) =>
+            frame.func && frame.func.selector === '$.sleeper'));
+    t.assert('GET /threads finds $.sleeper thread', sleeper,
+             JSON.stringify(r.body));
+    t.expect('GET /threads sleeper status', sleeper && sleeper.status,
+             'SLEEPING');
+
+    // Slow log.
+    intrp.options.slowTaskSteps = 1;
+    await request(port, 'POST', '/eval', {src: '1 + 1'});
+    delete intrp.options.slowTaskSteps;
+    r = await request(port, 'GET', '/slow?limit=1');
+    t.expect('GET /slow?limit=1 records', r.body.records.length, 1);
+    t.expect('GET /slow?limit=1 kind', r.body.records[0].kind, 'task');
+    t.expect('GET /slow?limit=1 samples', r.body.records[0].samples.length,
+             0);
+
+    // Heap queries.
+    r = await request(port, 'GET', '/heap/inbound?selector=$.gadget');
+    t.expect('GET /heap/inbound',
+             JSON.stringify(r.body.references.map((ref) =>
+                 [ref.from.selector, ref.name]).sort()),
+             JSON.stringify([['$', 'gadget'], ['$.widget', 'other']]));
+    r = await request(port, 'GET', '/heap/inbound?selector=$.gadget&limit=1');
+    t.expect('GET /heap/inbound?limit=1',
+             [r.body.references.length, r.body.truncated].join(), '1,true');
+    r = await request(port, 'GET', '/heap/inbound?selector=$.gadget&limit=0');
+    t.expect('GET /heap/inbound?limit=0 status', r.status, 400);
+    r = await request(port, 'GET', '/heap/paths?selector=$.gadget');
+    t.expect('GET /heap/paths [0]', JSON.stringify(r.body.paths[0]),
+             JSON.stringify([
+               {name: 'global', to: {type: 'scope', scopeType: 'global'}},
+               {name: '$', to: {type: 'object', class: 'Object',
+                                selector: '$'}},
+               {name: 'gadget', to: {type: 'object', class: 'Object',
+                                     selector: '$.gadget'}},
+             ]));
+    r = await request(port, 'GET', '/heap/retained?selector=$.widget');
+    t.expect('GET /heap/retained nodes (list)', r.body.nodes, 2);
+    t.assert('GET /heap/retained size', r.body.size > 0);
+    r = await request(port, 'GET', '/heap/retained?selector=$.missing');
+    t.expect('GET /heap/retained (no such object) status', r.status, 404);
+
+    // Auditing.
+    r = await request(port, 'POST', '/audits',
+                      {selector: '$.widget', property: 'count'});
+    t.expect('POST /audits', JSON.stringify(r.body),
+             JSON.stringify({object: {type: 'object', class: 'Object',
+                                      selector: '$.widget'},
+                             property: 'count'}));
+    await request(port, 'POST', '/audits', {selector: '$.gadget'});
+    r = await request(port, 'POST', '/audits',
+                      {selector: '$.widget', property: 7});
+    t.expect('POST /audits (bad property) status', r.status, 400);
+    r = await request(port, 'GET', '/audits');
+    t.expect('GET /audits', JSON.stringify(r.body.audits.map(
+        (audit) => [audit.object.selector, audit.properties])),
+             JSON.stringify([['$.widget', ['count']], ['$.gadget', null]]));
+    await request(port, 'POST', '/eval',
+                  {src: '$.widget.count = $.widget.count + 1; $.widget.name'});
+    r = await request(port, 'GET', '/audits/log?selector=$.widget');
+    t.expect('GET /audits/log accesses',
+             r.body.records.map((record) =>
+                 record.access + ' ' + record.property).join(),
+             'get count,set count');
+    t.expect('GET /audits/log perms', r.body.records[0].perms.type,
+             'object');
+    t.assert('GET /audits/log callers', r.body.records[0].callers.length > 0);
+    r = await request(port, 'GET', '/audits/log?limit=1');
+    t.expect('GET /audits/log?limit=1',
+             [r.body.records[0].access, r.body.truncated].join(), 'set,true');
+    r = await request(port, 'DELETE',
+                      '/audits?selector=$.widget&property=count');
+    t.expect('DELETE /audits', r.body.removed, true);
+    await request(port, 'DELETE', '/audits?selector=$.gadget');
+    r = await request(port, 'GET', '/audits');
+    t.expect('GET /audits (after DELETE)', r.body.audits.length, 0);
+
+    // Security events.
+    await request(port, 'POST', '/eval',
+                  {src: 'CC.ban("192.0.2.0/24")', owner: '$.widget'});
+    r = await request(port, 'GET', '/security?type=permission');
+    const event = r.body.events[r.body.events.length - 1];
+    t.expect('GET /security perms', event.perms.selector, '$.widget');
+    t.expect('GET /security details', JSON.stringify(event.details),
+             '{"message":"only root may ban"}');
+    r = await request(port, 'GET', '/security?after=' + event.id);
+    t.expect('GET /security?after=<id>', r.body.events.length, 0);
+    r = await request(port, 'GET', '/security?after=x');
+    t.expect('GET /security?after=x status', r.status, 400);
+
+    // Checkpoints.
+    r = await request(port, 'POST', '/checkpoint');
+    t.expect('POST /checkpoint status', r.status, 202);
+    r = await request(port, 'GET', '/checkpoints');
+    t.expect('GET /checkpoints', JSON.stringify(r.body.checkpoints),
+             JSON.stringify([{name: 'a.city', time: 1000}]));
+    r = await request(port, 'POST', '/restore', {checkpoint: 'b.city'});
+    t.expect('POST /restore (no such checkpoint) status', r.status, 404);
+    r = await request(port, 'POST', '/restore', {time: 2000});
+    t.expect('POST /restore status', r.status, 202);
+    t.expect('checkpoint and restore calls', log.join(),
+             'checkpoint,restore 2000');
+
+    // Configuration reload.
+    r = await request(port, 'POST', '/config/reload');
+    t.expect('POST /config/reload', JSON.stringify(r.body),
+             '{"applied":["fetch"],"restartRequired":["admin.port"]}');
+    reloadError = new SyntaxError('Invalid configuration');
+    r = await request(port, 'POST', '/config/reload');
+    t.expect('POST /config/reload (invalid) status', r.status, 400);
+    t.expect('POST /config/reload (invalid) error', r.body.error,
+             'Invalid configuration');
+
+    // Shutdown.
+    r = await request(port, 'POST', '/shutdown', {exitCode: 'x'});
+    t.expect('POST /shutdown (invalid) status', r.status, 400);
+    r = await request(port, 'POST', '/shutdown', {exitCode: 3});
+    t.expect('POST /shutdown status', r.status, 202);
+    t.expect('shutdown call', log[log.length - 1], 'shutdown 3');
+
+    // Handoff.
+    r = await request(port, 'POST', '/handoff');
+    t.expect('POST /handoff', r.body.pid, 4321);
+    t.expect('shutdown call (handoff)', log[log.length - 1], 'shutdown 0');
+
+    // Log levels.
+    r = await request(port, 'POST', '/log/levels',
+                      {subsystem: 'net', level: 'debug'});
+    t.expect('POST /log/levels', JSON.stringify(r.body),
+             '{"level":"info","subsystems":{"net":"debug"}}');
+    t.expect('logger.enabled(net, debug)', logger.enabled('net', 'debug'),
+             true);
+    r = await request(port, 'POST', '/log/levels', {level: 'warn'});
+    r = await request(port, 'POST', '/log/levels',
+                      {subsystem: 'net', level: null});
+    r = await request(port, 'GET', '/log/levels');
+    t.expect('GET /log/levels', JSON.stringify(r.body),
+             '{"level":"warn","subsystems":{}}');
+    r = await request(port, 'POST', '/log/levels', {level: 'loud'});
+    t.expect('POST /log/levels (invalid) status', r.status, 400);
+
+    // Admin log.
+    r = await request(port, 'GET', '/adminlog?limit=2');
+    t.expect('GET /adminlog', r.body.entries.map(
+        (e) => e.details.method + ' ' + e.details.path + ' ' +
+            e.details.status).join(),
+        'POST /log/levels 200,POST /log/levels 400');
+    t.expect('GET /adminlog actor', r.body.entries[0].actor,
+             'admin token 2');
+    r = await request(port, 'GET', '/adminlog/verify');
+    t.expect('GET /adminlog/verify error', r.body.error, null);
+    t.expect('GET /adminlog/verify head', r.body.head, adminLog.head);
+
+    // Bans.
+    r = await request(port, 'POST', '/bans',
+                      {network: '192.0.2.7/24', reason: 'spam'});
+    t.expect('POST /bans', r.body.network, '192.0.2.0/24');
+    r = await request(port, 'POST', '/bans', {network: 'nonsense'});
+    t.expect('POST /bans (invalid) status', r.status, 400);
+    r = await request(port, 'GET', '/bans');
+    t.expect('GET /bans', r.body.bans.map((ban) => ban.reason).join(),
+             'spam');
+    r = await request(port, 'DELETE', '/bans?network=192.0.2.0/24');
+    t.expect('DELETE /bans', r.body.removed, true);
+    t.expect('bans after DELETE', intrp.getBans().length, 0);
+
+    // Hosted worlds (no manager given).
+    r = await request(port, 'GET', '/worlds');
+    t.expect('GET /worlds (unavailable) status', r.status, 501);
+    r = await request(port, 'POST', '/worlds/start', {name: 'staging'});
+    t.expect('POST /worlds/start (unavailable) status', r.status, 501);
+
+    // Statistics (no recorder given).
+    r = await request(port, 'GET', '/stats');
+    t.expect('GET /stats (unavailable) status', r.status, 501);
+
+    // Extension routes.
+    admin.route('GET', '/ping', () => ({pong: true}));
+    r = await request(port, 'GET', '/ping');
+    t.expect('GET /ping', r.body.pong, true);
+  } finally {
+    intrp.stop();
+    await admin.close();
+  }
+};
+
+/**
+ * Unit tests for the admin API's debugger routes.
+ * @param {!T} t The test runner object.
+ */
+exports.testAdminDebug = async function(t) {
+  const intrp = getInterpreter({noLog: ['admin', 'net', 'unhandled']});
+  intrp.createThreadForSrc(`
+      var $ = {};
+      $.log = [];
+      $.debugMe = function(x) {
+        var y = x * 2;
+        $.log.push(y);
+        $.log.push(y + 1);
+      };
+      $.owner = {};
+      $.owned = (function() {
+        setPerms($.owner);
+        return function() {
+          return 1;
+        };
+      })();
+  `);
+  intrp.run();
+  let onPause;
+  intrp.onThreadPaused = (thread, reason) => onPause([thread, reason]);
+  const nextPause = () => new Promise((resolve) => onPause = resolve);
+  const admin = new Admin.Server({tokens: ['secret'], interpreter: intrp});
+  const port = await admin.listen(0, '127.0.0.1');
+  intrp.start();
+  try {
+    let r = await request(port, 'POST', '/breakpoints',
+                          {selector: '$.debugMe', line: 3});
+    t.expect('POST /breakpoints line', r.body.line, 3);
+    t.expect('POST /breakpoints func.selector', r.body.func.selector,
+             '$.debugMe');
+    const id = r.body.id;
+    r = await request(port, 'POST', '/breakpoints',
+                      {selector: '$.debugMe', line: 99});
+    t.expect('POST /breakpoints (no statement) status', r.status, 400);
+    r = await request(port, 'POST', '/breakpoints',
+                      {selector: '$.log', line: 1});
+    t.expect('POST /breakpoints (not a function) status', r.status, 400);
+
+    let paused = nextPause();
+    const debugMe = intrp.global.get('$').get('debugMe', intrp.ROOT);
+    intrp.createThreadForFuncCall(intrp.ROOT, debugMe, undefined, [20]);
+    let [thread, reason] = await paused;
+    t.expect('Pause reason', reason, 'breakpoint');
+    r = await request(port, 'GET', '/breakpoints');
+    t.expect('GET /breakpoints hits', r.body.breakpoints[0].hits, 1);
+
+    r = await request(port, 'GET', '/debug/frames?thread=' + thread.id);
+    t.expect('GET /debug/frames frames[0].line', r.body.frames[0].line, 3);
+    t.expect('GET /debug/frames frames[0].scopes[0].vars',
+             JSON.stringify(r.body.frames[0].scopes[0].vars),
+             JSON.stringify({x: {type: 'number', value: 20},
+                             y: {type: 'number', value: 40}}));
+    r = await request(port, 'GET', '/debug/frames?thread=nonsense');
+    t.expect('GET /debug/frames (invalid thread) status', r.status, 400);
+    r = await request(port, 'GET', '/debug/frames?thread=9999');
+    t.expect('GET /debug/frames (no such thread) status', r.status, 404);
+
+    r = await request(port, 'POST', '/debug/eval',
+                      {thread: thread.id, frame: 0, src: 'x + y'});
+    t.expect('POST /debug/eval',
+             JSON.stringify([r.body.threw, r.body.value]),
+             JSON.stringify([false, {type: 'number', value: 60}]));
+
+    paused = nextPause();
+    r = await request(port, 'POST', '/debug/resume',
+                      {thread: thread.id, mode: 'over'});
+    t.expect('POST /debug/resume status', r.status, 200);
+    [thread, reason] = await paused;
+    t.expect('Pause reason after step over', reason, 'step');
+    r = await request(port, 'GET', '/debug/frames?thread=' + thread.id);
+    t.expect('GET /debug/frames after step over frames[0].line',
+             r.body.frames[0].line, 4);
+    r = await request(port, 'POST', '/debug/resume',
+                      {thread: thread.id, mode: 'sideways'});
+    t.expect('POST /debug/resume (invalid mode) status', r.status, 400);
+    r = await request(port, 'POST', '/debug/resume', {thread: thread.id});
+    t.expect('POST /debug/resume (continue) status', r.status, 200);
+    r = await request(port, 'POST', '/debug/resume', {thread: thread.id});
+    t.expect('POST /debug/resume (not paused) status', r.status, 409);
+
+    r = await request(port, 'DELETE', '/breakpoints?id=' + id);
+    t.expect('DELETE /breakpoints', r.body.removed, true);
+    t.expect('Breakpoints after DELETE', intrp.getBreakpoints().length, 0);
+
+    // Watchpoints.
+    r = await request(port, 'POST', '/watchpoints',
+                      {selector: '$', property: 'log'});
+    t.expect('POST /watchpoints', JSON.stringify(r.body),
+             JSON.stringify({id: 1, object: {type: 'object', class: 'Object',
+                                             selector: '$'},
+                             property: 'log', handler: {type: 'null',
+                                                        value: null},
+                             hits: 0}));
+    r = await request(port, 'POST', '/watchpoints', {selector: '$'});
+    t.expect('POST /watchpoints (no property) status', r.status, 400);
+    paused = nextPause();
+    intrp.createThreadForSrc('$.log = []; $.log.push(1);');
+    [thread, reason] = await paused;
+    t.expect('Pause reason (watchpoint)', reason, 'watchpoint');
+    r = await request(port, 'GET', '/watchpoints');
+    t.expect('GET /watchpoints hits', r.body.watchpoints[0].hits, 1);
+    await request(port, 'POST', '/debug/resume', {thread: thread.id});
+    r = await request(port, 'DELETE', '/watchpoints?id=1');
+    t.expect('DELETE /watchpoints', r.body.removed, true);
+    t.expect('Watchpoints after DELETE', intrp.getWatchpoints().length, 0);
+
+    // Coverage.
+    r = await request(port, 'POST', '/coverage/start');
+    t.expect('POST /coverage/start', r.body.collecting, true);
+    await request(port, 'POST', '/eval', {src: '$.debugMe(1);'});
+    r = await request(port, 'POST', '/coverage/stop');
+    t.expect('POST /coverage/stop', r.body.collecting, false);
+    r = await request(port, 'GET', '/coverage');
+    t.expect('GET /coverage', JSON.stringify(r.body.functions.map(
+        (f) => [f.func.selector, f.covered, f.total])),
+             JSON.stringify([['$.debugMe', 3, 3]]));
+    t.expect('GET /coverage statements[0]',
+             JSON.stringify(r.body.functions[0].statements[0]),
+             JSON.stringify({line: 2, col: 9, hits: 1}));
+    r = await request(port, 'GET', '/coverage?owner=$.owner');
+    t.expect('GET /coverage?owner=$.owner', JSON.stringify(
+        r.body.functions.map((f) => [f.func.selector, f.covered, f.total])),
+             JSON.stringify([['$.owned', 0, 1]]));
+  } finally {
+    intrp.stop();
+    await admin.close();
+    adminLog.close();
+    fs.rmSync(dir, {recursive: true, force: true});
+  }
+};
+
+/**
+ * Unit tests for the admin API's limit on failed authentication.
+ * @param {!T} t The test runner object.
+ */
+exports.testAdminLockout = async function(t) {
+  const intrp = getInterpreter({noLog: ['admin']}, false);
+  const admin = new Admin.Server({tokens: ['secret'], interpreter: intrp});
+  const port = await admin.listen(0, '127.0.0.1');
+  try {
+    const limit = 5;  // RateLimit.POLICIES.login.limit.
+    let r;
+    for (let i = 0; i <= limit; i++) {
+      r = await request(port, 'GET', '/bans', undefined, 'wrong');
+    }
+    t.expect('Status of last failure', r.status, 401);
+    r = await request(port, 'GET', '/bans', undefined, 'wrong');
+    t.expect('Status after too many failures', r.status, 429);
+    t.assert('Retry-After', Number(r.headers['retry-after']) > 0);
+    r = await request(port, 'GET', '/bans');
+    t.expect('Status with right token during lockout', r.status, 429);
+  } finally {
+    await admin.close();
+  }
+};
@@ -0,0 +1,87 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for the log of privileged operations.
+ */
+'use strict';
+
+const AdminLog = require('../adminlog');
+const fs = require('fs');
+const os = require('os');
+const path = require('path');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for AdminLog.Log and AdminLog.verify.
+ * @param {!T} t The test runner object.
+ */
+exports.testAdminLog = function(t) {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'adminlog_test-'));
+  const filename = path.join(dir, 'admin.log');
+
+  // Recording.
+  let log = new AdminLog.Log(filename);
+  t.expect('seq (new)', log.seq, 0);
+  t.expect('head (new)', log.head, '');
+  const first = log.record('Maximilian', 'chown', {to: 'Neil'});
+  t.expect('first.seq', first.seq, 1);
+  t.expect('first.prev', first.prev, '');
+  t.expect('first.hash', first.hash, AdminLog.hash(first));
+  const second = log.record('admin token 1', 'admin', {path: '/eval'});
+  t.expect('second.prev', second.prev, first.hash);
+  t.expect('tail(1)', log.tail(1).map((e) => e.action).join(), 'admin');
+  t.expect('tail(5)', log.tail(5).length, 2);
+  t.expect('verify().error', log.verify().error, null);
+  log.close();
+
+  // Reopening continues the chain.
+  log = new AdminLog.Log(filename);
+  t.expect('seq (reopened)', log.seq, 2);
+  t.expect('head (reopened)', log.head, second.hash);
+  t.expect('record (reopened) .prev', log.record('root', 'ban', {}).prev,
+           second.hash);
+
+  // Truncation is noticed by the open log, if not by the chain.
+  const text = fs.readFileSync(filename, 'utf8');
+  const lines = text.split('\n');
+  fs.writeFileSync(filename, lines.slice(0, 2).join('\n') + '\n');
+  t.expect('verify(truncated).error', AdminLog.verify(
+      fs.readFileSync(filename, 'utf8')).error, null);
+  t.assert('log.verify() (truncated)', log.verify().error !== null);
+  log.close();
+
+  // Tampering.
+  const altered = text.replace('"Neil"', '"Nobody"');
+  t.expect('verify(altered)', AdminLog.verify(altered).error,
+           'line 1: hash mismatch');
+  t.expect('verify(altered).entries', AdminLog.verify(altered).entries, 0);
+  const removed = [lines[0], lines[2]].join('\n');
+  t.expect('verify(removed)', AdminLog.verify(removed).error,
+           'line 2: expected entry 2, found 3');
+  t.expect('verify(garbled)', AdminLog.verify(lines[0] + '\n{').error,
+           'line 2: not JSON');
+  fs.writeFileSync(filename, altered);
+  let threw = false;
+  try {
+    new AdminLog.Log(filename);
+  } catch (e) {
+    threw = true;
+  }
+  t.assert('new AdminLog.Log(altered) throws', threw);
+  fs.rmSync(dir, {recursive: true, force: true});
+};
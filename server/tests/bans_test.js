@@ -0,0 +1,120 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for bans of IP addresses and networks.
+ */
+'use strict';
+
+const Bans = require('../bans');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Bans.parseAddress and Bans.formatAddress.
+ * @param {!T} t The test runner object.
+ */
+exports.testBansAddress = function(t) {
+  const cases = [
+    ['192.0.2.1', '192.0.2.1'],
+    ['2001:DB8:0:0:0:0:0:1', '2001:db8::1'],
+    ['::', '::'],
+    ['::1', '::1'],
+    ['2001:db8:0:1:1:1:1:1', '2001:db8:0:1:1:1:1:1'],
+    ['2001:0:0:1:0:0:0:1', '2001:0:0:1::1'],
+    ['::ffff:192.0.2.1', '192.0.2.1'],
+    ['::ffff:c000:201', '192.0.2.1'],
+    ['64:ff9b::192.0.2.1', '64:ff9b::c000:201'],
+  ];
+  for (const [address, expected] of cases) {
+    const bytes = Bans.parseAddress(address);
+    t.expect('formatAddress(parseAddress(' + JSON.stringify(address) + '))',
+             bytes && Bans.formatAddress(bytes), expected);
+  }
+  const invalid = ['', 'localhost', '192.0.2', '1::2::3', '192.0.2.1/24'];
+  for (const address of invalid) {
+    t.expect('parseAddress(' + JSON.stringify(address) + ')',
+             Bans.parseAddress(address), null);
+  }
+};
+
+/**
+ * Unit tests for Bans.canonicalize and Bans.contains.
+ * @param {!T} t The test runner object.
+ */
+exports.testBansNetwork = function(t) {
+  const canonical = [
+    ['192.0.2.1', '192.0.2.1/32'],
+    ['192.0.2.77/24', '192.0.2.0/24'],
+    ['192.0.2.1/0', '0.0.0.0/0'],
+    ['10.255.0.0/9', '10.128.0.0/9'],
+    ['2001:DB8:0::1/32', '2001:db8::/32'],
+    ['::ffff:192.0.2.1/120', '192.0.2.0/24'],
+  ];
+  for (const [network, expected] of canonical) {
+    t.expect('canonicalize(' + JSON.stringify(network) + ')',
+             Bans.canonicalize(network), expected);
+  }
+  const invalid = ['192.0.2.0/33', '2001:db8::/129', '::ffff:1.2.3.4/64',
+                   'example.com', '192.0.2.0/'];
+  for (const network of invalid) {
+    try {
+      Bans.canonicalize(network);
+      t.fail('canonicalize(' + JSON.stringify(network) + ')', 'Did not throw');
+    } catch (e) {
+      t.expect('canonicalize(' + JSON.stringify(network) + ') throws',
+               e.name, 'TypeError');
+    }
+  }
+
+  const contains = [
+    ['192.0.2.0/24', '192.0.2.255', true],
+    ['192.0.2.0/24', '192.0.3.0', false],
+    ['192.0.2.0/24', '::ffff:192.0.2.9', true],
+    ['10.128.0.0/9', '10.200.1.1', true],
+    ['10.128.0.0/9', '10.127.1.1', false],
+    ['0.0.0.0/0', '203.0.113.5', true],
+    ['0.0.0.0/0', '2001:db8::1', false],
+    ['2001:db8::/32', '2001:db8:ffff::1', true],
+    ['2001:db8::/32', '2001:db9::1', false],
+    ['192.0.2.1', '192.0.2.1', true],
+    ['192.0.2.1', 'nonsense', false],
+  ];
+  for (const [network, address, expected] of contains) {
+    t.expect('contains(' + JSON.stringify(network) + ', ' +
+             JSON.stringify(address) + ')',
+             Bans.contains(network, address), expected);
+  }
+};
+
+/**
+ * Unit tests for Bans.find, Bans.remove and Bans.prune.
+ * @param {!T} t The test runner object.
+ */
+exports.testBansFind = function(t) {
+  const bans = [
+    {network: '192.0.2.0/24', reason: 'spam', created: 0, expires: 100},
+    {network: '192.0.0.0/16', reason: 'bots', created: 0, expires: null},
+  ];
+  t.expect('find(...)', Bans.find(bans, '192.0.2.1', 50).reason, 'spam');
+  t.expect('find(<unbanned>)', Bans.find(bans, '198.51.100.1', 50), null);
+  t.expect('find(<first expired>)', Bans.find(bans, '192.0.2.1', 100).reason,
+           'bots');
+  t.expect('find(...) prunes expired bans', bans.length, 1);
+  t.expect('remove(<not banned>)', Bans.remove(bans, '192.0.2.0/24'), false);
+  t.expect('remove(<banned>)', Bans.remove(bans, '192.0.0.0/16'), true);
+  t.expect('find(<removed>)', Bans.find(bans, '192.0.2.1', 100), null);
+};
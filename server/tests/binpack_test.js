@@ -0,0 +1,164 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for the binary flatpack encoding.
+ */
+'use strict';
+
+const Binpack = require('../binpack');
+const {getInterpreter} = require('./interpreter_common');
+const Serializer = require('../serialize');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Binpack.encode and Binpack.decode.
+ * @param {!T} t The test runner object.
+ */
+exports.testBinpackRoundtrip = function(t) {
+  const cases = [
+    [],
+    [null, true, false],
+    [0, 1, 127, 128, 300, -1, -128, -129, 2 ** 31, -(2 ** 31) - 1,
+     Number.MAX_SAFE_INTEGER, -Number.MAX_SAFE_INTEGER],
+    [0.5, -1.25, 1e300, 2 ** 53, Number.MIN_VALUE],
+    ['', 'foo', 'foo', 'ünïcödé ☃ 𝌆', '\0'],
+    [[], [1, [2, [3]]], {}],
+    [{'#': 0}, {'#': 42}, {'#': 1.5}, {'#': 1, 'x': 2}, {'#': 'foo'}],
+    [{'Value': 'undefined'}, {'Value': 'null'}, {'Number': 'NaN'}],
+    [{'__proto__': 1, 'constructor': 2, '': 3}],
+  ];
+  for (const records of cases) {
+    const name = 'Binpack roundtrip ' + JSON.stringify(records);
+    try {
+      const data = Binpack.encode(records);
+      t.assert(name + ' isBinary', Binpack.isBinary(data));
+      const decoded = Binpack.decode(data);
+      t.expect(name, JSON.stringify(decoded), JSON.stringify(records));
+    } catch (e) {
+      t.crash(name, e);
+    }
+  }
+
+  // -0 is preserved.
+  const negZero = Binpack.decode(Binpack.encode([-0]))[0];
+  t.assert('Binpack roundtrip -0', Object.is(negZero, -0));
+
+  // Key order is preserved.
+  const keys = Object.keys(Binpack.decode(Binpack.encode([{b: 1, a: 2}]))[0]);
+  t.expect('Binpack roundtrip key order', String(keys), 'b,a');
+};
+
+/**
+ * Unit tests for error handling in Binpack.decode.
+ * @param {!T} t The test runner object.
+ */
+exports.testBinpackErrors = function(t) {
+  t.assert('Binpack.isBinary(JSON)', !Binpack.isBinary(Buffer.from('[{}]')));
+  t.assert('Binpack.isBinary(empty)', !Binpack.isBinary(Buffer.alloc(0)));
+
+  const good = Binpack.encode([{foo: 'bar'}, [1, 2, 3]]);
+  const bad = {
+    'not binary': Buffer.from('[]'),
+    'truncated': good.subarray(0, good.length - 1),
+    'trailing data': Buffer.concat([good, Buffer.from([0])]),
+    'bad version': Buffer.concat([good.subarray(0, 4), Buffer.from([99]),
+                                  good.subarray(5)]),
+  };
+  for (const name in bad) {
+    try {
+      Binpack.decode(bad[name]);
+      t.fail('Binpack.decode(/* ' + name + ' */)', "Didn't throw.");
+    } catch (e) {
+      t.pass('Binpack.decode(/* ' + name + ' */)');
+    }
+  }
+  try {
+    Binpack.encode([NaN]);
+    t.fail('Binpack.encode([NaN])', "Didn't throw.");
+  } catch (e) {
+    t.pass('Binpack.encode([NaN])');
+  }
+};
+
+/**
+ * Unit tests for Binpack.Encoder and Binpack.Decoder.
+ * @param {!T} t The test runner object.
+ */
+exports.testBinpackStreaming = function(t) {
+  const records = [{foo: 'bar'}, 'bar', [{'#': 1}, {foo: 'baz'}], {}];
+  const encoder = new Binpack.Encoder();
+  const chunks = records.map((r) => Buffer.from(encoder.encode(r)));
+  chunks.push(encoder.end());
+  const data = Buffer.concat(chunks);
+  t.expect('Binpack.Encoder output == Binpack.encode output',
+           data.toString('hex'), Binpack.encode(records).toString('hex'));
+
+  // Decode one byte at a time.
+  const decoder = new Binpack.Decoder();
+  let decoded = [];
+  let whenComplete = [];
+  for (let i = 0; i < data.length; i++) {
+    const got = decoder.push(data.subarray(i, i + 1));
+    decoded = decoded.concat(got);
+    if (got.length) whenComplete.push(i);
+  }
+  decoded = decoded.concat(decoder.end());
+  t.expect('Binpack.Decoder bytewise', JSON.stringify(decoded),
+           JSON.stringify(records));
+  // Each record should be returned as soon as its last byte arrives.
+  const ends = [];
+  let offset = 0;
+  for (const chunk of chunks.slice(0, -1)) {
+    offset += chunk.length;
+    ends.push(offset - 1);
+  }
+  t.expect('Binpack.Decoder incremental', String(whenComplete), String(ends));
+
+  try {
+    const truncated = new Binpack.Decoder();
+    truncated.push(data.subarray(0, data.length - 1));
+    truncated.end();
+    t.fail('Binpack.Decoder.end(/* truncated */)', "Didn't throw.");
+  } catch (e) {
+    t.pass('Binpack.Decoder.end(/* truncated */)');
+  }
+
+  // Version 1 files (with a separate string table) can still be read.
+  const v1 = Buffer.from([0x00, 0x43, 0x43, 0x42, 1,  // Magic, version.
+                          1, 3, 0x66, 0x6f, 0x6f,     // Strings: 'foo'.
+                          2,                          // Two records:
+                          2, 6, 0,                    // 'foo'
+                          4, 8, 1, 0, 10]);           // {foo: undefined}
+  t.expect('Binpack.decode(/* version 1 */)', JSON.stringify(
+      Binpack.decode(v1)), '["foo",{"foo":{"Value":"undefined"}}]');
+};
+
+/**
+ * Check that a serialized interpreter survives conversion to binary
+ * and back, and that the binary form is smaller.
+ * @param {!T} t The test runner object.
+ */
+exports.testBinpackSerializedInterpreter = function(t) {
+  const name = 'Binpack serialized interpreter';
+  const intrp = getInterpreter();
+  const json = Serializer.serialize(intrp);
+  const text = JSON.stringify(json);
+  const data = Binpack.encode(json);
+  t.expect(name, JSON.stringify(Binpack.decode(data)), text);
+  t.assert(name + ' is smaller', data.length < text.length / 2);
+};
@@ -0,0 +1,150 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for blob storage.
+ */
+'use strict';
+
+const Blobs = require('../blobs');
+const fs = require('fs');
+const http = require('http');
+const os = require('os');
+const path = require('path');
+const {T} = require('./testing');
+
+/** @const {string} ID of the blob 'hello'. */
+const HELLO =
+    '2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824';
+
+/**
+ * Unit tests for Blobs.Store with a Blobs.FileBackend.
+ * @param {!T} t The test runner object.
+ */
+exports.testBlobsStore = async function(t) {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'blobs_test-'));
+  try {
+    const store = new Blobs.Store(new Blobs.FileBackend(dir), {maxSize: 8});
+    t.expect('Blobs.Store.prototype.put(...)',
+             await store.put(Buffer.from('hello')), HELLO);
+    t.expect('Blobs.Store.prototype.put(...) again',
+             await store.put(Buffer.from('hello')), HELLO);
+    t.expect('Blobs.FileBackend file', fs.readFileSync(
+        path.join(dir, HELLO.slice(0, 2), HELLO), 'utf8'), 'hello');
+    t.expect('Blobs.FileBackend temporary files',
+             fs.readdirSync(path.join(dir, HELLO.slice(0, 2))).join(), HELLO);
+    t.expect('Blobs.Store.prototype.get(...)',
+             String(await store.get(HELLO)), 'hello');
+    t.expect('Blobs.Store.prototype.get(...) missing',
+             await store.get('0'.repeat(64)), null);
+    try {
+      await store.put(Buffer.from('too long!'));
+      t.fail('Blobs.Store.prototype.put(...) too long', 'did not reject');
+    } catch (e) {
+      t.expect('Blobs.Store.prototype.put(...) too long', e.name,
+               'RangeError');
+    }
+    try {
+      await store.get('../etc/passwd');
+      t.fail('Blobs.Store.prototype.get(...) bad ID', 'did not throw');
+    } catch (e) {
+      t.expect('Blobs.Store.prototype.get(...) bad ID', e.name, 'TypeError');
+    }
+
+    fs.writeFileSync(path.join(dir, HELLO.slice(0, 2), HELLO), 'jello');
+    try {
+      await store.get(HELLO);
+      t.fail('Blobs.Store.prototype.get(...) corrupt', 'did not reject');
+    } catch (e) {
+      t.expect('Blobs.Store.prototype.get(...) corrupt', e.message,
+               'Blob ' + HELLO + ' is corrupt');
+    }
+    await store.delete(HELLO);
+    t.expect('Blobs.Store.prototype.delete(...)', await store.get(HELLO),
+             null);
+    await store.delete(HELLO);  // Deleting a missing blob is harmless.
+  } finally {
+    fs.rmSync(dir, {recursive: true});
+  }
+};
+
+/**
+ * Make an HTTP request.
+ * @param {number} port The port to connect to.
+ * @param {string} method The request method.
+ * @param {string} path The request path.
+ * @param {!Object<string,string>=} headers Request headers.
+ * @return {!Promise<{status: number, headers: !Object, body: string}>}
+ */
+function request(port, method, path, headers) {
+  return new Promise((resolve, reject) => {
+    const req = http.request({host: '127.0.0.1', port, method, path, headers},
+        (res) => {
+          let body = '';
+          res.setEncoding('utf8');
+          res.on('data', (data) => body += data);
+          res.on('end', () => resolve(
+              {status: res.statusCode, headers: res.headers, body}));
+        });
+    req.on('error', reject);
+    req.end();
+  });
+}
+
+/**
+ * Unit tests for Blobs.Server.
+ * @param {!T} t The test runner object.
+ */
+exports.testBlobsServer = async function(t) {
+  const blobs = new Map();
+  const backend = {
+    put: async (id, data) => void blobs.set(id, data),
+    get: async (id) => blobs.get(id) || null,
+    delete: async (id) => void blobs.delete(id),
+  };
+  const store = new Blobs.Store(backend);
+  await store.put(Buffer.from('hello'));
+  const server = new Blobs.Server(store);
+  const port = await server.listen(0, '127.0.0.1');
+  try {
+    let r = await request(port, 'GET', '/' + HELLO);
+    t.expect('GET /<id> status', r.status, 200);
+    t.expect('GET /<id> body', r.body, 'hello');
+    t.expect('GET /<id> Content-Type', r.headers['content-type'],
+             'application/octet-stream');
+    t.expect('GET /<id> ETag', r.headers['etag'], '"' + HELLO + '"');
+    r = await request(port, 'GET', '/' + HELLO + '?type=image/png');
+    t.expect('GET /<id>?type=... Content-Type', r.headers['content-type'],
+             'image/png');
+    r = await request(port, 'GET', '/' + HELLO + '?type=text/html;x');
+    t.expect('GET /<id>?type=<bad> status', r.status, 400);
+    r = await request(port, 'HEAD', '/' + HELLO);
+    t.expect('HEAD /<id> body', r.body, '');
+    t.expect('HEAD /<id> Content-Length', r.headers['content-length'], '5');
+    r = await request(port, 'GET', '/' + HELLO,
+                      {'If-None-Match': '"' + HELLO + '"'});
+    t.expect('GET /<id> (cached) status', r.status, 304);
+    r = await request(port, 'GET', '/' + '0'.repeat(64));
+    t.expect('GET /<missing> status', r.status, 404);
+    r = await request(port, 'GET', '/other');
+    t.expect('GET /other status', r.status, 404);
+    r = await request(port, 'PUT', '/' + HELLO);
+    t.expect('PUT /<id> status', r.status, 405);
+  } finally {
+    await server.close();
+  }
+};
@@ -0,0 +1,492 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Certificates, OCSP responses and a fake ACME
+ * certificate authority, for tests.
+ */
+'use strict';
+
+const Acme = require('../acme');
+const crypto = require('crypto');
+const Der = require('../der');
+const http = require('http');
+
+/** @const {!Buffer} Algorithm identifier for ecdsa-with-SHA256. */
+const ECDSA_SHA256 = Der.sequence([Der.oid('1.2.840.10045.4.3.2')]);
+
+/** @const {!Buffer} Encoded BOOLEAN true. */
+const TRUE = Der.encode(Der.Tag.BOOLEAN, Buffer.from([0xff]));
+
+/**
+ * Generate an ECDSA P-256 private key.
+ * @return {!crypto.KeyObject}
+ */
+function generateKey() {
+  return crypto.generateKeyPairSync('ec', {namedCurve: 'P-256'}).privateKey;
+}
+exports.generateKey = generateKey;
+
+/**
+ * Get the public half of a key.
+ * @param {!crypto.KeyObject} key A public or private key.
+ * @return {!crypto.KeyObject} The public key.
+ */
+function publicKey(key) {
+  return (key.type === 'public') ? key : crypto.createPublicKey(key);
+}
+
+/**
+ * Encode a time as a GeneralizedTime (or, if utc is true, a UTCTime).
+ * @param {!Date} date The time.
+ * @param {boolean=} utc Encode as UTCTime?
+ * @return {!Buffer}
+ */
+function time(date, utc) {
+  const text = date.toISOString().replace(/[-:T]|\.\d+/g, '');
+  return utc ? Der.encode(Der.Tag.UTC_TIME, Buffer.from(text.slice(2))) :
+      Der.encode(Der.Tag.GENERALIZED_TIME, Buffer.from(text));
+}
+exports.time = time;
+
+/**
+ * Encode a distinguished name consisting only of a common name.
+ * @param {string} commonName The common name.
+ * @return {!Buffer}
+ */
+function name(commonName) {
+  return Der.sequence([Der.set([Der.sequence([
+    Der.oid('2.5.4.3'), Der.utf8String(commonName),
+  ])])]);
+}
+
+/**
+ * Encode an extension.
+ * @param {string} oid The extension's OID.
+ * @param {!Buffer} value The encoded value.
+ * @param {boolean=} critical Is the extension critical?
+ * @return {!Buffer}
+ */
+function extension(oid, value, critical) {
+  return Der.sequence([Der.oid(oid)].concat(critical ? [TRUE] : [],
+                                            [Der.octetString(value)]));
+}
+
+/**
+ * Build and sign a certificate.
+ * @param {{subject: string,
+ *          key: !crypto.KeyObject,
+ *          issuer: (string|undefined),
+ *          issuerKey: (!crypto.KeyObject|undefined),
+ *          serial: (number|undefined),
+ *          notBefore: (!Date|undefined),
+ *          notAfter: (!Date|undefined),
+ *          hostnames: (!Array<string>|undefined),
+ *          ca: (boolean|undefined),
+ *          ocspUrl: (string|undefined)}} options The subject's common
+ *     name and (public or private) key; the issuer's name and private
+ *     key (default: self-signed); the serial number (default 1); the
+ *     validity period (default: from an hour ago for 90 days); the
+ *     subject alternative names (default: the subject); whether the
+ *     certificate is for a CA; and the URL of the OCSP responder to
+ *     give in its authority information access extension (if any).
+ * @return {!Buffer} The DER-encoded certificate.
+ */
+function makeCertificate(options) {
+  const notBefore = options.notBefore || new Date(Date.now() - 3600000);
+  const notAfter = options.notAfter ||
+      new Date(notBefore.getTime() + 90 * 86400000);
+  const extensions = [];
+  if (options.ca) {
+    extensions.push(extension('2.5.29.19', Der.sequence([TRUE]), true));
+  } else {
+    const hostnames = options.hostnames || [options.subject];
+    extensions.push(extension('2.5.29.17', Der.sequence(hostnames.map(
+        (hostname) => Der.context(2, Buffer.from(hostname), false)))));
+  }
+  if (options.ocspUrl) {
+    extensions.push(extension('1.3.6.1.5.5.7.1.1', Der.sequence([
+      Der.sequence([Der.oid('1.3.6.1.5.5.7.48.1'),
+                    Der.context(6, Buffer.from(options.ocspUrl), false)]),
+    ])));
+  }
+  const tbs = Der.sequence([
+    Der.context(0, Der.integer(2)),  // v3.
+    Der.integer(options.serial || 1),
+    ECDSA_SHA256,
+    name(options.issuer || options.subject),
+    Der.sequence([time(notBefore, true), time(notAfter, true)]),
+    name(options.subject),
+    publicKey(options.key).export({type: 'spki', format: 'der'}),
+    Der.context(3, Der.sequence(extensions)),
+  ]);
+  const signature =
+      crypto.sign('sha256', tbs, options.issuerKey || options.key);
+  return Der.sequence([tbs, ECDSA_SHA256, Der.bitString(signature)]);
+}
+exports.makeCertificate = makeCertificate;
+
+/**
+ * PEM-encode a certificate.
+ * @param {!Buffer} der The DER-encoded certificate.
+ * @return {string}
+ */
+function pem(der) {
+  const lines = der.toString('base64').match(/.{1,64}/g);
+  return '-----BEGIN CERTIFICATE-----\n' + lines.join('\n') +
+      '\n-----END CERTIFICATE-----\n';
+}
+exports.pem = pem;
+
+/**
+ * Build and sign an OCSP response.
+ * @param {{certId: !Buffer,
+ *          key: !crypto.KeyObject,
+ *          revoked: (boolean|undefined),
+ *          thisUpdate: (!Date|undefined),
+ *          nextUpdate: (?Date|undefined)}} options The CertID (as
+ *     encoded in the request); the responder's private key; whether
+ *     the certificate has been revoked; and the time of the status
+ *     (default now) and of the next update (default in a day, or none
+ *     if null).
+ * @return {!Buffer} The DER-encoded response.
+ */
+function makeOcspResponse(options) {
+  const thisUpdate = options.thisUpdate || new Date();
+  const nextUpdate = (options.nextUpdate === undefined) ?
+      new Date(thisUpdate.getTime() + 86400000) : options.nextUpdate;
+  const single = [
+    options.certId,
+    options.revoked ? Der.context(1, time(thisUpdate)) :
+        Der.context(0, Buffer.alloc(0), false),
+    time(thisUpdate),
+  ];
+  if (nextUpdate) single.push(Der.context(0, time(nextUpdate)));
+  const spki = publicKey(options.key).export({type: 'spki', format: 'der'});
+  const keyHash = crypto.createHash('sha1')
+      .update(Der.decode(spki).child(1).contents.subarray(1)).digest();
+  const data = Der.sequence([
+    Der.context(2, Der.octetString(keyHash)),  // responderID byKey.
+    time(thisUpdate),
+    Der.sequence([Der.sequence(single)]),
+  ]);
+  const signature = crypto.sign('sha256', data, options.key);
+  const basic = Der.sequence([data, ECDSA_SHA256, Der.bitString(signature)]);
+  return Der.sequence([
+    Der.encode(Der.Tag.ENUMERATED, Buffer.from([0])),  // successful.
+    Der.context(0, Der.sequence([
+      Der.oid('1.3.6.1.5.5.7.48.1.1'),  // id-pkix-ocsp-basic.
+      Der.octetString(basic),
+    ])),
+  ]);
+}
+exports.makeOcspResponse = makeOcspResponse;
+
+/**
+ * Get the CertID from an OCSP request.
+ * @param {!Buffer} request The DER-encoded request.
+ * @return {!Buffer} The encoded CertID.
+ */
+function ocspCertId(request) {
+  return Der.decode(request).child(0).child(0).child(0).child(0).raw;
+}
+exports.ocspCertId = ocspCertId;
+
+/**
+ * A CA, issuing certificates for hostnames.
+ */
+class Ca {
+  constructor() {
+    /** @const {!crypto.KeyObject} */
+    this.key = generateKey();
+    /** @const {!Buffer} */
+    this.cert = makeCertificate({subject: 'Test CA', key: this.key, ca: true});
+    /** @type {number} */
+    this.serial = 100;
+  }
+
+  /**
+   * Issue a certificate.
+   * @param {!Array<string>} hostnames Hostnames for the certificate.
+   * @param {!crypto.KeyObject} key The subject's key.
+   * @param {string=} ocspUrl URL of the OCSP responder.
+   * @return {!Buffer} The DER-encoded certificate.
+   */
+  issue(hostnames, key, ocspUrl) {
+    return makeCertificate({
+      subject: hostnames[0], key, hostnames, issuer: 'Test CA',
+      issuerKey: this.key, serial: this.serial++, ocspUrl,
+    });
+  }
+
+  /**
+   * Get the PEM-encoded chain of a certificate issued by this CA.
+   * @param {!Buffer} cert The DER-encoded certificate.
+   * @return {string}
+   */
+  chain(cert) {
+    return pem(cert) + pem(this.cert);
+  }
+}
+exports.Ca = Ca;
+
+/**
+ * Read the body of an HTTP request.
+ * @param {!http.IncomingMessage} req The request.
+ * @return {!Promise<!Buffer>}
+ */
+function readBody(req) {
+  return new Promise((resolve, reject) => {
+    const chunks = [];
+    req.on('data', (chunk) => chunks.push(chunk));
+    req.on('end', () => resolve(Buffer.concat(chunks)));
+    req.on('error', reject);
+  });
+}
+exports.readBody = readBody;
+
+/**
+ * A fake ACME server (issuing certificates from a Ca), which checks
+ * http-01 challenges by fetching them from localhost.
+ */
+class FakeAcme {
+  /**
+   * @param {!Ca} ca The CA.
+   * @param {number} challengePort Port from which to fetch challenges.
+   */
+  constructor(ca, challengePort) {
+    /** @const {!Ca} */
+    this.ca = ca;
+    /** @const {number} */
+    this.challengePort = challengePort;
+    /** @type {number} Number of upcoming requests to reject as badNonce. */
+    this.badNonces = 0;
+    /** @const {!Array<string>} Log of requests, as 'METHOD /path'. */
+    this.requests = [];
+    /** @const {!Map<string,!crypto.KeyObject>} Account keys, by URL. */
+    this.accounts = new Map();
+    this.nonces_ = new Set();
+    this.count_ = 0;
+    this.objects_ = new Map();
+    this.server_ = http.createServer((req, res) => {
+      readBody(req).then((body) => this.handle_(req, body, res))
+          .catch((e) => this.reply_(res, 500, {detail: String(e)}));
+    });
+    this.url = '';
+  }
+
+  /**
+   * Start listening.
+   * @return {!Promise}
+   */
+  async start() {
+    await new Promise(
+        (resolve) => this.server_.listen(0, 'localhost', resolve));
+    this.url = 'http://localhost:' + this.server_.address().port;
+  }
+
+  /** @return {string} URL of the directory. */
+  get directoryUrl() {
+    return this.url + '/directory';
+  }
+
+  /** Stop listening. */
+  stop() {
+    this.server_.close();
+  }
+
+  /**
+   * Send a response, with a fresh nonce.
+   * @private
+   * @param {!http.ServerResponse} res The response.
+   * @param {number} status HTTP status.
+   * @param {?Object|string} body Response body (an object is sent as
+   *     JSON).
+   * @param {!Object<string,string>=} headers Additional headers.
+   */
+  reply_(res, status, body, headers) {
+    const nonce = crypto.randomBytes(8).toString('hex');
+    this.nonces_.add(nonce);
+    headers = Object.assign({'Replay-Nonce': nonce}, headers);
+    if (body !== null && typeof body === 'object') {
+      headers['Content-Type'] = (status >= 400) ?
+          'application/problem+json' : 'application/json';
+      body = JSON.stringify(body);
+    }
+    res.writeHead(status, headers);
+    res.end(body === null ? undefined : body);
+  }
+
+  /**
+   * Create an object (order, authorization, etc.).
+   * @private
+   * @param {string} kind Kind of object, used as the first path
+   *     component of its URL.
+   * @param {!Object} object The object.
+   * @return {string} The object's URL.
+   */
+  create_(kind, object) {
+    const url = this.url + '/' + kind + '/' + (++this.count_);
+    this.objects_.set(url, object);
+    return url;
+  }
+
+  /**
+   * Handle a request.
+   * @private
+   * @param {!http.IncomingMessage} req The request.
+   * @param {!Buffer} body The request body.
+   * @param {!http.ServerResponse} res The response.
+   */
+  async handle_(req, body, res) {
+    const url = this.url + req.url;
+    this.requests.push(req.method + ' ' + req.url.replace(/\/\d+$/, ''));
+    if (req.method === 'GET' && req.url === '/directory') {
+      this.reply_(res, 200, {
+        newNonce: this.url + '/new-nonce',
+        newAccount: this.url + '/new-account',
+        newOrder: this.url + '/new-order',
+      });
+      return;
+    } else if (req.method === 'HEAD' && req.url === '/new-nonce') {
+      this.reply_(res, 200, null);
+      return;
+    } else if (req.method !== 'POST') {
+      this.reply_(res, 405, {detail: 'Method not allowed'});
+      return;
+    }
+    // Check the JWS.
+    const jws = JSON.parse(String(body));
+    const header = JSON.parse(Buffer.from(jws.protected, 'base64'));
+    const problem = (type, detail) => this.reply_(
+        res, 400, {type: 'urn:ietf:params:acme:error:' + type, detail});
+    if (!this.nonces_.delete(header.nonce) || this.badNonces > 0) {
+      if (this.badNonces > 0) this.badNonces--;
+      problem('badNonce', 'Bad nonce');
+      return;
+    }
+    if (header.url !== url) {
+      problem('unauthorized', 'Wrong URL in JWS');
+      return;
+    }
+    const key = header.jwk ?
+        crypto.createPublicKey({key: header.jwk, format: 'jwk'}) :
+        this.accounts.get(header.kid);
+    if (!key || (header.jwk && req.url !== '/new-account') ||
+        !crypto.verify('sha256',
+                       Buffer.from(jws.protected + '.' + jws.payload),
+                       {key, dsaEncoding: 'ieee-p1363'},
+                       Buffer.from(jws.signature, 'base64'))) {
+      problem('unauthorized', 'Bad signature');
+      return;
+    }
+    const payload = jws.payload ?
+        JSON.parse(Buffer.from(jws.payload, 'base64')) : null;
+
+    if (req.url === '/new-account') {
+      const account = this.create_('account', {status: 'valid'});
+      this.accounts.set(account, key);
+      this.reply_(res, 201, {status: 'valid'}, {Location: account});
+    } else if (req.url === '/new-order') {
+      const authorizations = payload.identifiers.map((identifier) => {
+        const authz = {status: 'pending', identifier, challenges: []};
+        const authzUrl = this.create_('authz', authz);
+        const challenge = {
+          type: 'http-01', status: 'pending',
+          token: crypto.randomBytes(16).toString('hex'),
+        };
+        challenge.url = this.create_('challenge', {authz, challenge, key});
+        authz.challenges.push(challenge);
+        return authzUrl;
+      });
+      const order = {
+        status: 'pending', identifiers: payload.identifiers, authorizations,
+      };
+      const orderUrl = this.create_('order', order);
+      order.finalize = this.create_('finalize', order);
+      this.reply_(res, 201, order, {Location: orderUrl});
+    } else if (req.url.startsWith('/challenge/')) {
+      const {authz, challenge} = this.objects_.get(url);
+      this.reply_(res, 200, challenge);
+      await this.validate_(authz, challenge, key);
+    } else if (req.url.startsWith('/finalize/')) {
+      const order = this.objects_.get(url);
+      if (order.authorizations.some(
+          (authzUrl) => this.objects_.get(authzUrl).status !== 'valid')) {
+        problem('orderNotReady', 'Order not ready');
+        return;
+      }
+      const csr = Der.decode(Buffer.from(payload.csr, 'base64'));
+      const info = csr.child(0);
+      const subjectKey = crypto.createPublicKey(
+          {key: info.child(2).raw, format: 'der', type: 'spki'});
+      if (!crypto.verify('sha256', info.raw, subjectKey,
+                         csr.child(2).contents.subarray(1))) {
+        problem('badCSR', 'Bad CSR signature');
+        return;
+      }
+      const san = Der.decode(info.child(3).child(0).child(1).child(0).child(0)
+                                 .child(1).contents);
+      const hostnames = san.children.map((n) => String(n.contents));
+      const cert = this.ca.issue(hostnames, subjectKey);
+      order.status = 'valid';
+      order.certificate = this.create_('cert', this.ca.chain(cert));
+      this.reply_(res, 200, order);
+    } else if (this.objects_.has(url)) {
+      // POST-as-GET.
+      const object = this.objects_.get(url);
+      if (typeof object === 'string') {
+        this.reply_(res, 200, object,
+                    {'Content-Type': 'application/pem-certificate-chain'});
+      } else {
+        this.reply_(res, 200, object);
+      }
+    } else {
+      this.reply_(res, 404, {detail: 'Not found'});
+    }
+  }
+
+  /**
+   * Check an http-01 challenge.
+   * @private
+   * @param {!Object} authz The authorization.
+   * @param {!Object} challenge The challenge.
+   * @param {!crypto.KeyObject} key The account key.
+   */
+  async validate_(authz, challenge, key) {
+    const jwk = key.export({format: 'jwk'});
+    const thumbprint = Acme.base64url(crypto.createHash('sha256').update(
+        JSON.stringify({crv: jwk.crv, kty: jwk.kty, x: jwk.x, y: jwk.y}))
+        .digest());
+    let res;
+    try {
+      res = await Acme.request('GET', 'http://localhost:' +
+          this.challengePort + Acme.CHALLENGE_PATH + challenge.token, {},
+          null);
+    } catch (e) {
+      res = {status: 0, body: Buffer.from(String(e))};
+    }
+    if (res.status === 200 &&
+        String(res.body) === challenge.token + '.' + thumbprint) {
+      challenge.status = authz.status = 'valid';
+    } else {
+      challenge.status = authz.status = 'invalid';
+      challenge.error = {detail: 'Challenge response ' + res.status};
+    }
+  }
+}
+exports.FakeAcme = FakeAcme;
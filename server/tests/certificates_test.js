@@ -0,0 +1,281 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for TLS certificate management.
+ */
+'use strict';
+
+const Certificates = require('../certificates');
+const {Ca, FakeAcme, generateKey, makeOcspResponse, ocspCertId, pem,
+       readBody} = require('./certificates_common');
+const crypto = require('crypto');
+const Der = require('../der');
+const fs = require('fs');
+const http = require('http');
+const net = require('net');
+const os = require('os');
+const path = require('path');
+const {T} = require('./testing');
+const tls = require('tls');
+
+/**
+ * Start a TCP server whose connections are wrapped by a
+ * Certificates.Manager, and which greets each client with the
+ * hostname it asked for.
+ * @param {!Certificates.Manager} manager The manager.
+ * @return {!Promise<!net.Server>}
+ */
+async function serve(manager) {
+  const server = net.createServer((socket) => {
+    const secure = manager.wrap(socket);
+    secure.on('error', () => {});
+    secure.on('secure', () => secure.end('Hello ' + secure.servername));
+  });
+  await new Promise((resolve) => server.listen(0, 'localhost', resolve));
+  return server;
+}
+
+/**
+ * Connect to a server started by serve().
+ * @param {!net.Server} server The server.
+ * @param {!Ca} ca CA to trust.
+ * @param {string=} servername Hostname to ask for.
+ * @return {!Promise<{subject: string, ocsp: ?Buffer, text: string}>}
+ *     The certificate's subject, any stapled OCSP response, and the
+ *     greeting.
+ */
+function connect(server, ca, servername) {
+  return new Promise((resolve, reject) => {
+    let ocsp = null;
+    let text = '';
+    const client = tls.connect({
+      port: server.address().port,
+      host: 'localhost',
+      servername,
+      ca: pem(ca.cert),
+      checkServerIdentity: () => undefined,
+      requestOCSP: true,
+    });
+    client.on('OCSPResponse', (response) => {
+      ocsp = response;
+    });
+    client.on('data', (data) => {
+      text += data;
+    });
+    client.on('error', reject);
+    client.on('end', () => {
+      resolve({subject: client.getPeerCertificate().subject.CN, ocsp, text});
+      client.destroy();
+    });
+  });
+}
+
+/**
+ * Unit tests for Certificates.ocspRequest.
+ * @param {!T} t The test runner object.
+ */
+exports.testCertificatesOcspRequest = function(t) {
+  const ca = new Ca();
+  const cert = ca.issue(['a.test'], generateKey());
+  const request = Der.decode(Certificates.ocspRequest(cert, ca.cert));
+  const certId = Der.decode(ocspCertId(request.raw));
+  const sha1 = (data) => crypto.createHash('sha1').update(data).digest();
+  t.expect('ocspRequest(...) hash algorithm',
+           certId.child(0).child(0).oid(), '1.3.14.3.2.26');
+  const caCert = Der.decode(ca.cert).child(0);
+  t.expect('ocspRequest(...) issuerNameHash',
+           certId.child(1).contents.toString('hex'),
+           sha1(caCert.child(5).raw).toString('hex'));
+  t.expect('ocspRequest(...) issuerKeyHash',
+           certId.child(2).contents.toString('hex'),
+           sha1(caCert.child(6).child(1).contents.subarray(1))
+               .toString('hex'));
+  t.expect('ocspRequest(...) serialNumber',
+           certId.child(3).contents.toString('hex'),
+           new crypto.X509Certificate(cert).serialNumber.toLowerCase());
+};
+
+/**
+ * Unit tests for Certificates.parseOcspResponse.
+ * @param {!T} t The test runner object.
+ */
+exports.testCertificatesParseOcspResponse = function(t) {
+  const key = generateKey();
+  const certId = Der.sequence([Der.integer(1)]);
+  const now = Date.UTC(2020, 10, 14);
+  const hour = 60 * 60 * 1000;
+  const thisUpdate = new Date(now - hour);
+
+  let response = makeOcspResponse(
+      {certId, key, thisUpdate, nextUpdate: new Date(now + 3 * hour)});
+  let result = Certificates.parseOcspResponse(response, now);
+  t.expect('parseOcspResponse(...).response', result.response, response);
+  t.expect('parseOcspResponse(...).expires', result.expires, now + 3 * hour);
+  t.expect('parseOcspResponse(...).refreshAt', result.refreshAt,
+           now + 1.5 * hour);
+
+  response = makeOcspResponse({certId, key, thisUpdate, nextUpdate: null});
+  result = Certificates.parseOcspResponse(response, now);
+  t.expect('parseOcspResponse(<no nextUpdate>).expires', result.expires,
+           thisUpdate.getTime() + Certificates.MAX_OCSP_AGE);
+
+  response = makeOcspResponse(
+      {certId, key, thisUpdate, nextUpdate: new Date(now + 100 * 24 * hour)});
+  result = Certificates.parseOcspResponse(response, now);
+  t.expect('parseOcspResponse(<distant nextUpdate>).expires', result.expires,
+           now + Certificates.MAX_OCSP_AGE);
+
+  const invalid = [
+    ['revoked', makeOcspResponse({certId, key, thisUpdate, revoked: true}),
+     'Certificate status is not good'],
+    ['expired', makeOcspResponse({certId, key, thisUpdate,
+                                  nextUpdate: new Date(now - 1)}),
+     'OCSP response has expired'],
+    ['tryLater', Der.sequence([Der.encode(Der.Tag.ENUMERATED,
+                                          Buffer.from([3]))]),
+     'OCSP response status 3'],
+  ];
+  for (const [name, data, message] of invalid) {
+    try {
+      Certificates.parseOcspResponse(data, now);
+      t.fail('parseOcspResponse(<' + name + '>)', 'Did not throw');
+    } catch (e) {
+      t.expect('parseOcspResponse(<' + name + '>) throws', e.message,
+               message);
+    }
+  }
+};
+
+/**
+ * Unit tests for Certificates.Manager, using certificates from files.
+ * @param {!T} t The test runner object.
+ */
+exports.testCertificatesManager = async function(t) {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'certificates_test-'));
+  const ca = new Ca();
+  // OCSP responder, reporting every certificate as good.
+  const ocspRequests = [];
+  let ocsp;
+  const responder = http.createServer(async (req, res) => {
+    const body = await readBody(req);
+    ocspRequests.push(body);
+    ocsp = makeOcspResponse({certId: ocspCertId(body), key: ca.key});
+    res.writeHead(200, {'Content-Type': 'application/ocsp-response'});
+    res.end(ocsp);
+  });
+  await new Promise((resolve) => responder.listen(0, 'localhost', resolve));
+  const ocspUrl = 'http://localhost:' + responder.address().port + '/';
+
+  const hosts = {};
+  for (const hostname of ['a.test', 'b.test']) {
+    const key = generateKey();
+    const cert = ca.issue([hostname], key,
+                          (hostname === 'b.test') ? ocspUrl : undefined);
+    const certFile = path.join(dir, hostname + '.pem');
+    const keyFile = path.join(dir, hostname + '-key.pem');
+    fs.writeFileSync(certFile, ca.chain(cert));
+    fs.writeFileSync(keyFile, key.export({type: 'pkcs8', format: 'pem'}));
+    hosts[hostname] = {certFile, keyFile};
+  }
+  const log = [];
+  const manager = new Certificates.Manager({
+    directory: dir,
+    hosts,
+    challengePort: 0,
+    log: (...args) => log.push(args.join(' ')),
+  });
+  await manager.start();
+  const server = await serve(manager);
+  try {
+    t.expect('Manager.p.start() loads certificates', log.length, 2);
+
+    let result = await connect(server, ca, 'b.test');
+    t.expect('Manager SNI certificate', result.subject, 'b.test');
+    t.expect('Manager SNI greeting', result.text, 'Hello b.test');
+    t.expect('Manager OCSP request made', ocspRequests.length, 1);
+    t.assert('Manager OCSP response stapled',
+             result.ocsp && result.ocsp.equals(ocsp));
+    result = await connect(server, ca, 'B.TEST');
+    t.assert('Manager OCSP response cached',
+             ocspRequests.length === 1 && result.ocsp &&
+             result.ocsp.equals(ocsp));
+
+    result = await connect(server, ca, 'a.test');
+    t.expect('Manager certificate with no OCSP responder', result.subject,
+             'a.test');
+    t.expect('Manager no OCSP response', result.ocsp, null);
+    result = await connect(server, ca, undefined);
+    t.expect('Manager default certificate', result.subject, 'a.test');
+    result = await connect(server, ca, 'c.test');
+    t.expect('Manager unknown hostname certificate', result.subject,
+             'a.test');
+  } finally {
+    manager.stop();
+    server.close();
+    responder.close();
+    fs.rmSync(dir, {recursive: true});
+  }
+};
+
+/**
+ * Unit tests for Certificates.Manager, obtaining certificates via ACME.
+ * @param {!T} t The test runner object.
+ */
+exports.testCertificatesManagerAcme = async function(t) {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'certificates_test-'));
+  const ca = new Ca();
+  // Find a free port on which the manager can answer challenges.
+  const probe = net.createServer();
+  await new Promise((resolve) => probe.listen(0, 'localhost', resolve));
+  const challengePort = probe.address().port;
+  await new Promise((resolve) => probe.close(resolve));
+  const acme = new FakeAcme(ca, challengePort);
+  await acme.start();
+  const options = {
+    directory: dir,
+    hosts: {'a.test': {}},
+    acmeDirectory: acme.directoryUrl,
+    challengePort,
+    pollInterval: 10,
+    log: () => {},
+  };
+  let manager = new Certificates.Manager(options);
+  await manager.start();
+  const server = await serve(manager);
+  try {
+    const result = await connect(server, ca, 'a.test');
+    t.expect('Manager ACME certificate', result.subject, 'a.test');
+    t.expect('Manager ACME files', fs.readdirSync(dir).sort().join(),
+             'a.test.crt,a.test.key,account.key');
+    t.expect('Manager ACME key file mode',
+             fs.statSync(path.join(dir, 'a.test.key')).mode & 0o777, 0o600);
+    t.expect('Manager ACME challenges removed', manager.responder.size, 0);
+
+    // Restarted: certificate is loaded, not requested again.
+    manager.stop();
+    acme.requests.length = 0;
+    manager = new Certificates.Manager(options);
+    await manager.start();
+    t.expect('Manager ACME restart requests', acme.requests.length, 0);
+  } finally {
+    manager.stop();
+    server.close();
+    acme.stop();
+    fs.rmSync(dir, {recursive: true});
+  }
+};
@@ -0,0 +1,176 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for the command parser.
+ */
+'use strict';
+
+const Command = require('../command');
+const {getInterpreter} = require('./interpreter_common');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Command.parse.
+ * @param {!T} t The test runner object.
+ */
+exports.testCommandParse = function(t) {
+  const cases = [
+    ['', null],
+    ['   ', null],
+    ['look', {verbstr: 'look', argstr: '', args: [], dobjstr: '',
+              prepstr: '', iobjstr: ''}],
+    ['  get   red  ball ', {verbstr: 'get', argstr: '  red  ball ',
+                           args: ['red', 'ball'], dobjstr: 'red ball',
+                           prepstr: '', iobjstr: ''}],
+    ['put ball in box', {dobjstr: 'ball', prepstr: 'in', iobjstr: 'box'}],
+    ['look at me', {dobjstr: '', prepstr: 'at', iobjstr: 'me'}],
+    // The first preposition, and the longest there.
+    ['put ball on top of box in hall',
+     {dobjstr: 'ball', prepstr: 'on top of', iobjstr: 'box in hall'}],
+    ['take it out  of box', {dobjstr: 'it', prepstr: 'out of',
+                             iobjstr: 'box'}],
+    // Quoted words are not prepositions.
+    ['say "in the box" to bob', {args: ['in the box', 'to', 'bob'],
+                                 dobjstr: 'in the box', prepstr: 'to',
+                                 iobjstr: 'bob'}],
+    ['say "a \\"b\\"', {args: ['a "b"'], dobjstr: 'a "b"'}],
+  ];
+  for (const [cmdstr, expected] of cases) {
+    const name = 'parse(' + JSON.stringify(cmdstr) + ')';
+    const parsed = Command.parse(cmdstr);
+    if (expected === null) {
+      t.expect(name, parsed, null);
+      continue;
+    }
+    t.expect(name + '.cmdstr', parsed.cmdstr, cmdstr);
+    for (const key in expected) {
+      t.expect(name + '.' + key, String(parsed[key]), String(expected[key]));
+    }
+  }
+};
+
+/**
+ * Unit tests for Command.strength.
+ * @param {!T} t The test runner object.
+ */
+exports.testCommandStrength = function(t) {
+  t.expect('strength("Ball", "ball")', Command.strength('Ball', 'ball', []),
+           3);
+  t.expect('strength("orb", ...)',
+           Command.strength('orb', 'ball', ['sphere', 'orb']), 2);
+  t.expect('strength("sph", ...)',
+           Command.strength('sph', 'ball', ['sphere', 'orb']), 1);
+  t.expect('strength("cube", ...)',
+           Command.strength('cube', 'ball', ['sphere']), 0);
+  t.expect('strength("", ...)', Command.strength('', 'ball', []), 0);
+};
+
+/**
+ * Unit tests for Command.splitOrdinal.
+ * @param {!T} t The test runner object.
+ */
+exports.testCommandSplitOrdinal = function(t) {
+  const cases = [
+    ['second lamp', '2:lamp'],
+    ['  Third  red lamp ', '3:red lamp'],
+    ['2nd lamp', '2:lamp'],
+    ['11th lamp', '11:lamp'],
+    ['0th lamp', null],
+    ['second', null],
+    ['lamp second', null],
+    ['secondhand lamp', null],
+  ];
+  for (const [str, expected] of cases) {
+    const split = Command.splitOrdinal(str);
+    t.expect('splitOrdinal(' + JSON.stringify(str) + ')',
+             split && split.ordinal + ':' + split.rest, expected);
+  }
+};
+
+/**
+ * Unit tests for Command.match, Command.resolve and Command.findVerb.
+ * @param {!T} t The test runner object.
+ */
+exports.testCommandMatchResolveAndFindVerb = function(t) {
+  const intrp = getInterpreter();
+  intrp.createThreadForSrc(`
+      var thing = {name: 'thing'};
+      thing.take = function() {};
+      thing.take.verb = 'take|get';
+      thing.take.dobj = 'this';
+      thing.take.prep = 'none';
+      thing.take.iobj = 'none';
+      thing.put = function() {};
+      thing.put.verb = 'put';
+      thing.put.dobj = 'this';
+      thing.put.prep = 'in/inside/into';
+      thing.put.iobj = 'any';
+      var ball = Object.create(thing);
+      ball.name = 'red ball';
+      ball.aliases = ['orb'];
+      var box = Object.create(thing);
+      box.name = 'box';
+      box.put = 'not a verb';  // Shadows thing.put.
+      var redBox = Object.create(thing);
+      redBox.name = 'red box';
+      var objects = [ball, box, redBox, 42, ball];
+      var results = [];
+      var cmd = CC.commandParse('get ball');
+      cmd.dobj = ball;
+      cmd.iobj = null;
+      var verb = CC.commandFindVerb(cmd, [null, ball]);
+      results.push(verb.host === ball, verb.key);
+      cmd = CC.commandParse('put ball into box');
+      cmd.dobj = ball;
+      cmd.iobj = box;
+      results.push(CC.commandFindVerb(cmd, [box, ball]).host === ball);
+      cmd.dobj = box;
+      results.push(CC.commandFindVerb(cmd, [box]));
+      results.push(CC.commandMatch('red', objects).length);
+      results.push(CC.commandMatch(' orb ', objects)[0] === ball);
+      results.push(CC.commandMatch('box', objects)[0] === box);
+      var kit = {name: 'first aid kit'};
+      var lamps = [{name: 'lamp'}, {name: 'lamp'}, kit];
+      var r = CC.commandResolve('lamp', lamps);
+      results.push([r.match, r.matches.length, r.ambiguous, r.ordinal]);
+      r = CC.commandResolve('second lamp', lamps);
+      results.push([r.match === lamps[1], r.ambiguous, r.ordinal]);
+      r = CC.commandResolve('3rd lamp', lamps);
+      results.push([r.match, r.matches.length, r.ordinal]);
+      results.push(CC.commandResolve('first aid', lamps).match === kit);
+      try {
+        CC.commandMatch('x', 'not an array');
+      } catch (e) {
+        results.push(e.name);
+      }
+  `);
+  intrp.run();
+  const results = intrp.pseudoToNative(
+      intrp.global.get('results', intrp.ROOT));
+  t.expect('findVerb (take)', results.slice(0, 2).join(), 'true,take');
+  t.expect('findVerb (put, dobj this)', results[2], true);
+  t.expect('findVerb (put, shadowed)', results[3], null);
+  t.expect('match (prefix of two)', results[4], 2);
+  t.expect('match (alias)', results[5], true);
+  t.expect('match (name beats prefix)', results[6], true);
+  t.expect('resolve (ambiguous)', String(results[7]), ',2,true,');
+  t.expect('resolve (ordinal)', String(results[8]), 'true,false,2');
+  t.expect('resolve (ordinal too big)', String(results[9]), ',2,3');
+  t.expect('resolve (ordinal-like name)', results[10], true);
+  t.expect('match (bad objects)', results[11], 'TypeError');
+};
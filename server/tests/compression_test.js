@@ -0,0 +1,85 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for compression.
+ */
+'use strict';
+
+const Compression = require('../compression');
+const {T} = require('./testing');
+const zlib = require('zlib');
+
+/**
+ * Get the name of the error thrown by a function.
+ * @param {function()} func The function.
+ * @return {string} The error's name, or 'none'.
+ */
+function errorName(func) {
+  try {
+    func();
+  } catch (e) {
+    return e.name;
+  }
+  return 'none';
+}
+
+/**
+ * Unit tests for compression and decompression.
+ * @param {!T} t The test runner object.
+ */
+exports.testCompression = function(t) {
+  const data = Buffer.from('Code City '.repeat(1000));
+  for (const format of Object.keys(Compression.FORMATS)) {
+    if (!Compression.FORMATS[format]) continue;  // Unsupported.
+    const compressed = Compression.compress(format, data);
+    t.assert(format + ' compresses', compressed.length < data.length / 10,
+             String(compressed.length));
+    t.assert(format + ' roundtrip',
+             Compression.decompress(format, compressed).equals(data));
+    t.assert(format + ' level 1', Compression.decompress(format,
+        Compression.compress(format, data, 1)).equals(data));
+  }
+  // Interoperable with other implementations.
+  t.expect('gzip (from zlib)', String(Compression.decompress('gzip',
+      zlib.gzipSync('hello'))), 'hello');
+  t.expect('deflate (to zlib)', String(zlib.inflateSync(
+      Compression.compress('deflate', Buffer.from('hello')))), 'hello');
+
+  const gzipped = Compression.compress('gzip', data);
+  t.expect('decompress (maxLength)',
+           Compression.decompress('gzip', gzipped, data.length).length,
+           data.length);
+  for (const [name, func, expected] of [
+    ['format', () => Compression.compress('lzma', data), 'TypeError'],
+    ['format (inherited)', () => Compression.compress('toString', data),
+     'TypeError'],
+    ['level', () => Compression.compress('gzip', data, 10), 'RangeError'],
+    ['level (br)', () => Compression.compress('br', data, 11), 'RangeError'],
+    ['maxLength', () => Compression.decompress('gzip', gzipped, -1),
+     'RangeError'],
+    ['too long', () => Compression.decompress('gzip', gzipped, 100),
+     'RangeError'],
+    ['too long (0)', () => Compression.decompress('gzip', gzipped, 0),
+     'RangeError'],
+    ['invalid', () => Compression.decompress('gzip', data), 'Error'],
+  ]) {
+    t.expect('Bad ' + name, errorName(func), expected);
+  }
+  t.assert('decompressCost', Compression.decompressCost(data) <
+           Compression.compressCost(data));
+};
@@ -0,0 +1,124 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for configuration file handling.
+ */
+'use strict';
+
+const Config = require('../config');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Config.parse and Config.validate.
+ * @param {!T} t The test runner object.
+ */
+exports.testConfigParse = function(t) {
+  let config = Config.parse('{"databaseDirectory": "./", ' +
+                            '"admin": {"port": 7790}}');
+  t.expect('parse(...).admin.port', config.admin.port, 7790);
+  t.expect('parse(...).checkpointInterval (default)',
+           config.checkpointInterval, 600);
+  config = Config.parse('{"checkpointInterval": 0}');
+  t.expect('parse(...).checkpointInterval (0)', config.checkpointInterval, 0);
+
+  const cases = [
+    [{checkpointInterval: '60'},
+     ['checkpointInterval: must be a number (not "60")']],
+    [{checkpointInterval: -1},
+     ['checkpointInterval: must be at least 0 (not -1)']],
+    [{checkpointStorage: 'file'},
+     ['checkpointStorage: must be one of "files", "log" (not "file")']],
+    [{checkpointCompression: 'lzma'},
+     ['checkpointCompression: Unknown compression method: lzma']],
+    [{checkpointIntervl: 60},
+     ['checkpointIntervl: unknown option ' +
+      '(did you mean "checkpointInterval"?)']],
+    [{nonsense: true}, ['nonsense: unknown option']],
+    [{admin: {port: 7790, tokenfile: 'tokens'}},
+     ['admin.tokenfile: unknown option (did you mean "tokenFile"?)']],
+    [{admin: []}, ['admin: must be an object (not array)']],
+    [{trustedProxies: ['10.0.0.0/8', 8]},
+     ['trustedProxies[1]: must be a string (not number)']],
+    [{rateLimits: {exempt: [], login: {limit: 3, perod: 1}}},
+     ['rateLimits.login.perod: unknown option (did you mean "period"?)']],
+    [{tls: {hosts: {'example.com': {certFile: 1}}}},
+     ['tls.hosts.example.com.certFile: must be a string (not number)']],
+    [[], ['Configuration: must be an object (not array)']],
+  ];
+  for (const [config, expected] of cases) {
+    const name = 'validate(' + JSON.stringify(config) + ')';
+    t.expect(name, JSON.stringify(Config.validate(config)),
+             JSON.stringify(expected));
+  }
+  t.expect('validate(<two problems>)',
+           Config.validate({lazyLoading: 'yes', journalInterval: null}).length,
+           2);
+
+  try {
+    Config.parse('{"checkpointInterval": 60,\n "admin": {"port": }}');
+    t.fail('parse(<bad JSON>)', "Didn't throw.");
+  } catch (e) {
+    t.expect('parse(<bad JSON>) throws', e.name, 'SyntaxError');
+  }
+  try {
+    Config.parse('{"checkpointInterval": "60"}');
+    t.fail('parse(<invalid>)', "Didn't throw.");
+  } catch (e) {
+    t.expect('parse(<invalid>) message', e.message,
+             'Invalid configuration:\n' +
+             '  checkpointInterval: must be a number (not "60")');
+  }
+};
+
+/**
+ * Unit tests for Config.reload.
+ * @param {!T} t The test runner object.
+ */
+exports.testConfigReload = function(t) {
+  const before = {
+    checkpointInterval: 600,
+    fetch: {allow: ['example.com']},
+    mail: {host: 'smtp.example.com', rateLimit: 20},
+    admin: {port: 7790},
+  };
+  const after = {
+    checkpointInterval: 60,
+    fetch: {allow: ['example.com', 'example.org']},
+    mail: {host: 'smtp.example.org', rateLimit: 10},
+    admin: {port: 7790},
+    metrics: {port: 9464},
+  };
+  const result = Config.reload(before, after);
+  t.expect('reload(...).applied', String(result.applied),
+           'checkpointInterval,fetch,mail.rateLimit');
+  t.expect('reload(...).restartRequired', String(result.restartRequired),
+           'mail.host,metrics');
+  t.expect('reload(...).config.checkpointInterval',
+           result.config.checkpointInterval, 60);
+  t.expect('reload(...).config.fetch', result.config.fetch, after.fetch);
+  t.expect('reload(...).config.mail', JSON.stringify(result.config.mail),
+           '{"host":"smtp.example.com","rateLimit":10}');
+  t.expect('reload(...).config.metrics', result.config.metrics, undefined);
+  t.expect('reload(...) leaves old config unchanged', before.mail.rateLimit,
+           20);
+
+  const unchanged = Config.reload(before, before);
+  t.expect('reload(<unchanged>).applied', unchanged.applied.length, 0);
+  t.expect('reload(<unchanged>).restartRequired',
+           unchanged.restartRequired.length, 0);
+};
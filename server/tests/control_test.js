@@ -0,0 +1,139 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for the gRPC control-plane service.
+ */
+'use strict';
+
+const Control = require('../control');
+const fs = require('fs');
+const Grpc = require('../grpc');
+const {getInterpreter} = require('./interpreter_common');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Control.SERVICE.
+ * @param {!T} t The test runner object.
+ */
+exports.testControlService = function(t) {
+  // Every method (and message field) in control.proto should be
+  // defined by Control.SERVICE.
+  const proto = fs.readFileSync('control.proto', 'utf8');
+  const methods = [];
+  for (const [, method] of proto.matchAll(/^\s*rpc (\w+)\(/gm)) {
+    methods.push(method);
+  }
+  t.expect('methods', Object.keys(Control.SERVICE.methods).join(),
+           methods.join());
+  const stats = Control.SERVICE.methods.GetStats.response;
+  const fields = /message Stats \{([^}]*)\}/.exec(proto)[1];
+  for (const [, name, id] of fields.matchAll(/(\w+) = (\d+);/g)) {
+    const camel = name.replace(/_(\w)/g, (_, c) => c.toUpperCase());
+    t.expect('Stats.' + camel + '.id', stats[camel] && stats[camel].id,
+             Number(id));
+  }
+};
+
+/**
+ * Unit tests for Control.Server.
+ * @param {!T} t The test runner object.
+ */
+exports.testControlServer = async function(t) {
+  const intrp = getInterpreter({noLog: ['admin']});
+  intrp.createThreadForSrc(`
+      var $ = {};
+      $.user = {name: 'User prototype', connection: null};
+      $.alice = Object.create($.user);
+      $.alice.name = 'Alice';
+      $.alice.connection = {};
+      $.bob = Object.create($.user);
+      $.bob.name = 'Bob';
+      $.userDatabase = {byMd5: Object.create(null)};
+      $.userDatabase.byMd5.a1 = $.alice;
+      $.userDatabase.byMd5.a2 = $.alice;
+      $.userDatabase.byMd5.b1 = $.bob;
+      $.sleeper = function() {suspend(100000);};
+      setTimeout($.sleeper, 0);
+  `);
+  intrp.run();
+  const log = [];
+  const server = new Control.Server({
+    tokens: ['secret'],
+    interpreter: intrp,
+    checkpoint: () => log.push('checkpoint'),
+    shutdown: (code) => log.push('shutdown ' + code),
+  });
+  const port = await server.listen(0, '127.0.0.1');
+  const url = 'http://127.0.0.1:' + port;
+  const client = new Grpc.Client(url, Control.SERVICE,
+                                 {'authorization': 'Bearer secret'});
+  const stranger = new Grpc.Client(url, Control.SERVICE,
+                                   {'authorization': 'Bearer wrong'});
+  try {
+    try {
+      await stranger.call('GetStats', {});
+      t.fail('GetStats (wrong token)', "Didn't reject.");
+    } catch (e) {
+      t.expect('GetStats (wrong token) code', e.code,
+               Grpc.Status.UNAUTHENTICATED);
+    }
+
+    const stats = await client.call('GetStats', {});
+    t.expect('GetStats threads', stats.threads, 1);
+    t.expect('GetStats listeners', stats.listeners, 0);
+    t.assert('GetStats rssBytes', stats.rssBytes > 0);
+
+    const {threads} = await client.call('ListThreads', {});
+    t.expect('ListThreads', JSON.stringify(
+        threads.map((thread) => [thread.status, thread.owner])),
+        JSON.stringify([['SLEEPING', 'CC.root']]));
+    let r = await client.call('KillThread', {id: threads[0].id});
+    t.expect('KillThread', r.killed, true);
+    r = await client.call('KillThread', {id: threads[0].id});
+    t.expect('KillThread (again)', r.killed, false);
+    t.expect('threads after KillThread', intrp.getThreads().length, 0);
+
+    const {users} = await client.call('ListUsers', {});
+    t.expect('ListUsers', JSON.stringify(users), JSON.stringify([
+      {selector: '$.alice', name: 'Alice', connected: true},
+      {selector: '$.bob', name: 'Bob', connected: false},
+    ]));
+    r = await client.call('RemoveUser', {selector: '$.alice'});
+    t.expect('RemoveUser', r.removed, 2);
+    const byMd5 = intrp.global.get('$').get('userDatabase', intrp.ROOT)
+        .get('byMd5', intrp.ROOT);
+    t.expect('keys after RemoveUser', byMd5.ownKeys(intrp.ROOT).join(), 'b1');
+    try {
+      await client.call('RemoveUser', {selector: '$.carol'});
+      t.fail('RemoveUser (no such user)', "Didn't reject.");
+    } catch (e) {
+      t.expect('RemoveUser (no such user) code', e.code,
+               Grpc.Status.NOT_FOUND);
+    }
+
+    await client.call('Checkpoint', {});
+    await client.call('Shutdown', {exitCode: 3});
+    await new Promise((resolve) => setTimeout(resolve, 10));
+    t.expect('checkpoint and shutdown calls', log.join(),
+             'checkpoint,shutdown 3');
+  } finally {
+    client.close();
+    stranger.close();
+    await server.close();
+  }
+};
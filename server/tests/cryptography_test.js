@@ -0,0 +1,134 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for cryptographic primitives.
+ */
+'use strict';
+
+const Cryptography = require('../cryptography');
+const {T} = require('./testing');
+
+/**
+ * Get the name of the error thrown by (or rejecting the promise
+ * returned by) a function.
+ * @param {function()} func The function.
+ * @return {!Promise<string>} The error's name, or 'none'.
+ */
+async function errorName(func) {
+  try {
+    await func();
+  } catch (e) {
+    return e.name;
+  }
+  return 'none';
+}
+
+/**
+ * Unit tests for hashes and HMACs.
+ * @param {!T} t The test runner object.
+ */
+exports.testCryptographyHash = async function(t) {
+  t.expect('hash sha256', Cryptography.hash('sha256', 'abc'),
+      'ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad');
+  t.expect('hash sha512 (base64)',
+      Cryptography.hash('sha512', '', 'base64').slice(0, 16),
+      'z4PhNX7vuL3xVChQ');
+  // RFC 4231, test case 2.
+  t.expect('hmac sha256',
+      Cryptography.hmac('sha256', 'Jefe', 'what do ya want for nothing?'),
+      '5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843');
+  for (const [name, func] of [
+    ['md5', () => Cryptography.hash('md5', 'abc')],
+    ['data', () => Cryptography.hash('sha256', 42)],
+    ['encoding', () => Cryptography.hash('sha256', '', 'latin1')],
+    ['key', () => Cryptography.hmac('sha256', null, '')],
+  ]) {
+    t.expect('Bad ' + name, await errorName(func), 'TypeError');
+  }
+  t.assert('hashCost', Cryptography.hashCost('x'.repeat(1024 * 1024)) > 1);
+};
+
+/**
+ * Unit tests for key derivation.
+ * @param {!T} t The test runner object.
+ */
+exports.testCryptographyKeyDerivation = async function(t) {
+  // RFC 7914, section 11.  (Its scrypt vectors all have p > 1.)
+  t.expect('pbkdf2',
+      await Cryptography.pbkdf2('sha256', 'passwd', 'salt', 1, 16),
+      '55ac046e56e3089fec1691c22544b605');
+  t.expect('scrypt', await Cryptography.scrypt('password', 'NaCl', 10, 16),
+      '27b418c674c769d12501fbb1f53bac32');
+  for (const [name, func] of [
+    ['iterations', () => Cryptography.pbkdf2('sha256', 'p', 's', 0, 16)],
+    ['length', () => Cryptography.pbkdf2('sha256', 'p', 's', 1, 1e6)],
+    ['cost', () => Cryptography.scrypt('p', 's', 99, 16)],
+  ]) {
+    t.expect('Bad ' + name, await errorName(func), 'RangeError');
+  }
+  t.assert('pbkdf2Cost',
+           Cryptography.pbkdf2Cost(1000000, 64) >
+           Cryptography.pbkdf2Cost(1000000, 32));
+  t.assert('scryptCost',
+           Cryptography.scryptCost(16) === 2 * Cryptography.scryptCost(15));
+};
+
+/**
+ * Unit tests for comparison and random numbers.
+ * @param {!T} t The test runner object.
+ */
+exports.testCryptographyMisc = async function(t) {
+  t.expect('equal (same)', Cryptography.equal('abc', 'abc'), true);
+  t.expect('equal (different)', Cryptography.equal('abc', 'abd'), false);
+  t.expect('equal (lengths)', Cryptography.equal('abc', 'abcd'), false);
+
+  const bytes = Cryptography.randomBytes(16);
+  t.assert('randomBytes', /^[0-9a-f]{32}$/.test(bytes), bytes);
+  t.expect('randomBytes (base64url)',
+           Cryptography.randomBytes(3, 'base64url').length, 4);
+  t.expect('randomBytes (too many)',
+           await errorName(() => Cryptography.randomBytes(1e6)),
+           'RangeError');
+
+  const n = Cryptography.randomInt(5, 7);
+  t.assert('randomInt', n === 5 || n === 6, String(n));
+  t.expect('randomInt (empty range)',
+           await errorName(() => Cryptography.randomInt(5, 5)), 'RangeError');
+};
+
+/**
+ * Unit tests for tokens and UUIDs.
+ * @param {!T} t The test runner object.
+ */
+exports.testCryptographyIdentifiers = async function(t) {
+  const random = (length) => Buffer.alloc(length, 0xff);
+  t.expect('token', Cryptography.token(undefined, random),
+           '_____________________w');
+  t.expect('token(3)', Cryptography.token(3, random), '____');
+  t.expect('uuid', Cryptography.uuid(undefined, undefined, random),
+           'ffffffff-ffff-4fff-bfff-ffffffffffff');
+  t.expect('uuid(7)', Cryptography.uuid(7, 0x0123456789ab, random),
+           '01234567-89ab-7fff-bfff-ffffffffffff');
+  t.assert('uuid (real)', /^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab]/.test(
+      Cryptography.uuid()));
+  const first = Cryptography.uuid(7);
+  await new Promise((resolve) => setTimeout(resolve, 2));
+  t.assert('uuid(7) ordered', first < Cryptography.uuid(7));
+  t.expect('uuid(1)', await errorName(() => Cryptography.uuid(1)),
+           'RangeError');
+};
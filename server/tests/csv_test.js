@@ -0,0 +1,94 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for CSV parsing and serializing.
+ */
+'use strict';
+
+const Csv = require('../csv');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Csv.parse.
+ * @param {!T} t The test runner object.
+ */
+exports.testCsvParse = function(t) {
+  const cases = [
+    ['a,b,c\r\n1,2,3\r\n', [['a', 'b', 'c'], ['1', '2', '3']]],
+    ['a,b\n\n1,2', [['a', 'b'], ['1', '2']]],
+    ['\ufeffname,desc\n"Hall","Big, ""grand""\nroom"\n',
+     [['name', 'desc'], ['Hall', 'Big, "grand"\nroom']]],
+    ['a,,\n,b,', [['a', '', ''], ['', 'b', '']]],
+    ['say "hi",x"y"z', [['say "hi"', 'x"y"z']]],
+    ['"q"tail,2', [['qtail', '2']]],
+    ['', []],
+  ];
+  for (const [csv, expected] of cases) {
+    t.expect('parse(' + JSON.stringify(csv) + ')',
+             JSON.stringify(Csv.parse(csv)), JSON.stringify(expected));
+  }
+  t.expect('parse(..., "\\t")', JSON.stringify(Csv.parse('a,b\tc', '\t')),
+           JSON.stringify([['a,b', 'c']]));
+  try {
+    Csv.parse('a\n"unterminated,b');
+    t.fail('parse(<unterminated>)', 'did not throw');
+  } catch (e) {
+    t.expect('parse(<unterminated>)', String(e),
+             'SyntaxError: Unterminated quoted field in record 2');
+  }
+};
+
+/**
+ * Unit tests for Csv.stringify and Csv.checkDelimiter.
+ * @param {!T} t The test runner object.
+ */
+exports.testCsvStringify = function(t) {
+  const records = [
+    ['plain', 'with,comma', 'with "quote"', 'multi\nline', ' padded'],
+    [1, true, null, undefined, ''],
+  ];
+  const csv = Csv.stringify(records);
+  t.expect('stringify(...)', csv,
+           'plain,"with,comma","with ""quote""","multi\nline"," padded"\r\n' +
+           '1,true,,,\r\n');
+  t.expect('parse(stringify(...))', JSON.stringify(Csv.parse(csv)),
+           JSON.stringify([records[0], ['1', 'true', '', '', '']]));
+  t.expect('stringify(..., ";")', Csv.stringify([['a;b', 'c,d']], ';'),
+           '"a;b";c,d\r\n');
+  for (const [name, records] of [['not array', ['a']],
+                                 ['object field', [[{}]]]]) {
+    try {
+      Csv.stringify(records);
+      t.fail('stringify(<' + name + '>)', 'did not throw');
+    } catch (e) {
+      t.expect('stringify(<' + name + '>)', e.name, 'TypeError');
+    }
+  }
+  t.expect('checkDelimiter()', Csv.checkDelimiter(undefined), ',');
+  t.expect('checkDelimiter("\\t")', Csv.checkDelimiter('\t'), '\t');
+  for (const delimiter of ['"', '\n', ';;', 9]) {
+    try {
+      Csv.checkDelimiter(delimiter);
+      t.fail('checkDelimiter(' + JSON.stringify(delimiter) + ')',
+             'did not throw');
+    } catch (e) {
+      t.expect('checkDelimiter(' + JSON.stringify(delimiter) + ')', e.name,
+               'TypeError');
+    }
+  }
+};
@@ -0,0 +1,108 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for the DER encoder and decoder.
+ */
+'use strict';
+
+const Der = require('../der');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for the Der encoding functions.
+ * @param {!T} t The test runner object.
+ */
+exports.testDerEncode = function(t) {
+  const cases = [
+    ['integer(0)', Der.integer(0), '020100'],
+    ['integer(127)', Der.integer(127), '02017f'],
+    ['integer(128)', Der.integer(128), '02020080'],
+    ['integer(65537)', Der.integer(65537), '0203010001'],
+    ['integer(<Buffer 00 00 ff>)', Der.integer(Buffer.from([0, 0, 0xff])),
+     '020200ff'],
+    ['oid(\'2.5.4.3\')', Der.oid('2.5.4.3'), '0603550403'],
+    ['oid(\'1.2.840.113549\')', Der.oid('1.2.840.113549'),
+     '06062a864886f70d'],
+    ['utf8String(\'é\')', Der.utf8String('é'), '0c02c3a9'],
+    ['bitString(...)', Der.bitString(Buffer.from([0xab])), '030200ab'],
+    ['context(0, ...)', Der.context(0, Der.integer(2)), 'a003020102'],
+    ['context(2, ..., false)', Der.context(2, Buffer.from('a'), false),
+     '820161'],
+    ['sequence([...])', Der.sequence([Der.NULL, Der.integer(1)]),
+     '30050500020101'],
+  ];
+  for (const [name, encoded, expected] of cases) {
+    t.expect('Der.' + name, encoded.toString('hex'), expected);
+  }
+  // Long form lengths.
+  const long = Der.octetString(Buffer.alloc(300));
+  t.expect('Der.octetString(<300 bytes>) header',
+           long.subarray(0, 4).toString('hex'), '0482012c');
+  t.expect('Der.octetString(<300 bytes>) length', long.length, 304);
+};
+
+/**
+ * Unit tests for Der.decode and Der.Element.
+ * @param {!T} t The test runner object.
+ */
+exports.testDerDecode = function(t) {
+  const encoded = Der.sequence([
+    Der.oid('1.2.840.113549.1.9.14'),
+    Der.context(0, Der.octetString(Buffer.alloc(200, 7))),
+    Der.encode(Der.Tag.UTC_TIME, Buffer.from('491231235959Z')),
+    Der.encode(Der.Tag.UTC_TIME, Buffer.from('500101000000Z')),
+    Der.encode(Der.Tag.GENERALIZED_TIME, Buffer.from('20201114123456.5Z')),
+  ]);
+  const root = Der.decode(encoded);
+  t.expect('Der.decode(...).tag', root.tag, Der.Tag.SEQUENCE);
+  t.expect('Der.decode(...).children.length', root.children.length, 5);
+  t.expect('Der.decode(...).raw', root.raw.equals(encoded), true);
+  t.expect('Element.p.oid()', root.child(0).oid(), '1.2.840.113549.1.9.14');
+  const octets = root.child(1).child(0);
+  t.expect('Der.decode(...) long form length', octets.contents.length, 200);
+  t.expect('Der.decode(...) primitive children', octets.children, null);
+  t.expect('Element.p.time() (UTCTime 2049)',
+           root.child(2).time().toISOString(), '2049-12-31T23:59:59.000Z');
+  t.expect('Element.p.time() (UTCTime 1950)',
+           root.child(3).time().toISOString(), '1950-01-01T00:00:00.000Z');
+  t.expect('Element.p.time() (GeneralizedTime)',
+           root.child(4).time().toISOString(), '2020-11-14T12:34:56.500Z');
+  t.assert('Element.p.child(5) throws', (() => {
+    try {
+      root.child(5);
+    } catch (e) {
+      return e instanceof RangeError;
+    }
+    return false;
+  })());
+
+  const invalid = [
+    ['truncated', encoded.subarray(0, encoded.length - 1)],
+    ['trailing data', Buffer.concat([encoded, Buffer.from([0])])],
+    ['child overruns parent', Buffer.from('30030203010203', 'hex')],
+    ['indefinite length', Buffer.from('3080020100', 'hex')],
+  ];
+  for (const [name, data] of invalid) {
+    try {
+      Der.decode(data);
+      t.fail('Der.decode(<' + name + '>)', 'Did not throw');
+    } catch (e) {
+      t.expect('Der.decode(<' + name + '>) throws', e.name, 'SyntaxError');
+    }
+  }
+};
@@ -0,0 +1,334 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for the Chrome DevTools Protocol adapter.
+ */
+'use strict';
+
+const Admin = require('../admin');
+const net = require('net');
+const {getInterpreter} = require('./interpreter_common');
+const {T} = require('./testing');
+const WebSocket = require('../websocket');
+
+/**
+ * A minimal DevTools Protocol client, connected to an admin server.
+ */
+class Client {
+  /**
+   * @param {number} port The admin server's port.
+   * @param {string} path The path (and query) to request.
+   */
+  constructor(port, path) {
+    /** @type {!Array<!Object>} Messages received but not yet awaited. */
+    this.messages = [];
+    /** @type {?function()} Called when a message is received. */
+    this.onMessage = null;
+    /** @type {number} */
+    this.nextId = 1;
+    this.socket = net.createConnection(port, '127.0.0.1');
+    this.socket.write('GET ' + path + ' HTTP/1.1\r\nHost: localhost\r\n' +
+                      'Upgrade: websocket\r\nConnection: Upgrade\r\n' +
+                      'Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n' +
+                      'Sec-WebSocket-Version: 13\r\n\r\n');
+    let received = Buffer.alloc(0);
+    /** @type {!Promise<string>} Resolves to the response's status line. */
+    this.response = new Promise((resolve) => {
+      let status = null;
+      this.socket.on('data', (data) => {
+        received = Buffer.concat([received, data]);
+        if (status === null) {
+          const end = received.indexOf('\r\n\r\n');
+          if (end === -1) return;
+          status = received.toString('latin1', 0, received.indexOf('\r\n'));
+          received = received.subarray(end + 4);
+          resolve(status);
+        }
+        // Parse unmasked server text frames.
+        while (received.length >= 2) {
+          let length = received[1];
+          let offset = 2;
+          if (length === 126) {
+            if (received.length < 4) break;
+            length = received.readUInt16BE(2);
+            offset = 4;
+          } else if (length === 127) {
+            if (received.length < 10) break;
+            length = Number(received.readBigUInt64BE(2));
+            offset = 10;
+          }
+          if (received.length < offset + length) break;
+          if ((received[0] & 0x0f) === WebSocket.Opcode.TEXT) {
+            this.messages.push(JSON.parse(
+                received.toString('utf8', offset, offset + length)));
+            if (this.onMessage) this.onMessage();
+          }
+          received = received.subarray(offset + length);
+        }
+      });
+    });
+  }
+
+  /**
+   * Wait for a message matching a predicate (discarding any that were
+   * received before it).
+   * @param {function(!Object): boolean} predicate The predicate.
+   * @return {!Promise<!Object>} The message.
+   */
+  async receive(predicate) {
+    for (;;) {
+      while (this.messages.length) {
+        const message = this.messages.shift();
+        if (predicate(message)) return message;
+      }
+      await new Promise((resolve) => this.onMessage = resolve);
+    }
+  }
+
+  /**
+   * Wait for an event.
+   * @param {string} method The event's name.
+   * @return {!Promise<!Object>} The event's params.
+   */
+  async event(method) {
+    return (await this.receive((message) => message.method === method))
+        .params;
+  }
+
+  /**
+   * Send a command and wait for the response.
+   * @param {string} method The method.
+   * @param {!Object=} params Its params.
+   * @return {!Promise<!Object>} The response.
+   */
+  async send(method, params = {}) {
+    const id = this.nextId++;
+    const data = Buffer.from(JSON.stringify({id, method, params}));
+    const frame = WebSocket.encodeFrame(WebSocket.Opcode.TEXT, data);
+    const headerLength = frame.length - data.length;
+    const mask = Buffer.from([0x37, 0xfa, 0x21, 0x3d]);
+    frame[1] |= 0x80;
+    this.socket.write(Buffer.concat([
+      frame.subarray(0, headerLength), mask,
+      Buffer.from(data.map((b, i) => b ^ mask[i % 4])),
+    ]));
+    // Keep events received meanwhile for later.
+    const others = [];
+    const response = await this.receive((message) => {
+      if (message.id === id) return true;
+      others.push(message);
+      return false;
+    });
+    this.messages.unshift(...others);
+    return response;
+  }
+
+  /** Close the connection. */
+  close() {
+    this.socket.destroy();
+  }
+}
+
+/**
+ * Unit tests for the DevTools Protocol adapter.
+ * @param {!T} t The test runner object.
+ */
+exports.testDevTools = async function(t) {
+  const intrp = getInterpreter({noLog: ['admin', 'net', 'unhandled']});
+  intrp.createThreadForSrc(`
+      var $ = {};
+      $.log = [];
+      $.debugMe = function(x) {
+        var y = x * 2;
+        $.log.push(y);
+        $.log.push(y + 1);
+      };
+  `);
+  intrp.run();
+  const admin = new Admin.Server({tokens: ['secret'], interpreter: intrp});
+  const port = await admin.listen(0, '127.0.0.1');
+  intrp.start();
+  let client;
+  try {
+    // Authentication.
+    client = new Client(port, '/devtools');
+    t.expect('No token', await client.response, 'HTTP/1.1 401 Missing or ' +
+             'invalid token');
+    client.close();
+    client = new Client(port, '/elsewhere?token=secret');
+    t.expect('Wrong path', await client.response,
+             'HTTP/1.1 404 No such route: /elsewhere');
+    client.close();
+    client = new Client(port, '/devtools?token=secret');
+    t.expect('Right token', await client.response,
+             'HTTP/1.1 101 Switching Protocols');
+
+    let r = await client.send('Runtime.enable');
+    t.expect('Runtime.enable', JSON.stringify(r.result), '{}');
+    let params = await client.event('Runtime.executionContextCreated');
+    t.expect('executionContextCreated context.id', params.context.id, 1);
+    r = await client.send('Nonsense.method');
+    t.expect('Unknown method error.code', r.error.code, -32601);
+    r = await client.send('Debugger.setAsyncCallStackDepth', {maxDepth: 32});
+    t.expect('Ignored method', JSON.stringify(r.result), '{}');
+
+    // Scripts and breakpoints.
+    r = await client.send('Debugger.enable');
+    t.expect('Debugger.enable', r.result.debuggerId, 'codecity');
+    const script = (await client.receive((message) =>
+        message.method === 'Debugger.scriptParsed' &&
+        message.params.url === 'codecity:///$.debugMe')).params;
+    r = await client.send('Debugger.getScriptSource',
+                          {scriptId: script.scriptId});
+    t.expect('Debugger.getScriptSource first line',
+             r.result.scriptSource.split('\n')[0], 'function(x) {');
+    r = await client.send('Debugger.setBreakpointByUrl',
+                          {url: 'codecity:///$.debugMe', lineNumber: 0});
+    t.expect('Debugger.setBreakpointByUrl locations',
+             JSON.stringify(r.result.locations),
+             JSON.stringify([{scriptId: script.scriptId, lineNumber: 1,
+                              columnNumber: 8}]));
+    const breakpointId = r.result.breakpointId;
+    r = await client.send('Debugger.setBreakpointByUrl',
+                          {url: 'codecity:///$.debugMe', lineNumber: 99});
+    t.assert('Debugger.setBreakpointByUrl (no statement) error', r.error);
+    r = await client.send('Debugger.setBreakpointByUrl',
+                          {url: 'codecity:///$.log', lineNumber: 0});
+    t.assert('Debugger.setBreakpointByUrl (not a function) error', r.error);
+
+    // Pausing and inspecting.
+    const debugMe = intrp.global.get('$').get('debugMe', intrp.ROOT);
+    intrp.createThreadForFuncCall(intrp.ROOT, debugMe, undefined, [20]);
+    params = await client.event('Debugger.paused');
+    let frame = params.callFrames[0];
+    t.expect('Debugger.paused hitBreakpoints',
+             JSON.stringify(params.hitBreakpoints),
+             JSON.stringify([breakpointId]));
+    t.expect('Debugger.paused callFrames[0].functionName',
+             frame.functionName, '$.debugMe');
+    t.expect('Debugger.paused callFrames[0].location.lineNumber',
+             frame.location.lineNumber, 1);
+    t.expect('Debugger.paused callFrames[0].scopeChain[0].type',
+             frame.scopeChain[0].type, 'local');
+    r = await client.send('Runtime.getProperties',
+                          {objectId: frame.scopeChain[0].object.objectId});
+    t.expect('Runtime.getProperties (scope)',
+             JSON.stringify(r.result.result.map((p) =>
+                 [p.name, p.value.type, p.value.value])),
+             JSON.stringify([['x', 'number', 20],
+                             ['y', 'undefined', undefined]]));
+    r = await client.send('Debugger.evaluateOnCallFrame',
+                          {callFrameId: frame.callFrameId,
+                           expression: 'x * 3'});
+    t.expect('Debugger.evaluateOnCallFrame', r.result.result.value, 60);
+
+    r = await client.send('Debugger.stepOver');
+    await client.event('Debugger.resumed');
+    params = await client.event('Debugger.paused');
+    frame = params.callFrames[0];
+    t.expect('Debugger.paused (after stepOver) location.lineNumber',
+             frame.location.lineNumber, 2);
+    r = await client.send('Debugger.removeBreakpoint', {breakpointId});
+    t.expect('Breakpoints after Debugger.removeBreakpoint',
+             intrp.getBreakpoints().length, 0);
+    r = await client.send('Debugger.resume');
+    await client.event('Debugger.resumed');
+    r = await client.send('Debugger.resume');
+    t.assert('Debugger.resume (not paused) error', r.error);
+
+    // Evaluation.
+    r = await client.send('Runtime.evaluate', {expression: '[1, 2]'});
+    t.expect('Runtime.evaluate (array)',
+             JSON.stringify([r.result.result.subtype,
+                             r.result.result.description]),
+             JSON.stringify(['array', 'Array(2)']));
+    r = await client.send('Runtime.getProperties',
+                          {objectId: r.result.result.objectId});
+    t.expect('Runtime.getProperties (object) names',
+             r.result.result.map((p) => p.name).join(), '0,1,length,__proto__');
+    r = await client.send('Runtime.evaluate',
+                          {expression: 'throw new RangeError("oops")'});
+    t.expect('Runtime.evaluate (throws)',
+             r.result.exceptionDetails.exception.description,
+             'RangeError: oops');
+    r = await client.send('Runtime.evaluate', {expression: '0 / 0'});
+    t.expect('Runtime.evaluate (NaN)',
+             r.result.result.unserializableValue, 'NaN');
+
+    // Profiling.
+    r = await client.send('Profiler.stop');
+    t.assert('Profiler.stop (not started) error', r.error);
+    await client.send('Profiler.enable');
+    await client.send('Profiler.start');
+    r = await client.send('Runtime.evaluate', {
+      expression: 'for (var i = 0; i < 2000; i++) {$.debugMe(i);}',
+    });
+    r = await client.send('Profiler.stop');
+    const profile = r.result.profile;
+    t.expect('Profile root', profile.nodes[0].callFrame.functionName,
+             '(root)');
+    t.assert('Profile has samples', profile.samples.length > 0);
+    t.expect('Profile samples/timeDeltas', profile.samples.length,
+             profile.timeDeltas.length);
+    t.assert('Profile includes $.debugMe', profile.nodes.some((node) =>
+        node.callFrame.functionName === '$.debugMe' &&
+        node.callFrame.url === 'codecity:///$.debugMe'));
+
+    // Breakpoints are removed when the session ends.
+    r = await client.send('Debugger.setBreakpointByUrl',
+                          {url: 'codecity:///$.debugMe', lineNumber: 2});
+    t.expect('Breakpoints before close', intrp.getBreakpoints().length, 1);
+    client.close();
+    await new Promise((resolve) => setTimeout(resolve, 50));
+    t.expect('Breakpoints after close', intrp.getBreakpoints().length, 0);
+    t.expect('onThreadPaused after close', intrp.onThreadPaused, null);
+  } finally {
+    if (client) client.close();
+    intrp.stop();
+    await admin.close();
+  }
+};
+
+/**
+ * Unit tests for the DevTools Protocol discovery routes.
+ * @param {!T} t The test runner object.
+ */
+exports.testDevToolsDiscovery = async function(t) {
+  const intrp = getInterpreter({noLog: ['admin']}, false);
+  const admin = new Admin.Server({tokens: ['secret'], interpreter: intrp});
+  const port = await admin.listen(0, '127.0.0.1');
+  try {
+    const r = await new Promise((resolve, reject) => {
+      require('http').get({
+        port, path: '/json/list',
+        headers: {'Authorization': 'Bearer secret', 'Host': 'example:9'},
+      }, (res) => {
+        let text = '';
+        res.on('data', (data) => text += data);
+        res.on('end', () => resolve(JSON.parse(text)));
+      }).on('error', reject);
+    });
+    t.expect('GET /json/list webSocketDebuggerUrl',
+             r[0].webSocketDebuggerUrl, 'ws://example:9/devtools?token=secret');
+    t.expect('GET /json/list devtoolsFrontendUrl', r[0].devtoolsFrontendUrl,
+             'devtools://devtools/bundled/js_app.html?ws=' +
+             'example%3A9%2Fdevtools%3Ftoken%3Dsecret');
+  } finally {
+    await admin.close();
+  }
+};
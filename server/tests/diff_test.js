@@ -0,0 +1,119 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for comparison of world states.
+ */
+'use strict';
+
+const Diff = require('../diff');
+const {getInterpreter} = require('./interpreter_common');
+const {T} = require('./testing');
+
+/**
+ * Create an interpreter and run some source in it, then give each
+ * object listed in $.owners (as [object, owner] pairs) its owner, and
+ * remove $.owners again.
+ * @param {string} src Source to run.
+ * @return {!Interpreter}
+ */
+function world(src) {
+  const intrp = getInterpreter();
+  intrp.createThreadForSrc(src);
+  intrp.run();
+  const $ = intrp.global.get('$');
+  const owners = $.get('owners', intrp.ROOT);
+  for (const key of owners.ownKeys(intrp.ROOT)) {
+    if (key === 'length') continue;
+    const pair = owners.get(key, intrp.ROOT);
+    pair.get('0', intrp.ROOT).owner = pair.get('1', intrp.ROOT);
+  }
+  $.deleteProperty('owners', intrp.ROOT);
+  return intrp;
+}
+
+/**
+ * Unit tests for Diff.compare and Diff.format.
+ * @param {!T} t The test runner object.
+ */
+exports.testDiff = function(t) {
+  const common = `
+      var $ = {users: {alice: {}, bob: {}}};
+  `;
+  const before = world(common + `
+      $.room = {name: 'Hall', exits: []};
+      $.hat = {colour: 'red'};
+      $.junk = {};
+      $.fn = function() {return 1;};
+      var temporary = 1;
+      $.owners = [[$.room, $.users.alice], [$.hat, $.users.alice],
+                  [$.junk, $.users.bob]];
+  `);
+  const after = world(common + `
+      $.room = {name: 'Kitchen', exits: [], smell: 'toast'};
+      $.hat = {colour: 'red'};
+      Object.defineProperty($.hat, 'colour', {writable: false});
+      $.users.bob.hat = Object.create($.hat);
+      $.fn = function() {return 2;};
+      $.owners = [[$.room, $.users.alice], [$.hat, $.users.bob],
+                  [$.users.bob.hat, $.users.bob]];
+  `);
+  let report;
+  try {
+    report = Diff.compare(before, after);
+  } catch (e) {
+    t.crash('testDiff', e);
+    return;
+  }
+  const name = 'Diff.compare(...)';
+  t.expect(name + ' owners', report.owners.map((g) => g.owner).join(),
+           '$.users.alice,$.users.bob,CC.root');
+  const [alice, bob, root] = report.owners;
+  t.expect(name + ' alice', JSON.stringify(alice),
+           '{"owner":"$.users.alice","created":[],"deleted":[],' +
+           '"modified":[{"object":"$.room","changes":[' +
+           '{"property":"name","before":"\'Hall\'","after":"\'Kitchen\'"},' +
+           '{"property":"smell","after":"\'toast\'"}]}]}');
+  t.expect(name + ' bob created', bob.created.join(), '$.users.bob.hat');
+  t.expect(name + ' bob deleted', bob.deleted.join(), '$.junk');
+  t.expect(name + ' bob modified', JSON.stringify(bob.modified),
+           '[{"object":"$.hat","changes":[' +
+           '{"property":"{owner}","before":"$.users.alice",' +
+           '"after":"$.users.bob"},' +
+           '{"property":"colour","before":"\'red\'",' +
+           '"after":"\'red\' (non-writable)"}]}]');
+  t.expect(name + ' root modified',
+           root.modified.map((m) => m.object).join(),
+           '$,$.fn,$.users.bob,' + Diff.GLOBAL);
+  t.expect(name + ' root modified $.fn', JSON.stringify(root.modified[1]),
+           '{"object":"$.fn","changes":[{"property":"{source}",' +
+           '"before":"function() {return 1;}",' +
+           '"after":"function() {return 2;}"}]}');
+  t.expect(name + ' root modified global', JSON.stringify(root.modified[3]),
+           '{"object":"' + Diff.GLOBAL + '","changes":' +
+           '[{"property":"temporary","before":"1"}]}');
+
+  t.expect('Diff.compare(/* same world */)',
+           JSON.stringify(Diff.compare(before, before)), '{"owners":[]}');
+  t.expect('Diff.format(/* no changes */)', Diff.format({owners: []}),
+           'No changes.');
+  t.expect('Diff.format(...)', Diff.format({owners: [alice]}),
+           'Owner $.users.alice:\n' +
+           '  ~ $.room\n' +
+           "      name: 'Hall' -> 'Kitchen'\n" +
+           "      + smell: 'toast'");
+};
@@ -1457,6 +1457,8 @@ exports.testDumperPrototypeDump = async function(t) {
       var listener = {onRecieve: function onRecieve(data) {}};
       (new 'CC.connectionListen')(8888, listener, 100);
       (new 'CC.connectionListen')(8889, listener);
+      (new 'CC.connectionListen')(8890, listener, 0,
+          {protocol: 'websocket', origins: ['https://example.com']});
       (new 'continue')();
   `);
   intrp.start();
@@ -1473,12 +1475,15 @@ exports.testDumperPrototypeDump = async function(t) {
            'var listener = {};\n' +
                'listener.onRecieve = function onRecieve(data) {};\n' +
                "(new 'CC.connectionListen')(8888, listener, 100);\n" +
-               "(new 'CC.connectionListen')(8889, listener);\n");
+               "(new 'CC.connectionListen')(8889, listener);\n" +
+               "(new 'CC.connectionListen')(8890, listener, 0, " +
+               "{protocol: 'websocket', origins: ['https://example.com']});\n");
 
   // Clean up.
   intrp.createThreadForSrc(`
       (new "CC.connectionUnlisten")(8888);
       (new "CC.connectionUnlisten")(8889);
+      (new "CC.connectionUnlisten")(8890);
       (new 'continue')();
   `);
   intrp.start();
@@ -0,0 +1,124 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for remote editing.
+ */
+'use strict';
+
+const Edit = require('../edit');
+const {getInterpreter} = require('./interpreter_common');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Edit.request and Edit.reply.
+ * @param {!T} t The test runner object.
+ */
+exports.testEditRequestAndReply = function(t) {
+  const request = Edit.request('3', 'a note', 'line 1\nline 2');
+  t.expect('request(...)', request,
+           '{"type":"edit","id":"3","title":"a note","syntax":"text",' +
+           '"text":"line 1\\nline 2"}');
+  t.assert('request(...) is one line', !request.includes('\n'));
+  try {
+    Edit.request('3', 'a note', '', 'cobol');
+    t.fail('request(..., "cobol")', 'Did not throw');
+  } catch (e) {
+    t.expect('request(..., "cobol") throws', e.name, 'RangeError');
+  }
+
+  const cases = [
+    ['{"type":"edit-save","id":"3","text":"new\\ntext"}', '3:"new\\ntext"'],
+    [' {"type":"edit-cancel","id":"3"} ', '3:null'],
+    ['{"type":"edit-save","id":"3"}', null],
+    ['{"type":"edit-save","id":3,"text":""}', null],
+    ['{"type":"narrate","id":"3","text":""}', null],
+    ['{not json', null],
+    ['look', null],
+  ];
+  for (const [line, expected] of cases) {
+    const reply = Edit.reply(line);
+    t.expect('reply(' + JSON.stringify(line) + ')',
+             reply && reply.id + ':' + JSON.stringify(reply.text), expected);
+  }
+};
+
+/**
+ * Unit tests for Edit.line.
+ * @param {!T} t The test runner object.
+ */
+exports.testEditLine = function(t) {
+  let state = {lines: ['one', 'two', 'three'], point: 3};
+  const run = (input) => {
+    const result = Edit.line(state, input);
+    state = {lines: result.lines, point: result.point};
+    return result;
+  };
+  t.expect('line(..., "four")', run('four').output, '');
+  t.expect('line(..., "..five")', run('..five').output, '');
+  t.expect('lines after appending', state.lines.join(),
+           'one,two,three,four,.five');
+  t.expect('line(..., ".i 2")', run('.i 2').output, 'Inserting before line 2.');
+  run('one and a half');
+  t.expect('line(..., ".l 1-3")', run('.l 1-3').output,
+           '1: one\n2: one and a half\n^:\n3: two');
+  t.expect('line(..., ".d 1-2")', run('.d 1-2').output, 'Deleted 2 lines.');
+  t.expect('point after deleting', state.point, 0);
+  t.expect('line(..., ".r 1 TWO")', run('.r 1 TWO').output, '1: TWO');
+  t.expect('lines after editing', state.lines.join(), 'TWO,three,four,.five');
+  t.expect('line(..., ".d 9")', run('.d 9').output,
+           'Invalid line number(s) in ".d 9".  Type .h for help.');
+  t.expect('line(..., ".z")', run('.z').output,
+           'Unknown command ".z".  Type .h for help.');
+  t.expect('line(..., ".save").done', run('.save').done, null);
+  t.expect('line(..., ".h")', run('.h').output, Edit.HELP);
+  t.expect('line(..., ".h").done', Edit.line(state, '.h').done, null);
+  t.expect('line(..., ".").done', Edit.line(state, '.').done, 'save');
+  t.expect('line(..., ".s").done', Edit.line(state, '.s').done, 'save');
+  t.expect('line(..., ".q").done', Edit.line(state, '.q').done, 'quit');
+  t.expect('line({lines: []}, ".l")',
+           Edit.line({lines: [], point: 0}, '.l').output, '^:');
+};
+
+/**
+ * Unit tests for the CC.edit* builtins.
+ * @param {!T} t The test runner object.
+ */
+exports.testEditBuiltins = function(t) {
+  const intrp = getInterpreter();
+  intrp.createThreadForSrc(`
+      var results = [];
+      results.push(JSON.parse(CC.editRequest('1', 'x', 'y', 'json')).syntax);
+      var reply = CC.editReply('{"type":"edit-save","id":"1","text":"z"}');
+      results.push(reply.id + reply.text, CC.editReply('look'));
+      var result = CC.editLine({lines: ['a'], point: 1}, 'b');
+      results.push(result.lines.join(), result.point, result.done);
+      try {
+        CC.editLine({lines: 'a'}, 'b');
+      } catch (e) {
+        results.push(e.name);
+      }
+  `);
+  intrp.run();
+  const results = intrp.pseudoToNative(
+      intrp.global.get('results', intrp.ROOT));
+  t.expect('CC.editRequest', results[0], 'json');
+  t.expect('CC.editReply', results[1], '1z');
+  t.expect('CC.editReply (not a reply)', results[2], null);
+  t.expect('CC.editLine', results.slice(3, 6).join(), 'a,b,2,');
+  t.expect('CC.editLine (bad state)', results[6], 'TypeError');
+};
@@ -0,0 +1,256 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for checkpoint compression and encryption.
+ */
+'use strict';
+
+const crypto = require('crypto');
+const Envelope = require('../envelope');
+const fs = require('fs');
+const os = require('os');
+const path = require('path');
+const {T} = require('./testing');
+const zlib = require('zlib');
+
+/**
+ * Unit tests for Envelope.wrap and Envelope.unwrap.
+ * @param {!T} t The test runner object.
+ */
+exports.testEnvelopeRoundtrip = function(t) {
+  const text = JSON.stringify(new Array(100).fill({foo: 'bar', baz: 42}));
+  const key = crypto.randomBytes(32);
+  const compressions = ['none', 'gzip'];
+  if (Envelope.zstdAvailable()) {
+    compressions.push('zstd');
+  } else {
+    t.skip('Envelope roundtrip zstd', 'zstd not supported by Node.js');
+  }
+  for (const compression of compressions) {
+    for (const encrypt of [false, true]) {
+      const name = 'Envelope roundtrip ' + compression +
+          (encrypt ? ' encrypted' : '');
+      try {
+        const data =
+            Envelope.wrap(text, {compression, key: encrypt ? key : null});
+        const plain = data.includes('"foo"');
+        t.assert(name + ' not plaintext',
+                 plain === (compression === 'none' && !encrypt));
+        const got = Envelope.unwrap(data, key).toString('utf8');
+        t.expect(name, got, text);
+      } catch (e) {
+        t.crash(name, e);
+      }
+    }
+  }
+
+  // Files compressed by other tools are also read.
+  const gz = zlib.gzipSync(Buffer.from(text));
+  t.expect('Envelope.unwrap(gzip)', Envelope.unwrap(gz).toString(), text);
+  // Data without any recognised layers is returned as-is.
+  const raw = Buffer.from(text);
+  t.assert('Envelope.unwrap(raw)', Envelope.unwrap(raw) === raw);
+  // Each encryption uses a fresh IV.
+  t.assert('Envelope.wrap IV',
+           !Envelope.wrap(text, {key}).equals(Envelope.wrap(text, {key})));
+};
+
+/**
+ * Unit tests for compressing chunks in parallel on worker threads.
+ * @param {!T} t The test runner object.
+ */
+exports.testEnvelopeThreads = async function(t) {
+  // Several chunks' worth, so that every thread gets some.
+  const parts = [];
+  for (let i = 0; i < 300000; i++) {
+    parts.push(JSON.stringify({'#': i, value: (i * 7919) % 1000}));
+  }
+  const data = Buffer.from(parts.join('\n'));
+  const key = crypto.randomBytes(32);
+  // Start writing (with the given options) but don't end yet.
+  const start = function(options) {
+    const chunks = [];
+    const writer = new Envelope.Writer(
+        (chunk) => chunks.push(Buffer.from(chunk)), options);
+    for (let i = 0; i < data.length; i += 100000) {
+      writer.write(data.subarray(i, i + 100000));
+    }
+    return {writer, chunks};
+  };
+  const {writer: serialWriter, chunks: serialChunks} =
+      start({compression: 'gzip'});
+  serialWriter.end();
+  const serial = Buffer.concat(serialChunks);
+  for (const threads of [1, 3]) {
+    const name = 'Envelope.Writer (' + threads + ' threads)';
+    try {
+      let {writer, chunks} = start({compression: 'gzip', threads});
+      await writer.end();
+      t.assert(name + ' same as serial', Buffer.concat(chunks).equals(serial));
+      ({writer, chunks} = start({compression: 'gzip', key, threads}));
+      await writer.end();
+      t.assert(name + ' encrypted',
+               Envelope.unwrap(Buffer.concat(chunks), key).equals(data));
+    } catch (e) {
+      t.crash(name, e);
+    }
+  }
+
+  // A pool replaced (by one of a different size) while a writer is
+  // still using it keeps going until that writer has finished.
+  let name = 'Envelope.Writer (pool replaced)';
+  try {
+    const first = start({compression: 'gzip', threads: 2});
+    const second = start({compression: 'gzip', threads: 4});
+    await Promise.all([first.writer.end(), second.writer.end()]);
+    t.assert(name + ' first', Buffer.concat(first.chunks).equals(serial));
+    t.assert(name + ' second', Buffer.concat(second.chunks).equals(serial));
+  } catch (e) {
+    t.crash(name, e);
+  }
+
+  // An abandoned writer outputs nothing more.
+  name = 'Envelope.Writer (abort)';
+  try {
+    const {writer, chunks} = start({compression: 'gzip', threads: 2});
+    const count = chunks.length;
+    writer.abort();
+    try {
+      await writer.end();
+      t.fail(name + ' end', "Didn't reject");
+    } catch (e) {
+      t.pass(name + ' end');
+    }
+    t.expect(name + ' output', chunks.length, count);
+  } catch (e) {
+    t.crash(name, e);
+  }
+};
+
+/**
+ * Unit tests for error handling in Envelope.wrap and Envelope.unwrap.
+ * @param {!T} t The test runner object.
+ */
+exports.testEnvelopeErrors = function(t) {
+  const key = crypto.randomBytes(32);
+  const good = Envelope.wrap('[{"foo": "bar"}]', {compression: 'gzip', key});
+  const tampered = Buffer.from(good);
+  tampered[30] ^= 1;
+  const badHeader = Buffer.from(good);
+  badHeader[20] ^= 1;  // Within IV, which is authenticated.
+  const cases = {
+    'no key': [good, undefined],
+    'wrong key': [good, crypto.randomBytes(32)],
+    'short key': [good, key.subarray(0, 16)],
+    'truncated': [good.subarray(0, good.length - 1), key],
+    'too short': [good.subarray(0, 20), key],
+    'tampered ciphertext': [tampered, key],
+    'tampered header': [badHeader, key],
+  };
+  for (const name in cases) {
+    try {
+      Envelope.unwrap(cases[name][0], cases[name][1]);
+      t.fail('Envelope.unwrap(/* ' + name + ' */)', "Didn't throw.");
+    } catch (e) {
+      t.pass('Envelope.unwrap(/* ' + name + ' */)');
+    }
+  }
+
+  t.expect('Envelope.checkCompression("gzip")',
+           Envelope.checkCompression('gzip'), null);
+  t.assert('Envelope.checkCompression("lzma")',
+           Envelope.checkCompression('lzma') !== null);
+  try {
+    Envelope.wrap('', {compression: 'lzma'});
+    t.fail('Envelope.wrap(/* bad compression */)', "Didn't throw.");
+  } catch (e) {
+    t.pass('Envelope.wrap(/* bad compression */)');
+  }
+  try {
+    Envelope.wrap('', {key: key.subarray(0, 16)});
+    t.fail('Envelope.wrap(/* short key */)', "Didn't throw.");
+  } catch (e) {
+    t.pass('Envelope.wrap(/* short key */)');
+  }
+};
+
+/**
+ * Unit tests for Envelope.Writer and Envelope.createReadStream.
+ * @param {!T} t The test runner object.
+ */
+exports.testEnvelopeStreaming = async function(t) {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'envelope_test-'));
+  const filename = path.join(dir, 'test.city');
+  const read = async function(key) {
+    const chunks = [];
+    for await (const chunk of Envelope.createReadStream(filename, key)) {
+      chunks.push(chunk);
+    }
+    return Buffer.concat(chunks);
+  };
+  // Several megabytes, so output is compressed in multiple chunks.
+  const data = crypto.randomBytes(1024).toString('hex').repeat(2000);
+  const key = crypto.randomBytes(32);
+  try {
+    for (const compression of ['none', 'gzip']) {
+      for (const encrypt of [false, true]) {
+        const name = 'Envelope streaming ' + compression +
+            (encrypt ? ' encrypted' : '');
+        try {
+          const fd = fs.openSync(filename, 'w');
+          const writer = new Envelope.Writer((buf) => fs.writeSync(fd, buf),
+              {compression, key: encrypt ? key : null});
+          for (let i = 0; i < data.length; i += 100000) {
+            writer.write(data.slice(i, i + 100000));
+          }
+          writer.end();
+          fs.closeSync(fd);
+          t.expect(name, (await read(key)).toString(), data);
+          t.expect(name + ' unwrap',
+              Envelope.unwrap(fs.readFileSync(filename), key).toString(), data);
+        } catch (e) {
+          t.crash(name, e);
+        }
+      }
+    }
+
+    // Tampering is detected when the stream is read.
+    const tampered = Envelope.wrap(data, {compression: 'gzip', key});
+    tampered[tampered.length - 100] ^= 1;
+    fs.writeFileSync(filename, tampered);
+    try {
+      await read(key);
+      t.fail('Envelope.createReadStream(/* tampered */)', "Didn't throw.");
+    } catch (e) {
+      t.pass('Envelope.createReadStream(/* tampered */)');
+    }
+    // Missing or wrong keys are detected immediately.
+    for (const badKey of [null, crypto.randomBytes(32)]) {
+      const name = 'Envelope.createReadStream(/* ' +
+          (badKey ? 'wrong' : 'no') + ' key */)';
+      try {
+        Envelope.createReadStream(filename, badKey);
+        t.fail(name, "Didn't throw.");
+      } catch (e) {
+        t.pass(name);
+      }
+    }
+  } finally {
+    fs.rmSync(dir, {recursive: true});
+  }
+};
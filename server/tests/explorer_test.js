@@ -0,0 +1,100 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for offline exploration of checkpoints.
+ */
+'use strict';
+
+const Explorer = require('../explorer');
+const {getInterpreter} = require('./interpreter_common');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Explorer.find, Explorer.stats and Explorer.query.
+ * @param {!T} t The test runner object.
+ */
+exports.testExplorer = function(t) {
+  const intrp = getInterpreter();
+  intrp.createThreadForSrc(`
+      var $ = {hall: {name: 'Hall'}, users: {}};
+      $.users.bob = {name: 'Bob', location: $.hall};
+      $.users.eve = {name: 'Eve', location: $.hall, age: 42};
+      $.hall.contents = [$.users.bob, $.users.eve];
+      (function() {
+        var hidden = {location: $.hall};
+        $.keep = function() {return hidden;};
+      })();
+  `);
+  intrp.run();
+  const $ = intrp.global.get('$');
+  const hall = $.get('hall', intrp.ROOT);
+  const users = $.get('users', intrp.ROOT);
+  const bob = users.get('bob', intrp.ROOT);
+  const eve = users.get('eve', intrp.ROOT);
+
+  // Explorer.find.
+  let result = Explorer.find(intrp, 'name', 'Bob');
+  t.expect('find(name, Bob)', String(result.objects), String([bob]));
+  t.expect('find(name, Bob).truncated', result.truncated, false);
+  result = Explorer.find(intrp, 'location', hall);
+  t.expect('find(location, $.hall) count', result.objects.length, 3);
+  result = Explorer.find(intrp, 'location', hall, 1);
+  t.expect('find(location, $.hall, 1) count', result.objects.length, 1);
+  t.expect('find(location, $.hall, 1).truncated', result.truncated, true);
+  result = Explorer.find(intrp, '*', 42);
+  t.expect('find(*, 42)', result.objects[0], eve);
+  result = Explorer.find(intrp, 'name', 'Mallory');
+  t.expect('find(name, Mallory)', result.objects.length, 0);
+
+  // Explorer.stats.
+  const stats = Explorer.stats(intrp);
+  t.assert('stats.objects', stats.objects > 5);
+  t.assert('stats.scopes', stats.scopes > 0);
+  t.assert('stats.size', stats.size > 0);
+  t.assert('stats.byClass.Array', stats.byClass['Array'].count > 0);
+  t.assert('stats.byOwner.root', stats.byOwner['root'].count > 5);
+  t.assert('formatStats', /^\d+ objects, \d+ scopes, \d+ threads/.test(
+      Explorer.formatStats(stats)));
+
+  // Explorer.query.
+  t.expect('query find name "Eve"',
+           Explorer.query(intrp, 'find name "Eve"'), '$.users.eve');
+  t.expect('query find location $.hall',
+           Explorer.query(intrp, 'find location $.hall'),
+           '$.users.bob\n$.users.eve\n(unnamed Object, owner root)');
+  t.expect('query find age 43',
+           Explorer.query(intrp, 'find age 43'), 'No objects found.');
+  t.expect('query dump $.users.bob',
+           Explorer.query(intrp, 'dump $.users.bob'),
+           "{\n  name: 'Bob',\n  location: { name: 'Hall', contents: " +
+           "[ [Circular], [Object], length: 2 ] }\n}");
+  t.expect('query dump $.users.bob 0',
+           Explorer.query(intrp, 'dump $.users.bob 0'),
+           "{ name: 'Bob', location: [Object] }");
+  t.assert('query stats', /objects/.test(Explorer.query(intrp, 'stats')));
+  t.expect('query help', Explorer.query(intrp, 'help'), Explorer.HELP);
+  for (const bad of ['frob', 'find name', 'find x [1]', 'dump $.nobody',
+                     'find location $.nowhere']) {
+    try {
+      Explorer.query(intrp, bad);
+      t.fail('query ' + bad, "didn't throw");
+    } catch (e) {
+      t.pass('query ' + bad);
+    }
+  }
+};
@@ -0,0 +1,247 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for federation of worlds.
+ */
+'use strict';
+
+const Federation = require('../federation');
+const http = require('http');
+const {getInterpreter} = require('./interpreter_common');
+const {T} = require('./testing');
+
+/**
+ * Make an (unsigned, unless headers say otherwise) request of a
+ * federation service.
+ * @param {number} port The service's port.
+ * @param {string} body The request body.
+ * @param {!Object<string, string>=} headers Request headers.
+ * @return {!Promise<{status: number, headers: !Object, body: string}>}
+ */
+function request(port, body, headers = {}) {
+  return new Promise((resolve, reject) => {
+    const req = http.request(
+        {host: '127.0.0.1', port, method: 'POST', path: '/teleport', headers},
+        (res) => {
+          let text = '';
+          res.setEncoding('utf8');
+          res.on('data', (data) => text += data);
+          res.on('end', () => resolve(
+              {status: res.statusCode, headers: res.headers, body: text}));
+        });
+    req.on('error', reject);
+    req.end(body);
+  });
+}
+
+/**
+ * Unit tests for Federation.sign and the Federation.Service constructor.
+ * @param {!T} t The test runner object.
+ */
+exports.testFederationSign = function(t) {
+  const key = '0123456789abcdef';
+  const sig = Federation.sign(key, ['request', 'POST', '/teleport']);
+  t.assert('sign is hex', /^[0-9a-f]{64}$/.test(sig));
+  t.expect('sign is deterministic', sig,
+           Federation.sign(key, ['request', 'POST', '/teleport']));
+  t.assert('sign depends on fields',
+           sig !== Federation.sign(key, ['request', 'POST', '/other']));
+  t.assert('sign depends on key', sig !== Federation.sign(
+      'fedcba9876543210', ['request', 'POST', '/teleport']));
+
+  const intrp = getInterpreter({noLog: ['net']}, false);
+  const invalid = {
+    'no name': {peers: {}},
+    'bad peer name': {name: 'a', peers: {'b c': {url: 'http://b/', key}}},
+    'bad peer URL': {name: 'a', peers: {b: {url: 'ftp://b/', key}}},
+    'short key': {name: 'a', peers: {b: {url: 'http://b/', key: 'short'}}},
+  };
+  for (const desc in invalid) {
+    try {
+      new Federation.Service(
+          Object.assign({interpreter: intrp}, invalid[desc]));
+      t.fail('Service with ' + desc, "Didn't throw.");
+    } catch (e) {
+      t.expect('Service with ' + desc, e.name, 'TypeError');
+    }
+  }
+};
+
+/**
+ * Unit tests for teleporting between two Federation.Services.
+ * @param {!T} t The test runner object.
+ */
+exports.testFederationTeleport = async function(t) {
+  const key = 'shared secret key';
+  const noLog = ['net', 'unhandled'];
+  const origin = getInterpreter({noLog});
+  origin.createThreadForSrc(`
+      var $ = {};
+      $.physical = {};
+      var alice = Object.create($.physical);
+      alice.name = 'Alice';
+      alice.hat = {colour: 'red'};
+      Object.setOwnerOf(alice, alice);
+      Object.setOwnerOf(alice.hat, alice);
+      var result, error;
+  `);
+  origin.run();
+  const destination = getInterpreter({noLog});
+  destination.createThreadForSrc(`
+      var $ = {};
+      $.physical = {};
+      var offers = [];
+      var visitor;
+      $.federation = {
+        onOffer: function(offer) {
+          offers.push(offer.world + ' ' + offer.info.name + ' ' +
+                      offer.objects);
+          return offer.info.name === 'Mallory' ? 'No Mallories' : true;
+        },
+        onArrive: function(arrival) {
+          visitor = arrival.objects && arrival.objects[0];
+          return {welcome: arrival.info.name, count:
+                  arrival.objects ? arrival.objects.length : 0};
+        },
+      };
+  `);
+  destination.run();
+
+  // b never sends to a, so a's URL is never used.
+  const b = new Federation.Service({
+    name: 'b',
+    peers: {a: {url: 'http://127.0.0.1:1/', key}},
+    interpreter: destination,
+  });
+  const portB = await b.listen(0, '127.0.0.1');
+  const a = new Federation.Service({
+    name: 'a',
+    peers: {b: {url: 'http://127.0.0.1:' + portB + '/', key}},
+    interpreter: origin,
+  });
+  origin.federation = a;
+  origin.start();
+  destination.start();
+  try {
+    t.expect('peers()', String(a.peers()), 'b');
+
+    // Teleport without objects.
+    let r = await a.teleport('b', null, {name: 'Bob'});
+    t.expect('Teleport Bob', JSON.stringify(r),
+             JSON.stringify({accepted: true,
+                             reply: {welcome: 'Bob', count: 0}}));
+    // Refused.
+    r = await a.teleport('b', null, {name: 'Mallory'});
+    t.expect('Teleport Mallory', JSON.stringify(r),
+             JSON.stringify({accepted: false, reason: 'No Mallories'}));
+    // With objects, via CC.federationTeleport.
+    origin.createThreadForSrc(`
+        try {
+          result = (new 'CC.federationTeleport')('b', {name: 'Alice'}, alice);
+        } catch (e) {
+          error = String(e);
+        }
+    `);
+    await new Promise((resolve) => setTimeout(resolve, 200));
+    t.expect('CC.federationTeleport(...)',
+             JSON.stringify(origin.pseudoToNative(origin.global.get('result'))),
+             JSON.stringify({accepted: true,
+                             reply: {welcome: 'Alice', count: 2}}));
+    t.expect('CC.federationTeleport(...) error',
+             origin.global.get('error'), undefined);
+    const offers = destination.pseudoToNative(destination.global.get('offers'));
+    t.expect('Offers', offers.join('; '),
+             'a Bob false; a Mallory false; a Alice true');
+    destination.createThreadForSrc(`
+        var check = [visitor.name, visitor.hat.colour,
+            Object.getPrototypeOf(visitor) === $.physical,
+            Object.getOwnerOf(visitor) === visitor,
+            Object.getOwnerOf(visitor.hat) === visitor].join();
+    `);
+    destination.run();
+    t.expect('Visitor', destination.global.get('check'),
+             'Alice,red,true,true,true');
+
+    // Unknown peer.
+    try {
+      await a.teleport('c', null, {});
+      t.fail('Teleport to unknown peer', "Didn't reject.");
+    } catch (e) {
+      t.expect('Teleport to unknown peer', e.name, 'RangeError');
+    }
+
+    // Authentication.
+    const body = JSON.stringify({info: {name: 'Eve'}});
+    const time = String(Date.now());
+    const nonce = '00112233445566778899aabbccddeeff';
+    const sign = (k) => Federation.sign(k, ['request', 'POST',
+        '/teleport', 'a', 'b', time, nonce, Federation.hashBody(body)]);
+    const headers = {
+      'X-CodeCity-World': 'a',
+      'X-CodeCity-Time': time,
+      'X-CodeCity-Nonce': nonce,
+      'X-CodeCity-Signature': sign('wrong key wrong key'),
+    };
+    r = await request(portB, body);
+    t.expect('Unsigned request', r.status, 401);
+    r = await request(portB, body, headers);
+    t.expect('Request signed with wrong key', r.status, 401);
+    headers['X-CodeCity-Signature'] = sign(key);
+    r = await request(portB, body, headers);
+    t.expect('Signed request', r.status, 200);
+    t.expect('Response signature', r.headers['x-codecity-signature'],
+             Federation.sign(key, ['response', 200, nonce,
+                                   Federation.hashBody(r.body)]));
+    r = await request(portB, body, headers);
+    t.expect('Replayed request', r.status, 401);
+    t.expect('Replayed request error', JSON.parse(r.body).error,
+             'Request replayed');
+  } finally {
+    await b.close();
+    origin.stop();
+    destination.stop();
+  }
+};
+
+/**
+ * Unit tests for Federation.Service lockout of unauthenticated peers.
+ * @param {!T} t The test runner object.
+ */
+exports.testFederationLockout = async function(t) {
+  const intrp = getInterpreter({noLog: ['net']}, false);
+  const service = new Federation.Service({
+    name: 'b',
+    peers: {a: {url: 'http://127.0.0.1:1/', key: 'shared secret key'}},
+    interpreter: intrp,
+  });
+  const port = await service.listen(0, '127.0.0.1');
+  try {
+    const limit = 5;  // RateLimit.POLICIES.login.limit.
+    const headers = {'X-CodeCity-World': 'a'};
+    let r;
+    for (let i = 0; i <= limit; i++) {
+      r = await request(port, '{}', headers);
+    }
+    t.expect('Status of last failure', r.status, 401);
+    r = await request(port, '{}', headers);
+    t.expect('Status after too many failures', r.status, 429);
+    t.assert('Retry-After', Number(r.headers['retry-after']) > 0);
+  } finally {
+    await service.close();
+  }
+};
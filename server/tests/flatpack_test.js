@@ -0,0 +1,197 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for reading and writing flatpack files.
+ */
+'use strict';
+
+const crypto = require('crypto');
+const Flatpack = require('../flatpack');
+const fs = require('fs');
+const os = require('os');
+const path = require('path');
+const {T} = require('./testing');
+
+/**
+ * Write data to a temporary file, read it with Flatpack.read, and
+ * return the records read.
+ * @param {string|!Buffer} data Contents of file.
+ * @param {?Buffer=} key Decryption key.
+ * @return {!Promise<!Array<!Object>>}
+ */
+async function readData(data, key) {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'flatpack_test-'));
+  const filename = path.join(dir, 'test.city');
+  try {
+    fs.writeFileSync(filename, data);
+    const records = [];
+    const result = await Flatpack.read(filename, key || null, (record) => {
+      records.push(record);
+    });
+    if (result.records !== records.length) throw new Error('Wrong count');
+    return records;
+  } finally {
+    fs.rmSync(dir, {recursive: true});
+  }
+}
+
+/**
+ * Unit tests for Flatpack.Writer and Flatpack.read.
+ * @param {!T} t The test runner object.
+ */
+exports.testFlatpackRoundtrip = async function(t) {
+  // Enough records for the output to be compressed in several chunks.
+  const records = [];
+  for (let i = 0; i < 30000; i++) {
+    records.push({'#': i, 'type': 'Object', 'props': {
+      'name': 'record ' + i, 'next': {'#': i + 1}, 'ü': [i, -i, i / 7]}});
+  }
+  const expected = JSON.stringify(records);
+  const key = crypto.randomBytes(32);
+  for (const format of ['json', 'binary']) {
+    for (const compression of ['none', 'gzip']) {
+      for (const encrypt of [false, true]) {
+        const name = 'Flatpack roundtrip ' + format + ' ' + compression +
+            (encrypt ? ' encrypted' : '');
+        try {
+          const data = Flatpack.encode(records, format,
+              {compression, key: encrypt ? key : null});
+          const got = await readData(data, key);
+          t.expect(name, JSON.stringify(got), expected);
+          t.expect(name + ' decode',
+                   JSON.stringify(Flatpack.decode(data, key)), expected);
+        } catch (e) {
+          t.crash(name, e);
+        }
+      }
+    }
+  }
+
+  // Empty flatpacks.
+  for (const format of ['json', 'binary']) {
+    const name = 'Flatpack roundtrip empty ' + format;
+    try {
+      const got = await readData(Flatpack.encode([], format));
+      t.expect(name, got.length, 0);
+    } catch (e) {
+      t.crash(name, e);
+    }
+  }
+};
+
+/**
+ * Unit tests for reading textual flatpacks not written by
+ * Flatpack.Writer, and for error handling in Flatpack.read.
+ * @param {!T} t The test runner object.
+ */
+exports.testFlatpackReadJson = async function(t) {
+  const records = [{'#': 0, 'a': 'x\ny'}, {'#': 1, 'b': [1, 2]}];
+  const expected = JSON.stringify(records);
+  const good = {
+    'one line': JSON.stringify(records),
+    'pretty-printed': JSON.stringify(records, null, '  '),
+    'leading space': ' ' + JSON.stringify(records),
+    'trailing newline': Flatpack.encode(records).toString() + '\n',
+  };
+  for (const name in good) {
+    try {
+      const got = await readData(good[name]);
+      t.expect('Flatpack.read(/* ' + name + ' */)', JSON.stringify(got),
+               expected);
+    } catch (e) {
+      t.crash('Flatpack.read(/* ' + name + ' */)', e);
+    }
+  }
+
+  const text = Flatpack.encode(records).toString();
+  const bad = {
+    'truncated': text.slice(0, -1),
+    'truncated record': text.slice(0, -5),
+    'trailing data': text + '\n{}',
+    'not a list': '{}',
+    'empty': '',
+  };
+  for (const name in bad) {
+    try {
+      await readData(bad[name]);
+      t.fail('Flatpack.read(/* ' + name + ' */)', "Didn't throw.");
+    } catch (e) {
+      t.pass('Flatpack.read(/* ' + name + ' */)');
+    }
+  }
+  try {
+    Flatpack.encode([], 'xml');
+    t.fail('Flatpack.encode(/* bad format */)', "Didn't throw.");
+  } catch (e) {
+    t.pass('Flatpack.encode(/* bad format */)');
+  }
+};
+
+/**
+ * Unit tests for the checksums that Flatpack.Writer adds and
+ * Flatpack.read and Flatpack.decode verify.
+ * @param {!T} t The test runner object.
+ */
+exports.testFlatpackChecksums = async function(t) {
+  const records = [];
+  for (let i = 0; i < 25000; i++) {
+    records.push({'#': i, 'type': 'Object', 'props': {'name': 'record ' + i}});
+  }
+  const json = Flatpack.encode(records).toString();
+  const lines = json.split('\n');
+  t.expect('Flatpack checksum records',
+           lines.filter((line) => line.includes('"Checksum"')).length, 3);
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'flatpack_test-'));
+  const filename = path.join(dir, 'test.city');
+  try {
+    fs.writeFileSync(filename, json);
+    const result = await Flatpack.read(filename, null, () => {});
+    t.expect('Flatpack.read(/* checksummed */) records', result.records,
+             records.length);
+    t.expect('Flatpack.read(/* checksummed */) sections', result.sections, 3);
+  } catch (e) {
+    t.crash('Flatpack.read(/* checksummed */)', e);
+  } finally {
+    fs.rmSync(dir, {recursive: true});
+  }
+
+  const binary = Flatpack.encode(records, 'binary');
+  const tamperedBinary = Buffer.from(binary);
+  tamperedBinary[tamperedBinary.indexOf('record 12345') + 11] ^= 1;
+  const bad = {
+    'tampered record': json.replace('"record 12345"', '"record 12346"'),
+    'missing record': lines.filter((line, i) => i !== 12345).join('\n'),
+    'missing checksum': lines.slice(0, -2).join('\n') + '\n' +
+        lines[lines.length - 2].slice(0, -1) + ']',
+    'tampered binary': tamperedBinary,
+  };
+  for (const name in bad) {
+    try {
+      await readData(bad[name]);
+      t.fail('Flatpack.read(/* ' + name + ' */)', "Didn't throw.");
+    } catch (e) {
+      t.pass('Flatpack.read(/* ' + name + ' */)');
+    }
+    try {
+      Flatpack.decode(Buffer.from(bad[name]));
+      t.fail('Flatpack.decode(/* ' + name + ' */)', "Didn't throw.");
+    } catch (e) {
+      t.pass('Flatpack.decode(/* ' + name + ' */)');
+    }
+  }
+};
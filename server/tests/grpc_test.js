@@ -0,0 +1,170 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for gRPC and protocol buffers.
+ */
+'use strict';
+
+const Grpc = require('../grpc');
+const {T} = require('./testing');
+
+/** @const {!Grpc.Schema} */
+const POINT = {
+  x: {id: 1, type: 'int32'},
+  label: {id: 2, type: 'string'},
+};
+
+/** @const {!Grpc.Schema} */
+const SHAPE = {
+  name: {id: 1, type: 'string'},
+  points: {id: 2, type: 'message', repeated: true, message: POINT},
+  sides: {id: 3, type: 'uint64'},
+  area: {id: 4, type: 'double'},
+  closed: {id: 5, type: 'bool'},
+  kind: {id: 6, type: 'enum', values: ['UNKNOWN', 'POLYGON', 'CURVE']},
+  tags: {id: 7, type: 'uint32', repeated: true},
+  centre: {id: 8, type: 'message', message: POINT},
+  data: {id: 9, type: 'bytes'},
+};
+
+/**
+ * Unit tests for Grpc.encode and Grpc.decode.
+ * @param {!T} t The test runner object.
+ */
+exports.testGrpcEncoding = function(t) {
+  // Examples from the protocol buffers encoding documentation.
+  t.expect('encode({x: 150})',
+           Grpc.encode(POINT, {x: 150}).toString('hex'), '089601');
+  t.expect('encode({label: "testing"})',
+           Grpc.encode(POINT, {label: 'testing'}).toString('hex'),
+           '120774657374696e67');
+  t.expect('encode({x: -1})', Grpc.encode(POINT, {x: -1}).toString('hex'),
+           '08ffffffffffffffffff01');
+  t.expect('encode({tags: [3, 270, 86942]})',
+           Grpc.encode(SHAPE, {tags: [3, 270, 86942]}).toString('hex'),
+           '3a06038e029ea705');
+  t.expect('encode(<defaults>)',
+           Grpc.encode(SHAPE, {name: '', sides: 0, closed: false,
+                               kind: 'UNKNOWN', tags: []}).length, 0);
+
+  const shape = {
+    name: 'Triangle',
+    points: [{x: 0, label: 'a'}, {x: -7, label: ''}, {x: 2 ** 31 - 1,
+                                                       label: 'ç'}],
+    sides: 2 ** 53 - 1,
+    area: 0.5,
+    closed: true,
+    kind: 'POLYGON',
+    tags: [3, 270, 86942],
+    centre: {x: 0, label: ''},
+    data: Buffer.from([0, 255]),
+  };
+  const decoded = Grpc.decode(SHAPE, Grpc.encode(SHAPE, shape));
+  t.expect('decode(encode(shape))', JSON.stringify(decoded),
+           JSON.stringify(shape));
+  t.expect('decode(<empty>)',
+           JSON.stringify(Grpc.decode(SHAPE, Buffer.alloc(0))),
+           JSON.stringify({name: '', points: [], sides: 0, area: 0,
+                           closed: false, kind: 'UNKNOWN', tags: [],
+                           centre: null, data: Buffer.alloc(0)}));
+
+  // Unknown fields are skipped; unpacked repeated fields are accepted.
+  const other = Buffer.from('6805' + '7a0178' + '3803' + '3804' +
+                            '550000803f', 'hex');
+  const point = Grpc.decode(SHAPE, other);
+  t.expect('decode(<unknown fields>).tags', point.tags.join(), '3,4');
+  t.expect('decode(<unknown fields>).name', point.name, '');
+
+  for (const [name, hex] of [['truncated varint', '0896'],
+                             ['truncated string', '1205616263'],
+                             ['wrong wire type', '0801']]) {
+    try {
+      Grpc.decode(SHAPE, Buffer.from(hex, 'hex'));
+      t.fail('decode(<' + name + '>)', "Didn't throw.");
+    } catch (e) {
+      t.assert('decode(<' + name + '>)', e instanceof Grpc.Error, String(e));
+    }
+  }
+};
+
+/** @const {!Grpc.Service} */
+const SERVICE = {
+  name: 'test.Shapes',
+  methods: {
+    Describe: {request: SHAPE, response: POINT},
+    Missing: {request: POINT, response: POINT},
+  },
+};
+
+/**
+ * Unit tests for Grpc.Server and Grpc.Client.
+ * @param {!T} t The test runner object.
+ */
+exports.testGrpcServer = async function(t) {
+  const log = [];
+  const server = new Grpc.Server(SERVICE, {
+    Describe: function(call) {
+      if (call.request.name === 'fail') {
+        throw new Grpc.Error(Grpc.Status.INVALID_ARGUMENT, 'Bad shape: 100%');
+      }
+      call.afterResponse = () => log.push('after');
+      return {x: call.request.points.length, label: call.request.name};
+    },
+  }, {
+    authorize: function(call) {
+      if (call.metadata['x-key'] !== 'open sesame') {
+        throw new Grpc.Error(Grpc.Status.UNAUTHENTICATED, 'No key');
+      }
+    },
+    onCall: (call, code) => log.push(call.method + ' ' + code),
+  });
+  const port = await server.listen(0, '127.0.0.1');
+  const client = new Grpc.Client('http://127.0.0.1:' + port, SERVICE,
+                                 {'x-key': 'open sesame'});
+  const stranger = new Grpc.Client('http://127.0.0.1:' + port, SERVICE);
+  try {
+    const response = await client.call(
+        'Describe', {name: 'Square', points: [{}, {}, {}, {}]});
+    t.expect('call(Describe)', JSON.stringify(response),
+             JSON.stringify({x: 4, label: 'Square'}));
+
+    const cases = [
+      [client, 'Describe', {name: 'fail'}, Grpc.Status.INVALID_ARGUMENT,
+       'Bad shape: 100%'],
+      [client, 'Missing', {}, Grpc.Status.UNIMPLEMENTED],
+      [stranger, 'Describe', {}, Grpc.Status.UNAUTHENTICATED, 'No key'],
+    ];
+    for (const [who, method, request, code, message] of cases) {
+      const name = 'call(' + method + ', ' + JSON.stringify(request) + ')';
+      try {
+        await who.call(method, request);
+        t.fail(name, "Didn't reject.");
+      } catch (e) {
+        t.expect(name + ' code', e.code, code);
+        if (message) t.expect(name + ' message', e.message, message);
+      }
+    }
+    await new Promise((resolve) => setTimeout(resolve, 10));
+    t.expect('log', log.join(),
+             'Describe 0,after,Describe 3,Missing 12,Describe 16');
+  } finally {
+    client.close();
+    stranger.close();
+    await server.close();
+  }
+};
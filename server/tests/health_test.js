@@ -0,0 +1,117 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for health and readiness checks.
+ */
+'use strict';
+
+const Health = require('../health');
+const http = require('http');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Health.Registry.
+ * @param {!T} t The test runner object.
+ */
+exports.testHealthRegistry = function(t) {
+  const registry = new Health.Registry();
+  registry.report('database', Health.Kind.READINESS, false, 'Loading');
+  let delay = 0;
+  registry.check('scheduler', Health.Kind.LIVENESS,
+                 () => ({ok: delay < 10, message: 'Delay ' + delay}));
+
+  let status = registry.status(Health.Kind.LIVENESS);
+  t.expect('liveness (healthy)', JSON.stringify(status),
+           JSON.stringify({ok: true, checks: {
+             scheduler: {ok: true, message: 'Delay 0'},
+           }}));
+  status = registry.status(Health.Kind.READINESS);
+  t.expect('readiness (loading)', JSON.stringify(status),
+           JSON.stringify({ok: false, checks: {
+             database: {ok: false, message: 'Loading'},
+             scheduler: {ok: true, message: 'Delay 0'},
+           }}));
+
+  registry.report('database', Health.Kind.READINESS, true, 'Loaded');
+  t.expect('readiness (loaded)',
+           registry.status(Health.Kind.READINESS).ok, true);
+  delay = 20;
+  t.expect('readiness (stalled)',
+           registry.status(Health.Kind.READINESS).ok, false);
+  t.expect('liveness (stalled)',
+           registry.status(Health.Kind.LIVENESS).ok, false);
+
+  registry.check('scheduler', Health.Kind.LIVENESS, () => {
+    throw new Error('Broken');
+  });
+  t.expect('liveness (check throws)',
+           JSON.stringify(registry.status(Health.Kind.LIVENESS).checks),
+           JSON.stringify({scheduler: {ok: false, message: 'Error: Broken'}}));
+};
+
+/**
+ * Make an HTTP request.
+ * @param {number} port The port to connect to.
+ * @param {string} method The request method.
+ * @param {string} path The request path.
+ * @return {!Promise<{status: number, body: string}>}
+ */
+function request(port, method, path) {
+  return new Promise((resolve, reject) => {
+    const req = http.request({host: '127.0.0.1', port, method, path}, (res) => {
+      let body = '';
+      res.setEncoding('utf8');
+      res.on('data', (data) => body += data);
+      res.on('end', () => resolve({status: res.statusCode, body}));
+    });
+    req.on('error', reject);
+    req.end();
+  });
+}
+
+/**
+ * Unit tests for Health.Server.
+ * @param {!T} t The test runner object.
+ */
+exports.testHealthServer = async function(t) {
+  const registry = new Health.Registry();
+  registry.report('database', Health.Kind.READINESS, false, 'Loading');
+  registry.report('scheduler', Health.Kind.LIVENESS, true, 'Running');
+  const server = new Health.Server(registry);
+  const port = await server.listen(0, '127.0.0.1');
+  try {
+    let r = await request(port, 'GET', '/healthz');
+    t.expect('GET /healthz status', r.status, 200);
+    t.expect('GET /healthz body', JSON.stringify(JSON.parse(r.body)),
+             JSON.stringify({status: 'ok', checks: {
+               scheduler: {ok: true, message: 'Running'},
+             }}));
+    r = await request(port, 'GET', '/readyz');
+    t.expect('GET /readyz status (loading)', r.status, 503);
+    t.expect('GET /readyz body (loading)', JSON.parse(r.body).status, 'fail');
+    registry.report('database', Health.Kind.READINESS, true, 'Loaded');
+    r = await request(port, 'GET', '/readyz');
+    t.expect('GET /readyz status (loaded)', r.status, 200);
+    r = await request(port, 'POST', '/readyz');
+    t.expect('POST /readyz status', r.status, 405);
+    r = await request(port, 'GET', '/other');
+    t.expect('GET /other status', r.status, 404);
+  } finally {
+    await server.close();
+  }
+};
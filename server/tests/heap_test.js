@@ -0,0 +1,104 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for heap reference queries.
+ */
+'use strict';
+
+const Heap = require('../heap');
+const Interpreter = require('../interpreter');
+const {getInterpreter} = require('./interpreter_common');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Heap.inbound, Heap.paths and Heap.retained.
+ * @param {!T} t The test runner object.
+ */
+exports.testHeap = function(t) {
+  const intrp = getInterpreter();
+  intrp.createThreadForSrc(`
+      var room = {occupants: [{name: 'Bob', bio: 'Once upon a time'}]};
+      var player = room.occupants[0];
+      var ghost = (function() {
+        var p = player;
+        return function() {return p;};
+      })();
+      var cache = new WeakMap();
+      cache.set(player, 'cached');
+  `);
+  intrp.run();
+  const global = intrp.global;
+  const room = global.vars['room'];
+  const occupants = room.get('occupants', intrp.ROOT);
+  const player = global.vars['player'];
+
+  // Inbound references.  (The WeakMap's is not one.)
+  let result = Heap.inbound(intrp, player);
+  t.expect('inbound(player) names',
+           String(result.references.map((ref) => ref.name).sort()),
+           '0,p,player');
+  t.expect('inbound(player).truncated', result.truncated, false);
+  const fromArray = result.references.find((ref) => ref.name === '0');
+  t.expect('inbound(player) from array', fromArray.from, occupants);
+  const fromClosure = result.references.find((ref) => ref.name === 'p');
+  t.assert('inbound(player) from closure',
+           fromClosure.from instanceof Interpreter.Scope &&
+           fromClosure.from !== global);
+  result = Heap.inbound(intrp, player, 1);
+  t.expect('inbound(player, 1) count', result.references.length, 1);
+  t.expect('inbound(player, 1).truncated', result.truncated, true);
+  result = Heap.inbound(intrp, global);
+  t.expect('inbound(global) from root', result.references[0].from, null);
+  t.expect('inbound(global) root name', result.references[0].name,
+           'global');
+
+  // Paths from roots.
+  let paths = Heap.paths(intrp, player).paths;
+  t.expect('paths(player) count', paths.length, 3);
+  t.expect('paths(player)[0]', paths[0].map((ref) => ref.name).join('.'),
+           'global.player');
+  t.expect('paths(player)[0] end', paths[0][1].value, player);
+  t.expect('paths(player) via room',
+           paths.map((path) => path.map((ref) => ref.name).join('.'))
+               .includes('global.room.occupants.0'),
+           true);
+  t.expect('paths(player, 1) count', Heap.paths(intrp, player, 1).paths.length,
+           1);
+
+  // Retained size.
+  let retained = Heap.retained(intrp, room);
+  t.expect('retained(room).nodes (player referenced elsewhere)',
+           retained.nodes, 2);
+  const roomSize = retained.size;
+  t.assert('retained(room).size > 0', roomSize > 0);
+
+  // Once the other references are gone the player is retained only by
+  // the room, and would be garbage without it.
+  global.vars['player'] = undefined;
+  global.vars['ghost'] = undefined;
+  retained = Heap.retained(intrp, room);
+  t.expect('retained(room).nodes (player not referenced elsewhere)',
+           retained.nodes, 3);
+  t.assert('retained(room).size (player not referenced elsewhere)',
+           retained.size > roomSize);
+  occupants.set('0', undefined, intrp.ROOT);
+  t.expect('inbound(garbage)', Heap.inbound(intrp, player).references.length,
+           0);
+  t.expect('paths(garbage)', Heap.paths(intrp, player).paths.length, 0);
+  t.expect('retained(garbage).nodes', Heap.retained(intrp, player).nodes, 1);
+};
@@ -0,0 +1,128 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for HTML tokenizing and sanitizing.
+ */
+'use strict';
+
+const Html = require('../html');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Html.escape, Html.decode and Html.tokenize.
+ * @param {!T} t The test runner object.
+ */
+exports.testHtmlTokenize = function(t) {
+  t.expect('escape', Html.escape(`<a href="x">'&'</a>`),
+           '&lt;a href=&quot;x&quot;&gt;&#39;&amp;&#39;&lt;/a&gt;');
+  t.expect('decode', Html.decode('&lt;&#65;&#x42;&#67&eacute;&amp'),
+           '<ABC&eacute;&amp');
+  t.expect('decode (invalid)', Html.decode('&#0;&#xd800;'), '��');
+
+  const tokens = Html.tokenize(
+      '<!DOCTYPE html><P Class=x id="a&amp;b" hidden data-x=\'1\'>' +
+      'a &lt; b<br/></p><script>if (a<b) x="</p>"</script>< c');
+  t.expect('tokenize', JSON.stringify(tokens), JSON.stringify([
+    {type: 'comment', raw: '<!DOCTYPE html>'},
+    {type: 'start', name: 'p', attrs: [['class', 'x', 'x'],
+        ['id', 'a&b', 'a&amp;b'], ['hidden', '', ''], ['data-x', '1', '1']],
+     selfClosing: false},
+    {type: 'text', text: 'a < b', raw: 'a &lt; b'},
+    {type: 'start', name: 'br', attrs: [], selfClosing: true},
+    {type: 'end', name: 'p'},
+    {type: 'start', name: 'script', attrs: [], selfClosing: false},
+    {type: 'raw', text: 'if (a<b) x="</p>"', raw: 'if (a<b) x="</p>"'},
+    {type: 'end', name: 'script'},
+    {type: 'text', text: '< c', raw: '< c'},
+  ]));
+  t.expect('tokenize (unterminated tag)',
+           JSON.stringify(Html.tokenize('x<a href="y')),
+           JSON.stringify([{type: 'text', text: 'x<a href="y',
+                            raw: 'x<a href="y'}]));
+};
+
+/**
+ * Unit tests for Html.sanitize.
+ * @param {!T} t The test runner object.
+ */
+exports.testHtmlSanitize = function(t) {
+  const cases = [
+    // Allowed markup is kept.
+    ['<p>Hi <b>there</b> &amp; <i>you</i>&nbsp;</p>',
+     '<p>Hi <b>there</b> &amp; <i>you</i>&nbsp;</p>'],
+    ['<a href="https://example.com/?a=1&amp;b=2" title=\'Say "hi"\'>x</a>',
+     '<a href="https://example.com/?a=1&amp;b=2" title="Say &quot;hi&quot;">' +
+         'x</a>'],
+    ['<a href="/relative">r</a>', '<a href="/relative">r</a>'],
+    // Script and its content are dropped.
+    ['<p onclick="evil()">a<script>evil()</script>b</p>', '<p>ab</p>'],
+    ['<style>*{}</style><svg><svg onload=evil()></svg></svg>c', 'c'],
+    ['<img src=x onerror=evil() style="x">', '<img src="x">'],
+    // Dangerous URLs are dropped.
+    ['<a href="javascript:evil()">a</a>', '<a>a</a>'],
+    ['<a href=" JaVaScRiPt:evil()">a</a>', '<a>a</a>'],
+    ['<a href="java&#x09;script:evil()">a</a>', '<a>a</a>'],
+    ['<a href="javascript&#58evil()">a</a>', '<a>a</a>'],
+    ['<a href="javascript&colon;evil()">a</a>', '<a>a</a>'],
+    ['<img src="data:image/svg+xml,...">', '<img>'],
+    // Unknown elements are dropped, but not their content.
+    ['<blink><b>x</b></blink>', '<b>x</b>'],
+    ['<textarea><b>x</b></textarea>y', 'y'],
+    // The result is well-formed.
+    ['<div><i>unclosed', '<div><i>unclosed</i></div>'],
+    ['<b><i>x</b>y</i>', '<b><i>x</i></b>y'],
+    ['</b>stray', 'stray'],
+    ['<ul><li>one<li>two</ul>', '<ul><li>one</li><li>two</li></ul>'],
+    ['a < b > c', 'a &lt; b &gt; c'],
+    ['<!-- <script>evil()</script> -->x', 'x'],
+    ['"<b x=1>"', '&quot;<b>&quot;</b>'],
+  ];
+  for (const [html, expected] of cases) {
+    t.expect('sanitize(' + JSON.stringify(html) + ')', Html.sanitize(html),
+             expected);
+  }
+  const deep = '<b>'.repeat(Html.MAX_DEPTH + 10) + 'x';
+  t.expect('sanitize (deep)', Html.sanitize(deep),
+           '<b>'.repeat(Html.MAX_DEPTH) + 'x' + '</b>'.repeat(Html.MAX_DEPTH));
+};
+
+/**
+ * Unit tests for Html.checkPolicy.
+ * @param {!T} t The test runner object.
+ */
+exports.testHtmlPolicy = function(t) {
+  const policy = Html.checkPolicy({
+    elements: {'SPAN': ['Class', 'onclick', 'style'], 'script': [],
+               'a': ['href']},
+    protocols: ['https', 'javascript'],
+  });
+  t.expect('checkPolicy', JSON.stringify(policy), JSON.stringify({
+    elements: {'span': ['class'], 'a': ['href']},
+    protocols: ['https'],
+  }));
+  t.expect('sanitize (custom policy)', Html.sanitize(
+      '<span class="c" id="i"><b>x</b></span><a href="http://e.com/">y</a>' +
+      '<script>z</script>', policy),
+      '<span class="c">x</span><a>y</a>');
+  try {
+    Html.checkPolicy({elements: {'a': 'href'}, protocols: []});
+    t.fail('checkPolicy (bad attributes)', 'did not throw');
+  } catch (e) {
+    t.expect('checkPolicy (bad attributes)', e.name, 'TypeError');
+  }
+};
@@ -0,0 +1,89 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for idle timeouts.
+ */
+'use strict';
+
+const Idle = require('../idle');
+const {T} = require('./testing');
+
+/**
+ * Wait a while.
+ * @param {number} ms Time to wait (in ms).
+ * @return {!Promise}
+ */
+function sleep(ms) {
+  return new Promise((resolve) => setTimeout(resolve, ms));
+}
+
+/**
+ * Unit tests for Idle.Timer.
+ * @param {!T} t The test runner object.
+ */
+exports.testIdleTimer = async function(t) {
+  const log = [];
+  const timer = new Idle.Timer((remaining) => {
+    log.push('warning ' + (remaining > 0 && remaining <= 50));
+  }, () => log.push('timeout'));
+  t.expect('remaining() (disabled)', timer.remaining(), Infinity);
+  await sleep(60);
+  t.expect('Log (disabled)', log.join(), '');
+
+  timer.set(100, 50);
+  t.assert('remaining() (idle 60ms)', timer.remaining() <= 40);
+  await sleep(10);
+  t.expect('Log (warned)', log.join(), 'warning true');
+  timer.touch();
+  t.assert('remaining() (touched)', timer.remaining() > 90);
+  await sleep(30);
+  timer.touch();
+  await sleep(30);
+  t.expect('Log (still active)', log.join(), 'warning true');
+  await sleep(40);
+  t.expect('Log (warned again)', log.join(), 'warning true,warning true');
+  await sleep(60);
+  t.expect('Log (timed out)', log.join(),
+           'warning true,warning true,timeout');
+  t.expect('remaining() (timed out)', timer.remaining(), Infinity);
+  timer.touch();
+  await sleep(120);
+  t.expect('Log (stopped)', log.join(), 'warning true,warning true,timeout');
+
+  for (const args of [[-1], [NaN], [Infinity], [100, -1]]) {
+    try {
+      new Idle.Timer(() => {}, () => {}).set(...args);
+      t.fail('set(' + args + ')', "Didn't throw.");
+    } catch (e) {
+      t.expect('set(' + args + ')', e.name, 'RangeError');
+    }
+  }
+
+  // Disabling (by setting the timeout to 0) and stopping.
+  const quiet = new Idle.Timer(() => log.push('quiet warning'),
+                               () => log.push('quiet timeout'));
+  quiet.set(20);
+  quiet.set(0);
+  const stopped = new Idle.Timer(() => log.push('stopped warning'),
+                                 () => log.push('stopped timeout'));
+  stopped.set(20, 10);
+  stopped.stop();
+  await sleep(40);
+  t.expect('Log (disabled & stopped)', log.join(),
+           'warning true,warning true,timeout');
+};
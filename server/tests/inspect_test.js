@@ -0,0 +1,97 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for the value inspector.
+ */
+'use strict';
+
+const Inspect = require('../inspect');
+const {getInterpreter} = require('./interpreter_common');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Inspect.inspect.
+ * @param {!T} t The test runner object.
+ */
+exports.testInspect = function(t) {
+  const intrp = getInterpreter();
+  intrp.createThreadForSrc(`
+      var obj = {a: 1, b: 'two', c: [1, 2, 3], d: {e: {f: {g: 1}}},
+                 fn: function foo() {}};
+      obj.self = obj;
+      var attrs = {x: 1};
+      Object.defineProperty(attrs, 'y', {value: 2});
+      var arr = [1, 'a'];
+      arr.extra = true;
+      var results = [
+        CC.inspect({a: [1]}),
+        CC.inspect({a: {b: {}}}, {depth: 0}),
+      ];
+      try {
+        CC.inspect(1, {depth: -1});
+      } catch (e) {
+        results.push(e.name);
+      }
+  `);
+  intrp.run();
+  const get = (name) => intrp.global.get(name, intrp.ROOT);
+  const inspect = (value, options) =>
+      Inspect.inspect(intrp, value, intrp.ROOT, options);
+
+  // Primitives.
+  t.expect('inspect(undefined)', inspect(undefined), 'undefined');
+  t.expect('inspect(null)', inspect(null), 'null');
+  t.expect('inspect(-0)', inspect(-0), '-0');
+  t.expect('inspect("it\'s\\n")', inspect('it\'s\n'), "'it\\'s\\n'");
+  t.expect('inspect(1, {colors: true})', inspect(1, {colors: true}),
+           '\x1b[33m1\x1b[39m');
+
+  // Objects: nesting, depth, cycles and layout.
+  t.expect('inspect(obj)', inspect(get('obj')), [
+    '{',
+    '  a: 1,',
+    '  b: \'two\',',
+    '  c: [ 1, 2, 3 ],',
+    '  d: { e: { f: [Object] } },',
+    '  fn: [Function: foo],',
+    '  self: [Circular]',
+    '}',
+  ].join('\n'));
+  t.expect('inspect(obj.d, {depth: Infinity})',
+           inspect(get('obj').get('d', intrp.ROOT), {depth: Infinity}),
+           '{ e: { f: { g: 1 } } }');
+  t.expect('inspect(arr)', inspect(get('arr')), '[ 1, \'a\', extra: true ]');
+  t.expect('inspect(obj.c, {maxItems: 1})',
+           inspect(get('obj').get('c', intrp.ROOT), {maxItems: 1}),
+           '[ 1, ... 2 more items ]');
+
+  // Property attributes and non-enumerable properties.
+  t.expect('inspect(attrs)', inspect(get('attrs')), '{ x: 1 }');
+  t.expect('inspect(attrs, {hidden: true, attributes: true})',
+           inspect(get('attrs'), {hidden: true, attributes: true}),
+           '{ x <wec>: 1, y <--->: 2 }');
+
+  // CC.inspect.
+  const results = get('results');
+  t.expect('CC.inspect({a: [1]})', results.get('0', intrp.ROOT),
+           '{ a: [ 1 ] }');
+  t.expect('CC.inspect(..., {depth: 0})', results.get('1', intrp.ROOT),
+           '{ a: [Object] }');
+  t.expect('CC.inspect(1, {depth: -1})', results.get('2', intrp.ROOT),
+           'RangeError');
+};
@@ -96,3 +96,56 @@ exports.benchSort = function(b) {
     runBench(b, name, setup, timed);
   }
 };
+
+/**
+ * Run some benchmarks of property lookups along prototype chains of
+ * various depths (as in MOO-style worlds, where everything descends
+ * from a few root objects such as $.physical).
+ * @param {!B} b The test runner object.
+ */
+exports.benchInheritance = function(b) {
+  for (const depth of [1, 10, 30]) {
+    const name = 'inherited lookup depth ' + depth;
+    const setup = `
+      var root = {method: function() {return 1;}};
+      for (var i = 0; i < 50; i++) root['p' + i] = i;
+      var obj = root;
+      for (var i = 0; i < ${depth}; i++) {
+        obj = Object.create(obj);
+        obj['q' + i] = i;
+      }`;
+    const timed = `
+      var n = 0;
+      for (var i = 0; i < 100000; i++) {
+        n += obj.method() + obj.p7;
+        if (obj.missing === undefined) n++;
+      }
+      n;
+    `;
+    runBench(b, name, setup, timed);
+  }
+};
+
+/**
+ * Run some benchmarks of reading and writing array elements by
+ * numeric index, in loops typical of array-heavy code.
+ * @param {!B} b The test runner object.
+ */
+exports.benchArrayIndexing = function(b) {
+  const setup = `
+    var arr = [];
+    for (var i = 0; i < 1000; i++) arr.push(i);
+  `;
+  runBench(b, 'array index read', setup, `
+    var sum = 0;
+    for (var r = 0; r < 100; r++) {
+      for (var i = 0; i < arr.length; i++) sum += arr[i];
+    }
+    sum;
+  `);
+  runBench(b, 'array index write', setup, `
+    for (var r = 0; r < 100; r++) {
+      for (var i = 0; i < arr.length; i++) arr[i] = arr[i] + 1;
+    }
+  `);
+};
@@ -24,6 +24,7 @@
 
 const fs = require('fs');
 const Interpreter = require('../interpreter');
+const Snapshot = require('../snapshot');
 
 exports.startupFiles = {
   es5: fs.readFileSync('startup/es5.js', 'utf8'),
@@ -33,6 +34,14 @@ exports.startupFiles = {
   cc: fs.readFileSync('startup/cc.js', 'utf8'),
 };
 
+/**
+ * Startup snapshot (see snapshot.js) of an interpreter with default
+ * options and the standard startup files loaded, made the first time
+ * one is needed, or null if none has been made yet.
+ * @type {?Buffer}
+ */
+let snapshot = null;
+
 /**
  * Create an initialize an Interpreter instance.
  * @param {!Interpreter.Options=} options Interpreter constructor
@@ -42,7 +51,14 @@ exports.startupFiles = {
  */
 exports.getInterpreter = function(options, init) {
   var intrp = new Interpreter(options);
-  if (init || init === undefined) {
+  if ((init || init === undefined) && !options) {
+    // Evaluating the startup files takes much longer than loading a
+    // snapshot of the result.
+    if (!snapshot) {
+      snapshot = Snapshot.encode(exports.getInterpreter({}));
+    }
+    Snapshot.load(snapshot, intrp);
+  } else if (init || init === undefined) {
     for (const file of Object.values(exports.startupFiles)) {
       intrp.createThreadForSrc(file);
       intrp.run();
@@ -21,12 +21,20 @@
  */
 'use strict';
 
+const fs = require('fs');
 const http = require('http');
 const net = require('net');
+const os = require('os');
+const path = require('path');
+const tls = require('tls');
 const util = require('util');
 
+const Blobs = require('../blobs');
+const Certificates = require('../certificates');
+const {generateKey, makeCertificate, pem} = require('./certificates_common');
 const Interpreter = require('../interpreter');
 const {getInterpreter} = require('./interpreter_common');
+const Mail = require('../mail');
 const Parser = require('../parser').Parser;
 const {T} = require('./testing');
 const testcases = require('./testcases');
@@ -875,6 +883,106 @@ exports.testThreading = function(t) {
   `;
   runTest(t, 'Thread.kill', src, 'OK');
 
+  src = `
+      var result = [];
+      var worker = new Thread(function() {
+        for (var i = 0; i < 5; i++) {
+          if (Thread.current().cancelled) {
+            result.push('cancelled');
+            return;
+          }
+          result.push(i);
+          suspend(1000);
+        }
+      });
+      suspend(1500);
+      worker.cancel();
+      suspend();
+      String(result);
+  `;
+  runTest(t, 'Thread.prototype.cancel', src, '0,1,cancelled');
+
+  src = `
+      var when;
+      var worker = new Thread(function() {
+        var start = Date.now();
+        suspend(100000);
+        when = Date.now() - start;
+      });
+      suspend();
+      worker.cancel();
+      suspend();
+      when < 100000;
+  `;
+  runTest(t, 'Thread.prototype.cancel wakes sleeping thread', src, true);
+
+  src = `
+      var alice = {name: 'Alice'};
+      var bob = {name: 'Bob'};
+      var results = [];
+      var attempt = function(owner, f) {
+        Object.setOwnerOf(f, owner);  // So that it runs with owner's perms.
+        try {
+          results.push(f());
+        } catch (e) {
+          results.push(e.name);
+        }
+      };
+      var body = function() {
+        Thread.current().setLocal('key', 'value');
+        suspend(100000);
+      };
+      Object.setOwnerOf(body, alice);
+      var worker = new Thread(body);
+      suspend();
+      attempt(alice, function() {return worker.getLocal('key');});
+      attempt(bob, function() {return worker.getLocal('key');});
+      attempt(bob, function() {worker.setLocal('key', 'bob');});
+      attempt(bob, function() {return worker.hasLocal('key');});
+      attempt(bob, function() {return worker.deleteLocal('key');});
+      attempt(bob, function() {worker.cancel();});
+      results.push(worker.cancelled, worker.getLocal('key'));
+      worker.cancel();
+      results.push(worker.cancelled);
+      String(results);
+  `;
+  runTest(t, 'Thread.prototype.{get,set,has,delete}Local, cancel: perms',
+          src, 'value,PermissionError,PermissionError,PermissionError,' +
+          'PermissionError,PermissionError,false,value,true');
+
+  src = `
+      var reports = [];
+      CC.root.onError = function(report) {
+        reports.push(report);
+      };
+      var worker = new Thread(function() {throw new Error('oops');});
+      var other = new Thread(function() {throw 42;});
+      suspend();
+      suspend();
+      delete CC.root.onError;
+      var r0 = reports[0], r1 = reports[1];
+      [reports.length, r0.error.message, r0.thread === worker,
+       typeof r0.stack, r1.error, r1.thread === other].join();
+  `;
+  runTest(t, 'Uncaught exception reported to owner.onError', src,
+      '2,oops,true,string,42,true', {options: {noLog: ['unhandled']}});
+
+  src = `
+      var calls = 0;
+      CC.root.onError = function(report) {
+        calls++;
+        throw report.error;
+      };
+      new Thread(function() {throw new Error('oops');});
+      suspend();
+      suspend();
+      suspend();
+      delete CC.root.onError;
+      calls;
+  `;
+  runTest(t, 'Errors thrown by onError not reported again', src, 1,
+      {options: {noLog: ['unhandled']}});
+
   src = `
       'before';
       suspend(10000);
@@ -1027,6 +1135,38 @@ exports.testTimeLimit = function(t) {
   runTest(t, name, src, 'RangeError: Thread ran too long', {
     onCreateThread: (intrp, thread) => {thread.timeLimit = timeLimit;},
   });
+
+  // Test regular expressions that backtrack catastrophically are
+  // stopped when the thread runs out of time.
+  name = 'Catastrophic RegExp hits timeLimit';
+  src = `
+      var input = 'aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa!';
+      try {
+        // The first completes (V8's linear engine takes over), but the
+        // second (which has a backreference) is stopped.
+        String(/(a+)+b/.test(input)) + ', ' + /^(a+)+\\1b$/.test(input);
+      } catch (e) {
+        e.name + ': ' + e.message;  // Can't call String(e): we're out of time!
+      }
+  `;
+  runTest(t, name, src, 'RangeError: Regular expression took too long', {
+    onCreateThread: (intrp, thread) => {thread.timeLimit = timeLimit;},
+  });
+
+  // Test long native operations are stopped when the thread runs out
+  // of time, rather than running to completion.
+  name = 'JSON.stringify hits timeLimit';
+  src = `
+      try {
+        JSON.stringify(new Array(${iterations} * 100));
+        "Thread didn't time out";  // Maybe increase iterations?
+      } catch (e) {
+        e.name + ': ' + e.message;  // Can't call String(e): we're out of time!
+      }
+  `;
+  runTest(t, name, src, 'RangeError: Thread ran too long', {
+    onCreateThread: (intrp, thread) => {thread.timeLimit = timeLimit;},
+  });
 };
 
 /**
@@ -1379,193 +1519,1503 @@ exports.testServing = async function(t) {
     onCreate: createReceive,
   });
 
-  // Check to make sure that connectionListen() throws if attempting
-  // to bind to an invalid port or rebind a port already in use.
-  name = 'testConnectionListenThrows';
-  const server = new net.Server();
-  server.listen(8887);
+  // Run a test of a WebSocket listener: the client's ID cookie is
+  // passed on first, followed by each message.
+  name = 'testServerWebSocket';
   src = `
-      // Some invalid ports:
-      // * 8887 is in use by the above net.Server.
-      // * 8888 will be in-use by via previous connectionListen.
-      // * Others are not integers or are out-of-range.
-      var ports = ['foo', {}, -1, 80.8, 8887, 8888, 65536];
-      try {
-        CC.connectionListen(8888, {});
-        for (var i = 0; i < ports.length; i++) {
-          try {
-            CC.connectionListen(ports[i], {});
-            resolve('Unexpected success listening on port ' + ports[i]);
-          } catch (e) {
-            if (!(e instanceof Error)) {
-              resolve('threw non-Error value ' + String(e));
-            }
-          }
-        }
-      } finally {
+      var data = '', conn = {};
+      conn.onReceive = function(d) {
+        data += d;
+      };
+      conn.onEnd = function() {
+        CC.connectionClose(this);
         CC.connectionUnlisten(8888);
-      }
-      resolve('OK');
+        resolve(data);
+      };
+      CC.connectionListen(8888, conn, 0,
+          {protocol: 'websocket', origins: ['https://example.com']});
+      send();
    `;
-  await runAsyncTest(t, name, src, 'OK', {options: {noLog: ['net']}});
-  server.close();
+  function createWebSocketSend(intrp) {
+    intrp.global.createMutableBinding('send', intrp.createNativeFunction(
+        'send', function() {
+          const frame = function(opcode, text) {
+            // Masked with an all-zero mask, for simplicity.
+            const payload = Buffer.from(text);
+            return Buffer.concat([Buffer.from([0x80 | opcode,
+                0x80 | payload.length, 0, 0, 0, 0]), payload]);
+          };
+          const client = net.createConnection({port: 8888}, function() {
+            client.write('GET / HTTP/1.1\r\nHost: localhost\r\n' +
+                'Upgrade: websocket\r\nConnection: Upgrade\r\n' +
+                'Origin: https://example.com\r\nCookie: ID=c0ffee\r\n' +
+                'Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n' +
+                'Sec-WebSocket-Version: 13\r\n\r\n');
+            client.write(frame(1, 'look\n'));
+            client.write(frame(8, ''));
+          });
+          client.on('data', function() {});
+        }));
+  };
+  await runAsyncTest(t, name, src, 'identify as c0ffee\nlook\n', {
+    options: {noLog: ['net']},
+    onCreate: createWebSocketSend,
+  });
 
-  // Check to make sure that connectionUnlisten() throws if attempting
-  // to unbind an invalid or not / no longer bound port.
-  name = 'testConnectionUnlistenThrows';
+  // Run a test of client protocol negotiation: the newest version
+  // offered that the server speaks is selected, and the features asked
+  // for that the listener supports agreed; these are passed to
+  // .onConnect and sent to the client in a hello message (which it
+  // echoes back).  A client speaking no version known to the server is refused.
+  name = 'testServerWebSocketNegotiate';
   src = `
-      var ports = ['foo', {}, -1, 22, 80.8, 4567, 8888, 65536];
-      CC.connectionListen(8888, {});
-      CC.connectionUnlisten(8888, {});
-      for (var i = 0; i < ports.length; i++) {
-        try {
-          CC.connectionUnlisten(ports[i], {});
-          resolve('Unexpected success unlistening on port ' + ports[i]);
-        } catch (e) {
-          if (!(e instanceof Error)) {
-            resolve('threw non-Error value ' + String(e));
-          }
-        }
-      }
-      resolve('OK');
+      var data = '', conn = {};
+      conn.onConnect = function(client) {
+        data += JSON.stringify(client) + '\\n';
+      };
+      conn.onReceive = function(d) {
+        data += d;
+      };
+      conn.onEnd = function() {
+        CC.connectionClose(this);
+        CC.connectionUnlisten(8888);
+        resolve(data);
+      };
+      CC.connectionListen(8888, conn, 0, {protocol: 'websocket',
+          compress: true, features: ['editor', 'binary', 'sound']});
+      send();
    `;
-  await runAsyncTest(t, name, src, 'OK', {options: {noLog: ['net']}});
+  function createWebSocketNegotiateSend(intrp) {
+    intrp.global.createMutableBinding('send', intrp.createNativeFunction(
+        'send', function() {
+          const frame = function(opcode, payload) {
+            payload = Buffer.from(payload);
+            return Buffer.concat([Buffer.from([0x80 | opcode,
+                0x80 | payload.length, 0, 0, 0, 0]), payload]);
+          };
+          const open = function(versions, onData) {
+            const client = net.createConnection({port: 8888}, function() {
+              client.write('GET /?features=binary,unknown,editor ' +
+                  'HTTP/1.1\r\nHost: localhost\r\n' +
+                  'Upgrade: websocket\r\nConnection: Upgrade\r\n' +
+                  'Cookie: ID=c0ffee\r\n' +
+                  'Sec-WebSocket-Protocol: ' + versions + '\r\n' +
+                  'Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n' +
+                  'Sec-WebSocket-Version: 13\r\n\r\n');
+            });
+            let received = Buffer.alloc(0);
+            client.on('data', function(data) {
+              received = Buffer.concat([received, data]);
+              onData(client, received);
+            });
+            client.on('error', function() {});
+          };
+          open('codecity.v9', function(client, received) {
+            if (!String(received).startsWith('HTTP/1.1 400 ')) return;
+            let done = false;
+            open('codecity.v9, codecity.v2, codecity.v1',
+                function(client, received) {
+                  const end = received.indexOf('\r\n\r\n');
+                  const frames = received.subarray(end + 4);
+                  if (end === -1 || frames.length < 2 ||
+                      frames.length < 2 + frames[1] || done) {
+                    return;
+                  }
+                  done = true;
+                  const protocol = String(received.subarray(0, end))
+                      .match(/Sec-WebSocket-Protocol: (.*)/);
+                  client.write(frame(1, (protocol && protocol[1]) + '\n'));
+                  client.write(frame(1, frames.subarray(2, 2 + frames[1])));
+                  client.write(frame(8, ''));
+                });
+          });
+        }));
+  };
+  await runAsyncTest(t, name, src,
+      '{"version":2,"features":["binary","editor"],"compress":false}\n' +
+      'identify as c0ffee\ncodecity.v2\n' +
+      '{"type":"hello","version":2,"features":["binary","editor"],' +
+      '"compress":false}', {
+    options: {noLog: ['net']},
+    onCreate: createWebSocketNegotiateSend,
+  });
 
-  // Check to make sure that connectionWrite() throws if attempting to
-  // write anything not a string or to anything not a connected
-  // object.
-  name = 'testConnectionWriteThrows';
+  // Run a test of binary messages: each received is passed to
+  // .onReceiveBinary, as a string of one character per byte, and
+  // CC.connectionWriteBinary sends them.
+  name = 'testServerWebSocketBinary';
   src = `
-      var conn = {toString: function() {return 'an open connection';}};
-      conn.onConnect = function() {
-        var cases = [
-          {obj: undefined, data: 'fine'},
-          {obj: null, data: 'fine'},
-          {obj: 42, data: 'fine'},
-          {obj: true, data: 'fine'},
-          {obj: 'a string', data: 'fine'},
-          {obj: {/* not connected */}, data: 'fine'},
-          {obj: this, data: undefined},
-          {obj: this, data: null},
-          {obj: this, data: 42},
-          {obj: this, data: true},
-          {obj: this, data: {}},
-        ];
-        for (var tc, i = 0; (tc = cases[i]); i++) {
-          try {
-            CC.connectionWrite(tc.obj, tc.data);
-            resolve('Unexpected success writing ' + tc.data +
-                    ' to ' + String(tc.obj));
-          } catch (e) {
-            if (!(e instanceof TypeError)) {
-              resolve('threw non-TypeError value ' + String(e));
-            }
-          }
+      var data = '', conn = {};
+      conn.onReceive = function(d) {
+        data += d;
+      };
+      conn.onReceiveBinary = function(d) {
+        data += '[binary ' + d.charCodeAt(0) + ',' + d.charCodeAt(1) + ']';
+        try {
+          CC.connectionWriteBinary(this, '\\u0100');
+        } catch (e) {
+          data += e.name + '\\n';
         }
-        CC.connectionClose(this);
-        resolve('OK');
+        CC.connectionWriteBinary(this, d.split('').reverse().join(''));
       };
-      CC.connectionListen(8888, conn);
-      try {
-        receive();
-      } finally {
+      conn.onEnd = function() {
+        CC.connectionClose(this);
         CC.connectionUnlisten(8888);
-      }
+        resolve(data);
+      };
+      CC.connectionListen(8888, conn, 0,
+          {protocol: 'websocket', features: ['binary']});
+      send();
    `;
-  await runAsyncTest(t, name, src, 'OK', {
+  function createWebSocketBinarySend(intrp) {
+    intrp.global.createMutableBinding('send', intrp.createNativeFunction(
+        'send', function() {
+          const frame = function(opcode, payload) {
+            payload = Buffer.from(payload);
+            return Buffer.concat([Buffer.from([0x80 | opcode,
+                0x80 | payload.length, 0, 0, 0, 0]), payload]);
+          };
+          const client = net.createConnection({port: 8888}, function() {
+            client.write('GET /?features=binary HTTP/1.1\r\n' +
+                'Host: localhost\r\n' +
+                'Upgrade: websocket\r\nConnection: Upgrade\r\n' +
+                'Cookie: ID=c0ffee\r\n' +
+                'Sec-WebSocket-Protocol: codecity.v2\r\n' +
+                'Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n' +
+                'Sec-WebSocket-Version: 13\r\n\r\n');
+            client.write(frame(2, Buffer.from([0x00, 0xe9])));
+          });
+          let received = Buffer.alloc(0);
+          client.on('data', function(data) {
+            received = Buffer.concat([received, data]);
+            // Skip the response and hello message; echo the first
+            // binary message received as text.
+            let frames =
+                received.subarray(received.indexOf('\r\n\r\n') + 4);
+            while (frames.length >= 2 && frames.length >= 2 + frames[1]) {
+              if ((frames[0] & 0x0f) === 2) {
+                client.write(frame(1,
+                    frames.subarray(2, 2 + frames[1]).toString('hex') + '\n'));
+                client.write(frame(8, ''));
+                client.removeAllListeners('data');
+                return;
+              }
+              frames = frames.subarray(2 + frames[1]);
+            }
+          });
+          client.on('error', function() {});
+        }));
+  };
+  await runAsyncTest(t, name, src,
+      'identify as c0ffee\n[binary 0,233]RangeError\ne900\n', {
     options: {noLog: ['net']},
-    onCreate: createReceive,
+    onCreate: createWebSocketBinarySend,
   });
 
-  // Run a test to make sure listening sockets survive the interpreter
-  // being paused and restarted.
-  name = 'testServerPauseStart';
+  // Run a test of session resumption: a WebSocket client that drops
+  // and reconnects (presenting its SESSION cookie) is reattached to
+  // the same object, and sent what was written meanwhile.  The object
+  // is ended only once the grace period has passed.
+  name = 'testServerWebSocketResume';
   src = `
       var data = '', conn = {};
       conn.onReceive = function(d) {
         data += d;
+        if (d === 'one\\n') {
+          var obj = this;
+          setTimeout(function() {CC.connectionWrite(obj, 'kept');}, 50);
+        }
+      };
+      conn.onResume = function() {
+        data += '[resume]';
       };
       conn.onEnd = function() {
         CC.connectionClose(this);
         CC.connectionUnlisten(8888);
         resolve(data);
       };
-      CC.connectionListen(8888, conn);
-      pause();
+      CC.connectionListen(8888, conn, 0, {protocol: 'websocket', resume: 200});
       send();
    `;
-  function createPauseAndSend(intrp) {
-    intrp.global.createMutableBinding('pause', intrp.createNativeFunction(
-        'pause', function() {
-          intrp.pause();
-          intrp.start();
+  function createWebSocketResumeSend(intrp) {
+    intrp.global.createMutableBinding('send', intrp.createNativeFunction(
+        'send', function() {
+          const frame = function(opcode, text) {
+            const payload = Buffer.from(text);
+            return Buffer.concat([Buffer.from([0x80 | opcode,
+                0x80 | payload.length, 0, 0, 0, 0]), payload]);
+          };
+          const open = function(cookie, onResponse) {
+            const client = net.createConnection({port: 8888}, function() {
+              client.write('GET / HTTP/1.1\r\nHost: localhost\r\n' +
+                  'Upgrade: websocket\r\nConnection: Upgrade\r\n' +
+                  'Cookie: ' + cookie + '\r\n' +
+                  'Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n' +
+                  'Sec-WebSocket-Version: 13\r\n\r\n');
+            });
+            let received = Buffer.alloc(0);
+            client.on('data', function(data) {
+              received = Buffer.concat([received, data]);
+              onResponse(client, received);
+            });
+            client.on('error', function() {});
+          };
+          let token = null;
+          open('ID=c0ffee', function(client, received) {
+            const m = String(received).match(/Set-Cookie: SESSION=(\w+)/);
+            if (!m || token) return;
+            token = m[1];
+            client.write(frame(1, 'one\n'));
+            setTimeout(function() {
+              client.destroy();
+              setTimeout(reconnect, 100);
+            }, 10);
+          });
+          const reconnect = function() {
+            let done = false;
+            open('ID=c0ffee; SESSION=' + token, function(client, received) {
+              const end = received.indexOf('\r\n\r\n');
+              // Unmasked frames from server: [0x81, length, payload].
+              const frames = received.subarray(end + 4);
+              if (end === -1 || frames.length < 2 ||
+                  frames.length < 2 + frames[1] || done) {
+                return;
+              }
+              done = true;
+              client.write(frame(1, 'got ' +
+                  frames.subarray(2, 2 + frames[1]) + '\n'));
+              client.write(frame(8, ''));
+            });
+          };
         }));
-    createSend(intrp);
   };
-  await runAsyncTest(t, name, src, 'foobar', {
+  await runAsyncTest(t, name, src,
+                     'identify as c0ffee\none\n[resume]got kept\n', {
     options: {noLog: ['net']},
-    onCreate: createPauseAndSend
+    onCreate: createWebSocketResumeSend,
   });
 
-  // Run a test to make sure listening sockets are re-listened after
-  // the interpreter is stopped and restarted.
-  name = 'testServerStopStart';
+  // Run a test of a telnet listener: commands are removed from the
+  // data received, and the window size is reported.
+  name = 'testServerTelnet';
   src = `
       var data = '', conn = {};
       conn.onReceive = function(d) {
         data += d;
       };
+      conn.onResize = function(width, height) {
+        data += '[' + width + 'x' + height + ']';
+        CC.connectionSetEcho(this, false);
+      };
       conn.onEnd = function() {
         CC.connectionClose(this);
         CC.connectionUnlisten(8888);
         resolve(data);
       };
-      CC.connectionListen(8888, conn);
-      stop();
+      CC.connectionListen(8888, conn, 0, {protocol: 'telnet'});
       send();
    `;
-  function createStopAndSend(intrp) {
-    intrp.global.createMutableBinding('stop', intrp.createNativeFunction(
-        'stop', function() {
-          intrp.stop();
-          intrp.start();
+  function createTelnetSend(intrp) {
+    intrp.global.createMutableBinding('send', intrp.createNativeFunction(
+        'send', function() {
+          const client = net.createConnection({port: 8888}, function() {
+            client.write(Buffer.from([255, 251, 31, 255, 250, 31, 0, 80, 0, 24,
+                                      255, 240]));
+            setTimeout(function() {
+              // An escaped IAC (which is not valid UTF-8).
+              client.write(Buffer.concat([Buffer.from('foo'),
+                  Buffer.from([255, 255]), Buffer.from('bar')]));
+              client.end();
+            }, 50);
+          });
+          client.on('data', function() {});
         }));
-    createSend(intrp);
   };
-  await runAsyncTest(t, name, src, 'foobar', {
+  await runAsyncTest(t, name, src, '[80x24]foo\ufffdbar', {
     options: {noLog: ['net']},
-    onCreate: createStopAndSend
+    onCreate: createTelnetSend,
   });
-};
-
-/**
- * Run tests of the client side of the networking subsystem (xhr).
- * @param {!T} t The test runner object.
- */
-exports.testClient = async function(t) {
-  // Run test of the xhr() function using HTTP.
-  let name = 'testXhrHttp';
-  const httpTestServer = http.createServer(function (req, res) {
-    res.writeHead(200, {'Content-Type': 'text/plain'});
-    res.end('OK HTTP: ' + req.url);
-  }).listen(9980);
-  let src = `
-      try {
-        resolve(CC.xhr('http://localhost:9980/foo'));
-      } catch (e) {
-        reject(e);
-      }
-  `;
-  await runAsyncTest(t, name, src, 'OK HTTP: /foo',
-                     {options: {noLog: ['net']}});
-  httpTestServer.close();
 
-  // Run test of the xhr() function using HTTPS.
-  // TODO(cpcallen): Don't depend on external webserver.
-  name = 'testXhr';
+  // Run a test of an HTTP listener: the request is described to
+  // .onRequest, and the response streamed back.
+  name = 'testServerHttp';
   src = `
-      try {
-        resolve(CC.xhr('https://neil.fraser.name/software/JS-Interpreter/' +
+      var proto = {};
+      proto.onRequest = function(request) {
+        CC.httpWriteHead(this, 201, {'Content-Type': 'text/plain',
+                                     'Set-Cookie': ['a=1', 'b=2']});
+        CC.connectionWrite(this, request.method + ' ' + request.path + '?' +
+            request.query + ' ' + request.headers['x-test'] + ' ' +
+            request.cookies.ID + ' ' + request.body);
+        try {
+          CC.httpWriteHead(this, 200);
+          CC.connectionWrite(this, ' (headers written twice)');
+        } catch (e) {
+          CC.connectionWrite(this, '!');
+        }
+        CC.connectionClose(this);
+      };
+      proto.onClose = function() {
+        CC.connectionUnlisten(8888);
+      };
+      CC.connectionListen(8888, proto, 0, {protocol: 'http'});
+      resolve(send());
+   `;
+  function createHttpSend(intrp) {
+    intrp.global.createMutableBinding('send', new intrp.NativeFunction({
+      name: 'send', length: 0,
+      call: function(intrp, thread, state, thisVal, args) {
+        const rr = intrp.getResolveReject(thread, state);
+        const req = http.request({
+          port: 8888, method: 'POST', path: '/foo/bar?baz=1',
+          headers: {'X-Test': 'quux', 'Cookie': 'ID=c0ffee'},
+        }, function(res) {
+          let body = '';
+          res.on('data', function(data) {
+            body += data;
+          });
+          res.on('end', function() {
+            rr.resolve(res.statusCode + ' ' + res.headers['content-type'] +
+                ' ' + res.headers['set-cookie'].join() + ': ' + body);
+          });
+        });
+        req.on('error', function(e) {
+          rr.resolve(String(e));
+        });
+        req.end('café');
+        return Interpreter.FunctionResult.Block;
+      }
+    }));
+  };
+  await runAsyncTest(t, name, src,
+      '201 text/plain a=1,b=2: POST /foo/bar?baz=1 quux c0ffee café!', {
+        options: {noLog: ['net']},
+        onCreate: createHttpSend,
+      });
+
+  // Run a test of an SSE listener: each GET request is described to
+  // .onConnect, and each string written sent as an event.
+  name = 'testServerSse';
+  src = `
+      var proto = {};
+      var log = [];
+      proto.onConnect = function(request) {
+        log.push(request.method + ' ' + request.path + '?' + request.query);
+        CC.connectionWrite(this, 'hello\\nworld');
+        CC.connectionWrite(this, request.cookies.ID);
+        CC.connectionClose(this);
+      };
+      CC.connectionListen(8888, proto, 0,
+          {protocol: 'sse', origins: ['https://example.com']});
+      log.push(send('GET', 'https://example.com'));
+      log.push(send('GET', 'https://evil.example'));
+      log.push(send('POST'));
+      CC.connectionUnlisten(8888);
+      resolve(log.join('|'));
+   `;
+  function createSseSend(intrp) {
+    intrp.global.createMutableBinding('send', new intrp.NativeFunction({
+      name: 'send', length: 2,
+      call: function(intrp, thread, state, thisVal, args) {
+        const [method, origin] = args;
+        const rr = intrp.getResolveReject(thread, state);
+        const headers = {'Cookie': 'ID=c0ffee'};
+        if (origin) headers['Origin'] = origin;
+        const req = http.request({
+          port: 8888, method: method, path: '/feed?x=1', headers: headers,
+        }, function(res) {
+          let body = '';
+          res.on('data', function(data) {
+            body += data;
+          });
+          res.on('end', function() {
+            rr.resolve(res.statusCode + ' ' + res.headers['content-type'] +
+                ' ' + res.headers['access-control-allow-origin'] + ': ' +
+                body);
+          });
+        });
+        req.on('error', function(e) {
+          rr.resolve(String(e));
+        });
+        req.end();
+        return Interpreter.FunctionResult.Block;
+      }
+    }));
+  };
+  await runAsyncTest(t, name, src,
+      'GET /feed?x=1|200 text/event-stream; charset=utf-8 ' +
+      'https://example.com: data: hello\ndata: world\n\ndata: c0ffee\n\n|' +
+      '403 text/plain undefined: Forbidden\n|' +
+      '405 text/plain undefined: Method Not Allowed\n', {
+        options: {noLog: ['net']},
+        onCreate: createSseSend,
+      });
+
+  // Run a test of the limits on the requests to HTTP listeners: the
+  // number in progress at once, and their size.
+  name = 'testServerHttpQuota';
+  src = `
+      var proto = {};
+      var pending = [];
+      proto.onRequest = function(request) {
+        pending.push(this);
+      };
+      CC.connectionListen(8888, proto, 0, {protocol: 'http'});
+      var result = [send('GET', '', false), send('GET', '')];
+      for (var i = 0; i < pending.length; i++) {
+        CC.connectionWrite(pending[i], 'OK');
+        CC.connectionClose(pending[i]);
+      }
+      result.push(pending.length);
+      suspend(10);
+      result.push(send('POST', 'this is too long'));
+      CC.connectionUnlisten(8888);
+      resolve(result.join());
+   `;
+  function createHttpQuotaSend(intrp) {
+    intrp.global.createMutableBinding('send', new intrp.NativeFunction({
+      name: 'send', length: 3,
+      call: function(intrp, thread, state, thisVal, args) {
+        const rr = intrp.getResolveReject(thread, state);
+        let done = false;
+        const resolve = (value) => {
+          if (!done) rr.resolve(value);
+          done = true;
+        };
+        const req = http.request({port: 8888, method: args[0]}, (res) => {
+          res.resume();
+          resolve(res.statusCode);
+        });
+        req.on('error', (e) => resolve(String(e)));
+        req.end(args[1]);
+        if (args[2] === false) {
+          // Don't wait for the response (which will not be sent until
+          // after the other request is made).
+          setTimeout(() => resolve('sent'), 50);
+        }
+        return Interpreter.FunctionResult.Block;
+      }
+    }));
+  };
+  await runAsyncTest(t, name, src, 'sent,503,1,413', {
+    options: {noLog: ['net'], httpMaxRequests: 1, httpMaxBody: 8},
+    onCreate: createHttpQuotaSend,
+  });
+
+  // Run a test of an SMTP listener.
+  name = 'testServerSmtp';
+  src = `
+      var proto = {};
+      proto.onMail = function(message) {
+        CC.connectionUnlisten(8888);
+        resolve([this === proto, message.sender, message.recipients.join('+'),
+                 message.from, message.subject, message.text,
+                 message.headers['x-test'], message.secure].join());
+      };
+      CC.connectionListen(8888, proto, 0, {protocol: 'smtp'});
+      send();
+   `;
+  function createSmtpSend(intrp) {
+    intrp.global.createMutableBinding('send', new intrp.NativeFunction({
+      name: 'send', length: 0,
+      call: function(intrp, thread, state, thisVal, args) {
+        Mail.deliver({host: 'localhost', port: 8888}, 'a@b.test',
+                     ['bot@city.test', 'Joe+x@city.test'],
+                     'From: Al <a@b.test>\r\nSubject: =?UTF-8?B?Q2Fmw6k=?=\r\n' +
+                     'X-Test: yes\r\n\r\nHello\r\nthere\r\n')
+            .catch(() => {});
+      }
+    }));
+  };
+  await runAsyncTest(t, name, src,
+                     'true,a@b.test,bot@city.test+Joe+x@city.test,' +
+                     'Al <a@b.test>,Café,Hello\nthere\n,yes,false', {
+    options: {noLog: ['net']},
+    onCreate: createSmtpSend,
+  });
+
+  // Run a test of rate limiting: connection attempts beyond the
+  // 'connect' limit are refused, and input beyond the 'command' limit
+  // discarded (with .onRateLimit called as the lockout begins).
+  name = 'testServerRateLimit';
+  src = `
+      var log = [], connections = 0, conn = {};
+      conn.onConnect = function() {
+        connections++;
+      };
+      conn.onReceive = function(d) {
+        log.push('receive ' + d);
+      };
+      conn.onRateLimit = function(policy, wait) {
+        log.push(policy + ' ' + wait);
+      };
+      conn.onEnd = function() {
+        CC.connectionClose(this);
+        CC.connectionUnlisten(8888);
+        resolve(log.join() + ',' + connections);
+      };
+      CC.connectionListen(8888, conn);
+      send();
+   `;
+  function createRateLimitedSend(intrp) {
+    intrp.global.createMutableBinding('send', intrp.createNativeFunction(
+        'send', function() {
+          const client = net.createConnection({port: 8888}, function() {
+            // A second connection should be refused.
+            const refused = net.createConnection({port: 8888});
+            refused.on('error', () => {});
+            refused.on('close', async function() {
+              // Send each chunk separately, so they are not coalesced.
+              for (const data of ['a', 'b', 'c', 'd']) {
+                client.write(data);
+                await new Promise((resolve) => setTimeout(resolve, 50));
+              }
+              client.end();
+            });
+          });
+        }));
+  };
+  await runAsyncTest(t, name, src, 'receive a,receive b,command 1000,1', {
+    options: {
+      noLog: ['net'],
+      rateLimits: {
+        exempt: [],
+        connect: {limit: 1},
+        command: {limit: 2, period: 60000, lockout: 1000},
+      },
+    },
+    onCreate: createRateLimitedSend,
+  });
+
+  // Run a test of idle timeouts: .onIdle is called idleWarning ms
+  // before the idle timeout (again after further input), and the
+  // connection closed when it expires.
+  name = 'testServerIdle';
+  src = `
+      var log = [], conn = {};
+      var errors = [
+        function() {CC.connectionListen(8888, conn, 0, {idle: -1});},
+        function() {
+          CC.connectionListen(8888, conn, 0, {protocol: 'http', idle: 1});
+        },
+        function() {CC.connectionSetIdle({}, 1000);},
+      ];
+      for (var i = 0; i < errors.length; i++) {
+        try {
+          errors[i]();
+        } catch (e) {
+          log.push(e.name);
+        }
+      }
+      conn.onConnect = function() {
+        try {
+          CC.connectionSetIdle(this, 0, -1);
+        } catch (e) {
+          log.push(e.name);
+        }
+      };
+      conn.onReceive = function(d) {
+        log.push('receive ' + d);
+      };
+      conn.onIdle = function(remaining) {
+        log.push('idle ' + (remaining > 0 && remaining <= 100));
+      };
+      conn.onClose = function() {
+        CC.connectionUnlisten(8888);
+        resolve(log.join());
+      };
+      CC.connectionListen(8888, conn, undefined,
+                          {idle: 200, idleWarning: 100});
+      send();
+   `;
+  function createIdleSend(intrp) {
+    intrp.global.createMutableBinding('send', intrp.createNativeFunction(
+        'send', function() {
+          const client = net.createConnection({port: 8888}, function() {
+            setTimeout(() => client.write('a'), 150);
+          });
+          client.on('end', () => client.end());
+        }));
+  };
+  await runAsyncTest(t, name, src,
+                     'RangeError,TypeError,TypeError,RangeError,' +
+                     'idle true,receive a,idle true', {
+    options: {noLog: ['net']},
+    onCreate: createIdleSend,
+  });
+
+  // Run a test of CC.rateLimit, CC.rateLimitCheck and
+  // CC.rateLimitReset.
+  name = 'testRateLimit';
+  src = `
+      var user = {}, results = [];
+      for (var i = 0; i < 3; i++) {
+        results.push(CC.rateLimit('login', 'bob'),
+                     CC.rateLimit('login', user));
+      }
+      results.push(CC.rateLimitCheck('login', 'bob') > 0,
+                   CC.rateLimitCheck('login', 'alice'));
+      CC.rateLimitReset('login', 'bob');
+      results.push(CC.rateLimitCheck('login', 'bob'),
+                   CC.rateLimitCheck('login', user) > 0);
+      var errors = [[42, 'bob'], ['login', 42], ['nonesuch', 'bob']];
+      for (i = 0; i < errors.length; i++) {
+        try {
+          CC.rateLimit(errors[i][0], errors[i][1]);
+          results.push('no error');
+        } catch (e) {
+          results.push(e.name);
+        }
+      }
+      try {
+        (function() {
+          setPerms({});
+          CC.rateLimit('login', 'bob');
+        })();
+      } catch (e) {
+        results.push(e.name);
+      }
+      results.join();
+  `;
+  runTest(t, name, src,
+          '0,0,0,0,60000,60000,true,0,0,true,' +
+          'TypeError,TypeError,RangeError,PermissionError', {
+    options: {rateLimits: {login: {limit: 2, lockout: 60000}}},
+  });
+
+  // Run a test of CC.ban: connections from banned networks are
+  // refused, until unbanned.
+  name = 'testServerBan';
+  src = `
+      var conn = {};
+      conn.onReceive = function(d) {
+        CC.connectionClose(this);
+        CC.connectionUnlisten(8888);
+        resolve(d);
+      };
+      CC.connectionListen(8888, conn);
+      CC.ban('127.0.0.0/8', 'testing');
+      send(function() {
+        CC.unban('127.0.0.0/8');
+        send();
+      });
+   `;
+  function createBannedSend(intrp) {
+    intrp.global.createMutableBinding('send', new intrp.NativeFunction({
+      name: 'send', length: 1,
+      call: function(intrp, thread, state, thisVal, args) {
+        const callback = args[0];
+        const client = net.createConnection({port: 8888}, function() {
+          client.end(callback ? 'not refused' : 'accepted');
+        });
+        client.on('error', () => {});
+        client.on('close', function() {
+          if (callback) {
+            intrp.createThreadForFuncCall(intrp.ROOT, callback, undefined, []);
+          }
+        });
+      }
+    }));
+  };
+  await runAsyncTest(t, name, src, 'accepted', {
+    options: {noLog: ['net']},
+    onCreate: createBannedSend,
+  });
+
+  // Run a test of CC.ban, CC.unban and CC.bans.
+  name = 'testBan';
+  src = `
+      var results = [];
+      results.push(CC.ban('192.0.2.77/24', 'spam', Date.now() + 60000),
+                   CC.ban('2001:DB8::/32'),
+                   CC.ban('192.0.2.0/24', 'more spam'),
+                   CC.ban('198.51.100.1', 'gone', Date.now() - 1));
+      var bans = CC.bans();
+      results.push(bans.length, bans[0].network, bans[0].reason,
+                   bans[0].expires, bans[1].network, bans[1].reason,
+                   typeof bans[1].created);
+      results.push(CC.unban('2001:db8:0::/32'), CC.unban('2001:db8::/32'),
+                   CC.bans().length);
+      var errors = [[42], ['example.com'], ['192.0.2.0/33'],
+                    ['192.0.2.0/24', '', 'tomorrow']];
+      for (var i = 0; i < errors.length; i++) {
+        try {
+          CC.ban.apply(undefined, errors[i]);
+          results.push('no error');
+        } catch (e) {
+          results.push(e.name);
+        }
+      }
+      try {
+        (function() {
+          setPerms({});
+          CC.bans();
+        })();
+      } catch (e) {
+        results.push(e.name);
+      }
+      results.join();
+  `;
+  runTest(t, name, src,
+          '192.0.2.0/24,2001:db8::/32,192.0.2.0/24,198.51.100.1/32,' +
+          '2,2001:db8::/32,,,192.0.2.0/24,more spam,number,' +
+          'true,false,1,TypeError,TypeError,TypeError,TypeError,' +
+          'PermissionError', {options: {noLog: ['net']}});
+
+  // Run a test of the CC.account* functions.
+  name = 'testAccounts';
+  src = `
+      var results = [];
+      CC.accountCreate('alice', 'correct horse');
+      results.push(CC.accountVerify('alice', 'correct horse'),
+                   CC.accountVerify('alice', 'battery'),
+                   CC.accountVerify('bob', 'correct horse'));
+      try {
+        CC.accountCreate('alice', 'correct horse');
+        results.push('no error');
+      } catch (e) {
+        results.push(e.name);
+      }
+      try {
+        CC.accountCreate('bob', 'short');
+        results.push('no error');
+      } catch (e) {
+        results.push(e.name);
+      }
+      var token = CC.accountRequireReset('alice', 60000);
+      results.push(typeof token, CC.accountInfo('alice').resetPending,
+                   CC.accountVerify('alice', 'correct horse'),
+                   CC.accountReset('alice', 'guess', 'new password'),
+                   CC.accountReset('alice', token, 'new password'),
+                   CC.accountVerify('alice', 'new password'));
+      CC.accountSetPassword('alice', 'newer password');
+      results.push(CC.accountVerify('alice', 'newer password'),
+                   CC.accountInfo('alice').resetPending);
+      var enrollment = CC.accountTotpEnroll('alice', 'Test');
+      results.push(enrollment.uri.slice(0, 20),
+                   CC.accountTotpConfirm('alice', '000000'),
+                   CC.accountInfo('alice').totp,
+                   CC.accountVerifyCode('alice', '000000'),
+                   CC.accountTotpDisable('alice'),
+                   CC.accountTotpDisable('alice'));
+      try {
+        CC.accountRecoveryCodes('alice');
+        results.push('no error');
+      } catch (e) {
+        results.push(e.name);
+      }
+      results.push(CC.accountDelete('alice'), CC.accountDelete('alice'),
+                   CC.accountInfo('alice'));
+      try {
+        (function() {
+          setPerms({});
+          CC.accountVerify('alice', 'newer password');
+        })();
+      } catch (e) {
+        results.push(e.name);
+      }
+      resolve(results.join());
+  `;
+  await runAsyncTest(t, name, src,
+      'true,false,false,Error,TypeError,' +
+      'string,true,false,false,true,true,' +
+      'true,false,otpauth://totp/Test:,,false,false,true,false,Error,' +
+      'true,false,,PermissionError', {
+        options: {noLog: ['net'], passwordHashCost: 4},
+      });
+
+  // Run a test of CC.guestCreate and the limits on guests.
+  name = 'testGuests';
+  src = `
+      var results = [];
+      var g = CC.guestCreate({}, null);
+      results.push(CC.isGuest(g), Object.getOwnerOf(g) === g, CC.isGuest({}));
+      try {
+        CC.guestCreate(null);
+        results.push('no error');
+      } catch (e) {
+        results.push(e.name);
+      }
+      (function() {
+        setPerms(g);
+        try {
+          CC.fetch('http://example.com/');
+          results.push('no error');
+        } catch (e) {
+          results.push(e.name);
+        }
+        new Thread(function() {});
+        try {
+          new Thread(function() {});
+          results.push('no error');
+        } catch (e) {
+          results.push(e.name);
+        }
+      })();
+      new Thread(function() {
+        Object.setOwnerOf(Thread.current(), g);
+        setPerms(g);
+        var objects = [];
+        for (var i = 0; i < 1000; i++) {
+          objects.push({});
+        }
+        results.push('not killed');
+      });
+      new Thread(function() {
+        results.push(CC.guestRelease(g), CC.isGuest(g), CC.guestRelease(g));
+        try {
+          (function() {
+            setPerms({});
+            CC.guestCreate(null);
+          })();
+        } catch (e) {
+          results.push(e.name);
+        }
+        resolve(results.join());
+      }, 10);
+  `;
+  await runAsyncTest(t, name, src,
+      'true,true,false,RangeError,PermissionError,RangeError,' +
+      'true,false,false,PermissionError', {
+        options: {noLog: ['net'],
+                  guests: {maxGuests: 1, maxObjects: 100, maxThreads: 1}},
+      });
+
+  name = 'testGuestsDisabled';
+  src = `
+      try {
+        CC.guestCreate(null);
+      } catch (e) {
+        e.name;
+      }
+  `;
+  runTest(t, name, src, 'Error');
+
+  // Run a test of a listener with the proxy option: the client's
+  // address is taken from the PROXY protocol header (so that a banned
+  // client is refused), and data following the header passed on.
+  name = 'testServerProxy';
+  src = `
+      var data = '', conn = {};
+      conn.onReceive = function(d) {
+        data += d;
+      };
+      conn.onEnd = function() {
+        CC.connectionClose(this);
+        CC.connectionUnlisten(8888);
+        resolve(data);
+      };
+      CC.connectionListen(8888, conn, 0, {proxy: true});
+      CC.ban('198.51.100.0/24', 'testing');
+      send();
+   `;
+  function createProxySend(intrp) {
+    intrp.global.createMutableBinding('send', intrp.createNativeFunction(
+        'send', function() {
+          const banned = net.createConnection({port: 8888}, function() {
+            banned.write('PROXY TCP4 198.51.100.7 192.0.2.2 4321 8888\r\n' +
+                         'banned');
+          });
+          banned.on('error', () => {});
+          banned.on('close', function() {
+            // Version 2 header: PROXY command, TCP over IPv4.
+            const header = Buffer.concat([
+              Buffer.from('0d0a0d0a000d0a515549540a' + '2111000c', 'hex'),
+              Buffer.from([192, 0, 2, 1, 192, 0, 2, 2, 0x10, 0xe1, 0x22, 0xb8]),
+            ]);
+            const client = net.createConnection({port: 8888}, function() {
+              client.write(Buffer.concat([header, Buffer.from('foo')]));
+              client.end('bar');
+            });
+          });
+        }));
+  };
+  await runAsyncTest(t, name, src, 'foobar', {
+    options: {noLog: ['net'], trustedProxies: ['127.0.0.1', '::1']},
+    onCreate: createProxySend,
+  });
+
+  // Run a test of an HTTP listener receiving requests via a trusted
+  // proxy: the client's address is taken from X-Forwarded-For.
+  name = 'testServerHttpForwarded';
+  src = `
+      var proto = {};
+      proto.onRequest = function(request) {
+        CC.connectionWrite(this, request.remoteAddress);
+        CC.connectionClose(this);
+      };
+      CC.connectionListen(8888, proto, 0, {protocol: 'http'});
+      CC.ban('198.51.100.0/24', 'testing');
+      var results = [send('203.0.113.9'), send('198.51.100.7'),
+                     send('198.51.100.7, 203.0.113.9')];
+      CC.connectionUnlisten(8888);
+      resolve(results.join());
+   `;
+  function createForwardedSend(intrp) {
+    intrp.global.createMutableBinding('send', new intrp.NativeFunction({
+      name: 'send', length: 1,
+      call: function(intrp, thread, state, thisVal, args) {
+        const rr = intrp.getResolveReject(thread, state);
+        const req = http.request({
+          port: 8888, headers: {'X-Forwarded-For': args[0]},
+        }, function(res) {
+          let body = '';
+          res.on('data', function(data) {
+            body += data;
+          });
+          res.on('end', function() {
+            rr.resolve(res.statusCode + ' ' + body.trim());
+          });
+        });
+        req.on('error', function(e) {
+          rr.resolve(String(e));
+        });
+        req.end();
+        return Interpreter.FunctionResult.Block;
+      }
+    }));
+  };
+  await runAsyncTest(t, name, src,
+                     '200 203.0.113.9,403 Forbidden,200 203.0.113.9', {
+    options: {noLog: ['net'], trustedProxies: ['127.0.0.1', '::1']},
+    onCreate: createForwardedSend,
+  });
+
+  // Run a test of a TLS listener.
+  name = 'testServerTls';
+  src = `
+      var data = '', conn = {};
+      conn.onReceive = function(d) {
+        data += d;
+      };
+      conn.onEnd = function() {
+        CC.connectionClose(this);
+        CC.connectionUnlisten(8888);
+        resolve(data);
+      };
+      CC.connectionListen(8888, conn, 0, {tls: true});
+      send();
+   `;
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'interpreter_test-'));
+  const manager = (function() {
+    const key = generateKey();
+    const certFile = path.join(dir, 'cert.pem');
+    const keyFile = path.join(dir, 'key.pem');
+    fs.writeFileSync(certFile, pem(makeCertificate({subject: 'a.test', key})));
+    fs.writeFileSync(keyFile, key.export({type: 'pkcs8', format: 'pem'}));
+    return new Certificates.Manager({
+      directory: dir, hosts: {'a.test': {certFile, keyFile}},
+      challengePort: 0, log: () => {},
+    });
+  })();
+  await manager.start();
+  function createTlsSend(intrp) {
+    intrp.wrapTls = manager.wrap.bind(manager);
+    intrp.global.createMutableBinding('send', intrp.createNativeFunction(
+        'send', function() {
+          const client = tls.connect({
+            port: 8888, servername: 'a.test', rejectUnauthorized: false,
+          }, function() {
+            client.write('foo');
+            client.end('bar');
+          });
+          client.on('data', function() {});
+        }));
+  };
+  try {
+    await runAsyncTest(t, name, src, 'foobar', {
+      options: {noLog: ['net']},
+      onCreate: createTlsSend,
+    });
+
+    // Run a test of a TLS listener with the proxy option: the PROXY
+    // protocol header precedes the TLS handshake.
+    name = 'testServerTlsProxy';
+    src = `
+        var data = '', conn = {};
+        conn.onReceive = function(d) {
+          data += d;
+        };
+        conn.onEnd = function() {
+          CC.connectionClose(this);
+          CC.connectionUnlisten(8888);
+          resolve(data);
+        };
+        CC.connectionListen(8888, conn, 0, {tls: true, proxy: true});
+        send();
+     `;
+    const createTlsProxySend = function(intrp) {
+      intrp.wrapTls = manager.wrap.bind(manager);
+      intrp.global.createMutableBinding('send', intrp.createNativeFunction(
+          'send', function() {
+            const raw = net.createConnection({port: 8888}, function() {
+              raw.write('PROXY TCP4 192.0.2.1 192.0.2.2 4321 8888\r\n');
+              const client = tls.connect({
+                socket: raw, servername: 'a.test', rejectUnauthorized: false,
+              }, function() {
+                client.write('foo');
+                client.end('bar');
+              });
+              client.on('data', function() {});
+            });
+          }));
+    };
+    await runAsyncTest(t, name, src, 'foobar', {
+      options: {noLog: ['net'], trustedProxies: ['127.0.0.1', '::1']},
+      onCreate: createTlsProxySend,
+    });
+  } finally {
+    manager.stop();
+    fs.rmSync(dir, {recursive: true});
+  }
+
+  // Check to make sure that connectionListen() throws if given
+  // invalid options.
+  name = 'testConnectionListenOptionsThrows';
+  src = `
+      // TLS has not been configured for this interpreter.
+      var options = [42, {protocol: 'udp'}, {origins: 'https://example.com'},
+                     {origins: [42]}, {tls: true}];
+      for (var i = 0; i < options.length; i++) {
+        try {
+          CC.connectionListen(8888, {}, 0, options[i]);
+          CC.connectionUnlisten(8888);
+          resolve('Unexpected success with options ' + i);
+        } catch (e) {
+          if (!(e instanceof Error)) {
+            resolve('threw non-Error value ' + String(e));
+          }
+        }
+      }
+      resolve('OK');
+   `;
+  await runAsyncTest(t, name, src, 'OK', {options: {noLog: ['net']}});
+
+  // Check to make sure that connectionListen() throws if attempting
+  // to bind to an invalid port or rebind a port already in use.
+  name = 'testConnectionListenThrows';
+  const server = new net.Server();
+  server.listen(8887);
+  src = `
+      // Some invalid ports:
+      // * 8887 is in use by the above net.Server.
+      // * 8888 will be in-use by via previous connectionListen.
+      // * Others are not integers or are out-of-range.
+      var ports = ['foo', {}, -1, 80.8, 8887, 8888, 65536];
+      try {
+        CC.connectionListen(8888, {});
+        for (var i = 0; i < ports.length; i++) {
+          try {
+            CC.connectionListen(ports[i], {});
+            resolve('Unexpected success listening on port ' + ports[i]);
+          } catch (e) {
+            if (!(e instanceof Error)) {
+              resolve('threw non-Error value ' + String(e));
+            }
+          }
+        }
+      } finally {
+        CC.connectionUnlisten(8888);
+      }
+      resolve('OK');
+   `;
+  await runAsyncTest(t, name, src, 'OK', {options: {noLog: ['net']}});
+  server.close();
+
+  // Check to make sure that connectionUnlisten() throws if attempting
+  // to unbind an invalid or not / no longer bound port.
+  name = 'testConnectionUnlistenThrows';
+  src = `
+      var ports = ['foo', {}, -1, 22, 80.8, 4567, 8888, 65536];
+      CC.connectionListen(8888, {});
+      CC.connectionUnlisten(8888, {});
+      for (var i = 0; i < ports.length; i++) {
+        try {
+          CC.connectionUnlisten(ports[i], {});
+          resolve('Unexpected success unlistening on port ' + ports[i]);
+        } catch (e) {
+          if (!(e instanceof Error)) {
+            resolve('threw non-Error value ' + String(e));
+          }
+        }
+      }
+      resolve('OK');
+   `;
+  await runAsyncTest(t, name, src, 'OK', {options: {noLog: ['net']}});
+
+  // Check to make sure that connectionWrite() throws if attempting to
+  // write anything not a string or to anything not a connected
+  // object.
+  name = 'testConnectionWriteThrows';
+  src = `
+      var conn = {toString: function() {return 'an open connection';}};
+      conn.onConnect = function() {
+        var cases = [
+          {obj: undefined, data: 'fine'},
+          {obj: null, data: 'fine'},
+          {obj: 42, data: 'fine'},
+          {obj: true, data: 'fine'},
+          {obj: 'a string', data: 'fine'},
+          {obj: {/* not connected */}, data: 'fine'},
+          {obj: this, data: undefined},
+          {obj: this, data: null},
+          {obj: this, data: 42},
+          {obj: this, data: true},
+          {obj: this, data: {}},
+        ];
+        for (var tc, i = 0; (tc = cases[i]); i++) {
+          try {
+            CC.connectionWrite(tc.obj, tc.data);
+            resolve('Unexpected success writing ' + tc.data +
+                    ' to ' + String(tc.obj));
+          } catch (e) {
+            if (!(e instanceof TypeError)) {
+              resolve('threw non-TypeError value ' + String(e));
+            }
+          }
+        }
+        CC.connectionClose(this);
+        resolve('OK');
+      };
+      CC.connectionListen(8888, conn);
+      try {
+        receive();
+      } finally {
+        CC.connectionUnlisten(8888);
+      }
+   `;
+  await runAsyncTest(t, name, src, 'OK', {
+    options: {noLog: ['net']},
+    onCreate: createReceive,
+  });
+
+  // Run a test to make sure listening sockets survive the interpreter
+  // being paused and restarted.
+  name = 'testServerPauseStart';
+  src = `
+      var data = '', conn = {};
+      conn.onReceive = function(d) {
+        data += d;
+      };
+      conn.onEnd = function() {
+        CC.connectionClose(this);
+        CC.connectionUnlisten(8888);
+        resolve(data);
+      };
+      CC.connectionListen(8888, conn);
+      pause();
+      send();
+   `;
+  function createPauseAndSend(intrp) {
+    intrp.global.createMutableBinding('pause', intrp.createNativeFunction(
+        'pause', function() {
+          intrp.pause();
+          intrp.start();
+        }));
+    createSend(intrp);
+  };
+  await runAsyncTest(t, name, src, 'foobar', {
+    options: {noLog: ['net']},
+    onCreate: createPauseAndSend
+  });
+
+  // Run a test to make sure listening sockets are re-listened after
+  // the interpreter is stopped and restarted.
+  name = 'testServerStopStart';
+  src = `
+      var data = '', conn = {};
+      conn.onReceive = function(d) {
+        data += d;
+      };
+      conn.onEnd = function() {
+        CC.connectionClose(this);
+        CC.connectionUnlisten(8888);
+        resolve(data);
+      };
+      CC.connectionListen(8888, conn);
+      stop();
+      send();
+   `;
+  function createStopAndSend(intrp) {
+    intrp.global.createMutableBinding('stop', intrp.createNativeFunction(
+        'stop', function() {
+          intrp.stop();
+          intrp.start();
+        }));
+    createSend(intrp);
+  };
+  await runAsyncTest(t, name, src, 'foobar', {
+    options: {noLog: ['net']},
+    onCreate: createStopAndSend
+  });
+
+  // Run a test of attaching connections to a player: its .onAttach
+  // and .onDetach methods are called with the number of connections
+  // it has, which may be several at once.
+  name = 'testServerPlayerBinding';
+  src = `
+      var log = [], conns = [], conn = {}, player = {};
+      player.onAttach = function(c, count) {
+        log.push('attach ' + count);
+        if (count === 2) {
+          log.push(CC.playerConnections(player).length,
+                   CC.connectionPlayer(conns[1]) === player);
+          log.push(CC.connectionDetach(conns[0]),
+                   CC.connectionDetach(conns[0]));
+          CC.connectionClose(conns[0]);
+          CC.connectionClose(conns[1]);
+        }
+      };
+      player.onDetach = function(c, remaining, reason) {
+        log.push('detach ' + remaining + ' ' + reason);
+        if (!remaining) {
+          CC.connectionUnlisten(8888);
+          resolve(log.join());
+        }
+      };
+      conn.onConnect = function() {
+        conns.push(this);
+        CC.connectionAttach(this, player);
+      };
+      CC.connectionListen(8888, conn);
+      send();
+      send();
+   `;
+  function createBindingSend(intrp) {
+    intrp.global.createMutableBinding('send', intrp.createNativeFunction(
+        'send', function() {
+          const client = net.createConnection({port: 8888});
+          client.on('data', function() {});
+          client.on('error', function() {});
+        }));
+  };
+  await runAsyncTest(t, name, src,
+      'attach 1,attach 2,2,true,true,false,detach 1 detach,' +
+      'detach 0 disconnect', {
+    options: {noLog: ['net']},
+    onCreate: createBindingSend,
+  });
+};
+
+/**
+ * Run tests of the client side of the networking subsystem (xhr, fetch
+ * and outbound connections).
+ * @param {!T} t The test runner object.
+ */
+exports.testClient = async function(t) {
+  // Run test of the xhr() function using HTTP.
+  let name = 'testXhrHttp';
+  const httpTestServer = http.createServer(function (req, res) {
+    res.writeHead(200, {'Content-Type': 'text/plain'});
+    res.end('OK HTTP: ' + req.url);
+  }).listen(9980);
+  let src = `
+      try {
+        resolve(CC.xhr('http://localhost:9980/foo'));
+      } catch (e) {
+        reject(e);
+      }
+  `;
+  await runAsyncTest(t, name, src, 'OK HTTP: /foo',
+                     {options: {noLog: ['net']}});
+  httpTestServer.close();
+
+  // Run tests of the fetch() function.
+  const fetchTestServer = http.createServer(async (req, res) => {
+    let body = '';
+    for await (const chunk of req) body += chunk;
+    if (req.url === '/slow') return;  // Never respond.
+    res.writeHead(req.url === '/missing' ? 404 : 200,
+                  {'Content-Type': 'text/plain', 'X-Test': 'yes'});
+    res.end(req.url === '/big' ? 'x'.repeat(100) :
+            req.method + ' ' + req.url + ' ' + req.headers['x-foo'] + ' ' +
+            body);
+  });
+  await new Promise((resolve) => fetchTestServer.listen(9981, resolve));
+  name = 'testFetch';
+  src = `
+      var base = 'http://localhost:9981';
+      var r = CC.fetch(base + '/foo', {method: 'post', body: 'bar',
+                                       headers: {'X-Foo': 'baz'}});
+      var result = [r.status, r.statusText, r.headers['x-test'], r.body];
+      r = CC.fetch(base + '/missing');
+      result.push(r.status);
+      function error(func) {
+        try {
+          func();
+        } catch (e) {
+          return e.name + ': ' + e.message;
+        }
+      }
+      result.push(error(function() {CC.fetch(base + '/big');}));
+      result.push(error(function() {
+        CC.fetch(base + '/slow', {timeout: 100});
+      }));
+      result.push(error(function() {CC.fetch('http://denied.test/');}));
+      result.push(error(function() {CC.fetch('ftp://localhost/');}));
+      result.push(error(function() {CC.fetch(base + '/');}));
+      resolve(result.join('\\n'));
+  `;
+  await runAsyncTest(t, name, src, [
+    '200', 'OK', 'yes', 'POST /foo baz bar',
+    '404',
+    'Error: Response too large',
+    'Error: Request timed out',
+    'PermissionError: Requests to denied.test are not permitted',
+    'SyntaxError: Unrecognized URL "ftp://localhost/"',
+    'RangeError: Too many requests; try again later',
+  ].join('\n'), {options: {noLog: ['net'], fetchMaxResponse: 50,
+                            fetchDeny: ['test'], fetchRateLimit: 4}});
+  fetchTestServer.close();
+
+  // Run a test of outbound connections, in line mode.
+  const tcpTestServer = net.createServer((socket) => {
+    socket.write('hello\r\nwor');
+    socket.once('data', (data) => {
+      socket.end('ld: ' + data + 'café\npartial');
+    });
+  });
+  await new Promise((resolve) => tcpTestServer.listen(9982, resolve));
+  name = 'testConnectionOpen';
+  src = `
+      var log = [];
+      var conn = {};
+      conn.onConnect = function() {
+        log.push('connect');
+        CC.connectionWrite(this, 'hi\\n');
+      };
+      conn.onReceive = function(line) {
+        log.push(JSON.stringify(line));
+      };
+      conn.onEnd = function() {
+        log.push('end');
+        CC.connectionClose(this);
+      };
+      conn.onClose = function() {
+        log.push('close');
+        resolve(log.join());
+      };
+      CC.connectionOpen(conn, 'localhost', 9982, {lines: true});
+  `;
+  await runAsyncTest(t, name, src,
+                     'connect,"hello","world: hi","café","partial",end,close',
+                     {options: {noLog: ['net']}});
+  tcpTestServer.close();
+
+  // Run a test of an outbound connection that is refused.
+  name = 'testConnectionOpenRefused';
+  src = `
+      var log = [];
+      var conn = {};
+      conn.onConnect = function() {
+        log.push('connect');
+      };
+      conn.onError = function(e) {
+        log.push(e.name);
+      };
+      conn.onClose = function() {
+        log.push('close');
+        resolve(log.join());
+      };
+      CC.connectionOpen(conn, 'localhost', 9983);
+  `;
+  await runAsyncTest(t, name, src, 'Error,close', {options: {noLog: ['net']}});
+
+  // Check that connectionOpen() throws on invalid arguments.
+  name = 'testConnectionOpenThrows';
+  src = `
+      var cases = [
+        [undefined, 'localhost', 9983],
+        [42, 'localhost', 9983],
+        [{}, '', 9983],
+        [{}, 42, 9983],
+        [{}, 'localhost', 0],
+        [{}, 'localhost', 65536],
+        [{}, 'localhost', 'foo'],
+        [{}, 'localhost', 9983, 42],
+      ];
+      for (var i = 0; i < cases.length; i++) {
+        try {
+          CC.connectionOpen.apply(undefined, cases[i]);
+          resolve('Unexpected success with case ' + i);
+        } catch (e) {
+          if (!(e instanceof TypeError || e instanceof RangeError)) {
+            resolve('threw unexpected value ' + String(e));
+          }
+        }
+      }
+      resolve('OK');
+  `;
+  await runAsyncTest(t, name, src, 'OK', {options: {noLog: ['net']}});
+
+  // Run tests of the mailSend() function, with a fake mailer.
+  name = 'testMailSend';
+  src = `
+      var result = [];
+      function attempt(func) {
+        try {
+          func();
+        } catch (e) {
+          return e.name + ': ' + e.message;
+        }
+      }
+      CC.mailSend({to: 'a@b.test', subject: 'Hi {{name}}', text: 'Hello',
+                   params: {name: 'Bob'}}, function(error, reply) {
+        result.push(error + ' ' + reply);
+        CC.mailSend({to: ['fail@b.test']}, function(error, reply) {
+          result.push(error.message + ' ' + reply);
+          result.push(attempt(function() {CC.mailSend({to: 'bad'});}));
+          result.push(attempt(function() {CC.mailSend({to: ['a@b.test',
+              'c@d.test', 'e@f.test']});}));
+          result.push(attempt(function() {CC.mailSend({to: 'a@b.test'});}));
+          resolve(result.join('\\n'));
+        });
+      });
+      result.push(attempt(function() {CC.mailSend('a@b.test');}));
+  `;
+  const sent = [];
+  await runAsyncTest(t, name, src, [
+    'TypeError: message must be an object',
+    'null 250 Ok',
+    'Relay said no undefined',
+    'TypeError: Invalid recipient address',
+    'RangeError: too many recipients',
+    'RangeError: Too many messages; try again later',
+  ].join('\n'), {
+    options: {noLog: ['net'], mailRateLimit: 3, mailMaxRecipients: 2},
+    onCreate: (intrp) => {
+      intrp.sendMail = (message) => {
+        if (!message.to.every((a) => a.includes('@'))) {
+          throw new TypeError('Invalid recipient address');
+        }
+        sent.push(message);
+        return message.to[0].startsWith('fail') ?
+            Promise.reject(new Error('Relay said no')) :
+            Promise.resolve('250 Ok');
+      };
+    },
+  });
+  t.expect('testMailSend message', JSON.stringify(sent[0]), JSON.stringify({
+    to: ['a@b.test'], subject: 'Hi {{name}}', text: 'Hello',
+    replyTo: undefined, params: {name: 'Bob'},
+  }));
+
+  name = 'testMailSendNotConfigured';
+  src = `
+      try {
+        CC.mailSend({to: 'a@b.test'});
+      } catch (e) {
+        resolve(e.message);
+      }
+  `;
+  await runAsyncTest(t, name, src, 'Mail is not configured');
+
+  // Run test of the xhr() function using HTTPS.
+  // TODO(cpcallen): Don't depend on external webserver.
+  name = 'testXhr';
+  src = `
+      try {
+        resolve(CC.xhr('https://neil.fraser.name/software/JS-Interpreter/' +
             'demos/async.txt'));
       } catch (e) {
         reject(e);
@@ -1573,3 +3023,775 @@ exports.testClient = async function(t) {
   `;
   await runAsyncTest(t, name, src, 'It worked!\n', {options: {noLog: ['net']}});
 };
+
+/**
+ * Run tests of Buffers.
+ * @param {!T} t The test runner object.
+ */
+exports.testBuffer = function(t) {
+  const src = `
+      var result = [];
+      function error(func) {
+        try {
+          func();
+        } catch (e) {
+          return e.name + ': ' + e.message;
+        }
+      }
+      var buf = Buffer.from('héllo');
+      result.push(buf.length, buf.toString('hex'), buf.toString('base64'));
+      result.push(Buffer.from('68c3a9', 'hex').toString());
+      result.push(Buffer.from('aMOp', 'base64').equals(buf.slice(0, 3)));
+      result.push(new Buffer([104, 105]).toString());
+      result.push(buf.at(0), buf.at(-1), buf.at(6));
+      result.push(buf.slice(-3).toString(), buf.toString('utf8', 3));
+      result.push(buf.indexOf('l'), buf.indexOf(0x6f),
+                  buf.indexOf(Buffer.from('lo')));
+      result.push(Buffer.concat([buf, Buffer.from('!')]).toString());
+      result.push(Buffer.isBuffer(buf), Buffer.isBuffer('héllo'));
+      result.push(Buffer.byteLength('héllo'), typeof buf, String(buf));
+      result.push(error(function() {Buffer.from('abc', 'hex');}));
+      result.push(error(function() {Buffer.from([256]);}));
+      result.push(error(function() {Buffer.from({});}));
+      result.push(error(function() {buf.toString('ucs2');}));
+      result.push(error(function() {Buffer.prototype.slice.call({});}));
+      result.push(error(function() {Buffer('x');}));
+      result.push(CC.crypto.hash('sha256', Buffer.from('abc')).slice(0, 8));
+      result.push(CC.crypto.hash('sha256', 'abc', 'buffer').length);
+      result.join('\n');
+  `;
+  runTest(t, 'testBuffer', src, [
+    '6', '68c3a96c6c6f', 'aMOpbGxv', 'hé', 'true', 'hi',
+    '104', '111', '',
+    'llo', 'llo',
+    '3', '5', '4',
+    'héllo!',
+    'true', 'false',
+    '6', 'object', 'héllo',
+    'SyntaxError: Invalid hex string',
+    'RangeError: Array elements must be integers from 0 to 255',
+    'TypeError: Expected a Buffer, string or array of bytes',
+    'TypeError: Unknown encoding: ucs2',
+    'TypeError: Method Buffer.prototype.slice called on incompatible ' +
+        'receiver [object Object]',
+    "TypeError: Constructor Buffer requires 'new'",
+    'ba7816bf',
+    '32',
+  ].join('\n'));
+};
+
+/**
+ * Run tests of the CC.crypto builtins.
+ * @param {!T} t The test runner object.
+ */
+exports.testCrypto = async function(t) {
+  const src = `
+      var result = [];
+      function error(func) {
+        try {
+          func();
+        } catch (e) {
+          return e.name + ': ' + e.message;
+        }
+      }
+      result.push(CC.crypto.hash('sha256', 'abc').slice(0, 8));
+      result.push(CC.crypto.hmac('sha256', 'Jefe',
+                                 'what do ya want for nothing?', 'base64'));
+      result.push(CC.crypto.pbkdf2('sha256', 'passwd', 'salt', 1, 16));
+      result.push(CC.crypto.scrypt('password', 'NaCl', 10, 8));
+      result.push(CC.crypto.equal('abc', 'abc'), CC.crypto.equal('a', 'b'));
+      result.push(CC.crypto.randomBytes(8).length);
+      result.push(error(function() {CC.crypto.hash('md5', 'abc');}));
+      result.push(error(function() {
+        CC.crypto.pbkdf2('sha256', 'p', 's', 0, 16);
+      }));
+      Thread.current().setTimeLimit(100);
+      suspend();  // Apply new time limit.
+      result.push(error(function() {
+        CC.crypto.pbkdf2('sha256', 'p', 's', 1e7, 64);
+      }));
+      resolve(result.join('\\n'));
+  `;
+  await runAsyncTest(t, 'testCrypto', src, [
+    'ba7816bf',
+    'W9zBRr9gdU5qBCQmCJV1x1oAPwidJzmDnexYuWTsOEM=',
+    '55ac046e56e3089fec1691c22544b605',
+    '27b418c674c769d1',
+    'true', 'false',
+    '16',
+    'TypeError: Unsupported algorithm md5',
+    'RangeError: iterations must be an integer from 1 to 10000000',
+    'RangeError: Thread ran too long',
+  ].join('\n'));
+
+  // Random values all come from intrp.randomBytes.
+  const randomSrc = `
+      resolve([
+        CC.crypto.randomBytes(2),
+        CC.crypto.token(3),
+        CC.crypto.uuid(),
+        CC.crypto.uuid(7).slice(14),
+        CC.crypto.randomInt(0, 1000),
+      ].join());
+  `;
+  await runAsyncTest(t, 'testCryptoRandom', randomSrc,
+      'abab,q6ur,abababab-abab-4bab-abab-abababababab,7bab-abab-abababababab,' +
+          0xabababababab % 1000, {
+    onCreate: (intrp) => {
+      intrp.randomBytes = (length) => Buffer.alloc(length, 0xab);
+    },
+  });
+};
+
+/**
+ * Run tests of CC.hrtime.
+ * @param {!T} t The test runner object.
+ */
+exports.testHrtime = async function(t) {
+  const src = `
+      var start = CC.hrtime();
+      suspend(10);
+      var elapsed = CC.hrtime() - start;
+      resolve(typeof start + ' ' + (elapsed >= 10) + ' ' + (elapsed < 1000));
+  `;
+  await runAsyncTest(t, 'testHrtime', src, 'number true true');
+
+  // CC.hrtime reads intrp.now().
+  await runAsyncTest(t, 'testHrtime (replaced clock)',
+      'resolve(CC.hrtime());', '1234.568', {
+        onCreate: (intrp) => {
+          intrp.now = () => 1234.5678;
+        },
+      });
+};
+
+/**
+ * Run tests of the CC.log* builtins.
+ * @param {!T} t The test runner object.
+ */
+exports.testLogging = async function(t) {
+  const src = `
+      var result = [];
+      function error(func) {
+        try {
+          func();
+        } catch (e) {
+          return e.name + ': ' + e.message;
+        }
+      }
+      CC.log('hello', 42, {});
+      result.push(CC.logWrite('debug', 'hidden'));
+      result.push(CC.logChannel({level: 'debug'}).level);
+      result.push(CC.logWrite('debug', 'shown', {n: 1, s: 'a b'}));
+      result.push(error(function() {CC.logWrite('fatal', 'x');}));
+      result.push(error(function() {CC.logChannel({connection: {}});}));
+      var alice = {name: 'Alice'};
+      (function() {
+        setPerms(alice);
+        result.push(CC.logChannel().level);
+        for (var i = 0; i < 4; i++) result.push(CC.logWrite('warn', 'w' + i));
+        result.push(error(function() {CC.logChannel({}, CC.root);}));
+      })();
+      resolve(result.join('\\n'));
+  `;
+  const lines = [];
+  await runAsyncTest(t, 'testLogging', src, [
+    'false',
+    'debug',
+    'true',
+    'TypeError: Unknown log level fatal',
+    'TypeError: connection must be a connected object or null',
+    'info',
+    'true', 'true', 'false', 'false',
+    'PermissionError: only root may configure the log channels of ' +
+        'other owners',
+  ].join('\n'), {
+    options: {rateLimits: {log: {limit: 2, period: 60000, lockout: 60000}}},
+    onCreate: (intrp) => {
+      intrp.log = (category, line) => lines.push(category + ': ' + line);
+    },
+  });
+  t.expect('testLogging lines', lines.join('\n'), [
+    'user: info root: hello 42 [object Object]',
+    'user: debug root: shown n=1 s="a b"',
+    'user: warn Alice: w0',
+    'user: warn Alice: w1',
+  ].join('\n'));
+};
+
+/**
+ * Run tests of the CC.compress and CC.decompress builtins.
+ * @param {!T} t The test runner object.
+ */
+exports.testCompress = async function(t) {
+  const src = `
+      var result = [];
+      function error(func) {
+        try {
+          func();
+        } catch (e) {
+          return e.name + ': ' + e.message;
+        }
+      }
+      var text = 'Code City '.repeat(100);
+      var gz = CC.compress('gzip', text);
+      result.push(Buffer.isBuffer(gz), gz.length < 100);
+      result.push(CC.decompress('gzip', gz).toString() === text);
+      result.push(CC.decompress('br', CC.compress('br', text, 9)).length);
+      result.push(CC.decompress('deflate',
+          CC.compress('deflate', 'hi').toString('base64')).toString());
+      result.push(error(function() {CC.compress('lzma', text);}));
+      result.push(error(function() {CC.decompress('gzip', gz, 10);}));
+      result.push(error(function() {CC.decompress('gzip', 'AAAA');}));
+      resolve(result.join('\\n'));
+  `;
+  await runAsyncTest(t, 'testCompress', src, [
+    'true', 'true',
+    'true',
+    '1000',
+    'hi',
+    'TypeError: Unsupported compression format lzma',
+    'RangeError: Decompressed data longer than 10 bytes',
+    'Error: Invalid gzip data',
+  ].join('\n'));
+};
+
+/**
+ * Run tests of the CC.htmlEscape and CC.htmlSanitize builtins.
+ * @param {!T} t The test runner object.
+ */
+exports.testHtml = async function(t) {
+  const src = `
+      var result = [];
+      function error(func) {
+        try {
+          func();
+        } catch (e) {
+          return e.name + ': ' + e.message;
+        }
+      }
+      result.push(CC.htmlEscape('<b title="x">&</b>'));
+      result.push(CC.htmlSanitize(
+          '<p onclick="evil()">Hi <a href="javascript:evil()">you</a>' +
+          '<script>evil()</script>'));
+      result.push(CC.htmlSanitize('<span class="c"><b>x</b></span>',
+          {elements: {span: ['class']}}));
+      result.push(error(function() {CC.htmlSanitize(42);}));
+      result.push(error(function() {CC.htmlSanitize('', 'p');}));
+      result.push(error(function() {
+        CC.htmlSanitize('', {protocols: 'http'});
+      }));
+      resolve(result.join('\\n'));
+  `;
+  await runAsyncTest(t, 'testHtml', src, [
+    '&lt;b title=&quot;x&quot;&gt;&amp;&lt;/b&gt;',
+    '<p>Hi <a>you</a></p>',
+    '<span class="c">x</span>',
+    'TypeError: html must be a string',
+    'TypeError: policy must be an object',
+    'TypeError: protocols must be an array',
+  ].join('\n'));
+};
+
+/**
+ * Run tests of the CC.markdown builtin.
+ * @param {!T} t The test runner object.
+ */
+exports.testMarkdown = async function(t) {
+  const src = `
+      var result = [];
+      function error(func) {
+        try {
+          func();
+        } catch (e) {
+          return e.name + ': ' + e.message;
+        }
+      }
+      result.push(CC.markdown('# Hi\\n\\n*You* [go](javascript:x)'));
+      result.push(CC.markdown('**a** [b](http://b.com)',
+          {elements: {p: []}}));
+      result.push(error(function() {CC.markdown(42);}));
+      result.push(error(function() {CC.markdown('', 'p');}));
+      resolve(result.join('\\n'));
+  `;
+  await runAsyncTest(t, 'testMarkdown', src, [
+    '<h1>Hi</h1>',
+    '<p><em>You</em> <a>go</a></p>',
+    '<p>a b</p>',
+    'TypeError: text must be a string',
+    'TypeError: policy must be an object',
+  ].join('\n'));
+};
+
+/**
+ * Run tests of the CC.csv* and CC.xmlTokenize builtins.
+ * @param {!T} t The test runner object.
+ */
+exports.testFormats = async function(t) {
+  const src = `
+      var result = [];
+      function error(func) {
+        try {
+          func();
+        } catch (e) {
+          return e.name + ': ' + e.message;
+        }
+      }
+      var rows = CC.csvParse('name,size\\r\\n"Hall, big",3\\r\\n');
+      result.push(JSON.stringify(rows));
+      result.push(JSON.stringify(CC.csvStringify(rows, {delimiter: ';'})));
+      result.push(error(function() {CC.csvParse('"x');}));
+      result.push(error(function() {CC.csvParse('x', {delimiter: '"'});}));
+      var r = CC.xmlTokenize('<a x="1">b &amp; c</a><d', {final: false});
+      result.push(JSON.stringify(r));
+      r = CC.xmlTokenize(r.rest + '/>', {open: r.open});
+      result.push(JSON.stringify(r.tokens));
+      result.push(JSON.stringify(CC.xmlTokenize('<P>x', {html: true}).open));
+      result.push(error(function() {CC.xmlTokenize('<a></b>');}));
+      result.push(error(function() {CC.xmlTokenize('', {open: [1]});}));
+      resolve(result.join('\\n'));
+  `;
+  await runAsyncTest(t, 'testFormats', src, [
+    '[["name","size"],["Hall, big","3"]]',
+    '"name;size\\r\\nHall, big;3\\r\\n"',
+    'SyntaxError: Unterminated quoted field in record 2',
+    'TypeError: delimiter must be a single character (other than a quote ' +
+        'or line break)',
+    '{"tokens":[{"type":"start","name":"a","attrs":{"x":"1"},' +
+        '"selfClosing":false},{"type":"text","text":"b & c"},' +
+        '{"type":"end","name":"a"}],"rest":"<d","open":[]}',
+    '[{"type":"start","name":"d","attrs":{},"selfClosing":true}]',
+    '["p"]',
+    'SyntaxError: Unexpected end tag </b>, expected </a>',
+    'TypeError: open must be an array of element names',
+  ].join('\n'));
+};
+
+/**
+ * Run tests of the CC.text* builtins.
+ * @param {!T} t The test runner object.
+ */
+exports.testText = async function(t) {
+  const src = `
+      var result = [];
+      function error(func) {
+        try {
+          func();
+        } catch (e) {
+          return e.name + ': ' + e.message;
+        }
+      }
+      var thumbs = '\\ud83d\\udc4d';
+      result.push(CC.textGraphemes('a' + thumbs + 'b').length);
+      result.push(CC.textWords('One, two three.').join('|'));
+      result.push(CC.textWidth('\\u65e5\\u672c' + thumbs + 'x'));
+      result.push('[' + CC.textPad('ab', 5, 'center') + ']');
+      result.push(CC.textTruncate('hello world', 8, '...'));
+      result.push(error(function() {CC.textWidth(42);}));
+      result.push(error(function() {CC.textPad('a', -1);}));
+      result.push(error(function() {CC.textTruncate('a', 1, {});}));
+      result.push(CC.textWrap('one two three', 7).split('\\n').join('|'));
+      result.push(CC.textStripAnsi(CC.textColor('red', 'bold red')));
+      result.push(CC.textTable([['a', 'bb'], ['ccc', 'd']],
+                               {align: ['right']}).split('\\n').join('|'));
+      result.push(CC.textColumns(['a', 'b', 'c'], 4).split('\\n').join('|'));
+      result.push(error(function() {CC.textTable([[1]]);}));
+      result.push(error(function() {CC.textColor('a', 'plaid');}));
+      resolve(result.join('\\n'));
+  `;
+  await runAsyncTest(t, 'testText', src, [
+    '3',
+    'One|two|three',
+    '7',
+    '[ ab  ]',
+    'hello...',
+    'TypeError: text must be a string',
+    'RangeError: width must be a non-negative integer',
+    'TypeError: ellipsis must be a string',
+    'one two|three',
+    'red',
+    '  a  bb|ccc  d',
+    'a  c|b',
+    'TypeError: each row must be an array of strings',
+    'TypeError: Unknown style: plaid',
+  ].join('\n'));
+};
+
+/**
+ * Run tests of the CC.blob* builtins.
+ * @param {!T} t The test runner object.
+ */
+exports.testBlobs = async function(t) {
+  const src = `
+      var result = [];
+      function error(func) {
+        try {
+          func();
+        } catch (e) {
+          return e.name + ': ' + e.message;
+        }
+      }
+      var id = CC.blobPut('hello');
+      result.push(id.slice(0, 8));
+      result.push(CC.blobPut(new Buffer([104, 105])).slice(0, 8));
+      result.push(CC.blobGet(id).toString());
+      result.push(CC.blobGet('0'.repeat(64)));
+      result.push(error(function() {CC.blobGet('nonsense');}));
+      result.push(error(function() {CC.blobPut(42);}));
+      CC.blobDelete(id);
+      result.push(CC.blobGet(id));
+      resolve(result.join('\\n'));
+  `;
+  const blobs = new Map();
+  await runAsyncTest(t, 'testBlobs', src, [
+    '2cf24dba',
+    '8f434346',
+    'hello',
+    'null',
+    'TypeError: Invalid blob ID: nonsense',
+    'TypeError: Expected a Buffer, string or array of bytes',
+    'null',
+  ].join('\n'), {
+    onCreate: (intrp) => {
+      intrp.blobs = new Blobs.Store({
+        put: async (id, data) => void blobs.set(id, data),
+        get: async (id) => blobs.get(id) || null,
+        delete: async (id) => void blobs.delete(id),
+      });
+    },
+  });
+
+  await runAsyncTest(t, 'testBlobsUnconfigured', `
+      try {
+        CC.blobGet('0'.repeat(64));
+      } catch (e) {
+        resolve(e.message);
+      }
+  `, 'Blob storage is not configured');
+};
+
+/**
+ * Run tests of the CC.debug* builtins.
+ * @param {!T} t The test runner object.
+ */
+exports.testDebugger = async function(t) {
+  const src = `
+      var result = [];
+      function error(func) {
+        try {
+          func();
+        } catch (e) {
+          return e.name + ': ' + e.message;
+        }
+      }
+      function target(x) {
+        var y = x + 1;
+        return y * 2;
+      }
+      var id = CC.debugSetBreakpoint(target, 3);
+      result.push(CC.debugBreakpoints().map(function(breakpoint) {
+        return breakpoint.line + ':' + breakpoint.hits;
+      }).join());
+      result.push(error(function() {CC.debugSetBreakpoint(Math.max, 1);}));
+      result.push(error(function() {CC.debugSetBreakpoint(target, 9);}));
+      result.push(error(function() {CC.debugResume({});}));
+      result.push(error(function() {CC.debugSetHandler(42);}));
+      CC.debugSetHandler(function(thread, reason) {
+        var frame = CC.debugFrames(thread)[0];
+        result.push(reason + ' at line ' + frame.line +
+                    ', y = ' + frame.scopes[0].vars.y);
+        CC.debugResume(thread, (reason === 'breakpoint') ? 'over' : undefined);
+      });
+      new Thread(function() {
+        result.push(target(1));
+        result.push(CC.debugBreakpoints()[0].hits);
+        CC.debugClearBreakpoint(id);
+        CC.debugSetHandler(null);
+        result.push(CC.debugBreakpoints().length);
+        resolve(result.join('\\n'));
+      });
+  `;
+  await runAsyncTest(t, 'testDebugger', src, [
+    '3:0',
+    'TypeError: Breakpoints can only be set in user functions',
+    'RangeError: No statement begins on line 9',
+    'TypeError: thread must be a Thread',
+    'TypeError: handler must be a function or null',
+    'breakpoint at line 3, y = 2',
+    'step at line 3, y = undefined',
+    '4',
+    '1',
+    '0',
+  ].join('\n'));
+};
+
+/**
+ * Run tests of the debugger's watchpoints (CC.debugSetWatchpoint et
+ * al.)
+ * @param {!T} t The test runner object.
+ */
+exports.testWatchpoints = async function(t) {
+  const src = `
+      var result = [];
+      var log = [];
+      var obj = {value: 1};
+      function error(func) {
+        try {
+          func();
+        } catch (e) {
+          return e.name + ': ' + e.message;
+        }
+      }
+      function writer() {
+        obj.value = 3;
+        return obj.value;
+      }
+      result.push(error(function() {CC.debugSetWatchpoint(42, 'value');}));
+      result.push(error(function() {
+        CC.debugSetWatchpoint(obj, 'value', 42);
+      }));
+      var id = CC.debugSetWatchpoint(obj, 'value',
+          function(o, key, oldValue, newValue, thread) {
+            log.push(key + ': ' + oldValue + ' -> ' + newValue +
+                     (thread ? ' by thread' : ''));
+            o.value = 'handler';  // Handlers don't trigger watchpoints.
+            next();
+          });
+      obj.other = 'unwatched';
+      obj.value = 2;
+
+      function next() {
+        result.push(log.join());
+        result.push(CC.debugWatchpoints()[0].hits);
+        CC.debugClearWatchpoint(id);
+        // Pause writers.  (The key is converted as by ToPropertyKey.)
+        CC.debugSetWatchpoint(obj, {toString: function() {return 'value';}});
+        CC.debugSetHandler(function(thread, reason) {
+          result.push(reason + ' at line ' + CC.debugFrames(thread)[0].line);
+          CC.debugResume(thread);
+        });
+        new Thread(function() {
+          result.push(writer());
+          CC.debugClearWatchpoint(CC.debugWatchpoints()[0].id);
+          CC.debugSetHandler(null);
+          result.push(CC.debugWatchpoints().length);
+          resolve(result.join('\\n'));
+        });
+      }
+  `;
+  await runAsyncTest(t, 'testWatchpoints', src, [
+    'TypeError: Watchpoints can only be set on objects',
+    'TypeError: handler must be a function or null',
+    'value: 1 -> 2 by thread',
+    '1',
+    'watchpoint at line 3',
+    '3',
+    '0',
+  ].join('\n'));
+};
+
+/**
+ * Run tests of property access auditing (Interpreter.prototype.audit
+ * et al.)
+ * @param {!T} t The test runner object.
+ */
+exports.testAudit = function(t) {
+  const intrp = getInterpreter();
+  intrp.createThreadForSrc(`
+      var user = {name: 'alice', password: 'secret'};
+      var other = {password: 'hunter2'};
+      var thief = {};
+  `);
+  intrp.run();
+  const user = intrp.global.get('user', intrp.ROOT);
+  const other = intrp.global.get('other', intrp.ROOT);
+  const thief = intrp.global.get('thief', intrp.ROOT);
+  intrp.audit(user, 'password');
+  intrp.audit(other);
+  t.expect('getAudits()', JSON.stringify(intrp.getAudits().map(
+      (audit) => [audit.object === user, audit.keys])),
+           JSON.stringify([[true, ['password']], [false, null]]));
+
+  intrp.createThreadForSrc(`
+      function steal() {
+        return user.password;
+      }
+      setPerms(thief);
+      var stolen = [user.name, steal(), other.password];
+      user.password = 'changed';
+      delete other.password;
+      Object.defineProperty(user, 'password', {value: 'again'});
+      Object.getOwnPropertyDescriptor(user, 'name');
+  `);
+  intrp.run();
+  const log = intrp.getAuditLog();
+  t.expect('audit log accesses',
+           log.map((r) => r.access + ' ' + r.key).join(),
+           'get password,get password,set password,delete password,' +
+           'define password');
+  const steal = intrp.global.get('steal', intrp.ROOT);
+  t.expect('audit log[0].perms', log[0].perms, steal.owner);
+  t.expect('audit log[0].object', log[0].object, user);
+  t.expect('audit log[1].perms', log[1].perms, thief);
+  t.expect('audit log[1].object', log[1].object, other);
+  t.assert('audit log[0].thread', typeof log[0].thread === 'number');
+  t.expect('audit log[0].callers[0].func', log[0].callers[0].func, steal);
+  t.expect('audit log[0].callers[0].line', log[0].callers[0].line, 2);
+  t.expect('audit log[0].callers.length', log[0].callers.length, 2);
+  t.assert('audit log times', log.every((r, i) =>
+      typeof r.time === 'number' && (i === 0 || r.time >= log[i - 1].time)));
+  t.expect('getAuditLog(other)',
+           intrp.getAuditLog(other).map((r) => r.access).join(),
+           'get,delete');
+  t.expect('getAuditLog(user, "name")',
+           intrp.getAuditLog(user, 'name').length, 0);
+
+  // Host access (outside any thread).
+  user.get('password', intrp.ROOT);
+  const last = intrp.getAuditLog().pop();
+  t.expect('host access thread', last.thread, null);
+  t.expect('host access callers', last.callers.length, 0);
+  t.expect('host access perms', last.perms, intrp.ROOT);
+
+  // Unauditing.
+  t.expect('unaudit(other, "password")', intrp.unaudit(other, 'password'),
+           false);
+  t.expect('unaudit(user, "name")', intrp.unaudit(user, 'name'), false);
+  t.expect('unaudit(user, "password")', intrp.unaudit(user, 'password'),
+           true);
+  t.expect('unaudit(other)', intrp.unaudit(other), true);
+  t.expect('getAudits() after unaudit', intrp.getAudits().length, 0);
+  const length = intrp.getAuditLog().length;
+  user.get('password', intrp.ROOT);
+  t.expect('no records after unaudit', intrp.getAuditLog().length, length);
+  intrp.clearAuditLog();
+  t.expect('clearAuditLog()', intrp.getAuditLog().length, 0);
+};
+
+/**
+ * Run tests of statement coverage (Interpreter.prototype.startCoverage
+ * et al.)
+ * @param {!T} t The test runner object.
+ */
+exports.testCoverage = function(t) {
+  const intrp = getInterpreter();
+  intrp.createThreadForSrc(`
+      var lib = {};
+      lib.abs = function(x) {
+        if (x < 0) {
+          return -x;
+        }
+        return x;
+      };
+      var other = {};
+      var result = [];
+  `);
+  intrp.run();
+  const abs = intrp.global.get('lib', intrp.ROOT).get('abs', intrp.ROOT);
+  const other = intrp.global.get('other', intrp.ROOT);
+  t.expect('getCoverage() before start', intrp.getCoverage().length, 0);
+  t.expect('isCollectingCoverage() before start',
+           intrp.isCollectingCoverage(), false);
+
+  intrp.startCoverage();
+  t.expect('isCollectingCoverage()', intrp.isCollectingCoverage(), true);
+  intrp.createThreadForSrc(`
+      lib.abs(5);
+      lib.abs(7);
+      setPerms(other);
+      result = [];
+      var f = function() {return 2;};
+      f();
+      try {
+        CC.debugCoverage(CC.root);
+      } catch (e) {
+        result.push(e.name);
+      }
+      result.push(CC.debugCoverage()[0].statements[0].hits);
+  `);
+  intrp.run();
+  const summarise = (coverage) => coverage.statements.map(
+      (s) => s.line + ':' + s.col + '=' + s.hits).join();
+  let coverage = intrp.getCoverage();
+  t.expect('getCoverage().length', coverage.length, 2);
+  t.expect('getCoverage()[0].func', coverage[0].func, abs);
+  t.expect('getCoverage()[0]', summarise(coverage[0]), '2:9=2,3:11=0,5:9=2');
+  coverage = intrp.getCoverage(other);
+  t.expect('getCoverage(other).length', coverage.length, 1);
+  t.expect('getCoverage(other)[0]', summarise(coverage[0]), '1:13=1');
+  const result = intrp.global.get('result', intrp.ROOT);
+  t.expect('CC.debugCoverage(<other owner>)', result.get('0', intrp.ROOT),
+           'PermissionError');
+  t.expect('CC.debugCoverage()[0].statements[0].hits',
+           result.get('1', intrp.ROOT), 1);
+
+  // Stopping keeps what was collected; starting again discards it.
+  intrp.stopCoverage();
+  intrp.createThreadForSrc('lib.abs(-1);');
+  intrp.run();
+  t.expect('getCoverage() after stop', summarise(intrp.getCoverage()[0]),
+           '2:9=2,3:11=0,5:9=2');
+  intrp.startCoverage();
+  intrp.createThreadForSrc('lib.abs(-1);');
+  intrp.run();
+  t.expect('getCoverage() after restart', summarise(intrp.getCoverage()[0]),
+           '2:9=1,3:11=1,5:9=0');
+  intrp.stopCoverage();
+  t.expect('getFunctionCoverage(<not executed>)',
+           summarise(intrp.getFunctionCoverage(
+               intrp.global.get('f', intrp.ROOT))),
+           '1:13=0');
+};
+
+/**
+ * Run tests of the logging of slow tasks and long scheduler pauses
+ * (Interpreter.prototype.getSlowLog).
+ * @param {!T} t The test runner object.
+ */
+exports.testSlowLog = async function(t) {
+  const intrp = getInterpreter({noLog: ['slow']});
+  intrp.createThreadForSrc(`
+      function spin(n) {
+        for (var i = 0; i < n; i++) {}
+      }
+  `);
+  intrp.run();
+  const before = intrp.getSlowLog().length;
+  intrp.options.slowTaskTime = 0;  // Disabled.
+  intrp.options.slowTaskSteps = Interpreter.SLOW_SAMPLE_INTERVAL;
+  intrp.createThreadForSrc('spin(10);');
+  intrp.run();
+  t.expect('getSlowLog() after fast task', intrp.getSlowLog().length, before);
+
+  intrp.createThreadForSrc('spin(50000);');
+  intrp.run();
+  let log = intrp.getSlowLog();
+  t.expect('getSlowLog() after slow task', log.length, before + 1);
+  const record = log[log.length - 1];
+  t.expect('slow task kind', record.kind, 'task');
+  t.assert('slow task steps',
+           record.steps >= Interpreter.SLOW_SAMPLE_INTERVAL);
+  t.assert('slow task thread', typeof record.thread === 'number');
+  t.assert('slow task samples', record.samples.length > 0 &&
+           record.samples.length <= Interpreter.SLOW_MAX_SAMPLES);
+  t.expect('slow task samples[0][0].func', record.samples[0][0].func,
+           intrp.global.get('spin', intrp.ROOT));
+  t.expect('slow task samples[0][0].line', record.samples[0][0].line, 2);
+
+  // Block the event loop, making the scheduler run late.
+  intrp.options.slowTaskSteps = 0;  // Disabled.
+  intrp.options.slowPauseTime = 50;
+  intrp.start();
+  try {
+    intrp.createThreadForSrc('spin(1);');
+    const start = Date.now();
+    while (Date.now() - start < 100) {}
+    await new Promise((resolve) => setTimeout(resolve, 10));
+    log = intrp.getSlowLog();
+    t.expect('getSlowLog() after long pause', log.length, before + 2);
+    t.expect('long pause kind', log[log.length - 1].kind, 'pause');
+    t.assert('long pause duration', log[log.length - 1].duration >= 50);
+  } finally {
+    intrp.stop();
+  }
+};
@@ -81,6 +81,38 @@ exports.testToIntegerEtc = function(t) {
   }
 };
 
+/**
+ * Unit tests for Interpreter.strictEquals, .sameValueZero and
+ * .sameValue.
+ * @param {!T} t The test runner object.
+ */
+exports.testEquality = function(t) {
+  const intrp = new Interpreter;
+  const obj = new intrp.Object;
+  const cases = [
+    // [x, y, StrictEquals(x, y), SameValueZero(x, y), SameValue(x, y)]
+    [0, 0, true, true, true],
+    [0, -0, true, true, false],
+    [-0, -0, true, true, true],
+    [NaN, NaN, false, true, true],
+    [NaN, 0, false, false, false],
+    [1, '1', false, false, false],
+    ['a', 'a', true, true, true],
+    [null, undefined, false, false, false],
+    [undefined, undefined, true, true, true],
+    [obj, obj, true, true, true],
+    [obj, new intrp.Object, false, false, false],
+  ];
+  const funcs = [Interpreter.strictEquals, Interpreter.sameValueZero,
+                 Interpreter.sameValue];
+  for (const [x, y, ...expected] of cases) {
+    for (let i = 0; i < funcs.length; i++) {
+      const name = util.format('%s(%o, %o)', funcs[i].name, x, y);
+      t.expect(name, funcs[i](x, y), expected[i]);
+    }
+  }
+};
+
 /**
  * Unit tests for Interpreter.prototype.nativeToPseudo.
  * @param {!T} t The test runner object.
@@ -0,0 +1,210 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for the checkpoint journal.
+ */
+'use strict';
+
+const crypto = require('crypto');
+const fs = require('fs');
+const Journal = require('../journal');
+const os = require('os');
+const path = require('path');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Journal.Writer and Journal.read.
+ * @param {!T} t The test runner object.
+ */
+exports.testJournalRoundtrip = function(t) {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'journal_test-'));
+  const filename = path.join(dir, 'test.0.wal');
+  const key = crypto.randomBytes(32);
+  const delta1 = [{'#': 0, 'type': 'Interpreter'}, {'#': 3, 'x': 'ü'}];
+  const effect = {'type': 'connectionWrite', 'length': 5};
+  const delta2 = [{'#': 3, 'x': 'y'}];
+  const expected = JSON.stringify([
+    {kind: Journal.Kind.DELTA, records: delta1},
+    {kind: Journal.Kind.EFFECT, records: [effect]},
+    {kind: Journal.Kind.DELTA, records: delta2},
+  ]);
+  try {
+    for (const format of ['json', 'binary']) {
+      for (const encrypt of [false, true]) {
+        const name = 'Journal roundtrip ' + format +
+            (encrypt ? ' encrypted' : '');
+        try {
+          const start = Date.now();
+          const writer = new Journal.Writer(filename, format,
+              {compression: encrypt ? 'gzip' : 'none',
+               key: encrypt ? key : null});
+          writer.appendDelta(delta1);
+          writer.appendEffect(effect);
+          writer.appendDelta(delta2);
+          writer.close();
+          const journal = Journal.read(filename, key);
+          t.expect(name, JSON.stringify(journal.entries.map(
+              (e) => ({kind: e.kind, records: e.records}))), expected);
+          t.assert(name + ' times', journal.entries.every(
+              (e) => e.time >= start && e.time <= Date.now()));
+          t.expect(name + ' torn', journal.torn, false);
+          t.assert(name + ' not plaintext',
+              fs.readFileSync(filename).includes('connectionWrite') ===
+                  !encrypt);
+        } catch (e) {
+          t.crash(name, e);
+        }
+      }
+    }
+
+    // An empty journal (e.g., after a crash just after starting one).
+    new Journal.Writer(filename, undefined, {}).close();
+    const empty = Journal.read(filename);
+    t.expect('Journal.read(/* empty */)', empty.entries.length, 0);
+    t.expect('Journal.read(/* empty */) torn', empty.torn, false);
+  } finally {
+    fs.rmSync(dir, {recursive: true});
+  }
+};
+
+/**
+ * Unit tests for reading damaged journals.
+ * @param {!T} t The test runner object.
+ */
+exports.testJournalDamaged = function(t) {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'journal_test-'));
+  const filename = path.join(dir, 'test.0.wal');
+  try {
+    const writer = new Journal.Writer(filename, 'json', {});
+    writer.appendDelta([{'#': 1, 'a': 1}]);
+    writer.appendDelta([{'#': 1, 'a': 2}]);
+    writer.close();
+    const good = fs.readFileSync(filename);
+
+    // Incomplete or damaged entries at the end are ignored.
+    const tails = {
+      'truncated payload': good.subarray(0, good.length - 3),
+      'truncated header': good.subarray(0, good.length - 20),
+      'damaged payload': Buffer.from(good),
+    };
+    tails['damaged payload'][good.length - 5] ^= 1;
+    for (const name in tails) {
+      try {
+        fs.writeFileSync(filename, tails[name]);
+        const journal = Journal.read(filename);
+        t.expect('Journal.read(/* ' + name + ' */)',
+                 JSON.stringify(journal.entries.map((e) => e.records)),
+                 '[[{"#":1,"a":1}]]');
+        t.expect('Journal.read(/* ' + name + ' */) torn', journal.torn, true);
+      } catch (e) {
+        t.crash('Journal.read(/* ' + name + ' */)', e);
+      }
+    }
+
+    // Other problems are errors.
+    const bad = {
+      'not a journal': Buffer.from('[]'),
+      'bad version': Buffer.concat(
+          [good.subarray(0, 4), Buffer.from([99]), good.subarray(5)]),
+    };
+    for (const name in bad) {
+      fs.writeFileSync(filename, bad[name]);
+      try {
+        Journal.read(filename);
+        t.fail('Journal.read(/* ' + name + ' */)', "Didn't throw.");
+      } catch (e) {
+        t.pass('Journal.read(/* ' + name + ' */)');
+      }
+    }
+    const encrypted = new Journal.Writer(filename, 'json',
+        {key: crypto.randomBytes(32)});
+    encrypted.appendDelta([{'#': 1}]);
+    encrypted.close();
+    try {
+      Journal.read(filename, crypto.randomBytes(32));
+      t.fail('Journal.read(/* wrong key */)', "Didn't throw.");
+    } catch (e) {
+      t.pass('Journal.read(/* wrong key */)');
+    }
+  } finally {
+    fs.rmSync(dir, {recursive: true});
+  }
+};
+
+/**
+ * Unit tests for Journal.copyUntil and Journal.lastDeltaTime.
+ * @param {!T} t The test runner object.
+ */
+exports.testJournalCopyUntil = function(t) {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'journal_test-'));
+  const filename = path.join(dir, 'test.0.wal');
+  const copy = path.join(dir, 'copy.0.wal');
+  const realNow = Date.now;
+  try {
+    let now = 1000;
+    Date.now = () => now;
+    const writer = new Journal.Writer(filename, 'json', {});
+    writer.appendDelta([{'#': 1, 'a': 1}]);
+    now = 2000;
+    writer.appendEffect({'type': 'connectionWrite'});
+    writer.appendDelta([{'#': 1, 'a': 2}]);
+    now = 3000;
+    writer.appendDelta([{'#': 1, 'a': 3}]);
+    writer.appendEffect({'type': 'connectionWrite'});
+    writer.close();
+    Date.now = realNow;
+    t.expect('Journal.lastDeltaTime(...)', Journal.lastDeltaTime(filename),
+             3000);
+
+    const cases = [[999, 0, ''], [1000, 1, '1'], [2500, 2, '1,2'],
+                   [Infinity, 3, '1,2,3']];
+    for (const [time, count, values] of cases) {
+      const name = 'Journal.copyUntil(..., ' + time + ')';
+      t.expect(name, Journal.copyUntil(filename, copy, time), count);
+      const journal = Journal.read(copy);
+      t.expect(name + ' values', journal.entries.filter(
+          (e) => e.kind === Journal.Kind.DELTA).map(
+              (e) => e.records[0]['a']).join(), values);
+      t.expect(name + ' torn', journal.torn, false);
+    }
+    t.expect('Journal.lastDeltaTime(/* empty */)', (() => {
+      Journal.copyUntil(filename, copy, 0);
+      return Journal.lastDeltaTime(copy);
+    })(), null);
+
+    // Version 1 journals (without times) can still be read.
+    const v1 = Buffer.from('\0CCJ\x01', 'latin1');
+    const payload = Buffer.from('[{"#":1}]');
+    const header = Buffer.alloc(13);
+    header[0] = Journal.Kind.DELTA;
+    header.writeUInt32BE(payload.length, 1);
+    crypto.createHash('sha256').update(header.subarray(0, 5)).update(payload)
+        .digest().copy(header, 5, 0, 8);
+    fs.writeFileSync(filename, Buffer.concat([v1, header, payload]));
+    const old = Journal.read(filename);
+    t.expect('Journal.read(/* version 1 */)', JSON.stringify(old.entries),
+             '[{"kind":68,"time":null,"records":[{"#":1}]}]');
+    t.expect('Journal.copyUntil(/* version 1 */)',
+             Journal.copyUntil(filename, copy, Infinity), 0);
+  } catch (e) {
+    t.crash('testJournalCopyUntil', e);
+  } finally {
+    Date.now = realNow;
+    fs.rmSync(dir, {recursive: true});
+  }
+};
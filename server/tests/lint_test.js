@@ -0,0 +1,89 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for the lint pass over user code.
+ */
+'use strict';
+
+const Lint = require('../lint');
+const {T} = require('./testing');
+
+/**
+ * Summarise warnings as 'rule@line:col' strings.
+ * @param {!Array<!Lint.Warning>} warnings The warnings.
+ * @return {string} The summary.
+ */
+function summarise(warnings) {
+  return warnings.map((w) => w.rule + '@' + w.line + ':' + w.col).join(', ');
+}
+
+/**
+ * Unit tests for Lint.check.
+ * @param {!T} t The test runner object.
+ */
+exports.testLintCheck = function(t) {
+  const isGlobal = (name) => name === '$' || name === 'user';
+  const cases = [
+    // Clean code.
+    ['var x = 1; function f(a) {return a + x + arguments.length;}', ''],
+    ['$.foo = 1; user.bar = 2; var o = {x: 1}; o.y = o.x;', ''],
+    ['try {} catch (e) {e = 1;}', ''],
+    ['function f() {return g(); function g() {}}', ''],
+    ['outer: for (;;) {break outer;}', ''],
+
+    // Unreachable code.
+    ['function f() {\n  return 1;\n  f();\n}', 'unreachable@3:3'],
+    ['while (1) {break; f(); g();}', 'unreachable@1:19'],
+    ['switch (1) {case 1: throw 0; case 2: f();}', ''],
+
+    // Assignment in condition.
+    ['var x, y; if (x = y) {}', 'assign-in-condition@1:15'],
+    ['var x, y; if ((x = y)) {}', ''],
+    ['var x, y; while (x = y) {}', 'assign-in-condition@1:18'],
+    ['var x, y; for (; x = y;) {}', 'assign-in-condition@1:18'],
+    ['var x, y; (x = y) ? 1 : 2;', 'assign-in-condition@1:12'],
+    ['var x, y; if (x === y) {}', ''],
+
+    // Use before declaration.
+    ['x = 1;\nvar x;', 'use-before-declaration@1:1'],
+    ['f(x, x); var x;', 'use-before-declaration@1:3'],
+    ['function f() {return x;} var x;', ''],  // Nested function: fine.
+    ['function f(a) {a = 1; var a;}', ''],  // Parameter: fine.
+
+    // Accidental globals.
+    ['function f() {total = 0;}', 'implicit-global@1:15'],
+    ['count++;', 'implicit-global@1:1'],
+    ['for (k in {}) {}', 'implicit-global@1:6'],
+    ['undeclared.x = 1;', ''],  // A ReferenceError, but not a global.
+  ];
+  for (const [src, expected] of cases) {
+    t.expect(`summarise(Lint.check(${JSON.stringify(src)}))`,
+             summarise(Lint.check(src, isGlobal)), expected);
+  }
+
+  const warning = Lint.check('if (a = 1) {}')[0];
+  t.expect('warning.message', warning.message,
+           'Assignment in condition (use === to compare, or wrap the ' +
+           'assignment in parentheses if it is intended)');
+  try {
+    Lint.check('if (');
+    t.fail('Lint.check(<syntax error>)', 'did not throw');
+  } catch (e) {
+    t.expect('Lint.check(<syntax error>) throws', e.name, 'SyntaxError');
+  }
+};
@@ -0,0 +1,162 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for structured logging.
+ */
+'use strict';
+
+const fs = require('fs');
+const Logging = require('../logging');
+const os = require('os');
+const path = require('path');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Logging.format.
+ * @param {!T} t The test runner object.
+ */
+exports.testLoggingFormat = function(t) {
+  t.expect('format (message only)', Logging.format('info', 'root', 'Hello'),
+           'info root: Hello');
+  t.expect('format (fields)',
+           Logging.format('warn', 'alice', 'Door jammed',
+                          {room: 'Kitchen', tries: 3, open: false, x: null}),
+           'warn alice: Door jammed room="Kitchen" tries=3 open=false x=null');
+  t.expect('format (quoting)',
+           Logging.format('error', 'bob', 'Two\nlines',
+                          {'odd key=': 'say "hi"', u: undefined}),
+           'error bob: Two\\nlines odd_key_="say \\"hi\\"" u="undefined"');
+};
+
+/**
+ * Unit tests for levels and channels.
+ * @param {!T} t The test runner object.
+ */
+exports.testLoggingLevels = function(t) {
+  const channel = Logging.defaultChannel();
+  t.expect('default level', channel.level, 'info');
+  t.expect('enabled (debug)', Logging.enabled(channel, 'debug'), false);
+  t.expect('enabled (info)', Logging.enabled(channel, 'info'), true);
+  t.expect('enabled (error)', Logging.enabled(channel, 'error'), true);
+  channel.level = 'error';
+  t.expect('enabled (warn < error)', Logging.enabled(channel, 'warn'), false);
+  t.expect('checkLevel', Logging.checkLevel('warn'), 'warn');
+  try {
+    Logging.checkLevel('fatal');
+    t.fail('checkLevel (unknown)', 'did not throw');
+  } catch (e) {
+    t.expect('checkLevel (unknown)', e.name, 'TypeError');
+  }
+};
+
+/**
+ * Unit tests for Logging.Logger.
+ * @param {!T} t The test runner object.
+ */
+exports.testLoggingLogger = function(t) {
+  const lines = [];
+  const logger = new Logging.Logger((line, level) => lines.push(line));
+  t.expect('log (info)', logger.log('net', 'info', 'Hello', {n: 1}), true);
+  t.assert('line', /^\d{4}-\d\d-\d\dT[\d:.]+Z info net: Hello n=1$/
+      .test(lines[0]));
+  t.expect('log (debug)', logger.log('net', 'debug', 'Detail'), false);
+
+  logger.setLevel('net', 'debug');
+  logger.setLevel('slow', 'error');
+  t.expect('enabled (net debug)', logger.enabled('net', 'debug'), true);
+  t.expect('enabled (slow warn)', logger.enabled('slow', 'warn'), false);
+  t.expect('enabled (admin info)', logger.enabled('admin', 'info'), true);
+  t.expect('getLevels()', JSON.stringify(logger.getLevels()),
+           '{"level":"info","subsystems":{"net":"debug","slow":"error"}}');
+  logger.setLevel('net', null);
+  logger.setLevel(null, 'warn');
+  t.expect('enabled (net info, after)', logger.enabled('net', 'info'), false);
+  t.expect('getLevels() (after)', JSON.stringify(logger.getLevels()),
+           '{"level":"warn","subsystems":{"slow":"error"}}');
+  logger.configure(undefined, {user: 'debug'});
+  t.expect('getLevels() (configured)', JSON.stringify(logger.getLevels()),
+           '{"level":"info","subsystems":{"user":"debug"}}');
+  for (const [subsystem, level] of [['net', 'fatal'], [null, null]]) {
+    let threw = false;
+    try {
+      logger.setLevel(subsystem, level);
+    } catch (e) {
+      threw = true;
+    }
+    t.assert('setLevel(' + subsystem + ', ' + level + ') throws', threw);
+  }
+};
+
+/**
+ * Unit tests for Logging.Subsystem.
+ * @param {!T} t The test runner object.
+ */
+exports.testLoggingSubsystem = function(t) {
+  const lines = [];
+  const logger = new Logging.Logger((line, level) => lines.push(line));
+  const log = new Logging.Subsystem('checkpoint', logger);
+  t.expect('info', log.info('Checkpoint %s complete.', 'a.city'), true);
+  t.assert('line', / info checkpoint: Checkpoint a\.city complete\.$/
+      .test(lines[0]), lines[0]);
+  t.expect('debug', log.debug('Detail'), false);
+  logger.setLevel('checkpoint', 'error');
+  t.expect('warn (checkpoint: error)', log.warn('Slow'), false);
+  t.expect('error', log.error('Failed: %d', 42), true);
+  t.assert('line (error)', / error checkpoint: Failed: 42$/.test(lines[1]),
+           lines[1]);
+  t.expect('lines', lines.length, 2);
+};
+
+/**
+ * Unit tests for Logging.File.
+ * @param {!T} t The test runner object.
+ */
+exports.testLoggingFile = function(t) {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'logging_test-'));
+  const filename = path.join(dir, 'server.log');
+  const read = (name) => fs.readFileSync(name, 'utf8');
+
+  // Rotation by size.
+  let file = new Logging.File(filename, {maxSize: 10, keep: 2});
+  file.write('first');
+  file.write('second');  // Would make 13 bytes: rotates first.
+  t.expect('after one rotation', read(filename), 'second\n');
+  t.expect('.1 after one rotation', read(filename + '.1'), 'first\n');
+  file.write('third');
+  file.write('fourth');
+  t.expect('.2 after three rotations', read(filename + '.2'), 'second\n');
+  t.expect('.1 after three rotations', read(filename + '.1'), 'third\n');
+  t.assert('.3 not kept', !fs.existsSync(filename + '.3'));
+  t.expect('file after three rotations', read(filename), 'fourth\n');
+
+  // Reopening, once moved aside by something else.
+  fs.renameSync(filename, filename + '.moved');
+  file.reopen();
+  file.write('fifth');
+  t.expect('file after reopen', read(filename), 'fifth\n');
+  file.close();
+
+  // Rotation by age (an interval of 0 meaning never).
+  file = new Logging.File(filename, {interval: 0.001, keep: 0});
+  const start = Date.now();
+  while (Date.now() - start < 5) {}
+  file.write('sixth');
+  t.expect('file after rotation by age', read(filename), 'sixth\n');
+  file.close();
+  fs.rmSync(dir, {recursive: true, force: true});
+};
@@ -0,0 +1,485 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for sending and receiving email.
+ */
+'use strict';
+
+const {generateKey, makeCertificate, pem} = require('./certificates_common');
+const Mail = require('../mail');
+const net = require('net');
+const {T} = require('./testing');
+const tls = require('tls');
+
+/**
+ * A fake SMTP relay, recording what it is sent.
+ */
+class FakeSmtp {
+  /**
+   * @param {{startTls: (boolean|undefined),
+   *          reject: (!Array<string>|undefined)}=} options Whether to
+   *     offer STARTTLS (and AUTH, once secure), and recipients to reject.
+   */
+  constructor(options = {}) {
+    this.options = options;
+    const key = generateKey();
+    this.cert = makeCertificate({subject: 'localhost', key});
+    this.key = key;
+    /** @type {!Array<{commands: !Array<string>, data: ?string,
+     *                 secure: boolean}>} */
+    this.sessions = [];
+    this.server = net.createServer((socket) => this.handle(socket));
+  }
+
+  /** Start listening. */
+  async start() {
+    await new Promise((resolve) => this.server.listen(0, 'localhost', resolve));
+    this.port = this.server.address().port;
+  }
+
+  /** Stop listening. */
+  stop() {
+    this.server.close();
+  }
+
+  /**
+   * Conduct an SMTP session.
+   * @param {!net.Socket} socket The connection.
+   */
+  handle(socket) {
+    const session = {commands: [], data: null, secure: false};
+    this.sessions.push(session);
+    let buffer = '';
+    let data = null;
+    const reply = (text) => socket.write(text + '\r\n');
+    const onData = (chunk) => {
+      buffer += chunk;
+      let i;
+      while ((i = buffer.indexOf('\r\n')) !== -1) {
+        const line = buffer.slice(0, i);
+        buffer = buffer.slice(i + 2);
+        if (data !== null) {
+          if (line === '.') {
+            session.data = data;
+            data = null;
+            reply('250 Ok: queued as 1');
+          } else {
+            data += line + '\r\n';
+          }
+          continue;
+        }
+        session.commands.push(line);
+        const verb = line.split(/[ :]/)[0].toUpperCase();
+        if (verb === 'EHLO') {
+          const lines = ['fake'];
+          if (this.options.startTls && !session.secure) lines.push('STARTTLS');
+          if (session.secure) lines.push('AUTH LOGIN PLAIN');
+          lines.push('8BITMIME');
+          reply(lines.map((l, j) => '250' + (j < lines.length - 1 ? '-' : ' ') +
+                          l).join('\r\n'));
+        } else if (verb === 'STARTTLS') {
+          reply('220 Ready to start TLS');
+          socket.removeListener('data', onData);
+          socket = new tls.TLSSocket(socket, {
+            isServer: true,
+            cert: pem(this.cert),
+            key: this.key.export({type: 'pkcs8', format: 'pem'}),
+          });
+          socket.on('error', () => {});
+          socket.on('secure', () => {
+            session.secure = true;
+          });
+          socket.on('data', onData);
+        } else if (verb === 'AUTH') {
+          reply('235 Authenticated');
+        } else if (verb === 'MAIL') {
+          reply('250 Ok');
+        } else if (verb === 'RCPT') {
+          const address = line.match(/<(.*)>/)[1];
+          reply((this.options.reject || []).includes(address) ?
+                '550 No such user' : '250 Ok');
+        } else if (verb === 'DATA') {
+          data = '';
+          reply('354 End data with <CR><LF>.<CR><LF>');
+        } else if (verb === 'QUIT') {
+          reply('221 Bye');
+          socket.end();
+        } else {
+          reply('500 Unrecognized command');
+        }
+      }
+    };
+    socket.on('data', onData);
+    socket.on('error', () => {});
+    reply('220 fake ESMTP');
+  }
+}
+
+/**
+ * Unit tests for Mail.isAddress.
+ * @param {!T} t The test runner object.
+ */
+exports.testMailIsAddress = function(t) {
+  const cases = [
+    ['a@b.test', true],
+    ['first.last+tag@mail.b.test', true],
+    ['a@b.test\r\nBcc: c@d.test', false],
+    ['a@b.test>', false],
+    ['<a@b.test', false],
+    ['a b@c.test', false],
+    ['a@b@c.test', false],
+    ['a.test', false],
+    [42, false],
+  ];
+  for (const [address, expected] of cases) {
+    t.expect('Mail.isAddress(' + JSON.stringify(address) + ')',
+             Mail.isAddress(address), expected);
+  }
+};
+
+/**
+ * Unit tests for Mail.render.
+ * @param {!T} t The test runner object.
+ */
+exports.testMailRender = function(t) {
+  t.expect('Mail.render(...)',
+           Mail.render('Hi {{name}}, code {{ code }}{{missing}}.',
+                       {name: 'Bob', code: 42}),
+           'Hi Bob, code 42.');
+  t.expect('Mail.render(<inherited name>)',
+           Mail.render('{{toString}}', {}), '');
+};
+
+/**
+ * Unit tests for Mail.format.
+ * @param {!T} t The test runner object.
+ */
+exports.testMailFormat = function(t) {
+  const text = 'Line one\nLine two: ' + 'x'.repeat(100) + ' café';
+  const message = Mail.format(
+      {to: ['a@b.test', 'c@d.test'], subject: 'Café', text,
+       replyTo: 'e@f.test'},
+      '"City" <city@c.test>', new Date(Date.UTC(2020, 10, 14, 12)),
+      '123@c.test');
+  const [head, body] = message.split('\r\n\r\n');
+  t.expect('Mail.format(...) headers', head, [
+    'From: "City" <city@c.test>',
+    'To: a@b.test, c@d.test',
+    'Reply-To: e@f.test',
+    'Subject: =?UTF-8?B?Q2Fmw6k=?=',
+    'Date: Sat, 14 Nov 2020 12:00:00 GMT',
+    'Message-ID: <123@c.test>',
+    'MIME-Version: 1.0',
+    'Content-Type: text/plain; charset=utf-8',
+    'Content-Transfer-Encoding: base64',
+  ].join('\r\n'));
+  t.assert('Mail.format(...) body line length',
+           body.split('\r\n').every((line) => line.length <= 76));
+  t.expect('Mail.format(...) body',
+           Buffer.from(body.replace(/\r\n/g, ''), 'base64').toString(),
+           text.replace(/\n/g, '\r\n'));
+};
+
+/**
+ * Unit tests for Mail.deliver.
+ * @param {!T} t The test runner object.
+ */
+exports.testMailDeliver = async function(t) {
+  const smtp = new FakeSmtp({reject: ['nobody@b.test']});
+  await smtp.start();
+  const options = {host: 'localhost', port: smtp.port, name: 'city.test'};
+  try {
+    const reply = await Mail.deliver(options, 'city@c.test',
+                                     ['a@b.test', 'c@d.test'],
+                                     'Subject: Hi\r\n\r\n.leading dot\r\n');
+    t.expect('Mail.deliver(...) reply', reply, '250 Ok: queued as 1');
+    const session = smtp.sessions[0];
+    t.expect('Mail.deliver(...) commands', session.commands.join('\n'), [
+      'EHLO city.test',
+      'MAIL FROM:<city@c.test>',
+      'RCPT TO:<a@b.test>',
+      'RCPT TO:<c@d.test>',
+      'DATA',
+    ].join('\n'));
+    t.expect('Mail.deliver(...) data (dot-stuffed)', session.data,
+             'Subject: Hi\r\n\r\n..leading dot\r\n');
+
+    try {
+      await Mail.deliver(options, 'city@c.test', ['nobody@b.test'], 'Hi');
+      t.fail('Mail.deliver(<rejected recipient>)', 'Did not reject');
+    } catch (e) {
+      t.expect('Mail.deliver(<rejected recipient>) rejects', e.message,
+               'SMTP RCPT failed: 550 No such user');
+    }
+
+    // Credentials must not be sent in the clear.
+    try {
+      await Mail.deliver(Object.assign({user: 'u', password: 'p'}, options),
+                         'city@c.test', ['a@b.test'], 'Hi');
+      t.fail('Mail.deliver(<insecure auth>)', 'Did not reject');
+    } catch (e) {
+      t.expect('Mail.deliver(<insecure auth>) rejects', e.message,
+               'Refusing to send SMTP credentials without TLS');
+    }
+    t.assert('Mail.deliver(<insecure auth>) sent no credentials',
+             !smtp.sessions[2].commands.some((c) => c.startsWith('AUTH')));
+
+    // Nothing is listening on this port.
+    smtp.stop();
+    try {
+      await Mail.deliver(options, 'city@c.test', ['a@b.test'], 'Hi');
+      t.fail('Mail.deliver(<refused>)', 'Did not reject');
+    } catch (e) {
+      t.expect('Mail.deliver(<refused>) rejects', e.code, 'ECONNREFUSED');
+    }
+  } finally {
+    smtp.stop();
+  }
+};
+
+/**
+ * Unit tests for Mail.Mailer, using STARTTLS and AUTH.
+ * @param {!T} t The test runner object.
+ */
+exports.testMailMailer = async function(t) {
+  const smtp = new FakeSmtp({startTls: true});
+  await smtp.start();
+  const mailer = new Mail.Mailer({
+    host: 'localhost',
+    port: smtp.port,
+    user: 'user',
+    password: 'secret',
+    from: 'city@c.test',
+    fromName: 'Code City',
+    tls: {ca: pem(smtp.cert)},
+  });
+  try {
+    t.assert('Mailer.p.send(<bad address>) throws', (() => {
+      try {
+        mailer.send({to: ['a@b.test\r\nRCPT TO:<c@d.test>'], subject: '',
+                     text: ''});
+      } catch (e) {
+        return e instanceof TypeError;
+      }
+      return false;
+    })());
+    await mailer.send({to: ['a@b.test'], subject: 'Welcome, {{name}}',
+                       text: 'Your code is {{code}}.',
+                       params: {name: 'Bob', code: 1234}});
+    const session = smtp.sessions[0];
+    t.expect('Mailer.p.send(...) secure', session.secure, true);
+    t.expect('Mailer.p.send(...) commands',
+             session.commands.map((c) => c.split(' ')[0]).join(),
+             'EHLO,STARTTLS,EHLO,AUTH,MAIL,RCPT,DATA');
+    t.expect('Mailer.p.send(...) AUTH', session.commands[3],
+             'AUTH PLAIN ' + Buffer.from('\0user\0secret').toString('base64'));
+    const [head, body] = session.data.split('\r\n\r\n');
+    const headers = head.split('\r\n');
+    t.expect('Mailer.p.send(...) From', headers[0],
+             'From: "Code City" <city@c.test>');
+    t.expect('Mailer.p.send(...) Subject', headers[2],
+             'Subject: Welcome, Bob');
+    t.assert('Mailer.p.send(...) Message-ID',
+             /^Message-ID: <[0-9a-f]{32}@c\.test>$/.test(headers[4]));
+    t.expect('Mailer.p.send(...) body',
+             Buffer.from(body, 'base64').toString(), 'Your code is 1234.');
+  } finally {
+    smtp.stop();
+  }
+};
+
+/**
+ * Start a server receiving mail with Mail.receive.
+ * @param {!Object=} options Options for Mail.receive (other than name).
+ * @return {!Promise<{server: !net.Server,
+ *                    messages: !Array<{envelope: !Mail.Envelope,
+ *                                      data: string}>}>}
+ */
+async function receiver(options = {}) {
+  const messages = [];
+  const server = net.createServer((socket) => {
+    socket.on('error', () => {});
+    Mail.receive(socket, Object.assign(
+        {name: 'city.test', maxSize: 1000, maxRecipients: 2}, options),
+        (envelope, data) => messages.push({envelope, data: String(data)}));
+  });
+  await new Promise((resolve) => server.listen(0, 'localhost', resolve));
+  return {server, messages};
+}
+
+/**
+ * Conduct an SMTP session by sending some lines, one at a time, and
+ * collecting the server's replies.
+ * @param {number} port The server's port.
+ * @param {!Array<string>} lines Lines to send (without CRLF), each
+ *     (except in DATA) eliciting a reply.
+ * @return {!Promise<!Array<string>>} The first line of each reply
+ *     (including the greeting).
+ */
+function converse(port, lines) {
+  return new Promise((resolve, reject) => {
+    const replies = [];
+    let buffer = '';
+    const socket = net.connect({port, host: 'localhost'});
+    socket.on('data', (data) => {
+      buffer += data;
+      let i;
+      while ((i = buffer.indexOf('\r\n')) !== -1) {
+        const line = buffer.slice(0, i);
+        buffer = buffer.slice(i + 2);
+        if (line[3] === '-') continue;
+        replies.push(line);
+        if (replies.length > lines.length) {
+          socket.end();
+          resolve(replies);
+        } else {
+          socket.write(lines[replies.length - 1] + '\r\n');
+        }
+      }
+    });
+    socket.on('error', reject);
+  });
+}
+
+/**
+ * Unit tests for Mail.receive.
+ * @param {!T} t The test runner object.
+ */
+exports.testMailReceive = async function(t) {
+  const {server, messages} = await receiver();
+  const port = server.address().port;
+  try {
+    const reply = await Mail.deliver({host: 'localhost', port},
+                                     'a@b.test', ['bot@city.test'],
+                                     'Subject: Hi\r\n\r\n.dot\r\nend\r\n');
+    t.expect('Mail.receive(...) reply', reply, '250 2.0.0 OK');
+    t.expect('Mail.receive(...) envelope', JSON.stringify(messages[0].envelope),
+             '{"from":"a@b.test","to":["bot@city.test"],"secure":false}');
+    t.expect('Mail.receive(...) data', messages[0].data,
+             'Subject: Hi\r\n\r\n.dot\r\nend\r\n');
+
+    const replies = await converse(port, [
+      'MAIL FROM:<a@b.test>',
+      'EHLO client.test',
+      'RCPT TO:<bot@city.test>',
+      'MAIL FROM:<a@b.test> SIZE=5000',
+      'MAIL FROM:<a@b.test>',
+      'RCPT TO:<bad address@city.test>',
+      'DATA',
+      'RCPT TO:<a@city.test>',
+      'RCPT TO:<b@city.test>',
+      'RCPT TO:<c@city.test>',
+      'DATA',
+      'x'.repeat(1000) + '\r\n.',
+      'STARTTLS',
+      'FOO',
+      'QUIT',
+    ]);
+    t.expect('Mail.receive(...) replies', replies.map((r) => r.slice(0, 3))
+             .join(), '220,503,250,503,552,250,501,503,250,250,452,354,552,' +
+             '502,502,221');
+    t.expect('Mail.receive(<too big>) not delivered', messages.length, 1);
+  } finally {
+    server.close();
+  }
+};
+
+/**
+ * Unit tests for Mail.receive, using STARTTLS.
+ * @param {!T} t The test runner object.
+ */
+exports.testMailReceiveStartTls = async function(t) {
+  const key = generateKey();
+  const cert = makeCertificate({subject: 'localhost', key});
+  const {server, messages} = await receiver({
+    startTls: (socket) => new tls.TLSSocket(socket, {
+      isServer: true,
+      cert: pem(cert),
+      key: key.export({type: 'pkcs8', format: 'pem'}),
+    }),
+  });
+  try {
+    await Mail.deliver({host: 'localhost', port: server.address().port,
+                        tls: {ca: pem(cert)}},
+                       'a@b.test', ['bot@city.test'], 'Subject: Hi\r\n\r\n');
+    t.expect('Mail.receive(<STARTTLS>) secure', messages[0].envelope.secure,
+             true);
+  } finally {
+    server.close();
+  }
+};
+
+/**
+ * Unit tests for Mail.parse and Mail.decodeHeader.
+ * @param {!T} t The test runner object.
+ */
+exports.testMailParse = function(t) {
+  t.expect('Mail.decodeHeader(<B>)',
+           Mail.decodeHeader('=?UTF-8?B?Q2Fmw6k=?= ok'), 'Café ok');
+  t.expect('Mail.decodeHeader(<adjacent Q>)',
+           Mail.decodeHeader('=?iso-8859-1?q?caf=E9_au?= =?utf-8?Q?_lait?='),
+           'café au lait');
+
+  let parsed = Mail.parse(Buffer.from([
+    'From: Bob <bob@b.test>',
+    'Subject: A long',
+    ' folded subject',
+    'Subject: second',
+    'Content-Type: text/plain; charset="utf-8"',
+    'Content-Transfer-Encoding: quoted-printable',
+    '',
+    'Caf=C3=A9 is a lo=',
+    'ng line.',
+  ].join('\r\n')));
+  t.expect('Mail.parse(...).from', parsed.from, 'Bob <bob@b.test>');
+  t.expect('Mail.parse(...).subject', parsed.subject,
+           'A long folded subject');
+  t.expect('Mail.parse(...).text', parsed.text, 'Café is a long line.');
+  t.expect('Mail.parse(...).headers', Object.keys(parsed.headers).join(),
+           'from,subject,content-type,content-transfer-encoding');
+
+  parsed = Mail.parse(Buffer.from([
+    'Subject: =?UTF-8?B?8J+QrQ==?=',
+    'Content-Type: multipart/mixed; boundary=outer',
+    '',
+    'Preamble.',
+    '--outer',
+    'Content-Type: multipart/alternative; boundary="in ner"',
+    '',
+    '--in ner',
+    'Content-Type: text/html',
+    '',
+    '<p>HTML</p>',
+    '--in ner',
+    'Content-Type: text/plain; charset=utf-8',
+    'Content-Transfer-Encoding: base64',
+    '',
+    Buffer.from('Plain\r\ntext').toString('base64'),
+    '--in ner--',
+    '--outer',
+    'Content-Type: text/plain',
+    '',
+    'Attachment',
+    '--outer--',
+  ].join('\r\n')));
+  t.expect('Mail.parse(<multipart>).subject', parsed.subject, '🐭');
+  t.expect('Mail.parse(<multipart>).text', parsed.text, 'Plain\ntext');
+
+  parsed = Mail.parse(Buffer.from('Content-Type: image/png\r\n\r\nPNG'));
+  t.expect('Mail.parse(<no text>).text', parsed.text, '');
+};
@@ -0,0 +1,137 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for Markdown rendering.
+ */
+'use strict';
+
+const Markdown = require('../markdown');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for block structure.
+ * @param {!T} t The test runner object.
+ */
+exports.testMarkdownBlocks = function(t) {
+  const cases = [
+    ['Para one\ncontinued.\n\nPara two.',
+     '<p>Para one\ncontinued.</p>\n<p>Para two.</p>'],
+    ['# One\n## Two ##\n###### Six\n####### Seven\n#NotHeading',
+     '<h1>One</h1>\n<h2>Two</h2>\n<h6>Six</h6>\n' +
+         '<p>####### Seven\n#NotHeading</p>'],
+    ['Setext\n===\nAlso\n---', '<h1>Setext</h1>\n<h2>Also</h2>'],
+    ['a\n\n***\n- - -', '<p>a</p>\n<hr>\n<hr>'],
+    ['```js\nif (a < b) {\n\n}\n```\n\n    indented\n\tcode',
+     '<pre><code>if (a &lt; b) {\n\n}\n</code></pre>\n' +
+         '<pre><code>indented\ncode\n</code></pre>'],
+    ['~~~\nunclosed', '<pre><code>unclosed\n</code></pre>'],
+    ['> quoted\nlazy\n>\n> > nested',
+     '<blockquote>\n<p>quoted\nlazy</p>\n<blockquote>\n<p>nested</p>\n' +
+         '</blockquote>\n</blockquote>'],
+    ['- a\n- b\n  - c\n\n+ d',
+     '<ul>\n<li>a</li>\n<li>b\n<ul>\n<li>c</li>\n</ul></li>\n</ul>\n' +
+         '<ul>\n<li>d</li>\n</ul>'],
+    ['1. a\n\n2. b\n\n   more', '<ol>\n<li><p>a</p></li>\n<li><p>b</p>\n' +
+         '<p>more</p></li>\n</ol>'],
+    ['7) seven\n8) eight', '<ol start="7">\n<li>seven</li>\n' +
+         '<li>eight</li>\n</ol>'],
+    ['text\n2. not a list', '<p>text\n2. not a list</p>'],
+    ['<div>\n*raw*\n</div>\n\n*md*',
+     '<div>\n*raw*\n</div>\n<p><em>md</em></p>'],
+  ];
+  for (const [md, expected] of cases) {
+    t.expect('toHtml(' + JSON.stringify(md) + ')', Markdown.toHtml(md),
+             expected);
+  }
+  const deep = '>'.repeat(Markdown.MAX_DEPTH + 5) + ' x';
+  t.expect('toHtml(<deep quotes>)', Markdown.toHtml(deep),
+           '<blockquote>\n'.repeat(Markdown.MAX_DEPTH) + '<p>&gt;&gt;&gt;' +
+           '&gt;&gt; x</p>' + '\n</blockquote>'.repeat(Markdown.MAX_DEPTH));
+};
+
+/**
+ * Unit tests for inline content.
+ * @param {!T} t The test runner object.
+ */
+exports.testMarkdownInline = function(t) {
+  const cases = [
+    ['*em* _em_ **strong** __strong__ ***both***',
+     '<p><em>em</em> <em>em</em> <strong>strong</strong> ' +
+         '<strong>strong</strong> <em><strong>both</strong></em></p>'],
+    ['*foo**bar**baz* snake_case_name * not em *',
+     '<p><em>foo<strong>bar</strong>baz</em> snake_case_name ' +
+         '* not em *</p>'],
+    ['`a <b>` `` c ` d `` `unclosed',
+     '<p><code>a &lt;b&gt;</code> <code>c ` d</code> `unclosed</p>'],
+    ['\\*not em\\* &copy; & a < b',
+     '<p>*not em* &copy; &amp; a &lt; b</p>'],
+    ['hard  \nbreak\\\nagain', '<p>hard<br>\nbreak<br>\nagain</p>'],
+    ['[a](http://x.com/?q=1&r=2 "T") [b](<c d>) [c]',
+     '<p><a href="http://x.com/?q=1&amp;r=2" title="T">a</a> ' +
+         '<a href="c d">b</a> [c]</p>'],
+    ['![alt *em*](/i.png)', '<p><img src="/i.png" alt="alt em"></p>'],
+    ['[r] [text][R] [r][]\n\n[r]: http://r.com \'Ref\'',
+     '<p><a href="http://r.com" title="Ref">r</a> ' +
+         '<a href="http://r.com" title="Ref">text</a> ' +
+         '<a href="http://r.com" title="Ref">r</a></p>'],
+    ['<http://a.com/x> <me@example.com>',
+     '<p><a href="http://a.com/x">http://a.com/x</a> ' +
+         '<a href="mailto:me@example.com">me@example.com</a></p>'],
+  ];
+  for (const [md, expected] of cases) {
+    t.expect('toHtml(' + JSON.stringify(md) + ')', Markdown.toHtml(md),
+             expected);
+  }
+};
+
+/**
+ * Unit tests for sanitizing and limits.
+ * @param {!T} t The test runner object.
+ */
+exports.testMarkdownSafety = function(t) {
+  const cases = [
+    ['[x](javascript:alert(1))', '<p><a>x</a></p>'],
+    ['<script>alert(1)</script>', ''],
+    ['a <b onclick="x()">b</b> <!-- c -->', '<p>a <b>b</b> </p>'],
+    ['![x](data:text/html,evil)', '<p><img alt="x"></p>'],
+    ['```"><script>\nx\n```', '<pre><code>x\n</code></pre>'],
+  ];
+  for (const [md, expected] of cases) {
+    t.expect('toHtml(' + JSON.stringify(md) + ')', Markdown.toHtml(md),
+             expected);
+  }
+  const policy = {elements: {'p': [], 'code': ['class'], 'pre': []},
+                  protocols: []};
+  t.expect('toHtml(..., policy)',
+           Markdown.toHtml('*a* [b](http://b)\n\n```js\nc\n```', policy),
+           '<p>a b</p>\n<pre><code class="language-js">c\n</code></pre>');
+
+  for (const [name, md, message] of [
+    ['too long', 'x'.repeat(Markdown.MAX_LENGTH + 1), 'Markdown too long'],
+    ['references',
+     '[r]: http://' + 'x'.repeat(10000) + '\n\n' + '[r] '.repeat(1000),
+     'Rendered HTML too long'],
+  ]) {
+    try {
+      Markdown.toHtml(md);
+      t.fail('toHtml(<' + name + '>)', 'did not throw');
+    } catch (e) {
+      t.expect('toHtml(<' + name + '>)', e.message, message);
+    }
+  }
+};
@@ -0,0 +1,182 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for monitoring metrics.
+ */
+'use strict';
+
+const http = require('http');
+const {getInterpreter} = require('./interpreter_common');
+const Metrics = require('../metrics');
+const net = require('net');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Metrics.Registry and the metric types.
+ * @param {!T} t The test runner object.
+ */
+exports.testMetricsRegistry = function(t) {
+  const registry = new Metrics.Registry();
+  const requests = registry.counter('test_requests_total',
+      'Requests\nreceived (by "path").', ['path']);
+  const temperature = registry.gauge('test_temperature', 'Temperature.');
+  const duration = registry.histogram('test_duration_seconds', 'Duration.',
+                                      [0.1, 1]);
+  let collected = 0;
+  registry.collect(() => temperature.set(++collected * 10));
+  registry.collect(() => {throw new Error('Should be ignored');});
+
+  requests.inc(undefined, {path: '/'});
+  requests.inc(2, {path: '/a"b\\c'});
+  requests.inc(undefined, {path: '/'});
+  for (const value of [0.05, 0.5, 0.5, 7]) duration.observe(value);
+  const error = console.error;
+  console.error = () => {};
+  try {
+    t.expect('format()', registry.format(), [
+      '# HELP test_requests_total Requests\\nreceived (by "path").',
+      '# TYPE test_requests_total counter',
+      'test_requests_total{path="/"} 2',
+      'test_requests_total{path="/a\\"b\\\\c"} 2',
+      '# HELP test_temperature Temperature.',
+      '# TYPE test_temperature gauge',
+      'test_temperature 10',
+      '# HELP test_duration_seconds Duration.',
+      '# TYPE test_duration_seconds histogram',
+      'test_duration_seconds_bucket{le="0.1"} 1',
+      'test_duration_seconds_bucket{le="1"} 3',
+      'test_duration_seconds_bucket{le="+Inf"} 4',
+      'test_duration_seconds_sum 8.05',
+      'test_duration_seconds_count 4',
+      '',
+    ].join('\n'));
+  } finally {
+    console.error = error;
+  }
+
+  const latency = new Metrics.Histogram('test_latency_seconds', 'Latency.',
+                                        [1], ['port']);
+  latency.observe(2, {port: 7777});
+  t.expect('Histogram with labels', latency.format().split('\n')[2],
+           'test_latency_seconds_bucket{port="7777",le="1"} 0');
+
+  const invalid = [
+    ['counter with invalid name', () => registry.counter('1x', '')],
+    ['duplicate metric', () => registry.gauge('test_temperature', '')],
+    ['reserved label', () => registry.gauge('test_g', '', ['le'])],
+    ['missing label', () => requests.inc()],
+    ['decreasing counter', () => requests.inc(-1, {path: '/'})],
+    ['unordered buckets', () => new Metrics.Histogram('test_h', '', [2, 1])],
+  ];
+  for (const [name, func] of invalid) {
+    try {
+      func();
+      t.fail(name, "Didn't throw.");
+    } catch (e) {
+      t.pass(name);
+    }
+  }
+};
+
+/**
+ * Make an HTTP request.
+ * @param {number} port The port to connect to.
+ * @param {string} method The request method.
+ * @param {string} path The request path.
+ * @return {!Promise<{status: number, type: string, body: string}>}
+ */
+function request(port, method, path) {
+  return new Promise((resolve, reject) => {
+    const req = http.request({host: '127.0.0.1', port, method, path}, (res) => {
+      let body = '';
+      res.setEncoding('utf8');
+      res.on('data', (data) => body += data);
+      res.on('end', () => resolve({
+        status: res.statusCode,
+        type: res.headers['content-type'],
+        body,
+      }));
+    });
+    req.on('error', reject);
+    req.end();
+  });
+}
+
+/**
+ * Unit tests for Metrics.Server.
+ * @param {!T} t The test runner object.
+ */
+exports.testMetricsServer = async function(t) {
+  const registry = new Metrics.Registry();
+  registry.counter('test_scrapes_total', 'Scrapes.').inc();
+  const server = new Metrics.Server(registry);
+  const port = await server.listen(0, '127.0.0.1');
+  try {
+    let r = await request(port, 'GET', '/metrics');
+    t.expect('GET /metrics status', r.status, 200);
+    t.expect('GET /metrics Content-Type', r.type, Metrics.CONTENT_TYPE);
+    t.expect('GET /metrics body', r.body.split('\n')[2],
+             'test_scrapes_total 1');
+    r = await request(port, 'POST', '/metrics');
+    t.expect('POST /metrics status', r.status, 405);
+    r = await request(port, 'GET', '/other');
+    t.expect('GET /other status', r.status, 404);
+  } finally {
+    await server.close();
+  }
+};
+
+/**
+ * Unit tests for the interpreter's counts and Interpreter.getTraffic.
+ * @param {!T} t The test runner object.
+ */
+exports.testInterpreterTraffic = async function(t) {
+  const intrp = getInterpreter({noLog: ['net']});
+  const threads = intrp.counts.threads;
+  intrp.createThreadForSrc(`
+      var conn = {};
+      conn.onReceive = function(data) {
+        CC.connectionWrite(this, data.toUpperCase());
+        CC.connectionClose(this);
+      };
+      CC.connectionListen(8888, conn);
+  `);
+  intrp.start();
+  try {
+    const reply = await new Promise((resolve, reject) => {
+      let data = '';
+      const client = net.createConnection({port: 8888}, () => {
+        client.write('hello');
+      });
+      client.setEncoding('utf8');
+      client.on('data', (d) => data += d);
+      client.on('close', () => resolve(data));
+      client.on('error', reject);
+    });
+    t.expect('reply', reply, 'HELLO');
+    await new Promise((resolve) => setTimeout(resolve, 20));
+    t.expect('getTraffic()', JSON.stringify(intrp.getTraffic()),
+             JSON.stringify([{port: 8888, accepted: 1, open: 0, bytesRead: 5,
+                              bytesWritten: 5}]));
+    t.assert('counts.steps', intrp.counts.steps > 0);
+    // One thread for the program, and one for .onReceive.
+    t.expect('counts.threads', intrp.counts.threads - threads, 2);
+  } finally {
+    intrp.stop();
+  }
+};
@@ -0,0 +1,177 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for checkpoint migration.
+ */
+'use strict';
+
+const Interpreter = require('../interpreter');
+const Migrate = require('../migrate');
+const Serializer = require('../serialize');
+const {T} = require('./testing');
+
+/**
+ * Pass records through a Migrator and return the result.
+ * @param {!Array<!Object>} records Records to migrate.
+ * @param {number=} target Version to migrate to.
+ * @param {!Object<number,!Migrate.Migration>=} migrations
+ * @return {{version: (number|undefined), records: !Array<!Object>}}
+ */
+function migrate(records, target, migrations) {
+  const out = [];
+  const migrator = new Migrate.Migrator((r) => out.push(r), target,
+                                        migrations);
+  for (const record of records) {
+    migrator.add(record);
+  }
+  migrator.finish();
+  return {version: migrator.version, records: out};
+}
+
+/**
+ * Unit tests for Migrate.Migrator.
+ * @param {!T} t The test runner object.
+ */
+exports.testMigrator = function(t) {
+  const migrations = {
+    1: {description: 'Rename Foo to Bar', migrate: function(record) {
+      if (record['type'] === 'Foo') record['type'] = 'Bar';
+    }},
+    2: {description: 'Add baz', migrate: function(record) {
+      if (record['type'] === 'Bar') record['baz'] = true;
+    }},
+  };
+  const old = function(version) {
+    const props = (version === undefined) ? {} :
+        {'serializationVersion': version};
+    // Record for object #0 need not be first.
+    return [{'#': 1, 'type': 'Foo'},
+            {'#': 0, 'type': 'Interpreter', 'props': props},
+            {'#': 2, 'type': 'Object'}];
+  };
+
+  let result = migrate(old(1), 3, migrations);
+  t.expect('Migrator 1 -> 3 version', result.version, 1);
+  t.expect('Migrator 1 -> 3', JSON.stringify(result.records), JSON.stringify([
+    {'#': 0, 'type': 'Interpreter', 'props': {'serializationVersion': 3}},
+    {'#': 1, 'type': 'Bar', 'baz': true},
+    {'#': 2, 'type': 'Object'},
+  ]));
+  result = migrate(old(2), 3, migrations);
+  t.expect('Migrator 2 -> 3', JSON.stringify(result.records[1]),
+           '{"#":1,"type":"Foo"}');
+  result = migrate(old(3), 3, migrations);
+  t.expect('Migrator 3 -> 3', JSON.stringify(result.records[0]['props']),
+           '{"serializationVersion":3}');
+  // Records identified by position.
+  result = migrate([{'type': 'Interpreter', 'props': {}}, {'type': 'Foo'}],
+                   2, {0: migrations[1], 1: migrations[1]});
+  t.expect('Migrator 0 -> 2 version', result.version, 0);
+  t.expect('Migrator 0 -> 2', result.records[1]['type'], 'Bar');
+
+  const bad = {
+    'newer version': [old(4), 3],
+    'missing migration': [old(undefined), 3],
+    'no interpreter record': [[{'#': 1, 'type': 'Foo'}], 3],
+  };
+  for (const name in bad) {
+    try {
+      migrate(bad[name][0], bad[name][1], migrations);
+      t.fail('Migrator(/* ' + name + ' */)', "Didn't throw.");
+    } catch (e) {
+      t.pass('Migrator(/* ' + name + ' */)');
+    }
+  }
+};
+
+/**
+ * Unit tests for the registered migrations: a serialization that
+ * appears to have been saved by each earlier version for which there
+ * is a chain of migrations should be loadable.
+ * @param {!T} t The test runner object.
+ */
+exports.testMigrateRegistered = function(t) {
+  const intrp = new Interpreter;
+  intrp.global.createMutableBinding('x', 42);
+  const json = Serializer.serialize(intrp);
+  const current = Interpreter.SERIALIZATION_VERSION;
+  t.expect('serializationVersion recorded',
+           json[0]['props']['serializationVersion'], current);
+  t.assert('serverVersion recorded',
+           typeof json[0]['props']['serverVersion'] === 'string');
+  for (let version = current; version >= 0; version--) {
+    if (version < current && !(version in Migrate.migrations_)) break;
+    const name = 'Migrate from version ' + version;
+    try {
+      const records = JSON.parse(JSON.stringify(json));
+      records[0]['props']['serializationVersion'] = version;
+      if (version < 4) delete records[0]['props']['serverVersion'];
+      const intrp2 = new Interpreter;
+      const deserializer = new Serializer.Deserializer(intrp2);
+      const migrator = new Migrate.Migrator(
+          deserializer.add.bind(deserializer));
+      for (const record of records) {
+        migrator.add(record);
+      }
+      migrator.finish();
+      deserializer.finish();
+      t.expect(name, intrp2.global.get('x'), 42);
+    } catch (e) {
+      t.crash(name, e);
+    }
+  }
+};
+
+/**
+ * Unit tests for the migration adding permission tiers: worlds saved
+ * before tiers existed default to wizard; newer ones keep their
+ * default.
+ * @param {!T} t The test runner object.
+ */
+exports.testMigrateTiers = function(t) {
+  const intrp = new Interpreter;
+  const json = Serializer.serialize(intrp);
+  t.expect('new world default tier', json[0]['props']['defaultTier_'],
+           'programmer');
+  for (const [version, saved, expected] of [[16, undefined, 'wizard'],
+                                            [17, 'player', 'player']]) {
+    const name = 'Migrate tiers from version ' + version;
+    try {
+      const records = JSON.parse(JSON.stringify(json));
+      records[0]['props']['serializationVersion'] = version;
+      if (saved === undefined) {
+        delete records[0]['props']['defaultTier_'];
+      } else {
+        records[0]['props']['defaultTier_'] = saved;
+      }
+      const intrp2 = new Interpreter;
+      const deserializer = new Serializer.Deserializer(intrp2);
+      const migrator = new Migrate.Migrator(
+          deserializer.add.bind(deserializer));
+      for (const record of records) {
+        migrator.add(record);
+      }
+      migrator.finish();
+      deserializer.finish();
+      t.expect(name, intrp2.tierOf(new intrp2.Object(intrp2.ROOT)),
+               expected);
+    } catch (e) {
+      t.crash(name, e);
+    }
+  }
+};
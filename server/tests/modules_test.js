@@ -0,0 +1,129 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for modules of in-world code.
+ */
+'use strict';
+
+const Modules = require('../modules');
+const {getInterpreter} = require('./interpreter_common');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Modules.isValidName.
+ * @param {!T} t The test runner object.
+ */
+exports.testModulesIsValidName = function(t) {
+  for (const name of ['text', 'text/wrap', 'a.b-c_$', '1/2']) {
+    t.expect('isValidName(' + JSON.stringify(name) + ')',
+             Modules.isValidName(name), true);
+  }
+  for (const name of ['', '/text', 'text/', 'a//b', '../x', 'a b', 'x/.',
+                      'x'.repeat(201), 42]) {
+    t.expect('isValidName(' + JSON.stringify(name) + ')',
+             Modules.isValidName(name), false);
+  }
+};
+
+/**
+ * Unit tests for Modules.dependents and Modules.invalidate.
+ * @param {!T} t The test runner object.
+ */
+exports.testModulesInvalidate = function(t) {
+  const cache = new Map();
+  const add = (name, requires) => {
+    cache.set(name, {name: name, library: null, module: null,
+                     requires: requires, loaded: true, loading: null});
+  };
+  add('base', []);
+  add('text', ['base']);
+  add('wrap', ['text']);
+  add('other', []);
+  add('cycle', ['cycle', 'wrap']);
+  Modules.addDependency(cache, 'other', 'base');
+  Modules.addDependency(cache, 'other', 'base');
+  t.expect('addDependency', cache.get('other').requires.join(), 'base');
+  t.expect('dependents("wrap")', Modules.dependents(cache, 'wrap').join(),
+           'wrap,cycle');
+  t.expect('dependents("missing")', Modules.dependents(cache, 'missing').length,
+           0);
+  t.expect('invalidate("base")', Modules.invalidate(cache, 'base').join(),
+           'base,text,other,wrap,cycle');
+  t.expect('cache after invalidate', cache.size, 0);
+};
+
+/**
+ * Unit tests for CC.require and related builtins.
+ * @param {!T} t The test runner object.
+ */
+exports.testModulesRequire = function(t) {
+  const intrp = getInterpreter();
+  intrp.createThreadForSrc(`
+      var lib = {};
+      var runs = 0;
+      lib.base = 'runs++; exports.value = 42;';
+      lib['text/upper'] =
+          'var base = require("base");' +
+          'module.exports = function(s) {' +
+          '  return s.toUpperCase() + base.value;' +
+          '};';
+      lib.a = function(require, module, exports) {
+        exports.early = true;
+        exports.b = require('b');
+      };
+      lib.b = 'exports.a = require("a"); exports.sawEarly = exports.a.early;';
+      lib.bad = 'throw new Error("oops");';
+      CC.moduleSetLibraries([lib]);
+      var results = [];
+      results.push(CC.require('text/upper')('x'));
+      results.push(CC.require('base').value, runs);
+      var a = CC.require('a');
+      results.push(a.b.a === a, a.b.sawEarly);
+      try {
+        CC.require('missing');
+      } catch (e) {
+        results.push(e.message);
+      }
+      for (var i = 0; i < 2; i++) {
+        try {
+          CC.require('bad');
+        } catch (e) {
+          results.push(e.message);
+        }
+      }
+      results.push(CC.moduleReload('base').join());
+      CC.require('text/upper');
+      results.push(runs);
+      results.push(CC.modules().map(function(m) {
+        return m.name + ':' + m.requires.join('+');
+      }).sort().join());
+      results.push(CC.moduleLibraries()[0] === lib);
+  `);
+  intrp.run();
+  const results = intrp.pseudoToNative(
+      intrp.global.get('results', intrp.ROOT));
+  t.expect('require (string module)', results[0], 'X42');
+  t.expect('require (cached)', results.slice(1, 3).join(), '42,1');
+  t.expect('require (cycle)', results.slice(3, 5).join(), 'true,true');
+  t.expect('require (missing)', results[5], 'Cannot find module missing');
+  t.expect('require (throws)', results.slice(6, 8).join(), 'oops,oops');
+  t.expect('moduleReload', results[8], 'base,text/upper');
+  t.expect('require (after reload)', results[9], 2);
+  t.expect('modules', results[10], 'a:b,b:a,base:,text/upper:base');
+  t.expect('moduleLibraries', results[11], true);
+};
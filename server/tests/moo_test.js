@@ -0,0 +1,199 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for importing LambdaMOO databases.
+ */
+'use strict';
+
+const Moo = require('../moo');
+const {T} = require('./testing');
+
+/**
+ * A small database: #0 (naming #2 and #4 as room and thing), the root
+ * class #1, the generic room #2, a wizard #3, the generic thing #4, a
+ * recycled #5, a room #6 and a ball #7 in it.
+ * @const {string}
+ */
+const DB = [
+  '** LambdaMOO Database, Format Version 4 **',
+  '8', '2', '0', '1', '3',
+  // #0: System Object.
+  '#0', 'System Object', '', '24', '3', '-1', '-1', '-1', '1', '-1', '2',
+  '0',
+  '2', 'room', 'thing',
+  '4', '1', '2', '3', '5', '1', '4', '3', '5', '5', '3', '5', '5', '3', '5',
+  // #1: Root Class.
+  '#1', 'Root Class', '', '16', '3', '-1', '-1', '-1', '-1', '0', '-1',
+  '1', 'description', '3', '165', '-1',
+  '2', 'description', 'aliases',
+  '2', '2', 'A root.', '3', '5', '4', '0', '3', '5',
+  // #2: generic room.
+  '#2', 'generic room', '', '144', '3', '-1', '-1', '-1', '1', '6', '3',
+  '0', '0',
+  '2', '5', '3', '5', '5', '3', '5',
+  // #3: Wizard.
+  '#3', 'Wizard', '', '7', '3', '6', '-1', '7', '1', '-1', '4',
+  '0', '1', 'location',
+  '3', '2', 'somewhere', '3', '5', '5', '3', '5', '4', '1', '2', 'Wiz',
+  '3', '5',
+  // #4: generic thing.
+  '#4', 'generic thing', '', '144', '3', '-1', '-1', '-1', '1', '7', '-1',
+  '2', 'g*et t*ake', '3', '37', '-1', 'put', '3', '97', '3',
+  '0',
+  '2', '2', 'A thing.', '3', '5', '4', '0', '3', '5',
+  '#5 recycled',
+  // #6: The Hall.
+  '#6', 'The Hall', '', '0', '3', '-1', '3', '-1', '2', '-1', '-1',
+  '0', '0',
+  '2', '2', 'It\'s a "hall".', '3', '5', '5', '3', '5',
+  // #7: ball.
+  '#7', 'ball', '', '0', '3', '6', '-1', '-1', '4', '-1', '-1',
+  '0', '1', 'owner_ref',
+  '3', '1', '5', '3', '5', '5', '3', '5', '4', '2', '2', 'orb', '3', '99',
+  '3', '5',
+  // Programs.
+  '#4:0', 'player:tell("Taken.");', '.',
+  '#1:0', 'return this.description;', '.',
+  '0 clocks', '0 queued tasks',
+  '',
+].join('\n');
+
+/**
+ * Unit tests for Moo.parse.
+ * @param {!T} t The test runner object.
+ */
+exports.testMooParse = function(t) {
+  const db = Moo.parse(DB);
+  t.expect('version', db.version, 4);
+  t.expect('users', db.users.join(), '3');
+  t.expect('objects.length', db.objects.length, 8);
+  t.expect('objects[5]', db.objects[5], null);
+  const ball = db.objects[7];
+  t.expect('ball.name', ball.name, 'ball');
+  t.expect('ball.location', ball.location, 6);
+  t.expect('propertyNames(ball)', Moo.propertyNames(db, ball).join(),
+           'owner_ref,description,aliases');
+  t.expect('ball property values', JSON.stringify(
+               ball.propvals.map((propval) => propval.value)),
+           '[{"obj":5},null,["orb",{"err":"E_99"}]]');
+  const get = db.objects[4].verbs[0];
+  t.expect('get.code', get.code.join(), 'player:tell("Taken.");');
+  t.expect('put.code', db.objects[4].verbs[1].code, null);
+
+  const bad = [
+    ['', /not a LambdaMOO database/],
+    ['** LambdaMOO Database, Format Version 17 **', /unsupported format/],
+    [DB.replace('#6\nThe Hall', '#8\nThe Hall'), /expected object #6/],
+    [DB.slice(0, DB.indexOf('\n#4:0')), /unexpected end/],
+    [DB.replace('#4:0', '#4:5'), /no such verb/],
+  ];
+  for (const [text, expected] of bad) {
+    try {
+      Moo.parse(text);
+      t.fail('parse(bad)', 'Did not throw ' + expected);
+    } catch (e) {
+      t.assert('parse(bad) throws ' + expected,
+               e instanceof SyntaxError && expected.test(e.message));
+    }
+  }
+};
+
+/**
+ * Unit tests for Moo.verbPattern.
+ * @param {!T} t The test runner object.
+ */
+exports.testMooVerbPattern = function(t) {
+  const cases = [
+    ['look', 'look'],
+    ['l*ook examine', 'l(?:o(?:o(?:k)?)?)?|examine'],
+    ['foo*', 'foo.*'],
+    ['*', '.*'],
+    ['@cr*eate', '@cr(?:e(?:a(?:t(?:e)?)?)?)?'],
+    ['a.b', 'a\\.b'],
+  ];
+  for (const [names, expected] of cases) {
+    const pattern = Moo.verbPattern(names);
+    t.expect('verbPattern(' + JSON.stringify(names) + ')', pattern, expected);
+  }
+  const regexp = new RegExp('^(?:' + Moo.verbPattern('l*ook') + ')$');
+  t.expect('l*ook matches "lo"', regexp.test('lo'), true);
+  t.expect('l*ook does not match "lok"', regexp.test('lok'), false);
+};
+
+/**
+ * Unit tests for Moo.convert and Moo.formatReport.
+ * @param {!T} t The test runner object.
+ */
+exports.testMooConvert = function(t) {
+  const {source, report} = Moo.convert(Moo.parse(DB), {namespace: '$.old'});
+  const has = (line) => {
+    t.assert('source includes ' + JSON.stringify(line),
+             source.split('\n').includes(line));
+  };
+  has("$.old = {};");
+  has("$.old['#1'] = {};");
+  has("$.old['#2'] = (new 'Object.create')($.room);");
+  has("$.old['#6'] = (new 'Object.create')($.old['#2']);");
+  has("$.old.room = $.old['#2'];");
+  has("$.old['#6'].description = 'It\\'s a \"hall\".';");
+  has("$.old['#7'].owner_ref = null;");
+  has("$.old['#7'].aliases = ['orb', 'E_99'];");
+  has("$.old['#3'].moo_location = 'somewhere';");
+  has("$.old['#4'].get = function get(cmd) {");
+  has("  //   player:tell(\"Taken.\");");
+  has("$.old['#4'].get.verb = 'g(?:e(?:t)?)?|t(?:a(?:k(?:e)?)?)?';");
+  has("$.old['#4'].get.dobj = 'this';");
+  has("$.old['#4'].put.prep = 'in/inside/into';");
+  has("$.old['#4'].put.iobj = 'any';");
+  // A method (this none this) is not a command.
+  has("$.old['#1'].description_2 = function description_2() {");
+  t.assert('method has no verb property',
+           !source.includes("['#1'].description_2.verb"));
+  has("$.old['#7'].location = $.old['#6'];");
+  has("$.old['#6'].contents_ = [$.old['#7']];");
+  t.assert('non-physical #3 has no location',
+           !source.includes("$.old['#3'].location"));
+  try {
+    new Function('$', source);
+  } catch (e) {
+    t.fail('source is valid JavaScript', String(e));
+  }
+
+  t.expect('report.objects', report.objects, 7);
+  t.expect('report.recycled', report.recycled, 1);
+  t.expect('report.verbs', report.verbs.map((v) => v.key).join(),
+           'description_2,get,put');
+  t.expect('report.wizards', report.wizards.join(), '#3 (Wizard)');
+  t.expect('report.warnings', report.warnings.join('\n'), [
+    '#1 (Root Class): verb description renamed description_2',
+    '#3 (Wizard): property location renamed moo_location',
+    '#7 (ball).owner_ref: reference to missing object #5 replaced by null',
+  ].join('\n'));
+  const text = Moo.formatReport(report);
+  t.assert('formatReport includes verb',
+           text.includes('  #4:g*et t*ake (as .get, 1 line)'));
+  t.assert('formatReport includes users',
+           text.includes('Users (need CodeCity accounts) (1):\n  #3 (Wizard)'));
+
+  try {
+    Moo.convert(Moo.parse(DB), {namespace: '$["x"]'});
+    t.fail('convert(..., bad namespace)', 'Did not throw');
+  } catch (e) {
+    t.expect('convert(..., bad namespace) throws', e.name, 'RangeError');
+  }
+};
@@ -0,0 +1,246 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for object packages.
+ */
+'use strict';
+
+const {getInterpreter} = require('./interpreter_common');
+const Package = require('../package');
+const Serializer = require('../serialize');
+const {T} = require('./testing');
+
+/**
+ * Create an interpreter and run some source in it.
+ * @param {string} src Source to run.
+ * @return {!Interpreter}
+ */
+function world(src) {
+  const intrp = getInterpreter();
+  intrp.createThreadForSrc(src);
+  intrp.run();
+  return intrp;
+}
+
+/**
+ * Evaluate an expression in an interpreter.
+ * @param {!Interpreter} intrp The interpreter.
+ * @param {string} src Expression to evaluate.
+ * @return {*} Its (native) value.
+ */
+function evaluate(intrp, src) {
+  const thread = intrp.createThreadForSrc(src).thread;
+  intrp.run();
+  return intrp.pseudoToNative(thread.value);
+}
+
+/**
+ * Unit tests for Package.exportPackage and Package.importPackage.
+ * @param {!T} t The test runner object.
+ */
+exports.testPackageRoundtrip = function(t) {
+  const name = 'testPackageRoundtrip';
+  const common = `
+      var $ = {};
+      $.physical = {describe: function() {return this.prefix + this.name;}};
+      $.user = {};
+  `;
+  const src = common + `
+      $.physical.prefix = 'A ';
+      var thing = Object.create($.physical);
+      thing.name = 'widget';
+      thing.parts = [1, {x: 2}];
+      thing.counter = (function() {
+        var c = 10;
+        return function() {return c++;};
+      })();
+      thing.maker = $.user;
+      thing.when = new Date(5);
+      thing.re = /a+/g;
+      thing.self = thing;
+      $.thing = thing;
+  `;
+  let pkg;
+  try {
+    const intrp = world(src);
+    pkg = Package.exportPackage(intrp, intrp.global.get('thing'));
+    pkg = JSON.parse(JSON.stringify(pkg));
+  } catch (e) {
+    t.crash(name + ': export', e);
+    return;
+  }
+  const externals = pkg['records'].filter((r) => r['type'] === 'External')
+      .map((r) => JSON.stringify(r['external']));
+  t.assert(name + ': $.physical external',
+           externals.includes('{"selector":"$.physical"}'));
+  t.assert(name + ': $.user external',
+           externals.includes('{"selector":"$.user"}'));
+  t.assert(name + ': builtin external',
+           externals.includes('{"builtin":"Object.prototype"}'));
+  t.assert(name + ': no owners', pkg['records'].every(
+      (r) => !r['props'] || !('owner' in r['props']) ||
+          r['props']['owner'] === null));
+
+  try {
+    const intrp = world(common + `
+        $.physical.prefix = 'An ';
+        var user = {};
+    `);
+    const owner = intrp.global.get('user');
+    const root = Package.importPackage(intrp, pkg, owner);
+    intrp.global.createMutableBinding('imported', root);
+    const tests = {
+      'imported.describe()': 'An widget',
+      'imported.parts[1].x': 2,
+      '[imported.counter(), imported.counter()].join()': '10,11',
+      'imported.maker === $.user': true,
+      'Object.getPrototypeOf(imported) === $.physical': true,
+      'imported.when.getTime()': 5,
+      'imported.re.test("aa")': true,
+      'imported.self === imported': true,
+      'Object.getOwnerOf(imported) === user': true,
+      'Object.getOwnerOf(imported.parts[1]) === user': true,
+      'Object.getOwnerOf(imported.counter) === user': true,
+      'Object.getOwnerOf($.physical) === user': false,
+    };
+    for (const expr in tests) {
+      t.expect(name + ': ' + expr, evaluate(intrp, expr), tests[expr]);
+    }
+    // Importing again creates a separate copy.
+    const again = Package.importPackage(intrp, pkg, owner);
+    t.assert(name + ': import again', again !== root &&
+             again.get('parts', intrp.ROOT) !== root.get('parts', intrp.ROOT));
+  } catch (e) {
+    t.crash(name + ': import', e);
+  }
+};
+
+/**
+ * Unit tests for errors exporting and importing packages.
+ * @param {!T} t The test runner object.
+ */
+exports.testPackageErrors = function(t) {
+  const name = 'testPackageErrors';
+  const intrp = world(`
+      var $ = {};
+      $.base = {};
+      var thing = Object.create($.base);
+      thing.thread = new Thread(function() {}, 1000);
+      var ok = Object.create($.base);
+  `);
+  try {
+    Package.exportPackage(intrp, intrp.global.get('thing'));
+    t.fail(name + ': export thread', "Didn't throw.");
+  } catch (e) {
+    t.pass(name + ': export thread');
+  }
+  const pkg = Package.exportPackage(intrp, intrp.global.get('ok'));
+  const bad = {
+    'not a package': {},
+    'missing selector': pkg,
+    'newer version': Object.assign({}, pkg, {'serializationVersion': 9999}),
+    'bad record': Object.assign({}, pkg, {'records': [null]}),
+  };
+  const intrp2 = world('var $ = {};');
+  for (const label in bad) {
+    try {
+      Package.importPackage(intrp2, bad[label], intrp2.ROOT);
+      t.fail(name + ': ' + label, "Didn't throw.");
+    } catch (e) {
+      t.pass(name + ': ' + label);
+    }
+  }
+};
+
+/**
+ * Unit tests for Package.exportOwned and Package.importOwned.
+ * @param {!T} t The test runner object.
+ */
+exports.testPackageOwned = function(t) {
+  const name = 'testPackageOwned';
+  const common = `
+      var $ = {};
+      $.physical = {describe: function() {return 'A ' + this.name;}};
+  `;
+  let pkg;
+  try {
+    const intrp = world(common + `
+        var alice = Object.create($.physical);
+        alice.name = 'Alice';
+        // A prototype owned by someone else and known by no name.
+        alice.hat = Object.create({secret: 'not exported'});
+        alice.hat.colour = 'red';
+        alice.notes = ['one', {two: 2}];
+        alice.borrowed = {};  // Not owned by alice.
+        alice.thread = new Thread(function() {}, 1000);
+        $.alice = alice;
+        $.other = {hatOf: alice.hat};
+        [alice, alice.hat, alice.notes, alice.notes[1], alice.thread]
+            .forEach(function(o) {Object.setOwnerOf(o, alice);});
+    `);
+    const alice = intrp.global.get('alice');
+    const index = Serializer.indexByOwner(intrp);
+    t.expect(name + ': indexByOwner(...).get(alice).length',
+             index.get(alice).length, 5);
+    pkg = Package.exportOwned(intrp, alice);
+    pkg = JSON.parse(JSON.stringify(pkg));
+  } catch (e) {
+    t.crash(name + ': export', e);
+    return;
+  }
+  const json = JSON.stringify(pkg);
+  t.assert(name + ': owned', pkg['owned'] === true);
+  t.assert(name + ': $.physical external', json.includes('"$.physical"'));
+  t.assert(name + ': stub', json.includes('{"stub":1,"class":"Object"}'));
+  t.assert(name + ': not exported', !json.includes('not exported'));
+
+  try {
+    const intrp = world(common + 'var bob = {};');
+    const root = Package.importOwned(intrp, pkg);
+    intrp.global.createMutableBinding('imported', root);
+    intrp.global.createMutableBinding('a', root.get('0', intrp.ROOT));
+    const tests = {
+      'imported.length': 4,
+      'a.describe()': 'A Alice',
+      'a.hat.colour': 'red',
+      'a.hat.secret': undefined,
+      'a.notes[1].two': 2,
+      'Object.getPrototypeOf(a) === $.physical': true,
+      'Object.getOwnerOf(a) === a': true,
+      'Object.getOwnerOf(a.notes[1]) === a': true,
+      'Object.getOwnerOf(Object.getPrototypeOf(a.hat)) === a': true,
+      'Object.getOwnPropertyNames(a.borrowed).length': 0,
+      'a.thread instanceof Thread': false,
+    };
+    for (const expr in tests) {
+      t.expect(name + ': ' + expr, evaluate(intrp, expr), tests[expr]);
+    }
+    const again = Package.importOwned(intrp, pkg, intrp.global.get('bob'));
+    intrp.global.createMutableBinding('again', again);
+    t.expect(name + ': import for bob',
+             evaluate(intrp, 'Object.getOwnerOf(again[0].hat) === bob'), true);
+    try {
+      Package.importPackage(intrp, pkg, intrp.ROOT);
+      t.fail(name + ': importPackage', "Didn't throw.");
+    } catch (e) {
+      t.pass(name + ': importPackage');
+    }
+  } catch (e) {
+    t.crash(name + ': import', e);
+  }
+};
@@ -0,0 +1,174 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for installing packages from a registry.
+ */
+'use strict';
+
+const crypto = require('crypto');
+const http = require('http');
+const Packages = require('../packages');
+const {T} = require('./testing');
+
+/**
+ * Generate a key pair for signing registry files.
+ * @param {string} type Key type (e.g., 'ed25519').
+ * @return {{publicKey: string, privateKey: string}} PEM keys.
+ */
+function keyPair(type) {
+  return crypto.generateKeyPairSync(type, {
+    modulusLength: 2048,
+    publicKeyEncoding: {type: 'spki', format: 'pem'},
+    privateKeyEncoding: {type: 'pkcs8', format: 'pem'},
+  });
+}
+
+/**
+ * Unit tests for Packages.isValidName, .isValidVersion and
+ * .compareVersions.
+ * @param {!T} t The test runner object.
+ */
+exports.testPackagesVersions = function(t) {
+  for (const name of ['text', 'text-utils', 'a.b_c', '9lives']) {
+    t.expect('isValidName(' + JSON.stringify(name) + ')',
+             Packages.isValidName(name), true);
+  }
+  for (const name of ['', 'Text', '-x', '.x', 'a/b', 'a b', 'x'.repeat(101)]) {
+    t.expect('isValidName(' + JSON.stringify(name) + ')',
+             Packages.isValidName(name), false);
+  }
+  for (const version of ['1', '1.0', '0.10.2']) {
+    t.expect('isValidVersion(' + JSON.stringify(version) + ')',
+             Packages.isValidVersion(version), true);
+  }
+  for (const version of ['', '1.', '.1', '01', '1.0-beta', 'v1', 1]) {
+    t.expect('isValidVersion(' + JSON.stringify(version) + ')',
+             Packages.isValidVersion(version), false);
+  }
+  const cases = [
+    ['1.0.0', '1.0.0', 0],
+    ['1.0', '1.0.0', 0],
+    ['1.10.0', '1.9.2', 1],
+    ['0.9', '1', -1],
+    ['2.0.1', '2.0', 1],
+  ];
+  for (const [a, b, expected] of cases) {
+    t.expect('compareVersions(' + a + ', ' + b + ')',
+             Math.sign(Packages.compareVersions(a, b)), expected);
+  }
+};
+
+/**
+ * Unit tests for Packages.sign and Packages.verify.
+ * @param {!T} t The test runner object.
+ */
+exports.testPackagesSign = function(t) {
+  for (const type of ['ed25519', 'rsa']) {
+    const {publicKey, privateKey} = keyPair(type);
+    const other = keyPair(type);
+    const data = '{"name": "text"}';
+    const signature = Packages.sign(privateKey, data);
+    t.expect(type + ': verify', Packages.verify(publicKey, data, signature),
+             true);
+    t.expect(type + ': verify (trailing newline)',
+             Packages.verify(publicKey, data, signature + '\n'), true);
+    t.expect(type + ': verify (altered data)',
+             Packages.verify(publicKey, data + ' ', signature), false);
+    t.expect(type + ': verify (other key)',
+             Packages.verify(other.publicKey, data, signature), false);
+    t.expect(type + ': verify (garbage)',
+             Packages.verify(publicKey, data, 'not base64!'), false);
+  }
+  try {
+    new Packages.Registry({url: 'ftp://example.org/', publicKey: ''});
+    t.fail('new Registry(ftp URL)', 'Did not throw');
+  } catch (e) {
+    t.expect('new Registry(ftp URL) throws', e.name, 'TypeError');
+  }
+};
+
+/**
+ * Unit tests for fetching from a Packages.Registry.
+ * @param {!T} t The test runner object.
+ */
+exports.testPackagesRegistry = async function(t) {
+  const {publicKey, privateKey} = keyPair('ed25519');
+  const files = new Map();
+  const publish = (path, value, signWith = privateKey) => {
+    const data = JSON.stringify(value);
+    files.set(path, data);
+    files.set(path + '.sig', Packages.sign(signWith, data));
+  };
+  const pkg = {package: 1, serializationVersion: 16, records: []};
+  publish('/reg/text/index.json',
+          {name: 'text', versions: ['1.10.0', '1.2.0', '1.9.0']});
+  publish('/reg/text/1.10.0.json',
+          {name: 'text', version: '1.10.0', package: pkg});
+  publish('/reg/text/1.2.0.json',
+          {name: 'text', version: '1.9.0', package: pkg});
+  publish('/reg/text/1.9.0.json',
+          {name: 'text', version: '1.9.0', package: pkg},
+          keyPair('ed25519').privateKey);
+  const server = http.createServer((req, res) => {
+    if (files.has(req.url)) {
+      res.end(files.get(req.url));
+    } else {
+      res.writeHead(404);
+      res.end();
+    }
+  });
+  await new Promise((resolve) => server.listen(0, '127.0.0.1', resolve));
+  const registry = new Packages.Registry({
+    url: 'http://127.0.0.1:' + server.address().port + '/reg',
+    publicKey,
+  });
+  const expectReject = async (name, promise, expected) => {
+    try {
+      await promise;
+      t.fail(name, 'Did not reject');
+    } catch (e) {
+      t.assert(name + ' rejects with ' + expected, expected.test(e.message));
+    }
+  };
+  try {
+    t.expect('versions', (await registry.versions('text')).join(),
+             '1.2.0,1.9.0,1.10.0');
+    t.expect('latest', await registry.latest('text'), '1.10.0');
+    t.expect('newer than 1.9.0', await registry.newer('text', '1.9.0'),
+             '1.10.0');
+    t.expect('newer than 1.10', await registry.newer('text', '1.10'), null);
+    let release = await registry.release('text', '1.10.0');
+    t.expect('release', JSON.stringify(release), JSON.stringify(
+        {name: 'text', version: '1.10.0', package: pkg}));
+    release = await registry.release('text');
+    t.expect('release (latest)', release.version, '1.10.0');
+
+    await expectReject('release (wrong version)',
+                       registry.release('text', '1.2.0'), /Invalid release/);
+    await expectReject('release (bad signature)',
+                       registry.release('text', '1.9.0'), /Bad signature/);
+    await expectReject('release (missing)',
+                       registry.release('text', '2.0'), /404/);
+    await expectReject('release (bad version)',
+                       registry.release('text', '../x'), /Invalid version/);
+    await expectReject('versions (bad name)',
+                       registry.versions('../etc'), /Invalid package name/);
+  } finally {
+    server.close();
+  }
+};
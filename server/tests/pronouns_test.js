@@ -0,0 +1,76 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for pronoun and message substitution.
+ */
+'use strict';
+
+const Pronouns = require('../pronouns');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Pronouns.parse.
+ * @param {!T} t The test runner object.
+ */
+exports.testPronounsParse = function(t) {
+  t.expect('parse("She")', Pronouns.parse(' She '), Pronouns.SETS['she']);
+  const ze = Pronouns.parse('ze/zir/zir/zirs/zirself');
+  t.expect('parse("ze/...")',
+           [ze.subject, ze.object, ze.possessive, ze.possessivePronoun,
+            ze.reflexive, ze.plural].join(),
+           'ze,zir,zir,zirs,zirself,false');
+  for (const bad of ['xe', 'a/b/c/d', 'a/b/c/d/%n', 'a/b/c/d/e f', 42]) {
+    t.expect('parse(' + JSON.stringify(bad) + ')', Pronouns.parse(bad),
+             null);
+  }
+};
+
+/**
+ * Unit tests for Pronouns.substitute.
+ * @param {!T} t The test runner object.
+ */
+exports.testPronounsSubstitute = function(t) {
+  const alice = {name: 'Alice', pronouns: Pronouns.SETS['she'], id: 1};
+  const sam = {name: 'Sam', pronouns: Pronouns.SETS['they'], id: 2};
+  const key = {name: 'the key', pronouns: null, id: 3};
+  const room = {name: 'the hall', pronouns: null, id: 4};
+  const template = '%N %[puts|put] %d in %p pocket.';
+  const cases = [
+    [template, {actor: alice, dobj: key}, 5,
+     'Alice puts the key in her pocket.'],
+    [template, {actor: alice, dobj: key}, 1,
+     'You put the key in your pocket.'],
+    [template, {actor: sam, dobj: key}, undefined,
+     'Sam puts the key in their pocket.'],
+    ['%S %[puts|put] it down.', {actor: sam}, undefined,
+     'They put it down.'],
+    ['%S %[is|are] in %l; %s %[looks|look] at %r.',
+     {actor: alice, location: room}, 5,
+     'She is in the hall; she looks at herself.'],
+    ['%N %[gives|give] %d to %i.', {actor: sam, dobj: key, iobj: alice}, 1,
+     'Sam gives the key to you.'],
+    ['%O, %Q, 100%% %x %i', {actor: alice}, 5, 'Her, Hers, 100% %x %i'],
+    // No actor, or no pronouns: the default.
+    ['%s %o', {}, undefined, 'they them'],
+    ['%s', {actor: key}, undefined, 'they'],
+  ];
+  for (const [template, roles, viewer, expected] of cases) {
+    t.expect('substitute(' + JSON.stringify(template) + ', ...)',
+             Pronouns.substitute(template, roles, viewer), expected);
+  }
+};
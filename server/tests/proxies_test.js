@@ -0,0 +1,182 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for finding the addresses of clients
+ * behind proxies.
+ */
+'use strict';
+
+const net = require('net');
+const Proxies = require('../proxies');
+const {T} = require('./testing');
+
+/**
+ * Make a version 2 PROXY protocol header.
+ * @param {number} command 0 for LOCAL or 1 for PROXY.
+ * @param {number} family Address family and transport protocol byte.
+ * @param {!Array<number>} addresses Address block (and any TLVs).
+ * @return {!Buffer}
+ */
+function v2Header(command, family, addresses) {
+  const length = Buffer.alloc(2);
+  length.writeUInt16BE(addresses.length);
+  return Buffer.concat([Proxies.V2_SIGNATURE, Buffer.from([0x20 | command]),
+                        Buffer.from([family]), length,
+                        Buffer.from(addresses)]);
+}
+
+/**
+ * Unit tests for Proxies.parseHeader.
+ * @param {!T} t The test runner object.
+ */
+exports.testProxiesParseHeader = function(t) {
+  const v6 = [0x20, 0x01, 0x0d, 0xb8].concat(new Array(11).fill(0), [1],
+                                             new Array(16).fill(0),
+                                             [0x04, 0xd2, 0, 80]);
+  const valid = [
+    ['v1 TCP4', Buffer.from('PROXY TCP4 192.0.2.1 192.0.2.2 1234 80\r\nx'),
+     '{"length":40,"source":{"address":"192.0.2.1","port":1234}}'],
+    ['v1 TCP6', Buffer.from('PROXY TCP6 2001:db8::1 ::1 1234 80\r\n'),
+     '{"length":36,"source":{"address":"2001:db8::1","port":1234}}'],
+    ['v1 UNKNOWN', Buffer.from('PROXY UNKNOWN ignored\r\n'),
+     '{"length":23,"source":null}'],
+    ['v2 TCP4', v2Header(1, 0x11, [192, 0, 2, 1, 192, 0, 2, 2, 4, 210, 0, 80,
+                                   0xee, 0, 0]),
+     '{"length":31,"source":{"address":"192.0.2.1","port":1234}}'],
+    ['v2 TCP6', v2Header(1, 0x21, v6),
+     '{"length":52,"source":{"address":"2001:db8:0:0:0:0:0:1",' +
+     '"port":1234}}'],
+    ['v2 LOCAL', v2Header(0, 0x00, []), '{"length":16,"source":null}'],
+    ['v2 UNIX', v2Header(1, 0x31, new Array(216).fill(0)),
+     '{"length":232,"source":null}'],
+  ];
+  for (const [name, data, expected] of valid) {
+    t.expect('parseHeader(<' + name + '>)',
+             JSON.stringify(Proxies.parseHeader(data)), expected);
+    // Incomplete headers need more data.
+    t.expect('parseHeader(<partial ' + name + '>)',
+             Proxies.parseHeader(data.subarray(0, 14)), null);
+  }
+
+  const invalid = [
+    ['not a header', Buffer.from('GET / HTTP/1.1\r\n')],
+    ['v1 bad address', Buffer.from('PROXY TCP4 ::1 192.0.2.2 1234 80\r\n')],
+    ['v1 bad port', Buffer.from('PROXY TCP4 192.0.2.1 192.0.2.2 99999 80\r\n')],
+    ['v1 too long', Buffer.from('PROXY ' + 'x'.repeat(200))],
+    ['v2 bad command', Buffer.concat([Proxies.V2_SIGNATURE,
+                                      Buffer.from([0x22, 0x11, 0, 0])])],
+  ];
+  for (const [name, data] of invalid) {
+    try {
+      Proxies.parseHeader(data);
+      t.fail('parseHeader(<' + name + '>)', 'Did not throw');
+    } catch (e) {
+      t.pass('parseHeader(<' + name + '>) throws');
+    }
+  }
+};
+
+/**
+ * Unit tests for Proxies.readHeader and Proxies.Socket.
+ * @param {!T} t The test runner object.
+ */
+exports.testProxiesReadHeader = async function(t) {
+  const results = [];
+  const server = net.createServer((socket) => {
+    Proxies.readHeader(socket, (error, client) => {
+      if (error) {
+        results.push(error.message);
+        socket.destroy();
+        return;
+      }
+      let data = '';
+      client.on('data', (chunk) => {
+        data += chunk;
+      });
+      client.on('end', () => {
+        results.push(client.remoteAddress + ':' + client.remotePort + ' ' +
+                     client.proxyAddress + ' ' + data);
+        client.end('bye');
+      });
+    });
+  });
+  await new Promise((resolve) => server.listen(0, '127.0.0.1', resolve));
+  const send = (chunks) => new Promise((resolve) => {
+    let reply = '';
+    const client = net.createConnection(server.address().port, '127.0.0.1');
+    client.on('data', (data) => {
+      reply += data;
+    });
+    client.on('error', () => {});
+    client.on('close', () => resolve(reply));
+    (async () => {
+      for (const chunk of chunks) {
+        client.write(chunk);
+        await new Promise((resolve) => setTimeout(resolve, 10));
+      }
+      client.end();
+    })();
+  });
+  try {
+    t.expect('readHeader(...) reply',
+             await send(['PROXY TCP4 192.0.2.1 ', '192.0.2.2 1234 80\r\nfo',
+                         'o', 'bar']),
+             'bye');
+    t.expect('readHeader(...)', results.pop(),
+             '192.0.2.1:1234 127.0.0.1 foobar');
+    await send(['PROXY UNKNOWN\r\nbaz']);
+    t.expect('readHeader(<UNKNOWN>)', results.pop().replace(/:\d+/, ':N'),
+             '127.0.0.1:N 127.0.0.1 baz');
+    await send(['HELO example.com\r\n']);
+    t.expect('readHeader(<no header>)', results.pop(),
+             'Not a PROXY protocol header');
+    await send(['PROXY TCP4']);
+    t.expect('readHeader(<ended early>)', results.pop(),
+             'Connection ended before PROXY protocol header');
+  } finally {
+    server.close();
+  }
+};
+
+/**
+ * Unit tests for Proxies.forwardedFor.
+ * @param {!T} t The test runner object.
+ */
+exports.testProxiesForwardedFor = function(t) {
+  const isTrusted = (address) => /^10\./.test(address);
+  const cases = [
+    ['untrusted peer', '192.0.2.1', {'x-forwarded-for': '203.0.113.9'},
+     '192.0.2.1'],
+    ['one proxy', '10.0.0.1', {'x-forwarded-for': '203.0.113.9'},
+     '203.0.113.9'],
+    ['two proxies', '10.0.0.1',
+     {'x-forwarded-for': '198.51.100.1, 203.0.113.9, 10.0.0.2'},
+     '203.0.113.9'],
+    ['all trusted', '10.0.0.1', {'x-forwarded-for': '10.0.0.3, 10.0.0.2'},
+     '10.0.0.3'],
+    ['garbage', '10.0.0.1', {'x-forwarded-for': 'unknown, 203.0.113.9'},
+     '203.0.113.9'],
+    ['only garbage', '10.0.0.1', {'x-forwarded-for': 'unknown'}, '10.0.0.1'],
+    ['X-Real-IP', '10.0.0.1', {'x-real-ip': '203.0.113.9'}, '203.0.113.9'],
+    ['no header', '10.0.0.1', {}, '10.0.0.1'],
+  ];
+  for (const [name, peer, headers, expected] of cases) {
+    t.expect('forwardedFor(<' + name + '>)',
+             Proxies.forwardedFor(peer, headers, isTrusted), expected);
+  }
+};
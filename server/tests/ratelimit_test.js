@@ -0,0 +1,132 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for rate limiting.
+ */
+'use strict';
+
+const RateLimit = require('../ratelimit');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for RateLimit.Limiter.
+ * @param {!T} t The test runner object.
+ */
+exports.testRateLimitLimiter = function(t) {
+  const limiter = new RateLimit.Limiter({
+    exempt: ['127.0.0.1'],
+    login: {limit: 2},
+    custom: {limit: 1, period: 10, lockout: 100},
+  });
+  t.expect('Limiter policies.login', JSON.stringify(limiter.policies.login),
+           JSON.stringify({limit: 2, period: 5 * 60 * 1000,
+                           lockout: 15 * 60 * 1000}));
+  t.expect('Limiter policies.command.limit', limiter.policies.command.limit,
+           RateLimit.POLICIES.command.limit);
+
+  // Events within the limit are permitted; the one exceeding it starts
+  // a lockout, during which events are refused uncounted.
+  const results = [];
+  for (const now of [0, 20, 25, 30, 40, 126, 127]) {
+    results.push(limiter.record('custom', 'a', now));
+  }
+  t.expect('Limiter.p.record(...)', results.join(), '0,0,100,95,85,0,100');
+  t.expect('Limiter.p.record(<other key>)', limiter.record('custom', 'b', 5),
+           0);
+  t.expect('Limiter.p.check(<locked out>)', limiter.check('custom', 'a', 130),
+           97);
+  t.expect('Limiter.p.check(<not locked out>)',
+           limiter.check('custom', 'b', 5), 0);
+  limiter.reset('custom', 'a');
+  t.expect('Limiter.p.check(<reset>)', limiter.check('custom', 'a', 130), 0);
+  t.expect('Limiter.p.record(<reset>)', limiter.record('custom', 'a', 130),
+           0);
+
+  // Exempt keys are never limited.
+  for (let i = 0; i < 5; i++) limiter.record('custom', '127.0.0.1', 200);
+  t.expect('Limiter.p.record(<exempt>)',
+           limiter.record('custom', '127.0.0.1', 200), 0);
+  // Objects can be keys too.
+  const account = {};
+  limiter.record('login', account, 0);
+  limiter.record('login', account, 0);
+  t.expect('Limiter.p.record(<object>)', limiter.record('login', account, 0),
+           15 * 60 * 1000);
+  t.expect('Limiter.p.record(<equal object>)', limiter.record('login', {}, 0),
+           0);
+
+  limiter.sweep(10000);
+  t.expect('Limiter.p.sweep() keeps lockouts',
+           limiter.check('login', account, 10000) > 0, true);
+  t.expect('Limiter.p.sweep() discards stale entries',
+           /** @type {?} */(limiter).entries_.get('custom').size, 0);
+
+  try {
+    limiter.record('nonesuch', 'a');
+    t.fail('Limiter.p.record(<unknown policy>)', 'Did not throw');
+  } catch (e) {
+    t.expect('Limiter.p.record(<unknown policy>) throws', e.name,
+             'RangeError');
+  }
+};
+
+/**
+ * Unit tests for RateLimit.Limiter.prototype.configure.
+ * @param {!T} t The test runner object.
+ */
+exports.testRateLimitLimiterConfigure = function(t) {
+  const limiter = new RateLimit.Limiter({
+    exempt: [],
+    login: {limit: 1},
+    custom: {limit: 1, period: 10, lockout: 100},
+  });
+  limiter.record('login', 'a', 0);
+  t.expect('Limiter.p.record(<over limit>)', limiter.record('login', 'a', 0),
+           RateLimit.POLICIES.login.lockout);
+  limiter.record('custom', 'a', 0);
+  limiter.configure({exempt: ['b'], login: {lockout: 1000}});
+  t.expect('Limiter.p.configure(...) policies.login.limit',
+           limiter.policies.login.limit, RateLimit.POLICIES.login.limit);
+  t.expect('Limiter.p.configure(...) policies.login.lockout',
+           limiter.policies.login.lockout, 1000);
+  t.expect('Limiter.p.configure(...) policies.custom',
+           limiter.policies.custom, undefined);
+  t.expect('Limiter.p.configure(...) exempt', Array.from(limiter.exempt).join(),
+           'b');
+  t.expect('Limiter.p.check(<locked out before configure>)',
+           limiter.check('login', 'a', 1) > 0, true);
+  limiter.sweep(10000);  // Must not trip over the removed policy.
+  t.expect('Limiter.p.record(<newly exempt>)',
+           limiter.record('login', 'b', 0), 0);
+};
+
+/**
+ * Unit tests for the default RateLimit.Limiter configuration.
+ * @param {!T} t The test runner object.
+ */
+exports.testRateLimitLimiterDefaults = function(t) {
+  const limiter = new RateLimit.Limiter();
+  const {limit, lockout} = RateLimit.POLICIES.connect;
+  let wait = 0;
+  for (let i = 0; i <= limit; i++) {
+    wait = limiter.record('connect', '192.0.2.1', 0);
+    t.expect('Limiter.p.record(<loopback>) #' + i,
+             limiter.record('connect', '::1', 0), 0);
+  }
+  t.expect('Limiter.p.record(<over limit>)', wait, lockout);
+};
@@ -0,0 +1,76 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for regular expression execution limits.
+ */
+'use strict';
+
+const RegExpGuard = require('../regexp_guard');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for RegExpGuard.isLinear.
+ * @param {!T} t The test runner object.
+ */
+exports.testRegExpGuardIsLinear = function(t) {
+  const cases = [
+    [/(a+)+b/, true],
+    [/^(\w+\s?)*$/gm, true],
+    [/(a+)+\1b/, false],
+    [/(?=a)(a+)+b/, false],
+    [/(a+)+b/i, false],
+  ];
+  for (const [regexp, expected] of cases) {
+    t.expect('isLinear(' + regexp + ')', RegExpGuard.isLinear(regexp),
+             expected);
+  }
+};
+
+/**
+ * Unit tests for RegExpGuard.run.
+ * @param {!T} t The test runner object.
+ */
+exports.testRegExpGuardRun = function(t) {
+  const input = 'a'.repeat(40) + '!';
+  const cases = [/(a+)+b/, /(a+)+b/i, /^(a+)+\1b$/];
+  for (const regexp of cases) {
+    const name = 'run(' + regexp + ', <match>)';
+    const start = Date.now();
+    try {
+      const result = RegExpGuard.run(regexp, () => regexp.test(input), 100);
+      t.expect(name, result, false);
+    } catch (e) {
+      t.expect(name, String(e),
+               'RangeError: Regular expression took too long');
+    }
+    const elapsed = Date.now() - start;
+    if (elapsed > 1000) t.fail(name, 'took ' + elapsed + 'ms');
+  }
+  t.expect('run(/a+b/i, <no match>)',
+           RegExpGuard.run(/a+b/i, () => /a+b/i.test(input), 100), false);
+  t.expect('run(/a/, <match>)',
+           RegExpGuard.run(/a/, () => 'cat'.replace(/a/, 'u')), 'cut');
+  t.expect('run(\'a\', <match>)',
+           RegExpGuard.run('a', () => 'cat'.replace('a', 'o')), 'cot');
+  try {
+    RegExpGuard.run(/x/i, () => {throw new TypeError('oops');});
+    t.fail('run(..., <throws>)', 'did not throw');
+  } catch (e) {
+    t.expect('run(..., <throws>)', String(e), 'TypeError: oops');
+  }
+};
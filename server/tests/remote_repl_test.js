@@ -0,0 +1,181 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for the remote REPL.
+ */
+'use strict';
+
+const http = require('http');
+const RemoteRepl = require('../remote_repl');
+const stream = require('stream');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for RemoteRepl.format and RemoteRepl.formatObject.
+ * @param {!T} t The test runner object.
+ */
+exports.testRemoteReplFormat = function(t) {
+  const cases = [
+    [{type: 'undefined'}, 'undefined'],
+    [{type: 'null', value: null}, 'null'],
+    [{type: 'number', value: 42}, '42'],
+    [{type: 'number', value: 'NaN'}, 'NaN'],
+    [{type: 'string', value: 'a "b"'}, '"a \\"b\\""'],
+    [{type: 'object', class: 'Array', selector: null}, '[Array]'],
+    [{type: 'object', class: 'Object', selector: '$.widget'}, '$.widget'],
+    [{type: 'function', class: 'Function', selector: '$.f'}, '[Function $.f]'],
+    [{type: 'function', class: 'Function', selector: null}, '[Function]'],
+    [{type: 'object', class: 'Error', selector: null, message: 'oops'},
+     '[Error: oops]'],
+  ];
+  for (const [desc, want] of cases) {
+    t.expect('format(' + JSON.stringify(desc) + ')',
+             RemoteRepl.format(desc), want);
+  }
+  const value = (v) => ({value: {type: typeof v, value: v}});
+  t.expect('formatObject', RemoteRepl.formatObject({
+    type: 'object', class: 'Object', selector: '$.widget',
+    properties: {name: value('Widget'), 'odd key': value(1)},
+  }), '$.widget {\n  name: "Widget",\n  "odd key": 1,\n}');
+  t.expect('formatObject (empty Array)', RemoteRepl.formatObject({
+    type: 'object', class: 'Array', selector: '$.list', properties: {},
+  }), '$.list Array {}');
+};
+
+/**
+ * Unit tests for RemoteRepl.Client and RemoteRepl.start, against a fake
+ * admin API.
+ * @param {!T} t The test runner object.
+ */
+exports.testRemoteReplClient = async function(t) {
+  const requests = [];
+  const widget = {
+    type: 'object', class: 'Object', selector: '$.widget',
+    properties: {
+      count: {value: {type: 'number', value: 3}},
+      colour: {value: {type: 'string', value: 'red'}},
+      'not-an-identifier': {value: {type: 'number', value: 0}},
+    },
+  };
+  const server = http.createServer((req, res) => {
+    let body = '';
+    req.on('data', (data) => body += data);
+    req.on('end', () => {
+      requests.push(req.method + ' ' + req.url +
+                    (body ? ' ' + body : ''));
+      let status = 200;
+      let result;
+      if (req.headers['authorization'] !== 'Bearer secret') {
+        status = 401;
+        result = {error: 'Unauthorized'};
+      } else if (req.url === '/eval') {
+        const src = JSON.parse(body).src;
+        result = (src === '$.widget') ?
+            {thread: 1, threw: false,
+             value: {type: 'object', class: 'Object', selector: '$.widget'}} :
+            (src === 'oops') ?
+            {thread: 2, threw: true,
+             value: {type: 'object', class: 'Error', selector: null,
+                     message: 'oops is not defined'}} :
+            {thread: 3, threw: false, value: {type: 'number', value: 42}};
+      } else if (req.url === '/object?selector=%24.widget') {
+        result = widget;
+      } else if (req.url.startsWith('/objects?search=')) {
+        result = {objects: [{selector: '$', class: 'Object'},
+                            {selector: '$.widget', class: 'Object'},
+                            {selector: 'Object', class: 'Function'}],
+                  truncated: false};
+      } else {
+        status = 404;
+        result = {error: 'No such object'};
+      }
+      res.writeHead(status, {'Content-Type': 'application/json'});
+      res.end(JSON.stringify(result));
+    });
+  });
+  await new Promise((resolve) => server.listen(0, '127.0.0.1', resolve));
+  const url = 'http://127.0.0.1:' + server.address().port;
+  try {
+    const client = new RemoteRepl.Client(url, 'secret');
+    t.expect('evaluate (number)', await client.evaluate('6 * 7'), '42');
+    t.expect('evaluate (as owner) request', requests.pop(),
+             'POST /eval {"src":"6 * 7"}');
+    await client.evaluate('6 * 7', '$.alice');
+    t.expect('evaluate (as owner) request', requests.pop(),
+             'POST /eval {"src":"6 * 7","owner":"$.alice"}');
+    t.expect('evaluate (named object)', await client.evaluate('$.widget'),
+             '$.widget {\n  count: 3,\n  colour: "red",\n' +
+             '  "not-an-identifier": 0,\n}');
+    t.expect('evaluate (throws)', await client.evaluate('oops'),
+             'Uncaught [Error: oops is not defined]');
+
+    let [completions, text] = await client.complete('x = $.widget.c');
+    t.expect('complete property', JSON.stringify([completions, text]),
+             JSON.stringify([['$.widget.colour', '$.widget.count'],
+                             '$.widget.c']));
+    [completions] = await client.complete('$.widget.');
+    t.expect('complete (all properties)', completions.join(),
+             '$.widget.colour,$.widget.count');
+    [completions] = await client.complete('$.nothing.c');
+    t.expect('complete (no such object)', completions.length, 0);
+    [completions, text] = await client.complete('Obj');
+    t.expect('complete top-level name', JSON.stringify([completions, text]),
+             JSON.stringify([['Object'], 'Obj']));
+    [completions] = await client.complete('1 + ');
+    t.expect('complete (nothing to complete)', completions.length, 0);
+
+    const unauthorized = new RemoteRepl.Client(url, 'wrong');
+    try {
+      await unauthorized.evaluate('1');
+      t.fail('evaluate (wrong token)', 'did not reject');
+    } catch (e) {
+      t.expect('evaluate (wrong token)', e.message, 'Unauthorized');
+    }
+    try {
+      new RemoteRepl.Client('ftp://example.com/', 'secret');
+      t.fail('Client (ftp: URL)', 'did not throw');
+    } catch (e) {
+      t.expect('Client (ftp: URL)', e.name, 'TypeError');
+    }
+
+    // A whole session.
+    const input = new stream.PassThrough();
+    let output = '';
+    const sink = new stream.Writable({
+      write(chunk, encoding, callback) {
+        output += chunk;
+        callback();
+      },
+    });
+    const closed = new Promise((resolve) => {
+      RemoteRepl.start(client, {owner: '$.alice', input, output: sink})
+          .on('close', resolve);
+    });
+    input.write('6 * 7\n');
+    input.write('oops\n');
+    input.end();
+    await closed;
+    // Wait for the last line's evaluation to be printed.
+    await new Promise((resolve) => setTimeout(resolve, 100));
+    t.expect('session output', output,
+             '$.alice> 42\n$.alice> Uncaught [Error: oops is not defined]\n' +
+             '$.alice> ');
+  } finally {
+    server.close();
+  }
+};
@@ -0,0 +1,97 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for following a primary's saved state.
+ */
+'use strict';
+
+const Replica = require('../replica');
+const {T} = require('./testing');
+
+/**
+ * A stand-in for an Interpreter, recording what is done to it.
+ */
+class FakeInterpreter {
+  /** @param {string} name Name, for the log. */
+  constructor(name) {
+    this.name = name;
+    this.log = [];
+  }
+  start() {this.log.push('start');}
+  stop() {this.log.push('stop');}
+  closeConnections() {this.log.push('closeConnections');}
+}
+
+/**
+ * Unit tests for Replica.Follower.
+ * @param {!T} t The test runner object.
+ */
+exports.testReplicaFollower = async function(t) {
+  const first = new FakeInterpreter('first');
+  let signature = 'a.city:100';
+  let loads = 0;
+  let fail = false;
+  let broken = false;
+  const replaced = [];
+  const follower = new Replica.Follower(first, signature, {
+    signature: () => {
+      if (broken) throw new Error('ENOENT');
+      return signature;
+    },
+    load: () => {
+      loads++;
+      return fail ? Promise.reject(new Error('Gone')) :
+          Promise.resolve(new FakeInterpreter('copy' + loads));
+    },
+    replaced: (intrp, old) => replaced.push(intrp.name + '<' + old.name),
+  });
+
+  // Nothing new saved.
+  t.expect('poll() (unchanged)', await follower.poll(), false);
+  t.expect('loads (unchanged)', loads, 0);
+
+  // Something new saved.
+  signature = 'a.city:100 a.0.wal:50';
+  t.expect('poll() (changed)', await follower.poll(), true);
+  t.expect('follower.intrp', follower.intrp.name, 'copy1');
+  t.expect('old interpreter', first.log.join(), 'stop,closeConnections');
+  t.expect('new interpreter', follower.intrp.log.join(), 'start');
+  t.expect('replaced', replaced.join(), 'copy1<first');
+  t.expect('refreshes', follower.refreshes, 1);
+  t.expect('poll() (again unchanged)', await follower.poll(), false);
+
+  // Loading fails: the current copy continues to be used.
+  signature = 'b.city:200';
+  fail = true;
+  t.expect('poll() (load fails)', await follower.poll(), false);
+  t.expect('follower.intrp (load failed)', follower.intrp.name, 'copy1');
+  fail = false;
+  t.expect('poll() (retry)', await follower.poll(), true);
+  t.expect('follower.intrp (retried)', follower.intrp.name, 'copy3');
+
+  // Only one load at a time.
+  signature = 'c.city:300';
+  const polling = follower.poll();
+  t.expect('poll() (while loading)', await follower.poll(), false);
+  t.expect('poll() (loaded)', await polling, true);
+  t.expect('loads', loads, 4);
+
+  // The signature cannot be determined.
+  broken = true;
+  t.expect('poll() (signature throws)', await follower.poll(), false);
+};
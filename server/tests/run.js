@@ -28,18 +28,76 @@
 // require statements with arguments that are not a string literal.
 const compileTargets = [
   require('../codecity'),
+  require('./accounts_test'),
+  require('./acme_test'),
+  require('./activation_test'),
+  require('./admin_test'),
+  require('./adminlog_test'),
+  require('./backup_test'),
+  require('./bans_test'),
+  require('./blobs_test'),
+  require('./binpack_test'),
+  require('./certificates_test'),
   require('./code_test'),
+  require('./command_test'),
+  require('./compression_test'),
+  require('./config_test'),
+  require('./control_test'),
+  require('./cryptography_test'),
+  require('./csv_test'),
+  require('./der_test'),
+  require('./devtools_test'),
   require('./dump_test'),
+  require('./diff_test'),
   require('./dumper_test'),
+  require('./edit_test'),
+  require('./envelope_test'),
+  require('./explorer_test'),
+  require('./federation_test'),
+  require('./flatpack_test'),
+  require('./grpc_test'),
+  require('./health_test'),
+  require('./heap_test'),
+  require('./html_test'),
+  require('./idle_test'),
+  require('./inspect_test'),
   require('./interpreter_test'),
   require('./interpreter_unit_test'),
   require('./interpreter_test'),
   require('./iterable_weakmap_test'),
   require('./iterable_weakset_test'),
+  require('./journal_test'),
+  require('./lint_test'),
+  require('./logging_test'),
+  require('./mail_test'),
+  require('./markdown_test'),
+  require('./metrics_test'),
+  require('./migrate_test'),
+  require('./modules_test'),
+  require('./moo_test'),
+  require('./package_test'),
+  require('./packages_test'),
   require('./registry_test'),
   require('./priorityqueue_test'),
+  require('./pronouns_test'),
+  require('./proxies_test'),
+  require('./ratelimit_test'),
+  require('./regexp_guard_test'),
+  require('./remote_repl_test'),
+  require('./replica_test'),
   require('./selector_test'),
   require('./serialize_test'),
+  require('./sessions_test'),
+  require('./snapshot_test'),
+  require('./sse_test'),
+  require('./stats_test'),
+  require('./store_test'),
+  require('./telnet_test'),
+  require('./text_test'),
+  require('./tiers_test'),
+  require('./websocket_test'),
+  require('./worlds_test'),
+  require('./xml_test'),
 
   require('./interpreter_bench'),
   require('./serialize_bench'),
@@ -152,6 +152,8 @@ exports.benchRoundtrip = function(b) {
     // Hack to install stubs for builtins found in codecity.js.
     const builtins = [
       'CC.log', 'CC.checkpoint', 'CC.shutdown', 'CC.hash',
+      'CC.checkpoints', 'CC.restoreCheckpoint', 'CC.exportPackage',
+      'CC.importPackage', 'CC.exportOwned', 'CC.importOwned',
       'CC.acorn.parse', 'CC.acorn.parseExpressionAt',
     ];
     for (const bi of builtins) {
@@ -21,6 +21,7 @@
  */
 'use strict';
 
+const http = require('http');
 const net = require('net');
 const util = require('util');
 
@@ -332,6 +333,42 @@ exports.testRoundtripWeakMap = function(t) {
   `, 105 - 42);
 };
 
+/**
+ * Run a round trip of serializing Buffers.
+ * @param {!T} t The test runner object.
+ */
+exports.testRoundtripBuffer = function(t) {
+  runTest(t, 'testRoundtripBuffer', `
+      var buf = Buffer.from('héllo');
+      var slice = buf.slice(1, 3);
+      buf.extra = 'x';
+  `, '', `
+      [buf instanceof Buffer, buf.length, buf.toString(), slice.toString(),
+       buf.extra].join();
+  `, 'true,6,héllo,é,x');
+};
+
+/**
+ * Run a round trip of serializing thread-local storage and
+ * cancellation state.
+ * @param {!T} t The test runner object.
+ */
+exports.testRoundtripThreadLocals = function(t) {
+  runTest(t, 'testRoundtripThreadLocals', `
+      var obj = {};
+      var worker = new Thread(function() {
+        var t = Thread.current();
+        t.setLocal('obj', obj);
+        t.setLocal('n', 42);
+        t.cancel();
+        suspend(1000000);
+      });
+  `, 'suspend();', `
+      worker.cancelled && worker.getLocal('obj') === obj &&
+          worker.getLocal('n');
+  `, 42, {steps: 1});
+};
+
 /**
  * Run more detailed tests of the state of the post-rountrip interpreter.
  * @param {!T} t The test runner object.
@@ -464,6 +501,506 @@ exports.testRoundtripDetails = function(t) {
 
 };
 
+/**
+ * Run tests of incremental serialization: make some changes between
+ * a full and an incremental serialization, merge the two, and check
+ * that the result deserializes to the expected state.
+ * @param {!T} t The test runner object.
+ */
+exports.testSerializeIncremental = function(t) {
+  const name = 'testSerializeIncremental';
+  const src1 = `
+      var unchanged = {a: 1};
+      var obj = {a: 1, b: 2};
+      var arr = [1, 2, 3];
+      var wm = new WeakMap;
+      var date = new Date(0);
+      var proto = {};
+      var child = {};
+      var frozen = {x: 1};
+      var counter = 0;
+      var deleteMe = {};
+  `;
+  const src2 = `
+      obj.a = 'changed';
+      delete obj.b;
+      arr.push(4);
+      wm.set(unchanged, 'value');
+      date.setTime(1000);
+      Object.setPrototypeOf(child, proto);
+      Object.preventExtensions(frozen);
+      var added = {created: true};
+      counter++;
+      deleteMe = undefined;
+  `;
+  const src3 = `
+      [unchanged.a, obj.a, 'b' in obj, String(arr), wm.get(unchanged),
+       date.getTime(), Object.getPrototypeOf(child) === proto,
+       Object.isExtensible(frozen), added.created, counter, deleteMe].join();
+  `;
+  const expected = '1,changed,false,1,2,3,4,value,1000,true,false,true,1,';
+
+  const intrp = getInterpreter();
+  const inc = new Serializer.Incremental();
+  let json, delta;
+  try {
+    intrp.createThreadForSrc(src1);
+    intrp.run();
+    const first = Serializer.serializeIncremental(intrp, inc);
+    t.assert(name + ': first serialization is full', first.full);
+    json = first.json;
+    intrp.createThreadForSrc(src2);
+    intrp.run();
+    const second = Serializer.serializeIncremental(intrp, inc);
+    t.assert(name + ': second serialization is incremental', !second.full);
+    delta = second.json;
+    t.assert(name + ': incremental serialization is smaller',
+        delta.length < json.length / 2);
+    Serializer.merge(json, JSON.parse(JSON.stringify(delta)));
+  } catch (e) {
+    t.crash(name, e);
+    return;
+  }
+
+  let intrp2;
+  try {
+    intrp2 = new Interpreter;
+    Serializer.deserialize(JSON.parse(JSON.stringify(json)), intrp2);
+    intrp2.pause();
+    const thread = intrp2.createThreadForSrc(src3).thread;
+    intrp2.run();
+    t.expect(name, intrp2.pseudoToNative(thread.value), expected,
+        util.format('%s\n/* full */\n%s\n/* incremental */\n%s',
+                    src1, src2, src3));
+  } catch (e) {
+    t.crash(name + 'Post', e);
+  }
+
+  // After a reset, next serialization should be full again.
+  inc.reset();
+  t.assert(name + ': serialization after reset is full',
+      Serializer.serializeIncremental(intrp, inc).full);
+};
+
+/**
+ * Run tests of streaming serialization and deserialization: records
+ * passed to an emit callback should be the same as those returned
+ * otherwise, and should deserialize correctly record by record, even
+ * in reverse order (so that every reference is a forward reference).
+ * @param {!T} t The test runner object.
+ */
+exports.testSerializeStreaming = function(t) {
+  const name = 'testSerializeStreaming';
+  const src1 = `
+      var proto = {p: 'inherited'};
+      var obj = Object.create(proto);
+      obj.self = obj;
+      Object.defineProperty(obj, 'fixed', {value: proto});
+      var wm = new WeakMap;
+      wm.set(obj, proto);
+      Object.preventExtensions(obj);
+  `;
+  const src3 = `
+      [obj.p, obj.self === obj, obj.fixed === proto,
+       Object.getOwnPropertyDescriptor(obj, 'fixed').writable,
+       Object.isExtensible(obj), wm.get(obj) === proto].join();
+  `;
+  const expected = 'inherited,true,true,false,false,true';
+
+  const intrp = getInterpreter();
+  let records;
+  try {
+    intrp.createThreadForSrc(src1);
+    intrp.run();
+    intrp.pause();
+    const json = Serializer.serialize(intrp);
+    records = [];
+    const returned = Serializer.serialize(intrp, function(record) {
+      records.push(record);
+    });
+    t.expect(name + ': nothing returned when emitting', returned.length, 0);
+    t.expect(name + ': emitted records', JSON.stringify(records),
+             JSON.stringify(json));
+  } catch (e) {
+    t.crash(name, e);
+    return;
+  }
+
+  try {
+    const intrp2 = new Interpreter;
+    const deserializer = new Serializer.Deserializer(intrp2);
+    for (let i = records.length - 1; i >= 0; i--) {
+      deserializer.add(JSON.parse(JSON.stringify(records[i])));
+    }
+    deserializer.finish();
+    intrp2.pause();
+    const thread = intrp2.createThreadForSrc(src3).thread;
+    intrp2.run();
+    t.expect(name, intrp2.pseudoToNative(thread.value), expected,
+        util.format('%s\n/* serialize in reverse */\n%s', src1, src3));
+  } catch (e) {
+    t.crash(name + 'Post', e);
+  }
+
+  // Missing and duplicate records are detected.
+  const cases = {
+    'missing record': records.slice(0, -1).concat([{'#': records.length}]),
+    'duplicate record': records.concat([records[1]]),
+    'dangling reference': records.concat(
+        [{'#': records.length, 'type': 'Object', 'props': {'x': {'#': 1e6}}}]),
+  };
+  for (const c in cases) {
+    try {
+      const deserializer = new Serializer.Deserializer(new Interpreter);
+      for (const record of cases[c]) {
+        deserializer.add(JSON.parse(JSON.stringify(record)));
+      }
+      deserializer.finish();
+      t.fail(name + ': ' + c, "Didn't throw.");
+    } catch (e) {
+      t.pass(name + ': ' + c);
+    }
+  }
+};
+
+/**
+ * Run tests of background serialization using Serializer.Snapshot:
+ * the records emitted should reflect the state of the interpreter
+ * when the snapshot was taken, even if objects are modified before
+ * they are serialized.
+ * @param {!T} t The test runner object.
+ */
+exports.testSerializeSnapshot = function(t) {
+  const name = 'testSerializeSnapshot';
+  const src1 = `
+      var obj = {a: 1, b: 2};
+      var arr = [1, 2, 3];
+      var wm = new WeakMap;
+      var date = new Date(0);
+      var proto = {};
+      var child = {};
+      var open = {x: 1};
+      var counter = 0;
+      wm.set(obj, 'before');
+  `;
+  const src2 = `
+      obj.a = 'changed';
+      delete obj.b;
+      arr.push(4);
+      wm.set(obj, 'after');
+      date.setTime(1000);
+      Object.setPrototypeOf(child, proto);
+      Object.preventExtensions(open);
+      var added = {created: true};
+      counter++;
+  `;
+  const src3 = `
+      [obj.a, obj.b, String(arr), wm.get(obj), date.getTime(),
+       Object.getPrototypeOf(child) === proto, Object.isExtensible(open),
+       typeof added, counter].join();
+  `;
+  const before = '1,2,1,2,3,before,0,false,true,undefined,0';
+  const after = 'changed,,1,2,3,4,after,1000,true,false,object,1';
+
+  const check = function(label, json, src, expected) {
+    try {
+      const intrp2 = new Interpreter;
+      Serializer.deserialize(JSON.parse(JSON.stringify(json)), intrp2);
+      intrp2.pause();
+      const thread = intrp2.createThreadForSrc(src).thread;
+      intrp2.run();
+      t.expect(name + ': ' + label, intrp2.pseudoToNative(thread.value),
+          expected, util.format('%s\n/* snapshot */\n%s\n%s', src1, src2, src));
+    } catch (e) {
+      t.crash(name + ': ' + label, e);
+    }
+  };
+
+  // Full snapshot, with the program modifying objects partway through.
+  const intrp = getInterpreter();
+  const inc = new Serializer.Incremental();
+  let json;
+  try {
+    intrp.createThreadForSrc(src1);
+    intrp.run();
+    intrp.pause();
+    // Take the first snapshot of a series, with tracking enabled.
+    Serializer.serializeIncremental(intrp, new Serializer.Incremental());
+    json = [];
+    const snapshot =
+        new Serializer.Snapshot(intrp, json.push.bind(json), inc);
+    t.assert(name + ': first snapshot is full', snapshot.full);
+    t.assert(name + ': snapshot not complete immediately',
+        !snapshot.step(0));
+    intrp.createThreadForSrc(src2);
+    intrp.run();
+    t.assert(name + ': snapshot complete', snapshot.step());
+    t.assert(name + ': tracking restored',
+        intrp.dirtyObjects instanceof Set &&
+        intrp.dirtyObjects.constructor === Set);
+    json.sort((a, b) => a['#'] - b['#']);
+  } catch (e) {
+    t.crash(name, e);
+    return;
+  }
+  check('full', json, src3, before);
+
+  // An incremental snapshot records the changes made since, and
+  // tracks the ones made while it is in progress for the next.
+  try {
+    intrp.pause();
+    const delta = [];
+    const snapshot =
+        new Serializer.Snapshot(intrp, delta.push.bind(delta), inc);
+    t.assert(name + ': second snapshot is incremental', !snapshot.full);
+    intrp.createThreadForSrc('obj.a = "again";');
+    intrp.run();
+    snapshot.step();
+    Serializer.merge(json, JSON.parse(JSON.stringify(delta)));
+    check('incremental', json, src3, after);
+    intrp.pause();
+    const third = Serializer.serializeIncremental(intrp, inc);
+    t.assert(name + ': third serialization is incremental', !third.full);
+    Serializer.merge(json, JSON.parse(JSON.stringify(third.json)));
+    check('incremental after', json, 'obj.a', 'again');
+  } catch (e) {
+    t.crash(name + ': incremental', e);
+  }
+
+  // Without tracking, dirtyObjects is left as it was found.
+  try {
+    const intrp2 = getInterpreter();
+    intrp2.createThreadForSrc(src1);
+    intrp2.run();
+    intrp2.pause();
+    const snapshot = new Serializer.Snapshot(intrp2, function() {});
+    snapshot.abort();
+    t.expect(name + ': untracked', intrp2.dirtyObjects, null);
+  } catch (e) {
+    t.crash(name + ': untracked', e);
+  }
+};
+
+/**
+ * Run tests of lazy loading using Serializer.LazyLoader: objects'
+ * contents should be loaded when used, saved incrementally when
+ * changed, and reloaded after being evicted.
+ * @param {!T} t The test runner object.
+ */
+exports.testSerializeLazyLoader = function(t) {
+  const name = 'testSerializeLazyLoader';
+  const src1 = `
+      var proto = {a: 1};
+      var child = Object.create(proto);
+      var arr = [1, 2, 3];
+      var obj = {b: 2};
+      var unused = {c: 3};
+  `;
+  const run = function(intrp, src) {
+    const thread = intrp.createThreadForSrc(src).thread;
+    intrp.run();
+    return intrp.pseudoToNative(thread.value);
+  };
+  // The store: records by ID.
+  let store;
+  const fetch = (id) => store[id] && JSON.parse(JSON.stringify(store[id]));
+
+  try {
+    const intrp = getInterpreter();
+    intrp.createThreadForSrc(src1);
+    intrp.run();
+    store = JSON.parse(JSON.stringify(Serializer.serialize(intrp)));
+  } catch (e) {
+    t.crash(name, e);
+    return;
+  }
+
+  const intrp2 = new Interpreter;
+  const loader = new Serializer.LazyLoader(intrp2, fetch, store.length);
+  try {
+    loader.load();
+    intrp2.pause();
+    const faults = loader.faults;
+    t.expect(name + ': load', run(intrp2, 'child.a + arr.length'), 4);
+    t.assert(name + ': faults', loader.faults > faults);
+  } catch (e) {
+    t.crash(name + ': load', e);
+    return;
+  }
+
+  try {
+    run(intrp2, 'obj.b = "changed"; arr.push(4); var added = {d: 4};');
+    const inc = loader.incremental;
+    const result = Serializer.serializeIncremental(intrp2, inc);
+    t.assert(name + ': incremental', !result.full);
+    t.assert(name + ': incremental serialization is smaller',
+        result.json.length < store.length / 2);
+    t.assert(name + ': IDs', result.json.every(
+        (record) => !(record['#'] in store) ||
+            record['type'] === store[record['#']]['type']));
+    Serializer.merge(store, JSON.parse(JSON.stringify(result.json)));
+    loader.saved(false);
+    t.assert(name + ': evict', loader.evict(0) > 0);
+    const faults = loader.faults;
+    t.expect(name + ': refault',
+        run(intrp2, '[child.a, obj.b, String(arr), added.d].join()'),
+        '1,changed,1,2,3,4,4');
+    t.assert(name + ': refaults', loader.faults > faults);
+  } catch (e) {
+    t.crash(name + ': incremental', e);
+  }
+
+  try {
+    const intrp3 = new Interpreter;
+    Serializer.deserialize(JSON.parse(JSON.stringify(store)), intrp3);
+    intrp3.pause();
+    t.expect(name + ': merged',
+        run(intrp3, '[child.a, obj.b, String(arr), added.d, unused.c].join()'),
+        '1,changed,1,2,3,4,4,3');
+  } catch (e) {
+    t.crash(name + ': merged', e);
+  }
+
+  try {
+    const inc = loader.incremental;
+    inc.reset();
+    const result = Serializer.serializeIncremental(intrp2, inc);
+    t.assert(name + ': full', result.full);
+    store = JSON.parse(JSON.stringify(result.json));
+    loader.saved(true);
+    loader.evict(0);
+    run(intrp2, 'obj.b = "again"');
+    t.expect(name + ': after full',
+        run(intrp2, '[child.a, obj.b, String(arr), unused.c].join()'),
+        '1,again,1,2,3,4,3');
+  } catch (e) {
+    t.crash(name + ': full', e);
+  }
+};
+
+/**
+ * Unit tests for deterministic serialization and
+ * Serializer.canonicalize: serializations of the same state should be
+ * identical, however that state was arrived at and saved.
+ * @param {!T} t The test runner object.
+ */
+exports.testSerializeCanonicalize = function(t) {
+  const name = 'testSerializeCanonicalize';
+  const text = (json) => json.map((record) => JSON.stringify(record)).join();
+  const copy = (json) => JSON.parse(JSON.stringify(json));
+  const make = function(src) {
+    const intrp = getInterpreter();
+    intrp.createThreadForSrc(`
+        var wm = new WeakMap;
+        var k1 = {}, k2 = {};
+        var obj = {a: 1};
+        var garbage = {b: 2};
+    ` + src);
+    intrp.run();
+    return intrp;
+  };
+  try {
+    // Order in which WeakMap entries were added can't be observed.
+    const intrp = make('wm.set(k1, {v: 1}); wm.set(k2, {v: 2});');
+    const json = Serializer.serialize(intrp);
+    t.expect(name + ': WeakMap order', text(json), text(Serializer.serialize(
+        make('wm.set(k2, {v: 2}); wm.set(k1, {v: 1});'))));
+    t.expect(name + ': full is canonical',
+             text(Serializer.canonicalize(copy(json))), text(copy(json)));
+
+    // Deserializing and reserializing changes nothing (except status).
+    const intrp2 = new Interpreter;
+    Serializer.deserialize(copy(json), intrp2);
+    t.expect(name + ': roundtrip', text(Serializer.serialize(intrp2).slice(1)),
+             text(json.slice(1)));
+    intrp2.pause();
+    const thread = intrp2.createThreadForSrc('typeof hasOwnProperty').thread;
+    intrp2.run();
+    t.expect(name + ': null prototypes preserved', thread.value, 'undefined');
+
+    // Merged incremental serializations are canonicalized (dropping
+    // records of unreachable objects) into the full serialization.
+    const inc = new Serializer.Incremental();
+    const merged = copy(Serializer.serializeIncremental(intrp, inc).json);
+    intrp.createThreadForSrc(
+        'garbage = null; obj.a = 2; obj.c = [3]; wm.set(obj, 4);');
+    intrp.run();
+    Serializer.merge(merged,
+                     copy(Serializer.serializeIncremental(intrp, inc).json));
+    const full = copy(Serializer.serialize(intrp));
+    const canonical = Serializer.canonicalize(merged);
+    t.assert(name + ': garbage dropped', canonical.length < merged.length);
+    t.expect(name + ': incremental', text(canonical), text(full));
+    t.expect(name + ': any order',
+             text(Serializer.canonicalize(merged.slice().reverse())),
+             text(full));
+  } catch (e) {
+    t.crash(name, e);
+  }
+  try {
+    Serializer.canonicalize([{'#': 0, 'type': 'Interpreter',
+                              'props': {'x': {'#': 1}}}]);
+    t.fail(name + ': missing record', "Didn't throw.");
+  } catch (e) {
+    t.pass(name + ': missing record');
+  }
+};
+
+/**
+ * Unit tests for Serializer.Verifier.
+ * @param {!T} t The test runner object.
+ */
+exports.testSerializeVerifier = function(t) {
+  const name = 'testSerializeVerifier';
+  const intrp = getInterpreter();
+  intrp.createThreadForSrc(
+      'var obj = {a: [1, 2]}; var wm = new WeakMap; wm.set(obj, 1);');
+  intrp.run();
+  intrp.pause();
+  const json = Serializer.serialize(intrp);
+  const verify = function(records) {
+    const verifier = new Serializer.Verifier(new Interpreter);
+    for (const record of records) {
+      verifier.add(record);
+    }
+    return verifier.finish();
+  };
+  t.expect(name + ': good', verify(json).join('\n'), '');
+
+  const copy = () => JSON.parse(JSON.stringify(json));
+  const pseudo = json.filter((r) => r['type'] === 'PseudoObject' &&
+      r['props']['proto'] && r['props']['proto']['#'] !== undefined)[0];
+  const id = pseudo['#'];
+  const protoId = pseudo['props']['proto']['#'];
+  const bad = {
+    'dangling reference': [(records) => {
+      records[0]['props']['dangling'] = {'#': records.length + 10};
+    }, /Object reference not found: \d+ \(from object 0\)/],
+    'missing record': [(records) => {
+      records.splice(id, 1);
+    }, new RegExp('Missing record for object ' + id)],
+    'duplicate record': [(records) => {
+      records.push(records[id]);
+    }, new RegExp('Duplicate record for object ' + id)],
+    'unknown type': [(records) => {
+      records[id]['type'] = 'Bogus';
+    }, /Unknown type tag "Bogus"/],
+    'prototype cycle': [(records) => {
+      records[protoId]['props']['proto'] = {'#': id};
+    }, /Prototype cycle includes object/],
+  };
+  for (const label in bad) {
+    try {
+      const records = copy();
+      bad[label][0](records);
+      const problems = verify(records).join('\n');
+      t.assert(name + ': ' + label, bad[label][1].test(problems), problems);
+    } catch (e) {
+      t.crash(name + ': ' + label, e);
+    }
+  }
+};
+
 /**
  * Run tests of post-roundtrip interpreter timers & networking state.
  * @param {!T} t The test runner object.
@@ -545,4 +1082,65 @@ exports.testRoundtripAsync = async function(t) {
     onCreate: blockPort,
   });
   server.close();
+
+  // Run a test to verify that a connected object's .onReattach method
+  // is called when the connection no longer exists after the
+  // interpreter is deserialized, and that it can then be closed
+  // (harmlessly) but not written to.
+  name = 'testPostRestoreConnectionReattach';
+  src1 = `
+      var conn = {};
+      conn.onConnect = function() {
+        resolve();  // Start serialisation roundtrip.
+      };
+      conn.onReattach = function(error) {
+        var result = error.message;
+        CC.connectionClose(this);
+        try {
+          CC.connectionWrite(this, 'data');
+        } catch (e) {
+          result += ' / ' + e.message;
+        }
+        CC.connectionUnlisten(8888);
+        resolve(result.replace(/from [^ ]*/g, 'from X'));
+      };
+      CC.connectionListen(8888, conn);
+      connect();
+  `;
+  let /** ?net.Socket */ client = null;
+  const installConnect = function(intrp) {
+    intrp.global.createMutableBinding('connect', intrp.createNativeFunction(
+        'connect', function() {
+          client = net.createConnection({port: 8888});
+        }));
+  };
+  await runAsyncTest(t, name, src1, '',
+      'connection from X no longer exists / ' +
+      'connection from X no longer exists',
+      {options: {noLog: ['net']}, onCreate: installConnect});
+  if (client) client.destroy();
+
+  // Run a test to verify that a thread blocked waiting for a host
+  // operation (here, an XHR that never completes) when the interpreter
+  // is serialized has an error thrown in it after deserialization.
+  name = 'testPostRestoreOperationInterrupted';
+  src1 = `
+      var result = 'Not interrupted';
+      setTimeout(resolve, 10);  // Start serialisation roundtrip.
+      try {
+        CC.xhr('http://localhost:8888/');
+      } catch (e) {
+        result = e.message;
+      }
+  `;
+  src2 = `
+      setTimeout(function() {resolve(result);}, 10);
+  `;
+  const hang = http.createServer(function() {});  // Never responds.
+  await new Promise((res) => hang.listen(8888, res));
+  await runAsyncTest(t, name, src1, src2,
+      'XHR for http://localhost:8888/ interrupted by server restart',
+      {options: {noLog: ['net']}});
+  hang.closeAllConnections();
+  hang.close();
 };
@@ -0,0 +1,207 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for sessions that survive reconnection.
+ */
+'use strict';
+
+const events = require('events');
+const Sessions = require('../sessions');
+const {T} = require('./testing');
+
+/**
+ * A fake connection, recording what is written to it.
+ */
+class FakeConnection extends events.EventEmitter {
+  /** @param {string} address Remote address. */
+  constructor(address) {
+    super();
+    this.remoteAddress = address;
+    this.remotePort = 1234;
+    this.written = '';
+    this.ended = false;
+    this.destroyed = false;
+  }
+
+  /**
+   * @param {string} data
+   * @return {boolean}
+   */
+  write(data) {
+    this.written += data;
+    return true;
+  }
+
+  end() {
+    this.ended = true;
+  }
+
+  destroy() {
+    this.destroyed = true;
+  }
+}
+
+/**
+ * Record the events emitted by a session.
+ * @param {!Sessions.Session} session
+ * @return {!Array<string>} Log of events (updated as they happen).
+ */
+function record(session) {
+  const log = [];
+  for (const name of ['data', 'end', 'close', 'detach', 'resume']) {
+    session.on(name, (data) => log.push(data ? name + ' ' + data : name));
+  }
+  return log;
+}
+
+/**
+ * Unit tests for Sessions.Registry and Sessions.Session.
+ * @param {!T} t The test runner object.
+ */
+exports.testSessions = async function(t) {
+  const token = Sessions.newToken();
+  t.assert('newToken()', /^[0-9a-f]{32}$/.test(token), token);
+  t.assert('newToken() unique', Sessions.newToken() !== token);
+
+  const registry = new Sessions.Registry();
+  const first = new FakeConnection('192.0.2.1');
+  const session = registry.create(first, token, 20, 'id1');
+  const log = record(session);
+  t.expect('session.remoteAddress', session.remoteAddress, '192.0.2.1');
+  t.expect('registry.size', registry.size, 1);
+  t.assert('session.isConnected()', session.isConnected());
+  t.expect('registry.find(token) while connected',
+           registry.find(token, 'id1'), null);
+
+  session.write('a');
+  first.emit('data', 'x');
+  t.expect('first.written', first.written, 'a');
+
+  // Connection lost: output is kept until the client reconnects.
+  first.emit('close');
+  t.assert('first.destroyed', first.destroyed);
+  t.assert('!session.isConnected()', !session.isConnected());
+  session.write('b');
+  session.write('c');
+  t.expect('first.written after close', first.written, 'a');
+  t.expect('registry.find(token, <wrong identity>)',
+           registry.find(token, 'id2'), null);
+  t.expect('registry.find(<wrong token>)',
+           registry.find(Sessions.newToken(), 'id1'), null);
+  t.expect('registry.find(undefined)', registry.find(undefined, 'id1'), null);
+  t.expect('registry.find(token)', registry.find(token, 'id1'), session);
+
+  const second = new FakeConnection('192.0.2.2');
+  session.resume(second);
+  t.expect('second.written', second.written, 'bc');
+  t.expect('session.remoteAddress after resume',
+           session.remoteAddress, '192.0.2.2');
+  first.emit('data', 'ignored');
+  second.emit('data', 'y');
+  // Waiting beyond the grace period does not matter once resumed.
+  await new Promise((resolve) => setTimeout(resolve, 40));
+  t.expect('events', log.join(), 'data x,detach,resume,data y');
+
+  // Ending the session ends the connection; the session ends when
+  // it closes.
+  session.end();
+  t.assert('second.ended', second.ended);
+  session.write('discarded');
+  second.emit('close');
+  t.expect('events after end', log.join(),
+           'data x,detach,resume,data y,close');
+  t.expect('registry.size after end', registry.size, 0);
+  t.expect('second.written after end', second.written, 'bc');
+};
+
+/**
+ * Unit tests for sessions whose clients do not reconnect in time.
+ * @param {!T} t The test runner object.
+ */
+exports.testSessionsExpiry = async function(t) {
+  const registry = new Sessions.Registry();
+  const token = Sessions.newToken();
+  const connection = new FakeConnection('192.0.2.1');
+  const session = registry.create(connection, token, 10);
+  const log = record(session);
+  try {
+    registry.create(new FakeConnection('192.0.2.2'), token, 10);
+    t.fail('registry.create(<duplicate token>)', "Didn't throw.");
+  } catch (e) {
+    t.pass('registry.create(<duplicate token>)');
+  }
+
+  connection.emit('error', new Error('ECONNRESET'));
+  connection.emit('close');
+  t.expect('registry.find(token)', registry.find(token), session);
+  await new Promise((resolve) => setTimeout(resolve, 40));
+  t.expect('events', log.join(), 'detach,end,close');
+  t.expect('registry.size', registry.size, 0);
+  t.expect('registry.find(token) after expiry', registry.find(token), null);
+  try {
+    session.resume(new FakeConnection('192.0.2.2'));
+    t.fail('session.resume() after expiry', "Didn't throw.");
+  } catch (e) {
+    t.pass('session.resume() after expiry');
+  }
+
+  // Ending a session awaiting reconnection closes it immediately.
+  const third = new FakeConnection('192.0.2.3');
+  const other = registry.create(third, Sessions.newToken(), 1000);
+  const otherLog = record(other);
+  third.emit('end');
+  third.emit('close');
+  other.end();
+  t.expect('events (ended while detached)', otherLog.join(), 'detach,close');
+  t.expect('registry.size (ended while detached)', registry.size, 0);
+
+  // Writing too much while detached ends the session.
+  const fourth = new FakeConnection('192.0.2.4');
+  const full = registry.create(fourth, Sessions.newToken(), 1000);
+  const fullLog = record(full);
+  fourth.emit('close');
+  full.write('x'.repeat(Sessions.MAX_BUFFERED + 1));
+  t.expect('events (overflow)', fullLog.join(), 'detach,end,close');
+  t.expect('registry.size (overflow)', registry.size, 0);
+};
+
+/**
+ * Unit tests for binary messages kept for sessions' clients.
+ * @param {!T} t The test runner object.
+ */
+exports.testSessionsBinary = function(t) {
+  const registry = new Sessions.Registry();
+  const first = new FakeConnection('192.0.2.1');
+  first.binary = true;
+  const session = registry.create(first, Sessions.newToken(), 1000);
+  const log = record(session);
+  t.expect('session.binary', session.binary, true);
+  first.emit('close');
+  session.write('a');
+  session.write(Buffer.from('b'));
+  session.write('c');
+
+  // The new connection does not accept binary messages.
+  const second = new FakeConnection('192.0.2.2');
+  session.resume(second, 'info');
+  t.expect('session.binary after resume', session.binary, false);
+  t.expect('second.written', second.written, 'ac');
+  t.expect('events', log.join(), 'detach,resume info');
+  session.end();
+  second.emit('close');
+};
@@ -0,0 +1,99 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for startup snapshots.
+ */
+'use strict';
+
+const fs = require('fs');
+const Interpreter = require('../interpreter');
+const os = require('os');
+const packageJson = require('../package.json');
+const path = require('path');
+const Snapshot = require('../snapshot');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Snapshot.startupFiles and Snapshot.find.
+ * @param {!T} t The test runner object.
+ */
+exports.testSnapshotFind = function(t) {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'snapshot_test-'));
+  try {
+    for (const file of ['core_10_b.js', 'core_00_a.js', 'db_x.js', 'x.js',
+                        'core.txt']) {
+      fs.writeFileSync(path.join(dir, file), '');
+    }
+    t.expect('startupFiles', Snapshot.startupFiles(dir).join(),
+             'core_00_a.js,core_10_b.js,db_x.js');
+    t.expect('find (no snapshot)', Snapshot.find(dir), null);
+
+    const filename = path.join(dir, Snapshot.FILENAME);
+    fs.writeFileSync(filename, Snapshot.header_() + '\n');
+    const past = new Date(Date.now() - 60 * 1000);
+    for (const file of Snapshot.startupFiles(dir)) {
+      fs.utimesSync(path.join(dir, file), past, past);
+    }
+    t.expect('find (up to date)', Snapshot.find(dir), filename);
+    fs.writeFileSync(filename, 'CodeCity snapshot serialization=1 ' +
+                     'server=0.0.0\n');
+    t.expect('find (other version)', Snapshot.find(dir), null);
+    fs.writeFileSync(filename, '');
+    t.expect('find (no header)', Snapshot.find(dir), null);
+    fs.writeFileSync(path.join(dir, 'core_10_b.js'), '// Edited.\n');
+    fs.utimesSync(filename, past, past);
+    t.expect('find (startup file edited)', Snapshot.find(dir), null);
+  } finally {
+    fs.rmSync(dir, {recursive: true, force: true});
+  }
+};
+
+/**
+ * Unit tests for Snapshot.encode and Snapshot.load.
+ * @param {!T} t The test runner object.
+ */
+exports.testSnapshotLoad = function(t) {
+  const intrp = new Interpreter({stackLimit: 100});
+  intrp.createThreadForSrc('var answer = {value: 42};');
+  intrp.run();
+  intrp.pause();
+  const data = Snapshot.encode(intrp, {compression: 'gzip'});
+  t.expect('header', data.toString('latin1', 0, data.indexOf('\n')),
+           'CodeCity snapshot serialization=' +
+           Interpreter.SERIALIZATION_VERSION + ' server=' +
+           packageJson.version);
+
+  const intrp2 = new Interpreter({stackLimit: 200});
+  Snapshot.load(data, intrp2);
+  t.expect('status', intrp2.status, Interpreter.Status.PAUSED);
+  t.expect('options kept', intrp2.options.stackLimit, 200);
+  intrp2.createThreadForSrc('answer.value++;');
+  intrp2.run();
+  const answer = intrp2.global.get('answer', intrp2.ROOT);
+  t.expect('answer.value', answer.get('value', intrp2.ROOT), 43);
+  t.expect('original unaffected',
+           intrp.global.get('answer', intrp.ROOT).get('value', intrp.ROOT),
+           42);
+
+  // Snapshots made by earlier versions have no header.
+  const intrp3 = new Interpreter();
+  Snapshot.load(data.subarray(data.indexOf('\n') + 1), intrp3);
+  t.expect('load (no header)',
+           intrp3.global.get('answer', intrp3.ROOT).get('value', intrp3.ROOT),
+           42);
+};
@@ -0,0 +1,98 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for server-sent events.
+ */
+'use strict';
+
+const http = require('http');
+const SSE = require('../sse');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for SSE.formatEvent.
+ * @param {!T} t The test runner object.
+ */
+exports.testSseFormatEvent = function(t) {
+  const cases = [
+    ['', 'data: \n\n'],
+    ['hello', 'data: hello\n\n'],
+    ['one\ntwo\r\nthree\rfour', 'data: one\ndata: two\ndata: three\n' +
+     'data: four\n\n'],
+    ['trailing\n', 'data: trailing\ndata: \n\n'],
+  ];
+  for (const [data, expected] of cases) {
+    t.expect('formatEvent(' + JSON.stringify(data) + ')',
+             SSE.formatEvent(data), expected);
+  }
+};
+
+/**
+ * Unit tests for SSE.Connection.
+ * @param {!T} t The test runner object.
+ */
+exports.testSseConnection = async function(t) {
+  const connections = [];
+  const server = http.createServer(function(req, res) {
+    const connection = new SSE.Connection(req, res, {'X-Test': 'yes'});
+    const log = [];
+    for (const name of ['end', 'close']) {
+      connection.on(name, () => log.push(name));
+    }
+    connections.push({connection, log});
+    connection.write('hello');
+    if (req.url === '/end') {
+      connection.end();
+      connection.write('discarded');
+    }
+  });
+  await new Promise((resolve) => server.listen(0, '127.0.0.1', resolve));
+  const port = server.address().port;
+  try {
+    // Stream ended by the server.
+    const response = await new Promise(function(resolve, reject) {
+      http.get({port, path: '/end'}, function(res) {
+        let body = '';
+        res.on('data', (data) => body += data);
+        res.on('end', () => resolve({res, body}));
+      }).on('error', reject);
+    });
+    t.expect('Content-Type', response.res.headers['content-type'],
+             'text/event-stream; charset=utf-8');
+    t.expect('X-Test', response.res.headers['x-test'], 'yes');
+    t.expect('body', response.body, 'data: hello\n\n');
+    await new Promise((resolve) => setTimeout(resolve, 10));
+    t.expect('events (ended)', connections[0].log.join(), 'close');
+
+    // Client going away.
+    await new Promise(function(resolve) {
+      const req = http.get({port, path: '/'}, function(res) {
+        res.once('data', function() {
+          req.destroy();
+          resolve();
+        });
+      });
+      req.on('error', function() {});
+    });
+    await new Promise((resolve) => setTimeout(resolve, 50));
+    t.expect('events (client went away)', connections[1].log.join(),
+             'end,close');
+  } finally {
+    server.close();
+  }
+};
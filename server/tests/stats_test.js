@@ -0,0 +1,99 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for resource usage statistics.
+ */
+'use strict';
+
+const Stats = require('../stats');
+const {getInterpreter} = require('./interpreter_common');
+const {T} = require('./testing');
+
+/**
+ * Make a sample with the given time and a value for every field.
+ * @param {number} time Time of the sample (ms).
+ * @param {number} value Value of every counter and gauge.
+ * @return {!Stats.Sample}
+ */
+function sample(time, value) {
+  const s = {time: time};
+  for (const field of Stats.FIELDS.counters.concat(Stats.FIELDS.gauges)) {
+    s[field] = value;
+  }
+  return s;
+}
+
+/**
+ * Unit tests for Stats.summarize.
+ * @param {!T} t The test runner object.
+ */
+exports.testStatsSummarize = function(t) {
+  t.expect('summarize([], 60)', Stats.summarize([], 60), null);
+
+  const samples = [sample(0, 0), sample(10000, 50), sample(20000, 100),
+                   sample(30000, 400)];
+  // The whole 30 seconds.
+  let summary = Stats.summarize(samples, 60);
+  t.expect('summarize(..., 60).seconds', summary.seconds, 30);
+  t.expect('summarize(..., 60).rates.steps', summary.rates.steps,
+           400 / 30);
+  t.expect('summarize(..., 60).averages.threads',
+           summary.averages.threads, 550 / 4);
+  t.expect('summarize(..., 60).maxima.threads', summary.maxima.threads, 400);
+  // Just the last 10 seconds.
+  summary = Stats.summarize(samples, 10);
+  t.expect('summarize(..., 10).seconds', summary.seconds, 10);
+  t.expect('summarize(..., 10).rates.bytesRead', summary.rates.bytesRead,
+           30);
+  t.expect('summarize(..., 10).averages.rss', summary.averages.rss, 250);
+  // A single sample: no rates can be computed.
+  summary = Stats.summarize([sample(0, 7)], 60);
+  t.expect('summarize(one, 60).seconds', summary.seconds, 0);
+  t.expect('summarize(one, 60).rates.steps', summary.rates.steps, 0);
+  t.expect('summarize(one, 60).maxima.delay', summary.maxima.delay, 7);
+};
+
+/**
+ * Unit tests for Stats.Recorder.
+ * @param {!T} t The test runner object.
+ */
+exports.testStatsRecorder = function(t) {
+  let intrp = null;
+  const recorder = new Stats.Recorder(() => intrp, {windows: [60]});
+  t.expect('record() (no interpreter)', recorder.record(), null);
+  t.expect('snapshot() (no interpreter)', recorder.snapshot(), null);
+
+  intrp = getInterpreter();
+  intrp.createThreadForSrc('var x = {}; suspend(1000);');
+  intrp.run();
+  const recorded = recorder.record();
+  t.expect('record().threads', recorded.threads, 1);
+  const snapshot = recorder.snapshot({checkpoint: {time: 42}});
+  t.expect('snapshot().scheduler.status', snapshot.scheduler.status,
+           'stopped');
+  t.expect('snapshot().scheduler.threads', snapshot.scheduler.threads, 1);
+  t.assert('snapshot().scheduler.steps',
+           snapshot.scheduler.steps >= recorded.steps);
+  t.expect('snapshot().connections.open', snapshot.connections.open, 0);
+  t.assert('snapshot().windows[60]', snapshot.windows[60] !== null);
+  t.expect('snapshot().checkpoint.time', snapshot.checkpoint.time, 42);
+  const root = snapshot.owners.owners.find((o) => o.owner === 'root');
+  t.assert('snapshot().owners root objects', root && root.objects > 0);
+  t.expect('snapshot() JSON round trip',
+           JSON.parse(JSON.stringify(snapshot)).time, snapshot.time);
+};
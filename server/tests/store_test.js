@@ -0,0 +1,170 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for the log-structured object store.
+ */
+'use strict';
+
+const crypto = require('crypto');
+const fs = require('fs');
+const os = require('os');
+const path = require('path');
+const Store = require('../store');
+const {T} = require('./testing');
+
+/**
+ * Synchronously read all the records in a store.
+ * @param {!Store.Log} store The store.
+ * @return {string} JSON encoding of the records, in ID order.
+ */
+function readAll(store) {
+  const records = [];
+  // Store.Log.prototype.read calls onRecord synchronously.
+  store.read((r) => records.push(r));
+  return JSON.stringify(records);
+}
+
+/**
+ * Unit tests for Store.Log transactions.
+ * @param {!T} t The test runner object.
+ */
+exports.testStoreLog = function(t) {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'store_test-'));
+  const key = crypto.randomBytes(32);
+  try {
+    for (const format of ['json', 'binary']) {
+      for (const encrypt of [false, true]) {
+        const name = 'Store.Log ' + format + (encrypt ? ' encrypted' : '');
+        const storeDir = path.join(dir, name.replace(/ /g, '_'));
+        const options = {format: format, key: encrypt ? key : null,
+                         compression: encrypt ? 'gzip' : 'none'};
+        try {
+          let store = new Store.Log(storeDir, options);
+          t.expect(name + ' new isEmpty()', store.isEmpty(), true);
+          t.expect(name + ' new wantsFull()', store.wantsFull(), true);
+          let tx = store.begin();
+          tx.write({'#': 0, 'type': 'Interpreter'});
+          tx.write({'#': 2, 'x': 'ü'});
+          tx.write({'#': 1, 'x': 1});
+          tx.commit(true);
+          t.expect(name + ' wantsFull()', store.wantsFull(), false);
+          tx = store.begin();
+          tx.write({'#': 1, 'x': 2});
+          tx.write({'#': 3, 'x': 3});
+          tx.commit(false);
+          const expected =
+              '[{"#":0,"type":"Interpreter"},{"#":1,"x":2},{"#":2,"x":"ü"},' +
+              '{"#":3,"x":3}]';
+          t.expect(name + ' read', readAll(store), expected);
+          t.expect(name + ' get(1)', JSON.stringify(store.get(1)),
+                   '{"#":1,"x":2}');
+          t.expect(name + ' get(4)', store.get(4), undefined);
+          // An aborted transaction is discarded.
+          tx = store.begin();
+          tx.write({'#': 1, 'x': 'aborted'});
+          tx.abort();
+          t.expect(name + ' wantsFull() after abort', store.wantsFull(),
+                   true);
+          tx = store.begin();
+          tx.write({'#': 2, 'x': 'uncommitted'});
+          store.close();
+
+          store = new Store.Log(storeDir, options);
+          t.expect(name + ' reopened', readAll(store), expected);
+          t.expect(name + ' reopened wantsFull()', store.wantsFull(), true);
+          // A full transaction replaces everything.
+          tx = store.begin();
+          tx.write({'#': 0, 'type': 'Interpreter'});
+          tx.write({'#': 1, 'x': 'new'});
+          tx.commit(true);
+          t.expect(name + ' full', readAll(store),
+                   '[{"#":0,"type":"Interpreter"},{"#":1,"x":"new"}]');
+          store.compact();
+          t.expect(name + ' compacted', readAll(store),
+                   '[{"#":0,"type":"Interpreter"},{"#":1,"x":"new"}]');
+          t.expect(name + ' compacted segments',
+                   fs.readdirSync(storeDir).length, 1);
+          store.close();
+          store = new Store.Log(storeDir, options);
+          t.expect(name + ' compacted reopened', readAll(store),
+                   '[{"#":0,"type":"Interpreter"},{"#":1,"x":"new"}]');
+          t.assert(name + ' not plaintext', fs.readFileSync(path.join(
+              storeDir, fs.readdirSync(storeDir)[0])).includes('new') ===
+                  !encrypt);
+          store.close();
+        } catch (e) {
+          t.crash(name, e);
+        }
+      }
+    }
+  } finally {
+    fs.rmSync(dir, {recursive: true});
+  }
+};
+
+/**
+ * Unit tests for Store.Log's management of segment files.
+ * @param {!T} t The test runner object.
+ */
+exports.testStoreLogSegments = function(t) {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'store_test-'));
+  try {
+    let store = new Store.Log(dir, {segmentSize: 100});
+    const save = function(full, records) {
+      const tx = store.begin();
+      for (const record of records) tx.write(record);
+      tx.commit(full);
+    };
+    save(true, [{'#': 0, 'x': 0}, {'#': 1, 'x': 1}]);
+    save(false, [{'#': 1, 'x': 2}]);
+    t.expect('Store.Log segments rolled over', store.stats().segments, 2);
+    save(false, [{'#': 0, 'x': 3}]);
+    // First segment no longer contains anything live.
+    t.expect('Store.Log dead segment deleted', store.stats().segments, 2);
+    t.expect('Store.Log dead segment file deleted',
+             fs.existsSync(path.join(dir, '000001.seg')), false);
+    const stats = store.stats();
+    t.expect('Store.Log stats().records', stats.records, 2);
+    t.assert('Store.Log stats().live', stats.live > 0 &&
+             stats.live < stats.total);
+    save(false, [{'#': 1, 'x': 4}]);
+    store.close();
+
+    // Damage at the end of the last segment is ignored, and removed.
+    const last = path.join(dir, '000003.seg');
+    const good = fs.readFileSync(last);
+    fs.writeFileSync(last, good.subarray(0, good.length - 3));
+    store = new Store.Log(dir, {segmentSize: 100});
+    t.expect('Store.Log torn', readAll(store),
+             '[{"#":0,"x":3},{"#":1,"x":2}]');
+    save(false, [{'#': 1, 'x': 5}]);
+    t.expect('Store.Log after torn', readAll(store),
+             '[{"#":0,"x":3},{"#":1,"x":5}]');
+    store.close();
+
+    fs.writeFileSync(path.join(dir, '000099.seg'), 'garbage');
+    try {
+      new Store.Log(dir);
+      t.fail('Store.Log(/* not a segment */)', "Didn't throw.");
+    } catch (e) {
+      t.pass('Store.Log(/* not a segment */)');
+    }
+  } finally {
+    fs.rmSync(dir, {recursive: true});
+  }
+};
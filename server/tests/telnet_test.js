@@ -0,0 +1,174 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for the telnet protocol implementation.
+ */
+'use strict';
+
+const net = require('net');
+const Telnet = require('../telnet');
+const {T} = require('./testing');
+const zlib = require('zlib');
+
+const {IAC, SB, SE, NOP, WILL, WONT, DO, DONT} = Telnet.Command;
+const {ECHO, TTYPE, NAWS, COMPRESS2} = Telnet.Option;
+
+/**
+ * A client connected to a Telnet.Connection over a loopback TCP
+ * connection.
+ * @param {!Telnet.Options=} options Options for the connection.
+ * @return {!Promise<{conn: !Telnet.Connection, client: !net.Socket,
+ *     received: function(): !Buffer, server: !net.Server}>}
+ */
+async function connect(options) {
+  const server = net.createServer();
+  await new Promise((resolve) => server.listen(0, 'localhost', resolve));
+  const accepted = new Promise((resolve) => {
+    server.on('connection', (socket) => {
+      resolve(new Telnet.Connection(socket, options));
+    });
+  });
+  const client = net.createConnection(server.address().port, 'localhost');
+  let data = Buffer.alloc(0);
+  client.on('data', (d) => {
+    data = Buffer.concat([data, d]);
+  });
+  const conn = await accepted;
+  // Return (and forget) the data received so far.
+  const received = () => {
+    const result = data;
+    data = Buffer.alloc(0);
+    return result;
+  };
+  return {conn, client, received, server};
+}
+
+/**
+ * Wait for any pending I/O to complete.
+ * @return {!Promise}
+ */
+function settle() {
+  return new Promise((resolve) => setTimeout(resolve, 50));
+}
+
+/**
+ * Unit tests for Telnet.Connection.
+ * @param {!T} t The test runner object.
+ */
+exports.testTelnetConnection = async function(t) {
+  const {conn, client, received, server} = await connect();
+  try {
+    const events = [];
+    let text = '';
+    conn.on('data', (data) => {
+      text += data;
+    });
+    conn.on('resize', (w, h) => events.push('resize:' + w + 'x' + h));
+    conn.on('terminaltype', (type) => events.push('terminaltype:' + type));
+    await settle();
+    t.expect('Connection initial negotiation', received().toString('hex'),
+             Buffer.from([IAC, DO, NAWS, IAC, DO, TTYPE]).toString('hex'));
+
+    // Client agrees to NAWS and TTYPE, and reports its window size.
+    client.write(Buffer.from([IAC, WILL, NAWS, IAC, SB, NAWS, 0, 80, 0, 24,
+                              IAC, SE, IAC, WILL, TTYPE]));
+    await settle();
+    t.expect('Connection requests terminal type', received().toString('hex'),
+             Buffer.from([IAC, SB, TTYPE, 1, IAC, SE]).toString('hex'));
+    client.write(Buffer.concat([
+      Buffer.from([IAC, SB, TTYPE, 0]), Buffer.from('XTERM'),
+      Buffer.from([IAC, SE]),
+    ]));
+    // Text, with commands interspersed and a character split between
+    // packets.
+    const cafe = Buffer.from('café\r\n');
+    client.write(Buffer.concat([Buffer.from('lo'), Buffer.from([IAC, NOP]),
+                                Buffer.from('ok\r\n'), cafe.subarray(0, 4)]));
+    await settle();
+    client.write(cafe.subarray(4));
+    await settle();
+    t.expect('Connection events', events.join('|'),
+             'resize:80x24|terminaltype:XTERM');
+    t.expect('Connection data', text, 'look\r\ncafé\r\n');
+    t.expect('Connection.p.width', conn.width, 80);
+    t.expect('Connection.p.terminalType', conn.terminalType, 'XTERM');
+
+    // Unrequested options are refused; acknowledgements and requests to
+    // disable options not enabled are not replied to.
+    client.write(Buffer.from([IAC, DO, 34, IAC, WILL, 42, IAC, DONT, 34,
+                              IAC, WONT, 42]));
+    await settle();
+    t.expect('Connection refuses options', received().toString('hex'),
+             Buffer.from([IAC, WONT, 34, IAC, DONT, 42]).toString('hex'));
+
+    conn.setEcho(false);
+    conn.setEcho(false);
+    await settle();
+    t.expect('Connection.p.setEcho(false)', received().toString('hex'),
+             Buffer.from([IAC, WILL, ECHO]).toString('hex'));
+    client.write(Buffer.from([IAC, DO, ECHO]));
+    conn.setEcho(true);
+    await settle();
+    t.expect('Connection.p.setEcho(true)', received().toString('hex'),
+             Buffer.from([IAC, WONT, ECHO]).toString('hex'));
+
+    conn.write('one\ntwo\r\n');
+    await settle();
+    t.expect('Connection.p.write(...)', String(received()),
+             'one\r\ntwo\r\n');
+
+    const ended = new Promise((resolve) => conn.on('end', resolve));
+    client.end();
+    await ended;
+    t.pass('Connection end event');
+  } finally {
+    client.destroy();
+    server.close();
+  }
+};
+
+/**
+ * Unit tests for Telnet.Connection's MCCP2 compression.
+ * @param {!T} t The test runner object.
+ */
+exports.testTelnetCompress = async function(t) {
+  const {conn, client, received, server} = await connect({compress: true});
+  try {
+    await settle();
+    t.expect('Connection offers compression', received().toString('hex'),
+             Buffer.from([IAC, DO, NAWS, IAC, DO, TTYPE, IAC, WILL, COMPRESS2])
+                 .toString('hex'));
+    client.write(Buffer.from([IAC, DO, COMPRESS2]));
+    await settle();
+    conn.write('Hello, world!\n');
+    await settle();
+    const start = Buffer.from([IAC, SB, COMPRESS2, IAC, SE]);
+    const data = received();
+    t.expect('Connection begins compression',
+             data.subarray(0, start.length).toString('hex'),
+             start.toString('hex'));
+    const inflated = zlib.inflateSync(
+        data.subarray(start.length),
+        {finishFlush: zlib.constants.Z_SYNC_FLUSH});
+    t.expect('Connection compressed data', String(inflated),
+             'Hello, world!\r\n');
+  } finally {
+    client.destroy();
+    server.close();
+  }
+};
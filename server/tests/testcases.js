@@ -1930,6 +1930,143 @@ module.exports = [
     `,
     expected: '1,2,3',
   },
+  {
+    name: 'Array elements by numeric index',
+    src: `
+      var a = [1, 2, 3];
+      var r = [];
+      for (var i = 0; i < a.length; i++) a[i] *= 10;
+      a[1]++;
+      a[3] = 40;  // Lengthens array.
+      a[5] = 60;  // Leaves a hole.
+      r.push(String(a), a.length, 4 in a, a[-1], a[1.5], a[4294967295]);
+      delete a[0];
+      r.push(0 in a, a[0]);
+      Object.freeze(a);
+      try {
+        a[1] = 0;
+      } catch (e) {
+        r.push(e.name, a[1]);
+      }
+      var o = Object.create(['inherited']);
+      o[1] = 'own';
+      r.push(o[0], o[1], o['1']);
+      var f = [];
+      f[0] = function() {};
+      r.push(f[0].name);
+      r.join();
+    `,
+    options: {methodNames: true},
+    expected: '10,21,30,40,,60,6,false,,,,false,,TypeError,21,' +
+        'inherited,own,own,0',
+  },
+  {
+    name: 'Elements of primitives, and by string index',
+    src: `
+      var s = 'abc';
+      var r = [];
+      for (var i = 0; i < s.length; i++) r.push(s[i]);
+      String.prototype[5] = 'inherited';
+      r.push(s[3], s[5], (5)[0], true[0]);
+      delete String.prototype[5];
+      var a = ['x', 'y'];
+      r.push(a['1'], a['01'], s['1'], s[5]);
+      r.join();
+    `,
+    expected: 'a,b,c,,inherited,,,y,,b,',
+  },
+  {
+    name: 'Property keys: ToPropertyKey and canonical numeric strings',
+    src: `
+      var o = {1: 'one', '01': 'oh-one', 1.50: 'one-and-half', 1e21: 'big'};
+      var log = [];
+      var k = {toString: function() {log.push('toString'); return '01';}};
+      var v = {
+        toString: function() {return {};},
+        valueOf: function() {log.push('valueOf'); return 1;}
+      };
+      var bad = {toString: function() {return {};}, valueOf: undefined};
+      var r = [o[1], o['1'], o[1.0], o['01'], o[k], o[v], o['1.50'], o[3/2],
+               o[1e21], o['1e+21'], k in o, Object.keys(o).join('|')];
+      o[k] = 'changed';
+      r.push(o['01']);
+      try {
+        null[k];
+      } catch (e) {
+        r.push(e.name);
+      }
+      try {
+        o[bad];
+      } catch (e) {
+        r.push(e.name);
+      }
+      r.push(log.join('|'), ({1.0: function() {}})[1].name);
+      r.join();
+    `,
+    expected: 'one,one,one,oh-one,oh-one,one,,one-and-half,big,big,true,' +
+        '1|01|1.5|1e+21,changed,TypeError,TypeError,' +
+        'toString|valueOf|toString|toString,1',
+  },
+  {
+    name: 'Object.prototype.hasOwnProperty: ToPropertyKey',
+    src: `
+      var o = {foo: 1, 1: 'one'};
+      var r = [o.hasOwnProperty({toString: function() {return 'foo';}}),
+               o.hasOwnProperty({toString: function() {return 'bar';}}),
+               o.hasOwnProperty({toString: function() {return {};},
+                                 valueOf: function() {return 1.0;}})];
+      try {
+        o.hasOwnProperty({toString: function() {throw new RangeError;}});
+      } catch (e) {
+        r.push(e.name);
+      }
+      String(r);
+    `,
+    expected: 'true,false,true,RangeError',
+  },
+  {
+    name: 'Object.prototype.propertyIsEnumerable: ToPropertyKey',
+    src: `
+      var o = {foo: 1};
+      Object.defineProperty(o, 'hidden', {value: 2, enumerable: false});
+      var key = function(k) {return {toString: function() {return k;}};};
+      String([o.propertyIsEnumerable(key('foo')),
+              o.propertyIsEnumerable(key('hidden')),
+              [0].propertyIsEnumerable({valueOf: function() {return 0;},
+                                        toString: undefined})]);
+    `,
+    expected: 'true,false,true',
+  },
+  {
+    name: 'Object.defineProperty: ToPropertyKey',
+    src: `
+      var o = {};
+      var calls = [];
+      var key = {toString: function() {calls.push('key'); return 'foo';}};
+      Object.defineProperty(o, key, {value: 42, enumerable: true});
+      try {
+        Object.defineProperty(1, key, {});
+      } catch (e) {
+        calls.push(e.name);  // Object checked before key is converted.
+      }
+      String([o.foo, Object.keys(o), calls]);
+    `,
+    expected: '42,foo,key,TypeError',
+  },
+  {
+    name: 'Object.getOwnPropertyDescriptor: ToPropertyKey',
+    src: `
+      var o = {foo: 'bar', 1: 'one'};
+      var pd1 = Object.getOwnPropertyDescriptor(
+          o, {toString: function() {return 'foo';}});
+      var pd2 = Object.getOwnPropertyDescriptor(
+          o, {toString: undefined, valueOf: function() {return 1;}});
+      var pd3 = Object.getOwnPropertyDescriptor(
+          o, {toString: function() {return 'baz';}});
+      String([pd1.value, pd2.value, pd3]);
+    `,
+    expected: 'bar,one,',
+  },
   {src: `Array.isArray(Array.prototype);`, expected: true},
   {src: `Array.isArray(new Array);`, expected: true},
   {src: `Array.isArray([]);`, expected: true},
@@ -1974,6 +2111,25 @@ module.exports = [
     expected: true,
   },
   {src: `['x', NaN, 'y'].includes(NaN);`, expected: true},
+  {src: `[-0].includes(0) && [0].includes(-0);`, expected: true},
+  {
+    name: 'Equality of -0 and NaN',
+    src: `
+      var r = [NaN === NaN, NaN !== NaN, 0 === -0, [NaN].indexOf(NaN),
+               [-0].indexOf(0), [0].lastIndexOf(-0), Object.is(NaN, NaN),
+               Object.is(0, -0)];
+      switch (-0) {
+        case 0: r.push('case 0'); break;
+        default: r.push('default');
+      }
+      switch (NaN) {
+        case NaN: r.push('case NaN'); break;
+        default: r.push('default');
+      }
+      r.join();
+    `,
+    expected: 'false,true,true,-1,0,0,true,false,case 0,default',
+  },
   {
     name: 'Array.prototype.includes.call(array-like, ...)',
     src: `
@@ -2657,6 +2813,32 @@ module.exports = [
     src: `'hello'.search('ll')`,
     expected: 2,
   },
+  {
+    name: 'String.prototype.repeat',
+    src: `
+      var long = 'abc'.repeat(100000);
+      var r = ['ab'.repeat(2.7), 'ab'.repeat(), long.length,
+               long.slice(-4)];
+      try {
+        'abc'.repeat(-1);
+      } catch (e) {
+        r.push(e.name);
+      }
+      try {
+        'abc'.repeat(Infinity);
+      } catch (e) {
+        r.push(e.name);
+      }
+      try {
+        'abc'.repeat(0x1000000);
+      } catch (e) {
+        r.push(e.message);
+      }
+      r.join();
+    `,
+    expected: 'abab,,300000,cabc,RangeError,RangeError,' +
+        'String length exceeds the limit of 16777216',
+  },
   {
     name: 'String.prototype.search(regexp) not found',
     src: `'hello'.search(/H/)`,
@@ -2905,6 +3087,56 @@ module.exports = [
     `,
     expected: 'at foo 2:16',
   },
+  {
+    name: 'Error messages worded as by V8',
+    src: `
+      var r = [];
+      var u, n = null, o = {p: [{}]}, i = 0;
+      var tests = [
+        function() {u();},
+        function() {o.f();},
+        function() {o['x y']();},
+        function() {o.p[i + 1]();},
+        function() {o.p[0].q();},
+        function() {(function() {})()();},
+        function() {'x'.foo();},
+        function() {new o.p();},
+        function() {u.x;},
+        function() {n[1.5];},
+        function() {o.a.b = 1;},
+        function() {u.x += 1;},
+        function() {delete u.x;},
+        function() {'a' in u;},
+        function() {o instanceof 2;},
+        function() {o instanceof o;},
+        function() {Object.keys(n);},
+        function() {v;},
+      ];
+      for (var j = 0; j < tests.length; j++) {
+        try {
+          tests[j]();
+        } catch (e) {
+          r.push(e.message);
+        }
+      }
+      r.join('|');
+    `,
+    options: {v8Messages: true},
+    expected: 'u is not a function|o.f is not a function|' +
+        'o.x y is not a function|o.p[(i + 1)] is not a function|' +
+        'o.p[0].q is not a function|' +
+        '(intermediate value)(...) is not a function|' +
+        '"x".foo is not a function|o.p is not a constructor|' +
+        "Cannot read properties of undefined (reading 'x')|" +
+        "Cannot read properties of null (reading '1.5')|" +
+        "Cannot set properties of undefined (setting 'b')|" +
+        "Cannot read properties of undefined (reading 'x')|" +
+        'Cannot convert undefined or null to object|' +
+        "Cannot use 'in' operator to search for 'a' in undefined|" +
+        "Right-hand side of 'instanceof' is not an object|" +
+        "Right-hand side of 'instanceof' is not callable|" +
+        'Cannot convert undefined or null to object|v is not defined',
+  },
 
   /////////////////////////////////////////////////////////////////////////////
   // JSON
@@ -3034,6 +3266,30 @@ module.exports = [
     `,
     expected: 'TypeError',
   },
+  {
+    name: 'JSON.stringify of large values',
+    src: `
+      var deep = [];
+      for (var a = deep, i = 0; i < 100; i++) {
+        a = a[0] = [];
+      }
+      var wide = {};
+      for (i = 0; i < 20000; i++) {
+        wide['k' + i] = i;
+      }
+      var r = [JSON.stringify(new Array(20000)).length,
+               JSON.stringify(wide).length,
+               JSON.stringify(deep) === '['.repeat(101) + ']'.repeat(101)];
+      wide.self = wide;
+      try {
+        JSON.stringify(wide);
+      } catch (e) {
+        r.push(e.name);
+      }
+      r.join();
+    `,
+    expected: '100001,277781,true,TypeError',
+  },
 
   /////////////////////////////////////////////////////////////////////////////
   // Other built-in functions
@@ -3207,6 +3463,85 @@ module.exports = [
     `,
     expected: 'OK',
   },
+  // Thread-local storage.
+  {
+    name: 'Thread.prototype.getLocal() initially undefined',
+    src: `
+      var t = Thread.current();
+      String(t.getLocal('foo')) + ',' + t.hasLocal('foo');
+    `,
+    expected: 'undefined,false',
+  },
+  {
+    name: 'Thread.prototype.setLocal()',
+    src: `
+      var t = Thread.current();
+      var obj = {};
+      t.setLocal('foo', obj);
+      t.setLocal(42, 'bar');
+      t.getLocal('foo') === obj && t.getLocal('42') === 'bar' &&
+          t.hasLocal('foo');
+    `,
+    expected: true,
+  },
+  {
+    name: 'Thread.prototype.deleteLocal()',
+    src: `
+      var t = Thread.current();
+      t.setLocal('foo', 1);
+      var r = [t.deleteLocal('foo'), t.deleteLocal('foo'), t.hasLocal('foo')];
+      String(r);
+    `,
+    expected: 'true,false,false',
+  },
+  {
+    name: 'Thread locals are per-thread',
+    src: `
+      Thread.current().setLocal('foo', 'outer');
+      var t = new Thread(function() {});
+      String(t.getLocal('foo'));
+    `,
+    expected: 'undefined',
+  },
+  {
+    name: 'Thread locals: keys converted by ToPropertyKey',
+    src: `
+      var t = Thread.current();
+      var calls = 0;
+      var key = {toString: function() {calls++; return 'foo';}};
+      t.setLocal(key, 'bar');
+      var r = [t.getLocal('foo'), t.getLocal(key), t.hasLocal(key),
+               t.deleteLocal(key), t.hasLocal('foo'), calls];
+      String(r);
+    `,
+    expected: 'bar,bar,true,true,false,4',
+  },
+  // Cancellation tests.  Waking of sleeping threads is tested in
+  // interpreter_tests.js.
+  {
+    name: 'Thread.prototype.cancelled initially false',
+    src: `Thread.current().cancelled;`,
+    expected: false,
+  },
+  {
+    name: 'Thread.prototype.cancel()',
+    src: `
+      var t = Thread.current();
+      t.cancel();
+      t.cancel();  // Idempotent.
+      var pd = Object.getOwnPropertyDescriptor(t, 'cancelled');
+      [pd.value, pd.writable, pd.configurable].join();
+    `,
+    expected: 'true,false,false',
+  },
+  {
+    name: 'Thread.prototype.cancel() does not stop thread',
+    src: `
+      Thread.current().cancel();
+      'still running';
+    `,
+    expected: 'still running',
+  },
 
   /////////////////////////////////////////////////////////////////////////////
   // Permissions system:
@@ -3256,6 +3591,230 @@ module.exports = [
     expected: true,
   },
 
+  /////////////////////////////////////////////////////////////////////////////
+  // Object destruction:
+  {
+    name: 'CC.destroy',
+    src: `
+      var proto = {inherited: true};
+      var obj = Object.create(proto);
+      obj.foo = 42;
+      var f = function() {return 'called';};
+      var refs = [obj];
+      CC.destroy(obj);
+      CC.destroy(f);
+      var r = [CC.isDestroyed(obj), refs[0] === obj, proto.inherited];
+      var attempts = [
+        function() {return obj.foo;},
+        function() {obj.foo = 69;},
+        function() {return 'foo' in obj;},
+        function() {return Object.keys(obj);},
+        function() {return Object.getPrototypeOf(obj);},
+        function() {return f();},
+        function() {return f.call(null);},
+        function() {CC.destroy(obj);},
+      ];
+      for (var i = 0; i < attempts.length; i++) {
+        try {
+          r.push(attempts[i]());
+        } catch (e) {
+          r.push(e.name);
+        }
+      }
+      r.join();
+    `,
+    expected: 'true,true,true,' + 'TypeError,'.repeat(7) + 'TypeError',
+  },
+  {
+    name: 'CC.destroy with grace period and CC.restore',
+    src: `
+      var obj = {foo: 42};
+      CC.destroy(obj, 60 * 1000);
+      var r = [CC.isDestroyed(obj)];
+      try {
+        obj.foo;
+      } catch (e) {
+        r.push(e.name);
+      }
+      r.push(CC.recycleBin().length, CC.recycleBin()[0].object === obj);
+      r.push(CC.restore(obj) === obj, CC.isDestroyed(obj), obj.foo);
+      try {
+        CC.restore(obj);
+      } catch (e) {
+        r.push(e.name);
+      }
+      CC.destroy(obj, 60 * 1000);
+      r.push(CC.recycleBinEmpty(), CC.recycleBin().length);
+      try {
+        CC.restore(obj);
+      } catch (e) {
+        r.push(e.name);
+      }
+      try {
+        CC.destroy(Object.prototype);
+      } catch (e) {
+        r.push(e.name);
+      }
+      r.join();
+    `,
+    expected: 'true,TypeError,1,true,true,false,42,RangeError,1,0,' +
+        'RangeError,PermissionError',
+  },
+
+  /////////////////////////////////////////////////////////////////////////////
+  // Sandboxes:
+  {
+    name: 'CC.sandboxEval with standard globals',
+    src: `
+      var g = {x: 2};
+      var sb = CC.sandboxCreate(g, [], true);
+      var r = [CC.sandboxEval(sb, 'var y = Math.max(x, 3) * 2; y')];
+      r.push(CC.sandboxEval(sb, 'y + [1, 2].length'));
+      r.push(CC.sandboxEval(sb, 'this === undefined') === false);
+      r.push(CC.sandboxEval(sb, 'typeof CC + typeof $'));
+      r.push(CC.sandboxEval(sb, 'String(parseInt("42"))'));
+      r.push(typeof y);
+      r.join();
+    `,
+    expected: '6,8,true,undefinedundefined,42,undefined',
+  },
+  {
+    name: 'CC.sandboxEval hides functions not allowed',
+    src: `
+      var obj = {
+        data: 42,
+        secret: function() {return 'secret';},
+      };
+      var tool = {use: function() {return 'used';}};
+      var sb = CC.sandboxCreate({obj: obj, tool: tool}, [tool]);
+      var r = [];
+      r.push(CC.sandboxEval(sb, 'obj.data'));
+      r.push(CC.sandboxEval(sb, 'var s = obj.secret; s === undefined'));
+      r.push(CC.sandboxEval(sb, 'tool.use()'));
+      r.push(CC.sandboxEval(sb,
+          'var F = (function() {}).constructor; F === undefined'));
+      var attempts = [
+        'obj.secret()',
+        'Math.max(1, 2)',
+        'new Function("return 1")',
+        '[].push(1)',
+      ];
+      for (var i = 0; i < attempts.length; i++) {
+        try {
+          r.push(CC.sandboxEval(sb, attempts[i]));
+        } catch (e) {
+          r.push(e.name);
+        }
+      }
+      var f = CC.sandboxEval(sb, '(function() {return obj.secret();})');
+      try {
+        f();
+      } catch (e) {
+        r.push(e.name);
+      }
+      r.join();
+    `,
+    expected: '42,true,used,true,PermissionError,ReferenceError,' +
+        'ReferenceError,PermissionError,PermissionError',
+  },
+
+  /////////////////////////////////////////////////////////////////////////////
+  // Size limits:
+  {
+    name: 'CC.sizeLimitsSet',
+    src: `
+      var alice = {};
+      CC.sizeLimitsSet(alice, {maxString: 8, maxArray: 2, maxProperties: 4});
+      var r = [];
+      var attempts = [
+        function() {var s = 'ab'; while (true) s += s;},
+        function() {return 'abcd' + 'efgh' + 'i';},
+        function() {return 'abc'.repeat(3);},
+        function() {var a = []; a[2] = 1;},
+        function() {var a = [1, 2]; a.push(3);},
+        function() {var a = []; a.length = 3;},
+        function() {var o = {a: 1, b: 2, c: 3, d: 4}; o.e = 5;},
+        function() {
+          var o = {a: 1, b: 2, c: 3, d: 4};
+          delete o.a;
+          o.e = 5;
+        },
+        function() {var o = {a: 1, b: 2, c: 3, d: 4}; o.a = 'abcdefgh';},
+      ];
+      for (var i = 0; i < attempts.length; i++) {
+        Object.setOwnerOf(attempts[i], alice);  // Run with alice's perms.
+        try {
+          attempts[i]();
+          r.push('ok');
+        } catch (e) {
+          r.push(e.name);
+        }
+      }
+      var limits = CC.sizeLimits(alice);
+      r.push(limits.maxString, limits.maxArray, limits.maxProperties);
+      CC.sizeLimitsSet(alice, null);
+      r.push(CC.sizeLimits(alice).maxString > 8);
+      r.join();
+    `,
+    expected: 'RangeError,RangeError,RangeError,RangeError,RangeError,' +
+        'RangeError,RangeError,ok,ok,8,2,4,true',
+  },
+
+  /////////////////////////////////////////////////////////////////////////////
+  // Security events:
+  {
+    name: 'CC.securityEvents',
+    src: `
+      var events = CC.securityEvents();
+      var after = events.length ? events[events.length - 1].id : 0;
+      var alice = {};
+      CC.sizeLimitsSet(alice, {maxString: 4});
+      var attempts = [
+        function() {setPerms(alice);},
+        function() {CC.ban('192.0.2.0/24');},
+        function() {return 'abc' + 'de';},
+      ];
+      for (var i = 0; i < attempts.length; i++) {
+        if (i > 0) Object.setOwnerOf(attempts[i], alice);
+        try {
+          attempts[i]();
+        } catch (e) {}
+      }
+      var r = CC.securityEvents(after).map(function(event) {
+        return event.type + ' ' + (event.perms === alice);
+      });
+      var quotas = CC.securityEvents(after, 'quota');
+      r.push(quotas.length, quotas[0].details.quota, quotas[0].details.limit);
+      r.join();
+    `,
+    expected: 'setPerms false,permission true,quota true,1,maxString,4',
+  },
+
+  /////////////////////////////////////////////////////////////////////////////
+  // Taint tracking:
+  {
+    name: 'CC.taint',
+    options: {taint: 'error'},
+    src: `
+      var input = CC.taint('x = 42');
+      var cmd = 'var ' + input;
+      var r = [CC.isTainted(input), CC.isTainted(cmd),
+               CC.isTainted(input.toUpperCase())];
+      try {
+        eval(cmd);
+      } catch (e) {
+        r.push(e.name);
+      }
+      CC.untaint(cmd);
+      eval(cmd);
+      r.push(x, CC.isTainted('clean'), CC.isTainted(input.length));
+      CC.untaint(input);
+      CC.untaint(input.toUpperCase());
+      r.join();
+    `,
+    expected: 'true,true,true,PermissionError,42,false,false',
+  },
+
   /////////////////////////////////////////////////////////////////////////////
   // Other tests:
   {
@@ -0,0 +1,213 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for Unicode-aware text layout.
+ */
+'use strict';
+
+const Text = require('../text');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Text.graphemes and Text.words.
+ * @param {!T} t The test runner object.
+ */
+exports.testTextSegment = function(t) {
+  const family = '\u{1f468}\u200d\u{1f469}\u200d\u{1f467}';
+  const flag = '\u{1f1ef}\u{1f1f5}';
+  t.expect('graphemes(...)',
+           JSON.stringify(Text.graphemes('ae\u0301' + family + flag + '\r\n')),
+           JSON.stringify(['a', 'e\u0301', family, flag, '\r\n']));
+  t.expect('words(...)', JSON.stringify(
+      Text.words('Hello, world!  It\'s 日本語.')),
+      JSON.stringify(['Hello', 'world', 'It\'s', '日本語']));
+  // Long text is segmented in pieces; check none are cut short.
+  const long = ('x' + family + 'e\u0301\u0302 ').repeat(1000);
+  const graphemes = Text.graphemes(long);
+  t.expect('graphemes(<long>).length', graphemes.length, 4000);
+  t.expect('graphemes(<long>).join()', graphemes.join(''), long);
+  const marks = 'a' + '\u0301'.repeat(1000) + 'b';
+  t.expect('graphemes(<long grapheme>).length',
+           Text.graphemes(marks).length, 2);
+  try {
+    Text.graphemes('x'.repeat(Text.MAX_LENGTH + 1));
+    t.fail('graphemes(<too long>)', 'did not throw');
+  } catch (e) {
+    t.expect('graphemes(<too long>)', String(e), 'RangeError: Text too long');
+  }
+};
+
+/**
+ * Unit tests for Text.width.
+ * @param {!T} t The test runner object.
+ */
+exports.testTextWidth = function(t) {
+  const cases = [
+    ['', 0],
+    ['hello', 5],
+    ['caf\u00e9', 4],
+    ['cafe\u0301', 4],
+    ['日本語', 6],  // CJK.
+    ['한국어', 6],  // Hangul.
+    ['ｈｉ', 4],  // Fullwidth.
+    ['\u{1f44d}', 2],
+    ['\u{1f44d}\u{1f3fd}', 2],  // With skin tone modifier.
+    ['\u{1f468}\u200d\u{1f469}\u200d\u{1f467}', 2],
+    ['\u{1f1ef}\u{1f1f5}', 2],
+    ['\u2764', 1],  // Text presentation by default...
+    ['\u2764\ufe0f', 2],  // ...emoji with selector.
+    ['#\ufe0f\u20e3', 2],
+    ['a\u200bb', 2],  // Zero width space.
+    ['a\tb\x07', 2],
+    ['\u0301x', 1],
+  ];
+  for (const [text, width] of cases) {
+    t.expect('width(' + JSON.stringify(text) + ')', Text.width(text), width);
+  }
+};
+
+/**
+ * Unit tests for Text.pad and Text.truncate.
+ * @param {!T} t The test runner object.
+ */
+exports.testTextPadTruncate = function(t) {
+  const jp = '日本';
+  t.expect('pad("ab", 5)', Text.pad('ab', 5), 'ab   ');
+  t.expect('pad("ab", 5, "right")', Text.pad('ab', 5, 'right'), '   ab');
+  t.expect('pad(jp, 7, "center", "-")', Text.pad(jp, 7, 'center', '-'),
+           '-' + jp + '--');
+  t.expect('pad("abc", 2)', Text.pad('abc', 2), 'abc');
+  t.expect('truncate("hello world", 8)', Text.truncate('hello world', 8),
+           'hello w\u2026');
+  t.expect('truncate("hello world", 8, "...")',
+           Text.truncate('hello world', 8, '...'), 'hello...');
+  t.expect('truncate("hello", 5)', Text.truncate('hello', 5), 'hello');
+  t.expect('truncate("hello", 2, "...")', Text.truncate('hello', 2, '...'),
+           'he');
+  // A wide character that does not fit is left out.
+  t.expect('truncate(jp + jp, 7)', Text.truncate(jp + jp, 7),
+           jp + '日\u2026');
+  t.expect('truncate(jp + jp, 6)', Text.truncate(jp + jp, 6),
+           jp + '\u2026');
+
+  const errors = [
+    ['pad(..., -1)', () => Text.pad('a', -1), 'RangeError'],
+    ['pad(..., 1.5)', () => Text.pad('a', 1.5), 'RangeError'],
+    ['pad(..., "middle")', () => Text.pad('a', 3, 'middle'), 'TypeError'],
+    ['pad(..., "ab")', () => Text.pad('a', 3, 'left', 'ab'), 'TypeError'],
+    ['pad(..., jp)', () => Text.pad('a', 3, 'left', '日'), 'TypeError'],
+    ['truncate(..., "3")', () => Text.truncate('a', '3'), 'RangeError'],
+  ];
+  for (const [name, func, type] of errors) {
+    try {
+      func();
+      t.fail(name, 'did not throw');
+    } catch (e) {
+      t.expect(name, e.name, type);
+    }
+  }
+};
+
+/**
+ * Unit tests for ANSI escape sequence handling.
+ * @param {!T} t The test runner object.
+ */
+exports.testTextAnsi = function(t) {
+  const red = Text.color('hello', 'red');
+  t.expect('color("hello", "red")', red, '\x1b[31mhello\x1b[39m');
+  t.expect('color("hi", "bold bgBlue")', Text.color('hi', 'bold bgBlue'),
+           '\x1b[1;44mhi\x1b[49;22m');
+  t.expect('color("hi", "")', Text.color('hi', ''), 'hi');
+  t.expect('width(red)', Text.width(red), 5);
+  t.expect('stripAnsi(red)', Text.stripAnsi(red), 'hello');
+  t.expect('pad(red, 7)', Text.pad(red, 7), red + '  ');
+  // Escapes are kept, so that the color is still ended.
+  t.expect('truncate(red, 4)', Text.truncate(red, 4),
+           '\x1b[31mhel\u2026\x1b[39m');
+  t.expect('supportsColor("xterm-256color")',
+           Text.supportsColor('xterm-256color'), true);
+  t.expect('supportsColor("DUMB")', Text.supportsColor('DUMB'), false);
+  try {
+    Text.color('hi', 'plaid');
+    t.fail('color(..., "plaid")', 'did not throw');
+  } catch (e) {
+    t.expect('color(..., "plaid")', e.name, 'TypeError');
+  }
+};
+
+/**
+ * Unit tests for Text.wrap.
+ * @param {!T} t The test runner object.
+ */
+exports.testTextWrap = function(t) {
+  const cases = [
+    ['The quick brown fox', 10, 'The quick\nbrown fox'],
+    ['  indented text here', 10, '  indented\ntext here'],
+    ['one  two   three', 9, 'one  two\nthree'],
+    ['a verylongword', 4, 'a\nvery\nlong\nword'],
+    ['line one\n\nline two', 20, 'line one\n\nline two'],
+    ['日本語 日本語', 7, '日本語\n日本語'],
+    ['\x1b[31mred\x1b[39m text', 4, '\x1b[31mred\x1b[39m\ntext'],
+    ['trailing   ', 20, 'trailing'],
+  ];
+  for (const [text, width, expected] of cases) {
+    t.expect('wrap(' + JSON.stringify(text) + ', ' + width + ')',
+             Text.wrap(text, width), expected);
+  }
+  try {
+    Text.wrap('a', 0);
+    t.fail('wrap(..., 0)', 'did not throw');
+  } catch (e) {
+    t.expect('wrap(..., 0)', e.name, 'RangeError');
+  }
+};
+
+/**
+ * Unit tests for Text.table and Text.columns.
+ * @param {!T} t The test runner object.
+ */
+exports.testTextTableColumns = function(t) {
+  const rows = [['Name', 'Score'], ['Alice', '10'], ['日本', '7']];
+  t.expect('table(rows)', Text.table(rows), [
+    'Name   Score',
+    'Alice  10',
+    '日本   7',
+  ].join('\n'));
+  t.expect('table(rows, {header, align})',
+           Text.table(rows, {header: true, align: ['left', 'right'],
+                             separator: ' | '}), [
+             'Name  | Score',
+             '----- | -----',
+             'Alice |    10',
+             '日本  |     7',
+           ].join('\n'));
+  t.expect('table(..., {width: 12})',
+           Text.table([['id', 'a long description']], {width: 12}),
+           'id  a long\n    descript\n    ion');
+  t.expect('table([])', Text.table([]), '');
+
+  const items = ['apple', 'banana', 'cherry', 'date', 'fig'];
+  t.expect('columns(items, 20)', Text.columns(items, 20), [
+    'apple   date',
+    'banana  fig',
+    'cherry',
+  ].join('\n'));
+  t.expect('columns(items, 4)', Text.columns(items, 4),
+           'app\u2026\nban\u2026\nche\u2026\ndate\nfig');
+  t.expect('columns([], 20)', Text.columns([], 20), '');
+};
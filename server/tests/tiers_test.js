@@ -0,0 +1,175 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for permission tiers.
+ */
+'use strict';
+
+const Tiers = require('../tiers');
+const {getInterpreter} = require('./interpreter_common');
+const {T} = require('./testing');
+
+/**
+ * Unit tests for Tiers.isValid and Tiers.atLeast.
+ * @param {!T} t The test runner object.
+ */
+exports.testTiersAtLeast = function(t) {
+  for (const tier of ['player', 'programmer', 'wizard']) {
+    t.expect('isValid(' + JSON.stringify(tier) + ')', Tiers.isValid(tier),
+             true);
+  }
+  for (const tier of ['', 'Wizard', 'root', null, 2]) {
+    t.expect('isValid(' + JSON.stringify(tier) + ')', Tiers.isValid(tier),
+             false);
+  }
+  const cases = [
+    ['player', 'player', true],
+    ['player', 'programmer', false],
+    ['programmer', 'player', true],
+    ['programmer', 'wizard', false],
+    ['wizard', 'programmer', true],
+  ];
+  for (const [tier, required, expected] of cases) {
+    t.expect('atLeast(' + tier + ', ' + required + ')',
+             Tiers.atLeast(tier, required), expected);
+  }
+};
+
+/**
+ * Unit tests for the CC.tier builtins, and the checks the interpreter
+ * makes of tiers.
+ * @param {!T} t The test runner object.
+ */
+exports.testTiersEnforced = function(t) {
+  const intrp = getInterpreter();
+  intrp.createThreadForSrc(`
+      var results = [];
+      var attempt = function(owner, f) {
+        Object.setOwnerOf(f, owner);  // So that it runs with owner's perms.
+        try {
+          f();
+          results.push('ok');
+        } catch (e) {
+          results.push(e.name);
+        }
+      };
+      var alice = {name: 'Alice'};
+      var bob = {name: 'Bob'};
+      var carol = {name: 'Carol'};
+      results.push(CC.tierDefault(), CC.tier(CC.root), CC.tier(null),
+                   CC.tier(alice));
+      CC.tierSet(alice, 'player');
+      CC.tierSet(bob, 'programmer');
+      results.push(CC.tier(alice), CC.tier(bob), CC.tiers().length);
+      var bobs = {};
+      Object.setOwnerOf(bobs, bob);
+      var evalCode = function() {eval('1 + 1');};
+      var construct = function() {new Function('return 1');};
+      attempt(alice, evalCode);
+      attempt(alice, construct);
+      attempt(bob, evalCode);
+      attempt(bob, construct);
+      attempt(bob, function() {setPerms(alice);});
+      attempt(bob, function() {Object.setOwnerOf(bobs, alice);});
+      attempt(bob, function() {Object.setOwnerOf(carol, alice);});
+      attempt(bob, function() {CC.tierSet(bob, 'wizard');});
+      CC.tierSet(carol, 'wizard');
+      attempt(carol, function() {CC.tierSet(bob, 'wizard');});
+      CC.tierSet(carol, null);
+      CC.tierSetDefault('player');
+      attempt(carol, evalCode);
+      CC.tierSet(alice, null);
+      results.push(CC.tier(alice), CC.tier(bob), CC.tier(carol));
+      try {
+        CC.tierSet(bob, 'god');
+      } catch (e) {
+        results.push(e.name);
+      }
+      try {
+        CC.tierSet(CC.root, 'player');
+      } catch (e) {
+        results.push(e.name);
+      }
+  `);
+  intrp.run();
+  const results = intrp.pseudoToNative(
+      intrp.global.get('results', intrp.ROOT));
+  t.expect('defaults', results.slice(0, 4).join(),
+           'programmer,wizard,player,programmer');
+  t.expect('tierSet', results.slice(4, 7).join(), 'player,programmer,2');
+  t.expect('player: eval', results[7], 'PermissionError');
+  t.expect('player: Function', results[8], 'PermissionError');
+  t.expect('programmer: eval', results[9], 'ok');
+  t.expect('programmer: Function', results[10], 'ok');
+  t.expect('programmer: setPerms', results[11], 'PermissionError');
+  t.expect('programmer: give own object', results[12], 'ok');
+  t.expect("programmer: chown others' object", results[13],
+           'PermissionError');
+  t.expect('programmer: tierSet', results[14], 'PermissionError');
+  t.expect('wizard: tierSet', results[15], 'ok');
+  t.expect('player (by default): eval', results[16], 'PermissionError');
+  t.expect('tierSet (to default)', results.slice(17, 20).join(),
+           'player,programmer,player');
+  t.expect('tierSet (invalid tier)', results[20], 'RangeError');
+  t.expect('tierSet (root)', results[21], 'PermissionError');
+};
+
+/**
+ * Unit tests that an owner not assigned a tier, in a new world, may
+ * do what programmers may but not what only wizards may.
+ * @param {!T} t The test runner object.
+ */
+exports.testTiersDefault = function(t) {
+  const intrp = getInterpreter();
+  intrp.createThreadForSrc(`
+      var results = [];
+      var newcomer = {name: 'Newcomer'};
+      var other = {name: 'Other'};
+      var others = {};
+      Object.setOwnerOf(others, other);
+      var attempts = [
+        function() {eval('1 + 1');},
+        function() {setPerms(other);},
+        function() {Object.setOwnerOf(others, newcomer);},
+        function() {CC.tierSet(newcomer, 'wizard');},
+        function() {CC.tierSetDefault('wizard');},
+        function() {CC.recycleBinEmpty();},
+      ];
+      for (var i = 0; i < attempts.length; i++) {
+        Object.setOwnerOf(attempts[i], newcomer);
+        try {
+          attempts[i]();
+          results.push('ok');
+        } catch (e) {
+          results.push(e.name);
+        }
+      }
+      results.push(CC.tier(newcomer), CC.tierDefault());
+  `);
+  intrp.run();
+  const results = intrp.pseudoToNative(
+      intrp.global.get('results', intrp.ROOT));
+  t.expect('eval', results[0], 'ok');
+  t.expect('setPerms', results[1], 'PermissionError');
+  t.expect("chown others' object", results[2], 'PermissionError');
+  t.expect('tierSet', results[3], 'PermissionError');
+  t.expect('tierSetDefault', results[4], 'PermissionError');
+  t.expect('recycleBinEmpty', results[5], 'PermissionError');
+  t.expect('tiers afterwards', results.slice(6).join(),
+           'programmer,programmer');
+};
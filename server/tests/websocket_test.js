@@ -0,0 +1,484 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for the WebSocket server implementation.
+ */
+'use strict';
+
+const net = require('net');
+const {T} = require('./testing');
+const WebSocket = require('../websocket');
+
+/**
+ * Encode a frame as a client would (i.e., masked).
+ * @param {number} opcode Opcode of frame.
+ * @param {string|!Buffer} payload Payload of frame.
+ * @param {boolean=} fin Is this the final frame of a message?
+ * @return {!Buffer}
+ */
+function clientFrame(opcode, payload, fin = true) {
+  const data = Buffer.from(payload);
+  const frame = WebSocket.encodeFrame(opcode, data);
+  frame[0] = (frame[0] & 0x7f) | (fin ? 0x80 : 0);
+  const headerLength = frame.length - data.length;
+  const mask = Buffer.from([0x37, 0xfa, 0x21, 0x3d]);
+  const masked = Buffer.from(data.map((b, i) => b ^ mask[i % 4]));
+  frame[1] |= 0x80;
+  return Buffer.concat([frame.subarray(0, headerLength), mask, masked]);
+}
+
+/**
+ * A client connected to a WebSocket.Connection over a loopback TCP
+ * connection.
+ * @param {!WebSocket.Options=} options Options for the connection.
+ * @param {string=} headers Additional headers for the opening request.
+ * @return {!Promise<{ws: !WebSocket.Connection, client: !net.Socket,
+ *     response: string, frames: !Array<{opcode: number, payload: !Buffer,
+ *     compressed: boolean}>, server: !net.Server}>}
+ */
+async function connect(options, headers = '') {
+  const server = net.createServer();
+  await new Promise((resolve) => server.listen(0, 'localhost', resolve));
+  const accepted = new Promise((resolve, reject) => {
+    server.on('connection', (socket) => {
+      WebSocket.readRequest(socket, (error, request, head) => {
+        if (error) {
+          reject(error);
+          return;
+        }
+        resolve(new WebSocket.Connection(socket, request, head, options));
+      });
+    });
+  });
+  const client = net.createConnection(server.address().port, 'localhost');
+  // Example key from RFC 6455 §1.3.
+  client.write('GET /chat HTTP/1.1\r\nHost: localhost\r\n' +
+               'Upgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n' +
+               'Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n' +
+               'Sec-WebSocket-Version: 13\r\n' + headers + '\r\n');
+  const ws = await accepted;
+  const frames = [];
+  let received = Buffer.alloc(0);
+  let response = null;
+  const ready = new Promise((resolve) => {
+    client.on('data', (data) => {
+      received = Buffer.concat([received, data]);
+      if (response === null) {
+        const end = received.indexOf('\r\n\r\n');
+        if (end === -1) return;
+        response = received.toString('latin1', 0, end);
+        received = received.subarray(end + 4);
+        resolve();
+      }
+      // Parse unmasked server frames (all short enough for 16-bit lengths).
+      while (received.length >= 2) {
+        let length = received[1];
+        let offset = 2;
+        if (length === 126) {
+          if (received.length < 4) break;
+          length = received.readUInt16BE(2);
+          offset = 4;
+        }
+        if (received.length < offset + length) break;
+        frames.push({
+          opcode: received[0] & 0x0f,
+          payload: received.subarray(offset, offset + length),
+          compressed: Boolean(received[0] & 0x40),
+        });
+        received = received.subarray(offset + length);
+      }
+    });
+  });
+  await ready;
+  return {ws, client, response, frames, server};
+}
+
+/**
+ * Wait for any pending I/O to complete.
+ * @return {!Promise}
+ */
+function settle() {
+  return new Promise((resolve) => setTimeout(resolve, 50));
+}
+
+/**
+ * Unit tests for WebSocket.parseCookies and WebSocket.parseRequest_.
+ * @param {!T} t The test runner object.
+ */
+exports.testWebSocketParse = function(t) {
+  const cookies = WebSocket.parseCookies('ID=c0ffee; other=a%20b; bad=%');
+  t.expect("parseCookies(...)['ID']", cookies['ID'], 'c0ffee');
+  t.expect("parseCookies(...)['other']", cookies['other'], 'a b');
+  t.expect("parseCookies(...)['bad']", cookies['bad'], undefined);
+  t.expect('parseCookies(undefined)',
+           Object.keys(WebSocket.parseCookies(undefined)).length, 0);
+
+  const valid = 'GET /ws HTTP/1.1\r\nHost: x\r\nUpgrade: WebSocket\r\n' +
+      'Connection: Upgrade\r\nOrigin: https://example.com\r\n' +
+      'Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n' +
+      'Sec-WebSocket-Version: 13';
+  const request = WebSocket.parseRequest_(valid);
+  t.expect('parseRequest_(...).url', request.url, '/ws');
+  t.expect("parseRequest_(...).headers['origin']", request.headers['origin'],
+           'https://example.com');
+  const invalid = {
+    'POST': valid.replace('GET', 'POST'),
+    'no upgrade': valid.replace('Upgrade: WebSocket\r\n', ''),
+    'version 8': valid.replace('Version: 13', 'Version: 8'),
+    'short key': valid.replace('dGhlIHNhbXBsZSBub25jZQ==', 'c2hvcnQ='),
+    'malformed': 'GET /ws\r\n',
+  };
+  for (const name in invalid) {
+    try {
+      WebSocket.parseRequest_(invalid[name]);
+      t.fail('parseRequest_(/* ' + name + ' */)', "Didn't throw.");
+    } catch (e) {
+      t.pass('parseRequest_(/* ' + name + ' */)');
+    }
+  }
+};
+
+/**
+ * Unit tests for WebSocket.parseList and WebSocket.negotiateDeflate_.
+ * @param {!T} t The test runner object.
+ */
+exports.testWebSocketNegotiate = function(t) {
+  t.expect("parseList('codecity.v2, codecity.v1')",
+           WebSocket.parseList('codecity.v2, codecity.v1').join('|'),
+           'codecity.v2|codecity.v1');
+  t.expect("parseList(' a,,b ')", WebSocket.parseList(' a,,b ').join('|'),
+           'a|b');
+  t.expect('parseList(undefined)', WebSocket.parseList(undefined).length, 0);
+
+  const cases = [
+    ['permessage-deflate; client_max_window_bits', 15, ''],
+    ['permessage-deflate; server_max_window_bits=10', 10,
+     '; server_max_window_bits=10'],
+    // First offer is unacceptable; second is accepted.
+    ['permessage-deflate; server_max_window_bits=8, permessage-deflate', 15,
+     ''],
+    ['x-webkit-deflate-frame', null],
+    ['permessage-deflate; unknown_param', null],
+    ['permessage-deflate; client_no_context_takeover=1', null],
+    ['permessage-deflate; server_no_context_takeover; ' +
+     'server_no_context_takeover', null],
+    [undefined, null],
+  ];
+  for (const [header, windowBits, params] of cases) {
+    const name = 'negotiateDeflate_(' + JSON.stringify(header) + ')';
+    const result = WebSocket.negotiateDeflate_(header);
+    if (windowBits === null) {
+      t.expect(name, result, null);
+      continue;
+    }
+    t.expect(name + '.windowBits', result && result.windowBits, windowBits);
+    t.expect(name + '.response', result && result.response,
+             'permessage-deflate; server_no_context_takeover; ' +
+             'client_no_context_takeover' + params);
+  }
+};
+
+/**
+ * Unit tests for WebSocket.encodeFrame and WebSocket.decodeFrame_.
+ * @param {!T} t The test runner object.
+ */
+exports.testWebSocketFrames = function(t) {
+  t.expect('encodeFrame(TEXT, "Hello")',
+           WebSocket.encodeFrame(WebSocket.Opcode.TEXT,
+                                 Buffer.from('Hello')).toString('hex'),
+           '810548656c6c6f');
+  t.expect('encodeFrame(TEXT, /* 256 bytes */).length',
+           WebSocket.encodeFrame(WebSocket.Opcode.TEXT,
+                                 Buffer.alloc(256)).length, 260);
+  t.expect('encodeFrame(TEXT, /* 64 KiB */).length',
+           WebSocket.encodeFrame(WebSocket.Opcode.TEXT,
+                                 Buffer.alloc(0x10000)).length, 0x1000a);
+
+  // Masked "Hello", from RFC 6455 §5.7.
+  const hello = Buffer.from('818537fa213d7f9f4d5158', 'hex');
+  let frame = WebSocket.decodeFrame_(hello, 100);
+  t.expect('decodeFrame_(hello).payload', String(frame.payload), 'Hello');
+  t.expect('decodeFrame_(hello).length', frame.length, hello.length);
+  t.expect('decodeFrame_(hello).fin', frame.fin, true);
+  t.expect('decodeFrame_(/* incomplete */)',
+           WebSocket.decodeFrame_(hello.subarray(0, 8), 100), null);
+  frame = WebSocket.decodeFrame_(clientFrame(WebSocket.Opcode.TEXT,
+                                             'x'.repeat(300)), 1000);
+  t.expect('decodeFrame_(/* 300 bytes */).payload.length',
+           frame.payload.length, 300);
+
+  const unmasked = WebSocket.encodeFrame(WebSocket.Opcode.TEXT,
+                                         Buffer.from('Hello'));
+  t.expect('decodeFrame_(/* unmasked */).error.status',
+           WebSocket.decodeFrame_(unmasked, 100).error.status,
+           WebSocket.Status.PROTOCOL_ERROR);
+  t.expect('decodeFrame_(/* too big */).error.status',
+           WebSocket.decodeFrame_(hello, 4).error.status,
+           WebSocket.Status.TOO_BIG);
+  t.expect('decodeFrame_(/* fragmented ping */).error.status',
+           WebSocket.decodeFrame_(clientFrame(WebSocket.Opcode.PING, '', false),
+                                  100).error.status,
+           WebSocket.Status.PROTOCOL_ERROR);
+};
+
+/**
+ * Unit tests for WebSocket.Connection.
+ * @param {!T} t The test runner object.
+ */
+exports.testWebSocketConnection = async function(t) {
+  let {ws, client, response, frames, server} = await connect();
+  try {
+    t.expect('Connection handshake response', response.split('\r\n')[0],
+             'HTTP/1.1 101 Switching Protocols');
+    t.assert('Connection handshake Sec-WebSocket-Accept', response.includes(
+        'Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo='));
+
+    const messages = [];
+    ws.on('data', (data) => messages.push(data));
+    client.write(clientFrame(WebSocket.Opcode.TEXT, 'look\n'));
+    client.write(clientFrame(WebSocket.Opcode.TEXT, 'caf', false));
+    client.write(clientFrame(WebSocket.Opcode.PING, 'are you there?'));
+    client.write(clientFrame(WebSocket.Opcode.CONTINUATION, 'é\n'));
+    ws.write('You see nothing.\n');
+    await settle();
+    t.expect('Connection messages received', messages.join('|'),
+             'look\n|café\n');
+    t.expect('Connection frames sent',
+             frames.map((f) => f.opcode + ':' + f.payload).join('|'),
+             WebSocket.Opcode.TEXT + ':You see nothing.\n|' +
+             WebSocket.Opcode.PONG + ':are you there?');
+
+    // Closing handshake, initiated by the client.
+    let ended = 0;
+    const closed = new Promise((resolve) => ws.on('close', resolve));
+    ws.on('end', () => ended++);
+    client.write(clientFrame(WebSocket.Opcode.CLOSE, Buffer.from([0x03, 0xe8])));
+    await closed;
+    t.expect('Connection close: end events', ended, 1);
+    t.expect('Connection close: reply opcode', frames[2].opcode,
+             WebSocket.Opcode.CLOSE);
+  } finally {
+    client.destroy();
+    server.close();
+  }
+
+  // Binary and invalid messages are rejected.
+  const rejects = {
+    'binary': [clientFrame(WebSocket.Opcode.BINARY, 'x'),
+               WebSocket.Status.UNSUPPORTED_DATA],
+    'invalid UTF-8': [clientFrame(WebSocket.Opcode.TEXT, Buffer.from([0xff])),
+                      WebSocket.Status.INVALID_DATA],
+    'too big': [clientFrame(WebSocket.Opcode.TEXT, 'x'.repeat(200)),
+                WebSocket.Status.TOO_BIG],
+  };
+  for (const name in rejects) {
+    ({ws, client, response, frames, server} = await connect(
+        {maxMessageSize: 100}));
+    try {
+      const errors = [];
+      ws.on('error', (e) => errors.push(e));
+      client.write(rejects[name][0]);
+      await settle();
+      t.expect('Connection rejects ' + name + ': errors', errors.length, 1);
+      t.expect('Connection rejects ' + name + ': close status',
+               frames.length && frames[0].payload.readUInt16BE(0),
+               rejects[name][1]);
+    } finally {
+      client.destroy();
+      server.close();
+    }
+  }
+};
+
+/**
+ * Unit tests for WebSocket.Connection's subprotocol selection,
+ * compression and binary messages.
+ * @param {!T} t The test runner object.
+ */
+exports.testWebSocketConnectionExtensions = async function(t) {
+  const zlib = require('zlib');
+  /**
+   * Compress a message as a client using permessage-deflate would.
+   * @param {string} text The message.
+   * @return {!Buffer}
+   */
+  const deflate = (text) => {
+    const data = zlib.deflateRawSync(Buffer.from(text),
+        {finishFlush: zlib.constants.Z_SYNC_FLUSH});
+    return data.subarray(0, data.length - 4);
+  };
+  /**
+   * Decompress a frame sent by the server.
+   * @param {!Buffer} payload The frame's payload.
+   * @return {string}
+   */
+  const inflate = (payload) => String(zlib.inflateRawSync(
+      Buffer.concat([payload, Buffer.from([0, 0, 0xff, 0xff])]),
+      {finishFlush: zlib.constants.Z_SYNC_FLUSH}));
+
+  let {ws, client, response, frames, server} = await connect(
+      {protocol: 'codecity.v2', binary: true, deflate: true},
+      'Sec-WebSocket-Protocol: codecity.v2, codecity.v1\r\n' +
+      'Sec-WebSocket-Extensions: permessage-deflate; ' +
+      'client_max_window_bits\r\n');
+  try {
+    t.assert('Connection handshake Sec-WebSocket-Protocol',
+             response.includes('Sec-WebSocket-Protocol: codecity.v2\r\n'));
+    t.assert('Connection handshake Sec-WebSocket-Extensions', response.includes(
+        'Sec-WebSocket-Extensions: permessage-deflate;'));
+    t.expect('Connection.p.protocol', ws.protocol, 'codecity.v2');
+    t.expect('Connection.p.deflate', ws.deflate, true);
+    t.expect('Connection.p.binary', ws.binary, true);
+
+    const messages = [];
+    ws.on('data', (data) => messages.push(data));
+    const compressed = clientFrame(WebSocket.Opcode.TEXT, deflate('look\n'));
+    compressed[0] |= 0x40;
+    client.write(compressed);
+    client.write(clientFrame(WebSocket.Opcode.TEXT, 'plain\n'));
+    client.write(clientFrame(WebSocket.Opcode.BINARY, Buffer.from([0, 0xff])));
+    const long = 'You see nothing. '.repeat(10);
+    ws.write(long);
+    ws.write('Short.');
+    ws.write(Buffer.from([1, 2, 3]));
+    await settle();
+    t.expect('Connection messages received', messages.length, 3);
+    t.expect('Connection compressed message received', messages[0],
+             'look\n');
+    t.expect('Connection plain message received', messages[1], 'plain\n');
+    t.assert('Connection binary message received',
+             Buffer.isBuffer(messages[2]) &&
+             messages[2].equals(Buffer.from([0, 0xff])));
+    t.expect('Connection long message sent compressed',
+             frames[0].compressed && inflate(frames[0].payload), long);
+    t.expect('Connection short message sent uncompressed',
+             !frames[1].compressed && String(frames[1].payload), 'Short.');
+    t.expect('Connection binary message sent',
+             frames[2].opcode === WebSocket.Opcode.BINARY &&
+             frames[2].payload.join(), '1,2,3');
+  } finally {
+    client.destroy();
+    server.close();
+  }
+
+  // Compression is declined if not offered, and RSV1 is then invalid.
+  ({ws, client, response, frames, server} = await connect({deflate: true}));
+  try {
+    t.assert('Connection handshake (not offered) Sec-WebSocket-Extensions',
+             !response.includes('Sec-WebSocket-Extensions'));
+    t.expect('Connection.p.deflate (not offered)', ws.deflate, false);
+    t.expect('Connection.p.protocol (none)', ws.protocol, null);
+    const errors = [];
+    ws.on('error', (e) => errors.push(e));
+    const compressed = clientFrame(WebSocket.Opcode.TEXT, deflate('look\n'));
+    compressed[0] |= 0x40;
+    client.write(compressed);
+    await settle();
+    t.expect('Connection rejects unnegotiated RSV1: close status',
+             frames.length && frames[0].payload.readUInt16BE(0),
+             WebSocket.Status.PROTOCOL_ERROR);
+  } finally {
+    client.destroy();
+    server.close();
+  }
+};
+
+/**
+ * Unit tests for WebSocket.Connection.prototype.write's flow control.
+ * @param {!T} t The test runner object.
+ */
+exports.testWebSocketBackpressure = async function(t) {
+  // Messages must be large enough to fill the kernel's socket buffers.
+  const message = 'x'.repeat(60000);
+  let {ws, client, frames, server} = await connect(
+      {highWaterMark: 100000, maxQueued: 1e9});
+  try {
+    client.pause();
+    let result = true;
+    let writes = 0;
+    while (result && writes < 2000) {
+      result = ws.write(message);
+      writes++;
+    }
+    t.expect('Connection.p.write(...) eventually', result, false);
+    t.assert('Connection.p.bufferedAmount', ws.bufferedAmount > 100000);
+    const drained = new Promise((resolve) => ws.on('drain', resolve));
+    client.resume();
+    await drained;
+    t.pass('Connection drain event');
+    await settle();
+    t.expect('Connection frames received', frames.length, writes);
+  } finally {
+    client.destroy();
+    server.close();
+  }
+
+  // Overflowing the queue closes the connection.
+  ({ws, client, frames, server} = await connect({maxQueued: 1000000}));
+  try {
+    const closed = new Promise((resolve) => ws.on('close', resolve));
+    ws.on('error', () => {});
+    client.pause();
+    for (let i = 0; i < 2000; i++) {
+      ws.write(message);
+    }
+    client.resume();
+    await closed;
+    t.pass('Connection closed on overflow');
+  } finally {
+    client.destroy();
+    server.close();
+  }
+};
+
+/**
+ * Unit tests for WebSocket.Connection keepalive pings.
+ * @param {!T} t The test runner object.
+ */
+exports.testWebSocketKeepalive = async function(t) {
+  // A client that responds to pings stays connected.
+  let {ws, client, frames, server} = await connect({keepalive: 30});
+  try {
+    let closed = false;
+    ws.on('close', () => closed = true);
+    for (let i = 0; i < 12; i++) {
+      await new Promise((resolve) => setTimeout(resolve, 10));
+      client.write(clientFrame(WebSocket.Opcode.PONG, ''));
+    }
+    const pings = frames.filter((f) => f.opcode === WebSocket.Opcode.PING);
+    t.assert('Pings sent', pings.length >= 2);
+    t.expect('Connection closed (with pongs)', closed, false);
+  } finally {
+    client.destroy();
+    server.close();
+  }
+
+  // One that doesn't is dropped.
+  ({ws, client, frames, server} = await connect({keepalive: 30}));
+  try {
+    let error = null;
+    ws.on('error', (e) => error = e);
+    await new Promise((resolve) => ws.on('close', resolve));
+    t.expect('Error (without pongs)', String(error),
+             'Error: No response to keepalive ping');
+    t.expect('Pings sent (without pongs)', frames.length, 1);
+  } finally {
+    client.destroy();
+    server.close();
+  }
+};
@@ -0,0 +1,104 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for hosting additional worlds.
+ */
+'use strict';
+
+const fs = require('fs');
+const Interpreter = require('../interpreter');
+const os = require('os');
+const path = require('path');
+const {T} = require('./testing');
+const Worlds = require('../worlds');
+
+/**
+ * Unit tests for Worlds.Manager and Worlds.World.
+ * @param {!T} t The test runner object.
+ */
+exports.testWorlds = async function(t) {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'worlds_test-'));
+  fs.mkdirSync(path.join(dir, 'core'));
+  fs.writeFileSync(path.join(dir, 'core', 'core_00_test.js'),
+                   'var counter = 41;\n');
+  const manager = new Worlds.Manager({
+    makeInterpreter: function(world) {return new Interpreter();},
+    dir: dir,
+    checkpointInterval: 0,
+  });
+
+  // Creating worlds.
+  const world = manager.create('staging', 'staging', 'core');
+  t.expect('world.status', world.status, Worlds.Status.STOPPED);
+  t.expect('world.dir', world.dir, path.join(dir, 'staging'));
+  t.assert('world directory created', fs.existsSync(world.dir));
+  t.expect('manager.get(staging)', manager.get('staging'), world);
+  t.expect('manager.list()', String(manager.list().map(function(w) {
+    return w.name;
+  })), 'staging');
+  for (const name of ['staging', '', 'a/b']) {
+    let threw = false;
+    try {
+      manager.create(name, 'elsewhere');
+    } catch (e) {
+      threw = true;
+    }
+    t.assert('create(' + JSON.stringify(name) + ') throws', threw);
+  }
+
+  // Starting from startup files.
+  await world.start();
+  t.expect('world.status (started)', world.status, Worlds.Status.RUNNING);
+  world.intrp.createThreadForSrc('counter++;');
+  world.intrp.run();
+  let threw = false;
+  try {
+    manager.remove('staging');
+  } catch (e) {
+    threw = true;
+  }
+  t.assert('remove(running world) throws', threw);
+
+  // Stopping (which checkpoints), then starting from the checkpoint.
+  world.stop();
+  t.expect('world.status (stopped)', world.status, Worlds.Status.STOPPED);
+  t.expect('world.intrp (stopped)', world.intrp, null);
+  t.assert('world.checkpointTime', world.checkpointTime !== null);
+  fs.unlinkSync(path.join(dir, 'core', 'core_00_test.js'));
+  await world.start();
+  t.expect('counter (restored)', world.intrp.global.get('counter'), 42);
+  t.expect('describe().status', world.describe().status, 'running');
+  t.expect('checkpoint()', world.checkpoint(), true);
+  manager.stopAll();
+  t.expect('world.status (stopAll)', world.status, Worlds.Status.STOPPED);
+
+  // A world with no startup files, or saved world, fails to start.
+  const empty = manager.create('empty', 'empty');
+  threw = false;
+  try {
+    await empty.start();
+  } catch (e) {
+    threw = true;
+  }
+  t.assert('start(empty) rejects', threw);
+  t.expect('empty.status', empty.status, Worlds.Status.STOPPED);
+
+  manager.remove('empty');
+  t.expect('manager.list() (after remove)', manager.list().length, 1);
+  fs.rmSync(dir, {recursive: true, force: true});
+};
@@ -0,0 +1,170 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unit tests for XML and HTML tokenizing.
+ */
+'use strict';
+
+const Xml = require('../xml');
+const {T} = require('./testing');
+
+/**
+ * Tokenize some text, and summarize the tokens for comparison.
+ * @param {string} text The text.
+ * @param {!Xml.Options=} options Options.
+ * @return {string} The tokens, one per line, and the rest and open
+ *     elements, if any.
+ */
+function summarize(text, options) {
+  const result = Xml.tokenize(text, options);
+  const lines = result.tokens.map((token) => {
+    switch (token.type) {
+      case 'start':
+        return '<' + token.name +
+            Object.entries(token.attrs).map(([k, v]) => ` ${k}=${v}`)
+                .join('') + (token.selfClosing ? '/>' : '>');
+      case 'end':
+        return '</' + token.name + '>';
+      case 'pi':
+        return token.type + ' ' + token.name + ': ' + token.text;
+      default:
+        return token.type + ': ' + token.text;
+    }
+  });
+  if (result.rest) lines.push('rest: ' + result.rest);
+  if (result.open.length) lines.push('open: ' + result.open.join(','));
+  return lines.join('\n');
+}
+
+/**
+ * Unit tests for tokenizing XML.
+ * @param {!T} t The test runner object.
+ */
+exports.testXmlTokenize = function(t) {
+  t.expect('tokenize(<document>)', summarize(
+      '<?xml version="1.0"?>\n<!DOCTYPE rooms [<!ENTITY x "y">]>' +
+      '<rooms n=\'2\'><room name="Hall &amp; &#x2603;">A &lt;big&gt; ' +
+      'room</room><!-- c --><room name="Loo"/><![CDATA[<x>]]></rooms>'), [
+    'pi xml: version="1.0"',
+    'text: \n',
+    'doctype: rooms [<!ENTITY x "y">]',
+    '<rooms n=2>',
+    '<room name=Hall & \u2603>',
+    'text: A <big> room',
+    '</room>',
+    'comment:  c ',
+    '<room name=Loo/>',
+    'cdata: <x>',
+    '</rooms>',
+  ].join('\n'));
+
+  const errors = [
+    ['<a><b></a>', 'Unexpected end tag </a>, expected </b>'],
+    ['</a>', 'Unexpected end tag </a>'],
+    ['<a>', 'Unclosed element <a>'],
+    ['<a x="1" x="2"/>', 'Duplicate attribute x'],
+    ['<a x=1/>', 'Malformed start tag <a>'],
+    ['a < b', 'Unexpected <'],
+    ['&nbsp;', 'Unknown entity &nbsp;'],
+    ['AT&T', 'Malformed character reference &T'],
+    ['&#0;', 'Invalid character reference &#0;'],
+    ['<!-- x', 'Unterminated comment'],
+  ];
+  for (const [xml, message] of errors) {
+    try {
+      Xml.tokenize(xml);
+      t.fail('tokenize(' + JSON.stringify(xml) + ')', 'did not throw');
+    } catch (e) {
+      t.expect('tokenize(' + JSON.stringify(xml) + ')', String(e),
+               'SyntaxError: ' + message);
+    }
+  }
+  try {
+    Xml.tokenize('<a>'.repeat(Xml.MAX_DEPTH + 1));
+    t.fail('tokenize(<deep>)', 'did not throw');
+  } catch (e) {
+    t.expect('tokenize(<deep>)', String(e),
+             'RangeError: Elements nested too deeply');
+  }
+};
+
+/**
+ * Unit tests for tokenizing XML in chunks.
+ * @param {!T} t The test runner object.
+ */
+exports.testXmlTokenizeStream = function(t) {
+  const xml = '<log><entry at="1">Tom &amp; Jerry</entry><!-- <ignored> -->' +
+      '<entry at="2"/></log>';
+  // Split the document at every possible point.
+  for (let i = 1; i < xml.length; i++) {
+    const first = Xml.tokenize(xml.slice(0, i), {final: false});
+    const second = Xml.tokenize(first.rest + xml.slice(i),
+                                {open: first.open});
+    const tokens = first.tokens.concat(second.tokens);
+    // Text split between chunks is in two tokens; join them.
+    const joined = [];
+    for (const token of tokens) {
+      const last = joined[joined.length - 1];
+      if (token.type === 'text' && last && last.type === 'text') {
+        last.text += token.text;
+      } else {
+        joined.push(Object.assign({}, token));
+      }
+    }
+    const name = 'tokenize(<split at ' + i + '>)';
+    t.expect(name, JSON.stringify(joined),
+             JSON.stringify(Xml.tokenize(xml).tokens));
+  }
+  t.expect('tokenize(<partial>)',
+           summarize('<log><entry at="1">Tom &am', {final: false}),
+           '<log>\n<entry at=1>\ntext: Tom \nrest: &am\nopen: log,entry');
+};
+
+/**
+ * Unit tests for tokenizing HTML.
+ * @param {!T} t The test runner object.
+ */
+exports.testXmlTokenizeHtml = function(t) {
+  t.expect('tokenize(<html>)', summarize(
+      '<!doctype html><P Class=x CLASS=y>a &nbsp;&amp b<br>' +
+      '<ul><li>1<li>2</ul><script>if (a<b) x="</p>"</script>' +
+      '<img src=x alt="a &lt; b"> 1 < 2</p', {html: true}), [
+    'doctype: html',
+    '<p class=x>',
+    'text: a \u00a0&amp b',
+    '<br>',
+    '<ul>',
+    '<li>',
+    'text: 1',
+    '<li>',
+    'text: 2',
+    '</ul>',
+    '<script>',
+    'text: if (a<b) x="</p>"',
+    '</script>',
+    '<img src=x alt=a < b>',
+    'text:  1 < 2</p',
+    'open: p',
+  ].join('\n'));
+  t.expect('tokenize(<html chunk>)', summarize(
+      '<div><script>a<b</scr', {html: true, final: false}),
+      '<div>\n<script>\ntext: a<b\nrest: </scr\nopen: div,script');
+  t.expect('tokenize(<html next chunk>)', summarize(
+      '</script>x', {html: true, open: ['div', 'script']}),
+      '</script>\ntext: x\nopen: div');
+};
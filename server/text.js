@@ -0,0 +1,567 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Unicode-aware text layout (the CC.text* builtins), for
+ * laying out tables and columns in telnet and web output.
+ *
+ * JavaScript strings are sequences of UTF-16 code units, so the
+ * .length of a string is not the number of characters a user sees:
+ * an emoji may be two code units (or, with modifiers and joiners,
+ * many more), and an accented letter may be a base letter followed by
+ * a combining mark.  These functions instead work in grapheme clusters
+ * (user-perceived characters, as segmented by Intl.Segmenter), and
+ * measure text by its display width in a terminal: zero columns for
+ * control and formatting characters, two for East Asian wide and
+ * fullwidth characters and emoji, and one for everything else.
+ *
+ * ANSI escape sequences (such as those Text.color adds to set colors)
+ * also take no space, and are never split; to send text to a terminal
+ * that does not support them, remove them with Text.stripAnsi.
+ */
+'use strict';
+
+var Text = {};
+
+/**
+ * Maximum length (in UTF-16 code units) of text to process.
+ * @const {number}
+ */
+Text.MAX_LENGTH = 1024 * 1024;
+
+/**
+ * Estimated speed (code units processed per ms), for computing the
+ * cost of operations.
+ * @const {number}
+ */
+Text.SPEED = 1024;
+
+/** @private @const {!Intl.Segmenter} */
+Text.GRAPHEMES_ = new Intl.Segmenter('en', {granularity: 'grapheme'});
+
+/** @private @const {!Intl.Segmenter} */
+Text.WORDS_ = new Intl.Segmenter('en', {granularity: 'word'});
+
+/**
+ * Length (in code units) of the pieces in which long text is
+ * segmented, since Intl.Segmenter copies the whole text into each
+ * segment it returns (and so takes time quadratic in its length).
+ * @private @const {number}
+ */
+Text.WINDOW_ = 128;
+
+/**
+ * Grapheme clusters that take no space: those beginning with a control
+ * or format character (other than the soft hyphen), or with a
+ * combining mark (that has nothing to combine with).
+ * @private @const {!RegExp}
+ */
+Text.ZERO_WIDTH_RE_ = /^(?:[\p{Cc}\p{M}]|(?!\u00ad)\p{Cf})/u;
+
+/**
+ * Grapheme clusters that take two columns: emoji, East Asian wide and
+ * fullwidth characters, and emoji characters followed by an emoji
+ * presentation selector.
+ * @private @const {!RegExp}
+ */
+Text.WIDE_RE_ = new RegExp('^(?:\\p{Emoji_Presentation}|' +
+    '\\p{Emoji}\\ufe0f|[' +
+    '\\u1100-\\u115f\\u2329\\u232a\\u2e80-\\u303e\\u3041-\\u33ff' +
+    '\\u3400-\\u4dbf\\u4e00-\\u9fff\\ua000-\\ua4cf\\ua960-\\ua97f' +
+    '\\uac00-\\ud7a3\\uf900-\\ufaff\\ufe10-\\ufe19\\ufe30-\\ufe6f' +
+    '\\uff00-\\uff60\\uffe0-\\uffe6\\u{16fe0}-\\u{16fe4}' +
+    '\\u{17000}-\\u{18cff}\\u{1b000}-\\u{1b2ff}\\u{1f200}-\\u{1f2ff}' +
+    '\\u{20000}-\\u{2fffd}\\u{30000}-\\u{3fffd}])', 'u');
+
+/**
+ * ANSI escape sequences: CSI sequences, such as the SGR sequences that
+ * set colors.
+ * @private @const {!RegExp}
+ */
+Text.ANSI_RE_ = /\x1b\[[0-?]*[ -\/]*[@-~]/g;
+
+/**
+ * ANSI SGR codes (to start and end) for each text style.
+ * @const {!Object<string, !Array<number>>}
+ */
+Text.STYLES = {
+  'bold': [1, 22],
+  'dim': [2, 22],
+  'italic': [3, 23],
+  'underline': [4, 24],
+  'inverse': [7, 27],
+  'black': [30, 39],
+  'red': [31, 39],
+  'green': [32, 39],
+  'yellow': [33, 39],
+  'blue': [34, 39],
+  'magenta': [35, 39],
+  'cyan': [36, 39],
+  'white': [37, 39],
+  'gray': [90, 39],
+  'bgBlack': [40, 49],
+  'bgRed': [41, 49],
+  'bgGreen': [42, 49],
+  'bgYellow': [43, 49],
+  'bgBlue': [44, 49],
+  'bgMagenta': [45, 49],
+  'bgCyan': [46, 49],
+  'bgWhite': [47, 49],
+};
+
+/**
+ * Terminal types (as reported by telnet clients) that support ANSI
+ * colors.
+ * @private @const {!RegExp}
+ */
+Text.COLOR_TERMINALS_ = new RegExp('^(?:xterm|vt(?:100|102|220|320)|ansi|' +
+    'linux|screen|tmux|rxvt|konsole|putty|cygwin|eterm|gnome|mintty|' +
+    'mudlet|mushclient|tintin|zmud|cmud|alacritty|kitty)', 'i');
+
+/**
+ * Estimated cost (in ms) of processing some text.
+ * @param {string} text The text.
+ * @return {number} The cost.
+ */
+Text.cost = function(text) {
+  return text.length / Text.SPEED;
+};
+
+/**
+ * Check that text is not too long.
+ * @param {string} text The text.
+ * @return {string} The text.
+ */
+Text.checkLength = function(text) {
+  if (text.length > Text.MAX_LENGTH) throw new RangeError('Text too long');
+  return text;
+};
+
+/**
+ * Segment text, a window at a time.  Each window but the last ends
+ * with a segment that may have been cut short, so it is segmented
+ * again as part of the next.
+ * @private
+ * @param {!Intl.Segmenter} segmenter The segmenter.
+ * @param {string} text The text.
+ * @return {!Array<{segment: string, isWordLike: (boolean|undefined)}>}
+ *     The segments.
+ */
+Text.segment_ = function(segmenter, text) {
+  Text.checkLength(text);
+  var result = [];
+  var start = 0;
+  var size = Text.WINDOW_;
+  while (start < text.length) {
+    var end = Math.min(start + size, text.length);
+    var segments = Array.from(segmenter.segment(text.slice(start, end)));
+    if (end < text.length) {
+      if (segments.length < 2) {
+        size *= 2;  // A very long segment (e.g., of combining marks).
+        continue;
+      }
+      segments.pop();
+    }
+    var last = segments[segments.length - 1];
+    start += last.index + last.segment.length;
+    size = Text.WINDOW_;
+    for (var i = 0; i < segments.length; i++) result.push(segments[i]);
+  }
+  return result;
+};
+
+/**
+ * Split text into grapheme clusters.
+ * @param {string} text The text.
+ * @return {!Array<string>} The grapheme clusters.
+ */
+Text.graphemes = function(text) {
+  return Text.segment_(Text.GRAPHEMES_, text).map((s) => s.segment);
+};
+
+/**
+ * Split text into words (omitting the spaces and punctuation between
+ * them).
+ * @param {string} text The text.
+ * @return {!Array<string>} The words.
+ */
+Text.words = function(text) {
+  return Text.segment_(Text.WORDS_, text).filter((s) => s.isWordLike)
+      .map((s) => s.segment);
+};
+
+/**
+ * Get the display width of a grapheme cluster.
+ * @param {string} grapheme The grapheme cluster.
+ * @return {number} The width, in columns: 0, 1 or 2.
+ */
+Text.graphemeWidth = function(grapheme) {
+  if (grapheme.length === 1 && grapheme < '\x7f') {
+    return (grapheme < ' ') ? 0 : 1;  // Fast path for ASCII.
+  } else if (Text.ZERO_WIDTH_RE_.test(grapheme)) {
+    return 0;
+  }
+  return Text.WIDE_RE_.test(grapheme) ? 2 : 1;
+};
+
+/**
+ * Split text into ANSI escape sequences and grapheme clusters.
+ * @private
+ * @param {string} text The text.
+ * @return {!Array<string>} The pieces.
+ */
+Text.tokens_ = function(text) {
+  var tokens = [];
+  var last = 0;
+  var add = function(end) {
+    if (end > last) {
+      tokens.push.apply(tokens, Text.graphemes(text.slice(last, end)));
+    }
+  };
+  Text.checkLength(text).replace(Text.ANSI_RE_, function(match, offset) {
+    add(offset);
+    tokens.push(match);
+    last = offset + match.length;
+    return match;
+  });
+  add(text.length);
+  return tokens;
+};
+
+/**
+ * Get the display width of a piece of text returned by Text.tokens_.
+ * @private
+ * @param {string} token The piece.
+ * @return {number} The width, in columns: 0, 1 or 2.
+ */
+Text.tokenWidth_ = function(token) {
+  return (token.length > 1 && token.charAt(0) === '\x1b') ? 0 :
+      Text.graphemeWidth(token);
+};
+
+/**
+ * Get the display width of some text.
+ * @param {string} text The text.
+ * @return {number} The width, in columns.
+ */
+Text.width = function(text) {
+  Text.checkLength(text);
+  if (/^[ -~]*$/.test(text)) return text.length;  // Printable ASCII.
+  text = text.replace(Text.ANSI_RE_, '');
+  return Text.graphemes(text).reduce(
+      (width, grapheme) => width + Text.graphemeWidth(grapheme), 0);
+};
+
+/**
+ * Check a width argument.
+ * @private
+ * @param {*} width The width.
+ * @return {number} The width.
+ */
+Text.checkWidth_ = function(width) {
+  if (typeof width !== 'number' || !Number.isInteger(width) || width < 0 ||
+      width > Text.MAX_LENGTH) {
+    throw new RangeError('width must be a non-negative integer');
+  }
+  return width;
+};
+
+/**
+ * Pad text to a given display width.  Text already that wide (or
+ * wider) is returned as it is.
+ * @param {string} text The text.
+ * @param {number} width The width, in columns.
+ * @param {string=} align 'left' (the default, i.e. pad on the right),
+ *     'right' or 'center'.
+ * @param {string=} fill The character to pad with, which must have a
+ *     display width of one (default ' ').
+ * @return {string} The padded text.
+ */
+Text.pad = function(text, width, align, fill) {
+  Text.checkWidth_(width);
+  align = (align === undefined) ? 'left' : align;
+  if (!['left', 'right', 'center'].includes(align)) {
+    throw new TypeError('align must be "left", "right" or "center"');
+  }
+  fill = (fill === undefined) ? ' ' : fill;
+  if (Text.graphemes(fill).length !== 1 || Text.width(fill) !== 1) {
+    throw new TypeError('fill must be a single character one column wide');
+  }
+  var padding = width - Text.width(text);
+  if (padding <= 0) return text;
+  var left = (align === 'right') ? padding :
+      (align === 'center') ? Math.floor(padding / 2) : 0;
+  return fill.repeat(left) + text + fill.repeat(padding - left);
+};
+
+/**
+ * Truncate text to fit a given display width, ending it with an
+ * ellipsis if anything was removed.  Grapheme clusters are never
+ * split, and ANSI escape sequences are never removed (so that, e.g.,
+ * a color is still ended).
+ * @param {string} text The text.
+ * @param {number} width The width, in columns.
+ * @param {string=} ellipsis Text to end truncated text with (default
+ *     '\u2026'), omitted if it is itself too wide.
+ * @return {string} The truncated text.
+ */
+Text.truncate = function(text, width, ellipsis) {
+  Text.checkWidth_(width);
+  ellipsis = (ellipsis === undefined) ? '\u2026' : ellipsis;
+  if (Text.width(text) <= width) return text;
+  var ellipsisWidth = Text.width(ellipsis);
+  if (ellipsisWidth > width) {
+    ellipsis = '';
+    ellipsisWidth = 0;
+  }
+  var result = '';
+  var escapes = '';
+  var used = ellipsisWidth;
+  var tokens = Text.tokens_(text);
+  for (var i = 0; i < tokens.length; i++) {
+    var tokenWidth = Text.tokenWidth_(tokens[i]);
+    if (used > width) {
+      if (!tokenWidth) escapes += tokens[i];
+      continue;
+    }
+    used += tokenWidth;
+    if (used <= width) result += tokens[i];
+  }
+  return result + ellipsis + escapes;
+};
+
+/**
+ * Wrap text to a given display width, breaking lines at spaces where
+ * possible (and within words only where they are too long to fit on a
+ * line of their own).  Spaces at line breaks are removed, but existing
+ * line breaks, and indentation at the start of each, are kept.
+ * @param {string} text The text.
+ * @param {number} width The width, in columns (at least one).
+ * @return {string} The wrapped text.
+ */
+Text.wrap = function(text, width) {
+  if (!Text.checkWidth_(width)) throw new RangeError('width must be positive');
+  return Text.checkLength(text).split('\n').map(function(line) {
+    return Text.wrapLine_(line, width).join('\n');
+  }).join('\n');
+};
+
+/**
+ * Wrap a line of text (see Text.wrap).
+ * @private
+ * @param {string} text The line.
+ * @param {number} width The width, in columns (at least one).
+ * @return {!Array<string>} The wrapped lines.
+ */
+Text.wrapLine_ = function(text, width) {
+  var lines = [];
+  var line = '';
+  var lineWidth = 0;
+  var space = '';  // Spaces after line, kept only if a word follows.
+  var spaceWidth = 0;
+  var word = '';
+  var wordWidth = 0;
+  var endWord = function() {
+    if (lineWidth && lineWidth + spaceWidth + wordWidth > width) {
+      lines.push(line);
+      line = '';
+      lineWidth = 0;
+    } else if (lineWidth || !lines.length) {
+      line += space;  // Not at the start of a wrapped line.
+      lineWidth += spaceWidth;
+    }
+    line += word;
+    lineWidth += wordWidth;
+    space = word = '';
+    spaceWidth = wordWidth = 0;
+  };
+  var tokens = Text.tokens_(text);
+  for (var i = 0; i < tokens.length; i++) {
+    var token = tokens[i];
+    if (token === ' ' || token === '\t') {
+      if (word) endWord();
+      space += ' ';
+      spaceWidth++;
+      continue;
+    }
+    var tokenWidth = Text.tokenWidth_(token);
+    if (wordWidth && wordWidth + tokenWidth > width) {
+      // Too long for a line of its own: break it.
+      if (line) lines.push(line);
+      lines.push(word);
+      line = space = word = '';
+      lineWidth = spaceWidth = wordWidth = 0;
+    }
+    word += token;
+    wordWidth += tokenWidth;
+  }
+  if (word) endWord();
+  lines.push(line);
+  return lines;
+};
+
+/**
+ * Options for Text.table:
+ *
+ * - width: maximum width of the table, in columns.  If the columns'
+ *   contents are too wide, the widest columns are narrowed and their
+ *   contents wrapped.  (Default: no maximum.)
+ * - separator: text to separate columns with.  (Default: two spaces.)
+ * - align: how to align the contents of each column ('left', 'right'
+ *   or 'center'; see Text.pad).  (Default: all left.)
+ * - header: whether the first row is a header, to be underlined.
+ * @typedef {{width: (number|undefined),
+ *            separator: (string|undefined),
+ *            align: (!Array<string>|undefined),
+ *            header: (boolean|undefined)}}
+ */
+Text.TableOptions;
+
+/**
+ * Lay out rows of text as a table, in columns.  Cells may contain line
+ * breaks, and trailing spaces are removed from each line.
+ * @param {!Array<!Array<string>>} rows The rows of cells.
+ * @param {!Text.TableOptions=} options Options.
+ * @return {string} The table.
+ */
+Text.table = function(rows, options) {
+  options = options || {};
+  var separator = (options.separator === undefined) ? '  ' :
+      options.separator;
+  var align = options.align || [];
+  var columns = rows.reduce(function(n, row) {
+    return Math.max(n, row.length);
+  }, 0);
+  var widths = [];
+  for (var col = 0; col < columns; col++) {
+    widths[col] = 0;
+    for (var r = 0; r < rows.length; r++) {
+      var lines = (rows[r][col] || '').split('\n');
+      for (var i = 0; i < lines.length; i++) {
+        widths[col] = Math.max(widths[col], Text.width(lines[i]));
+      }
+    }
+  }
+  if (options.width !== undefined) {
+    var available = Text.checkWidth_(options.width) -
+        Text.width(separator) * Math.max(columns - 1, 0);
+    var total = widths.reduce(function(a, b) {return a + b;}, 0);
+    while (total > available) {
+      var widest = widths.indexOf(Math.max.apply(Math, widths));
+      if (widths[widest] <= 1) break;
+      widths[widest]--;
+      total--;
+    }
+  }
+  var output = [];
+  rows.forEach(function(row, r) {
+    var cells = widths.map(function(width, col) {
+      return Text.wrap(row[col] || '', Math.max(width, 1)).split('\n');
+    });
+    var height = Math.max.apply(Math, cells.map(function(cell) {
+      return cell.length;
+    }));
+    for (var i = 0; i < height; i++) {
+      output.push(cells.map(function(cell, col) {
+        return Text.pad(cell[i] || '', widths[col], align[col]);
+      }).join(separator).replace(/ +$/, ''));
+    }
+    if (r === 0 && options.header) {
+      output.push(widths.map(function(width) {
+        return '-'.repeat(width);
+      }).join(separator).replace(/ +$/, ''));
+    }
+  });
+  return output.join('\n');
+};
+
+/**
+ * Lay out a list of items in as many columns as fit in a given width,
+ * reading down each column in turn (as ls does).  Items too wide for
+ * the width are truncated.
+ * @param {!Array<string>} items The items.
+ * @param {number} width The width, in columns.
+ * @param {string=} separator Text to separate columns with (default
+ *     two spaces).
+ * @return {string} The columns.
+ */
+Text.columns = function(items, width, separator) {
+  Text.checkWidth_(width);
+  separator = (separator === undefined) ? '  ' : separator;
+  var separatorWidth = Text.width(separator);
+  var columnWidth = Math.min(width, items.reduce(function(max, item) {
+    return Math.max(max, Text.width(item));
+  }, 0));
+  var columns = Math.max(1, Math.floor(
+      (width + separatorWidth) / (columnWidth + separatorWidth)));
+  var rows = Math.ceil(items.length / columns);
+  var output = [];
+  for (var r = 0; r < rows; r++) {
+    var line = [];
+    for (var c = 0; c * rows + r < items.length; c++) {
+      line.push(Text.pad(Text.truncate(items[c * rows + r], columnWidth),
+                         columnWidth));
+    }
+    output.push(line.join(separator).replace(/ +$/, ''));
+  }
+  return output.join('\n');
+};
+
+/**
+ * Style text with ANSI escape sequences.
+ * @param {string} text The text.
+ * @param {string} style Names of styles (see Text.STYLES) separated by
+ *     spaces, e.g., 'bold red'.
+ * @return {string} The styled text.
+ */
+Text.color = function(text, style) {
+  var names = style.split(/\s+/).filter(Boolean);
+  var start = [];
+  var end = [];
+  names.forEach(function(name) {
+    if (!Object.prototype.hasOwnProperty.call(Text.STYLES, name)) {
+      throw new TypeError('Unknown style: ' + name);
+    }
+    start.push(Text.STYLES[name][0]);
+    end.unshift(Text.STYLES[name][1]);
+  });
+  if (!names.length) return text;
+  return '\x1b[' + start.join(';') + 'm' + text + '\x1b[' + end.join(';') +
+      'm';
+};
+
+/**
+ * Remove ANSI escape sequences from text (e.g., for a terminal that
+ * does not support colors).
+ * @param {string} text The text.
+ * @return {string} The text, without them.
+ */
+Text.stripAnsi = function(text) {
+  return Text.checkLength(text).replace(Text.ANSI_RE_, '');
+};
+
+/**
+ * Does a terminal support ANSI colors?
+ * @param {string} terminalType The terminal type reported by the client
+ *     (e.g., by telnet's TTYPE option).
+ * @return {boolean} True iff it (probably) does.
+ */
+Text.supportsColor = function(terminalType) {
+  return Text.COLOR_TERMINALS_.test(terminalType);
+};
+
+module.exports = Text;
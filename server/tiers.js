@@ -0,0 +1,80 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Permission tiers of owners, enforced by the
+ * interpreter itself (see Interpreter.prototype.tierOf) as a backstop
+ * to whatever security the world's own code implements.
+ *
+ * Every owner has one of three tiers, each permitting what the ones
+ * below it do:
+ *
+ * - player: may run code (as any owner may), but not compile it.
+ * - programmer: may also eval code and construct functions from
+ *   source, and use builtins which reach outside the world (listening
+ *   on ports, making requests and sending mail).
+ * - wizard: may also change the perms of a thread to those of another
+ *   owner (setPerms), change the ownership of objects belonging to
+ *   others, kill others' threads and assign tiers (CC.tierSet).
+ *
+ * Root is always a wizard, and guests always players; other owners
+ * have the tier assigned them, or else the world's default tier
+ * (see CC.tierSetDefault).  This is initially programmer, so that only
+ * root and those it makes wizards can do what wizards may; but worlds
+ * whose checkpoints predate tiers default to wizard, so that they
+ * behave as they did before until their wizards assign tiers.
+ */
+'use strict';
+
+var Tiers = {};
+
+/**
+ * The tiers, lowest first.
+ * @enum {string}
+ */
+Tiers.Tier = {
+  PLAYER: 'player',
+  PROGRAMMER: 'programmer',
+  WIZARD: 'wizard',
+};
+
+/**
+ * The names of the tiers, lowest first.
+ * @const {!Array<!Tiers.Tier>}
+ */
+Tiers.ORDER = [Tiers.Tier.PLAYER, Tiers.Tier.PROGRAMMER, Tiers.Tier.WIZARD];
+
+/**
+ * Is a value the name of a tier?
+ * @param {*} tier The value.
+ * @return {boolean} True iff it is.
+ */
+Tiers.isValid = function(tier) {
+  return Tiers.ORDER.includes(tier);
+};
+
+/**
+ * Does a tier permit what another does?
+ * @param {!Tiers.Tier} tier The tier.
+ * @param {!Tiers.Tier} required The tier required.
+ * @return {boolean} True iff tier is at least as high as required.
+ */
+Tiers.atLeast = function(tier, required) {
+  return Tiers.ORDER.indexOf(tier) >= Tiers.ORDER.indexOf(required);
+};
+
+module.exports = Tiers;
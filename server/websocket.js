@@ -0,0 +1,753 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview The server side of the WebSocket protocol (RFC 6455),
+ * so that web browsers (which cannot make raw TCP connections) can
+ * connect to Code City directly.
+ *
+ * A connection is accepted in two steps: WebSocket.readRequest reads
+ * the HTTP request that opens it (from a net.Socket, e.g. as accepted
+ * by a net.Server), so that the caller can check it (e.g. for a login
+ * cookie); then either WebSocket.reject refuses it, or a new
+ * WebSocket.Connection completes the opening handshake.
+ *
+ * A WebSocket.Connection imitates a net.Socket carrying text: each
+ * message received is emitted as a 'data' event (with a string), and
+ * each call to .write sends one text message (or, if passed a Buffer,
+ * one binary message).  Messages to be sent are
+ * queued by the connection; .write returns false (and a 'drain' event
+ * follows) once more than highWaterMark bytes are queued, and the
+ * connection is dropped if more than maxQueued bytes ever are.
+ *
+ * The caller may also select one of the subprotocols the client
+ * offers (see WebSocket.parseList), accept binary messages (emitted as
+ * Buffers), and agree to compress messages with the permessage-deflate
+ * extension (RFC 7692), if the client offers it.
+ */
+'use strict';
+
+var crypto = require('crypto');
+var events = require('events');
+var util = require('util');
+var zlib = require('zlib');
+
+var WebSocket = {};
+
+/** @private @const {string} Appended to key to compute accept value. */
+WebSocket.GUID_ = '258EAFA5-E914-47DA-95CA-C5AB0DC85B11';
+
+/** @private @const {number} Maximum size of the opening request. */
+WebSocket.MAX_REQUEST_SIZE_ = 8192;
+
+/** @private @const {number} Time allowed for the opening request (ms). */
+WebSocket.REQUEST_TIMEOUT_ = 10000;
+
+/** @private @const {number} Time allowed for reply to close frame (ms). */
+WebSocket.CLOSE_TIMEOUT_ = 5000;
+
+/** @private @const {number} Smallest message worth compressing. */
+WebSocket.DEFLATE_THRESHOLD_ = 64;
+
+/**
+ * @private @const {!Buffer} Removed from the end of each compressed
+ *     message, and restored before decompressing it (RFC 7692 §7.2).
+ */
+WebSocket.DEFLATE_TRAILER_ = Buffer.from([0x00, 0x00, 0xff, 0xff]);
+
+/**
+ * Frame opcodes.
+ * @enum {number}
+ */
+WebSocket.Opcode = {
+  CONTINUATION: 0x0,
+  TEXT: 0x1,
+  BINARY: 0x2,
+  CLOSE: 0x8,
+  PING: 0x9,
+  PONG: 0xa,
+};
+
+/**
+ * Status codes sent in close frames.
+ * @enum {number}
+ */
+WebSocket.Status = {
+  NORMAL: 1000,
+  GOING_AWAY: 1001,
+  PROTOCOL_ERROR: 1002,
+  UNSUPPORTED_DATA: 1003,
+  INVALID_DATA: 1007,
+  TOO_BIG: 1009,
+};
+
+/**
+ * The HTTP request that opened a connection.  Header names are in
+ * lower case.
+ * @typedef {{method: string, url: string, headers: !Object<string,string>}}
+ */
+WebSocket.Request;
+
+/**
+ * Options for a WebSocket.Connection:
+ *
+ * - maxMessageSize: the largest message (in bytes) that will be
+ *   accepted; the connection is closed if a larger one is received.
+ *   (Default: 1 MiB.)
+ * - highWaterMark: number of bytes queued for sending above which
+ *   .write returns false.  (Default: 64 KiB.)
+ * - maxQueued: number of bytes queued for sending above which the
+ *   connection is dropped.  (Default: 16 MiB.)
+ * - headers: additional headers to send in the response completing
+ *   the opening handshake (e.g., {'Set-Cookie': ...}).
+ * - protocol: the subprotocol selected (which must be one of those
+ *   offered by the client), if any.
+ * - binary: if true, binary messages are accepted (and emitted as
+ *   Buffers); otherwise the connection is closed if one is received.
+ *   (Regardless, binary messages may be sent.)
+ * - deflate: if true, messages are compressed, if the client offers
+ *   the permessage-deflate extension with acceptable parameters.
+ * - keepalive: interval (in ms) at which to ping the client.  If
+ *   nothing (not even a pong) has been received from it by the next
+ *   ping, the connection is taken to be dead, and destroyed.
+ *   (Default: 0, never to ping.)
+ * @typedef {{maxMessageSize: (number|undefined),
+ *            highWaterMark: (number|undefined),
+ *            maxQueued: (number|undefined),
+ *            headers: (!Object<string, string>|undefined),
+ *            protocol: (string|undefined),
+ *            binary: (boolean|undefined),
+ *            deflate: (boolean|undefined),
+ *            keepalive: (number|undefined)}}
+ */
+WebSocket.Options;
+
+/**
+ * Read the HTTP request that opens a WebSocket connection.  The
+ * callback is called with an Error if the request is malformed, is not
+ * a WebSocket opening request, or is not received in reasonable time.
+ * @param {!net.Socket} socket Newly-accepted connection.
+ * @param {function(?Error, ?WebSocket.Request, ?Buffer)} callback
+ *     Called with the request and any data received after it.
+ */
+WebSocket.readRequest = function(socket, callback) {
+  var received = Buffer.alloc(0);
+  var done = function(error, request, head) {
+    socket.removeListener('data', onData);
+    socket.removeListener('timeout', onTimeout);
+    socket.setTimeout(0);
+    callback(error, request, head);
+  };
+  var onData = function(data) {
+    received = Buffer.concat([received, data]);
+    var end = received.indexOf('\r\n\r\n');
+    if (end === -1) {
+      if (received.length > WebSocket.MAX_REQUEST_SIZE_) {
+        done(new Error('Request too large'), null, null);
+      }
+      return;
+    }
+    var request;
+    try {
+      request = WebSocket.parseRequest_(received.toString('latin1', 0, end));
+    } catch (e) {
+      done(e, null, null);
+      return;
+    }
+    done(null, request, received.subarray(end + 4));
+  };
+  var onTimeout = function() {
+    done(new Error('Request timed out'), null, null);
+  };
+  socket.on('data', onData);
+  socket.on('timeout', onTimeout);
+  socket.setTimeout(WebSocket.REQUEST_TIMEOUT_);
+};
+
+/**
+ * Refuse a WebSocket connection, with an HTTP error response.
+ * @param {!net.Socket} socket The connection.
+ * @param {number} status HTTP status code (e.g., 403).
+ * @param {string} message Explanation, sent as the response body.
+ */
+WebSocket.reject = function(socket, status, message) {
+  socket.end('HTTP/1.1 ' + status + ' ' + message + '\r\n' +
+             'Content-Type: text/plain\r\n' +
+             'Content-Length: ' + Buffer.byteLength(message) + '\r\n' +
+             'Connection: close\r\n\r\n' + message);
+};
+
+/**
+ * Parse the cookies sent with a request.
+ * @param {string|undefined} header Value of the Cookie header.
+ * @return {!Object<string,string>} Cookie values, by name.
+ */
+WebSocket.parseCookies = function(header) {
+  var cookies = Object.create(null);
+  if (!header) return cookies;
+  header.split(';').forEach(function(cookie) {
+    var parts = cookie.split('=');
+    var name = parts.shift().trim();
+    if (!name) return;
+    try {
+      cookies[name] = decodeURIComponent(parts.join('=').trim());
+    } catch (e) {
+      // Malformed escape; ignore the cookie.
+    }
+  });
+  return cookies;
+};
+
+/**
+ * Parse a header whose value is a comma-separated list (e.g.,
+ * Sec-WebSocket-Protocol), or a query parameter of the same form.
+ * @param {string|undefined} header Value of the header.
+ * @return {!Array<string>} The (non-empty) values listed, in order.
+ */
+WebSocket.parseList = function(header) {
+  if (!header) return [];
+  return header.split(',').map(function(value) {
+    return value.trim();
+  }).filter(Boolean);
+};
+
+/**
+ * Choose parameters for the permessage-deflate extension from those
+ * offered by a client, in its Sec-WebSocket-Extensions header.  Both
+ * ends are required to compress each message separately (i.e., with
+ * no context takeover), so that no zlib stream need be kept between
+ * messages.
+ * @private
+ * @param {string|undefined} header Value of the header.
+ * @return {?{windowBits: number, response: string}} The window size
+ *     to compress with, and the value of the Sec-WebSocket-Extensions
+ *     response header accepting the offer, or null if there is no
+ *     acceptable offer.
+ */
+WebSocket.negotiateDeflate_ = function(header) {
+  var offers = header ? header.split(',') : [];
+  offer: for (var i = 0; i < offers.length; i++) {
+    var params = offers[i].split(';').map(function(param) {
+      return param.trim();
+    });
+    if (params.shift().toLowerCase() !== 'permessage-deflate') continue;
+    var seen = Object.create(null);
+    var windowBits = 15;
+    var response = 'permessage-deflate; server_no_context_takeover; ' +
+        'client_no_context_takeover';
+    for (var j = 0; j < params.length; j++) {
+      var m = params[j].match(/^([\w-]+)(?:\s*=\s*"?(\d+)"?)?$/);
+      if (!m || m[1] in seen) continue offer;
+      var name = m[1].toLowerCase();
+      var value = (m[2] === undefined) ? undefined : Number(m[2]);
+      seen[name] = true;
+      if (name === 'server_no_context_takeover' ||
+          name === 'client_no_context_takeover') {
+        if (value !== undefined) continue offer;
+      } else if (name === 'client_max_window_bits') {
+        if (value !== undefined && !(value >= 8 && value <= 15)) continue offer;
+      } else if (name === 'server_max_window_bits') {
+        // zlib cannot make raw deflate streams with an 8-bit window.
+        if (!(value >= 9 && value <= 15)) continue offer;
+        windowBits = value;
+        response += '; server_max_window_bits=' + value;
+      } else {
+        continue offer;
+      }
+    }
+    return {windowBits: windowBits, response: response};
+  }
+  return null;
+};
+
+/**
+ * Parse and check a WebSocket opening request.
+ * @private
+ * @param {string} text The request line and headers.
+ * @return {!WebSocket.Request}
+ * @throws {Error} If it is not a valid opening request.
+ */
+WebSocket.parseRequest_ = function(text) {
+  var lines = text.split('\r\n');
+  var m = lines[0].match(/^(\S+) (\S+) HTTP\/1\.1$/);
+  if (!m) throw new Error('Malformed request');
+  var headers = Object.create(null);
+  for (var i = 1; i < lines.length; i++) {
+    var colon = lines[i].indexOf(':');
+    if (colon < 1) throw new Error('Malformed header');
+    var name = lines[i].slice(0, colon).trim().toLowerCase();
+    var value = lines[i].slice(colon + 1).trim();
+    headers[name] = (name in headers) ? headers[name] + ', ' + value : value;
+  }
+  if (m[1] !== 'GET' ||
+      !/(^|,)\s*websocket\s*(,|$)/i.test(headers['upgrade'] || '') ||
+      !/(^|,)\s*upgrade\s*(,|$)/i.test(headers['connection'] || '')) {
+    throw new Error('Not a WebSocket request');
+  }
+  if (headers['sec-websocket-version'] !== '13') {
+    throw new Error('Unsupported WebSocket version');
+  }
+  var key = headers['sec-websocket-key'] || '';
+  if (Buffer.from(key, 'base64').length !== 16) {
+    throw new Error('Bad Sec-WebSocket-Key');
+  }
+  return {method: m[1], url: m[2], headers: headers};
+};
+
+/**
+ * A WebSocket connection.  Completes the opening handshake.
+ * @constructor
+ * @extends {events.EventEmitter}
+ * @param {!net.Socket} socket The underlying connection.
+ * @param {!WebSocket.Request} request The opening request (as returned
+ *     by WebSocket.readRequest).
+ * @param {?Buffer} head Data received after the request.
+ * @param {!WebSocket.Options=} options Limits, etc.
+ */
+WebSocket.Connection = function(socket, request, head, options) {
+  events.EventEmitter.call(this);
+  options = options || {};
+  /** @private @const {!net.Socket} */
+  this.socket_ = socket;
+  /**
+   * Address of the client (which the owner may correct, if it is known
+   * to have connected via a proxy).
+   * @type {string|undefined}
+   */
+  this.remoteAddress = socket.remoteAddress;
+  /** @const {number|undefined} */
+  this.remotePort = socket.remotePort;
+  /** @private @const {number} */
+  this.maxMessageSize_ = options.maxMessageSize || 1024 * 1024;
+  /** @private @const {number} */
+  this.highWaterMark_ = options.highWaterMark || 64 * 1024;
+  /** @private @const {number} */
+  this.maxQueued_ = options.maxQueued || 16 * 1024 * 1024;
+  /** @private @type {!Buffer} Data received but not yet parsed. */
+  this.received_ = head || Buffer.alloc(0);
+  /** @private @type {!Array<!Buffer>} Parts of a fragmented message. */
+  this.fragments_ = [];
+  /** @private @type {number} Total length of fragments_. */
+  this.fragmentsLength_ = 0;
+  /** @private @type {!Array<!Buffer>} Frames waiting to be sent. */
+  this.queue_ = [];
+  /** @private @type {number} Total length of queue_. */
+  this.queued_ = 0;
+  /** @private @type {boolean} Has .write returned false? */
+  this.needDrain_ = false;
+  /** @private @type {boolean} Has a close frame been sent? */
+  this.closeSent_ = false;
+  /** @private @type {boolean} Has a close frame been received? */
+  this.closeReceived_ = false;
+  /** @private @type {boolean} Is the message being received compressed? */
+  this.compressed_ = false;
+  /** @private @type {boolean} Is the message being received binary? */
+  this.messageBinary_ = false;
+  /** @const {boolean} Are binary messages accepted? */
+  this.binary = Boolean(options.binary);
+  /** @const {?string} The subprotocol selected, if any. */
+  this.protocol = options.protocol || null;
+  var deflate = options.deflate ? WebSocket.negotiateDeflate_(
+      request.headers['sec-websocket-extensions']) : null;
+  /**
+   * Window size (in bits) with which messages are compressed, or 0 if
+   * the permessage-deflate extension is not in use.
+   * @private @const {number}
+   */
+  this.deflateBits_ = deflate ? deflate.windowBits : 0;
+  /** @const {boolean} Are messages compressed? */
+  this.deflate = Boolean(deflate);
+  /** @private @type {boolean} Received anything since the last ping? */
+  this.alive_ = true;
+  /** @private @type {?Object} Interval timer sending pings, if any. */
+  this.keepalive_ = null;
+
+  var accept = crypto.createHash('sha1')
+      .update(request.headers['sec-websocket-key'] + WebSocket.GUID_)
+      .digest('base64');
+  var extra = '';
+  if (this.protocol) {
+    extra += 'Sec-WebSocket-Protocol: ' + this.protocol + '\r\n';
+  }
+  if (deflate) {
+    extra += 'Sec-WebSocket-Extensions: ' + deflate.response + '\r\n';
+  }
+  for (var name in options.headers) {
+    extra += name + ': ' + options.headers[name] + '\r\n';
+  }
+  socket.write('HTTP/1.1 101 Switching Protocols\r\n' +
+               'Upgrade: websocket\r\n' +
+               'Connection: Upgrade\r\n' +
+               'Sec-WebSocket-Accept: ' + accept + '\r\n' + extra + '\r\n');
+  socket.setNoDelay(true);
+
+  var ws = this;
+  socket.on('data', function(data) {
+    ws.alive_ = true;
+    ws.received_ = Buffer.concat([ws.received_, data]);
+    ws.parse_();
+  });
+  socket.on('drain', function() {
+    ws.flush_();
+  });
+  socket.on('end', function() {
+    // Far end closed without a close frame (or after one).
+    if (!ws.closeReceived_) ws.emit('end');
+    socket.end();
+  });
+  socket.on('error', function(error) {
+    ws.emit('error', error);
+  });
+  socket.on('close', function() {
+    clearInterval(ws.keepalive_);
+    ws.keepalive_ = null;
+    ws.emit('close');
+  });
+  if (options.keepalive) {
+    this.keepalive_ = setInterval(function() {
+      if (ws.closeSent_) return;  // Closing anyway.
+      if (!ws.alive_) {
+        ws.destroy(new Error('No response to keepalive ping'));
+        return;
+      }
+      ws.alive_ = false;
+      ws.send_(WebSocket.Opcode.PING, Buffer.alloc(0));
+    }, options.keepalive);
+  }
+  if (this.received_.length) {
+    process.nextTick(this.parse_.bind(this));
+  }
+};
+util.inherits(WebSocket.Connection, events.EventEmitter);
+
+/**
+ * Number of bytes queued for sending (including those buffered by the
+ * underlying socket).
+ * @type {number}
+ */
+Object.defineProperty(WebSocket.Connection.prototype, 'bufferedAmount', {
+  get: function() {
+    return this.queued_ + this.socket_.writableLength;
+  }
+});
+
+/**
+ * Send a message.
+ * @param {string|!Buffer} data The message: text, or binary data.
+ * @return {boolean} False if the caller should wait for a 'drain'
+ *     event before sending more.
+ */
+WebSocket.Connection.prototype.write = function(data) {
+  if (this.closeSent_) return true;  // Discarded, like a closed socket.
+  if (Buffer.isBuffer(data)) {
+    this.send_(WebSocket.Opcode.BINARY, data);
+  } else {
+    this.send_(WebSocket.Opcode.TEXT, Buffer.from(data, 'utf8'));
+  }
+  if (this.bufferedAmount > this.maxQueued_) {
+    this.socket_.destroy(new Error('Outbound queue overflow'));
+    return true;
+  }
+  if (this.bufferedAmount > this.highWaterMark_) this.needDrain_ = true;
+  return !this.needDrain_;
+};
+
+/**
+ * Close the connection (once any queued messages have been sent).
+ * @param {number=} code Status code.  (Default: WebSocket.Status.NORMAL.)
+ * @param {string=} reason Explanation.
+ */
+WebSocket.Connection.prototype.end = function(code, reason) {
+  if (this.closeSent_) return;
+  var reasonBuf = Buffer.from(reason || '', 'utf8');
+  var payload = Buffer.alloc(2 + reasonBuf.length);
+  payload.writeUInt16BE(code || WebSocket.Status.NORMAL, 0);
+  reasonBuf.copy(payload, 2);
+  this.send_(WebSocket.Opcode.CLOSE, payload);
+  this.closeSent_ = true;
+  this.flush_();
+  var socket = this.socket_;
+  socket.setTimeout(WebSocket.CLOSE_TIMEOUT_, function() {
+    socket.destroy();
+  });
+};
+
+/**
+ * Immediately close the underlying connection.
+ * @param {!Error=} error Reason, if any (emitted as an 'error' event).
+ */
+WebSocket.Connection.prototype.destroy = function(error) {
+  this.socket_.destroy(error);
+};
+
+/**
+ * Queue a frame to be sent.
+ * @private
+ * @param {!WebSocket.Opcode} opcode Opcode of frame.
+ * @param {!Buffer} payload Payload of frame.
+ */
+WebSocket.Connection.prototype.send_ = function(opcode, payload) {
+  var compressed = false;
+  if (this.deflateBits_ && !(opcode & 0x8) &&
+      payload.length >= WebSocket.DEFLATE_THRESHOLD_) {
+    payload = zlib.deflateRawSync(payload, {
+      windowBits: this.deflateBits_,
+      finishFlush: zlib.constants.Z_SYNC_FLUSH,
+    });
+    payload = payload.subarray(0,
+        payload.length - WebSocket.DEFLATE_TRAILER_.length);
+    compressed = true;
+  }
+  this.queue_.push(WebSocket.encodeFrame(opcode, payload, compressed));
+  this.queued_ += this.queue_[this.queue_.length - 1].length;
+  this.flush_();
+};
+
+/**
+ * Pass queued frames to the underlying socket, until it will accept no
+ * more; emit 'drain' if the queue has emptied since .write returned
+ * false.
+ * @private
+ */
+WebSocket.Connection.prototype.flush_ = function() {
+  var socket = this.socket_;
+  while (this.queue_.length && !socket.writableNeedDrain &&
+         !socket.destroyed) {
+    var frame = this.queue_.shift();
+    this.queued_ -= frame.length;
+    socket.write(frame);
+  }
+  if (this.needDrain_ && this.bufferedAmount <= this.highWaterMark_ &&
+      !socket.writableNeedDrain) {
+    this.needDrain_ = false;
+    this.emit('drain');
+  }
+  if (this.closeSent_ && this.closeReceived_ && !this.queue_.length) {
+    socket.end();
+  }
+};
+
+/**
+ * Handle the complete frames received so far.
+ * @private
+ */
+WebSocket.Connection.prototype.parse_ = function() {
+  while (!this.socket_.destroyed) {
+    var frame = WebSocket.decodeFrame_(this.received_, this.maxMessageSize_,
+                                       this.deflateBits_ > 0);
+    if (!frame) return;  // Incomplete.
+    if (frame.error) {
+      this.fail_(frame.error.status, frame.error.message);
+      return;
+    }
+    this.received_ = this.received_.subarray(frame.length);
+    if (this.closeReceived_) continue;  // Ignore anything after close.
+    this.handleFrame_(frame.fin, frame.opcode, frame.payload,
+                      frame.compressed);
+  }
+};
+
+/**
+ * Handle a single frame.
+ * @private
+ * @param {boolean} fin Is this the final frame of a message?
+ * @param {number} opcode Opcode of frame.
+ * @param {!Buffer} payload Unmasked payload.
+ * @param {boolean=} compressed Was the frame's RSV1 bit set (marking
+ *     the start of a compressed message)?
+ */
+WebSocket.Connection.prototype.handleFrame_ = function(fin, opcode, payload,
+                                                       compressed) {
+  if (compressed && (opcode & 0x8 ||
+                     opcode === WebSocket.Opcode.CONTINUATION)) {
+    this.fail_(WebSocket.Status.PROTOCOL_ERROR, 'Unexpected extension');
+    return;
+  }
+  switch (opcode) {
+    case WebSocket.Opcode.TEXT:
+    case WebSocket.Opcode.BINARY:
+    case WebSocket.Opcode.CONTINUATION:
+      if ((opcode === WebSocket.Opcode.CONTINUATION) !==
+          (this.fragments_.length > 0)) {
+        this.fail_(WebSocket.Status.PROTOCOL_ERROR, 'Unexpected frame');
+        return;
+      }
+      if (opcode === WebSocket.Opcode.BINARY && !this.binary) {
+        this.fail_(WebSocket.Status.UNSUPPORTED_DATA,
+                   'Binary messages not supported');
+        return;
+      }
+      if (opcode !== WebSocket.Opcode.CONTINUATION) {
+        this.compressed_ = Boolean(compressed);
+        this.messageBinary_ = (opcode === WebSocket.Opcode.BINARY);
+      }
+      this.fragmentsLength_ += payload.length;
+      if (this.fragmentsLength_ > this.maxMessageSize_) {
+        this.fail_(WebSocket.Status.TOO_BIG, 'Message too big');
+        return;
+      }
+      this.fragments_.push(payload);
+      if (!fin) return;
+      var message = Buffer.concat(this.fragments_);
+      this.fragments_ = [];
+      this.fragmentsLength_ = 0;
+      if (this.compressed_) {
+        try {
+          message = zlib.inflateRawSync(
+              Buffer.concat([message, WebSocket.DEFLATE_TRAILER_]),
+              {finishFlush: zlib.constants.Z_SYNC_FLUSH,
+               maxOutputLength: this.maxMessageSize_});
+        } catch (e) {
+          if (e.code === 'ERR_BUFFER_TOO_LARGE') {
+            this.fail_(WebSocket.Status.TOO_BIG, 'Message too big');
+          } else {
+            this.fail_(WebSocket.Status.INVALID_DATA, 'Invalid compression');
+          }
+          return;
+        }
+      }
+      if (this.messageBinary_) {
+        this.emit('data', message);
+        return;
+      }
+      var text;
+      try {
+        text = new util.TextDecoder('utf-8', {fatal: true}).decode(message);
+      } catch (e) {
+        this.fail_(WebSocket.Status.INVALID_DATA, 'Invalid UTF-8');
+        return;
+      }
+      this.emit('data', text);
+      return;
+    case WebSocket.Opcode.PING:
+      this.send_(WebSocket.Opcode.PONG, payload);
+      return;
+    case WebSocket.Opcode.PONG:
+      return;
+    case WebSocket.Opcode.CLOSE:
+      this.closeReceived_ = true;
+      this.emit('end');
+      if (!this.closeSent_) {
+        this.send_(WebSocket.Opcode.CLOSE, payload.subarray(0, 2));
+        this.closeSent_ = true;
+      }
+      this.flush_();
+      return;
+    default:
+      this.fail_(WebSocket.Status.PROTOCOL_ERROR, 'Unknown opcode');
+  }
+};
+
+/**
+ * Close the connection because the far end has violated the protocol
+ * or a limit.
+ * @private
+ * @param {!WebSocket.Status} status Status code.
+ * @param {string} message Explanation.
+ */
+WebSocket.Connection.prototype.fail_ = function(status, message) {
+  this.emit('error', new Error(message));
+  this.end(status, message);
+  this.closeReceived_ = true;  // Don't wait for reply.
+  this.flush_();
+};
+
+/**
+ * Encode an (unmasked, unfragmented) frame, as sent by a server.
+ * @param {!WebSocket.Opcode} opcode Opcode of frame.
+ * @param {!Buffer} payload Payload of frame.
+ * @param {boolean=} compressed Set the RSV1 bit, marking the payload as
+ *     compressed with permessage-deflate?
+ * @return {!Buffer}
+ */
+WebSocket.encodeFrame = function(opcode, payload, compressed) {
+  var first = 0x80 | (compressed ? 0x40 : 0) | opcode;
+  var header;
+  if (payload.length < 126) {
+    header = Buffer.from([first, payload.length]);
+  } else if (payload.length < 0x10000) {
+    header = Buffer.from([first, 126, 0, 0]);
+    header.writeUInt16BE(payload.length, 2);
+  } else {
+    header = Buffer.alloc(10);
+    header[0] = first;
+    header[1] = 127;
+    header.writeBigUInt64BE(BigInt(payload.length), 2);
+  }
+  return Buffer.concat([header, payload]);
+};
+
+/**
+ * Decode a frame from the start of some data received from a client
+ * (whose frames must be masked).
+ * @private
+ * @param {!Buffer} data Data received.
+ * @param {number} maxSize Largest payload to accept.
+ * @param {boolean=} deflate Is the permessage-deflate extension in use
+ *     (so that the RSV1 bit may be set)?
+ * @return {?{fin: boolean, opcode: number, payload: !Buffer, length: number,
+ *            compressed: boolean,
+ *            error: ({status: !WebSocket.Status, message: string}|undefined)}}
+ *     The frame (and its total length), an error, or null if data does
+ *     not yet contain a complete frame.
+ */
+WebSocket.decodeFrame_ = function(data, maxSize, deflate) {
+  if (data.length < 2) return null;
+  var fin = Boolean(data[0] & 0x80);
+  var opcode = data[0] & 0x0f;
+  var compressed = Boolean(data[0] & 0x40);
+  var error = function(status, message) {
+    return {fin: fin, opcode: opcode, payload: Buffer.alloc(0), length: 0,
+            compressed: compressed,
+            error: {status: status, message: message}};
+  };
+  if (data[0] & (deflate ? 0x30 : 0x70)) {
+    return error(WebSocket.Status.PROTOCOL_ERROR, 'Unexpected extension');
+  }
+  if (!(data[1] & 0x80)) {
+    return error(WebSocket.Status.PROTOCOL_ERROR, 'Unmasked frame');
+  }
+  var length = data[1] & 0x7f;
+  var offset = 2;
+  if (length === 126) {
+    if (data.length < 4) return null;
+    length = data.readUInt16BE(2);
+    offset = 4;
+  } else if (length === 127) {
+    if (data.length < 10) return null;
+    var bigLength = data.readBigUInt64BE(2);
+    length = (bigLength > BigInt(maxSize)) ? Infinity : Number(bigLength);
+    offset = 10;
+  }
+  if (opcode & 0x8 && (length > 125 || !fin)) {
+    return error(WebSocket.Status.PROTOCOL_ERROR, 'Bad control frame');
+  }
+  if (length > maxSize) {
+    return error(WebSocket.Status.TOO_BIG, 'Message too big');
+  }
+  if (data.length < offset + 4 + length) return null;
+  var mask = data.subarray(offset, offset + 4);
+  var payload = Buffer.from(data.subarray(offset + 4, offset + 4 + length));
+  for (var i = 0; i < payload.length; i++) {
+    payload[i] ^= mask[i % 4];
+  }
+  return {fin: fin, opcode: opcode, payload: payload,
+          length: offset + 4 + length, compressed: compressed,
+          error: undefined};
+};
+
+module.exports = WebSocket;
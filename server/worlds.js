@@ -0,0 +1,355 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Hosting of additional worlds in the same process as
+ * the main one, e.g. for staging or testing, or for several small
+ * worlds on one host.  Each hosted world has its own interpreter (and
+ * so its own heap, threads and listeners) and is saved in its own
+ * object store (see Store.Log), in the "store" subdirectory of its
+ * directory; if that is empty, the world is created by loading the
+ * startup files (core*.js, etc.) from its startup directory.  The
+ * worlds share the rest of the server: its configuration, TLS
+ * certificates, mailer, blob store, admin API and so on.
+ *
+ * Hosted worlds are created and started from the worlds option of the
+ * configuration file, or via the admin API, and are checkpointed at
+ * regular intervals and when stopped (or when the server shuts down).
+ */
+'use strict';
+
+var fs = require('fs');
+var Interpreter = require('./interpreter');
+var Logging = require('./logging');
+var path = require('path');
+var Serializer = require('./serialize');
+var Snapshot = require('./snapshot');
+var Store = require('./store');
+
+var Worlds = {};
+
+/**
+ * Subsystem of the server log to which hosted worlds' events are written.
+ * @const {!Logging.Subsystem}
+ */
+var log = new Logging.Subsystem('worlds');
+
+/**
+ * Statuses of a hosted world.
+ * @enum {string}
+ */
+Worlds.Status = {
+  STOPPED: 'stopped',
+  STARTING: 'starting',
+  RUNNING: 'running',
+};
+
+/**
+ * Options for a Worlds.Manager:
+ *
+ * - makeInterpreter: function to create a (fresh, empty) interpreter
+ *   for a world, with the server's options and builtins.
+ * - dir: directory relative to which worlds' directories are resolved.
+ * - store: options for worlds' object stores (format, compression and
+ *   key).
+ * - checkpointInterval: seconds between regular checkpoints of each
+ *   running world, or 0 for none.  (Default: 600.)
+ * @typedef {{makeInterpreter: function(!Worlds.World): !Interpreter,
+ *            dir: string,
+ *            store: (!Store.LogOptions|undefined),
+ *            checkpointInterval: (number|undefined)}}
+ */
+Worlds.Options;
+
+/**
+ * Description of a hosted world, as reported by the admin API.
+ * @typedef {{name: string, directory: string, startup: string,
+ *            status: string, threads: number,
+ *            checkpointTime: ?number}}
+ */
+Worlds.Description;
+
+/**
+ * A collection of hosted worlds.
+ * @constructor
+ * @struct
+ * @param {!Worlds.Options} options Options.
+ */
+Worlds.Manager = function(options) {
+  /** @const {!Worlds.Options} */
+  this.options = options;
+  /** @private @const {!Map<string, !Worlds.World>} Worlds, by name. */
+  this.worlds_ = new Map();
+};
+
+/**
+ * Add a (stopped) world.  Its directory is created if it does not
+ * exist.
+ * @param {string} name The world's name: letters, digits, '-' and '_'.
+ * @param {string} directory The world's directory.
+ * @param {string=} startup Directory containing the startup files
+ *     with which to create the world, if it has not yet been saved.
+ *     (Default: the world's directory.)
+ * @return {!Worlds.World} The world.
+ * @throws {Error} If the name is invalid or already in use.
+ */
+Worlds.Manager.prototype.create = function(name, directory, startup) {
+  if (!/^[A-Za-z0-9_-]+$/.test(name)) {
+    throw new TypeError('Invalid world name ' + JSON.stringify(name));
+  }
+  if (this.worlds_.has(name)) {
+    throw new Error('World ' + name + ' already exists');
+  }
+  var dir = path.resolve(this.options.dir, directory);
+  if (!fs.existsSync(dir)) fs.mkdirSync(dir, {recursive: true});
+  var world = new Worlds.World(this, name, dir,
+      startup === undefined ? dir : path.resolve(this.options.dir, startup));
+  this.worlds_.set(name, world);
+  return world;
+};
+
+/**
+ * Get a world by name.
+ * @param {string} name The world's name.
+ * @return {!Worlds.World} The world.
+ * @throws {Error} If there is no such world.
+ */
+Worlds.Manager.prototype.get = function(name) {
+  var world = this.worlds_.get(name);
+  if (!world) throw new Error('No such world: ' + name);
+  return world;
+};
+
+/**
+ * List the worlds.
+ * @return {!Array<!Worlds.World>} The worlds, in order of creation.
+ */
+Worlds.Manager.prototype.list = function() {
+  return Array.from(this.worlds_.values());
+};
+
+/**
+ * Remove a world, which must be stopped.  Its directory is not
+ * deleted, so it can be added again later.
+ * @param {string} name The world's name.
+ * @throws {Error} If there is no such world, or it is not stopped.
+ */
+Worlds.Manager.prototype.remove = function(name) {
+  var world = this.get(name);
+  if (world.status !== Worlds.Status.STOPPED) {
+    throw new Error('World ' + name + ' is not stopped');
+  }
+  this.worlds_.delete(name);
+};
+
+/**
+ * Stop every running world (e.g., when the server shuts down).
+ */
+Worlds.Manager.prototype.stopAll = function() {
+  this.worlds_.forEach(function(world) {
+    if (world.status === Worlds.Status.RUNNING) world.stop();
+  });
+};
+
+/**
+ * A hosted world.
+ * @constructor
+ * @struct
+ * @param {!Worlds.Manager} manager The manager hosting it.
+ * @param {string} name The world's name.
+ * @param {string} dir The world's directory.
+ * @param {string} startup Directory containing its startup files.
+ */
+Worlds.World = function(manager, name, dir, startup) {
+  /** @private @const {!Worlds.Manager} */
+  this.manager_ = manager;
+  /** @const {string} */
+  this.name = name;
+  /** @const {string} */
+  this.dir = dir;
+  /** @const {string} */
+  this.startup = startup;
+  /** @type {!Worlds.Status} */
+  this.status = Worlds.Status.STOPPED;
+  /** @type {?Interpreter} The interpreter, while running. */
+  this.intrp = null;
+  /** @type {?number} Time of the most recent checkpoint, if any. */
+  this.checkpointTime = null;
+  /** @private {?Store.Log} The object store, while running. */
+  this.store_ = null;
+  /** @private @const {!Serializer.Incremental} */
+  this.incremental_ = new Serializer.Incremental();
+  /** @private {?NodeJS.Timer} Timer for regular checkpoints. */
+  this.timer_ = null;
+};
+
+/**
+ * Start the world: load it from its object store (or, if that is
+ * empty, from its startup files) and run it.
+ * @return {!Promise<void>} Resolves once it is running.
+ */
+Worlds.World.prototype.start = function() {
+  if (this.status !== Worlds.Status.STOPPED) {
+    return Promise.reject(new Error('World ' + this.name + ' is ' +
+                                    this.status));
+  }
+  this.status = Worlds.Status.STARTING;
+  var world = this;
+  var loading;
+  try {
+    this.store_ = new Store.Log(path.join(this.dir, 'store'),
+                                this.manager_.options.store);
+    loading = this.store_.isEmpty() ? Promise.resolve(this.loadStartup_()) :
+        this.deserialize_();
+  } catch (e) {
+    loading = Promise.reject(e);
+  }
+  return loading.then(function(intrp) {
+    world.intrp = intrp;
+    world.incremental_.reset();
+    world.status = Worlds.Status.RUNNING;
+    var interval = world.manager_.options.checkpointInterval;
+    if (interval === undefined) interval = 600;
+    if (interval > 0) {
+      world.timer_ = setInterval(world.checkpoint.bind(world),
+                                 interval * 1000);
+    }
+    intrp.start();
+    log.info('World %s started.', world.name);
+  }, function(e) {
+    if (world.store_) world.store_.close();
+    world.store_ = null;
+    world.status = Worlds.Status.STOPPED;
+    throw e;
+  });
+};
+
+/**
+ * Create an interpreter for the world and load its startup files into
+ * it, or an up-to-date startup snapshot of them (see snapshot.js).
+ * @private
+ * @return {!Interpreter}
+ * @throws {Error} If there are no startup files.
+ */
+Worlds.World.prototype.loadStartup_ = function() {
+  var files = Snapshot.startupFiles(this.startup);
+  if (!files.length) {
+    throw new Error('No startup files in ' + this.startup);
+  }
+  var intrp = this.manager_.options.makeInterpreter(this);
+  var snapshot = Snapshot.find(this.startup);
+  if (snapshot) {
+    Snapshot.load(fs.readFileSync(snapshot), intrp);
+    log.info('World %s: loaded startup snapshot %s', this.name, snapshot);
+    return intrp;
+  }
+  for (var i = 0; i < files.length; i++) {
+    intrp.createThreadForSrc(
+        fs.readFileSync(path.join(this.startup, files[i]), 'utf8'));
+  }
+  log.info('World %s: loaded %d startup file(s) from %s', this.name,
+           files.length, this.startup);
+  return intrp;
+};
+
+/**
+ * Create an interpreter for the world and deserialize the world's
+ * object store into it.
+ * @private
+ * @return {!Promise<!Interpreter>}
+ */
+Worlds.World.prototype.deserialize_ = function() {
+  var intrp = this.manager_.options.makeInterpreter(this);
+  var deserializer = new Serializer.Deserializer(intrp);
+  var world = this;
+  var store = /** @type {!Store.Log} */(this.store_);
+  return store.read(deserializer.add.bind(deserializer)).then(function() {
+    deserializer.finish();
+    log.info('World %s: %s loaded.', world.name, String(store));
+    return intrp;
+  });
+};
+
+/**
+ * Save the world to its object store.  Only the objects changed since
+ * the previous checkpoint are saved, except for the first after the
+ * world is started.  Errors are logged, not thrown.
+ * @return {boolean} True iff the checkpoint was saved.
+ */
+Worlds.World.prototype.checkpoint = function() {
+  if (this.status !== Worlds.Status.RUNNING) return false;
+  var intrp = /** @type {!Interpreter} */(this.intrp);
+  var store = /** @type {!Store.Log} */(this.store_);
+  var wasRunning = intrp.status === Interpreter.Status.RUNNING;
+  var transaction = null;
+  try {
+    if (store.wantsFull()) this.incremental_.reset();
+    transaction = store.begin();
+    intrp.pause();
+    var full = Serializer.serializeIncremental(intrp, this.incremental_,
+        transaction.write.bind(transaction)).full;
+    var description = transaction.commit(full);
+  } catch (e) {
+    if (transaction) transaction.abort();
+    this.incremental_.reset();
+    log.error('World %s: checkpoint failed: %s', this.name, String(e));
+    return false;
+  } finally {
+    if (wasRunning) intrp.start();
+  }
+  this.checkpointTime = Date.now();
+  log.info('World %s: checkpoint %s complete.', this.name, description);
+  return true;
+};
+
+/**
+ * Stop the world: stop listening, checkpoint it and stop its
+ * interpreter.  (Connections already open are not closed, but nothing
+ * more is done with them until the world is started again.)
+ */
+Worlds.World.prototype.stop = function() {
+  if (this.status !== Worlds.Status.RUNNING) return;
+  var intrp = /** @type {!Interpreter} */(this.intrp);
+  clearInterval(this.timer_);
+  this.timer_ = null;
+  intrp.stopListening();
+  intrp.pause();
+  this.checkpoint();
+  intrp.stop();
+  /** @type {!Store.Log} */(this.store_).close();
+  this.store_ = null;
+  this.intrp = null;
+  this.status = Worlds.Status.STOPPED;
+  log.info('World %s stopped.', this.name);
+};
+
+/**
+ * Describe the world.
+ * @return {!Worlds.Description}
+ */
+Worlds.World.prototype.describe = function() {
+  return {
+    name: this.name,
+    directory: this.dir,
+    startup: this.startup,
+    status: this.status,
+    threads: this.intrp ? this.intrp.getThreads().length : 0,
+    checkpointTime: this.checkpointTime,
+  };
+};
+
+module.exports = Worlds;
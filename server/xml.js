@@ -0,0 +1,368 @@
+/**
+ * @license
+ * Copyright 2020 Google LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+/**
+ * @fileoverview Tokenizing XML and HTML (the CC.xmlTokenize builtin),
+ * e.g. for importing data or scraping web pages.
+ *
+ * The tokenizer produces a flat list of tokens (start and end tags,
+ * text, comments, etc.) rather than a tree, and can be used on a
+ * stream: given a chunk of a document that is not the last, it
+ * returns the tokens complete so far, plus the rest of the chunk (to
+ * be prepended to the next) and the names of the elements still open
+ * (to be passed back with it).  In XML mode, the document must be
+ * well-formed, or a SyntaxError is thrown; only the predefined and
+ * numeric character references are decoded, and DTDs are not
+ * processed (so there is no entity expansion to abuse).  In HTML
+ * mode, tokenizing is lenient, as for Html.tokenize: names are in
+ * lower case, the content of elements such as <script> is raw text,
+ * void elements such as <br> are never open, and anything that is not
+ * well-formed markup is text.
+ */
+'use strict';
+
+var Html = require('./html');
+
+var Xml = {};
+
+/**
+ * A token: a start tag (with its name, attributes, and whether it
+ * ends with "/>"), an end tag, or text, a comment, CDATA section,
+ * processing instruction (with its target as name) or doctype, with
+ * the text it contains.  Text is decoded; the others are as found.
+ * @typedef {{type: string, name: (string|undefined),
+ *            attrs: (!Object<string, string>|undefined),
+ *            selfClosing: (boolean|undefined), text: (string|undefined)}}
+ */
+Xml.Token;
+
+/**
+ * Options for tokenizing: whether the text is HTML (default false),
+ * whether it is the final chunk of the document (default true), and
+ * the names of the elements left open by the previous chunk, if any.
+ * @typedef {{html: (boolean|undefined), final: (boolean|undefined),
+ *            open: (!Array<string>|undefined)}}
+ */
+Xml.Options;
+
+/**
+ * The result of tokenizing a chunk: the tokens, the text not yet
+ * tokenized (because it may continue in the next chunk), and the
+ * names of the elements open at the end of the chunk (outermost
+ * first).
+ * @typedef {{tokens: !Array<!Xml.Token>, rest: string,
+ *            open: !Array<string>}}
+ */
+Xml.Result;
+
+/**
+ * Maximum length (in characters) of a chunk to tokenize.
+ * @const {number}
+ */
+Xml.MAX_LENGTH = 1024 * 1024;
+
+/**
+ * Maximum depth of nested elements.
+ * @const {number}
+ */
+Xml.MAX_DEPTH = 256;
+
+/**
+ * Estimated speed (characters tokenized per ms), for computing the
+ * cost of tokenizing.
+ * @const {number}
+ */
+Xml.SPEED = 10 * 1024;
+
+/**
+ * The predefined XML entities.
+ * @const {!Object<string, string>}
+ */
+Xml.ENTITIES = {'amp': '&', 'lt': '<', 'gt': '>', 'quot': '"', 'apos': "'"};
+
+/** @private @const {string} Pattern of an XML name. */
+Xml.NAME_ = '[A-Za-z_:\\u00c0-\\uffff][A-Za-z0-9_:.\\u00b7\\u00c0-\\uffff-]*';
+
+/** @private @const {!RegExp} An XML start tag's name. */
+Xml.START_RE_ = new RegExp('<(' + Xml.NAME_ + ')', 'y');
+
+/** @private @const {!RegExp} An XML attribute, or the end of a tag. */
+Xml.ATTR_RE_ = new RegExp('(?:\\s+(' + Xml.NAME_ + ')\\s*=\\s*' +
+    '(?:"([^"<]*)"|\'([^\'<]*)\'))|\\s*(/?>)', 'y');
+
+/** @private @const {!RegExp} An XML end tag. */
+Xml.END_RE_ = new RegExp('</(' + Xml.NAME_ + ')\\s*>', 'y');
+
+/** @private @const {!RegExp} An HTML start tag's name. */
+Xml.HTML_START_RE_ = /<([a-zA-Z][^\s/>]*)/y;
+
+/** @private @const {!RegExp} An HTML attribute, or the end of a tag. */
+Xml.HTML_ATTR_RE_ = new RegExp('[\\s/]*(?:([^\\s/>=]+)(?:\\s*=\\s*' +
+    '(?:"([^"]*)"|\'([^\']*)\'|([^\\s>]+)))?|(>))', 'y');
+
+/** @private @const {!RegExp} An HTML end tag. */
+Xml.HTML_END_RE_ = /<\/([a-zA-Z][^\s/>]*)[^>]*>/y;
+
+/** @private @const {!RegExp} An XML reference, or a stray "&". */
+Xml.REFERENCE_RE_ = new RegExp('&(?:#([0-9]+)|#x([0-9a-fA-F]+)|' +
+    '(' + Xml.NAME_ + '))?(;?)', 'g');
+
+/**
+ * Estimated cost (in ms) of tokenizing some text.
+ * @param {string} text The text.
+ * @return {number} The cost.
+ */
+Xml.cost = function(text) {
+  return text.length / Xml.SPEED;
+};
+
+/**
+ * Decode the character references in XML text.
+ * @private
+ * @param {string} text The text.
+ * @return {string} The decoded text.
+ */
+Xml.decode_ = function(text) {
+  if (!text.includes('&')) return text;
+  return text.replace(Xml.REFERENCE_RE_,
+      function(ref, dec, hex, name, semicolon) {
+    if (!semicolon || (dec === undefined && hex === undefined &&
+                       name === undefined)) {
+      throw new SyntaxError('Malformed character reference ' + ref);
+    }
+    if (name !== undefined) {
+      if (!Xml.ENTITIES.hasOwnProperty(name)) {
+        throw new SyntaxError('Unknown entity ' + ref);
+      }
+      return Xml.ENTITIES[name];
+    }
+    var code = (dec !== undefined) ? parseInt(dec, 10) : parseInt(hex, 16);
+    if (code === 0 || code > 0x10ffff || (code >= 0xd800 && code <= 0xdfff)) {
+      throw new SyntaxError('Invalid character reference ' + ref);
+    }
+    return String.fromCodePoint(code);
+  });
+};
+
+/**
+ * Tokenize a chunk of XML or HTML.
+ * @param {string} text The chunk (including the rest of the previous
+ *     chunk, if any).
+ * @param {!Xml.Options=} options Options.
+ * @return {!Xml.Result} The tokens, etc.
+ */
+Xml.tokenize = function(text, options) {
+  options = options || {};
+  if (text.length > Xml.MAX_LENGTH) throw new RangeError('Text too long');
+  var html = Boolean(options.html);
+  var final = options.final !== false;
+  var open = options.open ? options.open.slice() : [];
+  var decode = html ? Html.decode : Xml.decode_;
+  var tokens = [];
+  var rest = '';
+  var i = 0;
+  // Add text, to the previous token if that is text too.
+  var pushText = function(value) {
+    var last = tokens[tokens.length - 1];
+    if (last && last.type === 'text') {
+      last.text += value;
+    } else {
+      tokens.push({type: 'text', text: value});
+    }
+  };
+  /**
+   * Deal with markup at i that is unterminated or malformed.  If it
+   * may yet be completed by the next chunk, it is left for that;
+   * otherwise it is an error in XML, and text in HTML.
+   * @param {string} message Description of the problem.
+   * @param {boolean=} unterminated True if the markup (a comment,
+   *     etc.) may contain "<", and is only unterminated.
+   * @return {boolean} True if the markup is to be left for the next
+   *     chunk.
+   */
+  var partial = function(message, unterminated) {
+    if (!final && (html || unterminated || text.indexOf('<', i + 1) === -1)) {
+      rest = text.slice(i);
+      return true;
+    } else if (!html) {
+      throw new SyntaxError(message);
+    }
+    return false;
+  };
+
+  while (i < text.length) {
+    var top = open[open.length - 1];
+    var m;
+    if (html && Html.RAW_TEXT_ELEMENTS.includes(top)) {
+      // Everything up to the end tag is text.
+      var endRe = new RegExp('</' + top + '[\\s/>]', 'ig');
+      endRe.lastIndex = i;
+      m = endRe.exec(text);
+      var end = m ? m.index : final ? text.length :
+          Math.max(i, text.lastIndexOf('<'));
+      if (end > i) pushText(text.slice(i, end));
+      i = end;
+      if (!m) {
+        rest = text.slice(i);
+        break;
+      }
+    }
+    var lt = text.indexOf('<', i);
+    if (lt !== i) {
+      end = (lt === -1) ? text.length : lt;
+      if (lt === -1 && !final) {
+        // A character reference may continue in the next chunk.
+        var amp = text.lastIndexOf('&');
+        if (amp >= i && !text.includes(';', amp)) end = amp;
+      }
+      if (end > i) pushText(decode(text.slice(i, end)));
+      i = end;
+      if (lt === -1) {
+        rest = text.slice(i);
+        break;
+      }
+      continue;
+    }
+
+    // Markup other than tags.
+    var delimited = [
+      ['<!--', '-->', 'comment'],
+      ['<![CDATA[', ']]>', 'cdata'],
+      ['<?', html ? '>' : '?>', html ? 'comment' : 'pi'],
+      ['<!', '>', 'doctype'],
+    ].find((d) => text.startsWith(d[0], i));
+    if (delimited) {
+      var start = i + delimited[0].length;
+      var close = delimited[1];
+      var type = delimited[2];
+      if (type === 'doctype') {
+        if (!/^doctype\s/i.test(text.slice(start, start + 8))) {
+          if (!html) {
+            if (partial('Malformed markup', text.length - start < 8)) break;
+          }
+          type = 'comment';  // A "bogus comment" in HTML.
+        } else if (!html) {
+          // Skip any internal subset (which may contain ">").
+          var bracket = text.indexOf('[', start);
+          var gt = text.indexOf('>', start);
+          if (bracket !== -1 && (gt === -1 || bracket < gt)) close = ']>';
+        }
+      }
+      end = text.indexOf(close, start);
+      if (end === -1) {
+        if (partial('Unterminated ' + type, true)) break;
+        end = text.length;
+      }
+      // Keep the "]" closing an internal subset.
+      if (close === ']>') end++;
+      var token = {type: type, text: text.slice(start, end)};
+      if (type === 'pi') {
+        m = token.text.match(/^(\S+)\s*([\s\S]*)$/);
+        token = {type: type, name: m ? m[1] : '', text: m ? m[2] : ''};
+      } else if (type === 'doctype') {
+        token.text = token.text.slice(8).trim();
+      }
+      tokens.push(token);
+      i = Math.min(end + (close === ']>' ? 1 : close.length), text.length);
+      continue;
+    }
+
+    // End tags.
+    if (text[i + 1] === '/') {
+      var re = html ? Xml.HTML_END_RE_ : Xml.END_RE_;
+      re.lastIndex = i;
+      m = re.exec(text);
+      if (!m) {
+        if (partial('Malformed end tag')) break;
+        pushText('<');
+        i++;
+        continue;
+      }
+      var name = html ? m[1].toLowerCase() : m[1];
+      if (html) {
+        var index = open.lastIndexOf(name);
+        if (index !== -1) open.length = index;
+      } else if (top !== name) {
+        throw new SyntaxError('Unexpected end tag </' + name + '>' +
+            (top ? ', expected </' + top + '>' : ''));
+      } else {
+        open.pop();
+      }
+      tokens.push({type: 'end', name: name});
+      i = re.lastIndex;
+      continue;
+    }
+
+    // Start tags.
+    re = html ? Xml.HTML_START_RE_ : Xml.START_RE_;
+    re.lastIndex = i;
+    m = re.exec(text);
+    var attrs = Object.create(null);
+    var closed = null;
+    if (m) {
+      name = html ? m[1].toLowerCase() : m[1];
+      var attrRe = html ? Xml.HTML_ATTR_RE_ : Xml.ATTR_RE_;
+      var j = re.lastIndex;
+      for (;;) {
+        attrRe.lastIndex = j;
+        var a = attrRe.exec(text);
+        if (!a) break;
+        j = attrRe.lastIndex;
+        if (html ? a[5] : a[4]) {
+          closed = html ? text[j - 2] === '/' : a[4] === '/>';
+          break;
+        }
+        var attrName = html ? a[1].toLowerCase() : a[1];
+        var value = (a[2] !== undefined) ? a[2] :
+            (a[3] !== undefined) ? a[3] : (a[4] !== undefined) ? a[4] : '';
+        if (attrName in attrs) {
+          if (!html) throw new SyntaxError('Duplicate attribute ' + attrName);
+          continue;
+        }
+        attrs[attrName] = html ? Html.decode(value) :
+            Xml.decode_(value.replace(/[\t\n\r]/g, ' '));
+      }
+    }
+    if (closed === null) {
+      if (partial(m ? 'Malformed start tag <' + name + '>' : 'Unexpected <')) {
+        break;
+      }
+      pushText('<');
+      i++;
+      continue;
+    }
+    if (html) {
+      var implied = Html.IMPLIED_END[name];
+      while (implied && implied.includes(open[open.length - 1])) open.pop();
+    }
+    tokens.push({type: 'start', name: name, attrs: attrs,
+                 selfClosing: closed});
+    if (!closed && !(html && Html.VOID_ELEMENTS.includes(name))) {
+      if (open.length >= Xml.MAX_DEPTH) {
+        throw new RangeError('Elements nested too deeply');
+      }
+      open.push(name);
+    }
+    i = j;
+  }
+  if (final && !html && open.length) {
+    throw new SyntaxError('Unclosed element <' + open[open.length - 1] + '>');
+  }
+  return {tokens: tokens, rest: rest, open: open};
+};
+
+module.exports = Xml;
@@ -421,9 +421,17 @@ Code.Editor.receiveXhr = function() {
     }
   }
 
-  // If there's a message, show it in the butter.
+  // If there's a message, show it in the butter, with any warnings.
   if (data.butter) {
-    Code.Editor.showButter(data.butter, 5000);
+    var warnings = (data.warnings || []).map(function(warning) {
+      return 'Line ' + warning.line + ': ' + warning.message;
+    });
+    if (warnings.length) {
+      Code.Editor.showButter(data.butter + ' \u2014 ' + warnings.join('; '),
+                             10000);
+    } else {
+      Code.Editor.showButter(data.butter, 5000);
+    }
   }
 
   Code.Editor.ready && Code.Editor.ready();